@@ -18,24 +18,42 @@ import "reflect"
 
 const batchSize = 1024 * 1024
 
+// Array is an append-only array stored in preallocated chunks, so that growing the array never copies elements.
 type Array[T any] struct {
 	Data [][]T
+	// ChunkSize is the number of elements in a chunk. It must be set before the first element is appended. The
+	// default chunk size is used if it is zero.
+	ChunkSize int
+}
+
+// NewArray creates an array of chunks of given size.
+func NewArray[T any](chunkSize int) Array[T] {
+	return Array[T]{ChunkSize: chunkSize}
+}
+
+func (a *Array[T]) chunkSize() int {
+	if a.ChunkSize > 0 {
+		return a.ChunkSize
+	}
+	return batchSize
 }
 
 func (a *Array[T]) Len() int {
 	if len(a.Data) == 0 {
 		return 0
 	}
-	return len(a.Data)*batchSize - batchSize + len(a.Data[len(a.Data)-1])
+	chunkSize := a.chunkSize()
+	return len(a.Data)*chunkSize - chunkSize + len(a.Data[len(a.Data)-1])
 }
 
 func (a *Array[T]) Get(index int) T {
-	return a.Data[index/batchSize][index%batchSize]
+	chunkSize := a.chunkSize()
+	return a.Data[index/chunkSize][index%chunkSize]
 }
 
 func (a *Array[T]) Append(val T) {
-	if len(a.Data) == 0 || len(a.Data[len(a.Data)-1]) == batchSize {
-		a.Data = append(a.Data, make([]T, 0, batchSize))
+	if len(a.Data) == 0 || len(a.Data[len(a.Data)-1]) == a.chunkSize() {
+		a.Data = append(a.Data, make([]T, 0, a.chunkSize()))
 	}
 	a.Data[len(a.Data)-1] = append(a.Data[len(a.Data)-1], val)
 }
@@ -48,7 +66,7 @@ func (a *Array[T]) Bytes() int {
 	bytes := reflect.TypeOf(a).Elem().Size()
 	if len(a.Data) > 0 {
 		bytes += reflect.TypeOf(a.Data).Elem().Size() * uintptr(cap(a.Data))
-		bytes += reflect.TypeOf(a.Data).Elem().Elem().Size() * uintptr(len(a.Data)) * batchSize
+		bytes += reflect.TypeOf(a.Data).Elem().Elem().Size() * uintptr(len(a.Data)*a.chunkSize())
 	}
 	return int(bytes)
 }
@@ -15,5 +15,19 @@ func TestArray(t *testing.T) {
 	for i := 0; i < 123; i++ {
 		assert.Equal(t, int32(i), a.Get(i))
 	}
-	assert.Equal(t, 48+4*batchSize, a.Bytes())
+	assert.Equal(t, 56+4*batchSize, a.Bytes())
+}
+
+func TestArray_ChunkSize(t *testing.T) {
+	a := NewArray[int32](10)
+	for i := 0; i < 123; i++ {
+		a.Append(int32(i))
+	}
+	assert.Equal(t, 123, a.Len())
+	assert.Len(t, a.Data, 13)
+	for i := 0; i < 123; i++ {
+		assert.Equal(t, int32(i), a.Get(i))
+	}
+	// struct + 13 slices (capacity 16) + 13 chunks
+	assert.Equal(t, 32+24*16+4*10*13, a.Bytes())
 }
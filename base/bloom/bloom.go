@@ -0,0 +1,129 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/bits"
+
+	"github.com/juju/errors"
+)
+
+// BloomFilter tests whether an element is in a set in bounded memory. Elements in the set are always found, while
+// elements not in the set are found by false positives at a rate growing with the number of added elements.
+type BloomFilter struct {
+	numHashes uint8
+	count     uint32
+	words     []uint64
+}
+
+// New creates an empty filter of at least numBits bits with numHashes hash functions. The number of bits is rounded
+// up to a multiple of 64.
+func New(numBits int, numHashes uint8) *BloomFilter {
+	if numBits <= 0 || numHashes == 0 {
+		panic("size of Bloom filter must be positive")
+	}
+	return &BloomFilter{numHashes: numHashes, words: make([]uint64, (numBits+63)/64)}
+}
+
+// Add adds an element to the filter.
+func (f *BloomFilter) Add(element string) {
+	h1, h2 := f.hash(element)
+	numBits := uint64(len(f.words)) * 64
+	for i := uint64(0); i < uint64(f.numHashes); i++ {
+		index := (h1 + i*h2) % numBits
+		f.words[index/64] |= 1 << (index % 64)
+	}
+	f.count++
+}
+
+// Has returns true if the element might be in the set, or false if the element is definitely not in the set.
+func (f *BloomFilter) Has(element string) bool {
+	h1, h2 := f.hash(element)
+	numBits := uint64(len(f.words)) * 64
+	for i := uint64(0); i < uint64(f.numHashes); i++ {
+		index := (h1 + i*h2) % numBits
+		if f.words[index/64]&(1<<(index%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of added elements. Elements added more than once are counted repeatedly.
+func (f *BloomFilter) Count() int {
+	return int(f.count)
+}
+
+// FalsePositiveRate estimates the false positive rate from the fraction of set bits.
+func (f *BloomFilter) FalsePositiveRate() float64 {
+	var setBits int
+	for _, word := range f.words {
+		setBits += bits.OnesCount64(word)
+	}
+	return math.Pow(float64(setBits)/float64(len(f.words)*64), float64(f.numHashes))
+}
+
+// String encodes the filter in base64, which is stored in cache stores as strings.
+func (f *BloomFilter) String() string {
+	buf := make([]byte, 5+8*len(f.words))
+	buf[0] = f.numHashes
+	binary.BigEndian.PutUint32(buf[1:], f.count)
+	for i, word := range f.words {
+		binary.BigEndian.PutUint64(buf[5+8*i:], word)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// Parse decodes a filter encoded by String.
+func Parse(s string) (*BloomFilter, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(buf) <= 5 || buf[0] == 0 || (len(buf)-5)%8 != 0 {
+		return nil, errors.NotValidf("Bloom filter")
+	}
+	f := &BloomFilter{
+		numHashes: buf[0],
+		count:     binary.BigEndian.Uint32(buf[1:]),
+		words:     make([]uint64, (len(buf)-5)/8),
+	}
+	for i := range f.words {
+		f.words[i] = binary.BigEndian.Uint64(buf[5+8*i:])
+	}
+	return f, nil
+}
+
+// hash returns two hashes of an element for double hashing. The second hash is odd so that probes don't repeat.
+func (f *BloomFilter) hash(element string) (uint64, uint64) {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(element))
+	x := mix64(hash.Sum64())
+	return x >> 32, x&0xffffffff | 1
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads bits of FNV hashes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,58 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter_Has(t *testing.T) {
+	f := New(10000, 7)
+	assert.Zero(t, f.FalsePositiveRate())
+	for i := 0; i < 1000; i++ {
+		f.Add(strconv.Itoa(i))
+	}
+	assert.Equal(t, 1000, f.Count())
+	// no false negatives
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.Has(strconv.Itoa(i)))
+	}
+	// false positives at about 1% with 10 bits per element
+	var falsePositives int
+	for i := 1000; i < 101000; i++ {
+		if f.Has(strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	assert.InDelta(t, 0.01, float64(falsePositives)/100000, 0.005)
+	assert.InDelta(t, 0.01, f.FalsePositiveRate(), 0.005)
+}
+
+func TestBloomFilter_String(t *testing.T) {
+	f := New(100, 3)
+	for i := 0; i < 10; i++ {
+		f.Add(strconv.Itoa(i))
+	}
+	parsed, err := Parse(f.String())
+	assert.NoError(t, err)
+	assert.Equal(t, f, parsed)
+	_, err = Parse("!")
+	assert.Error(t, err)
+	_, err = Parse("")
+	assert.Error(t, err)
+}
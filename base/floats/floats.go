@@ -14,11 +14,20 @@
 
 package floats
 
-func dot(a, b []float32) (ret float32) {
-	for i := range a {
-		ret += a[i] * b[i]
-	}
-	return
+func dot(a, b []float32) float32 {
+	// unroll the loop to break the dependency chain of additions
+	var s0, s1, s2, s3 float32
+	n := len(a) &^ 3
+	for i := 0; i < n; i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for i := n; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return (s0 + s1) + (s2 + s3)
 }
 
 func mulTo(a, b, c []float32) {
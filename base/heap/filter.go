@@ -14,38 +14,85 @@
 
 package heap
 
-import (
-	"container/heap"
-	"golang.org/x/exp/constraints"
-)
+import "golang.org/x/exp/constraints"
 
-// TopKFilter filters out top k items with maximum weights.
-type TopKFilter[T any, W constraints.Ordered] struct {
-	_heap[T, W]
-	k int
+// TopKFilter filters out top k items with maximum weights. It keeps a bounded min-heap of k items, so that selecting
+// top k items from n items costs O(n log k) instead of sorting all items. Ties of weights are broken by items in
+// ascending order, which makes the result independent of the order of pushes.
+type TopKFilter[T constraints.Ordered, W constraints.Ordered] struct {
+	elems []Elem[T, W]
+	k     int
 }
 
 // NewTopKFilter creates a top k filter.
-func NewTopKFilter[T any, W constraints.Ordered](k int) *TopKFilter[T, W] {
+func NewTopKFilter[T constraints.Ordered, W constraints.Ordered](k int) *TopKFilter[T, W] {
 	return &TopKFilter[T, W]{k: k}
 }
 
+// worse returns true if a is ranked after b.
+func worse[T constraints.Ordered, W constraints.Ordered](a, b Elem[T, W]) bool {
+	if a.Weight != b.Weight {
+		return a.Weight < b.Weight
+	}
+	return a.Value > b.Value
+}
+
+// Len returns the number of items in the filter.
+func (filter *TopKFilter[T, W]) Len() int {
+	return len(filter.elems)
+}
+
 // Push pushes the element x onto the heap.
-// The complexity is O(log n) where n = h.Count().
+// The complexity is O(log k).
 func (filter *TopKFilter[T, W]) Push(item T, weight W) {
-	heap.Push(&filter._heap, Elem[T, W]{item, weight})
-	if filter.Len() > filter.k {
-		heap.Pop(&filter._heap)
+	elem := Elem[T, W]{item, weight}
+	if len(filter.elems) < filter.k {
+		filter.elems = append(filter.elems, elem)
+		filter.up(len(filter.elems) - 1)
+	} else if filter.k > 0 && worse(filter.elems[0], elem) {
+		// replace the worst item
+		filter.elems[0] = elem
+		filter.down(0, len(filter.elems))
 	}
 }
 
 // PopAll pops all items in the filter with decreasing order.
 func (filter *TopKFilter[T, W]) PopAll() ([]T, []W) {
-	items := make([]T, filter.Len())
-	weights := make([]W, filter.Len())
-	for i := len(items) - 1; i >= 0; i-- {
-		elem := heap.Pop(&filter._heap).(Elem[T, W])
-		items[i], weights[i] = elem.Value, elem.Weight
+	items := make([]T, len(filter.elems))
+	weights := make([]W, len(filter.elems))
+	for n := len(filter.elems) - 1; n >= 0; n-- {
+		items[n], weights[n] = filter.elems[0].Value, filter.elems[0].Weight
+		filter.elems[0] = filter.elems[n]
+		filter.down(0, n)
 	}
+	filter.elems = filter.elems[:0]
 	return items, weights
 }
+
+func (filter *TopKFilter[T, W]) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !worse(filter.elems[i], filter.elems[parent]) {
+			break
+		}
+		filter.elems[i], filter.elems[parent] = filter.elems[parent], filter.elems[i]
+		i = parent
+	}
+}
+
+func (filter *TopKFilter[T, W]) down(i, n int) {
+	for {
+		child := 2*i + 1
+		if child >= n {
+			break
+		}
+		if right := child + 1; right < n && worse(filter.elems[right], filter.elems[child]) {
+			child = right
+		}
+		if !worse(filter.elems[child], filter.elems[i]) {
+			break
+		}
+		filter.elems[i], filter.elems[child] = filter.elems[child], filter.elems[i]
+		i = child
+	}
+}
@@ -15,7 +15,10 @@ package heap
 
 import (
 	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
 	"testing"
+	"testing/quick"
 )
 
 func TestTopKFilter(t *testing.T) {
@@ -65,3 +68,101 @@ func TestTopKStringFilter(t *testing.T) {
 	assert.Equal(t, []string{"12", "32", "20"}, elem)
 	assert.Equal(t, []float64{10, 9, 8}, scores)
 }
+
+// naiveTopK selects top k items by sorting all items.
+func naiveTopK(items []int32, weights []uint8, k int) ([]int32, []uint8) {
+	elems := make([]Elem[int32, uint8], len(items))
+	for i := range items {
+		elems[i] = Elem[int32, uint8]{items[i], weights[i]}
+	}
+	sort.Slice(elems, func(i, j int) bool {
+		if elems[i].Weight != elems[j].Weight {
+			return elems[i].Weight > elems[j].Weight
+		}
+		return elems[i].Value < elems[j].Value
+	})
+	if len(elems) > k {
+		elems = elems[:k]
+	}
+	topItems := make([]int32, len(elems))
+	topWeights := make([]uint8, len(elems))
+	for i, elem := range elems {
+		topItems[i], topWeights[i] = elem.Value, elem.Weight
+	}
+	return topItems, topWeights
+}
+
+func TestTopKFilter_Property(t *testing.T) {
+	// small weights produce lots of ties
+	err := quick.Check(func(weights []uint8, k uint8) bool {
+		items := rand.Perm(len(weights))
+		filter := NewTopKFilter[int32, uint8](int(k))
+		values := make([]int32, len(weights))
+		for i := range weights {
+			values[i] = int32(items[i])
+			filter.Push(values[i], weights[i])
+		}
+		expectedItems, expectedWeights := naiveTopK(values, weights, int(k))
+		actualItems, actualWeights := filter.PopAll()
+		return assert.ObjectsAreEqual(expectedItems, actualItems) && assert.ObjectsAreEqual(expectedWeights, actualWeights)
+	}, &quick.Config{MaxCount: 1000})
+	assert.NoError(t, err)
+}
+
+func TestTopKFilter_Tie(t *testing.T) {
+	// results are independent of the order of pushes
+	a := NewTopKFilter[string, float64](2)
+	a.Push("3", 1)
+	a.Push("2", 1)
+	a.Push("1", 1)
+	b := NewTopKFilter[string, float64](2)
+	b.Push("1", 1)
+	b.Push("3", 1)
+	b.Push("2", 1)
+	elemA, _ := a.PopAll()
+	elemB, _ := b.PopAll()
+	assert.Equal(t, []string{"1", "2"}, elemA)
+	assert.Equal(t, []string{"1", "2"}, elemB)
+	// empty filter
+	c := NewTopKFilter[string, float64](0)
+	c.Push("1", 1)
+	elemC, _ := c.PopAll()
+	assert.Empty(t, elemC)
+}
+
+const benchNumScores = 10000000
+
+func benchScores() []float32 {
+	rng := rand.New(rand.NewSource(0))
+	scores := make([]float32, benchNumScores)
+	for i := range scores {
+		scores[i] = rng.Float32()
+	}
+	return scores
+}
+
+func BenchmarkTopKFilter(b *testing.B) {
+	scores := benchScores()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		filter := NewTopKFilter[int32, float32](100)
+		for i, score := range scores {
+			filter.Push(int32(i), score)
+		}
+		filter.PopAll()
+	}
+}
+
+func BenchmarkSort(b *testing.B) {
+	scores := benchScores()
+	elems := make([]Elem[int32, float32], len(scores))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i, score := range scores {
+			elems[i] = Elem[int32, float32]{int32(i), score}
+		}
+		sort.Slice(elems, func(i, j int) bool {
+			return elems[i].Weight > elems[j].Weight
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hll
+
+import (
+	"encoding/base64"
+	"hash/fnv"
+	"math"
+	"math/bits"
+
+	"github.com/juju/errors"
+)
+
+const (
+	MinPrecision = 4
+	MaxPrecision = 18
+)
+
+// HyperLogLog estimates the number of distinct elements in bounded memory. A sketch of precision p keeps 2^p
+// registers, and the relative standard error of estimates is 1.04/sqrt(2^p). Sketches of the same precision are merged
+// by taking the maximum of registers, so that a sketch of a window is merged from sketches of days.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// New creates an empty sketch of a precision between MinPrecision and MaxPrecision.
+func New(precision uint8) *HyperLogLog {
+	if precision < MinPrecision || precision > MaxPrecision {
+		panic("precision of HyperLogLog out of range")
+	}
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+// Add adds an element to the sketch.
+func (h *HyperLogLog) Add(element string) {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(element))
+	x := mix64(hash.Sum64())
+	index := x >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge merges another sketch of the same precision into the sketch.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.precision != other.precision {
+		return errors.NotValidf("merge HyperLogLog of precision %d into precision %d", other.precision, h.precision)
+	}
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+	return nil
+}
+
+// Count returns the estimated number of distinct elements. Linear counting is used for small cardinalities.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// RelativeError returns the relative standard error of estimates.
+func (h *HyperLogLog) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(len(h.registers)))
+}
+
+// String encodes the sketch in base64, which is stored in cache stores as strings.
+func (h *HyperLogLog) String() string {
+	return base64.StdEncoding.EncodeToString(append([]byte{h.precision}, h.registers...))
+}
+
+// Parse decodes a sketch encoded by String.
+func Parse(s string) (*HyperLogLog, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(buf) == 0 || buf[0] < MinPrecision || buf[0] > MaxPrecision || len(buf) != 1+1<<buf[0] {
+		return nil, errors.NotValidf("HyperLogLog")
+	}
+	return &HyperLogLog{precision: buf[0], registers: buf[1:]}, nil
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads bits of FNV hashes.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hll
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLog_Count(t *testing.T) {
+	h := New(14)
+	assert.Zero(t, h.Count())
+	// small cardinalities
+	for i := 0; i < 100; i++ {
+		h.Add(strconv.Itoa(i))
+		h.Add(strconv.Itoa(i))
+	}
+	assert.InDelta(t, 100, h.Count(), 2)
+	// large cardinalities
+	for i := 0; i < 100000; i++ {
+		h.Add(strconv.Itoa(i))
+	}
+	assert.InDelta(t, 100000, h.Count(), 100000*3*h.RelativeError())
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	a, b := New(12), New(12)
+	for i := 0; i < 1000; i++ {
+		a.Add(strconv.Itoa(i))
+		b.Add(strconv.Itoa(i + 500))
+	}
+	assert.NoError(t, a.Merge(b))
+	assert.InDelta(t, 1500, a.Count(), 1500*3*a.RelativeError())
+	assert.Error(t, a.Merge(New(10)))
+}
+
+func TestHyperLogLog_String(t *testing.T) {
+	h := New(10)
+	for i := 0; i < 100; i++ {
+		h.Add(strconv.Itoa(i))
+	}
+	parsed, err := Parse(h.String())
+	assert.NoError(t, err)
+	assert.Equal(t, h, parsed)
+	_, err = Parse("!")
+	assert.Error(t, err)
+	_, err = Parse("")
+	assert.Error(t, err)
+}
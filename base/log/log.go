@@ -22,9 +22,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
-var logger *zap.Logger
+var (
+	logger           *zap.Logger
+	userIdObfuscator atomic.Value
+)
 
 func init() {
 	SetProductionLogger()
@@ -35,6 +39,19 @@ func Logger() *zap.Logger {
 	return logger
 }
 
+// SetUserIdObfuscator sets the function to replace user ids in logs. User ids are logged as they are if it is nil.
+func SetUserIdObfuscator(obfuscate func(userId string) string) {
+	userIdObfuscator.Store(obfuscate)
+}
+
+// UserId returns the log field of a user id, which is obfuscated if an obfuscator is set.
+func UserId(userId string) zap.Field {
+	if obfuscate, _ := userIdObfuscator.Load().(func(string) string); obfuscate != nil {
+		userId = obfuscate(userId)
+	}
+	return zap.String("user_id", userId)
+}
+
 func ResponseLogger(resp *restful.Response) *zap.Logger {
 	return logger.With(zap.String("request_id", resp.Header().Get("X-Request-ID")))
 }
@@ -50,11 +50,13 @@ func (rng RandomGenerator) NewNormalVector(size int, mean, stdDev float32) []flo
 	return ret
 }
 
-// NormalMatrix makes a matrix filled with normal random floats.
+// NormalMatrix makes a matrix filled with normal random floats. Rows are stored contiguously like NewMatrix32.
 func (rng RandomGenerator) NormalMatrix(row, col int, mean, stdDev float32) [][]float32 {
-	ret := make([][]float32, row)
+	ret := NewMatrix32(row, col)
 	for i := range ret {
-		ret[i] = rng.NewNormalVector(col, mean, stdDev)
+		for j := range ret[i] {
+			ret[i][j] = float32(rng.NormFloat64())*stdDev + mean
+		}
 	}
 	return ret
 }
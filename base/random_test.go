@@ -29,6 +29,11 @@ func TestRandomGenerator_MakeNormalMatrix(t *testing.T) {
 	vec := rng.NormalMatrix(1, 1000, 1, 2)[0]
 	assert.False(t, math32.Abs(mean(vec)-1) > randomEpsilon)
 	assert.False(t, math32.Abs(stdDev(vec)-2) > randomEpsilon)
+	// rows never overlap
+	m := rng.NormalMatrix(2, 4, 1, 2)
+	row := append([]float32(nil), m[1]...)
+	m[0] = append(m[0], 0)
+	assert.Equal(t, row, m[1])
 }
 
 func TestRandomGenerator_MakeUniformMatrix(t *testing.T) {
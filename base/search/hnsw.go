@@ -25,6 +25,7 @@ import (
 	"go.uber.org/zap"
 	"math/rand"
 	"modernc.org/mathutil"
+	"reflect"
 	"runtime"
 	"sync"
 	"time"
@@ -106,6 +107,19 @@ func (h *HNSW) Search(q Vector, n int, prune0 bool) (values []int32, scores []fl
 	return
 }
 
+// Bytes returns the estimated memory usage of connections in the bottom layer. Vectors are owned by the caller and
+// connections in upper layers are omitted.
+func (h *HNSW) Bytes() int {
+	bytes := reflect.TypeOf(h).Elem().Size()
+	connectionSize := reflect.TypeOf(heap.Elem[int32, float32]{}).Size() + reflect.TypeOf(int32(0)).Size()
+	for _, neighbors := range h.bottomNeighbors {
+		if neighbors != nil {
+			bytes += connectionSize * uintptr(neighbors.Len())
+		}
+	}
+	return int(bytes)
+}
+
 func (h *HNSW) knnSearch(q Vector, k, ef int) *heap.PriorityQueue {
 	var (
 		w           *heap.PriorityQueue                    // set for the current the nearest element
@@ -31,3 +31,18 @@ func TestHNSWConfig(t *testing.T) {
 	SetEFConstruction(345)(hnsw)
 	assert.Equal(t, 345, hnsw.efConstruction)
 }
+
+func TestHNSW_Bytes(t *testing.T) {
+	vectors := make([]Vector, 100)
+	for i := range vectors {
+		data := make([]float32, 16)
+		for j := range data {
+			data[j] = float32((i + j) % 10)
+		}
+		vectors[i] = NewDenseVector(data, nil, false)
+	}
+	hnsw := NewHNSW(vectors, SetHNSWNumJobs(1))
+	empty := hnsw.Bytes()
+	hnsw.Build()
+	assert.Greater(t, hnsw.Bytes(), empty)
+}
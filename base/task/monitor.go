@@ -15,6 +15,8 @@
 package task
 
 import (
+	"context"
+	"github.com/juju/errors"
 	"github.com/scylladb/go-set/strset"
 	"sort"
 	"strings"
@@ -30,20 +32,30 @@ const (
 	StatusRunning   Status = "Running"
 	StatusSuspended Status = "Suspended"
 	StatusFailed    Status = "Failed"
+	StatusCancelled Status = "Cancelled"
 )
 
-// Task progress information.
+// Task progress information. Progress is the percentage of completion.
 type Task struct {
 	Name       string
 	Status     Status
 	Done       int
 	Total      int
+	Progress   float64
 	StartTime  time.Time
 	FinishTime time.Time
 	Error      string
+	// Details is the result of the latest run reported by the task, such as discrepancies found by verification.
+	Details interface{} `json:",omitempty"`
+
+	ctx context.Context
+	// cancel is referenced by pointer, so that copies of the task listed by the monitor are still comparable.
+	cancel *context.CancelFunc
+	onDone func(Task)
 }
 
 func NewTask(name string, total int) *Task {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Task{
 		Name:       name,
 		Status:     StatusRunning,
@@ -51,31 +63,69 @@ func NewTask(name string, total int) *Task {
 		Total:      total,
 		StartTime:  time.Now(),
 		FinishTime: time.Time{},
+		ctx:        ctx,
+		cancel:     &cancel,
+	}
+}
+
+// Progress returns the percentage of completion.
+func Progress(done, total int) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return 100 * float64(done) / float64(total)
+}
+
+// Context is cancelled once the task is cancelled. Task loops should check it between batches.
+func (t *Task) Context() context.Context {
+	if t == nil || t.ctx == nil {
+		return context.Background()
 	}
+	return t.ctx
+}
+
+// Cancelled returns true if the task has been cancelled.
+func (t *Task) Cancelled() bool {
+	return t.Context().Err() != nil
 }
 
 func (t *Task) Update(done int) {
-	t.Done = done
-	t.Status = StatusRunning
+	if t != nil {
+		t.Done = done
+		t.running()
+	}
 }
 
 func (t *Task) Add(done int) {
 	if t != nil {
-		t.Status = StatusRunning
 		t.Done += done
+		t.running()
 	}
 }
 
+// running marks the task running unless it has been cancelled, and updates the progress.
+func (t *Task) running() {
+	if t.Status != StatusCancelled {
+		t.Status = StatusRunning
+	}
+	t.Progress = Progress(t.Done, t.Total)
+}
+
 func (t *Task) Finish() {
-	if t != nil {
+	if t != nil && t.Status != StatusCancelled {
+		completed := t.Status == StatusComplete
 		t.Status = StatusComplete
 		t.Done = t.Total
+		t.Progress = Progress(t.Done, t.Total)
 		t.FinishTime = time.Now()
+		if !completed && t.onDone != nil {
+			t.onDone(*t)
+		}
 	}
 }
 
 func (t *Task) Suspend(flag bool) {
-	if t != nil {
+	if t != nil && t.Status != StatusCancelled {
 		if flag {
 			t.Status = StatusSuspended
 		} else {
@@ -85,9 +135,24 @@ func (t *Task) Suspend(flag bool) {
 }
 
 func (t *Task) Fail(err string) {
-	if t != nil {
+	if t != nil && t.Status != StatusCancelled {
+		failed := t.Status == StatusFailed
 		t.Error = err
 		t.Status = StatusFailed
+		if !failed && t.onDone != nil {
+			t.onDone(*t)
+		}
+	}
+}
+
+// Cancel marks the task cancelled and cancels its context.
+func (t *Task) Cancel() {
+	if t != nil {
+		t.Status = StatusCancelled
+		t.FinishTime = time.Now()
+		if t.cancel != nil {
+			(*t.cancel)()
+		}
 	}
 }
 
@@ -124,6 +189,9 @@ func (t *SubTask) Finish() {
 type Monitor struct {
 	TaskLock sync.Mutex
 	Tasks    map[string]*Task
+	// OnDone is called once a task started by the monitor completes or fails. It might be called with TaskLock held,
+	// so it must not call the monitor.
+	OnDone func(Task)
 }
 
 // NewTaskMonitor creates a Monitor and add pending tasks.
@@ -146,6 +214,7 @@ func (tm *Monitor) Pending(name string) {
 	tm.Tasks[name] = &Task{
 		Name:   name,
 		Status: StatusPending,
+		onDone: tm.OnDone,
 	}
 }
 
@@ -154,6 +223,7 @@ func (tm *Monitor) Start(name string, total int) *Task {
 	tm.TaskLock.Lock()
 	defer tm.TaskLock.Unlock()
 	t := NewTask(name, total)
+	t.onDone = tm.OnDone
 	tm.Tasks[name] = t
 	return t
 }
@@ -189,12 +259,36 @@ func (tm *Monitor) Suspend(name string, flag bool) {
 	tm.Tasks[name].Suspend(flag)
 }
 
+// SetDetails sets the result of the latest run of a task. Details should not be modified after set.
+func (tm *Monitor) SetDetails(name string, details interface{}) {
+	tm.TaskLock.Lock()
+	defer tm.TaskLock.Unlock()
+	if t, exist := tm.Tasks[name]; exist {
+		t.Details = details
+	}
+}
+
 func (tm *Monitor) Fail(name, err string) {
 	tm.TaskLock.Lock()
 	defer tm.TaskLock.Unlock()
 	tm.Tasks[name].Fail(err)
 }
 
+// Cancel a running or suspended task.
+func (tm *Monitor) Cancel(name string) error {
+	tm.TaskLock.Lock()
+	defer tm.TaskLock.Unlock()
+	t, exist := tm.Tasks[name]
+	if !exist {
+		return errors.NotFoundf("task %v", name)
+	}
+	if t.Status != StatusRunning && t.Status != StatusSuspended {
+		return errors.NotValidf("cancel %v task %v", t.Status, name)
+	}
+	t.Cancel()
+	return nil
+}
+
 // List all tasks and remove tasks from disconnected workers.
 func (tm *Monitor) List(workers ...string) []Task {
 	tm.TaskLock.Lock()
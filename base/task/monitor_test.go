@@ -15,6 +15,7 @@
 package task
 
 import (
+	"github.com/juju/errors"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -85,3 +86,54 @@ func TestSubTask(t *testing.T) {
 	s.Finish()
 	assert.Equal(t, 90, task.Done)
 }
+
+func TestTaskMonitor_Cancel(t *testing.T) {
+	taskMonitor := NewTaskMonitor()
+	task := taskMonitor.Start("a", 100)
+	task.Add(40)
+	assert.Equal(t, 40.0, task.Progress)
+	assert.NoError(t, taskMonitor.Cancel("a"))
+	assert.True(t, task.Cancelled())
+	assert.Error(t, task.Context().Err())
+	// cancelled tasks are not overwritten by later updates
+	task.Add(10)
+	task.Finish()
+	assert.Equal(t, StatusCancelled, taskMonitor.GetTask("a").Status)
+	assert.True(t, errors.Is(taskMonitor.Cancel("a"), errors.NotValid))
+	assert.True(t, errors.Is(taskMonitor.Cancel("b"), errors.NotFound))
+	taskMonitor.Start("c", 100)
+	taskMonitor.Finish("c")
+	assert.True(t, errors.Is(taskMonitor.Cancel("c"), errors.NotValid))
+}
+
+func TestTaskMonitor_OnDone(t *testing.T) {
+	var tasks []Task
+	taskMonitor := NewTaskMonitor()
+	taskMonitor.OnDone = func(task Task) {
+		tasks = append(tasks, task)
+	}
+	taskMonitor.Pending("a")
+	taskMonitor.Fail("a", "error")
+	taskMonitor.Fail("a", "error")
+	taskMonitor.Start("b", 10)
+	taskMonitor.Finish("b")
+	taskMonitor.Finish("b")
+	taskMonitor.Start("c", 10)
+	assert.NoError(t, taskMonitor.Cancel("c"))
+	taskMonitor.Finish("c")
+	assert.Equal(t, []string{"a", "b"}, lo.Map(tasks, func(task Task, _ int) string {
+		return task.Name
+	}))
+	assert.Equal(t, StatusFailed, tasks[0].Status)
+	assert.Equal(t, StatusComplete, tasks[1].Status)
+}
+
+func TestTaskMonitor_SetDetails(t *testing.T) {
+	taskMonitor := NewTaskMonitor()
+	taskMonitor.SetDetails("a", "ignored")
+	assert.Nil(t, taskMonitor.GetTask("a"))
+	taskMonitor.Start("a", 10)
+	taskMonitor.SetDetails("a", map[string]int{"n": 1})
+	taskMonitor.Finish("a")
+	assert.Equal(t, map[string]int{"n": 1}, taskMonitor.List()[0].Details)
+}
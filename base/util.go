@@ -17,6 +17,9 @@ package base
 import (
 	"github.com/zhenghaoz/gorse/base/log"
 	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 // RangeInt generate a slice [0, ..., n-1].
@@ -37,11 +40,13 @@ func RepeatFloat32s(n int, value float32) []float32 {
 	return a
 }
 
-// NewMatrix32 creates a 2D matrix of 32-bit floats.
+// NewMatrix32 creates a 2D matrix of 32-bit floats. Rows are stored contiguously in one slice, so that scanning rows
+// in order is cache friendly.
 func NewMatrix32(row, col int) [][]float32 {
 	ret := make([][]float32, row)
+	data := make([]float32, row*col)
 	for i := range ret {
-		ret[i] = make([]float32, col)
+		ret[i] = data[i*col : (i+1)*col : (i+1)*col]
 	}
 	return ret
 }
@@ -61,3 +66,10 @@ func CheckPanic() {
 		log.Logger().Error("panic recovered", zap.Any("panic", r))
 	}
 }
+
+// NotifyShutdown relays SIGINT and SIGTERM to the returned channel.
+func NotifyShutdown() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return signals
+}
@@ -25,6 +25,9 @@ func TestNewMatrix32(t *testing.T) {
 	assert.Equal(t, 4, len(a[0]))
 	assert.Equal(t, 4, len(a[0]))
 	assert.Equal(t, 4, len(a[0]))
+	// rows never overlap
+	a[0] = append(a[0], 1)
+	assert.Equal(t, []float32{0, 0, 0, 0}, a[1])
 }
 
 func TestRangeInt(t *testing.T) {
@@ -0,0 +1,359 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench drives synthetic traffic against a gorse server to find the throughput a deployment could serve.
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/client"
+)
+
+// Operations of traffic.
+const (
+	OpRecommend      = "recommend"
+	OpInsertFeedback = "insert_feedback"
+	OpGetItem        = "get_item"
+	OpTotal          = "total"
+)
+
+// Config is the configuration of a benchmark. Nodes of distributed generation share the same config except the node
+// index. Target QPS is the total of all nodes, and each node sends an equal share of it.
+type Config struct {
+	// dataset
+	NumUsers        int
+	NumItems        int
+	NumCategories   int
+	FeedbackPerUser int
+	FeedbackType    string
+	ZipfExponent    float64 // exponent of the Zipf distribution of item popularity, greater than 1
+	Seed            int64   // shared by nodes of distributed generation
+	NumNodes        int
+	NodeIndex       int
+	BatchSize       int // number of rows inserted in a request while seeding
+
+	// traffic
+	RecommendRatio float64
+	InsertRatio    float64
+	GetItemRatio   float64
+	RecommendN     int
+	StartQPS       float64
+	StepQPS        float64
+	MaxQPS         float64
+	StepDuration   time.Duration
+	Concurrency    int // maximum number of in-flight requests of a node
+
+	// saturation
+	MaxErrorRate  float64       // a stage is saturated if the error rate exceeds it
+	MaxP99Latency time.Duration // a stage is saturated if the 99th percentile latency exceeds it
+}
+
+// DefaultConfig returns the default config of benchmarks.
+func DefaultConfig() Config {
+	return Config{
+		NumUsers:        10000,
+		NumItems:        10000,
+		NumCategories:   10,
+		FeedbackPerUser: 20,
+		FeedbackType:    "read",
+		ZipfExponent:    1.1,
+		NumNodes:        1,
+		BatchSize:       1000,
+		RecommendRatio:  0.7,
+		InsertRatio:     0.2,
+		GetItemRatio:    0.1,
+		RecommendN:      10,
+		StartQPS:        100,
+		StepQPS:         100,
+		MaxQPS:          1000,
+		StepDuration:    30 * time.Second,
+		Concurrency:     256,
+		MaxErrorRate:    0.01,
+		MaxP99Latency:   time.Second,
+	}
+}
+
+// Validate checks the config.
+func (config Config) Validate() error {
+	if config.NumUsers <= 0 || config.NumItems <= 1 || config.NumCategories <= 0 {
+		return errors.New("numbers of users, items and categories must be positive, and at least two items are required")
+	}
+	if config.ZipfExponent <= 1 {
+		return errors.New("exponent of the Zipf distribution must be greater than 1")
+	}
+	if config.NumNodes <= 0 || config.NodeIndex < 0 || config.NodeIndex >= config.NumNodes {
+		return errors.Errorf("node index must be in [0, %d)", config.NumNodes)
+	}
+	if config.RecommendRatio < 0 || config.InsertRatio < 0 || config.GetItemRatio < 0 ||
+		config.RecommendRatio+config.InsertRatio+config.GetItemRatio <= 0 {
+		return errors.New("ratios of operations must be non-negative and not all zero")
+	}
+	if config.StartQPS <= 0 || config.StepQPS <= 0 || config.MaxQPS < config.StartQPS {
+		return errors.New("QPS must be positive and the maximum QPS must not be less than the start QPS")
+	}
+	if config.StepDuration <= 0 || config.Concurrency <= 0 || config.BatchSize <= 0 {
+		return errors.New("step duration, concurrency and batch size must be positive")
+	}
+	return nil
+}
+
+// Seed inserts items, users and feedback of this node into the server. The progress callback receives the name and
+// the number of inserted rows after each batch.
+func Seed(c *client.GorseClient, dataset *Dataset, progress func(name string, n int)) error {
+	batchSize := dataset.config.BatchSize
+	if err := insertBatches("items", dataset.Items(), batchSize, c.InsertItems, progress); err != nil {
+		return errors.Trace(err)
+	}
+	if err := insertBatches("users", dataset.Users(), batchSize, c.InsertUsers, progress); err != nil {
+		return errors.Trace(err)
+	}
+	return insertBatches("feedback", dataset.Feedback(), batchSize, c.InsertFeedback, progress)
+}
+
+func insertBatches[T any](name string, rows []T, batchSize int, insert func([]T) (client.RowAffected, error),
+	progress func(name string, n int)) error {
+	for i := 0; i < len(rows); i += batchSize {
+		end := lo.Min([]int{i + batchSize, len(rows)})
+		if _, err := insert(rows[i:end]); err != nil {
+			return errors.Annotatef(err, "failed to insert %s", name)
+		}
+		progress(name, end)
+	}
+	return nil
+}
+
+// OperationReport summarizes requests of an operation in a stage. Latencies are in milliseconds.
+type OperationReport struct {
+	Operation string
+	Requests  int
+	Errors    int
+	ErrorRate float64
+	P50       float64
+	P95       float64
+	P99       float64
+}
+
+// StageReport summarizes a stage of the QPS schedule.
+type StageReport struct {
+	TargetQPS   float64
+	AchievedQPS float64 // total of all nodes assuming nodes achieve the same throughput
+	Duration    time.Duration
+	Retries     int
+	Saturated   bool
+	Operations  []OperationReport // the last one is the total
+}
+
+// Report is the result of a benchmark on a node.
+type Report struct {
+	Node          int
+	NumNodes      int
+	Seed          int64
+	Stages        []StageReport
+	SaturationQPS float64 // target QPS of the first saturated stage, 0 if the deployment is never saturated
+	SustainedQPS  float64 // target QPS of the last stage before saturation
+}
+
+// WriteTable writes operations of stages as a table, followed by the saturation point.
+func (r *Report) WriteTable(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "TARGET QPS\tACHIEVED QPS\tOPERATION\tREQUESTS\tERROR RATE\tP50 (MS)\tP95 (MS)\tP99 (MS)\tRETRIES\tSATURATED")
+	for _, stage := range r.Stages {
+		for _, op := range stage.Operations {
+			_, _ = fmt.Fprintf(table, "%.0f\t%.1f\t%s\t%d\t%.2f%%\t%.1f\t%.1f\t%.1f\t%d\t%v\n",
+				stage.TargetQPS, stage.AchievedQPS, op.Operation, op.Requests, op.ErrorRate*100,
+				op.P50, op.P95, op.P99, stage.Retries, stage.Saturated)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	var err error
+	if r.SaturationQPS > 0 {
+		_, err = fmt.Fprintf(w, "saturated at %.0f QPS, sustained %.0f QPS\n", r.SaturationQPS, r.SustainedQPS)
+	} else {
+		_, err = fmt.Fprintf(w, "not saturated, sustained %.0f QPS\n", r.SustainedQPS)
+	}
+	return errors.Trace(err)
+}
+
+// Run drives mixed traffic against the server by the ramping QPS schedule. The schedule stops at the first saturated
+// stage. A stage is saturated if the error rate or the 99th percentile latency exceeds the limit, or less than 90% of
+// the target QPS is achieved. The progress callback receives the report of each stage.
+func Run(c *client.GorseClient, dataset *Dataset, progress func(StageReport)) *Report {
+	config := dataset.config
+	var retries int64
+	c.ObserveRequests(func(metrics client.RequestMetrics) {
+		atomic.AddInt64(&retries, int64(metrics.Retries))
+	})
+	traffic := newTraffic(c, dataset)
+	report := &Report{Node: config.NodeIndex, NumNodes: config.NumNodes, Seed: config.Seed}
+	for qps := config.StartQPS; qps <= config.MaxQPS; qps += config.StepQPS {
+		retriesBefore := atomic.LoadInt64(&retries)
+		stage := traffic.runStage(qps, config.StepDuration)
+		stage.Retries = int(atomic.LoadInt64(&retries) - retriesBefore)
+		report.Stages = append(report.Stages, stage)
+		progress(stage)
+		if stage.Saturated {
+			report.SaturationQPS = qps
+			break
+		}
+		report.SustainedQPS = qps
+	}
+	return report
+}
+
+// sample is the outcome of a request.
+type sample struct {
+	operation string
+	latency   time.Duration
+	failed    bool
+}
+
+// traffic generates requests of a node. Requests are drawn from a random source seeded by the shared seed and the node
+// index, so that nodes send different requests reproducibly.
+type traffic struct {
+	client  *client.GorseClient
+	dataset *Dataset
+	rng     *rand.Rand
+	zipf    *rand.Zipf
+}
+
+func newTraffic(c *client.GorseClient, dataset *Dataset) *traffic {
+	rng := rand.New(rand.NewSource(dataset.config.Seed - int64(dataset.config.NodeIndex) - 1))
+	return &traffic{client: c, dataset: dataset, rng: rng, zipf: dataset.newZipf(rng)}
+}
+
+// next draws an operation by ratios and returns the request. Requests are drawn by the dispatcher only, since random
+// sources aren't safe for concurrent use.
+func (t *traffic) next() (string, func() error) {
+	config := t.dataset.config
+	x := t.rng.Float64() * (config.RecommendRatio + config.InsertRatio + config.GetItemRatio)
+	switch {
+	case x < config.RecommendRatio:
+		userId := t.dataset.randomUser(t.rng)
+		return OpRecommend, func() error {
+			_, err := t.client.GetRecommend(userId, "", config.RecommendN)
+			return err
+		}
+	case x < config.RecommendRatio+config.InsertRatio:
+		feedback := client.Feedback{
+			FeedbackType: config.FeedbackType,
+			UserId:       t.dataset.randomUser(t.rng),
+			ItemId:       t.dataset.popularItem(t.zipf),
+		}
+		return OpInsertFeedback, func() error {
+			feedback.Timestamp = time.Now().Format(time.RFC3339)
+			_, err := t.client.InsertFeedback([]client.Feedback{feedback})
+			return err
+		}
+	default:
+		itemId := t.dataset.popularItem(t.zipf)
+		return OpGetItem, func() error {
+			_, err := t.client.GetItem(itemId)
+			return err
+		}
+	}
+}
+
+// runStage sends requests at the share of the target QPS of this node for the duration. Requests are scheduled at
+// fixed intervals regardless of responses, and the dispatcher waits if the number of in-flight requests reaches the
+// concurrency, which lowers the achieved QPS. The stage ends once in-flight requests are done.
+func (t *traffic) runStage(qps float64, duration time.Duration) StageReport {
+	config := t.dataset.config
+	interval := time.Duration(float64(time.Second) * float64(config.NumNodes) / qps)
+	var (
+		samples []sample
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		slots   = make(chan struct{}, config.Concurrency)
+		start   = time.Now()
+	)
+	for next := start; next.Before(start.Add(duration)); next = next.Add(interval) {
+		time.Sleep(time.Until(next))
+		operation, do := t.next()
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			begin := time.Now()
+			err := do()
+			s := sample{operation: operation, latency: time.Since(begin), failed: err != nil}
+			<-slots
+			mu.Lock()
+			samples = append(samples, s)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	stage := StageReport{
+		TargetQPS:   qps,
+		AchievedQPS: float64(len(samples)) / elapsed.Seconds() * float64(config.NumNodes),
+		Duration:    elapsed,
+	}
+	for _, operation := range []string{OpRecommend, OpInsertFeedback, OpGetItem, OpTotal} {
+		stage.Operations = append(stage.Operations, summarize(operation, samples))
+	}
+	total := stage.Operations[len(stage.Operations)-1]
+	stage.Saturated = total.ErrorRate > config.MaxErrorRate ||
+		total.P99 > float64(config.MaxP99Latency)/float64(time.Millisecond) ||
+		stage.AchievedQPS < 0.9*qps
+	return stage
+}
+
+// summarize computes the error rate and latency percentiles of an operation, or all operations if the operation is
+// OpTotal.
+func summarize(operation string, samples []sample) OperationReport {
+	report := OperationReport{Operation: operation}
+	var latencies []time.Duration
+	for _, s := range samples {
+		if operation != OpTotal && s.operation != operation {
+			continue
+		}
+		report.Requests++
+		if s.failed {
+			report.Errors++
+		}
+		latencies = append(latencies, s.latency)
+	}
+	if report.Requests == 0 {
+		return report
+	}
+	report.ErrorRate = float64(report.Errors) / float64(report.Requests)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50 = percentile(latencies, 0.5)
+	report.P95 = percentile(latencies, 0.95)
+	report.P99 = percentile(latencies, 0.99)
+	return report
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	rank := int(math.Ceil(float64(len(sorted))*p)) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return float64(sorted[rank]) / float64(time.Millisecond)
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/client"
+)
+
+// mockServer counts requests of operations. Requests fail if the server is overloaded.
+type mockServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+	items    []client.Item
+	users    []client.User
+	feedback []client.Feedback
+	failures bool
+}
+
+func newMockServer() *mockServer {
+	s := &mockServer{requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/items":
+			var items []client.Item
+			_ = json.NewDecoder(r.Body).Decode(&items)
+			s.items = append(s.items, items...)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/users":
+			var users []client.User
+			_ = json.NewDecoder(r.Body).Decode(&users)
+			s.users = append(s.users, users...)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/feedback":
+			var feedback []client.Feedback
+			_ = json.NewDecoder(r.Body).Decode(&feedback)
+			s.feedback = append(s.feedback, feedback...)
+			s.requests[OpInsertFeedback]++
+		case strings.HasPrefix(r.URL.Path, "/api/recommend/"):
+			s.requests[OpRecommend]++
+			if s.failures {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte(`[]`))
+			return
+		case strings.HasPrefix(r.URL.Path, "/api/item/"):
+			s.requests[OpGetItem]++
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"RowAffected":0}`))
+	}))
+	return s
+}
+
+func sortFeedback(feedback []client.Feedback) {
+	sort.Slice(feedback, func(i, j int) bool {
+		if feedback[i].UserId != feedback[j].UserId {
+			return feedback[i].UserId < feedback[j].UserId
+		}
+		return feedback[i].Timestamp < feedback[j].Timestamp
+	})
+}
+
+func TestDataset(t *testing.T) {
+	config := DefaultConfig()
+	config.NumUsers = 100
+	config.NumItems = 1000
+	config.FeedbackPerUser = 100
+	config.Seed = 1
+	config.NumNodes = 3
+
+	// nodes seed disjoint shares of the same dataset
+	var (
+		items    []client.Item
+		users    []client.User
+		feedback []client.Feedback
+	)
+	for i := 0; i < config.NumNodes; i++ {
+		config.NodeIndex = i
+		dataset := NewDataset(config)
+		items = append(items, dataset.Items()...)
+		users = append(users, dataset.Users()...)
+		feedback = append(feedback, dataset.Feedback()...)
+	}
+	assert.Len(t, lo.Uniq(lo.Map(items, func(item client.Item, _ int) string { return item.ItemId })), config.NumItems)
+	assert.Len(t, lo.Uniq(lo.Map(users, func(user client.User, _ int) string { return user.UserId })), config.NumUsers)
+	assert.Len(t, feedback, config.NumUsers*config.FeedbackPerUser)
+	config.NumNodes, config.NodeIndex = 1, 0
+	expected := NewDataset(config).Feedback()
+	sortFeedback(expected)
+	sortFeedback(feedback)
+	assert.Equal(t, expected, feedback)
+
+	// popularity follows the Zipf distribution
+	counts := make(map[string]int)
+	for _, f := range feedback {
+		counts[f.ItemId]++
+	}
+	assert.Greater(t, lo.Max(lo.Values(counts)), len(feedback)/20)
+
+	// datasets are generated by seeds
+	config.Seed = 2
+	assert.NotEqual(t, feedback[0].ItemId+feedback[1].ItemId+feedback[2].ItemId,
+		func() string {
+			f := NewDataset(config).Feedback()
+			return f[0].ItemId + f[1].ItemId + f[2].ItemId
+		}())
+}
+
+func TestSeed(t *testing.T) {
+	server := newMockServer()
+	defer server.Close()
+	config := DefaultConfig()
+	config.NumUsers = 30
+	config.NumItems = 50
+	config.FeedbackPerUser = 10
+	config.BatchSize = 7
+	progress := make(map[string]int)
+	err := Seed(client.NewGorseClient(server.URL, ""), NewDataset(config), func(name string, n int) {
+		progress[name] = n
+	})
+	assert.NoError(t, err)
+	assert.Len(t, server.items, 50)
+	assert.Len(t, server.users, 30)
+	assert.Len(t, server.feedback, 300)
+	assert.Equal(t, map[string]int{"items": 50, "users": 30, "feedback": 300}, progress)
+}
+
+func TestRun(t *testing.T) {
+	server := newMockServer()
+	defer server.Close()
+	config := DefaultConfig()
+	config.StartQPS = 200
+	config.StepQPS = 200
+	config.MaxQPS = 400
+	config.StepDuration = time.Second
+	c := client.NewGorseClient(server.URL, "")
+
+	// traffic is mixed by ratios and the schedule is ramped
+	var stages []StageReport
+	report := Run(c, NewDataset(config), func(stage StageReport) {
+		stages = append(stages, stage)
+	})
+	assert.Equal(t, stages, report.Stages)
+	if assert.Len(t, report.Stages, 2) {
+		assert.Equal(t, 200.0, report.Stages[0].TargetQPS)
+		assert.Equal(t, 400.0, report.Stages[1].TargetQPS)
+		assert.False(t, report.Stages[1].Saturated)
+		assert.InDelta(t, 400, report.Stages[1].AchievedQPS, 40)
+	}
+	assert.Zero(t, report.SaturationQPS)
+	assert.Equal(t, 400.0, report.SustainedQPS)
+	total := server.requests[OpRecommend] + server.requests[OpInsertFeedback] + server.requests[OpGetItem]
+	assert.InDelta(t, 600, total, 10)
+	assert.InDelta(t, 0.7, float64(server.requests[OpRecommend])/float64(total), 0.1)
+	assert.InDelta(t, 0.2, float64(server.requests[OpInsertFeedback])/float64(total), 0.1)
+	assert.InDelta(t, 0.1, float64(server.requests[OpGetItem])/float64(total), 0.1)
+
+	// the schedule stops once the server is saturated
+	server.failures = true
+	c.EnableRetry(1, time.Millisecond)
+	report = Run(c, NewDataset(config), func(StageReport) {})
+	if assert.Len(t, report.Stages, 1) {
+		assert.True(t, report.Stages[0].Saturated)
+		assert.Greater(t, report.Stages[0].Retries, 0)
+		recommend := report.Stages[0].Operations[0]
+		assert.Equal(t, OpRecommend, recommend.Operation)
+		assert.Equal(t, 1.0, recommend.ErrorRate)
+	}
+	assert.Equal(t, 200.0, report.SaturationQPS)
+	assert.Zero(t, report.SustainedQPS)
+	var buf bytes.Buffer
+	err := report.WriteTable(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "saturated at 200 QPS, sustained 0 QPS")
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond}
+	assert.Equal(t, 2.0, percentile(latencies, 0.5))
+	assert.Equal(t, 4.0, percentile(latencies, 0.99))
+	assert.Equal(t, 1.0, percentile(latencies, 0))
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/zhenghaoz/gorse/client"
+)
+
+// epoch is the timestamp of synthetic items and seeded feedback, so that datasets generated by the same seed are
+// identical.
+var epoch = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func userId(i int) string {
+	return fmt.Sprintf("bench_user_%d", i)
+}
+
+func itemId(i int) string {
+	return fmt.Sprintf("bench_item_%d", i)
+}
+
+// Dataset is a synthetic catalog and user base. Datasets generated by the same seed are identical on every machine, so
+// that nodes of distributed generation seed and request the same users and items.
+type Dataset struct {
+	config Config
+	// popularity maps ranks of popularity to items, so that popular items are scattered over the catalog.
+	popularity []int
+}
+
+// NewDataset generates a dataset by the seed in the config.
+func NewDataset(config Config) *Dataset {
+	rng := rand.New(rand.NewSource(config.Seed))
+	return &Dataset{config: config, popularity: rng.Perm(config.NumItems)}
+}
+
+// owned returns true if the i-th user or item is seeded by this node.
+func (d *Dataset) owned(i int) bool {
+	return i%d.config.NumNodes == d.config.NodeIndex
+}
+
+// Items returns items seeded by this node.
+func (d *Dataset) Items() []client.Item {
+	var items []client.Item
+	for i := 0; i < d.config.NumItems; i++ {
+		if !d.owned(i) {
+			continue
+		}
+		items = append(items, client.Item{
+			ItemId:     itemId(i),
+			Labels:     []string{fmt.Sprintf("bench_label_%d", i%(d.config.NumCategories*10))},
+			Categories: []string{fmt.Sprintf("bench_category_%d", i%d.config.NumCategories)},
+			Timestamp:  epoch.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+	}
+	return items
+}
+
+// Users returns users seeded by this node.
+func (d *Dataset) Users() []client.User {
+	var users []client.User
+	for i := 0; i < d.config.NumUsers; i++ {
+		if d.owned(i) {
+			users = append(users, client.User{
+				UserId: userId(i),
+				Labels: []string{fmt.Sprintf("bench_label_%d", i%(d.config.NumCategories*10))},
+			})
+		}
+	}
+	return users
+}
+
+// Feedback returns feedback of users seeded by this node. Items are drawn from the Zipf distribution of popularity.
+// Feedback of each user is drawn from its own random source, so that feedback doesn't depend on the number of nodes.
+func (d *Dataset) Feedback() []client.Feedback {
+	var feedback []client.Feedback
+	for i := 0; i < d.config.NumUsers; i++ {
+		if !d.owned(i) {
+			continue
+		}
+		rng := rand.New(rand.NewSource(d.config.Seed + int64(i) + 1))
+		zipf := d.newZipf(rng)
+		for j := 0; j < d.config.FeedbackPerUser; j++ {
+			feedback = append(feedback, client.Feedback{
+				FeedbackType: d.config.FeedbackType,
+				UserId:       userId(i),
+				ItemId:       d.popularItem(zipf),
+				Timestamp:    epoch.Add(time.Duration(j) * time.Second).Format(time.RFC3339),
+			})
+		}
+	}
+	return feedback
+}
+
+func (d *Dataset) newZipf(rng *rand.Rand) *rand.Zipf {
+	return rand.NewZipf(rng, d.config.ZipfExponent, 1, uint64(d.config.NumItems-1))
+}
+
+// popularItem draws an item from the Zipf distribution of popularity.
+func (d *Dataset) popularItem(zipf *rand.Zipf) string {
+	return itemId(d.popularity[zipf.Uint64()])
+}
+
+// randomUser draws a user uniformly.
+func (d *Dataset) randomUser(rng *rand.Rand) string {
+	return userId(rng.Intn(d.config.NumUsers))
+}
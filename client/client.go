@@ -16,16 +16,68 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ErrPageTokenExpired is returned by RecommendIterator if the recommendation snapshot of the iterator has expired.
+var ErrPageTokenExpired = errors.New("page token expired")
+
+// ErrSessionExpired is returned by Session if the session has been idle for longer than the TTL.
+var ErrSessionExpired = errors.New("session expired")
+
+// ErrConflict is returned by ModifyItem and ModifyUser if the item or the user isn't at the version of the patch.
+var ErrConflict = errors.New("version conflict")
+
 type GorseClient struct {
 	entryPoint string
 	apiKey     string
 	httpClient http.Client
+	etags      *etagCache
+	maxRetries int
+	backoff    time.Duration
+	observer   func(RequestMetrics)
+}
+
+// RequestMetrics is reported to the observer once a request is done.
+type RequestMetrics struct {
+	Method  string
+	URL     string
+	Status  int           // status code of the last attempt, 0 if no response is received
+	Latency time.Duration // time spent on all attempts including backoff
+	Retries int
+	Err     error
+}
+
+// EnableRetry retries requests at most maxRetries times if no response is received, or the server is overloaded or
+// fails. The backoff before the n-th retry is backoff * 2^(n-1). Writes are retried as well, since insertions overwrite
+// existing rows.
+func (c *GorseClient) EnableRetry(maxRetries int, backoff time.Duration) {
+	c.maxRetries = maxRetries
+	c.backoff = backoff
+}
+
+// SetTimeout limits the time of each attempt of requests.
+func (c *GorseClient) SetTimeout(timeout time.Duration) {
+	c.httpClient.Timeout = timeout
+}
+
+// ObserveRequests reports metrics of each request to the observer, which should be safe for concurrent use.
+func (c *GorseClient) ObserveRequests(observer func(RequestMetrics)) {
+	c.observer = observer
+}
+
+// EnableETagCache keeps local copies of at most size responses to GET requests, which are revalidated by ETags. Copies
+// not modified are used without transferring responses again.
+func (c *GorseClient) EnableETagCache(size int) {
+	c.etags = &etagCache{size: size, entries: make(map[string]etagEntry)}
 }
 
 func NewGorseClient(EntryPoint, ApiKey string) *GorseClient {
@@ -43,70 +95,532 @@ func (c *GorseClient) ListFeedbacks(feedbackType, userId string) ([]Feedback, er
 	return request[[]Feedback, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/user/"+userId+"/feedback/"+feedbackType), nil)
 }
 
+// DeleteUserFeedbackInRange deletes feedback of the user timestamped in [begin, end). A nil begin or end means the range
+// is open on that side. Feedback of all types is deleted if no types are given. Deleting feedback in an unbounded range
+// requires confirm to be true.
+func (c *GorseClient) DeleteUserFeedbackInRange(userId string, begin, end *time.Time, confirm bool, feedbackTypes ...string) (RowAffected, error) {
+	params := url.Values{}
+	if begin != nil {
+		params.Set("begin", begin.Format(time.RFC3339Nano))
+	}
+	if end != nil {
+		params.Set("end", end.Format(time.RFC3339Nano))
+	}
+	if confirm {
+		params.Set("confirm", "true")
+	}
+	for _, feedbackType := range feedbackTypes {
+		params.Add("type", feedbackType)
+	}
+	return request[RowAffected, any](c, "DELETE", c.entryPoint+fmt.Sprintf("/api/feedback/%s?%s", url.PathEscape(userId), params.Encode()), nil)
+}
+
 func (c *GorseClient) GetRecommend(userId string, category string, n int) ([]string, error) {
 	return request[[]string, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/recommend/%s/%s?n=%d", userId, category, n), nil)
 }
 
+// RecommendIterator iterates pages of recommendation. Pages are served from a snapshot frozen on the first page, so
+// that items don't shift between pages when recommendation is refreshed.
+type RecommendIterator struct {
+	client   *GorseClient
+	userId   string
+	category string
+	n        int
+	token    string
+	done     bool
+}
+
+// IterRecommend returns an iterator over pages of recommendation for the user in the category.
+func (c *GorseClient) IterRecommend(userId string, category string, n int) *RecommendIterator {
+	return &RecommendIterator{client: c, userId: userId, category: category, n: n}
+}
+
+// Next returns the next page of recommendation. An empty page is returned after the last page. ErrPageTokenExpired
+// is returned if the snapshot has expired, and the iteration should be restarted.
+func (it *RecommendIterator) Next() ([]string, error) {
+	if it.done {
+		return nil, nil
+	}
+	query := url.Values{}
+	query.Set("n", strconv.Itoa(it.n))
+	if it.token == "" {
+		query.Set("paging", "token")
+	} else {
+		query.Set("page-token", it.token)
+	}
+	page, header, err := requestHeader[[]string, any](it.client, "GET",
+		it.client.entryPoint+fmt.Sprintf("/api/recommend/%s/%s?%s", it.userId, it.category, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	it.token = header.Get("X-Next-Page-Token")
+	it.done = it.token == ""
+	return page, nil
+}
+
 func (c *GorseClient) SessionRecommend(feedbacks []Feedback, n int) ([]Score, error) {
 	return request[[]Score](c, "POST", c.entryPoint+fmt.Sprintf("/api/session/recommend?n=%d", n), feedbacks)
 }
 
+// Session is a session stored by the server. Feedback inserted into the session is kept by the server, so that it
+// isn't resent for recommendation.
+type Session struct {
+	client *GorseClient
+	id     string
+}
+
+// CreateSession creates a session stored by the server.
+func (c *GorseClient) CreateSession() (*Session, error) {
+	session, err := request[struct{ SessionId string }, any](c, "POST", c.entryPoint+"/api/session", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{client: c, id: session.SessionId}, nil
+}
+
+// InsertFeedback appends feedback to the session. ErrSessionExpired is returned if the session has expired.
+func (s *Session) InsertFeedback(feedbacks []Feedback) (RowAffected, error) {
+	result, err := request[RowAffected](s.client, "POST", s.client.entryPoint+fmt.Sprintf("/api/session/%s/feedback", s.id), feedbacks)
+	if errors.Is(err, ErrPageTokenExpired) {
+		err = ErrSessionExpired
+	}
+	return result, err
+}
+
+// Recommend gets recommendation in the category for feedback in the session. Recommendation in all categories is
+// returned if the category is empty. ErrSessionExpired is returned if the session has expired.
+func (s *Session) Recommend(category string, n int) ([]Score, error) {
+	result, err := request[[]Score, any](s.client, "GET", s.client.entryPoint+fmt.Sprintf("/api/session/%s/recommend/%s?n=%d", s.id, category, n), nil)
+	if errors.Is(err, ErrPageTokenExpired) {
+		err = ErrSessionExpired
+	}
+	return result, err
+}
+
 func (c *GorseClient) GetNeighbors(itemId string, n int) ([]Score, error) {
 	return request[[]Score, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/item/%s/neighbors?n=%d", itemId, n), nil)
 }
 
+// GetCovisitedItems gets items co-visited with the item. Scores are numbers of users giving feedback to both items.
+func (c *GorseClient) GetCovisitedItems(itemId string, n, offset int) ([]Score, error) {
+	return request[[]Score, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/item/%s/covisit?n=%d&offset=%d", itemId, n, offset), nil)
+}
+
+func (c *GorseClient) GetUserNeighbors(userId string, n, offset int) ([]Score, error) {
+	return request[[]Score, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/user/%s/neighbors?n=%d&offset=%d", userId, n, offset), nil)
+}
+
+// GetPopular gets popular items in the category. Popular items in all categories are returned if the category is empty.
+func (c *GorseClient) GetPopular(category string, n, offset int) ([]Score, error) {
+	return request[[]Score, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/popular/%s?n=%d&offset=%d", category, n, offset), nil)
+}
+
+// GetLatest gets latest items in the category. Latest items in all categories are returned if the category is empty.
+func (c *GorseClient) GetLatest(category string, n, offset int) ([]Score, error) {
+	return request[[]Score, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/latest/%s?n=%d&offset=%d", category, n, offset), nil)
+}
+
+// GetTrending gets trending items in the category. Trending items in all categories are returned if the category is
+// empty.
+func (c *GorseClient) GetTrending(category string, n, offset int) ([]Score, error) {
+	return request[[]Score, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/trending/%s?n=%d&offset=%d", category, n, offset), nil)
+}
+
+func (c *GorseClient) InsertUsers(users []User) (RowAffected, error) {
+	return request[RowAffected](c, "POST", c.entryPoint+"/api/users", users)
+}
+
 func (c *GorseClient) InsertUser(user User) (RowAffected, error) {
 	return request[RowAffected](c, "POST", c.entryPoint+"/api/user", user)
 }
 
-func (c *GorseClient) GetUser(userId string) (User, error) {
-	return request[User, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/user/%s", userId), nil)
+// GetUser returns a user. Only the user id and given fields are returned if fields are given.
+func (c *GorseClient) GetUser(userId string, fields ...string) (User, error) {
+	return request[User, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/user/%s%s", userId, fieldsQuery(fields)), nil)
+}
+
+// GetUserVersion returns a user and its version. The version is passed by UserPatch to modify the user only if the
+// user hasn't been modified since then.
+func (c *GorseClient) GetUserVersion(userId string) (User, string, error) {
+	user, header, err := requestHeader[User, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/user/%s", url.PathEscape(userId)), nil)
+	if err != nil {
+		return User{}, "", err
+	}
+	return user, strings.Trim(header.Get("ETag"), `"`), nil
+}
+
+func (c *GorseClient) ModifyUser(userId string, patch UserPatch) (RowAffected, error) {
+	return request[RowAffected](c, "PATCH", c.entryPoint+fmt.Sprintf("/api/user/%s", url.PathEscape(userId)), patch)
+}
+
+// AddUserLabels adds labels to a user. Existing labels are kept.
+func (c *GorseClient) AddUserLabels(userId string, labels ...string) (RowAffected, error) {
+	return c.ModifyUser(userId, UserPatch{AddLabels: labels})
+}
+
+// RemoveUserLabels removes labels from a user. Other labels are kept.
+func (c *GorseClient) RemoveUserLabels(userId string, labels ...string) (RowAffected, error) {
+	return c.ModifyUser(userId, UserPatch{RemoveLabels: labels})
+}
+
+// Subscribe subscribes a topic for a user. Topics are labels or categories of items.
+func (c *GorseClient) Subscribe(userId, topic string) (RowAffected, error) {
+	return request[RowAffected, any](c, "PUT", c.entryPoint+fmt.Sprintf("/api/user/%s/subscribe/%s", url.PathEscape(userId), url.PathEscape(topic)), nil)
+}
+
+// Unsubscribe unsubscribes a topic for a user. Other topics are kept.
+func (c *GorseClient) Unsubscribe(userId, topic string) (RowAffected, error) {
+	return request[RowAffected, any](c, "DELETE", c.entryPoint+fmt.Sprintf("/api/user/%s/subscribe/%s", url.PathEscape(userId), url.PathEscape(topic)), nil)
 }
 
 func (c *GorseClient) DeleteUser(userId string) (RowAffected, error) {
 	return request[RowAffected, any](c, "DELETE", c.entryPoint+fmt.Sprintf("/api/user/%s", userId), nil)
 }
 
+// SetUserOverrides replaces pinned items and blocked items of the user. Positions of pinned items start from 1.
+func (c *GorseClient) SetUserOverrides(overrides UserOverrides) (RowAffected, error) {
+	return request[RowAffected](c, "PUT", c.entryPoint+fmt.Sprintf("/api/user/%s/overrides", url.PathEscape(overrides.UserId)), overrides)
+}
+
+func (c *GorseClient) GetUserOverrides(userId string) (UserOverrides, error) {
+	return request[UserOverrides, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/user/%s/overrides", url.PathEscape(userId)), nil)
+}
+
+func (c *GorseClient) DeleteUserOverrides(userId string) (RowAffected, error) {
+	return request[RowAffected, any](c, "DELETE", c.entryPoint+fmt.Sprintf("/api/user/%s/overrides", url.PathEscape(userId)), nil)
+}
+
+func (c *GorseClient) InsertItems(items []Item) (RowAffected, error) {
+	return request[RowAffected](c, "POST", c.entryPoint+"/api/items", items)
+}
+
 func (c *GorseClient) InsertItem(item Item) (RowAffected, error) {
 	return request[RowAffected](c, "POST", c.entryPoint+"/api/item", item)
 }
 
-func (c *GorseClient) GetItem(itemId string) (Item, error) {
-	return request[Item, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/item/%s", itemId), nil)
+// GetItem returns an item. Only the item id and given fields are returned if fields are given.
+func (c *GorseClient) GetItem(itemId string, fields ...string) (Item, error) {
+	return request[Item, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/item/%s%s", itemId, fieldsQuery(fields)), nil)
+}
+
+// GetItemVersion returns an item and its version. The version is passed by ItemPatch to modify the item only if the
+// item hasn't been modified since then.
+func (c *GorseClient) GetItemVersion(itemId string) (Item, string, error) {
+	item, header, err := requestHeader[Item, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/item/%s", url.PathEscape(itemId)), nil)
+	if err != nil {
+		return Item{}, "", err
+	}
+	return item, strings.Trim(header.Get("ETag"), `"`), nil
+}
+
+func (c *GorseClient) ModifyItem(itemId string, patch ItemPatch) (RowAffected, error) {
+	return request[RowAffected](c, "PATCH", c.entryPoint+fmt.Sprintf("/api/item/%s", url.PathEscape(itemId)), patch)
+}
+
+// AddItemLabels adds labels to an item. Existing labels are kept.
+func (c *GorseClient) AddItemLabels(itemId string, labels ...string) (RowAffected, error) {
+	return c.ModifyItem(itemId, ItemPatch{AddLabels: labels})
+}
+
+// RemoveItemLabels removes labels from an item. Other labels are kept.
+func (c *GorseClient) RemoveItemLabels(itemId string, labels ...string) (RowAffected, error) {
+	return c.ModifyItem(itemId, ItemPatch{RemoveLabels: labels})
+}
+
+// AddItemCategory adds an item to a category. Existing categories are kept.
+func (c *GorseClient) AddItemCategory(itemId, category string) (RowAffected, error) {
+	return c.ModifyItem(itemId, ItemPatch{AddCategories: []string{category}})
+}
+
+// RemoveItemCategory removes an item from a category. Other categories are kept.
+func (c *GorseClient) RemoveItemCategory(itemId, category string) (RowAffected, error) {
+	return c.ModifyItem(itemId, ItemPatch{RemoveCategories: []string{category}})
+}
+
+func fieldsQuery(fields []string) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	return "?fields=" + url.QueryEscape(strings.Join(fields, ","))
 }
 
 func (c *GorseClient) DeleteItem(itemId string) (RowAffected, error) {
 	return request[RowAffected, any](c, "DELETE", c.entryPoint+fmt.Sprintf("/api/item/%s", itemId), nil)
 }
 
+func (c *GorseClient) ListCategories() (Categories, error) {
+	return request[Categories, any](c, "GET", c.entryPoint+"/api/categories", nil)
+}
+
+func (c *GorseClient) InsertRule(rule Rule) (RowAffected, error) {
+	return request[RowAffected](c, "POST", c.entryPoint+"/api/rules", rule)
+}
+
+func (c *GorseClient) UpdateRule(rule Rule) (RowAffected, error) {
+	return request[RowAffected](c, "PUT", c.entryPoint+fmt.Sprintf("/api/rules/%s", rule.RuleId), rule)
+}
+
+func (c *GorseClient) GetRule(ruleId string) (Rule, error) {
+	return request[Rule, any](c, "GET", c.entryPoint+fmt.Sprintf("/api/rules/%s", ruleId), nil)
+}
+
+func (c *GorseClient) ListRules() ([]Rule, error) {
+	return request[[]Rule, any](c, "GET", c.entryPoint+"/api/rules", nil)
+}
+
+func (c *GorseClient) DeleteRule(ruleId string) (RowAffected, error) {
+	return request[RowAffected, any](c, "DELETE", c.entryPoint+fmt.Sprintf("/api/rules/%s", ruleId), nil)
+}
+
+// AdminClient calls administrative APIs.
+type AdminClient struct {
+	client *GorseClient
+}
+
+// Admin creates a client for administrative APIs with the admin API key. The API key is used if the admin API key is
+// empty.
+func (c *GorseClient) Admin(adminApiKey string) *AdminClient {
+	if adminApiKey == "" {
+		adminApiKey = c.apiKey
+	}
+	return &AdminClient{client: &GorseClient{
+		entryPoint: c.entryPoint,
+		apiKey:     adminApiKey,
+	}}
+}
+
+// RecommendPreview returns candidates and filtering decisions of each recommendation stage for a user. Read feedback
+// is not written back.
+func (c *AdminClient) RecommendPreview(userId, category string, n int) (RecommendPreview, error) {
+	return request[RecommendPreview, any](c.client, "GET", c.client.entryPoint+fmt.Sprintf("/api/dashboard/recommend-preview/%s?category=%s&n=%d",
+		url.PathEscape(userId), url.QueryEscape(category), n), nil)
+}
+
+// GetBlendWeights returns weights of score blending.
+func (c *AdminClient) GetBlendWeights() (BlendWeights, error) {
+	return request[BlendWeights, any](c.client, "GET", c.client.entryPoint+"/api/blend-weights", nil)
+}
+
+// SetBlendWeights sets weights of score blending, which take effect without restarting.
+func (c *AdminClient) SetBlendWeights(weights BlendWeights) (RowAffected, error) {
+	return request[RowAffected](c.client, "PUT", c.client.entryPoint+"/api/blend-weights", weights)
+}
+
+// ResetBlendWeights resets weights of score blending to the configuration.
+func (c *AdminClient) ResetBlendWeights() (RowAffected, error) {
+	return request[RowAffected, any](c.client, "DELETE", c.client.entryPoint+"/api/blend-weights", nil)
+}
+
+// ExportUser returns the user, feedback of the user and cache entries about the user.
+func (c *AdminClient) ExportUser(userId string) (UserExport, error) {
+	return request[UserExport, any](c.client, "GET", c.client.entryPoint+fmt.Sprintf("/api/user/%s/export", url.PathEscape(userId)), nil)
+}
+
+// EraseUser removes the user, feedback of the user and cache entries about the user.
+func (c *AdminClient) EraseUser(userId string) (RowAffected, error) {
+	return request[RowAffected, any](c.client, "DELETE", c.client.entryPoint+fmt.Sprintf("/api/user/%s?erase=true", url.PathEscape(userId)), nil)
+}
+
+// ListTasks returns tasks of the master and workers with progress. The entry point should be the master.
+func (c *AdminClient) ListTasks() ([]Task, error) {
+	return request[[]Task, any](c.client, "GET", c.client.entryPoint+"/api/dashboard/tasks", nil)
+}
+
+// ListShards lists user shards assigned to workers and their progress of offline recommendation.
+func (c *AdminClient) ListShards() ([]Shard, error) {
+	return request[[]Shard, any](c.client, "GET", c.client.entryPoint+"/api/dashboard/tasks/shards", nil)
+}
+
+// CancelTask cancels a running task. The task stops at the next check between batches.
+func (c *AdminClient) CancelTask(name string) (RowAffected, error) {
+	return request[RowAffected, any](c.client, "POST", c.client.entryPoint+fmt.Sprintf("/api/dashboard/tasks/%s/cancel", url.PathEscape(name)), nil)
+}
+
+// RunTask runs a pipeline stage immediately. The entry point should be the master.
+func (c *AdminClient) RunTask(stage string) (StageRun, error) {
+	return request[StageRun, any](c.client, "POST", c.client.entryPoint+fmt.Sprintf("/api/dashboard/tasks/%s/run", url.PathEscape(stage)), nil)
+}
+
+// ListDuplicates returns clusters of near-duplicate items. The entry point should be the master.
+func (c *AdminClient) ListDuplicates() ([]DuplicateCluster, error) {
+	return request[[]DuplicateCluster, any](c.client, "GET", c.client.entryPoint+"/api/dashboard/duplicates", nil)
+}
+
+// BreakDuplicates breaks the cluster of a canonical item, whose items are never clustered again. The entry point
+// should be the master.
+func (c *AdminClient) BreakDuplicates(canonicalId string) (RowAffected, error) {
+	return request[RowAffected, any](c.client, "DELETE", c.client.entryPoint+fmt.Sprintf("/api/dashboard/duplicates/%s", url.PathEscape(canonicalId)), nil)
+}
+
+// RefreshItem searches neighbors of an item with the latest labels and categories immediately. The entry point should
+// be the master.
+func (c *AdminClient) RefreshItem(itemId string) (ItemRefresh, error) {
+	return request[ItemRefresh, any](c.client, "POST", c.client.entryPoint+fmt.Sprintf("/api/admin/refresh/item/%s", url.PathEscape(itemId)), nil)
+}
+
+// RefreshUser refreshes offline recommendation of a user via the priority refresh queue and waits for workers.
+// Refreshed is false if workers haven't refreshed the user before timeout. The entry point should be the master.
+func (c *AdminClient) RefreshUser(userId string) (UserRefresh, error) {
+	return request[UserRefresh, any](c.client, "POST", c.client.entryPoint+fmt.Sprintf("/api/admin/refresh/user/%s", url.PathEscape(userId)), nil)
+}
+
+// LookupDigest returns the user id of a digest in cache keys and logs if user ids are obfuscated. The entry point
+// should be the master.
+func (c *AdminClient) LookupDigest(digest string) (DigestLookup, error) {
+	return request[DigestLookup, any](c.client, "GET", c.client.entryPoint+fmt.Sprintf("/api/admin/digest/%s", url.PathEscape(digest)), nil)
+}
+
+// ExportSnapshot starts exporting a consistent snapshot of data and cache stores. The entry point should be the master.
+func (c *AdminClient) ExportSnapshot() (SnapshotRun, error) {
+	return request[SnapshotRun, any](c.client, "POST", c.client.entryPoint+"/api/admin/snapshot", nil)
+}
+
+// ListLabels lists labels with numbers of items and users. The entry point should be the master.
+func (c *AdminClient) ListLabels() ([]LabelCount, error) {
+	return request[[]LabelCount, any](c.client, "GET", c.client.entryPoint+"/api/admin/labels", nil)
+}
+
+// RenameLabel starts renaming a label of items and users to a label not in use. Progress is reported by the task
+// "Rewrite label" and GetLabelRewrite. The entry point should be the master.
+func (c *AdminClient) RenameLabel(from, to string) (LabelRewriteRun, error) {
+	return request[LabelRewriteRun, any](c.client, "POST", c.client.entryPoint+fmt.Sprintf("/api/admin/labels/rename?from=%s&to=%s",
+		url.QueryEscape(from), url.QueryEscape(to)), nil)
+}
+
+// MergeLabels starts merging a label of items and users into another label in use. Progress is reported by the task
+// "Rewrite label" and GetLabelRewrite. The entry point should be the master.
+func (c *AdminClient) MergeLabels(from, to string) (LabelRewriteRun, error) {
+	return request[LabelRewriteRun, any](c.client, "POST", c.client.entryPoint+fmt.Sprintf("/api/admin/labels/merge?from=%s&to=%s",
+		url.QueryEscape(from), url.QueryEscape(to)), nil)
+}
+
+// GetLabelRewrite returns the progress of the latest label rewrite. The entry point should be the master.
+func (c *AdminClient) GetLabelRewrite() (LabelRewrite, error) {
+	return request[LabelRewrite, any](c.client, "GET", c.client.entryPoint+"/api/admin/labels/rewrite", nil)
+}
+
 func request[Response any, Body any](c *GorseClient, method, url string, body Body) (result Response, err error) {
+	result, _, err = requestHeader[Response](c, method, url, body)
+	return
+}
+
+func requestHeader[Response any, Body any](c *GorseClient, method, url string, body Body) (result Response, header http.Header, err error) {
 	bodyByte, marshalErr := json.Marshal(body)
 	if marshalErr != nil {
-		return result, marshalErr
+		return result, nil, marshalErr
+	}
+	cached, hasCached := c.etags.get(method, url)
+	var (
+		resp    *http.Response
+		buf     *strings.Builder
+		retries int
+		start   = time.Now()
+	)
+	if c.observer != nil {
+		defer func() {
+			metrics := RequestMetrics{Method: method, URL: url, Latency: time.Since(start), Retries: retries, Err: err}
+			if resp != nil {
+				metrics.Status = resp.StatusCode
+			}
+			c.observer(metrics)
+		}()
+	}
+	for {
+		resp, buf, err = c.do(method, url, bodyByte, cached.etag)
+		if retries >= c.maxRetries || !retryable(resp, err) {
+			break
+		}
+		time.Sleep(c.backoff << retries)
+		retries++
 	}
-	var req *http.Request
-	req, err = http.NewRequest(method, url, strings.NewReader(string(bodyByte)))
 	if err != nil {
-		return result, err
+		return result, nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && hasCached {
+		buf.Reset()
+		buf.WriteString(cached.body)
+		resp.StatusCode = http.StatusOK
+	} else if resp.StatusCode == http.StatusOK {
+		c.etags.put(method, url, resp.Header.Get("ETag"), buf.String())
+	}
+	if resp.StatusCode == http.StatusGone {
+		return result, nil, ErrPageTokenExpired
+	} else if resp.StatusCode == http.StatusConflict {
+		return result, nil, ErrConflict
+	} else if resp.StatusCode != http.StatusOK {
+		return result, nil, ErrorMessage(buf.String())
+	}
+	err = json.Unmarshal([]byte(buf.String()), &result)
+	if err != nil {
+		return result, nil, err
+	}
+	return result, resp.Header, err
+}
+
+// do sends a request once and reads the response.
+func (c *GorseClient) do(method, url string, body []byte, etag string) (*http.Response, *strings.Builder, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, nil, err
 	}
 	req.Header.Set("X-API-Key", c.apiKey)
 	req.Header.Set("Content-Type", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return result, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 	buf := new(strings.Builder)
-	_, err = io.Copy(buf, resp.Body)
-	if err != nil {
-		return result, err
+	if _, err = io.Copy(buf, resp.Body); err != nil {
+		return resp, nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return result, ErrorMessage(buf.String())
+	return resp, buf, nil
+}
+
+// retryable returns true if no response is received, or the server is overloaded or fails.
+func retryable(resp *http.Response, err error) bool {
+	if resp == nil || err != nil {
+		return true
 	}
-	err = json.Unmarshal([]byte(buf.String()), &result)
-	if err != nil {
-		return result, err
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+type etagEntry struct {
+	etag string
+	body string
+}
+
+// etagCache keeps local copies of responses to GET requests by URLs. An arbitrary copy is evicted once it is full.
+type etagCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]etagEntry
+}
+
+func (c *etagCache) get(method, url string) (etagEntry, bool) {
+	if c == nil || method != http.MethodGet {
+		return etagEntry{}, false
 	}
-	return result, err
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[url]
+	return entry, ok
+}
+
+func (c *etagCache) put(method, url, etag, body string) {
+	if c == nil || method != http.MethodGet || etag == "" || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exist := c.entries[url]; !exist && len(c.entries) >= c.size {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[url] = etagEntry{etag: etag, body: body}
 }
@@ -19,7 +19,9 @@ package client
 import (
 	"context"
 	"github.com/go-redis/redis/v8"
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/suite"
+	"sync"
 	"testing"
 	"time"
 )
@@ -91,6 +93,26 @@ func (suite *GorseClientTestSuite) TestFeedback() {
 	}, feedbacks)
 }
 
+func (suite *GorseClientTestSuite) TestDeleteUserFeedbackInRange() {
+	userId := "801"
+	_, err := suite.client.InsertFeedback([]Feedback{
+		{FeedbackType: "like", UserId: userId, ItemId: "200", Timestamp: "2022-02-28T00:00:00Z"},
+		{FeedbackType: "like", UserId: userId, ItemId: "300", Timestamp: "2022-03-15T00:00:00Z"},
+		{FeedbackType: "read", UserId: userId, ItemId: "400", Timestamp: "2022-03-16T00:00:00Z"},
+	})
+	suite.NoError(err)
+	begin := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	resp, err := suite.client.DeleteUserFeedbackInRange(userId, &begin, &end, false, "like")
+	suite.NoError(err)
+	suite.Equal(1, resp.RowAffected)
+	_, err = suite.client.DeleteUserFeedbackInRange(userId, nil, nil, false)
+	suite.Error(err)
+	resp, err = suite.client.DeleteUserFeedbackInRange(userId, nil, nil, true)
+	suite.NoError(err)
+	suite.Equal(2, resp.RowAffected)
+}
+
 func (suite *GorseClientTestSuite) TestRecommend() {
 	suite.redis.ZAddArgs(context.Background(), "offline_recommend/100", redis.ZAddArgs{
 		Members: []redis.Z{
@@ -113,6 +135,35 @@ func (suite *GorseClientTestSuite) TestRecommend() {
 	suite.Equal([]string{"3", "2", "1"}, resp)
 }
 
+func (suite *GorseClientTestSuite) TestIterRecommend() {
+	suite.redis.ZAddArgs(context.Background(), "offline_recommend/200", redis.ZAddArgs{
+		Members: []redis.Z{
+			{
+				Score:  1,
+				Member: "1",
+			},
+			{
+				Score:  2,
+				Member: "2",
+			},
+			{
+				Score:  3,
+				Member: "3",
+			},
+		},
+	})
+	it := suite.client.IterRecommend("200", "", 2)
+	resp, err := it.Next()
+	suite.NoError(err)
+	suite.Equal([]string{"3", "2"}, resp)
+	resp, err = it.Next()
+	suite.NoError(err)
+	suite.Equal([]string{"1"}, resp)
+	resp, err = it.Next()
+	suite.NoError(err)
+	suite.Empty(resp)
+}
+
 func (suite *GorseClientTestSuite) TestSessionRecommend() {
 	ctx := context.Background()
 	suite.redis.ZAddArgs(ctx, "item_neighbors/1", redis.ZAddArgs{
@@ -234,6 +285,44 @@ func (suite *GorseClientTestSuite) TestSessionRecommend() {
 	}, resp)
 }
 
+func (suite *GorseClientTestSuite) TestSession() {
+	ctx := context.Background()
+	suite.redis.ZAddArgs(ctx, "item_neighbors/21", redis.ZAddArgs{
+		Members: []redis.Z{
+			{
+				Score:  2,
+				Member: "22",
+			},
+			{
+				Score:  1,
+				Member: "23",
+			},
+		},
+	})
+
+	session, err := suite.client.CreateSession()
+	suite.NoError(err)
+	rowAffected, err := session.InsertFeedback([]Feedback{{
+		FeedbackType: "like",
+		ItemId:       "21",
+		Timestamp:    time.Unix(1660459054, 0).UTC().Format(time.RFC3339),
+	}})
+	suite.NoError(err)
+	suite.Equal(1, rowAffected.RowAffected)
+	resp, err := session.Recommend("", 3)
+	suite.NoError(err)
+	suite.Equal([]Score{
+		{
+			Id:    "22",
+			Score: 2,
+		},
+		{
+			Id:    "23",
+			Score: 1,
+		},
+	}, resp)
+}
+
 func (suite *GorseClientTestSuite) TestNeighbors() {
 	r := redis.NewClient(&redis.Options{
 		Addr: "127.0.0.1:6379",
@@ -274,6 +363,167 @@ func (suite *GorseClientTestSuite) TestNeighbors() {
 	}, resp)
 }
 
+func (suite *GorseClientTestSuite) TestUserNeighbors() {
+	ctx := context.Background()
+	suite.redis.ZAddArgs(ctx, "user_neighbors/100", redis.ZAddArgs{
+		Members: []redis.Z{
+			{
+				Score:  1,
+				Member: "1",
+			},
+			{
+				Score:  2,
+				Member: "2",
+			},
+			{
+				Score:  3,
+				Member: "3",
+			},
+		},
+	})
+
+	userId := "100"
+	resp, err := suite.client.GetUserNeighbors(userId, 3, 0)
+	suite.NoError(err)
+	suite.Equal([]Score{
+		{
+			Id:    "3",
+			Score: 3,
+		}, {
+			Id:    "2",
+			Score: 2,
+		}, {
+			Id:    "1",
+			Score: 1,
+		},
+	}, resp)
+
+	resp, err = suite.client.GetUserNeighbors(userId, 1, 1)
+	suite.NoError(err)
+	suite.Equal([]Score{
+		{
+			Id:    "2",
+			Score: 2,
+		},
+	}, resp)
+}
+
+func (suite *GorseClientTestSuite) TestUserNeighbors_CoConsumption() {
+	// user_co_1 and user_co_2 like the same items, user_co_3 likes one of them
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	var feedbacks []Feedback
+	for _, itemId := range []string{"item_co_1", "item_co_2", "item_co_3"} {
+		for _, userId := range []string{"user_co_1", "user_co_2"} {
+			feedbacks = append(feedbacks, Feedback{FeedbackType: "like", UserId: userId, ItemId: itemId, Timestamp: timestamp})
+		}
+	}
+	feedbacks = append(feedbacks, Feedback{FeedbackType: "like", UserId: "user_co_3", ItemId: "item_co_1", Timestamp: timestamp})
+	_, err := suite.client.InsertFeedback(feedbacks)
+	suite.NoError(err)
+
+	// ask the master to reload the dataset and find neighbors
+	ctx := context.Background()
+	err = suite.redis.Set(ctx, "global_meta/data_imported", 1, 0).Err()
+	suite.NoError(err)
+	suite.Eventually(func() bool {
+		resp, err := suite.client.GetUserNeighbors("user_co_1", 2, 0)
+		if err != nil || len(resp) != 2 {
+			return false
+		}
+		return resp[0].Id == "user_co_2" && resp[1].Id == "user_co_3" && resp[0].Score > resp[1].Score
+	}, 2*time.Minute, time.Second)
+}
+
+func (suite *GorseClientTestSuite) TestTrending() {
+	// trending scores are fractional
+	ctx := context.Background()
+	suite.redis.ZAddArgs(ctx, "trending_items/100", redis.ZAddArgs{
+		Members: []redis.Z{
+			{
+				Score:  1.25,
+				Member: "1",
+			},
+			{
+				Score:  2.5,
+				Member: "2",
+			},
+			{
+				Score:  3.75,
+				Member: "3",
+			},
+		},
+	})
+
+	resp, err := suite.client.GetTrending("100", 2, 0)
+	suite.NoError(err)
+	suite.Equal([]Score{
+		{
+			Id:    "3",
+			Score: 3.75,
+		}, {
+			Id:    "2",
+			Score: 2.5,
+		},
+	}, resp)
+}
+
+func (suite *GorseClientTestSuite) TestPopularETag() {
+	ctx := context.Background()
+	suite.redis.ZAddArgs(ctx, "popular_items/200", redis.ZAddArgs{
+		Members: []redis.Z{{Score: 1, Member: "1"}, {Score: 2, Member: "2"}},
+	})
+	client := NewGorseClient(GorseEndpoint, GorseApiKey)
+	client.EnableETagCache(10)
+
+	// the local copy is used if not modified
+	resp, err := client.GetPopular("200", 10, 0)
+	suite.NoError(err)
+	suite.Equal([]Score{{Id: "2", Score: 2}, {Id: "1", Score: 1}}, resp)
+	resp, err = client.GetPopular("200", 10, 0)
+	suite.NoError(err)
+	suite.Equal([]Score{{Id: "2", Score: 2}, {Id: "1", Score: 1}}, resp)
+
+	// the local copy is replaced if modified
+	suite.redis.ZAddArgs(ctx, "popular_items/200", redis.ZAddArgs{
+		Members: []redis.Z{{Score: 3, Member: "3"}},
+	})
+	resp, err = client.GetPopular("200", 10, 0)
+	suite.NoError(err)
+	suite.Equal([]Score{{Id: "3", Score: 3}, {Id: "2", Score: 2}, {Id: "1", Score: 1}}, resp)
+}
+
+func (suite *GorseClientTestSuite) TestCovisitedItems() {
+	ctx := context.Background()
+	suite.redis.ZAddArgs(ctx, "covisited_items/100", redis.ZAddArgs{
+		Members: []redis.Z{
+			{
+				Score:  1,
+				Member: "1",
+			},
+			{
+				Score:  2,
+				Member: "2",
+			},
+			{
+				Score:  3,
+				Member: "3",
+			},
+		},
+	})
+
+	resp, err := suite.client.GetCovisitedItems("100", 2, 0)
+	suite.NoError(err)
+	suite.Equal([]Score{
+		{
+			Id:    "3",
+			Score: 3,
+		}, {
+			Id:    "2",
+			Score: 2,
+		},
+	}, resp)
+}
+
 func (suite *GorseClientTestSuite) TestUsers() {
 	user := User{
 		UserId:    "100",
@@ -314,6 +564,14 @@ func (suite *GorseClientTestSuite) TestItems() {
 	itemResp, err := suite.client.GetItem("100")
 	suite.NoError(err)
 	suite.Equal(item, itemResp)
+	itemResp, err = suite.client.GetItem("100", "Labels", "Comment")
+	suite.NoError(err)
+	suite.Equal(Item{ItemId: "100", Labels: []string{"a", "b", "c"}, Comment: "comment"}, itemResp)
+
+	categories, err := suite.client.ListCategories()
+	suite.NoError(err)
+	suite.Contains(categories.Categories, CategoryCount{Name: "d", Count: 1})
+	suite.Contains(categories.Categories, CategoryCount{Name: "e", Count: 1})
 
 	deleteAffect, err := suite.client.DeleteItem("100")
 	suite.NoError(err)
@@ -323,6 +581,194 @@ func (suite *GorseClientTestSuite) TestItems() {
 	suite.Equal("100: item not found", err.Error())
 }
 
+func (suite *GorseClientTestSuite) TestModifyItem() {
+	_, err := suite.client.InsertItem(Item{ItemId: "200", Labels: []string{"a"}, Categories: []string{"x"}})
+	suite.NoError(err)
+	// concurrent additions of different labels survive
+	var wg sync.WaitGroup
+	for _, label := range []string{"b", "c", "d"} {
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			_, err := suite.client.AddItemLabels("200", label)
+			suite.NoError(err)
+		}(label)
+	}
+	wg.Wait()
+	_, err = suite.client.RemoveItemLabels("200", "a")
+	suite.NoError(err)
+	_, err = suite.client.AddItemCategory("200", "y")
+	suite.NoError(err)
+	_, err = suite.client.RemoveItemCategory("200", "x")
+	suite.NoError(err)
+	item, err := suite.client.GetItem("200")
+	suite.NoError(err)
+	suite.ElementsMatch([]string{"b", "c", "d"}, item.Labels)
+	suite.Equal([]string{"y"}, item.Categories)
+
+	_, err = suite.client.InsertUser(User{UserId: "200", Labels: []string{"a"}})
+	suite.NoError(err)
+	_, err = suite.client.AddUserLabels("200", "b")
+	suite.NoError(err)
+	_, err = suite.client.RemoveUserLabels("200", "a")
+	suite.NoError(err)
+	user, err := suite.client.GetUser("200")
+	suite.NoError(err)
+	suite.Equal([]string{"b"}, user.Labels)
+	_, err = suite.client.Subscribe("200", "sports")
+	suite.NoError(err)
+	_, err = suite.client.Subscribe("200", "news")
+	suite.NoError(err)
+	_, err = suite.client.Unsubscribe("200", "news")
+	suite.NoError(err)
+	user, err = suite.client.GetUser("200")
+	suite.NoError(err)
+	suite.Equal([]string{"sports"}, user.Subscribe)
+
+	// modify items and users at versions
+	_, version, err := suite.client.GetItemVersion("200")
+	suite.NoError(err)
+	suite.NotEmpty(version)
+	_, err = suite.client.ModifyItem("200", ItemPatch{AddLabels: []string{"e"}, Version: version})
+	suite.NoError(err)
+	_, err = suite.client.ModifyItem("200", ItemPatch{AddLabels: []string{"f"}, Version: version})
+	suite.ErrorIs(err, ErrConflict)
+	_, version, err = suite.client.GetUserVersion("200")
+	suite.NoError(err)
+	_, err = suite.client.AddUserLabels("200", "c")
+	suite.NoError(err)
+	_, err = suite.client.ModifyUser("200", UserPatch{AddLabels: []string{"d"}, Version: version})
+	suite.ErrorIs(err, ErrConflict)
+}
+
+func (suite *GorseClientTestSuite) TestRules() {
+	rule := Rule{
+		RuleId:     "sponsored",
+		Action:     "pin",
+		Position:   2,
+		ItemIds:    []string{"100"},
+		Labels:     []string{},
+		Categories: []string{},
+		Scope:      []string{},
+		StartTime:  time.Unix(1660459054, 0).UTC(),
+		EndTime:    time.Unix(1760459054, 0).UTC(),
+		Comment:    "comment",
+	}
+	rowAffected, err := suite.client.InsertRule(rule)
+	suite.NoError(err)
+	suite.Equal(1, rowAffected.RowAffected)
+
+	ruleResp, err := suite.client.GetRule("sponsored")
+	suite.NoError(err)
+	suite.Equal(rule, ruleResp)
+
+	rule.Position = 3
+	rowAffected, err = suite.client.UpdateRule(rule)
+	suite.NoError(err)
+	suite.Equal(1, rowAffected.RowAffected)
+
+	rules, err := suite.client.ListRules()
+	suite.NoError(err)
+	suite.Contains(rules, rule)
+
+	deleteAffect, err := suite.client.DeleteRule("sponsored")
+	suite.NoError(err)
+	suite.Equal(1, deleteAffect.RowAffected)
+
+	_, err = suite.client.GetRule("sponsored")
+	suite.Error(err)
+}
+
+func (suite *GorseClientTestSuite) TestUserOverrides() {
+	overrides := UserOverrides{
+		UserId:  "1000",
+		Pinned:  []PinnedItem{{ItemId: "100", Position: 1, ExpireTime: time.Unix(1760459054, 0).UTC()}},
+		Blocked: []BlockedItem{{ItemId: "200", ExpireTime: time.Unix(1760459054, 0).UTC()}},
+	}
+	rowAffected, err := suite.client.SetUserOverrides(overrides)
+	suite.NoError(err)
+	suite.Equal(1, rowAffected.RowAffected)
+
+	resp, err := suite.client.GetUserOverrides("1000")
+	suite.NoError(err)
+	suite.Equal(overrides, resp)
+
+	deleteAffect, err := suite.client.DeleteUserOverrides("1000")
+	suite.NoError(err)
+	suite.Equal(1, deleteAffect.RowAffected)
+
+	_, err = suite.client.GetUserOverrides("1000")
+	suite.Error(err)
+}
+
+func (suite *GorseClientTestSuite) TestRecommendPreview() {
+	timestamp := time.Unix(1660459054, 0).UTC().Format(time.RFC3339)
+	_, err := suite.client.InsertFeedback([]Feedback{{
+		FeedbackType: "read",
+		UserId:       "1100",
+		Timestamp:    timestamp,
+		ItemId:       "300",
+	}})
+	suite.NoError(err)
+
+	preview, err := suite.client.Admin("").RecommendPreview("1100", "", 3)
+	suite.NoError(err)
+	suite.Equal("1100", preview.UserId)
+	suite.Equal([]string{"offline", "item_based", "latest", "popular"}, lo.Map(preview.Stages, func(stage PreviewStage, _ int) string {
+		return stage.Name
+	}))
+	suite.NotContains(preview.Results, "300")
+
+	// read feedback is not written back
+	feedback, err := suite.client.ListFeedbacks("read", "1100")
+	suite.NoError(err)
+	suite.Len(feedback, 1)
+}
+
+func (suite *GorseClientTestSuite) TestBlendWeights() {
+	admin := suite.client.Admin("")
+	weights := BlendWeights{CFWeight: 0.5, CTRWeight: 1, FreshnessWeight: 0.2, FreshnessHalfLife: time.Hour}
+	rowAffected, err := admin.SetBlendWeights(weights)
+	suite.NoError(err)
+	suite.Equal(1, rowAffected.RowAffected)
+
+	resp, err := admin.GetBlendWeights()
+	suite.NoError(err)
+	suite.Equal(weights, resp)
+
+	rowAffected, err = admin.ResetBlendWeights()
+	suite.NoError(err)
+	suite.Equal(1, rowAffected.RowAffected)
+
+	_, err = admin.SetBlendWeights(BlendWeights{CFWeight: -1, FreshnessHalfLife: time.Hour})
+	suite.Error(err)
+}
+
+func (suite *GorseClientTestSuite) TestExportEraseUser() {
+	timestamp := time.Unix(1660459054, 0).UTC().Format(time.RFC3339)
+	user := User{UserId: "1200", Labels: []string{"a"}, Subscribe: []string{}, Comment: "comment"}
+	_, err := suite.client.InsertUser(user)
+	suite.NoError(err)
+	_, err = suite.client.InsertFeedback([]Feedback{{
+		FeedbackType: "like",
+		UserId:       "1200",
+		Timestamp:    timestamp,
+		ItemId:       "300",
+	}})
+	suite.NoError(err)
+
+	export, err := suite.client.Admin("").ExportUser("1200")
+	suite.NoError(err)
+	suite.Equal(user, export.User)
+	suite.Len(export.Feedback, 1)
+
+	rowAffected, err := suite.client.Admin("").EraseUser("1200")
+	suite.NoError(err)
+	suite.Equal(1, rowAffected.RowAffected)
+	_, err = suite.client.Admin("").ExportUser("1200")
+	suite.Equal("1200: user not found", err.Error())
+}
+
 func TestGorseClientTestSuite(t *testing.T) {
 	suite.Run(t, new(GorseClientTestSuite))
 }
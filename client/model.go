@@ -14,11 +14,18 @@
 
 package client
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type Feedback struct {
 	FeedbackType string `json:"FeedbackType"`
 	UserId       string `json:"UserId"`
 	ItemId       string `json:"ItemId"`
 	Timestamp    string `json:"Timestamp"`
+	// Context is the context of the feedback, such as the device and the placement.
+	Context map[string]string `json:"Context,omitempty"`
 }
 
 type ErrorMessage string
@@ -32,8 +39,8 @@ type RowAffected struct {
 }
 
 type Score struct {
-	Id    string `json:"Id"`
-	Score int    `json:"Score"`
+	Id    string  `json:"Id"`
+	Score float64 `json:"Score"`
 }
 
 type User struct {
@@ -44,10 +51,217 @@ type User struct {
 }
 
 type Item struct {
-	ItemId     string   `json:"ItemId"`
-	IsHidden   bool     `json:"IsHidden"`
-	Labels     []string `json:"Labels"`
-	Categories []string `json:"Categories"`
-	Timestamp  string   `json:"Timestamp"`
-	Comment    string   `json:"Comment"`
+	ItemId       string   `json:"ItemId"`
+	IsHidden     bool     `json:"IsHidden"`
+	Labels       []string `json:"Labels"`
+	Categories   []string `json:"Categories"`
+	Timestamp    string   `json:"Timestamp"`
+	Comment      string   `json:"Comment"`
+	VisibleFrom  string   `json:"VisibleFrom,omitempty"`
+	VisibleUntil string   `json:"VisibleUntil,omitempty"`
+	HiddenReason string   `json:"HiddenReason,omitempty"`
+}
+
+// ItemPatch is the modification on an item. Labels and categories are added or removed atomically, so that concurrent
+// modifications of different elements don't overwrite each other.
+type ItemPatch struct {
+	IsHidden         *bool    `json:"IsHidden,omitempty"`
+	Categories       []string `json:"Categories,omitempty"`
+	Labels           []string `json:"Labels,omitempty"`
+	Comment          *string  `json:"Comment,omitempty"`
+	AddLabels        []string `json:"AddLabels,omitempty"`
+	RemoveLabels     []string `json:"RemoveLabels,omitempty"`
+	AddCategories    []string `json:"AddCategories,omitempty"`
+	RemoveCategories []string `json:"RemoveCategories,omitempty"`
+	// Version makes the modification conditional, which fails with ErrConflict if the item isn't at the version.
+	Version string `json:"Version,omitempty"`
+}
+
+// UserPatch is the modification on a user. Labels and subscriptions are added or removed atomically, so that
+// concurrent modifications of different elements don't overwrite each other.
+type UserPatch struct {
+	Labels          []string `json:"Labels,omitempty"`
+	Subscribe       []string `json:"Subscribe,omitempty"`
+	Comment         *string  `json:"Comment,omitempty"`
+	AddLabels       []string `json:"AddLabels,omitempty"`
+	RemoveLabels    []string `json:"RemoveLabels,omitempty"`
+	AddSubscribe    []string `json:"AddSubscribe,omitempty"`
+	RemoveSubscribe []string `json:"RemoveSubscribe,omitempty"`
+	// Version makes the modification conditional, which fails with ErrConflict if the user isn't at the version.
+	Version string `json:"Version,omitempty"`
+}
+
+type CategoryCount struct {
+	Name  string `json:"Name"`
+	Count int    `json:"Count"`
+}
+
+type Categories struct {
+	Categories  []CategoryCount `json:"Categories"`
+	Approximate bool            `json:"Approximate"`
+}
+
+type Scored struct {
+	Id    string  `json:"Id"`
+	Score float64 `json:"Score"`
+}
+
+type UserExport struct {
+	User     User                `json:"User"`
+	Feedback []Feedback          `json:"Feedback"`
+	Sorted   map[string][]Scored `json:"Sorted"`
+	Values   map[string]string   `json:"Values"`
+}
+
+type RecommendCandidate struct {
+	Id       string  `json:"Id"`
+	Score    float64 `json:"Score"`
+	Decision string  `json:"Decision"`
+}
+
+type PreviewStage struct {
+	Name       string               `json:"Name"`
+	Candidates []RecommendCandidate `json:"Candidates"`
+}
+
+type FiredOverride struct {
+	ItemId   string `json:"ItemId"`
+	Action   string `json:"Action"`
+	Position int    `json:"Position"`
+}
+
+type RecommendPreview struct {
+	UserId               string          `json:"UserId"`
+	Category             string          `json:"Category"`
+	OfflineRecommendTime time.Time       `json:"OfflineRecommendTime"`
+	StalenessSeconds     float64         `json:"StalenessSeconds"`
+	Stages               []PreviewStage  `json:"Stages"`
+	Results              []string        `json:"Results"`
+	Overrides            []FiredOverride `json:"Overrides"`
+	BlendWeights         *BlendWeights   `json:"BlendWeights"`
+	Blend                []BlendedItem   `json:"Blend"`
+}
+
+type BlendWeights struct {
+	CFWeight          float64       `json:"CFWeight"`
+	CTRWeight         float64       `json:"CTRWeight"`
+	FreshnessWeight   float64       `json:"FreshnessWeight"`
+	FreshnessHalfLife time.Duration `json:"FreshnessHalfLife"`
+}
+
+type BlendedItem struct {
+	ItemId    string  `json:"ItemId"`
+	CF        float64 `json:"CF"`
+	CTR       float64 `json:"CTR"`
+	Freshness float64 `json:"Freshness"`
+	Score     float64 `json:"Score"`
+}
+
+type Rule struct {
+	RuleId     string    `json:"RuleId"`
+	Action     string    `json:"Action"`
+	Position   int       `json:"Position"`
+	Weight     float64   `json:"Weight"`
+	ItemIds    []string  `json:"ItemIds"`
+	Labels     []string  `json:"Labels"`
+	Categories []string  `json:"Categories"`
+	Scope      []string  `json:"Scope"`
+	StartTime  time.Time `json:"StartTime"`
+	EndTime    time.Time `json:"EndTime"`
+	Comment    string    `json:"Comment"`
+}
+
+type PinnedItem struct {
+	ItemId     string    `json:"ItemId"`
+	Position   int       `json:"Position"`
+	ExpireTime time.Time `json:"ExpireTime"`
+}
+
+type BlockedItem struct {
+	ItemId     string    `json:"ItemId"`
+	ExpireTime time.Time `json:"ExpireTime"`
+}
+
+type UserOverrides struct {
+	UserId  string        `json:"UserId"`
+	Pinned  []PinnedItem  `json:"Pinned"`
+	Blocked []BlockedItem `json:"Blocked"`
+}
+
+type Task struct {
+	Name       string    `json:"Name"`
+	Status     string    `json:"Status"`
+	Done       int       `json:"Done"`
+	Total      int       `json:"Total"`
+	Progress   float64   `json:"Progress"`
+	StartTime  time.Time `json:"StartTime"`
+	FinishTime time.Time `json:"FinishTime"`
+	Error      string    `json:"Error"`
+	// Details is the result of the latest run of the task in JSON, which depends on the task.
+	Details json.RawMessage `json:"Details,omitempty"`
+}
+
+type Shard struct {
+	Worker     string    `json:"Worker"`
+	NumUsers   int       `json:"NumUsers"`
+	Status     string    `json:"Status"`
+	Progress   float64   `json:"Progress"`
+	UpdateTime time.Time `json:"UpdateTime"`
+}
+
+type StageRun struct {
+	Task    string `json:"Task"`
+	Started bool   `json:"Started"`
+}
+
+type DuplicateCluster struct {
+	CanonicalId string   `json:"CanonicalId"`
+	ItemIds     []string `json:"ItemIds"`
+}
+
+type ItemRefresh struct {
+	ItemId     string             `json:"ItemId"`
+	Categories []string           `json:"Categories"`
+	Neighbors  map[string][]Score `json:"Neighbors"`
+}
+
+type UserRefresh struct {
+	UserId    string  `json:"UserId"`
+	Refreshed bool    `json:"Refreshed"`
+	Recommend []Score `json:"Recommend"`
+}
+
+type DigestLookup struct {
+	Digest string `json:"Digest"`
+	UserId string `json:"UserId"`
+}
+
+type SnapshotRun struct {
+	Task    string `json:"Task"`
+	Started bool   `json:"Started"`
+}
+
+type LabelCount struct {
+	Name     string `json:"Name"`
+	NumItems int    `json:"NumItems"`
+	NumUsers int    `json:"NumUsers"`
+}
+
+type LabelRewriteRun struct {
+	Task    string `json:"Task"`
+	Started bool   `json:"Started"`
+}
+
+type LabelRewrite struct {
+	Kind       string    `json:"Kind"`
+	From       string    `json:"From"`
+	To         string    `json:"To"`
+	Stage      string    `json:"Stage"`
+	Cursor     string    `json:"Cursor"`
+	NumScanned int       `json:"NumScanned"`
+	NumItems   int       `json:"NumItems"`
+	NumUsers   int       `json:"NumUsers"`
+	StartTime  time.Time `json:"StartTime"`
+	UpdateTime time.Time `json:"UpdateTime"`
+	Error      string    `json:"Error"`
 }
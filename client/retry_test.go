@@ -0,0 +1,76 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGorseClient_Retry(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/item/1":
+			// the server fails twice before it recovers
+			if atomic.AddInt32(&attempts, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(`{"ItemId":"1"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("bad request"))
+		}
+	}))
+	defer server.Close()
+	var metrics []RequestMetrics
+	client := NewGorseClient(server.URL, "")
+	client.ObserveRequests(func(m RequestMetrics) {
+		metrics = append(metrics, m)
+	})
+
+	// requests aren't retried by default
+	_, err := client.GetItem("1")
+	assert.Error(t, err)
+	if assert.Len(t, metrics, 1) {
+		assert.Equal(t, http.StatusServiceUnavailable, metrics[0].Status)
+		assert.Zero(t, metrics[0].Retries)
+		assert.Error(t, metrics[0].Err)
+	}
+
+	// failed requests are retried
+	client.EnableRetry(3, time.Millisecond)
+	item, err := client.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", item.ItemId)
+	if assert.Len(t, metrics, 2) {
+		assert.Equal(t, http.StatusOK, metrics[1].Status)
+		assert.Equal(t, 1, metrics[1].Retries)
+		assert.NoError(t, metrics[1].Err)
+	}
+
+	// client errors aren't retried
+	_, err = client.GetItem("2")
+	assert.Equal(t, ErrorMessage("bad request"), err)
+	if assert.Len(t, metrics, 3) {
+		assert.Zero(t, metrics[2].Retries)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
+	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/cmd/version"
 	"github.com/zhenghaoz/gorse/config"
@@ -36,7 +37,6 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"os/signal"
 	"strings"
 )
 
@@ -106,20 +106,20 @@ var oneCommand = &cobra.Command{
 		// create master
 		cachePath, _ := cmd.PersistentFlags().GetString("cache-path")
 		m := master.NewMaster(conf, cachePath)
+		if !playgroundMode {
+			config.WatchConfig(true, m.ReloadConfig)
+		}
 		// Start worker
-		go func() {
-			workerJobs, _ := cmd.PersistentFlags().GetInt("recommend-jobs")
-			w := worker.NewWorker(conf.Master.Host, conf.Master.Port, conf.Master.Host,
-				0, workerJobs, "")
-			w.SetOneMode(m.Settings)
-			w.Serve()
-		}()
-		// Stop master
+		workerJobs, _ := cmd.PersistentFlags().GetInt("recommend-jobs")
+		w := worker.NewWorker(conf.Master.Host, conf.Master.Port, conf.Master.Host,
+			0, workerJobs, "")
+		w.SetOneMode(m.Settings)
+		go w.Serve()
+		// Stop worker and master
 		done := make(chan struct{})
 		go func() {
-			sigint := make(chan os.Signal, 1)
-			signal.Notify(sigint, os.Interrupt)
-			<-sigint
+			<-base.NotifyShutdown()
+			w.Shutdown()
 			m.Shutdown()
 			close(done)
 		}()
@@ -16,14 +16,13 @@ package main
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/cmd/version"
 	"github.com/zhenghaoz/gorse/config"
 	"github.com/zhenghaoz/gorse/master"
 	"go.uber.org/zap"
 	_ "net/http/pprof"
-	"os"
-	"os/signal"
 )
 
 var masterCommand = &cobra.Command{
@@ -56,12 +55,11 @@ var masterCommand = &cobra.Command{
 		}
 		cachePath, _ := cmd.PersistentFlags().GetString("cache-path")
 		m := master.NewMaster(conf, cachePath)
+		config.WatchConfig(false, m.ReloadConfig)
 		// Stop master
 		done := make(chan struct{})
 		go func() {
-			sigint := make(chan os.Signal, 1)
-			signal.Notify(sigint, os.Interrupt)
-			<-sigint
+			<-base.NotifyShutdown()
 			m.Shutdown()
 			close(done)
 		}()
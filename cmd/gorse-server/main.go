@@ -16,13 +16,12 @@ package main
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/cmd/version"
 	"github.com/zhenghaoz/gorse/server"
 	"go.uber.org/zap"
 	_ "net/http/pprof"
-	"os"
-	"os/signal"
 )
 
 var serverCommand = &cobra.Command{
@@ -60,9 +59,7 @@ var serverCommand = &cobra.Command{
 		// stop server
 		done := make(chan struct{})
 		go func() {
-			sigint := make(chan os.Signal, 1)
-			signal.Notify(sigint, os.Interrupt)
-			<-sigint
+			<-base.NotifyShutdown()
 			s.Shutdown()
 			close(done)
 		}()
@@ -16,6 +16,7 @@ package main
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/cmd/version"
 	"github.com/zhenghaoz/gorse/worker"
@@ -53,7 +54,20 @@ var workerCommand = &cobra.Command{
 		// create worker
 		cachePath, _ := cmd.PersistentFlags().GetString("cache-path")
 		w := worker.NewWorker(masterHost, masterPort, httpHost, httpPort, workingJobs, cachePath)
-		w.Serve()
+		if dryRun, _ := cmd.PersistentFlags().GetBool("dry-run"); dryRun {
+			w.SetDryRun()
+		}
+		// stop worker
+		done := make(chan struct{})
+		go func() {
+			<-base.NotifyShutdown()
+			w.Shutdown()
+			close(done)
+		}()
+		// start worker
+		go w.Serve()
+		<-done
+		log.Logger().Info("stop gorse worker successfully")
 	},
 }
 
@@ -67,6 +81,7 @@ func init() {
 	workerCommand.PersistentFlags().IntP("jobs", "j", 1, "number of working jobs.")
 	workerCommand.PersistentFlags().String("log-path", "", "path of log file")
 	workerCommand.PersistentFlags().String("cache-path", "worker_cache.data", "path of cache file")
+	workerCommand.PersistentFlags().Bool("dry-run", false, "write shadow recommendation for all users instead of serving them")
 }
 
 func main() {
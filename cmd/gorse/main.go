@@ -0,0 +1,454 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/spf13/cobra"
+	"github.com/zhenghaoz/gorse/client"
+	"github.com/zhenghaoz/gorse/client/bench"
+	"github.com/zhenghaoz/gorse/cmd/version"
+	"github.com/zhenghaoz/gorse/master"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/blob"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"github.com/zhenghaoz/gorse/storage/snapshot"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var rootCommand = &cobra.Command{
+	Use:   "gorse",
+	Short: "The command line tool of gorse recommender system.",
+	Run: func(cmd *cobra.Command, args []string) {
+		showVersion, _ := cmd.PersistentFlags().GetBool("version")
+		if showVersion {
+			fmt.Println(version.BuildInfo())
+			return
+		}
+		_ = cmd.Help()
+	},
+}
+
+var importCommand = &cobra.Command{
+	Use:   "import",
+	Short: "Import items or feedback from local files.",
+}
+
+var importItemsCommand = &cobra.Command{
+	Use:   "items <file>",
+	Short: "Import items from a csv or json lines file.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return importFile(cmd, "items", args[0])
+	},
+}
+
+var importFeedbackCommand = &cobra.Command{
+	Use:   "feedback <file>",
+	Short: "Import feedback from a csv or json lines file.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return importFile(cmd, "feedback", args[0])
+	},
+}
+
+// importFile streams a local file to the import endpoint and prints the summary.
+func importFile(cmd *cobra.Command, kind, path string) error {
+	endpoint, _ := cmd.Flags().GetString("endpoint")
+	apiKey, _ := cmd.Flags().GetString("api-key")
+	params := url.Values{}
+	for _, name := range []string{"format", "sep", "mapping", "label-sep"} {
+		if value, _ := cmd.Flags().GetString(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+	hasHeader, _ := cmd.Flags().GetBool("has-header")
+	params.Set("has-header", fmt.Sprint(hasHeader))
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+	request, err := http.NewRequest(http.MethodPost,
+		strings.TrimSuffix(endpoint, "/")+"/api/import/"+kind+"?"+params.Encode(), file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("X-API-Key", apiKey)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to import %s: %s", kind, strings.TrimSpace(string(body)))
+	}
+	var summary server.ImportSummary
+	if err = json.Unmarshal(body, &summary); err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("%d rows accepted, %d rows rejected\n", summary.RowsAccepted, summary.RowsRejected)
+	for _, rejection := range summary.Rejections {
+		fmt.Printf("line %d: %s\n", rejection.Line, rejection.Reason)
+	}
+	return nil
+}
+
+var tasksCommand = &cobra.Command{
+	Use:   "tasks",
+	Short: "Manage tasks of the master.",
+}
+
+var tasksRunCommand = &cobra.Command{
+	Use:   "run <stage>",
+	Short: "Run a pipeline stage immediately.",
+	Long: "Run a pipeline stage immediately. Valid stages are load_dataset, refresh_popular, refresh_latest, refresh_trending, refresh_covisit, " +
+		"find_item_neighbors, train_ranking and offline_recommend.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		endpoint, _ := cmd.Flags().GetString("endpoint")
+		apiKey, _ := cmd.Flags().GetString("api-key")
+		request, err := http.NewRequest(http.MethodPost,
+			strings.TrimSuffix(endpoint, "/")+"/api/dashboard/tasks/"+url.PathEscape(args[0])+"/run", nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		request.Header.Set("X-API-Key", apiKey)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			return errors.Errorf("failed to run %s: %s", args[0], strings.TrimSpace(string(body)))
+		}
+		var run master.StageRun
+		if err = json.Unmarshal(body, &run); err != nil {
+			return errors.Trace(err)
+		}
+		if run.Started {
+			fmt.Printf("%s started, poll progress of task \"%s\"\n", args[0], run.Task)
+		} else {
+			fmt.Printf("%s is running already, poll progress of task \"%s\"\n", args[0], run.Task)
+		}
+		return nil
+	},
+}
+
+var snapshotCommand = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Export a consistent snapshot of data and cache stores.",
+	Long: "Export a consistent snapshot of data and cache stores to the snapshot location of the master. Snapshots are " +
+		"incremental after the first full snapshot.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		endpoint, _ := cmd.Flags().GetString("endpoint")
+		apiKey, _ := cmd.Flags().GetString("api-key")
+		request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/api/admin/snapshot", nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		request.Header.Set("X-API-Key", apiKey)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			return errors.Errorf("failed to export snapshot: %s", strings.TrimSpace(string(body)))
+		}
+		var run master.SnapshotRun
+		if err = json.Unmarshal(body, &run); err != nil {
+			return errors.Trace(err)
+		}
+		if run.Started {
+			fmt.Printf("snapshot started, poll progress of task \"%s\"\n", run.Task)
+		} else {
+			fmt.Printf("snapshot is running already, poll progress of task \"%s\"\n", run.Task)
+		}
+		return nil
+	},
+}
+
+var restoreCommand = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a snapshot into fresh data and cache stores.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manifestPath, _ := cmd.Flags().GetString("manifest")
+		dataStore, _ := cmd.Flags().GetString("data-store")
+		cacheStore, _ := cmd.Flags().GetString("cache-store")
+		tablePrefix, _ := cmd.Flags().GetString("table-prefix")
+		force, _ := cmd.Flags().GetBool("force")
+		location, id, err := snapshot.ParseManifestPath(manifestPath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		store, err := blob.Open(location)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// open fresh stores
+		dataClient, err := data.Open(dataStore, tablePrefix)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer dataClient.Close()
+		if err = dataClient.Init(); err != nil {
+			return errors.Trace(err)
+		}
+		cacheClient, err := cache.Open(cacheStore, tablePrefix)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer cacheClient.Close()
+		if err = cacheClient.Init(); err != nil {
+			return errors.Trace(err)
+		}
+		if !force {
+			if _, users, err := dataClient.GetUsers("", 1); err != nil {
+				return errors.Trace(err)
+			} else if len(users) > 0 {
+				return errors.New("data store isn't empty, restore with --force to merge the snapshot")
+			}
+		}
+
+		restorer := &snapshot.Restorer{
+			Store:       store,
+			DataClient:  dataClient,
+			CacheClient: cacheClient,
+			BatchSize:   1000,
+			Progress: func(file snapshot.File) {
+				fmt.Printf("%s restored, %d rows\n", file.Name, file.Count)
+			},
+		}
+		return restorer.Restore(id)
+	},
+}
+
+var dataCommand = &cobra.Command{
+	Use:   "data",
+	Short: "Maintain the data store.",
+}
+
+var compressCommentsCommand = &cobra.Command{
+	Use:   "compress-comments",
+	Short: "Compress comments of existing items, users and feedback.",
+	Long: "Compress comments of existing items, users and feedback longer than the threshold in batches. Comments " +
+		"compressed already are skipped, so that the migration could be resumed after failures.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dataStore, _ := cmd.Flags().GetString("data-store")
+		tablePrefix, _ := cmd.Flags().GetString("table-prefix")
+		threshold, _ := cmd.Flags().GetInt("threshold")
+		batchSize, _ := cmd.Flags().GetInt("batch-size")
+		if threshold <= 0 || batchSize <= 0 {
+			return errors.New("threshold and batch size must be positive")
+		}
+		dataClient, err := data.Open(dataStore, tablePrefix)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer dataClient.Close()
+		// stats of each table are cumulative
+		saved := make(map[string]int64)
+		err = data.CompressComments(dataClient, threshold, batchSize, func(table string, stats data.CompressionStats) {
+			saved[table] = stats.BytesBefore - stats.BytesAfter
+			fmt.Printf("%s: %d rows compressed, %d bytes saved\n", table, stats.Rows, saved[table])
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("%d bytes saved in total\n", saved["items"]+saved["users"]+saved["feedback"])
+		return nil
+	},
+}
+
+var benchCommand = &cobra.Command{
+	Use:   "bench",
+	Short: "Drive synthetic traffic against a server to find the QPS it could serve.",
+	Long: "Generate a synthetic catalog and user base, seed feedback following a Zipf popularity distribution, and " +
+		"drive mixed traffic of recommend, feedback insert and item get by a ramping QPS schedule until the server is " +
+		"saturated. Traffic could be generated from multiple machines with the same seed and different node indices, " +
+		"each of which seeds its share of the dataset and sends its share of the target QPS.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		endpoint, _ := cmd.Flags().GetString("endpoint")
+		apiKey, _ := cmd.Flags().GetString("api-key")
+		skipSeed, _ := cmd.Flags().GetBool("skip-seed")
+		reportPath, _ := cmd.Flags().GetString("report")
+		retries, _ := cmd.Flags().GetInt("retries")
+		retryBackoff, _ := cmd.Flags().GetDuration("retry-backoff")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		config := bench.DefaultConfig()
+		config.NumUsers, _ = cmd.Flags().GetInt("users")
+		config.NumItems, _ = cmd.Flags().GetInt("items")
+		config.NumCategories, _ = cmd.Flags().GetInt("categories")
+		config.FeedbackPerUser, _ = cmd.Flags().GetInt("feedback-per-user")
+		config.FeedbackType, _ = cmd.Flags().GetString("feedback-type")
+		config.ZipfExponent, _ = cmd.Flags().GetFloat64("zipf-exponent")
+		config.Seed, _ = cmd.Flags().GetInt64("seed")
+		config.NumNodes, _ = cmd.Flags().GetInt("nodes")
+		config.NodeIndex, _ = cmd.Flags().GetInt("node-index")
+		config.BatchSize, _ = cmd.Flags().GetInt("batch-size")
+		config.RecommendRatio, _ = cmd.Flags().GetFloat64("recommend-ratio")
+		config.InsertRatio, _ = cmd.Flags().GetFloat64("insert-ratio")
+		config.GetItemRatio, _ = cmd.Flags().GetFloat64("get-item-ratio")
+		config.RecommendN, _ = cmd.Flags().GetInt("n")
+		config.StartQPS, _ = cmd.Flags().GetFloat64("start-qps")
+		config.StepQPS, _ = cmd.Flags().GetFloat64("step-qps")
+		config.MaxQPS, _ = cmd.Flags().GetFloat64("max-qps")
+		config.StepDuration, _ = cmd.Flags().GetDuration("step-duration")
+		config.Concurrency, _ = cmd.Flags().GetInt("concurrency")
+		config.MaxErrorRate, _ = cmd.Flags().GetFloat64("max-error-rate")
+		config.MaxP99Latency, _ = cmd.Flags().GetDuration("max-p99-latency")
+		if err := config.Validate(); err != nil {
+			return errors.Trace(err)
+		}
+
+		gorse := client.NewGorseClient(strings.TrimSuffix(endpoint, "/"), apiKey)
+		gorse.EnableRetry(retries, retryBackoff)
+		gorse.SetTimeout(timeout)
+		dataset := bench.NewDataset(config)
+		if !skipSeed {
+			var seeding string
+			if err := bench.Seed(gorse, dataset, func(name string, n int) {
+				if seeding != "" && seeding != name {
+					fmt.Println()
+				}
+				seeding = name
+				fmt.Printf("\r%s seeded: %d", name, n)
+			}); err != nil {
+				return errors.Trace(err)
+			}
+			fmt.Println()
+		}
+		report := bench.Run(gorse, dataset, func(stage bench.StageReport) {
+			total := stage.Operations[len(stage.Operations)-1]
+			fmt.Printf("%.0f QPS: achieved %.1f QPS, error rate %.2f%%, p99 %.1f ms\n",
+				stage.TargetQPS, stage.AchievedQPS, total.ErrorRate*100, total.P99)
+		})
+		fmt.Println()
+		if err := report.WriteTable(os.Stdout); err != nil {
+			return errors.Trace(err)
+		}
+		if reportPath != "" {
+			bytes, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err = os.WriteFile(reportPath, bytes, 0644); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCommand.PersistentFlags().BoolP("version", "v", false, "gorse version")
+	for _, command := range []*cobra.Command{importItemsCommand, importFeedbackCommand} {
+		command.Flags().String("endpoint", "http://127.0.0.1:8087", "endpoint of gorse server")
+		command.Flags().String("api-key", "", "admin api key")
+		command.Flags().String("format", "csv", "format of the file (csv or jsonl)")
+		command.Flags().String("sep", ",", "separator of csv")
+		command.Flags().Bool("has-header", true, "whether the first line of csv is a header")
+		command.Flags().String("mapping", "", "comma separated field:column pairs")
+		importCommand.AddCommand(command)
+	}
+	importItemsCommand.Flags().String("label-sep", "|", "separator of categories and labels in csv")
+	rootCommand.AddCommand(importCommand)
+	tasksRunCommand.Flags().String("endpoint", "http://127.0.0.1:8088", "endpoint of gorse master")
+	tasksRunCommand.Flags().String("api-key", "", "admin api key")
+	tasksCommand.AddCommand(tasksRunCommand)
+	rootCommand.AddCommand(tasksCommand)
+	snapshotCommand.Flags().String("endpoint", "http://127.0.0.1:8088", "endpoint of gorse master")
+	snapshotCommand.Flags().String("api-key", "", "admin api key")
+	rootCommand.AddCommand(snapshotCommand)
+	restoreCommand.Flags().String("manifest", "", "path of the manifest of the snapshot")
+	restoreCommand.Flags().String("data-store", "", "data store to restore into")
+	restoreCommand.Flags().String("cache-store", "", "cache store to restore into")
+	restoreCommand.Flags().String("table-prefix", "", "table prefix of data and cache stores")
+	restoreCommand.Flags().Bool("force", false, "restore into non-empty data store")
+	_ = restoreCommand.MarkFlagRequired("manifest")
+	_ = restoreCommand.MarkFlagRequired("data-store")
+	_ = restoreCommand.MarkFlagRequired("cache-store")
+	rootCommand.AddCommand(restoreCommand)
+	compressCommentsCommand.Flags().String("data-store", "", "data store to compress")
+	compressCommentsCommand.Flags().String("table-prefix", "", "table prefix of the data store")
+	compressCommentsCommand.Flags().Int("threshold", 1024, "comments longer than this number of bytes are compressed")
+	compressCommentsCommand.Flags().Int("batch-size", 1000, "number of rows read in a batch")
+	_ = compressCommentsCommand.MarkFlagRequired("data-store")
+	dataCommand.AddCommand(compressCommentsCommand)
+	rootCommand.AddCommand(dataCommand)
+	defaultBench := bench.DefaultConfig()
+	benchCommand.Flags().String("endpoint", "http://127.0.0.1:8087", "endpoint of gorse server")
+	benchCommand.Flags().String("api-key", "", "api key")
+	benchCommand.Flags().Bool("skip-seed", false, "skip seeding the dataset, which has been seeded by a previous run")
+	benchCommand.Flags().String("report", "", "path of the JSON report")
+	benchCommand.Flags().Int("retries", 0, "maximum number of retries of failed requests")
+	benchCommand.Flags().Duration("retry-backoff", 100*time.Millisecond, "backoff before the first retry")
+	benchCommand.Flags().Duration("timeout", 10*time.Second, "timeout of requests")
+	benchCommand.Flags().Int("users", defaultBench.NumUsers, "number of synthetic users")
+	benchCommand.Flags().Int("items", defaultBench.NumItems, "number of synthetic items")
+	benchCommand.Flags().Int("categories", defaultBench.NumCategories, "number of categories of items")
+	benchCommand.Flags().Int("feedback-per-user", defaultBench.FeedbackPerUser, "number of seeded feedback per user")
+	benchCommand.Flags().String("feedback-type", defaultBench.FeedbackType, "type of seeded and inserted feedback")
+	benchCommand.Flags().Float64("zipf-exponent", defaultBench.ZipfExponent, "exponent of the Zipf distribution of item popularity")
+	benchCommand.Flags().Int64("seed", defaultBench.Seed, "random seed shared by nodes of distributed generation")
+	benchCommand.Flags().Int("nodes", defaultBench.NumNodes, "number of nodes generating traffic")
+	benchCommand.Flags().Int("node-index", defaultBench.NodeIndex, "index of this node in [0, nodes)")
+	benchCommand.Flags().Int("batch-size", defaultBench.BatchSize, "number of rows inserted in a request while seeding")
+	benchCommand.Flags().Float64("recommend-ratio", defaultBench.RecommendRatio, "ratio of recommend requests")
+	benchCommand.Flags().Float64("insert-ratio", defaultBench.InsertRatio, "ratio of feedback insert requests")
+	benchCommand.Flags().Float64("get-item-ratio", defaultBench.GetItemRatio, "ratio of item get requests")
+	benchCommand.Flags().Int("n", defaultBench.RecommendN, "number of recommended items")
+	benchCommand.Flags().Float64("start-qps", defaultBench.StartQPS, "target QPS of all nodes in the first stage")
+	benchCommand.Flags().Float64("step-qps", defaultBench.StepQPS, "increase of target QPS per stage")
+	benchCommand.Flags().Float64("max-qps", defaultBench.MaxQPS, "target QPS of the last stage")
+	benchCommand.Flags().Duration("step-duration", defaultBench.StepDuration, "duration of each stage")
+	benchCommand.Flags().Int("concurrency", defaultBench.Concurrency, "maximum number of in-flight requests of this node")
+	benchCommand.Flags().Float64("max-error-rate", defaultBench.MaxErrorRate, "error rate beyond which the server is saturated")
+	benchCommand.Flags().Duration("max-p99-latency", defaultBench.MaxP99Latency, "99th percentile latency beyond which the server is saturated")
+	rootCommand.AddCommand(benchCommand)
+}
+
+func main() {
+	if err := rootCommand.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
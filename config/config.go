@@ -23,6 +23,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-playground/locales/en"
 	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
@@ -41,11 +42,17 @@ const (
 	NeighborTypeRelated = "related"
 )
 
+const (
+	SimilarityCosine  = "cosine"
+	SimilarityJaccard = "jaccard"
+)
+
 // Config is the configuration for the engine.
 type Config struct {
 	Database  DatabaseConfig  `mapstructure:"database"`
 	Master    MasterConfig    `mapstructure:"master"`
 	Server    ServerConfig    `mapstructure:"server"`
+	Worker    WorkerConfig    `mapstructure:"worker"`
 	Recommend RecommendConfig `mapstructure:"recommend"`
 }
 
@@ -54,55 +61,361 @@ type DatabaseConfig struct {
 	DataStore   string `mapstructure:"data_store" validate:"required,data_store"`   // database for data store
 	CacheStore  string `mapstructure:"cache_store" validate:"required,cache_store"` // database for cache store
 	TablePrefix string `mapstructure:"table_prefix"`
+	// IdObfuscationSecret is the secret to replace user ids in cache keys and logs with digests (disabled if empty).
+	IdObfuscationSecret string `mapstructure:"id_obfuscation_secret"`
+	// IdObfuscationPreviousSecret is the secret before rotation. Cache keys are written under digests of both secrets
+	// and read under digests of the previous secret as fallback until it is removed.
+	IdObfuscationPreviousSecret string `mapstructure:"id_obfuscation_previous_secret"`
+	// BlobStore is the blob store for large artifacts such as model checkpoints (disabled if empty).
+	BlobStore string `mapstructure:"blob_store"`
+	// CompressComments compresses comments of items, users and feedback longer than CommentCompressionThreshold bytes.
+	CompressComments            bool `mapstructure:"compress_comments"`
+	CommentCompressionThreshold int  `mapstructure:"comment_compression_threshold" validate:"gt=0"`
+	// BatchGetChunkSize is the max number of ids in a query when items are fetched in batches.
+	BatchGetChunkSize int `mapstructure:"batch_get_chunk_size" validate:"gt=0"`
+	// BatchGetJobs is the max number of queries running concurrently when items are fetched in batches.
+	BatchGetJobs int `mapstructure:"batch_get_jobs" validate:"gt=0"`
+	// HotFeedbackStore is the Redis serving feedback of users in HotFeedbackWindow in front of the data store
+	// (disabled if empty).
+	HotFeedbackStore  string        `mapstructure:"hot_feedback_store"`
+	HotFeedbackWindow time.Duration `mapstructure:"hot_feedback_window" validate:"gt=0"`
+	// ShadowDataStore receives all writes to the data store while migrating from the data store, and reads come from
+	// the data store only (disabled if empty). Failed writes are queued and retried every ShadowRetryInterval. Sampled
+	// users and items are compared between both stores every ShadowCheckPeriod (never if zero).
+	ShadowDataStore     string        `mapstructure:"shadow_data_store" validate:"omitempty,data_store"`
+	ShadowRetryInterval time.Duration `mapstructure:"shadow_retry_interval" validate:"gt=0"`
+	ShadowCheckPeriod   time.Duration `mapstructure:"shadow_check_period" validate:"gte=0"`
+	ShadowCheckSamples  int           `mapstructure:"shadow_check_samples" validate:"gt=0"`
+}
+
+// CommentThreshold returns the length of comments in bytes beyond which comments are compressed, or 0 if comments
+// are never compressed.
+func (config *DatabaseConfig) CommentThreshold() int {
+	if !config.CompressComments {
+		return 0
+	}
+	return config.CommentCompressionThreshold
 }
 
 // MasterConfig is the configuration for the master.
 type MasterConfig struct {
-	Port              int           `mapstructure:"port" validate:"gte=0"`        // master port
-	Host              string        `mapstructure:"host"`                         // master host
-	HttpPort          int           `mapstructure:"http_port" validate:"gte=0"`   // HTTP port
-	HttpHost          string        `mapstructure:"http_host"`                    // HTTP host
-	HttpCorsDomains   []string      `mapstructure:"http_cors_domains"`            // add allowed cors domains
-	HttpCorsMethods   []string      `mapstructure:"http_cors_methods"`            // add allowed cors methods
-	NumJobs           int           `mapstructure:"n_jobs" validate:"gt=0"`       // number of working jobs
-	MetaTimeout       time.Duration `mapstructure:"meta_timeout" validate:"gt=0"` // cluster meta timeout (second)
-	DashboardUserName string        `mapstructure:"dashboard_user_name"`          // dashboard user name
-	DashboardPassword string        `mapstructure:"dashboard_password"`           // dashboard password
+	Port                     int                `mapstructure:"port" validate:"gte=0"`                                    // master port
+	Host                     string             `mapstructure:"host"`                                                     // master host
+	HttpPort                 int                `mapstructure:"http_port" validate:"gte=0"`                               // HTTP port
+	HttpHost                 string             `mapstructure:"http_host"`                                                // HTTP host
+	HttpCorsDomains          []string           `mapstructure:"http_cors_domains"`                                        // add allowed cors domains
+	HttpCorsMethods          []string           `mapstructure:"http_cors_methods"`                                        // add allowed cors methods
+	NumJobs                  int                `mapstructure:"n_jobs" validate:"gt=0"`                                   // number of working jobs
+	MetaTimeout              time.Duration      `mapstructure:"meta_timeout" validate:"gt=0"`                             // cluster meta timeout (second)
+	DashboardUserName        string             `mapstructure:"dashboard_user_name"`                                      // dashboard user name
+	DashboardPassword        string             `mapstructure:"dashboard_password"`                                       // dashboard password
+	MaxRefreshPerMinute      int                `mapstructure:"max_refresh_per_minute" validate:"gt=0"`                   // max number of refreshes of single users or items every minute
+	SnapshotLocation         string             `mapstructure:"snapshot_location"`                                        // object storage location of snapshots (empty disables snapshots)
+	ModelRetention           int                `mapstructure:"model_retention" validate:"gte=0"`                         // number of archived models kept in the model registry
+	FeatureImportanceTopK    int                `mapstructure:"feature_importance_top_k" validate:"gte=0"`                // number of top features of click models kept in the model registry (0 disables it)
+	FeatureImportanceSamples int                `mapstructure:"feature_importance_samples" validate:"gte=0"`              // max number of holdout samples to compute permutation importance (0 uses all)
+	EmbeddingExportFormat    string             `mapstructure:"embedding_export_format" validate:"oneof=jsonl binary ''"` // format of embeddings exported to the blob store once ranking models go live (empty disables it)
+	Webhook                  WebhookConfig      `mapstructure:"webhook"`
+	Alert                    AlertConfig        `mapstructure:"alert"`
+	Verification             VerificationConfig `mapstructure:"verification"`
+}
+
+// VerificationConfig is the configuration of verifying cached documents against the data store. Sampled users and items
+// are verified in every run.
+type VerificationConfig struct {
+	Period   time.Duration `mapstructure:"period" validate:"gte=0"`  // period of verification (0 disables it)
+	NumUsers int           `mapstructure:"n_users" validate:"gte=0"` // number of sampled users in a run
+	NumItems int           `mapstructure:"n_items" validate:"gte=0"` // number of sampled items in a run
+}
+
+// WebhookConfig is the configuration of webhook notifications.
+type WebhookConfig struct {
+	URLs               []string      `mapstructure:"urls"`                                                                                                                                   // endpoints receiving notifications
+	Events             []string      `mapstructure:"events" validate:"dive,oneof=task_completed task_failed staleness_exceeded ingest_stalled quota_near_limit alert_firing alert_resolved"` // notified events (all events if empty)
+	Secret             string        `mapstructure:"secret"`                                                                                                                                 // secret to sign payloads
+	MaxRetries         int           `mapstructure:"max_retries" validate:"gte=0"`                                                                                                           // max number of retries of a delivery
+	StalenessThreshold time.Duration `mapstructure:"staleness_threshold" validate:"gte=0"`                                                                                                   // max staleness of offline recommendation (0 disables it)
+	IngestStallTimeout time.Duration `mapstructure:"ingest_stall_timeout" validate:"gte=0"`                                                                                                  // max duration without new feedback (0 disables it)
+}
+
+// Types of alert rules.
+const (
+	AlertTrainingStale = "training_stale" // no model has been trained for the duration
+	AlertIngestStalled = "ingest_stalled" // no feedback has been ingested for the duration
+	AlertCacheStale    = "cache_stale"    // the max staleness of offline recommendation exceeds the duration
+	AlertErrorRate     = "error_rate"     // the rate of server errors in the duration exceeds the threshold
+)
+
+// AlertConfig is the configuration of alerts evaluated by the master. Rules are reloaded once the config file changes.
+type AlertConfig struct {
+	EvaluationPeriod  time.Duration `mapstructure:"evaluation_period" validate:"gt=0"`  // period of evaluating rules
+	ResolvedRetention time.Duration `mapstructure:"resolved_retention" validate:"gt=0"` // period of listing resolved alerts
+	Rules             []AlertRule   `mapstructure:"rules" validate:"unique=Name,dive"`  // alert rules
+	SMTP              SMTPConfig    `mapstructure:"smtp"`                               // email alerts
+}
+
+// AlertRule fires an alert once its condition holds, and resolves the alert once the condition no longer holds.
+type AlertRule struct {
+	Name      string        `mapstructure:"name" validate:"required"`
+	Type      string        `mapstructure:"type" validate:"oneof=training_stale ingest_stalled cache_stale error_rate"`
+	Duration  time.Duration `mapstructure:"duration" validate:"gt=0"`
+	Threshold float64       `mapstructure:"threshold" validate:"gte=0,lte=1"` // max rate of server errors
+}
+
+// SMTPConfig is the configuration of the SMTP server sending alerts by email.
+type SMTPConfig struct {
+	Host     string   `mapstructure:"host"`                        // SMTP server host (empty disables emails)
+	Port     int      `mapstructure:"port" validate:"gt=0"`        // SMTP server port
+	Username string   `mapstructure:"username"`                    // user name for PLAIN authentication (empty disables authentication)
+	Password string   `mapstructure:"password"`                    // password for PLAIN authentication
+	From     string   `mapstructure:"from"`                        // sender address
+	To       []string `mapstructure:"to" validate:"dive,required"` // recipient addresses
 }
 
 // ServerConfig is the configuration for the server.
 type ServerConfig struct {
-	APIKey         string        `mapstructure:"api_key"`                      // default number of returned items
-	DefaultN       int           `mapstructure:"default_n" validate:"gt=0"`    // secret key for RESTful APIs (SSL required)
-	ClockError     time.Duration `mapstructure:"clock_error" validate:"gte=0"` // clock error in the cluster in seconds
-	AutoInsertUser bool          `mapstructure:"auto_insert_user"`             // insert new users while inserting feedback
-	AutoInsertItem bool          `mapstructure:"auto_insert_item"`             // insert new items while inserting feedback
-	CacheExpire    time.Duration `mapstructure:"cache_expire" validate:"gt=0"` // server-side cache expire time
+	APIKey         string        `mapstructure:"api_key"`                              // default number of returned items
+	AdminAPIKey    string        `mapstructure:"admin_api_key"`                        // secret key for administrative RESTful APIs
+	DefaultN       int           `mapstructure:"default_n" validate:"gt=0"`            // secret key for RESTful APIs (SSL required)
+	ClockError     time.Duration `mapstructure:"clock_error" validate:"gte=0"`         // clock error in the cluster in seconds
+	AutoInsertUser bool          `mapstructure:"auto_insert_user"`                     // insert new users while inserting feedback
+	AutoInsertItem bool          `mapstructure:"auto_insert_item"`                     // insert new items while inserting feedback
+	CacheExpire    time.Duration `mapstructure:"cache_expire" validate:"gt=0"`         // server-side cache expire time
+	ExploreRatio   float64       `mapstructure:"explore_ratio" validate:"gte=0,lte=1"` // fraction of recommendation replaced by explored items
+
+	LocalCacheSize            int           `mapstructure:"local_cache_size" validate:"gte=0"` // number of entries in the local cache (0 disables it)
+	LocalCacheTTL             time.Duration `mapstructure:"local_cache_ttl" validate:"gt=0"`   // max staleness of local cache entries
+	LocalCacheExcludePrefixes []string      `mapstructure:"local_cache_exclude_prefixes"`      // keys never cached locally
+
+	ImportJobs int `mapstructure:"import_jobs" validate:"gt=0"` // number of concurrent batch inserts of an import
+
+	DrainTimeout time.Duration `mapstructure:"drain_timeout" validate:"gt=0"` // max time to drain in-flight requests on shutdown
+
+	PageTokenTTL time.Duration `mapstructure:"page_token_ttl" validate:"gt=0"` // lifetime of recommendation snapshots paged by tokens
+
+	SessionIdleTTL time.Duration `mapstructure:"session_idle_ttl" validate:"gt=0"` // sessions expire after being idle for the TTL
+
+	FeedbackSkewTolerance time.Duration `mapstructure:"feedback_skew_tolerance" validate:"gte=0"` // max clock skew of feedback timestamps
+
+	ReadOnly bool `mapstructure:"read_only"` // reject writes for maintenance
+
+	CoalesceTimeout time.Duration `mapstructure:"coalesce_timeout" validate:"gte=0"` // max time to wait for coalesced reads (0 disables coalescing)
+
+	CacheControlMaxAge time.Duration `mapstructure:"cache_control_max_age" validate:"gte=0"` // max age of responses tagged by ETags
+
+	FeedbackValidation FeedbackValidationConfig `mapstructure:"feedback_validation"`
+	Quota              QuotaConfig              `mapstructure:"quota"`
+	Audit              AuditConfig              `mapstructure:"audit"`
+	Degraded           DegradedConfig           `mapstructure:"degraded"`
+	ShadowTraffic      ShadowTrafficConfig      `mapstructure:"shadow_traffic"`
+	Kafka              KafkaConfig              `mapstructure:"kafka"`
+	Enrichment         EnrichmentConfig         `mapstructure:"enrichment"`
+	WarmUp             WarmUpConfig             `mapstructure:"warm_up"`
+	WriteBack          WriteBackConfig          `mapstructure:"write_back"`
+	History            HistoryConfig            `mapstructure:"history"`
+}
+
+// HistoryConfig is the configuration of archiving served recommendation to reproduce it later.
+type HistoryConfig struct {
+	SampleRatio float64       `mapstructure:"sample_ratio" validate:"gte=0,lte=1"` // ratio of users whose recommendation is archived, 0 disables archiving
+	Bucket      time.Duration `mapstructure:"bucket" validate:"gt=0"`              // length of time buckets, the latest recommendation in a bucket is archived
+	Retention   time.Duration `mapstructure:"retention" validate:"gt=0"`           // period to keep archived recommendation
+}
+
+// WriteBackConfig is the configuration of writing back feedback of recommended items in the background.
+type WriteBackConfig struct {
+	BatchSize     int           `mapstructure:"batch_size" validate:"gt=0"`     // max number of feedback inserted in a batch
+	FlushInterval time.Duration `mapstructure:"flush_interval" validate:"gt=0"` // interval to flush delayed feedback
+	PollInterval  time.Duration `mapstructure:"poll_interval" validate:"gt=0"`  // interval to check whether writes are enabled in read-only mode
+}
+
+// WarmUpConfig is the configuration of warming up the local cache before a server is ready.
+type WarmUpConfig struct {
+	Keys        []string      `mapstructure:"keys"`                          // sorted sets to prefetch, keys ending with "/*" are expanded to categories
+	ActiveUsers int           `mapstructure:"active_users" validate:"gte=0"` // number of most recently active users whose recommendation is prefetched
+	Timeout     time.Duration `mapstructure:"timeout" validate:"gt=0"`       // deadline of warm-up, the server is ready once it exceeds
+}
+
+// EnrichmentConfig is the configuration of filling in metadata of items created automatically by feedback.
+type EnrichmentConfig struct {
+	URL        string        `mapstructure:"url"`                          // endpoint returning metadata of items (empty disables enrichment)
+	APIKey     string        `mapstructure:"api_key"`                      // API key sent to the endpoint
+	Timeout    time.Duration `mapstructure:"timeout" validate:"gt=0"`      // timeout of requests to the endpoint
+	BatchSize  int           `mapstructure:"batch_size" validate:"gt=0"`   // max number of items in a request
+	MaxRetries int           `mapstructure:"max_retries" validate:"gte=0"` // max number of retries of failed requests
+	RateLimit  float64       `mapstructure:"rate_limit" validate:"gte=0"`  // max number of requests per second (0 means unlimited)
+}
+
+// KafkaConfig is the configuration of consuming feedback from a Kafka topic.
+type KafkaConfig struct {
+	Brokers         []string           `mapstructure:"brokers"`                       // brokers of the Kafka cluster (empty disables the consumer)
+	Topic           string             `mapstructure:"topic"`                         // topic of feedback events
+	GroupId         string             `mapstructure:"group_id"`                      // consumer group of server nodes
+	DeadLetterTopic string             `mapstructure:"dead_letter_topic"`             // topic of invalid events (empty drops them)
+	BatchSize       int                `mapstructure:"batch_size" validate:"gt=0"`    // max number of events inserted in a batch
+	BatchTimeout    time.Duration      `mapstructure:"batch_timeout" validate:"gt=0"` // max time to wait for a full batch
+	FeedbackType    string             `mapstructure:"feedback_type"`                 // feedback type of events without the type field
+	Mapping         KafkaMappingConfig `mapstructure:"mapping"`
+}
+
+// KafkaMappingConfig is the mapping from fields of JSON events to fields of feedback. Fields are paths separated by
+// dots, such as "event.user.id".
+type KafkaMappingConfig struct {
+	FeedbackType string `mapstructure:"feedback_type"`
+	UserId       string `mapstructure:"user_id" validate:"required"`
+	ItemId       string `mapstructure:"item_id" validate:"required"`
+	Timestamp    string `mapstructure:"timestamp"`
+	Comment      string `mapstructure:"comment"`
+}
+
+// ShadowTrafficConfig is the configuration of replaying sampled requests against a secondary cluster.
+type ShadowTrafficConfig struct {
+	Target        string        `mapstructure:"target"`                                  // base URL of the secondary cluster (empty disables shadowing)
+	APIKey        string        `mapstructure:"api_key"`                                 // API key of the secondary cluster
+	SamplePercent float64       `mapstructure:"sample_percent" validate:"gte=0,lte=100"` // percentage of requests replayed
+	Timeout       time.Duration `mapstructure:"timeout" validate:"gt=0"`                 // timeout of replayed requests
+	Feedback      bool          `mapstructure:"feedback"`                                // replay feedback insertions as well
+	LogSize       int           `mapstructure:"log_size" validate:"gt=0"`                // max number of diffs kept in the rolling log
+}
+
+// DegradedConfig is the configuration of serving stale recommendation kept in process while the cache store is down.
+type DegradedConfig struct {
+	Enable           bool          `mapstructure:"enable"`                            // serve stale recommendation while the cache store is down
+	CacheSize        int           `mapstructure:"cache_size" validate:"gt=0"`        // max number of recommendation lists kept in process
+	FailureThreshold int           `mapstructure:"failure_threshold" validate:"gt=0"` // consecutive failures to open the circuit breaker
+	RetryInterval    time.Duration `mapstructure:"retry_interval" validate:"gt=0"`    // interval to probe the cache store while the circuit is open
+}
+
+// AuditConfig is the configuration of audit logs of mutating API calls.
+type AuditConfig struct {
+	Enable    bool          `mapstructure:"enable"`                     // write audit logs of mutating API calls
+	Retention time.Duration `mapstructure:"retention" validate:"gte=0"` // lifetime of audit logs (0 means forever)
+}
+
+// QuotaConfig is the configuration of soft quotas on the number of users and items. Zero means unlimited.
+type QuotaConfig struct {
+	MaxUsers     int     `mapstructure:"max_users" validate:"gte=0"`          // max number of users
+	MaxItems     int     `mapstructure:"max_items" validate:"gte=0"`          // max number of items
+	WarningRatio float64 `mapstructure:"warning_ratio" validate:"gt=0,lte=1"` // fraction of quotas to warn about
+}
+
+// FeedbackValidationConfig is the configuration of validating feedback inserted by RESTful APIs. Known feedback types
+// are allowed types and feedback types in [recommend.data_source].
+type FeedbackValidationConfig struct {
+	Strict        bool                     `mapstructure:"strict"`                                 // reject feedback of unknown types
+	Lowercase     bool                     `mapstructure:"lowercase"`                              // lowercase feedback types
+	Aliases       map[string]string        `mapstructure:"aliases"`                                // normalized types of aliases
+	AllowedTypes  []string                 `mapstructure:"allowed_types" validate:"dive,required"` // known feedback types besides data source
+	MaxFutureSkew map[string]time.Duration `mapstructure:"max_future_skew" validate:"dive,gte=0"`  // max skew of future timestamps of each type
+}
+
+// WorkerConfig is the configuration of resource budgets of workers. Budgets take effect on the next batch.
+type WorkerConfig struct {
+	TrainingJobs    int   `mapstructure:"training_jobs" validate:"gte=0"`     // max parallelism of building vector indices (0 means the number of jobs)
+	ScoringJobs     int   `mapstructure:"scoring_jobs" validate:"gte=0"`      // max parallelism of offline recommendation (0 means the number of jobs)
+	SoftMemoryLimit int64 `mapstructure:"soft_memory_limit" validate:"gte=0"` // soft limit of heap memory in bytes (0 means GOMEMLIMIT)
 }
 
 // RecommendConfig is the configuration of recommendation setup.
 type RecommendConfig struct {
-	CacheSize     int                 `mapstructure:"cache_size" validate:"gt=0"`
-	CacheExpire   time.Duration       `mapstructure:"cache_expire" validate:"gt=0"`
-	DataSource    DataSourceConfig    `mapstructure:"data_source"`
-	Popular       PopularConfig       `mapstructure:"popular"`
-	UserNeighbors NeighborsConfig     `mapstructure:"user_neighbors"`
-	ItemNeighbors NeighborsConfig     `mapstructure:"item_neighbors"`
-	Collaborative CollaborativeConfig `mapstructure:"collaborative"`
-	Replacement   ReplacementConfig   `mapstructure:"replacement"`
-	Offline       OfflineConfig       `mapstructure:"offline"`
-	Online        OnlineConfig        `mapstructure:"online"`
+	CacheSize         int                  `mapstructure:"cache_size" validate:"gt=0"`
+	CategoryCacheSize map[string]int       `mapstructure:"category_cache_size" validate:"dive,gt=0"` // lengths of cached recommendation overridden in categories
+	CacheExpire       time.Duration        `mapstructure:"cache_expire" validate:"gt=0"`
+	DataSource        DataSourceConfig     `mapstructure:"data_source"`
+	Popular           PopularConfig        `mapstructure:"popular"`
+	Trending          TrendingConfig       `mapstructure:"trending"`
+	Covisit           CovisitConfig        `mapstructure:"covisit"`
+	UserNeighbors     NeighborsConfig      `mapstructure:"user_neighbors"`
+	ItemNeighbors     ItemNeighborsConfig  `mapstructure:"item_neighbors"`
+	Collaborative     CollaborativeConfig  `mapstructure:"collaborative"`
+	Replacement       ReplacementConfig    `mapstructure:"replacement"`
+	Quality           QualityConfig        `mapstructure:"quality"`
+	Incremental       IncrementalConfig    `mapstructure:"incremental"`
+	Evaluation        EvaluationConfig     `mapstructure:"evaluation"`
+	Offline           OfflineConfig        `mapstructure:"offline"`
+	Online            OnlineConfig         `mapstructure:"online"`
+	Rerank            RerankConfig         `mapstructure:"rerank"`
+	Blend             BlendConfig          `mapstructure:"blend"`
+	Dedup             DedupConfig          `mapstructure:"dedup"`
+	ConsumedFilter    ConsumedFilterConfig `mapstructure:"consumed_filter"`
+	Subscription      SubscriptionConfig   `mapstructure:"subscription"`
 }
 
 type DataSourceConfig struct {
 	PositiveFeedbackTypes []string `mapstructure:"positive_feedback_types" validate:"min=1,dive,required"` // positive feedback type
 	ReadFeedbackTypes     []string `mapstructure:"read_feedback_types" validate:"min=1,dive,required"`     // feedback type for read event
+	NegativeFeedbackTypes []string `mapstructure:"negative_feedback_types" validate:"dive,required"`       // feedback type for negative event
 	PositiveFeedbackTTL   uint     `mapstructure:"positive_feedback_ttl" validate:"gte=0"`                 // time-to-live of positive feedbacks
 	ItemTTL               uint     `mapstructure:"item_ttl" validate:"gte=0"`                              // item-to-live of items
+	// PositiveFeedbackWeights are the confidence weights of positive feedback types in offline training.
+	PositiveFeedbackWeights map[string]float64 `mapstructure:"positive_feedback_weights" validate:"dive,gte=0"`
+	// ChunkSize is the number of feedback stored in a chunk of datasets during loading.
+	ChunkSize int `mapstructure:"chunk_size" validate:"gt=0"`
+	// ContextKeys are keys of feedback context used as categorical features of the click-through rate prediction model.
+	ContextKeys []string `mapstructure:"context_keys" validate:"dive,required"`
+	// ItemTimeField is the time of items ordering latest items, deciding fresh items and starting trending items, which
+	// is the timestamp of items (event time) or the time when items were inserted (ingestion time).
+	ItemTimeField string `mapstructure:"item_time_field" validate:"oneof=timestamp created_at"`
+	// Sampling bounds positive feedback loaded for training.
+	Sampling SamplingConfig `mapstructure:"sampling"`
+}
+
+// SamplingConfig is the configuration of sampling positive feedback during loading. Feedback is sampled by hashes of
+// feedback keys seeded by the random seed of collaborative filtering, so that the same feedback is sampled every time.
+type SamplingConfig struct {
+	MaxFeedbackPerUser int           `mapstructure:"max_feedback_per_user" validate:"gte=0"` // max number of the latest feedback of a user
+	SampleCutoff       time.Duration `mapstructure:"sample_cutoff" validate:"gte=0"`         // age of feedback to down-sample
+	SampleRate         float64       `mapstructure:"sample_rate" validate:"gte=0,lte=1"`     // rate of feedback older than the cutoff to keep
+	MaxFeedback        int           `mapstructure:"max_feedback" validate:"gte=0"`          // max number of feedback in total
 }
 
 type PopularConfig struct {
 	PopularWindow time.Duration `mapstructure:"popular_window" validate:"gte=0"`
+	HalfLife      time.Duration `mapstructure:"half_life" validate:"gte=0"` // 0 means no decay
+}
+
+// TrendingConfig is the configuration of trending items. The trending score of an item is the lower confidence bound
+// of the ratio of positive feedback in the latest window to positive feedback in the previous window, both added by the
+// smoothing constant.
+type TrendingConfig struct {
+	EnableTrending bool          `mapstructure:"enable_trending"`
+	TrendingWindow time.Duration `mapstructure:"trending_window" validate:"gt=0"`
+	Smoothing      float64       `mapstructure:"smoothing" validate:"gt=0"`
+}
+
+// CovisitConfig is the configuration of co-visitation counts of items, which are the numbers of users giving positive
+// feedback to both items in the time window. Only the latest items of each user are counted, so that users with long
+// histories never blow up the computation.
+type CovisitConfig struct {
+	EnableCovisit  bool          `mapstructure:"enable_covisit"`
+	CovisitWindow  time.Duration `mapstructure:"covisit_window" validate:"gt=0"`
+	FeedbackTypes  []string      `mapstructure:"feedback_types" validate:"dive,required"` // feedback types counted (empty means positive feedback types)
+	MaxUserHistory int           `mapstructure:"max_user_history" validate:"gt=0"`        // max number of the latest items of a user counted
+}
+
+type QualityConfig struct {
+	EnableQualityGate bool          `mapstructure:"enable_quality_gate"`
+	QualityWindow     time.Duration `mapstructure:"quality_window" validate:"gt=0"`
+	MinImpressions    int           `mapstructure:"min_impressions" validate:"gte=0"`
+	MinPositiveRatio  float64       `mapstructure:"min_positive_ratio" validate:"gte=0,lte=1"`
+}
+
+type IncrementalConfig struct {
+	EnableIncrementalUpdate bool          `mapstructure:"enable_incremental_update"`
+	UpdatePeriod            time.Duration `mapstructure:"update_period" validate:"gt=0"`
+	MaxFeedback             int           `mapstructure:"max_feedback" validate:"gt=0"`
+	NumEpochs               int           `mapstructure:"n_epochs" validate:"gt=0"`
+	LearningRate            float32       `mapstructure:"learning_rate" validate:"gt=0"`
+	Reg                     float32       `mapstructure:"reg" validate:"gte=0"`
+	MaxVocabularyGrowth     float64       `mapstructure:"max_vocabulary_growth" validate:"gte=0"`
+}
+
+type EvaluationConfig struct {
+	EnableEvaluation bool    `mapstructure:"enable_evaluation"`
+	TestRatio        float64 `mapstructure:"test_ratio" validate:"gt=0,lt=1"`
+	TopN             []int   `mapstructure:"top_n" validate:"min=1,dive,gt=0"`
+	NumTestUsers     int     `mapstructure:"num_test_users" validate:"gte=0"`
+	HistorySize      int     `mapstructure:"history_size" validate:"gt=0"`
 }
 
 type NeighborsConfig struct {
@@ -112,6 +425,33 @@ type NeighborsConfig struct {
 	IndexFitEpoch int     `mapstructure:"index_fit_epoch" validate:"gt=0"`
 }
 
+type ItemNeighborsConfig struct {
+	NeighborsConfig    `mapstructure:",squash"`
+	LabelSimilarity    string  `mapstructure:"label_similarity" validate:"oneof=cosine jaccard"`
+	FeedbackSimilarity string  `mapstructure:"feedback_similarity" validate:"oneof=cosine jaccard"`
+	HybridAlpha        float32 `mapstructure:"hybrid_alpha" validate:"gte=0,lte=1"`
+	MaxCategories      int     `mapstructure:"max_categories" validate:"gte=0"`
+	// EnableLSH enables candidate generation by locality-sensitive hashing for brute force searching once the number
+	// of items reaches LSHMinItems.
+	EnableLSH   bool `mapstructure:"enable_lsh"`
+	LSHMinItems int  `mapstructure:"lsh_min_items" validate:"gte=0"`
+	LSHNumBands int  `mapstructure:"lsh_num_bands" validate:"gt=0"`
+	LSHBandSize int  `mapstructure:"lsh_band_size" validate:"gt=0,lte=64"`
+}
+
+// Similarity describes the similarity function of item neighbors.
+func (config *ItemNeighborsConfig) Similarity() string {
+	switch config.NeighborType {
+	case NeighborTypeSimilar:
+		return fmt.Sprintf("%s(labels)", config.LabelSimilarity)
+	case NeighborTypeRelated:
+		return fmt.Sprintf("%s(feedback)", config.FeedbackSimilarity)
+	default:
+		return fmt.Sprintf("%v*%s(labels)+%v*%s(feedback)",
+			1-config.HybridAlpha, config.LabelSimilarity, config.HybridAlpha, config.FeedbackSimilarity)
+	}
+}
+
 type CollaborativeConfig struct {
 	ModelFitPeriod        time.Duration `mapstructure:"model_fit_period" validate:"gt=0"`
 	ModelSearchPeriod     time.Duration `mapstructure:"model_search_period" validate:"gt=0"`
@@ -121,6 +461,15 @@ type CollaborativeConfig struct {
 	EnableIndex           bool          `mapstructure:"enable_index"`
 	IndexRecall           float32       `mapstructure:"index_recall" validate:"gt=0"`
 	IndexFitEpoch         int           `mapstructure:"index_fit_epoch" validate:"gt=0"`
+	IndexMinItems         int           `mapstructure:"index_min_items" validate:"gte=0"`
+	// RandomSeed seeds weight initialization, negative sampling, dataset splitting and model searching.
+	RandomSeed int64 `mapstructure:"random_seed"`
+	// Deterministic trains models by stochastic gradient descent in a single job, so that models trained from the
+	// same data with the same seed are identical.
+	Deterministic bool `mapstructure:"deterministic"`
+	// CanaryPercent is the percentage of users served by the latest model, while other users are served by the
+	// previous model until the latest model is promoted.
+	CanaryPercent int `mapstructure:"canary_percent" validate:"gte=0,lte=100"`
 }
 
 type ReplacementConfig struct {
@@ -139,25 +488,136 @@ type OfflineConfig struct {
 	EnableItemBasedRecommend     bool               `mapstructure:"enable_item_based_recommend"`
 	EnableColRecommend           bool               `mapstructure:"enable_collaborative_recommend"`
 	EnableClickThroughPrediction bool               `mapstructure:"enable_click_through_prediction"`
+	PriorityRefreshQueueSize     int                `mapstructure:"priority_refresh_queue_size" validate:"gte=0"`
+	MaxPriorityRefreshPerMinute  int                `mapstructure:"max_priority_refresh_per_minute" validate:"gte=0"`
+	ShadowPrefix                 string             `mapstructure:"shadow_prefix" validate:"required"`
+	SkipUnchangedUsers           bool               `mapstructure:"skip_unchanged_users"`
+	MaxSkippedCycles             int                `mapstructure:"max_skipped_cycles" validate:"gte=0"`
 	exploreRecommendLock         sync.RWMutex
 }
 
 type OnlineConfig struct {
-	FallbackRecommend            []string `mapstructure:"fallback_recommend"`
-	NumFeedbackFallbackItemBased int      `mapstructure:"num_feedback_fallback_item_based" validate:"gt=0"`
+	FallbackRecommend            []string           `mapstructure:"fallback_recommend" validate:"dive,recommend_stage"`
+	NumFeedbackFallbackItemBased int                `mapstructure:"num_feedback_fallback_item_based" validate:"gt=0"`
+	SuppressionWindow            time.Duration      `mapstructure:"suppression_window" validate:"gte=0"`
+	FreshnessQuota               float64            `mapstructure:"freshness_quota" validate:"gte=0,lte=1"`
+	FreshnessWindow              time.Duration      `mapstructure:"freshness_window" validate:"gte=0"`
+	OfflineRecommendTTL          time.Duration      `mapstructure:"offline_recommend_ttl" validate:"gte=0"`
+	SessionRecommendTTL          time.Duration      `mapstructure:"session_recommend_ttl" validate:"gte=0"`
+	LabelWeights                 map[string]float64 `mapstructure:"label_weights"`
+	ExceedCacheSize              string             `mapstructure:"exceed_cache_size" validate:"oneof=fallback reject"`
+	// LatencyBudget is the default latency budget of recommendation requests, and fallback stages are skipped once the
+	// budget is exhausted. MaxLatencyBudget caps budgets requested by the X-Timeout header.
+	LatencyBudget    time.Duration `mapstructure:"latency_budget" validate:"gte=0"`
+	MaxLatencyBudget time.Duration `mapstructure:"max_latency_budget" validate:"gte=0"`
 }
 
+// Policies of requests for more items than the length of cached recommendation.
+const (
+	ExceedCacheSizeFallback = "fallback" // backfill by fallback recommenders
+	ExceedCacheSizeReject   = "reject"   // reject requests
+)
+
+// RerankConfig is the configuration of re-ranking candidates by an external scorer. The circuit is opened after
+// MaxFailures consecutive failures, and candidates keep their original order until the circuit is closed again.
+type RerankConfig struct {
+	Scorer        string        `mapstructure:"scorer" validate:"oneof=none http grpc"` // type of the external scorer
+	Stage         string        `mapstructure:"stage" validate:"oneof=server worker"`   // node re-ranking candidates
+	Endpoint      string        `mapstructure:"endpoint"`                               // endpoint of the http or grpc scorer
+	Timeout       time.Duration `mapstructure:"timeout" validate:"gt=0"`                // timeout of a scoring request
+	BatchSize     int           `mapstructure:"batch_size" validate:"gt=0"`             // max number of candidates in a scoring request
+	MaxFailures   int           `mapstructure:"max_failures" validate:"gt=0"`           // consecutive failures to open the circuit
+	BreakDuration time.Duration `mapstructure:"break_duration" validate:"gt=0"`         // duration before retrying the scorer
+}
+
+// BlendConfig is the configuration of blending collaborative filtering scores, click-through rates and freshness of
+// items into final scores. The weights are defaults, which are overridden by weights saved in the cache store.
+type BlendConfig struct {
+	EnableBlend       bool          `mapstructure:"enable_blend"`
+	CFWeight          float64       `mapstructure:"cf_weight" validate:"gte=0"`
+	CTRWeight         float64       `mapstructure:"ctr_weight" validate:"gte=0"`
+	FreshnessWeight   float64       `mapstructure:"freshness_weight" validate:"gte=0"`
+	FreshnessHalfLife time.Duration `mapstructure:"freshness_half_life" validate:"gt=0"`
+}
+
+// DedupConfig is the configuration of detecting near-duplicate items by MinHash similarity of labels and comments.
+type DedupConfig struct {
+	EnableDedup         bool    `mapstructure:"enable_dedup"`
+	SimilarityThreshold float64 `mapstructure:"similarity_threshold" validate:"gt=0,lte=1"`
+	NumHashes           int     `mapstructure:"num_hashes" validate:"gt=0"`
+}
+
+// ConsumedFilterConfig is the configuration of Bloom filters of items consumed by users, which replace queries of user
+// feedback when consumed items are excluded from online recommendation.
+type ConsumedFilterConfig struct {
+	EnableConsumedFilter bool `mapstructure:"enable_consumed_filter"`
+	BitsPerItem          int  `mapstructure:"bits_per_item" validate:"gt=0"`
+	NumHashes            int  `mapstructure:"num_hashes" validate:"gt=0,lte=255"`
+}
+
+// SubscriptionConfig is the configuration of recommending items of topics subscribed by users. Topics are labels and
+// categories of items, and candidate lists of topics are maintained by workers if the subscription stage is in the
+// fallback chain.
+type SubscriptionConfig struct {
+	Weight          float64       `mapstructure:"weight" validate:"gt=0"`            // weight of scores of subscription candidates merged into the chain
+	RecencyHalfLife time.Duration `mapstructure:"recency_half_life" validate:"gt=0"` // scores of items decay by half every half-life since published
+}
+
+// Stages in the fallback chain of online recommendation.
+const (
+	StageOffline       = "offline"
+	StageCollaborative = "collaborative"
+	StageItemBased     = "item_based"
+	StageUserBased     = "user_based"
+	StageLabelBased    = "label_based"
+	StageSubscription  = "subscription"
+	StageLatest        = "latest"
+	StagePopular       = "popular"
+)
+
+// RecommendStages are valid stages in the fallback chain of online recommendation.
+var RecommendStages = []string{StageOffline, StageCollaborative, StageItemBased, StageUserBased, StageLabelBased,
+	StageSubscription, StageLatest, StagePopular}
+
 func GetDefaultConfig() *Config {
 	return &Config{
+		Database: DatabaseConfig{
+			CommentCompressionThreshold: 1024,
+			BatchGetChunkSize:           1000,
+			BatchGetJobs:                4,
+			HotFeedbackWindow:           90 * 24 * time.Hour,
+			ShadowRetryInterval:         time.Minute,
+			ShadowCheckPeriod:           10 * time.Minute,
+			ShadowCheckSamples:          100,
+		},
 		Master: MasterConfig{
-			Port:            8086,
-			Host:            "0.0.0.0",
-			HttpPort:        8088,
-			HttpHost:        "0.0.0.0",
-			HttpCorsDomains: []string{".*"},
-			HttpCorsMethods: []string{"GET", "POST", "PUT", "DELETE", "PATCH"},
-			NumJobs:         1,
-			MetaTimeout:     10 * time.Second,
+			Port:                     8086,
+			Host:                     "0.0.0.0",
+			HttpPort:                 8088,
+			HttpHost:                 "0.0.0.0",
+			HttpCorsDomains:          []string{".*"},
+			HttpCorsMethods:          []string{"GET", "POST", "PUT", "DELETE", "PATCH"},
+			NumJobs:                  1,
+			MetaTimeout:              10 * time.Second,
+			MaxRefreshPerMinute:      60,
+			ModelRetention:           5,
+			FeatureImportanceTopK:    20,
+			FeatureImportanceSamples: 10000,
+			Webhook: WebhookConfig{
+				MaxRetries: 3,
+			},
+			Alert: AlertConfig{
+				EvaluationPeriod:  time.Minute,
+				ResolvedRetention: 24 * time.Hour,
+				SMTP: SMTPConfig{
+					Port: 587,
+				},
+			},
+			Verification: VerificationConfig{
+				Period:   time.Hour,
+				NumUsers: 100,
+				NumItems: 100,
+			},
 		},
 		Server: ServerConfig{
 			DefaultN:       10,
@@ -165,12 +625,111 @@ func GetDefaultConfig() *Config {
 			AutoInsertUser: true,
 			AutoInsertItem: true,
 			CacheExpire:    10 * time.Second,
+			ExploreRatio:   0,
+			LocalCacheSize: 0,
+			LocalCacheTTL:  time.Second,
+			LocalCacheExcludePrefixes: []string{
+				"offline_recommend",
+				"collaborative_recommend",
+				"ignore_items",
+				"user_neighbors",
+				"last_modify_user_time",
+				"last_update_user_recommend_time",
+				"last_update_user_neighbors_time",
+				"consumed_filter",
+				"session_feedback",
+				"session_active_time",
+			},
+			ImportJobs:            1,
+			DrainTimeout:          30 * time.Second,
+			PageTokenTTL:          10 * time.Minute,
+			SessionIdleTTL:        30 * time.Minute,
+			FeedbackSkewTolerance: 5 * time.Minute,
+			ReadOnly:              false,
+			CoalesceTimeout:       time.Second,
+			CacheControlMaxAge:    0,
+			FeedbackValidation: FeedbackValidationConfig{
+				Strict:    false,
+				Lowercase: false,
+			},
+			Quota: QuotaConfig{
+				WarningRatio: 0.9,
+			},
+			Audit: AuditConfig{
+				Enable:    false,
+				Retention: 90 * 24 * time.Hour,
+			},
+			Degraded: DegradedConfig{
+				Enable:           false,
+				CacheSize:        10000,
+				FailureThreshold: 5,
+				RetryInterval:    10 * time.Second,
+			},
+			ShadowTraffic: ShadowTrafficConfig{
+				SamplePercent: 1,
+				Timeout:       5 * time.Second,
+				Feedback:      false,
+				LogSize:       1000,
+			},
+			Kafka: KafkaConfig{
+				GroupId:      "gorse",
+				BatchSize:    1000,
+				BatchTimeout: time.Second,
+				Mapping: KafkaMappingConfig{
+					FeedbackType: "feedback_type",
+					UserId:       "user_id",
+					ItemId:       "item_id",
+					Timestamp:    "timestamp",
+					Comment:      "comment",
+				},
+			},
+			Enrichment: EnrichmentConfig{
+				Timeout:    10 * time.Second,
+				BatchSize:  100,
+				MaxRetries: 3,
+				RateLimit:  10,
+			},
+			WarmUp: WarmUpConfig{
+				Timeout: 30 * time.Second,
+			},
+			WriteBack: WriteBackConfig{
+				BatchSize:     1000,
+				FlushInterval: time.Second,
+				PollInterval:  10 * time.Second,
+			},
+			History: HistoryConfig{
+				Bucket:    time.Hour,
+				Retention: 7 * 24 * time.Hour,
+			},
+		},
+		Worker: WorkerConfig{
+			TrainingJobs:    0,
+			ScoringJobs:     0,
+			SoftMemoryLimit: 0,
 		},
 		Recommend: RecommendConfig{
 			CacheSize:   100,
 			CacheExpire: 72 * time.Hour,
+			DataSource: DataSourceConfig{
+				ChunkSize:     1024 * 1024,
+				ItemTimeField: "timestamp",
+				Sampling: SamplingConfig{
+					SampleRate: 1,
+				},
+			},
 			Popular: PopularConfig{
 				PopularWindow: 180 * 24 * time.Hour,
+				HalfLife:      72 * time.Hour,
+			},
+			Trending: TrendingConfig{
+				EnableTrending: false,
+				TrendingWindow: 24 * time.Hour,
+				Smoothing:      10,
+			},
+			Covisit: CovisitConfig{
+				EnableCovisit:  false,
+				CovisitWindow:  30 * 24 * time.Hour,
+				MaxUserHistory: 100,
 			},
 			UserNeighbors: NeighborsConfig{
 				NeighborType:  "auto",
@@ -178,11 +737,21 @@ func GetDefaultConfig() *Config {
 				IndexRecall:   0.8,
 				IndexFitEpoch: 3,
 			},
-			ItemNeighbors: NeighborsConfig{
-				NeighborType:  "auto",
-				EnableIndex:   true,
-				IndexRecall:   0.8,
-				IndexFitEpoch: 3,
+			ItemNeighbors: ItemNeighborsConfig{
+				NeighborsConfig: NeighborsConfig{
+					NeighborType:  "auto",
+					EnableIndex:   true,
+					IndexRecall:   0.8,
+					IndexFitEpoch: 3,
+				},
+				LabelSimilarity:    SimilarityCosine,
+				FeedbackSimilarity: SimilarityCosine,
+				HybridAlpha:        0.5,
+				MaxCategories:      0,
+				EnableLSH:          true,
+				LSHMinItems:        100000,
+				LSHNumBands:        16,
+				LSHBandSize:        4,
 			},
 			Collaborative: CollaborativeConfig{
 				ModelFitPeriod:    60 * time.Minute,
@@ -192,12 +761,35 @@ func GetDefaultConfig() *Config {
 				EnableIndex:       true,
 				IndexRecall:       0.9,
 				IndexFitEpoch:     3,
+				IndexMinItems:     10000,
 			},
 			Replacement: ReplacementConfig{
 				EnableReplacement:        false,
 				PositiveReplacementDecay: 0.8,
 				ReadReplacementDecay:     0.6,
 			},
+			Quality: QualityConfig{
+				EnableQualityGate: false,
+				QualityWindow:     7 * 24 * time.Hour,
+				MinImpressions:    100,
+				MinPositiveRatio:  0.01,
+			},
+			Incremental: IncrementalConfig{
+				EnableIncrementalUpdate: false,
+				UpdatePeriod:            10 * time.Minute,
+				MaxFeedback:             10000,
+				NumEpochs:               10,
+				LearningRate:            0.05,
+				Reg:                     0.01,
+				MaxVocabularyGrowth:     0.1,
+			},
+			Evaluation: EvaluationConfig{
+				EnableEvaluation: true,
+				TestRatio:        0.2,
+				TopN:             []int{10, 20},
+				NumTestUsers:     1000,
+				HistorySize:      100,
+			},
 			Offline: OfflineConfig{
 				CheckRecommendPeriod:         time.Minute,
 				RefreshRecommendPeriod:       120 * time.Hour,
@@ -207,10 +799,44 @@ func GetDefaultConfig() *Config {
 				EnableItemBasedRecommend:     false,
 				EnableColRecommend:           true,
 				EnableClickThroughPrediction: false,
+				PriorityRefreshQueueSize:     10000,
+				MaxPriorityRefreshPerMinute:  1000,
+				ShadowPrefix:                 "shadow_",
+				MaxSkippedCycles:             10,
 			},
 			Online: OnlineConfig{
 				FallbackRecommend:            []string{"latest"},
 				NumFeedbackFallbackItemBased: 10,
+				SuppressionWindow:            48 * time.Hour,
+				FreshnessQuota:               0,
+				FreshnessWindow:              24 * time.Hour,
+				ExceedCacheSize:              ExceedCacheSizeFallback,
+				MaxLatencyBudget:             time.Second,
+			},
+			Rerank: RerankConfig{
+				Scorer:        "none",
+				Stage:         "server",
+				Timeout:       100 * time.Millisecond,
+				BatchSize:     100,
+				MaxFailures:   5,
+				BreakDuration: 30 * time.Second,
+			},
+			Blend: BlendConfig{
+				CFWeight:          1,
+				CTRWeight:         1,
+				FreshnessHalfLife: 72 * time.Hour,
+			},
+			Dedup: DedupConfig{
+				SimilarityThreshold: 0.8,
+				NumHashes:           128,
+			},
+			ConsumedFilter: ConsumedFilterConfig{
+				BitsPerItem: 10,
+				NumHashes:   7,
+			},
+			Subscription: SubscriptionConfig{
+				Weight:          1,
+				RecencyHalfLife: 7 * 24 * time.Hour,
 			},
 		},
 	}
@@ -239,6 +865,8 @@ func (config *Config) UserNeighborDigest() string {
 func (config *Config) ItemNeighborDigest() string {
 	var builder strings.Builder
 	builder.WriteString(fmt.Sprintf("%v-%v", config.Recommend.ItemNeighbors.NeighborType, config.Recommend.ItemNeighbors.EnableIndex))
+	// similarity option
+	builder.WriteString(fmt.Sprintf("-%s", config.Recommend.ItemNeighbors.Similarity()))
 	// feedback option
 	if lo.Contains([]string{"auto", "related"}, config.Recommend.ItemNeighbors.NeighborType) {
 		builder.WriteString(fmt.Sprintf("-%s", strings.Join(config.Recommend.DataSource.PositiveFeedbackTypes, "-")))
@@ -251,6 +879,11 @@ func (config *Config) ItemNeighborDigest() string {
 	} else {
 		builder.WriteString("--")
 	}
+	// lsh option
+	if config.Recommend.ItemNeighbors.EnableLSH {
+		builder.WriteString(fmt.Sprintf("-%v-%v-%v", config.Recommend.ItemNeighbors.LSHMinItems,
+			config.Recommend.ItemNeighbors.LSHNumBands, config.Recommend.ItemNeighbors.LSHBandSize))
+	}
 
 	digest := md5.Sum([]byte(builder.String()))
 	return hex.EncodeToString(digest[:])
@@ -313,6 +946,9 @@ func (config *Config) OfflineRecommendDigest(option ...DigestOption) string {
 	))
 	if config.Recommend.Offline.EnablePopularRecommend {
 		builder.WriteString(fmt.Sprintf("-%v", config.Recommend.Popular.PopularWindow))
+		if config.Recommend.Popular.TimeDecayEnabled() {
+			builder.WriteString(fmt.Sprintf("-%v", config.Recommend.Popular.HalfLife))
+		}
 	}
 	if config.Recommend.Offline.EnableUserBasedRecommend {
 		builder.WriteString(fmt.Sprintf("-%v", options.userNeighborDigest))
@@ -331,11 +967,23 @@ func (config *Config) OfflineRecommendDigest(option ...DigestOption) string {
 		builder.WriteString(fmt.Sprintf("-%v-%v",
 			config.Recommend.Replacement.PositiveReplacementDecay, config.Recommend.Replacement.ReadReplacementDecay))
 	}
+	if len(config.Recommend.CategoryCacheSize) > 0 {
+		builder.WriteString(fmt.Sprintf("-%v", config.Recommend.CategoryCacheSize))
+	}
+	// weights are excluded since they are reloaded without regenerating recommendation
+	if config.Recommend.Blend.EnableBlend {
+		builder.WriteString("-blend")
+	}
 
 	digest := md5.Sum([]byte(builder.String()))
 	return hex.EncodeToString(digest[:])
 }
 
+// TimeDecayEnabled returns true if popularity scores are decayed by feedback age.
+func (config *PopularConfig) TimeDecayEnabled() bool {
+	return config.HalfLife > 0
+}
+
 func (config *OfflineConfig) Lock() {
 	config.exploreRecommendLock.Lock()
 }
@@ -354,8 +1002,54 @@ func (config *OfflineConfig) GetExploreRecommend(key string) (value float64, exi
 	return
 }
 
+// GetFeedbackWeight returns the weight of a positive feedback type in offline training. Feedback types are matched
+// case-insensitively and the default weight is 1.
+func (config *DataSourceConfig) GetFeedbackWeight(feedbackType string) float64 {
+	if weight, exist := config.PositiveFeedbackWeights[strings.ToLower(feedbackType)]; exist {
+		return weight
+	}
+	return 1
+}
+
+// CacheSizeOf returns the length of cached recommendation in a category. Categories are matched case-insensitively
+// since keys of maps in configuration files are lowercased.
+func (config *RecommendConfig) CacheSizeOf(category string) int {
+	if size, exist := config.CategoryCacheSize[strings.ToLower(category)]; exist && category != "" {
+		return size
+	}
+	return config.CacheSize
+}
+
+// MaxCacheSize returns the max length of cached recommendation in all categories.
+func (config *RecommendConfig) MaxCacheSize() int {
+	maxSize := config.CacheSize
+	for _, size := range config.CategoryCacheSize {
+		if size > maxSize {
+			maxSize = size
+		}
+	}
+	return maxSize
+}
+
+// GetLabelWeight returns the weight of a user label in label-based fallback recommendation. Labels are matched
+// case-insensitively and the default weight is 1.
+func (config *OnlineConfig) GetLabelWeight(label string) float64 {
+	if weight, exist := config.LabelWeights[strings.ToLower(label)]; exist {
+		return weight
+	}
+	return 1
+}
+
 func setDefault() {
 	defaultConfig := GetDefaultConfig()
+	// [database]
+	viper.SetDefault("database.comment_compression_threshold", defaultConfig.Database.CommentCompressionThreshold)
+	viper.SetDefault("database.batch_get_chunk_size", defaultConfig.Database.BatchGetChunkSize)
+	viper.SetDefault("database.batch_get_jobs", defaultConfig.Database.BatchGetJobs)
+	viper.SetDefault("database.hot_feedback_window", defaultConfig.Database.HotFeedbackWindow)
+	viper.SetDefault("database.shadow_retry_interval", defaultConfig.Database.ShadowRetryInterval)
+	viper.SetDefault("database.shadow_check_period", defaultConfig.Database.ShadowCheckPeriod)
+	viper.SetDefault("database.shadow_check_samples", defaultConfig.Database.ShadowCheckSamples)
 	// [master]
 	viper.SetDefault("master.port", defaultConfig.Master.Port)
 	viper.SetDefault("master.host", defaultConfig.Master.Host)
@@ -365,18 +1059,102 @@ func setDefault() {
 	viper.SetDefault("master.http_cors_methods", defaultConfig.Master.HttpCorsMethods)
 	viper.SetDefault("master.n_jobs", defaultConfig.Master.NumJobs)
 	viper.SetDefault("master.meta_timeout", defaultConfig.Master.MetaTimeout)
+	viper.SetDefault("master.max_refresh_per_minute", defaultConfig.Master.MaxRefreshPerMinute)
+	viper.SetDefault("master.model_retention", defaultConfig.Master.ModelRetention)
+	viper.SetDefault("master.feature_importance_top_k", defaultConfig.Master.FeatureImportanceTopK)
+	viper.SetDefault("master.feature_importance_samples", defaultConfig.Master.FeatureImportanceSamples)
+	viper.SetDefault("master.embedding_export_format", defaultConfig.Master.EmbeddingExportFormat)
+	viper.SetDefault("master.webhook.max_retries", defaultConfig.Master.Webhook.MaxRetries)
+	viper.SetDefault("master.webhook.staleness_threshold", defaultConfig.Master.Webhook.StalenessThreshold)
+	viper.SetDefault("master.webhook.ingest_stall_timeout", defaultConfig.Master.Webhook.IngestStallTimeout)
+	// [master.alert]
+	viper.SetDefault("master.alert.evaluation_period", defaultConfig.Master.Alert.EvaluationPeriod)
+	viper.SetDefault("master.alert.resolved_retention", defaultConfig.Master.Alert.ResolvedRetention)
+	viper.SetDefault("master.alert.smtp.port", defaultConfig.Master.Alert.SMTP.Port)
+	// [master.verification]
+	viper.SetDefault("master.verification.period", defaultConfig.Master.Verification.Period)
+	viper.SetDefault("master.verification.n_users", defaultConfig.Master.Verification.NumUsers)
+	viper.SetDefault("master.verification.n_items", defaultConfig.Master.Verification.NumItems)
 	// [server]
 	viper.SetDefault("server.api_key", defaultConfig.Server.APIKey)
+	viper.SetDefault("server.admin_api_key", defaultConfig.Server.AdminAPIKey)
 	viper.SetDefault("server.default_n", defaultConfig.Server.DefaultN)
 	viper.SetDefault("server.clock_error", defaultConfig.Server.ClockError)
 	viper.SetDefault("server.auto_insert_user", defaultConfig.Server.AutoInsertUser)
 	viper.SetDefault("server.auto_insert_item", defaultConfig.Server.AutoInsertItem)
 	viper.SetDefault("server.cache_expire", defaultConfig.Server.CacheExpire)
+	viper.SetDefault("server.explore_ratio", defaultConfig.Server.ExploreRatio)
+	viper.SetDefault("server.local_cache_size", defaultConfig.Server.LocalCacheSize)
+	viper.SetDefault("server.local_cache_ttl", defaultConfig.Server.LocalCacheTTL)
+	viper.SetDefault("server.local_cache_exclude_prefixes", defaultConfig.Server.LocalCacheExcludePrefixes)
+	viper.SetDefault("server.import_jobs", defaultConfig.Server.ImportJobs)
+	viper.SetDefault("server.drain_timeout", defaultConfig.Server.DrainTimeout)
+	viper.SetDefault("server.page_token_ttl", defaultConfig.Server.PageTokenTTL)
+	viper.SetDefault("server.session_idle_ttl", defaultConfig.Server.SessionIdleTTL)
+	viper.SetDefault("server.feedback_skew_tolerance", defaultConfig.Server.FeedbackSkewTolerance)
+	viper.SetDefault("server.read_only", defaultConfig.Server.ReadOnly)
+	viper.SetDefault("server.coalesce_timeout", defaultConfig.Server.CoalesceTimeout)
+	viper.SetDefault("server.cache_control_max_age", defaultConfig.Server.CacheControlMaxAge)
+	viper.SetDefault("server.feedback_validation.strict", defaultConfig.Server.FeedbackValidation.Strict)
+	viper.SetDefault("server.feedback_validation.lowercase", defaultConfig.Server.FeedbackValidation.Lowercase)
+	viper.SetDefault("server.quota.max_users", defaultConfig.Server.Quota.MaxUsers)
+	viper.SetDefault("server.quota.max_items", defaultConfig.Server.Quota.MaxItems)
+	viper.SetDefault("server.quota.warning_ratio", defaultConfig.Server.Quota.WarningRatio)
+	viper.SetDefault("server.audit.enable", defaultConfig.Server.Audit.Enable)
+	viper.SetDefault("server.audit.retention", defaultConfig.Server.Audit.Retention)
+	viper.SetDefault("server.degraded.enable", defaultConfig.Server.Degraded.Enable)
+	viper.SetDefault("server.degraded.cache_size", defaultConfig.Server.Degraded.CacheSize)
+	viper.SetDefault("server.degraded.failure_threshold", defaultConfig.Server.Degraded.FailureThreshold)
+	viper.SetDefault("server.degraded.retry_interval", defaultConfig.Server.Degraded.RetryInterval)
+	viper.SetDefault("server.shadow_traffic.sample_percent", defaultConfig.Server.ShadowTraffic.SamplePercent)
+	viper.SetDefault("server.shadow_traffic.timeout", defaultConfig.Server.ShadowTraffic.Timeout)
+	viper.SetDefault("server.shadow_traffic.feedback", defaultConfig.Server.ShadowTraffic.Feedback)
+	viper.SetDefault("server.shadow_traffic.log_size", defaultConfig.Server.ShadowTraffic.LogSize)
+	viper.SetDefault("server.kafka.group_id", defaultConfig.Server.Kafka.GroupId)
+	viper.SetDefault("server.kafka.batch_size", defaultConfig.Server.Kafka.BatchSize)
+	viper.SetDefault("server.kafka.batch_timeout", defaultConfig.Server.Kafka.BatchTimeout)
+	viper.SetDefault("server.kafka.mapping.feedback_type", defaultConfig.Server.Kafka.Mapping.FeedbackType)
+	viper.SetDefault("server.kafka.mapping.user_id", defaultConfig.Server.Kafka.Mapping.UserId)
+	viper.SetDefault("server.kafka.mapping.item_id", defaultConfig.Server.Kafka.Mapping.ItemId)
+	viper.SetDefault("server.kafka.mapping.timestamp", defaultConfig.Server.Kafka.Mapping.Timestamp)
+	viper.SetDefault("server.kafka.mapping.comment", defaultConfig.Server.Kafka.Mapping.Comment)
+	viper.SetDefault("server.enrichment.timeout", defaultConfig.Server.Enrichment.Timeout)
+	viper.SetDefault("server.enrichment.batch_size", defaultConfig.Server.Enrichment.BatchSize)
+	viper.SetDefault("server.enrichment.max_retries", defaultConfig.Server.Enrichment.MaxRetries)
+	viper.SetDefault("server.enrichment.rate_limit", defaultConfig.Server.Enrichment.RateLimit)
+	viper.SetDefault("server.warm_up.timeout", defaultConfig.Server.WarmUp.Timeout)
+	viper.SetDefault("server.write_back.batch_size", defaultConfig.Server.WriteBack.BatchSize)
+	viper.SetDefault("server.write_back.flush_interval", defaultConfig.Server.WriteBack.FlushInterval)
+	viper.SetDefault("server.write_back.poll_interval", defaultConfig.Server.WriteBack.PollInterval)
+	viper.SetDefault("server.history.sample_ratio", defaultConfig.Server.History.SampleRatio)
+	viper.SetDefault("server.history.bucket", defaultConfig.Server.History.Bucket)
+	viper.SetDefault("server.history.retention", defaultConfig.Server.History.Retention)
+	// [worker]
+	viper.SetDefault("worker.training_jobs", defaultConfig.Worker.TrainingJobs)
+	viper.SetDefault("worker.scoring_jobs", defaultConfig.Worker.ScoringJobs)
+	viper.SetDefault("worker.soft_memory_limit", defaultConfig.Worker.SoftMemoryLimit)
 	// [recommend]
 	viper.SetDefault("recommend.cache_size", defaultConfig.Recommend.CacheSize)
 	viper.SetDefault("recommend.cache_expire", defaultConfig.Recommend.CacheExpire)
+	// [recommend.data_source]
+	viper.SetDefault("recommend.data_source.chunk_size", defaultConfig.Recommend.DataSource.ChunkSize)
+	viper.SetDefault("recommend.data_source.item_time_field", defaultConfig.Recommend.DataSource.ItemTimeField)
+	// [recommend.data_source.sampling]
+	viper.SetDefault("recommend.data_source.sampling.max_feedback_per_user", defaultConfig.Recommend.DataSource.Sampling.MaxFeedbackPerUser)
+	viper.SetDefault("recommend.data_source.sampling.sample_cutoff", defaultConfig.Recommend.DataSource.Sampling.SampleCutoff)
+	viper.SetDefault("recommend.data_source.sampling.sample_rate", defaultConfig.Recommend.DataSource.Sampling.SampleRate)
+	viper.SetDefault("recommend.data_source.sampling.max_feedback", defaultConfig.Recommend.DataSource.Sampling.MaxFeedback)
 	// [recommend.popular]
 	viper.SetDefault("recommend.popular.popular_window", defaultConfig.Recommend.Popular.PopularWindow)
+	viper.SetDefault("recommend.popular.half_life", defaultConfig.Recommend.Popular.HalfLife)
+	// [recommend.trending]
+	viper.SetDefault("recommend.trending.enable_trending", defaultConfig.Recommend.Trending.EnableTrending)
+	viper.SetDefault("recommend.trending.trending_window", defaultConfig.Recommend.Trending.TrendingWindow)
+	viper.SetDefault("recommend.trending.smoothing", defaultConfig.Recommend.Trending.Smoothing)
+	// [recommend.covisit]
+	viper.SetDefault("recommend.covisit.enable_covisit", defaultConfig.Recommend.Covisit.EnableCovisit)
+	viper.SetDefault("recommend.covisit.covisit_window", defaultConfig.Recommend.Covisit.CovisitWindow)
+	viper.SetDefault("recommend.covisit.max_user_history", defaultConfig.Recommend.Covisit.MaxUserHistory)
 	// [recommend.user_neighbors]
 	viper.SetDefault("recommend.user_neighbors.neighbor_type", defaultConfig.Recommend.UserNeighbors.NeighborType)
 	viper.SetDefault("recommend.user_neighbors.enable_index", defaultConfig.Recommend.UserNeighbors.EnableIndex)
@@ -387,6 +1165,14 @@ func setDefault() {
 	viper.SetDefault("recommend.item_neighbors.enable_index", defaultConfig.Recommend.ItemNeighbors.EnableIndex)
 	viper.SetDefault("recommend.item_neighbors.index_recall", defaultConfig.Recommend.ItemNeighbors.IndexRecall)
 	viper.SetDefault("recommend.item_neighbors.index_fit_epoch", defaultConfig.Recommend.ItemNeighbors.IndexFitEpoch)
+	viper.SetDefault("recommend.item_neighbors.label_similarity", defaultConfig.Recommend.ItemNeighbors.LabelSimilarity)
+	viper.SetDefault("recommend.item_neighbors.feedback_similarity", defaultConfig.Recommend.ItemNeighbors.FeedbackSimilarity)
+	viper.SetDefault("recommend.item_neighbors.hybrid_alpha", defaultConfig.Recommend.ItemNeighbors.HybridAlpha)
+	viper.SetDefault("recommend.item_neighbors.max_categories", defaultConfig.Recommend.ItemNeighbors.MaxCategories)
+	viper.SetDefault("recommend.item_neighbors.enable_lsh", defaultConfig.Recommend.ItemNeighbors.EnableLSH)
+	viper.SetDefault("recommend.item_neighbors.lsh_min_items", defaultConfig.Recommend.ItemNeighbors.LSHMinItems)
+	viper.SetDefault("recommend.item_neighbors.lsh_num_bands", defaultConfig.Recommend.ItemNeighbors.LSHNumBands)
+	viper.SetDefault("recommend.item_neighbors.lsh_band_size", defaultConfig.Recommend.ItemNeighbors.LSHBandSize)
 	// [recommend.collaborative]
 	viper.SetDefault("recommend.collaborative.model_fit_period", defaultConfig.Recommend.Collaborative.ModelFitPeriod)
 	viper.SetDefault("recommend.collaborative.model_search_period", defaultConfig.Recommend.Collaborative.ModelSearchPeriod)
@@ -395,10 +1181,33 @@ func setDefault() {
 	viper.SetDefault("recommend.collaborative.enable_index", defaultConfig.Recommend.Collaborative.EnableIndex)
 	viper.SetDefault("recommend.collaborative.index_recall", defaultConfig.Recommend.Collaborative.IndexRecall)
 	viper.SetDefault("recommend.collaborative.index_fit_epoch", defaultConfig.Recommend.Collaborative.IndexFitEpoch)
+	viper.SetDefault("recommend.collaborative.index_min_items", defaultConfig.Recommend.Collaborative.IndexMinItems)
+	viper.SetDefault("recommend.collaborative.random_seed", defaultConfig.Recommend.Collaborative.RandomSeed)
+	viper.SetDefault("recommend.collaborative.deterministic", defaultConfig.Recommend.Collaborative.Deterministic)
+	viper.SetDefault("recommend.collaborative.canary_percent", defaultConfig.Recommend.Collaborative.CanaryPercent)
 	// [recommend.replacement]
 	viper.SetDefault("recommend.replacement.enable_replacement", defaultConfig.Recommend.Replacement.EnableReplacement)
 	viper.SetDefault("recommend.replacement.positive_replacement_decay", defaultConfig.Recommend.Replacement.PositiveReplacementDecay)
 	viper.SetDefault("recommend.replacement.read_replacement_decay", defaultConfig.Recommend.Replacement.ReadReplacementDecay)
+	// [recommend.quality]
+	viper.SetDefault("recommend.quality.enable_quality_gate", defaultConfig.Recommend.Quality.EnableQualityGate)
+	viper.SetDefault("recommend.quality.quality_window", defaultConfig.Recommend.Quality.QualityWindow)
+	viper.SetDefault("recommend.quality.min_impressions", defaultConfig.Recommend.Quality.MinImpressions)
+	viper.SetDefault("recommend.quality.min_positive_ratio", defaultConfig.Recommend.Quality.MinPositiveRatio)
+	// [recommend.incremental]
+	viper.SetDefault("recommend.incremental.enable_incremental_update", defaultConfig.Recommend.Incremental.EnableIncrementalUpdate)
+	viper.SetDefault("recommend.incremental.update_period", defaultConfig.Recommend.Incremental.UpdatePeriod)
+	viper.SetDefault("recommend.incremental.max_feedback", defaultConfig.Recommend.Incremental.MaxFeedback)
+	viper.SetDefault("recommend.incremental.n_epochs", defaultConfig.Recommend.Incremental.NumEpochs)
+	viper.SetDefault("recommend.incremental.learning_rate", defaultConfig.Recommend.Incremental.LearningRate)
+	viper.SetDefault("recommend.incremental.reg", defaultConfig.Recommend.Incremental.Reg)
+	viper.SetDefault("recommend.incremental.max_vocabulary_growth", defaultConfig.Recommend.Incremental.MaxVocabularyGrowth)
+	// [recommend.evaluation]
+	viper.SetDefault("recommend.evaluation.enable_evaluation", defaultConfig.Recommend.Evaluation.EnableEvaluation)
+	viper.SetDefault("recommend.evaluation.test_ratio", defaultConfig.Recommend.Evaluation.TestRatio)
+	viper.SetDefault("recommend.evaluation.top_n", defaultConfig.Recommend.Evaluation.TopN)
+	viper.SetDefault("recommend.evaluation.num_test_users", defaultConfig.Recommend.Evaluation.NumTestUsers)
+	viper.SetDefault("recommend.evaluation.history_size", defaultConfig.Recommend.Evaluation.HistorySize)
 	// [recommend.offline]
 	viper.SetDefault("recommend.offline.check_recommend_period", defaultConfig.Recommend.Offline.CheckRecommendPeriod)
 	viper.SetDefault("recommend.offline.refresh_recommend_period", defaultConfig.Recommend.Offline.RefreshRecommendPeriod)
@@ -408,9 +1217,45 @@ func setDefault() {
 	viper.SetDefault("recommend.offline.enable_item_based_recommend", defaultConfig.Recommend.Offline.EnableItemBasedRecommend)
 	viper.SetDefault("recommend.offline.enable_collaborative_recommend", defaultConfig.Recommend.Offline.EnableColRecommend)
 	viper.SetDefault("recommend.offline.enable_click_through_prediction", defaultConfig.Recommend.Offline.EnableClickThroughPrediction)
+	viper.SetDefault("recommend.offline.priority_refresh_queue_size", defaultConfig.Recommend.Offline.PriorityRefreshQueueSize)
+	viper.SetDefault("recommend.offline.max_priority_refresh_per_minute", defaultConfig.Recommend.Offline.MaxPriorityRefreshPerMinute)
+	viper.SetDefault("recommend.offline.shadow_prefix", defaultConfig.Recommend.Offline.ShadowPrefix)
+	viper.SetDefault("recommend.offline.max_skipped_cycles", defaultConfig.Recommend.Offline.MaxSkippedCycles)
 	// [recommend.online]
 	viper.SetDefault("recommend.online.fallback_recommend", defaultConfig.Recommend.Online.FallbackRecommend)
 	viper.SetDefault("recommend.online.num_feedback_fallback_item_based", defaultConfig.Recommend.Online.NumFeedbackFallbackItemBased)
+	viper.SetDefault("recommend.online.suppression_window", defaultConfig.Recommend.Online.SuppressionWindow)
+	viper.SetDefault("recommend.online.freshness_quota", defaultConfig.Recommend.Online.FreshnessQuota)
+	viper.SetDefault("recommend.online.freshness_window", defaultConfig.Recommend.Online.FreshnessWindow)
+	viper.SetDefault("recommend.online.offline_recommend_ttl", defaultConfig.Recommend.Online.OfflineRecommendTTL)
+	viper.SetDefault("recommend.online.session_recommend_ttl", defaultConfig.Recommend.Online.SessionRecommendTTL)
+	viper.SetDefault("recommend.online.exceed_cache_size", defaultConfig.Recommend.Online.ExceedCacheSize)
+	viper.SetDefault("recommend.online.latency_budget", defaultConfig.Recommend.Online.LatencyBudget)
+	viper.SetDefault("recommend.online.max_latency_budget", defaultConfig.Recommend.Online.MaxLatencyBudget)
+	// [recommend.rerank]
+	viper.SetDefault("recommend.rerank.scorer", defaultConfig.Recommend.Rerank.Scorer)
+	viper.SetDefault("recommend.rerank.stage", defaultConfig.Recommend.Rerank.Stage)
+	viper.SetDefault("recommend.rerank.timeout", defaultConfig.Recommend.Rerank.Timeout)
+	viper.SetDefault("recommend.rerank.batch_size", defaultConfig.Recommend.Rerank.BatchSize)
+	viper.SetDefault("recommend.rerank.max_failures", defaultConfig.Recommend.Rerank.MaxFailures)
+	viper.SetDefault("recommend.rerank.break_duration", defaultConfig.Recommend.Rerank.BreakDuration)
+	// [recommend.blend]
+	viper.SetDefault("recommend.blend.enable_blend", defaultConfig.Recommend.Blend.EnableBlend)
+	viper.SetDefault("recommend.blend.cf_weight", defaultConfig.Recommend.Blend.CFWeight)
+	viper.SetDefault("recommend.blend.ctr_weight", defaultConfig.Recommend.Blend.CTRWeight)
+	viper.SetDefault("recommend.blend.freshness_weight", defaultConfig.Recommend.Blend.FreshnessWeight)
+	viper.SetDefault("recommend.blend.freshness_half_life", defaultConfig.Recommend.Blend.FreshnessHalfLife)
+	// [recommend.dedup]
+	viper.SetDefault("recommend.dedup.enable_dedup", defaultConfig.Recommend.Dedup.EnableDedup)
+	viper.SetDefault("recommend.dedup.similarity_threshold", defaultConfig.Recommend.Dedup.SimilarityThreshold)
+	viper.SetDefault("recommend.dedup.num_hashes", defaultConfig.Recommend.Dedup.NumHashes)
+	// [recommend.consumed_filter]
+	viper.SetDefault("recommend.consumed_filter.enable_consumed_filter", defaultConfig.Recommend.ConsumedFilter.EnableConsumedFilter)
+	viper.SetDefault("recommend.consumed_filter.bits_per_item", defaultConfig.Recommend.ConsumedFilter.BitsPerItem)
+	viper.SetDefault("recommend.consumed_filter.num_hashes", defaultConfig.Recommend.ConsumedFilter.NumHashes)
+	// [recommend.subscription]
+	viper.SetDefault("recommend.subscription.weight", defaultConfig.Recommend.Subscription.Weight)
+	viper.SetDefault("recommend.subscription.recency_half_life", defaultConfig.Recommend.Subscription.RecencyHalfLife)
 }
 
 type configBinding struct {
@@ -428,6 +1273,11 @@ func LoadConfig(path string, oneModel bool) (*Config, error) {
 		{"database.cache_store", "GORSE_CACHE_STORE"},
 		{"database.data_store", "GORSE_DATA_STORE"},
 		{"database.table_prefix", "GORSE_TABLE_PREFIX"},
+		{"database.id_obfuscation_secret", "GORSE_ID_OBFUSCATION_SECRET"},
+		{"database.id_obfuscation_previous_secret", "GORSE_ID_OBFUSCATION_PREVIOUS_SECRET"},
+		{"database.blob_store", "GORSE_BLOB_STORE"},
+		{"database.hot_feedback_store", "GORSE_HOT_FEEDBACK_STORE"},
+		{"database.shadow_data_store", "GORSE_SHADOW_DATA_STORE"},
 		{"master.port", "GORSE_MASTER_PORT"},
 		{"master.host", "GORSE_MASTER_HOST"},
 		{"master.http_port", "GORSE_MASTER_HTTP_PORT"},
@@ -435,7 +1285,10 @@ func LoadConfig(path string, oneModel bool) (*Config, error) {
 		{"master.n_jobs", "GORSE_MASTER_JOBS"},
 		{"master.dashboard_user_name", "GORSE_DASHBOARD_USER_NAME"},
 		{"master.dashboard_password", "GORSE_DASHBOARD_PASSWORD"},
+		{"master.webhook.secret", "GORSE_WEBHOOK_SECRET"},
+		{"master.alert.smtp.password", "GORSE_SMTP_PASSWORD"},
 		{"server.api_key", "GORSE_SERVER_API_KEY"},
+		{"server.admin_api_key", "GORSE_SERVER_ADMIN_API_KEY"},
 	}
 	for _, binding := range bindings {
 		err := viper.BindEnv(binding.key, binding.env)
@@ -464,6 +1317,24 @@ func LoadConfig(path string, oneModel bool) (*Config, error) {
 	return &conf, nil
 }
 
+// WatchConfig watches the config file loaded by LoadConfig. The callback is called with the reloaded config once the
+// config file changes, while invalid changes are logged and ignored.
+func WatchConfig(oneModel bool, callback func(*Config)) {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		var conf Config
+		if err := viper.Unmarshal(&conf); err != nil {
+			log.Logger().Error("failed to reload config", zap.String("config", e.Name), zap.Error(err))
+			return
+		}
+		if err := conf.Validate(oneModel); err != nil {
+			log.Logger().Error("failed to reload config", zap.String("config", e.Name), zap.Error(err))
+			return
+		}
+		callback(&conf)
+	})
+	viper.WatchConfig()
+}
+
 func (config *Config) Validate(oneModel bool) error {
 	validate := validator.New()
 	if err := validate.RegisterValidation("data_store", func(fl validator.FieldLevel) bool {
@@ -493,6 +1364,7 @@ func (config *Config) Validate(oneModel bool) error {
 		prefixes := []string{
 			storage.RedisPrefix,
 			storage.RedissPrefix,
+			storage.MemcachedPrefix,
 			storage.MongoPrefix,
 			storage.MongoSrvPrefix,
 			storage.MySQLPrefix,
@@ -500,7 +1372,7 @@ func (config *Config) Validate(oneModel bool) error {
 			storage.PostgreSQLPrefix,
 		}
 		if oneModel {
-			prefixes = append(prefixes, storage.SQLitePrefix)
+			prefixes = append(prefixes, storage.SQLitePrefix, storage.InMemoryPrefix)
 		}
 		for _, prefix := range prefixes {
 			if strings.HasPrefix(fl.Field().String(), prefix) {
@@ -511,6 +1383,11 @@ func (config *Config) Validate(oneModel bool) error {
 	}); err != nil {
 		return errors.Trace(err)
 	}
+	if err := validate.RegisterValidation("recommend_stage", func(fl validator.FieldLevel) bool {
+		return lo.Contains(RecommendStages, fl.Field().String())
+	}); err != nil {
+		return errors.Trace(err)
+	}
 	validate.RegisterTagNameFunc(func(fld reflect.StructField) string {
 		return strings.SplitN(fld.Tag.Get("mapstructure"), ",", 2)[0]
 	})
@@ -537,6 +1414,14 @@ func (config *Config) Validate(oneModel bool) error {
 		}); err != nil {
 			return errors.Trace(err)
 		}
+		if err := validate.RegisterTranslation("recommend_stage", trans, func(ut ut.Translator) error {
+			return ut.Add("recommend_stage", "{0} contains unknown recommend stage, valid stages are {1}", true)
+		}, func(ut ut.Translator, fe validator.FieldError) string {
+			t, _ := ut.T("recommend_stage", fe.Field(), strings.Join(RecommendStages, ", "))
+			return t
+		}); err != nil {
+			return errors.Trace(err)
+		}
 		errs := err.(validator.ValidationErrors)
 		for _, e := range errs {
 			return errors.New(e.Translate(trans))
@@ -15,6 +15,7 @@
 package config
 
 import (
+	"github.com/juju/errors"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
 	"github.com/zhenghaoz/gorse/storage/cache"
@@ -35,6 +36,19 @@ type Settings struct {
 	ClickModelVersion   int64
 }
 
+// CloseDatabases closes connections to the data store and the cache store. Databases not connected are skipped.
+func (s *Settings) CloseDatabases() error {
+	dataErr := s.DataClient.Close()
+	cacheErr := s.CacheClient.Close()
+	if dataErr != nil && !errors.Is(dataErr, errors.NotAssigned) {
+		return errors.Trace(dataErr)
+	}
+	if cacheErr != nil && !errors.Is(cacheErr, errors.NotAssigned) {
+		return errors.Trace(cacheErr)
+	}
+	return nil
+}
+
 func NewSettings() *Settings {
 	return &Settings{
 		Config:      GetDefaultConfig(),
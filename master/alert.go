@@ -0,0 +1,376 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+// States of alerts.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is an alert fired by a rule. Values and thresholds are in seconds, except for error rates.
+type Alert struct {
+	Rule       string
+	Type       string
+	State      string
+	Value      float64
+	Threshold  float64
+	Message    string
+	FiredAt    time.Time
+	ResolvedAt time.Time
+}
+
+// Alerts are active alerts and recently resolved alerts, both ordered by the latest first.
+type Alerts struct {
+	Active   []Alert
+	Resolved []Alert
+}
+
+// requestSample is the number of requests and server errors counted since the master started.
+type requestSample struct {
+	timestamp time.Time
+	requests  float64
+	errors    float64
+}
+
+// RunAlertLoop evaluates alert rules periodically.
+func (m *Master) RunAlertLoop() {
+	defer base.CheckPanic()
+	for {
+		if err := m.evaluateAlerts(time.Now()); err != nil {
+			log.Logger().Error("failed to evaluate alerts", zap.Error(err))
+		}
+		time.Sleep(m.Config.Master.Alert.EvaluationPeriod)
+	}
+}
+
+// ReloadConfig applies changes of the config file which take effect without restart. Only alert rules are reloaded.
+func (m *Master) ReloadConfig(cfg *config.Config) {
+	m.alertMutex.Lock()
+	defer m.alertMutex.Unlock()
+	m.Config.Master.Alert.Rules = cfg.Master.Alert.Rules
+	log.Logger().Info("reload alert rules", zap.Int("n_rules", len(cfg.Master.Alert.Rules)))
+}
+
+// evaluateAlerts evaluates alert rules. An alert fires once the condition of its rule holds, and it isn't notified
+// again until it resolves. Alerts of removed rules are resolved as well. The state of alerts is saved in the cache
+// store, so that alerts aren't notified again after the master restarts.
+func (m *Master) evaluateAlerts(now time.Time) error {
+	m.alertMutex.Lock()
+	defer m.alertMutex.Unlock()
+	if err := m.loadAlerts(); err != nil {
+		return errors.Trace(err)
+	}
+	if m.alertSince.IsZero() {
+		m.alertSince = now
+	}
+	rules := m.Config.Master.Alert.Rules
+	if err := m.sampleRequests(rules, now); err != nil {
+		return errors.Trace(err)
+	}
+	changed := false
+	ruleNames := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		ruleNames[rule.Name] = struct{}{}
+		alert, firing, err := m.checkAlertRule(rule, now)
+		if err != nil {
+			log.Logger().Error("failed to check alert rule", zap.String("rule", rule.Name), zap.Error(err))
+			continue
+		}
+		i := m.activeAlert(rule.Name)
+		switch {
+		case firing && i < 0:
+			alert.State, alert.FiredAt = AlertFiring, now
+			m.alerts.Active = append([]Alert{alert}, m.alerts.Active...)
+			m.notifyAlert(EventAlertFiring, alert)
+			changed = true
+		case firing:
+			m.alerts.Active[i].Value, m.alerts.Active[i].Threshold, m.alerts.Active[i].Message = alert.Value, alert.Threshold, alert.Message
+			changed = true
+		case i >= 0:
+			alert.FiredAt = m.alerts.Active[i].FiredAt
+			m.resolveAlert(i, alert, now)
+			changed = true
+		}
+	}
+	for i := len(m.alerts.Active) - 1; i >= 0; i-- {
+		if _, exist := ruleNames[m.alerts.Active[i].Rule]; !exist {
+			alert := m.alerts.Active[i]
+			alert.Message = fmt.Sprintf("rule %s has been removed", alert.Rule)
+			m.resolveAlert(i, alert, now)
+			changed = true
+		}
+	}
+	// remove alerts resolved before the retention
+	retention := now.Add(-m.Config.Master.Alert.ResolvedRetention)
+	for len(m.alerts.Resolved) > 0 && m.alerts.Resolved[len(m.alerts.Resolved)-1].ResolvedAt.Before(retention) {
+		m.alerts.Resolved = m.alerts.Resolved[:len(m.alerts.Resolved)-1]
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return m.saveAlerts()
+}
+
+func (m *Master) activeAlert(rule string) int {
+	for i, alert := range m.alerts.Active {
+		if alert.Rule == rule {
+			return i
+		}
+	}
+	return -1
+}
+
+// resolveAlert moves the i-th active alert to resolved alerts.
+func (m *Master) resolveAlert(i int, alert Alert, now time.Time) {
+	alert.State, alert.ResolvedAt = AlertResolved, now
+	m.alerts.Active = append(m.alerts.Active[:i], m.alerts.Active[i+1:]...)
+	m.alerts.Resolved = append([]Alert{alert}, m.alerts.Resolved...)
+	m.notifyAlert(EventAlertResolved, alert)
+}
+
+// checkAlertRule returns the alert of a rule, and whether the condition of the rule holds.
+func (m *Master) checkAlertRule(rule config.AlertRule, now time.Time) (Alert, bool, error) {
+	alert := Alert{Rule: rule.Name, Type: rule.Type, Threshold: rule.Duration.Seconds()}
+	switch rule.Type {
+	case config.AlertTrainingStale:
+		fitTime := m.alertSince
+		for _, key := range []string{cache.LastFitMatchingModelTime, cache.LastFitRankingModelTime} {
+			t, err := m.CacheClient.Get(cache.Key(cache.GlobalMeta, key)).Time()
+			if err != nil && !errors.Is(err, errors.NotFound) {
+				return alert, false, errors.Trace(err)
+			}
+			if t.After(fitTime) {
+				fitTime = t
+			}
+		}
+		staleness := now.Sub(fitTime)
+		alert.Value = staleness.Seconds()
+		alert.Message = fmt.Sprintf("no model has been trained for %v", staleness.Truncate(time.Second))
+		return alert, staleness > rule.Duration, nil
+	case config.AlertIngestStalled:
+		insertTime, err := m.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime)).Time()
+		if errors.Is(err, errors.NotFound) {
+			// feedback has never been ingested
+			return alert, false, nil
+		} else if err != nil {
+			return alert, false, errors.Trace(err)
+		}
+		stall := now.Sub(insertTime)
+		alert.Value = stall.Seconds()
+		alert.Message = fmt.Sprintf("no feedback has been ingested for %v", stall.Truncate(time.Second))
+		return alert, stall > rule.Duration, nil
+	case config.AlertCacheStale:
+		alert.Value = m.maxStaleness.Seconds()
+		alert.Message = fmt.Sprintf("offline recommendation is stale for %v", m.maxStaleness.Truncate(time.Second))
+		return alert, m.maxStaleness > rule.Duration, nil
+	case config.AlertErrorRate:
+		requests, errorRate := m.errorRate(rule.Duration, now)
+		alert.Value, alert.Threshold = errorRate, rule.Threshold
+		alert.Message = fmt.Sprintf("%.2f%% of %d requests failed in %v", errorRate*100, int(requests), rule.Duration)
+		return alert, requests > 0 && errorRate > rule.Threshold, nil
+	default:
+		return alert, false, errors.NotValidf("alert rule type %s", rule.Type)
+	}
+}
+
+// sampleRequests samples numbers of requests and server errors counted by nodes today if any rule checks error rates.
+// Counters restart from zero every day, so numbers since the master started are accumulated from increments of
+// counters. Samples older than windows of rules are removed.
+func (m *Master) sampleRequests(rules []config.AlertRule, now time.Time) error {
+	var window time.Duration
+	for _, rule := range rules {
+		if rule.Type == config.AlertErrorRate && rule.Duration > window {
+			window = rule.Duration
+		}
+	}
+	if window == 0 {
+		m.requestSamples = nil
+		return nil
+	}
+	day := server.ActivityDay(now)
+	requests, serverErrors, err := m.readRequestCounters(day)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if day != m.requestDay {
+		m.requestDay, m.dayRequests, m.dayErrors = day, 0, 0
+	}
+	sample := requestSample{timestamp: now}
+	if n := len(m.requestSamples); n > 0 {
+		sample.requests, sample.errors = m.requestSamples[n-1].requests, m.requestSamples[n-1].errors
+		sample.requests += math.Max(requests-m.dayRequests, 0)
+		sample.errors += math.Max(serverErrors-m.dayErrors, 0)
+	}
+	m.dayRequests, m.dayErrors = requests, serverErrors
+	m.requestSamples = append(m.requestSamples, sample)
+	// keep the latest sample before the window as the baseline
+	for len(m.requestSamples) > 1 && !m.requestSamples[1].timestamp.After(now.Add(-window)) {
+		m.requestSamples = m.requestSamples[1:]
+	}
+	return nil
+}
+
+// errorRate returns the number of requests and the rate of server errors in the window.
+func (m *Master) errorRate(window time.Duration, now time.Time) (float64, float64) {
+	if len(m.requestSamples) == 0 {
+		return 0, 0
+	}
+	latest := m.requestSamples[len(m.requestSamples)-1]
+	baseline := m.requestSamples[0]
+	for _, sample := range m.requestSamples {
+		if sample.timestamp.After(now.Add(-window)) {
+			break
+		}
+		baseline = sample
+	}
+	requests := latest.requests - baseline.requests
+	serverErrors := latest.errors - baseline.errors
+	if requests+serverErrors == 0 {
+		return 0, 0
+	}
+	return requests + serverErrors, serverErrors / (requests + serverErrors)
+}
+
+// readRequestCounters sums up successful requests and server errors counted by nodes in a day.
+func (m *Master) readRequestCounters(day string) (float64, float64, error) {
+	nodes, err := m.CacheClient.GetSet(cache.Key(cache.UsageNodes, day))
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	var requests, serverErrors float64
+	for _, node := range nodes {
+		scores, err := m.CacheClient.GetSorted(cache.Key(cache.UsageCounters, day, node), 0, -1)
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		for _, score := range scores {
+			if strings.HasPrefix(score.Id, server.UsageRequests) {
+				requests += score.Score
+			} else if score.Id == server.UsageServerErrors {
+				serverErrors += score.Score
+			}
+		}
+	}
+	return requests, serverErrors, nil
+}
+
+// loadAlerts loads the state of alerts from the cache store if it hasn't been loaded.
+func (m *Master) loadAlerts() error {
+	if m.alerts != nil {
+		return nil
+	}
+	text, err := m.CacheClient.Get(cache.Alerts).String()
+	if errors.Is(err, errors.NotFound) {
+		m.alerts = &Alerts{}
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	var alerts Alerts
+	if err = json.Unmarshal([]byte(text), &alerts); err != nil {
+		return errors.Trace(err)
+	}
+	m.alerts = &alerts
+	return nil
+}
+
+func (m *Master) saveAlerts() error {
+	buf, err := json.Marshal(m.alerts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return m.CacheClient.Set(cache.String(cache.Alerts, string(buf)))
+}
+
+// GetAlerts returns active alerts and recently resolved alerts.
+func (m *Master) GetAlerts() (*Alerts, error) {
+	m.alertMutex.Lock()
+	defer m.alertMutex.Unlock()
+	if err := m.loadAlerts(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Alerts{
+		Active:   append([]Alert{}, m.alerts.Active...),
+		Resolved: append([]Alert{}, m.alerts.Resolved...),
+	}, nil
+}
+
+// notifyAlert notifies webhooks and sends emails once an alert fires or resolves.
+func (m *Master) notifyAlert(event string, alert Alert) {
+	log.Logger().Warn("alert "+alert.State, zap.String("rule", alert.Rule), zap.String("message", alert.Message))
+	m.notifyWebhooks(event, alert)
+	smtpConfig := m.Config.Master.Alert.SMTP
+	if smtpConfig.Host == "" || len(smtpConfig.To) == 0 {
+		return
+	}
+	go func() {
+		defer base.CheckPanic()
+		var auth smtp.Auth
+		if smtpConfig.Username != "" {
+			auth = smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, smtpConfig.Host)
+		}
+		addr := fmt.Sprintf("%s:%d", smtpConfig.Host, smtpConfig.Port)
+		if err := smtp.SendMail(addr, auth, smtpConfig.From, smtpConfig.To, alertEmail(smtpConfig, alert)); err != nil {
+			log.Logger().Error("failed to send alert email", zap.String("rule", alert.Rule), zap.Error(err))
+		}
+	}()
+}
+
+// alertEmail returns the message of an alert email.
+func alertEmail(smtpConfig config.SMTPConfig, alert Alert) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", smtpConfig.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(smtpConfig.To, ", "))
+	fmt.Fprintf(&buf, "Subject: [gorse] Alert %s is %s\r\n", alert.Rule, alert.State)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Rule: %s (%s)\r\n", alert.Rule, alert.Type)
+	fmt.Fprintf(&buf, "State: %s\r\n", alert.State)
+	fmt.Fprintf(&buf, "Message: %s\r\n", alert.Message)
+	fmt.Fprintf(&buf, "Fired at: %s\r\n", alert.FiredAt.Format(time.RFC3339))
+	if alert.State == AlertResolved {
+		fmt.Fprintf(&buf, "Resolved at: %s\r\n", alert.ResolvedAt.Format(time.RFC3339))
+	}
+	return buf.Bytes()
+}
+
+func (m *Master) getAlerts(_ *restful.Request, response *restful.Response) {
+	alerts, err := m.GetAlerts()
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, alerts)
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+func TestMaster_EvaluateAlerts(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.webhookChan = make(chan WebhookPayload, webhookQueueSize)
+	m.Config.Master.Webhook.URLs = []string{"http://localhost"}
+	m.Config.Master.Alert.Rules = []config.AlertRule{{Name: "ingest", Type: config.AlertIngestStalled, Duration: time.Hour}}
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// feedback has never been ingested
+	assert.NoError(t, m.evaluateAlerts(now))
+	assert.Empty(t, m.webhookChan)
+
+	// an alert fires once
+	err := m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime), now.Add(-2*time.Hour)))
+	assert.NoError(t, err)
+	assert.NoError(t, m.evaluateAlerts(now))
+	assert.NoError(t, m.evaluateAlerts(now.Add(time.Minute)))
+	assert.Len(t, m.webhookChan, 1)
+	payload := <-m.webhookChan
+	assert.Equal(t, EventAlertFiring, payload.Event)
+	alerts, err := m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Len(t, alerts.Active, 1)
+	assert.Equal(t, "ingest", alerts.Active[0].Rule)
+	assert.Equal(t, AlertFiring, alerts.Active[0].State)
+	assert.Equal(t, now, alerts.Active[0].FiredAt)
+	assert.Equal(t, (2*time.Hour + time.Minute).Seconds(), alerts.Active[0].Value)
+	assert.Equal(t, time.Hour.Seconds(), alerts.Active[0].Threshold)
+
+	// the state of alerts is kept after restart
+	m.alerts = nil
+	assert.NoError(t, m.evaluateAlerts(now.Add(2*time.Minute)))
+	assert.Empty(t, m.webhookChan)
+
+	// the alert resolves
+	err = m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime), now))
+	assert.NoError(t, err)
+	assert.NoError(t, m.evaluateAlerts(now.Add(3*time.Minute)))
+	assert.Len(t, m.webhookChan, 1)
+	payload = <-m.webhookChan
+	assert.Equal(t, EventAlertResolved, payload.Event)
+	alerts, err = m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Empty(t, alerts.Active)
+	assert.Len(t, alerts.Resolved, 1)
+	assert.Equal(t, AlertResolved, alerts.Resolved[0].State)
+	assert.Equal(t, now, alerts.Resolved[0].FiredAt)
+	assert.Equal(t, now.Add(3*time.Minute), alerts.Resolved[0].ResolvedAt)
+
+	// resolved alerts are removed after the retention
+	assert.NoError(t, m.evaluateAlerts(now.Add(m.Config.Master.Alert.ResolvedRetention).Add(time.Hour)))
+	alerts, err = m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Empty(t, alerts.Resolved)
+}
+
+func TestMaster_EvaluateAlerts_ReloadRules(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config.Master.Alert.Rules = []config.AlertRule{{Name: "cache", Type: config.AlertCacheStale, Duration: time.Hour}}
+	now := time.Now()
+	m.maxStaleness = 2 * time.Hour
+	assert.NoError(t, m.evaluateAlerts(now))
+	alerts, err := m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Len(t, alerts.Active, 1)
+
+	// alerts of removed rules are resolved
+	cfg := config.GetDefaultConfig()
+	cfg.Master.Alert.Rules = []config.AlertRule{{Name: "training", Type: config.AlertTrainingStale, Duration: time.Hour}}
+	m.ReloadConfig(cfg)
+	assert.NoError(t, m.evaluateAlerts(now.Add(time.Minute)))
+	alerts, err = m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Empty(t, alerts.Active)
+	assert.Len(t, alerts.Resolved, 1)
+	assert.Equal(t, "cache", alerts.Resolved[0].Rule)
+
+	// no model has been trained since the first evaluation
+	assert.NoError(t, m.evaluateAlerts(now.Add(2*time.Hour)))
+	alerts, err = m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Len(t, alerts.Active, 1)
+	assert.Equal(t, "training", alerts.Active[0].Rule)
+	err = m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastFitMatchingModelTime), now.Add(2*time.Hour)))
+	assert.NoError(t, err)
+	assert.NoError(t, m.evaluateAlerts(now.Add(2*time.Hour+time.Minute)))
+	alerts, err = m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Empty(t, alerts.Active)
+}
+
+func TestMaster_EvaluateAlerts_ErrorRate(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config.Master.Alert.Rules = []config.AlertRule{{Name: "errors", Type: config.AlertErrorRate, Duration: 10 * time.Minute, Threshold: 0.1}}
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	day := server.ActivityDay(now)
+	setCounters := func(node string, requests, errors float64) {
+		assert.NoError(t, m.CacheClient.AddSet(cache.Key(cache.UsageNodes, day), node))
+		assert.NoError(t, m.CacheClient.SetSorted(cache.Key(cache.UsageCounters, day, node), []cache.Scored{
+			{Id: server.UsageRequests + "GET /api/user/{user-id}", Score: requests},
+			{Id: server.UsageServerErrors, Score: errors},
+		}))
+	}
+
+	// errors before the first evaluation are ignored
+	setCounters("a", 100, 50)
+	assert.NoError(t, m.evaluateAlerts(now))
+	alerts, err := m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Empty(t, alerts.Active)
+
+	// errors of nodes are summed up
+	setCounters("a", 130, 60)
+	setCounters("b", 20, 10)
+	assert.NoError(t, m.evaluateAlerts(now.Add(time.Minute)))
+	alerts, err = m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Len(t, alerts.Active, 1)
+	assert.InDelta(t, 20.0/70, alerts.Active[0].Value, 1e-6)
+	assert.Equal(t, 0.1, alerts.Active[0].Threshold)
+
+	// errors out of the window are ignored
+	setCounters("a", 230, 61)
+	assert.NoError(t, m.evaluateAlerts(now.Add(12*time.Minute)))
+	alerts, err = m.GetAlerts()
+	assert.NoError(t, err)
+	assert.Empty(t, alerts.Active)
+	assert.Len(t, alerts.Resolved, 1)
+	assert.InDelta(t, 1.0/101, alerts.Resolved[0].Value, 1e-6)
+}
+
+func TestAlertEmail(t *testing.T) {
+	smtpConfig := config.SMTPConfig{From: "gorse@example.com", To: []string{"a@example.com", "b@example.com"}}
+	email := string(alertEmail(smtpConfig, Alert{
+		Rule:    "ingest",
+		Type:    config.AlertIngestStalled,
+		State:   AlertFiring,
+		Message: "no feedback has been ingested for 2h0m0s",
+		FiredAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+	}))
+	assert.Contains(t, email, "To: a@example.com, b@example.com\r\n")
+	assert.Contains(t, email, "Subject: [gorse] Alert ingest is firing\r\n")
+	assert.Contains(t, email, "Message: no feedback has been ingested for 2h0m0s\r\n")
+	assert.Contains(t, email, "Fired at: 2022-01-01T00:00:00Z\r\n")
+	assert.NotContains(t, email, "Resolved at")
+}
+
+func TestMaster_GetAlerts(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Master.Alert.Rules = []config.AlertRule{{Name: "cache", Type: config.AlertCacheStale, Duration: time.Hour}}
+	s.maxStaleness = 2 * time.Hour
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.evaluateAlerts(now))
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/alerts").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, Alerts{
+			Active: []Alert{{
+				Rule:      "cache",
+				Type:      config.AlertCacheStale,
+				State:     AlertFiring,
+				Value:     (2 * time.Hour).Seconds(),
+				Threshold: time.Hour.Seconds(),
+				Message:   "offline recommendation is stale for 2h0m0s",
+				FiredAt:   now,
+			}},
+			Resolved: []Alert{},
+		})).
+		End()
+}
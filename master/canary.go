@@ -0,0 +1,220 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/encoding"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+const (
+	GenerationDefault = "default"
+	GenerationCanary  = "canary"
+
+	canaryBatchSize = 1000
+)
+
+// GenerationCTR is click-through of users served by a generation of the ranking model since the canary started.
+type GenerationCTR struct {
+	Version string
+	Users   int // number of users having read items
+	Reads   int // number of read items
+	Clicks  int // number of read items with positive feedback
+	CTR     float64
+}
+
+// CanaryStatus is the status of the canary ranking model. Canary is absent if no canary ranking model exists.
+type CanaryStatus struct {
+	Percent   int
+	StartTime time.Time
+	Default   GenerationCTR
+	Canary    *GenerationCTR
+}
+
+// setCanaryRankingModel makes a newly trained ranking model the canary ranking model, which serves canary users
+// until it is promoted. The previous canary ranking model is discarded. The lock of ranking models must be held.
+func (m *Master) setCanaryRankingModel(rankingModel ranking.MatrixFactorization, score ranking.Score) int64 {
+	m.canaryRankingModel = rankingModel
+	m.canaryRankingModelVersion = m.nextModelVersion(RankingModelCheckpoint,
+		lo.Max([]int64{m.RankingModelVersion, m.canaryRankingModelVersion}))
+	m.canaryRankingScore = score
+	m.canaryStartTime = time.Now()
+	m.canaryCTR = nil
+	return m.canaryRankingModelVersion
+}
+
+// publishCanaryVersion tells workers the version of the canary ranking model. Zero means no canary ranking model.
+func (m *Master) publishCanaryVersion(version int64) error {
+	return m.CacheClient.Set(cache.Integer(cache.Key(cache.GlobalMeta, cache.RankingCanaryVersion), int(version)))
+}
+
+// PromoteCanary makes the canary ranking model the default ranking model without retraining. The default ranking
+// model becomes the canary ranking model, so that it could be restored by promoting again. Users are served by the
+// promoted generation after their offline recommendation is refreshed.
+func (m *Master) PromoteCanary() error {
+	m.rankingModelMutex.Lock()
+	if m.canaryRankingModel == nil {
+		m.rankingModelMutex.Unlock()
+		return errors.NotFoundf("canary ranking model")
+	}
+	m.RankingModel, m.canaryRankingModel = m.canaryRankingModel, m.RankingModel
+	m.RankingModelVersion, m.canaryRankingModelVersion = m.canaryRankingModelVersion, m.RankingModelVersion
+	m.rankingScore, m.canaryRankingScore = m.canaryRankingScore, m.rankingScore
+	m.canaryStartTime = time.Now()
+	m.canaryCTR = nil
+	defaultVersion, canaryVersion := m.RankingModelVersion, m.canaryRankingModelVersion
+	m.localCache.RankingModelName = m.rankingModelName
+	m.localCache.RankingModelVersion = m.RankingModelVersion
+	m.localCache.RankingModel = m.RankingModel
+	m.localCache.RankingModelScore = m.rankingScore
+	m.rankingModelMutex.Unlock()
+	log.Logger().Info("promote canary ranking model",
+		zap.String("default_version", encoding.Hex(defaultVersion)),
+		zap.String("canary_version", encoding.Hex(canaryVersion)))
+
+	if err := m.publishCanaryVersion(canaryVersion); err != nil {
+		return errors.Trace(err)
+	}
+	if m.registry != nil {
+		// the previous default ranking model serves canary users now
+		if err := m.registry.SetLive(RankingModelCheckpoint, encoding.Hex(defaultVersion), ModelCandidate); err != nil {
+			log.Logger().Error("failed to update model registry", zap.Error(err))
+		}
+	}
+	m.exportEmbeddingsToBlob()
+	if err := m.localCache.WriteLocalCache(); err != nil {
+		log.Logger().Error("failed to write local cache", zap.Error(err))
+	}
+	return nil
+}
+
+// GetCanaryStatus returns the status of the canary ranking model and click-through of each generation evaluated when
+// the dataset was loaded last time.
+func (m *Master) GetCanaryStatus() CanaryStatus {
+	m.rankingModelMutex.RLock()
+	defer m.rankingModelMutex.RUnlock()
+	status := CanaryStatus{
+		Percent:   m.Config.Recommend.Collaborative.CanaryPercent,
+		StartTime: m.canaryStartTime,
+		Default:   GenerationCTR{Version: encoding.Hex(m.RankingModelVersion)},
+	}
+	if m.canaryRankingModel != nil {
+		status.Canary = &GenerationCTR{Version: encoding.Hex(m.canaryRankingModelVersion)}
+	}
+	if m.canaryCTR != nil {
+		status.Default = m.canaryCTR[GenerationDefault]
+		if status.Canary != nil {
+			*status.Canary = m.canaryCTR[GenerationCanary]
+		}
+	}
+	return status
+}
+
+// evaluateCanary aggregates click-through of each generation of the ranking model since the canary started. Reads
+// are attributed to the generation tagged on offline recommendation of each user, and a read item is clicked if it
+// has positive feedback.
+func (m *Master) evaluateCanary(evaluator *OnlineEvaluator, userIndex base.Index) error {
+	m.rankingModelMutex.RLock()
+	if m.canaryRankingModel == nil {
+		m.rankingModelMutex.RUnlock()
+		return nil
+	}
+	startTime := m.canaryStartTime
+	generations := map[string]string{
+		encoding.Hex(m.RankingModelVersion):       GenerationDefault,
+		encoding.Hex(m.canaryRankingModelVersion): GenerationCanary,
+	}
+	m.rankingModelMutex.RUnlock()
+
+	// count reads and clicks of each user
+	positives := make(map[lo.Tuple2[int32, int32]]struct{})
+	for _, feedback := range evaluator.PositiveFeedbacks {
+		for _, f := range feedback {
+			positives[lo.Tuple2[int32, int32]{A: f.A, B: f.B}] = struct{}{}
+		}
+	}
+	reads := make(map[int32]int)
+	clicks := make(map[int32]int)
+	for pair, readTime := range evaluator.ReverseIndex {
+		if readTime.Before(startTime) {
+			continue
+		}
+		reads[pair.A]++
+		if _, clicked := positives[pair]; clicked {
+			clicks[pair.A]++
+		}
+	}
+
+	// aggregate by generations of users
+	ctr := make(map[string]GenerationCTR)
+	for version, generation := range generations {
+		ctr[generation] = GenerationCTR{Version: version}
+	}
+	userIndices := lo.Keys(reads)
+	for begin := 0; begin < len(userIndices); begin += canaryBatchSize {
+		end := lo.Min([]int{begin + canaryBatchSize, len(userIndices)})
+		documents, err := m.CacheClient.ReadDocuments(lo.Map(userIndices[begin:end], func(u int32, _ int) cache.Read {
+			return cache.ReadValue(cache.Key(cache.RankingGeneration, userIndex.ToName(u)))
+		})...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for i, document := range documents {
+			version, err := document.Value.String()
+			if err != nil {
+				if errors.Is(err, errors.NotFound) {
+					continue
+				}
+				return errors.Trace(err)
+			}
+			generation, exist := generations[version]
+			if !exist {
+				// recommendation generated by a discarded generation
+				continue
+			}
+			u := userIndices[begin+i]
+			g := ctr[generation]
+			g.Users++
+			g.Reads += reads[u]
+			g.Clicks += clicks[u]
+			ctr[generation] = g
+		}
+	}
+	for generation, g := range ctr {
+		if g.Reads > 0 {
+			g.CTR = float64(g.Clicks) / float64(g.Reads)
+			ctr[generation] = g
+		}
+		RankingGenerationReadsVec.WithLabelValues(generation).Set(float64(g.Reads))
+		RankingGenerationClicksVec.WithLabelValues(generation).Set(float64(g.Clicks))
+		RankingGenerationCTRVec.WithLabelValues(generation).Set(g.CTR)
+	}
+
+	m.rankingModelMutex.Lock()
+	defer m.rankingModelMutex.Unlock()
+	if m.canaryStartTime.Equal(startTime) {
+		// discard stale click-through if the canary was replaced or promoted
+		m.canaryCTR = ctr
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/encoding"
+	"github.com/zhenghaoz/gorse/model"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+func newCanaryRankingModel() ranking.MatrixFactorization {
+	dataset := ranking.NewMapIndexDataset()
+	for i := 0; i < 10; i++ {
+		dataset.AddFeedback(strconv.Itoa(i), strconv.Itoa(i), true)
+	}
+	trainSet, testSet := dataset.Split(0, 0)
+	bpr := ranking.NewBPR(model.Params{model.NEpochs: 1})
+	bpr.Fit(trainSet, testSet, nil)
+	return bpr
+}
+
+func TestMaster_Canary(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.localCache = &LocalCache{path: filepath.Join(t.TempDir(), "TestMaster_Canary")}
+	s.Config.Recommend.Collaborative.CanaryPercent = 50
+	s.RankingModel = newCanaryRankingModel()
+	s.RankingModelVersion = 1
+
+	// promote without canary
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/canary/promote").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	// train a canary ranking model
+	s.rankingModelMutex.Lock()
+	version := s.setCanaryRankingModel(newCanaryRankingModel(), ranking.Score{})
+	s.rankingModelMutex.Unlock()
+	assert.Equal(t, int64(2), version)
+
+	// user 0 is served by the default model, user 1 is served by the canary model and user 2 isn't tagged
+	userIndex := base.NewMapIndex()
+	for i := 0; i < 3; i++ {
+		userIndex.Add(strconv.Itoa(i))
+	}
+	err := s.CacheClient.Set(
+		cache.String(cache.Key(cache.RankingGeneration, "0"), encoding.Hex(1)),
+		cache.String(cache.Key(cache.RankingGeneration, "1"), encoding.Hex(2)))
+	assert.NoError(t, err)
+	evaluator := NewOnlineEvaluator()
+	now := time.Now()
+	evaluator.Read(0, 0, now)
+	evaluator.Read(0, 1, now)
+	evaluator.Read(1, 0, now)
+	evaluator.Read(2, 0, now)
+	evaluator.Positive("like", 0, 0, now)
+	evaluator.Positive("like", 2, 0, now)
+	err = s.evaluateCanary(evaluator, userIndex)
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/canary").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var status CanaryStatus
+			if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+				return err
+			}
+			assert.Equal(t, 50, status.Percent)
+			assert.Equal(t, GenerationCTR{Version: "1", Users: 1, Reads: 2, Clicks: 1, CTR: 0.5}, status.Default)
+			if assert.NotNil(t, status.Canary) {
+				assert.Equal(t, GenerationCTR{Version: "2", Users: 1, Reads: 1}, *status.Canary)
+			}
+			return nil
+		}).
+		End()
+
+	// promote the canary ranking model
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/canary/promote").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.Equal(t, int64(2), s.RankingModelVersion)
+	assert.Equal(t, int64(1), s.canaryRankingModelVersion)
+	assert.Equal(t, int64(2), s.localCache.RankingModelVersion)
+	canaryVersion, err := s.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.RankingCanaryVersion)).Integer()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, canaryVersion)
+	// click-through is evaluated again after promotion
+	status := s.GetCanaryStatus()
+	assert.Equal(t, GenerationCTR{Version: "2"}, status.Default)
+	assert.Equal(t, &GenerationCTR{Version: "1"}, status.Canary)
+
+	// roll back by promoting again
+	err = s.PromoteCanary()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), s.RankingModelVersion)
+	assert.Equal(t, int64(2), s.canaryRankingModelVersion)
+}
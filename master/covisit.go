@@ -0,0 +1,179 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/heap"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+type FindCovisitedItemsTask struct {
+	*Master
+}
+
+func NewFindCovisitedItemsTask(m *Master) *FindCovisitedItemsTask {
+	return &FindCovisitedItemsTask{m}
+}
+
+func (t *FindCovisitedItemsTask) name() string {
+	return TaskFindCovisitedItems
+}
+
+func (t *FindCovisitedItemsTask) priority() int {
+	return -t.rankingTrainSet.ItemCount()
+}
+
+// run counts users giving feedback to both items of each pair of items in the time window, and caches the top co-visited
+// items of each item. Co-visited items are written for all items, so that items no longer co-visited are cleared.
+func (t *FindCovisitedItemsTask) run(_ *task.JobsAllocator) error {
+	cfg := t.Config.Recommend.Covisit
+	if !cfg.EnableCovisit {
+		log.Logger().Debug("co-visited items are disabled")
+		return nil
+	}
+	log.Logger().Info("start finding co-visited items")
+	t.taskMonitor.Start(TaskFindCovisitedItems, 2)
+	start := time.Now()
+	timeLimit := start.Add(-cfg.CovisitWindow)
+	feedbackTypes := cfg.FeedbackTypes
+	if len(feedbackTypes) == 0 {
+		feedbackTypes = t.Config.Recommend.DataSource.PositiveFeedbackTypes
+	}
+
+	// STEP 1: count co-visitation in the latest items of each user
+	counter := newCovisitCounter(cfg.MaxUserHistory)
+	feedbackChan, errChan := t.DataClient.GetFeedbackStream(batchSize, &timeLimit, feedbackTypes...)
+	for feedback := range feedbackChan {
+		for _, f := range feedback {
+			if f.Timestamp.Before(timeLimit) || f.Timestamp.After(start) {
+				continue
+			}
+			counter.Add(f.UserId, f.ItemId, f.Timestamp)
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	counts := counter.Count()
+	t.taskMonitor.Update(TaskFindCovisitedItems, 1)
+
+	// STEP 2: cache the top co-visited items of each item
+	numCovisited := 0
+	itemChan, errChan := t.DataClient.GetItemStream(batchSize, nil)
+	for items := range itemChan {
+		for _, item := range items {
+			filter := heap.NewTopKFilter[string, float64](t.Config.Recommend.CacheSize)
+			for itemId, count := range counts[item.ItemId] {
+				filter.Push(itemId, float64(count))
+			}
+			itemIds, scores := filter.PopAll()
+			if len(itemIds) > 0 {
+				numCovisited++
+			}
+			if err := t.CacheClient.SetSorted(cache.Key(cache.CovisitedItems, item.ItemId), cache.CreateScoredItems(itemIds, scores)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	if err := t.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastUpdateCovisitedItemsTime), time.Now())); err != nil {
+		log.Logger().Error("failed to write latest update co-visited items time", zap.Error(err))
+	}
+	t.taskMonitor.Finish(TaskFindCovisitedItems)
+	log.Logger().Info("complete finding co-visited items",
+		zap.Int("n_users", len(counter.histories)),
+		zap.Int("n_covisited", numCovisited),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+// covisitCounter counts co-visitation of items in histories of users. Only the latest items of each user are kept, so
+// that the cost of a user is bounded by the square of the max length of histories. An item is counted once per user
+// no matter how many times the user gave feedback to it.
+type covisitCounter struct {
+	maxHistory int
+	histories  map[string]map[string]time.Time
+}
+
+func newCovisitCounter(maxHistory int) *covisitCounter {
+	return &covisitCounter{maxHistory: maxHistory, histories: make(map[string]map[string]time.Time)}
+}
+
+// Add adds feedback of a user to an item.
+func (c *covisitCounter) Add(userId, itemId string, timestamp time.Time) {
+	history, exist := c.histories[userId]
+	if !exist {
+		history = make(map[string]time.Time)
+		c.histories[userId] = history
+	}
+	if last, exist := history[itemId]; !exist || timestamp.After(last) {
+		history[itemId] = timestamp
+	}
+	// truncate lazily to amortize the cost of sorting
+	if len(history) > 2*c.maxHistory {
+		c.truncate(history)
+	}
+}
+
+// truncate keeps the latest items in a history of a user.
+func (c *covisitCounter) truncate(history map[string]time.Time) []string {
+	itemIds := make([]string, 0, len(history))
+	for itemId := range history {
+		itemIds = append(itemIds, itemId)
+	}
+	sort.Slice(itemIds, func(i, j int) bool {
+		if !history[itemIds[i]].Equal(history[itemIds[j]]) {
+			return history[itemIds[i]].After(history[itemIds[j]])
+		}
+		return itemIds[i] < itemIds[j]
+	})
+	if len(itemIds) > c.maxHistory {
+		for _, itemId := range itemIds[c.maxHistory:] {
+			delete(history, itemId)
+		}
+		itemIds = itemIds[:c.maxHistory]
+	}
+	return itemIds
+}
+
+// Count returns numbers of users co-visiting each pair of items.
+func (c *covisitCounter) Count() map[string]map[string]int {
+	counts := make(map[string]map[string]int)
+	for _, history := range c.histories {
+		itemIds := c.truncate(history)
+		for i, a := range itemIds {
+			for _, b := range itemIds[i+1:] {
+				if _, exist := counts[a]; !exist {
+					counts[a] = make(map[string]int)
+				}
+				if _, exist := counts[b]; !exist {
+					counts[b] = make(map[string]int)
+				}
+				counts[a][b]++
+				counts[b][a]++
+			}
+		}
+	}
+	return counts
+}
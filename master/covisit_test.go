@@ -0,0 +1,122 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestCovisitCounter(t *testing.T) {
+	now := time.Now()
+	counter := newCovisitCounter(3)
+	counter.Add("1", "a", now)
+	counter.Add("1", "b", now)
+	counter.Add("1", "c", now)
+	counter.Add("2", "a", now)
+	counter.Add("2", "b", now)
+	// duplicate feedback is counted once
+	counter.Add("2", "a", now.Add(time.Minute))
+	// only the latest items of a user are counted
+	for i := 0; i < 10; i++ {
+		counter.Add("3", "p"+strconv.Itoa(i), now.Add(time.Duration(i)*time.Minute))
+	}
+	counter.Add("3", "p0", now.Add(-time.Hour))
+	assert.Equal(t, map[string]map[string]int{
+		"a":  {"b": 2, "c": 1},
+		"b":  {"a": 2, "c": 1},
+		"c":  {"a": 1, "b": 1},
+		"p7": {"p8": 1, "p9": 1},
+		"p8": {"p7": 1, "p9": 1},
+		"p9": {"p7": 1, "p8": 1},
+	}, counter.Count())
+}
+
+func TestRunFindCovisitedItemsTask(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like", "star"}
+	m.Config.Recommend.Covisit.EnableCovisit = true
+	m.Config.Recommend.Covisit.CovisitWindow = 24 * time.Hour
+	m.Config.Recommend.Covisit.MaxUserHistory = 3
+
+	// insert items
+	items := []data.Item{{ItemId: "a"}, {ItemId: "b"}, {ItemId: "c"}, {ItemId: "stale"}}
+	for i := 0; i < 10; i++ {
+		items = append(items, data.Item{ItemId: "p" + strconv.Itoa(i)})
+	}
+	err := m.DataClient.BatchInsertItems(items)
+	assert.NoError(t, err)
+	// co-visited items of stale are outdated
+	err = m.CacheClient.SetSorted(cache.Key(cache.CovisitedItems, "stale"), []cache.Scored{{Id: "a", Score: 1}})
+	assert.NoError(t, err)
+
+	// insert feedback
+	now := time.Now()
+	newFeedback := func(feedbackType, userId, itemId string, timestamp time.Time) data.Feedback {
+		return data.Feedback{
+			FeedbackKey: data.FeedbackKey{FeedbackType: feedbackType, UserId: userId, ItemId: itemId},
+			Timestamp:   timestamp,
+		}
+	}
+	feedback := []data.Feedback{
+		newFeedback("like", "1", "a", now.Add(-time.Hour)),
+		newFeedback("like", "1", "b", now.Add(-time.Hour)),
+		newFeedback("like", "1", "c", now.Add(-time.Hour)),
+		newFeedback("like", "2", "a", now.Add(-time.Hour)),
+		newFeedback("like", "2", "b", now.Add(-time.Hour)),
+		newFeedback("like", "3", "a", now.Add(-time.Hour)),
+		newFeedback("star", "3", "a", now.Add(-time.Hour)),
+		newFeedback("star", "3", "b", now.Add(-time.Hour)),
+		newFeedback("star", "3", "c", now.Add(-time.Hour)),
+		// feedback not positive is ignored
+		newFeedback("read", "2", "c", now.Add(-time.Hour)),
+		// feedback out of the window is ignored
+		newFeedback("like", "4", "a", now.Add(-48*time.Hour)),
+		newFeedback("like", "4", "c", now.Add(-48*time.Hour)),
+	}
+	// only the latest items of a power user are counted
+	for i := 0; i < 10; i++ {
+		feedback = append(feedback, newFeedback("like", "power", "p"+strconv.Itoa(i), now.Add(-time.Duration(20-i)*time.Minute)))
+	}
+	err = m.DataClient.BatchInsertFeedback(feedback, true, false, true)
+	assert.NoError(t, err)
+
+	// find co-visited items
+	err = NewFindCovisitedItemsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	covisited, err := m.CacheClient.GetSorted(cache.Key(cache.CovisitedItems, "a"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{Id: "b", Score: 3}, {Id: "c", Score: 2}}, covisited)
+	covisited, err = m.CacheClient.GetSorted(cache.Key(cache.CovisitedItems, "c"), 0, -1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Scored{{Id: "a", Score: 2}, {Id: "b", Score: 2}}, covisited)
+	covisited, err = m.CacheClient.GetSorted(cache.Key(cache.CovisitedItems, "p9"), 0, -1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Scored{{Id: "p7", Score: 1}, {Id: "p8", Score: 1}}, covisited)
+	covisited, err = m.CacheClient.GetSorted(cache.Key(cache.CovisitedItems, "p0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, covisited)
+	covisited, err = m.CacheClient.GetSorted(cache.Key(cache.CovisitedItems, "stale"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, covisited)
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"sort"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"modernc.org/sortutil"
+)
+
+// labelInterner indexes labels shared by at least two users or items while they are streamed. A label is memorized
+// with its first owner until the second occurrence, so that labels used only once never reach the index. Each label
+// string is kept once in the index no matter how many owners share it.
+type labelInterner struct {
+	index base.Index
+	first map[string]int32
+}
+
+func newLabelInterner() *labelInterner {
+	return &labelInterner{
+		index: base.NewMapIndex(),
+		first: make(map[string]int32),
+	}
+}
+
+// intern appends the label to labels of the owner if the label is shared. The label is also appended to labels of
+// its first owner on the second occurrence.
+func (l *labelInterner) intern(labels [][]int32, owner int32, label string) {
+	if id := l.index.ToNumber(label); id != base.NotId {
+		labels[owner] = append(labels[owner], id)
+		return
+	}
+	firstOwner, exist := l.first[label]
+	if !exist {
+		l.first[label] = owner
+		return
+	}
+	delete(l.first, label)
+	l.index.Add(label)
+	id := l.index.ToNumber(label)
+	labels[firstOwner] = append(labels[firstOwner], id)
+	labels[owner] = append(labels[owner], id)
+}
+
+// release drops labels used only once. The index is kept.
+func (l *labelInterner) release() base.Index {
+	l.first = nil
+	return l.index
+}
+
+// sortedUnique sorts and removes duplicates from a slice in place.
+func sortedUnique(a []int32) []int32 {
+	if len(a) == 0 {
+		return a
+	}
+	sort.Sort(sortutil.Int32Slice(a))
+	n := 1
+	for i := 1; i < len(a); i++ {
+		if a[i] != a[n-1] {
+			a[n] = a[i]
+			n++
+		}
+	}
+	return a[:n]
+}
+
+// subtractSorted removes elements of a sorted slice b from a sorted slice a in place.
+func subtractSorted(a, b []int32) []int32 {
+	n, j := 0, 0
+	for _, x := range a {
+		for j < len(b) && b[j] < x {
+			j++
+		}
+		if j < len(b) && b[j] == x {
+			continue
+		}
+		a[n] = x
+		n++
+	}
+	return a[:n]
+}
+
+// containsSorted returns true if a sorted slice a contains x.
+func containsSorted(a []int32, x int32) bool {
+	i := sort.Search(len(a), func(i int) bool { return a[i] >= x })
+	return i < len(a) && a[i] == x
+}
+
+// feedbackContexts collects context labels of the latest feedback of each user-item pair while feedback is streamed.
+// A context label is "key=value" for each selected key in the context of feedback. Feedback without context has no
+// context labels.
+type feedbackContexts struct {
+	keys   []string
+	index  base.Index
+	labels map[lo.Tuple2[int32, int32]]timedContext
+}
+
+type timedContext struct {
+	timestamp time.Time
+	labels    []int32
+}
+
+func newFeedbackContexts(keys []string) *feedbackContexts {
+	return &feedbackContexts{
+		keys:   keys,
+		index:  base.NewMapIndex(),
+		labels: make(map[lo.Tuple2[int32, int32]]timedContext),
+	}
+}
+
+// add collects context labels of feedback unless newer feedback of the same user-item pair has been collected.
+func (c *feedbackContexts) add(userIndex, itemIndex int32, feedback data.Feedback) {
+	pair := lo.Tuple2[int32, int32]{A: userIndex, B: itemIndex}
+	if collected, exist := c.labels[pair]; exist && collected.timestamp.After(feedback.Timestamp) {
+		return
+	}
+	var labels []int32
+	for _, key := range c.keys {
+		if value, exist := feedback.Context[key]; exist {
+			label := key + "=" + value
+			c.index.Add(label)
+			labels = append(labels, c.index.ToNumber(label))
+		}
+	}
+	c.labels[pair] = timedContext{timestamp: feedback.Timestamp, labels: labels}
+}
+
+// features returns context features of a user-item pair, where context labels are shifted by the offset of context
+// labels in the unified index.
+func (c *feedbackContexts) features(userIndex, itemIndex, offset int32) ([]int32, []float32) {
+	labels := c.labels[lo.Tuple2[int32, int32]{A: userIndex, B: itemIndex}].labels
+	features := make([]int32, len(labels))
+	for i, label := range labels {
+		features[i] = offset + label
+	}
+	return features, base.RepeatFloat32s(len(labels), 1)
+}
@@ -0,0 +1,324 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scylladb/go-set/i32set"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model/click"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestLabelInterner(t *testing.T) {
+	interner := newLabelInterner()
+	labels := make([][]int32, 3)
+	interner.intern(labels, 0, "a")
+	interner.intern(labels, 0, "b")
+	assert.Equal(t, [][]int32{nil, nil, nil}, labels)
+	interner.intern(labels, 1, "a")
+	interner.intern(labels, 2, "a")
+	interner.intern(labels, 2, "c")
+	assert.Equal(t, [][]int32{{0}, {0}, {0}}, labels)
+	index := interner.release()
+	assert.Equal(t, int32(1), index.Len())
+	assert.Equal(t, "a", index.ToName(0))
+}
+
+func TestSortedUnique(t *testing.T) {
+	assert.Empty(t, sortedUnique(nil))
+	assert.Equal(t, []int32{1, 2, 3}, sortedUnique([]int32{3, 1, 2, 3, 1}))
+	assert.Equal(t, []int32{1, 3}, subtractSorted([]int32{1, 2, 3, 4}, []int32{0, 2, 4, 5}))
+	assert.Empty(t, subtractSorted([]int32{1, 2}, []int32{1, 2}))
+	assert.Equal(t, []int32{1, 2}, subtractSorted([]int32{1, 2}, nil))
+}
+
+const (
+	benchUsers           = 1000000
+	benchItems           = 100000
+	benchPositivePerUser = 8
+	benchReadPerUser     = 2
+)
+
+// heapSampler tracks the peak heap size while a dataset is loading. The heap size is sampled periodically in
+// background as well as after each batch is streamed, so that peaks during conversions between streams are observed.
+type heapSampler struct {
+	mutex    sync.Mutex
+	peakHeap uint64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func startHeapSampler() *heapSampler {
+	s := &heapSampler{stop: make(chan struct{}), done: make(chan struct{})}
+	s.sample()
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.sample()
+			}
+		}
+	}()
+	return s
+}
+
+func (s *heapSampler) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stats.HeapAlloc > s.peakHeap {
+		s.peakHeap = stats.HeapAlloc
+	}
+}
+
+// Stop stops sampling and returns the peak heap size.
+func (s *heapSampler) Stop() uint64 {
+	close(s.stop)
+	<-s.done
+	s.sample()
+	return s.peakHeap
+}
+
+// syntheticDatabase streams a synthetic dataset of 10M feedback without holding it in memory.
+type syntheticDatabase struct {
+	data.Database
+	sampler *heapSampler
+}
+
+func (d *syntheticDatabase) sample() {
+	d.sampler.sample()
+}
+
+func (d *syntheticDatabase) GetUserStream(batchSize int) (chan []data.User, chan error) {
+	userChan := make(chan []data.User, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(userChan)
+		defer close(errChan)
+		users := make([]data.User, 0, batchSize)
+		for i := 0; i < benchUsers; i++ {
+			users = append(users, data.User{
+				UserId: strconv.Itoa(i),
+				Labels: []string{"age:" + strconv.Itoa(i%100), "city:" + strconv.Itoa(i%1000)},
+			})
+			if len(users) == batchSize {
+				userChan <- users
+				d.sample()
+				users = make([]data.User, 0, batchSize)
+			}
+		}
+		userChan <- users
+		d.sample()
+	}()
+	return userChan, errChan
+}
+
+func (d *syntheticDatabase) GetItemStream(batchSize int, _ *time.Time) (chan []data.Item, chan error) {
+	itemChan := make(chan []data.Item, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(itemChan)
+		defer close(errChan)
+		items := make([]data.Item, 0, batchSize)
+		for i := 0; i < benchItems; i++ {
+			items = append(items, data.Item{
+				ItemId:     strconv.Itoa(i),
+				Categories: []string{strconv.Itoa(i % 10)},
+				Labels:     []string{"tag:" + strconv.Itoa(i%500)},
+				Timestamp:  time.Unix(int64(i), 0),
+			})
+			if len(items) == batchSize {
+				itemChan <- items
+				d.sample()
+				items = make([]data.Item, 0, batchSize)
+			}
+		}
+		itemChan <- items
+		d.sample()
+	}()
+	return itemChan, errChan
+}
+
+func (d *syntheticDatabase) GetFeedbackStream(batchSize int, _ *time.Time, feedbackTypes ...string) (chan []data.Feedback, chan error) {
+	feedbackChan := make(chan []data.Feedback, 1)
+	errChan := make(chan error, 1)
+	numPerUser, offset := benchPositivePerUser, 0
+	if len(feedbackTypes) > 0 && feedbackTypes[0] == "read" {
+		numPerUser, offset = benchReadPerUser, benchPositivePerUser
+	}
+	go func() {
+		defer close(feedbackChan)
+		defer close(errChan)
+		feedback := make([]data.Feedback, 0, batchSize)
+		for i := 0; i < benchUsers; i++ {
+			for j := 0; j < numPerUser; j++ {
+				feedback = append(feedback, data.Feedback{
+					FeedbackKey: data.FeedbackKey{
+						FeedbackType: feedbackTypes[0],
+						UserId:       strconv.Itoa(i),
+						ItemId:       strconv.Itoa((i*31 + (offset+j)*7919) % benchItems),
+					},
+					Timestamp: time.Unix(int64(i), 0),
+				})
+				if len(feedback) == batchSize {
+					feedbackChan <- feedback
+					d.sample()
+					feedback = make([]data.Feedback, 0, batchSize)
+				}
+			}
+		}
+		feedbackChan <- feedback
+		d.sample()
+	}()
+	return feedbackChan, errChan
+}
+
+// loadBaseline loads the synthetic dataset in the way before streaming index construction: labels are indexed without
+// interning, positive and negative feedback are collected into sets per user, and samples of the click dataset are
+// appended to chunks of the default size.
+func loadBaseline(database data.Database) (*ranking.DataSet, *click.Dataset) {
+	rankingDataset := ranking.NewMapIndexDataset()
+	userLabelIndex := base.NewMapIndex()
+	userChan, _ := database.GetUserStream(batchSize)
+	for users := range userChan {
+		for _, user := range users {
+			rankingDataset.AddUser(user.UserId)
+			userIndex := rankingDataset.UserIndex.ToNumber(user.UserId)
+			if len(rankingDataset.UserLabels) == int(userIndex) {
+				rankingDataset.UserLabels = append(rankingDataset.UserLabels, nil)
+			}
+			rankingDataset.UserLabels[userIndex] = make([]int32, 0, len(user.Labels))
+			for _, label := range user.Labels {
+				userLabelIndex.Add(label)
+				rankingDataset.UserLabels[userIndex] = append(rankingDataset.UserLabels[userIndex], userLabelIndex.ToNumber(label))
+			}
+		}
+	}
+	itemLabelIndex := base.NewMapIndex()
+	itemChan, _ := database.GetItemStream(batchSize, nil)
+	for items := range itemChan {
+		for _, item := range items {
+			rankingDataset.AddItem(item.ItemId)
+			itemIndex := rankingDataset.ItemIndex.ToNumber(item.ItemId)
+			if len(rankingDataset.ItemLabels) == int(itemIndex) {
+				rankingDataset.ItemLabels = append(rankingDataset.ItemLabels, nil)
+			}
+			rankingDataset.ItemLabels[itemIndex] = make([]int32, 0, len(item.Labels))
+			for _, label := range item.Labels {
+				itemLabelIndex.Add(label)
+				rankingDataset.ItemLabels[itemIndex] = append(rankingDataset.ItemLabels[itemIndex], itemLabelIndex.ToNumber(label))
+			}
+		}
+	}
+	positiveSet := make([]*i32set.Set, rankingDataset.UserCount())
+	negativeSet := make([]*i32set.Set, rankingDataset.UserCount())
+	for i := range positiveSet {
+		positiveSet[i] = i32set.New()
+		negativeSet[i] = i32set.New()
+	}
+	feedbackChan, _ := database.GetFeedbackStream(batchSize, nil, "star")
+	for feedback := range feedbackChan {
+		for _, f := range feedback {
+			rankingDataset.AddTimedFeedback(f.UserId, f.ItemId, 1, f.Timestamp, false)
+			positiveSet[rankingDataset.UserIndex.ToNumber(f.UserId)].Add(rankingDataset.ItemIndex.ToNumber(f.ItemId))
+		}
+	}
+	feedbackChan, _ = database.GetFeedbackStream(batchSize, nil, "read")
+	for feedback := range feedbackChan {
+		for _, f := range feedback {
+			userIndex := rankingDataset.UserIndex.ToNumber(f.UserId)
+			itemIndex := rankingDataset.ItemIndex.ToNumber(f.ItemId)
+			if !positiveSet[userIndex].Has(itemIndex) {
+				negativeSet[userIndex].Add(itemIndex)
+			}
+		}
+	}
+	clickDataset := &click.Dataset{
+		UserFeatures: rankingDataset.UserLabels,
+		ItemFeatures: rankingDataset.ItemLabels,
+	}
+	for userIndex := range positiveSet {
+		if positiveSet[userIndex].IsEmpty() || negativeSet[userIndex].IsEmpty() {
+			continue
+		}
+		for _, itemIndex := range positiveSet[userIndex].List() {
+			clickDataset.Users.Append(int32(userIndex))
+			clickDataset.Items.Append(itemIndex)
+			clickDataset.Target.Append(1)
+			clickDataset.PositiveCount++
+		}
+		for _, itemIndex := range negativeSet[userIndex].List() {
+			clickDataset.Users.Append(int32(userIndex))
+			clickDataset.Items.Append(itemIndex)
+			clickDataset.Target.Append(-1)
+			clickDataset.NegativeCount++
+		}
+	}
+	return rankingDataset, clickDataset
+}
+
+// BenchmarkLoadDataFromDatabase compares peak and retained heap sizes of loadBaseline and LoadDataFromDatabase.
+func BenchmarkLoadDataFromDatabase(b *testing.B) {
+	m := &Master{taskMonitor: task.NewTaskMonitor()}
+	m.Settings = config.NewSettings()
+	loaders := []struct {
+		name string
+		load func(database data.Database) (*ranking.DataSet, *click.Dataset)
+	}{
+		{"Baseline", loadBaseline},
+		{"Streaming", func(database data.Database) (*ranking.DataSet, *click.Dataset) {
+			rankingDataset, clickDataset, _, _, _, err := m.LoadDataFromDatabase(database, []string{"star"}, []string{"read"}, nil, 0, 0, NewOnlineEvaluator())
+			assert.NoError(b, err)
+			return rankingDataset, clickDataset
+		}},
+	}
+	for _, loader := range loaders {
+		b.Run(loader.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				var before runtime.MemStats
+				runtime.ReadMemStats(&before)
+				database := &syntheticDatabase{sampler: startHeapSampler()}
+				rankingDataset, clickDataset := loader.load(database)
+				peakHeap := database.sampler.Stop()
+				assert.Equal(b, benchUsers*benchPositivePerUser, rankingDataset.Count())
+				runtime.GC()
+				var after runtime.MemStats
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(peakHeap-before.HeapAlloc)/(1<<20), "peak-MB/op")
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "retained-MB/op")
+				runtime.KeepAlive(rankingDataset)
+				runtime.KeepAlive(clickDataset)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+type FindDuplicateItemsTask struct {
+	*Master
+}
+
+func NewFindDuplicateItemsTask(m *Master) *FindDuplicateItemsTask {
+	return &FindDuplicateItemsTask{m}
+}
+
+func (t *FindDuplicateItemsTask) name() string {
+	return TaskFindDuplicateItems
+}
+
+func (t *FindDuplicateItemsTask) priority() int {
+	return -t.rankingTrainSet.ItemCount()
+}
+
+// run clusters items whose labels and comment words are similar. Candidate pairs are items sharing a band of MinHash
+// signatures, and pairs with estimated Jaccard similarity above the threshold are merged into clusters. The oldest
+// item of each cluster is canonical. Items of clusters broken by users are never clustered again.
+func (t *FindDuplicateItemsTask) run(_ *task.JobsAllocator) error {
+	if !t.Config.Recommend.Dedup.EnableDedup {
+		log.Logger().Debug("duplicate detection is disabled")
+		return nil
+	}
+	log.Logger().Info("start finding duplicate items")
+	t.taskMonitor.Start(TaskFindDuplicateItems, 3)
+	start := time.Now()
+	numHashes := t.Config.Recommend.Dedup.NumHashes
+	threshold := t.Config.Recommend.Dedup.SimilarityThreshold
+	breaks, err := t.CacheClient.GetSet(cache.DedupBreaks)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	breakSet := strset.New(breaks...)
+
+	// STEP 1: sign items by MinHash
+	var (
+		itemIds    []string
+		timestamps []time.Time
+		signatures [][]uint32
+	)
+	itemChan, errChan := t.DataClient.GetItemStream(batchSize, nil)
+	for items := range itemChan {
+		for _, item := range items {
+			if item.IsHidden || breakSet.Has(item.ItemId) {
+				continue
+			}
+			tokens := dedupTokens(item)
+			if len(tokens) == 0 {
+				continue
+			}
+			itemIds = append(itemIds, item.ItemId)
+			timestamps = append(timestamps, item.Timestamp)
+			signatures = append(signatures, minHashSignature(tokens, numHashes))
+		}
+	}
+	if err = <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Update(TaskFindDuplicateItems, 1)
+
+	// STEP 2: merge similar items among items sharing a band
+	clusters := newUnionFind(len(itemIds))
+	numBands, bandSize := dedupBands(numHashes, threshold)
+	for b := 0; b < numBands; b++ {
+		buckets := make(map[uint64][]int)
+		for i, signature := range signatures {
+			key := uint64(b)
+			for _, h := range signature[b*bandSize : (b+1)*bandSize] {
+				key = mix64(key ^ uint64(h))
+			}
+			buckets[key] = append(buckets[key], i)
+		}
+		for _, bucket := range buckets {
+			for x := 0; x < len(bucket); x++ {
+				for y := x + 1; y < len(bucket); y++ {
+					i, j := bucket[x], bucket[y]
+					if clusters.find(i) != clusters.find(j) && minHashSimilarity(signatures[i], signatures[j]) >= threshold {
+						clusters.union(i, j)
+					}
+				}
+			}
+		}
+	}
+	t.taskMonitor.Update(TaskFindDuplicateItems, 2)
+
+	// STEP 3: save canonical items of duplicates
+	members := make(map[int][]int)
+	for i := range itemIds {
+		root := clusters.find(i)
+		members[root] = append(members[root], i)
+	}
+	var canonicals []data.ItemCanonical
+	duplicateSet := strset.New()
+	for _, cluster := range members {
+		if len(cluster) < 2 {
+			continue
+		}
+		canonical := cluster[0]
+		for _, i := range cluster[1:] {
+			if timestamps[i].Before(timestamps[canonical]) ||
+				(timestamps[i].Equal(timestamps[canonical]) && itemIds[i] < itemIds[canonical]) {
+				canonical = i
+			}
+		}
+		for _, i := range cluster {
+			if i != canonical {
+				canonicals = append(canonicals, data.ItemCanonical{ItemId: itemIds[i], CanonicalId: itemIds[canonical]})
+				duplicateSet.Add(itemIds[i])
+			}
+		}
+	}
+	prevCanonicals, err := t.DataClient.GetItemCanonicals()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var staleIds []string
+	for _, canonical := range prevCanonicals {
+		if !duplicateSet.Has(canonical.ItemId) {
+			staleIds = append(staleIds, canonical.ItemId)
+		}
+	}
+	if err = t.DataClient.DeleteItemCanonicals(staleIds); err != nil {
+		return errors.Trace(err)
+	}
+	if err = t.DataClient.BatchInsertItemCanonicals(canonicals); err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Finish(TaskFindDuplicateItems)
+	DuplicateItemsTotal.Set(float64(len(canonicals)))
+	log.Logger().Info("complete finding duplicate items",
+		zap.Int("n_items", len(itemIds)),
+		zap.Int("n_duplicates", len(canonicals)),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+// dedupTokens returns labels and lower-cased comment words of an item.
+func dedupTokens(item data.Item) []string {
+	tokens := strset.New()
+	for _, label := range item.Labels {
+		tokens.Add("label:" + label)
+	}
+	for _, word := range strings.Fields(strings.ToLower(item.Comment)) {
+		tokens.Add("word:" + word)
+	}
+	return tokens.List()
+}
+
+// minHashSignature signs a set of tokens by minimal hash values of hash functions.
+func minHashSignature(tokens []string, numHashes int) []uint32 {
+	hashes := make([]uint64, len(tokens))
+	for i, token := range tokens {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(token))
+		hashes[i] = h.Sum64()
+	}
+	signature := make([]uint32, numHashes)
+	for k := range signature {
+		minHash := uint32(math.MaxUint32)
+		for _, h := range hashes {
+			if v := uint32(mix64(uint64(k)<<32 ^ h)); v < minHash {
+				minHash = v
+			}
+		}
+		signature[k] = minHash
+	}
+	return signature
+}
+
+// minHashSimilarity estimates Jaccard similarity by the ratio of equal hash values in signatures.
+func minHashSimilarity(a, b []uint32) float64 {
+	var equal int
+	for k := range a {
+		if a[k] == b[k] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(a))
+}
+
+// dedupBands returns the number of bands and the size of bands for MinHash signatures. The size is the largest one
+// that items with similarity of the threshold share a band with probability of at least 1-1/e, so that candidate
+// pairs are as few as possible while similar pairs are rarely missed.
+func dedupBands(numHashes int, threshold float64) (numBands, bandSize int) {
+	for bandSize = numHashes; bandSize > 1; bandSize-- {
+		numBands = numHashes / bandSize
+		if math.Pow(1/float64(numBands), 1/float64(bandSize)) <= threshold {
+			return numBands, bandSize
+		}
+	}
+	return numHashes, 1
+}
+
+// unionFind is a disjoint-set forest of items.
+type unionFind struct {
+	parents []int
+}
+
+func newUnionFind(n int) *unionFind {
+	parents := make([]int, n)
+	for i := range parents {
+		parents[i] = i
+	}
+	return &unionFind{parents: parents}
+}
+
+func (u *unionFind) find(i int) int {
+	for u.parents[i] != i {
+		u.parents[i] = u.parents[u.parents[i]]
+		i = u.parents[i]
+	}
+	return i
+}
+
+func (u *unionFind) union(i, j int) {
+	u.parents[u.find(i)] = u.find(j)
+}
+
+// DuplicateCluster is a cluster of near-duplicate items.
+type DuplicateCluster struct {
+	CanonicalId string
+	ItemIds     []string
+}
+
+// GetDuplicateClusters returns clusters of near-duplicate items ordered by canonical items.
+func (m *Master) GetDuplicateClusters() ([]DuplicateCluster, error) {
+	canonicals, err := m.DataClient.GetItemCanonicals()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	members := make(map[string][]string)
+	for _, canonical := range canonicals {
+		members[canonical.CanonicalId] = append(members[canonical.CanonicalId], canonical.ItemId)
+	}
+	clusters := make([]DuplicateCluster, 0, len(members))
+	for canonicalId, itemIds := range members {
+		clusters = append(clusters, DuplicateCluster{CanonicalId: canonicalId, ItemIds: itemIds})
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].CanonicalId < clusters[j].CanonicalId
+	})
+	return clusters, nil
+}
+
+// BreakDuplicateCluster removes the cluster of a canonical item. Items of the cluster are never clustered again. It
+// returns the number of removed duplicates.
+func (m *Master) BreakDuplicateCluster(canonicalId string) (int, error) {
+	canonicals, err := m.DataClient.GetItemCanonicals()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	var itemIds []string
+	for _, canonical := range canonicals {
+		if canonical.CanonicalId == canonicalId {
+			itemIds = append(itemIds, canonical.ItemId)
+		}
+	}
+	if len(itemIds) == 0 {
+		return 0, nil
+	}
+	if err = m.CacheClient.AddSet(cache.DedupBreaks, append(itemIds, canonicalId)...); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if err = m.DataClient.DeleteItemCanonicals(itemIds); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return len(itemIds), nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestMinHashSimilarity(t *testing.T) {
+	a := minHashSignature([]string{"1", "2", "3", "4", "5", "6", "7", "8"}, 1024)
+	b := minHashSignature([]string{"1", "2", "3", "4", "5", "6", "9", "10"}, 1024)
+	assert.Equal(t, 1.0, minHashSimilarity(a, a))
+	assert.InDelta(t, 0.6, minHashSimilarity(a, b), 0.1)
+}
+
+func TestDedupBands(t *testing.T) {
+	for _, threshold := range []float64{0.5, 0.8, 0.9} {
+		numBands, bandSize := dedupBands(128, threshold)
+		assert.LessOrEqual(t, numBands*bandSize, 128)
+		assert.LessOrEqual(t, math.Pow(1/float64(numBands), 1/float64(bandSize)), threshold)
+	}
+	// a larger threshold requires larger bands
+	_, small := dedupBands(128, 0.5)
+	_, large := dedupBands(128, 0.9)
+	assert.Less(t, small, large)
+}
+
+func TestRunFindDuplicateItemsTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Recommend.Dedup.EnableDedup = true
+
+	// insert items
+	comment := "Red running shoes for men"
+	err := m.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "copy", Labels: []string{"shoes", "red"}, Comment: comment, Timestamp: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "original", Labels: []string{"shoes", "red"}, Comment: comment, Timestamp: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "upper", Labels: []string{"shoes", "red"}, Comment: "RED RUNNING SHOES FOR MEN", Timestamp: time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "hidden", Labels: []string{"shoes", "red"}, Comment: comment, IsHidden: true},
+		{ItemId: "other", Labels: []string{"hat", "blue"}, Comment: "Blue summer hat for women"},
+		{ItemId: "empty"},
+	})
+	assert.NoError(t, err)
+	err = m.DataClient.BatchInsertItemCanonicals([]data.ItemCanonical{{ItemId: "other", CanonicalId: "stale"}})
+	assert.NoError(t, err)
+
+	// find duplicate items
+	err = NewFindDuplicateItemsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	canonicals, err := m.DataClient.GetItemCanonicals()
+	assert.NoError(t, err)
+	assert.Equal(t, []data.ItemCanonical{
+		{ItemId: "copy", CanonicalId: "original"},
+		{ItemId: "upper", CanonicalId: "original"},
+	}, canonicals)
+	clusters, err := m.GetDuplicateClusters()
+	assert.NoError(t, err)
+	assert.Equal(t, []DuplicateCluster{{CanonicalId: "original", ItemIds: []string{"copy", "upper"}}}, clusters)
+
+	// broken clusters are never clustered again
+	count, err := m.BreakDuplicateCluster("original")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	breaks, err := m.CacheClient.GetSet(cache.DedupBreaks)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"copy", "upper", "original"}, breaks)
+	err = NewFindDuplicateItemsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	canonicals, err = m.DataClient.GetItemCanonicals()
+	assert.NoError(t, err)
+	assert.Empty(t, canonicals)
+	count, err = m.BreakDuplicateCluster("original")
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestMaster_LoadDataFromDatabase_Duplicates(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = &config.Config{}
+	m.Config.Recommend.CacheSize = 10
+	m.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"positive"}
+	m.Config.Recommend.Dedup.EnableDedup = true
+
+	// insert items and feedback
+	var items []data.Item
+	for i := 0; i < 3; i++ {
+		items = append(items, data.Item{ItemId: strconv.Itoa(i), Labels: []string{"a"}, Timestamp: time.Now()})
+	}
+	err := m.DataClient.BatchInsertItems(items)
+	assert.NoError(t, err)
+	var feedback []data.Feedback
+	for i, count := range []int{1, 2, 2} {
+		for j := 0; j < count; j++ {
+			feedback = append(feedback, data.Feedback{
+				FeedbackKey: data.FeedbackKey{FeedbackType: "positive", UserId: strconv.Itoa(j), ItemId: strconv.Itoa(i)},
+				Timestamp:   time.Now().Add(-time.Hour),
+			})
+		}
+	}
+	err = m.DataClient.BatchInsertFeedback(feedback, true, false, true)
+	assert.NoError(t, err)
+	err = m.DataClient.BatchInsertItemCanonicals([]data.ItemCanonical{{ItemId: "1", CanonicalId: "0"}})
+	assert.NoError(t, err)
+
+	// feedback on duplicates counts for canonical items
+	_, _, _, popularItems, labelPopularItems, err := m.LoadDataFromDatabase(m.DataClient, []string{"positive"}, nil, nil, 0, 0, NewOnlineEvaluator())
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{Id: "0", Score: 3}, {Id: "2", Score: 2}}, popularItems[""])
+	assert.Equal(t, []cache.Scored{{Id: "0", Score: 3}, {Id: "2", Score: 2}}, labelPopularItems["a"])
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+// DigestLookup is the user id of a digest in cache keys and logs.
+type DigestLookup struct {
+	Digest string
+	UserId string
+}
+
+// scanDigests computes digests of all users under the current secret and the previous secret. Digests can't be
+// reversed, so that users are scanned from the data store.
+func (m *Master) scanDigests(visit func(digest, userId string)) error {
+	secrets := []string{m.Config.Database.IdObfuscationSecret}
+	if m.Config.Database.IdObfuscationPreviousSecret != "" {
+		secrets = append(secrets, m.Config.Database.IdObfuscationPreviousSecret)
+	}
+	userChan, errChan := m.DataClient.GetUserStream(batchSize)
+	for users := range userChan {
+		for _, user := range users {
+			for _, secret := range secrets {
+				visit(cache.DigestID(secret, user.UserId), user.UserId)
+			}
+		}
+	}
+	return errors.Trace(<-errChan)
+}
+
+// resolveDigests returns user ids of digests of all users.
+func (m *Master) resolveDigests() (map[string]string, error) {
+	digests := make(map[string]string)
+	if err := m.scanDigests(func(digest, userId string) {
+		digests[digest] = userId
+	}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return digests, nil
+}
+
+func (m *Master) lookupDigest(request *restful.Request, response *restful.Response) {
+	if m.Config.Database.IdObfuscationSecret == "" {
+		server.BadRequest(response, errors.NotSupportedf("user ids aren't obfuscated"))
+		return
+	}
+	digest := request.PathParameter("digest")
+	if !cache.IsDigest(digest) {
+		server.BadRequest(response, errors.NotValidf("digest %s", digest))
+		return
+	}
+	lookup := DigestLookup{Digest: digest}
+	if err := m.scanDigests(func(d, userId string) {
+		if d == digest {
+			lookup.UserId = userId
+		}
+	}); err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	if lookup.UserId == "" {
+		server.PageNotFound(response, errors.NotFoundf("user of digest %s", digest))
+		return
+	}
+	server.Ok(response, lookup)
+}
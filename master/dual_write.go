@@ -0,0 +1,88 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"go.uber.org/zap"
+)
+
+type CheckDivergenceTask struct {
+	*Master
+}
+
+func NewCheckDivergenceTask(m *Master) *CheckDivergenceTask {
+	return &CheckDivergenceTask{m}
+}
+
+func (t *CheckDivergenceTask) name() string {
+	return TaskCheckDivergence
+}
+
+func (t *CheckDivergenceTask) priority() int {
+	return -2 * t.Config.Database.ShadowCheckSamples
+}
+
+// run compares sampled users and items between the data store and the shadow data store. Operators could switch to
+// the shadow data store once the divergence rate is zero and no write is queued.
+func (t *CheckDivergenceTask) run(_ *task.JobsAllocator) error {
+	numSamples := t.Config.Database.ShadowCheckSamples
+	log.Logger().Info("start checking divergence of shadow data store", zap.Int("n_samples", numSamples))
+	t.taskMonitor.Start(TaskCheckDivergence, 1)
+	divergence, err := t.dualWrite.CheckDivergence(numSamples, numSamples, rand.Int63())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	DataStoreDivergenceRate.Set(divergence.DivergenceRate)
+	ShadowQueuedWritesTotal.Set(float64(divergence.NumQueuedWrites))
+	t.taskMonitor.SetDetails(TaskCheckDivergence, *divergence)
+	t.taskMonitor.Finish(TaskCheckDivergence)
+	log.Logger().Info("complete checking divergence of shadow data store",
+		zap.Int("n_diverged_users", divergence.NumDivergedUsers),
+		zap.Int("n_diverged_items", divergence.NumDivergedItems),
+		zap.Int("n_queued_writes", divergence.NumQueuedWrites),
+		zap.Float64("divergence_rate", divergence.DivergenceRate))
+	return nil
+}
+
+// RunCheckDivergenceLoop checks divergence of the shadow data store periodically. It never runs if the shadow data
+// store isn't configured or the period is zero.
+func (m *Master) RunCheckDivergenceLoop() {
+	defer base.CheckPanic()
+	period := m.Config.Database.ShadowCheckPeriod
+	if m.dualWrite == nil || period <= 0 {
+		return
+	}
+	for {
+		time.Sleep(period)
+		t := NewCheckDivergenceTask(m)
+		if !m.jobsScheduler.Register(t.name(), t.priority(), false) {
+			continue
+		}
+		j := m.jobsScheduler.GetJobsAllocator(t.name())
+		j.Init()
+		if err := t.run(j); err != nil {
+			log.Logger().Error("failed to run task", zap.String("task", t.name()), zap.Error(err))
+			m.taskMonitor.Fail(t.name(), err.Error())
+		}
+		m.jobsScheduler.Unregister(t.name())
+	}
+}
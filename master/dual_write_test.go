@@ -0,0 +1,68 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestCheckDivergenceTask(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	shadowStoreServer, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer shadowStoreServer.Close()
+	shadowClient, err := data.Open("redis://"+shadowStoreServer.Addr(), "")
+	assert.NoError(t, err)
+	m.dualWrite, err = data.NewDualWriteDatabase(m.DataClient, shadowClient, "", m.Config.Database.ShadowRetryInterval)
+	assert.NoError(t, err)
+	defer m.dualWrite.Close()
+	err = m.dualWrite.Init()
+	assert.NoError(t, err)
+	m.DataClient = m.dualWrite
+
+	// users written to both data stores are consistent
+	err = m.DataClient.BatchInsertUsers([]data.User{{UserId: "1"}})
+	assert.NoError(t, err)
+	shadowStoreServer.SetError("shadow data store is down")
+	err = m.DataClient.BatchInsertUsers([]data.User{{UserId: "2"}})
+	assert.NoError(t, err)
+	shadowStoreServer.SetError("")
+	err = NewCheckDivergenceTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	divergence, ok := m.taskMonitor.GetTask(TaskCheckDivergence).Details.(data.Divergence)
+	assert.True(t, ok)
+	assert.Equal(t, 2, divergence.NumUsers)
+	assert.Equal(t, 1, divergence.NumDivergedUsers)
+	assert.Equal(t, 1, divergence.NumQueuedWrites)
+	assert.Equal(t, []string{"user/2"}, divergence.DivergedEntities)
+
+	// queued writes are replayed
+	n, err := m.dualWrite.Replay()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	err = NewCheckDivergenceTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	divergence, ok = m.taskMonitor.GetTask(TaskCheckDivergence).Details.(data.Divergence)
+	assert.True(t, ok)
+	assert.Zero(t, divergence.DivergenceRate)
+	assert.Zero(t, divergence.NumQueuedWrites)
+}
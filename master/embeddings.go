@@ -0,0 +1,237 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/blob"
+	"go.uber.org/zap"
+)
+
+// Kinds of embeddings.
+const (
+	UserEmbeddings = "users"
+	ItemEmbeddings = "items"
+)
+
+// Formats of exported embeddings.
+const (
+	EmbeddingFormatJSONL  = "jsonl"
+	EmbeddingFormatBinary = "binary"
+)
+
+// embeddingMagic starts embeddings in the binary format.
+var embeddingMagic = [8]byte{'G', 'O', 'R', 'S', 'E', 'E', 'M', 'B'}
+
+// embeddingFormatVersion is the version of the binary format.
+const embeddingFormatVersion uint32 = 1
+
+// EmbeddingHeader precedes exported embeddings. Downstream systems detect stale embeddings by the model version.
+type EmbeddingHeader struct {
+	Kind         string
+	ModelName    string
+	ModelVersion int64
+	Dimension    int
+	Count        int
+}
+
+// Embedding is the embedding of a user or an item.
+type Embedding struct {
+	Id     string
+	Vector []float32
+}
+
+// embeddingMatrix is the view of embeddings of users or items in a matrix factorization model.
+type embeddingMatrix struct {
+	index       base.Index
+	predictable func(int32) bool
+	factor      func(int32) []float32
+}
+
+func newEmbeddingMatrix(model ranking.MatrixFactorization, kind string) (embeddingMatrix, error) {
+	switch kind {
+	case UserEmbeddings:
+		return embeddingMatrix{index: model.GetUserIndex(), predictable: model.IsUserPredictable, factor: model.GetUserFactor}, nil
+	case ItemEmbeddings:
+		return embeddingMatrix{index: model.GetItemIndex(), predictable: model.IsItemPredictable, factor: model.GetItemFactor}, nil
+	default:
+		return embeddingMatrix{}, errors.NotValidf("kind of embeddings %s", kind)
+	}
+}
+
+// WriteEmbeddings writes embeddings of users or items in a matrix factorization model. Only embeddings trained by
+// feedback are written, since others are random. Embeddings are written one by one, so that the matrix is never
+// copied. The model must not be modified while writing.
+//
+// In the JSON lines format, the first line is the header followed by a line per embedding. In the binary format, all
+// numbers are little-endian:
+//
+//	header:    magic "GORSEEMB", format version (uint32), model version (int64), dimension (uint32), count (uint64),
+//	           length of model name (uint32), model name
+//	embedding: length of id (uint32), id, vector (dimension * float32)
+func WriteEmbeddings(w io.Writer, model ranking.MatrixFactorization, name string, version int64, kind, format string) error {
+	matrix, err := newEmbeddingMatrix(model, kind)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	header := EmbeddingHeader{Kind: kind, ModelName: name, ModelVersion: version}
+	for i := int32(0); i < matrix.index.Len(); i++ {
+		if matrix.predictable(i) {
+			header.Count++
+			header.Dimension = len(matrix.factor(i))
+		}
+	}
+	buf := bufio.NewWriter(w)
+	switch format {
+	case EmbeddingFormatJSONL:
+		err = writeEmbeddingsJSONL(buf, matrix, header)
+	case EmbeddingFormatBinary:
+		err = writeEmbeddingsBinary(buf, matrix, header)
+	default:
+		return errors.NotValidf("format of embeddings %s", format)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(buf.Flush())
+}
+
+func writeEmbeddingsJSONL(w io.Writer, matrix embeddingMatrix, header EmbeddingHeader) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(header); err != nil {
+		return errors.Trace(err)
+	}
+	for i := int32(0); i < matrix.index.Len(); i++ {
+		if !matrix.predictable(i) {
+			continue
+		}
+		if err := encoder.Encode(Embedding{Id: matrix.index.ToName(i), Vector: matrix.factor(i)}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func writeEmbeddingsBinary(w io.Writer, matrix embeddingMatrix, header EmbeddingHeader) error {
+	if err := binary.Write(w, binary.LittleEndian, embeddingMagic); err != nil {
+		return errors.Trace(err)
+	}
+	for _, v := range []interface{}{embeddingFormatVersion, header.ModelVersion, uint32(header.Dimension),
+		uint64(header.Count), uint32(len(header.ModelName))} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if _, err := io.WriteString(w, header.ModelName); err != nil {
+		return errors.Trace(err)
+	}
+	row := make([]byte, 4*header.Dimension)
+	for i := int32(0); i < matrix.index.Len(); i++ {
+		if !matrix.predictable(i) {
+			continue
+		}
+		id := matrix.index.ToName(i)
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(id))); err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := io.WriteString(w, id); err != nil {
+			return errors.Trace(err)
+		}
+		for j, value := range matrix.factor(i) {
+			binary.LittleEndian.PutUint32(row[4*j:], math.Float32bits(value))
+		}
+		if _, err := w.Write(row); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// liveRankingModel returns the live ranking model with its name and version. Trained models are replaced instead of
+// modified, so that the returned model could be read without the lock.
+func (m *Master) liveRankingModel() (ranking.MatrixFactorization, string, int64) {
+	m.rankingModelMutex.RLock()
+	defer m.rankingModelMutex.RUnlock()
+	return m.RankingModel, m.rankingModelName, m.RankingModelVersion
+}
+
+// exportEmbeddings streams embeddings of users or items in the live ranking model.
+func (m *Master) exportEmbeddings(kind string) restful.RouteFunction {
+	return func(request *restful.Request, response *restful.Response) {
+		format := request.QueryParameter("format")
+		if format == "" {
+			format = EmbeddingFormatJSONL
+		}
+		if format != EmbeddingFormatJSONL && format != EmbeddingFormatBinary {
+			server.BadRequest(response, fmt.Errorf("unknown format %s", format))
+			return
+		}
+		model, name, version := m.liveRankingModel()
+		if model == nil || model.Invalid() {
+			server.PageNotFound(response, errors.New("ranking model hasn't been trained"))
+			return
+		}
+		if format == EmbeddingFormatBinary {
+			response.Header().Set("Content-Type", restful.MIME_OCTET)
+		} else {
+			response.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		response.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s.%s", kind, format))
+		if err := WriteEmbeddings(response, model, name, version, kind, format); err != nil {
+			log.ResponseLogger(response).Error("failed to export embeddings", zap.String("kind", kind), zap.Error(err))
+		}
+	}
+}
+
+// embeddingsBlob returns the name of exported embeddings in the blob store. Versions are padded, so that the latest
+// embeddings are listed last.
+func embeddingsBlob(kind string, version int64, format string) string {
+	return fmt.Sprintf("embeddings/%s/%016x.%s", kind, version, format)
+}
+
+// exportEmbeddingsToBlob writes embeddings of users and items in the live ranking model to the blob store if the
+// export is enabled. Failures are logged since the model is serving anyway.
+func (m *Master) exportEmbeddingsToBlob() {
+	format := m.Config.Master.EmbeddingExportFormat
+	if format == "" || m.blobStore == nil {
+		return
+	}
+	model, name, version := m.liveRankingModel()
+	if model == nil || model.Invalid() {
+		return
+	}
+	for _, kind := range []string{UserEmbeddings, ItemEmbeddings} {
+		blobName := embeddingsBlob(kind, version, format)
+		if err := blob.Write(m.blobStore, blobName, func(w io.Writer) error {
+			return WriteEmbeddings(w, model, name, version, kind, format)
+		}); err != nil {
+			log.Logger().Error("failed to export embeddings", zap.String("blob", blobName), zap.Error(err))
+			continue
+		}
+		log.Logger().Info("export embeddings", zap.String("blob", blobName))
+	}
+}
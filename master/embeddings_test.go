@@ -0,0 +1,204 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/blob"
+)
+
+func newEmbeddingModel() *ranking.BPR {
+	dataset := ranking.NewMapIndexDataset()
+	for i := 0; i < 10; i++ {
+		dataset.AddFeedback(strconv.Itoa(i), strconv.Itoa(i), true)
+	}
+	// embeddings of users and items without feedback aren't trained
+	dataset.AddUser("untrained")
+	dataset.AddItem("untrained")
+	bpr := ranking.NewBPR(nil)
+	bpr.Fit(dataset, dataset, nil)
+	return bpr
+}
+
+// readEmbeddingsJSONL reads embeddings in the JSON lines format.
+func readEmbeddingsJSONL(t *testing.T, r io.Reader) (EmbeddingHeader, map[string][]float32) {
+	var header EmbeddingHeader
+	embeddings := make(map[string][]float32)
+	scanner := bufio.NewScanner(r)
+	if assert.True(t, scanner.Scan()) {
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &header))
+	}
+	for scanner.Scan() {
+		var embedding Embedding
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &embedding))
+		embeddings[embedding.Id] = embedding.Vector
+	}
+	return header, embeddings
+}
+
+// readEmbeddingsBinary reads embeddings in the binary format.
+func readEmbeddingsBinary(t *testing.T, r io.Reader) (EmbeddingHeader, map[string][]float32) {
+	var (
+		magic         [8]byte
+		formatVersion uint32
+		modelVersion  int64
+		dimension     uint32
+		count         uint64
+		nameLength    uint32
+	)
+	for _, v := range []interface{}{&magic, &formatVersion, &modelVersion, &dimension, &count, &nameLength} {
+		assert.NoError(t, binary.Read(r, binary.LittleEndian, v))
+	}
+	assert.Equal(t, embeddingMagic, magic)
+	assert.Equal(t, embeddingFormatVersion, formatVersion)
+	name := make([]byte, nameLength)
+	_, err := io.ReadFull(r, name)
+	assert.NoError(t, err)
+	header := EmbeddingHeader{ModelName: string(name), ModelVersion: modelVersion, Dimension: int(dimension), Count: int(count)}
+	embeddings := make(map[string][]float32)
+	for i := uint64(0); i < count; i++ {
+		var idLength uint32
+		assert.NoError(t, binary.Read(r, binary.LittleEndian, &idLength))
+		id := make([]byte, idLength)
+		_, err = io.ReadFull(r, id)
+		assert.NoError(t, err)
+		row := make([]byte, 4*dimension)
+		_, err = io.ReadFull(r, row)
+		assert.NoError(t, err)
+		vector := make([]float32, dimension)
+		for j := range vector {
+			vector[j] = math.Float32frombits(binary.LittleEndian.Uint32(row[4*j:]))
+		}
+		embeddings[string(id)] = vector
+	}
+	n, _ := r.Read(make([]byte, 1))
+	assert.Zero(t, n)
+	return header, embeddings
+}
+
+func TestWriteEmbeddings(t *testing.T) {
+	bpr := newEmbeddingModel()
+	// embeddings in the JSON lines format
+	var buf bytes.Buffer
+	err := WriteEmbeddings(&buf, bpr, "bpr", 123, ItemEmbeddings, EmbeddingFormatJSONL)
+	assert.NoError(t, err)
+	header, embeddings := readEmbeddingsJSONL(t, &buf)
+	assert.Equal(t, EmbeddingHeader{Kind: ItemEmbeddings, ModelName: "bpr", ModelVersion: 123, Dimension: len(bpr.ItemFactor[0]), Count: 10}, header)
+	assert.Len(t, embeddings, 10)
+	assert.NotContains(t, embeddings, "untrained")
+	itemIndex := bpr.GetItemIndex().ToNumber("1")
+	assert.Equal(t, bpr.GetItemFactor(itemIndex), embeddings["1"])
+
+	// embeddings in the binary format
+	buf.Reset()
+	err = WriteEmbeddings(&buf, bpr, "bpr", 123, UserEmbeddings, EmbeddingFormatBinary)
+	assert.NoError(t, err)
+	header, embeddings = readEmbeddingsBinary(t, &buf)
+	assert.Equal(t, EmbeddingHeader{ModelName: "bpr", ModelVersion: 123, Dimension: len(bpr.UserFactor[0]), Count: 10}, header)
+	assert.Len(t, embeddings, 10)
+	assert.NotContains(t, embeddings, "untrained")
+	userIndex := bpr.GetUserIndex().ToNumber("1")
+	assert.Equal(t, bpr.GetUserFactor(userIndex), embeddings["1"])
+
+	// unknown kinds and formats
+	err = WriteEmbeddings(&buf, bpr, "bpr", 123, "unknown", EmbeddingFormatJSONL)
+	assert.Error(t, err)
+	err = WriteEmbeddings(&buf, bpr, "bpr", 123, ItemEmbeddings, "unknown")
+	assert.Error(t, err)
+}
+
+func TestMaster_ExportEmbeddings(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+
+	// export embeddings of untrained model
+	req := httptest.NewRequest("GET", "https://example.com/api/admin/embeddings/items", nil)
+	req.Header.Set("Cookie", cookie)
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// export embeddings of trained model
+	bpr := newEmbeddingModel()
+	s.RankingModel = bpr
+	s.rankingModelName = "bpr"
+	s.RankingModelVersion = 123
+	req = httptest.NewRequest("GET", "https://example.com/api/admin/embeddings/items", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	header, embeddings := readEmbeddingsJSONL(t, w.Body)
+	assert.Equal(t, int64(123), header.ModelVersion)
+	assert.Len(t, embeddings, 10)
+	req = httptest.NewRequest("GET", "https://example.com/api/admin/embeddings/users?format=binary", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	header, embeddings = readEmbeddingsBinary(t, w.Body)
+	assert.Equal(t, int64(123), header.ModelVersion)
+	assert.Len(t, embeddings, 10)
+	req = httptest.NewRequest("GET", "https://example.com/api/admin/embeddings/users?format=unknown", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// export embeddings to the blob store
+	store, err := blob.Open(t.TempDir())
+	assert.NoError(t, err)
+	s.blobStore = store
+	s.Config.Master.EmbeddingExportFormat = EmbeddingFormatBinary
+	s.exportEmbeddingsToBlob()
+	names, err := store.List("embeddings/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"embeddings/items/000000000000007b.binary", "embeddings/users/000000000000007b.binary"}, names)
+	r, err := store.Get(names[0])
+	assert.NoError(t, err)
+	defer r.Close()
+	header, embeddings = readEmbeddingsBinary(t, r)
+	assert.Equal(t, int64(123), header.ModelVersion)
+	assert.Len(t, embeddings, 10)
+}
+
+func TestMaster_ExportEmbeddings_Forbidden(t *testing.T) {
+	s, _ := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Master.DashboardUserName = "admin"
+	s.Config.Master.DashboardPassword = "admin"
+	s.Config.Server.APIKey = "api_key"
+	s.Config.Server.AdminAPIKey = "admin_api_key"
+	s.RankingModel = newEmbeddingModel()
+	req := httptest.NewRequest("GET", "https://example.com/api/admin/embeddings/items", nil)
+	req.Header.Set("X-API-Key", "api_key")
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,310 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+// Kinds of label rewrites. A label is renamed to a label not in use, or merged into a label in use.
+const (
+	LabelRewriteRename = "rename"
+	LabelRewriteMerge  = "merge"
+)
+
+// Stages of label rewrites. Items are rewritten before users.
+const (
+	LabelRewriteItems     = "items"
+	LabelRewriteUsers     = "users"
+	LabelRewriteDone      = "done"
+	LabelRewriteCancelled = "cancelled"
+)
+
+// LabelRewrite is the progress record of a label rewrite. Items and users are rewritten in batches, and the cursor of
+// the next batch is recorded after each batch. An unfinished rewrite is resumed from the cursor once the master
+// restarts or the same rewrite is requested again.
+type LabelRewrite struct {
+	Kind       string
+	From       string
+	To         string
+	Stage      string
+	Cursor     string
+	NumScanned int // number of scanned items and users
+	NumItems   int // number of rewritten items
+	NumUsers   int // number of rewritten users
+	StartTime  time.Time
+	UpdateTime time.Time
+	Error      string
+}
+
+// Pending returns true if the rewrite is unfinished.
+func (r *LabelRewrite) Pending() bool {
+	return r.Stage == LabelRewriteItems || r.Stage == LabelRewriteUsers
+}
+
+// LabelRewriteRun is the result of a request to rewrite a label.
+type LabelRewriteRun struct {
+	Task    string
+	Started bool
+}
+
+// RewriteLabel starts renaming a label or merging a label into another label in background. The rewrite isn't started
+// if another rewrite is running, and false is returned. An unfinished rewrite of other labels must be finished first.
+func (m *Master) RewriteLabel(kind, from, to string) (bool, error) {
+	if from == "" || to == "" || from == to {
+		return false, errors.NotValidf("rewrite label %q to %q", from, to)
+	}
+	if !m.labelRewriteRunning.TryLock() {
+		return false, nil
+	}
+	record, err := m.newLabelRewrite(kind, from, to)
+	if err != nil {
+		m.labelRewriteRunning.Unlock()
+		return false, errors.Trace(err)
+	}
+	go func() {
+		defer base.CheckPanic()
+		defer m.labelRewriteRunning.Unlock()
+		if err := m.rewriteLabel(record); err != nil {
+			log.Logger().Error("failed to rewrite label", zap.String("from", record.From), zap.String("to", record.To), zap.Error(err))
+			m.taskMonitor.Fail(TaskRewriteLabel, err.Error())
+		}
+	}()
+	return true, nil
+}
+
+// newLabelRewrite creates a label rewrite, or returns the unfinished rewrite of the same labels to resume.
+func (m *Master) newLabelRewrite(kind, from, to string) (*LabelRewrite, error) {
+	record, err := m.GetLabelRewrite()
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		return nil, errors.Trace(err)
+	}
+	if record != nil && record.Pending() {
+		if record.From != from || record.To != to {
+			return nil, errors.AlreadyExistsf("unfinished rewrite of label %v to %v", record.From, record.To)
+		}
+		record.Error = ""
+		return record, nil
+	}
+	labels, err := m.DataClient.GetLabels()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	names := lo.Map(labels, func(label data.LabelCount, _ int) string {
+		return label.Name
+	})
+	if !lo.Contains(names, from) {
+		return nil, errors.NotFoundf("label %v", from)
+	}
+	switch kind {
+	case LabelRewriteRename:
+		if lo.Contains(names, to) {
+			return nil, errors.AlreadyExistsf("label %v (merge labels instead)", to)
+		}
+	case LabelRewriteMerge:
+		if !lo.Contains(names, to) {
+			return nil, errors.NotFoundf("label %v (rename the label instead)", to)
+		}
+	default:
+		return nil, errors.NotValidf("label rewrite %v", kind)
+	}
+	return &LabelRewrite{Kind: kind, From: from, To: to, Stage: LabelRewriteItems, StartTime: time.Now()}, nil
+}
+
+// ResumeLabelRewrite resumes the unfinished label rewrite in background if exists.
+func (m *Master) ResumeLabelRewrite() {
+	record, err := m.GetLabelRewrite()
+	if errors.Is(err, errors.NotFound) {
+		return
+	} else if err != nil {
+		log.Logger().Error("failed to load label rewrite", zap.Error(err))
+		return
+	}
+	if !record.Pending() {
+		return
+	}
+	log.Logger().Info("resume label rewrite", zap.String("from", record.From), zap.String("to", record.To))
+	if _, err = m.RewriteLabel(record.Kind, record.From, record.To); err != nil {
+		log.Logger().Error("failed to resume label rewrite", zap.Error(err))
+	}
+}
+
+// GetLabelRewrite returns the progress record of the latest label rewrite.
+func (m *Master) GetLabelRewrite() (*LabelRewrite, error) {
+	text, err := m.CacheClient.Get(cache.LabelRewrite).String()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var record LabelRewrite
+	if err = json.Unmarshal([]byte(text), &record); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &record, nil
+}
+
+func (m *Master) saveLabelRewrite(record *LabelRewrite) error {
+	record.UpdateTime = time.Now()
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return m.CacheClient.Set(cache.String(cache.LabelRewrite, string(buf)))
+}
+
+// rewriteLabel rewrites labels of items and then users in batches. Rewritten items and users are marked modified, so
+// that their neighbors are searched again in the next cycle.
+func (m *Master) rewriteLabel(record *LabelRewrite) error {
+	numItems, err := m.DataClient.CountItems()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	numUsers, err := m.DataClient.CountUsers()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rewriteTask := m.taskMonitor.Start(TaskRewriteLabel, numItems+numUsers)
+	rewriteTask.Update(record.NumScanned)
+	startTime := time.Now()
+	log.Logger().Info("start rewriting label",
+		zap.String("kind", record.Kind),
+		zap.String("from", record.From),
+		zap.String("to", record.To),
+		zap.String("stage", record.Stage),
+		zap.Int("n_scanned", record.NumScanned))
+	if err = m.saveLabelRewrite(record); err != nil {
+		return errors.Trace(err)
+	}
+	for record.Pending() {
+		if rewriteTask.Cancelled() {
+			record.Stage, record.Error = LabelRewriteCancelled, context.Canceled.Error()
+			return errors.Trace(m.saveLabelRewrite(record))
+		}
+		if record.Stage == LabelRewriteItems {
+			err = m.rewriteItemLabels(record)
+		} else {
+			err = m.rewriteUserLabels(record)
+		}
+		if err != nil {
+			record.Error = err.Error()
+			if saveErr := m.saveLabelRewrite(record); saveErr != nil {
+				log.Logger().Error("failed to save label rewrite", zap.Error(saveErr))
+			}
+			return errors.Trace(err)
+		}
+		if err = m.saveLabelRewrite(record); err != nil {
+			return errors.Trace(err)
+		}
+		rewriteTask.Update(record.NumScanned)
+	}
+	rewriteTask.Finish()
+	log.Logger().Info("complete rewriting label",
+		zap.String("from", record.From),
+		zap.String("to", record.To),
+		zap.Int("n_items", record.NumItems),
+		zap.Int("n_users", record.NumUsers),
+		zap.String("used_time", time.Since(startTime).String()))
+	return nil
+}
+
+// rewriteItemLabels rewrites labels of the next batch of items.
+func (m *Master) rewriteItemLabels(record *LabelRewrite) error {
+	cursor, items, err := m.DataClient.GetItems(record.Cursor, batchSize, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var rewritten []data.Item
+	for _, item := range items {
+		if labels, replaced := replaceLabel(item.Labels, record.From, record.To); replaced {
+			item.Labels = labels
+			rewritten = append(rewritten, item)
+		}
+	}
+	if len(rewritten) > 0 {
+		if err = m.DataClient.BatchInsertItems(rewritten); err != nil {
+			return errors.Trace(err)
+		}
+		if err = m.CacheClient.Set(lo.Map(rewritten, func(item data.Item, _ int) cache.Value {
+			return cache.Time(cache.Key(cache.LastModifyItemTime, item.ItemId), time.Now())
+		})...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	record.NumScanned += len(items)
+	record.NumItems += len(rewritten)
+	record.Cursor = cursor
+	if cursor == "" {
+		record.Stage = LabelRewriteUsers
+	}
+	return nil
+}
+
+// rewriteUserLabels rewrites labels of the next batch of users.
+func (m *Master) rewriteUserLabels(record *LabelRewrite) error {
+	cursor, users, err := m.DataClient.GetUsers(record.Cursor, batchSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var rewritten []data.User
+	for _, user := range users {
+		if labels, replaced := replaceLabel(user.Labels, record.From, record.To); replaced {
+			user.Labels = labels
+			rewritten = append(rewritten, user)
+		}
+	}
+	if len(rewritten) > 0 {
+		if err = m.DataClient.BatchInsertUsers(rewritten); err != nil {
+			return errors.Trace(err)
+		}
+		if err = m.CacheClient.Set(lo.Map(rewritten, func(user data.User, _ int) cache.Value {
+			return cache.Time(cache.Key(cache.LastModifyUserTime, user.UserId), time.Now())
+		})...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	record.NumScanned += len(users)
+	record.NumUsers += len(rewritten)
+	record.Cursor = cursor
+	if cursor == "" {
+		record.Stage = LabelRewriteDone
+	}
+	return nil
+}
+
+// replaceLabel replaces a label by another label in place. The other label isn't duplicated if it exists already.
+func replaceLabel(labels []string, from, to string) ([]string, bool) {
+	if !lo.Contains(labels, from) {
+		return labels, false
+	}
+	replaced := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label == from {
+			label = to
+		}
+		if !lo.Contains(replaced, label) || label != to {
+			replaced = append(replaced, label)
+		}
+	}
+	return replaced, true
+}
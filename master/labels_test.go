@@ -0,0 +1,183 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestReplaceLabel(t *testing.T) {
+	labels, replaced := replaceLabel([]string{"a", "sci-fi", "b"}, "sci-fi", "scifi")
+	assert.True(t, replaced)
+	assert.Equal(t, []string{"a", "scifi", "b"}, labels)
+	labels, replaced = replaceLabel([]string{"scifi", "sci-fi", "b"}, "sci-fi", "scifi")
+	assert.True(t, replaced)
+	assert.Equal(t, []string{"scifi", "b"}, labels)
+	labels, replaced = replaceLabel([]string{"a"}, "sci-fi", "scifi")
+	assert.False(t, replaced)
+	assert.Equal(t, []string{"a"}, labels)
+}
+
+func TestMaster_RewriteLabel(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	err := m.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "0", Labels: []string{"sci-fi"}},
+		{ItemId: "1", Labels: []string{"sci-fi", "scifi"}},
+		{ItemId: "2", Labels: []string{"drama"}},
+		{ItemId: "3", Labels: []string{"sci-fi", "drama"}},
+	})
+	assert.NoError(t, err)
+	err = m.DataClient.BatchInsertUsers([]data.User{
+		{UserId: "0", Labels: []string{"sci-fi"}},
+		{UserId: "1", Labels: []string{"drama"}},
+	})
+	assert.NoError(t, err)
+
+	// invalid rewrites
+	_, err = m.RewriteLabel(LabelRewriteRename, "sci-fi", "sci-fi")
+	assert.True(t, errors.Is(err, errors.NotValid))
+	_, err = m.RewriteLabel(LabelRewriteRename, "comedy", "scifi")
+	assert.True(t, errors.Is(err, errors.NotFound))
+	_, err = m.RewriteLabel(LabelRewriteRename, "sci-fi", "scifi")
+	assert.True(t, errors.Is(err, errors.AlreadyExists))
+	_, err = m.RewriteLabel(LabelRewriteMerge, "sci-fi", "comedy")
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	// resume an interrupted rewrite from the stage of users
+	record := &LabelRewrite{Kind: LabelRewriteMerge, From: "sci-fi", To: "scifi", Stage: LabelRewriteUsers, NumScanned: 4}
+	err = m.saveLabelRewrite(record)
+	assert.NoError(t, err)
+	_, err = m.RewriteLabel(LabelRewriteMerge, "drama", "scifi")
+	assert.True(t, errors.Is(err, errors.AlreadyExists))
+	record, err = m.newLabelRewrite(LabelRewriteMerge, "sci-fi", "scifi")
+	assert.NoError(t, err)
+	err = m.rewriteLabel(record)
+	assert.NoError(t, err)
+	item, err := m.DataClient.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sci-fi"}, item.Labels)
+	user, err := m.DataClient.GetUser("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scifi"}, user.Labels)
+	record, err = m.GetLabelRewrite()
+	assert.NoError(t, err)
+	assert.Equal(t, LabelRewriteDone, record.Stage)
+	assert.Equal(t, 6, record.NumScanned)
+	assert.Zero(t, record.NumItems)
+	assert.Equal(t, 1, record.NumUsers)
+
+	// merge labels of items
+	record, err = m.newLabelRewrite(LabelRewriteMerge, "sci-fi", "scifi")
+	assert.NoError(t, err)
+	err = m.rewriteLabel(record)
+	assert.NoError(t, err)
+	item, err = m.DataClient.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scifi"}, item.Labels)
+	item, err = m.DataClient.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scifi"}, item.Labels)
+	item, err = m.DataClient.GetItem("3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scifi", "drama"}, item.Labels)
+	record, err = m.GetLabelRewrite()
+	assert.NoError(t, err)
+	assert.Equal(t, LabelRewriteDone, record.Stage)
+	assert.Equal(t, 3, record.NumItems)
+	assert.Zero(t, record.NumUsers)
+	// rewritten items are refreshed in the next cycle
+	_, err = m.CacheClient.Get(cache.Key(cache.LastModifyItemTime, "3")).Time()
+	assert.NoError(t, err)
+	_, err = m.CacheClient.Get(cache.Key(cache.LastModifyItemTime, "2")).Time()
+	assert.True(t, errors.Is(err, errors.NotFound))
+	_, err = m.CacheClient.Get(cache.Key(cache.LastModifyUserTime, "0")).Time()
+	assert.NoError(t, err)
+}
+
+func TestMaster_LabelsAPI(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.taskMonitor = task.NewTaskMonitor()
+	err := s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "0", Labels: []string{"sci-fi"}},
+		{ItemId: "1", Labels: []string{"drama"}},
+	})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertUsers([]data.User{{UserId: "0", Labels: []string{"sci-fi"}}})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/admin/labels").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []data.LabelCount{
+			{Name: "drama", NumItems: 1},
+			{Name: "sci-fi", NumItems: 1, NumUsers: 1},
+		})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/labels/rename").
+		Header("Cookie", cookie).
+		QueryParams(map[string]string{"from": "sci-fi", "to": "drama"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/labels/rename").
+		Header("Cookie", cookie).
+		QueryParams(map[string]string{"from": "sci-fi", "to": "scifi"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, LabelRewriteRun{Task: TaskRewriteLabel, Started: true})).
+		End()
+	// wait for the rewrite
+	assert.Eventually(t, func() bool {
+		record, err := s.GetLabelRewrite()
+		return err == nil && record.Stage == LabelRewriteDone
+	}, 10*time.Second, 10*time.Millisecond)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/admin/labels/rewrite").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var record LabelRewrite
+			err := json.NewDecoder(response.Body).Decode(&record)
+			assert.NoError(t, err)
+			assert.Equal(t, "scifi", record.To)
+			assert.Equal(t, 1, record.NumItems)
+			assert.Equal(t, 1, record.NumUsers)
+			return nil
+		}).
+		End()
+	item, err := s.DataClient.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"scifi"}, item.Labels)
+}
@@ -22,14 +22,31 @@ import (
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/blob"
 	"go.uber.org/zap"
+	"io"
 	"os"
 	"path/filepath"
 )
 
+const (
+	// checkpointMagic is the leading bytes of model checkpoints.
+	checkpointMagic = "GORSE\x00CK"
+	// CheckpointVersion is the version of the model checkpoint format. It must be increased once the layout of
+	// model checkpoints is changed. Checkpoints of other versions are refused.
+	CheckpointVersion = int32(1)
+
+	RankingModelCheckpoint = "ranking"
+	ClickModelCheckpoint   = "click"
+
+	// LocalCacheBlob is the name of the local cache in the blob store.
+	LocalCacheBlob = "master/local_cache"
+)
+
 // LocalCache is local cache for the master node.
 type LocalCache struct {
-	path                string
+	path                string     // path of the file, or name of the blob if it is stored in the blob store
+	blob                blob.Store // blob store of the local cache, stored in a local file if nil
 	RankingModelName    string
 	RankingModelVersion int64
 	RankingModel        ranking.MatrixFactorization
@@ -63,46 +80,56 @@ func LoadLocalCache(path string) (*LocalCache, error) {
 			log.Logger().Error("fail to close file", zap.Error(err))
 		}
 	}(f)
-	// 1. ranking model name
-	state.RankingModelName, err = encoding.ReadString(f)
-	if err != nil {
-		return state, errors.Trace(err)
-	}
-	// 2. ranking model version
-	err = binary.Read(f, binary.LittleEndian, &state.RankingModelVersion)
-	if err != nil {
+	// 1. ranking model
+	if err = state.ReadRankingModel(f); err != nil {
 		return state, errors.Trace(err)
 	}
-	// 3. ranking model
-	state.RankingModel, err = ranking.UnmarshalModel(f)
-	if err != nil {
+	// 2. click model
+	if err = state.ReadClickModel(f); err != nil {
 		return state, errors.Trace(err)
 	}
-	// 4. ranking model score
-	err = encoding.ReadGob(f, &state.RankingModelScore)
-	if err != nil {
-		return state, errors.Trace(err)
-	}
-	// 7. click model version
-	err = binary.Read(f, binary.LittleEndian, &state.ClickModelVersion)
+	return state, nil
+}
+
+// LoadBlobCache loads local cache from a blob store.
+// If the ranking model is invalid, RankingModel == nil.
+// If the click model is invalid, ClickModel == nil.
+func LoadBlobCache(store blob.Store, name string) (*LocalCache, error) {
+	log.Logger().Info("load cache from blob store", zap.String("name", name))
+	state := &LocalCache{path: name, blob: store}
+	r, err := store.Get(name)
 	if err != nil {
 		return state, errors.Trace(err)
 	}
-	// 8. click model score
-	err = encoding.ReadGob(f, &state.ClickModelScore)
-	if err != nil {
+	defer func(r io.ReadCloser) {
+		err = r.Close()
+		if err != nil {
+			log.Logger().Error("fail to close blob", zap.Error(err))
+		}
+	}(r)
+	// 1. ranking model
+	if err = state.ReadRankingModel(r); err != nil {
 		return state, errors.Trace(err)
 	}
-	// 9. click model
-	state.ClickModel, err = click.UnmarshalModel(f)
-	if err != nil {
+	// 2. click model
+	if err = state.ReadClickModel(r); err != nil {
 		return state, errors.Trace(err)
 	}
 	return state, nil
 }
 
-// WriteLocalCache writes local cache to a file.
+// WriteLocalCache writes local cache to a file, or to the blob store if the local cache is loaded from a blob store.
 func (c *LocalCache) WriteLocalCache() error {
+	if c.blob != nil {
+		return blob.Write(c.blob, c.path, func(w io.Writer) error {
+			// 1. ranking model
+			if err := c.WriteRankingModel(w); err != nil {
+				return errors.Trace(err)
+			}
+			// 2. click model
+			return c.WriteClickModel(w)
+		})
+	}
 	// create parent folder if not exists
 	parent := filepath.Dir(c.path)
 	if _, err := os.Stat(parent); os.IsNotExist(err) {
@@ -122,40 +149,180 @@ func (c *LocalCache) WriteLocalCache() error {
 			log.Logger().Error("fail to close file", zap.Error(err))
 		}
 	}(f)
-	// 1. ranking model name
-	err = encoding.WriteString(f, c.RankingModelName)
-	if err != nil {
+	// 1. ranking model
+	if err = c.WriteRankingModel(f); err != nil {
+		return errors.Trace(err)
+	}
+	// 2. click model
+	if err = c.WriteClickModel(f); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// WriteRankingModel writes the checkpoint of the ranking model, including weights and indices of users and items.
+func (c *LocalCache) WriteRankingModel(w io.Writer) error {
+	// 1. header
+	if err := writeCheckpointHeader(w, RankingModelCheckpoint, c.RankingModel != nil); err != nil {
+		return errors.Trace(err)
+	}
+	if c.RankingModel == nil {
+		return nil
+	}
+	// 2. ranking model name
+	if err := encoding.WriteString(w, c.RankingModelName); err != nil {
 		return errors.Trace(err)
 	}
-	// 2. ranking model version
-	err = binary.Write(f, binary.LittleEndian, c.RankingModelVersion)
+	// 3. ranking model version
+	if err := binary.Write(w, binary.LittleEndian, c.RankingModelVersion); err != nil {
+		return errors.Trace(err)
+	}
+	// 4. ranking model score
+	if err := encoding.WriteGob(w, c.RankingModelScore); err != nil {
+		return errors.Trace(err)
+	}
+	// 5. ranking model
+	if err := ranking.MarshalModel(w, c.RankingModel); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// ReadRankingModel reads the checkpoint of the ranking model written by WriteRankingModel.
+func (c *LocalCache) ReadRankingModel(r io.Reader) error {
+	// 1. header
+	exist, err := readCheckpointHeader(r, RankingModelCheckpoint)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	// 3. ranking model
-	err = ranking.MarshalModel(f, c.RankingModel)
+	if !exist {
+		return nil
+	}
+	// 2. ranking model name
+	name, err := encoding.ReadString(r)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	// 3. ranking model version
+	var version int64
+	if err = binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return errors.Trace(err)
+	}
 	// 4. ranking model score
-	err = encoding.WriteGob(f, c.RankingModelScore)
-	if err != nil {
+	var score ranking.Score
+	if err = encoding.ReadGob(r, &score); err != nil {
 		return errors.Trace(err)
 	}
-	// 7. click model version
-	err = binary.Write(f, binary.LittleEndian, c.ClickModelVersion)
+	// 5. ranking model
+	rankingModel, err := ranking.UnmarshalModel(r)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	// 8. click model score
-	err = encoding.WriteGob(f, c.ClickModelScore)
+	c.RankingModelName = name
+	c.RankingModelVersion = version
+	c.RankingModelScore = score
+	c.RankingModel = rankingModel
+	return nil
+}
+
+// WriteClickModel writes the checkpoint of the click model, including weights and indices of features.
+func (c *LocalCache) WriteClickModel(w io.Writer) error {
+	// 1. header
+	if err := writeCheckpointHeader(w, ClickModelCheckpoint, c.ClickModel != nil); err != nil {
+		return errors.Trace(err)
+	}
+	if c.ClickModel == nil {
+		return nil
+	}
+	// 2. click model version
+	if err := binary.Write(w, binary.LittleEndian, c.ClickModelVersion); err != nil {
+		return errors.Trace(err)
+	}
+	// 3. click model score
+	if err := encoding.WriteGob(w, c.ClickModelScore); err != nil {
+		return errors.Trace(err)
+	}
+	// 4. click model
+	if err := click.MarshalModel(w, c.ClickModel); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// ReadClickModel reads the checkpoint of the click model written by WriteClickModel.
+func (c *LocalCache) ReadClickModel(r io.Reader) error {
+	// 1. header
+	exist, err := readCheckpointHeader(r, ClickModelCheckpoint)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	// 9. click model
-	err = click.MarshalModel(f, c.ClickModel)
+	if !exist {
+		return nil
+	}
+	// 2. click model version
+	var version int64
+	if err = binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return errors.Trace(err)
+	}
+	// 3. click model score
+	var score click.Score
+	if err = encoding.ReadGob(r, &score); err != nil {
+		return errors.Trace(err)
+	}
+	// 4. click model
+	clickModel, err := click.UnmarshalModel(r)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	c.ClickModelVersion = version
+	c.ClickModelScore = score
+	c.ClickModel = clickModel
+	return nil
+}
+
+// writeCheckpointHeader writes magic bytes, format version, model type and whether the model exists.
+func writeCheckpointHeader(w io.Writer, modelType string, exist bool) error {
+	if _, err := io.WriteString(w, checkpointMagic); err != nil {
+		return errors.Trace(err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, CheckpointVersion); err != nil {
+		return errors.Trace(err)
+	}
+	if err := encoding.WriteString(w, modelType); err != nil {
+		return errors.Trace(err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, exist); err != nil {
+		return errors.Trace(err)
+	}
 	return nil
 }
+
+// readCheckpointHeader validates the header of a checkpoint and returns whether the model exists.
+func readCheckpointHeader(r io.Reader, modelType string) (bool, error) {
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return false, errors.Trace(err)
+	}
+	if string(magic) != checkpointMagic {
+		return false, errors.NotValidf("model checkpoint")
+	}
+	var version int32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return false, errors.Trace(err)
+	}
+	if version != CheckpointVersion {
+		return false, errors.NotSupportedf("model checkpoint version %d (expect version %d)", version, CheckpointVersion)
+	}
+	actualType, err := encoding.ReadString(r)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if actualType != modelType {
+		return false, errors.NotValidf("%s model checkpoint (got %s model checkpoint)", modelType, actualType)
+	}
+	var exist bool
+	if err = binary.Read(r, binary.LittleEndian, &exist); err != nil {
+		return false, errors.Trace(err)
+	}
+	return exist, nil
+}
@@ -15,11 +15,15 @@
 package master
 
 import (
+	"bytes"
+	"encoding/binary"
+	"github.com/juju/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/model"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/blob"
 	"os"
 	"path/filepath"
 	"testing"
@@ -87,3 +91,68 @@ func TestLocalCache(t *testing.T) {
 	// delete test file
 	assert.NoError(t, os.Remove(path))
 }
+
+func TestLocalCache_Blob(t *testing.T) {
+	store, err := blob.Open(t.TempDir())
+	assert.NoError(t, err)
+
+	// load non-existed blob
+	cache, err := LoadBlobCache(store, LocalCacheBlob)
+	assert.True(t, errors.Is(err, errors.NotFound))
+	assert.Nil(t, cache.RankingModel)
+	assert.Nil(t, cache.ClickModel)
+
+	// write and load
+	trainSet, testSet := newRankingDataset()
+	bpr := ranking.NewBPR(model.Params{model.NEpochs: 0})
+	bpr.Fit(trainSet, testSet, nil)
+	cache.RankingModel = bpr
+	cache.RankingModelName = "bpr"
+	cache.RankingModelVersion = 123
+	assert.NoError(t, cache.WriteLocalCache())
+	names, err := store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{LocalCacheBlob}, names)
+
+	read, err := LoadBlobCache(store, LocalCacheBlob)
+	assert.NoError(t, err)
+	assert.NotNil(t, read.RankingModel)
+	assert.Equal(t, "bpr", read.RankingModelName)
+	assert.Equal(t, int64(123), read.RankingModelVersion)
+	assert.Nil(t, read.ClickModel)
+}
+
+func TestLocalCache_Checkpoint(t *testing.T) {
+	// write ranking model only
+	trainSet, testSet := newRankingDataset()
+	bpr := ranking.NewBPR(model.Params{model.NEpochs: 0})
+	bpr.Fit(trainSet, testSet, nil)
+	cache := &LocalCache{RankingModel: bpr, RankingModelName: "bpr", RankingModelVersion: 123}
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, cache.WriteRankingModel(buf))
+	assert.NoError(t, cache.WriteClickModel(buf))
+	read := &LocalCache{}
+	assert.NoError(t, read.ReadRankingModel(buf))
+	assert.NoError(t, read.ReadClickModel(buf))
+	assert.NotNil(t, read.RankingModel)
+	assert.Equal(t, "bpr", read.RankingModelName)
+	assert.Equal(t, int64(123), read.RankingModelVersion)
+	assert.Nil(t, read.ClickModel)
+
+	// read checkpoint of another model
+	buf.Reset()
+	assert.NoError(t, cache.WriteRankingModel(buf))
+	err := read.ReadClickModel(buf)
+	assert.True(t, errors.Is(err, errors.NotValid), err)
+
+	// read checkpoint of incompatible version
+	buf.Reset()
+	buf.WriteString(checkpointMagic)
+	assert.NoError(t, binary.Write(buf, binary.LittleEndian, CheckpointVersion+1))
+	err = read.ReadRankingModel(buf)
+	assert.True(t, errors.Is(err, errors.NotSupported), err)
+
+	// read invalid checkpoint
+	err = read.ReadRankingModel(bytes.NewBufferString("invalid checkpoint"))
+	assert.True(t, errors.Is(err, errors.NotValid), err)
+}
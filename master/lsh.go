@@ -0,0 +1,208 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"math"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/zhenghaoz/gorse/base/heap"
+	"github.com/zhenghaoz/gorse/base/parallel"
+	"github.com/zhenghaoz/gorse/base/task"
+)
+
+// lshRecallSamples is the number of items sampled to estimate the recall of neighbors found by hashing.
+const lshRecallSamples = 100
+
+// emptyKey is the band key of empty vectors, which are never put into buckets.
+const emptyKey = math.MaxUint64
+
+// LSHVectors generates candidate neighbors by locality-sensitive hashing instead of all vectors sharing a dimension.
+// Signatures of each vector are split into bands, and vectors sharing a band are candidates of each other. Jaccard
+// vectors are signed by MinHash while cosine vectors are signed by SimHash. Similarities between candidates are still
+// measured exactly by the wrapped vectors.
+type LSHVectors struct {
+	VectorsInterface
+	numBands int
+	bandSize int
+	keys     [][]uint64           // band keys of vectors
+	buckets  []map[uint64][]int32 // vectors in buckets of bands
+}
+
+// NewLSHVectors creates buckets of bands for vectors. Vectors of DualVectors are signed separately, and their bands
+// are shared by candidates of either group.
+func NewLSHVectors(vectors VectorsInterface, numBands, bandSize int, j *task.JobsAllocator) (*LSHVectors, error) {
+	var groups []*Vectors
+	switch typed := vectors.(type) {
+	case *Vectors:
+		groups = []*Vectors{typed}
+	case *DualVectors:
+		groups = []*Vectors{typed.first, typed.second}
+	}
+	numVectors := 0
+	if len(groups) > 0 {
+		numVectors = len(groups[0].connections)
+	}
+	v := &LSHVectors{
+		VectorsInterface: vectors,
+		numBands:         numBands,
+		bandSize:         bandSize,
+		keys:             make([][]uint64, numVectors),
+		buckets:          make([]map[uint64][]int32, numBands*len(groups)),
+	}
+	// sign vectors in parallel
+	if err := parallel.DynamicParallel(numVectors, j, func(_, i int) error {
+		v.keys[i] = make([]uint64, 0, len(v.buckets))
+		for _, group := range groups {
+			switch {
+			case len(group.connections[i]) == 0:
+				// empty vectors are similar to nothing
+				for b := 0; b < numBands; b++ {
+					v.keys[i] = append(v.keys[i], emptyKey)
+				}
+			case group.jaccard:
+				v.keys[i] = append(v.keys[i], v.minHash(group.connections[i])...)
+			default:
+				v.keys[i] = append(v.keys[i], v.simHash(group.connections[i], group.weights)...)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// put vectors into buckets
+	for b := range v.buckets {
+		v.buckets[b] = make(map[uint64][]int32)
+	}
+	for i, keys := range v.keys {
+		for b, key := range keys {
+			if key != emptyKey {
+				v.buckets[b][key] = append(v.buckets[b][key], int32(i))
+			}
+		}
+	}
+	return v, nil
+}
+
+// minHash signs a set by minimal hash values, so that the probability of sharing a hash equals Jaccard similarity.
+func (v *LSHVectors) minHash(connections []int32) []uint64 {
+	keys := make([]uint64, v.numBands)
+	for b := range keys {
+		key := uint64(b)
+		for r := 0; r < v.bandSize; r++ {
+			seed := uint64(b*v.bandSize + r)
+			minHash := uint64(math.MaxUint64)
+			for _, c := range connections {
+				if h := mix64(seed<<32 | uint64(uint32(c))); h < minHash {
+					minHash = h
+				}
+			}
+			key = mix64(key ^ minHash)
+		}
+		keys[b] = key
+	}
+	return keys
+}
+
+// simHash signs a weighted vector by signs of projections on random hyperplanes, so that the probability of sharing
+// a sign decreases with the angle between vectors.
+func (v *LSHVectors) simHash(connections []int32, weights []float32) []uint64 {
+	keys := make([]uint64, v.numBands)
+	for b := range keys {
+		var bits uint64
+		for r := 0; r < v.bandSize; r++ {
+			seed := uint64(b*v.bandSize + r)
+			var projection float32
+			for _, c := range connections {
+				if mix64(seed<<32|uint64(uint32(c)))&1 == 0 {
+					projection += weights[c]
+				} else {
+					projection -= weights[c]
+				}
+			}
+			if projection >= 0 {
+				bits |= 1 << r
+			}
+		}
+		keys[b] = mix64(uint64(b)<<32 ^ bits)
+	}
+	return keys
+}
+
+// Neighbors returns vectors sharing at least one band with the i-th vector.
+func (v *LSHVectors) Neighbors(i int) []int32 {
+	bitSet := bitset.New(uint(len(v.keys)))
+	var adjacent []int32
+	for b, key := range v.keys[i] {
+		if key == emptyKey {
+			continue
+		}
+		for _, neighbor := range v.buckets[b][key] {
+			if !bitSet.Test(uint(neighbor)) {
+				bitSet.Set(uint(neighbor))
+				adjacent = append(adjacent, neighbor)
+			}
+		}
+	}
+	return adjacent
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// topNeighbors returns top k neighbors of the i-th vector among candidates.
+func topNeighbors(vectors VectorsInterface, candidates []int32, i, k int, hidden []bool) []int32 {
+	filter := heap.NewTopKFilter[int32, float32](k)
+	for _, j := range candidates {
+		if j != int32(i) && !hidden[j] {
+			if score := vectors.Distance(i, int(j)); score > 0 {
+				filter.Push(j, score)
+			}
+		}
+	}
+	neighbors, _ := filter.PopAll()
+	return neighbors
+}
+
+// Recall estimates the recall of top k neighbors found in candidates generated by hashing, compared with top k
+// neighbors found in exact candidates.
+func (v *LSHVectors) Recall(samples []int, k int, hidden []bool) float32 {
+	var hit, total int
+	for _, i := range samples {
+		exact := topNeighbors(v.VectorsInterface, v.VectorsInterface.Neighbors(i), i, k, hidden)
+		approx := topNeighbors(v.VectorsInterface, v.Neighbors(i), i, k, hidden)
+		found := make(map[int32]struct{}, len(approx))
+		for _, j := range approx {
+			found[j] = struct{}{}
+		}
+		for _, j := range exact {
+			if _, exist := found[j]; exist {
+				hit++
+			}
+		}
+		total += len(exact)
+	}
+	if total == 0 {
+		return 1
+	}
+	return float32(hit) / float32(total)
+}
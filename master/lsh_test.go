@@ -0,0 +1,84 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/task"
+)
+
+// newClusteredConnections generates items in clusters. Items in the same cluster share most of the labels of their
+// cluster, and the last item has no label.
+func newClusteredConnections(numClusters, clusterSize, numLabels int) (connections, connected [][]int32, weights []float32) {
+	rng := rand.New(rand.NewSource(0))
+	connections = make([][]int32, numClusters*clusterSize+1)
+	connected = make([][]int32, numClusters*numLabels)
+	weights = make([]float32, numClusters*numLabels)
+	for i := range weights {
+		weights[i] = 1
+	}
+	for c := 0; c < numClusters; c++ {
+		for i := c * clusterSize; i < (c+1)*clusterSize; i++ {
+			for l := c * numLabels; l < (c+1)*numLabels; l++ {
+				if rng.Float64() < 0.9 {
+					connections[i] = append(connections[i], int32(l))
+					connected[l] = append(connected[l], int32(i))
+				}
+			}
+		}
+	}
+	return
+}
+
+func TestLSHVectors_Jaccard(t *testing.T) {
+	connections, connected, weights := newClusteredConnections(10, 50, 20)
+	vectors := NewJaccardVectors(connections, connected, weights)
+	lsh, err := NewLSHVectors(vectors, 16, 4, task.NewConstantJobsAllocator(2))
+	assert.NoError(t, err)
+	hidden := make([]bool, len(connections))
+	samples := []int{0, 49, 50, 123, 250, 499}
+	assert.Greater(t, lsh.Recall(samples, 10, hidden), float32(0.9))
+	// candidates never cross clusters
+	for _, j := range lsh.Neighbors(0) {
+		assert.Less(t, j, int32(50))
+	}
+	// empty vectors have no candidate
+	assert.Empty(t, lsh.Neighbors(len(connections)-1))
+}
+
+func TestLSHVectors_Cosine(t *testing.T) {
+	connections, connected, weights := newClusteredConnections(10, 50, 20)
+	vectors := NewVectors(connections, connected, weights)
+	lsh, err := NewLSHVectors(vectors, 16, 4, task.NewConstantJobsAllocator(2))
+	assert.NoError(t, err)
+	hidden := make([]bool, len(connections))
+	samples := []int{0, 49, 50, 123, 250, 499}
+	assert.Greater(t, lsh.Recall(samples, 10, hidden), float32(0.9))
+	assert.Empty(t, lsh.Neighbors(len(connections)-1))
+}
+
+func TestLSHVectors_Dual(t *testing.T) {
+	connections, connected, weights := newClusteredConnections(10, 50, 20)
+	vectors := NewDualVectors(NewJaccardVectors(connections, connected, weights), NewVectors(connections, connected, weights))
+	lsh, err := NewLSHVectors(vectors, 8, 4, task.NewConstantJobsAllocator(2))
+	assert.NoError(t, err)
+	assert.Len(t, lsh.buckets, 16)
+	assert.Contains(t, lsh.Neighbors(0), int32(1))
+	// distances are measured by the wrapped vectors
+	assert.Equal(t, vectors.Distance(0, 1), lsh.Distance(0, 1))
+}
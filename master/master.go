@@ -20,21 +20,29 @@ import (
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/juju/errors"
+	"github.com/samber/lo"
 	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/encoding"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/model/rerank"
 	"github.com/zhenghaoz/gorse/protocol"
 	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/blob"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
 	"go.uber.org/zap"
@@ -56,14 +64,22 @@ type Master struct {
 	nodesInfo      map[string]*Node
 	nodesInfoMutex sync.RWMutex
 
+	// user shards of workers
+	shards      map[string]*Shard
+	shardsMutex sync.RWMutex
+
 	// ranking dataset
-	rankingTrainSet  *ranking.DataSet
-	rankingTestSet   *ranking.DataSet
-	rankingDataMutex sync.RWMutex
+	rankingTrainSet     *ranking.DataSet
+	rankingTestSet      *ranking.DataSet
+	rankingEvalTrainSet *ranking.DataSet // train set split by time for offline evaluation
+	rankingEvalTestSet  *ranking.DataSet // test set split by time for offline evaluation
+	rankingDataTime     time.Time        // time when the ranking dataset was loaded
+	rankingDataMutex    sync.RWMutex
 
 	// click dataset
 	clickTrainSet  *click.Dataset
 	clickTestSet   *click.Dataset
+	clickDataTime  time.Time // time when the click dataset was loaded
 	clickDataMutex sync.RWMutex
 
 	// ranking model
@@ -72,17 +88,61 @@ type Master struct {
 	rankingModelMutex    sync.RWMutex
 	rankingModelSearcher *ranking.ModelSearcher
 
+	// canary ranking model serving a fraction of users, guarded by rankingModelMutex
+	canaryRankingModel        ranking.MatrixFactorization
+	canaryRankingModelVersion int64
+	canaryRankingScore        ranking.Score
+	canaryStartTime           time.Time
+	canaryCTR                 map[string]GenerationCTR // click-through of generations evaluated last time
+
 	// click model
 	clickScore         click.Score
 	clickModelMutex    sync.RWMutex
 	clickModelSearcher *click.ModelSearcher
 
 	localCache *LocalCache
+	blobStore  blob.Store              // blob store for large artifacts, nil if not configured
+	registry   *ModelRegistry          // records and checkpoints of trained models, nil if not loaded
+	dualWrite  *data.DualWriteDatabase // writes to the shadow data store during migration, nil if not configured
 
 	// events
 	fitTicker    *time.Ticker
 	importedChan chan struct{} // feedback inserted events
 	loadDataChan chan struct{} // dataset loaded events
+
+	// webhooks
+	webhookChan       chan WebhookPayload
+	webhookClient     *http.Client
+	webhookBackoff    time.Duration // initial backoff between retries
+	ingestStalled     bool
+	stalenessExceeded bool
+	usersNearLimit    bool
+	itemsNearLimit    bool
+
+	// refreshes of single users or items
+	refreshMutex       sync.Mutex
+	refreshWindowStart time.Time
+	refreshCount       int
+
+	// user ids in cache keys are replaced by digests
+	obfuscator *cache.Obfuscator
+
+	// snapshots
+	snapshotMutex   sync.RWMutex // tasks hold read locks while snapshots are exported with the write lock
+	snapshotRunning sync.Mutex
+
+	// label rewrites
+	labelRewriteRunning sync.Mutex
+
+	// alerts
+	alertMutex     sync.Mutex
+	alerts         *Alerts   // loaded from the cache store lazily
+	alertSince     time.Time // the first evaluation of alerts
+	maxStaleness   time.Duration
+	requestSamples []requestSample
+	requestDay     string
+	dayRequests    float64 // requests counted today in the last sample
+	dayErrors      float64 // server errors counted today in the last sample
 }
 
 // NewMaster creates a master node.
@@ -90,13 +150,9 @@ func NewMaster(cfg *config.Config, cacheFile string) *Master {
 	rand.Seed(time.Now().UnixNano())
 	// create task monitor
 	taskMonitor := task.NewTaskMonitor()
-	for _, taskName := range []string{TaskLoadDataset, TaskFindItemNeighbors, TaskFindUserNeighbors,
-		TaskFitRankingModel, TaskFitClickModel, TaskSearchRankingModel, TaskSearchClickModel,
-		TaskCacheGarbageCollection} {
-		taskMonitor.Pending(taskName)
-	}
-	return &Master{
+	m := &Master{
 		nodesInfo: make(map[string]*Node),
+		shards:    make(map[string]*Shard),
 		// create task monitor
 		cacheFile:     cacheFile,
 		taskMonitor:   taskMonitor,
@@ -107,20 +163,22 @@ func NewMaster(cfg *config.Config, cacheFile string) *Master {
 			cfg.Recommend.Collaborative.ModelSearchEpoch,
 			cfg.Recommend.Collaborative.ModelSearchTrials,
 			cfg.Recommend.Collaborative.EnableModelSizeSearch,
-		),
+		).SetRandomState(cfg.Recommend.Collaborative.RandomSeed).
+			SetDeterministic(cfg.Recommend.Collaborative.Deterministic),
 		// default click model
 		clickModelSearcher: click.NewModelSearcher(
 			cfg.Recommend.Collaborative.ModelSearchEpoch,
 			cfg.Recommend.Collaborative.ModelSearchTrials,
 			cfg.Recommend.Collaborative.EnableModelSizeSearch,
-		),
+		).SetRandomState(cfg.Recommend.Collaborative.RandomSeed).
+			SetDeterministic(cfg.Recommend.Collaborative.Deterministic),
 		RestServer: server.RestServer{
 			Settings: &config.Settings{
 				Config:       cfg,
 				CacheClient:  cache.NoDatabase{},
 				DataClient:   data.NoDatabase{},
-				RankingModel: ranking.NewBPR(nil),
-				ClickModel:   click.NewFM(click.FMClassification, nil),
+				RankingModel: ranking.NewBPR(model.Params{model.RandomState: cfg.Recommend.Collaborative.RandomSeed}),
+				ClickModel:   click.NewFM(click.FMClassification, model.Params{model.RandomState: cfg.Recommend.Collaborative.RandomSeed}),
 				// init versions
 				RankingModelVersion: rand.Int63(),
 				ClickModelVersion:   rand.Int63(),
@@ -129,10 +187,23 @@ func NewMaster(cfg *config.Config, cacheFile string) *Master {
 			HttpPort:   cfg.Master.HttpPort,
 			WebService: new(restful.WebService),
 		},
-		fitTicker:    time.NewTicker(cfg.Recommend.Collaborative.ModelFitPeriod),
-		importedChan: make(chan struct{}),
-		loadDataChan: make(chan struct{}),
+		fitTicker:      time.NewTicker(cfg.Recommend.Collaborative.ModelFitPeriod),
+		importedChan:   make(chan struct{}),
+		loadDataChan:   make(chan struct{}),
+		webhookChan:    make(chan WebhookPayload, webhookQueueSize),
+		webhookClient:  &http.Client{Timeout: webhookTimeout},
+		webhookBackoff: time.Second,
+	}
+	// notify webhooks once tasks are done
+	taskMonitor.OnDone = m.notifyTaskDone
+	for _, taskName := range []string{TaskLoadDataset, TaskFindItemNeighbors, TaskFindUserNeighbors,
+		TaskFitRankingModel, TaskFitClickModel, TaskSearchRankingModel, TaskSearchClickModel,
+		TaskCacheGarbageCollection, TaskQualityGate, TaskEvaluateRankingModel, TaskFindTrendingItems,
+		TaskCollectExpiredOverrides, TaskFindDuplicateItems, TaskConsolidateActivity, TaskCollectExpiredAuditLogs,
+		TaskCollectExpiredHistory, TaskCollectUsage, TaskFindCovisitedItems} {
+		taskMonitor.Pending(taskName)
 	}
+	return m
 }
 
 // Serve starts the master node.
@@ -140,12 +211,20 @@ func (m *Master) Serve() {
 
 	// load local cached model
 	var err error
-	m.localCache, err = LoadLocalCache(m.cacheFile)
+	if m.Config.Database.BlobStore != "" {
+		m.blobStore, err = blob.Open(m.Config.Database.BlobStore)
+		if err != nil {
+			log.Logger().Fatal("failed to open blob store", zap.Error(err))
+		}
+		m.localCache, err = LoadBlobCache(m.blobStore, LocalCacheBlob)
+	} else {
+		m.localCache, err = LoadLocalCache(m.cacheFile)
+	}
 	if err != nil {
 		if errors.Is(err, errors.NotFound) {
-			log.Logger().Info("no local cache found, create a new one", zap.String("path", m.cacheFile))
+			log.Logger().Info("no local cache found, create a new one", zap.String("path", m.localCache.path))
 		} else {
-			log.Logger().Error("failed to load local cache", zap.String("path", m.cacheFile), zap.Error(err))
+			log.Logger().Error("failed to load local cache", zap.String("path", m.localCache.path), zap.Error(err))
 		}
 	}
 	if m.localCache.RankingModel != nil {
@@ -177,6 +256,15 @@ func (m *Master) Serve() {
 		MemoryInUseBytesVec.WithLabelValues("ranking_model").Set(float64(m.ClickModel.Bytes()))
 	}
 
+	// load model registry, which is stored beside the local cache if the blob store isn't configured
+	registryStore := m.blobStore
+	if registryStore == nil {
+		registryStore = blob.NewLocal(filepath.Dir(m.cacheFile))
+	}
+	if m.registry, err = LoadModelRegistry(registryStore, m.Config.Master.ModelRetention); err != nil {
+		log.Logger().Error("failed to load model registry", zap.Error(err))
+	}
+
 	// create cluster meta cache
 	m.ttlCache = ttlcache.NewCache()
 	m.ttlCache.SetExpirationCallback(m.nodeDown)
@@ -186,32 +274,84 @@ func (m *Master) Serve() {
 	}
 
 	// connect data database
-	m.DataClient, err = data.Open(m.Config.Database.DataStore, m.Config.Database.TablePrefix)
+	dataClient, err := data.Open(m.Config.Database.DataStore, m.Config.Database.TablePrefix)
 	if err != nil {
 		log.Logger().Fatal("failed to connect data database", zap.Error(err),
 			zap.String("database", log.RedactDBURL(m.Config.Database.DataStore)))
 	}
+	data.SetBatchGetOptions(dataClient, m.Config.Database.BatchGetChunkSize, m.Config.Database.BatchGetJobs)
+	if m.Config.Database.ShadowDataStore != "" {
+		shadowClient, err := data.Open(m.Config.Database.ShadowDataStore, m.Config.Database.TablePrefix)
+		if err != nil {
+			log.Logger().Fatal("failed to connect shadow data database", zap.Error(err),
+				zap.String("database", log.RedactDBURL(m.Config.Database.ShadowDataStore)))
+		}
+		data.SetBatchGetOptions(shadowClient, m.Config.Database.BatchGetChunkSize, m.Config.Database.BatchGetJobs)
+		m.dualWrite, err = data.NewDualWriteDatabase(dataClient, shadowClient, m.cacheFile+server.ShadowQueueSuffix,
+			m.Config.Database.ShadowRetryInterval)
+		if err != nil {
+			log.Logger().Fatal("failed to load queued writes of shadow data database", zap.Error(err))
+		}
+		dataClient = m.dualWrite
+	}
+	m.DataClient = data.NewCommentCompressor(dataClient, m.Config.Database.CommentThreshold())
 	if err = m.DataClient.Init(); err != nil {
 		log.Logger().Fatal("failed to init database", zap.Error(err))
 	}
 
 	// connect cache database
-	m.CacheClient, err = cache.Open(m.Config.Database.CacheStore, m.Config.Database.TablePrefix)
+	cacheClient, err := cache.Open(m.Config.Database.CacheStore, m.Config.Database.TablePrefix)
 	if err != nil {
 		log.Logger().Fatal("failed to connect cache database", zap.Error(err),
 			zap.String("database", log.RedactDBURL(m.Config.Database.CacheStore)))
 	}
-	if err = m.CacheClient.Init(); err != nil {
+	if err = cacheClient.Init(); err != nil {
 		log.Logger().Fatal("failed to init database", zap.Error(err))
 	}
+	// user ids in cache keys and logs are replaced by digests
+	m.obfuscator = cache.NewObfuscator(cacheClient,
+		m.Config.Database.IdObfuscationSecret, m.Config.Database.IdObfuscationPreviousSecret)
+	log.SetUserIdObfuscator(m.obfuscator.Digest)
+	cacheClient = m.obfuscator
+	// offline recommendation is read under the production prefix, which is switched by promotion
+	productionPrefix, err := cache.ProductionPrefix(cacheClient)
+	if err != nil {
+		log.Logger().Fatal("failed to read prefix of offline recommendation", zap.Error(err))
+	}
+	m.CacheClient = cache.NewShadow(cacheClient, productionPrefix)
+	// the canary ranking model isn't kept in the local cache
+	if err = m.publishCanaryVersion(0); err != nil {
+		log.Logger().Error("failed to reset version of canary ranking model", zap.Error(err))
+	}
 
 	m.RestServer.HiddenItemsManager = server.NewHiddenItemsManager(&m.RestServer)
 	m.RestServer.PopularItemsCache = server.NewPopularItemsCache(&m.RestServer)
+	m.RestServer.RulesManager = server.NewRulesManager(&m.RestServer)
+	m.RestServer.DuplicatesManager = server.NewDuplicatesManager(&m.RestServer)
+	m.RestServer.ActivityTracker = server.NewActivityTracker(&m.RestServer)
+	m.RestServer.QuotaManager = server.NewQuotaManager(&m.RestServer)
+	m.RestServer.ReadOnlyManager = server.NewReadOnlyManager(&m.RestServer)
+	m.RestServer.AuditLogger = server.NewAuditLogger(&m.RestServer)
+	m.RestServer.WriteBackBuffer = server.NewWriteBackBuffer(&m.RestServer)
+	m.RestServer.HistoryArchiver = server.NewHistoryArchiver(&m.RestServer)
+	m.RestServer.UsageCounter = server.NewUsageCounter(&m.RestServer)
+	m.RestServer.ShadowTraffic = server.NewShadowTraffic(&m.RestServer)
+	m.RestServer.ItemEnricher = server.NewItemEnricher(&m.RestServer)
+	m.RestServer.Reranker = rerank.NewReranker()
 
 	go m.RunPrivilegedTasksLoop()
 	log.Logger().Info("start model fit", zap.Duration("period", m.Config.Recommend.Collaborative.ModelFitPeriod))
 	go m.RunRagtagTasksLoop()
 	log.Logger().Info("start model searcher", zap.Duration("period", m.Config.Recommend.Collaborative.ModelSearchPeriod))
+	go m.RunWebhookLoop()
+	log.Logger().Info("start webhook notifier", zap.Int("n_urls", len(m.Config.Master.Webhook.URLs)))
+	go m.RunStalenessLoop()
+	go m.RunAlertLoop()
+	log.Logger().Info("start alert evaluator", zap.Int("n_rules", len(m.Config.Master.Alert.Rules)))
+	go m.RunVerifyCacheLoop()
+	log.Logger().Info("start cache verifier", zap.Duration("period", m.Config.Master.Verification.Period))
+	go m.RunCheckDivergenceLoop()
+	go m.ResumeLabelRewrite()
 
 	// start rpc server
 	go func() {
@@ -235,12 +375,17 @@ func (m *Master) Serve() {
 
 func (m *Master) Shutdown() {
 	// stop http server
-	err := m.HttpServer.Shutdown(context.TODO())
-	if err != nil {
+	if err := m.ShutdownHttpServer(); err != nil {
 		log.Logger().Error("failed to shutdown http server", zap.Error(err))
 	}
 	// stop grpc server
-	m.grpcServer.GracefulStop()
+	if m.grpcServer != nil {
+		m.grpcServer.GracefulStop()
+	}
+	// close databases
+	if err := m.CloseDatabases(); err != nil {
+		log.Logger().Error("failed to close databases", zap.Error(err))
+	}
 }
 
 func (m *Master) RunPrivilegedTasksLoop() {
@@ -250,8 +395,11 @@ func (m *Master) RunPrivilegedTasksLoop() {
 		tasks = []Task{
 			NewFitClickModelTask(m),
 			NewFitRankingModelTask(m),
+			NewEvaluateRankingModelTask(m),
 			NewFindUserNeighborsTask(m),
 			NewFindItemNeighborsTask(m),
+			NewFindTrendingItemsTask(m),
+			NewFindCovisitedItemsTask(m),
 		}
 		firstLoop = true
 	)
@@ -271,8 +419,13 @@ func (m *Master) RunPrivilegedTasksLoop() {
 		}
 
 		// download dataset
+		m.snapshotMutex.RLock()
 		err = m.runLoadDatasetTask()
-		if err != nil {
+		m.snapshotMutex.RUnlock()
+		if errors.Is(err, context.Canceled) {
+			log.Logger().Info("loading dataset cancelled")
+			continue
+		} else if err != nil {
 			log.Logger().Error("failed to load ranking dataset", zap.Error(err))
 			continue
 		}
@@ -298,6 +451,8 @@ func (m *Master) RunPrivilegedTasksLoop() {
 				j := m.jobsScheduler.GetJobsAllocator(task.name())
 				defer m.jobsScheduler.Unregister(task.name())
 				j.Init()
+				m.snapshotMutex.RLock()
+				defer m.snapshotMutex.RUnlock()
 				if err := task.run(j); err != nil {
 					log.Logger().Error("failed to run task", zap.String("task", task.name()), zap.Error(err))
 					return
@@ -316,6 +471,13 @@ func (m *Master) RunRagtagTasksLoop() {
 		err   error
 		tasks = []Task{
 			NewCacheGarbageCollectionTask(m),
+			NewQualityGateTask(m),
+			NewCollectExpiredOverridesTask(m),
+			NewCollectExpiredAuditLogsTask(m),
+			NewCollectExpiredHistoryTask(m),
+			NewFindDuplicateItemsTask(m),
+			NewConsolidateActivityTask(m),
+			NewCollectUsageTask(m),
 			NewSearchRankingModelTask(m),
 			NewSearchClickModelTask(m),
 		}
@@ -336,7 +498,11 @@ func (m *Master) RunRagtagTasksLoop() {
 				defer m.jobsScheduler.Unregister(task.name())
 				j := m.jobsScheduler.GetJobsAllocator(task.name())
 				j.Init()
-				if err = task.run(j); err != nil {
+				m.snapshotMutex.RLock()
+				defer m.snapshotMutex.RUnlock()
+				if err = task.run(j); errors.Is(err, context.Canceled) {
+					log.Logger().Info("task cancelled", zap.String("task", task.name()))
+				} else if err != nil {
 					log.Logger().Error("failed to run task", zap.String("task", task.name()), zap.Error(err))
 					m.taskMonitor.Fail(task.name(), err.Error())
 				}
@@ -370,3 +536,92 @@ func (m *Master) notifyDataImported() {
 		log.Logger().Error("failed to write meta", zap.Error(err))
 	}
 }
+
+// pipelineStages maps names of pipeline stages to names of tasks in the task monitor. Popular items and the latest
+// items are refreshed while loading the dataset. Offline recommendation is generated by workers, whose tasks are
+// suffixed by worker names.
+var pipelineStages = map[string]string{
+	"load_dataset":        TaskLoadDataset,
+	"refresh_popular":     TaskLoadDataset,
+	"refresh_latest":      TaskLoadDataset,
+	"refresh_trending":    TaskFindTrendingItems,
+	"refresh_covisit":     TaskFindCovisitedItems,
+	"find_duplicates":     TaskFindDuplicateItems,
+	"find_item_neighbors": TaskFindItemNeighbors,
+	"train_ranking":       TaskFitRankingModel,
+	"offline_recommend":   offlineRecommendTaskName,
+	"verify_cache":        TaskVerifyCache,
+}
+
+// offlineRecommendRunning returns true if any worker is generating offline recommendation.
+func (m *Master) offlineRecommendRunning() bool {
+	m.taskMonitor.TaskLock.Lock()
+	defer m.taskMonitor.TaskLock.Unlock()
+	for name, t := range m.taskMonitor.Tasks {
+		if strings.HasPrefix(name, offlineRecommendTaskName+" [") && t.Status == task.StatusRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// runStage starts a pipeline stage immediately and returns the name of the task. The stage isn't started again if it
+// is running, and false is returned.
+func (m *Master) runStage(stage string) (string, bool, error) {
+	taskName, exist := pipelineStages[stage]
+	if !exist {
+		stages := lo.Keys(pipelineStages)
+		sort.Strings(stages)
+		return "", false, errors.NotFoundf("stage %v (valid stages: %v)", stage, strings.Join(stages, ", "))
+	}
+	switch stage {
+	case "load_dataset", "refresh_popular", "refresh_latest":
+		// the privileged tasks loop is busy if the dataset is being loaded
+		select {
+		case m.importedChan <- struct{}{}:
+			return taskName, true, nil
+		default:
+			return taskName, false, nil
+		}
+	case "offline_recommend":
+		// workers regenerate recommendation older than the request at the next check, a running cycle has read the
+		// request time already so that the request is served by the next cycle.
+		if err := m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastRequestOfflineRecommendTime), time.Now())); err != nil {
+			return "", false, errors.Trace(err)
+		}
+		return taskName, !m.offlineRecommendRunning(), nil
+	}
+	if m.rankingTrainSet == nil {
+		return "", false, errors.NotValidf("dataset not loaded")
+	}
+	var t Task
+	switch stage {
+	case "find_item_neighbors":
+		t = NewFindItemNeighborsTask(m)
+	case "refresh_trending":
+		t = NewFindTrendingItemsTask(m)
+	case "refresh_covisit":
+		t = NewFindCovisitedItemsTask(m)
+	case "find_duplicates":
+		t = NewFindDuplicateItemsTask(m)
+	case "verify_cache":
+		t = NewVerifyCacheTask(m)
+	default:
+		t = NewFitRankingModelTask(m)
+	}
+	if !m.jobsScheduler.Register(t.name(), t.priority(), true) {
+		return taskName, false, nil
+	}
+	go func() {
+		defer base.CheckPanic()
+		defer m.jobsScheduler.Unregister(t.name())
+		j := m.jobsScheduler.GetJobsAllocator(t.name())
+		j.Init()
+		m.snapshotMutex.RLock()
+		defer m.snapshotMutex.RUnlock()
+		if err := t.run(j); err != nil {
+			log.Logger().Error("failed to run task", zap.String("task", t.name()), zap.Error(err))
+		}
+	}()
+	return taskName, true, nil
+}
@@ -29,6 +29,8 @@ const (
 	LabelFeedbackType = "feedback_type"
 	LabelStep         = "step"
 	LabelData         = "data"
+	LabelTopN         = "top_n"
+	LabelGeneration   = "generation"
 )
 
 var (
@@ -72,6 +74,43 @@ var (
 		Subsystem: "master",
 		Name:      "update_item_neighbors_total",
 	})
+	CategorizedItemNeighborsTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "categorized_item_neighbors_total",
+	})
+	CategorizedItemNeighborsBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "categorized_item_neighbors_bytes",
+	})
+	DuplicateItemsTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "duplicate_items_total",
+	})
+	// ActiveUsers (gorse_master_active_users) and ActiveItems (gorse_master_active_items) are estimated numbers of
+	// users giving feedback and items receiving feedback in windows, which are daily, weekly and monthly.
+	ActiveUsers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "active_users",
+	}, []string{"window"})
+	ActiveItems = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "active_items",
+	}, []string{"window"})
+	LowQualityItemsHidden = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "low_quality_items_hidden",
+	})
+	LowQualityItemsUnhidden = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "low_quality_items_unhidden",
+	})
 	CacheScannedTotal = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "gorse",
 		Subsystem: "master",
@@ -87,6 +126,26 @@ var (
 		Subsystem: "master",
 		Name:      "cache_scanned_seconds",
 	})
+	CacheInconsistencyRate = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "cache_inconsistency_rate",
+	})
+	DataStoreDivergenceRate = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "data_store_divergence_rate",
+	})
+	ShadowQueuedWritesTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "shadow_queued_writes_total",
+	})
+	OfflineRecommendMaxStalenessSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "offline_recommend_max_staleness_seconds",
+	})
 
 	CollaborativeFilteringFitSeconds = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "gorse",
@@ -143,6 +202,36 @@ var (
 		Subsystem: "master",
 		Name:      "ranking_model_auc",
 	})
+	OfflineEvaluationPrecisionVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "offline_evaluation_precision",
+	}, []string{LabelTopN})
+	OfflineEvaluationRecallVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "offline_evaluation_recall",
+	}, []string{LabelTopN})
+	OfflineEvaluationNDCGVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "offline_evaluation_ndcg",
+	}, []string{LabelTopN})
+	OfflineEvaluationMAPVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "offline_evaluation_map",
+	}, []string{LabelTopN})
+	OfflineEvaluationCoverageVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "offline_evaluation_coverage",
+	}, []string{LabelTopN})
+	OfflineEvaluationDiversityVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "offline_evaluation_intra_list_diversity",
+	}, []string{LabelTopN})
 	RankingSearchPrecision = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "gorse",
 		Subsystem: "master",
@@ -224,6 +313,21 @@ var (
 		Subsystem: "master",
 		Name:      "memory_inuse_bytes",
 	}, []string{LabelData})
+	RankingGenerationReadsVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "ranking_generation_reads",
+	}, []string{LabelGeneration})
+	RankingGenerationClicksVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "ranking_generation_clicks",
+	}, []string{LabelGeneration})
+	RankingGenerationCTRVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "master",
+		Name:      "ranking_generation_ctr",
+	}, []string{LabelGeneration})
 )
 
 type OnlineEvaluator struct {
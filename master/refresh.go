@@ -0,0 +1,266 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"sort"
+	"time"
+
+	"github.com/chewxy/math32"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/heap"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+const (
+	refreshUserTimeout      = 30 * time.Second
+	refreshUserPollInterval = time.Second
+)
+
+// ItemRefresh is derived data of an item refreshed on demand.
+type ItemRefresh struct {
+	ItemId     string
+	Categories []string
+	// Neighbors are neighbors of the item in each category. Neighbors in all categories are keyed by "".
+	Neighbors map[string][]cache.Scored
+}
+
+// UserRefresh is offline recommendation of a user refreshed on demand.
+type UserRefresh struct {
+	UserId string
+	// Refreshed is false if workers haven't refreshed the user before timeout. In that case, Recommend is the previous
+	// recommendation and the user is refreshed later.
+	Refreshed bool
+	Recommend []cache.Scored
+}
+
+// allowRefresh returns false if refreshes in the current minute have reached max_refresh_per_minute.
+func (m *Master) allowRefresh() bool {
+	m.refreshMutex.Lock()
+	defer m.refreshMutex.Unlock()
+	// reset the budget every minute
+	if time.Since(m.refreshWindowStart) >= time.Minute {
+		m.refreshWindowStart = time.Now()
+		m.refreshCount = 0
+	}
+	if m.refreshCount >= m.Config.Master.MaxRefreshPerMinute {
+		return false
+	}
+	m.refreshCount++
+	return true
+}
+
+// RefreshItem searches neighbors of an item with the latest labels and categories in the data store, without waiting
+// for the next cycle of searching neighbors of items. Neighbors are searched by brute force against the loaded
+// dataset, where labels unknown to the dataset are ignored until the dataset is reloaded.
+func (m *Master) RefreshItem(itemId string) (ItemRefresh, error) {
+	item, err := m.DataClient.GetItem(itemId)
+	if err != nil {
+		return ItemRefresh{}, err
+	}
+	labels, encoded := m.itemLabelNumbers(item.Labels)
+
+	m.rankingDataMutex.RLock()
+	defer m.rankingDataMutex.RUnlock()
+	dataset := m.rankingTrainSet
+	if dataset == nil {
+		return ItemRefresh{}, errors.NotValidf("dataset not loaded")
+	}
+	itemIndex := dataset.ItemIndex.ToNumber(itemId)
+	if itemIndex == base.NotId {
+		return ItemRefresh{}, errors.NotFoundf("item %v in the dataset, which is loaded in the next cycle", itemId)
+	}
+
+	// patch the item without modifying the dataset
+	patched := *dataset
+	patched.ItemLabels = make([][]int32, len(dataset.ItemLabels))
+	copy(patched.ItemLabels, dataset.ItemLabels)
+	if encoded {
+		patched.ItemLabels[itemIndex] = labels
+	}
+	patched.ItemCategories = make([][]string, len(dataset.ItemCategories))
+	copy(patched.ItemCategories, dataset.ItemCategories)
+	patched.ItemCategories[itemIndex] = item.Categories
+	patched.CategorySet = strset.Union(dataset.CategorySet, strset.New(item.Categories...))
+	allCategories := patched.CategorySet.List()
+	sort.Strings(allCategories)
+	categories := m.neighborCategories(&patched, allCategories, int(itemIndex))
+
+	// create vectors in the same way as searching neighbors of all items
+	var vector VectorsInterface
+	itemNeighborsConfig := m.Config.Recommend.ItemNeighbors
+	labelVectors := func() *Vectors {
+		itemLabels := sortedCopies(patched.ItemLabels)
+		labeledItems := make([][]int32, dataset.NumItemLabels)
+		for i := range itemLabels {
+			for _, label := range itemLabels[i] {
+				labeledItems[label] = append(labeledItems[label], int32(i))
+			}
+		}
+		labelIDF := make([]float32, dataset.NumItemLabels)
+		for i := range labeledItems {
+			labelIDF[i] = math32.Log(float32(dataset.ItemCount()) / float32(len(labeledItems[i])))
+		}
+		return newVectorsWithSimilarity(itemNeighborsConfig.LabelSimilarity, itemLabels, labeledItems, labelIDF)
+	}
+	feedbackVectors := func() *Vectors {
+		userIDF := make([]float32, dataset.UserCount())
+		for i := range dataset.UserFeedback {
+			userIDF[i] = math32.Log(float32(dataset.ItemCount()) / float32(len(dataset.UserFeedback[i])))
+		}
+		return newVectorsWithSimilarity(itemNeighborsConfig.FeedbackSimilarity, sortedCopies(dataset.ItemFeedback), dataset.UserFeedback, userIDF)
+	}
+	switch itemNeighborsConfig.NeighborType {
+	case config.NeighborTypeSimilar:
+		vector = labelVectors()
+	case config.NeighborTypeRelated:
+		vector = feedbackVectors()
+	case config.NeighborTypeAuto:
+		vector = NewWeightedDualVectors(labelVectors(), feedbackVectors(), itemNeighborsConfig.HybridAlpha)
+	default:
+		return ItemRefresh{}, errors.NotImplementedf("item neighbor type `%v`", itemNeighborsConfig.NeighborType)
+	}
+
+	// search neighbors
+	nearItemsFilters := make(map[string]*heap.TopKFilter[int32, float32])
+	nearItemsFilters[""] = heap.NewTopKFilter[int32, float32](m.Config.Recommend.CacheSize)
+	for _, category := range categories {
+		nearItemsFilters[category] = heap.NewTopKFilter[int32, float32](m.Config.Recommend.CacheSize)
+	}
+	for _, j := range vector.Neighbors(int(itemIndex)) {
+		if j != itemIndex && !dataset.HiddenItems[j] {
+			score := vector.Distance(int(itemIndex), int(j))
+			if score > 0 {
+				nearItemsFilters[""].Push(j, score)
+				for _, category := range patched.ItemCategories[j] {
+					if nearItemsFilter, exist := nearItemsFilters[category]; exist {
+						nearItemsFilter.Push(j, score)
+					}
+				}
+			}
+		}
+	}
+
+	// save neighbors
+	refresh := ItemRefresh{
+		ItemId:     itemId,
+		Categories: item.Categories,
+		Neighbors:  make(map[string][]cache.Scored, len(nearItemsFilters)),
+	}
+	for category, nearItemsFilter := range nearItemsFilters {
+		elem, scores := nearItemsFilter.PopAll()
+		neighbors := cache.CreateScoredItems(lo.Map(elem, func(i int32, _ int) string {
+			return dataset.ItemIndex.ToName(i)
+		}), scores)
+		if err = m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, itemId, category), neighbors); err != nil {
+			return ItemRefresh{}, errors.Trace(err)
+		}
+		refresh.Neighbors[category] = neighbors
+	}
+	if err = m.updateItemNeighborCategories(itemId, categories); err != nil {
+		return ItemRefresh{}, errors.Trace(err)
+	}
+	if len(item.Categories) > 0 {
+		if err = m.CacheClient.AddSet(cache.ItemCategories, item.Categories...); err != nil {
+			return ItemRefresh{}, errors.Trace(err)
+		}
+	}
+	if err = m.CacheClient.Set(
+		cache.Time(cache.Key(cache.LastUpdateItemNeighborsTime, itemId), time.Now()),
+		cache.String(cache.Key(cache.ItemNeighborsDigest, itemId), m.Config.ItemNeighborDigest())); err != nil {
+		return ItemRefresh{}, errors.Trace(err)
+	}
+	return refresh, nil
+}
+
+// itemLabelNumbers converts item labels to sorted numbers in the label index of the dataset. Labels unknown to the
+// dataset are ignored. False is returned if the label index isn't loaded.
+func (m *Master) itemLabelNumbers(labels []string) ([]int32, bool) {
+	m.clickDataMutex.RLock()
+	defer m.clickDataMutex.RUnlock()
+	if m.clickTrainSet == nil {
+		return nil, false
+	}
+	index := m.clickTrainSet.Index
+	offset := index.CountUsers() + index.CountItems() + index.CountUserLabels()
+	numbers := make([]int32, 0, len(labels))
+	for _, label := range labels {
+		if number := index.EncodeItemLabel(label); number != base.NotId {
+			numbers = append(numbers, number-offset)
+		}
+	}
+	numbers = lo.Uniq(numbers)
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, true
+}
+
+// sortedCopies returns lists sorted in ascending order. Unsorted lists are copied before sorting, so that lists shared
+// with the dataset are never modified.
+func sortedCopies(lists [][]int32) [][]int32 {
+	sorted := make([][]int32, len(lists))
+	for i, list := range lists {
+		if sort.SliceIsSorted(list, func(a, b int) bool { return list[a] < list[b] }) {
+			sorted[i] = list
+		} else {
+			sorted[i] = make([]int32, len(list))
+			copy(sorted[i], list)
+			sort.Slice(sorted[i], func(a, b int) bool { return sorted[i][a] < sorted[i][b] })
+		}
+	}
+	return sorted
+}
+
+// RefreshUser pushes a user to the priority refresh queue and waits until workers refresh offline recommendation of the
+// user.
+func (m *Master) RefreshUser(userId string) (UserRefresh, error) {
+	offlineConfig := &m.Config.Recommend.Offline
+	if offlineConfig.PriorityRefreshQueueSize <= 0 || offlineConfig.MaxPriorityRefreshPerMinute <= 0 {
+		return UserRefresh{}, errors.NotSupportedf("refreshing users without the priority refresh queue")
+	}
+	if _, err := m.DataClient.GetUser(userId); err != nil {
+		return UserRefresh{}, err
+	}
+	// recommendation is regenerated by workers even if it hasn't expired
+	requestTime := time.Now()
+	if err := m.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, userId), requestTime)); err != nil {
+		return UserRefresh{}, errors.Trace(err)
+	}
+	if err := m.CacheClient.AddSorted(cache.Sorted(cache.PriorityRefreshUsers,
+		[]cache.Scored{{Id: userId, Score: float64(requestTime.UnixNano())}})); err != nil {
+		return UserRefresh{}, errors.Trace(err)
+	}
+
+	// wait for workers
+	var err error
+	refresh := UserRefresh{UserId: userId}
+	for deadline := time.Now().Add(refreshUserTimeout); time.Now().Before(deadline); time.Sleep(refreshUserPollInterval) {
+		updateTime, err := m.CacheClient.Get(cache.Key(cache.LastUpdateUserRecommendTime, userId)).Time()
+		if err != nil && !errors.Is(err, errors.NotFound) {
+			return UserRefresh{}, errors.Trace(err)
+		}
+		if !updateTime.Before(requestTime) {
+			refresh.Refreshed = true
+			break
+		}
+	}
+	if refresh.Recommend, err = m.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, userId), 0, m.Config.Recommend.CacheSize-1); err != nil {
+		return UserRefresh{}, errors.Trace(err)
+	}
+	return refresh, nil
+}
@@ -0,0 +1,418 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/encoding"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/model"
+	"github.com/zhenghaoz/gorse/model/click"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/blob"
+	"go.uber.org/zap"
+)
+
+const (
+	ModelCandidate = "candidate" // trained but not serving all users, such as the canary ranking model
+	ModelLive      = "live"      // serving users
+	ModelArchived  = "archived"  // replaced by another model, could be rolled back to
+
+	// ModelRegistryBlob is the name of the manifest of the model registry in the blob store.
+	ModelRegistryBlob = "master/models/manifest.json"
+	// modelCheckpointPrefix is the prefix of names of model checkpoints in the blob store.
+	modelCheckpointPrefix = "master/models/"
+)
+
+// ModelRecord is a trained model in the model registry.
+type ModelRecord struct {
+	ID         string // version of the model in hex
+	Type       string // ranking or click
+	Name       string // name of the ranking model
+	Version    int64
+	Status     string
+	TrainTime  time.Time
+	DataCutoff time.Time // time when the dataset used to train the model was loaded
+	Params     model.Params
+	Metrics    map[string]float32
+	Features   *click.FeatureImportances `json:",omitempty"` // importance of features of the click model
+}
+
+// NewRankingModelRecord creates a record of a trained ranking model.
+func NewRankingModelRecord(name string, version int64, rankingModel ranking.MatrixFactorization, score ranking.Score, dataCutoff time.Time) ModelRecord {
+	return ModelRecord{
+		ID:         encoding.Hex(version),
+		Type:       RankingModelCheckpoint,
+		Name:       name,
+		Version:    version,
+		TrainTime:  time.Now(),
+		DataCutoff: dataCutoff,
+		Params:     rankingModel.GetParams(),
+		Metrics: map[string]float32{
+			"ndcg":      score.NDCG,
+			"precision": score.Precision,
+			"recall":    score.Recall,
+		},
+	}
+}
+
+// NewClickModelRecord creates a record of a trained click model.
+func NewClickModelRecord(version int64, clickModel click.FactorizationMachine, score click.Score, dataCutoff time.Time) ModelRecord {
+	return ModelRecord{
+		ID:         encoding.Hex(version),
+		Type:       ClickModelCheckpoint,
+		Version:    version,
+		TrainTime:  time.Now(),
+		DataCutoff: dataCutoff,
+		Params:     clickModel.GetParams(),
+		Metrics: map[string]float32{
+			"precision": score.Precision,
+			"recall":    score.Recall,
+			"auc":       score.AUC,
+		},
+	}
+}
+
+// ModelRegistry keeps records and checkpoints of trained models in a blob store. The manifest of records is rewritten
+// once a model is registered or its status is changed.
+type ModelRegistry struct {
+	store     blob.Store
+	retention int // number of archived models kept
+	mutex     sync.Mutex
+	records   []ModelRecord // sorted by versions
+}
+
+// LoadModelRegistry loads the model registry from a blob store. An empty registry is returned if the manifest doesn't
+// exist, while the registry is nil if the manifest is broken so that it won't be overwritten.
+func LoadModelRegistry(store blob.Store, retention int) (*ModelRegistry, error) {
+	registry := &ModelRegistry{store: store, retention: retention}
+	r, err := store.Get(ModelRegistryBlob)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return registry, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+	if err = json.NewDecoder(r).Decode(&registry.records); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return registry, nil
+}
+
+func modelCheckpointBlob(modelType, id string) string {
+	return modelCheckpointPrefix + modelType + "/" + id
+}
+
+// List returns records of a type of models from the latest version.
+func (r *ModelRegistry) List(modelType string) []ModelRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var records []ModelRecord
+	for i := len(r.records) - 1; i >= 0; i-- {
+		if r.records[i].Type == modelType {
+			records = append(records, r.records[i])
+		}
+	}
+	return records
+}
+
+// Get returns the record of a model. errors.NotFound is returned if the model doesn't exist.
+func (r *ModelRegistry) Get(modelType, id string) (ModelRecord, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, record := range r.records {
+		if record.Type == modelType && record.ID == id {
+			return record, nil
+		}
+	}
+	return ModelRecord{}, errors.NotFoundf("%s model %s", modelType, id)
+}
+
+// Previous returns the latest archived model older than the live model. errors.NotFound is returned if there is no
+// model to roll back to.
+func (r *ModelRegistry) Previous(modelType string) (ModelRecord, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	live, hasLive := lo.Find(r.records, func(record ModelRecord) bool {
+		return record.Type == modelType && record.Status == ModelLive
+	})
+	for i := len(r.records) - 1; i >= 0; i-- {
+		record := r.records[i]
+		if record.Type == modelType && record.Status == ModelArchived && (!hasLive || record.Version < live.Version) {
+			return record, nil
+		}
+	}
+	return ModelRecord{}, errors.NotFoundf("archived %s model to roll back to", modelType)
+}
+
+// MaxVersion returns the max version of a type of models, or zero if the registry is empty.
+func (r *ModelRegistry) MaxVersion(modelType string) int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var version int64
+	for _, record := range r.records {
+		if record.Type == modelType && record.Version > version {
+			version = record.Version
+		}
+	}
+	return version
+}
+
+// Register saves the checkpoint of a model and adds its record to the registry. The previous model of the same type
+// and status is archived.
+func (r *ModelRegistry) Register(record ModelRecord, writeCheckpoint func(w io.Writer) error) error {
+	if err := blob.Write(r.store, modelCheckpointBlob(record.Type, record.ID), writeCheckpoint); err != nil {
+		return errors.Trace(err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range r.records {
+		if r.records[i].Type == record.Type && r.records[i].Status == record.Status {
+			r.records[i].Status = ModelArchived
+		}
+	}
+	r.records = lo.Filter(r.records, func(r ModelRecord, _ int) bool {
+		return r.Type != record.Type || r.ID != record.ID
+	})
+	r.records = append(r.records, record)
+	sort.SliceStable(r.records, func(i, j int) bool {
+		return r.records[i].Version < r.records[j].Version
+	})
+	return r.save()
+}
+
+// SetLive marks a model as live. The previous live model of the same type is marked by the demoted status.
+func (r *ModelRegistry) SetLive(modelType, id, demoted string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !lo.ContainsBy(r.records, func(record ModelRecord) bool {
+		return record.Type == modelType && record.ID == id
+	}) {
+		return errors.NotFoundf("%s model %s", modelType, id)
+	}
+	for i := range r.records {
+		if r.records[i].Type != modelType {
+			continue
+		}
+		if r.records[i].ID == id {
+			r.records[i].Status = ModelLive
+		} else if r.records[i].Status == ModelLive {
+			r.records[i].Status = demoted
+		}
+	}
+	return r.save()
+}
+
+// Load reads the checkpoint of a model.
+func (r *ModelRegistry) Load(record ModelRecord) (*LocalCache, error) {
+	reader, err := r.store.Get(modelCheckpointBlob(record.Type, record.ID))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader.Close()
+	checkpoint := &LocalCache{}
+	switch record.Type {
+	case RankingModelCheckpoint:
+		err = checkpoint.ReadRankingModel(reader)
+	case ClickModelCheckpoint:
+		err = checkpoint.ReadClickModel(reader)
+	default:
+		err = errors.NotValidf("model type %s", record.Type)
+	}
+	return checkpoint, errors.Trace(err)
+}
+
+// save removes archived models beyond the retention and writes the manifest. The lock must be held.
+func (r *ModelRegistry) save() error {
+	archived := make(map[string]int)
+	var records []ModelRecord
+	for i := len(r.records) - 1; i >= 0; i-- {
+		record := r.records[i]
+		if record.Status == ModelArchived {
+			if archived[record.Type] >= r.retention {
+				if err := r.store.Delete(modelCheckpointBlob(record.Type, record.ID)); err != nil {
+					return errors.Trace(err)
+				}
+				log.Logger().Info("remove archived model",
+					zap.String("type", record.Type), zap.String("id", record.ID))
+				continue
+			}
+			archived[record.Type]++
+		}
+		records = append(records, record)
+	}
+	r.records = lo.Reverse(records)
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(r.records); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(r.store.Put(ModelRegistryBlob, &buf))
+}
+
+// nextModelVersion returns a version greater than the current version and versions in the model registry, so that
+// retrained models never reuse versions of models in the registry after rollbacks.
+func (m *Master) nextModelVersion(modelType string, version int64) int64 {
+	if m.registry != nil {
+		version = lo.Max([]int64{version, m.registry.MaxVersion(modelType)})
+	}
+	return version + 1
+}
+
+// registerRankingModel saves a ranking model to the model registry. Failures are logged since the model is
+// serving anyway.
+func (m *Master) registerRankingModel(record ModelRecord, rankingModel ranking.MatrixFactorization, score ranking.Score) {
+	if m.registry == nil {
+		return
+	}
+	checkpoint := &LocalCache{
+		RankingModelName:    record.Name,
+		RankingModelVersion: record.Version,
+		RankingModelScore:   score,
+		RankingModel:        rankingModel,
+	}
+	if err := m.registry.Register(record, checkpoint.WriteRankingModel); err != nil {
+		log.Logger().Error("failed to register ranking model", zap.String("id", record.ID), zap.Error(err))
+	}
+}
+
+// computeFeatureImportance computes importance of features of a click model on the holdout set and keeps top features
+// in the record. Failures are logged since feature importance is only used for inspection.
+func (m *Master) computeFeatureImportance(record *ModelRecord, clickModel click.FactorizationMachine, testSet *click.Dataset) {
+	topK := m.Config.Master.FeatureImportanceTopK
+	if topK <= 0 {
+		return
+	}
+	startTime := time.Now()
+	importances, err := click.ComputeFeatureImportance(clickModel, testSet, topK,
+		m.Config.Master.FeatureImportanceSamples, m.Config.Recommend.Collaborative.RandomSeed)
+	if err != nil {
+		log.Logger().Warn("failed to compute feature importance", zap.String("id", record.ID), zap.Error(err))
+		return
+	}
+	record.Features = importances
+	log.Logger().Info("compute feature importance complete",
+		zap.String("id", record.ID),
+		zap.Int("n_features", len(importances.Features)),
+		zap.Int("n_samples", importances.NumSamples),
+		zap.Duration("used_time", time.Since(startTime)))
+}
+
+// registerClickModel saves a click model to the model registry. Failures are logged since the model is serving
+// anyway.
+func (m *Master) registerClickModel(record ModelRecord, clickModel click.FactorizationMachine, score click.Score) {
+	if m.registry == nil {
+		return
+	}
+	checkpoint := &LocalCache{
+		ClickModelVersion: record.Version,
+		ClickModelScore:   score,
+		ClickModel:        clickModel,
+	}
+	if err := m.registry.Register(record, checkpoint.WriteClickModel); err != nil {
+		log.Logger().Error("failed to register click model", zap.String("id", record.ID), zap.Error(err))
+	}
+}
+
+// PromoteModel makes a model in the model registry the live model. The live model keeps the version in the registry,
+// so that workers reload it once the version of the live model changes. The canary ranking model is promoted by
+// PromoteCanary instead.
+func (m *Master) PromoteModel(modelType, id string) error {
+	if m.registry == nil {
+		return errors.NotFoundf("model registry")
+	}
+	record, err := m.registry.Get(modelType, id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if record.Status == ModelLive {
+		return nil
+	}
+	m.rankingModelMutex.RLock()
+	isCanary := m.canaryRankingModel != nil && m.canaryRankingModelVersion == record.Version
+	m.rankingModelMutex.RUnlock()
+	if modelType == RankingModelCheckpoint && isCanary {
+		return m.PromoteCanary()
+	}
+	checkpoint, err := m.registry.Load(record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	switch modelType {
+	case RankingModelCheckpoint:
+		if checkpoint.RankingModel == nil {
+			return errors.NotValidf("empty checkpoint of ranking model %s", id)
+		}
+		if err = checkRankingModelCompatibility(checkpoint.RankingModelName, checkpoint.RankingModel); err != nil {
+			return errors.Trace(err)
+		}
+		m.rankingModelMutex.Lock()
+		m.RankingModel = checkpoint.RankingModel
+		m.rankingModelName = checkpoint.RankingModelName
+		m.RankingModelVersion = record.Version
+		m.rankingScore = checkpoint.RankingModelScore
+		m.rankingModelMutex.Unlock()
+		if m.localCache != nil {
+			m.localCache.RankingModelName = checkpoint.RankingModelName
+			m.localCache.RankingModelVersion = record.Version
+			m.localCache.RankingModelScore = checkpoint.RankingModelScore
+			m.localCache.RankingModel = checkpoint.RankingModel
+		}
+	case ClickModelCheckpoint:
+		if checkpoint.ClickModel == nil || checkpoint.ClickModel.Invalid() {
+			return errors.NotValidf("empty checkpoint of click model %s", id)
+		}
+		m.clickModelMutex.Lock()
+		m.ClickModel = checkpoint.ClickModel
+		m.ClickModelVersion = record.Version
+		m.clickScore = checkpoint.ClickModelScore
+		m.clickModelMutex.Unlock()
+		if m.localCache != nil {
+			m.localCache.ClickModelVersion = record.Version
+			m.localCache.ClickModelScore = checkpoint.ClickModelScore
+			m.localCache.ClickModel = checkpoint.ClickModel
+		}
+	}
+	if err = m.registry.SetLive(modelType, id, ModelArchived); err != nil {
+		return errors.Trace(err)
+	}
+	log.Logger().Info("promote model", zap.String("type", modelType), zap.String("id", id))
+	if m.localCache != nil {
+		if err = m.localCache.WriteLocalCache(); err != nil {
+			log.Logger().Error("failed to write local cache", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// RollbackModel promotes the latest archived model older than the live model and returns its record.
+func (m *Master) RollbackModel(modelType string) (ModelRecord, error) {
+	if m.registry == nil {
+		return ModelRecord{}, errors.NotFoundf("model registry")
+	}
+	record, err := m.registry.Previous(modelType)
+	if err != nil {
+		return ModelRecord{}, errors.Trace(err)
+	}
+	return record, m.PromoteModel(modelType, record.ID)
+}
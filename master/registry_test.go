@@ -0,0 +1,216 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/encoding"
+	"github.com/zhenghaoz/gorse/model/click"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/blob"
+)
+
+func TestModelRegistry(t *testing.T) {
+	store := blob.NewLocal(t.TempDir())
+	registry, err := LoadModelRegistry(store, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, registry.List(RankingModelCheckpoint))
+	_, err = registry.Previous(RankingModelCheckpoint)
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	// register models
+	rankingModel := newCanaryRankingModel()
+	cutoff := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for version := int64(1); version <= 3; version++ {
+		record := NewRankingModelRecord("bpr", version, rankingModel, ranking.Score{NDCG: float32(version)}, cutoff)
+		record.Status = ModelLive
+		checkpoint := &LocalCache{RankingModelName: "bpr", RankingModelVersion: version, RankingModel: rankingModel}
+		assert.NoError(t, registry.Register(record, checkpoint.WriteRankingModel))
+	}
+	candidate := NewRankingModelRecord("bpr", 4, rankingModel, ranking.Score{}, cutoff)
+	candidate.Status = ModelCandidate
+	checkpoint := &LocalCache{RankingModelName: "bpr", RankingModelVersion: 4, RankingModel: rankingModel}
+	assert.NoError(t, registry.Register(candidate, checkpoint.WriteRankingModel))
+	assert.Equal(t, int64(4), registry.MaxVersion(RankingModelCheckpoint))
+	assert.Zero(t, registry.MaxVersion(ClickModelCheckpoint))
+
+	// archived models beyond the retention are removed
+	records := registry.List(RankingModelCheckpoint)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, encoding.Hex(4), records[0].ID)
+		assert.Equal(t, ModelCandidate, records[0].Status)
+		assert.Equal(t, encoding.Hex(3), records[1].ID)
+		assert.Equal(t, ModelLive, records[1].Status)
+		assert.Equal(t, encoding.Hex(2), records[2].ID)
+		assert.Equal(t, ModelArchived, records[2].Status)
+		assert.Equal(t, float32(2), records[2].Metrics["ndcg"])
+		assert.Equal(t, cutoff, records[2].DataCutoff)
+	}
+	names, err := store.List(modelCheckpointPrefix + RankingModelCheckpoint + "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		modelCheckpointBlob(RankingModelCheckpoint, encoding.Hex(2)),
+		modelCheckpointBlob(RankingModelCheckpoint, encoding.Hex(3)),
+		modelCheckpointBlob(RankingModelCheckpoint, encoding.Hex(4)),
+	}, names)
+
+	// roll back to the previous model
+	previous, err := registry.Previous(RankingModelCheckpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, encoding.Hex(2), previous.ID)
+	loaded, err := registry.Load(previous)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), loaded.RankingModelVersion)
+	assert.Equal(t, "bpr", loaded.RankingModelName)
+	assert.NoError(t, registry.SetLive(RankingModelCheckpoint, previous.ID, ModelArchived))
+	assert.True(t, errors.Is(registry.SetLive(RankingModelCheckpoint, encoding.Hex(1), ModelArchived), errors.NotFound))
+
+	// reload the registry
+	registry, err = LoadModelRegistry(store, 1)
+	assert.NoError(t, err)
+	records = registry.List(RankingModelCheckpoint)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, ModelArchived, records[1].Status)
+		assert.Equal(t, ModelLive, records[2].Status)
+	}
+}
+
+func TestMaster_RollbackModel(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.localCache = &LocalCache{path: filepath.Join(t.TempDir(), "TestMaster_RollbackModel")}
+	var err error
+	s.registry, err = LoadModelRegistry(blob.NewLocal(t.TempDir()), 5)
+	assert.NoError(t, err)
+
+	// train two generations of ranking models
+	models := []ranking.MatrixFactorization{newCanaryRankingModel(), newCanaryRankingModel()}
+	for i, rankingModel := range models {
+		s.RankingModel = rankingModel
+		s.rankingModelName = "bpr"
+		s.RankingModelVersion = s.nextModelVersion(RankingModelCheckpoint, s.RankingModelVersion)
+		record := NewRankingModelRecord("bpr", s.RankingModelVersion, rankingModel, ranking.Score{}, time.Now())
+		record.Status = ModelLive
+		s.registerRankingModel(record, rankingModel, ranking.Score{})
+		assert.Equal(t, int64(i+1), s.RankingModelVersion)
+	}
+
+	// roll back to the first generation
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/model/ranking/rollback").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.Equal(t, int64(1), s.RankingModelVersion)
+	assert.Equal(t, models[0].(*ranking.BPR).UserFactor, s.RankingModel.(*ranking.BPR).UserFactor)
+	assert.Equal(t, int64(1), s.localCache.RankingModelVersion)
+	assert.Equal(t, int64(3), s.nextModelVersion(RankingModelCheckpoint, s.RankingModelVersion))
+	resp := apitest.New().
+		Handler(s.handler).
+		Get("/api/admin/model/ranking/registry").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	var records []ModelRecord
+	assert.NoError(t, json.NewDecoder(resp.Response.Body).Decode(&records))
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, ModelArchived, records[0].Status)
+		assert.Equal(t, ModelLive, records[1].Status)
+	}
+
+	// no model to roll back to
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/model/ranking/rollback").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	// promote the second generation
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/model/ranking/registry/"+encoding.Hex(2)+"/promote").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.Equal(t, int64(2), s.RankingModelVersion)
+	assert.Equal(t, models[1].(*ranking.BPR).UserFactor, s.RankingModel.(*ranking.BPR).UserFactor)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/model/ranking/registry/missing/promote").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestMaster_GetModelFeatures(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	var err error
+	s.registry, err = LoadModelRegistry(blob.NewLocal(t.TempDir()), 5)
+	assert.NoError(t, err)
+	writeCheckpoint := func(w io.Writer) error {
+		_, err := w.Write([]byte("checkpoint"))
+		return err
+	}
+	importances := &click.FeatureImportances{
+		Features:   []click.FeatureImportance{{Index: 2, Kind: click.FeatureUserLabel, Name: "a", Weight: 1, Permutation: 0.5}},
+		Groups:     []click.FeatureImportance{{Index: -1, Kind: click.FeatureUserLabel, Permutation: 0.5}},
+		NumSamples: 10,
+	}
+	err = s.registry.Register(ModelRecord{ID: encoding.Hex(1), Type: ClickModelCheckpoint, Version: 1}, writeCheckpoint)
+	assert.NoError(t, err)
+	err = s.registry.Register(ModelRecord{ID: encoding.Hex(2), Type: ClickModelCheckpoint, Version: 2, Features: importances}, writeCheckpoint)
+	assert.NoError(t, err)
+
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/model/"+encoding.Hex(2)+"/features").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, importances)).
+		End()
+	// feature importance isn't computed
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/model/"+encoding.Hex(1)+"/features").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/model/missing/features").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
@@ -16,6 +16,7 @@ package master
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/araddon/dateparse"
 	restfulspec "github.com/emicklei/go-restful-openapi/v2"
@@ -35,6 +36,7 @@ import (
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
 	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/blob"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
 	"go.uber.org/zap"
@@ -47,6 +49,9 @@ import (
 	"time"
 )
 
+// bodilessMethods are methods of routes without request bodies, whose requests are sent without Content-Type.
+var bodilessMethods = []string{http.MethodPost}
+
 func (m *Master) CreateWebService() {
 	ws := m.WebService
 	ws.Consumes(restful.MIME_JSON).Produces(restful.MIME_JSON)
@@ -70,16 +75,153 @@ func (m *Master) CreateWebService() {
 		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
 		Param(ws.HeaderParameter("X-API-Key", "secret key for RESTful API")).
 		Writes(Status{}))
+	ws.Route(ws.GET("/dashboard/quota").To(m.getQuota).
+		Doc("Get usage of quotas on users and items.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Writes(server.QuotaState{}))
+	ws.Route(ws.GET("/dashboard/enrichment").To(m.getEnrichment).
+		Doc("Get numbers of items created automatically by feedback in each enrichment status.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Writes(server.EnrichmentCounts{}))
+	ws.Route(ws.GET("/dashboard/usage").To(m.getUsage).
+		Doc("Get daily usage, including requests, ingested rows, unique users and sizes of the data store.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.QueryParameter("from", "the first day (yyyy-mm-dd), 29 days before the last day by default").DataType("string")).
+		Param(ws.QueryParameter("to", "the last day (yyyy-mm-dd), today by default").DataType("string")).
+		Param(ws.QueryParameter("format", "json or csv, json by default").DataType("string")).
+		Produces(restful.MIME_JSON, "text/csv").
+		Writes([]data.Usage{}))
 	ws.Route(ws.GET("/dashboard/tasks").To(m.getTasks).
 		Doc("Get tasks.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
 		Param(ws.HeaderParameter("X-API-Key", "secret key for RESTful API")).
 		Writes([]task.Task{}))
+	ws.Route(ws.GET("/dashboard/tasks/shards").To(m.getShards).
+		Doc("Get user shards assigned to workers and their progress of offline recommendation.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "secret key for RESTful API")).
+		Writes([]Shard{}))
+	ws.Route(ws.POST("/dashboard/tasks/{name}/cancel").To(m.cancelTask).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Cancel a running task. The task stops at the next check between batches.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("name", "task name").DataType("string")).
+		Returns(200, "OK", server.Success{}).
+		Writes(server.Success{}))
+	ws.Route(ws.POST("/dashboard/tasks/{name}/run").To(m.runTask).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Run a pipeline stage immediately. Valid stages are load_dataset, refresh_popular, refresh_latest, refresh_trending, refresh_covisit, find_duplicates, find_item_neighbors, train_ranking, offline_recommend and verify_cache.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("name", "stage name").DataType("string")).
+		Returns(200, "OK", StageRun{}).
+		Writes(StageRun{}))
+	ws.Route(ws.GET("/dashboard/webhooks/deliveries").To(m.getWebhookDeliveries).
+		Filter(m.AdminFilter).
+		Doc("Get the latest webhook delivery attempts.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned deliveries").DataType("int")).
+		Returns(200, "OK", []WebhookDelivery{}).
+		Writes([]WebhookDelivery{}))
+	ws.Route(ws.GET("/dashboard/alerts").To(m.getAlerts).
+		Filter(m.AdminFilter).
+		Doc("Get active alerts and recently resolved alerts.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", Alerts{}).
+		Writes(Alerts{}))
+	ws.Route(ws.GET("/dashboard/shadow-diff").To(m.getShadowDiff).
+		Filter(m.AdminFilter).
+		Doc("Compare shadow recommendation generated by dry-run workers with production recommendation of sampled users.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("sample", "number of sampled users").DataType("int")).
+		Param(ws.QueryParameter("n", "number of compared items").DataType("int")).
+		Returns(200, "OK", ShadowDiff{}).
+		Writes(ShadowDiff{}))
+	ws.Route(ws.GET("/dashboard/shadow-traffic").To(m.getShadowTraffic).
+		Filter(m.AdminFilter).
+		Doc("Get differences between responses of this cluster and the secondary cluster to the latest replayed requests.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned differences").DataType("int")).
+		Returns(200, "OK", ShadowTrafficReport{}).
+		Writes(ShadowTrafficReport{}))
+	ws.Route(ws.POST("/dashboard/shadow/promote").To(m.promoteShadow).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Swap shadow recommendation with production recommendation atomically.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", server.Success{}).
+		Writes(server.Success{}))
+	ws.Route(ws.GET("/dashboard/canary").To(m.getCanary).
+		Filter(m.AdminFilter).
+		Doc("Get the canary ranking model and click-through of each generation of the ranking model.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", CanaryStatus{}).
+		Writes(CanaryStatus{}))
+	ws.Route(ws.POST("/dashboard/canary/promote").To(m.promoteCanary).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Swap the canary ranking model with the default ranking model without retraining.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", server.Success{}).
+		Writes(server.Success{}))
+	ws.Route(ws.GET("/dashboard/duplicates").To(m.getDuplicates).
+		Filter(m.AdminFilter).
+		Doc("Get clusters of near-duplicate items.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", []DuplicateCluster{}).
+		Writes([]DuplicateCluster{}))
+	ws.Route(ws.DELETE("/dashboard/duplicates/{canonical-id}").To(m.breakDuplicates).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Break a cluster of near-duplicate items. Items of the cluster are never clustered again.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("canonical-id", "identifier of the canonical item").DataType("string")).
+		Returns(200, "OK", server.Success{}).
+		Writes(server.Success{}))
+	ws.Route(ws.GET("/dashboard/audit").To(m.getAuditLogs).
+		Filter(m.AdminFilter).
+		Doc("Get audit logs of mutating API calls, latest first.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("cursor", "cursor for the next page").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned audit logs").DataType("int")).
+		Param(ws.QueryParameter("entity", "entity of audit logs, such as user/1 and item/2").DataType("string")).
+		Param(ws.QueryParameter("actor", "actor of audit logs").DataType("string")).
+		Returns(200, "OK", AuditLogIterator{}).
+		Writes(AuditLogIterator{}))
 	ws.Route(ws.GET("/dashboard/rates").To(m.getRates).
 		Doc("Get positive feedback rates.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
 		Param(ws.HeaderParameter("X-API-Key", "secret key for RESTful API")).
 		Writes(map[string][]server.Measurement{}))
+	ws.Route(ws.GET("/dashboard/evaluations").To(m.getEvaluations).
+		Doc("Get offline evaluation reports of training runs.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "secret key for RESTful API")).
+		Param(ws.QueryParameter("n", "number of returned reports").DataType("int")).
+		Writes([]EvaluationReport{}))
+	ws.Route(ws.GET("/dashboard/model/{id}/features").To(m.getModelFeatures).
+		Doc("Get importance of features of a click model in the model registry.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"dashboard"}).
+		Param(ws.HeaderParameter("X-API-Key", "secret key for RESTful API")).
+		Param(ws.PathParameter("id", "identifier of the model in the registry").DataType("string")).
+		Writes(click.FeatureImportances{}))
 	// Get a user
 	ws.Route(ws.GET("/dashboard/user/{user-id}").To(m.getUser).
 		Doc("Get a user.").
@@ -172,6 +314,142 @@ func (m *Master) CreateWebService() {
 		Param(ws.QueryParameter("n", "number of returned users").DataType("int")).
 		Param(ws.QueryParameter("offset", "offset of the list").DataType("int")).
 		Writes([]data.User{}))
+
+	ws.Route(ws.GET("/admin/model/{name}/export").To(m.exportModel).
+		Filter(m.AdminFilter).
+		Doc("Export the checkpoint of a trained model.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("name", "model name (ranking or click)").DataType("string")).
+		Param(ws.QueryParameter("blob", "write the checkpoint to the blob store by this name instead of the response").DataType("string")).
+		Produces(restful.MIME_OCTET, restful.MIME_JSON))
+	ws.Route(ws.GET("/admin/embeddings/users").To(m.exportEmbeddings(UserEmbeddings)).
+		Filter(m.AdminFilter).
+		Doc("Export embeddings of users in the live ranking model.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("format", "format of embeddings (jsonl or binary)").DataType("string")).
+		Produces(restful.MIME_OCTET, "application/x-ndjson"))
+	ws.Route(ws.GET("/admin/embeddings/items").To(m.exportEmbeddings(ItemEmbeddings)).
+		Filter(m.AdminFilter).
+		Doc("Export embeddings of items in the live ranking model.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("format", "format of embeddings (jsonl or binary)").DataType("string")).
+		Produces(restful.MIME_OCTET, "application/x-ndjson"))
+	ws.Route(ws.POST("/admin/model/{name}/import").To(m.importModel).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Import the checkpoint of a trained model.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("name", "model name (ranking or click)").DataType("string")).
+		Param(ws.QueryParameter("blob", "read the checkpoint from the blob store by this name instead of the body").DataType("string")).
+		Consumes(restful.MIME_OCTET).
+		Returns(200, "OK", server.Success{}).
+		Writes(server.Success{}))
+	ws.Route(ws.GET("/admin/model/{name}/registry").To(m.getModelRegistry).
+		Filter(m.AdminFilter).
+		Doc("List trained models in the model registry from the latest version.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("name", "model name (ranking or click)").DataType("string")).
+		Returns(200, "OK", []ModelRecord{}).
+		Writes([]ModelRecord{}))
+	ws.Route(ws.POST("/admin/model/{name}/registry/{id}/promote").To(m.promoteModel).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Make a model in the model registry the live model.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("name", "model name (ranking or click)").DataType("string")).
+		Param(ws.PathParameter("id", "identifier of the model in the registry").DataType("string")).
+		Returns(200, "OK", server.Success{}).
+		Writes(server.Success{}))
+	ws.Route(ws.POST("/admin/model/{name}/rollback").To(m.rollbackModel).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Make the latest archived model older than the live model the live model.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("name", "model name (ranking or click)").DataType("string")).
+		Returns(200, "OK", ModelRecord{}).
+		Writes(ModelRecord{}))
+	ws.Route(ws.POST("/admin/refresh/item/{item-id}").To(m.refreshItem).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Search neighbors of an item with the latest labels and categories immediately.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("item-id", "identifier of the item").DataType("string")).
+		Returns(200, "OK", ItemRefresh{}).
+		Writes(ItemRefresh{}))
+	ws.Route(ws.POST("/admin/refresh/user/{user-id}").To(m.refreshUser).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Refresh offline recommendation of a user via the priority refresh queue and wait for workers.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "identifier of the user").DataType("string")).
+		Returns(200, "OK", UserRefresh{}).
+		Writes(UserRefresh{}))
+	ws.Route(ws.GET("/admin/digest/{digest}").To(m.lookupDigest).
+		Filter(m.AdminFilter).
+		Doc("Get the user id of a digest in cache keys and logs if user ids are obfuscated.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("digest", "digest of the user id").DataType("string")).
+		Returns(200, "OK", DigestLookup{}).
+		Writes(DigestLookup{}))
+	ws.Route(ws.POST("/admin/snapshot").To(m.runSnapshot).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Export a consistent snapshot of data and cache stores to the snapshot location in background.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", SnapshotRun{}).
+		Writes(SnapshotRun{}))
+	ws.Route(ws.GET("/admin/labels").To(m.getLabels).
+		Filter(m.AdminFilter).
+		Doc("Get labels with numbers of items and users.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", []data.LabelCount{}).
+		Writes([]data.LabelCount{}))
+	ws.Route(ws.POST("/admin/labels/rename").To(m.renameLabel).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Rename a label of items and users to a label not in use in background.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("from", "the label to rename").DataType("string")).
+		Param(ws.QueryParameter("to", "the new label").DataType("string")).
+		Returns(200, "OK", LabelRewriteRun{}).
+		Writes(LabelRewriteRun{}))
+	ws.Route(ws.POST("/admin/labels/merge").To(m.mergeLabels).
+		AllowedMethodsWithoutContentType(bodilessMethods).
+		Filter(m.AdminFilter).
+		Filter(m.AuditFilter).
+		Doc("Merge a label of items and users into another label in use in background.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("from", "the label to merge").DataType("string")).
+		Param(ws.QueryParameter("to", "the label merged into").DataType("string")).
+		Returns(200, "OK", LabelRewriteRun{}).
+		Writes(LabelRewriteRun{}))
+	ws.Route(ws.GET("/admin/labels/rewrite").To(m.getLabelRewrite).
+		Filter(m.AdminFilter).
+		Doc("Get the progress of the latest label rewrite.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"admin"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", LabelRewrite{}).
+		Writes(LabelRewrite{}))
 }
 
 // SinglePageAppFileSystem is the file system for single page app.
@@ -326,7 +604,12 @@ func (m *Master) logout(response http.ResponseWriter, request *http.Request) {
 
 func (m *Master) LoginFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 	if m.checkLogin(req.Request) {
-		req.Request.Header.Set("X-API-Key", m.Config.Server.APIKey)
+		server.SetAuditActor(req, server.DashboardActor(m.Config.Master.DashboardUserName))
+		if m.Config.Server.AdminAPIKey != "" {
+			req.Request.Header.Set("X-API-Key", m.Config.Server.AdminAPIKey)
+		} else {
+			req.Request.Header.Set("X-API-Key", m.Config.Server.APIKey)
+		}
 	}
 	chain.ProcessFilter(req, resp)
 }
@@ -427,7 +710,32 @@ type Status struct {
 	RankingModelScore       click.Score
 	UserNeighborIndexRecall float32
 	ItemNeighborIndexRecall float32
+	ItemNeighborSimilarity  string
 	MatchingIndexRecall     float32
+	ActiveUsers             ActivityStats
+	ActiveItems             ActivityStats
+}
+
+func (m *Master) getQuota(_ *restful.Request, response *restful.Response) {
+	if m.QuotaManager == nil {
+		server.InternalServerError(response, errors.NotAssignedf("quota manager"))
+		return
+	}
+	state, err := m.QuotaManager.State()
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, state)
+}
+
+func (m *Master) getEnrichment(_ *restful.Request, response *restful.Response) {
+	counts, err := server.GetEnrichmentCounts(m.CacheClient)
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, counts)
 }
 
 func (m *Master) getStats(_ *restful.Request, response *restful.Response) {
@@ -507,6 +815,10 @@ func (m *Master) getStats(_ *restful.Request, response *restful.Response) {
 			status.ItemNeighborIndexRecall = encoding.ParseFloat32(temp)
 		}
 	}
+	// read similarity of item neighbors
+	if status.ItemNeighborSimilarity, err = m.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.ItemNeighborSimilarity)).String(); err != nil {
+		log.ResponseLogger(response).Warn("failed to get item neighbor similarity", zap.Error(err))
+	}
 	// read matching index recall
 	if m.Config.Recommend.Collaborative.EnableIndex {
 		if temp, err = m.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.MatchingIndexRecall)).String(); err != nil {
@@ -515,6 +827,10 @@ func (m *Master) getStats(_ *restful.Request, response *restful.Response) {
 			status.MatchingIndexRecall = encoding.ParseFloat32(temp)
 		}
 	}
+	// read estimated numbers of active users and items
+	if status.ActiveUsers, status.ActiveItems, err = m.GetActivityStats(); err != nil {
+		log.ResponseLogger(response).Warn("failed to get activity statistics", zap.Error(err))
+	}
 	server.Ok(response, status)
 }
 
@@ -533,6 +849,262 @@ func (m *Master) getTasks(_ *restful.Request, response *restful.Response) {
 	server.Ok(response, tasks)
 }
 
+func (m *Master) getShards(_ *restful.Request, response *restful.Response) {
+	server.Ok(response, m.GetShards())
+}
+
+func (m *Master) cancelTask(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	if err := m.taskMonitor.Cancel(name); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else if errors.Is(err, errors.NotValid) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	log.ResponseLogger(response).Info("cancel task", zap.String("task", name))
+	server.SetAudit(request, fmt.Sprintf("cancel task %v", name))
+	server.Ok(response, server.Success{RowAffected: 1})
+}
+
+// StageRun is the result of running a pipeline stage.
+type StageRun struct {
+	// Task is the name of the task to poll progress from.
+	Task string
+	// Started is false if the stage was running already. Offline recommendation requested during a running cycle is
+	// served by the next cycle.
+	Started bool
+}
+
+func (m *Master) runTask(request *restful.Request, response *restful.Response) {
+	stage := request.PathParameter("name")
+	taskName, started, err := m.runStage(stage)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else if errors.Is(err, errors.NotValid) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	log.ResponseLogger(response).Info("run stage", zap.String("stage", stage), zap.Bool("started", started))
+	server.SetAudit(request, fmt.Sprintf("run stage %v", stage))
+	server.Ok(response, StageRun{Task: taskName, Started: started})
+}
+
+func (m *Master) getWebhookDeliveries(request *restful.Request, response *restful.Response) {
+	n, err := server.ParseInt(request, "n", 100)
+	if err != nil {
+		server.BadRequest(response, err)
+		return
+	}
+	deliveries, err := m.GetWebhookDeliveries(n)
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, deliveries)
+}
+
+func (m *Master) getShadowDiff(request *restful.Request, response *restful.Response) {
+	numSamples, err := server.ParseInt(request, "sample", 1000)
+	if err != nil {
+		server.BadRequest(response, err)
+		return
+	}
+	n, err := server.ParseInt(request, "n", 10)
+	if err != nil {
+		server.BadRequest(response, err)
+		return
+	}
+	if numSamples <= 0 || n <= 0 {
+		server.BadRequest(response, errors.NotValidf("sample and n"))
+		return
+	}
+	diff, err := m.GetShadowDiff(numSamples, n)
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, diff)
+}
+
+func (m *Master) promoteShadow(_ *restful.Request, response *restful.Response) {
+	if err := m.PromoteShadow(); err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, server.Success{RowAffected: 1})
+}
+
+func (m *Master) getCanary(_ *restful.Request, response *restful.Response) {
+	server.Ok(response, m.GetCanaryStatus())
+}
+
+func (m *Master) promoteCanary(_ *restful.Request, response *restful.Response) {
+	if err := m.PromoteCanary(); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	server.Ok(response, server.Success{RowAffected: 1})
+}
+
+func (m *Master) getDuplicates(_ *restful.Request, response *restful.Response) {
+	clusters, err := m.GetDuplicateClusters()
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, clusters)
+}
+
+// AuditLogIterator is the iterator for audit logs.
+type AuditLogIterator struct {
+	Cursor    string
+	AuditLogs []data.AuditLog
+}
+
+func (m *Master) getAuditLogs(request *restful.Request, response *restful.Response) {
+	cursor := request.QueryParameter("cursor")
+	n, err := server.ParseInt(request, "n", 100)
+	if err != nil {
+		server.BadRequest(response, err)
+		return
+	}
+	cursor, auditLogs, err := m.DataClient.GetAuditLogs(cursor, n, request.QueryParameter("entity"), request.QueryParameter("actor"))
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, AuditLogIterator{Cursor: cursor, AuditLogs: auditLogs})
+}
+
+func (m *Master) breakDuplicates(request *restful.Request, response *restful.Response) {
+	canonicalId := request.PathParameter("canonical-id")
+	count, err := m.BreakDuplicateCluster(canonicalId)
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.SetAudit(request, fmt.Sprintf("break %d duplicates", count), server.AuditEntity(server.AuditEntityItem, canonicalId))
+	server.Ok(response, server.Success{RowAffected: count})
+}
+
+func (m *Master) refreshItem(request *restful.Request, response *restful.Response) {
+	if !m.allowRefresh() {
+		server.TooManyRequests(response, errors.Errorf("more than %d refreshes per minute", m.Config.Master.MaxRefreshPerMinute))
+		return
+	}
+	itemId := request.PathParameter("item-id")
+	refresh, err := m.RefreshItem(itemId)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else if errors.Is(err, errors.NotValid) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	log.ResponseLogger(response).Info("refresh item", zap.String("item_id", itemId))
+	server.Ok(response, refresh)
+}
+
+func (m *Master) refreshUser(request *restful.Request, response *restful.Response) {
+	if !m.allowRefresh() {
+		server.TooManyRequests(response, errors.Errorf("more than %d refreshes per minute", m.Config.Master.MaxRefreshPerMinute))
+		return
+	}
+	userId := request.PathParameter("user-id")
+	refresh, err := m.RefreshUser(userId)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else if errors.Is(err, errors.NotSupported) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	log.ResponseLogger(response).Info("refresh user", log.UserId(userId), zap.Bool("refreshed", refresh.Refreshed))
+	server.Ok(response, refresh)
+}
+
+func (m *Master) runSnapshot(request *restful.Request, response *restful.Response) {
+	started, err := m.RunSnapshot()
+	if err != nil {
+		if errors.Is(err, errors.NotSupported) || errors.Is(err, errors.NotValid) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	log.ResponseLogger(response).Info("run snapshot", zap.Bool("started", started))
+	server.SetAudit(request, "export snapshot")
+	server.Ok(response, SnapshotRun{Task: TaskExportSnapshot, Started: started})
+}
+
+func (m *Master) getLabels(_ *restful.Request, response *restful.Response) {
+	labels, err := m.DataClient.GetLabels()
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, labels)
+}
+
+func (m *Master) renameLabel(request *restful.Request, response *restful.Response) {
+	m.runLabelRewrite(LabelRewriteRename, request, response)
+}
+
+func (m *Master) mergeLabels(request *restful.Request, response *restful.Response) {
+	m.runLabelRewrite(LabelRewriteMerge, request, response)
+}
+
+func (m *Master) runLabelRewrite(kind string, request *restful.Request, response *restful.Response) {
+	from, to := request.QueryParameter("from"), request.QueryParameter("to")
+	started, err := m.RewriteLabel(kind, from, to)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else if errors.Is(err, errors.NotValid) || errors.Is(err, errors.AlreadyExists) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	log.ResponseLogger(response).Info("rewrite label",
+		zap.String("kind", kind), zap.String("from", from), zap.String("to", to), zap.Bool("started", started))
+	server.SetAudit(request, fmt.Sprintf("%s label %s to %s", kind, from, to))
+	server.Ok(response, LabelRewriteRun{Task: TaskRewriteLabel, Started: started})
+}
+
+func (m *Master) getLabelRewrite(_ *restful.Request, response *restful.Response) {
+	record, err := m.GetLabelRewrite()
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	server.Ok(response, record)
+}
+
 func (m *Master) getRates(request *restful.Request, response *restful.Response) {
 	// Parse parameters
 	n, err := server.ParseInt(request, "n", 100)
@@ -551,6 +1123,20 @@ func (m *Master) getRates(request *restful.Request, response *restful.Response)
 	server.Ok(response, measurements)
 }
 
+func (m *Master) getEvaluations(request *restful.Request, response *restful.Response) {
+	n, err := server.ParseInt(request, "n", 100)
+	if err != nil {
+		server.BadRequest(response, err)
+		return
+	}
+	reports, err := m.GetEvaluationReports(n)
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, reports)
+}
+
 type UserIterator struct {
 	Cursor string
 	Users  []User
@@ -637,23 +1223,11 @@ func (m *Master) getRecommend(request *restful.Request, response *restful.Respon
 	case "item_based":
 		results, err = m.Recommend(response, userId, category, n, m.RecommendItemBased)
 	case "_":
-		recommenders := []server.Recommender{m.RecommendOffline}
-		for _, recommender := range m.Config.Recommend.Online.FallbackRecommend {
-			switch recommender {
-			case "collaborative":
-				recommenders = append(recommenders, m.RecommendCollaborative)
-			case "item_based":
-				recommenders = append(recommenders, m.RecommendItemBased)
-			case "user_based":
-				recommenders = append(recommenders, m.RecommendUserBased)
-			case "latest":
-				recommenders = append(recommenders, m.RecommendLatest)
-			case "popular":
-				recommenders = append(recommenders, m.RecommendPopular)
-			default:
-				server.InternalServerError(response, fmt.Errorf("unknown fallback recommendation method `%s`", recommender))
-				return
-			}
+		var recommenders []server.Recommender
+		recommenders, err = m.FallbackRecommenders()
+		if err != nil {
+			server.InternalServerError(response, err)
+			return
 		}
 		results, err = m.Recommend(response, userId, category, n, recommenders...)
 	}
@@ -785,6 +1359,268 @@ func (m *Master) getUserNeighbors(request *restful.Request, response *restful.Re
 	m.getSort(cache.Key(cache.UserNeighbors, userId), "", false, request, response, data.User{})
 }
 
+func (m *Master) exportModel(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	checkpoint := &LocalCache{}
+	var writeCheckpoint func(w io.Writer) error
+	switch name {
+	case RankingModelCheckpoint:
+		m.rankingModelMutex.RLock()
+		checkpoint.RankingModelName = m.rankingModelName
+		checkpoint.RankingModelVersion = m.RankingModelVersion
+		checkpoint.RankingModelScore = m.rankingScore
+		checkpoint.RankingModel = m.RankingModel
+		m.rankingModelMutex.RUnlock()
+		if checkpoint.RankingModel == nil || checkpoint.RankingModel.Invalid() {
+			server.PageNotFound(response, errors.New("ranking model hasn't been trained"))
+			return
+		}
+		writeCheckpoint = checkpoint.WriteRankingModel
+	case ClickModelCheckpoint:
+		m.clickModelMutex.RLock()
+		checkpoint.ClickModelVersion = m.ClickModelVersion
+		checkpoint.ClickModelScore = m.clickScore
+		checkpoint.ClickModel = m.ClickModel
+		m.clickModelMutex.RUnlock()
+		if checkpoint.ClickModel == nil || checkpoint.ClickModel.Invalid() {
+			server.PageNotFound(response, errors.New("click model hasn't been trained"))
+			return
+		}
+		writeCheckpoint = checkpoint.WriteClickModel
+	default:
+		server.BadRequest(response, fmt.Errorf("unknown model %s", name))
+		return
+	}
+	if blobName := request.QueryParameter("blob"); blobName != "" {
+		if m.blobStore == nil {
+			server.BadRequest(response, errors.New("blob store isn't configured"))
+			return
+		}
+		if err := blob.Write(m.blobStore, blobName, writeCheckpoint); err != nil {
+			server.InternalServerError(response, err)
+			return
+		}
+		log.ResponseLogger(response).Info("export model", zap.String("name", name), zap.String("blob", blobName))
+		server.Ok(response, server.Success{RowAffected: 1})
+		return
+	}
+	response.Header().Set("Content-Type", restful.MIME_OCTET)
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s.model", name))
+	if err := writeCheckpoint(response); err != nil {
+		log.ResponseLogger(response).Error("failed to export model", zap.String("name", name), zap.Error(err))
+	}
+}
+
+// maxCheckpointBytes is the size limit of model checkpoints to import.
+var maxCheckpointBytes int64 = 1 << 30
+
+// errCheckpointTooLarge is returned once a checkpoint to import exceeds maxCheckpointBytes.
+var errCheckpointTooLarge = errors.New("model checkpoint too large")
+
+// checkpointReader reads a model checkpoint to import and fails once it exceeds the size limit.
+type checkpointReader struct {
+	reader io.Reader
+	remain int64
+}
+
+func (r *checkpointReader) Read(p []byte) (int, error) {
+	if r.remain <= 0 {
+		return 0, errCheckpointTooLarge
+	}
+	if int64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	n, err := r.reader.Read(p)
+	r.remain -= int64(n)
+	return n, err
+}
+
+// importModel replaces a model by an exported checkpoint. The model version is increased instead of being restored
+// from the checkpoint, so that workers and servers always reload the imported model.
+func (m *Master) importModel(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	checkpoint := &LocalCache{}
+	body := &checkpointReader{reader: request.Request.Body, remain: maxCheckpointBytes}
+	if blobName := request.QueryParameter("blob"); blobName != "" {
+		if m.blobStore == nil {
+			server.BadRequest(response, errors.New("blob store isn't configured"))
+			return
+		}
+		r, err := m.blobStore.Get(blobName)
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+			return
+		} else if err != nil {
+			server.InternalServerError(response, err)
+			return
+		}
+		defer r.Close()
+		body.reader = r
+	}
+	readError := func(err error) {
+		if errors.Is(err, errCheckpointTooLarge) {
+			if err = response.WriteErrorString(http.StatusRequestEntityTooLarge, err.Error()); err != nil {
+				log.ResponseLogger(response).Error("failed to write error", zap.Error(err))
+			}
+			return
+		}
+		server.BadRequest(response, err)
+	}
+	switch name {
+	case RankingModelCheckpoint:
+		if err := checkpoint.ReadRankingModel(body); err != nil {
+			readError(err)
+			return
+		}
+		if checkpoint.RankingModel == nil {
+			server.BadRequest(response, errors.New("ranking model checkpoint is empty"))
+			return
+		}
+		if err := checkRankingModelCompatibility(checkpoint.RankingModelName, checkpoint.RankingModel); err != nil {
+			server.BadRequest(response, err)
+			return
+		}
+		m.rankingModelMutex.Lock()
+		m.rankingModelName = checkpoint.RankingModelName
+		m.RankingModelVersion = m.nextModelVersion(RankingModelCheckpoint, m.RankingModelVersion)
+		m.rankingScore = checkpoint.RankingModelScore
+		m.RankingModel = checkpoint.RankingModel
+		version := m.RankingModelVersion
+		m.rankingModelMutex.Unlock()
+		// the dataset of imported models is unknown
+		record := NewRankingModelRecord(checkpoint.RankingModelName, version, checkpoint.RankingModel, checkpoint.RankingModelScore, time.Time{})
+		record.Status = ModelLive
+		m.registerRankingModel(record, checkpoint.RankingModel, checkpoint.RankingModelScore)
+		if m.localCache != nil {
+			m.localCache.RankingModelName = checkpoint.RankingModelName
+			m.localCache.RankingModelVersion = version
+			m.localCache.RankingModelScore = checkpoint.RankingModelScore
+			m.localCache.RankingModel = checkpoint.RankingModel
+		}
+	case ClickModelCheckpoint:
+		if err := checkpoint.ReadClickModel(body); err != nil {
+			readError(err)
+			return
+		}
+		if checkpoint.ClickModel == nil {
+			server.BadRequest(response, errors.New("click model checkpoint is empty"))
+			return
+		}
+		if checkpoint.ClickModel.Invalid() {
+			server.BadRequest(response, errors.New("click model hasn't been trained"))
+			return
+		}
+		m.clickModelMutex.Lock()
+		m.ClickModelVersion = m.nextModelVersion(ClickModelCheckpoint, m.ClickModelVersion)
+		m.clickScore = checkpoint.ClickModelScore
+		m.ClickModel = checkpoint.ClickModel
+		version := m.ClickModelVersion
+		m.clickModelMutex.Unlock()
+		record := NewClickModelRecord(version, checkpoint.ClickModel, checkpoint.ClickModelScore, time.Time{})
+		record.Status = ModelLive
+		m.registerClickModel(record, checkpoint.ClickModel, checkpoint.ClickModelScore)
+		if m.localCache != nil {
+			m.localCache.ClickModelVersion = version
+			m.localCache.ClickModelScore = checkpoint.ClickModelScore
+			m.localCache.ClickModel = checkpoint.ClickModel
+		}
+	default:
+		server.BadRequest(response, fmt.Errorf("unknown model %s", name))
+		return
+	}
+	if m.localCache != nil {
+		if err := m.localCache.WriteLocalCache(); err != nil {
+			log.ResponseLogger(response).Error("failed to write local cache", zap.Error(err))
+		}
+	}
+	log.ResponseLogger(response).Info("import model", zap.String("name", name))
+	server.SetAudit(request, fmt.Sprintf("import model %v", name))
+	server.Ok(response, server.Success{RowAffected: 1})
+}
+
+// checkRankingModelCompatibility checks whether an imported ranking model could serve recommendations.
+func (m *Master) getModelRegistry(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	if name != RankingModelCheckpoint && name != ClickModelCheckpoint {
+		server.BadRequest(response, fmt.Errorf("unknown model %s", name))
+		return
+	}
+	if m.registry == nil {
+		server.PageNotFound(response, errors.New("model registry isn't loaded"))
+		return
+	}
+	server.Ok(response, m.registry.List(name))
+}
+
+func (m *Master) getModelFeatures(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("id")
+	if m.registry == nil {
+		server.PageNotFound(response, errors.New("model registry isn't loaded"))
+		return
+	}
+	record, err := m.registry.Get(ClickModelCheckpoint, id)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	if record.Features == nil {
+		server.PageNotFound(response, errors.NotFoundf("feature importance of click model %s", id))
+		return
+	}
+	server.Ok(response, record.Features)
+}
+
+func (m *Master) promoteModel(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	id := request.PathParameter("id")
+	if err := m.PromoteModel(name, id); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else if errors.Is(err, errors.NotValid) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	server.SetAudit(request, fmt.Sprintf("promote %v model %v", name, id))
+	server.Ok(response, server.Success{RowAffected: 1})
+}
+
+func (m *Master) rollbackModel(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	record, err := m.RollbackModel(name)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			server.PageNotFound(response, err)
+		} else if errors.Is(err, errors.NotValid) {
+			server.BadRequest(response, err)
+		} else {
+			server.InternalServerError(response, err)
+		}
+		return
+	}
+	server.SetAudit(request, fmt.Sprintf("roll back %v model to %v", name, record.ID))
+	server.Ok(response, record)
+}
+
+func checkRankingModelCompatibility(name string, model ranking.MatrixFactorization) error {
+	if model.Invalid() {
+		return errors.New("ranking model hasn't been trained")
+	}
+	if actualName := ranking.GetModelName(model); actualName != name {
+		return errors.NotValidf("ranking model %s (got %s model)", name, actualName)
+	}
+	if model.GetUserIndex() == nil || model.GetItemIndex() == nil {
+		return errors.NotValidf("ranking model without user or item index")
+	}
+	return nil
+}
+
 func (m *Master) importExportUsers(response http.ResponseWriter, request *http.Request) {
 	if !m.checkLogin(request) {
 		resp := restful.NewResponse(response)
@@ -821,6 +1657,9 @@ func (m *Master) importExportUsers(response http.ResponseWriter, request *http.R
 			return
 		}
 	case http.MethodPost:
+		if m.RejectReadOnly(restful.NewResponse(response)) {
+			return
+		}
 		hasHeader := formValue(request, "has-header", "true") == "true"
 		sep := formValue(request, "sep", ",")
 		// field separator must be a single character
@@ -903,6 +1742,8 @@ func (m *Master) importUsers(response http.ResponseWriter, file io.Reader, hasHe
 	log.Logger().Info("complete import users",
 		zap.Duration("time_used", timeUsed),
 		zap.Int("num_users", lineCount))
+	m.AddUsage(server.UsageIngestedUsers, lineCount)
+	m.auditDashboard("POST /api/bulk/users", fmt.Sprintf("import %d users", lineCount))
 	server.Ok(restful.NewResponse(response), server.Success{RowAffected: lineCount})
 }
 
@@ -943,6 +1784,9 @@ func (m *Master) importExportItems(response http.ResponseWriter, request *http.R
 			return
 		}
 	case http.MethodPost:
+		if m.RejectReadOnly(restful.NewResponse(response)) {
+			return
+		}
 		hasHeader := formValue(request, "has-header", "true") == "true"
 		sep := formValue(request, "sep", ",")
 		// field separator must be a single character
@@ -1058,6 +1902,8 @@ func (m *Master) importItems(response http.ResponseWriter, file io.Reader, hasHe
 	log.Logger().Info("complete import items",
 		zap.Duration("time_used", timeUsed),
 		zap.Int("num_items", lineCount))
+	m.AddUsage(server.UsageIngestedItems, lineCount)
+	m.auditDashboard("POST /api/bulk/items", fmt.Sprintf("import %d items", lineCount))
 	server.Ok(restful.NewResponse(response), server.Success{RowAffected: lineCount})
 }
 
@@ -1106,7 +1952,7 @@ func (m *Master) importExportFeedback(response http.ResponseWriter, request *htt
 		response.Header().Set("Content-Type", "text/csv")
 		response.Header().Set("Content-Disposition", "attachment;filename=feedback.csv")
 		// write header
-		if _, err = response.Write([]byte("feedback_type,user_id,item_id,time_stamp\r\n")); err != nil {
+		if _, err = response.Write([]byte("feedback_type,user_id,item_id,time_stamp,context\r\n")); err != nil {
 			server.InternalServerError(restful.NewResponse(response), err)
 			return
 		}
@@ -1114,8 +1960,15 @@ func (m *Master) importExportFeedback(response http.ResponseWriter, request *htt
 		feedbackChan, errChan := m.DataClient.GetFeedbackStream(batchSize, nil)
 		for feedback := range feedbackChan {
 			for _, v := range feedback {
-				if _, err = response.Write([]byte(fmt.Sprintf("%s,%s,%s,%v\r\n",
-					base.Escape(v.FeedbackType), base.Escape(v.UserId), base.Escape(v.ItemId), v.Timestamp))); err != nil {
+				var feedbackContext []byte
+				if len(v.Context) > 0 {
+					if feedbackContext, err = json.Marshal(v.Context); err != nil {
+						server.InternalServerError(restful.NewResponse(response), err)
+						return
+					}
+				}
+				if _, err = response.Write([]byte(fmt.Sprintf("%s,%s,%s,%v,%s\r\n",
+					base.Escape(v.FeedbackType), base.Escape(v.UserId), base.Escape(v.ItemId), v.Timestamp, base.Escape(string(feedbackContext))))); err != nil {
 					server.InternalServerError(restful.NewResponse(response), err)
 					return
 				}
@@ -1126,6 +1979,9 @@ func (m *Master) importExportFeedback(response http.ResponseWriter, request *htt
 			return
 		}
 	case http.MethodPost:
+		if m.RejectReadOnly(restful.NewResponse(response)) {
+			return
+		}
 		hasHeader := formValue(request, "has-header", "true") == "true"
 		sep := formValue(request, "sep", ",")
 		// field separator must be a single character
@@ -1230,6 +2086,8 @@ func (m *Master) importFeedback(response http.ResponseWriter, file io.Reader, ha
 	log.Logger().Info("complete import feedback",
 		zap.Duration("time_used", timeUsed),
 		zap.Int("num_items", lineCount))
+	m.AddUsage(server.UsageIngestedFeedback, lineCount)
+	m.auditDashboard("POST /api/bulk/feedback", fmt.Sprintf("import %d feedback", lineCount))
 	server.Ok(restful.NewResponse(response), server.Success{RowAffected: lineCount})
 }
 
@@ -1260,6 +2118,9 @@ func (m *Master) purge(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 	// purge data
+	if m.RejectReadOnly(restful.NewResponse(response)) {
+		return
+	}
 	if err := m.DataClient.Purge(); err != nil {
 		writeError(response, http.StatusInternalServerError, err.Error())
 		return
@@ -1268,6 +2129,14 @@ func (m *Master) purge(response http.ResponseWriter, request *http.Request) {
 		writeError(response, http.StatusInternalServerError, err.Error())
 		return
 	}
+	m.auditDashboard("POST /api/purge", "purge all data")
+}
+
+// auditDashboard writes the audit log of a mutating call from the dashboard, which isn't served by restful routes.
+func (m *Master) auditDashboard(endpoint, summary string) {
+	if m.AuditLogger != nil {
+		m.AuditLogger.Log(server.DashboardActor(m.Config.Master.DashboardUserName), endpoint, summary, nil)
+	}
 }
 
 func writeError(response http.ResponseWriter, httpStatus int, message string) {
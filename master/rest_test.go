@@ -23,12 +23,16 @@ import (
 	"github.com/samber/lo"
 	"github.com/steinfletcher/apitest"
 	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/config"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
 	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/blob"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
+	"io"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -63,6 +67,8 @@ func newMockServer(t *testing.T) (*mockServer, string) {
 	s.Config = config.GetDefaultConfig()
 	s.RestServer.HiddenItemsManager = server.NewHiddenItemsManager(&s.RestServer)
 	s.RestServer.PopularItemsCache = server.NewPopularItemsCache(&s.RestServer)
+	s.RestServer.RulesManager = server.NewRulesManager(&s.RestServer)
+	s.RestServer.QuotaManager = server.NewQuotaManager(&s.RestServer)
 	s.WebService = new(restful.WebService)
 	s.CreateWebService()
 	// create handler
@@ -92,6 +98,15 @@ func marshal(t *testing.T, v interface{}) string {
 	return string(s)
 }
 
+// withoutCreatedAt checks that items have creation time and clears it for comparison.
+func withoutCreatedAt(t *testing.T, items []data.Item) []data.Item {
+	for i := range items {
+		assert.False(t, items[i].CreatedAt.IsZero(), items[i].ItemId)
+		items[i].CreatedAt = time.Time{}
+	}
+	return items
+}
+
 func TestMaster_ExportUsers(t *testing.T) {
 	s, cookie := newMockServer(t)
 	defer s.Close(t)
@@ -122,9 +137,9 @@ func TestMaster_ExportItems(t *testing.T) {
 	defer s.Close(t)
 	// insert items
 	items := []data.Item{
-		{"1", false, []string{"x"}, time.Date(2020, 1, 1, 1, 1, 1, 1, time.UTC), []string{"a", "b"}, "o,n,e"},
-		{"2", false, []string{"x", "y"}, time.Date(2021, 1, 1, 1, 1, 1, 1, time.UTC), []string{"b", "c"}, "t\r\nw\r\no"},
-		{"3", true, nil, time.Date(2022, 1, 1, 1, 1, 1, 1, time.UTC), nil, "\"three\""},
+		{"1", false, []string{"x"}, time.Date(2020, 1, 1, 1, 1, 1, 1, time.UTC), []string{"a", "b"}, "o,n,e", nil, nil, "", time.Time{}},
+		{"2", false, []string{"x", "y"}, time.Date(2021, 1, 1, 1, 1, 1, 1, time.UTC), []string{"b", "c"}, "t\r\nw\r\no", nil, nil, "", time.Time{}},
+		{"3", true, nil, time.Date(2022, 1, 1, 1, 1, 1, 1, time.UTC), nil, "\"three\"", nil, nil, "", time.Time{}},
 	}
 	err := s.DataClient.BatchInsertItems(items)
 	assert.NoError(t, err)
@@ -147,7 +162,7 @@ func TestMaster_ExportFeedback(t *testing.T) {
 	defer s.Close(t)
 	// insert feedback
 	feedbacks := []data.Feedback{
-		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "2"}},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "2"}, Context: map[string]string{"device": "mobile"}},
 		{FeedbackKey: data.FeedbackKey{FeedbackType: "share", UserId: "1", ItemId: "4"}},
 		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "2", ItemId: "6"}},
 	}
@@ -161,10 +176,10 @@ func TestMaster_ExportFeedback(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
 	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
 	assert.Equal(t, "attachment;filename=feedback.csv", w.Header().Get("Content-Disposition"))
-	assert.Equal(t, "feedback_type,user_id,item_id,time_stamp\r\n"+
-		"click,0,2,0001-01-01 00:00:00 +0000 UTC\r\n"+
-		"read,2,6,0001-01-01 00:00:00 +0000 UTC\r\n"+
-		"share,1,4,0001-01-01 00:00:00 +0000 UTC\r\n", w.Body.String())
+	assert.Equal(t, "feedback_type,user_id,item_id,time_stamp,context\r\n"+
+		"click,0,2,0001-01-01 00:00:00 +0000 UTC,\"{\"\"device\"\":\"\"mobile\"\"}\"\r\n"+
+		"read,2,6,0001-01-01 00:00:00 +0000 UTC,\r\n"+
+		"share,1,4,0001-01-01 00:00:00 +0000 UTC,\r\n", w.Body.String())
 }
 
 func TestMaster_ImportUsers(t *testing.T) {
@@ -271,10 +286,10 @@ func TestMaster_ImportItems(t *testing.T) {
 	_, items, err := s.DataClient.GetItems("", 100, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, []data.Item{
-		{"1", false, []string{"x"}, time.Date(2020, 1, 1, 1, 1, 1, 1, time.UTC), []string{"a", "b"}, "o,n,e"},
-		{"2", false, []string{"x", "y"}, time.Date(2021, 1, 1, 1, 1, 1, 1, time.UTC), []string{"b", "c"}, "t\r\nw\r\no"},
-		{"3", true, nil, time.Date(2022, 1, 1, 1, 1, 1, 1, time.UTC), []string{"c", "d"}, "\"three\""},
-	}, items)
+		{"1", false, []string{"x"}, time.Date(2020, 1, 1, 1, 1, 1, 1, time.UTC), []string{"a", "b"}, "o,n,e", nil, nil, "", time.Time{}},
+		{"2", false, []string{"x", "y"}, time.Date(2021, 1, 1, 1, 1, 1, 1, time.UTC), []string{"b", "c"}, "t\r\nw\r\no", nil, nil, "", time.Time{}},
+		{"3", true, nil, time.Date(2022, 1, 1, 1, 1, 1, 1, time.UTC), []string{"c", "d"}, "\"three\"", nil, nil, "", time.Time{}},
+	}, withoutCreatedAt(t, items))
 }
 
 func TestMaster_ImportItems_DefaultFormat(t *testing.T) {
@@ -303,10 +318,10 @@ func TestMaster_ImportItems_DefaultFormat(t *testing.T) {
 	_, items, err := s.DataClient.GetItems("", 100, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, []data.Item{
-		{"1", false, []string{"x"}, time.Date(2020, 1, 1, 1, 1, 1, 1, time.UTC), []string{"a", "b"}, "one"},
-		{"2", false, []string{"x", "y"}, time.Date(2021, 1, 1, 1, 1, 1, 1, time.UTC), []string{"b", "c"}, "two"},
-		{"3", true, nil, time.Date(2022, 1, 1, 1, 1, 1, 1, time.UTC), nil, "three"},
-	}, items)
+		{"1", false, []string{"x"}, time.Date(2020, 1, 1, 1, 1, 1, 1, time.UTC), []string{"a", "b"}, "one", nil, nil, "", time.Time{}},
+		{"2", false, []string{"x", "y"}, time.Date(2021, 1, 1, 1, 1, 1, 1, time.UTC), []string{"b", "c"}, "two", nil, nil, "", time.Time{}},
+		{"3", true, nil, time.Date(2022, 1, 1, 1, 1, 1, 1, time.UTC), nil, "three", nil, nil, "", time.Time{}},
+	}, withoutCreatedAt(t, items))
 }
 
 func TestMaster_ImportFeedback(t *testing.T) {
@@ -431,6 +446,46 @@ func TestMaster_GetStats(t *testing.T) {
 		End()
 }
 
+func TestMaster_GetQuota(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.Quota.MaxUsers = 4
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0"}, {UserId: "1"}, {UserId: "2"}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{{ItemId: "0"}})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/quota").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, server.QuotaState{
+			Users:        server.QuotaUsage{Count: 3, Limit: 4, Ratio: 0.75},
+			Items:        server.QuotaUsage{Count: 1},
+			WarningRatio: 0.9,
+		})).
+		End()
+}
+
+func TestMaster_GetEnrichment(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	err := s.CacheClient.AddSorted(
+		cache.Sorted(cache.Key(cache.ItemEnrichment, server.EnrichmentPending), []cache.Scored{{Id: "1"}}),
+		cache.Sorted(cache.Key(cache.ItemEnrichment, server.EnrichmentEnriched), []cache.Scored{{Id: "2"}, {Id: "3"}}),
+		cache.Sorted(cache.Key(cache.ItemEnrichment, server.EnrichmentFailed), []cache.Scored{{Id: "4"}}))
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/enrichment").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, server.EnrichmentCounts{Pending: 1, Enriched: 2, Failed: 1})).
+		End()
+}
+
 func TestMaster_GetRates(t *testing.T) {
 	s, cookie := newMockServer(t)
 	defer s.Close(t)
@@ -475,6 +530,261 @@ func TestMaster_GetRates(t *testing.T) {
 		End()
 }
 
+func TestMaster_GetEvaluations(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+
+	// write reports
+	reports := []EvaluationReport{
+		{
+			Timestamp:        time.Date(2000, 1, 2, 1, 1, 1, 0, time.UTC),
+			ModelName:        "ccd",
+			NumTrainFeedback: 80,
+			NumTestFeedback:  20,
+			Scores:           []ranking.TopNScore{{N: 10, Precision: 0.2, Recall: 0.3, NDCG: 0.4, MAP: 0.5, Coverage: 0.6, IntraListDiversity: 0.7}},
+		},
+		{
+			Timestamp:        time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC),
+			ModelName:        "bpr",
+			NumTrainFeedback: 80,
+			NumTestFeedback:  20,
+			Scores:           []ranking.TopNScore{{N: 10, Precision: 0.1, Recall: 0.2, NDCG: 0.3, MAP: 0.4, Coverage: 0.5, IntraListDiversity: 0.6}},
+		},
+	}
+	for _, report := range reports {
+		err := s.saveEvaluationReport(report)
+		assert.NoError(t, err)
+	}
+
+	// get reports
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/evaluations").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, reports)).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/evaluations").
+		Header("Cookie", cookie).
+		QueryParams(map[string]string{"n": "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, reports[:1])).
+		End()
+}
+
+func TestMaster_Duplicates(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertItemCanonicals([]data.ItemCanonical{
+		{ItemId: "1", CanonicalId: "0"},
+		{ItemId: "2", CanonicalId: "0"},
+		{ItemId: "4", CanonicalId: "3"},
+	})
+	assert.NoError(t, err)
+
+	// list clusters
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/duplicates").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []DuplicateCluster{
+			{CanonicalId: "0", ItemIds: []string{"1", "2"}},
+			{CanonicalId: "3", ItemIds: []string{"4"}},
+		})).
+		End()
+
+	// break a cluster
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/dashboard/duplicates/0").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected":2}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/duplicates").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []DuplicateCluster{{CanonicalId: "3", ItemIds: []string{"4"}}})).
+		End()
+	breaks, err := s.CacheClient.GetSet(cache.DedupBreaks)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"0", "1", "2"}, breaks)
+}
+
+func TestMaster_RefreshItem(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.taskMonitor = task.NewTaskMonitor()
+	s.Config.Master.MaxRefreshPerMinute = 3
+	s.Config.Recommend.ItemNeighbors.NeighborType = config.NeighborTypeSimilar
+	// dataset not loaded
+	err := s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "0", Labels: []string{"a", "b"}, Categories: []string{"x"}},
+		{ItemId: "1", Labels: []string{"a", "b"}},
+		{ItemId: "2", Labels: []string{"a"}},
+		{ItemId: "3"},
+		{ItemId: "4", Labels: []string{"d"}},
+		{ItemId: "5", Labels: []string{"d"}},
+	})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/refresh/item/3").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	// refresh an item with fixed labels
+	s.rankingTrainSet, s.clickTrainSet, _, _, _, err = s.LoadDataFromDatabase(s.DataClient, []string{"positive"}, nil, nil, 0, 0, NewOnlineEvaluator())
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{{ItemId: "3", Labels: []string{"a", "b", "c"}, Categories: []string{"x"}}})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/refresh/item/3").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var refresh ItemRefresh
+			err := json.NewDecoder(response.Body).Decode(&refresh)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"x"}, refresh.Categories)
+			assert.Len(t, refresh.Neighbors[""], 3)
+			assert.ElementsMatch(t, []string{"0", "1"}, cache.RemoveScores(refresh.Neighbors[""][:2]))
+			assert.Equal(t, "2", refresh.Neighbors[""][2].Id)
+			assert.Equal(t, []string{"0"}, cache.RemoveScores(refresh.Neighbors["x"]))
+			return nil
+		}).
+		End()
+	neighbors, err := s.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "3"), 0, -1)
+	assert.NoError(t, err)
+	assert.Len(t, neighbors, 3)
+	categories, err := s.CacheClient.GetSet(cache.Key(cache.ItemNeighborCategories, "3"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, categories)
+
+	// refresh a missing item
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/refresh/item/9").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	// refresh too many times
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/refresh/item/3").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusTooManyRequests).
+		End()
+}
+
+func TestMaster_RefreshUser(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0"}})
+	assert.NoError(t, err)
+	// simulate a worker draining the priority refresh queue
+	go func() {
+		for {
+			queue, err := s.CacheClient.GetSortedByScore(cache.PriorityRefreshUsers, math.Inf(-1), math.Inf(1))
+			if err == nil && len(queue) > 0 {
+				err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{Id: "1", Score: 1}})
+				assert.NoError(t, err)
+				err = s.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), time.Now()))
+				assert.NoError(t, err)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/refresh/user/0").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, UserRefresh{UserId: "0", Refreshed: true, Recommend: []cache.Scored{{Id: "1", Score: 1}}})).
+		End()
+
+	// refresh a missing user
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/refresh/user/1").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	// refresh without the priority refresh queue
+	s.Config.Recommend.Offline.PriorityRefreshQueueSize = 0
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/refresh/user/0").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestMaster_LookupDigest(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0"}, {UserId: "1"}})
+	assert.NoError(t, err)
+	// user ids aren't obfuscated
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/admin/digest/"+cache.DigestID("new", "1")).
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	s.Config.Database.IdObfuscationSecret = "new"
+	s.Config.Database.IdObfuscationPreviousSecret = "old"
+	for _, secret := range []string{"new", "old"} {
+		digest := cache.DigestID(secret, "1")
+		apitest.New().
+			Handler(s.handler).
+			Get("/api/admin/digest/"+digest).
+			Header("Cookie", cookie).
+			Expect(t).
+			Status(http.StatusOK).
+			Body(marshal(t, DigestLookup{Digest: digest, UserId: "1"})).
+			End()
+	}
+	// digest of a missing user
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/admin/digest/"+cache.DigestID("new", "2")).
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	// invalid digest
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/admin/digest/1").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
 func TestMaster_GetCategories(t *testing.T) {
 	s, cookie := newMockServer(t)
 	defer s.Close(t)
@@ -769,3 +1079,353 @@ func TestMaster_Purge(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Empty(t, feedbacks)
 }
+
+func TestMaster_ExportImportModel(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+
+	// export untrained model
+	req := httptest.NewRequest("GET", "https://example.com/api/admin/model/ranking/export", nil)
+	req.Header.Set("Cookie", cookie)
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// export trained model
+	dataset := ranking.NewMapIndexDataset()
+	for i := 0; i < 10; i++ {
+		dataset.AddFeedback(strconv.Itoa(i), strconv.Itoa(i), true)
+	}
+	trainSet, testSet := dataset.Split(0, 0)
+	bpr := ranking.NewBPR(nil)
+	bpr.Fit(trainSet, testSet, nil)
+	s.RankingModel = bpr
+	s.rankingModelName = "bpr"
+	s.RankingModelVersion = 123
+	s.rankingScore = ranking.Score{NDCG: 1}
+	req = httptest.NewRequest("GET", "https://example.com/api/admin/model/ranking/export", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	checkpoint := w.Body.Bytes()
+
+	// import model
+	s.RankingModel = ranking.NewBPR(nil)
+	s.rankingModelName = ""
+	s.RankingModelVersion = 0
+	s.rankingScore = ranking.Score{}
+	req = httptest.NewRequest("POST", "https://example.com/api/admin/model/ranking/import", bytes.NewReader(checkpoint))
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bpr", s.rankingModelName)
+	assert.Equal(t, int64(1), s.RankingModelVersion)
+	assert.Equal(t, ranking.Score{NDCG: 1}, s.rankingScore)
+	assert.Equal(t, bpr.UserFactor, s.RankingModel.(*ranking.BPR).UserFactor)
+	assert.Equal(t, bpr.GetUserIndex().GetNames(), s.RankingModel.GetUserIndex().GetNames())
+
+	// import ranking model as click model
+	req = httptest.NewRequest("POST", "https://example.com/api/admin/model/click/import", bytes.NewReader(checkpoint))
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// import unknown model
+	req = httptest.NewRequest("POST", "https://example.com/api/admin/model/unknown/import", bytes.NewReader(checkpoint))
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// import model of mismatched name
+	buf := bytes.NewBuffer(nil)
+	err := (&LocalCache{RankingModelName: "ccd", RankingModel: bpr}).WriteRankingModel(buf)
+	assert.NoError(t, err)
+	req = httptest.NewRequest("POST", "https://example.com/api/admin/model/ranking/import", buf)
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, int64(1), s.RankingModelVersion)
+
+	// import too large checkpoint
+	maxCheckpointBytes = int64(len(checkpoint) / 2)
+	defer func() { maxCheckpointBytes = 1 << 30 }()
+	req = httptest.NewRequest("POST", "https://example.com/api/admin/model/ranking/import", bytes.NewReader(checkpoint))
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, int64(1), s.RankingModelVersion)
+}
+
+func TestMaster_ExportImportModel_Blob(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	dataset := ranking.NewMapIndexDataset()
+	for i := 0; i < 10; i++ {
+		dataset.AddFeedback(strconv.Itoa(i), strconv.Itoa(i), true)
+	}
+	trainSet, testSet := dataset.Split(0, 0)
+	bpr := ranking.NewBPR(nil)
+	bpr.Fit(trainSet, testSet, nil)
+	s.RankingModel = bpr
+	s.rankingModelName = "bpr"
+	s.RankingModelVersion = 123
+
+	// blob store isn't configured
+	req := httptest.NewRequest("GET", "https://example.com/api/admin/model/ranking/export?blob=models/ranking", nil)
+	req.Header.Set("Cookie", cookie)
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// export model to the blob store
+	store, err := blob.Open(t.TempDir())
+	assert.NoError(t, err)
+	s.blobStore = store
+	req = httptest.NewRequest("GET", "https://example.com/api/admin/model/ranking/export?blob=models/ranking", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	names, err := store.List("models/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"models/ranking"}, names)
+
+	// import model from the blob store
+	s.RankingModel = ranking.NewBPR(nil)
+	s.rankingModelName = ""
+	req = httptest.NewRequest("POST", "https://example.com/api/admin/model/ranking/import?blob=models/ranking", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bpr", s.rankingModelName)
+	assert.Equal(t, int64(124), s.RankingModelVersion)
+	assert.Equal(t, bpr.UserFactor, s.RankingModel.(*ranking.BPR).UserFactor)
+
+	// import missing blob
+	req = httptest.NewRequest("POST", "https://example.com/api/admin/model/ranking/import?blob=models/missing", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMaster_ExportModel_Forbidden(t *testing.T) {
+	s, _ := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Master.DashboardUserName = "admin"
+	s.Config.Master.DashboardPassword = "admin"
+	s.Config.Server.APIKey = "api_key"
+	s.Config.Server.AdminAPIKey = "admin_api_key"
+	req := httptest.NewRequest("GET", "https://example.com/api/admin/model/ranking/export", nil)
+	req.Header.Set("X-API-Key", "api_key")
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestMaster_CancelTask(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.taskMonitor = task.NewTaskMonitor()
+	s.taskMonitor.Pending(TaskFitRankingModel)
+	fitTask := s.taskMonitor.Start(TaskFindItemNeighbors, 100)
+	fitTask.Add(25)
+
+	// list tasks with progress
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/tasks").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var tasks []task.Task
+			if err := json.NewDecoder(response.Body).Decode(&tasks); err != nil {
+				return err
+			}
+			assert.Len(t, tasks, 2)
+			assert.Equal(t, TaskFindItemNeighbors, tasks[0].Name)
+			assert.Equal(t, 25.0, tasks[0].Progress)
+			return nil
+		}).
+		End()
+
+	// cancel tasks
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/"+TaskFindItemNeighbors+"/cancel").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected":1}`).
+		End()
+	assert.True(t, fitTask.Cancelled())
+	assert.Equal(t, task.StatusCancelled, s.taskMonitor.GetTask(TaskFindItemNeighbors).Status)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/"+TaskFindItemNeighbors+"/cancel").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/unknown/cancel").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestMaster_RunTask(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.taskMonitor = task.NewTaskMonitor()
+	// unknown stage
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/unknown/run").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusNotFound).
+		Assert(func(response *http.Response, request *http.Request) error {
+			body, err := io.ReadAll(response.Body)
+			assert.NoError(t, err)
+			assert.Contains(t, string(body), "find_item_neighbors, load_dataset, offline_recommend")
+			return nil
+		}).
+		End()
+	// dataset not loaded
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/find_item_neighbors/run").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	// request offline recommendation
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/offline_recommend/run").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, StageRun{Task: "Generate offline recommendation", Started: true})).
+		End()
+	requestTime, err := s.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.LastRequestOfflineRecommendTime)).Time()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), requestTime, time.Minute)
+	// offline recommendation is running on a worker
+	s.taskMonitor.Tasks[offlineRecommendTaskName+" [worker_1]"] = &task.Task{Name: offlineRecommendTaskName + " [worker_1]", Status: task.StatusRunning}
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/offline_recommend/run").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, StageRun{Task: "Generate offline recommendation", Started: false})).
+		End()
+	// running stages aren't started again
+	s.rankingTrainSet = ranking.NewMapIndexDataset()
+	s.jobsScheduler = task.NewJobsScheduler(1)
+	s.jobsScheduler.Register(TaskFitRankingModel, 0, true)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/train_ranking/run").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, StageRun{Task: TaskFitRankingModel, Started: false})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/tasks/refresh_popular/run").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, StageRun{Task: TaskLoadDataset, Started: false})).
+		End()
+}
+
+func TestMaster_GetAuditLogs(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	now := time.Now()
+	auditLogs := []data.AuditLog{
+		{Id: data.NewAuditLogId(now.Add(-2 * time.Second)), Timestamp: now.Add(-2 * time.Second), Actor: "dashboard/admin", Endpoint: "POST /api/purge", Summary: "purge all data"},
+		{Id: data.NewAuditLogId(now.Add(-time.Second)), Timestamp: now.Add(-time.Second), Actor: "anonymous", Endpoint: "DELETE /api/item/{item-id}", Entities: []string{"item/1"}, Summary: "delete an item"},
+		{Id: data.NewAuditLogId(now), Timestamp: now, Actor: "anonymous", Endpoint: "DELETE /api/item/{item-id}", Entities: []string{"item/2"}, Summary: "delete an item"},
+	}
+	err := s.DataClient.InsertAuditLogs(auditLogs)
+	assert.NoError(t, err)
+
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/audit").
+		Header("Cookie", cookie).
+		Query("n", "2").
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var iterator AuditLogIterator
+			if err := json.NewDecoder(response.Body).Decode(&iterator); err != nil {
+				return err
+			}
+			assert.Equal(t, auditLogs[0].Id, iterator.Cursor)
+			assert.Equal(t, []string{auditLogs[2].Id, auditLogs[1].Id}, lo.Map(iterator.AuditLogs, func(auditLog data.AuditLog, _ int) string {
+				return auditLog.Id
+			}))
+			return nil
+		}).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/audit").
+		Header("Cookie", cookie).
+		Query("entity", "item/1").
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var iterator AuditLogIterator
+			if err := json.NewDecoder(response.Body).Decode(&iterator); err != nil {
+				return err
+			}
+			assert.Empty(t, iterator.Cursor)
+			if assert.Len(t, iterator.AuditLogs, 1) {
+				assert.Equal(t, auditLogs[1].Id, iterator.AuditLogs[0].Id)
+			}
+			return nil
+		}).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/audit").
+		Header("Cookie", cookie).
+		Query("actor", "dashboard/admin").
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var iterator AuditLogIterator
+			if err := json.NewDecoder(response.Body).Decode(&iterator); err != nil {
+				return err
+			}
+			if assert.Len(t, iterator.AuditLogs, 1) {
+				assert.Equal(t, "purge all data", iterator.AuditLogs[0].Summary)
+			}
+			return nil
+		}).
+		End()
+}
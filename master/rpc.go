@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"github.com/juju/errors"
 	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
 	"github.com/zhenghaoz/gorse/protocol"
@@ -118,12 +119,15 @@ func (m *Master) GetMeta(ctx context.Context, nodeInfo *protocol.NodeInfo) (*pro
 func (m *Master) GetRankingModel(version *protocol.VersionInfo, sender protocol.Master_GetRankingModelServer) error {
 	m.rankingModelMutex.RLock()
 	defer m.rankingModelMutex.RUnlock()
-	// skip empty model
-	if m.RankingModel == nil || m.RankingModel.Invalid() {
+	rankingModel := m.RankingModel
+	if m.canaryRankingModel != nil && m.canaryRankingModelVersion == version.Version {
+		// canary model is requested
+		rankingModel = m.canaryRankingModel
+	} else if m.RankingModel == nil || m.RankingModel.Invalid() {
+		// skip empty model
 		return errors.New("no valid model found")
-	}
-	// check model version
-	if m.RankingModelVersion != version.Version {
+	} else if m.RankingModelVersion != version.Version {
+		// check model version
 		return errors.New("model version mismatch")
 	}
 	// encode model
@@ -136,7 +140,7 @@ func (m *Master) GetRankingModel(version *protocol.VersionInfo, sender protocol.
 				log.Logger().Error("fail to close pipe", zap.Error(err))
 			}
 		}(writer)
-		err := ranking.MarshalModel(writer, m.RankingModel)
+		err := ranking.MarshalModel(writer, rankingModel)
 		if err != nil {
 			log.Logger().Error("fail to marshal ranking model", zap.Error(err))
 			encoderError = err
@@ -216,8 +220,11 @@ func (m *Master) nodeUp(key string, value interface{}) {
 		zap.String("node_ip", node.IP),
 		zap.String("node_type", node.Type))
 	m.nodesInfoMutex.Lock()
-	defer m.nodesInfoMutex.Unlock()
 	m.nodesInfo[key] = node
+	m.nodesInfoMutex.Unlock()
+	if node.Type == WorkerNode {
+		go m.rebalanceShards()
+	}
 }
 
 // nodeDown handles node information timout events.
@@ -228,8 +235,11 @@ func (m *Master) nodeDown(key string, value interface{}) {
 		zap.String("node_ip", node.IP),
 		zap.String("node_type", node.Type))
 	m.nodesInfoMutex.Lock()
-	defer m.nodesInfoMutex.Unlock()
 	delete(m.nodesInfo, key)
+	m.nodesInfoMutex.Unlock()
+	if node.Type == WorkerNode {
+		go m.rebalanceShards()
+	}
 }
 
 func (m *Master) PushTaskInfo(
@@ -237,6 +247,19 @@ func (m *Master) PushTaskInfo(
 	in *protocol.PushTaskInfoRequest) (*protocol.PushTaskInfoResponse, error) {
 	m.taskMonitor.TaskLock.Lock()
 	defer m.taskMonitor.TaskLock.Unlock()
-	m.taskMonitor.Tasks[in.GetName()] = protocol.DecodeTask(in)
+	t := protocol.DecodeTask(in)
+	// keep cancelled tasks cancelled until the worker stops them
+	if previous, exist := m.taskMonitor.Tasks[in.GetName()]; exist && previous.Status == task.StatusCancelled &&
+		(t.Status == task.StatusRunning || t.Status == task.StatusSuspended) {
+		previous.Done, previous.Total, previous.Progress = t.Done, t.Total, t.Progress
+		return &protocol.PushTaskInfoResponse{Cancel: true}, nil
+	}
+	// notify webhooks once tasks of workers are done
+	if previous, exist := m.taskMonitor.Tasks[in.GetName()]; (t.Status == task.StatusComplete || t.Status == task.StatusFailed) &&
+		(!exist || previous.Status != t.Status) {
+		m.notifyTaskDone(*t)
+	}
+	m.taskMonitor.Tasks[in.GetName()] = t
+	m.updateShard(t)
 	return &protocol.PushTaskInfoResponse{}, nil
 }
@@ -0,0 +1,211 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"sort"
+	"time"
+
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+// sampledFeedback is a piece of positive feedback waiting to be sampled.
+type sampledFeedback struct {
+	userIndex int32
+	itemIndex int32
+	weight    float32
+	timestamp time.Time
+	priority  uint64
+}
+
+// feedbackSampler samples positive feedback streamed from the database. Feedback older than the cutoff is kept at the
+// sample rate, then the latest feedback of each user is kept, and finally feedback is reservoir sampled if there is too
+// much feedback. Feedback is sampled by hashes of feedback keys instead of random numbers, so that the same feedback is
+// sampled under the same seed no matter in which order feedback is streamed.
+//
+// Buffers are truncated lazily once they grow twice as large as limits, so that memory is bounded by limits.
+type feedbackSampler struct {
+	maxPerUser int
+	cutoff     time.Time
+	rate       float64
+	maxTotal   int
+	seed       int64
+	emit       func(f sampledFeedback)
+
+	users     [][]sampledFeedback
+	reservoir []sampledFeedback
+
+	numStreamed     int
+	numRateDropped  int
+	numUserDropped  int
+	numTotalDropped int
+}
+
+func newFeedbackSampler(cfg config.SamplingConfig, seed int64, numUsers int, now time.Time, emit func(f sampledFeedback)) *feedbackSampler {
+	s := &feedbackSampler{
+		maxPerUser: cfg.MaxFeedbackPerUser,
+		rate:       cfg.SampleRate,
+		maxTotal:   cfg.MaxFeedback,
+		seed:       seed,
+		emit:       emit,
+	}
+	if cfg.SampleCutoff > 0 && cfg.SampleRate < 1 {
+		s.cutoff = now.Add(-cfg.SampleCutoff)
+	}
+	if s.maxPerUser > 0 {
+		s.users = make([][]sampledFeedback, numUsers)
+	}
+	return s
+}
+
+// Enabled returns true if any feedback might be dropped.
+func (s *feedbackSampler) Enabled() bool {
+	return s.maxPerUser > 0 || s.maxTotal > 0 || !s.cutoff.IsZero()
+}
+
+// Add samples a piece of feedback. Feedback is emitted at once if it is buffered by no limit.
+func (s *feedbackSampler) Add(f data.Feedback, userIndex, itemIndex int32, weight float32) {
+	s.numStreamed++
+	key := feedbackHash(s.seed, f.FeedbackType, f.UserId, f.ItemId)
+	if !s.cutoff.IsZero() && f.Timestamp.Before(s.cutoff) && hashToFloat(key) >= s.rate {
+		s.numRateDropped++
+		return
+	}
+	// the priority in the reservoir is independent of the hash used by the sample rate
+	sampled := sampledFeedback{
+		userIndex: userIndex,
+		itemIndex: itemIndex,
+		weight:    weight,
+		timestamp: f.Timestamp,
+		priority:  mixHash(key + 0x9e3779b97f4a7c15),
+	}
+	if s.maxPerUser > 0 {
+		s.users[userIndex] = append(s.users[userIndex], sampled)
+		if len(s.users[userIndex]) > 2*s.maxPerUser {
+			s.users[userIndex] = s.truncateUser(s.users[userIndex])
+		}
+	} else if s.maxTotal > 0 {
+		s.addReservoir(sampled)
+	} else {
+		s.emit(sampled)
+	}
+}
+
+// Flush emits buffered feedback. Feedback is emitted by users and then by timestamps.
+func (s *feedbackSampler) Flush() {
+	for userIndex, feedback := range s.users {
+		feedback = s.truncateUser(feedback)
+		s.users[userIndex] = nil
+		if s.maxTotal > 0 {
+			for _, f := range feedback {
+				s.addReservoir(f)
+			}
+		} else {
+			sortSampledFeedback(feedback)
+			for _, f := range feedback {
+				s.emit(f)
+			}
+		}
+	}
+	if s.maxTotal > 0 {
+		s.reservoir = s.truncateReservoir(s.reservoir)
+		sortSampledFeedback(s.reservoir)
+		for _, f := range s.reservoir {
+			s.emit(f)
+		}
+		s.reservoir = nil
+	}
+}
+
+// truncateUser keeps the latest feedback of a user.
+func (s *feedbackSampler) truncateUser(feedback []sampledFeedback) []sampledFeedback {
+	if len(feedback) <= s.maxPerUser {
+		return feedback
+	}
+	sort.Slice(feedback, func(i, j int) bool {
+		if !feedback[i].timestamp.Equal(feedback[j].timestamp) {
+			return feedback[i].timestamp.After(feedback[j].timestamp)
+		}
+		return feedback[i].priority < feedback[j].priority
+	})
+	s.numUserDropped += len(feedback) - s.maxPerUser
+	return feedback[:s.maxPerUser]
+}
+
+func (s *feedbackSampler) addReservoir(f sampledFeedback) {
+	s.reservoir = append(s.reservoir, f)
+	if len(s.reservoir) > 2*s.maxTotal {
+		s.reservoir = s.truncateReservoir(s.reservoir)
+	}
+}
+
+// truncateReservoir keeps feedback of the smallest priorities, which is a uniform sample of feedback.
+func (s *feedbackSampler) truncateReservoir(feedback []sampledFeedback) []sampledFeedback {
+	if len(feedback) <= s.maxTotal {
+		return feedback
+	}
+	sort.Slice(feedback, func(i, j int) bool {
+		return feedback[i].priority < feedback[j].priority
+	})
+	s.numTotalDropped += len(feedback) - s.maxTotal
+	// copy kept feedback to release the rest of the buffer
+	return append([]sampledFeedback(nil), feedback[:s.maxTotal]...)
+}
+
+// sortSampledFeedback sorts feedback by users and then by timestamps, so that emitted feedback is deterministic.
+func sortSampledFeedback(feedback []sampledFeedback) {
+	sort.Slice(feedback, func(i, j int) bool {
+		if feedback[i].userIndex != feedback[j].userIndex {
+			return feedback[i].userIndex < feedback[j].userIndex
+		}
+		if !feedback[i].timestamp.Equal(feedback[j].timestamp) {
+			return feedback[i].timestamp.Before(feedback[j].timestamp)
+		}
+		return feedback[i].priority < feedback[j].priority
+	})
+}
+
+// feedbackHash returns the seeded FNV-1a hash of a feedback key.
+func feedbackHash(seed int64, feedbackType, userId, itemId string) uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h = (h ^ uint64(byte(seed>>(8*i)))) * prime
+	}
+	for _, s := range []string{feedbackType, userId, itemId} {
+		for i := 0; i < len(s); i++ {
+			h = (h ^ uint64(s[i])) * prime
+		}
+		// separate fields, so that ("ab", "c") and ("a", "bc") are different
+		h = (h ^ 0xff) * prime
+	}
+	return mixHash(h)
+}
+
+// mixHash is the finalizer of SplitMix64, which spreads bits of a hash uniformly.
+func mixHash(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// hashToFloat maps a hash to [0, 1).
+func hashToFloat(h uint64) float64 {
+	return float64(h>>11) / (1 << 53)
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+// syntheticFeedback generates feedback of each user to items at each hour before now.
+func syntheticFeedback(numUsers, numItems int, now time.Time) []data.Feedback {
+	var feedback []data.Feedback
+	for i := 0; i < numUsers; i++ {
+		for j := 0; j < numItems; j++ {
+			feedback = append(feedback, data.Feedback{FeedbackKey: data.FeedbackKey{
+				FeedbackType: "star",
+				UserId:       strconv.Itoa(i),
+				ItemId:       strconv.Itoa(j),
+			}, Timestamp: now.Add(-time.Duration(j) * time.Hour)})
+		}
+	}
+	return feedback
+}
+
+func sampleFeedback(cfg config.SamplingConfig, seed int64, numUsers int, now time.Time, feedback []data.Feedback) ([]sampledFeedback, *feedbackSampler) {
+	var sampled []sampledFeedback
+	sampler := newFeedbackSampler(cfg, seed, numUsers, now, func(f sampledFeedback) {
+		sampled = append(sampled, f)
+	})
+	for _, f := range feedback {
+		userIndex, _ := strconv.Atoi(f.UserId)
+		itemIndex, _ := strconv.Atoi(f.ItemId)
+		sampler.Add(f, int32(userIndex), int32(itemIndex), 1)
+	}
+	sampler.Flush()
+	return sampled, sampler
+}
+
+func TestFeedbackSampler_Disabled(t *testing.T) {
+	now := time.Now()
+	feedback := syntheticFeedback(10, 20, now)
+	sampled, sampler := sampleFeedback(config.SamplingConfig{SampleRate: 1}, 0, 10, now, feedback)
+	assert.False(t, sampler.Enabled())
+	assert.Len(t, sampled, len(feedback))
+}
+
+func TestFeedbackSampler_MaxFeedbackPerUser(t *testing.T) {
+	now := time.Now()
+	feedback := syntheticFeedback(100, 50, now)
+	sampled, sampler := sampleFeedback(config.SamplingConfig{MaxFeedbackPerUser: 7, SampleRate: 1}, 0, 100, now, feedback)
+	assert.True(t, sampler.Enabled())
+	assert.Len(t, sampled, 700)
+	assert.Equal(t, 100*50-700, sampler.numUserDropped)
+	// the latest items are kept
+	counts := make(map[int32]int)
+	for _, f := range sampled {
+		counts[f.userIndex]++
+		assert.Less(t, f.itemIndex, int32(7))
+	}
+	for userIndex := int32(0); userIndex < 100; userIndex++ {
+		assert.Equal(t, 7, counts[userIndex])
+	}
+}
+
+func TestFeedbackSampler_SampleRate(t *testing.T) {
+	now := time.Now()
+	feedback := syntheticFeedback(100, 200, now)
+	cfg := config.SamplingConfig{SampleCutoff: 100 * time.Hour, SampleRate: 0.3}
+	sampled, sampler := sampleFeedback(cfg, 0, 100, now, feedback)
+	numRecent, numOld := 0, 0
+	for _, f := range sampled {
+		if f.timestamp.Before(now.Add(-100 * time.Hour)) {
+			numOld++
+		} else {
+			numRecent++
+		}
+	}
+	// recent feedback is kept
+	assert.Equal(t, 100*101, numRecent)
+	assert.InDelta(t, 0.3*100*99, numOld, 300)
+	assert.Equal(t, 100*99-numOld, sampler.numRateDropped)
+}
+
+func TestFeedbackSampler_MaxFeedback(t *testing.T) {
+	now := time.Now()
+	feedback := syntheticFeedback(100, 100, now)
+	sampled, sampler := sampleFeedback(config.SamplingConfig{MaxFeedback: 1234, SampleRate: 1}, 0, 100, now, feedback)
+	assert.Len(t, sampled, 1234)
+	assert.Equal(t, 100*100-1234, sampler.numTotalDropped)
+	// the reservoir never grows twice as large as the cap
+	assert.Nil(t, sampler.reservoir)
+	// feedback is sampled uniformly
+	counts := make(map[int32]int)
+	for _, f := range sampled {
+		counts[f.userIndex]++
+	}
+	for _, count := range counts {
+		assert.Less(t, count, 40)
+	}
+
+	// caps are applied together
+	sampled, _ = sampleFeedback(config.SamplingConfig{MaxFeedbackPerUser: 5, MaxFeedback: 300, SampleRate: 1}, 0, 100, now, feedback)
+	assert.Len(t, sampled, 300)
+	for _, f := range sampled {
+		assert.Less(t, f.itemIndex, int32(5))
+	}
+}
+
+func TestFeedbackSampler_Deterministic(t *testing.T) {
+	now := time.Now()
+	feedback := syntheticFeedback(100, 100, now)
+	cfg := config.SamplingConfig{MaxFeedbackPerUser: 50, SampleCutoff: 20 * time.Hour, SampleRate: 0.5, MaxFeedback: 2000}
+	expected, _ := sampleFeedback(cfg, 1, 100, now, feedback)
+	assert.Len(t, expected, 2000)
+	// the order of feedback doesn't matter
+	rand.New(rand.NewSource(0)).Shuffle(len(feedback), func(i, j int) {
+		feedback[i], feedback[j] = feedback[j], feedback[i]
+	})
+	actual, _ := sampleFeedback(cfg, 1, 100, now, feedback)
+	assert.Equal(t, expected, actual)
+	// the seed matters
+	actual, _ = sampleFeedback(cfg, 2, 100, now, feedback)
+	assert.NotEqual(t, expected, actual)
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+	"time"
+)
+
+// ShadowDiff compares shadow recommendation generated in dry-run mode with production recommendation.
+type ShadowDiff struct {
+	NumSampled      int     // number of sampled users
+	NumCompared     int     // number of sampled users having both production and shadow recommendation
+	N               int     // length of compared lists
+	OverlapAtN      float64 // mean fraction of shared items in top N
+	RankCorrelation float64 // mean Spearman's rank correlation of shared items
+	ChangedFraction float64 // fraction of top N lists changed
+}
+
+// GetShadowDiff samples users and compares their shadow recommendation with production recommendation.
+func (m *Master) GetShadowDiff(numSamples, n int) (ShadowDiff, error) {
+	diff := ShadowDiff{N: n}
+	// sample users
+	var userIds []string
+	m.rankingDataMutex.RLock()
+	if m.rankingTrainSet != nil {
+		rng := base.NewRandomGenerator(time.Now().UnixNano())
+		for _, userIndex := range rng.Sample(0, int(m.rankingTrainSet.UserIndex.Len()), numSamples) {
+			userIds = append(userIds, m.rankingTrainSet.UserIndex.ToName(int32(userIndex)))
+		}
+	}
+	m.rankingDataMutex.RUnlock()
+	diff.NumSampled = len(userIds)
+
+	// compare recommendation
+	cacheClient := m.CacheClient
+	if shadow, ok := cacheClient.(*cache.Shadow); ok {
+		cacheClient = shadow.Database
+	}
+	productionPrefix, err := cache.ProductionPrefix(cacheClient)
+	if err != nil {
+		return diff, errors.Trace(err)
+	}
+	productionCache := cache.NewShadow(cacheClient, productionPrefix)
+	shadowCache := cache.NewShadow(cacheClient, cache.CandidatePrefix(productionPrefix, m.Config.Recommend.Offline.ShadowPrefix))
+	var numCorrelated int
+	for _, userId := range userIds {
+		production, err := productionCache.GetSorted(cache.Key(cache.OfflineRecommend, userId), 0, n-1)
+		if err != nil {
+			return diff, errors.Trace(err)
+		}
+		candidate, err := shadowCache.GetSorted(cache.Key(cache.OfflineRecommend, userId), 0, n-1)
+		if err != nil {
+			return diff, errors.Trace(err)
+		}
+		if len(production) == 0 || len(candidate) == 0 {
+			continue
+		}
+		diff.NumCompared++
+		overlap, correlation, changed := compareRankings(cache.RemoveScores(production), cache.RemoveScores(candidate))
+		diff.OverlapAtN += overlap
+		if changed {
+			diff.ChangedFraction++
+		}
+		if correlation != nil {
+			diff.RankCorrelation += *correlation
+			numCorrelated++
+		}
+	}
+	if diff.NumCompared > 0 {
+		diff.OverlapAtN /= float64(diff.NumCompared)
+		diff.ChangedFraction /= float64(diff.NumCompared)
+	}
+	if numCorrelated > 0 {
+		diff.RankCorrelation /= float64(numCorrelated)
+	}
+	return diff, nil
+}
+
+// compareRankings returns the fraction of shared items, Spearman's rank correlation of shared items and whether two
+// rankings differ. The correlation is nil if less than two items are shared.
+func compareRankings(a, b []string) (float64, *float64, bool) {
+	changed := len(a) != len(b)
+	positions := make(map[string]int, len(b))
+	for i, item := range b {
+		positions[item] = i
+		if i < len(a) && a[i] != item {
+			changed = true
+		}
+	}
+	// ranks of shared items in both rankings
+	var ranksA, ranksB []int
+	for _, item := range a {
+		if position, exist := positions[item]; exist {
+			ranksA = append(ranksA, len(ranksA))
+			ranksB = append(ranksB, position)
+		}
+	}
+	overlap := float64(len(ranksA)) / float64(lo.Max([]int{len(a), len(b)}))
+	if len(ranksA) < 2 {
+		return overlap, nil, changed
+	}
+	// re-rank positions in b among shared items
+	order := make([]int, len(ranksB))
+	for i := range ranksB {
+		for j := range ranksB {
+			if ranksB[j] < ranksB[i] {
+				order[i]++
+			}
+		}
+	}
+	var sum float64
+	for i := range ranksA {
+		d := float64(ranksA[i] - order[i])
+		sum += d * d
+	}
+	k := float64(len(ranksA))
+	correlation := 1 - 6*sum/(k*(k*k-1))
+	return overlap, &correlation, changed
+}
+
+// PromoteShadow swaps shadow recommendation with production recommendation atomically by switching the production
+// prefix. Production recommendation becomes shadow recommendation, so that it could be restored by promoting again.
+// Servers and workers follow the production prefix at the next meta synchronization.
+func (m *Master) PromoteShadow() error {
+	prefix, err := cache.PromoteShadow(m.CacheClient, m.Config.Recommend.Offline.ShadowPrefix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Logger().Info("promote shadow recommendation to production", zap.String("production_prefix", prefix))
+	return nil
+}
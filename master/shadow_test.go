@@ -0,0 +1,141 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"encoding/json"
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"net/http"
+	"testing"
+)
+
+func TestCompareRankings(t *testing.T) {
+	// identical
+	overlap, correlation, changed := compareRankings([]string{"1", "2", "3"}, []string{"1", "2", "3"})
+	assert.Equal(t, 1.0, overlap)
+	assert.Equal(t, 1.0, *correlation)
+	assert.False(t, changed)
+	// reversed
+	overlap, correlation, changed = compareRankings([]string{"1", "2", "3"}, []string{"3", "2", "1"})
+	assert.Equal(t, 1.0, overlap)
+	assert.Equal(t, -1.0, *correlation)
+	assert.True(t, changed)
+	// partially overlapped
+	overlap, correlation, changed = compareRankings([]string{"1", "2", "3", "4"}, []string{"1", "5", "2", "6"})
+	assert.Equal(t, 0.5, overlap)
+	assert.Equal(t, 1.0, *correlation)
+	assert.True(t, changed)
+	// disjoint
+	overlap, correlation, changed = compareRankings([]string{"1", "2"}, []string{"3", "4"})
+	assert.Zero(t, overlap)
+	assert.Nil(t, correlation)
+	assert.True(t, changed)
+}
+
+func TestMaster_ShadowDiff(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.rankingTrainSet = ranking.NewMapIndexDataset()
+	for _, userId := range []string{"1", "2", "3"} {
+		s.rankingTrainSet.AddUser(userId)
+	}
+	shadow := cache.NewShadow(s.CacheClient, s.Config.Recommend.Offline.ShadowPrefix)
+	// unchanged
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "1"), []cache.Scored{{"1", 3}, {"2", 2}, {"3", 1}})
+	assert.NoError(t, err)
+	err = shadow.SetSorted(cache.Key(cache.OfflineRecommend, "1"), []cache.Scored{{"1", 3}, {"2", 2}, {"3", 1}})
+	assert.NoError(t, err)
+	// reversed
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "2"), []cache.Scored{{"1", 3}, {"2", 2}, {"3", 1}})
+	assert.NoError(t, err)
+	err = shadow.SetSorted(cache.Key(cache.OfflineRecommend, "2"), []cache.Scored{{"3", 3}, {"2", 2}, {"1", 1}})
+	assert.NoError(t, err)
+	// missing shadow recommendation
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "3"), []cache.Scored{{"1", 3}})
+	assert.NoError(t, err)
+
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/shadow-diff").
+		Query("sample", "10").
+		Query("n", "3").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var diff ShadowDiff
+			if err := json.NewDecoder(response.Body).Decode(&diff); err != nil {
+				return err
+			}
+			assert.Equal(t, 3, diff.NumSampled)
+			assert.Equal(t, 2, diff.NumCompared)
+			assert.Equal(t, 3, diff.N)
+			assert.Equal(t, 1.0, diff.OverlapAtN)
+			assert.Equal(t, 0.0, diff.RankCorrelation)
+			assert.Equal(t, 0.5, diff.ChangedFraction)
+			return nil
+		}).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/shadow-diff").
+		Query("sample", "0").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	// promote shadow recommendation
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/dashboard/shadow/promote").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	prefix, err := cache.ProductionPrefix(s.CacheClient)
+	assert.NoError(t, err)
+	assert.Equal(t, s.Config.Recommend.Offline.ShadowPrefix, prefix)
+	production := cache.NewShadow(s.CacheClient, prefix)
+	scores, err := production.GetSorted(cache.Key(cache.OfflineRecommend, "2"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"3", 3}, {"2", 2}, {"1", 1}}, scores)
+	scores, err = production.GetSorted(cache.Key(cache.OfflineRecommend, "3"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, scores)
+
+	// production recommendation is compared as shadow recommendation after promotion
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/shadow-diff").
+		Query("sample", "10").
+		Query("n", "3").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var diff ShadowDiff
+			if err := json.NewDecoder(response.Body).Decode(&diff); err != nil {
+				return err
+			}
+			assert.Equal(t, 2, diff.NumCompared)
+			assert.Equal(t, 0.5, diff.ChangedFraction)
+			return nil
+		}).
+		End()
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/server"
+)
+
+// ShadowTrafficReport summarizes the latest requests replayed against the secondary cluster.
+type ShadowTrafficReport struct {
+	NumReplayed      int                        // number of replayed requests
+	NumFailed        int                        // number of requests failed in the secondary cluster
+	MeanJaccard      float64                    // mean Jaccard overlap of returned ids
+	MeanLatencyDelta time.Duration              // mean latency of the secondary cluster minus latency of this cluster
+	Diffs            []server.ShadowTrafficDiff // latest differences
+}
+
+// GetShadowTrafficReport summarizes the latest n differences in the rolling log of shadow traffic.
+func (m *Master) GetShadowTrafficReport(n int) (ShadowTrafficReport, error) {
+	diffs, err := server.GetShadowTrafficDiffs(m.CacheClient, n)
+	if err != nil {
+		return ShadowTrafficReport{}, errors.Trace(err)
+	}
+	report := ShadowTrafficReport{NumReplayed: len(diffs), Diffs: diffs}
+	var sumJaccard float64
+	var numCompared int
+	var sumLatencyDelta time.Duration
+	for _, diff := range diffs {
+		if diff.Error != "" {
+			report.NumFailed++
+			continue
+		}
+		sumLatencyDelta += diff.ShadowLatency - diff.PrimaryLatency
+		if diff.Jaccard != nil {
+			sumJaccard += *diff.Jaccard
+			numCompared++
+		}
+	}
+	if numCompared > 0 {
+		report.MeanJaccard = sumJaccard / float64(numCompared)
+	}
+	if numSucceeded := report.NumReplayed - report.NumFailed; numSucceeded > 0 {
+		report.MeanLatencyDelta = sumLatencyDelta / time.Duration(numSucceeded)
+	}
+	return report, nil
+}
+
+func (m *Master) getShadowTraffic(request *restful.Request, response *restful.Response) {
+	n, err := server.ParseInt(request, "n", 100)
+	if err != nil {
+		server.BadRequest(response, err)
+		return
+	}
+	report, err := m.GetShadowTrafficReport(n)
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	server.Ok(response, report)
+}
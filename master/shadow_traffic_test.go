@@ -0,0 +1,69 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+func TestMaster_GetShadowTraffic(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	now := time.Now()
+	jaccard := 0.5
+	diffs := []server.ShadowTrafficDiff{
+		{Timestamp: now.Add(-2 * time.Second), Endpoint: "GET /api/recommend/{user-id}", Jaccard: &jaccard,
+			PrimaryLatency: 10 * time.Millisecond, ShadowLatency: 30 * time.Millisecond},
+		{Timestamp: now.Add(-time.Second), Endpoint: "POST /api/feedback",
+			PrimaryLatency: 10 * time.Millisecond, ShadowLatency: 20 * time.Millisecond},
+		{Timestamp: now, Endpoint: "GET /api/recommend/{user-id}", Error: "timeout",
+			PrimaryLatency: 10 * time.Millisecond, ShadowLatency: time.Second},
+	}
+	for _, diff := range diffs {
+		buf, err := json.Marshal(diff)
+		assert.NoError(t, err)
+		err = s.CacheClient.AddSorted(cache.Sorted(cache.ShadowTrafficLog, []cache.Scored{
+			{Id: string(buf), Score: float64(diff.Timestamp.UnixNano())},
+		}))
+		assert.NoError(t, err)
+	}
+
+	report, err := s.GetShadowTrafficReport(10)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.NumReplayed)
+	assert.Equal(t, 1, report.NumFailed)
+	assert.Equal(t, 0.5, report.MeanJaccard)
+	assert.Equal(t, 15*time.Millisecond, report.MeanLatencyDelta)
+	assert.Equal(t, "timeout", report.Diffs[0].Error)
+
+	req := httptest.NewRequest("GET", "https://example.com/api/dashboard/shadow-traffic?n=1", nil)
+	req.Header.Set("Cookie", cookie)
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &report)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.NumReplayed)
+	assert.Equal(t, 1, report.NumFailed)
+	assert.Len(t, report.Diffs, 1)
+}
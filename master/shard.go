@@ -0,0 +1,132 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"github.com/lafikl/consistent"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"time"
+)
+
+const offlineRecommendTaskName = "Generate offline recommendation"
+
+// Shard is the set of users assigned to a worker. Users are partitioned across workers by consistent hashing of user
+// ids, which is the same ring used by workers to pull users.
+type Shard struct {
+	Worker     string
+	NumUsers   int
+	Status     task.Status
+	Progress   float64
+	UpdateTime time.Time
+}
+
+// rebalanceShards reassigns users to connected workers. If a worker leaves before its shard completes, users of the
+// shard are taken over by remaining workers, so completed shards are marked pending to be retried. Users already
+// recommended in this cycle are skipped by workers since their cache is fresh.
+func (m *Master) rebalanceShards() {
+	workers := make([]string, 0)
+	m.nodesInfoMutex.RLock()
+	for name, info := range m.nodesInfo {
+		if info.Type == WorkerNode {
+			workers = append(workers, name)
+		}
+	}
+	m.nodesInfoMutex.RUnlock()
+	sort.Strings(workers)
+
+	// count users of each shard
+	numUsers := make(map[string]int)
+	if len(workers) > 0 {
+		ring := consistent.New()
+		for _, worker := range workers {
+			ring.Add(worker)
+		}
+		m.rankingDataMutex.RLock()
+		if m.rankingTrainSet != nil {
+			for _, userId := range m.rankingTrainSet.UserIndex.GetNames() {
+				if worker, err := ring.Get(userId); err == nil {
+					numUsers[worker]++
+				}
+			}
+		}
+		m.rankingDataMutex.RUnlock()
+	}
+
+	m.shardsMutex.Lock()
+	defer m.shardsMutex.Unlock()
+	retry := false
+	for name, shard := range m.shards {
+		if !lo.Contains(workers, name) && shard.Status != task.StatusComplete {
+			log.Logger().Warn("worker left before its shard completed, reassign users",
+				zap.String("worker", name), zap.Float64("progress", shard.Progress))
+			retry = true
+		}
+	}
+	shards := make(map[string]*Shard, len(workers))
+	for _, worker := range workers {
+		shard, exist := m.shards[worker]
+		if !exist {
+			shard = &Shard{Worker: worker, Status: task.StatusPending, UpdateTime: time.Now()}
+		}
+		shard.NumUsers = numUsers[worker]
+		if retry && shard.Status == task.StatusComplete {
+			shard.Status = task.StatusPending
+			shard.Progress = 0
+			shard.UpdateTime = time.Now()
+		}
+		shards[worker] = shard
+	}
+	m.shards = shards
+}
+
+// updateShard updates the progress of a shard from the offline recommendation task reported by its worker.
+func (m *Master) updateShard(t *task.Task) {
+	if !strings.HasPrefix(t.Name, offlineRecommendTaskName+" [") || !strings.HasSuffix(t.Name, "]") {
+		return
+	}
+	worker := strings.TrimSuffix(strings.TrimPrefix(t.Name, offlineRecommendTaskName+" ["), "]")
+	m.shardsMutex.Lock()
+	defer m.shardsMutex.Unlock()
+	if m.shards == nil {
+		m.shards = make(map[string]*Shard)
+	}
+	shard, exist := m.shards[worker]
+	if !exist {
+		shard = &Shard{Worker: worker}
+		m.shards[worker] = shard
+	}
+	shard.Status = t.Status
+	shard.Progress = t.Progress
+	shard.UpdateTime = time.Now()
+}
+
+// GetShards returns shards sorted by worker names.
+func (m *Master) GetShards() []Shard {
+	m.shardsMutex.RLock()
+	defer m.shardsMutex.RUnlock()
+	shards := make([]Shard, 0, len(m.shards))
+	for _, shard := range m.shards {
+		shards = append(shards, *shard)
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].Worker < shards[j].Worker
+	})
+	return shards
+}
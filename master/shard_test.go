@@ -0,0 +1,91 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"encoding/json"
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestMaster_RebalanceShards(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	s.nodesInfo = map[string]*Node{
+		"worker_1": {Name: "worker_1", Type: WorkerNode},
+		"worker_2": {Name: "worker_2", Type: WorkerNode},
+		"server_1": {Name: "server_1", Type: ServerNode},
+	}
+	s.rankingTrainSet = ranking.NewMapIndexDataset()
+	for i := 0; i < 100; i++ {
+		s.rankingTrainSet.AddUser(strconv.Itoa(i))
+	}
+
+	// partition users across workers
+	s.rebalanceShards()
+	shards := s.GetShards()
+	assert.Len(t, shards, 2)
+	assert.Equal(t, "worker_1", shards[0].Worker)
+	assert.Equal(t, "worker_2", shards[1].Worker)
+	assert.Equal(t, 100, shards[0].NumUsers+shards[1].NumUsers)
+	assert.Equal(t, task.StatusPending, shards[0].Status)
+
+	// progress is reported by workers
+	s.updateShard(&task.Task{Name: offlineRecommendTaskName + " [worker_1]", Status: task.StatusComplete, Progress: 100})
+	s.updateShard(&task.Task{Name: offlineRecommendTaskName + " [worker_2]", Status: task.StatusRunning, Progress: 50})
+	s.updateShard(&task.Task{Name: TaskLoadDataset, Status: task.StatusComplete})
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/tasks/shards").
+		Header("Cookie", cookie).
+		Expect(t).
+		Status(http.StatusOK).
+		Assert(func(response *http.Response, request *http.Request) error {
+			var shards []Shard
+			if err := json.NewDecoder(response.Body).Decode(&shards); err != nil {
+				return err
+			}
+			assert.Len(t, shards, 2)
+			assert.Equal(t, task.StatusComplete, shards[0].Status)
+			assert.Equal(t, task.StatusRunning, shards[1].Status)
+			assert.Equal(t, 50.0, shards[1].Progress)
+			return nil
+		}).
+		End()
+
+	// users of a crashed worker are retried by others
+	delete(s.nodesInfo, "worker_2")
+	s.rebalanceShards()
+	shards = s.GetShards()
+	assert.Len(t, shards, 1)
+	assert.Equal(t, "worker_1", shards[0].Worker)
+	assert.Equal(t, 100, shards[0].NumUsers)
+	assert.Equal(t, task.StatusPending, shards[0].Status)
+
+	// completed shards aren't retried if workers join
+	s.updateShard(&task.Task{Name: offlineRecommendTaskName + " [worker_1]", Status: task.StatusComplete, Progress: 100})
+	s.nodesInfo["worker_3"] = &Node{Name: "worker_3", Type: WorkerNode}
+	s.rebalanceShards()
+	shards = s.GetShards()
+	assert.Len(t, shards, 2)
+	assert.Equal(t, task.StatusComplete, shards[0].Status)
+	assert.Equal(t, task.StatusPending, shards[1].Status)
+	assert.Equal(t, 100, shards[0].NumUsers+shards[1].NumUsers)
+}
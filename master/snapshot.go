@@ -0,0 +1,151 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/blob"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/snapshot"
+	"go.uber.org/zap"
+)
+
+var (
+	// snapshotPauseTimeout is the duration of pauses of cache writes, which are extended by the master until the
+	// snapshot is exported. Workers resume if the master stops extending pauses.
+	snapshotPauseTimeout = 5 * time.Minute
+	// snapshotQuiesceTimeout is the max duration to wait for workers to pause.
+	snapshotQuiesceTimeout = 10 * time.Minute
+	// snapshotPollInterval is the interval to check whether workers have paused.
+	snapshotPollInterval = time.Second
+)
+
+// SnapshotRun is the result of a request to export a snapshot.
+type SnapshotRun struct {
+	Task    string
+	Started bool
+}
+
+// RunSnapshot starts exporting a snapshot to the snapshot location in background. The snapshot isn't started if another
+// snapshot is being exported, and false is returned.
+func (m *Master) RunSnapshot() (bool, error) {
+	if m.Config.Master.SnapshotLocation == "" {
+		return false, errors.NotSupportedf("snapshot without snapshot_location")
+	}
+	store, err := blob.Open(m.Config.Master.SnapshotLocation)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if !m.snapshotRunning.TryLock() {
+		return false, nil
+	}
+	go func() {
+		defer base.CheckPanic()
+		defer m.snapshotRunning.Unlock()
+		if _, err := m.exportSnapshot(store); err != nil {
+			log.Logger().Error("failed to export snapshot", zap.Error(err))
+			m.taskMonitor.Fail(TaskExportSnapshot, err.Error())
+		}
+	}()
+	return true, nil
+}
+
+// exportSnapshot exports a consistent snapshot of data and cache stores. Tasks of the master are waited for and workers
+// are paused between batches so that cache documents aren't written during the export. Cache writes of servers, such as
+// ignored items of inserted feedback, aren't paused.
+func (m *Master) exportSnapshot(store blob.Store) (*snapshot.Manifest, error) {
+	snapshotTask := m.taskMonitor.Start(TaskExportSnapshot, len(snapshot.Kinds)+1)
+	startTime := time.Now()
+	log.Logger().Info("start exporting snapshot", zap.String("location", m.Config.Master.SnapshotLocation))
+
+	// STEP 1: quiesce cache writes
+	m.snapshotMutex.Lock()
+	defer m.snapshotMutex.Unlock()
+	resume, err := m.pauseCacheWrites()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resume()
+	deadline := time.Now().Add(snapshotQuiesceTimeout)
+	for m.offlineRecommendRunning() {
+		if time.Now().After(deadline) {
+			return nil, errors.Timeoutf("waiting for workers to pause")
+		}
+		time.Sleep(snapshotPollInterval)
+	}
+	snapshotTask.Add(1)
+
+	// STEP 2: export data and cache documents
+	cutoff := time.Now()
+	exporter := &snapshot.Exporter{
+		Store:       store,
+		DataClient:  m.DataClient,
+		CacheClient: m.CacheClient,
+		BatchSize:   batchSize,
+		Progress: func(file snapshot.File) {
+			log.Logger().Info("snapshot file exported", zap.String("name", file.Name), zap.Int("count", file.Count))
+			snapshotTask.Add(1)
+		},
+	}
+	manifest, err := exporter.Export(cutoff.UTC().Format("20060102T150405Z"), cutoff)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	snapshotTask.Finish()
+	log.Logger().Info("complete exporting snapshot",
+		zap.String("manifest", snapshot.ManifestName(manifest.Id)),
+		zap.String("base", manifest.Base),
+		zap.String("used_time", time.Since(startTime).String()))
+	return manifest, nil
+}
+
+// pauseCacheWrites asks workers to pause cache writes, and extends the pause until the returned function is called to
+// resume cache writes.
+func (m *Master) pauseCacheWrites() (func(), error) {
+	pause := func() error {
+		return m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil), time.Now().Add(snapshotPauseTimeout)))
+	}
+	if err := pause(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer base.CheckPanic()
+		defer close(done)
+		ticker := time.NewTicker(snapshotPauseTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := pause(); err != nil {
+					log.Logger().Error("failed to extend pause of cache writes", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		if err := m.CacheClient.Delete(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil)); err != nil {
+			log.Logger().Error("failed to resume cache writes", zap.Error(err))
+		}
+	}, nil
+}
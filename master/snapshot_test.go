@@ -0,0 +1,74 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/blob"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"github.com/zhenghaoz/gorse/storage/snapshot"
+)
+
+func TestMaster_ExportSnapshot(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	_, err := m.RunSnapshot()
+	assert.True(t, errors.Is(err, errors.NotSupported))
+
+	m.Config.Master.SnapshotLocation = t.TempDir()
+	store, err := blob.Open(m.Config.Master.SnapshotLocation)
+	assert.NoError(t, err)
+	err = m.DataClient.BatchInsertUsers([]data.User{{UserId: "0"}})
+	assert.NoError(t, err)
+	err = m.DataClient.BatchInsertItems([]data.Item{{ItemId: "0"}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{Id: "0", Score: 1}})
+	assert.NoError(t, err)
+
+	// snapshots wait for workers to pause
+	snapshotQuiesceTimeout, snapshotPollInterval = 50*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		snapshotQuiesceTimeout, snapshotPollInterval = 10*time.Minute, time.Second
+	}()
+	workerTask := m.taskMonitor.Start(offlineRecommendTaskName+" [worker]", 10)
+	_, err = m.exportSnapshot(store)
+	assert.True(t, errors.Is(err, errors.Timeout))
+	_, err = m.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil)).Time()
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	workerTask.Suspend(true)
+	manifest, err := m.exportSnapshot(store)
+	assert.NoError(t, err)
+	assert.Empty(t, manifest.Base)
+	file, exist := manifest.File(snapshot.KindUsers)
+	assert.True(t, exist)
+	assert.Equal(t, 1, file.Count)
+	file, exist = manifest.File(snapshot.KindCache)
+	assert.True(t, exist)
+	assert.Equal(t, 1, file.Count)
+	latest, err := snapshot.ReadLatest(store)
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Id, latest.Id)
+	// cache writes are resumed
+	_, err = m.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil)).Time()
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"math"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/hll"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+const (
+	// weeklyDays and monthlyDays are the number of days in sliding windows of active users and items.
+	weeklyDays  = 7
+	monthlyDays = 30
+)
+
+type ConsolidateActivityTask struct {
+	*Master
+}
+
+func NewConsolidateActivityTask(m *Master) *ConsolidateActivityTask {
+	return &ConsolidateActivityTask{m}
+}
+
+func (t *ConsolidateActivityTask) name() string {
+	return TaskConsolidateActivity
+}
+
+func (t *ConsolidateActivityTask) priority() int {
+	return -t.rankingTrainSet.UserCount()
+}
+
+// run merges daily sketches of active users and items into sketches of the last week and the last month.
+func (t *ConsolidateActivityTask) run(_ *task.JobsAllocator) error {
+	log.Logger().Info("start consolidating activity statistics")
+	t.taskMonitor.Start(TaskConsolidateActivity, 2)
+	now := time.Now()
+	for i, prefix := range []string{cache.ActiveUsersSketch, cache.ActiveItemsSketch} {
+		daily, weekly, monthly, err := t.consolidateSketches(prefix, now)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		gauge := ActiveUsers
+		if prefix == cache.ActiveItemsSketch {
+			gauge = ActiveItems
+		}
+		gauge.WithLabelValues("daily").Set(float64(daily.Count()))
+		gauge.WithLabelValues("weekly").Set(float64(weekly.Count()))
+		gauge.WithLabelValues("monthly").Set(float64(monthly.Count()))
+		t.taskMonitor.Update(TaskConsolidateActivity, i+1)
+	}
+	t.taskMonitor.Finish(TaskConsolidateActivity)
+	log.Logger().Info("complete consolidating activity statistics", zap.Duration("used_time", time.Since(now)))
+	return nil
+}
+
+// consolidateSketches merges daily sketches of the last month, and saves sketches of the last week and the last month.
+func (t *ConsolidateActivityTask) consolidateSketches(prefix string, now time.Time) (daily, weekly, monthly *hll.HyperLogLog, err error) {
+	daily = hll.New(server.ActivityPrecision)
+	weekly = hll.New(server.ActivityPrecision)
+	monthly = hll.New(server.ActivityPrecision)
+	for d := 0; d < monthlyDays; d++ {
+		sketch, err := loadSketch(t.CacheClient, cache.Key(prefix, server.ActivityDay(now.AddDate(0, 0, -d))))
+		if err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		if d == 0 {
+			daily = sketch
+		}
+		if d < weeklyDays {
+			if err = weekly.Merge(sketch); err != nil {
+				return nil, nil, nil, errors.Trace(err)
+			}
+		}
+		if err = monthly.Merge(sketch); err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+	}
+	if err = t.CacheClient.Set(
+		cache.String(cache.Key(prefix, cache.WeeklySketch), weekly.String()),
+		cache.String(cache.Key(prefix, cache.MonthlySketch), monthly.String()),
+	); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	return daily, weekly, monthly, nil
+}
+
+// loadSketch loads a sketch from the cache store. An empty sketch is returned if the sketch doesn't exist.
+func loadSketch(cacheClient cache.Database, key string) (*hll.HyperLogLog, error) {
+	encoded, err := cacheClient.Get(key).String()
+	if errors.Is(err, errors.NotFound) {
+		return hll.New(server.ActivityPrecision), nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return hll.Parse(encoded)
+}
+
+// Estimate is an estimated number of distinct elements and its standard error.
+type Estimate struct {
+	Value      uint64
+	ErrorBound uint64
+}
+
+func newEstimate(sketch *hll.HyperLogLog) Estimate {
+	value := sketch.Count()
+	return Estimate{Value: value, ErrorBound: uint64(math.Ceil(float64(value) * sketch.RelativeError()))}
+}
+
+// ActivityStats is the estimated number of distinct active users or items today, in the last week and in the last
+// month. Sketches of weeks and months are refreshed by the master periodically.
+type ActivityStats struct {
+	Daily   Estimate
+	Weekly  Estimate
+	Monthly Estimate
+}
+
+// GetActivityStats returns estimated numbers of active users and items.
+func (m *Master) GetActivityStats() (users, items ActivityStats, err error) {
+	if users, err = m.loadActivityStats(cache.ActiveUsersSketch); err != nil {
+		return
+	}
+	items, err = m.loadActivityStats(cache.ActiveItemsSketch)
+	return
+}
+
+func (m *Master) loadActivityStats(prefix string) (ActivityStats, error) {
+	var stats ActivityStats
+	for key, estimate := range map[string]*Estimate{
+		server.ActivityDay(time.Now()): &stats.Daily,
+		cache.WeeklySketch:             &stats.Weekly,
+		cache.MonthlySketch:            &stats.Monthly,
+	} {
+		sketch, err := loadSketch(m.CacheClient, cache.Key(prefix, key))
+		if err != nil {
+			return ActivityStats{}, errors.Trace(err)
+		}
+		*estimate = newEstimate(sketch)
+	}
+	return stats, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/hll"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestRunConsolidateActivityTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+
+	// insert daily sketches: 10 users a day, 5 of them are new
+	now := time.Now()
+	for d := 0; d < 40; d++ {
+		users := hll.New(server.ActivityPrecision)
+		for i := 0; i < 10; i++ {
+			users.Add(strconv.Itoa(d*5 + i))
+		}
+		err := m.CacheClient.Set(cache.String(cache.Key(cache.ActiveUsersSketch, server.ActivityDay(now.AddDate(0, 0, -d))), users.String()))
+		assert.NoError(t, err)
+	}
+
+	// consolidate sketches
+	err := NewConsolidateActivityTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	users, items, err := m.GetActivityStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), users.Daily.Value)
+	assert.Equal(t, uint64(40), users.Weekly.Value)
+	assert.InDelta(t, 155, users.Monthly.Value, 3)
+	assert.LessOrEqual(t, users.Monthly.ErrorBound, uint64(2))
+	assert.Equal(t, ActivityStats{}, items)
+}
+
+func TestRunCacheGarbageCollectionTask_Sketches(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	err := m.DataClient.BatchInsertFeedback([]data.Feedback{{FeedbackKey: data.FeedbackKey{UserId: "1", ItemId: "10"}}}, true, true, true)
+	assert.NoError(t, err)
+	err = m.runLoadDatasetTask()
+	assert.NoError(t, err)
+
+	// insert sketches
+	now := time.Now()
+	sketch := hll.New(server.ActivityPrecision).String()
+	fresh := cache.Key(cache.ActiveUsersSketch, server.ActivityDay(now.AddDate(0, 0, -monthlyDays)))
+	stale := cache.Key(cache.ActiveUsersSketch, server.ActivityDay(now.AddDate(0, 0, -monthlyDays-2)))
+	weekly := cache.Key(cache.ActiveUsersSketch, cache.WeeklySketch)
+	err = m.CacheClient.Set(cache.String(fresh, sketch), cache.String(stale, sketch), cache.String(weekly, sketch))
+	assert.NoError(t, err)
+
+	// remove stale sketches
+	err = NewCacheGarbageCollectionTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	_, err = m.CacheClient.Get(fresh).String()
+	assert.NoError(t, err)
+	_, err = m.CacheClient.Get(weekly).String()
+	assert.NoError(t, err)
+	_, err = m.CacheClient.Get(stale).String()
+	assert.Error(t, err)
+}
@@ -15,16 +15,18 @@
 package master
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/chewxy/math32"
 	"github.com/juju/errors"
 	"github.com/samber/lo"
-	"github.com/scylladb/go-set/i32set"
 	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/encoding"
 	"github.com/zhenghaoz/gorse/base/heap"
@@ -33,6 +35,7 @@ import (
 	"github.com/zhenghaoz/gorse/base/search"
 	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
 	"github.com/zhenghaoz/gorse/storage/cache"
@@ -45,14 +48,28 @@ import (
 const (
 	PositiveFeedbackRate = "PositiveFeedbackRate"
 
-	TaskLoadDataset            = "Load dataset"
-	TaskFindItemNeighbors      = "Find neighbors of items"
-	TaskFindUserNeighbors      = "Find neighbors of users"
-	TaskFitRankingModel        = "Fit collaborative filtering model"
-	TaskFitClickModel          = "Fit click-through rate prediction model"
-	TaskSearchRankingModel     = "Search collaborative filtering  model"
-	TaskSearchClickModel       = "Search click-through rate prediction model"
-	TaskCacheGarbageCollection = "Collect garbage in cache"
+	TaskLoadDataset             = "Load dataset"
+	TaskFindItemNeighbors       = "Find neighbors of items"
+	TaskFindUserNeighbors       = "Find neighbors of users"
+	TaskFitRankingModel         = "Fit collaborative filtering model"
+	TaskFitClickModel           = "Fit click-through rate prediction model"
+	TaskSearchRankingModel      = "Search collaborative filtering  model"
+	TaskSearchClickModel        = "Search click-through rate prediction model"
+	TaskCacheGarbageCollection  = "Collect garbage in cache"
+	TaskQualityGate             = "Hide low quality items"
+	TaskEvaluateRankingModel    = "Evaluate collaborative filtering model"
+	TaskFindTrendingItems       = "Find trending items"
+	TaskCollectExpiredOverrides = "Collect expired user overrides"
+	TaskFindDuplicateItems      = "Find duplicate items"
+	TaskConsolidateActivity     = "Consolidate activity statistics"
+	TaskCollectExpiredAuditLogs = "Collect expired audit logs"
+	TaskCollectExpiredHistory   = "Collect expired recommendation history"
+	TaskCollectUsage            = "Collect usage"
+	TaskExportSnapshot          = "Export snapshot"
+	TaskFindCovisitedItems      = "Find co-visited items"
+	TaskRewriteLabel            = "Rewrite label"
+	TaskVerifyCache             = "Verify cache"
+	TaskCheckDivergence         = "Check divergence of shadow data store"
 
 	batchSize        = 10000
 	similarityShrink = 100
@@ -70,18 +87,23 @@ func (m *Master) runLoadDatasetTask() error {
 	log.Logger().Info("load dataset",
 		zap.Strings("positive_feedback_types", m.Config.Recommend.DataSource.PositiveFeedbackTypes),
 		zap.Strings("read_feedback_types", m.Config.Recommend.DataSource.ReadFeedbackTypes),
+		zap.Strings("negative_feedback_types", m.Config.Recommend.DataSource.NegativeFeedbackTypes),
 		zap.Uint("item_ttl", m.Config.Recommend.DataSource.ItemTTL),
 		zap.Uint("feedback_ttl", m.Config.Recommend.DataSource.PositiveFeedbackTTL))
 	evaluator := NewOnlineEvaluator()
-	rankingDataset, clickDataset, latestItems, popularItems, err := m.LoadDataFromDatabase(m.DataClient,
+	rankingDataset, clickDataset, latestItems, popularItems, labelPopularItems, err := m.LoadDataFromDatabase(m.DataClient,
 		m.Config.Recommend.DataSource.PositiveFeedbackTypes,
 		m.Config.Recommend.DataSource.ReadFeedbackTypes,
+		m.Config.Recommend.DataSource.NegativeFeedbackTypes,
 		m.Config.Recommend.DataSource.ItemTTL,
 		m.Config.Recommend.DataSource.PositiveFeedbackTTL,
 		evaluator)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err = m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastLoadDatasetTime), initialStartTime)); err != nil {
+		log.Logger().Error("failed to write latest load dataset time", zap.Error(err))
+	}
 
 	// save popular items to cache
 	for category, items := range popularItems {
@@ -93,6 +115,32 @@ func (m *Master) runLoadDatasetTask() error {
 		log.Logger().Error("failed to write latest update popular items time", zap.Error(err))
 	}
 
+	// save popular items of labels to cache and remove popular items of disappeared labels
+	for label, items := range labelPopularItems {
+		if err = m.CacheClient.SetSorted(cache.Key(cache.LabelPopularItems, label), items); err != nil {
+			log.Logger().Error("failed to cache popular items of label", zap.String("label", label), zap.Error(err))
+		}
+	}
+	if prevLabels, err := m.CacheClient.GetSet(cache.ItemLabels); err != nil {
+		log.Logger().Error("failed to load item labels", zap.Error(err))
+	} else {
+		for _, label := range prevLabels {
+			if _, exist := labelPopularItems[label]; !exist {
+				if err = m.CacheClient.Delete(cache.Key(cache.LabelPopularItems, label)); err != nil {
+					log.Logger().Error("failed to remove popular items of label", zap.String("label", label), zap.Error(err))
+				}
+			}
+		}
+		if len(labelPopularItems) == 0 {
+			err = m.CacheClient.Delete(cache.ItemLabels)
+		} else {
+			err = m.CacheClient.SetSet(cache.ItemLabels, lo.Keys(labelPopularItems)...)
+		}
+		if err != nil {
+			log.Logger().Error("failed to write item labels", zap.Error(err))
+		}
+	}
+
 	// save the latest items to cache
 	for category, items := range latestItems {
 		if err = m.CacheClient.AddSorted(cache.Sorted(cache.Key(cache.LatestItems, category), items)); err != nil {
@@ -146,6 +194,9 @@ func (m *Master) runLoadDatasetTask() error {
 	if err = m.RestServer.InsertMeasurement(measurement...); err != nil {
 		log.Logger().Error("failed to insert measurement", zap.Error(err))
 	}
+	if err = m.evaluateCanary(evaluator, rankingDataset.UserIndex); err != nil {
+		log.Logger().Error("failed to evaluate canary ranking model", zap.Error(err))
+	}
 
 	// collect active users and items
 	activeUsers, activeItems, inactiveUsers, inactiveItems := 0, 0, 0, 0
@@ -176,7 +227,14 @@ func (m *Master) runLoadDatasetTask() error {
 	// split ranking dataset
 	startTime := time.Now()
 	m.rankingDataMutex.Lock()
-	m.rankingTrainSet, m.rankingTestSet = rankingDataset.Split(0, 0)
+	m.rankingTrainSet, m.rankingTestSet = rankingDataset.Split(0, m.Config.Recommend.Collaborative.RandomSeed)
+	m.rankingDataTime = initialStartTime
+	m.rankingEvalTrainSet, m.rankingEvalTestSet = nil, nil
+	if m.Config.Recommend.Evaluation.EnableEvaluation {
+		if m.rankingEvalTrainSet, m.rankingEvalTestSet, err = rankingDataset.SplitByTime(m.Config.Recommend.Evaluation.TestRatio); err != nil {
+			log.Logger().Error("failed to split ranking dataset by time", zap.Error(err))
+		}
+	}
 	rankingDataset = nil
 	m.rankingDataMutex.Unlock()
 	LoadDatasetStepSecondsVec.WithLabelValues("split_ranking_dataset").Set(time.Since(startTime).Seconds())
@@ -186,13 +244,17 @@ func (m *Master) runLoadDatasetTask() error {
 	// split click dataset
 	startTime = time.Now()
 	m.clickDataMutex.Lock()
-	m.clickTrainSet, m.clickTestSet = clickDataset.Split(0.2, 0)
+	m.clickTrainSet, m.clickTestSet = clickDataset.Split(0.2, m.Config.Recommend.Collaborative.RandomSeed)
+	m.clickDataTime = initialStartTime
 	clickDataset = nil
 	m.clickDataMutex.Unlock()
 	LoadDatasetStepSecondsVec.WithLabelValues("split_click_dataset").Set(time.Since(startTime).Seconds())
 	MemoryInUseBytesVec.WithLabelValues("ranking_train_set").Set(float64(m.clickTrainSet.Bytes()))
 	MemoryInUseBytesVec.WithLabelValues("ranking_test_set").Set(float64(m.clickTestSet.Bytes()))
 
+	// count users of shards
+	m.rebalanceShards()
+
 	LoadDatasetTotalSeconds.Set(time.Since(initialStartTime).Seconds())
 	return nil
 }
@@ -207,7 +269,7 @@ func (m *Master) estimateFindItemNeighborsComplexity(dataset *ranking.DataSet) i
 		m.Config.Recommend.ItemNeighbors.NeighborType == config.NeighborTypeAuto {
 		complexity += len(dataset.ItemLabels) + int(dataset.NumItemLabels)
 	}
-	if m.Config.Recommend.ItemNeighbors.EnableIndex {
+	if m.Config.Recommend.ItemNeighbors.EnableIndex && isIndexSupported(m.Config.Recommend.ItemNeighbors) {
 		complexity += search.EstimateIVFBuilderComplexity(dataset.ItemCount(), m.Config.Recommend.ItemNeighbors.IndexFitEpoch)
 	}
 	return complexity
@@ -248,7 +310,7 @@ func (t *FindItemNeighborsTask) run(j *task.JobsAllocator) error {
 	}
 
 	startTaskTime := time.Now()
-	t.taskMonitor.Start(TaskFindItemNeighbors, t.estimateFindItemNeighborsComplexity(dataset))
+	neighborTask := t.taskMonitor.Start(TaskFindItemNeighbors, t.estimateFindItemNeighborsComplexity(dataset))
 	log.Logger().Info("start searching neighbors of items",
 		zap.Int("n_cache", t.Config.Recommend.CacheSize))
 	// create progress tracker
@@ -310,10 +372,10 @@ func (t *FindItemNeighborsTask) run(j *task.JobsAllocator) error {
 
 	start := time.Now()
 	var err error
-	if t.Config.Recommend.ItemNeighbors.EnableIndex {
-		err = t.findItemNeighborsIVF(dataset, labelIDF, userIDF, completed, j)
+	if t.Config.Recommend.ItemNeighbors.EnableIndex && isIndexSupported(t.Config.Recommend.ItemNeighbors) {
+		err = t.findItemNeighborsIVF(neighborTask.Context(), dataset, labelIDF, userIDF, completed, j)
 	} else {
-		err = t.findItemNeighborsBruteForce(dataset, labeledItems, labelIDF, userIDF, completed, j)
+		err = t.findItemNeighborsBruteForce(neighborTask.Context(), dataset, labeledItems, labelIDF, userIDF, completed, j)
 	}
 	searchTime := time.Since(start)
 
@@ -322,8 +384,14 @@ func (t *FindItemNeighborsTask) run(j *task.JobsAllocator) error {
 		log.Logger().Error("failed to searching neighbors of items", zap.Error(err))
 		t.taskMonitor.Fail(TaskFindItemNeighbors, err.Error())
 		FindItemNeighborsTotalSeconds.Set(0)
+	} else if neighborTask.Cancelled() {
+		// neighbors of remaining items are searched in the next round
+		log.Logger().Info("searching neighbors of items cancelled")
+		return nil
 	} else {
-		if err := t.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastUpdateItemNeighborsTime), time.Now())); err != nil {
+		if err := t.CacheClient.Set(
+			cache.Time(cache.Key(cache.GlobalMeta, cache.LastUpdateItemNeighborsTime), time.Now()),
+			cache.String(cache.Key(cache.GlobalMeta, cache.ItemNeighborSimilarity), t.Config.Recommend.ItemNeighbors.Similarity())); err != nil {
 			log.Logger().Error("failed to set neighbors of items update time", zap.Error(err))
 		}
 		log.Logger().Info("complete searching neighbors of items",
@@ -337,40 +405,71 @@ func (t *FindItemNeighborsTask) run(j *task.JobsAllocator) error {
 	return nil
 }
 
-func (m *Master) findItemNeighborsBruteForce(dataset *ranking.DataSet, labeledItems [][]int32,
+func (m *Master) findItemNeighborsBruteForce(ctx context.Context, dataset *ranking.DataSet, labeledItems [][]int32,
 	labelIDF, userIDF []float32, completed chan struct{}, j *task.JobsAllocator) error {
 	var (
 		updateItemCount     atomic.Float64
+		categorizedCount    atomic.Float64
+		categorizedBytes    atomic.Float64
 		findNeighborSeconds atomic.Float64
 	)
+	allCategories := dataset.CategorySet.List()
+	sort.Strings(allCategories)
 
 	var vector VectorsInterface
-	switch m.Config.Recommend.ItemNeighbors.NeighborType {
+	itemNeighborsConfig := m.Config.Recommend.ItemNeighbors
+	switch itemNeighborsConfig.NeighborType {
 	case config.NeighborTypeSimilar:
-		vector = NewVectors(dataset.ItemLabels, labeledItems, labelIDF)
+		vector = newVectorsWithSimilarity(itemNeighborsConfig.LabelSimilarity, dataset.ItemLabels, labeledItems, labelIDF)
 	case config.NeighborTypeRelated:
-		vector = NewVectors(dataset.ItemFeedback, dataset.UserFeedback, userIDF)
+		vector = newVectorsWithSimilarity(itemNeighborsConfig.FeedbackSimilarity, dataset.ItemFeedback, dataset.UserFeedback, userIDF)
 	case config.NeighborTypeAuto:
-		vector = NewDualVectors(
-			NewVectors(dataset.ItemLabels, labeledItems, labelIDF),
-			NewVectors(dataset.ItemFeedback, dataset.UserFeedback, userIDF))
+		vector = NewWeightedDualVectors(
+			newVectorsWithSimilarity(itemNeighborsConfig.LabelSimilarity, dataset.ItemLabels, labeledItems, labelIDF),
+			newVectorsWithSimilarity(itemNeighborsConfig.FeedbackSimilarity, dataset.ItemFeedback, dataset.UserFeedback, userIDF),
+			itemNeighborsConfig.HybridAlpha)
 	default:
 		return errors.NotImplementedf("item neighbor type `%v`", m.Config.Recommend.ItemNeighbors.NeighborType)
 	}
 
-	err := parallel.DynamicParallel(dataset.ItemCount(), j, func(workerId, itemIndex int) error {
+	// generate candidates by locality-sensitive hashing for large catalogs
+	var lsh *LSHVectors
+	buildIndexSeconds := 0.0
+	if itemNeighborsConfig.EnableLSH && dataset.ItemCount() >= itemNeighborsConfig.LSHMinItems {
+		startTime := time.Now()
+		var err error
+		if lsh, err = NewLSHVectors(vector, itemNeighborsConfig.LSHNumBands, itemNeighborsConfig.LSHBandSize, j); err != nil {
+			return errors.Trace(err)
+		}
+		vector = lsh
+		buildIndexSeconds = time.Since(startTime).Seconds()
+	}
+
+	hiddenItems, err := m.loadHiddenItems(allCategories)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = parallel.DynamicParallel(dataset.ItemCount(), j, func(workerId, itemIndex int) error {
 		defer func() {
 			completed <- struct{}{}
 		}()
+		// skip remaining jobs once cancelled
+		if ctx.Err() != nil {
+			return nil
+		}
 		itemId := dataset.ItemIndex.ToName(int32(itemIndex))
-		if !m.checkItemNeighborCacheTimeout(itemId, dataset.CategorySet.List()) {
+		itemCategories := m.neighborCategories(dataset, allCategories, itemIndex)
+		if !m.checkItemNeighborCacheTimeout(itemId, itemCategories) {
+			if err := m.removeHiddenNeighbors(itemId, itemCategories, hiddenItems); err != nil {
+				log.Logger().Error("failed to remove hidden item neighbors", zap.String("item_id", itemId), zap.Error(err))
+			}
 			return nil
 		}
 		updateItemCount.Add(1)
 		startTime := time.Now()
 		nearItemsFilters := make(map[string]*heap.TopKFilter[int32, float32])
 		nearItemsFilters[""] = heap.NewTopKFilter[int32, float32](m.Config.Recommend.CacheSize)
-		for _, category := range dataset.CategorySet.List() {
+		for _, category := range itemCategories {
 			nearItemsFilters[category] = heap.NewTopKFilter[int32, float32](m.Config.Recommend.CacheSize)
 		}
 
@@ -381,7 +480,9 @@ func (m *Master) findItemNeighborsBruteForce(dataset *ranking.DataSet, labeledIt
 				if score > 0 {
 					nearItemsFilters[""].Push(j, score)
 					for _, category := range dataset.ItemCategories[j] {
-						nearItemsFilters[category].Push(j, score)
+						if nearItemsFilter, exist := nearItemsFilters[category]; exist {
+							nearItemsFilter.Push(j, score)
+						}
 					}
 				}
 			}
@@ -397,6 +498,13 @@ func (m *Master) findItemNeighborsBruteForce(dataset *ranking.DataSet, labeledIt
 				cache.CreateScoredItems(recommends, scores)); err != nil {
 				return errors.Trace(err)
 			}
+			if category != "" {
+				categorizedCount.Add(1)
+				categorizedBytes.Add(float64(scoredBytes(recommends)))
+			}
+		}
+		if err := m.updateItemNeighborCategories(itemId, itemCategories); err != nil {
+			return errors.Trace(err)
 		}
 		if err := m.CacheClient.Set(
 			cache.Time(cache.Key(cache.LastUpdateItemNeighborsTime, itemId), time.Now()),
@@ -410,18 +518,32 @@ func (m *Master) findItemNeighborsBruteForce(dataset *ranking.DataSet, labeledIt
 		return errors.Trace(err)
 	}
 	UpdateItemNeighborsTotal.Set(updateItemCount.Load())
+	CategorizedItemNeighborsTotal.Set(categorizedCount.Load())
+	CategorizedItemNeighborsBytes.Set(categorizedBytes.Load())
 	FindItemNeighborsSecondsVec.WithLabelValues("find_item_neighbors").Set(findNeighborSeconds.Load())
-	FindItemNeighborsSecondsVec.WithLabelValues("build_index").Set(0)
-	ItemNeighborIndexRecall.Set(1)
+	FindItemNeighborsSecondsVec.WithLabelValues("build_index").Set(buildIndexSeconds)
+	recall := float32(1)
+	if lsh != nil {
+		samples := base.NewRandomGenerator(time.Now().UnixNano()).Sample(0, dataset.ItemCount(), lshRecallSamples)
+		recall = lsh.Recall(samples, m.Config.Recommend.CacheSize, dataset.HiddenItems)
+		log.Logger().Info("estimate recall of item neighbors found by lsh",
+			zap.Int("n_samples", len(samples)),
+			zap.Float32("recall", recall))
+	}
+	ItemNeighborIndexRecall.Set(float64(recall))
 	return nil
 }
 
-func (m *Master) findItemNeighborsIVF(dataset *ranking.DataSet, labelIDF, userIDF []float32, completed chan struct{}, j *task.JobsAllocator) error {
+func (m *Master) findItemNeighborsIVF(ctx context.Context, dataset *ranking.DataSet, labelIDF, userIDF []float32, completed chan struct{}, j *task.JobsAllocator) error {
 	var (
 		updateItemCount     atomic.Float64
+		categorizedCount    atomic.Float64
+		categorizedBytes    atomic.Float64
 		findNeighborSeconds atomic.Float64
 		buildIndexSeconds   atomic.Float64
 	)
+	allCategories := dataset.CategorySet.List()
+	sort.Strings(allCategories)
 
 	// build index
 	buildStart := time.Now()
@@ -457,12 +579,24 @@ func (m *Master) findItemNeighborsIVF(dataset *ranking.DataSet, labelIDF, userID
 	}
 	buildIndexSeconds.Add(time.Since(buildStart).Seconds())
 
-	err := parallel.DynamicParallel(dataset.ItemCount(), j, func(workerId, itemIndex int) error {
+	hiddenItems, err := m.loadHiddenItems(allCategories)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = parallel.DynamicParallel(dataset.ItemCount(), j, func(workerId, itemIndex int) error {
 		defer func() {
 			completed <- struct{}{}
 		}()
+		// skip remaining jobs once cancelled
+		if ctx.Err() != nil {
+			return nil
+		}
 		itemId := dataset.ItemIndex.ToName(int32(itemIndex))
-		if !m.checkItemNeighborCacheTimeout(itemId, dataset.CategorySet.List()) {
+		itemCategories := m.neighborCategories(dataset, allCategories, itemIndex)
+		if !m.checkItemNeighborCacheTimeout(itemId, itemCategories) {
+			if err := m.removeHiddenNeighbors(itemId, itemCategories, hiddenItems); err != nil {
+				log.Logger().Error("failed to remove hidden item neighbors", zap.String("item_id", itemId), zap.Error(err))
+			}
 			return nil
 		}
 		updateItemCount.Add(1)
@@ -471,15 +605,15 @@ func (m *Master) findItemNeighborsIVF(dataset *ranking.DataSet, labelIDF, userID
 		var scores map[string][]float32
 		if m.Config.Recommend.ItemNeighbors.NeighborType == config.NeighborTypeSimilar ||
 			m.Config.Recommend.ItemNeighbors.NeighborType == config.NeighborTypeAuto {
-			neighbors, scores = index.MultiSearch(vectors[itemIndex], dataset.CategorySet.List(),
+			neighbors, scores = index.MultiSearch(vectors[itemIndex], itemCategories,
 				m.Config.Recommend.CacheSize, true)
 		}
 		if m.Config.Recommend.ItemNeighbors.NeighborType == config.NeighborTypeRelated ||
 			m.Config.Recommend.ItemNeighbors.NeighborType == config.NeighborTypeAuto && len(neighbors[""]) == 0 {
-			neighbors, scores = index.MultiSearch(vectors[itemIndex], dataset.CategorySet.List(),
+			neighbors, scores = index.MultiSearch(vectors[itemIndex], itemCategories,
 				m.Config.Recommend.CacheSize, true)
 		}
-		for category := range neighbors {
+		for _, category := range append([]string{""}, itemCategories...) {
 			if categoryNeighbors, exist := neighbors[category]; exist && len(categoryNeighbors) > 0 {
 				itemScores := make([]cache.Scored, len(neighbors[category]))
 				for i := range scores[category] {
@@ -489,8 +623,17 @@ func (m *Master) findItemNeighborsIVF(dataset *ranking.DataSet, labelIDF, userID
 				if err := m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, itemId, category), itemScores); err != nil {
 					return errors.Trace(err)
 				}
+				if category != "" {
+					categorizedCount.Add(1)
+					categorizedBytes.Add(float64(scoredBytes(cache.RemoveScores(itemScores))))
+				}
+			} else if err := m.CacheClient.Delete(cache.Key(cache.ItemNeighbors, itemId, category)); err != nil {
+				return errors.Trace(err)
 			}
 		}
+		if err := m.updateItemNeighborCategories(itemId, itemCategories); err != nil {
+			return errors.Trace(err)
+		}
 		if err := m.CacheClient.Set(
 			cache.Time(cache.Key(cache.LastUpdateItemNeighborsTime, itemId), time.Now()),
 			cache.String(cache.Key(cache.ItemNeighborsDigest, itemId), m.Config.ItemNeighborDigest())); err != nil {
@@ -503,11 +646,90 @@ func (m *Master) findItemNeighborsIVF(dataset *ranking.DataSet, labelIDF, userID
 		return errors.Trace(err)
 	}
 	UpdateItemNeighborsTotal.Set(updateItemCount.Load())
+	CategorizedItemNeighborsTotal.Set(categorizedCount.Load())
+	CategorizedItemNeighborsBytes.Set(categorizedBytes.Load())
 	FindItemNeighborsSecondsVec.WithLabelValues("find_item_neighbors").Set(findNeighborSeconds.Load())
 	FindItemNeighborsSecondsVec.WithLabelValues("build_index").Set(buildIndexSeconds.Load())
 	return nil
 }
 
+// neighborCategories returns categories to cache neighbors of the item in. All categories are returned unless there
+// are more than max_categories. In that case, categories of the item come first, followed by other categories in
+// order. Neighbors in remaining categories are filtered from neighbors of the item when requested.
+func (m *Master) neighborCategories(dataset *ranking.DataSet, allCategories []string, itemIndex int) []string {
+	maxCategories := m.Config.Recommend.ItemNeighbors.MaxCategories
+	if maxCategories == 0 || len(allCategories) <= maxCategories {
+		return allCategories
+	}
+	categories := make([]string, 0, maxCategories)
+	for _, category := range dataset.ItemCategories[itemIndex] {
+		if len(categories) < maxCategories && dataset.CategorySet.Has(category) && !lo.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	for _, category := range allCategories {
+		if len(categories) >= maxCategories {
+			break
+		}
+		if !lo.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+// updateItemNeighborCategories records categories with cached neighbors of the item and removes neighbors cached in
+// other categories before.
+func (m *Master) updateItemNeighborCategories(itemId string, categories []string) error {
+	prevCategories, err := m.CacheClient.GetSet(cache.Key(cache.ItemNeighborCategories, itemId))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, category := range prevCategories {
+		if !lo.Contains(categories, category) {
+			if err = m.CacheClient.Delete(cache.Key(cache.ItemNeighbors, itemId, category)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	if len(categories) == 0 {
+		return m.CacheClient.Delete(cache.Key(cache.ItemNeighborCategories, itemId))
+	}
+	return m.CacheClient.SetSet(cache.Key(cache.ItemNeighborCategories, itemId), categories...)
+}
+
+// scoredBytes estimates the memory usage of a sorted set in cache store.
+func scoredBytes(ids []string) int {
+	bytes := 0
+	for _, id := range ids {
+		bytes += len(id) + 8
+	}
+	return bytes
+}
+
+// newVectorsWithSimilarity creates vectors measured by the similarity function.
+func newVectorsWithSimilarity(similarity string, connections, connected [][]int32, weights []float32) *Vectors {
+	if similarity == config.SimilarityJaccard {
+		return NewJaccardVectors(connections, connected, weights)
+	}
+	return NewVectors(connections, connected, weights)
+}
+
+// isIndexSupported returns true if the vector index supports the similarity of item neighbors. The vector index only
+// supports cosine similarity with equal weights of labels and feedback.
+func isIndexSupported(itemNeighborsConfig config.ItemNeighborsConfig) bool {
+	switch itemNeighborsConfig.NeighborType {
+	case config.NeighborTypeSimilar:
+		return itemNeighborsConfig.LabelSimilarity == config.SimilarityCosine
+	case config.NeighborTypeRelated:
+		return itemNeighborsConfig.FeedbackSimilarity == config.SimilarityCosine
+	default:
+		return itemNeighborsConfig.LabelSimilarity == config.SimilarityCosine &&
+			itemNeighborsConfig.FeedbackSimilarity == config.SimilarityCosine &&
+			itemNeighborsConfig.HybridAlpha == 0.5
+	}
+}
+
 func (m *Master) estimateFindUserNeighborsComplexity(dataset *ranking.DataSet) int {
 	complexity := dataset.UserCount() * dataset.UserCount()
 	if m.Config.Recommend.UserNeighbors.NeighborType == config.NeighborTypeRelated ||
@@ -559,7 +781,7 @@ func (t *FindUserNeighborsTask) run(j *task.JobsAllocator) error {
 	}
 
 	startTaskTime := time.Now()
-	t.taskMonitor.Start(TaskFindUserNeighbors, t.estimateFindUserNeighborsComplexity(dataset))
+	neighborTask := t.taskMonitor.Start(TaskFindUserNeighbors, t.estimateFindUserNeighborsComplexity(dataset))
 	log.Logger().Info("start searching neighbors of users",
 		zap.Int("n_cache", t.Config.Recommend.CacheSize))
 	// create progress tracker
@@ -622,9 +844,9 @@ func (t *FindUserNeighborsTask) run(j *task.JobsAllocator) error {
 	start := time.Now()
 	var err error
 	if t.Config.Recommend.UserNeighbors.EnableIndex {
-		err = t.findUserNeighborsIVF(dataset, labelIDF, itemIDF, completed, j)
+		err = t.findUserNeighborsIVF(neighborTask.Context(), dataset, labelIDF, itemIDF, completed, j)
 	} else {
-		err = t.findUserNeighborsBruteForce(dataset, labeledUsers, labelIDF, itemIDF, completed, j)
+		err = t.findUserNeighborsBruteForce(neighborTask.Context(), dataset, labeledUsers, labelIDF, itemIDF, completed, j)
 	}
 	searchTime := time.Since(start)
 
@@ -633,6 +855,10 @@ func (t *FindUserNeighborsTask) run(j *task.JobsAllocator) error {
 		log.Logger().Error("failed to searching neighbors of users", zap.Error(err))
 		t.taskMonitor.Fail(TaskFindUserNeighbors, err.Error())
 		FindUserNeighborsTotalSeconds.Set(0)
+	} else if neighborTask.Cancelled() {
+		// neighbors of remaining users are searched in the next round
+		log.Logger().Info("searching neighbors of users cancelled")
+		return nil
 	} else {
 		if err := t.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastUpdateUserNeighborsTime), time.Now())); err != nil {
 			log.Logger().Error("failed to set neighbors of users update time", zap.Error(err))
@@ -648,7 +874,7 @@ func (t *FindUserNeighborsTask) run(j *task.JobsAllocator) error {
 	return nil
 }
 
-func (m *Master) findUserNeighborsBruteForce(dataset *ranking.DataSet, labeledUsers [][]int32, labelIDF, itemIDF []float32, completed chan struct{}, j *task.JobsAllocator) error {
+func (m *Master) findUserNeighborsBruteForce(ctx context.Context, dataset *ranking.DataSet, labeledUsers [][]int32, labelIDF, itemIDF []float32, completed chan struct{}, j *task.JobsAllocator) error {
 	var (
 		updateUserCount     atomic.Float64
 		findNeighborSeconds atomic.Float64
@@ -672,6 +898,10 @@ func (m *Master) findUserNeighborsBruteForce(dataset *ranking.DataSet, labeledUs
 		defer func() {
 			completed <- struct{}{}
 		}()
+		// skip remaining jobs once cancelled
+		if ctx.Err() != nil {
+			return nil
+		}
 		userId := dataset.UserIndex.ToName(int32(userIndex))
 		if !m.checkUserNeighborCacheTimeout(userId) {
 			return nil
@@ -717,7 +947,7 @@ func (m *Master) findUserNeighborsBruteForce(dataset *ranking.DataSet, labeledUs
 	return nil
 }
 
-func (m *Master) findUserNeighborsIVF(dataset *ranking.DataSet, labelIDF, itemIDF []float32, completed chan struct{}, j *task.JobsAllocator) error {
+func (m *Master) findUserNeighborsIVF(ctx context.Context, dataset *ranking.DataSet, labelIDF, itemIDF []float32, completed chan struct{}, j *task.JobsAllocator) error {
 	var (
 		updateUserCount     atomic.Float64
 		buildIndexSeconds   atomic.Float64
@@ -764,6 +994,10 @@ func (m *Master) findUserNeighborsIVF(dataset *ranking.DataSet, labelIDF, itemID
 		defer func() {
 			completed <- struct{}{}
 		}()
+		// skip remaining jobs once cancelled
+		if ctx.Err() != nil {
+			return nil
+		}
 		userId := dataset.UserIndex.ToName(int32(userIndex))
 		if !m.checkUserNeighborCacheTimeout(userId) {
 			return nil
@@ -835,7 +1069,7 @@ func (m *Master) checkUserNeighborCacheTimeout(userId string) bool {
 	)
 	// check cache
 	if items, err := m.CacheClient.GetSorted(cache.Key(cache.UserNeighbors, userId), 0, -1); err != nil {
-		log.Logger().Error("failed to load user neighbors", zap.String("user_id", userId), zap.Error(err))
+		log.Logger().Error("failed to load user neighbors", log.UserId(userId), zap.Error(err))
 		return true
 	} else if len(items) == 0 {
 		return true
@@ -930,6 +1164,51 @@ func (m *Master) checkItemNeighborCacheTimeout(itemId string, categories []strin
 	return updateTime.Unix() <= modifiedTime.Unix()
 }
 
+// loadHiddenItems loads items hidden globally (category "") and in each category.
+func (m *Master) loadHiddenItems(categories []string) (map[string][]cache.Scored, error) {
+	hiddenItems := make(map[string][]cache.Scored)
+	end := float64(time.Now().Unix())
+	for _, category := range append([]string{""}, categories...) {
+		items, err := m.CacheClient.GetSortedByScore(cache.Key(cache.HiddenItemsV2, category), math.Inf(-1), end)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		hiddenItems[category] = items
+	}
+	return hiddenItems, nil
+}
+
+// removeHiddenNeighbors removes items hidden after the latest update of neighbors of an item from the cache, since
+// the cache won't be regenerated until it expires. Items hidden globally are removed from all categories.
+func (m *Master) removeHiddenNeighbors(itemId string, categories []string, hiddenItems map[string][]cache.Scored) error {
+	updateTime, err := m.CacheClient.Get(cache.Key(cache.LastUpdateItemNeighborsTime, itemId)).Time()
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+	var members []cache.SetMember
+	for _, category := range append([]string{""}, categories...) {
+		for _, item := range hiddenItems[category] {
+			if item.Score < float64(updateTime.Unix()) {
+				continue
+			}
+			if category == "" {
+				for _, c := range append([]string{""}, categories...) {
+					members = append(members, cache.Member(cache.Key(cache.ItemNeighbors, itemId, c), item.Id))
+				}
+			} else {
+				members = append(members, cache.Member(cache.Key(cache.ItemNeighbors, itemId, category), item.Id))
+			}
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	return m.CacheClient.RemSorted(members...)
+}
+
 type FitRankingModelTask struct {
 	*Master
 	lastNumFeedback int
@@ -983,19 +1262,44 @@ func (t *FitRankingModelTask) run(j *task.JobsAllocator) error {
 	}
 
 	startFitTime := time.Now()
+	fitTask := t.taskMonitor.Start(TaskFitRankingModel, rankingModel.Complexity())
 	score := rankingModel.Fit(t.rankingTrainSet, t.rankingTestSet, ranking.NewFitConfig().
 		SetJobsAllocator(j).
-		SetTask(t.taskMonitor.Start(TaskFitRankingModel, rankingModel.Complexity())))
+		SetTask(fitTask).
+		SetDeterministic(t.Config.Recommend.Collaborative.Deterministic))
+	if fitTask.Cancelled() {
+		// the model trained partially is discarded
+		log.Logger().Info("fit ranking model cancelled")
+		return nil
+	}
 	CollaborativeFilteringFitSeconds.Set(time.Since(startFitTime).Seconds())
 
 	// update ranking model
 	t.rankingModelMutex.Lock()
-	t.RankingModel = rankingModel
-	t.RankingModelVersion++
-	t.rankingScore = score
+	canary := t.Config.Recommend.Collaborative.CanaryPercent > 0 && t.RankingModel != nil && !t.RankingModel.Invalid()
+	var version int64
+	if canary {
+		// the trained model serves canary users until it is promoted
+		version = t.setCanaryRankingModel(rankingModel, score)
+	} else {
+		t.RankingModel = rankingModel
+		t.RankingModelVersion = t.nextModelVersion(RankingModelCheckpoint, t.RankingModelVersion)
+		t.rankingScore = score
+		version = t.RankingModelVersion
+	}
+	rankingModelName := t.rankingModelName
 	t.rankingModelMutex.Unlock()
+	record := NewRankingModelRecord(rankingModelName, version, rankingModel, score, t.rankingDataTime)
+	record.Status = lo.Ternary(canary, ModelCandidate, ModelLive)
+	t.registerRankingModel(record, rankingModel, score)
 	log.Logger().Info("fit ranking model complete",
-		zap.String("version", fmt.Sprintf("%x", t.RankingModelVersion)))
+		zap.String("version", fmt.Sprintf("%x", version)),
+		zap.Bool("canary", canary))
+	if canary {
+		if err := t.publishCanaryVersion(version); err != nil {
+			log.Logger().Error("failed to write version of canary ranking model", zap.Error(err))
+		}
+	}
 	CollaborativeFilteringNDCG10.Set(float64(score.NDCG))
 	CollaborativeFilteringRecall10.Set(float64(score.Recall))
 	CollaborativeFilteringPrecision10.Set(float64(score.Precision))
@@ -1004,30 +1308,168 @@ func (t *FitRankingModelTask) run(j *task.JobsAllocator) error {
 		log.Logger().Error("failed to write meta", zap.Error(err))
 	}
 
-	// caching model
+	// caching model, while the canary model is cached after promotion
+	if !canary {
+		t.rankingModelMutex.RLock()
+		t.localCache.RankingModelName = t.rankingModelName
+		t.localCache.RankingModelVersion = t.RankingModelVersion
+		t.localCache.RankingModel = rankingModel
+		t.localCache.RankingModelScore = score
+		t.rankingModelMutex.RUnlock()
+		t.exportEmbeddingsToBlob()
+		if err := t.localCache.WriteLocalCache(); err != nil {
+			log.Logger().Error("failed to write local cache", zap.Error(err))
+		} else {
+			log.Logger().Info("write model to local cache",
+				zap.String("ranking_model_name", t.localCache.RankingModelName),
+				zap.String("ranking_model_version", encoding.Hex(t.localCache.RankingModelVersion)),
+				zap.Float32("ranking_model_score", t.localCache.RankingModelScore.NDCG),
+				zap.Any("ranking_model_params", t.localCache.RankingModel.GetParams()))
+		}
+	}
+
+	t.taskMonitor.Finish(TaskFitRankingModel)
+	t.lastNumFeedback = numFeedback
+	return nil
+}
+
+// EvaluationReport is the offline evaluation report of a training run of the collaborative filtering model.
+type EvaluationReport struct {
+	Timestamp        time.Time
+	ModelName        string
+	Params           model.Params
+	NumTrainFeedback int
+	NumTestFeedback  int
+	Scores           []ranking.TopNScore
+}
+
+type EvaluateRankingModelTask struct {
+	*Master
+	lastNumFeedback int
+	lastModelName   string
+	lastParams      string
+}
+
+func NewEvaluateRankingModelTask(m *Master) *EvaluateRankingModelTask {
+	return &EvaluateRankingModelTask{Master: m}
+}
+
+func (t *EvaluateRankingModelTask) name() string {
+	return TaskEvaluateRankingModel
+}
+
+func (t *EvaluateRankingModelTask) priority() int {
+	return -t.rankingTrainSet.Count()
+}
+
+// run fits the current collaborative filtering model on earlier feedback and evaluates top-n recommendations on the
+// latest feedback. The report is saved to cache and the latest scores are exported as metrics.
+func (t *EvaluateRankingModelTask) run(j *task.JobsAllocator) error {
+	if !t.Config.Recommend.Evaluation.EnableEvaluation {
+		log.Logger().Debug("offline evaluation is disabled")
+		return nil
+	}
+	t.rankingDataMutex.RLock()
+	defer t.rankingDataMutex.RUnlock()
+	trainSet, testSet := t.rankingEvalTrainSet, t.rankingEvalTestSet
+	if trainSet == nil || testSet == nil || trainSet.Count() == 0 || testSet.Count() == 0 {
+		log.Logger().Info("no feedback for offline evaluation")
+		return nil
+	}
+
 	t.rankingModelMutex.RLock()
-	t.localCache.RankingModelName = t.rankingModelName
-	t.localCache.RankingModelVersion = t.RankingModelVersion
-	t.localCache.RankingModel = rankingModel
-	t.localCache.RankingModelScore = score
+	modelName := t.rankingModelName
+	rankingModel := ranking.Clone(t.RankingModel)
 	t.rankingModelMutex.RUnlock()
-	if t.localCache.ClickModel == nil || t.localCache.ClickModel.Invalid() {
-		log.Logger().Info("wait click model")
-	} else if err := t.localCache.WriteLocalCache(); err != nil {
-		log.Logger().Error("failed to write local cache", zap.Error(err))
-	} else {
-		log.Logger().Info("write model to local cache",
-			zap.String("ranking_model_name", t.localCache.RankingModelName),
-			zap.String("ranking_model_version", encoding.Hex(t.localCache.RankingModelVersion)),
-			zap.Float32("ranking_model_score", t.localCache.RankingModelScore.NDCG),
-			zap.Any("ranking_model_params", t.localCache.RankingModel.GetParams()))
+	numFeedback := trainSet.Count() + testSet.Count()
+	params := rankingModel.GetParams().ToString()
+	if numFeedback == t.lastNumFeedback && modelName == t.lastModelName && params == t.lastParams {
+		log.Logger().Info("nothing changed")
+		return nil
+	}
+
+	startTime := time.Now()
+	rankingModel.Fit(trainSet, testSet, ranking.NewFitConfig().
+		SetJobsAllocator(j).
+		SetTask(t.taskMonitor.Start(TaskEvaluateRankingModel, rankingModel.Complexity())).
+		SetDeterministic(t.Config.Recommend.Collaborative.Deterministic))
+	report := EvaluationReport{
+		Timestamp:        startTime,
+		ModelName:        modelName,
+		Params:           rankingModel.GetParams(),
+		NumTrainFeedback: trainSet.Count(),
+		NumTestFeedback:  testSet.Count(),
+		Scores: ranking.EvaluateTopN(rankingModel, testSet, trainSet, t.Config.Recommend.Evaluation.TopN,
+			t.Config.Recommend.Evaluation.NumTestUsers, j.MaxJobs(), 0),
+	}
+	for _, score := range report.Scores {
+		n := strconv.Itoa(score.N)
+		OfflineEvaluationPrecisionVec.WithLabelValues(n).Set(float64(score.Precision))
+		OfflineEvaluationRecallVec.WithLabelValues(n).Set(float64(score.Recall))
+		OfflineEvaluationNDCGVec.WithLabelValues(n).Set(float64(score.NDCG))
+		OfflineEvaluationMAPVec.WithLabelValues(n).Set(float64(score.MAP))
+		OfflineEvaluationCoverageVec.WithLabelValues(n).Set(float64(score.Coverage))
+		OfflineEvaluationDiversityVec.WithLabelValues(n).Set(float64(score.IntraListDiversity))
+	}
+	if err := t.saveEvaluationReport(report); err != nil {
+		return errors.Trace(err)
 	}
 
-	t.taskMonitor.Finish(TaskFitRankingModel)
 	t.lastNumFeedback = numFeedback
+	t.lastModelName = modelName
+	t.lastParams = params
+	t.taskMonitor.Finish(TaskEvaluateRankingModel)
+	log.Logger().Info("complete offline evaluation",
+		zap.String("model_name", modelName),
+		zap.Any("scores", report.Scores),
+		zap.Duration("used_time", time.Since(startTime)))
 	return nil
 }
 
+func (m *Master) saveEvaluationReport(report EvaluationReport) error {
+	buf, err := json.Marshal(report)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = m.CacheClient.AddSorted(cache.Sorted(cache.RankingEvaluations, []cache.Scored{
+		{Id: string(buf), Score: float64(report.Timestamp.Unix())},
+	})); err != nil {
+		return errors.Trace(err)
+	}
+	// remove reports beyond the history size
+	staleReports, err := m.CacheClient.GetSorted(cache.RankingEvaluations, m.Config.Recommend.Evaluation.HistorySize, -1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(staleReports) > 0 {
+		members := make([]cache.SetMember, len(staleReports))
+		for i, report := range staleReports {
+			members[i] = cache.Member(cache.RankingEvaluations, report.Id)
+		}
+		if err = m.CacheClient.RemSorted(members...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// GetEvaluationReports returns the latest n offline evaluation reports.
+func (m *Master) GetEvaluationReports(n int) ([]EvaluationReport, error) {
+	scores, err := m.CacheClient.GetSorted(cache.RankingEvaluations, 0, n-1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	reports := make([]EvaluationReport, 0, len(scores))
+	for _, score := range scores {
+		var report EvaluationReport
+		if err = json.Unmarshal([]byte(score.Id), &report); err != nil {
+			return nil, errors.Trace(err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
 // FitClickModelTask fits click model using latest data. After model fitted, following states are changed:
 // 1. Click model version are increased.
 // 2. Click model score are updated.
@@ -1096,17 +1538,29 @@ func (t *FitClickModelTask) run(j *task.JobsAllocator) error {
 		return nil
 	}
 	startFitTime := time.Now()
+	fitTask := t.taskMonitor.Start(TaskFitClickModel, clickModel.Complexity())
 	score := clickModel.Fit(t.clickTrainSet, t.clickTestSet, click.NewFitConfig().
 		SetJobsAllocator(j).
-		SetTask(t.taskMonitor.Start(TaskFitClickModel, clickModel.Complexity())))
+		SetTask(fitTask).
+		SetDeterministic(t.Config.Recommend.Collaborative.Deterministic))
+	if fitTask.Cancelled() {
+		// the model trained partially is discarded
+		log.Logger().Info("fit click model cancelled")
+		return nil
+	}
 	RankingFitSeconds.Set(time.Since(startFitTime).Seconds())
 
 	// update match model
 	t.clickModelMutex.Lock()
 	t.ClickModel = clickModel
 	t.clickScore = score
-	t.ClickModelVersion++
+	t.ClickModelVersion = t.nextModelVersion(ClickModelCheckpoint, t.ClickModelVersion)
+	version := t.ClickModelVersion
 	t.clickModelMutex.Unlock()
+	record := NewClickModelRecord(version, clickModel, score, t.clickDataTime)
+	record.Status = ModelLive
+	t.computeFeatureImportance(&record, clickModel, t.clickTestSet)
+	t.registerClickModel(record, clickModel, score)
 	log.Logger().Info("fit click model complete",
 		zap.String("version", fmt.Sprintf("%x", t.ClickModelVersion)))
 	RankingPrecision.Set(float64(score.Precision))
@@ -1123,9 +1577,7 @@ func (t *FitClickModelTask) run(j *task.JobsAllocator) error {
 	t.localCache.ClickModelVersion = t.ClickModelVersion
 	t.localCache.ClickModel = t.ClickModel
 	t.clickModelMutex.RUnlock()
-	if t.localCache.RankingModel == nil || t.localCache.RankingModel.Invalid() {
-		log.Logger().Info("wait ranking model")
-	} else if err := t.localCache.WriteLocalCache(); err != nil {
+	if err := t.localCache.WriteLocalCache(); err != nil {
 		log.Logger().Error("failed to write local cache", zap.Error(err))
 	} else {
 		log.Logger().Info("write model to local cache",
@@ -1189,7 +1641,10 @@ func (t *SearchRankingModelTask) run(j *task.JobsAllocator) error {
 	startTime := time.Now()
 	err := t.rankingModelSearcher.Fit(t.rankingTrainSet, t.rankingTestSet,
 		t.taskMonitor.Start(TaskSearchRankingModel, t.rankingModelSearcher.Complexity()), j)
-	if err != nil {
+	if errors.Is(err, context.Canceled) {
+		log.Logger().Info("searching collaborative filtering model cancelled")
+		return nil
+	} else if err != nil {
 		log.Logger().Error("failed to search collaborative filtering model", zap.Error(err))
 		return nil
 	}
@@ -1252,7 +1707,10 @@ func (t *SearchClickModelTask) run(j *task.JobsAllocator) error {
 	startTime := time.Now()
 	err := t.clickModelSearcher.Fit(t.clickTrainSet, t.clickTestSet,
 		t.taskMonitor.Start(TaskSearchClickModel, t.clickModelSearcher.Complexity()), j)
-	if err != nil {
+	if errors.Is(err, context.Canceled) {
+		log.Logger().Info("searching ranking model cancelled")
+		return nil
+	} else if err != nil {
 		log.Logger().Error("failed to search ranking model", zap.Error(err))
 		return nil
 	}
@@ -1290,46 +1748,69 @@ func (t *CacheGarbageCollectionTask) run(j *task.JobsAllocator) error {
 	}
 
 	log.Logger().Info("start cache garbage collection")
-	t.taskMonitor.Start(TaskCacheGarbageCollection, t.rankingTrainSet.UserCount()*9+t.rankingTrainSet.ItemCount()*4)
+	gcTask := t.taskMonitor.Start(TaskCacheGarbageCollection, t.rankingTrainSet.UserCount()*9+t.rankingTrainSet.ItemCount()*4)
 	var scanCount, reclaimCount int
+	var digests map[string]string
+	// keys of users are reclaimed as they are scanned, rather than obfuscated again
+	userCache := t.CacheClient
+	if t.obfuscator != nil {
+		userCache = t.obfuscator.Database
+	}
 	start := time.Now()
 	err := t.CacheClient.Scan(func(s string) error {
 		splits := strings.Split(s, "/")
 		if len(splits) <= 1 {
 			return nil
 		}
+		if gcTask.Cancelled() {
+			return errors.Trace(context.Canceled)
+		}
 		scanCount++
 		t.taskMonitor.Update(TaskCacheGarbageCollection, scanCount)
 		switch splits[0] {
 		case cache.UserNeighbors, cache.UserNeighborsDigest, cache.IgnoreItems,
-			cache.OfflineRecommend, cache.OfflineRecommendDigest, cache.CollaborativeRecommend,
+			cache.OfflineRecommend, cache.OfflineRecommendDigest, cache.CollaborativeRecommend, cache.ConsumedFilter,
 			cache.LastModifyUserTime, cache.LastUpdateUserNeighborsTime, cache.LastUpdateUserRecommendTime:
 			userId := splits[1]
-			// check user in dataset
-			if t.rankingTrainSet != nil && t.rankingTrainSet.UserIndex.ToNumber(userId) != base.NotId {
-				return nil
-			}
-			// check user in database
-			_, err := t.DataClient.GetUser(userId)
-			if !errors.Is(err, errors.NotFound) {
-				if err != nil {
-					log.Logger().Error("failed to load user", zap.String("user_id", userId), zap.Error(err))
+			var err error
+			if cache.IsDigest(userId) {
+				// check digest of users in database, including digests under the previous secret
+				if digests == nil {
+					if digests, err = t.resolveDigests(); err != nil {
+						return errors.Trace(err)
+					}
+				}
+				if _, exist := digests[userId]; exist {
+					return nil
+				}
+			} else if t.Config.Database.IdObfuscationSecret == "" {
+				// keys of raw user ids written before obfuscation are never read, otherwise check user in dataset
+				if t.rankingTrainSet != nil && t.rankingTrainSet.UserIndex.ToNumber(userId) != base.NotId {
+					return nil
+				}
+				// check user in database
+				_, err = t.DataClient.GetUser(userId)
+				if !errors.Is(err, errors.NotFound) {
+					if err != nil {
+						log.Logger().Error("failed to load user", log.UserId(userId), zap.Error(err))
+					}
+					return err
 				}
-				return err
 			}
 			// delete user cache
 			switch splits[0] {
 			case cache.UserNeighbors, cache.IgnoreItems, cache.CollaborativeRecommend, cache.OfflineRecommend:
-				err = t.CacheClient.SetSorted(s, nil)
-			case cache.UserNeighborsDigest, cache.OfflineRecommendDigest,
+				err = userCache.SetSorted(s, nil)
+			case cache.UserNeighborsDigest, cache.OfflineRecommendDigest, cache.ConsumedFilter,
 				cache.LastModifyUserTime, cache.LastUpdateUserNeighborsTime, cache.LastUpdateUserRecommendTime:
-				err = t.CacheClient.Delete(s)
+				err = userCache.Delete(s)
 			}
 			if err != nil {
 				return errors.Trace(err)
 			}
 			reclaimCount++
-		case cache.ItemNeighbors, cache.ItemNeighborsDigest, cache.LastModifyItemTime, cache.LastUpdateItemNeighborsTime:
+		case cache.ItemNeighbors, cache.ItemNeighborsDigest, cache.LastModifyItemTime, cache.LastUpdateItemNeighborsTime,
+			cache.CovisitedItems:
 			itemId := splits[1]
 			// check item in dataset
 			if t.rankingTrainSet != nil && t.rankingTrainSet.ItemIndex.ToNumber(itemId) != base.NotId {
@@ -1345,7 +1826,7 @@ func (t *CacheGarbageCollectionTask) run(j *task.JobsAllocator) error {
 			}
 			// delete item cache
 			switch splits[0] {
-			case cache.ItemNeighbors:
+			case cache.ItemNeighbors, cache.CovisitedItems:
 				err = t.CacheClient.SetSorted(s, nil)
 			case cache.ItemNeighborsDigest, cache.LastModifyItemTime, cache.LastUpdateItemNeighborsTime:
 				err = t.CacheClient.Delete(s)
@@ -1354,10 +1835,87 @@ func (t *CacheGarbageCollectionTask) run(j *task.JobsAllocator) error {
 				return errors.Trace(err)
 			}
 			reclaimCount++
+		case cache.SessionRecommend, cache.SessionRecommendTime:
+			signature := splits[1]
+			// check merge time of session recommendation
+			mergeTime, err := t.CacheClient.Get(cache.Key(cache.SessionRecommendTime, signature)).Time()
+			if err != nil && !errors.Is(err, errors.NotFound) {
+				return errors.Trace(err)
+			}
+			if !mergeTime.IsZero() && mergeTime.After(start.Add(-t.Config.Recommend.Online.SessionRecommendTTL)) {
+				return nil
+			}
+			// delete session recommendation cache
+			switch splits[0] {
+			case cache.SessionRecommend:
+				err = t.CacheClient.SetSorted(s, nil)
+			case cache.SessionRecommendTime:
+				err = t.CacheClient.Delete(s)
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			reclaimCount++
+		case cache.SessionFeedback, cache.SessionActiveTime:
+			sessionId := splits[1]
+			// check active time of session
+			activeTime, err := t.CacheClient.Get(cache.Key(cache.SessionActiveTime, sessionId)).Time()
+			if err != nil && !errors.Is(err, errors.NotFound) {
+				return errors.Trace(err)
+			}
+			if !activeTime.IsZero() && activeTime.After(start.Add(-t.Config.Server.SessionIdleTTL)) {
+				return nil
+			}
+			// delete expired session
+			switch splits[0] {
+			case cache.SessionFeedback:
+				err = t.CacheClient.SetSorted(s, nil)
+			case cache.SessionActiveTime:
+				err = t.CacheClient.Delete(s)
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			reclaimCount++
+		case cache.ActiveUsersSketch, cache.ActiveItemsSketch:
+			// delete daily sketches out of the monthly window
+			day, err := time.Parse("2006-01-02", splits[1])
+			if err != nil || !day.Before(start.AddDate(0, 0, -monthlyDays-1)) {
+				return nil
+			}
+			if err = t.CacheClient.Delete(s); err != nil {
+				return errors.Trace(err)
+			}
+			reclaimCount++
+		case cache.RecommendSnapshot:
+			// check create time of recommendation snapshot
+			value, err := t.CacheClient.Get(s).String()
+			if errors.Is(err, errors.NotFound) {
+				return nil
+			} else if err != nil {
+				return errors.Trace(err)
+			}
+			var snapshot struct {
+				CreateTime time.Time
+			}
+			if err = json.Unmarshal([]byte(value), &snapshot); err == nil &&
+				snapshot.CreateTime.After(start.Add(-t.Config.Server.PageTokenTTL)) {
+				return nil
+			}
+			// delete recommendation snapshot
+			if err = t.CacheClient.Delete(s); err != nil {
+				return errors.Trace(err)
+			}
+			reclaimCount++
 		}
 		return nil
 	})
-	// remove stale hidden items
+	if errors.IsNotSupported(err) {
+		// keys of cache stores unable to list keys are reclaimed by TTL
+		log.Logger().Info("skip scanning cache", zap.Error(err))
+		err = nil
+	}
+	// remove stale hidden items, offline recommendation generated before them have expired
 	if err := t.CacheClient.RemSortedByScore(cache.HiddenItemsV2, math.Inf(-1), float64(time.Now().Add(-t.Config.Recommend.CacheExpire).Unix())); err != nil {
 		return errors.Trace(err)
 	}
@@ -1368,10 +1926,386 @@ func (t *CacheGarbageCollectionTask) run(j *task.JobsAllocator) error {
 	return errors.Trace(err)
 }
 
-// LoadDataFromDatabase loads dataset from data store.
-func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes, readTypes []string, itemTTL, positiveFeedbackTTL uint, evaluator *OnlineEvaluator) (
-	rankingDataset *ranking.DataSet, clickDataset *click.Dataset, latestItems map[string][]cache.Scored, popularItems map[string][]cache.Scored, err error) {
-	m.taskMonitor.Start(TaskLoadDataset, 5)
+type CollectExpiredOverridesTask struct {
+	*Master
+}
+
+func NewCollectExpiredOverridesTask(m *Master) *CollectExpiredOverridesTask {
+	return &CollectExpiredOverridesTask{m}
+}
+
+func (t *CollectExpiredOverridesTask) name() string {
+	return TaskCollectExpiredOverrides
+}
+
+func (t *CollectExpiredOverridesTask) priority() int {
+	return -t.rankingTrainSet.UserCount()
+}
+
+// run removes expired pinned items and blocked items from overrides of users. Overrides without any unexpired
+// pinned items or blocked items are deleted.
+func (t *CollectExpiredOverridesTask) run(_ *task.JobsAllocator) error {
+	log.Logger().Info("start collecting expired user overrides")
+	t.taskMonitor.Start(TaskCollectExpiredOverrides, 1)
+	start := time.Now()
+	var numUpdated, numDeleted int
+	overridesChan, errChan := t.DataClient.GetUserOverridesStream(batchSize)
+	for batch := range overridesChan {
+		for _, overrides := range batch {
+			if !overrides.RemoveExpired(start) {
+				continue
+			}
+			if overrides.IsEmpty() {
+				if err := t.DataClient.DeleteUserOverrides(overrides.UserId); err != nil {
+					return errors.Trace(err)
+				}
+				numDeleted++
+			} else {
+				if err := t.DataClient.SetUserOverrides(overrides); err != nil {
+					return errors.Trace(err)
+				}
+				numUpdated++
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Finish(TaskCollectExpiredOverrides)
+	log.Logger().Info("complete collecting expired user overrides",
+		zap.Int("n_updated", numUpdated),
+		zap.Int("n_deleted", numDeleted),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+type CollectExpiredAuditLogsTask struct {
+	*Master
+}
+
+func NewCollectExpiredAuditLogsTask(m *Master) *CollectExpiredAuditLogsTask {
+	return &CollectExpiredAuditLogsTask{m}
+}
+
+func (t *CollectExpiredAuditLogsTask) name() string {
+	return TaskCollectExpiredAuditLogs
+}
+
+func (t *CollectExpiredAuditLogsTask) priority() int {
+	return -t.rankingTrainSet.UserCount()
+}
+
+// run deletes audit logs older than the retention. Audit logs are kept forever if the retention is zero.
+func (t *CollectExpiredAuditLogsTask) run(_ *task.JobsAllocator) error {
+	retention := t.Config.Server.Audit.Retention
+	if retention <= 0 {
+		return nil
+	}
+	log.Logger().Info("start collecting expired audit logs")
+	t.taskMonitor.Start(TaskCollectExpiredAuditLogs, 1)
+	start := time.Now()
+	if err := t.DataClient.DeleteAuditLogs(start.Add(-retention)); err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Finish(TaskCollectExpiredAuditLogs)
+	log.Logger().Info("complete collecting expired audit logs",
+		zap.Duration("retention", retention),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+type CollectExpiredHistoryTask struct {
+	*Master
+}
+
+func NewCollectExpiredHistoryTask(m *Master) *CollectExpiredHistoryTask {
+	return &CollectExpiredHistoryTask{m}
+}
+
+func (t *CollectExpiredHistoryTask) name() string {
+	return TaskCollectExpiredHistory
+}
+
+func (t *CollectExpiredHistoryTask) priority() int {
+	return -t.rankingTrainSet.UserCount()
+}
+
+// run deletes snapshots of served recommendation in time buckets older than the retention. Snapshots are collected
+// even if archiving is disabled, so that snapshots archived before are removed.
+func (t *CollectExpiredHistoryTask) run(_ *task.JobsAllocator) error {
+	log.Logger().Info("start collecting expired recommendation history")
+	t.taskMonitor.Start(TaskCollectExpiredHistory, 1)
+	start := time.Now()
+	retention := t.Config.Server.History.Retention
+	if err := t.DataClient.DeleteRecommendSnapshots(start.Add(-retention)); err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Finish(TaskCollectExpiredHistory)
+	log.Logger().Info("complete collecting expired recommendation history",
+		zap.Duration("retention", retention),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+type QualityGateTask struct {
+	*Master
+}
+
+func NewQualityGateTask(m *Master) *QualityGateTask {
+	return &QualityGateTask{m}
+}
+
+func (t *QualityGateTask) name() string {
+	return TaskQualityGate
+}
+
+func (t *QualityGateTask) priority() int {
+	return -t.rankingTrainSet.ItemCount()
+}
+
+// run hides items whose ratios of positive feedback to read feedback in the window are lower than the threshold.
+// Items hidden by the quality gate are marked with HiddenReasonLowQuality and unhidden once they pass the quality gate.
+// Items hidden for other reasons are left untouched.
+func (t *QualityGateTask) run(_ *task.JobsAllocator) error {
+	if !t.Config.Recommend.Quality.EnableQualityGate {
+		log.Logger().Debug("quality gate is disabled")
+		return nil
+	}
+	log.Logger().Info("start hiding low quality items")
+	t.taskMonitor.Start(TaskQualityGate, 3)
+	start := time.Now()
+	timeLimit := start.Add(-t.Config.Recommend.Quality.QualityWindow)
+
+	// STEP 1: count positive feedback
+	positiveCount := make(map[string]int)
+	feedbackChan, errChan := t.DataClient.GetFeedbackStream(batchSize, &timeLimit, t.Config.Recommend.DataSource.PositiveFeedbackTypes...)
+	for feedback := range feedbackChan {
+		for _, f := range feedback {
+			positiveCount[f.ItemId]++
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Update(TaskQualityGate, 1)
+
+	// STEP 2: count read feedback
+	readCount := make(map[string]int)
+	feedbackChan, errChan = t.DataClient.GetFeedbackStream(batchSize, &timeLimit, t.Config.Recommend.DataSource.ReadFeedbackTypes...)
+	for feedback := range feedbackChan {
+		for _, f := range feedback {
+			readCount[f.ItemId]++
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Update(TaskQualityGate, 2)
+
+	// STEP 3: hide or unhide items
+	var numHidden, numUnhidden int
+	itemChan, errChan := t.DataClient.GetItemStream(batchSize, nil)
+	for items := range itemChan {
+		var hide, unhide []string
+		for _, item := range items {
+			if t.isLowQuality(positiveCount[item.ItemId], readCount[item.ItemId]) {
+				if !item.IsHidden {
+					hide = append(hide, item.ItemId)
+				}
+			} else if item.IsHidden && item.HiddenReason == data.HiddenReasonLowQuality {
+				unhide = append(unhide, item.ItemId)
+			}
+		}
+		if err := t.hideItems(hide); err != nil {
+			return errors.Trace(err)
+		}
+		if err := t.unhideItems(unhide); err != nil {
+			return errors.Trace(err)
+		}
+		numHidden += len(hide)
+		numUnhidden += len(unhide)
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Finish(TaskQualityGate)
+	LowQualityItemsHidden.Set(float64(numHidden))
+	LowQualityItemsUnhidden.Set(float64(numUnhidden))
+	log.Logger().Info("complete hiding low quality items",
+		zap.Int("n_hidden", numHidden),
+		zap.Int("n_unhidden", numUnhidden),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+func (t *QualityGateTask) isLowQuality(positiveCount, readCount int) bool {
+	if readCount == 0 || readCount < t.Config.Recommend.Quality.MinImpressions {
+		return false
+	}
+	return float64(positiveCount)/float64(readCount) < t.Config.Recommend.Quality.MinPositiveRatio
+}
+
+func (t *QualityGateTask) hideItems(itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
+	}
+	isHidden, reason := true, data.HiddenReasonLowQuality
+	if err := t.DataClient.BatchModifyItems(itemIds, data.ItemPatch{IsHidden: &isHidden, HiddenReason: &reason}); err != nil {
+		return errors.Trace(err)
+	}
+	timestamp := float64(time.Now().Unix())
+	return t.CacheClient.AddSorted(cache.Sorted(cache.HiddenItemsV2, lo.Map(itemIds, func(itemId string, _ int) cache.Scored {
+		return cache.Scored{Id: itemId, Score: timestamp}
+	})))
+}
+
+func (t *QualityGateTask) unhideItems(itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
+	}
+	isHidden, reason := false, ""
+	if err := t.DataClient.BatchModifyItems(itemIds, data.ItemPatch{IsHidden: &isHidden, HiddenReason: &reason}); err != nil {
+		return errors.Trace(err)
+	}
+	return t.CacheClient.RemSorted(lo.Map(itemIds, func(itemId string, _ int) cache.SetMember {
+		return cache.Member(cache.HiddenItemsV2, itemId)
+	})...)
+}
+
+type FindTrendingItemsTask struct {
+	*Master
+}
+
+func NewFindTrendingItemsTask(m *Master) *FindTrendingItemsTask {
+	return &FindTrendingItemsTask{m}
+}
+
+func (t *FindTrendingItemsTask) name() string {
+	return TaskFindTrendingItems
+}
+
+func (t *FindTrendingItemsTask) priority() int {
+	return -t.rankingTrainSet.ItemCount()
+}
+
+// run ranks items by growth of positive feedback in the latest window compared with the previous window. Only items
+// with growing positive feedback are trending. Feedback before the time of an item, decided by the item time field, is
+// ignored, so that feedback backfilled with items doesn't count towards their growth. Trending items are written for
+// all categories, including categories without trending items.
+func (t *FindTrendingItemsTask) run(_ *task.JobsAllocator) error {
+	if !t.Config.Recommend.Trending.EnableTrending {
+		log.Logger().Debug("trending items are disabled")
+		return nil
+	}
+	log.Logger().Info("start finding trending items")
+	t.taskMonitor.Start(TaskFindTrendingItems, 3)
+	start := time.Now()
+	window := t.Config.Recommend.Trending.TrendingWindow
+	recentLimit, previousLimit := start.Add(-window), start.Add(-2*window)
+
+	// STEP 1: load categories and times of visible items
+	trendingFilters := make(map[string]*heap.TopKFilter[string, float64])
+	trendingFilters[""] = heap.NewTopKFilter[string, float64](t.Config.Recommend.CacheSize)
+	var itemIds []string
+	itemCategories, itemTimes := make(map[string][]string), make(map[string]time.Time)
+	itemChan, errChan := t.DataClient.GetItemStream(batchSize, nil)
+	for items := range itemChan {
+		for _, item := range items {
+			for _, category := range item.Categories {
+				if _, exist := trendingFilters[category]; !exist {
+					trendingFilters[category] = heap.NewTopKFilter[string, float64](t.Config.Recommend.CacheSize)
+				}
+			}
+			if item.IsHidden {
+				continue
+			}
+			itemIds = append(itemIds, item.ItemId)
+			itemCategories[item.ItemId] = item.Categories
+			itemTimes[item.ItemId] = item.Time(t.Config.Recommend.DataSource.ItemTimeField)
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Update(TaskFindTrendingItems, 1)
+
+	// STEP 2: count positive feedback in the latest window and the previous window
+	recentCount, previousCount := make(map[string]int), make(map[string]int)
+	feedbackChan, errChan := t.DataClient.GetFeedbackStream(batchSize, &previousLimit, t.Config.Recommend.DataSource.PositiveFeedbackTypes...)
+	for feedback := range feedbackChan {
+		for _, f := range feedback {
+			// feedback of zero weight is not positive
+			if t.Config.Recommend.DataSource.GetFeedbackWeight(f.FeedbackType) == 0 {
+				continue
+			}
+			if f.Timestamp.Before(previousLimit) || f.Timestamp.After(start) {
+				continue
+			}
+			if itemTime, exist := itemTimes[f.ItemId]; !exist || f.Timestamp.Before(itemTime) {
+				continue
+			}
+			if f.Timestamp.Before(recentLimit) {
+				previousCount[f.ItemId]++
+			} else {
+				recentCount[f.ItemId]++
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	t.taskMonitor.Update(TaskFindTrendingItems, 2)
+
+	// STEP 3: rank items by trending scores
+	for _, itemId := range itemIds {
+		if recentCount[itemId] <= previousCount[itemId] {
+			continue
+		}
+		score := trendingScore(recentCount[itemId], previousCount[itemId], t.Config.Recommend.Trending.Smoothing)
+		if score <= 1 {
+			// growth is not significant
+			continue
+		}
+		trendingFilters[""].Push(itemId, score)
+		for _, category := range itemCategories[itemId] {
+			trendingFilters[category].Push(itemId, score)
+		}
+	}
+	numTrending := trendingFilters[""].Len()
+	for category, trendingFilter := range trendingFilters {
+		items, scores := trendingFilter.PopAll()
+		if err := t.CacheClient.SetSorted(cache.Key(cache.TrendingItems, category), cache.CreateScoredItems(items, scores)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := t.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastUpdateTrendingItemsTime), time.Now())); err != nil {
+		log.Logger().Error("failed to write latest update trending items time", zap.Error(err))
+	}
+	t.taskMonitor.Finish(TaskFindTrendingItems)
+	log.Logger().Info("complete finding trending items",
+		zap.Int("n_trending", numTrending),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+// trendingConfidence is the z-score of the confidence level of trending scores (97.5% one-sided).
+const trendingConfidence = 1.96
+
+// trendingScore is the lower confidence bound of the ratio of positive feedback in the latest window to positive
+// feedback in the previous window. Both counts are added by the smoothing constant. Since counts are Poisson, the
+// standard error of the log ratio is sqrt(1/recent+1/previous), so that growth of items with few feedback (such as
+// 0 to 15) ranks below significant growth of items with lots of feedback (such as 1000 to 2000).
+func trendingScore(recentCount, previousCount int, smoothing float64) float64 {
+	recent, previous := float64(recentCount)+smoothing, float64(previousCount)+smoothing
+	return math.Exp(math.Log(recent/previous) - trendingConfidence*math.Sqrt(1/recent+1/previous))
+}
+
+// LoadDataFromDatabase loads dataset from data store. Popular items of labels are collected for labels shared by at
+// least two items. Items with negative feedback from a user are excluded from positive feedback of the user and used
+// as hard negatives in training.
+func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes, readTypes, negFeedbackTypes []string, itemTTL, positiveFeedbackTTL uint, evaluator *OnlineEvaluator) (
+	rankingDataset *ranking.DataSet, clickDataset *click.Dataset, latestItems map[string][]cache.Scored, popularItems map[string][]cache.Scored, labelPopularItems map[string][]cache.Scored, err error) {
+	loadTask := m.taskMonitor.Start(TaskLoadDataset, 5)
 
 	// setup time limit
 	var itemTimeLimit, feedbackTimeLimit *time.Time
@@ -1383,20 +2317,20 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 		temp := time.Now().AddDate(0, 0, -int(positiveFeedbackTTL))
 		feedbackTimeLimit = &temp
 	}
+	now := time.Now()
 	timeWindowLimit := time.Time{}
 	if m.Config.Recommend.Popular.PopularWindow > 0 {
-		timeWindowLimit = time.Now().Add(-m.Config.Recommend.Popular.PopularWindow)
+		timeWindowLimit = now.Add(-m.Config.Recommend.Popular.PopularWindow)
 	}
 	rankingDataset = ranking.NewMapIndexDataset()
+	rankingDataset.SetChunkSize(m.Config.Recommend.DataSource.ChunkSize)
 
 	// create filers for latest items
 	latestItemsFilters := make(map[string]*heap.TopKFilter[string, float64])
 	latestItemsFilters[""] = heap.NewTopKFilter[string, float64](m.Config.Recommend.CacheSize)
 
 	// STEP 1: pull users
-	userLabelCount := make(map[string]int)
-	userLabelFirst := make(map[string]int32)
-	userLabelIndex := base.NewMapIndex()
+	userLabels := newLabelInterner()
 	start := time.Now()
 	userChan, errChan := database.GetUserStream(batchSize)
 	for users := range userChan {
@@ -1407,31 +2341,21 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 				rankingDataset.UserLabels = append(rankingDataset.UserLabels, nil)
 			}
 			rankingDataset.NumUserLabelUsed += len(user.Labels)
-			rankingDataset.UserLabels[userIndex] = make([]int32, 0, len(user.Labels))
+			rankingDataset.UserLabels[userIndex] = nil
 			for _, label := range user.Labels {
-				userLabelCount[label]++
-				// Memorize the first occurrence.
-				if userLabelCount[label] == 1 {
-					userLabelFirst[label] = userIndex
-				}
-				// Add the label to the index in second occurrence.
-				if userLabelCount[label] == 2 {
-					userLabelIndex.Add(label)
-					firstUserIndex := userLabelFirst[label]
-					rankingDataset.UserLabels[firstUserIndex] = append(rankingDataset.UserLabels[firstUserIndex], userLabelIndex.ToNumber(label))
-				}
-				// Add the label to the user.
-				if userLabelCount[label] > 1 {
-					rankingDataset.UserLabels[userIndex] = append(rankingDataset.UserLabels[userIndex], userLabelIndex.ToNumber(label))
-				}
+				userLabels.intern(rankingDataset.UserLabels, userIndex, label)
 			}
 		}
 	}
 	if err = <-errChan; err != nil {
-		return nil, nil, nil, nil, errors.Trace(err)
+		return nil, nil, nil, nil, nil, errors.Trace(err)
 	}
+	userLabelIndex := userLabels.release()
 	rankingDataset.NumUserLabels = userLabelIndex.Len()
 	m.taskMonitor.Update(TaskLoadDataset, 1)
+	if loadTask.Cancelled() {
+		return nil, nil, nil, nil, nil, errors.Trace(context.Canceled)
+	}
 	log.Logger().Debug("pulled users from database",
 		zap.Int("n_users", rankingDataset.UserCount()),
 		zap.Int32("n_user_labels", userLabelIndex.Len()),
@@ -1439,9 +2363,7 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 	LoadDatasetStepSecondsVec.WithLabelValues("load_users").Set(time.Since(start).Seconds())
 
 	// STEP 2: pull items
-	itemLabelCount := make(map[string]int)
-	itemLabelFirst := make(map[string]int32)
-	itemLabelIndex := base.NewMapIndex()
+	itemLabels := newLabelInterner()
 	start = time.Now()
 	itemChan, errChan := database.GetItemStream(batchSize, itemTimeLimit)
 	for items := range itemChan {
@@ -1455,64 +2377,98 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 				rankingDataset.CategorySet.Add(item.Categories...)
 			}
 			rankingDataset.NumItemLabelUsed += len(item.Labels)
-			rankingDataset.ItemLabels[itemIndex] = make([]int32, 0, len(item.Labels))
+			rankingDataset.ItemLabels[itemIndex] = nil
 			for _, label := range item.Labels {
-				itemLabelCount[label]++
-				// Memorize the first occurrence.
-				if itemLabelCount[label] == 1 {
-					itemLabelFirst[label] = itemIndex
-				}
-				// Add the label to the index in second occurrence.
-				if itemLabelCount[label] == 2 {
-					itemLabelIndex.Add(label)
-					firstItemIndex := itemLabelFirst[label]
-					rankingDataset.ItemLabels[firstItemIndex] = append(rankingDataset.ItemLabels[firstItemIndex], itemLabelIndex.ToNumber(label))
-				}
-				// Add the label to the item.
-				if itemLabelCount[label] > 1 {
-					rankingDataset.ItemLabels[itemIndex] = append(rankingDataset.ItemLabels[itemIndex], itemLabelIndex.ToNumber(label))
-				}
+				itemLabels.intern(rankingDataset.ItemLabels, itemIndex, label)
 			}
+			itemTime := item.Time(m.Config.Recommend.DataSource.ItemTimeField)
 			if item.IsHidden { // set hidden flag
 				rankingDataset.HiddenItems[itemIndex] = true
-			} else if !item.Timestamp.IsZero() { // add items to the latest items filter
-				latestItemsFilters[""].Push(item.ItemId, float64(item.Timestamp.Unix()))
+			} else if !itemTime.IsZero() { // add items to the latest items filter
+				latestItemsFilters[""].Push(item.ItemId, float64(itemTime.Unix()))
 				for _, category := range item.Categories {
 					if _, exist := latestItemsFilters[category]; !exist {
 						latestItemsFilters[category] = heap.NewTopKFilter[string, float64](m.Config.Recommend.CacheSize)
 					}
-					latestItemsFilters[category].Push(item.ItemId, float64(item.Timestamp.Unix()))
+					latestItemsFilters[category].Push(item.ItemId, float64(itemTime.Unix()))
 				}
 			}
 		}
 	}
 	if err = <-errChan; err != nil {
-		return nil, nil, nil, nil, errors.Trace(err)
+		return nil, nil, nil, nil, nil, errors.Trace(err)
 	}
+	itemLabelIndex := itemLabels.release()
 	rankingDataset.NumItemLabels = itemLabelIndex.Len()
 	m.taskMonitor.Update(TaskLoadDataset, 2)
+	if loadTask.Cancelled() {
+		return nil, nil, nil, nil, nil, errors.Trace(context.Canceled)
+	}
 	log.Logger().Debug("pulled items from database",
 		zap.Int("n_items", rankingDataset.ItemCount()),
 		zap.Int32("n_item_labels", itemLabelIndex.Len()),
 		zap.Duration("used_time", time.Since(start)))
 	LoadDatasetStepSecondsVec.WithLabelValues("load_items").Set(time.Since(start).Seconds())
 
-	// create positive set
-	popularCount := make([]int32, rankingDataset.ItemCount())
-	positiveSet := make([]*i32set.Set, rankingDataset.UserCount())
-	for i := range positiveSet {
-		positiveSet[i] = i32set.New()
+	// collect context of feedback if context is used by the click model
+	var contexts *feedbackContexts
+	if contextKeys := m.Config.Recommend.DataSource.ContextKeys; len(contextKeys) > 0 {
+		contexts = newFeedbackContexts(contextKeys)
 	}
 
-	// STEP 3: pull positive feedback
+	// pull hard negative feedback, which never expires
 	var feedbackCount float64
 	start = time.Now()
+	if len(negFeedbackTypes) > 0 {
+		feedbackChan, errChan := database.GetFeedbackStream(batchSize, nil, negFeedbackTypes...)
+		for feedback := range feedbackChan {
+			for _, f := range feedback {
+				feedbackCount++
+				userIndex := rankingDataset.UserIndex.ToNumber(f.UserId)
+				if userIndex == base.NotId {
+					continue
+				}
+				itemIndex := rankingDataset.ItemIndex.ToNumber(f.ItemId)
+				if itemIndex == base.NotId {
+					continue
+				}
+				rankingDataset.AddHardNegative(userIndex, itemIndex)
+				if contexts != nil {
+					contexts.add(userIndex, itemIndex, f)
+				}
+			}
+		}
+		if err = <-errChan; err != nil {
+			return nil, nil, nil, nil, nil, errors.Trace(err)
+		}
+		for userIndex := range rankingDataset.HardNegatives {
+			rankingDataset.HardNegatives[userIndex] = sortedUnique(rankingDataset.HardNegatives[userIndex])
+		}
+	}
+	if loadTask.Cancelled() {
+		return nil, nil, nil, nil, nil, errors.Trace(context.Canceled)
+	}
+	log.Logger().Debug("pulled hard negative feedback from database",
+		zap.Duration("used_time", time.Since(start)))
+	LoadDatasetStepSecondsVec.WithLabelValues("load_hard_negative_feedback").Set(time.Since(start).Seconds())
+
+	// STEP 3: pull positive feedback
+	popularScore := make([]float64, rankingDataset.ItemCount())
+	start = time.Now()
+	// popularity and online evaluation count all feedback, while only sampled feedback is used in training
+	sampler := newFeedbackSampler(m.Config.Recommend.DataSource.Sampling, m.Config.Recommend.Collaborative.RandomSeed,
+		rankingDataset.UserCount(), now, func(f sampledFeedback) {
+			rankingDataset.AddTimedIndexedFeedback(f.userIndex, f.itemIndex, f.weight, f.timestamp)
+		})
 	feedbackChan, errChan := database.GetFeedbackStream(batchSize, feedbackTimeLimit, posFeedbackTypes...)
 	for feedback := range feedbackChan {
 		for _, f := range feedback {
 			feedbackCount++
-			rankingDataset.AddFeedback(f.UserId, f.ItemId, false)
-			// insert feedback to positive set
+			// feedback of zero weight is not positive
+			weight := m.Config.Recommend.DataSource.GetFeedbackWeight(f.FeedbackType)
+			if weight == 0 {
+				continue
+			}
 			userIndex := rankingDataset.UserIndex.ToNumber(f.UserId)
 			if userIndex == base.NotId {
 				continue
@@ -1521,30 +2477,54 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 			if itemIndex == base.NotId {
 				continue
 			}
-			positiveSet[userIndex].Add(itemIndex)
+			// items with negative feedback are not positive
+			if containsSorted(rankingDataset.UserHardNegatives(userIndex), itemIndex) {
+				continue
+			}
+			sampler.Add(f, userIndex, itemIndex, float32(weight))
+			if contexts != nil {
+				contexts.add(userIndex, itemIndex, f)
+			}
 			// insert feedback to popularity counter
 			if f.Timestamp.After(timeWindowLimit) && !rankingDataset.HiddenItems[itemIndex] {
-				popularCount[itemIndex]++
+				popularScore[itemIndex] += m.popularityWeight(f.Timestamp, now)
 			}
 			evaluator.Positive(f.FeedbackType, userIndex, itemIndex, f.Timestamp)
 		}
 	}
 	if err = <-errChan; err != nil {
-		return nil, nil, nil, nil, errors.Trace(err)
+		return nil, nil, nil, nil, nil, errors.Trace(err)
+	}
+	sampler.Flush()
+	if sampler.Enabled() {
+		cfg := m.Config.Recommend.DataSource.Sampling
+		log.Logger().Info("sampled positive feedback",
+			zap.Int("max_feedback_per_user", cfg.MaxFeedbackPerUser),
+			zap.Duration("sample_cutoff", cfg.SampleCutoff),
+			zap.Float64("sample_rate", cfg.SampleRate),
+			zap.Int("max_feedback", cfg.MaxFeedback),
+			zap.Int64("seed", m.Config.Recommend.Collaborative.RandomSeed),
+			zap.Int("n_streamed", sampler.numStreamed),
+			zap.Int("n_rate_dropped", sampler.numRateDropped),
+			zap.Int("n_user_dropped", sampler.numUserDropped),
+			zap.Int("n_total_dropped", sampler.numTotalDropped),
+			zap.Int("n_positive_feedback", rankingDataset.Count()),
+			zap.Int("n_users", rankingDataset.UserCount()),
+			zap.Int("n_items", rankingDataset.ItemCount()))
 	}
 	m.taskMonitor.Update(TaskLoadDataset, 3)
+	if loadTask.Cancelled() {
+		return nil, nil, nil, nil, nil, errors.Trace(context.Canceled)
+	}
 	log.Logger().Debug("pulled positive feedback from database",
 		zap.Int("n_positive_feedback", rankingDataset.Count()),
 		zap.Duration("used_time", time.Since(start)))
 	LoadDatasetStepSecondsVec.WithLabelValues("load_positive_feedback").Set(time.Since(start).Seconds())
 
-	// create negative set
-	negativeSet := make([]*i32set.Set, rankingDataset.UserCount())
-	for i := range negativeSet {
-		negativeSet[i] = i32set.New()
-	}
-
 	// STEP 4: pull negative feedback
+	// Read items are collected without lookups of positive feedback, and they are deduplicated and excluded from
+	// positive feedback user by user in the next step.
+	negatives := make([][]int32, rankingDataset.UserCount())
 	start = time.Now()
 	feedbackChan, errChan = database.GetFeedbackStream(batchSize, feedbackTimeLimit, readTypes...)
 	for feedback := range feedbackChan {
@@ -1558,16 +2538,20 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 			if itemIndex == base.NotId {
 				continue
 			}
-			if !positiveSet[userIndex].Has(itemIndex) {
-				negativeSet[userIndex].Add(itemIndex)
-			}
+			negatives[userIndex] = append(negatives[userIndex], itemIndex)
 			evaluator.Read(userIndex, itemIndex, f.Timestamp)
+			if contexts != nil {
+				contexts.add(userIndex, itemIndex, f)
+			}
 		}
 	}
 	if err = <-errChan; err != nil {
-		return nil, nil, nil, nil, errors.Trace(err)
+		return nil, nil, nil, nil, nil, errors.Trace(err)
 	}
 	m.taskMonitor.Update(TaskLoadDataset, 4)
+	if loadTask.Cancelled() {
+		return nil, nil, nil, nil, nil, errors.Trace(context.Canceled)
+	}
 	FeedbacksTotal.Set(feedbackCount)
 	log.Logger().Debug("pulled negative feedback from database",
 		zap.Duration("used_time", time.Since(start)))
@@ -1580,37 +2564,83 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 	unifiedIndex.UserIndex = rankingDataset.UserIndex
 	unifiedIndex.ItemLabelIndex = itemLabelIndex
 	unifiedIndex.UserLabelIndex = userLabelIndex
+	if contexts != nil {
+		unifiedIndex.CtxLabelIndex = contexts.index
+	}
+	chunkSize := m.Config.Recommend.DataSource.ChunkSize
 	clickDataset = &click.Dataset{
 		Index:        unifiedIndex.Build(),
 		UserFeatures: rankingDataset.UserLabels,
 		ItemFeatures: rankingDataset.ItemLabels,
+		Users:        base.NewArray[int32](chunkSize),
+		Items:        base.NewArray[int32](chunkSize),
+		NormValues:   base.NewArray[float32](chunkSize),
+		Target:       base.NewArray[float32](chunkSize),
+		Weights:      base.NewArray[float32](chunkSize),
+	}
+	var ctxOffset int32
+	if contexts != nil {
+		clickDataset.CtxFeatures = make([][]int32, 0)
+		clickDataset.CtxValues = make([][]float32, 0)
+		ctxOffset = clickDataset.Index.CountUsers() + clickDataset.Index.CountItems() +
+			clickDataset.Index.CountUserLabels() + clickDataset.Index.CountItemLabels()
+	}
+	appendContext := func(userIndex, itemIndex int32) {
+		if contexts != nil {
+			features, values := contexts.features(userIndex, itemIndex, ctxOffset)
+			clickDataset.CtxFeatures = append(clickDataset.CtxFeatures, features)
+			clickDataset.CtxValues = append(clickDataset.CtxValues, values)
+		}
 	}
-	for userIndex := range positiveSet {
-		if positiveSet[userIndex].IsEmpty() || negativeSet[userIndex].IsEmpty() {
-			// release positive set and negative set
-			positiveSet[userIndex] = nil
-			negativeSet[userIndex] = nil
+	for userIndex := range negatives {
+		// hard negatives are negative feedback as well
+		negatives[userIndex] = append(negatives[userIndex], rankingDataset.UserHardNegatives(int32(userIndex))...)
+		if len(rankingDataset.UserFeedback[userIndex]) == 0 || len(negatives[userIndex]) == 0 {
+			// release negative feedback
+			negatives[userIndex] = nil
+			continue
+		}
+		// positive feedback is copied since feedback weights are parallel to feedback
+		positives := sortedUnique(append([]int32(nil), rankingDataset.UserFeedback[userIndex]...))
+		negatives[userIndex] = subtractSorted(sortedUnique(negatives[userIndex]), positives)
+		if len(negatives[userIndex]) == 0 {
+			negatives[userIndex] = nil
 			continue
 		}
+		// the weight of a positive sample is the largest weight of its feedback
+		var positiveWeights map[int32]float32
+		if rankingDataset.UserFeedbackWeights != nil {
+			positiveWeights = make(map[int32]float32, len(positives))
+			for k, itemIndex := range rankingDataset.UserFeedback[userIndex] {
+				positiveWeights[itemIndex] = math32.Max(positiveWeights[itemIndex], rankingDataset.UserFeedbackWeight(int32(userIndex), k))
+			}
+		}
 		// insert positive feedback
-		for _, itemIndex := range positiveSet[userIndex].List() {
+		for _, itemIndex := range positives {
 			clickDataset.Users.Append(int32(userIndex))
 			clickDataset.Items.Append(itemIndex)
 			clickDataset.NormValues.Append(1 / math32.Sqrt(float32(len(clickDataset.UserFeatures[userIndex])+len(clickDataset.ItemFeatures[itemIndex]))))
 			clickDataset.Target.Append(1)
+			if positiveWeights != nil {
+				clickDataset.Weights.Append(positiveWeights[itemIndex])
+			}
+			appendContext(int32(userIndex), itemIndex)
 			clickDataset.PositiveCount++
 		}
 		// insert negative feedback
-		for _, itemIndex := range negativeSet[userIndex].List() {
+		for _, itemIndex := range negatives[userIndex] {
 			clickDataset.Users.Append(int32(userIndex))
 			clickDataset.Items.Append(itemIndex)
 			clickDataset.NormValues.Append(1 / math32.Sqrt(float32(len(clickDataset.UserFeatures[userIndex])+len(clickDataset.ItemFeatures[itemIndex]))))
 			clickDataset.Target.Append(-1)
+			if positiveWeights != nil {
+				clickDataset.Weights.Append(1)
+			}
+			appendContext(int32(userIndex), itemIndex)
 			clickDataset.NegativeCount++
 		}
-		// release positive set and negative set
-		positiveSet[userIndex] = nil
-		negativeSet[userIndex] = nil
+		// release negative feedback
+		negatives[userIndex] = nil
 	}
 	log.Logger().Debug("created ranking dataset",
 		zap.Int("n_valid_positive", clickDataset.PositiveCount),
@@ -1626,17 +2656,26 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 		latestItems[category] = cache.CreateScoredItems(items, scores)
 	}
 
+	// feedback on duplicates counts for canonical items
+	isDuplicate, err := m.rollUpDuplicates(database, rankingDataset, popularScore)
+	if err != nil {
+		return nil, nil, nil, nil, nil, errors.Trace(err)
+	}
+
 	// collect popular items
 	popularItemFilters := make(map[string]*heap.TopKFilter[string, float64])
 	popularItemFilters[""] = heap.NewTopKFilter[string, float64](m.Config.Recommend.CacheSize)
-	for itemIndex, val := range popularCount {
+	for itemIndex, val := range popularScore {
+		if isDuplicate[itemIndex] {
+			continue
+		}
 		itemId := rankingDataset.ItemIndex.ToName(int32(itemIndex))
-		popularItemFilters[""].Push(itemId, float64(val))
+		popularItemFilters[""].Push(itemId, val)
 		for _, category := range rankingDataset.ItemCategories[itemIndex] {
 			if _, exist := popularItemFilters[category]; !exist {
 				popularItemFilters[category] = heap.NewTopKFilter[string, float64](m.Config.Recommend.CacheSize)
 			}
-			popularItemFilters[category].Push(itemId, float64(val))
+			popularItemFilters[category].Push(itemId, val)
 		}
 	}
 	popularItems = make(map[string][]cache.Scored)
@@ -1645,6 +2684,64 @@ func (m *Master) LoadDataFromDatabase(database data.Database, posFeedbackTypes,
 		popularItems[category] = cache.CreateScoredItems(items, scores)
 	}
 
+	// collect popular items of labels
+	labelPopularItemFilters := make(map[int32]*heap.TopKFilter[string, float64])
+	for itemIndex, val := range popularScore {
+		if rankingDataset.HiddenItems[itemIndex] || isDuplicate[itemIndex] {
+			continue
+		}
+		itemId := rankingDataset.ItemIndex.ToName(int32(itemIndex))
+		for _, label := range rankingDataset.ItemLabels[itemIndex] {
+			if _, exist := labelPopularItemFilters[label]; !exist {
+				labelPopularItemFilters[label] = heap.NewTopKFilter[string, float64](m.Config.Recommend.CacheSize)
+			}
+			labelPopularItemFilters[label].Push(itemId, val)
+		}
+	}
+	labelPopularItems = make(map[string][]cache.Scored)
+	for label, labelPopularItemFilter := range labelPopularItemFilters {
+		items, scores := labelPopularItemFilter.PopAll()
+		labelPopularItems[itemLabelIndex.ToName(label)] = cache.CreateScoredItems(items, scores)
+	}
+
 	m.taskMonitor.Finish(TaskLoadDataset)
-	return rankingDataset, clickDataset, latestItems, popularItems, nil
+	return rankingDataset, clickDataset, latestItems, popularItems, labelPopularItems, nil
+}
+
+// rollUpDuplicates adds popularity scores of near-duplicate items to their canonical items if duplicate detection is
+// enabled. It returns whether each item is rolled up into its canonical item.
+func (m *Master) rollUpDuplicates(database data.Database, dataset *ranking.DataSet, popularScore []float64) ([]bool, error) {
+	isDuplicate := make([]bool, dataset.ItemCount())
+	if !m.Config.Recommend.Dedup.EnableDedup {
+		return isDuplicate, nil
+	}
+	canonicals, err := database.GetItemCanonicals()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, canonical := range canonicals {
+		itemIndex := dataset.ItemIndex.ToNumber(canonical.ItemId)
+		canonicalIndex := dataset.ItemIndex.ToNumber(canonical.CanonicalId)
+		if itemIndex == base.NotId || canonicalIndex == base.NotId || dataset.HiddenItems[canonicalIndex] {
+			continue
+		}
+		popularScore[canonicalIndex] += popularScore[itemIndex]
+		popularScore[itemIndex] = 0
+		isDuplicate[itemIndex] = true
+	}
+	return isDuplicate, nil
+}
+
+// popularityWeight returns the contribution of a feedback to the popularity score. Each feedback counts as one
+// if the half-life is 0, otherwise its contribution halves every half-life.
+func (m *Master) popularityWeight(timestamp, now time.Time) float64 {
+	if !m.Config.Recommend.Popular.TimeDecayEnabled() {
+		return 1
+	}
+	age := now.Sub(timestamp)
+	if age < 0 {
+		// feedback from the future is treated as fresh
+		age = 0
+	}
+	return math.Exp2(-age.Hours() / m.Config.Recommend.Popular.HalfLife.Hours())
 }
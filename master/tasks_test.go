@@ -15,14 +15,21 @@
 package master
 
 import (
+	"fmt"
+	"math"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
 	"github.com/stretchr/testify/assert"
 	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model"
+	"github.com/zhenghaoz/gorse/model/click"
+	"github.com/zhenghaoz/gorse/model/ranking"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
 )
@@ -35,18 +42,22 @@ func TestMaster_FindItemNeighborsBruteForce(t *testing.T) {
 	m.Config = &config.Config{}
 	m.Config.Recommend.CacheSize = 3
 	m.Config.Master.NumJobs = 4
+	m.Config.Recommend.ItemNeighbors.LabelSimilarity = config.SimilarityCosine
+	m.Config.Recommend.ItemNeighbors.FeedbackSimilarity = config.SimilarityCosine
+	m.Config.Recommend.ItemNeighbors.HybridAlpha = 0.5
+	m.Config.Recommend.ItemNeighbors.MaxCategories = 10
 	// collect similar
 	items := []data.Item{
-		{"0", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d"}, ""},
-		{"1", false, []string{"*"}, time.Now(), []string{}, ""},
-		{"2", false, []string{"*"}, time.Now(), []string{"b", "c", "d"}, ""},
-		{"3", false, nil, time.Now(), []string{}, ""},
-		{"4", false, nil, time.Now(), []string{"b", "c"}, ""},
-		{"5", false, []string{"*"}, time.Now(), []string{}, ""},
-		{"6", false, []string{"*"}, time.Now(), []string{"c"}, ""},
-		{"7", false, []string{"*"}, time.Now(), []string{}, ""},
-		{"8", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d", "e"}, ""},
-		{"9", false, nil, time.Now(), []string{}, ""},
+		{"0", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d"}, "", nil, nil, "", time.Time{}},
+		{"1", false, []string{"*"}, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"2", false, []string{"*"}, time.Now(), []string{"b", "c", "d"}, "", nil, nil, "", time.Time{}},
+		{"3", false, nil, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"4", false, nil, time.Now(), []string{"b", "c"}, "", nil, nil, "", time.Time{}},
+		{"5", false, []string{"*"}, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"6", false, []string{"*"}, time.Now(), []string{"c"}, "", nil, nil, "", time.Time{}},
+		{"7", false, []string{"*"}, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"8", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d", "e"}, "", nil, nil, "", time.Time{}},
+		{"9", false, nil, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
 	}
 	feedbacks := make([]data.Feedback, 0)
 	for i := 0; i < 10; i++ {
@@ -84,7 +95,7 @@ func TestMaster_FindItemNeighborsBruteForce(t *testing.T) {
 	}
 
 	// load mock dataset
-	dataset, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, 0, 0, NewOnlineEvaluator())
+	dataset, _, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, nil, 0, 0, NewOnlineEvaluator())
 	assert.NoError(t, err)
 	m.rankingTrainSet = dataset
 
@@ -97,7 +108,7 @@ func TestMaster_FindItemNeighborsBruteForce(t *testing.T) {
 	assert.Equal(t, []string{"7", "5", "3"}, cache.RemoveScores(similar))
 	assert.Equal(t, m.estimateFindItemNeighborsComplexity(dataset), m.taskMonitor.Tasks[TaskFindItemNeighbors].Done)
 	assert.Equal(t, task.StatusComplete, m.taskMonitor.Tasks[TaskFindItemNeighbors].Status)
-	// similar items in category (common users)
+	// similar items in category (common users) are cached even if item 9 doesn't belong to the category
 	similar, err = m.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "9", "*"), 0, 100)
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"7", "5", "1"}, cache.RemoveScores(similar))
@@ -136,6 +147,85 @@ func TestMaster_FindItemNeighborsBruteForce(t *testing.T) {
 	assert.Equal(t, task.StatusComplete, m.taskMonitor.Tasks[TaskFindItemNeighbors].Status)
 }
 
+func TestMaster_NeighborCategories(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	dataset := &ranking.DataSet{
+		ItemCategories: [][]string{{"c", "b", "a"}, {"c"}, nil},
+		CategorySet:    strset.New("a", "b", "c"),
+	}
+	allCategories := []string{"a", "b", "c"}
+	// all categories are covered by default
+	assert.Equal(t, allCategories, m.neighborCategories(dataset, allCategories, 0))
+	assert.Equal(t, allCategories, m.neighborCategories(dataset, allCategories, 2))
+	// categories of the item are preferred
+	m.Config.Recommend.ItemNeighbors.MaxCategories = 2
+	assert.Equal(t, []string{"c", "b"}, m.neighborCategories(dataset, allCategories, 0))
+	assert.Equal(t, []string{"c", "a"}, m.neighborCategories(dataset, allCategories, 1))
+	assert.Equal(t, []string{"a", "b"}, m.neighborCategories(dataset, allCategories, 2))
+}
+
+func TestMaster_UpdateItemNeighborCategories(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	for _, category := range []string{"a", "b"} {
+		err := m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0", category), []cache.Scored{{"1", 1}})
+		assert.NoError(t, err)
+	}
+	err := m.updateItemNeighborCategories("0", []string{"a", "b"})
+	assert.NoError(t, err)
+
+	// neighbors in category b are removed
+	err = m.updateItemNeighborCategories("0", []string{"a"})
+	assert.NoError(t, err)
+	neighbors, err := m.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "0", "a"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 1}}, neighbors)
+	neighbors, err = m.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "0", "b"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, neighbors)
+	categories, err := m.CacheClient.GetSet(cache.Key(cache.ItemNeighborCategories, "0"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, categories)
+}
+
+func TestMaster_RemoveHiddenNeighbors(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	updateTime := time.Now().Add(-time.Hour)
+	err := m.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateItemNeighborsTime, "0"), updateTime))
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0"), []cache.Scored{{"1", 4}, {"2", 3}, {"3", 2}, {"4", 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0", "a"), []cache.Scored{{"1", 4}, {"2", 3}, {"3", 2}})
+	assert.NoError(t, err)
+	// item 1 was hidden before update, item 2 was deleted and item 3 was removed from category a
+	err = m.CacheClient.AddSorted(
+		cache.Sorted(cache.HiddenItemsV2, []cache.Scored{
+			{"1", float64(updateTime.Add(-time.Hour).Unix())},
+			{"2", float64(time.Now().Unix())},
+		}),
+		cache.Sorted(cache.Key(cache.HiddenItemsV2, "a"), []cache.Scored{{"3", float64(time.Now().Unix())}}),
+	)
+	assert.NoError(t, err)
+
+	hiddenItems, err := m.loadHiddenItems([]string{"a"})
+	assert.NoError(t, err)
+	err = m.removeHiddenNeighbors("0", []string{"a"}, hiddenItems)
+	assert.NoError(t, err)
+	neighbors, err := m.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 4}, {"3", 2}, {"4", 1}}, neighbors)
+	neighbors, err = m.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "0", "a"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 4}}, neighbors)
+
+	// skip items without neighbors
+	err = m.removeHiddenNeighbors("1", []string{"a"}, hiddenItems)
+	assert.NoError(t, err)
+}
+
 func TestMaster_FindItemNeighborsIVF(t *testing.T) {
 	// create mock master
 	m := newMockMaster(t)
@@ -144,21 +234,25 @@ func TestMaster_FindItemNeighborsIVF(t *testing.T) {
 	m.Config = &config.Config{}
 	m.Config.Recommend.CacheSize = 3
 	m.Config.Master.NumJobs = 4
+	m.Config.Recommend.ItemNeighbors.LabelSimilarity = config.SimilarityCosine
+	m.Config.Recommend.ItemNeighbors.FeedbackSimilarity = config.SimilarityCosine
+	m.Config.Recommend.ItemNeighbors.HybridAlpha = 0.5
+	m.Config.Recommend.ItemNeighbors.MaxCategories = 10
 	m.Config.Recommend.ItemNeighbors.EnableIndex = true
 	m.Config.Recommend.ItemNeighbors.IndexRecall = 1
 	m.Config.Recommend.ItemNeighbors.IndexFitEpoch = 10
 	// collect similar
 	items := []data.Item{
-		{"0", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d"}, ""},
-		{"1", false, []string{"*"}, time.Now(), []string{}, ""},
-		{"2", false, []string{"*"}, time.Now(), []string{"b", "c", "d"}, ""},
-		{"3", false, nil, time.Now(), []string{}, ""},
-		{"4", false, nil, time.Now(), []string{"b", "c"}, ""},
-		{"5", false, []string{"*"}, time.Now(), []string{}, ""},
-		{"6", false, []string{"*"}, time.Now(), []string{"c"}, ""},
-		{"7", false, []string{"*"}, time.Now(), []string{}, ""},
-		{"8", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d", "e"}, ""},
-		{"9", false, nil, time.Now(), []string{}, ""},
+		{"0", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d"}, "", nil, nil, "", time.Time{}},
+		{"1", false, []string{"*"}, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"2", false, []string{"*"}, time.Now(), []string{"b", "c", "d"}, "", nil, nil, "", time.Time{}},
+		{"3", false, nil, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"4", false, nil, time.Now(), []string{"b", "c"}, "", nil, nil, "", time.Time{}},
+		{"5", false, []string{"*"}, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"6", false, []string{"*"}, time.Now(), []string{"c"}, "", nil, nil, "", time.Time{}},
+		{"7", false, []string{"*"}, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
+		{"8", false, []string{"*"}, time.Now(), []string{"a", "b", "c", "d", "e"}, "", nil, nil, "", time.Time{}},
+		{"9", false, nil, time.Now(), []string{}, "", nil, nil, "", time.Time{}},
 	}
 	feedbacks := make([]data.Feedback, 0)
 	for i := 0; i < 10; i++ {
@@ -196,7 +290,7 @@ func TestMaster_FindItemNeighborsIVF(t *testing.T) {
 	}
 
 	// load mock dataset
-	dataset, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, 0, 0, NewOnlineEvaluator())
+	dataset, _, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, nil, 0, 0, NewOnlineEvaluator())
 	assert.NoError(t, err)
 	m.rankingTrainSet = dataset
 
@@ -209,7 +303,7 @@ func TestMaster_FindItemNeighborsIVF(t *testing.T) {
 	assert.Equal(t, []string{"7", "5", "3"}, cache.RemoveScores(similar))
 	assert.Equal(t, m.estimateFindItemNeighborsComplexity(dataset), m.taskMonitor.Tasks[TaskFindItemNeighbors].Done)
 	assert.Equal(t, task.StatusComplete, m.taskMonitor.Tasks[TaskFindItemNeighbors].Status)
-	// similar items in category (common users)
+	// similar items in category (common users) are cached even if item 9 doesn't belong to the category
 	similar, err = m.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "9", "*"), 0, 100)
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"7", "5", "1"}, cache.RemoveScores(similar))
@@ -289,7 +383,7 @@ func TestMaster_FindUserNeighborsBruteForce(t *testing.T) {
 	assert.NoError(t, err)
 	err = m.DataClient.BatchInsertFeedback(feedbacks, true, true, true)
 	assert.NoError(t, err)
-	dataset, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, 0, 0, NewOnlineEvaluator())
+	dataset, _, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, nil, 0, 0, NewOnlineEvaluator())
 	assert.NoError(t, err)
 	m.rankingTrainSet = dataset
 
@@ -377,7 +471,7 @@ func TestMaster_FindUserNeighborsIVF(t *testing.T) {
 	assert.NoError(t, err)
 	err = m.DataClient.BatchInsertFeedback(feedbacks, true, true, true)
 	assert.NoError(t, err)
-	dataset, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, 0, 0, NewOnlineEvaluator())
+	dataset, _, _, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"FeedbackType"}, nil, nil, 0, 0, NewOnlineEvaluator())
 	assert.NoError(t, err)
 	m.rankingTrainSet = dataset
 
@@ -496,6 +590,12 @@ func TestMaster_LoadDataFromDatabase(t *testing.T) {
 	err = m.DataClient.BatchInsertFeedback(feedbacks, false, false, true)
 	assert.NoError(t, err)
 
+	// insert popular items of a disappeared label
+	err = m.CacheClient.SetSorted(cache.Key(cache.LabelPopularItems, "gone"), []cache.Scored{{Id: "0", Score: 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSet(cache.ItemLabels, "gone")
+	assert.NoError(t, err)
+
 	// load dataset
 	err = m.runLoadDatasetTask()
 	assert.NoError(t, err)
@@ -548,12 +648,239 @@ func TestMaster_LoadDataFromDatabase(t *testing.T) {
 		{Id: items[2].ItemId, Score: 3},
 	}, popular)
 
+	// check popular items of labels
+	popular, err = m.CacheClient.GetSorted(cache.Key(cache.LabelPopularItems, "1"), 0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{
+		{Id: items[7].ItemId, Score: 8},
+		{Id: items[4].ItemId, Score: 5},
+		{Id: items[1].ItemId, Score: 2},
+	}, popular)
+	popular, err = m.CacheClient.GetSorted(cache.Key(cache.LabelPopularItems, "10"), 0, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, popular)
+	popular, err = m.CacheClient.GetSorted(cache.Key(cache.LabelPopularItems, "gone"), 0, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, popular)
+	labels, err := m.CacheClient.GetSet(cache.ItemLabels)
+	assert.NoError(t, err)
+	assert.NotContains(t, labels, "gone")
+
 	// check categories
 	categories, err := m.CacheClient.GetSet(cache.ItemCategories)
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"0", "1", "2"}, categories)
 }
 
+func TestMaster_LoadDataFromDatabase_TimeDecay(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = &config.Config{}
+	m.Config.Recommend.CacheSize = 3
+
+	// insert feedback
+	// old: 10 feedback 10 days ago
+	// mid: 5 feedback 2 days ago
+	// new: 3 feedback just now
+	var feedbacks []data.Feedback
+	for itemId, spec := range map[string]struct {
+		count int
+		age   time.Duration
+	}{
+		"old": {10, 10 * 24 * time.Hour},
+		"mid": {5, 2 * 24 * time.Hour},
+		"new": {3, 0},
+	} {
+		for i := 0; i < spec.count; i++ {
+			feedbacks = append(feedbacks, data.Feedback{
+				FeedbackKey: data.FeedbackKey{ItemId: itemId, UserId: strconv.Itoa(i), FeedbackType: "positive"},
+				Timestamp:   time.Now().Add(-spec.age),
+			})
+		}
+	}
+	err := m.DataClient.BatchInsertFeedback(feedbacks, true, true, true)
+	assert.NoError(t, err)
+
+	popularIds := func(halfLife time.Duration) []string {
+		m.Config.Recommend.Popular.HalfLife = halfLife
+		_, _, _, popularItems, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"positive"}, nil, nil, 0, 0, NewOnlineEvaluator())
+		assert.NoError(t, err)
+		return cache.RemoveScores(popularItems[""])
+	}
+	// decay disabled
+	assert.Equal(t, []string{"old", "mid", "new"}, popularIds(0))
+	// short half-life: old=0.01, mid=1.25, new=3
+	assert.Equal(t, []string{"new", "mid", "old"}, popularIds(24*time.Hour))
+	// medium half-life: old=1.77, mid=3.54, new=3
+	assert.Equal(t, []string{"mid", "new", "old"}, popularIds(96*time.Hour))
+	// long half-life: close to raw counts
+	assert.Equal(t, []string{"old", "mid", "new"}, popularIds(10000*time.Hour))
+}
+
+func TestMaster_LoadDataFromDatabase_ItemTimeField(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = &config.Config{}
+	m.Config.Recommend.CacheSize = 3
+
+	// insert a recent item and a backfilled item with historical timestamp
+	start := time.Now()
+	recentTime, backfilledTime := start.Add(-time.Hour), time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := m.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "recent", Categories: []string{"a"}, Timestamp: recentTime},
+		{ItemId: "backfilled", Categories: []string{"a"}, Timestamp: backfilledTime},
+	})
+	assert.NoError(t, err)
+
+	// event time: the backfilled item is ordered by its timestamp
+	m.Config.Recommend.DataSource.ItemTimeField = data.ItemTimeTimestamp
+	_, _, latestItems, _, _, err := m.LoadDataFromDatabase(m.DataClient, []string{"positive"}, nil, nil, 0, 0, NewOnlineEvaluator())
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{
+		{Id: "recent", Score: float64(recentTime.Unix())},
+		{Id: "backfilled", Score: float64(backfilledTime.Unix())},
+	}, latestItems[""])
+	assert.Equal(t, latestItems[""], latestItems["a"])
+
+	// ingestion time: the backfilled item is ordered by the time of insertion
+	m.Config.Recommend.DataSource.ItemTimeField = data.ItemTimeCreatedAt
+	_, _, latestItems, _, _, err = m.LoadDataFromDatabase(m.DataClient, []string{"positive"}, nil, nil, 0, 0, NewOnlineEvaluator())
+	assert.NoError(t, err)
+	if assert.Len(t, latestItems[""], 2) {
+		for _, item := range latestItems[""] {
+			assert.GreaterOrEqual(t, item.Score, float64(start.Add(-time.Minute).Unix()))
+		}
+	}
+	assert.ElementsMatch(t, latestItems[""], latestItems["a"])
+}
+
+func TestMaster_LoadDataFromDatabase_FeedbackWeights(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = &config.Config{}
+	m.Config.Recommend.CacheSize = 3
+
+	// insert feedback
+	// user 0: purchase item 0, star item 1, like item 2, read item 2 and item 3
+	// user 1: like item 0, star item 1, read item 0 and item 3
+	var feedbacks []data.Feedback
+	for _, f := range []struct {
+		feedbackType string
+		userId       string
+		itemId       string
+	}{
+		{"purchase", "0", "0"}, {"star", "0", "1"}, {"like", "0", "2"}, {"read", "0", "2"}, {"read", "0", "3"},
+		{"like", "1", "0"}, {"star", "1", "1"}, {"read", "1", "0"}, {"read", "1", "3"},
+	} {
+		feedbacks = append(feedbacks, data.Feedback{
+			FeedbackKey: data.FeedbackKey{FeedbackType: f.feedbackType, UserId: f.userId, ItemId: f.itemId},
+			Timestamp:   time.Now(),
+		})
+	}
+	err := m.DataClient.BatchInsertFeedback(feedbacks, true, true, true)
+	assert.NoError(t, err)
+
+	load := func(weights map[string]float64) (*ranking.DataSet, *click.Dataset) {
+		m.Config.Recommend.DataSource.PositiveFeedbackWeights = weights
+		rankingDataset, clickDataset, _, _, _, err := m.LoadDataFromDatabase(m.DataClient,
+			[]string{"purchase", "star", "like"}, []string{"read"}, nil, 0, 0, NewOnlineEvaluator())
+		assert.NoError(t, err)
+		return rankingDataset, clickDataset
+	}
+	userFeedbackWeights := func(dataset *ranking.DataSet, userId string) []float32 {
+		userIndex := dataset.UserIndex.ToNumber(userId)
+		return lo.Map(dataset.UserFeedback[userIndex], func(_ int32, k int) float32 {
+			return dataset.UserFeedbackWeight(userIndex, k)
+		})
+	}
+
+	// all feedback types are equally weighted
+	rankingDataset, clickDataset := load(nil)
+	assert.Equal(t, 5, rankingDataset.Count())
+	assert.Nil(t, rankingDataset.UserFeedbackWeights)
+	assert.Equal(t, 5, clickDataset.PositiveCount)
+	assert.Equal(t, 2, clickDataset.NegativeCount)
+	assert.Zero(t, clickDataset.Weights.Len())
+
+	// purchase is weighted 5, like is ignored and star is weighted 1 by default
+	weights := map[string]float64{"purchase": 5, "like": 0}
+	rankingDataset, clickDataset = load(weights)
+	assert.Equal(t, 3, rankingDataset.Count())
+	assert.ElementsMatch(t, []float32{5, 1}, userFeedbackWeights(rankingDataset, "0"))
+	assert.ElementsMatch(t, []float32{1}, userFeedbackWeights(rankingDataset, "1"))
+	assert.Equal(t, 3, clickDataset.PositiveCount)
+	assert.Equal(t, 4, clickDataset.NegativeCount)
+	// click samples are weighted as well and negative samples are weighted 1
+	clickWeights := make(map[string]float32)
+	for i := 0; i < clickDataset.Count(); i++ {
+		userId := rankingDataset.UserIndex.ToName(clickDataset.Users.Get(i))
+		itemId := rankingDataset.ItemIndex.ToName(clickDataset.Items.Get(i))
+		clickWeights[userId+"/"+itemId] = clickDataset.Weight(i) * clickDataset.Target.Get(i)
+	}
+	assert.Equal(t, map[string]float32{"0/0": 5, "0/1": 1, "0/2": -1, "0/3": -1, "1/1": 1, "1/0": -1, "1/3": -1}, clickWeights)
+
+	// loading is deterministic
+	rankingDataset2, clickDataset2 := load(weights)
+	assert.Equal(t, rankingDataset.UserFeedback, rankingDataset2.UserFeedback)
+	assert.Equal(t, rankingDataset.UserFeedbackWeights, rankingDataset2.UserFeedbackWeights)
+	assert.Equal(t, rankingDataset.ItemFeedbackWeights, rankingDataset2.ItemFeedbackWeights)
+	assert.Equal(t, clickDataset.PositiveCount, clickDataset2.PositiveCount)
+	assert.Equal(t, clickDataset.NegativeCount, clickDataset2.NegativeCount)
+}
+
+func TestMaster_LoadDataFromDatabase_NegativeFeedback(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = &config.Config{}
+	m.Config.Recommend.CacheSize = 3
+
+	// insert feedback
+	// user 0: like item 0 and item 1, dislike item 1 and item 2, read item 3
+	// user 1: like item 2, dislike item 0
+	var feedbacks []data.Feedback
+	for _, f := range []struct {
+		feedbackType string
+		userId       string
+		itemId       string
+	}{
+		{"like", "0", "0"}, {"like", "0", "1"}, {"dislike", "0", "1"}, {"dislike", "0", "2"}, {"read", "0", "3"},
+		{"like", "1", "2"}, {"dislike", "1", "0"},
+	} {
+		feedbacks = append(feedbacks, data.Feedback{
+			FeedbackKey: data.FeedbackKey{FeedbackType: f.feedbackType, UserId: f.userId, ItemId: f.itemId},
+			Timestamp:   time.Now(),
+		})
+	}
+	err := m.DataClient.BatchInsertFeedback(feedbacks, true, true, true)
+	assert.NoError(t, err)
+
+	rankingDataset, clickDataset, _, _, _, err := m.LoadDataFromDatabase(m.DataClient,
+		[]string{"like"}, []string{"read"}, []string{"dislike"}, 0, 0, NewOnlineEvaluator())
+	assert.NoError(t, err)
+	itemIds := func(indices []int32) []string {
+		return lo.Map(indices, func(itemIndex int32, _ int) string {
+			return rankingDataset.ItemIndex.ToName(itemIndex)
+		})
+	}
+	// disliked items are not positive
+	assert.Equal(t, 2, rankingDataset.Count())
+	assert.Equal(t, []string{"0"}, itemIds(rankingDataset.UserFeedback[rankingDataset.UserIndex.ToNumber("0")]))
+	assert.Equal(t, []string{"2"}, itemIds(rankingDataset.UserFeedback[rankingDataset.UserIndex.ToNumber("1")]))
+	// disliked items are hard negatives
+	assert.ElementsMatch(t, []string{"1", "2"}, itemIds(rankingDataset.UserHardNegatives(rankingDataset.UserIndex.ToNumber("0"))))
+	assert.ElementsMatch(t, []string{"0"}, itemIds(rankingDataset.UserHardNegatives(rankingDataset.UserIndex.ToNumber("1"))))
+	trainSet, testSet := rankingDataset.Split(0, 0)
+	assert.Equal(t, rankingDataset.HardNegatives, trainSet.HardNegatives)
+	assert.Nil(t, testSet.HardNegatives)
+	// disliked items are negative in click-through rate prediction
+	assert.Equal(t, 2, clickDataset.PositiveCount)
+	assert.Equal(t, 4, clickDataset.NegativeCount)
+}
+
 func TestCheckItemNeighborCacheTimeout(t *testing.T) {
 	// create mock master
 	m := newMockMaster(t)
@@ -688,6 +1015,35 @@ func TestRunCacheGarbageCollectionTask(t *testing.T) {
 	err = m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "20"), []cache.Scored{{Id: "2", Score: 1}})
 	assert.NoError(t, err)
 
+	m.Config.Recommend.Online.SessionRecommendTTL = time.Minute
+	err = m.CacheClient.Set(
+		cache.Time(cache.Key(cache.SessionRecommendTime, "fresh"), timestamp),
+		cache.Time(cache.Key(cache.SessionRecommendTime, "stale"), timestamp.Add(-time.Hour)),
+	)
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.SessionRecommend, "fresh"), []cache.Scored{{Id: "1", Score: 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.SessionRecommend, "stale"), []cache.Scored{{Id: "1", Score: 1}})
+	assert.NoError(t, err)
+
+	m.Config.Server.SessionIdleTTL = time.Minute
+	err = m.CacheClient.Set(
+		cache.Time(cache.Key(cache.SessionActiveTime, "active"), timestamp),
+		cache.Time(cache.Key(cache.SessionActiveTime, "idle"), timestamp.Add(-time.Hour)),
+	)
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.SessionFeedback, "active"), []cache.Scored{{Id: "1", Score: 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.SessionFeedback, "idle"), []cache.Scored{{Id: "1", Score: 1}})
+	assert.NoError(t, err)
+
+	m.Config.Server.PageTokenTTL = time.Minute
+	err = m.CacheClient.Set(
+		cache.String(cache.Key(cache.RecommendSnapshot, "fresh"), fmt.Sprintf(`{"Items":["1"],"CreateTime":"%s"}`, timestamp.Format(time.RFC3339Nano))),
+		cache.String(cache.Key(cache.RecommendSnapshot, "stale"), fmt.Sprintf(`{"Items":["1"],"CreateTime":"%s"}`, timestamp.Add(-time.Hour).Format(time.RFC3339Nano))),
+	)
+	assert.NoError(t, err)
+
 	// remove cache
 	assert.NotNil(t, m.rankingTrainSet)
 	gcTask := NewCacheGarbageCollectionTask(&m.Master)
@@ -763,4 +1119,467 @@ func TestRunCacheGarbageCollectionTask(t *testing.T) {
 	sorted, err = m.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, "20"), 0, -1)
 	assert.NoError(t, err)
 	assert.Empty(t, sorted)
+
+	ts, err = m.CacheClient.Get(cache.Key(cache.SessionRecommendTime, "fresh")).Time()
+	assert.NoError(t, err)
+	assert.Equal(t, timestamp.Truncate(time.Second), ts.Truncate(time.Second))
+	sorted, err = m.CacheClient.GetSorted(cache.Key(cache.SessionRecommend, "fresh"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{Id: "1", Score: 1}}, sorted)
+	_, err = m.CacheClient.Get(cache.Key(cache.SessionRecommendTime, "stale")).Time()
+	assert.True(t, errors.Is(err, errors.NotFound))
+	sorted, err = m.CacheClient.GetSorted(cache.Key(cache.SessionRecommend, "stale"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, sorted)
+
+	_, err = m.CacheClient.Get(cache.Key(cache.SessionActiveTime, "active")).Time()
+	assert.NoError(t, err)
+	sorted, err = m.CacheClient.GetSorted(cache.Key(cache.SessionFeedback, "active"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{Id: "1", Score: 1}}, sorted)
+	_, err = m.CacheClient.Get(cache.Key(cache.SessionActiveTime, "idle")).Time()
+	assert.True(t, errors.Is(err, errors.NotFound))
+	sorted, err = m.CacheClient.GetSorted(cache.Key(cache.SessionFeedback, "idle"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, sorted)
+
+	_, err = m.CacheClient.Get(cache.Key(cache.RecommendSnapshot, "fresh")).String()
+	assert.NoError(t, err)
+	_, err = m.CacheClient.Get(cache.Key(cache.RecommendSnapshot, "stale")).String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
+
+func TestRunCacheGarbageCollectionTask_Obfuscated(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Database.IdObfuscationSecret = "new"
+	m.Config.Database.IdObfuscationPreviousSecret = "old"
+	rawCache := m.CacheClient
+	m.obfuscator = cache.NewObfuscator(rawCache, "new", "old")
+	m.CacheClient = m.obfuscator
+
+	// insert data
+	err := m.DataClient.BatchInsertFeedback([]data.Feedback{{FeedbackKey: data.FeedbackKey{UserId: "1", ItemId: "10"}}}, true, true, true)
+	assert.NoError(t, err)
+	err = m.runLoadDatasetTask()
+	assert.NoError(t, err)
+
+	// insert cache under digests of both secrets and raw user ids
+	err = m.CacheClient.Set(
+		cache.String(cache.Key(cache.OfflineRecommendDigest, "1"), "digest"),
+		cache.String(cache.Key(cache.OfflineRecommendDigest, "2"), "digest"))
+	assert.NoError(t, err)
+	err = rawCache.Set(cache.String(cache.Key(cache.OfflineRecommendDigest, "1"), "digest"))
+	assert.NoError(t, err)
+
+	// remove cache
+	gcTask := NewCacheGarbageCollectionTask(&m.Master)
+	err = gcTask.run(nil)
+	assert.NoError(t, err)
+
+	for _, secret := range []string{"new", "old"} {
+		_, err = rawCache.Get(cache.Key(cache.OfflineRecommendDigest, cache.DigestID(secret, "1"))).String()
+		assert.NoError(t, err)
+		_, err = rawCache.Get(cache.Key(cache.OfflineRecommendDigest, cache.DigestID(secret, "2"))).String()
+		assert.True(t, errors.Is(err, errors.NotFound))
+	}
+	_, err = rawCache.Get(cache.Key(cache.OfflineRecommendDigest, "1")).String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
+
+func TestRunQualityGateTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	m.Config.Recommend.DataSource.ReadFeedbackTypes = []string{"read"}
+	m.Config.Recommend.Quality.EnableQualityGate = true
+	m.Config.Recommend.Quality.MinImpressions = 10
+	m.Config.Recommend.Quality.MinPositiveRatio = 0.1
+
+	// insert items
+	err := m.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "spam"},
+		{ItemId: "good"},
+		{ItemId: "few"},
+		{ItemId: "manual", IsHidden: true},
+		{ItemId: "recovered", IsHidden: true, HiddenReason: data.HiddenReasonLowQuality},
+	})
+	assert.NoError(t, err)
+
+	// insert feedback
+	var feedback []data.Feedback
+	for itemId, count := range map[string][2]int{
+		"spam":      {0, 20},
+		"good":      {5, 20},
+		"few":       {0, 5},
+		"manual":    {0, 20},
+		"recovered": {10, 20},
+	} {
+		for i := 0; i < count[0]; i++ {
+			feedback = append(feedback, data.Feedback{
+				FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: strconv.Itoa(i), ItemId: itemId},
+				Timestamp:   time.Now().Add(-time.Hour),
+			})
+		}
+		for i := 0; i < count[1]; i++ {
+			feedback = append(feedback, data.Feedback{
+				FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: strconv.Itoa(i), ItemId: itemId},
+				Timestamp:   time.Now().Add(-time.Hour),
+			})
+		}
+	}
+	err = m.DataClient.BatchInsertFeedback(feedback, true, false, true)
+	assert.NoError(t, err)
+
+	// hide low quality items
+	err = NewQualityGateTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	items, _, err := m.DataClient.BatchGetItems([]string{"spam", "good", "few", "manual", "recovered"})
+	assert.NoError(t, err)
+	hidden := make(map[string]bool)
+	reasons := make(map[string]string)
+	for _, item := range items {
+		hidden[item.ItemId] = item.IsHidden
+		reasons[item.ItemId] = item.HiddenReason
+	}
+	assert.Equal(t, map[string]bool{
+		"spam":      true,
+		"good":      false,
+		"few":       false,
+		"manual":    true,
+		"recovered": false,
+	}, hidden)
+	assert.Equal(t, map[string]string{
+		"spam":      data.HiddenReasonLowQuality,
+		"good":      "",
+		"few":       "",
+		"manual":    "",
+		"recovered": "",
+	}, reasons)
+	hiddenItems, err := m.CacheClient.GetSorted(cache.HiddenItemsV2, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"spam"}, cache.RemoveScores(hiddenItems))
+}
+
+func TestRunCollectExpiredOverridesTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+
+	// insert overrides
+	expired, unexpired := time.Now().Add(-time.Hour).UTC().Truncate(time.Second), time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	err := m.DataClient.SetUserOverrides(data.UserOverrides{
+		UserId:  "partial",
+		Pinned:  []data.PinnedItem{{ItemId: "1", Position: 1, ExpireTime: expired}, {ItemId: "2", Position: 2}},
+		Blocked: []data.BlockedItem{{ItemId: "3", ExpireTime: unexpired}},
+	})
+	assert.NoError(t, err)
+	err = m.DataClient.SetUserOverrides(data.UserOverrides{
+		UserId:  "expired",
+		Blocked: []data.BlockedItem{{ItemId: "3", ExpireTime: expired}},
+	})
+	assert.NoError(t, err)
+
+	// collect expired overrides
+	err = NewCollectExpiredOverridesTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	overrides, err := m.DataClient.GetUserOverrides("partial")
+	assert.NoError(t, err)
+	assert.Equal(t, data.UserOverrides{
+		UserId:  "partial",
+		Pinned:  []data.PinnedItem{{ItemId: "2", Position: 2}},
+		Blocked: []data.BlockedItem{{ItemId: "3", ExpireTime: unexpired}},
+	}, overrides)
+	_, err = m.DataClient.GetUserOverrides("expired")
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
+
+func TestRunCollectExpiredAuditLogsTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Server.Audit.Retention = time.Hour
+
+	// insert audit logs
+	now := time.Now()
+	expired, unexpired := data.NewAuditLogId(now.Add(-2*time.Hour)), data.NewAuditLogId(now)
+	err := m.DataClient.InsertAuditLogs([]data.AuditLog{
+		{Id: expired, Timestamp: now.Add(-2 * time.Hour), Actor: "anonymous", Endpoint: "DELETE /api/item/{item-id}"},
+		{Id: unexpired, Timestamp: now, Actor: "anonymous", Endpoint: "DELETE /api/item/{item-id}"},
+	})
+	assert.NoError(t, err)
+
+	// collect expired audit logs
+	err = NewCollectExpiredAuditLogsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	_, auditLogs, err := m.DataClient.GetAuditLogs("", 10, "", "")
+	assert.NoError(t, err)
+	if assert.Len(t, auditLogs, 1) {
+		assert.Equal(t, unexpired, auditLogs[0].Id)
+	}
+
+	// audit logs are kept forever if the retention is zero
+	m.Config.Server.Audit.Retention = 0
+	err = m.DataClient.InsertAuditLogs([]data.AuditLog{
+		{Id: expired, Timestamp: now.Add(-2 * time.Hour), Actor: "anonymous", Endpoint: "DELETE /api/item/{item-id}"},
+	})
+	assert.NoError(t, err)
+	err = NewCollectExpiredAuditLogsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	_, auditLogs, err = m.DataClient.GetAuditLogs("", 10, "", "")
+	assert.NoError(t, err)
+	assert.Len(t, auditLogs, 2)
+}
+
+func TestRunCollectExpiredHistoryTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Server.History.Retention = time.Hour
+
+	// insert snapshots
+	now := time.Now().Truncate(time.Hour)
+	err := m.DataClient.BatchInsertRecommendSnapshots([]data.RecommendSnapshot{
+		{UserId: "0", Timestamp: now.Add(-2 * time.Hour), Items: []string{"1"}},
+		{UserId: "0", Timestamp: now, Items: []string{"2"}},
+	})
+	assert.NoError(t, err)
+
+	// collect expired snapshots
+	err = NewCollectExpiredHistoryTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	snapshots, err := m.DataClient.GetRecommendSnapshots("0")
+	assert.NoError(t, err)
+	if assert.Len(t, snapshots, 1) {
+		assert.Equal(t, []string{"2"}, snapshots[0].Items)
+	}
+}
+
+func TestTrendingScore(t *testing.T) {
+	// growth of items with few feedback is damped
+	assert.Less(t, trendingScore(4, 2, 10), trendingScore(150, 100, 10))
+	assert.Less(t, trendingScore(4, 0, 10), trendingScore(40, 10, 10))
+	assert.Less(t, trendingScore(15, 0, 10), trendingScore(2000, 1000, 10))
+	// even without smoothing, 2 to 4 is less trending than 100 to 200
+	assert.Less(t, trendingScore(4, 2, 1e-9), trendingScore(200, 100, 1e-9))
+	// the score approaches the growth ratio with lots of feedback
+	assert.InDelta(t, 2.0, trendingScore(2000000, 1000000, 10), 0.01)
+	// stable feedback is not trending
+	assert.Less(t, trendingScore(20, 20, 10), 1.0)
+	assert.Less(t, trendingScore(10, 40, 10), 1.0)
+}
+
+func TestRunFindTrendingItemsTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	m.Config.Recommend.Trending.EnableTrending = true
+	m.Config.Recommend.Trending.TrendingWindow = 24 * time.Hour
+	m.Config.Recommend.Trending.Smoothing = 10
+
+	// insert items
+	err := m.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "viral", Categories: []string{"a"}},
+		{ItemId: "tiny", Categories: []string{"a"}},
+		{ItemId: "rising", Categories: []string{"b"}},
+		{ItemId: "fresh"},
+		{ItemId: "steady", Categories: []string{"c"}},
+		{ItemId: "declining", Categories: []string{"c"}},
+		{ItemId: "old", Categories: []string{"c"}},
+		{ItemId: "hidden", Categories: []string{"a"}, IsHidden: true},
+	})
+	assert.NoError(t, err)
+	// trending items of category c are outdated
+	err = m.CacheClient.SetSorted(cache.Key(cache.TrendingItems, "c"), []cache.Scored{{Id: "steady", Score: 2}})
+	assert.NoError(t, err)
+
+	// insert hourly feedback in the previous window (24h to 48h ago) and the latest window (0h to 24h ago)
+	now := time.Now()
+	var feedback []data.Feedback
+	for itemId, count := range map[string][2]int{
+		"viral":     {10, 40},
+		"tiny":      {2, 4},
+		"rising":    {30, 50},
+		"fresh":     {0, 8},
+		"steady":    {20, 20},
+		"declining": {40, 10},
+		"hidden":    {0, 50},
+	} {
+		for i := 0; i < count[0]; i++ {
+			feedback = append(feedback, data.Feedback{
+				FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "previous" + strconv.Itoa(i), ItemId: itemId},
+				Timestamp:   now.Add(-time.Duration(25+i%23) * time.Hour),
+			})
+		}
+		for i := 0; i < count[1]; i++ {
+			feedback = append(feedback, data.Feedback{
+				FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "recent" + strconv.Itoa(i), ItemId: itemId},
+				Timestamp:   now.Add(-time.Duration(1+i%23) * time.Hour),
+			})
+		}
+	}
+	// feedback before the previous window is ignored
+	for i := 0; i < 100; i++ {
+		feedback = append(feedback, data.Feedback{
+			FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: strconv.Itoa(i), ItemId: "old"},
+			Timestamp:   now.Add(-72 * time.Hour),
+		})
+	}
+	err = m.DataClient.BatchInsertFeedback(feedback, true, false, true)
+	assert.NoError(t, err)
+
+	// find trending items
+	err = NewFindTrendingItemsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	trending, err := m.CacheClient.GetSorted(cache.Key(cache.TrendingItems, ""), 0, -1)
+	assert.NoError(t, err)
+	// growth of fresh (0 to 8) and tiny (2 to 4) is not significant
+	assert.Equal(t, []string{"viral", "rising"}, cache.RemoveScores(trending))
+	assert.InDelta(t, math.Exp(math.Log(2.5)-1.96*math.Sqrt(1.0/50+1.0/20)), trending[0].Score, 1e-6)
+	assert.InDelta(t, math.Exp(math.Log(1.5)-1.96*math.Sqrt(1.0/60+1.0/40)), trending[1].Score, 1e-6)
+	trending, err = m.CacheClient.GetSorted(cache.Key(cache.TrendingItems, "a"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"viral"}, cache.RemoveScores(trending))
+	trending, err = m.CacheClient.GetSorted(cache.Key(cache.TrendingItems, "b"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rising"}, cache.RemoveScores(trending))
+	trending, err = m.CacheClient.GetSorted(cache.Key(cache.TrendingItems, "c"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, trending)
+}
+
+func TestRunFindTrendingItemsTask_ItemTimeField(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	m.Config.Recommend.Trending.EnableTrending = true
+	m.Config.Recommend.Trending.TrendingWindow = 24 * time.Hour
+	m.Config.Recommend.Trending.Smoothing = 10
+
+	// insert a backfilled item with historical timestamp and an item published in the previous window
+	now := time.Now()
+	err := m.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "backfilled", Timestamp: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "published", Timestamp: now.Add(-30 * time.Hour)},
+	})
+	assert.NoError(t, err)
+	var feedback []data.Feedback
+	for itemId, count := range map[string][2]int{
+		"backfilled": {10, 40},
+		"published":  {30, 30},
+	} {
+		// feedback of the previous window is 40 hours ago, before the published item
+		for i := 0; i < count[0]; i++ {
+			feedback = append(feedback, data.Feedback{
+				FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "previous" + strconv.Itoa(i), ItemId: itemId},
+				Timestamp:   now.Add(-40 * time.Hour),
+			})
+		}
+		for i := 0; i < count[1]; i++ {
+			feedback = append(feedback, data.Feedback{
+				FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "recent" + strconv.Itoa(i), ItemId: itemId},
+				Timestamp:   now.Add(-time.Duration(1+i%23) * time.Hour),
+			})
+		}
+	}
+	err = m.DataClient.BatchInsertFeedback(feedback, true, false, true)
+	assert.NoError(t, err)
+
+	// event time: feedback before the published item is ignored
+	m.Config.Recommend.DataSource.ItemTimeField = data.ItemTimeTimestamp
+	err = NewFindTrendingItemsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	trending, err := m.CacheClient.GetSorted(cache.Key(cache.TrendingItems, ""), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"published", "backfilled"}, cache.RemoveScores(trending))
+	assert.InDelta(t, math.Exp(math.Log(4)-1.96*math.Sqrt(1.0/40+1.0/10)), trending[0].Score, 1e-6)
+	assert.InDelta(t, math.Exp(math.Log(2.5)-1.96*math.Sqrt(1.0/50+1.0/20)), trending[1].Score, 1e-6)
+
+	// ingestion time: feedback before both items were inserted is ignored
+	m.Config.Recommend.DataSource.ItemTimeField = data.ItemTimeCreatedAt
+	err = NewFindTrendingItemsTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	trending, err = m.CacheClient.GetSorted(cache.Key(cache.TrendingItems, ""), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, trending)
+}
+
+func TestRunEvaluateRankingModelTask(t *testing.T) {
+	// create mock master
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Recommend.Evaluation.TopN = []int{5, 10}
+
+	// user i likes items i, i+1, ..., i+9 in order
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	dataset := ranking.NewMapIndexDataset()
+	for i := 0; i < 20; i++ {
+		for j := i; j < i+10; j++ {
+			dataset.AddTimedFeedback(strconv.Itoa(i), strconv.Itoa(j), 1, timestamp.Add(time.Duration(j-i)*time.Hour), true)
+		}
+	}
+	var err error
+	m.rankingTrainSet, m.rankingTestSet = dataset.Split(0, 0)
+	m.rankingEvalTrainSet, m.rankingEvalTestSet, err = dataset.SplitByTime(m.Config.Recommend.Evaluation.TestRatio)
+	assert.NoError(t, err)
+	m.rankingModelName = "bpr"
+	m.RankingModel = ranking.NewBPR(model.Params{model.NEpochs: 5})
+
+	// evaluate model
+	evaluateTask := NewEvaluateRankingModelTask(&m.Master)
+	err = evaluateTask.run(nil)
+	assert.NoError(t, err)
+	reports, err := m.GetEvaluationReports(10)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(reports)) {
+		assert.Equal(t, "bpr", reports[0].ModelName)
+		assert.Equal(t, 160, reports[0].NumTrainFeedback)
+		assert.Equal(t, 40, reports[0].NumTestFeedback)
+		assert.Equal(t, 2, len(reports[0].Scores))
+		assert.Equal(t, 5, reports[0].Scores[0].N)
+		assert.Equal(t, 10, reports[0].Scores[1].N)
+		for _, score := range reports[0].Scores {
+			assert.Greater(t, score.Coverage, float32(0))
+			assert.LessOrEqual(t, score.Coverage, float32(1))
+		}
+	}
+
+	// nothing changed
+	err = evaluateTask.run(nil)
+	assert.NoError(t, err)
+	reports, err = m.GetEvaluationReports(10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(reports))
+}
+
+func TestMaster_SaveEvaluationReport_HistorySize(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	m.Config.Recommend.Evaluation.HistorySize = 3
+
+	// only the latest reports are kept
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		err := m.saveEvaluationReport(EvaluationReport{Timestamp: timestamp.Add(time.Duration(i) * time.Hour), ModelName: "bpr"})
+		assert.NoError(t, err)
+	}
+	reports, err := m.GetEvaluationReports(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{timestamp.Add(4 * time.Hour), timestamp.Add(3 * time.Hour), timestamp.Add(2 * time.Hour)},
+		lo.Map(reports, func(report EvaluationReport, _ int) time.Time {
+			return report.Timestamp.UTC()
+		}))
 }
@@ -0,0 +1,238 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+// Metrics of usage collected by the master. Metrics of table sizes are followed by names of tables, such as
+// "bytes:feedback".
+const (
+	UsageUniqueUsers = "unique_users"
+	UsageUsers       = "users"
+	UsageItems       = "items"
+	UsageBytes       = "bytes:"
+
+	// usageGracePeriod is the delay after midnight (UTC) before usage of the last day is collected, so that servers
+	// have saved their final counters of the last day.
+	usageGracePeriod = time.Hour
+	// usageCollectDays is the number of past days whose counters are collected if they were missed.
+	usageCollectDays = monthlyDays
+	// usageDefaultDays is the number of days reported by default.
+	usageDefaultDays = 30
+)
+
+type CollectUsageTask struct {
+	*Master
+}
+
+func NewCollectUsageTask(m *Master) *CollectUsageTask {
+	return &CollectUsageTask{m}
+}
+
+func (t *CollectUsageTask) name() string {
+	return TaskCollectUsage
+}
+
+func (t *CollectUsageTask) priority() int {
+	return -t.rankingTrainSet.UserCount()
+}
+
+// run collects usage of past days into the data store once a day. Counters of servers are summed up, and sizes of
+// the data store are measured when the last day is collected. Counters of days missed by the master are collected as
+// well, but sizes of these days are unknown.
+func (t *CollectUsageTask) run(_ *task.JobsAllocator) error {
+	start := time.Now()
+	lastDay := server.ActivityDay(start.Add(-usageGracePeriod).AddDate(0, 0, -1))
+	recorded, err := t.DataClient.GetUsage(lastDay, lastDay)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(recorded) > 0 {
+		return nil
+	}
+	log.Logger().Info("start collecting usage", zap.String("day", lastDay))
+	t.taskMonitor.Start(TaskCollectUsage, usageCollectDays)
+	for d := usageCollectDays - 1; d >= 0; d-- {
+		day := server.ActivityDay(start.Add(-usageGracePeriod).AddDate(0, 0, -1-d))
+		nodes, err := t.CacheClient.GetSet(cache.Key(cache.UsageNodes, day))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(nodes) > 0 || day == lastDay {
+			usage, err := t.readUsage(day, nodes)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if day == lastDay {
+				sizes, err := t.readStorageUsage(day)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				usage = append(usage, sizes...)
+			}
+			if err = t.DataClient.BatchInsertUsage(usage); err != nil {
+				return errors.Trace(err)
+			}
+			// remove collected counters
+			for _, node := range nodes {
+				if err = t.CacheClient.SetSorted(cache.Key(cache.UsageCounters, day, node), nil); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			if err = t.CacheClient.RemSet(cache.Key(cache.UsageNodes, day), nodes...); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		t.taskMonitor.Update(TaskCollectUsage, usageCollectDays-d)
+	}
+	t.taskMonitor.Finish(TaskCollectUsage)
+	log.Logger().Info("complete collecting usage", zap.String("day", lastDay), zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+// readUsage sums up counters of nodes in a day, and estimates the number of unique users giving feedback in the day.
+func (m *Master) readUsage(day string, nodes []string) ([]data.Usage, error) {
+	counters := make(map[string]int64)
+	for _, node := range nodes {
+		scores, err := m.CacheClient.GetSorted(cache.Key(cache.UsageCounters, day, node), 0, -1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, score := range scores {
+			counters[score.Id] += int64(score.Score)
+		}
+	}
+	sketch, err := loadSketch(m.CacheClient, cache.Key(cache.ActiveUsersSketch, day))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	usage := []data.Usage{{Day: day, Metric: UsageUniqueUsers, Value: int64(sketch.Count())}}
+	for metric, count := range counters {
+		usage = append(usage, data.Usage{Day: day, Metric: metric, Value: count})
+	}
+	return usage, nil
+}
+
+// readStorageUsage counts users and items, and measures sizes of tables if they are available.
+func (m *Master) readStorageUsage(day string) ([]data.Usage, error) {
+	numUsers, err := m.DataClient.CountUsers()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	numItems, err := m.DataClient.CountItems()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	usage := []data.Usage{
+		{Day: day, Metric: UsageUsers, Value: int64(numUsers)},
+		{Day: day, Metric: UsageItems, Value: int64(numItems)},
+	}
+	sizes, err := m.DataClient.GetTableSizes()
+	if errors.Is(err, errors.NotSupported) {
+		log.Logger().Debug("sizes of tables are unavailable", zap.Error(err))
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for table, size := range sizes {
+		usage = append(usage, data.Usage{Day: day, Metric: UsageBytes + table, Value: size})
+	}
+	return usage, nil
+}
+
+// getUsage returns usage between two days (both inclusive) in JSON or CSV. Usage of days not collected yet, such as
+// today, is read from counters in the cache store.
+func (m *Master) getUsage(request *restful.Request, response *restful.Response) {
+	now := time.Now()
+	to := request.QueryParameter("to")
+	if to == "" {
+		to = server.ActivityDay(now)
+	}
+	toDay, err := time.Parse("2006-01-02", to)
+	if err != nil {
+		server.BadRequest(response, errors.NotValidf("day %s", to))
+		return
+	}
+	from := request.QueryParameter("from")
+	if from == "" {
+		from = server.ActivityDay(toDay.AddDate(0, 0, 1-usageDefaultDays))
+	}
+	fromDay, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		server.BadRequest(response, errors.NotValidf("day %s", from))
+		return
+	}
+	usage, err := m.DataClient.GetUsage(from, to)
+	if err != nil {
+		server.InternalServerError(response, err)
+		return
+	}
+	// read usage not collected yet
+	recorded := make(map[string]struct{})
+	for _, u := range usage {
+		recorded[u.Day] = struct{}{}
+	}
+	// counters older than days to collect have been collected or dropped
+	if earliest := now.AddDate(0, 0, -usageCollectDays-1).UTC().Truncate(24 * time.Hour); fromDay.Before(earliest) {
+		fromDay = earliest
+	}
+	for day := fromDay; !day.After(toDay) && !day.After(now); day = day.AddDate(0, 0, 1) {
+		if _, exist := recorded[server.ActivityDay(day)]; exist {
+			continue
+		}
+		nodes, err := m.CacheClient.GetSet(cache.Key(cache.UsageNodes, server.ActivityDay(day)))
+		if err != nil {
+			server.InternalServerError(response, err)
+			return
+		}
+		if len(nodes) > 0 {
+			live, err := m.readUsage(server.ActivityDay(day), nodes)
+			if err != nil {
+				server.InternalServerError(response, err)
+				return
+			}
+			usage = append(usage, live...)
+		}
+	}
+	data.SortUsage(usage)
+	if request.QueryParameter("format") != "csv" {
+		server.Ok(response, usage)
+		return
+	}
+	response.Header().Set("Content-Type", "text/csv")
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=usage_%s_%s.csv", from, to))
+	if _, err = response.Write([]byte("day,metric,value\r\n")); err != nil {
+		log.ResponseLogger(response).Error("failed to write usage", zap.Error(err))
+		return
+	}
+	for _, u := range usage {
+		if _, err = response.Write([]byte(fmt.Sprintf("%s,%s,%d\r\n", u.Day, base.Escape(u.Metric), u.Value))); err != nil {
+			log.ResponseLogger(response).Error("failed to write usage", zap.Error(err))
+			return
+		}
+	}
+}
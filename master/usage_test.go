@@ -0,0 +1,129 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/hll"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+// setUsageCounters saves counters of a node in a day into the cache store.
+func setUsageCounters(t *testing.T, cacheClient cache.Database, day, node string, counters ...cache.Scored) {
+	err := cacheClient.AddSet(cache.Key(cache.UsageNodes, day), node)
+	assert.NoError(t, err)
+	err = cacheClient.SetSorted(cache.Key(cache.UsageCounters, day, node), counters)
+	assert.NoError(t, err)
+}
+
+func TestRunCollectUsageTask(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	err := m.DataClient.BatchInsertFeedback([]data.Feedback{{FeedbackKey: data.FeedbackKey{UserId: "1", ItemId: "10"}}}, true, true, true)
+	assert.NoError(t, err)
+
+	// counters of the last day and a missed day
+	now := time.Now()
+	lastDay := server.ActivityDay(now.Add(-usageGracePeriod).AddDate(0, 0, -1))
+	missedDay := server.ActivityDay(now.Add(-usageGracePeriod).AddDate(0, 0, -3))
+	today := server.ActivityDay(now.Add(-usageGracePeriod))
+	setUsageCounters(t, m.CacheClient, lastDay, "a", cache.Scored{Id: server.UsageIngestedFeedback, Score: 3})
+	setUsageCounters(t, m.CacheClient, lastDay, "b", cache.Scored{Id: server.UsageIngestedFeedback, Score: 4})
+	setUsageCounters(t, m.CacheClient, missedDay, "a", cache.Scored{Id: server.UsageIngestedUsers, Score: 5})
+	setUsageCounters(t, m.CacheClient, today, "a", cache.Scored{Id: server.UsageIngestedUsers, Score: 6})
+	users := hll.New(server.ActivityPrecision)
+	users.Add("1")
+	users.Add("2")
+	err = m.CacheClient.Set(cache.String(cache.Key(cache.ActiveUsersSketch, lastDay), users.String()))
+	assert.NoError(t, err)
+
+	err = NewCollectUsageTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	usage, err := m.DataClient.GetUsage(missedDay, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []data.Usage{
+		{Day: missedDay, Metric: server.UsageIngestedUsers, Value: 5},
+		{Day: missedDay, Metric: UsageUniqueUsers, Value: 0},
+		{Day: lastDay, Metric: server.UsageIngestedFeedback, Value: 7},
+		{Day: lastDay, Metric: UsageItems, Value: 1},
+		{Day: lastDay, Metric: UsageUniqueUsers, Value: 2},
+		{Day: lastDay, Metric: UsageUsers, Value: 1},
+	}, usage)
+	// collected counters are removed
+	nodes, err := m.CacheClient.GetSet(cache.Key(cache.UsageNodes, lastDay))
+	assert.NoError(t, err)
+	assert.Empty(t, nodes)
+	counters, err := m.CacheClient.GetSorted(cache.Key(cache.UsageCounters, lastDay, "a"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, counters)
+	nodes, err = m.CacheClient.GetSet(cache.Key(cache.UsageNodes, today))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, nodes)
+
+	// the last day is collected once
+	setUsageCounters(t, m.CacheClient, lastDay, "c", cache.Scored{Id: server.UsageIngestedFeedback, Score: 1})
+	err = NewCollectUsageTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	usage, err = m.DataClient.GetUsage(lastDay, lastDay)
+	assert.NoError(t, err)
+	assert.Contains(t, usage, data.Usage{Day: lastDay, Metric: server.UsageIngestedFeedback, Value: 7})
+}
+
+func TestMaster_GetUsage(t *testing.T) {
+	s, cookie := newMockServer(t)
+	defer s.Close(t)
+	today := server.ActivityDay(time.Now())
+	err := s.DataClient.BatchInsertUsage([]data.Usage{
+		{Day: "2022-10-01", Metric: UsageUsers, Value: 10},
+		{Day: "2022-10-02", Metric: UsageUsers, Value: 20},
+	})
+	assert.NoError(t, err)
+	setUsageCounters(t, s.CacheClient, today, "a", cache.Scored{Id: server.UsageRequests + "GET /api/user/{user-id}", Score: 3})
+
+	// get recorded usage
+	req := httptest.NewRequest("GET", "https://example.com/api/dashboard/usage?from=2022-10-02&to=2022-10-31", nil)
+	req.Header.Set("Cookie", cookie)
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"Day":"2022-10-02","Metric":"users","Value":20}]`, w.Body.String())
+
+	// get usage of today from counters in CSV
+	req = httptest.NewRequest("GET", "https://example.com/api/dashboard/usage?format=csv", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, "day,metric,value\r\n"+
+		today+",requests:GET /api/user/{user-id},3\r\n"+
+		today+",unique_users,0\r\n", w.Body.String())
+
+	// invalid day
+	req = httptest.NewRequest("GET", "https://example.com/api/dashboard/usage?from=yesterday", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -32,6 +32,7 @@ type Vectors struct {
 	connections [][]int32
 	connected   [][]int32
 	weights     []float32
+	jaccard     bool
 }
 
 func NewVectors(connections, connected [][]int32, weights []float32) *Vectors {
@@ -45,7 +46,17 @@ func NewVectors(connections, connected [][]int32, weights []float32) *Vectors {
 	}
 }
 
+// NewJaccardVectors creates vectors measured by weighted Jaccard similarity.
+func NewJaccardVectors(connections, connected [][]int32, weights []float32) *Vectors {
+	v := NewVectors(connections, connected, weights)
+	v.jaccard = true
+	return v
+}
+
 func (v *Vectors) Distance(i, j int) float32 {
+	if v.jaccard {
+		return v.jaccardDistance(i, j)
+	}
 	commonSum, commonCount := commonElements(v.connections[i], v.connections[j], v.weights)
 	if commonCount > 0 {
 		return commonSum * commonCount /
@@ -57,6 +68,16 @@ func (v *Vectors) Distance(i, j int) float32 {
 	}
 }
 
+func (v *Vectors) jaccardDistance(i, j int) float32 {
+	commonSum, _ := commonElements(v.connections[i], v.connections[j], v.weights)
+	unionSum := weightedSum(v.connections[i], v.weights) + weightedSum(v.connections[j], v.weights) - commonSum
+	if commonSum > 0 && unionSum > 0 {
+		return commonSum / unionSum
+	} else {
+		return 0
+	}
+}
+
 func (v *Vectors) Neighbors(i int) []int32 {
 	connections := v.connections[i]
 	bitSet := bitset.New(uint(len(connections)))
@@ -75,20 +96,27 @@ func (v *Vectors) Neighbors(i int) []int32 {
 type DualVectors struct {
 	first  *Vectors
 	second *Vectors
+	alpha  float32
 }
 
 func NewDualVectors(first, second *Vectors) *DualVectors {
+	return NewWeightedDualVectors(first, second, 0.5)
+}
+
+// NewWeightedDualVectors creates dual vectors measured by (1 - alpha) * first + alpha * second.
+func NewWeightedDualVectors(first, second *Vectors, alpha float32) *DualVectors {
 	if len(first.connections) != len(second.connections) {
 		panic("the number of connections mismatch")
 	}
 	return &DualVectors{
 		first:  first,
 		second: second,
+		alpha:  alpha,
 	}
 }
 
 func (v *DualVectors) Distance(i, j int) float32 {
-	return (v.first.Distance(i, j) + v.second.Distance(i, j)) / 2
+	return (1-v.alpha)*v.first.Distance(i, j) + v.alpha*v.second.Distance(i, j)
 }
 
 func (v *DualVectors) Neighbors(i int) []int32 {
@@ -0,0 +1,85 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+)
+
+// item 0 has labels {0, 1, 2}, item 1 has labels {1, 2, 3} and item 2 has labels {3}.
+var (
+	testConnections = [][]int32{{0, 1, 2}, {1, 2, 3}, {3}}
+	testConnected   = [][]int32{{0}, {0, 1}, {0, 1}, {1, 2}}
+)
+
+func TestVectors_Cosine(t *testing.T) {
+	vectors := NewVectors(testConnections, testConnected, []float32{1, 1, 1, 1})
+	// 2 * 2 / sqrt(3) / sqrt(3) / (2 + 100)
+	assert.InDelta(t, 4.0/3.0/102.0, vectors.Distance(0, 1), 1e-6)
+	assert.Zero(t, vectors.Distance(0, 2))
+	assert.ElementsMatch(t, []int32{0, 1}, vectors.Neighbors(0))
+}
+
+func TestVectors_Jaccard(t *testing.T) {
+	vectors := NewJaccardVectors(testConnections, testConnected, []float32{1, 1, 1, 1})
+	// |{1, 2}| / |{0, 1, 2, 3}|
+	assert.InDelta(t, 0.5, vectors.Distance(0, 1), 1e-6)
+	// |{3}| / |{1, 2, 3}|
+	assert.InDelta(t, 1.0/3.0, vectors.Distance(1, 2), 1e-6)
+	assert.Zero(t, vectors.Distance(0, 2))
+	assert.ElementsMatch(t, []int32{0, 1}, vectors.Neighbors(0))
+
+	// (2 + 2) / (1 + 2 + 2 + 1)
+	vectors = NewJaccardVectors(testConnections, testConnected, []float32{1, 2, 2, 1})
+	assert.InDelta(t, 4.0/6.0, vectors.Distance(0, 1), 1e-6)
+}
+
+func TestDualVectors_Hybrid(t *testing.T) {
+	labels := NewJaccardVectors(testConnections, testConnected, []float32{1, 1, 1, 1})
+	// item 0 has users {0}, item 1 has users {0, 1} and item 2 has users {1}.
+	feedback := NewJaccardVectors([][]int32{{0}, {0, 1}, {1}}, [][]int32{{0, 1}, {1, 2}}, []float32{1, 1})
+	// 0.5 * 0.5 + 0.5 * 0.5
+	vectors := NewDualVectors(labels, feedback)
+	assert.InDelta(t, 0.5, vectors.Distance(0, 1), 1e-6)
+	// 0.8 * 0.5 + 0.2 * 0.5
+	vectors = NewWeightedDualVectors(labels, feedback, 0.2)
+	assert.InDelta(t, 0.5, vectors.Distance(0, 1), 1e-6)
+	// 0.8 * 1/3 + 0.2 * 1/2
+	assert.InDelta(t, 0.8/3.0+0.1, vectors.Distance(1, 2), 1e-6)
+	// 0.8 * 0 + 0.2 * 0
+	assert.Zero(t, vectors.Distance(0, 2))
+	// labels only
+	vectors = NewWeightedDualVectors(labels, feedback, 0)
+	assert.InDelta(t, 1.0/3.0, vectors.Distance(1, 2), 1e-6)
+	// feedback only
+	vectors = NewWeightedDualVectors(labels, feedback, 1)
+	assert.InDelta(t, 0.5, vectors.Distance(1, 2), 1e-6)
+}
+
+func TestIsIndexSupported(t *testing.T) {
+	cfg := config.GetDefaultConfig().Recommend.ItemNeighbors
+	assert.True(t, isIndexSupported(cfg))
+	cfg.HybridAlpha = 0.8
+	assert.False(t, isIndexSupported(cfg))
+	cfg.NeighborType = config.NeighborTypeSimilar
+	assert.True(t, isIndexSupported(cfg))
+	cfg.LabelSimilarity = config.SimilarityJaccard
+	assert.False(t, isIndexSupported(cfg))
+	cfg.NeighborType = config.NeighborTypeRelated
+	assert.True(t, isIndexSupported(cfg))
+}
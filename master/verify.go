@@ -0,0 +1,287 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+// Reasons of discrepancies between cached documents and the data store.
+const (
+	DiscrepancyMissing  = "missing"  // the item doesn't exist in the data store
+	DiscrepancyHidden   = "hidden"   // the item is hidden in the data store
+	DiscrepancyCategory = "category" // the item doesn't belong to the category of the document
+)
+
+// maxReportedDiscrepancies is the max number of discrepancies reported in the details of a verification.
+const maxReportedDiscrepancies = 100
+
+// CacheDiscrepancy is an item in a cached document which is inconsistent with the data store.
+type CacheDiscrepancy struct {
+	Key    string
+	ItemId string
+	Reason string
+}
+
+// CacheVerification is the result of verifying cached documents of sampled users and items. The inconsistency rate is
+// the ratio of inconsistent users and items to sampled users and items. Inconsistent users are repaired if they are
+// pushed to the priority refresh queue, and neighbors of inconsistent items are searched again in the next cycle.
+type CacheVerification struct {
+	NumUsers             int
+	NumItems             int
+	NumInconsistentUsers int
+	NumInconsistentItems int
+	NumRepairedUsers     int
+	InconsistencyRate    float64
+	Discrepancies        []CacheDiscrepancy
+}
+
+// cachedDocument is a cached list of items in a category.
+type cachedDocument struct {
+	key      string
+	category string
+	itemIds  []string
+}
+
+type VerifyCacheTask struct {
+	*Master
+}
+
+func NewVerifyCacheTask(m *Master) *VerifyCacheTask {
+	return &VerifyCacheTask{m}
+}
+
+func (t *VerifyCacheTask) name() string {
+	return TaskVerifyCache
+}
+
+func (t *VerifyCacheTask) priority() int {
+	return -t.Config.Master.Verification.NumUsers - t.Config.Master.Verification.NumItems
+}
+
+// run verifies offline recommendation of sampled users and neighbors of sampled items against the data store. Items
+// in cached documents should exist, be visible and belong to categories of documents. Cached documents aren't written
+// directly, inconsistent users are pushed to the priority refresh queue instead.
+func (t *VerifyCacheTask) run(_ *task.JobsAllocator) error {
+	verificationConfig := t.Config.Master.Verification
+	log.Logger().Info("start verifying cache",
+		zap.Int("n_users", verificationConfig.NumUsers),
+		zap.Int("n_items", verificationConfig.NumItems))
+	t.taskMonitor.Start(TaskVerifyCache, verificationConfig.NumUsers+verificationConfig.NumItems)
+	start := time.Now()
+	var (
+		users []data.User
+		items []data.Item
+		err   error
+	)
+	if verificationConfig.NumUsers > 0 {
+		if users, err = t.DataClient.SampleUsers(verificationConfig.NumUsers, false, rand.Int63()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if verificationConfig.NumItems > 0 {
+		if items, err = t.DataClient.SampleItems(verificationConfig.NumItems, "", rand.Int63()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	categories, err := t.CacheClient.GetSet(cache.ItemCategories)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	verification := CacheVerification{NumUsers: len(users), NumItems: len(items)}
+
+	// verify offline recommendation of users
+	var inconsistentUsers []string
+	for i, user := range users {
+		documents, err := t.readCachedDocuments(cache.OfflineRecommend, user.UserId, categories)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		discrepancies, err := t.verifyCachedDocuments(documents)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(discrepancies) > 0 {
+			inconsistentUsers = append(inconsistentUsers, user.UserId)
+			verification.addDiscrepancies(discrepancies)
+		}
+		t.taskMonitor.Update(TaskVerifyCache, i+1)
+	}
+	verification.NumInconsistentUsers = len(inconsistentUsers)
+	if verification.NumRepairedUsers, err = t.repairUsers(inconsistentUsers); err != nil {
+		return errors.Trace(err)
+	}
+
+	// verify neighbors of items
+	var inconsistentItems []string
+	for i, item := range items {
+		neighborCategories, err := t.CacheClient.GetSet(cache.Key(cache.ItemNeighborCategories, item.ItemId))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		documents, err := t.readCachedDocuments(cache.ItemNeighbors, item.ItemId, neighborCategories)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		discrepancies, err := t.verifyCachedDocuments(documents)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(discrepancies) > 0 {
+			inconsistentItems = append(inconsistentItems, item.ItemId)
+			verification.addDiscrepancies(discrepancies)
+		}
+		t.taskMonitor.Update(TaskVerifyCache, len(users)+i+1)
+	}
+	verification.NumInconsistentItems = len(inconsistentItems)
+	if err = t.repairItems(inconsistentItems); err != nil {
+		return errors.Trace(err)
+	}
+
+	if total := verification.NumUsers + verification.NumItems; total > 0 {
+		verification.InconsistencyRate = float64(verification.NumInconsistentUsers+verification.NumInconsistentItems) / float64(total)
+	}
+	CacheInconsistencyRate.Set(verification.InconsistencyRate)
+	t.taskMonitor.SetDetails(TaskVerifyCache, verification)
+	t.taskMonitor.Finish(TaskVerifyCache)
+	log.Logger().Info("complete verifying cache",
+		zap.Int("n_inconsistent_users", verification.NumInconsistentUsers),
+		zap.Int("n_inconsistent_items", verification.NumInconsistentItems),
+		zap.Int("n_repaired_users", verification.NumRepairedUsers),
+		zap.Float64("inconsistency_rate", verification.InconsistencyRate),
+		zap.Duration("used_time", time.Since(start)))
+	return nil
+}
+
+func (v *CacheVerification) addDiscrepancies(discrepancies []CacheDiscrepancy) {
+	if n := maxReportedDiscrepancies - len(v.Discrepancies); n > 0 {
+		v.Discrepancies = append(v.Discrepancies, discrepancies[:lo.Min([]int{n, len(discrepancies)})]...)
+	}
+}
+
+// readCachedDocuments reads cached lists of items of a user or an item in all categories and in each category.
+func (m *Master) readCachedDocuments(prefix, id string, categories []string) ([]cachedDocument, error) {
+	var documents []cachedDocument
+	for _, category := range append([]string{""}, categories...) {
+		key := cache.Key(prefix, id, category)
+		scores, err := m.CacheClient.GetSorted(key, 0, -1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(scores) > 0 {
+			documents = append(documents, cachedDocument{key: key, category: category, itemIds: cache.RemoveScores(scores)})
+		}
+	}
+	return documents, nil
+}
+
+// verifyCachedDocuments returns items in cached documents which don't exist, are hidden or don't belong to categories
+// of documents in the data store.
+func (m *Master) verifyCachedDocuments(documents []cachedDocument) ([]CacheDiscrepancy, error) {
+	if len(documents) == 0 {
+		return nil, nil
+	}
+	itemIds := lo.Uniq(lo.FlatMap(documents, func(document cachedDocument, _ int) []string {
+		return document.itemIds
+	}))
+	items, _, err := m.DataClient.BatchGetItems(itemIds)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	itemMap := lo.SliceToMap(items, func(item data.Item) (string, data.Item) {
+		return item.ItemId, item
+	})
+	var discrepancies []CacheDiscrepancy
+	for _, document := range documents {
+		for _, itemId := range document.itemIds {
+			item, exist := itemMap[itemId]
+			if !exist {
+				discrepancies = append(discrepancies, CacheDiscrepancy{Key: document.key, ItemId: itemId, Reason: DiscrepancyMissing})
+			} else if item.IsHidden {
+				discrepancies = append(discrepancies, CacheDiscrepancy{Key: document.key, ItemId: itemId, Reason: DiscrepancyHidden})
+			} else if document.category != "" && !lo.Contains(item.Categories, document.category) {
+				discrepancies = append(discrepancies, CacheDiscrepancy{Key: document.key, ItemId: itemId, Reason: DiscrepancyCategory})
+			}
+		}
+	}
+	return discrepancies, nil
+}
+
+// repairUsers pushes users to the priority refresh queue, so that workers regenerate their offline recommendation.
+// Users aren't repaired if the priority refresh queue is disabled. The number of repaired users is returned.
+func (m *Master) repairUsers(userIds []string) (int, error) {
+	offlineConfig := &m.Config.Recommend.Offline
+	if len(userIds) == 0 || offlineConfig.PriorityRefreshQueueSize <= 0 || offlineConfig.MaxPriorityRefreshPerMinute <= 0 {
+		return 0, nil
+	}
+	// recommendation is regenerated by workers even if it hasn't expired
+	now := time.Now()
+	if err := m.CacheClient.Set(lo.Map(userIds, func(userId string, _ int) cache.Value {
+		return cache.Time(cache.Key(cache.LastModifyUserTime, userId), now)
+	})...); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if err := m.PushPriorityUsers(userIds); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return len(userIds), nil
+}
+
+// repairItems marks items modified, so that neighbors of items are searched again in the next cycle.
+func (m *Master) repairItems(itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return m.CacheClient.Set(lo.Map(itemIds, func(itemId string, _ int) cache.Value {
+		return cache.Time(cache.Key(cache.LastModifyItemTime, itemId), now)
+	})...)
+}
+
+// RunVerifyCacheLoop verifies cached documents against the data store periodically. It never runs if the period is
+// zero.
+func (m *Master) RunVerifyCacheLoop() {
+	defer base.CheckPanic()
+	period := m.Config.Master.Verification.Period
+	if period <= 0 {
+		return
+	}
+	for {
+		time.Sleep(period)
+		t := NewVerifyCacheTask(m)
+		if !m.jobsScheduler.Register(t.name(), t.priority(), false) {
+			continue
+		}
+		j := m.jobsScheduler.GetJobsAllocator(t.name())
+		j.Init()
+		m.snapshotMutex.RLock()
+		if err := t.run(j); err != nil {
+			log.Logger().Error("failed to run task", zap.String("task", t.name()), zap.Error(err))
+			m.taskMonitor.Fail(t.name(), err.Error())
+		}
+		m.snapshotMutex.RUnlock()
+		m.jobsScheduler.Unregister(t.name())
+	}
+}
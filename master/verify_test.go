@@ -0,0 +1,85 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestRunVerifyCacheTask(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.Config = config.GetDefaultConfig()
+	timestamp := time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)
+	err := m.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1", Categories: []string{"a"}, Timestamp: timestamp},
+		{ItemId: "2", Categories: []string{"b"}, Timestamp: timestamp},
+		{ItemId: "3", IsHidden: true, Timestamp: timestamp},
+	})
+	assert.NoError(t, err)
+	err = m.DataClient.BatchInsertUsers([]data.User{{UserId: "1"}, {UserId: "2"}})
+	assert.NoError(t, err)
+	err = m.CacheClient.AddSet(cache.ItemCategories, "a", "b")
+	assert.NoError(t, err)
+	// user 1 is consistent, user 2 is recommended a deleted item and an item out of the category
+	err = m.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "1"), []cache.Scored{{Id: "1", Score: 2}, {Id: "2", Score: 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "1", "a"), []cache.Scored{{Id: "1", Score: 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "2"), []cache.Scored{{Id: "1", Score: 2}, {Id: "4", Score: 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "2", "a"), []cache.Scored{{Id: "2", Score: 1}})
+	assert.NoError(t, err)
+	// item 1 is consistent, item 2 has a hidden neighbor
+	err = m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "1"), []cache.Scored{{Id: "2", Score: 1}})
+	assert.NoError(t, err)
+	err = m.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "2"), []cache.Scored{{Id: "1", Score: 2}, {Id: "3", Score: 1}})
+	assert.NoError(t, err)
+
+	err = NewVerifyCacheTask(&m.Master).run(nil)
+	assert.NoError(t, err)
+	verification, ok := m.taskMonitor.GetTask(TaskVerifyCache).Details.(CacheVerification)
+	if assert.True(t, ok) {
+		assert.Equal(t, 2, verification.NumUsers)
+		assert.Equal(t, 2, verification.NumItems)
+		assert.Equal(t, 1, verification.NumInconsistentUsers)
+		assert.Equal(t, 1, verification.NumInconsistentItems)
+		assert.Equal(t, 1, verification.NumRepairedUsers)
+		assert.Equal(t, 0.5, verification.InconsistencyRate)
+		assert.ElementsMatch(t, []CacheDiscrepancy{
+			{Key: cache.Key(cache.OfflineRecommend, "2"), ItemId: "4", Reason: DiscrepancyMissing},
+			{Key: cache.Key(cache.OfflineRecommend, "2", "a"), ItemId: "2", Reason: DiscrepancyCategory},
+			{Key: cache.Key(cache.ItemNeighbors, "2"), ItemId: "3", Reason: DiscrepancyHidden},
+		}, verification.Discrepancies)
+	}
+
+	// inconsistent users are pushed to the priority refresh queue
+	queue, err := m.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2"}, cache.RemoveScores(queue))
+	_, err = m.CacheClient.Get(cache.Key(cache.LastModifyUserTime, "2")).Time()
+	assert.NoError(t, err)
+	// neighbors of inconsistent items are searched again
+	_, err = m.CacheClient.Get(cache.Key(cache.LastModifyItemTime, "2")).Time()
+	assert.NoError(t, err)
+	_, err = m.CacheClient.Get(cache.Key(cache.LastModifyItemTime, "1")).Time()
+	assert.Error(t, err)
+}
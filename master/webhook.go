@@ -0,0 +1,370 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventTaskCompleted     = "task_completed"
+	EventTaskFailed        = "task_failed"
+	EventStalenessExceeded = "staleness_exceeded"
+	EventIngestStalled     = "ingest_stalled"
+	EventQuotaNearLimit    = "quota_near_limit"
+	EventAlertFiring       = "alert_firing"
+	EventAlertResolved     = "alert_resolved"
+
+	webhookQueueSize = 1000
+	webhookTimeout   = 10 * time.Second
+	// webhookConcurrency is the max number of events being delivered at the same time
+	webhookConcurrency = 16
+	// deliveries older than webhookDeliveryTTL are removed
+	webhookDeliveryTTL = 7 * 24 * time.Hour
+
+	stalenessCheckPeriod = time.Minute
+	stalenessBatchSize   = 1000
+)
+
+// WebhookPayload is posted to webhooks in JSON.
+type WebhookPayload struct {
+	Id        string
+	Event     string
+	Timestamp time.Time
+	Data      any
+}
+
+// WebhookDelivery is an attempt to deliver a payload to a webhook.
+type WebhookDelivery struct {
+	PayloadId  string
+	Event      string
+	URL        string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Timestamp  time.Time
+}
+
+// StalenessExceeded is the data of staleness_exceeded events.
+type StalenessExceeded struct {
+	MaxStaleness time.Duration
+	Threshold    time.Duration
+}
+
+// IngestStalled is the data of ingest_stalled events.
+type IngestStalled struct {
+	// Since is the latest time that feedback was ingested.
+	Since time.Time
+}
+
+// QuotaNearLimit is the data of quota_near_limit events.
+type QuotaNearLimit struct {
+	Quota string
+	Usage server.QuotaUsage
+}
+
+// notifyWebhooks enqueues an event if any webhook subscribes it. Events are dropped if the queue is full.
+func (m *Master) notifyWebhooks(event string, data any) {
+	webhook := m.Config.Master.Webhook
+	if len(webhook.URLs) == 0 || (len(webhook.Events) > 0 && !lo.Contains(webhook.Events, event)) {
+		return
+	}
+	payload := WebhookPayload{
+		Id:        uuid.NewString(),
+		Event:     event,
+		Timestamp: time.Now(),
+		Data:      data,
+	}
+	select {
+	case m.webhookChan <- payload:
+	default:
+		log.Logger().Warn("webhook queue is full, drop event", zap.String("event", event))
+	}
+}
+
+// notifyTaskDone notifies webhooks that a task completes or fails.
+func (m *Master) notifyTaskDone(t task.Task) {
+	switch t.Status {
+	case task.StatusComplete:
+		m.notifyWebhooks(EventTaskCompleted, t)
+	case task.StatusFailed:
+		m.notifyWebhooks(EventTaskFailed, t)
+	}
+}
+
+// checkStaleness notifies webhooks once the max staleness of offline recommendation exceeds the threshold. It isn't
+// notified again until the staleness recovers.
+func (m *Master) checkStaleness(maxStaleness time.Duration) {
+	threshold := m.Config.Master.Webhook.StalenessThreshold
+	if threshold <= 0 || maxStaleness <= threshold {
+		m.stalenessExceeded = false
+		return
+	}
+	if !m.stalenessExceeded {
+		m.stalenessExceeded = true
+		m.notifyWebhooks(EventStalenessExceeded, StalenessExceeded{MaxStaleness: maxStaleness, Threshold: threshold})
+	}
+}
+
+// measureStaleness reads the latest update time of offline recommendation of users in the dataset by batches, and
+// exports the max staleness.
+func (m *Master) measureStaleness() error {
+	m.rankingDataMutex.RLock()
+	var userIds []string
+	if m.rankingTrainSet != nil {
+		userIds = m.rankingTrainSet.UserIndex.GetNames()
+	}
+	m.rankingDataMutex.RUnlock()
+	var maxStaleness time.Duration
+	for begin := 0; begin < len(userIds); begin += stalenessBatchSize {
+		end := lo.Min([]int{begin + stalenessBatchSize, len(userIds)})
+		reads := make([]cache.Read, 0, end-begin)
+		for _, userId := range userIds[begin:end] {
+			reads = append(reads, cache.ReadValue(cache.Key(cache.LastUpdateUserRecommendTime, userId)))
+		}
+		documents, err := m.CacheClient.ReadDocuments(reads...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, document := range documents {
+			recommendTime, err := document.Value.Time()
+			if err != nil {
+				if errors.Is(err, errors.NotFound) {
+					continue
+				}
+				return errors.Trace(err)
+			}
+			if staleness := time.Since(recommendTime); staleness > maxStaleness {
+				maxStaleness = staleness
+			}
+		}
+	}
+	OfflineRecommendMaxStalenessSeconds.Set(maxStaleness.Seconds())
+	m.alertMutex.Lock()
+	m.maxStaleness = maxStaleness
+	m.alertMutex.Unlock()
+	m.checkStaleness(maxStaleness)
+	return nil
+}
+
+// RunStalenessLoop measures the staleness of offline recommendation and checks ingestion periodically.
+func (m *Master) RunStalenessLoop() {
+	defer base.CheckPanic()
+	for {
+		if err := m.measureStaleness(); err != nil {
+			log.Logger().Error("failed to measure staleness of offline recommendation", zap.Error(err))
+		}
+		if err := m.checkIngestStalled(); err != nil {
+			log.Logger().Error("failed to check ingestion", zap.Error(err))
+		}
+		if err := m.checkQuota(); err != nil {
+			log.Logger().Error("failed to check quotas", zap.Error(err))
+		}
+		time.Sleep(stalenessCheckPeriod)
+	}
+}
+
+// checkIngestStalled notifies webhooks once no feedback has been ingested by servers for the timeout. It isn't
+// notified again until new feedback arrives.
+func (m *Master) checkIngestStalled() error {
+	timeout := m.Config.Master.Webhook.IngestStallTimeout
+	if timeout <= 0 {
+		return nil
+	}
+	insertTime, err := m.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime)).Time()
+	if errors.Is(err, errors.NotFound) {
+		// feedback has never been ingested
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if time.Since(insertTime) <= timeout {
+		m.ingestStalled = false
+	} else if !m.ingestStalled {
+		m.ingestStalled = true
+		m.notifyWebhooks(EventIngestStalled, IngestStalled{Since: insertTime})
+	}
+	return nil
+}
+
+// RunWebhookLoop delivers queued events to webhooks. Events are delivered independently so that an event backing off
+// doesn't delay others.
+func (m *Master) RunWebhookLoop() {
+	defer base.CheckPanic()
+	semaphore := make(chan struct{}, webhookConcurrency)
+	for payload := range m.webhookChan {
+		semaphore <- struct{}{}
+		go func(payload WebhookPayload) {
+			defer base.CheckPanic()
+			defer func() { <-semaphore }()
+			m.deliverWebhooks(payload)
+		}(payload)
+	}
+}
+
+// deliverWebhooks posts a payload to every webhook in parallel. Failed deliveries are retried with exponential
+// backoff. The secret and the signature are never logged or recorded.
+func (m *Master) deliverWebhooks(payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Logger().Error("failed to marshal webhook payload", zap.String("event", payload.Event), zap.Error(err))
+		return
+	}
+	webhook := m.Config.Master.Webhook
+	var signature string
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(webhook.URLs))
+	for _, url := range webhook.URLs {
+		go func(url string) {
+			defer base.CheckPanic()
+			defer wg.Done()
+			m.deliverWebhook(payload, url, body, signature)
+		}(url)
+	}
+	wg.Wait()
+}
+
+// deliverWebhook posts a payload to a webhook until it succeeds or retries are exhausted.
+func (m *Master) deliverWebhook(payload WebhookPayload, url string, body []byte, signature string) {
+	maxRetries := m.Config.Master.Webhook.MaxRetries
+	for attempt := 1; attempt <= maxRetries+1; attempt++ {
+		if attempt > 1 {
+			time.Sleep(m.webhookBackoff * time.Duration(math.Pow(2, float64(attempt-2))))
+		}
+		delivery := WebhookDelivery{
+			PayloadId: payload.Id,
+			Event:     payload.Event,
+			URL:       log.RedactDBURL(url),
+			Attempt:   attempt,
+			Timestamp: time.Now(),
+		}
+		var err error
+		delivery.StatusCode, err = m.postWebhook(url, body, payload.Event, signature)
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err = m.saveWebhookDelivery(delivery); err != nil {
+			log.Logger().Error("failed to save webhook delivery", zap.Error(err))
+		}
+		if delivery.Error == "" {
+			break
+		}
+		log.Logger().Warn("failed to deliver webhook",
+			zap.String("event", delivery.Event),
+			zap.String("url", delivery.URL),
+			zap.Int("attempt", attempt),
+			zap.String("error", delivery.Error))
+	}
+}
+
+func (m *Master) postWebhook(url string, body []byte, event, signature string) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gorse-Event", event)
+	if signature != "" {
+		request.Header.Set("X-Gorse-Signature", signature)
+	}
+	response, err := m.webhookClient.Do(request)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+func (m *Master) saveWebhookDelivery(delivery WebhookDelivery) error {
+	buf, err := json.Marshal(delivery)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = m.CacheClient.AddSorted(cache.Sorted(cache.WebhookDeliveries, []cache.Scored{
+		{Id: string(buf), Score: float64(delivery.Timestamp.UnixNano())},
+	})); err != nil {
+		return errors.Trace(err)
+	}
+	return m.CacheClient.RemSortedByScore(cache.WebhookDeliveries, math.Inf(-1),
+		float64(time.Now().Add(-webhookDeliveryTTL).UnixNano()))
+}
+
+// GetWebhookDeliveries returns the latest n webhook deliveries.
+func (m *Master) GetWebhookDeliveries(n int) ([]WebhookDelivery, error) {
+	scores, err := m.CacheClient.GetSorted(cache.WebhookDeliveries, 0, n-1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	deliveries := make([]WebhookDelivery, 0, len(scores))
+	for _, score := range scores {
+		var delivery WebhookDelivery
+		if err = json.Unmarshal([]byte(score.Id), &delivery); err != nil {
+			return nil, errors.Trace(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// checkQuota notifies webhooks once the usage of a quota reaches the warning ratio. It isn't notified again until the
+// usage drops below the warning ratio.
+func (m *Master) checkQuota() error {
+	if m.QuotaManager == nil {
+		return nil
+	}
+	state, err := m.QuotaManager.State()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	nearLimit := state.NearLimit()
+	m.checkQuotaUsage(server.QuotaUsers, state.Users, lo.Contains(nearLimit, server.QuotaUsers), &m.usersNearLimit)
+	m.checkQuotaUsage(server.QuotaItems, state.Items, lo.Contains(nearLimit, server.QuotaItems), &m.itemsNearLimit)
+	return nil
+}
+
+func (m *Master) checkQuotaUsage(quota string, usage server.QuotaUsage, nearLimit bool, notified *bool) {
+	if !nearLimit {
+		*notified = false
+	} else if !*notified {
+		*notified = true
+		m.notifyWebhooks(EventQuotaNearLimit, QuotaNearLimit{Quota: quota, Usage: usage})
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package master
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/task"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/server"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestMaster_DeliverWebhooks(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.webhookClient = http.DefaultClient
+	m.webhookBackoff = time.Millisecond
+	m.Config.Master.Webhook.Secret = "secret"
+	m.Config.Master.Webhook.MaxRetries = 2
+
+	// the first attempt fails
+	var bodies [][]byte
+	numRequests := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Gorse-Signature"))
+		assert.Equal(t, EventTaskCompleted, r.Header.Get("X-Gorse-Event"))
+		if numRequests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies = append(bodies, body)
+	}))
+	defer hook.Close()
+	m.Config.Master.Webhook.URLs = []string{hook.URL}
+	m.deliverWebhooks(WebhookPayload{Id: "1", Event: EventTaskCompleted, Data: task.Task{Name: "a"}})
+	assert.Equal(t, 2, numRequests)
+	assert.Len(t, bodies, 1)
+	var payload WebhookPayload
+	assert.NoError(t, json.Unmarshal(bodies[0], &payload))
+	assert.Equal(t, "1", payload.Id)
+	assert.Equal(t, EventTaskCompleted, payload.Event)
+
+	deliveries, err := m.GetWebhookDeliveries(10)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 2)
+	assert.Equal(t, 2, deliveries[0].Attempt)
+	assert.Equal(t, http.StatusOK, deliveries[0].StatusCode)
+	assert.Empty(t, deliveries[0].Error)
+	assert.Equal(t, 1, deliveries[1].Attempt)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[1].StatusCode)
+	assert.NotEmpty(t, deliveries[1].Error)
+
+	// give up after retries
+	hook.Close()
+	m.deliverWebhooks(WebhookPayload{Id: "2", Event: EventTaskFailed})
+	deliveries, err = m.GetWebhookDeliveries(10)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 5)
+	assert.Equal(t, "2", deliveries[0].PayloadId)
+	assert.Equal(t, 3, deliveries[0].Attempt)
+}
+
+func TestMaster_RunWebhookLoop(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.webhookClient = http.DefaultClient
+	m.webhookBackoff = time.Minute
+	m.webhookChan = make(chan WebhookPayload, webhookQueueSize)
+	m.Config.Master.Webhook.MaxRetries = 1
+
+	// events of failed tasks are rejected
+	var mu sync.Mutex
+	var delivered []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Gorse-Event") == EventTaskFailed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, payload.Id)
+	}))
+	defer hook.Close()
+	m.Config.Master.Webhook.URLs = []string{hook.URL}
+	go m.RunWebhookLoop()
+	defer close(m.webhookChan)
+
+	// an event backing off doesn't block following events
+	m.webhookChan <- WebhookPayload{Id: "1", Event: EventTaskFailed}
+	m.webhookChan <- WebhookPayload{Id: "2", Event: EventTaskCompleted}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 1 && delivered[0] == "2"
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestMaster_NotifyWebhooks(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.webhookChan = make(chan WebhookPayload, webhookQueueSize)
+	m.taskMonitor.OnDone = m.notifyTaskDone
+
+	// no webhooks
+	m.taskMonitor.Start("a", 10).Finish()
+	assert.Empty(t, m.webhookChan)
+
+	// task events
+	m.Config.Master.Webhook.URLs = []string{"http://localhost"}
+	m.Config.Master.Webhook.Events = []string{EventTaskFailed, EventIngestStalled}
+	m.taskMonitor.Start("a", 10).Finish()
+	assert.Empty(t, m.webhookChan)
+	m.taskMonitor.Start("b", 10)
+	m.taskMonitor.Fail("b", "error")
+	m.taskMonitor.Fail("b", "error")
+	assert.Len(t, m.webhookChan, 1)
+	payload := <-m.webhookChan
+	assert.Equal(t, EventTaskFailed, payload.Event)
+	assert.Equal(t, "b", payload.Data.(task.Task).Name)
+
+	// ingest stalled
+	m.Config.Master.Webhook.IngestStallTimeout = time.Minute
+	assert.NoError(t, m.checkIngestStalled())
+	assert.Empty(t, m.webhookChan)
+	insertTime := time.Now().Add(-time.Hour)
+	err := m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime), insertTime))
+	assert.NoError(t, err)
+	assert.NoError(t, m.checkIngestStalled())
+	assert.NoError(t, m.checkIngestStalled())
+	assert.Len(t, m.webhookChan, 1)
+	payload = <-m.webhookChan
+	assert.Equal(t, EventIngestStalled, payload.Event)
+	assert.True(t, insertTime.Equal(payload.Data.(IngestStalled).Since))
+	err = m.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime), time.Now()))
+	assert.NoError(t, err)
+	assert.NoError(t, m.checkIngestStalled())
+	assert.False(t, m.ingestStalled)
+
+	// staleness exceeded isn't subscribed
+	m.Config.Master.Webhook.StalenessThreshold = time.Hour
+	m.checkStaleness(2 * time.Hour)
+	assert.True(t, m.stalenessExceeded)
+	assert.Empty(t, m.webhookChan)
+}
+
+func TestMaster_MeasureStaleness(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.webhookChan = make(chan WebhookPayload, webhookQueueSize)
+	m.Config.Master.Webhook.URLs = []string{"http://localhost"}
+	m.Config.Master.Webhook.StalenessThreshold = time.Hour
+	m.rankingTrainSet = ranking.NewMapIndexDataset()
+	for _, userId := range []string{"0", "1", "2"} {
+		m.rankingTrainSet.AddUser(userId)
+	}
+	err := m.CacheClient.Set(
+		cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), time.Now().Add(-time.Minute)),
+		cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "1"), time.Now().Add(-2*time.Hour)))
+	assert.NoError(t, err)
+	err = m.measureStaleness()
+	assert.NoError(t, err)
+	assert.True(t, m.stalenessExceeded)
+	assert.Len(t, m.webhookChan, 1)
+	payload := <-m.webhookChan
+	assert.Equal(t, EventStalenessExceeded, payload.Event)
+	assert.GreaterOrEqual(t, payload.Data.(StalenessExceeded).MaxStaleness, 2*time.Hour)
+
+	// staleness recovers
+	err = m.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "1"), time.Now()))
+	assert.NoError(t, err)
+	err = m.measureStaleness()
+	assert.NoError(t, err)
+	assert.False(t, m.stalenessExceeded)
+}
+
+func TestMaster_CheckQuota(t *testing.T) {
+	m := newMockMaster(t)
+	defer m.Close()
+	m.webhookChan = make(chan WebhookPayload, webhookQueueSize)
+	m.Config.Master.Webhook.URLs = []string{"http://localhost"}
+	m.Config.Server.CacheExpire = time.Nanosecond
+	m.Config.Server.Quota.MaxItems = 10
+	m.QuotaManager = server.NewQuotaManager(&m.RestServer)
+
+	// usage below the warning ratio
+	var items []data.Item
+	for i := 0; i < 8; i++ {
+		items = append(items, data.Item{ItemId: strconv.Itoa(i)})
+	}
+	err := m.DataClient.BatchInsertItems(items)
+	assert.NoError(t, err)
+	assert.NoError(t, m.checkQuota())
+	assert.Empty(t, m.webhookChan)
+
+	// usage reaches the warning ratio
+	err = m.DataClient.BatchInsertItems([]data.Item{{ItemId: "8"}})
+	assert.NoError(t, err)
+	assert.NoError(t, m.checkQuota())
+	assert.NoError(t, m.checkQuota())
+	assert.Len(t, m.webhookChan, 1)
+	payload := <-m.webhookChan
+	assert.Equal(t, EventQuotaNearLimit, payload.Event)
+	assert.Equal(t, QuotaNearLimit{Quota: server.QuotaItems, Usage: server.QuotaUsage{Count: 9, Limit: 10, Ratio: 0.9}}, payload.Data)
+
+	// usage recovers
+	err = m.DataClient.DeleteItem("8")
+	assert.NoError(t, err)
+	assert.NoError(t, m.checkQuota())
+	assert.False(t, m.itemsNearLimit)
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blend
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/config"
+)
+
+// Weights are weights of components blended into final scores.
+type Weights struct {
+	CFWeight          float64
+	CTRWeight         float64
+	FreshnessWeight   float64
+	FreshnessHalfLife time.Duration
+}
+
+// NewWeights creates weights from the configuration.
+func NewWeights(cfg config.BlendConfig) Weights {
+	return Weights{
+		CFWeight:          cfg.CFWeight,
+		CTRWeight:         cfg.CTRWeight,
+		FreshnessWeight:   cfg.FreshnessWeight,
+		FreshnessHalfLife: cfg.FreshnessHalfLife,
+	}
+}
+
+// ParseWeights parses weights saved in JSON.
+func ParseWeights(s string) (Weights, error) {
+	var weights Weights
+	if err := json.Unmarshal([]byte(s), &weights); err != nil {
+		return Weights{}, errors.Trace(err)
+	}
+	return weights, errors.Trace(weights.Validate())
+}
+
+// Validate returns an error if any weight is negative or the half life is not positive.
+func (w Weights) Validate() error {
+	if w.CFWeight < 0 || w.CTRWeight < 0 || w.FreshnessWeight < 0 {
+		return errors.NotValidf("negative weight")
+	}
+	if w.FreshnessHalfLife <= 0 {
+		return errors.NotValidf("non-positive freshness half life")
+	}
+	return nil
+}
+
+// Scores are normalized components and the blended score of an item.
+type Scores struct {
+	CF        float64
+	CTR       float64
+	Freshness float64
+	Score     float64
+}
+
+// Freshness of an item decays by half every half life since the timestamp. Items without timestamps are not fresh.
+func Freshness(timestamp, now time.Time, halfLife time.Duration) float64 {
+	if timestamp.IsZero() {
+		return 0
+	}
+	age := now.Sub(timestamp)
+	if age < 0 {
+		age = 0
+	}
+	return math.Exp2(-float64(age) / float64(halfLife))
+}
+
+// Normalize scales values to [0, 1] by min-max normalization. Values are all 1 if they are equal.
+func Normalize(values []float64) []float64 {
+	if len(values) == 0 {
+		return values
+	}
+	minValue, maxValue := values[0], values[0]
+	for _, value := range values[1:] {
+		minValue = math.Min(minValue, value)
+		maxValue = math.Max(maxValue, value)
+	}
+	normalized := make([]float64, len(values))
+	for i, value := range values {
+		if maxValue > minValue {
+			normalized[i] = (value - minValue) / (maxValue - minValue)
+		} else {
+			normalized[i] = 1
+		}
+	}
+	return normalized
+}
+
+// Blend blends components of n items by weights. CF scores and click-through rates are normalized by Normalize, while
+// freshness is in [0, 1] already. Missing components are nil and treated as zeros.
+func Blend(weights Weights, n int, cf, ctr, freshness []float64) []Scores {
+	cf, ctr = Normalize(cf), Normalize(ctr)
+	scores := make([]Scores, n)
+	for i := range scores {
+		if cf != nil {
+			scores[i].CF = cf[i]
+		}
+		if ctr != nil {
+			scores[i].CTR = ctr[i]
+		}
+		if freshness != nil {
+			scores[i].Freshness = freshness[i]
+		}
+		scores[i].Score = weights.CFWeight*scores[i].CF + weights.CTRWeight*scores[i].CTR +
+			weights.FreshnessWeight*scores[i].Freshness
+	}
+	return scores
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+)
+
+func TestParseWeights(t *testing.T) {
+	weights, err := ParseWeights(`{"CFWeight":1,"CTRWeight":0.5,"FreshnessWeight":0.2,"FreshnessHalfLife":3600000000000}`)
+	assert.NoError(t, err)
+	assert.Equal(t, Weights{CFWeight: 1, CTRWeight: 0.5, FreshnessWeight: 0.2, FreshnessHalfLife: time.Hour}, weights)
+	_, err = ParseWeights(`{"CFWeight":-1,"FreshnessHalfLife":3600000000000}`)
+	assert.Error(t, err)
+	_, err = ParseWeights(`{"CFWeight":1}`)
+	assert.Error(t, err)
+	assert.NoError(t, NewWeights(config.GetDefaultConfig().Recommend.Blend).Validate())
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 1.0, Freshness(now, now, time.Hour))
+	assert.Equal(t, 1.0, Freshness(now.Add(time.Hour), now, time.Hour))
+	assert.InDelta(t, 0.25, Freshness(now.Add(-2*time.Hour), now, time.Hour), 1e-9)
+	assert.Zero(t, Freshness(time.Time{}, now, time.Hour))
+}
+
+func TestNormalize(t *testing.T) {
+	assert.Equal(t, []float64{0, 0.5, 1}, Normalize([]float64{1, 2, 3}))
+	assert.Equal(t, []float64{1, 1}, Normalize([]float64{2, 2}))
+	assert.Nil(t, Normalize(nil))
+}
+
+func TestBlend(t *testing.T) {
+	weights := Weights{CFWeight: 1, CTRWeight: 2, FreshnessWeight: 0.5, FreshnessHalfLife: time.Hour}
+	scores := Blend(weights, 3, []float64{10, 20, 30}, []float64{0.5, 0.25, 0}, []float64{1, 0.5, 0})
+	assert.Equal(t, []Scores{
+		{CF: 0, CTR: 1, Freshness: 1, Score: 2.5},
+		{CF: 0.5, CTR: 0.5, Freshness: 0.5, Score: 1.75},
+		{CF: 1, CTR: 0, Freshness: 0, Score: 1},
+	}, scores)
+	// missing components are zeros
+	scores = Blend(weights, 2, []float64{1, 2}, nil, nil)
+	assert.Equal(t, []Scores{{CF: 0, Score: 0}, {CF: 1, Score: 1}}, scores)
+}
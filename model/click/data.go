@@ -39,6 +39,8 @@ type Dataset struct {
 	CtxValues   [][]float32
 	NormValues  base.Array[float32]
 	Target      base.Array[float32]
+	// Weights are parallel to Target. They are empty if all samples are equally weighted.
+	Weights base.Array[float32]
 
 	PositiveCount int
 	NegativeCount int
@@ -61,6 +63,7 @@ func (dataset *Dataset) Bytes() int {
 	bytes += uintptr(dataset.Items.Bytes())
 	bytes += uintptr(dataset.NormValues.Bytes())
 	bytes += uintptr(dataset.Target.Bytes())
+	bytes += uintptr(dataset.Weights.Bytes())
 	return int(bytes)
 }
 
@@ -81,6 +84,9 @@ func (dataset *Dataset) Count() int {
 	if dataset.CtxFeatures != nil && len(dataset.CtxFeatures) != dataset.Target.Len() {
 		panic("len(dataset.CtxFeatures) != len(dataset.Target)")
 	}
+	if dataset.Weights.Len() > 0 && dataset.Weights.Len() != dataset.Target.Len() {
+		panic("dataset.Weights.Len() != dataset.Target.Len()")
+	}
 	return dataset.Target.Len()
 }
 
@@ -126,6 +132,14 @@ func (dataset *Dataset) Get(i int) ([]int32, []float32, float32) {
 	return features, values, dataset.Target.Get(i)
 }
 
+// Weight returns the weight of the i-th sample.
+func (dataset *Dataset) Weight(i int) float32 {
+	if dataset.Weights.Len() == 0 {
+		return 1
+	}
+	return dataset.Weights.Get(i)
+}
+
 // LoadLibFMFile loads libFM format file.
 func LoadLibFMFile(path string) (features [][]int32, values [][]float32, targets base.Array[float32], maxLabel int32, err error) {
 	// open file
@@ -227,6 +241,9 @@ func (dataset *Dataset) Split(ratio float32, seed int64) (*Dataset, *Dataset) {
 			}
 			testSet.NormValues.Append(dataset.NormValues.Get(i))
 			testSet.Target.Append(dataset.Target.Get(i))
+			if dataset.Weights.Len() > 0 {
+				testSet.Weights.Append(dataset.Weights.Get(i))
+			}
 			if dataset.Target.Get(i) > 0 {
 				testSet.PositiveCount++
 			} else {
@@ -244,6 +261,9 @@ func (dataset *Dataset) Split(ratio float32, seed int64) (*Dataset, *Dataset) {
 			}
 			trainSet.NormValues.Append(dataset.NormValues.Get(i))
 			trainSet.Target.Append(dataset.Target.Get(i))
+			if dataset.Weights.Len() > 0 {
+				trainSet.Weights.Append(dataset.Weights.Get(i))
+			}
 			if dataset.Target.Get(i) > 0 {
 				trainSet.PositiveCount++
 			} else {
@@ -0,0 +1,218 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package click
+
+import (
+	"github.com/chewxy/math32"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/heap"
+)
+
+// Kinds of features in the encoding space of factorization machines.
+const (
+	FeatureUser      = "user"
+	FeatureItem      = "item"
+	FeatureUserLabel = "user_label"
+	FeatureItemLabel = "item_label"
+	FeatureContext   = "context"
+)
+
+// FeatureImportance is the importance of a feature or a group of features. The weight is the magnitude of the linear
+// weight and the factor of a feature. The permutation importance is the decrease of the score (AUC for classification
+// and negative RMSE for regression) on holdout samples after the feature is permuted between samples.
+type FeatureImportance struct {
+	Index       int32 // index of the feature in the encoding space, -1 for groups of features
+	Kind        string
+	Name        string // name of the feature, empty for groups of features
+	Weight      float32
+	Permutation float32
+}
+
+// FeatureImportances are top features of a factorization machine and importance of groups of features.
+type FeatureImportances struct {
+	Features   []FeatureImportance // top labels and context labels, sorted by weights
+	Groups     []FeatureImportance // permutation importance of users, items, user labels, item labels and context labels
+	NumSamples int                 // number of holdout samples used to compute permutation importance
+}
+
+// featureGroup is a range of features of the same kind in the encoding space.
+type featureGroup struct {
+	kind       string
+	begin, end int32
+	names      func() []string
+}
+
+// featureGroups returns ranges of features in the encoding space: | user | item | user label | item label | context label |
+func featureGroups(index UnifiedIndex) []featureGroup {
+	groups := []featureGroup{
+		{kind: FeatureUser, end: index.CountUsers(), names: index.GetUsers},
+		{kind: FeatureItem, end: index.CountItems(), names: index.GetItems},
+		{kind: FeatureUserLabel, end: index.CountUserLabels(), names: index.GetUserLabels},
+		{kind: FeatureItemLabel, end: index.CountItemLabels(), names: index.GetItemLabels},
+		{kind: FeatureContext, end: index.CountContextLabels(), names: index.GetContextLabels},
+	}
+	var offset int32
+	for i := range groups {
+		groups[i].begin, groups[i].end = offset, offset+groups[i].end
+		offset = groups[i].end
+	}
+	return groups
+}
+
+// importanceSample is a holdout sample.
+type importanceSample struct {
+	features []int32
+	values   []float32
+	target   float32
+}
+
+// ComputeFeatureImportance computes importance of features of a trained factorization machine. Weights are computed for
+// labels and context labels, and the top k of them are returned with names. Permutation importance is computed for top
+// features and groups of features on at most numSamples holdout samples, so that the time is bounded by
+// O((k + 5) * numSamples) predictions no matter how wide the encoding space is.
+func ComputeFeatureImportance(estimator FactorizationMachine, testSet *Dataset, k, numSamples int, seed int64) (*FeatureImportances, error) {
+	fm, ok := estimator.(*FM)
+	if !ok {
+		return nil, errors.NotSupportedf("feature importance of %T", estimator)
+	}
+	if fm.Invalid() {
+		return nil, errors.NotValidf("untrained factorization machine")
+	}
+	groups := featureGroups(fm.Index)
+
+	// weights of labels and context labels
+	filter := heap.NewTopKFilter[int32, float32](k)
+	for _, group := range groups[2:] {
+		for i := group.begin; i < group.end && int(i) < len(fm.W); i++ {
+			filter.Push(i, fm.featureWeight(i))
+		}
+	}
+	topFeatures, topWeights := filter.PopAll()
+	importances := &FeatureImportances{Features: make([]FeatureImportance, 0, len(topFeatures))}
+	names := make(map[string][]string)
+	for i, feature := range topFeatures {
+		group, _ := lo.Find(groups, func(group featureGroup) bool {
+			return feature >= group.begin && feature < group.end
+		})
+		if _, exist := names[group.kind]; !exist {
+			names[group.kind] = group.names()
+		}
+		importance := FeatureImportance{Index: feature, Kind: group.kind, Weight: topWeights[i]}
+		if offset := int(feature - group.begin); offset < len(names[group.kind]) {
+			importance.Name = names[group.kind][offset]
+		}
+		importances.Features = append(importances.Features, importance)
+	}
+
+	// permutation importance on sampled holdout samples
+	rng := base.NewRandomGenerator(seed)
+	samples := sampleHoldout(testSet, numSamples, rng)
+	importances.NumSamples = len(samples)
+	var baseline float32
+	if len(samples) > 0 {
+		baseline = fm.score(samples)
+		for i := range importances.Features {
+			feature := importances.Features[i].Index
+			importances.Features[i].Permutation = baseline - fm.score(permuteFeatures(samples, rng, func(f int32) bool {
+				return f == feature
+			}))
+		}
+	}
+	for _, group := range groups {
+		importance := FeatureImportance{Index: -1, Kind: group.kind}
+		if group.begin < group.end && len(samples) > 0 {
+			importance.Permutation = baseline - fm.score(permuteFeatures(samples, rng, func(f int32) bool {
+				return f >= group.begin && f < group.end
+			}))
+		}
+		importances.Groups = append(importances.Groups, importance)
+	}
+	return importances, nil
+}
+
+// featureWeight returns |w_i| + ||v_i||.
+func (fm *FM) featureWeight(i int32) float32 {
+	var norm float32
+	for _, v := range fm.V[i] {
+		norm += v * v
+	}
+	return math32.Abs(fm.W[i]) + math32.Sqrt(norm)
+}
+
+// score returns AUC for classification and negative RMSE for regression.
+func (fm *FM) score(samples []importanceSample) float32 {
+	if fm.Task == FMRegression {
+		var sum float32
+		for _, sample := range samples {
+			prediction := fm.InternalPredict(sample.features, sample.values)
+			sum += (sample.target - prediction) * (sample.target - prediction)
+		}
+		return -math32.Sqrt(sum / float32(len(samples)))
+	}
+	var posPrediction, negPrediction []float32
+	for _, sample := range samples {
+		prediction := fm.InternalPredict(sample.features, sample.values)
+		if sample.target > 0 {
+			posPrediction = append(posPrediction, prediction)
+		} else {
+			negPrediction = append(negPrediction, prediction)
+		}
+	}
+	if len(posPrediction) == 0 || len(negPrediction) == 0 {
+		return 0
+	}
+	return AUC(posPrediction, negPrediction)
+}
+
+// sampleHoldout samples at most n samples from the test set. All samples are used if n isn't positive.
+func sampleHoldout(testSet *Dataset, n int, rng base.RandomGenerator) []importanceSample {
+	if testSet == nil {
+		return nil
+	}
+	indices := lo.Range(testSet.Count())
+	if n > 0 && n < len(indices) {
+		indices = rng.Sample(0, len(indices), n)
+	}
+	samples := make([]importanceSample, len(indices))
+	for i, index := range indices {
+		samples[i].features, samples[i].values, samples[i].target = testSet.Get(index)
+	}
+	return samples
+}
+
+// permuteFeatures shuffles selected features between samples while other features are kept.
+func permuteFeatures(samples []importanceSample, rng base.RandomGenerator, selected func(int32) bool) []importanceSample {
+	permuted := make([]importanceSample, len(samples))
+	parts := make([]importanceSample, len(samples))
+	for i, sample := range samples {
+		permuted[i].target = sample.target
+		for j, feature := range sample.features {
+			if selected(feature) {
+				parts[i].features = append(parts[i].features, feature)
+				parts[i].values = append(parts[i].values, sample.values[j])
+			} else {
+				permuted[i].features = append(permuted[i].features, feature)
+				permuted[i].values = append(permuted[i].values, sample.values[j])
+			}
+		}
+	}
+	for i, j := range rng.Perm(len(samples)) {
+		permuted[i].features = append(permuted[i].features, parts[j].features...)
+		permuted[i].values = append(permuted[i].values, parts[j].values...)
+	}
+	return permuted
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package click
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/model"
+)
+
+func TestComputeFeatureImportance(t *testing.T) {
+	// users 0 and 1 labeled by "a" click items, while users 2 and 3 labeled by "b" don't.
+	builder := NewUnifiedMapIndexBuilder()
+	for i := 0; i < 4; i++ {
+		builder.AddUser(strconv.Itoa(i))
+	}
+	builder.AddItem("0")
+	builder.AddItem("1")
+	builder.AddUserLabel("a")
+	builder.AddUserLabel("b")
+	builder.AddItemLabel("x")
+	dataset := &Dataset{
+		Index:        builder.Build(),
+		UserFeatures: [][]int32{{0}, {0}, {1}, {1}},
+		ItemFeatures: [][]int32{{0}, {0}},
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 2; j++ {
+			dataset.Users.Append(int32(i))
+			dataset.Items.Append(int32(j))
+			dataset.NormValues.Append(1)
+			if i < 2 {
+				dataset.Target.Append(1)
+			} else {
+				dataset.Target.Append(-1)
+			}
+		}
+	}
+
+	fm := NewFM(FMClassification, model.Params{model.NFactors: 2})
+	_, err := ComputeFeatureImportance(fm, dataset, 2, 0, 0)
+	assert.True(t, errors.Is(err, errors.NotValid))
+	fm.Index = dataset.Index
+	fm.W = make([]float32, dataset.Index.Len())
+	fm.V = make([][]float32, dataset.Index.Len())
+	for i := range fm.V {
+		fm.V[i] = make([]float32, 2)
+	}
+	fm.W[dataset.Index.EncodeUserLabel("a")] = 2
+	fm.W[dataset.Index.EncodeUserLabel("b")] = -1
+
+	importances, err := ComputeFeatureImportance(fm, dataset, 2, 6, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, importances.NumSamples)
+	if assert.Len(t, importances.Features, 2) {
+		assert.Equal(t, FeatureImportance{Index: dataset.Index.EncodeUserLabel("a"), Kind: FeatureUserLabel, Name: "a",
+			Weight: 2, Permutation: importances.Features[0].Permutation}, importances.Features[0])
+		assert.Equal(t, FeatureImportance{Index: dataset.Index.EncodeUserLabel("b"), Kind: FeatureUserLabel, Name: "b",
+			Weight: 1, Permutation: importances.Features[1].Permutation}, importances.Features[1])
+	}
+	if assert.Len(t, importances.Groups, 5) {
+		for _, group := range importances.Groups {
+			assert.Equal(t, int32(-1), group.Index)
+			if group.Kind == FeatureUserLabel {
+				assert.Greater(t, group.Permutation, float32(0))
+			} else {
+				// other features don't affect predictions
+				assert.Zero(t, group.Permutation)
+			}
+		}
+	}
+}
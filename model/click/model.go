@@ -95,6 +95,9 @@ type FitConfig struct {
 	*task.JobsAllocator
 	Verbose int
 	Task    *task.Task
+	// Deterministic trains models by stochastic gradient descent in a single job, so that models trained with the
+	// same random state are identical.
+	Deterministic bool
 }
 
 func NewFitConfig() *FitConfig {
@@ -118,6 +121,19 @@ func (config *FitConfig) SetTask(t *task.Task) *FitConfig {
 	return config
 }
 
+func (config *FitConfig) SetDeterministic(deterministic bool) *FitConfig {
+	config.Deterministic = deterministic
+	return config
+}
+
+// SGDJobs returns the number of jobs for stochastic gradient descent.
+func (config *FitConfig) SGDJobs() int {
+	if config.Deterministic {
+		return 1
+	}
+	return config.AvailableJobs(config.Task)
+}
+
 func (config *FitConfig) LoadDefaultIfNil() *FitConfig {
 	if config == nil {
 		return NewFitConfig()
@@ -307,7 +323,7 @@ func (fm *FM) Fit(trainSet, testSet *Dataset, config *FitConfig) Score {
 		}
 		fitStart := time.Now()
 		cost := float32(0)
-		_ = parallel.BatchParallel(trainSet.Count(), config.AvailableJobs(config.Task), 128, func(workerId, beginJobId, endJobId int) error {
+		_ = parallel.BatchParallel(trainSet.Count(), config.SGDJobs(), 128, func(workerId, beginJobId, endJobId int) error {
 			for i := beginJobId; i < endJobId; i++ {
 				features, values, target := trainSet.Get(i)
 				prediction := fm.internalPredictImpl(features, values)
@@ -323,6 +339,7 @@ func (fm *FM) Fit(trainSet, testSet *Dataset, config *FitConfig) Score {
 				default:
 					log.Logger().Fatal("unknown task", zap.String("task", string(fm.Task)))
 				}
+				grad *= trainSet.Weight(i)
 				// \sum^n_{j=1}v_j,fx_j
 				floats.Zero(temp[workerId])
 				for it, j := range features {
@@ -370,6 +387,10 @@ func (fm *FM) Fit(trainSet, testSet *Dataset, config *FitConfig) Score {
 			snapshots.AddSnapshot(score, fm.V, fm.W, fm.B)
 		}
 		config.Task.Add(1)
+		// stop training once the task is cancelled
+		if config.Task.Cancelled() {
+			break
+		}
 	}
 	// restore best snapshot
 	fm.V = snapshots.BestWeights[0].([][]float32)
@@ -18,6 +18,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/model"
+	"strconv"
 	"testing"
 )
 
@@ -151,3 +152,47 @@ func TestFM_Regression_Criteo(t *testing.T) {
 //	score := m.Fit(train, test, fitConfig)
 //	assertEpsilon(t, 0.570648, score.RMSE)
 //}
+
+func TestFM_Deterministic(t *testing.T) {
+	builder := NewUnifiedMapIndexBuilder()
+	dataset := NewMapIndexDataset()
+	numUsers, numItems := 20, 30
+	for i := 0; i < numUsers; i++ {
+		builder.AddUser(strconv.Itoa(i))
+		builder.AddUserLabel("user_label" + strconv.Itoa(i%3))
+		dataset.UserFeatures = append(dataset.UserFeatures, []int32{int32(i % 3)})
+	}
+	for i := 0; i < numItems; i++ {
+		builder.AddItem(strconv.Itoa(i))
+		builder.AddItemLabel("item_label" + strconv.Itoa(i%5))
+		dataset.ItemFeatures = append(dataset.ItemFeatures, []int32{int32(i % 5)})
+	}
+	for i := 0; i < numUsers; i++ {
+		for j := 0; j < numItems; j++ {
+			dataset.Users.Append(int32(i))
+			dataset.Items.Append(int32(j))
+			dataset.NormValues.Append(1)
+			if (i+j)%3 == 0 {
+				dataset.Target.Append(1)
+				dataset.PositiveCount++
+			} else {
+				dataset.Target.Append(-1)
+				dataset.NegativeCount++
+			}
+		}
+	}
+	dataset.Index = builder.Build()
+	trainSet, testSet := dataset.Split(0.2, 1)
+
+	var models []*FM
+	for i := 0; i < 2; i++ {
+		m := NewFM(FMClassification, model.Params{model.NFactors: 4, model.NEpochs: 5, model.RandomState: 1})
+		m.Fit(trainSet, testSet, NewFitConfig().
+			SetJobsAllocator(task.NewConstantJobsAllocator(4)).
+			SetDeterministic(true))
+		models = append(models, m)
+	}
+	assert.Equal(t, models[0].V, models[1].V)
+	assert.Equal(t, models[0].W, models[1].W)
+	assert.Equal(t, models[0].B, models[1].B)
+}
@@ -15,10 +15,12 @@
 package click
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/juju/errors"
 	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/base/task"
@@ -40,12 +42,8 @@ type ParamsSearchResult struct {
 func GridSearchCV(estimator FactorizationMachine, trainSet *Dataset, testSet *Dataset, paramGrid model.ParamsGrid,
 	_ int64, fitConfig *FitConfig) ParamsSearchResult {
 	// Retrieve parameter names and length
-	paramNames := make([]model.ParamName, 0, len(paramGrid))
-	count := 1
-	for paramName, values := range paramGrid {
-		paramNames = append(paramNames, paramName)
-		count *= len(values)
-	}
+	paramNames := paramGrid.Names()
+	count := paramGrid.NumCombinations()
 	// Construct DFS procedure
 	results := ParamsSearchResult{
 		Scores: make([]Score, 0, count),
@@ -100,7 +98,8 @@ func RandomSearchCV(estimator FactorizationMachine, trainSet *Dataset, testSet *
 	for i := 1; i <= numTrials; i++ {
 		// Make parameters
 		params := model.Params{}
-		for paramName, values := range paramGrid {
+		for _, paramName := range paramGrid.Names() {
+			values := paramGrid[paramName]
 			value := values[rng.Intn(len(values))]
 			params[paramName] = value
 		}
@@ -126,9 +125,11 @@ func RandomSearchCV(estimator FactorizationMachine, trainSet *Dataset, testSet *
 type ModelSearcher struct {
 	model FactorizationMachine
 	// arguments
-	numEpochs  int
-	numTrials  int
-	searchSize bool
+	numEpochs     int
+	numTrials     int
+	searchSize    bool
+	randomState   int64
+	deterministic bool
 	// results
 	bestMutex sync.Mutex
 	bestModel FactorizationMachine
@@ -145,6 +146,19 @@ func NewModelSearcher(nEpoch, nTrials int, searchSize bool) *ModelSearcher {
 	}
 }
 
+// SetRandomState sets the random state of searching and searched models.
+func (searcher *ModelSearcher) SetRandomState(randomState int64) *ModelSearcher {
+	searcher.randomState = randomState
+	searcher.model.SetParams(searcher.model.GetParams().Overwrite(model.Params{model.RandomState: randomState}))
+	return searcher
+}
+
+// SetDeterministic sets whether searched models are trained deterministically.
+func (searcher *ModelSearcher) SetDeterministic(deterministic bool) *ModelSearcher {
+	searcher.deterministic = deterministic
+	return searcher
+}
+
 // GetBestModel returns the best click model with its score.
 func (searcher *ModelSearcher) GetBestModel() (FactorizationMachine, Score) {
 	searcher.bestMutex.Lock()
@@ -166,9 +180,14 @@ func (searcher *ModelSearcher) Fit(trainSet, valSet *Dataset, t *task.Task, j *t
 
 	// Random search
 	grid := searcher.model.GetParamsGrid(searcher.searchSize)
-	r := RandomSearchCV(searcher.model, trainSet, valSet, grid, searcher.numTrials, 0, NewFitConfig().
+	r := RandomSearchCV(searcher.model, trainSet, valSet, grid, searcher.numTrials, searcher.randomState, NewFitConfig().
 		SetJobsAllocator(j).
-		SetTask(t))
+		SetTask(t).
+		SetDeterministic(searcher.deterministic))
+	// models trained partially are discarded
+	if t.Cancelled() {
+		return errors.Trace(context.Canceled)
+	}
 	searcher.bestMutex.Lock()
 	defer searcher.bestMutex.Unlock()
 	searcher.bestModel = r.BestModel
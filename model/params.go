@@ -19,6 +19,7 @@ import (
 	"github.com/zhenghaoz/gorse/base/log"
 	"go.uber.org/zap"
 	"reflect"
+	"sort"
 )
 
 /* ParamName */
@@ -169,6 +170,18 @@ func (grid ParamsGrid) NumCombinations() int {
 	return count
 }
 
+// Names returns names of hyper-parameters in alphabetical order, so that searching is reproducible.
+func (grid ParamsGrid) Names() []ParamName {
+	names := make([]ParamName, 0, len(grid))
+	for name := range grid {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+	return names
+}
+
 func (grid ParamsGrid) Fill(_default ParamsGrid) {
 	for param, values := range _default {
 		if _, exist := grid[param]; !exist {
@@ -133,3 +133,12 @@ func TestParamsGrid(t *testing.T) {
 	assert.Equal(t, []interface{}{4, 5}, grid["b"])
 	assert.Equal(t, 4, grid.NumCombinations())
 }
+
+func TestParamsGrid_Names(t *testing.T) {
+	grid := ParamsGrid{
+		NFactors: []interface{}{8, 16},
+		Lr:       []interface{}{0.01},
+		Reg:      []interface{}{0.1},
+	}
+	assert.Equal(t, []ParamName{Lr, NFactors, Reg}, grid.Names())
+}
@@ -0,0 +1,28 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ranking
+
+import "hash/fnv"
+
+// IsCanaryUser returns true if a user is served by the canary model, which serves percent of users. Users are assigned
+// by the hash of user IDs, so that every node assigns a user to the same model.
+func IsCanaryUser(userId string, percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userId))
+	return int(h.Sum32()%100) < percent
+}
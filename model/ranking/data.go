@@ -26,20 +26,33 @@ import (
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/model"
 	"go.uber.org/zap"
+	"math"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 )
 
 // DataSet contains preprocessed data structures for recommendation models.
 type DataSet struct {
-	UserIndex      base.Index
-	ItemIndex      base.Index
-	FeedbackUsers  base.Array[int32]
-	FeedbackItems  base.Array[int32]
-	UserFeedback   [][]int32
-	ItemFeedback   [][]int32
-	Negatives      [][]int32
+	UserIndex     base.Index
+	ItemIndex     base.Index
+	FeedbackUsers base.Array[int32]
+	FeedbackItems base.Array[int32]
+	// FeedbackTimestamps are parallel to FeedbackUsers and FeedbackItems. They are empty if feedback is added
+	// without timestamps.
+	FeedbackTimestamps base.Array[int64]
+	UserFeedback       [][]int32
+	ItemFeedback       [][]int32
+	// UserFeedbackWeights and ItemFeedbackWeights are parallel to UserFeedback and ItemFeedback. They are nil if all
+	// feedback is equally weighted.
+	UserFeedbackWeights [][]float32
+	ItemFeedbackWeights [][]float32
+	Negatives           [][]int32
+	// HardNegatives are items with negative feedback from users, which are sampled as negative items in training.
+	// They are nil if there is no negative feedback.
+	HardNegatives  [][]int32
 	ItemLabels     [][]int32
 	UserLabels     [][]int32
 	HiddenItems    []bool
@@ -83,11 +96,15 @@ func (dataset *DataSet) Bytes() int {
 	bytes += uintptr(dataset.ItemIndex.Bytes())
 	bytes += uintptr(dataset.FeedbackUsers.Bytes())
 	bytes += uintptr(dataset.FeedbackItems.Bytes())
+	bytes += uintptr(dataset.FeedbackTimestamps.Bytes())
 
 	// UserFeedback + ItemFeedback + Negatives
 	bytes += reflect.TypeOf(dataset.UserFeedback).Elem().Size() * uintptr(len(dataset.UserFeedback)+len(dataset.ItemFeedback))
 	bytes += reflect.TypeOf(dataset.UserFeedback).Elem().Elem().Size() * uintptr(dataset.Count()*2)
+	bytes += encoding.MatrixBytes(dataset.UserFeedbackWeights)
+	bytes += encoding.MatrixBytes(dataset.ItemFeedbackWeights)
 	bytes += encoding.MatrixBytes(dataset.Negatives)
+	bytes += encoding.MatrixBytes(dataset.HardNegatives)
 
 	// ItemLabels + UserLabels
 	bytes += reflect.TypeOf(dataset.ItemLabels).Elem().Size() * uintptr(len(dataset.ItemLabels)+len(dataset.UserLabels))
@@ -115,6 +132,11 @@ func (dataset *DataSet) AddItem(itemId string) {
 }
 
 func (dataset *DataSet) AddFeedback(userId, itemId string, insertUserItem bool) {
+	dataset.AddWeightedFeedback(userId, itemId, 1, insertUserItem)
+}
+
+// AddWeightedFeedback adds a feedback with confidence weight.
+func (dataset *DataSet) AddWeightedFeedback(userId, itemId string, weight float32, insertUserItem bool) {
 	if insertUserItem {
 		dataset.UserIndex.Add(userId)
 	}
@@ -124,19 +146,90 @@ func (dataset *DataSet) AddFeedback(userId, itemId string, insertUserItem bool)
 	userIndex := dataset.UserIndex.ToNumber(userId)
 	itemIndex := dataset.ItemIndex.ToNumber(itemId)
 	if userIndex != base.NotId && itemIndex != base.NotId {
-		dataset.FeedbackUsers.Append(userIndex)
-		dataset.FeedbackItems.Append(itemIndex)
-		for int(itemIndex) >= len(dataset.ItemFeedback) {
-			dataset.ItemFeedback = append(dataset.ItemFeedback, make([]int32, 0))
+		dataset.addIndexedFeedback(userIndex, itemIndex, weight)
+	}
+}
+
+// AddTimedFeedback adds a feedback with confidence weight and timestamp. Timestamps are used to split the dataset
+// by time, so that feedback of a dataset should be added either all with timestamps or all without timestamps.
+func (dataset *DataSet) AddTimedFeedback(userId, itemId string, weight float32, timestamp time.Time, insertUserItem bool) {
+	count := dataset.Count()
+	dataset.AddWeightedFeedback(userId, itemId, weight, insertUserItem)
+	if dataset.Count() > count {
+		dataset.FeedbackTimestamps.Append(timestamp.Unix())
+	}
+}
+
+// AddTimedIndexedFeedback adds a feedback with confidence weight and timestamp of a user and an item already indexed,
+// which saves looking up ids for callers indexing users and items themselves.
+func (dataset *DataSet) AddTimedIndexedFeedback(userIndex, itemIndex int32, weight float32, timestamp time.Time) {
+	dataset.addIndexedFeedback(userIndex, itemIndex, weight)
+	dataset.FeedbackTimestamps.Append(timestamp.Unix())
+}
+
+// SetChunkSize sets the number of elements in a chunk of feedback arrays. It must be called before feedback is added.
+func (dataset *DataSet) SetChunkSize(chunkSize int) {
+	dataset.FeedbackUsers.ChunkSize = chunkSize
+	dataset.FeedbackItems.ChunkSize = chunkSize
+	dataset.FeedbackTimestamps.ChunkSize = chunkSize
+}
+
+func (dataset *DataSet) addIndexedFeedback(userIndex, itemIndex int32, weight float32) {
+	for int(itemIndex) >= len(dataset.ItemFeedback) {
+		dataset.ItemFeedback = append(dataset.ItemFeedback, make([]int32, 0))
+	}
+	for int(userIndex) >= len(dataset.UserFeedback) {
+		dataset.UserFeedback = append(dataset.UserFeedback, make([]int32, 0))
+	}
+	// weights are allocated once the first feedback not weighted 1 arrives
+	if weight != 1 && dataset.UserFeedbackWeights == nil {
+		dataset.UserFeedbackWeights = createWeights(dataset.UserFeedback)
+		dataset.ItemFeedbackWeights = createWeights(dataset.ItemFeedback)
+	}
+	dataset.FeedbackUsers.Append(userIndex)
+	dataset.FeedbackItems.Append(itemIndex)
+	dataset.ItemFeedback[itemIndex] = append(dataset.ItemFeedback[itemIndex], userIndex)
+	dataset.UserFeedback[userIndex] = append(dataset.UserFeedback[userIndex], itemIndex)
+	if dataset.UserFeedbackWeights != nil {
+		for int(itemIndex) >= len(dataset.ItemFeedbackWeights) {
+			dataset.ItemFeedbackWeights = append(dataset.ItemFeedbackWeights, make([]float32, 0))
 		}
-		dataset.ItemFeedback[itemIndex] = append(dataset.ItemFeedback[itemIndex], userIndex)
-		for int(userIndex) >= len(dataset.UserFeedback) {
-			dataset.UserFeedback = append(dataset.UserFeedback, make([]int32, 0))
+		for int(userIndex) >= len(dataset.UserFeedbackWeights) {
+			dataset.UserFeedbackWeights = append(dataset.UserFeedbackWeights, make([]float32, 0))
 		}
-		dataset.UserFeedback[userIndex] = append(dataset.UserFeedback[userIndex], itemIndex)
+		dataset.ItemFeedbackWeights[itemIndex] = append(dataset.ItemFeedbackWeights[itemIndex], weight)
+		dataset.UserFeedbackWeights[userIndex] = append(dataset.UserFeedbackWeights[userIndex], weight)
 	}
 }
 
+// UserFeedbackWeight returns the weight of the k-th feedback of a user.
+func (dataset *DataSet) UserFeedbackWeight(userIndex int32, k int) float32 {
+	if dataset.UserFeedbackWeights == nil {
+		return 1
+	}
+	return dataset.UserFeedbackWeights[userIndex][k]
+}
+
+// ItemFeedbackWeight returns the weight of the k-th feedback of an item.
+func (dataset *DataSet) ItemFeedbackWeight(itemIndex int32, k int) float32 {
+	if dataset.ItemFeedbackWeights == nil {
+		return 1
+	}
+	return dataset.ItemFeedbackWeights[itemIndex][k]
+}
+
+// createWeights creates weights of existed feedback, which are all 1.
+func createWeights(feedback [][]int32) [][]float32 {
+	weights := make([][]float32, len(feedback))
+	for i := range feedback {
+		weights[i] = make([]float32, len(feedback[i]))
+		for j := range weights[i] {
+			weights[i][j] = 1
+		}
+	}
+	return weights
+}
+
 func (dataset *DataSet) SetNegatives(userId string, negatives []string) {
 	userIndex := dataset.UserIndex.ToNumber(userId)
 	if userIndex != base.NotId {
@@ -153,6 +246,22 @@ func (dataset *DataSet) SetNegatives(userId string, negatives []string) {
 	}
 }
 
+// AddHardNegative adds an item with negative feedback from a user.
+func (dataset *DataSet) AddHardNegative(userIndex, itemIndex int32) {
+	for int(userIndex) >= len(dataset.HardNegatives) {
+		dataset.HardNegatives = append(dataset.HardNegatives, nil)
+	}
+	dataset.HardNegatives[userIndex] = append(dataset.HardNegatives[userIndex], itemIndex)
+}
+
+// UserHardNegatives returns items with negative feedback from a user.
+func (dataset *DataSet) UserHardNegatives(userIndex int32) []int32 {
+	if int(userIndex) < len(dataset.HardNegatives) {
+		return dataset.HardNegatives[userIndex]
+	}
+	return nil
+}
+
 func (dataset *DataSet) Count() int {
 	if dataset.FeedbackUsers.Len() != dataset.FeedbackItems.Len() {
 		panic("dataset.FeedbackUsers.Len() != dataset.FeedbackItems.Len()")
@@ -195,35 +304,16 @@ func (dataset *DataSet) NegativeSample(excludeSet *DataSet, numCandidates int) [
 // set. If numTestUsers is equal or greater than the number of total users or numTestUsers <= 0, all users are presented
 // in the test set.
 func (dataset *DataSet) Split(numTestUsers int, seed int64) (*DataSet, *DataSet) {
-	trainSet, testSet := new(DataSet), new(DataSet)
-	trainSet.NumItemLabels, testSet.NumItemLabels = dataset.NumItemLabels, dataset.NumItemLabels
-	trainSet.NumUserLabels, testSet.NumUserLabels = dataset.NumUserLabels, dataset.NumUserLabels
-	trainSet.HiddenItems, testSet.HiddenItems = dataset.HiddenItems, dataset.HiddenItems
-	trainSet.ItemCategories, testSet.ItemCategories = dataset.ItemCategories, dataset.ItemCategories
-	trainSet.CategorySet, testSet.CategorySet = dataset.CategorySet, dataset.CategorySet
-	trainSet.ItemLabels, testSet.ItemLabels = dataset.ItemLabels, dataset.ItemLabels
-	trainSet.UserLabels, testSet.UserLabels = dataset.UserLabels, dataset.UserLabels
-	trainSet.NumItemLabelUsed, testSet.NumItemLabelUsed = dataset.NumItemLabelUsed, dataset.NumItemLabelUsed
-	trainSet.NumUserLabelUsed, testSet.NumUserLabelUsed = dataset.NumUserLabelUsed, dataset.NumUserLabelUsed
-	trainSet.UserIndex, testSet.UserIndex = dataset.UserIndex, dataset.UserIndex
-	trainSet.ItemIndex, testSet.ItemIndex = dataset.ItemIndex, dataset.ItemIndex
-	trainSet.UserFeedback, testSet.UserFeedback = createSliceOfSlice(dataset.UserCount()), createSliceOfSlice(dataset.UserCount())
-	trainSet.ItemFeedback, testSet.ItemFeedback = createSliceOfSlice(dataset.ItemCount()), createSliceOfSlice(dataset.ItemCount())
+	trainSet, testSet := dataset.createSplit()
 	rng := base.NewRandomGenerator(seed)
 	if numTestUsers >= dataset.UserCount() || numTestUsers <= 0 {
 		for userIndex := int32(0); userIndex < int32(dataset.UserCount()); userIndex++ {
 			if len(dataset.UserFeedback[userIndex]) > 0 {
 				k := rng.Intn(len(dataset.UserFeedback[userIndex]))
-				testSet.FeedbackUsers.Append(userIndex)
-				testSet.FeedbackItems.Append(dataset.UserFeedback[userIndex][k])
-				testSet.UserFeedback[userIndex] = append(testSet.UserFeedback[userIndex], dataset.UserFeedback[userIndex][k])
-				testSet.ItemFeedback[dataset.UserFeedback[userIndex][k]] = append(testSet.ItemFeedback[dataset.UserFeedback[userIndex][k]], userIndex)
+				testSet.addIndexedFeedback(userIndex, dataset.UserFeedback[userIndex][k], dataset.UserFeedbackWeight(userIndex, k))
 				for i, itemIndex := range dataset.UserFeedback[userIndex] {
 					if i != k {
-						trainSet.FeedbackUsers.Append(userIndex)
-						trainSet.FeedbackItems.Append(itemIndex)
-						trainSet.UserFeedback[userIndex] = append(trainSet.UserFeedback[userIndex], itemIndex)
-						trainSet.ItemFeedback[itemIndex] = append(trainSet.ItemFeedback[itemIndex], userIndex)
+						trainSet.addIndexedFeedback(userIndex, itemIndex, dataset.UserFeedbackWeight(userIndex, i))
 					}
 				}
 			}
@@ -233,16 +323,10 @@ func (dataset *DataSet) Split(numTestUsers int, seed int64) (*DataSet, *DataSet)
 		for _, userIndex := range testUsers {
 			if len(dataset.UserFeedback[userIndex]) > 0 {
 				k := rng.Intn(len(dataset.UserFeedback[userIndex]))
-				testSet.FeedbackUsers.Append(userIndex)
-				testSet.FeedbackItems.Append(dataset.UserFeedback[userIndex][k])
-				testSet.UserFeedback[userIndex] = append(testSet.UserFeedback[userIndex], dataset.UserFeedback[userIndex][k])
-				testSet.ItemFeedback[dataset.UserFeedback[userIndex][k]] = append(testSet.ItemFeedback[dataset.UserFeedback[userIndex][k]], userIndex)
+				testSet.addIndexedFeedback(userIndex, dataset.UserFeedback[userIndex][k], dataset.UserFeedbackWeight(userIndex, k))
 				for i, itemIndex := range dataset.UserFeedback[userIndex] {
 					if i != k {
-						trainSet.FeedbackUsers.Append(userIndex)
-						trainSet.FeedbackItems.Append(itemIndex)
-						trainSet.UserFeedback[userIndex] = append(trainSet.UserFeedback[userIndex], itemIndex)
-						trainSet.ItemFeedback[itemIndex] = append(trainSet.ItemFeedback[itemIndex], userIndex)
+						trainSet.addIndexedFeedback(userIndex, itemIndex, dataset.UserFeedbackWeight(userIndex, i))
 					}
 				}
 			}
@@ -250,11 +334,8 @@ func (dataset *DataSet) Split(numTestUsers int, seed int64) (*DataSet, *DataSet)
 		testUserSet := i32set.New(testUsers...)
 		for userIndex := int32(0); userIndex < int32(dataset.UserCount()); userIndex++ {
 			if !testUserSet.Has(userIndex) {
-				for _, itemIndex := range dataset.UserFeedback[userIndex] {
-					trainSet.FeedbackUsers.Append(userIndex)
-					trainSet.FeedbackItems.Append(itemIndex)
-					trainSet.UserFeedback[userIndex] = append(trainSet.UserFeedback[userIndex], itemIndex)
-					trainSet.ItemFeedback[itemIndex] = append(trainSet.ItemFeedback[itemIndex], userIndex)
+				for i, itemIndex := range dataset.UserFeedback[userIndex] {
+					trainSet.addIndexedFeedback(userIndex, itemIndex, dataset.UserFeedbackWeight(userIndex, i))
 				}
 			}
 		}
@@ -262,6 +343,63 @@ func (dataset *DataSet) Split(numTestUsers int, seed int64) (*DataSet, *DataSet)
 	return trainSet, testSet
 }
 
+// SplitByTime splits dataset by timestamps of feedback. The latest testRatio of feedback are placed in the test set
+// and the others are placed in the train set. It fails if feedback were added without timestamps.
+func (dataset *DataSet) SplitByTime(testRatio float64) (*DataSet, *DataSet, error) {
+	if dataset.FeedbackTimestamps.Len() != dataset.Count() {
+		return nil, nil, errors.Errorf("%d of %d feedback have timestamps", dataset.FeedbackTimestamps.Len(), dataset.Count())
+	}
+	trainSet, testSet := dataset.createSplit()
+	if dataset.Count() == 0 {
+		return trainSet, testSet, nil
+	}
+	// find the earliest timestamp of test feedback
+	timestamps := make([]int64, dataset.Count())
+	for i := range timestamps {
+		timestamps[i] = dataset.FeedbackTimestamps.Get(i)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	numTrain := int(float64(len(timestamps)) * (1 - testRatio))
+	cutoff := int64(math.MaxInt64)
+	if numTrain < len(timestamps) {
+		cutoff = timestamps[numTrain]
+	}
+	// the k-th occurrence of a user in feedback is the k-th feedback of the user
+	userOffsets := make([]int, dataset.UserCount())
+	for i := 0; i < dataset.Count(); i++ {
+		userIndex, itemIndex := dataset.GetIndex(i)
+		weight := dataset.UserFeedbackWeight(userIndex, userOffsets[userIndex])
+		userOffsets[userIndex]++
+		if dataset.FeedbackTimestamps.Get(i) >= cutoff {
+			testSet.addIndexedFeedback(userIndex, itemIndex, weight)
+		} else {
+			trainSet.addIndexedFeedback(userIndex, itemIndex, weight)
+		}
+	}
+	return trainSet, testSet, nil
+}
+
+// createSplit creates an empty train set and an empty test set sharing indices and attributes with this dataset.
+func (dataset *DataSet) createSplit() (*DataSet, *DataSet) {
+	trainSet, testSet := new(DataSet), new(DataSet)
+	trainSet.NumItemLabels, testSet.NumItemLabels = dataset.NumItemLabels, dataset.NumItemLabels
+	trainSet.NumUserLabels, testSet.NumUserLabels = dataset.NumUserLabels, dataset.NumUserLabels
+	trainSet.HiddenItems, testSet.HiddenItems = dataset.HiddenItems, dataset.HiddenItems
+	trainSet.ItemCategories, testSet.ItemCategories = dataset.ItemCategories, dataset.ItemCategories
+	trainSet.CategorySet, testSet.CategorySet = dataset.CategorySet, dataset.CategorySet
+	trainSet.ItemLabels, testSet.ItemLabels = dataset.ItemLabels, dataset.ItemLabels
+	trainSet.UserLabels, testSet.UserLabels = dataset.UserLabels, dataset.UserLabels
+	trainSet.NumItemLabelUsed, testSet.NumItemLabelUsed = dataset.NumItemLabelUsed, dataset.NumItemLabelUsed
+	trainSet.NumUserLabelUsed, testSet.NumUserLabelUsed = dataset.NumUserLabelUsed, dataset.NumUserLabelUsed
+	trainSet.UserIndex, testSet.UserIndex = dataset.UserIndex, dataset.UserIndex
+	// hard negatives are used in training only
+	trainSet.HardNegatives = dataset.HardNegatives
+	trainSet.ItemIndex, testSet.ItemIndex = dataset.ItemIndex, dataset.ItemIndex
+	trainSet.UserFeedback, testSet.UserFeedback = createSliceOfSlice(dataset.UserCount()), createSliceOfSlice(dataset.UserCount())
+	trainSet.ItemFeedback, testSet.ItemFeedback = createSliceOfSlice(dataset.ItemCount()), createSliceOfSlice(dataset.ItemCount())
+	return trainSet, testSet
+}
+
 // GetIndex gets the i-th record by <user index, item index, rating>.
 func (dataset *DataSet) GetIndex(i int) (int32, int32) {
 	return dataset.FeedbackUsers.Get(i), dataset.FeedbackItems.Get(i)
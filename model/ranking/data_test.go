@@ -18,6 +18,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestNewMapIndexDataset(t *testing.T) {
@@ -69,3 +70,60 @@ func TestDataSet_Split(t *testing.T) {
 	assert.Equal(t, numItems, test2.ItemCount())
 	assert.Equal(t, 2, test2.Count())
 }
+
+func TestDataSet_AddWeightedFeedback(t *testing.T) {
+	dataset := NewMapIndexDataset()
+	dataset.AddFeedback("user0", "item0", true)
+	assert.Nil(t, dataset.UserFeedbackWeights)
+	assert.Equal(t, float32(1), dataset.UserFeedbackWeight(0, 0))
+	// weights are allocated for the first feedback not weighted 1
+	dataset.AddWeightedFeedback("user0", "item1", 2, true)
+	dataset.AddWeightedFeedback("user1", "item1", 0.5, true)
+	dataset.AddFeedback("user1", "item0", true)
+	assert.Equal(t, [][]float32{{1, 2}, {0.5, 1}}, dataset.UserFeedbackWeights)
+	assert.Equal(t, [][]float32{{1, 1}, {2, 0.5}}, dataset.ItemFeedbackWeights)
+	assert.Equal(t, float32(2), dataset.UserFeedbackWeight(0, 1))
+	assert.Equal(t, float32(0.5), dataset.ItemFeedbackWeight(1, 1))
+	// weights are kept after split
+	train, test := dataset.Split(0, 0)
+	assert.Equal(t, 2, train.Count())
+	assert.Equal(t, 2, test.Count())
+	var sum float32
+	for _, set := range []*DataSet{train, test} {
+		for userIndex := range set.UserFeedback {
+			for k := range set.UserFeedback[userIndex] {
+				sum += set.UserFeedbackWeight(int32(userIndex), k)
+			}
+		}
+	}
+	assert.Equal(t, float32(4.5), sum)
+}
+
+func TestDataSet_SplitByTime(t *testing.T) {
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	dataset := NewMapIndexDataset()
+	for i := 0; i < 10; i++ {
+		// insert feedback out of order
+		j := (i * 3) % 10
+		weight := float32(1)
+		if j == 8 {
+			weight = 2
+		}
+		dataset.AddTimedFeedback(strconv.Itoa(j%2), strconv.Itoa(j), weight, timestamp.Add(time.Duration(j)*time.Hour), true)
+	}
+	assert.Equal(t, 10, dataset.FeedbackTimestamps.Len())
+	train, test, err := dataset.SplitByTime(0.3)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, train.Count())
+	assert.Equal(t, 3, test.Count())
+	assert.ElementsMatch(t, []int32{dataset.ItemIndex.ToNumber("8")}, test.UserFeedback[dataset.UserIndex.ToNumber("0")])
+	assert.ElementsMatch(t, []int32{dataset.ItemIndex.ToNumber("7"), dataset.ItemIndex.ToNumber("9")},
+		test.UserFeedback[dataset.UserIndex.ToNumber("1")])
+	// weights are kept after split
+	assert.Equal(t, float32(2), test.UserFeedbackWeight(dataset.UserIndex.ToNumber("0"), 0))
+
+	// feedback without timestamps
+	dataset.AddFeedback("0", "0", true)
+	_, _, err = dataset.SplitByTime(0.3)
+	assert.Error(t, err)
+}
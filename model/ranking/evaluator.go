@@ -19,6 +19,7 @@ import (
 	"github.com/scylladb/go-set"
 	"github.com/scylladb/go-set/i32set"
 	"github.com/thoas/go-funk"
+	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/copier"
 	"github.com/zhenghaoz/gorse/base/floats"
 	"github.com/zhenghaoz/gorse/base/heap"
@@ -30,37 +31,42 @@ import (
 // Metric is used by evaluators in personalized ranking tasks.
 type Metric func(targetSet *i32set.Set, rankList []int32) float32
 
+// evaluateChunkSize is the number of users in a chunk of evaluation. Scores are summed in chunks and chunks are
+// summed in order, so that scores never depend on the number of jobs.
+const evaluateChunkSize = 64
+
 // Evaluate evaluates a model in top-n tasks.
 func Evaluate(estimator MatrixFactorization, testSet, trainSet *DataSet, topK, numCandidates, nJobs int, scorers ...Metric) []float32 {
-	partSum := make([][]float32, nJobs)
-	partCount := make([]float32, nJobs)
-	for i := 0; i < nJobs; i++ {
+	numChunks := (testSet.UserCount() + evaluateChunkSize - 1) / evaluateChunkSize
+	partSum := make([][]float32, numChunks)
+	partCount := make([]float32, numChunks)
+	for i := 0; i < numChunks; i++ {
 		partSum[i] = make([]float32, len(scorers))
 	}
-	//rng := NewRandomGenerator(0)
 	// For all UserFeedback
 	negatives := testSet.NegativeSample(trainSet, numCandidates)
-	_ = parallel.Parallel(testSet.UserCount(), nJobs, func(workerId, userIndex int) error {
-		// Find top-n ItemFeedback in test set
-		targetSet := set.NewInt32Set(testSet.UserFeedback[userIndex]...)
-		if targetSet.Size() > 0 {
-			// Sample negative samples
-			//userTrainSet := NewSet(trainSet.UserFeedback[userIndex])
-			negativeSample := negatives[userIndex]
-			candidates := make([]int32, 0, targetSet.Size()+len(negativeSample))
-			candidates = append(candidates, testSet.UserFeedback[userIndex]...)
-			candidates = append(candidates, negativeSample...)
-			// Find top-n ItemFeedback in predictions
-			rankList, _ := Rank(estimator, int32(userIndex), candidates, topK)
-			partCount[workerId]++
-			for i, metric := range scorers {
-				partSum[workerId][i] += metric(targetSet, rankList)
+	_ = parallel.Parallel(numChunks, nJobs, func(_, chunkId int) error {
+		for userIndex := chunkId * evaluateChunkSize; userIndex < testSet.UserCount() && userIndex < (chunkId+1)*evaluateChunkSize; userIndex++ {
+			// Find top-n ItemFeedback in test set
+			targetSet := set.NewInt32Set(testSet.UserFeedback[userIndex]...)
+			if targetSet.Size() > 0 {
+				// Sample negative samples
+				negativeSample := negatives[userIndex]
+				candidates := make([]int32, 0, targetSet.Size()+len(negativeSample))
+				candidates = append(candidates, testSet.UserFeedback[userIndex]...)
+				candidates = append(candidates, negativeSample...)
+				// Find top-n ItemFeedback in predictions
+				rankList, _ := Rank(estimator, int32(userIndex), candidates, topK)
+				partCount[chunkId]++
+				for i, metric := range scorers {
+					partSum[chunkId][i] += metric(targetSet, rankList)
+				}
 			}
 		}
 		return nil
 	})
 	sum := make([]float32, len(scorers))
-	for i := 0; i < nJobs; i++ {
+	for i := 0; i < numChunks; i++ {
 		for j := range partSum[i] {
 			sum[j] += partSum[i][j]
 		}
@@ -172,6 +178,133 @@ func Rank(model MatrixFactorization, userId int32, candidates []int32, topN int)
 	return recommends, scores
 }
 
+// TopNScore is the score of top-n recommendations over all items.
+type TopNScore struct {
+	N                  int
+	Precision          float32
+	Recall             float32
+	NDCG               float32
+	MAP                float32
+	Coverage           float32 // fraction of items recommended to at least one user
+	IntraListDiversity float32 // average cosine distance between latent factors of items in a list
+}
+
+// EvaluateTopN evaluates top-n recommendations generated from all items except items in the train set. At most
+// numTestUsers users in the test set are evaluated if numTestUsers > 0.
+func EvaluateTopN(estimator MatrixFactorization, testSet, trainSet *DataSet, topN []int, numTestUsers, nJobs int, seed int64) []TopNScore {
+	maxN := 0
+	for _, n := range topN {
+		if n > maxN {
+			maxN = n
+		}
+	}
+	// sample test users
+	var testUsers []int32
+	for userIndex := range testSet.UserFeedback {
+		if len(testSet.UserFeedback[userIndex]) > 0 {
+			testUsers = append(testUsers, int32(userIndex))
+		}
+	}
+	if numTestUsers > 0 && numTestUsers < len(testUsers) {
+		rng := base.NewRandomGenerator(seed)
+		rng.Shuffle(len(testUsers), func(i, j int) { testUsers[i], testUsers[j] = testUsers[j], testUsers[i] })
+		testUsers = testUsers[:numTestUsers]
+	}
+	scores := make([]TopNScore, len(topN))
+	for i, n := range topN {
+		scores[i].N = n
+	}
+	if len(testUsers) == 0 || maxN == 0 {
+		return scores
+	}
+	// evaluate test users
+	numItems := int32(testSet.ItemCount())
+	partSum := make([][]TopNScore, nJobs)
+	recommended := make([][]*i32set.Set, nJobs)
+	for i := 0; i < nJobs; i++ {
+		partSum[i] = make([]TopNScore, len(topN))
+		recommended[i] = make([]*i32set.Set, len(topN))
+		for j := range topN {
+			recommended[i][j] = i32set.New()
+		}
+	}
+	_ = parallel.Parallel(len(testUsers), nJobs, func(workerId, jobId int) error {
+		userIndex := testUsers[jobId]
+		targetSet := set.NewInt32Set(testSet.UserFeedback[userIndex]...)
+		var excludeSet *i32set.Set
+		if int(userIndex) < len(trainSet.UserFeedback) {
+			excludeSet = set.NewInt32Set(trainSet.UserFeedback[userIndex]...)
+		} else {
+			excludeSet = i32set.New()
+		}
+		itemsHeap := heap.NewTopKFilter[int32, float32](maxN)
+		for itemIndex := int32(0); itemIndex < numItems; itemIndex++ {
+			if !excludeSet.Has(itemIndex) {
+				itemsHeap.Push(itemIndex, estimator.InternalPredict(userIndex, itemIndex))
+			}
+		}
+		rankList, _ := itemsHeap.PopAll()
+		for i, n := range topN {
+			list := rankList
+			if n < len(list) {
+				list = list[:n]
+			}
+			if len(list) == 0 {
+				continue
+			}
+			partSum[workerId][i].Precision += Precision(targetSet, list)
+			partSum[workerId][i].Recall += Recall(targetSet, list)
+			partSum[workerId][i].NDCG += NDCG(targetSet, list)
+			partSum[workerId][i].MAP += MAP(targetSet, list)
+			partSum[workerId][i].IntraListDiversity += intraListDiversity(estimator, list)
+			recommended[workerId][i].Add(list...)
+		}
+		return nil
+	})
+	for i := range topN {
+		union := i32set.New()
+		for j := 0; j < nJobs; j++ {
+			scores[i].Precision += partSum[j][i].Precision
+			scores[i].Recall += partSum[j][i].Recall
+			scores[i].NDCG += partSum[j][i].NDCG
+			scores[i].MAP += partSum[j][i].MAP
+			scores[i].IntraListDiversity += partSum[j][i].IntraListDiversity
+			union.Merge(recommended[j][i])
+		}
+		count := float32(len(testUsers))
+		scores[i].Precision /= count
+		scores[i].Recall /= count
+		scores[i].NDCG /= count
+		scores[i].MAP /= count
+		scores[i].IntraListDiversity /= count
+		if numItems > 0 {
+			scores[i].Coverage = float32(union.Size()) / float32(numItems)
+		}
+	}
+	return scores
+}
+
+// intraListDiversity is the average cosine distance between latent factors of each pair of items in a list.
+func intraListDiversity(estimator MatrixFactorization, rankList []int32) float32 {
+	if len(rankList) < 2 {
+		return 0
+	}
+	sum := float32(0)
+	for i := 0; i < len(rankList); i++ {
+		a := estimator.GetItemFactor(rankList[i])
+		for j := i + 1; j < len(rankList); j++ {
+			b := estimator.GetItemFactor(rankList[j])
+			norm := math32.Sqrt(floats.Dot(a, a) * floats.Dot(b, b))
+			if norm > 0 {
+				sum += 1 - floats.Dot(a, b)/norm
+			} else {
+				sum += 1
+			}
+		}
+	}
+	return sum / float32(len(rankList)*(len(rankList)-1)/2)
+}
+
 // SnapshotManger manages the best snapshot.
 type SnapshotManger struct {
 	BestWeights []interface{}
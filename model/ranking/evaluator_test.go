@@ -81,8 +81,9 @@ func (m *mockMatrixFactorizationForEval) GetUserFactor(_ int32) []float32 {
 	panic("implement me")
 }
 
-func (m *mockMatrixFactorizationForEval) GetItemFactor(_ int32) []float32 {
-	panic("implement me")
+func (m *mockMatrixFactorizationForEval) GetItemFactor(itemId int32) []float32 {
+	// items of the same parity are similar
+	return []float32{float32(itemId % 2), float32(1 - itemId%2)}
 }
 
 func (m *mockMatrixFactorizationForEval) IsUserPredictable(_ int32) bool {
@@ -170,6 +171,41 @@ func TestEvaluate(t *testing.T) {
 	assert.Equal(t, float32(0.625), s[0])
 }
 
+func TestEvaluateTopN(t *testing.T) {
+	// create dataset
+	train, test := NewDirectIndexDataset(), NewDirectIndexDataset()
+	train.AddFeedback("0", "0", true)
+	train.AddFeedback("1", "0", true)
+	test.AddFeedback("0", "1", true)
+	test.AddFeedback("0", "2", true)
+	test.AddFeedback("1", "3", true)
+	// create model
+	m := &mockMatrixFactorizationForEval{
+		positive: []*i32set.Set{set.NewInt32Set(1), set.NewInt32Set(3)},
+		negative: []*i32set.Set{set.NewInt32Set(3), set.NewInt32Set(1)},
+	}
+	// evaluate model
+	scores := EvaluateTopN(m, test, train, []int{1, 2}, 0, 2, 0)
+	assert.Equal(t, 2, len(scores))
+	assert.Equal(t, 1, scores[0].N)
+	assert.InDelta(t, 1, scores[0].Precision, evalEpsilon)
+	assert.InDelta(t, 0.75, scores[0].Recall, evalEpsilon)
+	assert.InDelta(t, 1, scores[0].NDCG, evalEpsilon)
+	assert.InDelta(t, 0.75, scores[0].MAP, evalEpsilon)
+	assert.InDelta(t, 0.5, scores[0].Coverage, evalEpsilon)
+	assert.InDelta(t, 0, scores[0].IntraListDiversity, evalEpsilon)
+	assert.Equal(t, 2, scores[1].N)
+	assert.InDelta(t, 0.75, scores[1].Precision, evalEpsilon)
+	assert.InDelta(t, 1, scores[1].Recall, evalEpsilon)
+	assert.InDelta(t, 1, scores[1].NDCG, evalEpsilon)
+	assert.InDelta(t, 1, scores[1].MAP, evalEpsilon)
+	assert.InDelta(t, 0.75, scores[1].Coverage, evalEpsilon)
+	assert.InDelta(t, 1, scores[1].IntraListDiversity, evalEpsilon)
+	// evaluate a sampled user
+	scores = EvaluateTopN(m, test, train, []int{1}, 1, 1, 0)
+	assert.InDelta(t, 0.25, scores[0].Coverage, evalEpsilon)
+}
+
 func TestSnapshotManger_AddSnapshot(t *testing.T) {
 	a := []int{0}
 	b := [][]int{{0}}
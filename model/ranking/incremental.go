@@ -0,0 +1,90 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ranking
+
+import (
+	"github.com/chewxy/math32"
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/i32set"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/floats"
+)
+
+// IncrementalFit updates a trained model by new positive feedback <userIndices[k], itemIndices[k]>. It performs
+// nEpochs passes of stochastic gradient descent on the BPR loss. Only latent factors of users and items in new
+// feedback are modified, negative items are sampled from all items but left unchanged.
+func IncrementalFit(m MatrixFactorization, userIndices, itemIndices []int32, nEpochs int, lr, reg float32, seed int64) error {
+	if len(userIndices) != len(itemIndices) {
+		return errors.Errorf("the number of users (%d) and items (%d) mismatch", len(userIndices), len(itemIndices))
+	}
+	var baseModel *BaseMatrixFactorization
+	switch m := m.(type) {
+	case *BPR:
+		baseModel = &m.BaseMatrixFactorization
+	case *CCD:
+		baseModel = &m.BaseMatrixFactorization
+	default:
+		return errors.NotSupportedf("incremental fit of %s", GetModelName(m))
+	}
+	numItems := baseModel.ItemIndex.Len()
+	if len(userIndices) == 0 || numItems == 0 {
+		return nil
+	}
+	// collect new positive items of each user
+	positiveItems := make(map[int32]*i32set.Set)
+	for k, userIndex := range userIndices {
+		if userIndex < 0 || userIndex >= baseModel.UserIndex.Len() || itemIndices[k] < 0 || itemIndices[k] >= numItems {
+			return errors.Errorf("feedback <%d, %d> out of index", userIndex, itemIndices[k])
+		}
+		if _, exist := positiveItems[userIndex]; !exist {
+			positiveItems[userIndex] = i32set.New()
+		}
+		positiveItems[userIndex].Add(itemIndices[k])
+	}
+	rng := base.NewRandomGenerator(seed)
+	nFactors := len(baseModel.UserFactor[userIndices[0]])
+	userFactor := make([]float32, nFactors)
+	positiveItemFactor := make([]float32, nFactors)
+	temp := make([]float32, nFactors)
+	for epoch := 0; epoch < nEpochs; epoch++ {
+		for k := range userIndices {
+			userIndex, posIndex := userIndices[k], itemIndices[k]
+			// sample a negative item
+			negIndex := rng.Int31n(numItems)
+			if positiveItems[userIndex].Has(negIndex) {
+				continue
+			}
+			diff := m.InternalPredict(userIndex, posIndex) - m.InternalPredict(userIndex, negIndex)
+			grad := math32.Exp(-diff) / (1.0 + math32.Exp(-diff))
+			copy(userFactor, baseModel.UserFactor[userIndex])
+			copy(positiveItemFactor, baseModel.ItemFactor[posIndex])
+			// update positive item latent factor: +w_u
+			floats.MulConstTo(userFactor, grad, temp)
+			floats.MulConstAddTo(positiveItemFactor, -reg, temp)
+			floats.MulConstAddTo(temp, lr, baseModel.ItemFactor[posIndex])
+			// update user latent factor: h_i-h_j
+			floats.SubTo(positiveItemFactor, baseModel.ItemFactor[negIndex], temp)
+			floats.MulConst(temp, grad)
+			floats.MulConstAddTo(userFactor, -reg, temp)
+			floats.MulConstAddTo(temp, lr, baseModel.UserFactor[userIndex])
+		}
+	}
+	// users and items with feedback become predictable
+	for k := range userIndices {
+		baseModel.UserPredictable.Set(uint(userIndices[k]))
+		baseModel.ItemPredictable.Set(uint(itemIndices[k]))
+	}
+	return nil
+}
@@ -15,6 +15,7 @@
 package ranking
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"reflect"
@@ -48,6 +49,9 @@ type FitConfig struct {
 	Candidates int
 	TopK       int
 	Task       *task.Task
+	// Deterministic trains models by stochastic gradient descent in a single job, so that models trained with the
+	// same random state are identical.
+	Deterministic bool
 }
 
 func NewFitConfig() *FitConfig {
@@ -73,6 +77,19 @@ func (config *FitConfig) SetTask(t *task.Task) *FitConfig {
 	return config
 }
 
+func (config *FitConfig) SetDeterministic(deterministic bool) *FitConfig {
+	config.Deterministic = deterministic
+	return config
+}
+
+// SGDJobs returns the number of jobs for stochastic gradient descent.
+func (config *FitConfig) SGDJobs() int {
+	if config.Deterministic {
+		return 1
+	}
+	return config.AvailableJobs(config.Task)
+}
+
 func (config *FitConfig) LoadDefaultIfNil() *FitConfig {
 	if config == nil {
 		return NewFitConfig()
@@ -250,6 +267,15 @@ func Clone(m MatrixFactorization) MatrixFactorization {
 	}
 }
 
+// PredictBatch predicts scores of items for a user by dot products of latent factors, which is how matrix
+// factorization models predict. Items are scored in order, so item factors are scanned sequentially.
+func PredictBatch(m MatrixFactorization, userIndex int32, itemIndices []int32, scores []float32) {
+	userFactor := m.GetUserFactor(userIndex)
+	for i, itemIndex := range itemIndices {
+		scores[i] = floats.Dot(userFactor, m.GetItemFactor(itemIndex))
+	}
+}
+
 const (
 	CollaborativeBPR = "bpr"
 	CollaborativeCCD = "ccd"
@@ -266,7 +292,26 @@ func GetModelName(m Model) string {
 	}
 }
 
+const (
+	// modelFormat marks models encoded with a format version. Models encoded before versioning start with their
+	// names instead.
+	modelFormat = "gorse-ranking-model"
+	// modelFormatVersion is bumped once the encoding of models changes. Models in other versions are rejected.
+	modelFormatVersion int32 = 2
+	// PrecisionFloat32 means model weights are encoded as 32-bit floats.
+	PrecisionFloat32 int32 = 32
+)
+
 func MarshalModel(w io.Writer, m Model) error {
+	if err := encoding.WriteString(w, modelFormat); err != nil {
+		return errors.Trace(err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, modelFormatVersion); err != nil {
+		return errors.Trace(err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, PrecisionFloat32); err != nil {
+		return errors.Trace(err)
+	}
 	if err := encoding.WriteString(w, GetModelName(m)); err != nil {
 		return errors.Trace(err)
 	}
@@ -281,6 +326,25 @@ func UnmarshalModel(r io.Reader) (MatrixFactorization, error) {
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	// models encoded before versioning are in 32-bit floats
+	if name == modelFormat {
+		var version, precision int32
+		if err = binary.Read(r, binary.LittleEndian, &version); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if version != modelFormatVersion {
+			return nil, errors.NotSupportedf("model format version %d (expected version %d)", version, modelFormatVersion)
+		}
+		if err = binary.Read(r, binary.LittleEndian, &precision); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if precision != PrecisionFloat32 {
+			return nil, errors.NotSupportedf("model precision %d", precision)
+		}
+		if name, err = encoding.ReadString(r); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
 	switch name {
 	case "bpr":
 		var bpr BPR
@@ -298,6 +362,9 @@ func UnmarshalModel(r io.Reader) (MatrixFactorization, error) {
 	return nil, fmt.Errorf("unknown model %v", name)
 }
 
+// hardNegativeRatio is the probability of sampling negative items from hard negatives of a user in BPR.
+const hardNegativeRatio = 0.5
+
 // BPR means Bayesian Personal Ranking, is a pairwise learning algorithm for matrix factorization
 // model with implicit feedback. The pairwise ranking between item i and j for user u is estimated
 // by:
@@ -373,7 +440,7 @@ func (bpr *BPR) Predict(userId, itemId string) float32 {
 	userIndex := bpr.UserIndex.ToNumber(userId)
 	itemIndex := bpr.ItemIndex.ToNumber(itemId)
 	if userIndex == base.NotId {
-		log.Logger().Warn("unknown user", zap.String("user_id", userId))
+		log.Logger().Warn("unknown user", log.UserId(userId))
 	}
 	if itemIndex == base.NotId {
 		log.Logger().Warn("unknown item", zap.String("item_id", itemId))
@@ -433,7 +500,7 @@ func (bpr *BPR) Fit(trainSet, valSet *DataSet, config *FitConfig) Score {
 	for epoch := 1; epoch <= bpr.nEpochs; epoch++ {
 		fitStart := time.Now()
 		// Training epoch
-		numJobs := config.AvailableJobs(config.Task)
+		numJobs := config.SGDJobs()
 		cost := make([]float32, numJobs)
 		_ = parallel.Parallel(trainSet.Count(), numJobs, func(workerId, _ int) error {
 			// Select a user
@@ -449,7 +516,11 @@ func (bpr *BPR) Fit(trainSet, valSet *DataSet, config *FitConfig) Score {
 			posIndex := trainSet.UserFeedback[userIndex][rng[workerId].Intn(ratingCount)]
 			// Select a negative sample
 			negIndex := int32(-1)
-			for {
+			if hardNegatives := trainSet.UserHardNegatives(userIndex); len(hardNegatives) > 0 &&
+				rng[workerId].Float32() < hardNegativeRatio {
+				negIndex = hardNegatives[rng[workerId].Intn(len(hardNegatives))]
+			}
+			for negIndex < 0 {
 				temp := rng[workerId].Int31n(int32(trainSet.ItemCount()))
 				if !userFeedback[userIndex].Has(temp) {
 					negIndex = temp
@@ -493,6 +564,10 @@ func (bpr *BPR) Fit(trainSet, valSet *DataSet, config *FitConfig) Score {
 			snapshots.AddSnapshot(Score{NDCG: scores[0], Precision: scores[1], Recall: scores[2]}, bpr.UserFactor, bpr.ItemFactor)
 		}
 		config.Task.Add(1)
+		// stop training once the task is cancelled
+		if config.Task.Cancelled() {
+			break
+		}
 	}
 	// restore best snapshot
 	bpr.UserFactor = snapshots.BestWeights[0].([][]float32)
@@ -529,7 +604,7 @@ func (bpr *BPR) Init(trainSet *DataSet) {
 			oldIndex := bpr.UserIndex.ToNumber(userId)
 			newIndex := trainSet.UserIndex.ToNumber(userId)
 			if oldIndex != base.NotId {
-				newUserFactor[newIndex] = bpr.UserFactor[oldIndex]
+				copy(newUserFactor[newIndex], bpr.UserFactor[oldIndex])
 			}
 		}
 	}
@@ -538,7 +613,7 @@ func (bpr *BPR) Init(trainSet *DataSet) {
 			oldIndex := bpr.ItemIndex.ToNumber(itemId)
 			newIndex := trainSet.ItemIndex.ToNumber(itemId)
 			if oldIndex != base.NotId {
-				newItemFactor[newIndex] = bpr.ItemFactor[oldIndex]
+				copy(newItemFactor[newIndex], bpr.ItemFactor[oldIndex])
 			}
 		}
 	}
@@ -650,7 +725,7 @@ func (ccd *CCD) Predict(userId, itemId string) float32 {
 	userIndex := ccd.UserIndex.ToNumber(userId)
 	itemIndex := ccd.ItemIndex.ToNumber(itemId)
 	if userIndex == base.NotId {
-		log.Logger().Info("unknown user:", zap.String("user_id", userId))
+		log.Logger().Info("unknown user:", log.UserId(userId))
 		return 0
 	}
 	if itemIndex == base.NotId {
@@ -695,7 +770,7 @@ func (ccd *CCD) Init(trainSet *DataSet) {
 			oldIndex := ccd.UserIndex.ToNumber(userId)
 			newIndex := trainSet.UserIndex.ToNumber(userId)
 			if oldIndex != base.NotId {
-				newUserFactor[newIndex] = ccd.UserFactor[oldIndex]
+				copy(newUserFactor[newIndex], ccd.UserFactor[oldIndex])
 			}
 		}
 	}
@@ -704,7 +779,7 @@ func (ccd *CCD) Init(trainSet *DataSet) {
 			oldIndex := ccd.ItemIndex.ToNumber(itemId)
 			newIndex := trainSet.ItemIndex.ToNumber(itemId)
 			if oldIndex != base.NotId {
-				newItemFactor[newIndex] = ccd.ItemFactor[oldIndex]
+				copy(newItemFactor[newIndex], ccd.ItemFactor[oldIndex])
 			}
 		}
 	}
@@ -772,10 +847,12 @@ func (ccd *CCD) Fit(trainSet, valSet *DataSet, config *FitConfig) Score {
 					userRes[workerId][i] = userPredictions[workerId][i] - ccd.UserFactor[userIndex][f]*ccd.ItemFactor[i][f]
 				}
 				// p_{uf} <-
+				// the confidence of an observed feedback is its weight
 				a, b, c := float32(0), float32(0), float32(0)
-				for _, i := range userFeedback {
-					a += (1 - (1-ccd.weight)*userRes[workerId][i]) * ccd.ItemFactor[i][f]
-					c += (1 - ccd.weight) * ccd.ItemFactor[i][f] * ccd.ItemFactor[i][f]
+				for k, i := range userFeedback {
+					w := trainSet.UserFeedbackWeight(int32(userIndex), k)
+					a += (w - (w-ccd.weight)*userRes[workerId][i]) * ccd.ItemFactor[i][f]
+					c += (w - ccd.weight) * ccd.ItemFactor[i][f] * ccd.ItemFactor[i][f]
 				}
 				for k := 0; k < ccd.nFactors; k++ {
 					if k != f {
@@ -814,9 +891,10 @@ func (ccd *CCD) Fit(trainSet, valSet *DataSet, config *FitConfig) Score {
 				}
 				// q_{if} <-
 				a, b, c := float32(0), float32(0), float32(0)
-				for _, u := range itemFeedback {
-					a += (1 - (1-ccd.weight)*itemRes[workerId][u]) * ccd.UserFactor[u][f]
-					c += (1 - ccd.weight) * ccd.UserFactor[u][f] * ccd.UserFactor[u][f]
+				for k, u := range itemFeedback {
+					w := trainSet.ItemFeedbackWeight(int32(itemIndex), k)
+					a += (w - (w-ccd.weight)*itemRes[workerId][u]) * ccd.UserFactor[u][f]
+					c += (w - ccd.weight) * ccd.UserFactor[u][f] * ccd.UserFactor[u][f]
 				}
 				for k := 0; k < ccd.nFactors; k++ {
 					if k != f {
@@ -846,6 +924,10 @@ func (ccd *CCD) Fit(trainSet, valSet *DataSet, config *FitConfig) Score {
 			snapshots.AddSnapshot(Score{NDCG: scores[0], Precision: scores[1], Recall: scores[2]}, ccd.UserFactor, ccd.ItemFactor)
 		}
 		config.Task.Add(1)
+		// stop training once the task is cancelled
+		if config.Task.Cancelled() {
+			break
+		}
 	}
 	// restore best snapshot
 	ccd.UserFactor = snapshots.BestWeights[0].([][]float32)
@@ -15,12 +15,17 @@ package ranking
 
 import (
 	"bytes"
+	"encoding/binary"
+	"github.com/juju/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/encoding"
 	"github.com/zhenghaoz/gorse/base/floats"
 	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/model"
 	"math"
 	"runtime"
+	"strconv"
 	"testing"
 )
 
@@ -137,6 +142,101 @@ func TestCCD_MovieLens(t *testing.T) {
 	assert.True(t, m.Invalid())
 }
 
+func TestCCD_FeedbackWeights(t *testing.T) {
+	// user i likes items i, i+1, ... and purchases item i
+	createDataset := func(purchaseWeight float32) (*DataSet, *DataSet) {
+		dataset := NewMapIndexDataset()
+		for i := 0; i < 10; i++ {
+			for j := i; j < 10; j++ {
+				weight := float32(1)
+				if i == j {
+					weight = purchaseWeight
+				}
+				dataset.AddWeightedFeedback(strconv.Itoa(i), strconv.Itoa(j), weight, true)
+			}
+		}
+		return dataset.Split(0, 0)
+	}
+	fit := func(purchaseWeight float32) *CCD {
+		trainSet, testSet := createDataset(purchaseWeight)
+		m := NewCCD(model.Params{
+			model.NFactors: 4,
+			model.NEpochs:  5,
+			model.Alpha:    0.05,
+		})
+		m.Fit(trainSet, testSet, newFitConfig(5))
+		return m
+	}
+	unweighted, weighted := fit(1), fit(10)
+	assert.NotEqual(t, unweighted.UserFactor, weighted.UserFactor)
+	assert.NotEqual(t, unweighted.ItemFactor, weighted.ItemFactor)
+	// training with weights is deterministic
+	assert.Equal(t, weighted.UserFactor, fit(10).UserFactor)
+	assert.Equal(t, weighted.ItemFactor, fit(10).ItemFactor)
+}
+
+func TestIncrementalFit(t *testing.T) {
+	// user i likes items i, i+1, ..., i+4
+	dataset := NewMapIndexDataset()
+	for i := 0; i < 10; i++ {
+		for j := i; j < i+5 && j < 10; j++ {
+			dataset.AddFeedback(strconv.Itoa(i), strconv.Itoa(j), true)
+		}
+	}
+	trainSet, testSet := dataset.Split(0, 0)
+	m := NewBPR(model.Params{
+		model.NFactors: 4,
+		model.NEpochs:  5,
+	})
+	m.Fit(trainSet, testSet, newFitConfig(5))
+	userFactor := make([][]float32, len(m.UserFactor))
+	for i := range m.UserFactor {
+		userFactor[i] = append([]float32{}, m.UserFactor[i]...)
+	}
+	itemFactor := make([][]float32, len(m.ItemFactor))
+	for i := range m.ItemFactor {
+		itemFactor[i] = append([]float32{}, m.ItemFactor[i]...)
+	}
+
+	// user 9 likes item 0
+	userIndex, itemIndex := m.UserIndex.ToNumber("9"), m.ItemIndex.ToNumber("0")
+	before := m.Predict("9", "0")
+	err := IncrementalFit(m, []int32{userIndex}, []int32{itemIndex}, 100, 0.05, 0.01, 0)
+	assert.NoError(t, err)
+	assert.Greater(t, m.Predict("9", "0"), before)
+	assert.NotEqual(t, userFactor[userIndex], m.UserFactor[userIndex])
+	assert.NotEqual(t, itemFactor[itemIndex], m.ItemFactor[itemIndex])
+	for i := range userFactor {
+		if int32(i) != userIndex {
+			assert.Equal(t, userFactor[i], m.UserFactor[i])
+		}
+	}
+	for i := range itemFactor {
+		if int32(i) != itemIndex {
+			assert.Equal(t, itemFactor[i], m.ItemFactor[i])
+		}
+	}
+
+	// invalid feedback
+	assert.Error(t, IncrementalFit(m, []int32{0, 1}, []int32{0}, 1, 0.05, 0.01, 0))
+	assert.Error(t, IncrementalFit(m, []int32{100}, []int32{0}, 1, 0.05, 0.01, 0))
+}
+
+func TestIsCanaryUser(t *testing.T) {
+	count := 0
+	for i := 0; i < 10000; i++ {
+		userId := strconv.Itoa(i)
+		assert.False(t, IsCanaryUser(userId, 0))
+		assert.True(t, IsCanaryUser(userId, 100))
+		if IsCanaryUser(userId, 10) {
+			// canary users are still canary users if the percentage increases
+			assert.True(t, IsCanaryUser(userId, 20))
+			count++
+		}
+	}
+	assert.InDelta(t, 1000, count, 200)
+}
+
 //func TestCCD_Pinterest(t *testing.T) {
 //	trainSet, testSet, err := LoadDataFromBuiltIn("pinterest-20")
 //	assert.NoError(t, err)
@@ -150,3 +250,140 @@ func TestCCD_MovieLens(t *testing.T) {
 //	score := m.Fit(trainSet, testSet, fitConfig)
 //	assertEpsilon(t, 0.52, score.NDCG, benchDelta)
 //}
+
+func newRandomBPR(numUsers, numItems, numFactors int) *BPR {
+	m := NewBPR(model.Params{model.NFactors: numFactors})
+	rng := base.NewRandomGenerator(0)
+	m.UserFactor = rng.NormalMatrix(numUsers, numFactors, 0, 0.1)
+	m.ItemFactor = rng.NormalMatrix(numItems, numFactors, 0, 0.1)
+	return m
+}
+
+func TestPredictBatch(t *testing.T) {
+	m := newRandomBPR(10, 1000, 50)
+	itemIndices := make([]int32, 1000)
+	for i := range itemIndices {
+		itemIndices[i] = int32(i)
+	}
+	scores := make([]float32, len(itemIndices))
+	for userIndex := int32(0); userIndex < 10; userIndex++ {
+		PredictBatch(m, userIndex, itemIndices, scores)
+		for i, itemIndex := range itemIndices {
+			// compare with dot products in 64-bit floats
+			var expected float64
+			for k := range m.UserFactor[userIndex] {
+				expected += float64(m.UserFactor[userIndex][k]) * float64(m.ItemFactor[itemIndex][k])
+			}
+			assert.InDelta(t, expected, scores[i], 1e-5)
+			assert.Equal(t, m.InternalPredict(userIndex, itemIndex), scores[i])
+		}
+	}
+}
+
+func newSmallBPR() *BPR {
+	trainSet := NewMapIndexDataset()
+	for i := 0; i < 10; i++ {
+		for j := i; j < i+5; j++ {
+			trainSet.AddFeedback(strconv.Itoa(i), strconv.Itoa(j), true)
+		}
+	}
+	m := NewBPR(model.Params{model.NFactors: 8, model.NEpochs: 1})
+	m.Fit(trainSet, trainSet, newFitConfig(1))
+	return m
+}
+
+func TestMarshalModel(t *testing.T) {
+	m := newSmallBPR()
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, MarshalModel(buf, m))
+	// models start with the format header
+	encoded := bytes.NewReader(buf.Bytes())
+	format, err := encoding.ReadString(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, modelFormat, format)
+	var version, precision int32
+	assert.NoError(t, binary.Read(encoded, binary.LittleEndian, &version))
+	assert.NoError(t, binary.Read(encoded, binary.LittleEndian, &precision))
+	assert.Equal(t, modelFormatVersion, version)
+	assert.Equal(t, PrecisionFloat32, precision)
+	// round trip
+	tmp, err := UnmarshalModel(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, m.UserFactor, tmp.(*BPR).UserFactor)
+	assert.Equal(t, m.ItemFactor, tmp.(*BPR).ItemFactor)
+	assert.Equal(t, m.UserIndex, tmp.(*BPR).UserIndex)
+	assert.Equal(t, m.ItemIndex, tmp.(*BPR).ItemIndex)
+}
+
+func TestUnmarshalModel_Incompatible(t *testing.T) {
+	for _, header := range [][2]int32{
+		{modelFormatVersion + 1, PrecisionFloat32}, // newer version
+		{modelFormatVersion - 1, PrecisionFloat32}, // older version
+		{modelFormatVersion, 64},                   // unsupported precision
+	} {
+		buf := bytes.NewBuffer(nil)
+		assert.NoError(t, encoding.WriteString(buf, modelFormat))
+		assert.NoError(t, binary.Write(buf, binary.LittleEndian, header[0]))
+		assert.NoError(t, binary.Write(buf, binary.LittleEndian, header[1]))
+		assert.NoError(t, encoding.WriteString(buf, CollaborativeBPR))
+		assert.NoError(t, newSmallBPR().Marshal(buf))
+		_, err := UnmarshalModel(buf)
+		assert.True(t, errors.Is(err, errors.NotSupported), header)
+	}
+}
+
+func TestUnmarshalModel_Legacy(t *testing.T) {
+	m := newSmallBPR()
+	// models encoded before versioning
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, encoding.WriteString(buf, CollaborativeBPR))
+	assert.NoError(t, m.Marshal(buf))
+	tmp, err := UnmarshalModel(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, m.UserFactor, tmp.(*BPR).UserFactor)
+	assert.Equal(t, m.ItemFactor, tmp.(*BPR).ItemFactor)
+}
+
+const (
+	benchNumItems   = 100000
+	benchNumFactors = 64
+)
+
+func BenchmarkPredict_Float64(b *testing.B) {
+	m := newRandomBPR(1, benchNumItems, benchNumFactors)
+	userFactor := make([]float64, benchNumFactors)
+	itemFactor := make([][]float64, benchNumItems)
+	for k := range userFactor {
+		userFactor[k] = float64(m.UserFactor[0][k])
+	}
+	for i := range itemFactor {
+		itemFactor[i] = make([]float64, benchNumFactors)
+		for k := range itemFactor[i] {
+			itemFactor[i][k] = float64(m.ItemFactor[i][k])
+		}
+	}
+	scores := make([]float64, benchNumItems)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range itemFactor {
+			var score float64
+			for k := range userFactor {
+				score += userFactor[k] * itemFactor[i][k]
+			}
+			scores[i] = score
+		}
+	}
+}
+
+func BenchmarkPredict_Float32(b *testing.B) {
+	m := newRandomBPR(1, benchNumItems, benchNumFactors)
+	itemIndices := make([]int32, benchNumItems)
+	for i := range itemIndices {
+		itemIndices[i] = int32(i)
+	}
+	scores := make([]float32, benchNumItems)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		PredictBatch(m, 0, itemIndices, scores)
+	}
+}
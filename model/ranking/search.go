@@ -15,10 +15,12 @@
 package ranking
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/juju/errors"
 	"github.com/zhenghaoz/gorse/base"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/base/task"
@@ -50,12 +52,8 @@ func (r *ParamsSearchResult) AddScore(params model.Params, score Score) {
 func GridSearchCV(estimator MatrixFactorization, trainSet *DataSet, testSet *DataSet, paramGrid model.ParamsGrid,
 	_ int64, fitConfig *FitConfig) ParamsSearchResult {
 	// Retrieve parameter names and length
-	paramNames := make([]model.ParamName, 0, len(paramGrid))
-	count := 1
-	for paramName, values := range paramGrid {
-		paramNames = append(paramNames, paramName)
-		count *= len(values)
-	}
+	paramNames := paramGrid.Names()
+	count := paramGrid.NumCombinations()
 	// Construct DFS procedure
 	results := ParamsSearchResult{
 		Scores: make([]Score, 0, count),
@@ -110,7 +108,8 @@ func RandomSearchCV(estimator MatrixFactorization, trainSet *DataSet, testSet *D
 	for i := 1; i <= numTrials; i++ {
 		// Make parameters
 		params := model.Params{}
-		for paramName, values := range paramGrid {
+		for _, paramName := range paramGrid.Names() {
+			values := paramGrid[paramName]
 			value := values[rng.Intn(len(values))]
 			params[paramName] = value
 		}
@@ -136,9 +135,11 @@ func RandomSearchCV(estimator MatrixFactorization, trainSet *DataSet, testSet *D
 type ModelSearcher struct {
 	models []MatrixFactorization
 	// arguments
-	numEpochs  int
-	numTrials  int
-	searchSize bool
+	numEpochs     int
+	numTrials     int
+	searchSize    bool
+	randomState   int64
+	deterministic bool
 	// results
 	bestMutex     sync.Mutex
 	bestModelName string
@@ -158,6 +159,21 @@ func NewModelSearcher(nEpoch, nTrials int, searchSize bool) *ModelSearcher {
 	return searcher
 }
 
+// SetRandomState sets the random state of searching and searched models.
+func (searcher *ModelSearcher) SetRandomState(randomState int64) *ModelSearcher {
+	searcher.randomState = randomState
+	for _, m := range searcher.models {
+		m.SetParams(m.GetParams().Overwrite(model.Params{model.RandomState: randomState}))
+	}
+	return searcher
+}
+
+// SetDeterministic sets whether searched models are trained deterministically.
+func (searcher *ModelSearcher) SetDeterministic(deterministic bool) *ModelSearcher {
+	searcher.deterministic = deterministic
+	return searcher
+}
+
 // GetBestModel returns the optimal personal ranking model.
 func (searcher *ModelSearcher) GetBestModel() (string, MatrixFactorization, Score) {
 	searcher.bestMutex.Lock()
@@ -175,10 +191,15 @@ func (searcher *ModelSearcher) Fit(trainSet, valSet *DataSet, t *task.Task, j *t
 		zap.Int("n_items", trainSet.ItemCount()))
 	startTime := time.Now()
 	for _, m := range searcher.models {
-		r := RandomSearchCV(m, trainSet, valSet, m.GetParamsGrid(searcher.searchSize), searcher.numTrials, 0,
+		r := RandomSearchCV(m, trainSet, valSet, m.GetParamsGrid(searcher.searchSize), searcher.numTrials, searcher.randomState,
 			NewFitConfig().
 				SetJobsAllocator(j).
-				SetTask(t))
+				SetTask(t).
+				SetDeterministic(searcher.deterministic))
+		// models trained partially are discarded
+		if t.Cancelled() {
+			return errors.Trace(context.Canceled)
+		}
 		searcher.bestMutex.Lock()
 		if searcher.bestModel == nil || r.BestScore.NDCG > searcher.bestScore.NDCG {
 			searcher.bestModel = r.BestModel
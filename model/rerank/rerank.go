@@ -0,0 +1,248 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rerank
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/config"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FeatureSchemaVersion is the version of features sent to scorers. It is increased once features are changed
+// incompatibly, and responses of other versions are rejected.
+const FeatureSchemaVersion = 1
+
+const (
+	ScorerNone = "none"
+	ScorerHTTP = "http"
+	ScorerGRPC = "grpc"
+)
+
+const (
+	StageServer = "server"
+	StageWorker = "worker"
+)
+
+var (
+	// RequestSecondsVec (gorse_rerank_request_seconds) is the latency of scoring requests by scorer.
+	RequestSecondsVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gorse",
+		Subsystem: "rerank",
+		Name:      "request_seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"scorer"})
+	// FallbackTotal (gorse_rerank_fallback_total) counts candidate lists left in the original order by reason, such as
+	// error or circuit_open.
+	FallbackTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "rerank",
+		Name:      "fallback_total",
+	}, []string{"reason"})
+)
+
+// Candidate is a candidate item and its features.
+type Candidate struct {
+	ItemId     string   `json:"item_id"`
+	Labels     []string `json:"labels"`
+	Categories []string `json:"categories"`
+	Score      float64  `json:"score"` // score from retrieval, replaced by the score from the scorer after re-ranking
+}
+
+// Request is the payload sent to scorers. Context carries features of the request, such as the category.
+type Request struct {
+	SchemaVersion int               `json:"schema_version"`
+	UserId        string            `json:"user_id"`
+	UserLabels    []string          `json:"user_labels"`
+	Context       map[string]string `json:"context"`
+	Candidates    []Candidate       `json:"candidates"`
+}
+
+// Response is the payload returned by scorers. Scores are aligned with candidates in the request.
+type Response struct {
+	SchemaVersion int       `json:"schema_version"`
+	Scores        []float64 `json:"scores"`
+}
+
+// Scorer scores candidates by an external model.
+type Scorer interface {
+	Score(ctx context.Context, request *Request) ([]float64, error)
+	Close() error
+}
+
+// NewScorer creates a scorer from configuration.
+func NewScorer(cfg config.RerankConfig) (Scorer, error) {
+	switch cfg.Scorer {
+	case ScorerHTTP:
+		return NewHTTPScorer(cfg.Endpoint), nil
+	case ScorerGRPC:
+		return NewGRPCScorer(cfg.Endpoint)
+	default:
+		return nil, errors.NotSupportedf("scorer `%v`", cfg.Scorer)
+	}
+}
+
+// Reranker re-orders candidates by an external scorer with a circuit breaker. The scorer is recreated once
+// configuration changes. The circuit is opened after MaxFailures consecutive failures, and a trial request is
+// allowed once BreakDuration passes.
+type Reranker struct {
+	mu        sync.Mutex
+	config    config.RerankConfig
+	scorer    Scorer
+	failures  int
+	openUntil time.Time
+}
+
+// NewReranker creates a reranker.
+func NewReranker() *Reranker {
+	return &Reranker{}
+}
+
+// Enabled returns true if candidates are re-ranked at the stage.
+func Enabled(cfg config.RerankConfig, stage string) bool {
+	return cfg.Scorer != "" && cfg.Scorer != ScorerNone && cfg.Stage == stage
+}
+
+// Rerank sorts candidates of the request by scores from the scorer. Scores of candidates are replaced by scores from
+// the scorer. Candidates are left in the original order if the scorer fails or the circuit is open, and false is
+// returned.
+func (r *Reranker) Rerank(cfg config.RerankConfig, request *Request) bool {
+	if len(request.Candidates) == 0 {
+		return true
+	}
+	scorer, err := r.acquire(cfg)
+	if err != nil {
+		if errors.Is(err, errors.Forbidden) {
+			FallbackTotal.WithLabelValues("circuit_open").Inc()
+		} else {
+			FallbackTotal.WithLabelValues("error").Inc()
+			log.Logger().Error("failed to create scorer", zap.String("scorer", cfg.Scorer), zap.Error(err))
+		}
+		return false
+	}
+	scores, err := scoreInBatches(scorer, cfg, request)
+	r.release(cfg, err)
+	if err != nil {
+		FallbackTotal.WithLabelValues("error").Inc()
+		log.Logger().Error("failed to rerank candidates", zap.String("scorer", cfg.Scorer), zap.Error(err))
+		return false
+	}
+	for i := range request.Candidates {
+		request.Candidates[i].Score = scores[i]
+	}
+	sort.SliceStable(request.Candidates, func(i, j int) bool {
+		return request.Candidates[i].Score > request.Candidates[j].Score
+	})
+	return true
+}
+
+// acquire returns the scorer if the circuit is closed. The scorer is recreated if configuration changed.
+func (r *Reranker) acquire(cfg config.RerankConfig) (Scorer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.config != cfg {
+		if r.scorer != nil {
+			if err := r.scorer.Close(); err != nil {
+				log.Logger().Warn("failed to close scorer", zap.Error(err))
+			}
+		}
+		r.config, r.scorer, r.failures, r.openUntil = cfg, nil, 0, time.Time{}
+	}
+	if r.failures >= cfg.MaxFailures {
+		if time.Now().Before(r.openUntil) {
+			return nil, errors.Forbiddenf("circuit of scorer `%v`", cfg.Scorer)
+		}
+		// let a trial request pass and keep the circuit open for others
+		r.openUntil = time.Now().Add(cfg.BreakDuration)
+	}
+	if r.scorer == nil {
+		scorer, err := NewScorer(cfg)
+		if err != nil {
+			r.recordFailure()
+			return nil, errors.Trace(err)
+		}
+		r.scorer = scorer
+	}
+	return r.scorer, nil
+}
+
+// release records the result of a scoring request.
+func (r *Reranker) release(cfg config.RerankConfig, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.config != cfg {
+		return
+	}
+	if err != nil {
+		r.recordFailure()
+	} else {
+		r.failures = 0
+	}
+}
+
+func (r *Reranker) recordFailure() {
+	r.failures++
+	if r.failures >= r.config.MaxFailures {
+		r.openUntil = time.Now().Add(r.config.BreakDuration)
+	}
+}
+
+// scoreInBatches splits candidates into batches and scores batches concurrently.
+func scoreInBatches(scorer Scorer, cfg config.RerankConfig, request *Request) ([]float64, error) {
+	scores := make([]float64, len(request.Candidates))
+	var wg sync.WaitGroup
+	errs := make([]error, (len(request.Candidates)+cfg.BatchSize-1)/cfg.BatchSize)
+	for b := range errs {
+		begin := b * cfg.BatchSize
+		end := begin + cfg.BatchSize
+		if end > len(request.Candidates) {
+			end = len(request.Candidates)
+		}
+		batch := *request
+		batch.SchemaVersion = FeatureSchemaVersion
+		batch.Candidates = request.Candidates[begin:end]
+		wg.Add(1)
+		go func(b int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+			defer cancel()
+			startTime := time.Now()
+			batchScores, err := scorer.Score(ctx, &batch)
+			RequestSecondsVec.WithLabelValues(cfg.Scorer).Observe(time.Since(startTime).Seconds())
+			if err != nil {
+				errs[b] = errors.Trace(err)
+				return
+			}
+			if len(batchScores) != len(batch.Candidates) {
+				errs[b] = errors.NotValidf("%d scores for %d candidates", len(batchScores), len(batch.Candidates))
+				return
+			}
+			copy(scores[begin:end], batchScores)
+		}(b)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scores, nil
+}
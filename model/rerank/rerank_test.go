@@ -0,0 +1,171 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rerank
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"google.golang.org/grpc"
+)
+
+// scoreByItemId scores candidates by their numeric ids.
+func scoreByItemId(request *Request) *Response {
+	response := &Response{SchemaVersion: FeatureSchemaVersion}
+	for _, candidate := range request.Candidates {
+		score, _ := strconv.ParseFloat(candidate.ItemId, 64)
+		response.Scores = append(response.Scores, score)
+	}
+	return response
+}
+
+func newTestConfig(scorer, endpoint string) config.RerankConfig {
+	cfg := config.GetDefaultConfig().Recommend.Rerank
+	cfg.Scorer = scorer
+	cfg.Endpoint = endpoint
+	cfg.BatchSize = 2
+	cfg.MaxFailures = 2
+	cfg.BreakDuration = time.Hour
+	return cfg
+}
+
+func newTestRequest() *Request {
+	return &Request{
+		UserId: "0",
+		Candidates: []Candidate{
+			{ItemId: "1", Score: 5},
+			{ItemId: "5", Score: 4},
+			{ItemId: "3", Score: 3},
+			{ItemId: "2", Score: 2},
+			{ItemId: "4", Score: 1},
+		},
+	}
+}
+
+func itemIds(request *Request) []string {
+	var ids []string
+	for _, candidate := range request.Candidates {
+		ids = append(ids, candidate.ItemId)
+	}
+	return ids
+}
+
+func TestReranker_HTTP(t *testing.T) {
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		var request Request
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, FeatureSchemaVersion, request.SchemaVersion)
+		assert.LessOrEqual(t, len(request.Candidates), 2)
+		assert.NoError(t, json.NewEncoder(w).Encode(scoreByItemId(&request)))
+	}))
+	defer server.Close()
+
+	reranker := NewReranker()
+	request := newTestRequest()
+	assert.True(t, reranker.Rerank(newTestConfig(ScorerHTTP, server.URL), request))
+	assert.Equal(t, []string{"5", "4", "3", "2", "1"}, itemIds(request))
+	assert.Equal(t, float64(5), request.Candidates[0].Score)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&numRequests))
+}
+
+func TestReranker_CircuitBreaker(t *testing.T) {
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	cfg := newTestConfig(ScorerHTTP, server.URL)
+	cfg.BatchSize = 10
+	reranker := NewReranker()
+	for i := 0; i < 4; i++ {
+		request := newTestRequest()
+		assert.False(t, reranker.Rerank(cfg, request))
+		// original order is kept
+		assert.Equal(t, []string{"1", "5", "3", "2", "4"}, itemIds(request))
+	}
+	// the circuit is opened after 2 failures
+	assert.Equal(t, int32(2), atomic.LoadInt32(&numRequests))
+
+	// a trial request is allowed after the break
+	reranker.openUntil = time.Now()
+	assert.False(t, reranker.Rerank(cfg, newTestRequest()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&numRequests))
+	assert.False(t, reranker.Rerank(cfg, newTestRequest()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&numRequests))
+}
+
+func TestReranker_SchemaVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request Request
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		response := scoreByItemId(&request)
+		response.SchemaVersion = FeatureSchemaVersion + 1
+		assert.NoError(t, json.NewEncoder(w).Encode(response))
+	}))
+	defer server.Close()
+
+	request := newTestRequest()
+	assert.False(t, NewReranker().Rerank(newTestConfig(ScorerHTTP, server.URL), request))
+	assert.Equal(t, []string{"1", "5", "3", "2", "4"}, itemIds(request))
+}
+
+func TestReranker_GRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}),
+		grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+			method, _ := grpc.MethodFromServerStream(stream)
+			assert.Equal(t, GRPCScoreMethod, method)
+			var request Request
+			if err := stream.RecvMsg(&request); err != nil {
+				return err
+			}
+			return stream.SendMsg(scoreByItemId(&request))
+		}))
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	request := newTestRequest()
+	assert.True(t, NewReranker().Rerank(newTestConfig(ScorerGRPC, lis.Addr().String()), request))
+	assert.Equal(t, []string{"5", "4", "3", "2", "1"}, itemIds(request))
+}
+
+func TestReranker_Unsupported(t *testing.T) {
+	request := newTestRequest()
+	assert.False(t, NewReranker().Rerank(newTestConfig("onnx", ""), request))
+	assert.Equal(t, []string{"1", "5", "3", "2", "4"}, itemIds(request))
+}
+
+func TestEnabled(t *testing.T) {
+	cfg := config.GetDefaultConfig().Recommend.Rerank
+	assert.False(t, Enabled(cfg, StageServer))
+	cfg.Scorer = ScorerHTTP
+	assert.True(t, Enabled(cfg, StageServer))
+	assert.False(t, Enabled(cfg, StageWorker))
+}
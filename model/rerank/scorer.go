@@ -0,0 +1,120 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rerank
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net/http"
+)
+
+// GRPCScoreMethod is the full name of the method called on gRPC scorers. Requests and responses are encoded in JSON
+// instead of protocol buffers, so that scorers need no generated code from gorse.
+const GRPCScoreMethod = "/gorse.rerank.Scorer/Score"
+
+// checkResponse validates the schema version of a response.
+func checkResponse(response *Response) ([]float64, error) {
+	if response.SchemaVersion != FeatureSchemaVersion {
+		return nil, errors.NotSupportedf("feature schema version %d", response.SchemaVersion)
+	}
+	return response.Scores, nil
+}
+
+// HTTPScorer posts requests to an HTTP endpoint in JSON.
+type HTTPScorer struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewHTTPScorer creates a scorer posting requests to the endpoint.
+func NewHTTPScorer(endpoint string) *HTTPScorer {
+	return &HTTPScorer{endpoint: endpoint, client: &http.Client{}}
+}
+
+func (s *HTTPScorer) Score(ctx context.Context, request *Request) ([]float64, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpResponse, err := s.client.Do(httpRequest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s", httpResponse.Status)
+	}
+	var response Response
+	if err = json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return checkResponse(&response)
+}
+
+func (s *HTTPScorer) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// jsonCodec encodes gRPC messages in JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// GRPCScorer calls GRPCScoreMethod of a gRPC endpoint.
+type GRPCScorer struct {
+	conn *grpc.ClientConn
+}
+
+// NewGRPCScorer connects to a gRPC endpoint. The connection is established lazily.
+func NewGRPCScorer(endpoint string) (*GRPCScorer, error) {
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &GRPCScorer{conn: conn}, nil
+}
+
+func (s *GRPCScorer) Score(ctx context.Context, request *Request) ([]float64, error) {
+	var response Response
+	if err := s.conn.Invoke(ctx, GRPCScoreMethod, request, &response, grpc.ForceCodec(jsonCodec{})); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return checkResponse(&response)
+}
+
+func (s *GRPCScorer) Close() error {
+	return s.conn.Close()
+}
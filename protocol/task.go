@@ -27,6 +27,7 @@ func DecodeTask(in *PushTaskInfoRequest) *task.Task {
 		Status:     task.Status(in.GetStatus()),
 		Done:       int(in.GetDone()),
 		Total:      int(in.GetTotal()),
+		Progress:   task.Progress(int(in.GetDone()), int(in.GetTotal())),
 		StartTime:  time.UnixMilli(in.GetStartTime()),
 		FinishTime: time.UnixMilli(in.GetFinishTime()),
 	}
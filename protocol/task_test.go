@@ -26,6 +26,7 @@ func TestEncodeDecode(t *testing.T) {
 		Name:       "a",
 		Total:      100,
 		Done:       50,
+		Progress:   50,
 		Status:     task.StatusRunning,
 		StartTime:  time.Date(2018, time.January, 1, 0, 0, 0, 0, time.Local),
 		FinishTime: time.Date(2018, time.January, 2, 0, 0, 0, 0, time.Local),
@@ -0,0 +1,223 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+const (
+	AuditEntityUser = "user"
+	AuditEntityItem = "item"
+	AuditEntityRule = "rule"
+
+	auditQueueSize = 10000
+	auditBatchSize = 1000
+
+	auditActorAttribute    = "audit_actor"
+	auditSummaryAttribute  = "audit_summary"
+	auditEntitiesAttribute = "audit_entities"
+)
+
+// auditEntityParameters are path parameters of entities and types of these entities.
+var auditEntityParameters = []struct {
+	name       string
+	entityType string
+}{
+	{"user-id", AuditEntityUser},
+	{"item-id", AuditEntityItem},
+	{"rule-id", AuditEntityRule},
+}
+
+// AuditEntity returns the entity of an id, such as "user/1" and "item/2".
+func AuditEntity(entityType, id string) string {
+	return entityType + "/" + id
+}
+
+// AuditEntities returns entities of ids without duplicates.
+func AuditEntities(entityType string, ids ...string) []string {
+	return lo.Uniq(lo.Map(ids, func(id string, _ int) string {
+		return AuditEntity(entityType, id)
+	}))
+}
+
+// APIKeyActor returns the actor of requests with an API key, which is the hash of the API key.
+func APIKeyActor(apikey string) string {
+	if apikey == "" {
+		return "anonymous"
+	}
+	hash := sha256.Sum256([]byte(apikey))
+	return "api_key/" + hex.EncodeToString(hash[:])
+}
+
+// DashboardActor returns the actor of requests from the dashboard, which is the user of the dashboard.
+func DashboardActor(userName string) string {
+	return "dashboard/" + userName
+}
+
+// SetAuditActor sets the actor of a request, which is the hash of the API key by default.
+func SetAuditActor(request *restful.Request, actor string) {
+	request.SetAttribute(auditActorAttribute, actor)
+}
+
+// SetAudit sets the summary of a request and entities in the request body. Entities in path parameters are recorded
+// by AuditFilter.
+func SetAudit(request *restful.Request, summary string, entities ...string) {
+	request.SetAttribute(auditSummaryAttribute, summary)
+	request.SetAttribute(auditEntitiesAttribute, entities)
+}
+
+// auditPatch returns the summary of a patch, which is the action followed by fields set in the patch.
+func auditPatch(action string, patch interface{}) string {
+	fields := make(map[string]interface{})
+	value := reflect.ValueOf(patch)
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); !field.IsZero() {
+			fields[value.Type().Field(i).Name] = field.Interface()
+		}
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return action
+	}
+	return action + " " + string(encoded)
+}
+
+// AuditFilter writes the audit log of a mutating API call if it succeeds.
+func (s *RestServer) AuditFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	chain.ProcessFilter(req, resp)
+	if s.AuditLogger == nil || resp.StatusCode() != http.StatusOK {
+		return
+	}
+	actor, ok := req.Attribute(auditActorAttribute).(string)
+	if !ok {
+		actor = APIKeyActor(req.HeaderParameter("X-API-Key"))
+	}
+	var entities []string
+	for _, parameter := range auditEntityParameters {
+		if id := req.PathParameter(parameter.name); id != "" {
+			entities = append(entities, AuditEntity(parameter.entityType, id))
+		}
+	}
+	if bodyEntities, ok := req.Attribute(auditEntitiesAttribute).([]string); ok {
+		entities = lo.Uniq(append(entities, bodyEntities...))
+	}
+	summary, _ := req.Attribute(auditSummaryAttribute).(string)
+	s.AuditLogger.Log(actor, req.Request.Method+" "+req.SelectedRoutePath(), summary, entities)
+}
+
+// AuditLogger writes audit logs to the data store in the background. Audit logs are queued in a bounded queue and
+// dropped if the queue is full, so that API calls are never blocked by the data store. Writes are paused in read-only
+// mode, and queued audit logs are flushed once writes are enabled again.
+type AuditLogger struct {
+	server   *RestServer
+	queue    chan data.AuditLog
+	writable chan struct{}
+	test     bool
+}
+
+func NewAuditLogger(s *RestServer) *AuditLogger {
+	l := &AuditLogger{server: s, queue: make(chan data.AuditLog, auditQueueSize), writable: make(chan struct{}, 1)}
+	if s.ReadOnlyManager != nil {
+		s.ReadOnlyManager.OnWritable(func() {
+			select {
+			case l.writable <- struct{}{}:
+			default:
+			}
+		})
+	}
+	go l.run()
+	return l
+}
+
+func newAuditLoggerForTest(s *RestServer) *AuditLogger {
+	return &AuditLogger{server: s, test: true}
+}
+
+// Log writes the audit log of an API call if audit logs are enabled.
+func (l *AuditLogger) Log(actor, endpoint, summary string, entities []string) {
+	if !l.server.Config.Server.Audit.Enable {
+		return
+	}
+	timestamp := time.Now()
+	auditLog := data.AuditLog{
+		Id:        data.NewAuditLogId(timestamp),
+		Timestamp: timestamp,
+		Actor:     actor,
+		Endpoint:  endpoint,
+		Entities:  entities,
+		Summary:   summary,
+	}
+	if l.test {
+		l.write([]data.AuditLog{auditLog})
+		return
+	}
+	select {
+	case l.queue <- auditLog:
+	default:
+		AuditLogsDroppedTotal.Inc()
+		log.Logger().Warn("drop audit log since the queue is full",
+			zap.String("actor", actor),
+			zap.String("endpoint", endpoint),
+			zap.Strings("entities", entities))
+	}
+}
+
+// run writes queued audit logs in batches.
+func (l *AuditLogger) run() {
+	for auditLog := range l.queue {
+		batch := []data.AuditLog{auditLog}
+	drain:
+		for len(batch) < auditBatchSize {
+			select {
+			case auditLog = <-l.queue:
+				batch = append(batch, auditLog)
+			default:
+				break drain
+			}
+		}
+		l.waitWritable()
+		l.write(batch)
+	}
+}
+
+// waitWritable blocks until writes are enabled. The read-only state is checked periodically in case the callback is
+// missed.
+func (l *AuditLogger) waitWritable() {
+	for l.server.ReadOnlyState().ReadOnly {
+		select {
+		case <-l.writable:
+		case <-time.After(l.server.Config.Server.CacheExpire):
+		}
+	}
+}
+
+func (l *AuditLogger) write(auditLogs []data.AuditLog) {
+	if err := l.server.DataClient.InsertAuditLogs(auditLogs); err != nil {
+		AuditLogsDroppedTotal.Add(float64(len(auditLogs)))
+		log.Logger().Error("failed to write audit logs", zap.Int("n", len(auditLogs)), zap.Error(err))
+	}
+}
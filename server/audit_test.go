@@ -0,0 +1,99 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_AuditLogs(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+
+	// audit logs are disabled by default
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/user").
+		Header("X-API-Key", apiKey).
+		JSON(data.User{UserId: "0"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/item").
+		Header("X-API-Key", apiKey).
+		JSON(Item{ItemId: "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	_, auditLogs, err := s.DataClient.GetAuditLogs("", 10, "", "")
+	assert.NoError(t, err)
+	assert.Empty(t, auditLogs)
+
+	s.Config.Server.Audit.Enable = true
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/users").
+		Header("X-API-Key", apiKey).
+		JSON([]data.User{{UserId: "1"}, {UserId: "2"}}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	hidden := true
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/1").
+		Header("X-API-Key", apiKey).
+		JSON(data.ItemPatch{IsHidden: &hidden}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	// failed calls aren't audited
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/users").
+		Header("X-API-Key", apiKey).
+		Body("[").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	_, auditLogs, err = s.DataClient.GetAuditLogs("", 10, "", "")
+	assert.NoError(t, err)
+	if assert.Len(t, auditLogs, 2) {
+		assert.Equal(t, APIKeyActor(apiKey), auditLogs[0].Actor)
+		assert.Equal(t, "PATCH /api/item/{item-id}", auditLogs[0].Endpoint)
+		assert.Equal(t, []string{"item/1"}, auditLogs[0].Entities)
+		assert.Equal(t, `modify an item {"HiddenReason":"","IsHidden":true}`, auditLogs[0].Summary)
+		assert.Equal(t, APIKeyActor(apiKey), auditLogs[1].Actor)
+		assert.Equal(t, "POST /api/users", auditLogs[1].Endpoint)
+		assert.Equal(t, []string{"user/1", "user/2"}, auditLogs[1].Entities)
+		assert.Equal(t, "insert 2 users", auditLogs[1].Summary)
+	}
+	_, auditLogs, err = s.DataClient.GetAuditLogs("", 10, "user/2", "")
+	assert.NoError(t, err)
+	assert.Len(t, auditLogs, 1)
+}
+
+func TestAPIKeyActor(t *testing.T) {
+	assert.Equal(t, "anonymous", APIKeyActor(""))
+	assert.Equal(t, "api_key/2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", APIKeyActor("hello"))
+}
@@ -19,10 +19,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/emicklei/go-restful/v3"
 	"github.com/go-redis/redis/v8"
 	"github.com/go-resty/resty/v2"
 	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
 	"github.com/stretchr/testify/require"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/config"
@@ -31,13 +33,17 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -983,3 +989,166 @@ func BenchmarkRecommendFromItemBased(b *testing.B) {
 		})
 	}
 }
+
+// runLatencyProxy forwards connections to addr and delays every chunk sent by clients, which injects the round trip
+// latency of the network. Commands in a pipeline are flushed in one chunk and cost one round trip.
+func runLatencyProxy(b *testing.B, addr string, latency time.Duration) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				_ = client.Close()
+				return
+			}
+			go func() {
+				defer server.Close()
+				buf := make([]byte, 64*1024)
+				for {
+					n, err := client.Read(buf)
+					if n > 0 {
+						time.Sleep(latency)
+						if _, err := server.Write(buf[:n]); err != nil {
+							return
+						}
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer client.Close()
+				_, _ = io.Copy(client, server)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// unbatchedCache sends reads of ReadDocuments one by one.
+type unbatchedCache struct {
+	cache.Database
+}
+
+func (c *unbatchedCache) ReadDocuments(reads ...cache.Read) ([]cache.Document, error) {
+	documents := make([]cache.Document, 0, len(reads))
+	for _, read := range reads {
+		document, err := c.Database.ReadDocuments(read)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document...)
+	}
+	return documents, nil
+}
+
+// BenchmarkRecommendRoundTrips compares the p99 latency of recommendation from offline cache with and without
+// batched cache reads, given 1ms round trip latency between the server and the cache store.
+func BenchmarkRecommendRoundTrips(b *testing.B) {
+	for _, batching := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batching=%v", batching), func(b *testing.B) {
+			cacheStoreServer, err := miniredis.Run()
+			require.NoError(b, err)
+			defer cacheStoreServer.Close()
+			dataStoreServer, err := miniredis.Run()
+			require.NoError(b, err)
+			defer dataStoreServer.Close()
+
+			s := &RestServer{}
+			s.Config = config.GetDefaultConfig()
+			cacheClient, err := cache.Open("redis://"+runLatencyProxy(b, cacheStoreServer.Addr(), time.Millisecond), "")
+			require.NoError(b, err)
+			s.CacheClient = cacheClient
+			if !batching {
+				s.CacheClient = &unbatchedCache{Database: cacheClient}
+			}
+			s.DataClient, err = data.Open("redis://"+dataStoreServer.Addr(), "")
+			require.NoError(b, err)
+			s.HiddenItemsManager = &HiddenItemsManager{server: s, hiddenItems: strset.New()}
+			var scores []cache.Scored
+			for i := 0; i < s.Config.Recommend.CacheSize; i++ {
+				scores = append(scores, cache.Scored{Id: strconv.Itoa(i), Score: float64(-i)})
+			}
+			err = cacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), scores)
+			require.NoError(b, err)
+			err = cacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), time.Now()))
+			require.NoError(b, err)
+			recommenders, err := s.FallbackRecommenders()
+			require.NoError(b, err)
+			response := restful.NewResponse(httptest.NewRecorder())
+
+			durations := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				results, err := s.Recommend(response, "0", "", 10, recommenders...)
+				durations = append(durations, time.Since(start))
+				require.NoError(b, err)
+				require.Len(b, results, 10)
+			}
+			b.StopTimer()
+			sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+			b.ReportMetric(float64(durations[len(durations)*99/100].Microseconds())/1000, "p99_ms")
+		})
+	}
+}
+
+// countingCache counts reads of sorted sets.
+type countingCache struct {
+	cache.Database
+	numReads int64
+}
+
+func (c *countingCache) GetSorted(key string, begin, end int) ([]cache.Scored, error) {
+	atomic.AddInt64(&c.numReads, 1)
+	return c.Database.GetSorted(key, begin, end)
+}
+
+// BenchmarkCoalescedReads compares reads sent to the cache store and the cache store QPS while 64 goroutines per CPU
+// read popular items concurrently with and without coalescing, given 1ms round trip latency.
+func BenchmarkCoalescedReads(b *testing.B) {
+	for _, coalescing := range []bool{false, true} {
+		b.Run(fmt.Sprintf("coalescing=%v", coalescing), func(b *testing.B) {
+			cacheStoreServer, err := miniredis.Run()
+			require.NoError(b, err)
+			defer cacheStoreServer.Close()
+
+			s := &RestServer{Settings: config.NewSettings()}
+			if !coalescing {
+				s.Config.Server.CoalesceTimeout = 0
+			}
+			cacheClient, err := cache.Open("redis://"+runLatencyProxy(b, cacheStoreServer.Addr(), time.Millisecond), "")
+			require.NoError(b, err)
+			counter := &countingCache{Database: cacheClient}
+			s.CacheClient = counter
+			var scores []cache.Scored
+			for i := 0; i < s.Config.Recommend.CacheSize; i++ {
+				scores = append(scores, cache.Scored{Id: strconv.Itoa(i), Score: float64(-i)})
+			}
+			err = cacheClient.SetSorted(cache.PopularItems, scores)
+			require.NoError(b, err)
+
+			b.SetParallelism(64)
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					items, err := s.getSortedShared(cache.PopularItems, 0, s.Config.Recommend.CacheSize)
+					require.NoError(b, err)
+					require.Len(b, items, s.Config.Recommend.CacheSize)
+				}
+			})
+			b.StopTimer()
+			numReads := atomic.LoadInt64(&counter.numReads)
+			b.ReportMetric(float64(numReads)/float64(b.N), "cache_reads/op")
+			b.ReportMetric(float64(numReads)/time.Since(start).Seconds(), "cache_qps")
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/model/blend"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+// BlendedItem is normalized components and the blended score of a recommended item.
+type BlendedItem struct {
+	ItemId    string
+	CF        float64
+	CTR       float64
+	Freshness float64
+	Score     float64
+}
+
+// loadBlendWeights loads weights of score blending saved in the cache store. Weights in the configuration are used if
+// none is saved.
+func (s *RestServer) loadBlendWeights() (blend.Weights, error) {
+	value, err := s.CacheClient.Get(cache.BlendWeights).String()
+	if errors.Is(err, errors.NotFound) {
+		return blend.NewWeights(s.Config.Recommend.Blend), nil
+	} else if err != nil {
+		return blend.Weights{}, errors.Trace(err)
+	}
+	return blend.ParseWeights(value)
+}
+
+// Blend re-orders candidates by blended scores if score blending is enabled. Retrieval scores normalized within each
+// stage are used as collaborative filtering scores, and click-through rates are zeros since the click model is only
+// available on workers.
+func (s *RestServer) Blend(ctx *recommendContext) error {
+	if !s.Config.Recommend.Blend.EnableBlend || len(ctx.results) == 0 {
+		return nil
+	}
+	start := time.Now()
+	weights, err := s.loadBlendWeights()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	items, err := s.requireItems(ctx, ctx.results)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// normalize retrieval scores within stages
+	cf := make([]float64, len(ctx.results))
+	stages := make(map[string][]int)
+	for i, itemId := range ctx.results {
+		stages[ctx.sources[itemId]] = append(stages[ctx.sources[itemId]], i)
+	}
+	for _, indices := range stages {
+		scores := make([]float64, len(indices))
+		for j, i := range indices {
+			scores[j] = ctx.scores[ctx.results[i]]
+		}
+		for j, score := range blend.Normalize(scores) {
+			cf[indices[j]] = score
+		}
+	}
+	freshness := make([]float64, len(ctx.results))
+	for i, itemId := range ctx.results {
+		if item := items[itemId]; item != nil {
+			freshness[i] = blend.Freshness(item.Timestamp, start, weights.FreshnessHalfLife)
+		}
+	}
+
+	// re-order candidates by blended scores
+	scores := blend.Blend(weights, len(ctx.results), cf, nil, freshness)
+	candidates := make([]cache.Scored, len(ctx.results))
+	ctx.blendWeights = &weights
+	ctx.blendScores = make(map[string]blend.Scores, len(ctx.results))
+	for i, itemId := range ctx.results {
+		candidates[i] = cache.Scored{Id: itemId, Score: scores[i].Score}
+		ctx.blendScores[itemId] = scores[i]
+	}
+	cache.SortScores(candidates)
+	for i, candidate := range candidates {
+		ctx.results[i] = candidate.Id
+		ctx.scores[candidate.Id] = candidate.Score
+		ctx.sources[candidate.Id] = "blend"
+	}
+	ctx.blendTime = time.Since(start)
+	return nil
+}
+
+// blendedItems returns blended scores of recommended items in the order of results.
+func (ctx *recommendContext) blendedItems() []BlendedItem {
+	var blended []BlendedItem
+	for _, itemId := range ctx.results {
+		if scores, ok := ctx.blendScores[itemId]; ok {
+			blended = append(blended, BlendedItem{
+				ItemId:    itemId,
+				CF:        scores.CF,
+				CTR:       scores.CTR,
+				Freshness: scores.Freshness,
+				Score:     scores.Score,
+			})
+		}
+	}
+	return blended
+}
+
+func (s *RestServer) getBlendWeights(_ *restful.Request, response *restful.Response) {
+	weights, err := s.loadBlendWeights()
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	Ok(response, weights)
+}
+
+func (s *RestServer) setBlendWeights(request *restful.Request, response *restful.Response) {
+	var weights blend.Weights
+	if err := request.ReadEntity(&weights); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if err := weights.Validate(); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	value, err := json.Marshal(weights)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if err = s.CacheClient.Set(cache.String(cache.BlendWeights, string(value))); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	SetAudit(request, "set blend weights "+string(value))
+	Ok(response, Success{RowAffected: 1})
+}
+
+func (s *RestServer) deleteBlendWeights(request *restful.Request, response *restful.Response) {
+	if err := s.CacheClient.Delete(cache.BlendWeights); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	SetAudit(request, "delete blend weights")
+	Ok(response, Success{RowAffected: 1})
+}
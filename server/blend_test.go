@@ -0,0 +1,156 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/model/blend"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_BlendWeights(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// weights in the configuration are returned by default
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/blend-weights").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, blend.NewWeights(s.Config.Recommend.Blend))).
+		End()
+	// set weights
+	weights := blend.Weights{CFWeight: 0.5, CTRWeight: 0, FreshnessWeight: 2, FreshnessHalfLife: time.Hour}
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/blend-weights").
+		Header("X-API-Key", apiKey).
+		JSON(weights).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/blend-weights").
+		Header("X-API-Key", apiKey).
+		JSON(blend.Weights{CFWeight: -1, FreshnessHalfLife: time.Hour}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/blend-weights").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, weights)).
+		End()
+	// reset weights
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/blend-weights").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/blend-weights").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, blend.NewWeights(s.Config.Recommend.Blend))).
+		End()
+}
+
+func TestServer_Blend(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.Blend.EnableBlend = true
+	now := time.Now()
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"1", 99}, {"2", 98}, {"3", 97}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1", Timestamp: now.Add(-10 * time.Hour)},
+		{ItemId: "2", Timestamp: now.Add(-time.Hour)},
+		{ItemId: "3", Timestamp: now},
+	})
+	assert.NoError(t, err)
+
+	// candidates are ranked by retrieval scores without freshness
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+
+	// weights take effect without restarting
+	weights := blend.Weights{CFWeight: 1, FreshnessWeight: 2, FreshnessHalfLife: time.Hour}
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/blend-weights").
+		Header("X-API-Key", apiKey).
+		JSON(weights).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"3", "2", "1"})).
+		End()
+
+	// blended scores are shown in preview
+	response := apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-preview/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	var preview RecommendPreview
+	err = json.NewDecoder(response.Response.Body).Decode(&preview)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3", "2", "1"}, preview.Results)
+	assert.Equal(t, &weights, preview.BlendWeights)
+	if assert.Len(t, preview.Blend, 3) {
+		assert.Equal(t, "3", preview.Blend[0].ItemId)
+		assert.Equal(t, 0.0, preview.Blend[0].CF)
+		assert.Equal(t, 0.0, preview.Blend[0].CTR)
+		assert.InDelta(t, 1, preview.Blend[0].Freshness, 0.01)
+		assert.Equal(t, "1", preview.Blend[2].ItemId)
+		assert.Equal(t, 1.0, preview.Blend[2].CF)
+		assert.InDelta(t, 1, preview.Blend[2].Score, 0.01)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+const (
+	CoalesceSorted    = "sorted"
+	CoalesceNeighbors = "neighbors"
+	CoalesceItemBased = "item_based"
+
+	coalesceLeader  = "leader"
+	coalesceShared  = "shared"
+	coalesceTimeout = "timeout"
+)
+
+// coalesce calls fn once for concurrent calls of the same key, and the result is shared by all callers. Followers
+// waiting longer than the coalesce timeout call fn independently. Shared results must not be modified by callers.
+func (s *RestServer) coalesce(path, key string, fn func() (interface{}, error)) (interface{}, error) {
+	timeout := s.Config.Server.CoalesceTimeout
+	if timeout <= 0 {
+		return fn()
+	}
+	// fn of the leader is called by the group
+	var leader int32
+	ch := s.coalescer.DoChan(coalesceKey(path, key), func() (interface{}, error) {
+		atomic.StoreInt32(&leader, 1)
+		return fn()
+	})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-ch:
+		if atomic.LoadInt32(&leader) == 1 {
+			CoalescedRequestsTotal.WithLabelValues(path, coalesceLeader).Inc()
+		} else {
+			CoalescedRequestsTotal.WithLabelValues(path, coalesceShared).Inc()
+		}
+		return result.Val, result.Err
+	case <-timer.C:
+		if atomic.LoadInt32(&leader) == 1 {
+			// the leader has nobody to fall back to
+			result := <-ch
+			CoalescedRequestsTotal.WithLabelValues(path, coalesceLeader).Inc()
+			return result.Val, result.Err
+		}
+		CoalescedRequestsTotal.WithLabelValues(path, coalesceTimeout).Inc()
+		return fn()
+	}
+}
+
+// getSortedShared gets a sorted set from the cache store. Concurrent reads of the same range are coalesced.
+func (s *RestServer) getSortedShared(key string, begin, end int) ([]cache.Scored, error) {
+	v, err := s.coalesce(CoalesceSorted, coalesceKey(key, strconv.Itoa(begin), strconv.Itoa(end)), func() (interface{}, error) {
+		return s.CacheClient.GetSorted(key, begin, end)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return v.([]cache.Scored), nil
+}
+
+// coalesceKey joins parts of a key. Parts are separated by a byte never found in ids.
+func coalesceKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
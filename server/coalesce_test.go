@@ -0,0 +1,101 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+// runCoalesced calls coalesce concurrently. The leader blocks until all followers are waiting.
+func runCoalesced(s *RestServer, key string, numFollowers int, wait time.Duration) (int32, []interface{}) {
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return key, nil
+	}
+	results := make([]interface{}, numFollowers+1)
+	var wg sync.WaitGroup
+	wg.Add(numFollowers + 1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = s.coalesce(CoalesceSorted, key, fn)
+	}()
+	// wait for the leader
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= numFollowers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = s.coalesce(CoalesceSorted, key, fn)
+		}(i)
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	return calls, results
+}
+
+func TestServer_Coalesce(t *testing.T) {
+	s := &RestServer{Settings: config.NewSettings()}
+	shared := testutil.ToFloat64(CoalescedRequestsTotal.WithLabelValues(CoalesceSorted, coalesceShared))
+
+	// followers share the result of the leader
+	calls, results := runCoalesced(s, "a", 100, 100*time.Millisecond)
+	assert.Equal(t, int32(1), calls)
+	for _, result := range results {
+		assert.Equal(t, "a", result)
+	}
+	assert.Equal(t, shared+100, testutil.ToFloat64(CoalescedRequestsTotal.WithLabelValues(CoalesceSorted, coalesceShared)))
+
+	// followers fall back after the timeout
+	s.Config.Server.CoalesceTimeout = 10 * time.Millisecond
+	calls, results = runCoalesced(s, "b", 10, 100*time.Millisecond)
+	assert.Equal(t, int32(11), calls)
+	for _, result := range results {
+		assert.Equal(t, "b", result)
+	}
+
+	// reads aren't coalesced if the timeout is 0
+	s.Config.Server.CoalesceTimeout = 0
+	calls, _ = runCoalesced(s, "c", 10, 100*time.Millisecond)
+	assert.Equal(t, int32(11), calls)
+}
+
+func TestServer_GetSortedShared(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	scores := []cache.Scored{{"1", 3}, {"2", 2}, {"3", 1}}
+	assert.NoError(t, s.CacheClient.SetSorted(cache.PopularItems, scores))
+	items, err := s.getSortedShared(cache.PopularItems, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, scores, items)
+	items, err = s.getSortedShared(cache.PopularItems, 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, scores[1:2], items)
+	items, err = s.getSortedShared(cache.Key(cache.PopularItems, "unknown"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/bloom"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+// requireConsumedFilter loads the Bloom filter of items consumed by the user once per request. It returns false if
+// the filter doesn't exist or is broken, and consumed items should be excluded by querying feedback of the user.
+func (s *RestServer) requireConsumedFilter(ctx *recommendContext) (bool, error) {
+	if !ctx.consumedLoaded {
+		value, err := s.cacheStore(ctx).Get(cache.Key(cache.ConsumedFilter, ctx.userId)).String()
+		if err == nil {
+			if ctx.consumed, err = bloom.Parse(value); err != nil {
+				log.Logger().Warn("failed to parse consumed filter", log.UserId(ctx.userId), zap.Error(err))
+			} else {
+				ConsumedFilterFalsePositiveRate.Observe(ctx.consumed.FalsePositiveRate())
+			}
+		} else if !errors.Is(err, errors.NotFound) {
+			return false, errors.Trace(err)
+		}
+		ctx.consumedLoaded = true
+	}
+	return ctx.consumed != nil, nil
+}
+
+// updateConsumedFilters adds items of feedback to Bloom filters of users. Filters are only updated if they exist,
+// since filters of other users are built by workers from all feedback of users. Updates lost by concurrent servers are
+// recovered when filters are rebuilt.
+func (s *RestServer) updateConsumedFilters(feedback []data.Feedback) error {
+	userItems := make(map[string][]string)
+	for _, v := range feedback {
+		userItems[v.UserId] = append(userItems[v.UserId], v.ItemId)
+	}
+	for userId, items := range userItems {
+		value, err := s.CacheClient.Get(cache.Key(cache.ConsumedFilter, userId)).String()
+		if errors.Is(err, errors.NotFound) {
+			continue
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		filter, err := bloom.Parse(value)
+		if err != nil {
+			// broken filters are dropped and rebuilt by workers
+			if err = s.CacheClient.Delete(cache.Key(cache.ConsumedFilter, userId)); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		for _, itemId := range items {
+			filter.Add(itemId)
+		}
+		if err = s.CacheClient.Set(cache.String(cache.Key(cache.ConsumedFilter, userId), filter.String())); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/bloom"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_ConsumedFilter(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.ConsumedFilter.EnableConsumedFilter = true
+	s.Config.Recommend.Online.FallbackRecommend = []string{"latest"}
+	err := s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{
+		{Id: "1", Score: 4},
+		{Id: "2", Score: 3},
+		{Id: "3", Score: 2},
+		{Id: "4", Score: 1},
+	})
+	assert.NoError(t, err)
+	// both users consumed item 1
+	err = s.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: time.Now().Add(-time.Hour)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "1", ItemId: "1"}, Timestamp: time.Now().Add(-time.Hour)},
+	}, true, true, true)
+	assert.NoError(t, err)
+	// the filter of user 0 only contains item 2
+	filter := bloom.New(64, 3)
+	filter.Add("2")
+	err = s.CacheClient.Set(cache.String(cache.Key(cache.ConsumedFilter, "0"), filter.String()))
+	assert.NoError(t, err)
+
+	// items are excluded by the filter instead of feedback
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "3"})).
+		End()
+	// feedback is queried if the filter is missing
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/1").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"2", "3"})).
+		End()
+
+	// inserted feedback is added to existing filters
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "3"}, Timestamp: time.Now().Add(-time.Minute).Format(time.RFC3339)},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "1", ItemId: "3"}, Timestamp: time.Now().Add(-time.Minute).Format(time.RFC3339)},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 2}`).
+		End()
+	value, err := s.CacheClient.Get(cache.Key(cache.ConsumedFilter, "0")).String()
+	assert.NoError(t, err)
+	filter, err = bloom.Parse(value)
+	assert.NoError(t, err)
+	assert.True(t, filter.Has("2"))
+	assert.True(t, filter.Has("3"))
+	assert.Equal(t, 2, filter.Count())
+	_, err = s.CacheClient.Get(cache.Key(cache.ConsumedFilter, "1")).String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
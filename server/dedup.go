@@ -0,0 +1,93 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"go.uber.org/zap"
+)
+
+// DuplicatesManager keeps clusters of near-duplicate items in memory and reloads them from the data store
+// periodically.
+type DuplicatesManager struct {
+	server   *RestServer
+	mu       sync.RWMutex
+	clusters map[string][]string // members of the cluster of each item
+	test     bool
+}
+
+func NewDuplicatesManager(s *RestServer) *DuplicatesManager {
+	dm := &DuplicatesManager{server: s}
+	go func() {
+		for {
+			dm.sync()
+			log.Logger().Debug("refresh server side duplicate items", zap.String("cache_expire", s.Config.Server.CacheExpire.String()))
+			time.Sleep(s.Config.Server.CacheExpire)
+		}
+	}()
+	return dm
+}
+
+func newDuplicatesManagerForTest(s *RestServer) *DuplicatesManager {
+	return &DuplicatesManager{server: s, test: true}
+}
+
+func (dm *DuplicatesManager) sync() {
+	clusters := make(map[string][]string)
+	if dm.server.Config.Recommend.Dedup.EnableDedup {
+		canonicals, err := dm.server.DataClient.GetItemCanonicals()
+		if err != nil {
+			if !errors.Is(err, errors.NotAssigned) {
+				log.Logger().Error("failed to load duplicate items", zap.Error(err))
+			}
+			return
+		}
+		members := make(map[string][]string)
+		for _, canonical := range canonicals {
+			members[canonical.CanonicalId] = append(members[canonical.CanonicalId], canonical.ItemId)
+		}
+		for canonicalId, itemIds := range members {
+			cluster := append([]string{canonicalId}, itemIds...)
+			for _, itemId := range cluster {
+				clusters[itemId] = cluster
+			}
+		}
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.clusters = clusters
+}
+
+// Clusters returns members of the cluster of each item. Items without duplicates are absent. The returned map must
+// not be modified.
+func (dm *DuplicatesManager) Clusters() map[string][]string {
+	if dm.test {
+		dm.sync()
+	}
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.clusters
+}
+
+// excludeDuplicates excludes other members of the cluster of an item from recommendation.
+func (ctx *recommendContext) excludeDuplicates(itemIds ...string) {
+	for _, itemId := range itemIds {
+		ctx.excludeSet.Add(ctx.duplicates[itemId]...)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_GetRecommends_Duplicates(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert recommendation
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+	})
+	assert.NoError(t, err)
+	// insert canonical items
+	err = s.DataClient.BatchInsertItemCanonicals([]data.ItemCanonical{
+		{ItemId: "1", CanonicalId: "0"},
+		{ItemId: "2", CanonicalId: "0"},
+		{ItemId: "4", CanonicalId: "3"},
+	})
+	assert.NoError(t, err)
+	// duplicates are recommended if duplicate detection is disabled
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+	// at most one item of each cluster is recommended
+	s.Config.Recommend.Dedup.EnableDedup = true
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "3", "5"})).
+		End()
+}
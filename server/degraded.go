@@ -0,0 +1,184 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+// HeaderDegraded marks recommendation served while the cache store is down. The value is the source of served items,
+// which is stale or fallback.
+const HeaderDegraded = "X-Degraded"
+
+const (
+	degradedStale    = "stale"
+	degradedFallback = "fallback"
+)
+
+// DegradedCache keeps recommendation lists served recently in process, which are served while the cache store is
+// down. Lists are kept for each user and category in LRU order. Latest and popular items of each category are kept as
+// fallback for users without kept lists.
+type DegradedCache struct {
+	server *RestServer
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	fallback map[string]degradedFallbackEntry
+}
+
+type degradedEntry struct {
+	key   string
+	items []string
+}
+
+type degradedFallbackEntry struct {
+	items      []string
+	updateTime time.Time
+}
+
+// NewDegradedCache creates an empty DegradedCache.
+func NewDegradedCache(s *RestServer) *DegradedCache {
+	return &DegradedCache{
+		server:   s,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		fallback: make(map[string]degradedFallbackEntry),
+	}
+}
+
+// Put keeps a list served to a user. The least recently served lists are evicted beyond the cache size.
+func (c *DegradedCache) Put(userId, category string, items []string) {
+	key := cache.Key(userId, category)
+	items = append([]string(nil), items...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exist := c.entries[key]; exist {
+		element.Value.(*degradedEntry).items = items
+		c.lru.MoveToFront(element)
+	} else {
+		c.entries[key] = c.lru.PushFront(&degradedEntry{key: key, items: items})
+	}
+	for c.lru.Len() > c.server.Config.Server.Degraded.CacheSize {
+		entry := c.lru.Remove(c.lru.Back()).(*degradedEntry)
+		delete(c.entries, entry.key)
+	}
+}
+
+// Get returns the list served to a user recently.
+func (c *DegradedCache) Get(userId, category string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, exist := c.entries[cache.Key(userId, category)]
+	if !exist {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*degradedEntry).items, true
+}
+
+// Fallback returns latest items followed by popular items of a category.
+func (c *DegradedCache) Fallback(category string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fallback[category].items
+}
+
+// RefreshFallback reloads latest and popular items of a category from the cache store if they are older than the
+// server-side cache expire time.
+func (c *DegradedCache) RefreshFallback(category string) error {
+	c.mu.Lock()
+	entry, exist := c.fallback[category]
+	c.mu.Unlock()
+	if exist && time.Since(entry.updateTime) < c.server.Config.Server.CacheExpire {
+		return nil
+	}
+	latest, err := c.server.CacheClient.GetSorted(cache.Key(cache.LatestItems, category), 0, c.server.Config.Recommend.CacheSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	popular, err := c.server.CacheClient.GetSorted(cache.Key(cache.PopularItems, category), 0, c.server.Config.Recommend.CacheSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	itemSet := strset.New()
+	var items []string
+	for _, item := range append(latest, popular...) {
+		if !itemSet.Has(item.Id) {
+			itemSet.Add(item.Id)
+			items = append(items, item.Id)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fallback[category] = degradedFallbackEntry{items: items, updateTime: time.Now()}
+	return nil
+}
+
+// keepDegraded keeps a recommendation list served successfully for degraded serving.
+func (s *RestServer) keepDegraded(userId, category string, items []string) {
+	if !s.Config.Server.Degraded.Enable || s.DegradedCache == nil {
+		return
+	}
+	s.DegradedCache.Put(userId, category, items)
+	if err := s.DegradedCache.RefreshFallback(category); err != nil {
+		log.Logger().Warn("failed to refresh fallback of degraded recommendation", zap.Error(err))
+	}
+}
+
+// cacheFailing returns true if an error is caused by the cache store being down.
+func (s *RestServer) cacheFailing(err error) bool {
+	if errors.Is(err, cache.ErrCircuitOpen) {
+		return true
+	}
+	return s.cacheBreaker != nil && s.cacheBreaker.Failing()
+}
+
+// serveDegraded serves recommendation kept in process if the cache store is down. It returns false if there is
+// nothing to serve, and the error should be returned.
+func (s *RestServer) serveDegraded(response *restful.Response, userId, category string, n, offset int, err error) bool {
+	if !s.Config.Server.Degraded.Enable || s.DegradedCache == nil || !s.cacheFailing(err) {
+		return false
+	}
+	source := degradedStale
+	items, exist := s.DegradedCache.Get(userId, category)
+	if !exist {
+		source = degradedFallback
+		items = s.DegradedCache.Fallback(category)
+	}
+	if len(items) == 0 {
+		return false
+	}
+	items = items[lo.Min([]int{offset, len(items)}):]
+	if len(items) > n {
+		items = items[:n]
+	}
+	log.ResponseLogger(response).Warn("serve degraded recommendation since the cache store is down",
+		log.UserId(userId), zap.String("source", source), zap.Error(err))
+	DegradedServedTotal.WithLabelValues(source).Inc()
+	response.AddHeader(HeaderDegraded, source)
+	Ok(response, items)
+	return true
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+func TestDegradedCache(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.Degraded.CacheSize = 2
+	c := NewDegradedCache(&s.RestServer)
+	c.Put("0", "", []string{"1"})
+	c.Put("1", "", []string{"2"})
+	_, exist := c.Get("0", "")
+	assert.True(t, exist)
+	// the least recently served list is evicted
+	c.Put("2", "", []string{"3"})
+	_, exist = c.Get("1", "")
+	assert.False(t, exist)
+	items, exist := c.Get("0", "")
+	assert.True(t, exist)
+	assert.Equal(t, []string{"1"}, items)
+	items, exist = c.Get("2", "")
+	assert.True(t, exist)
+	assert.Equal(t, []string{"3"}, items)
+	// lists are kept by categories
+	_, exist = c.Get("0", "a")
+	assert.False(t, exist)
+
+	// latest items are followed by popular items
+	err := s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{{Id: "1", Score: 2}, {Id: "2", Score: 1}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.PopularItems, ""), []cache.Scored{{Id: "2", Score: 2}, {Id: "3", Score: 1}})
+	assert.NoError(t, err)
+	err = c.RefreshFallback("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, c.Fallback(""))
+	assert.Empty(t, c.Fallback("a"))
+}
+
+func TestServer_Degraded(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.Degraded.Enable = true
+	s.DegradedCache = NewDegradedCache(&s.RestServer)
+	s.cacheBreaker = cache.NewCircuitBreaker(s.CacheClient, 1, 10*time.Millisecond)
+	s.CacheClient = s.cacheBreaker
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 3},
+		{Id: "2", Score: 2},
+		{Id: "3", Score: 1},
+	})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{{Id: "4", Score: 1}})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		HeaderNotPresent(HeaderDegraded).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+
+	// serve stale recommendation while the cache store is down
+	s.cacheStoreServer.Close()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "offset": "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Header(HeaderDegraded, degradedStale).
+		Body(marshal(t, []string{"2", "3"})).
+		End()
+	assert.True(t, s.cacheBreaker.IsOpen())
+	// serve latest items to users without stale recommendation
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/1").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Header(HeaderDegraded, degradedFallback).
+		Body(marshal(t, []string{"4"})).
+		End()
+
+	// recover once the cache store returns
+	err = s.cacheStoreServer.Restart()
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		HeaderNotPresent(HeaderDegraded).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+	assert.False(t, s.cacheBreaker.IsOpen())
+}
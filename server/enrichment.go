@@ -0,0 +1,270 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+const (
+	EnrichmentPending  = "pending"
+	EnrichmentEnriched = "enriched"
+	EnrichmentFailed   = "failed"
+	EnrichmentDropped  = "dropped"
+
+	enrichmentQueueSize = 10000
+	enrichmentBackoff   = time.Second
+)
+
+// EnrichmentRequest is posted to the enrichment endpoint in JSON.
+type EnrichmentRequest struct {
+	ItemIds []string
+}
+
+// EnrichedItem is the metadata of an item responded by the enrichment endpoint, which patches the item.
+type EnrichedItem struct {
+	ItemId string
+	data.ItemPatch
+}
+
+// EnrichmentCounts are numbers of items created automatically by feedback in each enrichment status.
+type EnrichmentCounts struct {
+	Pending  int
+	Enriched int
+	Failed   int
+}
+
+// ItemEnricher fills in metadata of items created automatically by feedback. New items are queued and posted to the
+// enrichment endpoint in batches by a background worker, and responses patch these items. Items are dropped if the
+// queue is full, so that insertions of feedback are never blocked. Enrichment status of items is kept in the cache
+// store.
+type ItemEnricher struct {
+	server      *RestServer
+	client      *http.Client
+	queue       chan string
+	backoff     time.Duration
+	lastRequest time.Time
+	test        bool
+}
+
+func NewItemEnricher(s *RestServer) *ItemEnricher {
+	e := &ItemEnricher{
+		server:  s,
+		client:  &http.Client{},
+		queue:   make(chan string, enrichmentQueueSize),
+		backoff: enrichmentBackoff,
+	}
+	go e.run()
+	return e
+}
+
+func newItemEnricherForTest(s *RestServer) *ItemEnricher {
+	return &ItemEnricher{server: s, client: &http.Client{}, backoff: time.Millisecond, test: true}
+}
+
+func (e *ItemEnricher) enabled() bool {
+	return e != nil && e.server.Config.Server.Enrichment.URL != ""
+}
+
+// newItems returns items of feedback not existing in the data store. Failures are logged and no item is returned.
+func (e *ItemEnricher) newItems(feedback []data.Feedback) []string {
+	itemIds := strset.New()
+	for _, f := range feedback {
+		itemIds.Add(f.ItemId)
+	}
+	_, newItemIds, err := e.server.DataClient.BatchGetItems(itemIds.List())
+	if err != nil {
+		log.Logger().Error("failed to find new items to enrich", zap.Error(err))
+		return nil
+	}
+	return newItemIds
+}
+
+// Enqueue marks items as pending and queues them for enrichment. Items are marked as failed if the queue is full.
+func (e *ItemEnricher) Enqueue(itemIds []string) {
+	if len(itemIds) == 0 || !e.enabled() {
+		return
+	}
+	if err := e.setStatus(EnrichmentPending, itemIds); err != nil {
+		log.Logger().Error("failed to mark items as pending to enrich", zap.Error(err))
+	}
+	if e.test {
+		e.enrich(itemIds)
+		return
+	}
+	for i, itemId := range itemIds {
+		select {
+		case e.queue <- itemId:
+		default:
+			dropped := itemIds[i:]
+			EnrichedItemsTotal.WithLabelValues(EnrichmentDropped).Add(float64(len(dropped)))
+			log.Logger().Warn("drop items to enrich since the queue is full", zap.Int("n", len(dropped)))
+			if err := e.setStatus(EnrichmentFailed, dropped); err != nil {
+				log.Logger().Error("failed to mark items as failed to enrich", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// run enriches queued items in batches.
+func (e *ItemEnricher) run() {
+	for itemId := range e.queue {
+		batch := []string{itemId}
+	collect:
+		for len(batch) < e.server.Config.Server.Enrichment.BatchSize {
+			select {
+			case itemId = <-e.queue:
+				batch = append(batch, itemId)
+			default:
+				break collect
+			}
+		}
+		e.enrich(batch)
+	}
+}
+
+// enrich requests metadata of items with retries and patches items by responses. Items absent from responses are
+// marked as failed.
+func (e *ItemEnricher) enrich(itemIds []string) {
+	var (
+		items []EnrichedItem
+		err   error
+	)
+	maxRetries := e.server.Config.Server.Enrichment.MaxRetries
+	for attempt := 1; attempt <= maxRetries+1; attempt++ {
+		if attempt > 1 {
+			time.Sleep(e.backoff * time.Duration(math.Pow(2, float64(attempt-2))))
+		}
+		if items, err = e.request(itemIds); err == nil {
+			break
+		}
+		log.Logger().Warn("failed to request metadata of items",
+			zap.Int("n", len(itemIds)), zap.Int("attempt", attempt), zap.Error(err))
+	}
+	pending := strset.New(itemIds...)
+	var enriched []string
+	if err == nil {
+		for _, item := range items {
+			// items not requested are ignored
+			if !pending.Has(item.ItemId) {
+				continue
+			}
+			if err := e.server.patchItem(item.ItemId, item.ItemPatch); err != nil {
+				log.Logger().Error("failed to patch enriched item", zap.String("item_id", item.ItemId), zap.Error(err))
+				continue
+			}
+			pending.Remove(item.ItemId)
+			enriched = append(enriched, item.ItemId)
+		}
+	}
+	failed := pending.List()
+	EnrichedItemsTotal.WithLabelValues(EnrichmentEnriched).Add(float64(len(enriched)))
+	EnrichedItemsTotal.WithLabelValues(EnrichmentFailed).Add(float64(len(failed)))
+	if err := e.setStatus(EnrichmentEnriched, enriched); err != nil {
+		log.Logger().Error("failed to mark items as enriched", zap.Error(err))
+	}
+	if err := e.setStatus(EnrichmentFailed, failed); err != nil {
+		log.Logger().Error("failed to mark items as failed to enrich", zap.Error(err))
+	}
+}
+
+// request posts items to the enrichment endpoint. Requests are rate-limited.
+func (e *ItemEnricher) request(itemIds []string) ([]EnrichedItem, error) {
+	cfg := e.server.Config.Server.Enrichment
+	if cfg.RateLimit > 0 {
+		time.Sleep(time.Until(e.lastRequest.Add(time.Duration(float64(time.Second) / cfg.RateLimit))))
+	}
+	e.lastRequest = time.Now()
+	body, err := json.Marshal(EnrichmentRequest{ItemIds: itemIds})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.APIKey != "" {
+		req.Header.Set("X-API-Key", cfg.APIKey)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var items []EnrichedItem
+	if err = json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return items, nil
+}
+
+// setStatus moves items into the sorted set of an enrichment status.
+func (e *ItemEnricher) setStatus(status string, itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
+	}
+	timestamp := float64(time.Now().Unix())
+	scores := make([]cache.Scored, len(itemIds))
+	var members []cache.SetMember
+	for i, itemId := range itemIds {
+		scores[i] = cache.Scored{Id: itemId, Score: timestamp}
+		for _, other := range []string{EnrichmentPending, EnrichmentEnriched, EnrichmentFailed} {
+			if other != status {
+				members = append(members, cache.Member(cache.Key(cache.ItemEnrichment, other), itemId))
+			}
+		}
+	}
+	if err := e.server.CacheClient.RemSorted(members...); err != nil {
+		return errors.Trace(err)
+	}
+	return e.server.CacheClient.AddSorted(cache.Sorted(cache.Key(cache.ItemEnrichment, status), scores))
+}
+
+// GetEnrichmentCounts returns numbers of items created automatically by feedback in each enrichment status.
+func GetEnrichmentCounts(cacheClient cache.Database) (EnrichmentCounts, error) {
+	var counts EnrichmentCounts
+	for status, count := range map[string]*int{
+		EnrichmentPending:  &counts.Pending,
+		EnrichmentEnriched: &counts.Enriched,
+		EnrichmentFailed:   &counts.Failed,
+	} {
+		items, err := cacheClient.GetSorted(cache.Key(cache.ItemEnrichment, status), 0, -1)
+		if err != nil {
+			return EnrichmentCounts{}, errors.Trace(err)
+		}
+		*count = len(items)
+	}
+	return counts, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestItemEnricher(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.AutoInsertItem = true
+	var requests int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-API-Key"))
+		// the first request fails
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var request EnrichmentRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.ElementsMatch(t, []string{"1", "2"}, request.ItemIds)
+		// the metadata of item 2 is missing
+		assert.NoError(t, json.NewEncoder(w).Encode([]EnrichedItem{
+			{ItemId: "1", ItemPatch: data.ItemPatch{Labels: []string{"a"}, Categories: []string{"b"}}},
+			{ItemId: "3", ItemPatch: data.ItemPatch{Labels: []string{"a"}}},
+		}))
+	}))
+	defer endpoint.Close()
+	s.Config.Server.Enrichment.URL = endpoint.URL
+	s.Config.Server.Enrichment.APIKey = "secret"
+	s.Config.Server.Enrichment.RateLimit = 0
+
+	// existing items aren't enriched
+	assert.NoError(t, s.DataClient.BatchInsertItems([]data.Item{{ItemId: "0"}}))
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: time.Now()},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "1"}, Timestamp: time.Now()},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "2"}, Timestamp: time.Now()},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.Equal(t, int32(2), requests)
+	item, err := s.DataClient.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, item.Labels)
+	assert.Equal(t, []string{"b"}, item.Categories)
+	_, err = s.DataClient.GetItem("3")
+	assert.Error(t, err)
+	counts, err := GetEnrichmentCounts(s.CacheClient)
+	assert.NoError(t, err)
+	assert.Equal(t, EnrichmentCounts{Enriched: 1, Failed: 1}, counts)
+
+	// failures of the endpoint never block feedback
+	s.Config.Server.Enrichment.URL = "http://127.0.0.1:0"
+	s.Config.Server.Enrichment.MaxRetries = 1
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "4"}, Timestamp: time.Now()},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	counts, err = GetEnrichmentCounts(s.CacheClient)
+	assert.NoError(t, err)
+	assert.Equal(t, EnrichmentCounts{Enriched: 1, Failed: 2}, counts)
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/emicklei/go-restful/v3"
+)
+
+// etagResponseRecorder buffers the status code and the body of a response, so that the body can be replaced by 304 Not
+// Modified.
+type etagResponseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *etagResponseRecorder) WriteHeader(int) {}
+
+func (r *etagResponseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// ETagFilter tags responses of shared data, such as popular items, by hashes of bodies. Responses are replaced by 304
+// Not Modified if tags match If-None-Match. Responses scoped to a user by the user-id query parameter are private.
+func (s *RestServer) ETagFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	s.etag(req, resp, chain, req.QueryParameter("user-id"))
+}
+
+// PrivateETagFilter tags responses of per-user data, such as recommendation, by hashes of user ids and bodies.
+// Responses are private so that they are never cached by shared caches.
+func (s *RestServer) PrivateETagFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	s.etag(req, resp, chain, req.PathParameter("user-id"))
+}
+
+func (s *RestServer) etag(req *restful.Request, resp *restful.Response, chain *restful.FilterChain, userId string) {
+	writer := resp.ResponseWriter
+	recorder := &etagResponseRecorder{ResponseWriter: writer}
+	resp.ResponseWriter = recorder
+	chain.ProcessFilter(req, resp)
+	resp.ResponseWriter = writer
+	// the content length has been counted by the response
+	if resp.StatusCode() != http.StatusOK {
+		resp.WriteHeader(resp.StatusCode())
+		_, _ = writer.Write(recorder.body.Bytes())
+		return
+	}
+	scope := "public"
+	if userId != "" {
+		scope = "private"
+	}
+	tag := etag(userId, recorder.body.Bytes())
+	resp.Header().Set("ETag", tag)
+	resp.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int(s.Config.Server.CacheControlMaxAge.Seconds())))
+	if etagMatch(req.HeaderParameter("If-None-Match"), tag) {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(recorder.body.Bytes())
+}
+
+// etag returns the strong entity tag of a body in the scope of a user.
+func etag(userId string, body []byte) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(userId))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(body)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// etagMatch returns true if an entity tag is in the list of If-None-Match. Weak comparison is used.
+func etagMatch(ifNoneMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// versionTag returns the entity tag of a version of an item or a user.
+func versionTag(version string) string {
+	return `"` + version + `"`
+}
+
+// ifMatchVersion returns the version of an item or a user in If-Match. Only the first entity tag is used, and empty is
+// returned if If-Match is absent or matches any version.
+func ifMatchVersion(ifMatch string) string {
+	tag := strings.TrimPrefix(strings.TrimSpace(strings.Split(ifMatch, ",")[0]), "W/")
+	if tag == "*" {
+		return ""
+	}
+	return strings.Trim(tag, `"`)
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+func (s *mockServer) conditionalGet(t *testing.T, url, ifNoneMatch string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+	if ifNoneMatch != "" {
+		request.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestServer_ETag(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.CacheControlMaxAge = 10 * time.Second
+	assert.NoError(t, s.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"1", 2}, {"2", 1}}))
+
+	// responses are tagged
+	recorder := s.conditionalGet(t, "/api/popular", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []cache.Scored{{"1", 2}, {"2", 1}}), recorder.Body.String())
+	assert.Equal(t, "public, max-age=10", recorder.Header().Get("Cache-Control"))
+	tag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, tag)
+
+	// responses are not modified
+	recorder = s.conditionalGet(t, "/api/popular", tag)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Empty(t, recorder.Body.String())
+	assert.Equal(t, tag, recorder.Header().Get("ETag"))
+	recorder = s.conditionalGet(t, "/api/popular", `"0000000000000000", W/`+tag)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+
+	// responses are modified
+	assert.NoError(t, s.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"1", 2}, {"3", 1}}))
+	recorder = s.conditionalGet(t, "/api/popular", tag)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []cache.Scored{{"1", 2}, {"3", 1}}), recorder.Body.String())
+	assert.NotEqual(t, tag, recorder.Header().Get("ETag"))
+
+	// errors are not tagged
+	recorder = s.conditionalGet(t, "/api/popular?n=x", tag)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.NotEmpty(t, recorder.Body.String())
+	assert.Empty(t, recorder.Header().Get("ETag"))
+}
+
+func TestServer_PrivateETag(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+
+	// tags of users are different for the same body
+	recorder := s.conditionalGet(t, "/api/user/0/neighbors/", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "private, max-age=0", recorder.Header().Get("Cache-Control"))
+	tag := recorder.Header().Get("ETag")
+	recorder = s.conditionalGet(t, "/api/user/1/neighbors/", tag)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "private, max-age=0", recorder.Header().Get("Cache-Control"))
+	assert.NotEqual(t, tag, recorder.Header().Get("ETag"))
+	recorder = s.conditionalGet(t, "/api/user/0/neighbors/", tag)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+}
+
+func TestETagMatch(t *testing.T) {
+	assert.True(t, etagMatch(`"a"`, `"a"`))
+	assert.True(t, etagMatch(`W/"a"`, `"a"`))
+	assert.True(t, etagMatch(`"b", "a"`, `"a"`))
+	assert.True(t, etagMatch(`*`, `"a"`))
+	assert.False(t, etagMatch(``, `"a"`))
+	assert.False(t, etagMatch(`"b"`, `"a"`))
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/araddon/dateparse"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportBatchSize is the number of rows read from the data store and flushed at a time by an export.
+const exportBatchSize = 1000
+
+// userExportFields are columns of exported users. Columns of exported items and feedback are the same as fields of
+// imports, so that exported files could be imported directly.
+var userExportFields = []string{"user_id", "labels", "subscribe", "comment"}
+
+// exportWriter writes rows of an export as csv or json lines. Rows are compressed by gzip if the client accepts it.
+type exportWriter struct {
+	response *restful.Response
+	writer   io.Writer
+	gzip     *gzip.Writer
+	format   string
+}
+
+// parseExportFormat parses the format of an export: csv (default) or jsonl.
+func parseExportFormat(request *restful.Request) (string, error) {
+	switch format := request.QueryParameter("format"); format {
+	case "", "csv":
+		return "csv", nil
+	case "jsonl":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format `%v`", format)
+	}
+}
+
+func newExportWriter(request *restful.Request, response *restful.Response, format, name string, fields []string) (*exportWriter, error) {
+	w := &exportWriter{response: response, writer: response, format: format}
+	if format == "csv" {
+		response.Header().Set("Content-Type", "text/csv")
+	} else {
+		response.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s.%s", name, format))
+	if strings.Contains(request.HeaderParameter("Accept-Encoding"), "gzip") {
+		response.Header().Set("Content-Encoding", "gzip")
+		w.gzip = gzip.NewWriter(response)
+		w.writer = w.gzip
+	}
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.WriteHeader(http.StatusOK)
+	if format == "csv" {
+		if err := w.writeRecord(fields); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return w, nil
+}
+
+func (w *exportWriter) writeRecord(record []string) error {
+	for i := range record {
+		record[i] = base.Escape(record[i])
+	}
+	_, err := io.WriteString(w.writer, strings.Join(record, ",")+"\r\n")
+	return err
+}
+
+// write writes a row. The record is written for csv and the value is written for json lines.
+func (w *exportWriter) write(record []string, value any) error {
+	if w.format == "csv" {
+		return w.writeRecord(record)
+	}
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = w.writer.Write(append(buf, '\n'))
+	return err
+}
+
+// flush sends written rows to the client as a chunk.
+func (w *exportWriter) flush() error {
+	if w.gzip != nil {
+		if err := w.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+	w.response.Flush()
+	return nil
+}
+
+func (w *exportWriter) close() error {
+	if w.gzip != nil {
+		if err := w.gzip.Close(); err != nil {
+			return err
+		}
+	}
+	w.response.Flush()
+	return nil
+}
+
+func formatExportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// formatExportContext formats the context of feedback as a JSON object. Feedback without context is exported as empty.
+func formatExportContext(feedbackContext map[string]string) string {
+	if len(feedbackContext) == 0 {
+		return ""
+	}
+	buf, _ := json.Marshal(feedbackContext)
+	return string(buf)
+}
+
+// exportRows streams batches to the client. Errors after the header has been sent can't be reported by status codes,
+// so they are logged and the response is truncated.
+func exportRows[T any](request *restful.Request, response *restful.Response, format, name string, fields []string,
+	rows chan []T, errs chan error, toRecord func(T) []string, filter func(T) bool) {
+	defer func() {
+		// drain the stream so that the producer exits
+		for range rows {
+		}
+	}()
+	w, err := newExportWriter(request, response, format, name, fields)
+	if err != nil {
+		log.ResponseLogger(response).Error("failed to write header", zap.String("name", name), zap.Error(err))
+		return
+	}
+	count := 0
+	for batch := range rows {
+		for _, row := range batch {
+			if filter != nil && !filter(row) {
+				continue
+			}
+			if err = w.write(toRecord(row), row); err != nil {
+				log.ResponseLogger(response).Error("failed to export rows", zap.String("name", name), zap.Error(err))
+				return
+			}
+			count++
+		}
+		if err = w.flush(); err != nil {
+			log.ResponseLogger(response).Error("failed to flush rows", zap.String("name", name), zap.Error(err))
+			return
+		}
+	}
+	if err = <-errs; err != nil {
+		log.ResponseLogger(response).Error("failed to read rows", zap.String("name", name), zap.Error(err))
+		return
+	}
+	if err = w.close(); err != nil {
+		log.ResponseLogger(response).Error("failed to close export", zap.String("name", name), zap.Error(err))
+		return
+	}
+	log.ResponseLogger(response).Info("export rows", zap.String("name", name), zap.Int("num_rows", count))
+}
+
+func (s *RestServer) exportUsers(request *restful.Request, response *restful.Response) {
+	format, err := parseExportFormat(request)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	users, errs := s.DataClient.GetUserStream(exportBatchSize)
+	exportRows(request, response, format, "users", userExportFields, users, errs, func(user data.User) []string {
+		return []string{user.UserId, strings.Join(user.Labels, "|"), strings.Join(user.Subscribe, "|"), user.Comment}
+	}, nil)
+}
+
+func (s *RestServer) exportItems(request *restful.Request, response *restful.Response) {
+	format, err := parseExportFormat(request)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	items, errs := s.DataClient.GetItemStream(exportBatchSize, nil)
+	exportRows(request, response, format, "items", itemImportFields, items, errs, func(item data.Item) []string {
+		return []string{
+			item.ItemId,
+			strconv.FormatBool(item.IsHidden),
+			strings.Join(item.Categories, "|"),
+			item.Timestamp.Format(time.RFC3339),
+			strings.Join(item.Labels, "|"),
+			item.Comment,
+			formatExportTime(item.VisibleFrom),
+			formatExportTime(item.VisibleUntil),
+		}
+	}, nil)
+}
+
+func (s *RestServer) exportFeedback(request *restful.Request, response *restful.Response) {
+	format, err := parseExportFormat(request)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	var since, until *time.Time
+	for name, bound := range map[string]**time.Time{"since": &since, "until": &until} {
+		if text := request.QueryParameter(name); text != "" {
+			t, err := dateparse.ParseAny(text)
+			if err != nil {
+				BadRequest(response, err)
+				return
+			}
+			*bound = &t
+		}
+	}
+	feedback, errs := s.DataClient.GetFeedbackStream(exportBatchSize, since, request.QueryParameters("feedback-type")...)
+	exportRows(request, response, format, "feedback", feedbackImportFields, feedback, errs, func(v data.Feedback) []string {
+		return []string{v.FeedbackType, v.UserId, v.ItemId, v.Timestamp.Format(time.RFC3339), v.Comment, formatExportContext(v.Context)}
+	}, func(v data.Feedback) bool {
+		return until == nil || v.Timestamp.Before(*until)
+	})
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+const (
+	historyQueueSize = 10000
+	historyBatchSize = 1000
+)
+
+// historyTagHeaders are response headers of recommendation archived as provenance of snapshots.
+var historyTagHeaders = []string{
+	HeaderRecommendFreshness,
+	HeaderExploredItems,
+	HeaderBudgetTruncated,
+	HeaderRankingGeneration,
+}
+
+// historySampleBuckets is the number of buckets users are hashed into for sampling.
+const historySampleBuckets = 1000000
+
+// IsHistoryUser returns true if served recommendation of a user is archived. Users are sampled by the hash of user
+// IDs, so that every server archives recommendation of the same users.
+func IsHistoryUser(userId string, ratio float64) bool {
+	if ratio <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(userId))
+	// low bits of FNV hashes are mixed well even if user IDs differ in the last character
+	return float64(h.Sum64()%historySampleBuckets)/historySampleBuckets < ratio
+}
+
+// HistoryArchiver archives served recommendation of sampled users to the data store in the background. Snapshots are
+// keyed by users and beginnings of time buckets, so that the latest recommendation in a time bucket is kept. Snapshots
+// are queued in a bounded queue and dropped if the queue is full, so that recommendation is never blocked by the data
+// store. Writes are paused in read-only mode.
+type HistoryArchiver struct {
+	server   *RestServer
+	queue    chan data.RecommendSnapshot
+	writable chan struct{}
+	test     bool
+}
+
+func NewHistoryArchiver(s *RestServer) *HistoryArchiver {
+	a := &HistoryArchiver{server: s, queue: make(chan data.RecommendSnapshot, historyQueueSize), writable: make(chan struct{}, 1)}
+	if s.ReadOnlyManager != nil {
+		s.ReadOnlyManager.OnWritable(func() {
+			select {
+			case a.writable <- struct{}{}:
+			default:
+			}
+		})
+	}
+	go a.run()
+	return a
+}
+
+func newHistoryArchiverForTest(s *RestServer) *HistoryArchiver {
+	return &HistoryArchiver{server: s, test: true}
+}
+
+// Archive archives recommendation served to a user if the user is sampled. Provenance is read from headers of the
+// response.
+func (a *HistoryArchiver) Archive(response *restful.Response, userId, category string, items []string) {
+	if !IsHistoryUser(userId, a.server.Config.Server.History.SampleRatio) {
+		return
+	}
+	tags := make(map[string]string)
+	for _, header := range historyTagHeaders {
+		if value := response.Header().Get(header); value != "" {
+			tags[header] = value
+		}
+	}
+	snapshot := data.RecommendSnapshot{
+		UserId:    userId,
+		Category:  category,
+		Timestamp: time.Now().Truncate(a.server.Config.Server.History.Bucket),
+		Items:     items,
+		Tags:      tags,
+	}
+	if a.test {
+		a.write([]data.RecommendSnapshot{snapshot})
+		return
+	}
+	select {
+	case a.queue <- snapshot:
+	default:
+		HistorySnapshotsDroppedTotal.Inc()
+		log.Logger().Warn("drop snapshot of recommendation since the queue is full", zap.String("user_id", userId))
+	}
+}
+
+// run writes queued snapshots in batches.
+func (a *HistoryArchiver) run() {
+	for snapshot := range a.queue {
+		batch := []data.RecommendSnapshot{snapshot}
+	drain:
+		for len(batch) < historyBatchSize {
+			select {
+			case snapshot = <-a.queue:
+				batch = append(batch, snapshot)
+			default:
+				break drain
+			}
+		}
+		a.waitWritable()
+		a.write(batch)
+	}
+}
+
+// waitWritable blocks until writes are enabled. The read-only state is checked periodically in case the callback is
+// missed.
+func (a *HistoryArchiver) waitWritable() {
+	for a.server.ReadOnlyState().ReadOnly {
+		select {
+		case <-a.writable:
+		case <-time.After(a.server.Config.Server.CacheExpire):
+		}
+	}
+}
+
+func (a *HistoryArchiver) write(snapshots []data.RecommendSnapshot) {
+	if err := a.server.DataClient.BatchInsertRecommendSnapshots(snapshots); err != nil {
+		HistorySnapshotsDroppedTotal.Add(float64(len(snapshots)))
+		log.Logger().Error("failed to write snapshots of recommendation", zap.Int("n", len(snapshots)), zap.Error(err))
+	}
+}
+
+// closestSnapshot returns the snapshot whose time bucket is closest to a time. The earlier snapshot wins a tie.
+func closestSnapshot(snapshots []data.RecommendSnapshot, at time.Time) (data.RecommendSnapshot, bool) {
+	var (
+		closest  data.RecommendSnapshot
+		distance time.Duration = math.MaxInt64
+	)
+	for _, snapshot := range snapshots {
+		d := at.Sub(snapshot.Timestamp)
+		if d < 0 {
+			d = -d
+		}
+		if d < distance || (d == distance && snapshot.Timestamp.Before(closest.Timestamp)) {
+			closest, distance = snapshot, d
+		}
+	}
+	return closest, len(snapshots) > 0
+}
+
+func (s *RestServer) getRecommendHistory(request *restful.Request, response *restful.Response) {
+	userId := request.PathParameter("user-id")
+	at, err := ParseTime(request, "at")
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if at == nil {
+		now := time.Now()
+		at = &now
+	}
+	snapshots, err := s.DataClient.GetRecommendSnapshots(userId)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	snapshot, ok := closestSnapshot(snapshots, at.Truncate(s.Config.Server.History.Bucket))
+	if !ok {
+		PageNotFound(response, errors.NotFoundf("recommendation history of user %s", userId))
+		return
+	}
+	Ok(response, snapshot)
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestIsHistoryUser(t *testing.T) {
+	assert.False(t, IsHistoryUser("0", 0))
+	assert.True(t, IsHistoryUser("0", 1))
+	// users are sampled by the ratio
+	var sampled int
+	for i := 0; i < 1000; i++ {
+		if IsHistoryUser(strconv.Itoa(i), 0.5) {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 500, sampled, 100)
+}
+
+func TestClosestSnapshot(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	snapshots := []data.RecommendSnapshot{
+		{UserId: "0", Timestamp: now.Add(-2 * time.Hour)},
+		{UserId: "0", Timestamp: now},
+	}
+	snapshot, ok := closestSnapshot(snapshots, now.Add(-3*time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(-2*time.Hour), snapshot.Timestamp)
+	snapshot, ok = closestSnapshot(snapshots, now.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, now, snapshot.Timestamp)
+	// the earlier snapshot wins a tie
+	snapshot, ok = closestSnapshot(snapshots, now.Add(-time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(-2*time.Hour), snapshot.Timestamp)
+	_, ok = closestSnapshot(nil, now)
+	assert.False(t, ok)
+}
+
+func TestServer_RecommendHistory(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"1", 100}, {"2", 99}, {"3", 98}})
+	assert.NoError(t, err)
+	err = s.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), time.Now()))
+	assert.NoError(t, err)
+
+	// recommendation isn't archived without sampling
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-history/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	// served recommendation is archived with its provenance
+	s.Config.Server.History.SampleRatio = 1
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2"})).
+		End()
+	snapshots, err := s.DataClient.GetRecommendSnapshots("0")
+	assert.NoError(t, err)
+	if assert.Len(t, snapshots, 1) {
+		assert.Equal(t, []string{"1", "2"}, snapshots[0].Items)
+		assert.Equal(t, time.Now().Truncate(time.Hour).Unix(), snapshots[0].Timestamp.Unix())
+		assert.Contains(t, snapshots[0].Tags, HeaderRecommendFreshness)
+	}
+
+	// the snapshot closest to the time is returned
+	past := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	err = s.DataClient.BatchInsertRecommendSnapshots([]data.RecommendSnapshot{
+		{UserId: "0", Timestamp: past, Items: []string{"3"}, Tags: map[string]string{}},
+	})
+	assert.NoError(t, err)
+	snapshots, err = s.DataClient.GetRecommendSnapshots("0")
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-history/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, snapshots[1])).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-history/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"at": past.Add(10 * time.Minute).Format(time.RFC3339)}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, snapshots[0])).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-history/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"at": "invalid"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
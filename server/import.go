@@ -0,0 +1,472 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/araddon/dateparse"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// importBatchSize is the number of rows inserted by a batch of an import.
+	importBatchSize = 1000
+	// importMaxRejections is the max number of rejections listed in the summary of an import.
+	importMaxRejections = 1000
+	// importMaxLineSize is the max size of a line in imported files.
+	importMaxLineSize = 16 * 1024 * 1024
+)
+
+var (
+	itemImportFields     = []string{"item_id", "is_hidden", "categories", "time_stamp", "labels", "comment", "visible_from", "visible_until"}
+	feedbackImportFields = []string{"feedback_type", "user_id", "item_id", "time_stamp", "comment", "context"}
+)
+
+// ImportRejection is a rejected row and the reason.
+type ImportRejection struct {
+	Line   int
+	Reason string
+}
+
+// ImportSummary is the result of an import. At most 1000 rejections are listed.
+type ImportSummary struct {
+	RowsAccepted int
+	RowsRejected int
+	Rejections   []ImportRejection `json:",omitempty"`
+}
+
+// importOptions are options of an import parsed from query parameters:
+//   - format: csv (default) or jsonl.
+//   - sep: separator of csv (default ",").
+//   - has-header: whether the first line of csv is a header (default true).
+//   - mapping: comma separated field:column pairs. Columns are names in the header or 0-based indices if there is no
+//     header. Unmapped fields are mapped to columns of the same names, or columns in the order of fields if there is
+//     neither a header nor a mapping.
+//   - label-sep: separator of categories and labels in csv (default "|").
+type importOptions struct {
+	format    string
+	sep       string
+	hasHeader bool
+	mapping   map[string]string
+	labelSep  string
+}
+
+func parseImportOptions(request *restful.Request, fields []string) (*importOptions, error) {
+	opts := &importOptions{
+		format:   request.QueryParameter("format"),
+		sep:      request.QueryParameter("sep"),
+		labelSep: request.QueryParameter("label-sep"),
+		mapping:  make(map[string]string),
+	}
+	if opts.format == "" {
+		opts.format = "csv"
+	} else if opts.format != "csv" && opts.format != "jsonl" {
+		return nil, fmt.Errorf("unknown format `%v`", opts.format)
+	}
+	if opts.sep == "" {
+		opts.sep = ","
+	}
+	if opts.labelSep == "" {
+		opts.labelSep = "|"
+	}
+	var err error
+	if opts.hasHeader, err = ParseBool(request, "has-header", true); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if mapping := request.QueryParameter("mapping"); mapping != "" {
+		for _, pair := range strings.Split(mapping, ",") {
+			field, column, found := strings.Cut(pair, ":")
+			if !found {
+				return nil, fmt.Errorf("invalid mapping `%v`", pair)
+			}
+			field, column = strings.TrimSpace(field), strings.TrimSpace(column)
+			if !lo.Contains(fields, field) {
+				return nil, fmt.Errorf("unknown field `%v`", field)
+			}
+			if !opts.hasHeader {
+				if _, err = strconv.Atoi(column); err != nil {
+					return nil, fmt.Errorf("column of field `%v` must be an index if there is no header", field)
+				}
+			}
+			opts.mapping[field] = column
+		}
+	}
+	return opts, nil
+}
+
+// columnIndices resolves columns of fields. Fields without columns are resolved to -1.
+func (opts *importOptions) columnIndices(fields, required, header []string) ([]int, error) {
+	indices := make([]int, len(fields))
+	for i, field := range fields {
+		column, mapped := opts.mapping[field]
+		if header == nil {
+			if mapped {
+				indices[i], _ = strconv.Atoi(column)
+			} else if len(opts.mapping) > 0 {
+				if lo.Contains(required, field) {
+					return nil, fmt.Errorf("field `%v` is not mapped", field)
+				}
+				indices[i] = -1
+			} else {
+				indices[i] = i
+			}
+			continue
+		}
+		if !mapped {
+			column = field
+		}
+		indices[i] = lo.IndexOf(header, column)
+		if indices[i] < 0 && (mapped || lo.Contains(required, field)) {
+			return nil, fmt.Errorf("column `%v` of field `%v` not found in header", column, field)
+		}
+	}
+	return indices, nil
+}
+
+// importParser parses rows of an import and inserts them in batches.
+type importParser[T any] struct {
+	fields     []string
+	required   []string
+	fromRecord func(record map[string]string, labelSep string) (T, error)
+	fromJSON   func(line []byte) (T, error)
+	insert     func(batch []T) error
+}
+
+// importBody returns the file part of a multipart request or the request body.
+func importBody(request *restful.Request) (io.Reader, error) {
+	if !strings.HasPrefix(request.HeaderParameter("Content-Type"), "multipart/form-data") {
+		return request.Request.Body, nil
+	}
+	// only query parameters are parsed into the form, so that they are still readable by FormValue
+	if err := request.Request.ParseForm(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	reader, err := request.Request.MultipartReader()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("file not found in multipart form")
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// importRows parses the request body incrementally and inserts accepted rows in batches by concurrent jobs. Invalid
+// rows are rejected with line numbers and reasons while the import continues. The import is aborted if a batch fails.
+func importRows[T any](s *RestServer, request *restful.Request, response *restful.Response, parser importParser[T]) {
+	// open the body before reading query parameters, otherwise multipart forms are read into memory by FormValue
+	body, err := importBody(request)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	opts, err := parseImportOptions(request, parser.fields)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+
+	// start jobs
+	var (
+		start    = time.Now()
+		summary  ImportSummary
+		accepted int64
+		batches  = make(chan []T)
+		failed   = make(chan struct{})
+		failure  error
+		once     sync.Once
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < s.Config.Server.ImportJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := parser.insert(batch); err != nil {
+					once.Do(func() {
+						failure = err
+						close(failed)
+					})
+					return
+				}
+				atomic.AddInt64(&accepted, int64(len(batch)))
+			}
+		}()
+	}
+	batch := make([]T, 0, importBatchSize)
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		select {
+		case batches <- batch:
+			batch = make([]T, 0, importBatchSize)
+			return true
+		case <-failed:
+			return false
+		}
+	}
+	accept := func(row T) bool {
+		batch = append(batch, row)
+		if len(batch) < importBatchSize {
+			return true
+		}
+		return flush()
+	}
+	reject := func(line int, err error) {
+		summary.RowsRejected++
+		if len(summary.Rejections) < importMaxRejections {
+			summary.Rejections = append(summary.Rejections, ImportRejection{Line: line, Reason: err.Error()})
+		}
+	}
+
+	// parse rows
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, importMaxLineSize)
+	if opts.format == "jsonl" {
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := scanner.Bytes()
+			if len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			row, err := parser.fromJSON(line)
+			if err != nil {
+				reject(lineNumber, err)
+			} else if !accept(row) {
+				break
+			}
+		}
+		err = scanner.Err()
+	} else {
+		var (
+			indices   []int
+			headerErr error
+		)
+		err = base.ReadLines(scanner, opts.sep, func(lineNumber int, splits []string) bool {
+			if indices == nil {
+				var header []string
+				if opts.hasHeader {
+					header = splits
+				}
+				if indices, headerErr = opts.columnIndices(parser.fields, parser.required, header); headerErr != nil {
+					return false
+				}
+				if opts.hasHeader {
+					return true
+				}
+			}
+			record := make(map[string]string, len(parser.fields))
+			for i, field := range parser.fields {
+				if indices[i] >= 0 && indices[i] < len(splits) {
+					record[field] = splits[indices[i]]
+				}
+			}
+			row, err := parser.fromRecord(record, opts.labelSep)
+			if err != nil {
+				reject(lineNumber+1, err)
+				return true
+			}
+			return accept(row)
+		})
+		if headerErr != nil {
+			err = headerErr
+		}
+	}
+	if err == nil {
+		flush()
+	}
+	close(batches)
+	wg.Wait()
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if failure != nil {
+		var quota *QuotaExceeded
+		if errors.As(failure, &quota) {
+			Forbidden(response, quota)
+		} else {
+			InternalServerError(response, failure)
+		}
+		return
+	}
+	summary.RowsAccepted = int(accepted)
+	log.ResponseLogger(response).Info("import rows",
+		zap.Int("rows_accepted", summary.RowsAccepted),
+		zap.Int("rows_rejected", summary.RowsRejected),
+		zap.Duration("time", time.Since(start)))
+	SetAudit(request, fmt.Sprintf("import %d rows, reject %d rows", summary.RowsAccepted, summary.RowsRejected))
+	Ok(response, summary)
+}
+
+// splitLabels splits categories or labels in csv.
+func splitLabels(text, labelSep string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, labelSep)
+}
+
+// validateItem validates ids, categories and labels of an item.
+func validateItem(item data.Item) error {
+	if err := base.ValidateId(item.ItemId); err != nil {
+		return fmt.Errorf("invalid item id `%v` (%s)", item.ItemId, err.Error())
+	}
+	for _, category := range item.Categories {
+		if err := base.ValidateId(category); err != nil {
+			return fmt.Errorf("invalid category `%v` (%s)", category, err.Error())
+		}
+	}
+	for _, label := range item.Labels {
+		if err := base.ValidateLabel(label); err != nil {
+			return fmt.Errorf("invalid label `%v` (%s)", label, err.Error())
+		}
+	}
+	return nil
+}
+
+// validateFeedback validates the feedback type, the user id and the item id of feedback.
+func validateFeedback(feedback data.Feedback) error {
+	if err := base.ValidateId(feedback.FeedbackType); err != nil {
+		return fmt.Errorf("invalid feedback type `%v` (%s)", feedback.FeedbackType, err.Error())
+	}
+	if err := base.ValidateId(feedback.UserId); err != nil {
+		return fmt.Errorf("invalid user id `%v` (%s)", feedback.UserId, err.Error())
+	}
+	if err := base.ValidateId(feedback.ItemId); err != nil {
+		return fmt.Errorf("invalid item id `%v` (%s)", feedback.ItemId, err.Error())
+	}
+	return nil
+}
+
+// validateImportFeedback validates imported feedback and normalizes its feedback type.
+func (s *RestServer) validateImportFeedback(feedback *data.Feedback) error {
+	if err := validateFeedback(*feedback); err != nil {
+		return err
+	}
+	if reason := s.validateFeedbackSchema(feedback); reason != "" {
+		return fmt.Errorf("feedback of type `%v` rejected (%s)", feedback.FeedbackType, reason)
+	}
+	return nil
+}
+
+func (s *RestServer) importItems(request *restful.Request, response *restful.Response) {
+	importRows(s, request, response, importParser[data.Item]{
+		fields:   itemImportFields,
+		required: []string{"item_id"},
+		fromRecord: func(record map[string]string, labelSep string) (data.Item, error) {
+			item := Item{
+				ItemId:       record["item_id"],
+				Categories:   splitLabels(record["categories"], labelSep),
+				Timestamp:    record["time_stamp"],
+				Labels:       splitLabels(record["labels"], labelSep),
+				Comment:      record["comment"],
+				VisibleFrom:  record["visible_from"],
+				VisibleUntil: record["visible_until"],
+			}
+			if text := record["is_hidden"]; text != "" {
+				var err error
+				if item.IsHidden, err = strconv.ParseBool(text); err != nil {
+					return data.Item{}, fmt.Errorf("invalid hidden value `%v`", text)
+				}
+			}
+			dataItem, err := item.ToDataItem()
+			if err != nil {
+				return data.Item{}, err
+			}
+			return dataItem, validateItem(dataItem)
+		},
+		fromJSON: func(line []byte) (data.Item, error) {
+			var item Item
+			if err := json.Unmarshal(line, &item); err != nil {
+				return data.Item{}, err
+			}
+			dataItem, err := item.ToDataItem()
+			if err != nil {
+				return data.Item{}, err
+			}
+			return dataItem, validateItem(dataItem)
+		},
+		insert: func(batch []data.Item) error {
+			return s.insertItemsToStores(log.ResponseLogger(response), batch)
+		},
+	})
+}
+
+func (s *RestServer) importFeedback(request *restful.Request, response *restful.Response) {
+	importRows(s, request, response, importParser[data.Feedback]{
+		fields:   feedbackImportFields,
+		required: []string{"feedback_type", "user_id", "item_id"},
+		fromRecord: func(record map[string]string, _ string) (data.Feedback, error) {
+			feedback := data.Feedback{
+				FeedbackKey: data.FeedbackKey{
+					FeedbackType: record["feedback_type"],
+					UserId:       record["user_id"],
+					ItemId:       record["item_id"],
+				},
+				Comment: record["comment"],
+			}
+			if text := record["time_stamp"]; text != "" {
+				var err error
+				if feedback.Timestamp, err = dateparse.ParseAny(text); err != nil {
+					return data.Feedback{}, fmt.Errorf("failed to parse datetime `%v`", text)
+				}
+			}
+			if text := record["context"]; text != "" {
+				if err := json.Unmarshal([]byte(text), &feedback.Context); err != nil {
+					return data.Feedback{}, fmt.Errorf("failed to parse context `%v`", text)
+				}
+			}
+			return feedback, s.validateImportFeedback(&feedback)
+		},
+		fromJSON: func(line []byte) (data.Feedback, error) {
+			var feedback Feedback
+			if err := json.Unmarshal(line, &feedback); err != nil {
+				return data.Feedback{}, err
+			}
+			dataFeedback, err := feedback.ToDataFeedback()
+			if err != nil {
+				return data.Feedback{}, err
+			}
+			return dataFeedback, s.validateImportFeedback(&dataFeedback)
+		},
+		insert: func(batch []data.Feedback) error {
+			return s.insertFeedbackToStores(batch, true)
+		},
+	})
+}
@@ -0,0 +1,358 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/juju/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+const (
+	// KafkaErrorHeader is the header of dead letters, which is the reason why the event is invalid.
+	KafkaErrorHeader = "gorse-error"
+
+	kafkaMinRetryInterval = time.Second
+	kafkaMaxRetryInterval = time.Minute
+)
+
+// kafkaReader is the part of kafka.Reader used by the consumer.
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Stats() kafka.ReaderStats
+	Close() error
+}
+
+// kafkaWriter is the part of kafka.Writer used by the consumer.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaConsumer consumes feedback events from a Kafka topic. Events are inserted in batches, and offsets are committed
+// only after events are inserted, so that events are never lost. Events failing to be parsed or validated are written
+// to the dead-letter topic. Insertions are paused in read-only mode.
+type KafkaConsumer struct {
+	server     *RestServer
+	config     config.KafkaConfig
+	reader     kafkaReader
+	deadLetter kafkaWriter
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+func NewKafkaConsumer(s *RestServer) *KafkaConsumer {
+	cfg := s.Config.Server.Kafka
+	c := newKafkaConsumer(s, cfg, kafka.NewReader(kafka.ReaderConfig{
+		Brokers: cfg.Brokers,
+		GroupID: cfg.GroupId,
+		Topic:   cfg.Topic,
+		// offsets are committed synchronously
+		CommitInterval: 0,
+		MaxBytes:       10e6,
+	}), nil)
+	if cfg.DeadLetterTopic != "" {
+		c.deadLetter = &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.DeadLetterTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}
+	}
+	return c
+}
+
+func newKafkaConsumer(s *RestServer, cfg config.KafkaConfig, reader kafkaReader, deadLetter kafkaWriter) *KafkaConsumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KafkaConsumer{
+		server:     s,
+		config:     cfg,
+		reader:     reader,
+		deadLetter: deadLetter,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Run consumes events until the consumer is closed.
+func (c *KafkaConsumer) Run() {
+	log.Logger().Info("start consuming feedback from kafka",
+		zap.Strings("brokers", c.config.Brokers),
+		zap.String("topic", c.config.Topic),
+		zap.String("group_id", c.config.GroupId))
+	for {
+		messages, fetchErr := c.fetchBatch()
+		if len(messages) > 0 {
+			// failures are retried until the consumer is closed
+			if err := c.processBatch(messages); err != nil {
+				return
+			}
+		}
+		if c.ctx.Err() != nil {
+			return
+		} else if fetchErr != nil {
+			KafkaErrorsTotal.Inc()
+			log.Logger().Error("failed to fetch kafka messages", zap.Error(fetchErr))
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(kafkaMinRetryInterval):
+			}
+		}
+	}
+}
+
+// Close stops consuming events. Events fetched but not inserted are consumed again by the consumer group.
+func (c *KafkaConsumer) Close() error {
+	c.cancel()
+	var deadLetterErr error
+	if c.deadLetter != nil {
+		deadLetterErr = c.deadLetter.Close()
+	}
+	if err := c.reader.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(deadLetterErr)
+}
+
+// fetchBatch waits for the first message, and then fetches messages until the batch is full or the batch timeout.
+func (c *KafkaConsumer) fetchBatch() ([]kafka.Message, error) {
+	message, err := c.reader.FetchMessage(c.ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	messages := []kafka.Message{message}
+	ctx, cancel := context.WithTimeout(c.ctx, c.config.BatchTimeout)
+	defer cancel()
+	for len(messages) < c.config.BatchSize {
+		message, err = c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil && c.ctx.Err() == nil {
+				// the batch timeout
+				break
+			}
+			return messages, errors.Trace(err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// processBatch inserts valid events and writes invalid events to the dead-letter topic, then commits offsets. Failed
+// insertions are retried until the consumer is closed.
+func (c *KafkaConsumer) processBatch(messages []kafka.Message) error {
+	feedback := make([]data.Feedback, 0, len(messages))
+	var deadLetters []kafka.Message
+	for _, message := range messages {
+		f, err := c.parse(message.Value)
+		if err == nil {
+			if reason := c.server.validateFeedbackSchema(&f); reason != "" {
+				err = errors.New(reason)
+			}
+		}
+		if err != nil {
+			headers := append([]kafka.Header{}, message.Headers...)
+			deadLetters = append(deadLetters, kafka.Message{
+				Key:     message.Key,
+				Value:   message.Value,
+				Headers: append(headers, kafka.Header{Key: KafkaErrorHeader, Value: []byte(err.Error())}),
+			})
+			continue
+		}
+		// events without timestamps happen at the time they are produced
+		if f.Timestamp.IsZero() {
+			f.Timestamp = message.Time
+		}
+		feedback = append(feedback, f)
+	}
+
+	// insert valid events
+	if len(feedback) > 0 {
+		err := c.retry("insert feedback", func() error {
+			c.waitWritable()
+			if err := c.ctx.Err(); err != nil {
+				return err
+			}
+			return c.server.insertFeedbackToStores(feedback, false)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		KafkaInsertedTotal.Add(float64(len(feedback)))
+		c.server.recordClicks(feedback)
+	}
+
+	// write invalid events to the dead-letter topic
+	if len(deadLetters) > 0 {
+		if c.deadLetter != nil {
+			if err := c.retry("write dead letters", func() error {
+				return c.deadLetter.WriteMessages(c.ctx, deadLetters...)
+			}); err != nil {
+				return errors.Trace(err)
+			}
+		} else {
+			log.Logger().Warn("drop invalid kafka messages", zap.Int("n", len(deadLetters)))
+		}
+		KafkaDeadLettersTotal.Add(float64(len(deadLetters)))
+	}
+
+	// commit offsets
+	if err := c.retry("commit offsets", func() error {
+		return c.reader.CommitMessages(c.ctx, messages...)
+	}); err != nil {
+		return errors.Trace(err)
+	}
+	KafkaLag.Set(float64(c.reader.Stats().Lag))
+	return nil
+}
+
+// retry calls fn with exponential backoff until it succeeds or the consumer is closed.
+func (c *KafkaConsumer) retry(action string, fn func() error) error {
+	interval := kafkaMinRetryInterval
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		} else if c.ctx.Err() != nil {
+			return errors.Trace(c.ctx.Err())
+		}
+		KafkaErrorsTotal.Inc()
+		log.Logger().Error("failed to "+action+", retry later",
+			zap.String("topic", c.config.Topic), zap.Duration("interval", interval), zap.Error(err))
+		select {
+		case <-c.ctx.Done():
+			return errors.Trace(c.ctx.Err())
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > kafkaMaxRetryInterval {
+			interval = kafkaMaxRetryInterval
+		}
+	}
+}
+
+// waitWritable blocks until writes are enabled or the consumer is closed.
+func (c *KafkaConsumer) waitWritable() {
+	for c.server.ReadOnlyState().ReadOnly {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.server.Config.Server.CacheExpire):
+		}
+	}
+}
+
+// parse maps a JSON event to feedback.
+func (c *KafkaConsumer) parse(value []byte) (data.Feedback, error) {
+	var event interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		return data.Feedback{}, errors.Trace(err)
+	}
+	mapping := c.config.Mapping
+	var (
+		feedback data.Feedback
+		err      error
+	)
+	if feedback.FeedbackType, err = kafkaString(event, mapping.FeedbackType); err != nil {
+		return data.Feedback{}, errors.Trace(err)
+	} else if feedback.FeedbackType == "" {
+		feedback.FeedbackType = c.config.FeedbackType
+	}
+	if feedback.UserId, err = kafkaString(event, mapping.UserId); err != nil {
+		return data.Feedback{}, errors.Trace(err)
+	}
+	if feedback.ItemId, err = kafkaString(event, mapping.ItemId); err != nil {
+		return data.Feedback{}, errors.Trace(err)
+	}
+	if feedback.Comment, err = kafkaString(event, mapping.Comment); err != nil {
+		return data.Feedback{}, errors.Trace(err)
+	}
+	if feedback.Timestamp, err = kafkaTime(event, mapping.Timestamp); err != nil {
+		return data.Feedback{}, errors.Trace(err)
+	}
+	if feedback.FeedbackType == "" {
+		return data.Feedback{}, errors.NotValidf("empty feedback type")
+	} else if feedback.UserId == "" {
+		return data.Feedback{}, errors.NotValidf("empty user id")
+	} else if feedback.ItemId == "" {
+		return data.Feedback{}, errors.NotValidf("empty item id")
+	}
+	return feedback, nil
+}
+
+// kafkaField returns the field of a JSON event by the path separated by dots. Nil is returned if the field doesn't
+// exist.
+func kafkaField(event interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	for _, name := range strings.Split(path, ".") {
+		object, ok := event.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		event = object[name]
+	}
+	return event
+}
+
+// kafkaString returns the field of a JSON event as a string. Numbers are converted to strings.
+func kafkaString(event interface{}, path string) (string, error) {
+	switch value := kafkaField(event, path).(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	default:
+		return "", errors.NotValidf("field %s", path)
+	}
+}
+
+// kafkaTime returns the field of a JSON event as a timestamp. Strings are parsed as datetimes, and numbers are Unix
+// seconds.
+func kafkaTime(event interface{}, path string) (time.Time, error) {
+	switch value := kafkaField(event, path).(type) {
+	case nil:
+		return time.Time{}, nil
+	case string:
+		timestamp, err := dateparse.ParseAny(value)
+		if err != nil {
+			return time.Time{}, errors.Trace(err)
+		}
+		return timestamp, nil
+	case json.Number:
+		seconds, err := value.Float64()
+		if err != nil {
+			return time.Time{}, errors.Trace(err)
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), nil
+	default:
+		return time.Time{}, errors.NotValidf("field %s", path)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+type mockKafkaReader struct {
+	messages  chan kafka.Message
+	mu        sync.Mutex
+	committed []kafka.Message
+}
+
+func newMockKafkaReader(messages ...kafka.Message) *mockKafkaReader {
+	r := &mockKafkaReader{messages: make(chan kafka.Message, len(messages))}
+	for i, message := range messages {
+		message.Offset = int64(i)
+		r.messages <- message
+	}
+	return r
+}
+
+func (r *mockKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	case message := <-r.messages:
+		return message, nil
+	}
+}
+
+func (r *mockKafkaReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func (r *mockKafkaReader) Committed() []kafka.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.committed
+}
+
+func (r *mockKafkaReader) Stats() kafka.ReaderStats {
+	return kafka.ReaderStats{Lag: int64(len(r.messages))}
+}
+
+func (r *mockKafkaReader) Close() error {
+	return nil
+}
+
+type mockKafkaWriter struct {
+	messages []kafka.Message
+}
+
+func (w *mockKafkaWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *mockKafkaWriter) Close() error {
+	return nil
+}
+
+func kafkaMessage(t *testing.T, event interface{}) kafka.Message {
+	value, err := json.Marshal(event)
+	assert.NoError(t, err)
+	return kafka.Message{Value: value, Time: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestKafkaConsumer_Parse(t *testing.T) {
+	cfg := config.GetDefaultConfig().Server.Kafka
+	cfg.Mapping.UserId = "user.id"
+	cfg.Mapping.Timestamp = "time"
+	c := newKafkaConsumer(nil, cfg, newMockKafkaReader(), nil)
+
+	// nested fields and numbers
+	feedback, err := c.parse([]byte(`{"feedback_type":"star","user":{"id":12345678901234567890},"item_id":"1","time":1640995200.5}`))
+	assert.NoError(t, err)
+	assert.Equal(t, data.Feedback{
+		FeedbackKey: data.FeedbackKey{FeedbackType: "star", UserId: "12345678901234567890", ItemId: "1"},
+		Timestamp:   time.Date(2022, 1, 1, 0, 0, 0, 500000000, time.UTC),
+	}, feedback)
+	// datetimes
+	feedback, err = c.parse([]byte(`{"feedback_type":"star","user":{"id":"0"},"item_id":"1","time":"2022-01-01T00:00:00Z","comment":"good"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), feedback.Timestamp)
+	assert.Equal(t, "good", feedback.Comment)
+
+	// invalid events
+	_, err = c.parse([]byte(`{`))
+	assert.Error(t, err)
+	_, err = c.parse([]byte(`{"feedback_type":"star","user":{"id":"0"}}`))
+	assert.Error(t, err)
+	_, err = c.parse([]byte(`{"feedback_type":"star","user":{"id":{}},"item_id":"1"}`))
+	assert.Error(t, err)
+	_, err = c.parse([]byte(`{"feedback_type":"star","user":{"id":"0"},"item_id":"1","time":"yesterday"}`))
+	assert.Error(t, err)
+	_, err = c.parse([]byte(`{"user":{"id":"0"},"item_id":"1"}`))
+	assert.Error(t, err)
+
+	// events without feedback types
+	c.config.FeedbackType = "click"
+	feedback, err = c.parse([]byte(`{"user":{"id":"0"},"item_id":"1"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "click", feedback.FeedbackType)
+}
+
+func TestKafkaConsumer_FetchBatch(t *testing.T) {
+	cfg := config.GetDefaultConfig().Server.Kafka
+	cfg.BatchSize = 3
+	cfg.BatchTimeout = 10 * time.Millisecond
+	var messages []kafka.Message
+	for i := 0; i < 5; i++ {
+		messages = append(messages, kafka.Message{})
+	}
+	c := newKafkaConsumer(nil, cfg, newMockKafkaReader(messages...), nil)
+	// the batch is full
+	batch, err := c.fetchBatch()
+	assert.NoError(t, err)
+	assert.Len(t, batch, 3)
+	// the batch timeout
+	batch, err = c.fetchBatch()
+	assert.NoError(t, err)
+	assert.Len(t, batch, 2)
+	// the consumer is closed
+	assert.NoError(t, c.Close())
+	_, err = c.fetchBatch()
+	assert.Error(t, err)
+}
+
+func TestKafkaConsumer_ProcessBatch(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.FeedbackValidation.Strict = true
+	s.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"star"}
+	messages := []kafka.Message{
+		kafkaMessage(t, map[string]interface{}{"feedback_type": "star", "user_id": "0", "item_id": "1", "timestamp": "2021-01-01"}),
+		kafkaMessage(t, map[string]interface{}{"feedback_type": "star", "user_id": "0", "item_id": "2"}),
+		kafkaMessage(t, map[string]interface{}{"feedback_type": "unknown", "user_id": "0", "item_id": "3"}),
+		{Value: []byte("{"), Headers: []kafka.Header{{Key: "source", Value: []byte("web")}}},
+	}
+	reader := newMockKafkaReader(messages...)
+	deadLetter := &mockKafkaWriter{}
+	c := newKafkaConsumer(&s.RestServer, s.Config.Server.Kafka, reader, deadLetter)
+	batch, err := c.fetchBatch()
+	assert.NoError(t, err)
+	assert.NoError(t, c.processBatch(batch))
+
+	// valid events are inserted
+	feedback, err := s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	timestamps := make(map[string]time.Time)
+	for _, f := range feedback {
+		assert.Equal(t, "star", f.FeedbackType)
+		timestamps[f.ItemId] = f.Timestamp
+	}
+	assert.Len(t, timestamps, 2)
+	assert.True(t, timestamps["1"].Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)))
+	// events without timestamps happen at the time they are produced
+	assert.True(t, timestamps["2"].Equal(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)))
+	// invalid events are written to the dead-letter topic
+	if assert.Len(t, deadLetter.messages, 2) {
+		assert.Equal(t, messages[2].Value, deadLetter.messages[0].Value)
+		assert.Equal(t, []kafka.Header{{Key: KafkaErrorHeader, Value: []byte(RejectUnknownType)}}, deadLetter.messages[0].Headers)
+		assert.Equal(t, messages[3].Value, deadLetter.messages[1].Value)
+		assert.Equal(t, "source", deadLetter.messages[1].Headers[0].Key)
+		assert.Equal(t, KafkaErrorHeader, deadLetter.messages[1].Headers[1].Key)
+	}
+	// offsets of all events are committed
+	assert.Len(t, reader.Committed(), 4)
+}
+
+func TestKafkaConsumer_ReadOnly(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.CacheExpire = 10 * time.Millisecond
+	buf, err := json.Marshal(ReadOnlyState{ReadOnly: true, Reason: "migration", Since: time.Now(), Until: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.NoError(t, s.CacheClient.Set(cache.String(cache.ReadOnly, string(buf))))
+
+	// offsets aren't committed until events are inserted
+	reader := newMockKafkaReader(kafkaMessage(t, map[string]interface{}{"feedback_type": "star", "user_id": "0", "item_id": "1"}))
+	c := newKafkaConsumer(&s.RestServer, s.Config.Server.Kafka, reader, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, reader.Committed())
+	feedback, err := s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+
+	// events are inserted once writes are enabled
+	assert.NoError(t, s.CacheClient.Set(cache.String(cache.ReadOnly, "{}")))
+	assert.Eventually(t, func() bool {
+		return len(reader.Committed()) == 1
+	}, time.Second, 10*time.Millisecond)
+	feedback, err = s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+	assert.NoError(t, c.Close())
+	<-done
+}
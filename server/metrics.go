@@ -17,6 +17,8 @@ package server
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
 )
 
 var (
@@ -25,4 +27,341 @@ var (
 		Subsystem: "server",
 		Name:      "rest_api_request_seconds",
 	}, []string{"api"})
+	RuleApplicationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "rule_applications_total",
+	}, []string{"rule_id"})
+	// RecommendServedTotal (gorse_server_recommend_served_total) counts recommendation requests by the fallback stage
+	// serving most of the results, such as offline or popular.
+	RecommendServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "recommend_served_total",
+	}, []string{"stage"})
+	// RecommendEmptyTotal (gorse_server_recommend_empty_total) counts recommendation requests returning no items.
+	RecommendEmptyTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "recommend_empty_total",
+	})
+	// RecommendReturnedItems (gorse_server_recommend_returned_items) is the distribution of the number of returned
+	// items. The average length is the ratio of its sum and count.
+	RecommendReturnedItems = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "recommend_returned_items",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	// OfflineRecommendStalenessSeconds (gorse_server_offline_recommend_staleness_seconds) is the distribution of the
+	// age of served offline recommendation.
+	OfflineRecommendStalenessSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "offline_recommend_staleness_seconds",
+		Buckets:   prometheus.ExponentialBuckets(60, 2, 12),
+	})
+	// RollingCTR (gorse_server_rolling_ctr) is the click-through rate in the last 24 hours, estimated by impressions
+	// written back as read feedback and positive feedback on these impressions inserted to this server.
+	RollingCTR = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "rolling_ctr",
+	}, func() float64 {
+		return onlineCTR.CTR(time.Now())
+	})
+	LocalCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "local_cache_hits_total",
+	})
+	LocalCacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "local_cache_misses_total",
+	})
+	LocalCacheEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "local_cache_evictions_total",
+	})
+	// SessionRecommendCacheHitsTotal and SessionRecommendCacheMissesTotal count session recommendation served from
+	// and merged for the cache store, the hit ratio is hits / (hits + misses).
+	SessionRecommendCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "session_recommend_cache_hits_total",
+	})
+	SessionRecommendCacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "session_recommend_cache_misses_total",
+	})
+	// FeedbackRejectedTotal (gorse_server_feedback_rejected_total) counts feedback rejected by validation by the reason,
+	// such as unknown_type or future_timestamp.
+	FeedbackRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "feedback_rejected_total",
+	}, []string{"reason"})
+	// FeedbackUnknownTypeTotal (gorse_server_feedback_unknown_type_total) counts feedback of unknown types accepted out
+	// of strict mode.
+	FeedbackUnknownTypeTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "feedback_unknown_type_total",
+	})
+	// FeedbackClampedTotal (gorse_server_feedback_clamped_total) counts feedback whose future timestamps are clamped to
+	// now.
+	FeedbackClampedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "feedback_clamped_total",
+	})
+	// AuditLogsDroppedTotal (gorse_server_audit_logs_dropped_total) counts audit logs dropped since the queue is full or
+	// they fail to be written.
+	AuditLogsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "audit_logs_dropped_total",
+	})
+	// ConsumedFilterHitsTotal and ConsumedFilterMissesTotal count recommendation requests excluding consumed items by
+	// Bloom filters and by querying user feedback since filters are missing.
+	ConsumedFilterHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "consumed_filter_hits_total",
+	})
+	ConsumedFilterMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "consumed_filter_misses_total",
+	})
+	// ConsumedFilterFalsePositiveRate (gorse_server_consumed_filter_false_positive_rate) is the distribution of
+	// estimated false positive rates of Bloom filters of consumed items used by recommendation requests.
+	ConsumedFilterFalsePositiveRate = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "consumed_filter_false_positive_rate",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 12),
+	})
+	// DegradedServedTotal (gorse_server_degraded_served_total) counts recommendation requests served while the cache
+	// store is down, by the source of served items, which is stale or fallback.
+	DegradedServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "degraded_served_total",
+	}, []string{"source"})
+	// ReadOnlyMode (gorse_server_read_only) is 1 while writes are rejected in read-only mode.
+	ReadOnlyMode = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "read_only",
+	})
+	// ReadOnlyRejectedTotal (gorse_server_read_only_rejected_total) counts writes rejected in read-only mode.
+	ReadOnlyRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "read_only_rejected_total",
+	})
+	// CoalescedRequestsTotal (gorse_server_coalesced_requests_total) counts coalesced reads by paths and results. The
+	// result is leader if the read is done by the request, shared if the result of another request is shared, or
+	// timeout if the request gives up waiting.
+	CoalescedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "coalesced_requests_total",
+	}, []string{"path", "result"})
+	// KafkaInsertedTotal (gorse_server_kafka_inserted_total) counts feedback consumed from Kafka and inserted, whose rate
+	// is the insert rate.
+	KafkaInsertedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "kafka_inserted_total",
+	})
+	// KafkaDeadLettersTotal (gorse_server_kafka_dead_letters_total) counts invalid events consumed from Kafka.
+	KafkaDeadLettersTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "kafka_dead_letters_total",
+	})
+	// KafkaErrorsTotal (gorse_server_kafka_errors_total) counts failures of consuming events from Kafka, which are
+	// retried.
+	KafkaErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "kafka_errors_total",
+	})
+	// KafkaLag (gorse_server_kafka_lag) is the number of events behind the latest offset of the topic.
+	KafkaLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "kafka_lag",
+	})
+	// CacheCircuitOpen (gorse_server_cache_circuit_open) is 1 while the circuit breaker of the cache store is open.
+	CacheCircuitOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "cache_circuit_open",
+	})
+	// WriteBackBufferedTotal (gorse_server_write_back_buffered_total) counts feedback written back by recommendation
+	// APIs and buffered.
+	WriteBackBufferedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "write_back_buffered_total",
+	})
+	// WriteBackFlushedTotal (gorse_server_write_back_flushed_total) counts buffered feedback inserted into the data
+	// store.
+	WriteBackFlushedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "write_back_flushed_total",
+	})
+	// WriteBackDroppedTotal (gorse_server_write_back_dropped_total) counts feedback dropped since the queue is full or
+	// writes fail.
+	WriteBackDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "write_back_dropped_total",
+	})
+	// HistorySnapshotsDroppedTotal (gorse_server_history_snapshots_dropped_total) counts snapshots of served
+	// recommendation dropped since the queue is full or writes fail.
+	HistorySnapshotsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "history_snapshots_dropped_total",
+	})
+	// ShadowTrafficRequestsTotal (gorse_server_shadow_traffic_requests_total) counts requests replayed against the
+	// secondary cluster by results, which are ok, failed or dropped.
+	ShadowTrafficRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "shadow_traffic_requests_total",
+	}, []string{"result"})
+	// ShadowTrafficJaccard (gorse_server_shadow_traffic_jaccard) is the distribution of Jaccard overlaps between ids
+	// returned by this cluster and the secondary cluster.
+	ShadowTrafficJaccard = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "shadow_traffic_jaccard",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+	})
+	// ShadowTrafficLatencyDeltaSeconds (gorse_server_shadow_traffic_latency_delta_seconds) is the distribution of
+	// latencies of the secondary cluster minus latencies of this cluster.
+	ShadowTrafficLatencyDeltaSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "shadow_traffic_latency_delta_seconds",
+		Buckets:   []float64{-1, -0.25, -0.1, -0.05, -0.025, -0.01, 0, 0.01, 0.025, 0.05, 0.1, 0.25, 1},
+	})
+	// RecommendBudgetConsumption (gorse_server_recommend_budget_consumption) is the distribution of the fraction of the
+	// latency budget consumed by each fallback stage.
+	RecommendBudgetConsumption = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "recommend_budget_consumption",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 0.75, 1},
+	}, []string{"stage"})
+	// EnrichedItemsTotal (gorse_server_enriched_items_total) counts items created automatically by feedback by the
+	// result of enrichment, which is enriched, failed or dropped.
+	EnrichedItemsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "server",
+		Name:      "enriched_items_total",
+	}, []string{"result"})
 )
+
+// ctrWindow is the number of hours of the rolling click-through rate.
+const ctrWindow = 24
+
+// ctrMaxImpressions is the max number of impressions tracked in an hour. Impressions beyond it are neither tracked nor
+// counted, so that the estimate is kept unbiased.
+const ctrMaxImpressions = 1 << 20
+
+var onlineCTR = NewCTRAggregator()
+
+// CTRAggregator counts impressions and clicks in hourly buckets of a ring. A click is only counted if the item was
+// shown to the user in the window, and it is counted once per impression.
+type CTRAggregator struct {
+	mu          sync.Mutex
+	hours       [ctrWindow]int64
+	impressions [ctrWindow]map[string]struct{}
+	clicks      [ctrWindow]int
+}
+
+// NewCTRAggregator creates an empty CTRAggregator.
+func NewCTRAggregator() *CTRAggregator {
+	a := &CTRAggregator{}
+	for i := range a.impressions {
+		a.impressions[i] = make(map[string]struct{})
+	}
+	return a
+}
+
+// bucket returns the bucket of a time. The bucket of an expired hour is reset.
+func (a *CTRAggregator) bucket(t time.Time) int {
+	hour := t.Unix() / 3600
+	i := int(hour % ctrWindow)
+	if a.hours[i] != hour {
+		a.hours[i] = hour
+		a.impressions[i] = make(map[string]struct{})
+		a.clicks[i] = 0
+	}
+	return i
+}
+
+func impressionKey(userId, itemId string) string {
+	return userId + "/" + itemId
+}
+
+// Impress records items shown to a user at a time.
+func (a *CTRAggregator) Impress(t time.Time, userId string, itemIds ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := a.bucket(t)
+	for _, itemId := range itemIds {
+		if len(a.impressions[i]) >= ctrMaxImpressions {
+			return
+		}
+		a.impressions[i][impressionKey(userId, itemId)] = struct{}{}
+	}
+}
+
+// Click records a positive feedback at a time. It returns false if the item wasn't shown to the user in the window.
+func (a *CTRAggregator) Click(t time.Time, userId, itemId string) bool {
+	hour := t.Unix() / 3600
+	key := impressionKey(userId, itemId)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.hours {
+		if age := hour - a.hours[i]; age >= 0 && age < ctrWindow {
+			if _, exist := a.impressions[i][key]; exist {
+				// the click is counted in the bucket of the impression
+				delete(a.impressions[i], key)
+				a.clicks[i]++
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CTR returns the click-through rate of the last ctrWindow hours before a time.
+func (a *CTRAggregator) CTR(t time.Time) float64 {
+	hour := t.Unix() / 3600
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var impressions, clicks int
+	for i := range a.hours {
+		if age := hour - a.hours[i]; age >= 0 && age < ctrWindow {
+			// clicked impressions are removed from the set
+			impressions += len(a.impressions[i]) + a.clicks[i]
+			clicks += a.clicks[i]
+		}
+	}
+	if impressions == 0 {
+		return 0
+	}
+	return float64(clicks) / float64(impressions)
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCTRAggregator(t *testing.T) {
+	aggregator := NewCTRAggregator()
+	now := time.Date(2005, 6, 15, 12, 30, 0, 0, time.UTC)
+	assert.Zero(t, aggregator.CTR(now))
+
+	aggregator.Impress(now.Add(-time.Hour), "0", "0", "1", "2", "3", "4")
+	aggregator.Impress(now, "1", "0", "1", "2", "3", "4")
+	assert.True(t, aggregator.Click(now, "0", "1"))
+	assert.True(t, aggregator.Click(now, "1", "1"))
+	assert.True(t, aggregator.Click(now, "1", "2"))
+	assert.InDelta(t, 0.3, aggregator.CTR(now), 1e-6)
+
+	// clicks without impressions aren't counted
+	assert.False(t, aggregator.Click(now, "2", "1"))
+	// clicks are counted once per impression
+	assert.False(t, aggregator.Click(now, "1", "1"))
+	assert.InDelta(t, 0.3, aggregator.CTR(now), 1e-6)
+
+	// buckets older than 24 hours are excluded
+	assert.InDelta(t, 0.4, aggregator.CTR(now.Add(23*time.Hour)), 1e-6)
+	assert.Zero(t, aggregator.CTR(now.Add(24*time.Hour)))
+	assert.False(t, aggregator.Click(now.Add(24*time.Hour), "1", "3"))
+
+	// expired buckets are reused
+	aggregator.Impress(now.Add(23*time.Hour), "0", "5", "6", "7", "8", "9")
+	assert.InDelta(t, 2.0/10, aggregator.CTR(now.Add(23*time.Hour)), 1e-6)
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"sort"
+	"time"
+)
+
+const (
+	OverrideActionPin   = "pin"
+	OverrideActionBlock = "block"
+)
+
+// FiredOverride is a manual override of the user which changed recommendations. Position starts from 1 and is only
+// set for pinned items.
+type FiredOverride struct {
+	ItemId   string
+	Action   string
+	Position int
+}
+
+func validateUserOverrides(overrides *data.UserOverrides) error {
+	for _, item := range overrides.Pinned {
+		if item.ItemId == "" {
+			return errors.BadRequestf("empty pinned item id")
+		}
+		if item.Position <= 0 {
+			return errors.BadRequestf("position of pinned item `%s` should be positive", item.ItemId)
+		}
+	}
+	for _, item := range overrides.Blocked {
+		if item.ItemId == "" {
+			return errors.BadRequestf("empty blocked item id")
+		}
+	}
+	return nil
+}
+
+// requireUserOverrides loads unexpired overrides of the user once. Blocked items are excluded from recommendation so
+// that recommenders fill their places.
+func (s *RestServer) requireUserOverrides(ctx *recommendContext) error {
+	if ctx.overrides == nil {
+		overrides, err := s.DataClient.GetUserOverrides(ctx.userId)
+		if err != nil && !errors.Is(err, errors.NotFound) {
+			return errors.Trace(err)
+		}
+		overrides.RemoveExpired(time.Now())
+		for _, item := range overrides.Blocked {
+			ctx.excludeSet.Add(item.ItemId)
+		}
+		ctx.overrides = &overrides
+	}
+	return nil
+}
+
+// isBlockedByOverrides returns true if the item is blocked by overrides of the user.
+func (ctx *recommendContext) isBlockedByOverrides(itemId string) bool {
+	return ctx.overrides != nil && lo.ContainsBy(ctx.overrides.Blocked, func(item data.BlockedItem) bool {
+		return item.ItemId == itemId
+	})
+}
+
+// applyOverrides places pinned items of the user at their positions after business rules. Blocked items have been
+// excluded by requireUserOverrides.
+func (s *RestServer) applyOverrides(ctx *recommendContext) error {
+	start := time.Now()
+	if err := s.requireUserOverrides(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if len(ctx.overrides.Pinned) == 0 {
+		return nil
+	}
+	pinned := make([]data.PinnedItem, len(ctx.overrides.Pinned))
+	copy(pinned, ctx.overrides.Pinned)
+	sort.SliceStable(pinned, func(i, j int) bool {
+		return pinned[i].Position < pinned[j].Position
+	})
+	for _, item := range pinned {
+		if item.Position > ctx.n || ctx.isBlockedByOverrides(item.ItemId) {
+			continue
+		}
+		if index := lo.IndexOf(ctx.results, item.ItemId); index >= 0 {
+			ctx.results = append(ctx.results[:index], ctx.results[index+1:]...)
+		} else if s.HiddenItemsManager.IsHiddenWithDelta([]string{item.ItemId}, ctx.category, ctx.hiddenDelta)[0] {
+			continue
+		}
+		position := item.Position - 1
+		if position > len(ctx.results) {
+			position = len(ctx.results)
+		}
+		ctx.results = append(ctx.results[:position], append([]string{item.ItemId}, ctx.results[position:]...)...)
+		ctx.excludeSet.Add(item.ItemId)
+		ctx.firedOverrides = append(ctx.firedOverrides, FiredOverride{ItemId: item.ItemId, Action: OverrideActionPin, Position: position + 1})
+	}
+	ctx.applyOverridesTime = time.Since(start)
+	return nil
+}
+
+func (s *RestServer) getUserOverrides(request *restful.Request, response *restful.Response) {
+	userId := request.PathParameter("user-id")
+	overrides, err := s.DataClient.GetUserOverrides(userId)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			PageNotFound(response, err)
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
+	Ok(response, overrides)
+}
+
+func (s *RestServer) setUserOverrides(request *restful.Request, response *restful.Response) {
+	var overrides data.UserOverrides
+	if err := request.ReadEntity(&overrides); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	overrides.UserId = request.PathParameter("user-id")
+	if err := validateUserOverrides(&overrides); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if err := s.DataClient.SetUserOverrides(overrides); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	SetAudit(request, "set user overrides")
+	Ok(response, Success{RowAffected: 1})
+}
+
+func (s *RestServer) deleteUserOverrides(request *restful.Request, response *restful.Response) {
+	userId := request.PathParameter("user-id")
+	if err := s.DataClient.DeleteUserOverrides(userId); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	SetAudit(request, "delete user overrides")
+	Ok(response, Success{RowAffected: 1})
+}
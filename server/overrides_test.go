@@ -0,0 +1,151 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_UserOverrides(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	overrides := data.UserOverrides{
+		UserId:  "0",
+		Pinned:  []data.PinnedItem{{ItemId: "1", Position: 1}},
+		Blocked: []data.BlockedItem{{ItemId: "2", ExpireTime: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}},
+	}
+	// overrides not found
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/0/overrides").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	// set overrides
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/user/0/overrides").
+		Header("X-API-Key", apiKey).
+		JSON(overrides).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/user/0/overrides").
+		Header("X-API-Key", apiKey).
+		JSON(data.UserOverrides{Pinned: []data.PinnedItem{{ItemId: "1"}}}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	// get overrides
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/0/overrides").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, overrides)).
+		End()
+	// delete overrides
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/user/0/overrides").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/0/overrides").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestServer_GetRecommends_UserOverrides(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert recommendation
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+	})
+	assert.NoError(t, err)
+	// insert overrides
+	err = s.DataClient.SetUserOverrides(data.UserOverrides{
+		UserId: "0",
+		Pinned: []data.PinnedItem{
+			{ItemId: "9", Position: 2},
+			{ItemId: "8", Position: 1, ExpireTime: time.Now().Add(-time.Hour)},
+		},
+		Blocked: []data.BlockedItem{{ItemId: "2"}},
+	})
+	assert.NoError(t, err)
+	// fired overrides are shown in preview
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-preview/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "4"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, RecommendPreview{
+			UserId: "0",
+			Stages: []PreviewStage{
+				{Name: "offline", Candidates: []RecommendCandidate{
+					{"1", 99, DecisionKept},
+					{"2", 98, DecisionBlocked},
+					{"3", 97, DecisionKept},
+					{"4", 96, DecisionKept},
+					{"5", 95, DecisionKept},
+				}},
+				{Name: "item_based", Candidates: []RecommendCandidate{}},
+				{Name: "latest", Candidates: []RecommendCandidate{}},
+				{Name: "popular", Candidates: []RecommendCandidate{}},
+			},
+			Results: []string{"1", "9", "3", "4"},
+			Overrides: []FiredOverride{
+				{ItemId: "2", Action: OverrideActionBlock},
+				{ItemId: "9", Action: OverrideActionPin, Position: 2},
+			},
+		})).
+		End()
+	// blocked items are excluded and pinned items are placed at their positions
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "4",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "9", "3", "4"})).
+		End()
+}
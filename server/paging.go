@@ -0,0 +1,160 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+// HeaderNextPageToken is the response header of the token of the next page of recommendation. It is absent on the
+// last page.
+const HeaderNextPageToken = "X-Next-Page-Token"
+
+// ErrPageTokenExpired means the snapshot of a page token has expired, and clients should restart from the first page.
+var ErrPageTokenExpired = errors.New("page token expired")
+
+// RecommendSnapshot is recommendation frozen when the first page is requested. Later pages are served from the
+// snapshot so that they don't shift when recommendation is refreshed.
+type RecommendSnapshot struct {
+	UserId     string
+	Category   string
+	Filter     string
+	Items      []string
+	CreateTime time.Time
+}
+
+// pageToken is the position of a page in a snapshot.
+type pageToken struct {
+	SnapshotId string `json:"s"`
+	Offset     int    `json:"o"`
+}
+
+func encodePageToken(token pageToken) string {
+	buf, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodePageToken(s string) (pageToken, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageToken{}, errors.NotValidf("page token")
+	}
+	var token pageToken
+	if err = json.Unmarshal(buf, &token); err != nil || token.SnapshotId == "" || token.Offset < 0 {
+		return pageToken{}, errors.NotValidf("page token")
+	}
+	return token, nil
+}
+
+// filter returns parameters of recommendation bound to snapshots.
+func (options recommendOptions) filter() string {
+	return fmt.Sprintf("%v-%v-%v-%v-%v", options.suppressImpressions, options.suppressionWindow,
+		options.exploreRatio, options.freshnessQuota, options.freshnessWindow)
+}
+
+// saveRecommendSnapshot saves a snapshot of recommendation and returns its identifier.
+func (s *RestServer) saveRecommendSnapshot(snapshot RecommendSnapshot) (string, error) {
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	snapshotId := uuid.New().String()
+	if err = s.CacheClient.Set(cache.String(cache.Key(cache.RecommendSnapshot, snapshotId), string(buf))); err != nil {
+		return "", errors.Trace(err)
+	}
+	return snapshotId, nil
+}
+
+// loadRecommendSnapshot loads a snapshot of recommendation. ErrPageTokenExpired is returned if the snapshot doesn't
+// exist or has expired.
+func (s *RestServer) loadRecommendSnapshot(snapshotId string) (RecommendSnapshot, error) {
+	value, err := s.CacheClient.Get(cache.Key(cache.RecommendSnapshot, snapshotId)).String()
+	if errors.Is(err, errors.NotFound) {
+		return RecommendSnapshot{}, ErrPageTokenExpired
+	} else if err != nil {
+		return RecommendSnapshot{}, errors.Trace(err)
+	}
+	var snapshot RecommendSnapshot
+	if err = json.Unmarshal([]byte(value), &snapshot); err != nil {
+		return RecommendSnapshot{}, errors.Trace(err)
+	}
+	if time.Since(snapshot.CreateTime) > s.Config.Server.PageTokenTTL {
+		return RecommendSnapshot{}, ErrPageTokenExpired
+	}
+	return snapshot, nil
+}
+
+// recommendPage returns a page of recommendation paged by tokens. Recommendation is frozen in a snapshot if no token
+// is given, otherwise the page is read from the snapshot of the token. The token of the next page is empty on the last
+// page.
+func (s *RestServer) recommendPage(response *restful.Response, userId, category, token string, n int, options recommendOptions) ([]string, string, error) {
+	var (
+		snapshot   RecommendSnapshot
+		snapshotId string
+		offset     int
+	)
+	if token == "" {
+		recommenders, err := s.recommendChain(options)
+		if err != nil {
+			return nil, "", errors.Trace(err)
+		}
+		items, err := s.Recommend(response, userId, category, s.Config.Recommend.CacheSizeOf(category), recommenders...)
+		if err != nil {
+			return nil, "", errors.Trace(err)
+		}
+		snapshot = RecommendSnapshot{
+			UserId:     userId,
+			Category:   category,
+			Filter:     options.filter(),
+			Items:      items,
+			CreateTime: time.Now(),
+		}
+		if snapshotId, err = s.saveRecommendSnapshot(snapshot); err != nil {
+			return nil, "", errors.Trace(err)
+		}
+	} else {
+		decoded, err := decodePageToken(token)
+		if err != nil {
+			return nil, "", err
+		}
+		if snapshot, err = s.loadRecommendSnapshot(decoded.SnapshotId); err != nil {
+			return nil, "", err
+		}
+		if snapshot.UserId != userId || snapshot.Category != category || snapshot.Filter != options.filter() {
+			return nil, "", errors.NotValidf("page token of other recommendation")
+		}
+		snapshotId, offset = decoded.SnapshotId, decoded.Offset
+	}
+	begin, end := offset, offset+n
+	if begin > len(snapshot.Items) {
+		begin = len(snapshot.Items)
+	}
+	if end > len(snapshot.Items) {
+		end = len(snapshot.Items)
+	}
+	var next string
+	if end < len(snapshot.Items) {
+		next = encodePageToken(pageToken{SnapshotId: snapshotId, Offset: end})
+	}
+	return snapshot.Items[begin:end], next, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+func TestPageToken(t *testing.T) {
+	token := encodePageToken(pageToken{SnapshotId: "snapshot", Offset: 10})
+	decoded, err := decodePageToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, pageToken{SnapshotId: "snapshot", Offset: 10}, decoded)
+	_, err = decodePageToken("!")
+	assert.Error(t, err)
+	_, err = decodePageToken(encodePageToken(pageToken{Offset: 10}))
+	assert.Error(t, err)
+}
+
+func TestServer_GetRecommends_PageToken(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert recommendation
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+	})
+	assert.NoError(t, err)
+	// the first page
+	result := apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "paging": "token"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2"})).
+		End()
+	token := result.Response.Header.Get(HeaderNextPageToken)
+	assert.NotEmpty(t, token)
+	// later pages are not changed by refreshed recommendation
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "6", Score: 99},
+		{Id: "7", Score: 98},
+	})
+	assert.NoError(t, err)
+	result = apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "page-token": token}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"3", "4"})).
+		End()
+	token = result.Response.Header.Get(HeaderNextPageToken)
+	assert.NotEmpty(t, token)
+	// the last page has no next token
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "page-token": token}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"5"})).
+		HeaderNotPresent(HeaderNextPageToken).
+		End()
+	// tokens are bound to users
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/1").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "page-token": token}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	// invalid tokens
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "page-token": "invalid"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestServer_GetRecommends_PageTokenExpired(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.PageTokenTTL = time.Minute
+	// insert snapshot
+	snapshotId, err := s.saveRecommendSnapshot(RecommendSnapshot{
+		UserId:     "0",
+		Filter:     recommendOptions{}.filter(),
+		Items:      []string{"1", "2", "3"},
+		CreateTime: time.Now().Add(-time.Hour),
+	})
+	assert.NoError(t, err)
+	// expired snapshot
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "page-token": encodePageToken(pageToken{SnapshotId: snapshotId, Offset: 2})}).
+		Expect(t).
+		Status(http.StatusGone).
+		End()
+	// missing snapshot
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "page-token": encodePageToken(pageToken{SnapshotId: "missing", Offset: 2})}).
+		Expect(t).
+		Status(http.StatusGone).
+		End()
+}
@@ -0,0 +1,216 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model/blend"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+const (
+	DecisionKept             = "kept"
+	DecisionHidden           = "hidden"
+	DecisionCategoryMismatch = "category_mismatch"
+	DecisionRead             = "read"
+	DecisionDuplicate        = "duplicate"
+	DecisionBlocked          = "blocked"
+)
+
+// RecommendPreview is the breakdown of recommendation for a user. Stages are listed in the order of fallback and
+// Results is the final list after filtering, merging, business rules and manual overrides. OfflineRecommendTime is
+// the time when the cached offline recommendation was generated, which is zero if there is no offline recommendation.
+// Overrides lists manual overrides of the user fired in the recommendation. BlendWeights and Blend are weights and
+// blended scores of results if score blending is enabled.
+type RecommendPreview struct {
+	UserId               string
+	Category             string
+	OfflineRecommendTime time.Time
+	StalenessSeconds     float64
+	Stages               []PreviewStage
+	Results              []string
+	Overrides            []FiredOverride
+	BlendWeights         *blend.Weights
+	Blend                []BlendedItem
+}
+
+// PreviewStage is candidates returned by a stage.
+type PreviewStage struct {
+	Name       string
+	Candidates []RecommendCandidate
+}
+
+// RecommendCandidate is a candidate with its filtering decision:
+//   - kept: the candidate could be recommended.
+//   - hidden: the candidate is hidden or outside its visibility window.
+//   - category_mismatch: the candidate has been removed from the category.
+//   - blocked: the candidate is blocked by manual overrides of the user.
+//   - read: the user has read or ignored the candidate.
+//   - duplicate: the candidate has been kept by a previous stage.
+type RecommendCandidate struct {
+	Id       string
+	Score    float64
+	Decision string
+}
+
+// previewStageItems is candidates of a stage before filtering.
+type previewStageItems struct {
+	name  string
+	items []cache.Scored
+}
+
+func (s *RestServer) getRecommendPreview(request *restful.Request, response *restful.Response) {
+	userId := request.PathParameter("user-id")
+	category := request.QueryParameter("category")
+	n, err := ParseInt(request, "n", s.Config.Server.DefaultN)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	preview, err := s.previewRecommend(response, userId, category, n)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	Ok(response, preview)
+}
+
+// previewRecommend collects candidates of offline, item-based, subscription, latest and popular stages, and runs the recommendation
+// chain of getRecommend without impression suppression. Feedback is never written back.
+func (s *RestServer) previewRecommend(response *restful.Response, userId, category string, n int) (*RecommendPreview, error) {
+	ctx, err := s.createRecommendContext(userId, category, n)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = s.requireUserOverrides(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// items hidden in the category but not globally are category mismatches
+	globalDelta := ctx.hiddenDelta
+	if category != "" {
+		documents, err := s.CacheClient.ReadDocuments(s.HiddenItemsManager.DeltaReads("")...)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		globalDelta = DeltaHiddenItems(documents)
+	}
+
+	// load candidates
+	itemBased, err := s.itemBasedCandidates(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	itemBasedScores := make([]cache.Scored, 0, len(itemBased))
+	for itemId, score := range itemBased {
+		itemBasedScores = append(itemBasedScores, cache.Scored{Id: itemId, Score: score})
+	}
+	cache.SortScores(itemBasedScores)
+	stages := []previewStageItems{
+		{config.StageOffline, ctx.offlineRecommend},
+		{config.StageItemBased, itemBasedScores},
+	}
+	// candidates of subscribed topics are listed if the subscription stage is in the fallback chain
+	if lo.Contains(s.Config.Recommend.Online.FallbackRecommend, config.StageSubscription) {
+		subscription, err := s.subscriptionCandidates(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		subscriptionScores := make([]cache.Scored, 0, len(subscription))
+		for itemId, score := range subscription {
+			subscriptionScores = append(subscriptionScores, cache.Scored{Id: itemId, Score: score})
+		}
+		cache.SortScores(subscriptionScores)
+		stages = append(stages, previewStageItems{config.StageSubscription, subscriptionScores})
+	}
+	latest, err := s.CacheClient.GetSorted(cache.Key(cache.LatestItems, category), 0, s.Config.Recommend.CacheSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	popular, err := s.CacheClient.GetSorted(cache.Key(cache.PopularItems, category), 0, s.Config.Recommend.CacheSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// make decisions
+	preview := &RecommendPreview{UserId: userId, Category: category}
+	if len(ctx.offlineRecommend) > 0 {
+		recommendTime, err := ctx.recommendTime.Time()
+		if err != nil && !errors.Is(err, errors.NotFound) {
+			return nil, errors.Trace(err)
+		} else if err == nil {
+			preview.OfflineRecommendTime = recommendTime
+			preview.StalenessSeconds = time.Since(recommendTime).Seconds()
+		}
+	}
+	keptSet := strset.New()
+	blockedSet := strset.New()
+	stages = append(stages, previewStageItems{config.StageLatest, latest}, previewStageItems{config.StagePopular, popular})
+	for _, stage := range stages {
+		// offline recommendation excludes read items once generated, others exclude read items in place
+		if stage.name != config.StageOffline {
+			if err = s.requireUserFeedback(ctx); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		itemIds := cache.RemoveScores(stage.items)
+		isHidden := s.HiddenItemsManager.IsHiddenWithDelta(itemIds, "", globalDelta)
+		isHiddenInCategory := s.HiddenItemsManager.IsHiddenWithDelta(itemIds, category, ctx.hiddenDelta)
+		candidates := make([]RecommendCandidate, len(stage.items))
+		for i, item := range stage.items {
+			candidates[i] = RecommendCandidate{Id: item.Id, Score: item.Score}
+			switch {
+			case isHidden[i]:
+				candidates[i].Decision = DecisionHidden
+			case isHiddenInCategory[i]:
+				candidates[i].Decision = DecisionCategoryMismatch
+			case ctx.isBlockedByOverrides(item.Id):
+				candidates[i].Decision = DecisionBlocked
+				if !blockedSet.Has(item.Id) {
+					blockedSet.Add(item.Id)
+					preview.Overrides = append(preview.Overrides, FiredOverride{ItemId: item.Id, Action: OverrideActionBlock})
+				}
+			case ctx.isExcluded(item.Id):
+				candidates[i].Decision = DecisionRead
+			case keptSet.Has(item.Id):
+				candidates[i].Decision = DecisionDuplicate
+			default:
+				candidates[i].Decision = DecisionKept
+				keptSet.Add(item.Id)
+			}
+		}
+		preview.Stages = append(preview.Stages, PreviewStage{Name: stage.name, Candidates: candidates})
+	}
+
+	// run recommenders
+	recommenders, err := s.recommendChain(s.defaultRecommendOptions())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	recommendCtx, err := s.recommend(response, userId, category, n, recommenders...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	preview.Results = recommendCtx.results
+	preview.Overrides = append(preview.Overrides, recommendCtx.firedOverrides...)
+	preview.BlendWeights = recommendCtx.blendWeights
+	preview.Blend = recommendCtx.blendedItems()
+	return preview, nil
+}
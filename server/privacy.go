@@ -0,0 +1,237 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// exportFeedbackBatchSize is the number of feedback read and written between flushes of an export.
+const exportFeedbackBatchSize = 1000
+
+// UserExport is everything about a user, including cached sorted sets (recommendation, neighbors and ignored items)
+// and cached values (timestamps and digests) keyed by cache keys.
+type UserExport struct {
+	User     data.User
+	Feedback []data.Feedback
+	Sorted   map[string][]cache.Scored
+	Values   map[string]string
+}
+
+// userCacheKeys returns keys of sorted sets and values about a user in the cache store.
+func (s *RestServer) userCacheKeys(userId string) (sortedKeys, valueKeys []string, err error) {
+	categories, err := s.CacheClient.GetSet(cache.ItemCategories)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	for _, category := range append([]string{""}, categories...) {
+		sortedKeys = append(sortedKeys,
+			cache.Key(cache.OfflineRecommend, userId, category),
+			cache.Key(cache.CollaborativeRecommend, userId, category))
+	}
+	sortedKeys = append(sortedKeys,
+		cache.Key(cache.UserNeighbors, userId),
+		cache.Key(cache.IgnoreItems, userId))
+	valueKeys = []string{
+		cache.Key(cache.OfflineRecommendDigest, userId),
+		cache.Key(cache.UserNeighborsDigest, userId),
+		cache.Key(cache.LastModifyUserTime, userId),
+		cache.Key(cache.LastUpdateUserRecommendTime, userId),
+		cache.Key(cache.LastUpdateUserNeighborsTime, userId),
+	}
+	return
+}
+
+// exportUser writes everything about a user as a JSON document. Feedback is read from the data store and flushed in
+// batches so that the document is streamed with chunked encoding.
+func (s *RestServer) exportUser(request *restful.Request, response *restful.Response) {
+	userId := request.PathParameter("user-id")
+	user, err := s.DataClient.GetUser(userId)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			PageNotFound(response, err)
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
+	// read cache before writing so that errors are reported by status codes
+	sortedKeys, valueKeys, err := s.userCacheKeys(userId)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	var reads []cache.Read
+	for _, key := range sortedKeys {
+		reads = append(reads, cache.ReadSorted(key, 0, -1))
+	}
+	for _, key := range valueKeys {
+		reads = append(reads, cache.ReadValue(key))
+	}
+	documents, err := s.CacheClient.ReadDocuments(reads...)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	sorted := make(map[string][]cache.Scored)
+	for i, key := range sortedKeys {
+		if len(documents[i].Scores) > 0 {
+			sorted[key] = documents[i].Scores
+		}
+	}
+	values := make(map[string]string)
+	for i, key := range valueKeys {
+		value, err := documents[len(sortedKeys)+i].Value.String()
+		if err != nil {
+			if errors.Is(err, errors.NotFound) {
+				continue
+			}
+			InternalServerError(response, err)
+			return
+		}
+		values[key] = value
+	}
+
+	// stream document
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	response.Header().Set("Content-Type", restful.MIME_JSON)
+	response.WriteHeader(http.StatusOK)
+	// writeRaw writes a fragment of the document, which isn't valid JSON by itself
+	writeRaw := func(s string) bool {
+		if _, err := io.WriteString(response, s); err != nil {
+			log.ResponseLogger(response).Error("failed to write json", zap.Error(err))
+			return false
+		}
+		return true
+	}
+	write := func(v any) bool {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			log.ResponseLogger(response).Error("failed to marshal json", zap.Error(err))
+			return false
+		}
+		if _, err = response.Write(buf); err != nil {
+			log.ResponseLogger(response).Error("failed to write json", zap.Error(err))
+			return false
+		}
+		return true
+	}
+	if !writeRaw(`{"User":`) || !write(user) || !writeRaw(`,"Feedback":[`) {
+		return
+	}
+	feedbackChan, errChan := s.DataClient.GetUserFeedbackStream(userId, exportFeedbackBatchSize)
+	numFeedback := 0
+	for batchFeedback := range feedbackChan {
+		for _, v := range batchFeedback {
+			if numFeedback > 0 && !writeRaw(`,`) {
+				return
+			}
+			if !write(v) {
+				return
+			}
+			numFeedback++
+		}
+		response.Flush()
+	}
+	if err = <-errChan; err != nil {
+		// the status has been sent, so the document is left incomplete
+		log.ResponseLogger(response).Error("failed to read feedback", zap.Error(err))
+		return
+	}
+	if !writeRaw(`],"Sorted":`) || !write(sorted) ||
+		!writeRaw(`,"Values":`) || !write(values) || !writeRaw(`}`) {
+		return
+	}
+	response.Flush()
+}
+
+// eraseUser removes a user, feedback and overrides of the user and cache entries about the user.
+func (s *RestServer) eraseUser(userId string) error {
+	feedback, err := s.DataClient.GetUserFeedback(userId, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = s.DataClient.DeleteUser(userId); err != nil {
+		return errors.Trace(err)
+	}
+	if err = s.DataClient.DeleteUserOverrides(userId); err != nil {
+		return errors.Trace(err)
+	}
+	// purge feedback of all types in case that some are left by the data store
+	itemIds := strset.New()
+	for _, v := range feedback {
+		itemIds.Add(v.ItemId)
+	}
+	for _, itemId := range itemIds.List() {
+		if _, err = s.DataClient.DeleteUserItemFeedback(userId, itemId); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	// remove cache entries, entries in sorted sets of others are collected before neighbors of the user are removed
+	sortedKeys, valueKeys, err := s.userCacheKeys(userId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	members, err := s.userCacheMembers(userId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, key := range sortedKeys {
+		if err = s.CacheClient.SetSorted(key, nil); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, key := range valueKeys {
+		if err = s.CacheClient.Delete(key); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(s.CacheClient.RemSorted(members...))
+}
+
+// userCacheMembers returns entries of a user in sorted sets of others: the priority refresh queue and neighbor lists
+// of other users. Neighbor lists are scanned if the cache store supports scanning, otherwise neighbor lists of the
+// neighbors of the user are checked since similarity is symmetric.
+func (s *RestServer) userCacheMembers(userId string) ([]cache.SetMember, error) {
+	members := []cache.SetMember{cache.Member(cache.PriorityRefreshUsers, userId)}
+	err := s.CacheClient.Scan(func(key string) error {
+		if strings.HasPrefix(key, cache.UserNeighbors+"/") && key != cache.Key(cache.UserNeighbors, userId) {
+			members = append(members, cache.Member(key, userId))
+		}
+		return nil
+	})
+	if errors.IsNotSupported(err) {
+		neighbors, err := s.CacheClient.GetSorted(cache.Key(cache.UserNeighbors, userId), 0, -1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, neighbor := range neighbors {
+			members = append(members, cache.Member(cache.Key(cache.UserNeighbors, neighbor.Id), userId))
+		}
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return members, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+// itemFields and userFields are names of fields in JSON of items and users.
+var (
+	itemFields = jsonFields(reflect.TypeOf(data.Item{}))
+	userFields = jsonFields(reflect.TypeOf(data.User{}))
+)
+
+func jsonFields(t reflect.Type) []string {
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = t.Field(i).Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// ParseFields parses the comma-separated fields query parameter. Fields are case-insensitive names in valid fields, and
+// they are returned in canonical names. Nil is returned if the parameter is absent.
+func ParseFields(request *restful.Request, valid []string) ([]string, error) {
+	param := request.QueryParameter("fields")
+	if param == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		field, ok := lo.Find(valid, func(field string) bool {
+			return strings.EqualFold(field, name)
+		})
+		if !ok {
+			return nil, errors.NotValidf("field %s", name)
+		}
+		fields = append(fields, field)
+	}
+	return lo.Uniq(fields), nil
+}
+
+// project keeps only fields in JSON of an object or a list of objects, while the id field is always kept. The object
+// is returned as it is if fields are nil.
+func project(v interface{}, idField string, fields []string) (interface{}, error) {
+	if fields == nil {
+		return v, nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	keep := func(object map[string]json.RawMessage) {
+		for name := range object {
+			if name != idField && !lo.Contains(fields, name) {
+				delete(object, name)
+			}
+		}
+	}
+	if reflect.ValueOf(v).Kind() == reflect.Slice {
+		var objects []map[string]json.RawMessage
+		if err = json.Unmarshal(buf, &objects); err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, object := range objects {
+			keep(object)
+		}
+		return objects, nil
+	}
+	var object map[string]json.RawMessage
+	if err = json.Unmarshal(buf, &object); err != nil {
+		return nil, errors.Trace(err)
+	}
+	keep(object)
+	return object, nil
+}
+
+// The following methods read only requested fields if the data store supports projection. Otherwise, all fields are
+// read and projected before responding.
+
+func (s *RestServer) getItemProjected(itemId string, fields []string) (data.Item, error) {
+	if projector, ok := s.DataClient.(data.Projector); ok && fields != nil {
+		return projector.GetItemProjected(itemId, fields)
+	}
+	return s.DataClient.GetItem(itemId)
+}
+
+func (s *RestServer) getItemsProjected(cursor string, n int, timeLimit *time.Time, fields []string) (string, []data.Item, error) {
+	if projector, ok := s.DataClient.(data.Projector); ok && fields != nil {
+		return projector.GetItemsProjected(cursor, n, timeLimit, fields)
+	}
+	return s.DataClient.GetItems(cursor, n, timeLimit)
+}
+
+func (s *RestServer) getUserProjected(userId string, fields []string) (data.User, error) {
+	if projector, ok := s.DataClient.(data.Projector); ok && fields != nil {
+		return projector.GetUserProjected(userId, fields)
+	}
+	return s.DataClient.GetUser(userId)
+}
+
+func (s *RestServer) getUsersProjected(cursor string, n int, fields []string) (string, []data.User, error) {
+	if projector, ok := s.DataClient.(data.Projector); ok && fields != nil {
+		return projector.GetUsersProjected(cursor, n, fields)
+	}
+	return s.DataClient.GetUsers(cursor, n)
+}
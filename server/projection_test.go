@@ -0,0 +1,109 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_ProjectItems(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	items := []data.Item{
+		{ItemId: "0", Labels: []string{"a"}, Categories: []string{"x"}, Comment: "zero", Timestamp: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "1", Labels: []string{"b"}, Categories: []string{"y"}, Comment: "one", Timestamp: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "2", IsHidden: true, Labels: []string{"c"}, Comment: "two", Timestamp: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	assert.NoError(t, s.DataClient.BatchInsertItems(items))
+
+	// project an item
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0").
+		Header("X-API-Key", apiKey).
+		Query("fields", "labels, Comment").
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"ItemId":"0","Labels":["a"],"Comment":"zero"}`).
+		End()
+	// project items
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/items").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"fields":      "Categories",
+			"visible-now": "true",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"Cursor":"","Items":[{"ItemId":"0","Categories":["x"]},{"ItemId":"1","Categories":["y"]}]}`).
+		End()
+	// invalid fields
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0").
+		Header("X-API-Key", apiKey).
+		Query("fields", "Unknown").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestServer_ProjectUsers(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	users := []data.User{
+		{UserId: "0", Labels: []string{"a"}, Comment: "zero"},
+		{UserId: "1", Labels: []string{"b"}, Comment: "one"},
+	}
+	assert.NoError(t, s.DataClient.BatchInsertUsers(users))
+
+	// project a user
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/0").
+		Header("X-API-Key", apiKey).
+		Query("fields", "Comment").
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"UserId":"0","Comment":"zero"}`).
+		End()
+	// project users
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/users").
+		Header("X-API-Key", apiKey).
+		Query("fields", "Labels").
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"Cursor":"","Users":[{"UserId":"0","Labels":["a"]},{"UserId":"1","Labels":["b"]}]}`).
+		End()
+	// invalid fields
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/users").
+		Header("X-API-Key", apiKey).
+		Query("fields", "ItemId").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
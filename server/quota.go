@@ -0,0 +1,252 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+const (
+	QuotaUsers = "users"
+	QuotaItems = "items"
+)
+
+// QuotaUsage is the usage of a quota. Limit is zero if the quota is unlimited.
+type QuotaUsage struct {
+	Count int
+	Limit int
+	Ratio float64
+}
+
+// QuotaState is the usage of quotas on users and items.
+type QuotaState struct {
+	Users        QuotaUsage
+	Items        QuotaUsage
+	WarningRatio float64
+}
+
+// NearLimit returns quotas whose usage reaches the warning ratio.
+func (state QuotaState) NearLimit() []string {
+	var quotas []string
+	if state.Users.Limit > 0 && state.Users.Ratio >= state.WarningRatio {
+		quotas = append(quotas, QuotaUsers)
+	}
+	if state.Items.Limit > 0 && state.Items.Ratio >= state.WarningRatio {
+		quotas = append(quotas, QuotaItems)
+	}
+	return quotas
+}
+
+// QuotaExceeded is the body of responses to inserts beyond a quota. Requested is the number of new users or items.
+type QuotaExceeded struct {
+	Quota     string
+	Count     int
+	Limit     int
+	Requested int
+}
+
+func (q *QuotaExceeded) Error() string {
+	return fmt.Sprintf("quota of %v exceeded: %v + %v > %v", q.Quota, q.Count, q.Requested, q.Limit)
+}
+
+// QuotaManager admits new users and items within quotas. Counts of users and items are cached for cache_expire and
+// increased by admitted inserts in the meantime, so that the data store isn't counted for every insert. Quotas are
+// soft since concurrent inserts might be admitted by stale counts.
+type QuotaManager struct {
+	server     *RestServer
+	mu         sync.Mutex
+	users      int
+	items      int
+	updateTime time.Time
+	increased  bool // counts have been increased since they were counted
+	test       bool
+}
+
+func NewQuotaManager(s *RestServer) *QuotaManager {
+	return &QuotaManager{server: s}
+}
+
+func newQuotaManagerForTest(s *RestServer) *QuotaManager {
+	return &QuotaManager{server: s, test: true}
+}
+
+// sync counts users and items in the data store if cached counts have expired, or if recount is true and cached counts
+// have been increased. The lock must be held.
+func (qm *QuotaManager) sync(recount bool) error {
+	if !qm.test && time.Since(qm.updateTime) < qm.server.Config.Server.CacheExpire && !(recount && qm.increased) {
+		return nil
+	}
+	users, err := qm.server.DataClient.CountUsers()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	items, err := qm.server.DataClient.CountItems()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	qm.users, qm.items, qm.updateTime, qm.increased = users, items, time.Now(), false
+	return nil
+}
+
+// State returns the usage of quotas.
+func (qm *QuotaManager) State() (QuotaState, error) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	if err := qm.sync(false); err != nil {
+		return QuotaState{}, errors.Trace(err)
+	}
+	quota := qm.server.Config.Server.Quota
+	return QuotaState{
+		Users:        newQuotaUsage(qm.users, quota.MaxUsers),
+		Items:        newQuotaUsage(qm.items, quota.MaxItems),
+		WarningRatio: quota.WarningRatio,
+	}, nil
+}
+
+func newQuotaUsage(count, limit int) QuotaUsage {
+	usage := QuotaUsage{Count: count, Limit: limit}
+	if limit > 0 {
+		usage.Ratio = float64(count) / float64(limit)
+	}
+	return usage
+}
+
+// AdmitUsers returns QuotaExceeded if inserting users exceeds the quota on users. Existing users aren't counted.
+func (qm *QuotaManager) AdmitUsers(userIds []string) error {
+	return qm.admit(QuotaUsers, qm.server.Config.Server.Quota.MaxUsers, &qm.users, userIds, func(ids []string) ([]string, error) {
+		var existed []string
+		for _, userId := range ids {
+			if _, err := qm.server.DataClient.GetUser(userId); err == nil {
+				existed = append(existed, userId)
+			} else if !errors.Is(err, errors.NotFound) {
+				return nil, errors.Trace(err)
+			}
+		}
+		return existed, nil
+	})
+}
+
+// AdmitItems returns QuotaExceeded if inserting items exceeds the quota on items. Existing items aren't counted.
+func (qm *QuotaManager) AdmitItems(itemIds []string) error {
+	return qm.admit(QuotaItems, qm.server.Config.Server.Quota.MaxItems, &qm.items, itemIds, func(ids []string) ([]string, error) {
+		items, _, err := qm.server.DataClient.BatchGetItems(ids)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		existed := make([]string, len(items))
+		for i, item := range items {
+			existed[i] = item.ItemId
+		}
+		return existed, nil
+	})
+}
+
+// admit admits new ids within the limit and increases the cached count. Since the cached count might be
+// overestimated, existing ids are looked up and increased counts are counted again only if the quota seems exceeded.
+func (qm *QuotaManager) admit(quota string, limit int, count *int, ids []string, existed func([]string) ([]string, error)) error {
+	if limit <= 0 {
+		return nil
+	}
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	if err := qm.sync(false); err != nil {
+		return errors.Trace(err)
+	}
+	newIds := strset.New(ids...)
+	if *count+newIds.Size() > limit {
+		if err := qm.sync(true); err != nil {
+			return errors.Trace(err)
+		}
+		existedIds, err := existed(newIds.List())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		newIds.Remove(existedIds...)
+		if *count+newIds.Size() > limit {
+			return &QuotaExceeded{Quota: quota, Count: *count, Limit: limit, Requested: newIds.Size()}
+		}
+	}
+	*count += newIds.Size()
+	qm.increased = true
+	return nil
+}
+
+// admitFeedback returns whether users and items of feedback are inserted automatically. Automatic insertion is skipped
+// if it exceeds quotas, while feedback is still accepted.
+func (s *RestServer) admitFeedback(feedback []data.Feedback) (autoInsertUser, autoInsertItem bool, err error) {
+	autoInsertUser, autoInsertItem = s.Config.Server.AutoInsertUser, s.Config.Server.AutoInsertItem
+	if s.QuotaManager == nil {
+		return
+	}
+	if autoInsertUser {
+		userIds := make([]string, len(feedback))
+		for i, f := range feedback {
+			userIds[i] = f.UserId
+		}
+		if err = s.QuotaManager.AdmitUsers(userIds); err != nil {
+			var quota *QuotaExceeded
+			if !errors.As(err, &quota) {
+				return false, false, errors.Trace(err)
+			}
+			autoInsertUser = false
+			log.Logger().Warn("skip inserting new users of feedback beyond quota", zap.Error(err))
+		}
+	}
+	if autoInsertItem {
+		itemIds := make([]string, len(feedback))
+		for i, f := range feedback {
+			itemIds[i] = f.ItemId
+		}
+		if err = s.QuotaManager.AdmitItems(itemIds); err != nil {
+			var quota *QuotaExceeded
+			if !errors.As(err, &quota) {
+				return false, false, errors.Trace(err)
+			}
+			autoInsertItem = false
+			log.Logger().Warn("skip inserting new items of feedback beyond quota", zap.Error(err))
+		}
+	}
+	return autoInsertUser, autoInsertItem, nil
+}
+
+// admitUsers returns false and responds 403 Forbidden if inserting users exceeds the quota on users.
+func (s *RestServer) admitUsers(response *restful.Response, users []data.User) bool {
+	if s.QuotaManager == nil {
+		return true
+	}
+	userIds := make([]string, len(users))
+	for i, user := range users {
+		userIds[i] = user.UserId
+	}
+	if err := s.QuotaManager.AdmitUsers(userIds); err != nil {
+		var quota *QuotaExceeded
+		if errors.As(err, &quota) {
+			Forbidden(response, quota)
+		} else {
+			InternalServerError(response, err)
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_InsertUsers_Quota(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.Quota.MaxUsers = 2
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/users").
+		Header("X-API-Key", apiKey).
+		JSON([]data.User{{UserId: "0"}, {UserId: "1"}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 2}`).
+		End()
+	// existing users aren't counted
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/user").
+		Header("X-API-Key", apiKey).
+		JSON(data.User{UserId: "1", Comment: "modified"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	// new users beyond the quota are rejected
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/users").
+		Header("X-API-Key", apiKey).
+		JSON([]data.User{{UserId: "1"}, {UserId: "2"}}).
+		Expect(t).
+		Status(http.StatusForbidden).
+		Body(marshal(t, QuotaExceeded{Quota: QuotaUsers, Count: 2, Limit: 2, Requested: 1})).
+		End()
+	_, err := s.DataClient.GetUser("2")
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
+
+func TestServer_InsertItems_Quota(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.Quota.MaxItems = 1
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/item").
+		Header("X-API-Key", apiKey).
+		JSON(Item{ItemId: "0"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/items").
+		Header("X-API-Key", apiKey).
+		JSON([]Item{{ItemId: "0"}, {ItemId: "1"}}).
+		Expect(t).
+		Status(http.StatusForbidden).
+		Body(marshal(t, QuotaExceeded{Quota: QuotaItems, Count: 1, Limit: 1, Requested: 1})).
+		End()
+	_, err := s.DataClient.GetItem("1")
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
+
+func TestServer_InsertFeedback_Quota(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.Quota.MaxUsers = 1
+	s.Config.Server.Quota.MaxItems = 1
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0"}})
+	assert.NoError(t, err)
+	// feedback is accepted while new users and items beyond quotas aren't inserted
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "1", ItemId: "1"}}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	_, err = s.DataClient.GetItem("0")
+	assert.NoError(t, err)
+	_, err = s.DataClient.GetUser("1")
+	assert.True(t, errors.Is(err, errors.NotFound))
+	_, err = s.DataClient.GetItem("1")
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
@@ -0,0 +1,265 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+const (
+	// ReadOnlyCode is the code of responses to writes rejected in read-only mode.
+	ReadOnlyCode = "read_only"
+
+	readOnlyConfigReason  = "read_only is set in the config file"
+	readOnlyDefaultReason = "maintenance"
+	readOnlyDefaultTTL    = time.Hour
+)
+
+// readOnlyWritableRoutes are routes accepting non-GET requests in read-only mode, since they write nothing or they are
+// needed to leave read-only mode.
+var readOnlyWritableRoutes = []string{
+	"/api/session/recommend",
+	"/api/session/recommend/{category}",
+	"/api/admin/read-only",
+}
+
+// ReadOnlyState is the read-only state of the cluster. Read-only mode is turned on by the config file or by the admin
+// API until the deadline.
+type ReadOnlyState struct {
+	ReadOnly bool
+	Reason   string
+	Since    time.Time
+	Until    time.Time
+}
+
+// ReadOnlyRejected is the body of responses to writes rejected in read-only mode.
+type ReadOnlyRejected struct {
+	Code   string
+	Reason string
+	Until  time.Time
+}
+
+// Health is the health of a node.
+type Health struct {
+	ReadOnly ReadOnlyState
+}
+
+// ReadOnlyManager keeps the read-only state set by the admin API in memory and reloads it from the cache store
+// periodically. Callbacks are called once writes are enabled again.
+type ReadOnlyManager struct {
+	server     *RestServer
+	mu         sync.RWMutex
+	state      ReadOnlyState
+	readOnly   bool
+	onWritable []func()
+	test       bool
+}
+
+func NewReadOnlyManager(s *RestServer) *ReadOnlyManager {
+	m := &ReadOnlyManager{server: s}
+	go func() {
+		for {
+			m.sync()
+			log.Logger().Debug("refresh read-only state", zap.String("cache_expire", s.Config.Server.CacheExpire.String()))
+			time.Sleep(s.Config.Server.CacheExpire)
+		}
+	}()
+	return m
+}
+
+func newReadOnlyManagerForTest(s *RestServer) *ReadOnlyManager {
+	return &ReadOnlyManager{server: s, test: true}
+}
+
+// OnWritable registers a callback called once writes are enabled again.
+func (m *ReadOnlyManager) OnWritable(callback func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onWritable = append(m.onWritable, callback)
+}
+
+func (m *ReadOnlyManager) sync() {
+	state, err := loadReadOnlyState(m.server.CacheClient)
+	if err != nil {
+		if !errors.Is(err, errors.NotAssigned) {
+			log.Logger().Error("failed to load read-only state", zap.Error(err))
+		}
+		return
+	}
+	m.set(state)
+}
+
+// set replaces the read-only state, and calls callbacks if writes are enabled again.
+func (m *ReadOnlyManager) set(state ReadOnlyState) {
+	effective := m.server.effectiveReadOnly(state, time.Now())
+	m.mu.Lock()
+	m.state = state
+	wasReadOnly := m.readOnly
+	m.readOnly = effective.ReadOnly
+	callbacks := m.onWritable
+	m.mu.Unlock()
+	if effective.ReadOnly {
+		ReadOnlyMode.Set(1)
+	} else {
+		ReadOnlyMode.Set(0)
+	}
+	if effective.ReadOnly != wasReadOnly {
+		log.Logger().Info("switch read-only mode", zap.Bool("read_only", effective.ReadOnly), zap.String("reason", effective.Reason))
+	}
+	if wasReadOnly && !effective.ReadOnly {
+		for _, callback := range callbacks {
+			callback()
+		}
+	}
+}
+
+// State returns the read-only state. Writes are enabled once the deadline passes, even if the state hasn't been
+// reloaded.
+func (m *ReadOnlyManager) State() ReadOnlyState {
+	if m.test {
+		m.sync()
+	}
+	m.mu.RLock()
+	state, readOnly := m.state, m.readOnly
+	m.mu.RUnlock()
+	effective := m.server.effectiveReadOnly(state, time.Now())
+	if effective.ReadOnly != readOnly {
+		m.set(state)
+	}
+	return effective
+}
+
+func loadReadOnlyState(client cache.Database) (ReadOnlyState, error) {
+	text, err := client.Get(cache.ReadOnly).String()
+	if errors.Is(err, errors.NotFound) {
+		return ReadOnlyState{}, nil
+	} else if err != nil {
+		return ReadOnlyState{}, errors.Trace(err)
+	}
+	var state ReadOnlyState
+	if err = json.Unmarshal([]byte(text), &state); err != nil {
+		return ReadOnlyState{}, errors.Trace(err)
+	}
+	return state, nil
+}
+
+// ReadOnlyState returns the read-only state of the cluster.
+func (s *RestServer) ReadOnlyState() ReadOnlyState {
+	if s.ReadOnlyManager != nil {
+		return s.ReadOnlyManager.State()
+	}
+	return s.effectiveReadOnly(ReadOnlyState{}, time.Now())
+}
+
+// effectiveReadOnly returns the read-only state at the time. The config file takes precedence over the admin API.
+func (s *RestServer) effectiveReadOnly(state ReadOnlyState, now time.Time) ReadOnlyState {
+	if s.Config.Server.ReadOnly {
+		return ReadOnlyState{ReadOnly: true, Reason: readOnlyConfigReason}
+	}
+	if state.ReadOnly && now.Before(state.Until) {
+		return state
+	}
+	return ReadOnlyState{}
+}
+
+// RejectReadOnly responds 503 and returns true if the cluster is read-only.
+func (s *RestServer) RejectReadOnly(response *restful.Response) bool {
+	state := s.ReadOnlyState()
+	if !state.ReadOnly {
+		return false
+	}
+	ReadOnlyRejectedTotal.Inc()
+	ServiceUnavailable(response, ReadOnlyRejected{Code: ReadOnlyCode, Reason: state.Reason, Until: state.Until})
+	return true
+}
+
+// ReadOnlyFilter rejects writes in read-only mode. GET requests, dashboard APIs and routes writing nothing are
+// accepted.
+func (s *RestServer) ReadOnlyFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	method := req.Request.Method
+	if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions ||
+		strings.HasPrefix(req.SelectedRoutePath(), "/api/dashboard/") {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	for _, route := range readOnlyWritableRoutes {
+		if req.SelectedRoutePath() == route {
+			chain.ProcessFilter(req, resp)
+			return
+		}
+	}
+	if !s.RejectReadOnly(resp) {
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+// setReadOnly turns on read-only mode for the TTL, or turns it off.
+func (s *RestServer) setReadOnly(request *restful.Request, response *restful.Response) {
+	enable, err := ParseBool(request, "enable", true)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	ttl, err := ParseDuration(request, "ttl")
+	if err != nil {
+		BadRequest(response, err)
+		return
+	} else if ttl == 0 {
+		ttl = readOnlyDefaultTTL
+	} else if ttl < 0 {
+		BadRequest(response, errors.NotValidf("ttl %v", ttl))
+		return
+	}
+	state := ReadOnlyState{}
+	if enable {
+		now := time.Now()
+		state = ReadOnlyState{ReadOnly: true, Reason: request.QueryParameter("reason"), Since: now, Until: now.Add(ttl)}
+		if state.Reason == "" {
+			state.Reason = readOnlyDefaultReason
+		}
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if err = s.CacheClient.Set(cache.String(cache.ReadOnly, string(buf))); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	// other nodes reload the state periodically
+	if s.ReadOnlyManager != nil {
+		s.ReadOnlyManager.set(state)
+	}
+	Ok(response, s.ReadOnlyState())
+}
+
+func (s *RestServer) getReadOnly(_ *restful.Request, response *restful.Response) {
+	Ok(response, s.ReadOnlyState())
+}
+
+func (s *RestServer) getHealth(_ *restful.Request, response *restful.Response) {
+	Ok(response, Health{ReadOnly: s.ReadOnlyState()})
+}
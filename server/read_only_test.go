@@ -0,0 +1,171 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_ReadOnly(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+
+	// turn on read-only mode
+	request, err := http.NewRequest(http.MethodPost, "/api/admin/read-only?ttl=10m&reason=migration", nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var state ReadOnlyState
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &state))
+	assert.True(t, state.ReadOnly)
+	assert.Equal(t, "migration", state.Reason)
+	assert.Equal(t, 10*time.Minute, state.Until.Sub(state.Since))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ReadOnlyMode))
+
+	// writes are rejected
+	request, err = http.NewRequest(http.MethodPost, "/api/user", nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+	recorder = httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	var rejected ReadOnlyRejected
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &rejected))
+	assert.Equal(t, ReadOnlyCode, rejected.Code)
+	assert.Equal(t, "migration", rejected.Reason)
+	assert.True(t, state.Until.Equal(rejected.Until))
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/item/1").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusServiceUnavailable).
+		End()
+
+	// reads and writing nothing are accepted
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/1").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/recommend").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/health").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, Health{ReadOnly: state})).
+		End()
+
+	// turn off read-only mode
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/read-only").
+		QueryParams(map[string]string{"enable": "false"}).
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, ReadOnlyState{})).
+		End()
+	assert.Equal(t, 0.0, testutil.ToFloat64(ReadOnlyMode))
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/user").
+		Header("X-API-Key", apiKey).
+		JSON(data.User{UserId: "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestServer_ReadOnlyExpired(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+
+	// read-only mode is turned off after the TTL
+	now := time.Now()
+	buf, err := json.Marshal(ReadOnlyState{ReadOnly: true, Reason: "migration", Since: now.Add(-time.Hour), Until: now.Add(-time.Minute)})
+	assert.NoError(t, err)
+	assert.NoError(t, s.CacheClient.Set(cache.String(cache.ReadOnly, string(buf))))
+	assert.False(t, s.ReadOnlyState().ReadOnly)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/user").
+		Header("X-API-Key", apiKey).
+		JSON(data.User{UserId: "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	// callbacks are called once writes are enabled again
+	called := 0
+	s.ReadOnlyManager.OnWritable(func() { called++ })
+	buf, err = json.Marshal(ReadOnlyState{ReadOnly: true, Reason: "migration", Since: now, Until: now.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.NoError(t, s.CacheClient.Set(cache.String(cache.ReadOnly, string(buf))))
+	assert.True(t, s.ReadOnlyState().ReadOnly)
+	assert.Zero(t, called)
+	assert.NoError(t, s.CacheClient.Set(cache.String(cache.ReadOnly, "{}")))
+	assert.False(t, s.ReadOnlyState().ReadOnly)
+	assert.Equal(t, 1, called)
+}
+
+func TestServer_ReadOnlyConfig(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.ReadOnly = true
+
+	// the config file can't be overridden by the admin API
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/admin/read-only").
+		QueryParams(map[string]string{"enable": "false"}).
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, ReadOnlyState{ReadOnly: true, Reason: readOnlyConfigReason})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/user").
+		Header("X-API-Key", apiKey).
+		JSON(data.User{UserId: "1"}).
+		Expect(t).
+		Status(http.StatusServiceUnavailable).
+		Body(marshal(t, ReadOnlyRejected{Code: ReadOnlyCode, Reason: readOnlyConfigReason})).
+		End()
+}
@@ -15,12 +15,19 @@
 package server
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/araddon/dateparse"
@@ -33,12 +40,17 @@ import (
 	"github.com/scylladb/go-set"
 	"github.com/scylladb/go-set/strset"
 	"github.com/thoas/go-funk"
+	"github.com/zhenghaoz/gorse/base/bloom"
 	"github.com/zhenghaoz/gorse/base/heap"
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model/blend"
+	"github.com/zhenghaoz/gorse/model/rerank"
+	"github.com/zhenghaoz/gorse/storage"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 	"modernc.org/mathutil"
 )
 
@@ -53,8 +65,28 @@ type RestServer struct {
 	WebService *restful.WebService
 	HttpServer *http.Server
 
+	httpServerMutex  sync.Mutex // guards HttpServer between serving and shutdown
+	httpServerClosed bool       // true once the server is shut down
+
 	PopularItemsCache  *PopularItemsCache
 	HiddenItemsManager *HiddenItemsManager
+	RulesManager       *RulesManager
+	DuplicatesManager  *DuplicatesManager
+	ActivityTracker    *ActivityTracker
+	QuotaManager       *QuotaManager
+	AuditLogger        *AuditLogger
+	WriteBackBuffer    *WriteBackBuffer
+	HistoryArchiver    *HistoryArchiver
+	ReadOnlyManager    *ReadOnlyManager
+	UsageCounter       *UsageCounter
+	ShadowTraffic      *ShadowTraffic
+	ItemEnricher       *ItemEnricher
+	DegradedCache      *DegradedCache
+	Reranker           *rerank.Reranker
+
+	cacheBreaker *cache.CircuitBreaker // stops accessing the cache store while it is down
+	warmingUp    int32                 // non-zero until the local cache is warmed up
+	coalescer    singleflight.Group    // coalesces concurrent reads of the same data
 }
 
 // StartHttpServer starts the REST-ful API server.
@@ -87,15 +119,37 @@ func (s *RestServer) StartHttpServer(container *restful.Container) {
 		zap.Strings("cors_methods", s.Config.Master.HttpCorsMethods),
 		zap.Strings("cors_doamins", s.Config.Master.HttpCorsDomains),
 	)
-	s.HttpServer = &http.Server{
+	s.httpServerMutex.Lock()
+	if s.httpServerClosed {
+		// the server is shut down before it starts
+		s.httpServerMutex.Unlock()
+		return
+	}
+	httpServer := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", s.HttpHost, s.HttpPort),
 		Handler: container,
 	}
-	if err := s.HttpServer.ListenAndServe(); err != http.ErrServerClosed {
+	s.HttpServer = httpServer
+	s.httpServerMutex.Unlock()
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		log.Logger().Fatal("failed to start http server", zap.Error(err))
 	}
 }
 
+// ShutdownHttpServer stops accepting requests and waits for in-flight requests until the drain timeout expires.
+func (s *RestServer) ShutdownHttpServer() error {
+	s.httpServerMutex.Lock()
+	s.httpServerClosed = true
+	httpServer := s.HttpServer
+	s.httpServerMutex.Unlock()
+	if httpServer == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.Config.Server.DrainTimeout)
+	defer cancel()
+	return httpServer.Shutdown(ctx)
+}
+
 func (s *RestServer) LogFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 	// generate request id
 	requestId := uuid.New().String()
@@ -118,7 +172,7 @@ func (s *RestServer) AuthFilter(req *restful.Request, resp *restful.Response, ch
 		return
 	}
 	apikey := req.HeaderParameter("X-API-Key")
-	if apikey == s.Config.Server.APIKey {
+	if apikey == s.Config.Server.APIKey || (s.Config.Server.AdminAPIKey != "" && apikey == s.Config.Server.AdminAPIKey) {
 		chain.ProcessFilter(req, resp)
 		return
 	}
@@ -130,6 +184,28 @@ func (s *RestServer) AuthFilter(req *restful.Request, resp *restful.Response, ch
 	}
 }
 
+// AdminFilter restricts administrative APIs to requests with the admin API key. Administrative APIs are guarded by
+// AuthFilter only if the admin API key is empty.
+func (s *RestServer) AdminFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if s.checkAdmin(req, resp) {
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+// checkAdmin returns true if the request carries the admin API key or the admin API key is empty. Otherwise, 403 is
+// responded.
+func (s *RestServer) checkAdmin(req *restful.Request, resp *restful.Response) bool {
+	apikey := req.HeaderParameter("X-API-Key")
+	if s.Config.Server.AdminAPIKey == "" || apikey == s.Config.Server.AdminAPIKey {
+		return true
+	}
+	log.ResponseLogger(resp).Error("forbidden", zap.String("X-API-Key", apikey))
+	if err := resp.WriteError(http.StatusForbidden, fmt.Errorf("forbidden")); err != nil {
+		log.ResponseLogger(resp).Error("failed to write error", zap.Error(err))
+	}
+	return false
+}
+
 func (s *RestServer) MetricsFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 	startTime := time.Now()
 	chain.ProcessFilter(req, resp)
@@ -138,6 +214,11 @@ func (s *RestServer) MetricsFilter(req *restful.Request, resp *restful.Response,
 		if !strings.HasPrefix(routePath, "/api/dashboard") {
 			RestAPIRequestSecondsVec.WithLabelValues(fmt.Sprintf("%s %s", req.Request.Method, routePath)).
 				Observe(time.Since(startTime).Seconds())
+			s.AddUsage(UsageRequests+req.Request.Method+" "+routePath, 1)
+		}
+	} else if req.SelectedRoute() != nil && resp.StatusCode() >= http.StatusInternalServerError {
+		if !strings.HasPrefix(req.SelectedRoutePath(), "/api/dashboard") {
+			s.AddUsage(UsageServerErrors, 1)
 		}
 	}
 }
@@ -150,12 +231,14 @@ func (s *RestServer) CreateWebService() {
 		Produces(restful.MIME_JSON).
 		Filter(s.LogFilter).
 		Filter(s.AuthFilter).
-		Filter(s.MetricsFilter)
+		Filter(s.MetricsFilter).
+		Filter(s.ReadOnlyFilter)
 
 	/* Interactions with data store */
 
 	// Insert a user
 	ws.Route(ws.POST("/user").To(s.insertUser).
+		Filter(s.AuditFilter).
 		Doc("Insert a user.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -163,22 +246,46 @@ func (s *RestServer) CreateWebService() {
 		Reads(data.User{}))
 	// Modify a user
 	ws.Route(ws.PATCH("/user/{user-id}").To(s.modifyUser).
+		Filter(s.AuditFilter).
 		Doc("Modify a user.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "version of the user, which is modified only if it is at the version").DataType("string")).
 		Param(ws.PathParameter("user-id", "user id").DataType("string")).
 		Reads(data.UserPatch{}).
-		Returns(200, "OK", Success{}))
+		Returns(200, "OK", Success{}).
+		Returns(409, "Conflict", data.User{}))
+	// Manage subscribed topics of a user
+	ws.Route(ws.PUT("/user/{user-id}/subscribe/{topic}").To(s.addSubscribe).
+		Filter(s.AuditFilter).
+		Doc("Subscribe a topic, which is a label or a category of items. Existing topics are kept.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Param(ws.PathParameter("topic", "subscribed topic").DataType("string")).
+		Returns(200, "OK", Success{}).
+		Writes(Success{}))
+	ws.Route(ws.DELETE("/user/{user-id}/subscribe/{topic}").To(s.removeSubscribe).
+		Filter(s.AuditFilter).
+		Doc("Unsubscribe a topic. Other topics are kept.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Param(ws.PathParameter("topic", "subscribed topic").DataType("string")).
+		Returns(200, "OK", Success{}).
+		Writes(Success{}))
 	// Get a user
 	ws.Route(ws.GET("/user/{user-id}").To(s.getUser).
 		Doc("Get a user.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Param(ws.QueryParameter("fields", "comma-separated fields of the user returned, all fields by default").DataType("string")).
 		Returns(200, "OK", data.User{}).
 		Writes(data.User{}))
 	// Insert users
 	ws.Route(ws.POST("/users").To(s.insertUsers).
+		Filter(s.AuditFilter).
 		Doc("Insert users.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -191,19 +298,69 @@ func (s *RestServer) CreateWebService() {
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.QueryParameter("n", "number of returned users").DataType("integer")).
 		Param(ws.QueryParameter("cursor", "cursor for next page").DataType("string")).
+		Param(ws.QueryParameter("fields", "comma-separated fields of users returned, all fields by default").DataType("string")).
 		Returns(200, "OK", UserIterator{}).
 		Writes(UserIterator{}))
+	// Sample users
+	ws.Route(ws.GET("/users/sample").To(s.sampleUsers).
+		Doc("Sample random users. Users are sampled uniformly except SQLite, and the same users are sampled under the same seed except MongoDB.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.QueryParameter("n", "number of sampled users, at most 1000").DataType("integer")).
+		Param(ws.QueryParameter("has-feedback", "only sample users with feedback").DataType("boolean")).
+		Param(ws.QueryParameter("seed", "seed of the sample, random by default").DataType("integer")).
+		Returns(200, "OK", []data.User{}).
+		Writes([]data.User{}))
 	// Delete a user
 	ws.Route(ws.DELETE("/user/{user-id}").To(s.deleteUser).
+		Filter(s.AuditFilter).
 		Doc("Delete a user and his or her feedback.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Param(ws.QueryParameter("erase", "erase feedback of all types and cache entries about the user (admin api key is required)").DataType("boolean")).
+		Returns(200, "OK", Success{}).
+		Writes(Success{}))
+	// Export a user
+	ws.Route(ws.GET("/user/{user-id}/export").To(s.exportUser).
+		Filter(s.AdminFilter).
+		Doc("Export the user, his or her feedback and cache entries about the user.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Returns(200, "OK", UserExport{}).
+		Writes(UserExport{}))
+	// Manage overrides of a user
+	ws.Route(ws.GET("/user/{user-id}/overrides").To(s.getUserOverrides).
+		Filter(s.AdminFilter).
+		Doc("Get pinned items and blocked items of a user.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Returns(200, "OK", data.UserOverrides{}).
+		Writes(data.UserOverrides{}))
+	ws.Route(ws.PUT("/user/{user-id}/overrides").To(s.setUserOverrides).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Set pinned items and blocked items of a user. Previous overrides are replaced.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Reads(data.UserOverrides{}).
+		Returns(200, "OK", Success{}))
+	ws.Route(ws.DELETE("/user/{user-id}/overrides").To(s.deleteUserOverrides).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Delete pinned items and blocked items of a user.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
 		Returns(200, "OK", Success{}).
 		Writes(Success{}))
 
 	// Insert an item
 	ws.Route(ws.POST("/item").To(s.insertItem).
+		Filter(s.AuditFilter).
 		Doc("Insert an item. Overwrite if the item exists.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -211,12 +368,15 @@ func (s *RestServer) CreateWebService() {
 		Reads(data.Item{}))
 	// Modify an item
 	ws.Route(ws.PATCH("/item/{item-id}").To(s.modifyItem).
+		Filter(s.AuditFilter).
 		Doc("Modify an item.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "version of the item, which is modified only if it is at the version").DataType("string")).
 		Param(ws.PathParameter("item-id", "item id").DataType("string")).
 		Reads(data.ItemPatch{}).
-		Returns(200, "OK", Success{}))
+		Returns(200, "OK", Success{}).
+		Returns(409, "Conflict", data.Item{}))
 	// Get items
 	ws.Route(ws.GET("/items").To(s.getItems).
 		Doc("Get items.").
@@ -224,24 +384,46 @@ func (s *RestServer) CreateWebService() {
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
 		Param(ws.QueryParameter("cursor", "cursor for next page").DataType("string")).
+		Param(ws.QueryParameter("visible-now", "only return items could be recommended now").DataType("boolean")).
+		Param(ws.QueryParameter("fields", "comma-separated fields of items returned, all fields by default").DataType("string")).
 		Returns(200, "OK", ItemIterator{}).
 		Writes(ItemIterator{}))
+	// Sample items
+	ws.Route(ws.GET("/items/sample").To(s.sampleItems).
+		Doc("Sample random items which aren't hidden. Items are sampled uniformly except SQLite, and the same items are sampled under the same seed except MongoDB.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.QueryParameter("n", "number of sampled items, at most 1000").DataType("integer")).
+		Param(ws.QueryParameter("category", "category of sampled items").DataType("string")).
+		Param(ws.QueryParameter("seed", "seed of the sample, random by default").DataType("integer")).
+		Returns(200, "OK", []data.Item{}).
+		Writes([]data.Item{}))
+	// Get categories
+	ws.Route(ws.GET("/categories").To(s.getCategories).
+		Doc("Get categories and numbers of items in them.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Returns(200, "OK", Categories{}).
+		Writes(Categories{}))
 	// Get item
 	ws.Route(ws.GET("/item/{item-id}").To(s.getItem).
 		Doc("Get a item.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.PathParameter("item-id", "item id").DataType("string")).
+		Param(ws.QueryParameter("fields", "comma-separated fields of the item returned, all fields by default").DataType("string")).
 		Returns(200, "OK", data.Item{}).
 		Writes(data.Item{}))
 	// Insert items
 	ws.Route(ws.POST("/items").To(s.insertItems).
+		Filter(s.AuditFilter).
 		Doc("Insert items. Overwrite if items exist").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Reads([]data.Item{}))
 	// Delete item
 	ws.Route(ws.DELETE("/item/{item-id}").To(s.deleteItem).
+		Filter(s.AuditFilter).
 		Doc("Delete an item and its feedback.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -250,6 +432,7 @@ func (s *RestServer) CreateWebService() {
 		Writes(Success{}))
 	// Insert category
 	ws.Route(ws.PUT("/item/{item-id}/category/{category}").To(s.insertItemCategory).
+		Filter(s.AuditFilter).
 		Doc("Insert a category for a item").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -259,6 +442,7 @@ func (s *RestServer) CreateWebService() {
 		Writes(Success{}))
 	// Delete category
 	ws.Route(ws.DELETE("/item/{item-id}/category/{category}").To(s.deleteItemCategory).
+		Filter(s.AuditFilter).
 		Doc("Delete a category from a item").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -269,12 +453,16 @@ func (s *RestServer) CreateWebService() {
 
 	// Insert feedback
 	ws.Route(ws.POST("/feedback").To(s.insertFeedback(false)).
+		Filter(s.AuditFilter).
+		Filter(s.ShadowTrafficFilter).
 		Doc("Insert feedbacks. Ignore insertion if feedback exists.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Reads([]data.Feedback{}).
 		Returns(200, "OK", Success{}))
 	ws.Route(ws.PUT("/feedback").To(s.insertFeedback(true)).
+		Filter(s.AuditFilter).
+		Filter(s.ShadowTrafficFilter).
 		Doc("Insert feedbacks. Existed feedback will be overwritten.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -298,6 +486,7 @@ func (s *RestServer) CreateWebService() {
 		Returns(200, "OK", []data.Feedback{}).
 		Writes([]data.Feedback{}))
 	ws.Route(ws.DELETE("/feedback/{user-id}/{item-id}").To(s.deleteUserItemFeedback).
+		Filter(s.AuditFilter).
 		Doc("Delete feedbacks between a user and a item.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -305,6 +494,18 @@ func (s *RestServer) CreateWebService() {
 		Param(ws.PathParameter("item-id", "item id").DataType("string")).
 		Returns(200, "OK", []data.Feedback{}).
 		Writes([]data.Feedback{}))
+	ws.Route(ws.DELETE("/feedback/{user-id}").To(s.deleteUserFeedbackInRange).
+		Filter(s.AuditFilter).
+		Doc("Delete feedbacks of a user in a time range.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Param(ws.QueryParameter("type", "feedback types to delete (all types if empty)").DataType("string").AllowMultiple(true)).
+		Param(ws.QueryParameter("begin", "delete feedbacks timestamped at or after the time").DataType("string")).
+		Param(ws.QueryParameter("end", "delete feedbacks timestamped before the time").DataType("string")).
+		Param(ws.QueryParameter("confirm", "confirm to delete all feedbacks if both begin and end are empty").DataType("boolean")).
+		Returns(200, "OK", Success{}).
+		Writes(Success{}))
 	ws.Route(ws.GET("/feedback/{feedback-type}").To(s.getTypedFeedback).
 		Doc("Get feedbacks with feedback type.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
@@ -324,6 +525,7 @@ func (s *RestServer) CreateWebService() {
 		Returns(200, "OK", data.Feedback{}).
 		Writes(data.Feedback{}))
 	ws.Route(ws.DELETE("/feedback/{feedback-type}/{user-id}/{item-id}").To(s.deleteTypedUserItemFeedback).
+		Filter(s.AuditFilter).
 		Doc("Delete feedbacks between a user and a item with feedback type.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -392,6 +594,7 @@ func (s *RestServer) CreateWebService() {
 
 	// Get popular items
 	ws.Route(ws.GET("/popular").To(s.getPopular).
+		Filter(s.ETagFilter).
 		Doc("Get popular items").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -400,6 +603,7 @@ func (s *RestServer) CreateWebService() {
 		Returns(200, "OK", []string{}).
 		Writes([]string{}))
 	ws.Route(ws.GET("/popular/{category}").To(s.getPopular).
+		Filter(s.ETagFilter).
 		Doc("Get popular items in category").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -408,9 +612,30 @@ func (s *RestServer) CreateWebService() {
 		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
 		Returns(http.StatusOK, "OK", []string{}).
 		Writes([]string{}))
+	// Get trending items
+	ws.Route(ws.GET("/trending").To(s.getTrending).
+		Filter(s.ETagFilter).
+		Doc("Get trending items").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
+		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Returns(http.StatusOK, "OK", []cache.Scored{}).
+		Writes([]cache.Scored{}))
+	ws.Route(ws.GET("/trending/{category}").To(s.getTrending).
+		Filter(s.ETagFilter).
+		Doc("Get trending items in category").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("category", "item category").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
+		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Returns(http.StatusOK, "OK", []cache.Scored{}).
+		Writes([]cache.Scored{}))
 	// Get latest items
 	ws.Route(ws.GET("/latest").To(s.getLatest).
-		Doc("get latest items").
+		Filter(s.ETagFilter).
+		Doc("get latest items ordered by the item time field in the X-Ordered-By header").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
@@ -418,7 +643,8 @@ func (s *RestServer) CreateWebService() {
 		Returns(200, "OK", []cache.Scored{}).
 		Writes([]cache.Scored{}))
 	ws.Route(ws.GET("/latest/{category}").To(s.getLatest).
-		Doc("get latest items in category").
+		Filter(s.ETagFilter).
+		Doc("get latest items in category ordered by the item time field in the X-Ordered-By header").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.PathParameter("category", "items category").DataType("string")).
@@ -428,15 +654,20 @@ func (s *RestServer) CreateWebService() {
 		Writes([]string{}))
 	// Get neighbors
 	ws.Route(ws.GET("/item/{item-id}/neighbors/").To(s.getItemNeighbors).
+		Filter(s.ETagFilter).
+		Filter(s.ShadowTrafficFilter).
 		Doc("get neighbors of a item").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.PathParameter("item-id", "item id").DataType("string")).
 		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
 		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Param(ws.QueryParameter("user-id", "exclude items with negative feedback from the user").DataType("string")).
 		Returns(200, "OK", []string{}).
 		Writes([]string{}))
 	ws.Route(ws.GET("/item/{item-id}/neighbors/{category}").To(s.getItemNeighbors).
+		Filter(s.ETagFilter).
+		Filter(s.ShadowTrafficFilter).
 		Doc("get neighbors of a item").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -444,9 +675,22 @@ func (s *RestServer) CreateWebService() {
 		Param(ws.PathParameter("category", "item category").DataType("string")).
 		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
 		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Param(ws.QueryParameter("user-id", "exclude items with negative feedback from the user").DataType("string")).
 		Returns(200, "OK", []string{}).
 		Writes([]string{}))
+	ws.Route(ws.GET("/item/{item-id}/covisit").To(s.getCovisitedItems).
+		Filter(s.ETagFilter).
+		Doc("get items co-visited with a item, with numbers of users giving feedback to both items").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("item-id", "item id").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
+		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Returns(http.StatusOK, "OK", []cache.Scored{}).
+		Writes([]cache.Scored{}))
 	ws.Route(ws.GET("/user/{user-id}/neighbors/").To(s.getUserNeighbors).
+		Filter(s.PrivateETagFilter).
+		Filter(s.ShadowTrafficFilter).
 		Doc("get neighbors of a user").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -456,17 +700,29 @@ func (s *RestServer) CreateWebService() {
 		Returns(200, "OK", []string{}).
 		Writes([]string{}))
 	ws.Route(ws.GET("/recommend/{user-id}").To(s.getRecommend).
+		Filter(s.PrivateETagFilter).
+		Filter(s.ShadowTrafficFilter).
 		Doc("Get recommendation for user.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
 		Param(ws.PathParameter("user-id", "user id").DataType("string")).
 		Param(ws.QueryParameter("write-back-type", "type of write back feedback").DataType("string")).
 		Param(ws.QueryParameter("write-back-delay", "timestamp delay of write back feedback").DataType("string")).
+		Param(ws.QueryParameter("suppression-window", "items read within the window are not recommended if write back is enabled").DataType("string")).
+		Param(ws.QueryParameter("freshness-quota", "minimal fraction of items published within the freshness window").DataType("number")).
+		Param(ws.QueryParameter("freshness-window", "time window of fresh items").DataType("string")).
+		Param(ws.QueryParameter("explore", "fraction of items replaced by explored items").DataType("number")).
 		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
 		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Param(ws.QueryParameter("paging", "freeze recommendation for paging by tokens if it is \"token\"").DataType("string")).
+		Param(ws.QueryParameter("page-token", "token of the page returned in the X-Next-Page-Token header").DataType("string")).
+		Param(ws.HeaderParameter(HeaderTimeout, "latency budget of fallback stages, which is capped by the max latency budget").DataType("string")).
 		Returns(200, "OK", []string{}).
+		Returns(410, "page token expired", nil).
 		Writes([]string{}))
 	ws.Route(ws.GET("/recommend/{user-id}/{category}").To(s.getRecommend).
+		Filter(s.PrivateETagFilter).
+		Filter(s.ShadowTrafficFilter).
 		Doc("Get recommendation for user.").
 		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
 		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
@@ -474,9 +730,17 @@ func (s *RestServer) CreateWebService() {
 		Param(ws.PathParameter("category", "item category").DataType("string")).
 		Param(ws.QueryParameter("write-back-type", "type of write back feedback").DataType("string")).
 		Param(ws.QueryParameter("write-back-delay", "timestamp delay of write back feedback").DataType("string")).
+		Param(ws.QueryParameter("suppression-window", "items read within the window are not recommended if write back is enabled").DataType("string")).
+		Param(ws.QueryParameter("freshness-quota", "minimal fraction of items published within the freshness window").DataType("number")).
+		Param(ws.QueryParameter("freshness-window", "time window of fresh items").DataType("string")).
+		Param(ws.QueryParameter("explore", "fraction of items replaced by explored items").DataType("number")).
 		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
 		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Param(ws.QueryParameter("paging", "freeze recommendation for paging by tokens if it is \"token\"").DataType("string")).
+		Param(ws.QueryParameter("page-token", "token of the page returned in the X-Next-Page-Token header").DataType("string")).
+		Param(ws.HeaderParameter(HeaderTimeout, "latency budget of fallback stages, which is capped by the max latency budget").DataType("string")).
 		Returns(200, "OK", []string{}).
+		Returns(410, "page token expired", nil).
 		Writes([]string{}))
 	ws.Route(ws.POST("/session/recommend").To(s.sessionRecommend).
 		Doc("Get recommendation for session.").
@@ -497,6 +761,227 @@ func (s *RestServer) CreateWebService() {
 		Reads([]Feedback{}).
 		Returns(200, "OK", []string{}).
 		Writes([]string{}))
+	ws.Route(ws.POST("/session").To(s.createSession).
+		Doc("Create a session stored by the server.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Returns(200, "OK", Session{}).
+		Writes(Session{}))
+	ws.Route(ws.POST("/session/{session-id}/feedback").To(s.insertSessionFeedback).
+		Doc("Append feedback to a session.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("session-id", "identifier of the session").DataType("string")).
+		Reads([]Feedback{}).
+		Returns(200, "OK", Success{}).
+		Returns(410, "session expired", nil).
+		Writes(Success{}))
+	ws.Route(ws.GET("/session/{session-id}/recommend").To(s.getSessionRecommend).
+		Doc("Get recommendation for feedback appended to a session.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("session-id", "identifier of the session").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
+		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Returns(200, "OK", []cache.Scored{}).
+		Returns(410, "session expired", nil).
+		Writes([]cache.Scored{}))
+	ws.Route(ws.GET("/session/{session-id}/recommend/{category}").To(s.getSessionRecommend).
+		Doc("Get recommendation in a category for feedback appended to a session.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Param(ws.PathParameter("session-id", "identifier of the session").DataType("string")).
+		Param(ws.PathParameter("category", "item category").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
+		Param(ws.QueryParameter("offset", "offset of returned items").DataType("integer")).
+		Returns(200, "OK", []cache.Scored{}).
+		Returns(410, "session expired", nil).
+		Writes([]cache.Scored{}))
+
+	/* Bulk import */
+
+	importConsumes := []string{"text/csv", "text/plain", "application/x-ndjson", "multipart/form-data", restful.MIME_JSON, restful.MIME_OCTET}
+	ws.Route(ws.POST("/import/items").To(s.importItems).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Import items from csv or json lines in the request body or the file part of a multipart form. Overwrite if items exist.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("format", "csv (default) or jsonl").DataType("string")).
+		Param(ws.QueryParameter("sep", "separator of csv (default \",\")").DataType("string")).
+		Param(ws.QueryParameter("has-header", "whether the first line of csv is a header (default true)").DataType("boolean")).
+		Param(ws.QueryParameter("mapping", "comma separated field:column pairs, columns are names or indices if there is no header").DataType("string")).
+		Param(ws.QueryParameter("label-sep", "separator of categories and labels in csv (default \"|\")").DataType("string")).
+		Consumes(importConsumes...).
+		Returns(200, "OK", ImportSummary{}).
+		Writes(ImportSummary{}))
+	ws.Route(ws.POST("/import/feedback").To(s.importFeedback).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Import feedback from csv or json lines in the request body or the file part of a multipart form. Overwrite if feedback exists.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("format", "csv (default) or jsonl").DataType("string")).
+		Param(ws.QueryParameter("sep", "separator of csv (default \",\")").DataType("string")).
+		Param(ws.QueryParameter("has-header", "whether the first line of csv is a header (default true)").DataType("boolean")).
+		Param(ws.QueryParameter("mapping", "comma separated field:column pairs, columns are names or indices if there is no header").DataType("string")).
+		Consumes(importConsumes...).
+		Returns(200, "OK", ImportSummary{}).
+		Writes(ImportSummary{}))
+
+	/* Bulk export */
+
+	ws.Route(ws.GET("/export/users").To(s.exportUsers).
+		Filter(s.AdminFilter).
+		Doc("Export users as csv (user_id,labels,subscribe,comment) or json lines. Compressed by gzip if accepted.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"user"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("format", "csv (default) or jsonl").DataType("string")).
+		Produces("text/csv", "application/x-ndjson", restful.MIME_JSON))
+	ws.Route(ws.GET("/export/items").To(s.exportItems).
+		Filter(s.AdminFilter).
+		Doc("Export items as csv (item_id,is_hidden,categories,time_stamp,labels,comment,visible_from,visible_until) or json lines. Compressed by gzip if accepted.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"item"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("format", "csv (default) or jsonl").DataType("string")).
+		Produces("text/csv", "application/x-ndjson", restful.MIME_JSON))
+	ws.Route(ws.GET("/export/feedback").To(s.exportFeedback).
+		Filter(s.AdminFilter).
+		Doc("Export feedback as csv (feedback_type,user_id,item_id,time_stamp,comment) or json lines. Compressed by gzip if accepted.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"feedback"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("format", "csv (default) or jsonl").DataType("string")).
+		Param(ws.QueryParameter("since", "export feedback since the time (inclusive)").DataType("string")).
+		Param(ws.QueryParameter("until", "export feedback until the time (exclusive)").DataType("string")).
+		Param(ws.QueryParameter("feedback-type", "export feedback of the types only").DataType("string")).
+		Produces("text/csv", "application/x-ndjson", restful.MIME_JSON))
+
+	/* Recommendation preview */
+
+	ws.Route(ws.GET("/dashboard/recommend-preview/{user-id}").To(s.getRecommendPreview).
+		Filter(s.AdminFilter).
+		Doc("Preview recommendation for a user with candidates and filtering decisions of each stage. Read feedback is not written back.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Param(ws.QueryParameter("category", "item category").DataType("string")).
+		Param(ws.QueryParameter("n", "number of returned items").DataType("integer")).
+		Returns(200, "OK", RecommendPreview{}).
+		Writes(RecommendPreview{}))
+	ws.Route(ws.GET("/dashboard/recommend-history/{user-id}").To(s.getRecommendHistory).
+		Filter(s.AdminFilter).
+		Doc("Get archived recommendation served to a user in the time bucket closest to a time, tagged by its provenance.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"recommendation"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("user-id", "user id").DataType("string")).
+		Param(ws.QueryParameter("at", "time of recommendation (default: now)").DataType("string")).
+		Returns(200, "OK", data.RecommendSnapshot{}).
+		Writes(data.RecommendSnapshot{}))
+
+	/* Interaction with business rules */
+
+	ws.Route(ws.GET("/rules").To(s.getRules).
+		Filter(s.AdminFilter).
+		Doc("Get business rules.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"rules"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", []Rule{}).
+		Writes([]Rule{}))
+	ws.Route(ws.GET("/rules/{rule-id}").To(s.getRule).
+		Filter(s.AdminFilter).
+		Doc("Get a business rule.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"rules"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("rule-id", "rule id").DataType("string")).
+		Returns(200, "OK", Rule{}).
+		Writes(Rule{}))
+	ws.Route(ws.POST("/rules").To(s.insertRule).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Insert a business rule. Overwrite if the rule exists.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"rules"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Reads(Rule{}).
+		Returns(200, "OK", Success{}))
+	ws.Route(ws.PUT("/rules/{rule-id}").To(s.updateRule).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Update a business rule.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"rules"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("rule-id", "rule id").DataType("string")).
+		Reads(Rule{}).
+		Returns(200, "OK", Success{}))
+	ws.Route(ws.DELETE("/rules/{rule-id}").To(s.deleteRule).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Delete a business rule.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"rules"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.PathParameter("rule-id", "rule id").DataType("string")).
+		Returns(200, "OK", Success{}).
+		Writes(Success{}))
+
+	/* Interaction with blend weights */
+
+	ws.Route(ws.GET("/blend-weights").To(s.getBlendWeights).
+		Filter(s.AdminFilter).
+		Doc("Get weights of score blending.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"blend"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", blend.Weights{}).
+		Writes(blend.Weights{}))
+	ws.Route(ws.PUT("/blend-weights").To(s.setBlendWeights).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Set weights of score blending, which take effect without restarting.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"blend"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Reads(blend.Weights{}).
+		Returns(200, "OK", Success{}).
+		Writes(Success{}))
+	ws.Route(ws.DELETE("/blend-weights").To(s.deleteBlendWeights).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Reset weights of score blending to the configuration.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"blend"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", Success{}).
+		Writes(Success{}))
+
+	/* Maintenance */
+
+	ws.Route(ws.GET("/health").To(s.getHealth).
+		Doc("Get the health of the node.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"maintenance"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Returns(200, "OK", Health{}).
+		Writes(Health{}))
+	ws.Route(ws.GET("/health/ready").To(s.getReady).
+		Doc("Get the readiness of the node, which is ready once warm-up finishes.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"maintenance"}).
+		Param(ws.HeaderParameter("X-API-Key", "api key").DataType("string")).
+		Returns(200, "OK", Readiness{}).
+		Returns(503, "Service Unavailable", Readiness{}).
+		Writes(Readiness{}))
+	ws.Route(ws.GET("/admin/read-only").To(s.getReadOnly).
+		Filter(s.AdminFilter).
+		Doc("Get the read-only state of the cluster.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"maintenance"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Returns(200, "OK", ReadOnlyState{}).
+		Writes(ReadOnlyState{}))
+	ws.Route(ws.POST("/admin/read-only").To(s.setReadOnly).
+		Filter(s.AdminFilter).
+		Filter(s.AuditFilter).
+		Doc("Turn on read-only mode for a TTL, or turn it off. Writes are rejected with 503 in read-only mode.").
+		Metadata(restfulspec.KeyOpenAPITags, []string{"maintenance"}).
+		Param(ws.HeaderParameter("X-API-Key", "admin api key").DataType("string")).
+		Param(ws.QueryParameter("enable", "turn on read-only mode (default true)").DataType("boolean")).
+		Param(ws.QueryParameter("ttl", "read-only mode is turned off after the TTL (default 1h)").DataType("string")).
+		Param(ws.QueryParameter("reason", "reason of read-only mode (default maintenance)").DataType("string")).
+		Returns(200, "OK", ReadOnlyState{}).
+		Writes(ReadOnlyState{}))
 
 	/* Interaction with measurements */
 
@@ -520,6 +1005,28 @@ func ParseInt(request *restful.Request, name string, fallback int) (value int, e
 	return
 }
 
+// ParseFloat parses floats from the query parameter.
+func ParseFloat(request *restful.Request, name string, fallback float64) (value float64, err error) {
+	valueString := request.QueryParameter(name)
+	value, err = strconv.ParseFloat(valueString, 64)
+	if err != nil && valueString == "" {
+		value = fallback
+		err = nil
+	}
+	return
+}
+
+// ParseBool parses booleans from the query parameter.
+func ParseBool(request *restful.Request, name string, fallback bool) (value bool, err error) {
+	valueString := request.QueryParameter(name)
+	value, err = strconv.ParseBool(valueString)
+	if err != nil && valueString == "" {
+		value = fallback
+		err = nil
+	}
+	return
+}
+
 // ParseDuration parses duration from the query parameter.
 func ParseDuration(request *restful.Request, name string) (time.Duration, error) {
 	valueString := request.QueryParameter(name)
@@ -529,6 +1036,38 @@ func ParseDuration(request *restful.Request, name string) (time.Duration, error)
 	return time.ParseDuration(valueString)
 }
 
+// ParseTime parses time from the query parameter. Datetimes without timezones are treated as UTC. Nil is returned if the
+// query parameter is empty.
+func ParseTime(request *restful.Request, name string) (*time.Time, error) {
+	valueString := request.QueryParameter(name)
+	if valueString == "" {
+		return nil, nil
+	}
+	value, err := dateparse.ParseIn(valueString, time.UTC)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	value = value.In(time.UTC)
+	return &value, nil
+}
+
+// HeaderExploredItems is the response header listing explored items in recommendation.
+const HeaderExploredItems = "X-Explored-Items"
+
+// HeaderRecommendFreshness is the response header of the time when served offline recommendation was generated.
+const HeaderRecommendFreshness = "X-Recommend-Freshness"
+
+// HeaderBudgetTruncated is the response header listing fallback stages skipped or cut off since the latency budget of
+// the request is exhausted.
+const HeaderBudgetTruncated = "X-Budget-Truncated"
+
+// HeaderTimeout is the request header of the latency budget of recommendation, such as "500ms".
+const HeaderTimeout = "X-Timeout"
+
+// HeaderRankingGeneration is the response header of the version of the ranking model generating offline
+// recommendation. It is present if the ranking model has a canary.
+const HeaderRankingGeneration = "X-Ranking-Generation"
+
 func (s *RestServer) getSort(key, category string, isItem bool, request *restful.Request, response *restful.Response) {
 	var n, offset int
 	var err error
@@ -542,7 +1081,7 @@ func (s *RestServer) getSort(key, category string, isItem bool, request *restful
 		return
 	}
 	// Get the popular list
-	items, err := s.CacheClient.GetSorted(cache.Key(key, category), offset, s.Config.Recommend.CacheSize)
+	items, err := s.getSortedShared(cache.Key(key, category), offset, s.Config.Recommend.CacheSize)
 	if err != nil {
 		InternalServerError(response, err)
 		return
@@ -563,12 +1102,35 @@ func (s *RestServer) getPopular(request *restful.Request, response *restful.Resp
 	s.getSort(cache.PopularItems, category, true, request, response)
 }
 
+func (s *RestServer) getTrending(request *restful.Request, response *restful.Response) {
+	category := request.PathParameter("category")
+	log.ResponseLogger(response).Debug("get category trending items in category", zap.String("category", category))
+	s.getSort(cache.TrendingItems, category, true, request, response)
+}
+
+// OrderedByHeader is the header of the field of item time ordering latest items.
+const OrderedByHeader = "X-Ordered-By"
+
 func (s *RestServer) getLatest(request *restful.Request, response *restful.Response) {
 	category := request.PathParameter("category")
 	log.ResponseLogger(response).Debug("get category latest items in category", zap.String("category", category))
+	response.Header().Set(OrderedByHeader, s.itemTimeField())
 	s.getSort(cache.LatestItems, category, true, request, response)
 }
 
+// itemTimeField returns the field of item time ordering latest items.
+func (s *RestServer) itemTimeField() string {
+	if s.Config.Recommend.DataSource.ItemTimeField == "" {
+		return data.ItemTimeTimestamp
+	}
+	return s.Config.Recommend.DataSource.ItemTimeField
+}
+
+// latestScore returns the score of an item in latest items, which is the configured item time in seconds.
+func (s *RestServer) latestScore(item data.Item) float64 {
+	return float64(item.Time(s.itemTimeField()).Unix())
+}
+
 // get feedback by item-id with feedback type
 func (s *RestServer) getTypedFeedbackByItem(request *restful.Request, response *restful.Response) {
 	feedbackType := request.PathParameter("feedback-type")
@@ -594,10 +1156,136 @@ func (s *RestServer) getFeedbackByItem(request *restful.Request, response *restf
 
 // getItemNeighbors gets neighbors of a item from database.
 func (s *RestServer) getItemNeighbors(request *restful.Request, response *restful.Response) {
+	var n, offset int
+	var err error
 	// Get item id
 	itemId := request.PathParameter("item-id")
 	category := request.PathParameter("category")
-	s.getSort(cache.Key(cache.ItemNeighbors, itemId), category, true, request, response)
+	if offset, err = ParseInt(request, "offset", 0); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if n, err = ParseInt(request, "n", s.Config.Server.DefaultN); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	items, err := s.loadItemNeighbors(itemId, category)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	// filter out items with negative feedback from the user
+	if userId := request.QueryParameter("user-id"); userId != "" {
+		negativeSet, err := s.loadNegativeItems(userId)
+		if err != nil {
+			InternalServerError(response, err)
+			return
+		}
+		items = lo.Filter(items, func(item cache.Scored, _ int) bool {
+			return !negativeSet.Has(item.Id)
+		})
+	}
+	items = items[lo.Min([]int{offset, len(items)}):]
+	items = s.FilterOutHiddenScores(response, items, category)
+	if n > 0 && len(items) > n {
+		items = items[:n]
+	}
+	Ok(response, items)
+}
+
+// getCovisitedItems gets items co-visited with a item. Scores are raw numbers of users giving feedback to both items.
+func (s *RestServer) getCovisitedItems(request *restful.Request, response *restful.Response) {
+	itemId := request.PathParameter("item-id")
+	offset, err := ParseInt(request, "offset", 0)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	n, err := ParseInt(request, "n", s.Config.Server.DefaultN)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	items, err := s.CacheClient.GetSorted(cache.Key(cache.CovisitedItems, itemId), offset, s.Config.Recommend.CacheSize)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if n > 0 && len(items) > n {
+		items = items[:n]
+	}
+	Ok(response, items)
+}
+
+// loadItemNeighbors loads neighbors of a item in a category. Neighbors are cached for limited categories of each
+// item. For other categories, neighbors are filtered from global neighbors of the item.
+func (s *RestServer) loadItemNeighbors(itemId, category string) ([]cache.Scored, error) {
+	neighbors, err := s.batchLoadItemNeighbors([]string{itemId}, category)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return neighbors[0], nil
+}
+
+// batchLoadItemNeighbors loads neighbors of items in a category. Concurrent loads of the same items are coalesced, and
+// loaded neighbors must not be modified.
+func (s *RestServer) batchLoadItemNeighbors(itemIds []string, category string) ([][]cache.Scored, error) {
+	v, err := s.coalesce(CoalesceNeighbors, coalesceKey(append([]string{category}, itemIds...)...), func() (interface{}, error) {
+		return s.hydrateItemNeighbors(itemIds, category)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return v.([][]cache.Scored), nil
+}
+
+// hydrateItemNeighbors loads neighbors of items in a category. Categories of global neighbors to filter are loaded
+// from the database at once.
+func (s *RestServer) hydrateItemNeighbors(itemIds []string, category string) ([][]cache.Scored, error) {
+	neighbors := make([][]cache.Scored, len(itemIds))
+	var filtered []int
+	for i, itemId := range itemIds {
+		items, err := s.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, itemId, category), 0, s.Config.Recommend.CacheSize)
+		if err != nil {
+			return nil, errors.Trace(err)
+		} else if category == "" || len(items) > 0 {
+			neighbors[i] = items
+			continue
+		}
+		if neighbors[i], err = s.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, itemId), 0, s.Config.Recommend.CacheSize); err != nil {
+			return nil, errors.Trace(err)
+		}
+		filtered = append(filtered, i)
+	}
+	if len(filtered) == 0 {
+		return neighbors, nil
+	}
+	// filter global neighbors by category
+	neighborIds := strset.New()
+	for _, i := range filtered {
+		for _, item := range neighbors[i] {
+			neighborIds.Add(item.Id)
+		}
+	}
+	if neighborIds.Size() == 0 {
+		return neighbors, nil
+	}
+	items, _, err := s.DataClient.BatchGetItems(neighborIds.List())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	categorized := strset.New()
+	for _, item := range items {
+		if lo.Contains(item.Categories, category) {
+			categorized.Add(item.ItemId)
+		}
+	}
+	for _, i := range filtered {
+		neighbors[i] = lo.Filter(neighbors[i], func(item cache.Scored, _ int) bool {
+			return categorized.Has(item.Id)
+		})
+	}
+	return neighbors, nil
 }
 
 // getUserNeighbors gets neighbors of a user from database.
@@ -620,43 +1308,152 @@ func (s *RestServer) getCollaborative(request *restful.Request, response *restfu
 // 2. If there are historical interactions of the users, return similar items.
 // 3. Otherwise, return fallback recommendation (popular/latest).
 func (s *RestServer) Recommend(response *restful.Response, userId, category string, n int, recommenders ...Recommender) ([]string, error) {
-	initStart := time.Now()
-
-	// create context
-	ctx, err := s.createRecommendContext(userId, category, n)
+	ctx, err := s.recommend(response, userId, category, n, recommenders...)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	return ctx.results, nil
+}
+
+func (s *RestServer) recommend(response *restful.Response, userId, category string, n int, recommenders ...Recommender) (*recommendContext, error) {
+	initStart := time.Now()
+
+	// items blocked by ids are excluded before recommenders run
+	var rules []Rule
+	if s.RulesManager != nil {
+		rules = s.RulesManager.ActiveRules(category, initStart)
+	}
+	blockedSet := blockedItemIds(rules)
 
-	// execute recommenders
-	for _, recommender := range recommenders {
-		err = recommender(ctx)
+	// execute recommenders until candidates are enough after blocked items are removed
+	var (
+		ctx *recommendContext
+		err error
+	)
+	for attempt := 0; ; attempt++ {
+		ctx, err = s.runRecommenders(userId, category, n, rules, blockedSet, recommenders)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		blocked, err := s.removeBlockedItems(ctx)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
+		if len(blocked) == 0 || len(ctx.results) >= n || attempt >= maxBlockRetries {
+			break
+		}
+		blockedSet.Add(blocked...)
+	}
+
+	// apply business rules
+	if err = s.applyRules(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// apply manual overrides of the user
+	if err = s.applyOverrides(ctx); err != nil {
+		return nil, errors.Trace(err)
 	}
 
 	// return recommendations
 	if len(ctx.results) > n {
 		ctx.results = ctx.results[:n]
 	}
+	if ctx.servedBy != "" {
+		RecommendServedTotal.WithLabelValues(ctx.servedBy).Inc()
+	}
+	RecommendReturnedItems.Observe(float64(len(ctx.results)))
+	if len(ctx.results) == 0 {
+		RecommendEmptyTotal.Inc()
+	}
+	if response != nil {
+		if explored := lo.Filter(ctx.results, func(itemId string, _ int) bool {
+			return ctx.exploredSet.Has(itemId)
+		}); len(explored) > 0 {
+			response.AddHeader(HeaderExploredItems, strings.Join(explored, ","))
+		}
+		if !ctx.offlineRecommendTime.IsZero() {
+			response.AddHeader(HeaderRecommendFreshness, ctx.offlineRecommendTime.Format(time.RFC3339))
+		}
+		if len(ctx.truncatedStages) > 0 {
+			response.AddHeader(HeaderBudgetTruncated, strings.Join(ctx.truncatedStages, ","))
+		}
+	}
+	var staleness time.Duration
+	if !ctx.offlineRecommendTime.IsZero() {
+		staleness = time.Since(ctx.offlineRecommendTime)
+		OfflineRecommendStalenessSeconds.Observe(staleness.Seconds())
+	}
 	totalTime := time.Since(initStart)
 	log.ResponseLogger(response).Info("complete recommendation",
 		zap.Int("num_from_final", ctx.numFromOffline),
 		zap.Int("num_from_collaborative", ctx.numFromCollaborative),
 		zap.Int("num_from_item_based", ctx.numFromItemBased),
 		zap.Int("num_from_user_based", ctx.numFromUserBased),
+		zap.Int("num_from_label_based", ctx.numFromLabelBased),
+		zap.Int("num_from_subscription", ctx.numFromSubscription),
 		zap.Int("num_from_latest", ctx.numFromLatest),
 		zap.Int("num_from_poplar", ctx.numFromPopular),
+		zap.Int("num_suppressed", ctx.numSuppressed),
+		zap.String("served_by", ctx.servedBy),
+		zap.Strings("truncated_stages", ctx.truncatedStages),
+		zap.Int("num_explored", ctx.exploredSet.Size()),
+		zap.Int("num_fresh_promoted", ctx.numFreshPromoted),
+		zap.Duration("offline_recommend_staleness", staleness),
 		zap.Duration("total_time", totalTime),
 		zap.Duration("load_final_recommend_time", ctx.loadOfflineRecTime),
 		zap.Duration("load_col_recommend_time", ctx.loadColRecTime),
 		zap.Duration("load_hist_time", ctx.loadLoadHistTime),
 		zap.Duration("item_based_recommend_time", ctx.itemBasedTime),
 		zap.Duration("user_based_recommend_time", ctx.userBasedTime),
+		zap.Duration("label_based_recommend_time", ctx.labelBasedTime),
+		zap.Duration("subscription_recommend_time", ctx.subscriptionTime),
 		zap.Duration("load_latest_time", ctx.loadLatestTime),
-		zap.Duration("load_popular_time", ctx.loadPopularTime))
-	return ctx.results, nil
+		zap.Duration("load_popular_time", ctx.loadPopularTime),
+		zap.Duration("load_impressions_time", ctx.loadImpressionsTime),
+		zap.Duration("load_negative_time", ctx.loadNegativeTime),
+		zap.Duration("freshness_time", ctx.freshnessTime),
+		zap.Duration("explore_time", ctx.exploreTime),
+		zap.Duration("blend_time", ctx.blendTime),
+		zap.Duration("rerank_time", ctx.rerankTime),
+		zap.Duration("apply_rules_time", ctx.applyRulesTime),
+		zap.Duration("apply_overrides_time", ctx.applyOverridesTime))
+	return ctx, nil
+}
+
+// runRecommenders executes recommenders with blocked items excluded. Impression suppression is skipped if candidates
+// are not enough.
+func (s *RestServer) runRecommenders(userId, category string, n int, rules []Rule, blockedSet *strset.Set, recommenders []Recommender) (*recommendContext, error) {
+	run := func(disableSuppression bool) (*recommendContext, error) {
+		ctx, err := s.createRecommendContext(userId, category, n)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ctx.rules = rules
+		ctx.blockedSet = blockedSet
+		ctx.excludeSet.Merge(blockedSet)
+		if s.DuplicatesManager != nil {
+			ctx.duplicates = s.DuplicatesManager.Clusters()
+		}
+		ctx.disableSuppression = disableSuppression
+		if err = s.requireUserOverrides(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, recommender := range recommenders {
+			if err = recommender(ctx); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		return ctx, nil
+	}
+	ctx, err := run(false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(ctx.results) < n && ctx.numSuppressed > 0 {
+		return run(true)
+	}
+	return ctx, nil
 }
 
 type recommendContext struct {
@@ -664,14 +1461,66 @@ type recommendContext struct {
 	userId       string
 	category     string
 	userFeedback []data.Feedback
-	n            int
-	results      []string
-	excludeSet   *strset.Set
+	// userFeedbackLoaded is true once feedback of the user is loaded, and userFeedbackExcluded is true once items
+	// with feedback are excluded.
+	userFeedbackLoaded   bool
+	userFeedbackExcluded bool
+	n                    int
+	results              []string
+	excludeSet           *strset.Set
+	overrides            *data.UserOverrides
+
+	// Bloom filter of items consumed by the user, which replaces feedback of the user in exclusion if it exists
+	consumed       *bloom.BloomFilter
+	consumedLoaded bool
+
+	disableSuppression bool
+	numSuppressed      int
+	numFreshPromoted   int
+	servedBy           string
+	exploredSet        *strset.Set
+	firedOverrides     []FiredOverride
+
+	// retrieval scores and stages of candidates used by business rules
+	scores     map[string]float64
+	sources    map[string]string
+	rules      []Rule
+	blockedSet *strset.Set
+
+	// members of clusters of near-duplicate items, at most one of which is recommended
+	duplicates map[string][]string
+
+	// weights and blended scores of candidates if score blending is enabled
+	blendWeights *blend.Weights
+	blendScores  map[string]blend.Scores
+
+	offlineRecommendTime time.Time
+
+	// latency budget of the request and its deadline, which are zero if there is no budget. Fallback stages skipped or
+	// cut off at the deadline are recorded.
+	budget          time.Duration
+	deadline        time.Time
+	truncatedStages []string
+	// stores whose requests are cancelled at the deadline, which are set while a fallback stage is running
+	cacheClient cache.Database
+	dataClient  data.Database
+
+	// metadata of the user and items loaded on demand and shared by recommenders
+	user       *data.User
+	userLoaded bool
+	items      map[string]*data.Item
+
+	// documents read on creation of the context
+	recommendTime    *cache.ReturnValue
+	offlineRecommend []cache.Scored
+	hiddenDelta      *strset.Set
 
 	numPrevStage         int
 	numFromLatest        int
 	numFromPopular       int
 	numFromUserBased     int
+	numFromLabelBased    int
+	numFromSubscription  int
 	numFromItemBased     int
 	numFromCollaborative int
 	numFromOffline       int
@@ -681,45 +1530,198 @@ type recommendContext struct {
 	loadLoadHistTime   time.Duration
 	itemBasedTime      time.Duration
 	userBasedTime      time.Duration
+	labelBasedTime     time.Duration
+	subscriptionTime   time.Duration
 	loadLatestTime     time.Duration
 	loadPopularTime    time.Duration
+
+	loadImpressionsTime time.Duration
+	loadNegativeTime    time.Duration
+	freshnessTime       time.Duration
+	exploreTime         time.Duration
+	applyRulesTime      time.Duration
+	applyOverridesTime  time.Duration
+	blendTime           time.Duration
+	rerankTime          time.Duration
+}
+
+// recommendContextReads returns reads of ignored items, offline recommendation and delta hidden items of a user.
+func (s *RestServer) recommendContextReads(userId, category string) []cache.Read {
+	reads := []cache.Read{
+		cache.ReadSortedByScore(cache.Key(cache.IgnoreItems, userId),
+			math.Inf(-1), float64(time.Now().Add(s.Config.Server.ClockError).Unix())),
+		cache.ReadValue(cache.Key(cache.LastUpdateUserRecommendTime, userId)),
+		cache.ReadSorted(cache.Key(cache.OfflineRecommend, userId, category), 0, s.Config.Recommend.CacheSizeOf(category)),
+	}
+	return append(reads, s.HiddenItemsManager.DeltaReads(category)...)
 }
 
 func (s *RestServer) createRecommendContext(userId, category string, n int) (*recommendContext, error) {
-	// pull ignored items
-	ignoreItems, err := s.CacheClient.GetSortedByScore(cache.Key(cache.IgnoreItems, userId),
-		math.Inf(-1), float64(time.Now().Add(s.Config.Server.ClockError).Unix()))
+	// pull ignored items, offline recommendation and delta hidden items in one round trip
+	documents, err := s.CacheClient.ReadDocuments(s.recommendContextReads(userId, category)...)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	excludeSet := strset.New()
-	for _, item := range ignoreItems {
+	for _, item := range documents[0].Scores {
 		excludeSet.Add(item.Id)
 	}
 	return &recommendContext{
-		userId:     userId,
-		category:   category,
-		n:          n,
-		excludeSet: excludeSet,
+		userId:           userId,
+		category:         category,
+		n:                n,
+		results:          make([]string, 0),
+		excludeSet:       excludeSet,
+		exploredSet:      strset.New(),
+		scores:           make(map[string]float64),
+		sources:          make(map[string]string),
+		blockedSet:       strset.New(),
+		items:            make(map[string]*data.Item),
+		recommendTime:    documents[1].Value,
+		offlineRecommend: documents[2].Scores,
+		hiddenDelta:      DeltaHiddenItems(documents[3:]),
 	}, nil
 }
 
-func (s *RestServer) requireUserFeedback(ctx *recommendContext) error {
-	if ctx.userFeedback == nil {
+// cacheStore returns the cache store for the request, whose requests are cancelled at the deadline in fallback stages.
+func (s *RestServer) cacheStore(ctx *recommendContext) cache.Database {
+	if ctx.cacheClient != nil {
+		return ctx.cacheClient
+	}
+	return s.CacheClient
+}
+
+// dataStore returns the data store for the request, whose requests are cancelled at the deadline in fallback stages.
+func (s *RestServer) dataStore(ctx *recommendContext) data.Database {
+	if ctx.dataClient != nil {
+		return ctx.dataClient
+	}
+	return s.DataClient
+}
+
+// loadUserFeedback loads feedback of the user once per request.
+func (s *RestServer) loadUserFeedback(ctx *recommendContext) error {
+	if !ctx.userFeedbackLoaded {
 		start := time.Now()
 		var err error
-		ctx.userFeedback, err = s.DataClient.GetUserFeedback(ctx.userId, false)
+		ctx.userFeedback, err = s.dataStore(ctx).GetUserFeedback(ctx.userId, false)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		for _, feedback := range ctx.userFeedback {
-			ctx.excludeSet.Add(feedback.ItemId)
-		}
+		ctx.userFeedbackLoaded = true
 		ctx.loadLoadHistTime = time.Since(start)
 	}
 	return nil
 }
 
+// requireUserFeedback excludes items with feedback of the user from recommendation. If the consumed filter is enabled
+// and feedback hasn't been loaded, items are excluded by the Bloom filter of the user instead of loading feedback.
+func (s *RestServer) requireUserFeedback(ctx *recommendContext) error {
+	if ctx.userFeedbackExcluded {
+		return nil
+	}
+	if s.Config.Recommend.ConsumedFilter.EnableConsumedFilter && !ctx.userFeedbackLoaded {
+		exist, err := s.requireConsumedFilter(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if exist {
+			ConsumedFilterHitsTotal.Inc()
+			ctx.userFeedbackExcluded = true
+			return nil
+		}
+		ConsumedFilterMissesTotal.Inc()
+	}
+	if err := s.loadUserFeedback(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	for _, feedback := range ctx.userFeedback {
+		ctx.excludeSet.Add(feedback.ItemId)
+	}
+	ctx.userFeedbackExcluded = true
+	return nil
+}
+
+// isExcluded returns true if the item is excluded from recommendation. Items in the Bloom filter of consumed items are
+// excluded, including a few false positives.
+func (ctx *recommendContext) isExcluded(itemId string) bool {
+	return ctx.excludeSet.Has(itemId) || ctx.consumed != nil && ctx.consumed.Has(itemId)
+}
+
+// hasFeedback returns true if the user has feedback, which is loaded or counted by the Bloom filter.
+func (ctx *recommendContext) hasFeedback() bool {
+	return len(ctx.userFeedback) > 0 || ctx.consumed != nil && ctx.consumed.Count() > 0
+}
+
+// negativeItems returns items with negative feedback.
+func (s *RestServer) negativeItems(feedback []data.Feedback) *strset.Set {
+	negativeSet := strset.New()
+	for _, f := range feedback {
+		if lo.Contains(s.Config.Recommend.DataSource.NegativeFeedbackTypes, f.FeedbackType) {
+			negativeSet.Add(f.ItemId)
+		}
+	}
+	return negativeSet
+}
+
+// loadNegativeItems loads items with negative feedback from a user.
+func (s *RestServer) loadNegativeItems(userId string) (*strset.Set, error) {
+	if len(s.Config.Recommend.DataSource.NegativeFeedbackTypes) == 0 {
+		return strset.New(), nil
+	}
+	feedback, err := s.DataClient.GetUserFeedback(userId, true, s.Config.Recommend.DataSource.NegativeFeedbackTypes...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s.negativeItems(feedback), nil
+}
+
+// requireUser loads the user once per request. The user is nil if it doesn't exist.
+func (s *RestServer) requireUser(ctx *recommendContext) (*data.User, error) {
+	if !ctx.userLoaded {
+		user, err := s.dataStore(ctx).GetUser(ctx.userId)
+		if err != nil && !errors.Is(err, errors.NotFound) {
+			return nil, errors.Trace(err)
+		}
+		if err == nil {
+			ctx.user = &user
+		}
+		ctx.userLoaded = true
+	}
+	return ctx.user, nil
+}
+
+// requireItems loads metadata of items which haven't been loaded in the request. Items that don't exist are nil in
+// the returned map.
+func (s *RestServer) requireItems(ctx *recommendContext, itemIds []string) (map[string]*data.Item, error) {
+	missing := lo.Filter(lo.Uniq(itemIds), func(itemId string, _ int) bool {
+		_, loaded := ctx.items[itemId]
+		return !loaded
+	})
+	if len(missing) > 0 {
+		items, notFound, err := s.dataStore(ctx).BatchGetItems(missing)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, itemId := range notFound {
+			ctx.items[itemId] = nil
+		}
+		for i := range items {
+			ctx.items[items[i].ItemId] = &items[i]
+		}
+	}
+	return ctx.items, nil
+}
+
+// addCandidate appends an item to results. The retrieval score is kept for business rules. Duplicates of the item are
+// excluded.
+func (ctx *recommendContext) addCandidate(itemId string, score float64) {
+	ctx.results = append(ctx.results, itemId)
+	ctx.excludeSet.Add(itemId)
+	ctx.excludeDuplicates(itemId)
+	ctx.scores[itemId] = score
+}
+
 func (s *RestServer) FilterOutHiddenScores(response *restful.Response, items []cache.Scored, category string) []cache.Scored {
 	isHidden, err := s.HiddenItemsManager.IsHidden(cache.RemoveScores(items), category)
 	if err != nil {
@@ -735,6 +1737,18 @@ func (s *RestServer) FilterOutHiddenScores(response *restful.Response, items []c
 	return results
 }
 
+// filterOutHiddenScoresInContext filters out hidden items with delta hidden items read on creation of the context.
+func (s *RestServer) filterOutHiddenScoresInContext(ctx *recommendContext, items []cache.Scored) []cache.Scored {
+	isHidden := s.HiddenItemsManager.IsHiddenWithDelta(cache.RemoveScores(items), ctx.category, ctx.hiddenDelta)
+	results := make([]cache.Scored, 0, len(items))
+	for i := range isHidden {
+		if !isHidden[i] {
+			results = append(results, items[i])
+		}
+	}
+	return results
+}
+
 func (s *RestServer) filterOutHiddenFeedback(response *restful.Response, feedbacks []data.Feedback) []data.Feedback {
 	names := make([]string, len(feedbacks))
 	for i, item := range feedbacks {
@@ -756,18 +1770,436 @@ func (s *RestServer) filterOutHiddenFeedback(response *restful.Response, feedbac
 
 type Recommender func(ctx *recommendContext) error
 
+// Explore creates a recommender replacing the last floor(ratio*n) of top n items by items randomly sampled from the
+// latest items in the category. Samples are drawn by reservoir sampling seeded by the user and the date, so that
+// recommendation is stable within a day. Explored items are placed after organic items, as if they were scored lower.
+func (s *RestServer) Explore(ratio float64) Recommender {
+	return func(ctx *recommendContext) error {
+		numExplore := int(ratio * float64(ctx.n))
+		if numExplore <= 0 {
+			return nil
+		}
+		start := time.Now()
+		items, err := s.getSortedShared(cache.Key(cache.LatestItems, ctx.category), 0, s.Config.Recommend.CacheSize)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		items = s.filterOutHiddenScoresInContext(ctx, items)
+
+		// sample items from the latest items
+		hash := fnv.New64()
+		_, _ = hash.Write([]byte(ctx.userId + "/" + start.UTC().Format("2006-01-02")))
+		rng := rand.New(rand.NewSource(int64(hash.Sum64())))
+		explored := make([]string, 0, numExplore)
+		numSeen := 0
+		for _, item := range items {
+			if ctx.isExcluded(item.Id) {
+				continue
+			}
+			if len(explored) < numExplore {
+				explored = append(explored, item.Id)
+			} else if j := rng.Intn(numSeen + 1); j < numExplore {
+				explored[j] = item.Id
+			}
+			numSeen++
+		}
+
+		// replace the last items in top n
+		numOrganic := mathutil.Min(len(ctx.results), ctx.n-len(explored))
+		results := make([]string, 0, len(ctx.results)+len(explored))
+		results = append(results, ctx.results[:numOrganic]...)
+		results = append(results, explored...)
+		results = append(results, ctx.results[numOrganic:]...)
+		ctx.results = results
+		ctx.excludeSet.Add(explored...)
+		ctx.excludeDuplicates(explored...)
+		ctx.exploredSet.Add(explored...)
+		ctx.exploreTime = time.Since(start)
+		return nil
+	}
+}
+
+// Rerank re-orders candidates by the external scorer if re-ranking is enabled on servers. Candidates keep the
+// original order if the scorer fails. Metadata of the user and candidates loaded by previous recommenders is reused.
+func (s *RestServer) Rerank(ctx *recommendContext) error {
+	if s.Reranker == nil || !rerank.Enabled(s.Config.Recommend.Rerank, rerank.StageServer) || len(ctx.results) == 0 {
+		return nil
+	}
+	start := time.Now()
+	user, err := s.requireUser(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	items, err := s.requireItems(ctx, ctx.results)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	request := &rerank.Request{
+		UserId:     ctx.userId,
+		Context:    map[string]string{"category": ctx.category, "stage": rerank.StageServer},
+		Candidates: make([]rerank.Candidate, 0, len(ctx.results)),
+	}
+	if user != nil {
+		request.UserLabels = user.Labels
+	}
+	for _, itemId := range ctx.results {
+		candidate := rerank.Candidate{ItemId: itemId, Score: ctx.scores[itemId]}
+		if item := items[itemId]; item != nil {
+			candidate.Labels = item.Labels
+			candidate.Categories = item.Categories
+		}
+		request.Candidates = append(request.Candidates, candidate)
+	}
+	if s.Reranker.Rerank(s.Config.Recommend.Rerank, request) {
+		for i, candidate := range request.Candidates {
+			ctx.results[i] = candidate.ItemId
+			ctx.scores[candidate.ItemId] = candidate.Score
+			ctx.sources[candidate.ItemId] = "rerank"
+		}
+	}
+	ctx.rerankTime = time.Since(start)
+	return nil
+}
+
+// RecommendStage names a recommender in the fallback chain. The name of the last stage contributing to the
+// recommendation is recorded in the context. If the request has a latency budget, the stage is skipped once the budget
+// is exhausted, and requests to storage in the stage are cancelled at the deadline.
+func (s *RestServer) RecommendStage(name string, recommender Recommender) Recommender {
+	return func(ctx *recommendContext) error {
+		numPrev := len(ctx.results)
+		if err := s.runStage(ctx, name, recommender); err != nil {
+			return errors.Trace(err)
+		}
+		if len(ctx.results) > numPrev {
+			ctx.servedBy = name
+		}
+		for _, itemId := range ctx.results[numPrev:] {
+			ctx.sources[itemId] = name
+		}
+		return nil
+	}
+}
+
+// runStage runs a fallback stage within the latency budget of the request. Stages cut off at the deadline keep
+// candidates collected before the deadline.
+func (s *RestServer) runStage(ctx *recommendContext, name string, recommender Recommender) error {
+	if ctx.deadline.IsZero() {
+		return recommender(ctx)
+	}
+	start := time.Now()
+	if !start.Before(ctx.deadline) {
+		ctx.truncatedStages = append(ctx.truncatedStages, name)
+		return nil
+	}
+	stageCtx, cancel := context.WithDeadline(context.Background(), ctx.deadline)
+	defer cancel()
+	ctx.cacheClient, ctx.dataClient = cache.WithContext(stageCtx, s.CacheClient), data.WithContext(stageCtx, s.DataClient)
+	err := recommender(ctx)
+	ctx.cacheClient, ctx.dataClient = nil, nil
+	RecommendBudgetConsumption.WithLabelValues(name).Observe(time.Since(start).Seconds() / ctx.budget.Seconds())
+	if err != nil && stageCtx.Err() != nil {
+		log.Logger().Warn("fallback stage cut off at the deadline", log.UserId(ctx.userId),
+			zap.String("stage", name), zap.Error(err))
+		ctx.truncatedStages = append(ctx.truncatedStages, name)
+		return nil
+	}
+	return err
+}
+
+// recommendStages returns recommenders of stages in config.RecommendStages.
+func (s *RestServer) recommendStages() map[string]Recommender {
+	return map[string]Recommender{
+		config.StageOffline:       s.RecommendOffline,
+		config.StageCollaborative: s.RecommendCollaborative,
+		config.StageItemBased:     s.RecommendItemBased,
+		config.StageUserBased:     s.RecommendUserBased,
+		config.StageLabelBased:    s.RecommendLabelBased,
+		config.StageSubscription:  s.RecommendSubscription,
+		config.StageLatest:        s.RecommendLatest,
+		config.StagePopular:       s.RecommendPopular,
+	}
+}
+
+// FallbackRecommenders creates the fallback chain in the order of configuration. The offline stage is placed at the
+// beginning if it is absent from configuration.
+func (s *RestServer) FallbackRecommenders() ([]Recommender, error) {
+	names := s.Config.Recommend.Online.FallbackRecommend
+	if !lo.Contains(names, config.StageOffline) {
+		names = append([]string{config.StageOffline}, names...)
+	}
+	stages := s.recommendStages()
+	recommenders := make([]Recommender, 0, len(names))
+	for _, name := range names {
+		recommender, exist := stages[name]
+		if !exist {
+			return nil, fmt.Errorf("unknown fallback recommendation method `%s`", name)
+		}
+		recommenders = append(recommenders, s.RecommendStage(name, recommender))
+	}
+	return recommenders, nil
+}
+
+// recommendOptions are options of the recommendation chain for a request.
+type recommendOptions struct {
+	suppressImpressions bool
+	suppressionWindow   time.Duration
+	exploreRatio        float64
+	freshnessQuota      float64
+	freshnessWindow     time.Duration
+	latencyBudget       time.Duration
+}
+
+// defaultRecommendOptions returns options in configuration without impression suppression.
+func (s *RestServer) defaultRecommendOptions() recommendOptions {
+	return recommendOptions{
+		suppressionWindow: s.Config.Recommend.Online.SuppressionWindow,
+		exploreRatio:      s.Config.Server.ExploreRatio,
+		freshnessQuota:    s.Config.Recommend.Online.FreshnessQuota,
+		freshnessWindow:   s.Config.Recommend.Online.FreshnessWindow,
+		latencyBudget:     s.Config.Recommend.Online.LatencyBudget,
+	}
+}
+
+// recommendChain creates the recommendation chain: the latency budget, negative feedback exclusion, impression
+// suppression, the fallback chain, re-ranking, exploration and freshness.
+func (s *RestServer) recommendChain(options recommendOptions) ([]Recommender, error) {
+	recommenders := []Recommender{s.LimitLatency(options.latencyBudget), s.ExcludeNegativeFeedback}
+	if options.suppressImpressions {
+		recommenders = append(recommenders, s.SuppressImpressions(options.suppressionWindow))
+	}
+	fallbackRecommenders, err := s.FallbackRecommenders()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	recommenders = append(recommenders, fallbackRecommenders...)
+	recommenders = append(recommenders, s.Blend)
+	recommenders = append(recommenders, s.Rerank)
+	recommenders = append(recommenders, s.Explore(options.exploreRatio))
+	recommenders = append(recommenders, s.EnsureFreshness(options.freshnessQuota, options.freshnessWindow))
+	return recommenders, nil
+}
+
+// LimitLatency creates a recommender setting the latency budget of the request, which starts once the recommender is
+// created. There is no budget if the budget is zero.
+func (s *RestServer) LimitLatency(budget time.Duration) Recommender {
+	deadline := time.Now().Add(budget)
+	return func(ctx *recommendContext) error {
+		if budget > 0 {
+			ctx.budget, ctx.deadline = budget, deadline
+		}
+		return nil
+	}
+}
+
+// latencyBudget returns the latency budget requested by the X-Timeout header, which is capped by the max latency
+// budget. The default latency budget is returned if the header is absent.
+func (s *RestServer) latencyBudget(request *restful.Request) (time.Duration, error) {
+	timeout := request.HeaderParameter(HeaderTimeout)
+	if timeout == "" {
+		return s.Config.Recommend.Online.LatencyBudget, nil
+	}
+	budget, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, errors.Trace(err)
+	} else if budget <= 0 {
+		return 0, fmt.Errorf("timeout should be positive")
+	}
+	if maxBudget := s.Config.Recommend.Online.MaxLatencyBudget; maxBudget > 0 && budget > maxBudget {
+		budget = maxBudget
+	}
+	return budget, nil
+}
+
+// SuppressImpressions creates a recommender excluding items read by the user within the window (including read
+// feedback written back with delay). Excluded items are backfilled by the following recommenders.
+func (s *RestServer) SuppressImpressions(window time.Duration) Recommender {
+	return func(ctx *recommendContext) error {
+		if ctx.disableSuppression || window <= 0 || len(s.Config.Recommend.DataSource.ReadFeedbackTypes) == 0 {
+			return nil
+		}
+		start := time.Now()
+		feedback, err := s.DataClient.GetUserFeedback(ctx.userId, true, s.Config.Recommend.DataSource.ReadFeedbackTypes...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if s.WriteBackBuffer != nil {
+			// delayed read feedback might not be inserted yet
+			pending, err := s.WriteBackBuffer.PendingFeedback(ctx.userId, s.Config.Recommend.DataSource.ReadFeedbackTypes...)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			feedback = append(feedback, pending...)
+		}
+		threshold := start.Add(-window)
+		for _, f := range feedback {
+			if f.Timestamp.After(threshold) && !ctx.isExcluded(f.ItemId) {
+				ctx.excludeSet.Add(f.ItemId)
+				ctx.numSuppressed++
+			}
+		}
+		ctx.loadImpressionsTime = time.Since(start)
+		return nil
+	}
+}
+
+// ExcludeNegativeFeedback excludes items with negative feedback from the user. Unlike impression suppression, these
+// items are excluded permanently. Feedback of the user is loaded once and shared with following recommenders.
+func (s *RestServer) ExcludeNegativeFeedback(ctx *recommendContext) error {
+	if len(s.Config.Recommend.DataSource.NegativeFeedbackTypes) == 0 {
+		return nil
+	}
+	start := time.Now()
+	if s.Config.Recommend.ConsumedFilter.EnableConsumedFilter && !ctx.userFeedbackLoaded {
+		// items with negative feedback are consumed items excluded by the Bloom filter
+		exist, err := s.requireConsumedFilter(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if exist {
+			ctx.loadNegativeTime = time.Since(start)
+			return nil
+		}
+	}
+	if err := s.loadUserFeedback(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	ctx.excludeSet.Add(s.negativeItems(ctx.userFeedback).List()...)
+	ctx.loadNegativeTime = time.Since(start)
+	return nil
+}
+
+// EnsureFreshness creates a recommender guaranteeing that at least ceil(quota*n) of top n items are published within
+// the window. It should be the last recommender. If fresh items in top n are not enough, fresh items are promoted from
+// the rest of candidates first and then from the latest items. Promoted items replace the lowest-ranked stale items in
+// top n, and the i-th (starting from 0) of m promoted items is placed at floor((i+1)*n/(m+1)) so that fresh items are
+// spread across the list. Other items keep their relative order.
+func (s *RestServer) EnsureFreshness(quota float64, window time.Duration) Recommender {
+	return func(ctx *recommendContext) error {
+		if quota <= 0 || window <= 0 || ctx.n <= 0 {
+			return nil
+		}
+		start := time.Now()
+		numFresh := int(math.Ceil(quota * float64(ctx.n)))
+		latest, err := s.getSortedShared(cache.Key(cache.LatestItems, ctx.category), 0, s.Config.Recommend.CacheSize)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		latest = s.filterOutHiddenScoresInContext(ctx, latest)
+
+		// load timestamps of candidates and latest items
+		itemIds := append(cache.RemoveScores(latest), ctx.results...)
+		items, err := s.requireItems(ctx, itemIds)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		threshold := start.Add(-window)
+		freshSet := strset.New()
+		for _, itemId := range itemIds {
+			if item := items[itemId]; item != nil && item.Time(s.itemTimeField()).After(threshold) {
+				freshSet.Add(itemId)
+			}
+		}
+
+		// count fresh items in top n
+		top, rest := ctx.results, []string(nil)
+		if len(top) > ctx.n {
+			top, rest = ctx.results[:ctx.n], ctx.results[ctx.n:]
+		}
+		numMissing := numFresh
+		for _, itemId := range top {
+			if freshSet.Has(itemId) {
+				numMissing--
+			}
+		}
+		if numMissing <= 0 {
+			return nil
+		}
+
+		// collect fresh items from the rest of candidates and the latest items
+		var promoted []string
+		for _, itemId := range rest {
+			if len(promoted) < numMissing && freshSet.Has(itemId) {
+				promoted = append(promoted, itemId)
+			}
+		}
+		for _, item := range latest {
+			if len(promoted) < numMissing && freshSet.Has(item.Id) && !ctx.isExcluded(item.Id) {
+				promoted = append(promoted, item.Id)
+				ctx.excludeSet.Add(item.Id)
+				ctx.excludeDuplicates(item.Id)
+			}
+		}
+		if len(promoted) == 0 {
+			return nil
+		}
+
+		// remove the lowest-ranked stale items from top n
+		removedSet := strset.New()
+		for i := len(top) - 1; i >= 0 && len(top)+len(promoted)-removedSet.Size() > ctx.n; i-- {
+			if !freshSet.Has(top[i]) {
+				removedSet.Add(top[i])
+			}
+		}
+		var kept, removed []string
+		for _, itemId := range top {
+			if removedSet.Has(itemId) {
+				removed = append(removed, itemId)
+			} else {
+				kept = append(kept, itemId)
+			}
+		}
+
+		// interleave promoted items into top n
+		length := len(kept) + len(promoted)
+		results := make([]string, 0, len(ctx.results)+len(promoted))
+		for i, j := 0, 0; i+j < length; {
+			if j < len(promoted) && i+j == (j+1)*length/(len(promoted)+1) {
+				results = append(results, promoted[j])
+				j++
+			} else {
+				results = append(results, kept[i])
+				i++
+			}
+		}
+
+		// keep the rest of candidates for business rules
+		promotedSet := strset.New(promoted...)
+		results = append(results, removed...)
+		for _, itemId := range rest {
+			if !promotedSet.Has(itemId) {
+				results = append(results, itemId)
+			}
+		}
+		ctx.results = results
+		ctx.numFreshPromoted = len(promoted)
+		ctx.freshnessTime = time.Since(start)
+		return nil
+	}
+}
+
 func (s *RestServer) RecommendOffline(ctx *recommendContext) error {
 	if len(ctx.results) < ctx.n {
 		start := time.Now()
-		recommendation, err := s.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, ctx.userId, ctx.category), 0, s.Config.Recommend.CacheSize)
-		if err != nil {
+		recommendTime, err := ctx.recommendTime.Time()
+		if err != nil && !errors.Is(err, errors.NotFound) {
 			return errors.Trace(err)
 		}
-		recommendation = s.FilterOutHiddenScores(ctx.response, recommendation, ctx.category)
+		// treat stale offline recommendation as missing
+		if ttl := s.Config.Recommend.Online.OfflineRecommendTTL; ttl > 0 && !recommendTime.IsZero() &&
+			recommendTime.Before(time.Now().Add(-ttl)) {
+			log.Logger().Warn("offline recommendation is stale",
+				log.UserId(ctx.userId), zap.Time("recommend_time", recommendTime))
+			ctx.loadOfflineRecTime = time.Since(start)
+			return nil
+		}
+		recommendation := ctx.offlineRecommend
+		if len(recommendation) > 0 {
+			ctx.offlineRecommendTime = recommendTime
+		}
+		recommendation = s.filterOutHiddenScoresInContext(ctx, recommendation)
 		for _, item := range recommendation {
-			if !ctx.excludeSet.Has(item.Id) {
-				ctx.results = append(ctx.results, item.Id)
-				ctx.excludeSet.Add(item.Id)
+			if !ctx.isExcluded(item.Id) {
+				ctx.addCandidate(item.Id, item.Score)
 			}
 		}
 		ctx.loadOfflineRecTime = time.Since(start)
@@ -780,15 +2212,14 @@ func (s *RestServer) RecommendOffline(ctx *recommendContext) error {
 func (s *RestServer) RecommendCollaborative(ctx *recommendContext) error {
 	if len(ctx.results) < ctx.n {
 		start := time.Now()
-		collaborativeRecommendation, err := s.CacheClient.GetSorted(cache.Key(cache.CollaborativeRecommend, ctx.userId, ctx.category), 0, s.Config.Recommend.CacheSize)
+		collaborativeRecommendation, err := s.cacheStore(ctx).GetSorted(cache.Key(cache.CollaborativeRecommend, ctx.userId, ctx.category), 0, s.Config.Recommend.CacheSize)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		collaborativeRecommendation = s.FilterOutHiddenScores(ctx.response, collaborativeRecommendation, ctx.category)
+		collaborativeRecommendation = s.filterOutHiddenScoresInContext(ctx, collaborativeRecommendation)
 		for _, item := range collaborativeRecommendation {
-			if !ctx.excludeSet.Has(item.Id) {
-				ctx.results = append(ctx.results, item.Id)
-				ctx.excludeSet.Add(item.Id)
+			if !ctx.isExcluded(item.Id) {
+				ctx.addCandidate(item.Id, item.Score)
 			}
 		}
 		ctx.loadColRecTime = time.Since(start)
@@ -807,21 +2238,21 @@ func (s *RestServer) RecommendUserBased(ctx *recommendContext) error {
 		start := time.Now()
 		candidates := make(map[string]float64)
 		// load similar users
-		similarUsers, err := s.CacheClient.GetSorted(cache.Key(cache.UserNeighbors, ctx.userId), 0, s.Config.Recommend.CacheSize)
+		similarUsers, err := s.cacheStore(ctx).GetSorted(cache.Key(cache.UserNeighbors, ctx.userId), 0, s.Config.Recommend.CacheSize)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		for _, user := range similarUsers {
 			// load historical feedback
-			feedbacks, err := s.DataClient.GetUserFeedback(user.Id, false, s.Config.Recommend.DataSource.PositiveFeedbackTypes...)
+			feedbacks, err := s.dataStore(ctx).GetUserFeedback(user.Id, false, s.Config.Recommend.DataSource.PositiveFeedbackTypes...)
 			if err != nil {
 				return errors.Trace(err)
 			}
 			feedbacks = s.filterOutHiddenFeedback(ctx.response, feedbacks)
 			// add unseen items
 			for _, feedback := range feedbacks {
-				if !ctx.excludeSet.Has(feedback.ItemId) {
-					item, err := s.DataClient.GetItem(feedback.ItemId)
+				if !ctx.isExcluded(feedback.ItemId) {
+					item, err := s.dataStore(ctx).GetItem(feedback.ItemId)
 					if err != nil {
 						return errors.Trace(err)
 					}
@@ -837,9 +2268,10 @@ func (s *RestServer) RecommendUserBased(ctx *recommendContext) error {
 		for id, score := range candidates {
 			filter.Push(id, score)
 		}
-		ids, _ := filter.PopAll()
-		ctx.results = append(ctx.results, ids...)
-		ctx.excludeSet.Add(ids...)
+		ids, scores := filter.PopAll()
+		for i := range ids {
+			ctx.addCandidate(ids[i], scores[i])
+		}
 		ctx.userBasedTime = time.Since(start)
 		ctx.numFromUserBased = len(ctx.results) - ctx.numPrevStage
 		ctx.numPrevStage = len(ctx.results)
@@ -847,37 +2279,48 @@ func (s *RestServer) RecommendUserBased(ctx *recommendContext) error {
 	return nil
 }
 
-func (s *RestServer) RecommendItemBased(ctx *recommendContext) error {
-	if len(ctx.results) < ctx.n {
+// RecommendLabelBased recommends popular items with labels of the user. It only works for users without offline
+// recommendation and feedback. Scores of items from different labels are merged with label weights.
+func (s *RestServer) RecommendLabelBased(ctx *recommendContext) error {
+	if len(ctx.results) < ctx.n && ctx.numFromOffline == 0 {
 		err := s.requireUserFeedback(ctx)
 		if err != nil {
 			return errors.Trace(err)
 		}
+		if ctx.hasFeedback() {
+			return nil
+		}
 		start := time.Now()
-		// truncate user feedback
-		data.SortFeedbacks(ctx.userFeedback)
-		userFeedback := make([]data.Feedback, 0, s.Config.Recommend.Online.NumFeedbackFallbackItemBased)
-		for _, feedback := range ctx.userFeedback {
-			if s.Config.Recommend.Online.NumFeedbackFallbackItemBased <= len(userFeedback) {
-				break
+		user, err := s.requireUser(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if user == nil {
+			return nil
+		}
+		candidates := make(map[string]float64)
+		for _, label := range lo.Uniq(user.Labels) {
+			items, err := s.getSortedShared(cache.Key(cache.LabelPopularItems, label), 0, s.Config.Recommend.CacheSize)
+			if err != nil {
+				return errors.Trace(err)
 			}
-			if funk.ContainsString(s.Config.Recommend.DataSource.PositiveFeedbackTypes, feedback.FeedbackType) {
-				userFeedback = append(userFeedback, feedback)
+			items = s.filterOutHiddenScoresInContext(ctx, items)
+			weight := s.Config.Recommend.Online.GetLabelWeight(label)
+			for _, item := range items {
+				if !ctx.isExcluded(item.Id) {
+					candidates[item.Id] += weight * item.Score
+				}
 			}
 		}
-		// collect candidates
-		candidates := make(map[string]float64)
-		for _, feedback := range userFeedback {
-			// load similar items
-			similarItems, err := s.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, feedback.ItemId, ctx.category), 0, s.Config.Recommend.CacheSize)
+		// filter out items not in the category
+		if ctx.category != "" && len(candidates) > 0 {
+			items, err := s.requireItems(ctx, lo.Keys(candidates))
 			if err != nil {
 				return errors.Trace(err)
 			}
-			// add unseen items
-			similarItems = s.FilterOutHiddenScores(ctx.response, similarItems, ctx.category)
-			for _, item := range similarItems {
-				if !ctx.excludeSet.Has(item.Id) {
-					candidates[item.Id] += item.Score
+			for itemId := range candidates {
+				if item := items[itemId]; item == nil || !funk.ContainsString(item.Categories, ctx.category) {
+					delete(candidates, itemId)
 				}
 			}
 		}
@@ -887,9 +2330,152 @@ func (s *RestServer) RecommendItemBased(ctx *recommendContext) error {
 		for id, score := range candidates {
 			filter.Push(id, score)
 		}
-		ids, _ := filter.PopAll()
-		ctx.results = append(ctx.results, ids...)
-		ctx.excludeSet.Add(ids...)
+		ids, scores := filter.PopAll()
+		for i := range ids {
+			ctx.addCandidate(ids[i], scores[i])
+		}
+		ctx.labelBasedTime = time.Since(start)
+		ctx.numFromLabelBased = len(ctx.results) - ctx.numPrevStage
+		ctx.numPrevStage = len(ctx.results)
+	}
+	return nil
+}
+
+// subscriptionCandidates sums scores of items in candidate lists of topics subscribed by the user. Hidden items are
+// removed while excluded items are kept.
+func (s *RestServer) subscriptionCandidates(ctx *recommendContext) (map[string]float64, error) {
+	user, err := s.requireUser(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	candidates := make(map[string]float64)
+	if user == nil {
+		return candidates, nil
+	}
+	for _, topic := range lo.Uniq(user.Subscribe) {
+		items, err := s.getSortedShared(cache.Key(cache.SubscriptionItems, topic), 0, s.Config.Recommend.CacheSize)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, item := range s.filterOutHiddenScoresInContext(ctx, items) {
+			candidates[item.Id] += s.Config.Recommend.Subscription.Weight * item.Score
+		}
+	}
+	return candidates, nil
+}
+
+// RecommendSubscription recommends recent and popular items of topics subscribed by the user. Items subscribed by
+// multiple topics are ranked higher.
+func (s *RestServer) RecommendSubscription(ctx *recommendContext) error {
+	if len(ctx.results) < ctx.n {
+		err := s.requireUserFeedback(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		start := time.Now()
+		candidates, err := s.subscriptionCandidates(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for itemId := range candidates {
+			if ctx.isExcluded(itemId) {
+				delete(candidates, itemId)
+			}
+		}
+		// filter out items not in the category
+		if ctx.category != "" && len(candidates) > 0 {
+			items, err := s.requireItems(ctx, lo.Keys(candidates))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			for itemId := range candidates {
+				if item := items[itemId]; item == nil || !funk.ContainsString(item.Categories, ctx.category) {
+					delete(candidates, itemId)
+				}
+			}
+		}
+		// collect top k
+		k := ctx.n - len(ctx.results)
+		filter := heap.NewTopKFilter[string, float64](k)
+		for id, score := range candidates {
+			filter.Push(id, score)
+		}
+		ids, scores := filter.PopAll()
+		for i := range ids {
+			ctx.addCandidate(ids[i], scores[i])
+		}
+		ctx.subscriptionTime = time.Since(start)
+		ctx.numFromSubscription = len(ctx.results) - ctx.numPrevStage
+		ctx.numPrevStage = len(ctx.results)
+	}
+	return nil
+}
+
+// itemBasedCandidates sums similarities of neighbors of items in recent positive feedback of the user. Items with
+// negative feedback from the user are skipped even if they have positive feedback.
+func (s *RestServer) itemBasedCandidates(ctx *recommendContext) (map[string]float64, error) {
+	// seed items are picked from feedback even if consumed items are excluded by the Bloom filter
+	if err := s.loadUserFeedback(ctx); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// truncate user feedback
+	data.SortFeedbacks(ctx.userFeedback)
+	negativeSet := s.negativeItems(ctx.userFeedback)
+	userFeedback := make([]data.Feedback, 0, s.Config.Recommend.Online.NumFeedbackFallbackItemBased)
+	for _, feedback := range ctx.userFeedback {
+		if s.Config.Recommend.Online.NumFeedbackFallbackItemBased <= len(userFeedback) {
+			break
+		}
+		if funk.ContainsString(s.Config.Recommend.DataSource.PositiveFeedbackTypes, feedback.FeedbackType) &&
+			!negativeSet.Has(feedback.ItemId) {
+			userFeedback = append(userFeedback, feedback)
+		}
+	}
+	// collect candidates
+	neighbors, err := s.batchLoadItemNeighbors(lo.Map(userFeedback, func(feedback data.Feedback, _ int) string {
+		return feedback.ItemId
+	}), ctx.category)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	candidates := make(map[string]float64)
+	for _, similarItems := range neighbors {
+		for _, item := range similarItems {
+			candidates[item.Id] += item.Score
+		}
+	}
+	return candidates, nil
+}
+
+func (s *RestServer) RecommendItemBased(ctx *recommendContext) error {
+	if len(ctx.results) < ctx.n {
+		err := s.requireUserFeedback(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		start := time.Now()
+		// candidates are shared by concurrent requests of the user
+		v, err := s.coalesce(CoalesceItemBased, coalesceKey(ctx.userId, ctx.category), func() (interface{}, error) {
+			return s.itemBasedCandidates(ctx)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		candidates := v.(map[string]float64)
+		// collect top k except hidden and seen items
+		itemIds := lo.Keys(candidates)
+		isHidden := s.HiddenItemsManager.IsHiddenWithDelta(itemIds, ctx.category, ctx.hiddenDelta)
+		k := ctx.n - len(ctx.results)
+		filter := heap.NewTopKFilter[string, float64](k)
+		for i, itemId := range itemIds {
+			if !isHidden[i] && !ctx.isExcluded(itemId) {
+				filter.Push(itemId, candidates[itemId])
+			}
+		}
+		ids, scores := filter.PopAll()
+		for i := range ids {
+			ctx.addCandidate(ids[i], scores[i])
+		}
 		ctx.itemBasedTime = time.Since(start)
 		ctx.numFromItemBased = len(ctx.results) - ctx.numPrevStage
 		ctx.numPrevStage = len(ctx.results)
@@ -904,15 +2490,14 @@ func (s *RestServer) RecommendLatest(ctx *recommendContext) error {
 			return errors.Trace(err)
 		}
 		start := time.Now()
-		items, err := s.CacheClient.GetSorted(cache.Key(cache.LatestItems, ctx.category), 0, s.Config.Recommend.CacheSize)
+		items, err := s.getSortedShared(cache.Key(cache.LatestItems, ctx.category), 0, s.Config.Recommend.CacheSize)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		items = s.FilterOutHiddenScores(ctx.response, items, ctx.category)
+		items = s.filterOutHiddenScoresInContext(ctx, items)
 		for _, item := range items {
-			if !ctx.excludeSet.Has(item.Id) {
-				ctx.results = append(ctx.results, item.Id)
-				ctx.excludeSet.Add(item.Id)
+			if !ctx.isExcluded(item.Id) {
+				ctx.addCandidate(item.Id, item.Score)
 			}
 		}
 		ctx.loadLatestTime = time.Since(start)
@@ -929,15 +2514,14 @@ func (s *RestServer) RecommendPopular(ctx *recommendContext) error {
 			return errors.Trace(err)
 		}
 		start := time.Now()
-		items, err := s.CacheClient.GetSorted(cache.Key(cache.PopularItems, ctx.category), 0, s.Config.Recommend.CacheSize)
+		items, err := s.getSortedShared(cache.Key(cache.PopularItems, ctx.category), 0, s.Config.Recommend.CacheSize)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		items = s.FilterOutHiddenScores(ctx.response, items, ctx.category)
+		items = s.filterOutHiddenScoresInContext(ctx, items)
 		for _, item := range items {
-			if !ctx.excludeSet.Has(item.Id) {
-				ctx.results = append(ctx.results, item.Id)
-				ctx.excludeSet.Add(item.Id)
+			if !ctx.isExcluded(item.Id) {
+				ctx.addCandidate(item.Id, item.Score)
 			}
 		}
 		ctx.loadPopularTime = time.Since(start)
@@ -967,37 +2551,112 @@ func (s *RestServer) getRecommend(request *restful.Request, response *restful.Re
 		BadRequest(response, err)
 		return
 	}
-	// online recommendation
-	recommenders := []Recommender{s.RecommendOffline}
-	for _, recommender := range s.Config.Recommend.Online.FallbackRecommend {
-		switch recommender {
-		case "collaborative":
-			recommenders = append(recommenders, s.RecommendCollaborative)
-		case "item_based":
-			recommenders = append(recommenders, s.RecommendItemBased)
-		case "user_based":
-			recommenders = append(recommenders, s.RecommendUserBased)
-		case "latest":
-			recommenders = append(recommenders, s.RecommendLatest)
-		case "popular":
-			recommenders = append(recommenders, s.RecommendPopular)
-		default:
-			InternalServerError(response, fmt.Errorf("unknown fallback recommendation method `%s`", recommender))
+	suppressionWindow := s.Config.Recommend.Online.SuppressionWindow
+	if request.QueryParameter("suppression-window") != "" {
+		if suppressionWindow, err = ParseDuration(request, "suppression-window"); err != nil {
+			BadRequest(response, err)
 			return
 		}
 	}
-	results, err := s.Recommend(response, userId, category, offset+n, recommenders...)
+	freshnessQuota, err := ParseFloat(request, "freshness-quota", s.Config.Recommend.Online.FreshnessQuota)
 	if err != nil {
-		InternalServerError(response, err)
+		BadRequest(response, err)
+		return
+	} else if freshnessQuota < 0 || freshnessQuota > 1 {
+		BadRequest(response, fmt.Errorf("freshness quota should be in [0, 1]"))
+		return
+	}
+	freshnessWindow := s.Config.Recommend.Online.FreshnessWindow
+	if request.QueryParameter("freshness-window") != "" {
+		if freshnessWindow, err = ParseDuration(request, "freshness-window"); err != nil {
+			BadRequest(response, err)
+			return
+		}
+	}
+	exploreRatio, err := ParseFloat(request, "explore", s.Config.Server.ExploreRatio)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	} else if exploreRatio < 0 || exploreRatio > 1 {
+		BadRequest(response, fmt.Errorf("explore ratio should be in [0, 1]"))
+		return
+	}
+	latencyBudget, err := s.latencyBudget(request)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if cacheSize := s.Config.Recommend.CacheSizeOf(category); s.Config.Recommend.Online.ExceedCacheSize == config.ExceedCacheSizeReject &&
+		n+offset > cacheSize {
+		BadRequest(response, fmt.Errorf("n + offset (%d) exceeds the length of cached recommendation (%d) in category \"%s\"",
+			n+offset, cacheSize, category))
 		return
 	}
-	results = results[mathutil.Min(offset, len(results)):]
+	// online recommendation
+	options := recommendOptions{
+		suppressImpressions: writeBackFeedback != "",
+		suppressionWindow:   suppressionWindow,
+		exploreRatio:        exploreRatio,
+		freshnessQuota:      freshnessQuota,
+		freshnessWindow:     freshnessWindow,
+		latencyBudget:       latencyBudget,
+	}
+	var results []string
+	if token := request.QueryParameter("page-token"); token != "" || request.QueryParameter("paging") == "token" {
+		// page through a snapshot of recommendation
+		var next string
+		results, next, err = s.recommendPage(response, userId, category, token, n, options)
+		if errors.Is(err, ErrPageTokenExpired) {
+			Gone(response, err)
+			return
+		} else if errors.Is(err, errors.NotValid) {
+			BadRequest(response, err)
+			return
+		} else if err != nil {
+			InternalServerError(response, err)
+			return
+		}
+		if next != "" {
+			response.AddHeader(HeaderNextPageToken, next)
+		}
+	} else {
+		recommenders, err := s.recommendChain(options)
+		if err != nil {
+			if !s.serveDegraded(response, userId, category, n, offset, err) {
+				InternalServerError(response, err)
+			}
+			return
+		}
+		results, err = s.Recommend(response, userId, category, offset+n, recommenders...)
+		if err != nil {
+			if !s.serveDegraded(response, userId, category, n, offset, err) {
+				InternalServerError(response, err)
+			}
+			return
+		}
+		s.keepDegraded(userId, category, results)
+		results = results[mathutil.Min(offset, len(results)):]
+	}
+	// tag with the generation of the ranking model
+	if s.Config.Recommend.Collaborative.CanaryPercent > 0 {
+		generation, err := s.CacheClient.Get(cache.Key(cache.RankingGeneration, userId)).String()
+		if err == nil {
+			response.AddHeader(HeaderRankingGeneration, generation)
+		} else if !errors.Is(err, errors.NotFound) {
+			InternalServerError(response, err)
+			return
+		}
+	}
 	// write back
 	if writeBackFeedback != "" {
 		startTime := time.Now()
-		for _, itemId := range results {
-			// insert to data store
-			feedback := data.Feedback{
+		if s.estimateCTR() && lo.Contains(s.Config.Recommend.DataSource.ReadFeedbackTypes, writeBackFeedback) {
+			onlineCTR.Impress(startTime, userId, results...)
+		}
+		// feedback is inserted in the background
+		feedback := make([]data.Feedback, len(results))
+		for i, itemId := range results {
+			feedback[i] = data.Feedback{
 				FeedbackKey: data.FeedbackKey{
 					UserId:       userId,
 					ItemId:       itemId,
@@ -1005,18 +2664,14 @@ func (s *RestServer) getRecommend(request *restful.Request, response *restful.Re
 				},
 				Timestamp: startTime.Add(writeBackDelay),
 			}
-			err = s.DataClient.BatchInsertFeedback([]data.Feedback{feedback}, false, false, false)
-			if err != nil {
-				InternalServerError(response, err)
-				return
-			}
-			// insert to cache store
-			err = s.InsertFeedbackToCache([]data.Feedback{feedback})
-			if err != nil {
-				InternalServerError(response, err)
-				return
-			}
 		}
+		if err = s.WriteBackBuffer.Add(feedback, writeBackDelay); err != nil {
+			log.ResponseLogger(response).Warn("failed to write back feedback", zap.Error(err))
+		}
+	}
+	// archive served recommendation
+	if s.HistoryArchiver != nil {
+		s.HistoryArchiver.Archive(response, userId, category, results)
 	}
 	// Send result
 	Ok(response, results)
@@ -1052,32 +2707,92 @@ func (s *RestServer) sessionRecommend(request *restful.Request, response *restfu
 		}
 	}
 	data.SortFeedbacks(dataFeedback)
+	if result, ok := s.recommendSession(response, dataFeedback, category, n, offset); ok {
+		Ok(response, result)
+	}
+}
+
+// recommendSession recommends items for sorted feedback in a session. Errors are written to the response if it
+// returns false.
+func (s *RestServer) recommendSession(response *restful.Response, dataFeedback []data.Feedback, category string, n, offset int) ([]cache.Scored, bool) {
+	// items with negative feedback in the session or from users of the session are neither used nor recommended
+	negativeSet := s.negativeItems(dataFeedback)
+	for _, userId := range lo.Uniq(lo.Map(dataFeedback, func(feedback data.Feedback, _ int) string {
+		return feedback.UserId
+	})) {
+		if userId == "" {
+			continue
+		}
+		userNegativeSet, err := s.loadNegativeItems(userId)
+		if err != nil {
+			InternalServerError(response, err)
+			return nil, false
+		}
+		negativeSet.Merge(userNegativeSet)
+	}
 
 	// item-based recommendation
-	var excludeSet = strset.New()
+	var excludeSet = negativeSet.Copy()
 	var userFeedback []data.Feedback
 	for _, feedback := range dataFeedback {
 		excludeSet.Add(feedback.ItemId)
-		if funk.ContainsString(s.Config.Recommend.DataSource.PositiveFeedbackTypes, feedback.FeedbackType) {
+		if funk.ContainsString(s.Config.Recommend.DataSource.PositiveFeedbackTypes, feedback.FeedbackType) &&
+			!negativeSet.Has(feedback.ItemId) {
 			userFeedback = append(userFeedback, feedback)
 		}
 	}
 	// collect candidates
+	seeds := lo.Map(userFeedback, func(feedback data.Feedback, _ int) string {
+		return feedback.ItemId
+	})
+	var (
+		merged []cache.Scored
+		err    error
+	)
+	if ttl := s.Config.Recommend.Online.SessionRecommendTTL; ttl > 0 &&
+		len(seeds) <= s.Config.Recommend.Online.NumFeedbackFallbackItemBased {
+		// the merge is independent of the order of seed items if all of them are used
+		merged, err = s.loadCachedSessionNeighbors(response, seeds, category, ttl)
+	} else {
+		merged, err = s.mergeSessionNeighbors(response, seeds, category)
+	}
+	if err != nil {
+		BadRequest(response, err)
+		return nil, false
+	}
 	candidates := make(map[string]float64)
-	usedFeedbackCount := 0
-	for _, feedback := range userFeedback {
-		// load similar items
-		similarItems, err := s.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, feedback.ItemId, category), 0, s.Config.Recommend.CacheSize)
-		if err != nil {
-			BadRequest(response, err)
-			return
+	for _, item := range s.FilterOutHiddenScores(response, merged, "") {
+		if !excludeSet.Has(item.Id) {
+			candidates[item.Id] = item.Score
 		}
-		// add unseen items
+	}
+	// collect top k
+	filter := heap.NewTopKFilter[string, float64](n + offset)
+	for id, score := range candidates {
+		filter.Push(id, score)
+	}
+	result := cache.CreateScoredItems(filter.PopAll())
+	if len(result) > offset {
+		result = result[offset:]
+	} else {
+		result = nil
+	}
+	return result[:lo.Min([]int{len(result), n})], true
+}
+
+// mergeSessionNeighbors sums up scores of visible neighbors of seed items. Seed items are used in order until
+// NumFeedbackFallbackItemBased seed items with visible neighbors are used.
+func (s *RestServer) mergeSessionNeighbors(response *restful.Response, seeds []string, category string) ([]cache.Scored, error) {
+	neighbors, err := s.batchLoadItemNeighbors(seeds, category)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	scores := make(map[string]float64)
+	usedFeedbackCount := 0
+	for _, similarItems := range neighbors {
 		similarItems = s.FilterOutHiddenScores(response, similarItems, "")
 		for _, item := range similarItems {
-			if !excludeSet.Has(item.Id) {
-				candidates[item.Id] += item.Score
-			}
+			scores[item.Id] += item.Score
 		}
 		// finish recommendation if the number of used feedbacks is enough
 		if len(similarItems) > 0 {
@@ -1087,20 +2802,52 @@ func (s *RestServer) sessionRecommend(request *restful.Request, response *restfu
 			}
 		}
 	}
-	// collect top k
-	filter := heap.NewTopKFilter[string, float64](n + offset)
-	for id, score := range candidates {
-		filter.Push(id, score)
+	merged := make([]cache.Scored, 0, len(scores))
+	for id, score := range scores {
+		merged = append(merged, cache.Scored{Id: id, Score: score})
 	}
-	result := cache.CreateScoredItems(filter.PopAll())
-	if len(result) > offset {
-		result = result[offset:]
-	} else {
-		result = nil
+	cache.SortScores(merged)
+	return merged, nil
+}
+
+// loadCachedSessionNeighbors returns merged neighbors of seed items from the cache store if they were merged within
+// the TTL, otherwise neighbors are merged and saved to the cache store.
+func (s *RestServer) loadCachedSessionNeighbors(response *restful.Response, seeds []string, category string, ttl time.Duration) ([]cache.Scored, error) {
+	signature := sessionSignature(seeds, category)
+	mergeTime, err := s.CacheClient.Get(cache.Key(cache.SessionRecommendTime, signature)).Time()
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		return nil, errors.Trace(err)
 	}
-	result = result[:lo.Min([]int{len(result), n})]
-	// Send result
-	Ok(response, result)
+	if !mergeTime.IsZero() && mergeTime.After(time.Now().Add(-ttl)) {
+		merged, err := s.CacheClient.GetSorted(cache.Key(cache.SessionRecommend, signature), 0, -1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		SessionRecommendCacheHitsTotal.Inc()
+		return merged, nil
+	}
+	SessionRecommendCacheMissesTotal.Inc()
+	merged, err := s.mergeSessionNeighbors(response, seeds, category)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = s.CacheClient.SetSorted(cache.Key(cache.SessionRecommend, signature), merged); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = s.CacheClient.Set(cache.Time(cache.Key(cache.SessionRecommendTime, signature), time.Now())); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return merged, nil
+}
+
+// sessionSignature returns the signature of seed items in a category. Seed items are sorted so that the signature
+// depends on neither the order nor timestamps of feedback.
+func sessionSignature(seeds []string, category string) string {
+	sorted := make([]string, len(seeds))
+	copy(sorted, seeds)
+	sort.Strings(sorted)
+	digest := md5.Sum([]byte(strings.Join(append(sorted, category), "\n")))
+	return hex.EncodeToString(digest[:])
 }
 
 // Success is the returned data structure for data insert operations.
@@ -1115,15 +2862,20 @@ func (s *RestServer) insertUser(request *restful.Request, response *restful.Resp
 		BadRequest(response, err)
 		return
 	}
+	if !s.admitUsers(response, []data.User{temp}) {
+		return
+	}
 	if err := s.DataClient.BatchInsertUsers([]data.User{temp}); err != nil {
 		InternalServerError(response, err)
 		return
 	}
+	s.AddUsage(UsageIngestedUsers, 1)
 	// insert modify timestamp
 	if err := s.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, temp.UserId), time.Now())); err != nil {
 		InternalServerError(response, err)
 		return
 	}
+	SetAudit(request, "insert a user", AuditEntity(AuditEntityUser, temp.UserId))
 	Ok(response, Success{RowAffected: 1})
 }
 
@@ -1136,22 +2888,73 @@ func (s *RestServer) modifyUser(request *restful.Request, response *restful.Resp
 		BadRequest(response, err)
 		return
 	}
+	if err := validateArrayPatch(patch.AddLabels, patch.RemoveLabels, patch.AddSubscribe, patch.RemoveSubscribe); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if version := ifMatchVersion(request.HeaderParameter("If-Match")); version != "" {
+		patch.Version = version
+	}
+	if err := s.DataClient.ModifyUser(userId, patch); err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			s.conflictUser(response, userId)
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
+	// insert modify timestamp
+	if err := s.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, userId), time.Now())); err != nil {
+		return
+	}
+	SetAudit(request, auditPatch("modify a user", patch))
+	Ok(response, Success{RowAffected: 1})
+}
+
+func (s *RestServer) addSubscribe(request *restful.Request, response *restful.Response) {
+	topic := request.PathParameter("topic")
+	s.patchSubscribe(request, response, fmt.Sprintf("subscribe topic %s", topic), data.UserPatch{AddSubscribe: []string{topic}})
+}
+
+func (s *RestServer) removeSubscribe(request *restful.Request, response *restful.Response) {
+	topic := request.PathParameter("topic")
+	s.patchSubscribe(request, response, fmt.Sprintf("unsubscribe topic %s", topic), data.UserPatch{RemoveSubscribe: []string{topic}})
+}
+
+// patchSubscribe adds or removes a subscribed topic of an existing user atomically.
+func (s *RestServer) patchSubscribe(request *restful.Request, response *restful.Response, action string, patch data.UserPatch) {
+	userId := request.PathParameter("user-id")
+	if _, err := s.DataClient.GetUser(userId); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			PageNotFound(response, err)
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
 	if err := s.DataClient.ModifyUser(userId, patch); err != nil {
 		InternalServerError(response, err)
 		return
 	}
 	// insert modify timestamp
 	if err := s.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, userId), time.Now())); err != nil {
+		InternalServerError(response, err)
 		return
 	}
+	SetAudit(request, action, AuditEntity(AuditEntityUser, userId))
 	Ok(response, Success{RowAffected: 1})
 }
 
 func (s *RestServer) getUser(request *restful.Request, response *restful.Response) {
 	// get user id
 	userId := request.PathParameter("user-id")
+	fields, err := ParseFields(request, userFields)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
 	// get user
-	user, err := s.DataClient.GetUser(userId)
+	user, err := s.getUserProjected(userId, fields)
 	if err != nil {
 		if errors.Is(err, errors.NotFound) {
 			PageNotFound(response, err)
@@ -1160,7 +2963,26 @@ func (s *RestServer) getUser(request *restful.Request, response *restful.Respons
 		}
 		return
 	}
-	Ok(response, user)
+	if fields == nil {
+		response.AddHeader("ETag", versionTag(user.Version()))
+	}
+	projected, err := project(user, "UserId", fields)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	Ok(response, projected)
+}
+
+// conflictUser sends the current user with 409 Conflict to the client.
+func (s *RestServer) conflictUser(response *restful.Response, userId string) {
+	user, err := s.DataClient.GetUser(userId)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	response.AddHeader("ETag", versionTag(user.Version()))
+	Conflict(response, user)
 }
 
 func (s *RestServer) insertUsers(request *restful.Request, response *restful.Response) {
@@ -1170,11 +2992,15 @@ func (s *RestServer) insertUsers(request *restful.Request, response *restful.Res
 		BadRequest(response, err)
 		return
 	}
+	if !s.admitUsers(response, temp) {
+		return
+	}
 	// range temp and achieve user
 	if err := s.DataClient.BatchInsertUsers(temp); err != nil {
 		InternalServerError(response, err)
 		return
 	}
+	s.AddUsage(UsageIngestedUsers, len(temp))
 	// insert modify timestamp
 	values := make([]cache.Value, len(temp))
 	for i, user := range temp {
@@ -1184,6 +3010,9 @@ func (s *RestServer) insertUsers(request *restful.Request, response *restful.Res
 		InternalServerError(response, err)
 		return
 	}
+	SetAudit(request, fmt.Sprintf("insert %d users", len(temp)), AuditEntities(AuditEntityUser, lo.Map(temp, func(user data.User, _ int) string {
+		return user.UserId
+	})...)...)
 	Ok(response, Success{RowAffected: len(temp)})
 }
 
@@ -1199,23 +3028,55 @@ func (s *RestServer) getUsers(request *restful.Request, response *restful.Respon
 		BadRequest(response, err)
 		return
 	}
+	fields, err := ParseFields(request, userFields)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
 	// get all users
-	cursor, users, err := s.DataClient.GetUsers(cursor, n)
+	cursor, users, err := s.getUsersProjected(cursor, n, fields)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if fields == nil {
+		Ok(response, UserIterator{Cursor: cursor, Users: users})
+		return
+	}
+	projected, err := project(users, "UserId", fields)
 	if err != nil {
 		InternalServerError(response, err)
 		return
 	}
-	Ok(response, UserIterator{Cursor: cursor, Users: users})
+	Ok(response, struct {
+		Cursor string
+		Users  interface{}
+	}{Cursor: cursor, Users: projected})
 }
 
 // delete a user by user-id
 func (s *RestServer) deleteUser(request *restful.Request, response *restful.Response) {
 	// get user-id and put into temp
 	userId := request.PathParameter("user-id")
-	if err := s.DataClient.DeleteUser(userId); err != nil {
+	erase, err := ParseBool(request, "erase", false)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if erase {
+		// erasing is an administrative operation
+		if !s.checkAdmin(request, response) {
+			return
+		}
+		err = s.eraseUser(userId)
+	} else {
+		err = s.DataClient.DeleteUser(userId)
+	}
+	if err != nil {
 		InternalServerError(response, err)
 		return
 	}
+	SetAudit(request, lo.If(erase, "erase a user").Else("delete a user"))
 	Ok(response, Success{RowAffected: 1})
 }
 
@@ -1244,36 +3105,111 @@ func (s *RestServer) getFeedbackByUser(request *restful.Request, response *restf
 
 // Item is the data structure for the item but stores the timestamp using string.
 type Item struct {
-	ItemId     string
-	IsHidden   bool
-	Categories []string
-	Timestamp  string
-	Labels     []string
-	Comment    string
+	ItemId       string
+	IsHidden     bool
+	Categories   []string
+	Timestamp    string
+	Labels       []string
+	Comment      string
+	VisibleFrom  string `json:",omitempty"`
+	VisibleUntil string `json:",omitempty"`
+}
+
+// parseVisibility parses a bound of the visibility window. Datetimes without timezones are treated as UTC.
+func parseVisibility(text string) (*time.Time, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := dateparse.ParseIn(text, time.UTC)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	t = t.In(time.UTC)
+	return &t, nil
+}
+
+// ToDataItem parses timestamps and the visibility window of an item.
+func (item Item) ToDataItem() (data.Item, error) {
+	var timestamp time.Time
+	var err error
+	if item.Timestamp != "" {
+		if timestamp, err = dateparse.ParseAny(item.Timestamp); err != nil {
+			return data.Item{}, err
+		}
+	}
+	// parse visibility window
+	visibleFrom, err := parseVisibility(item.VisibleFrom)
+	if err != nil {
+		return data.Item{}, err
+	}
+	visibleUntil, err := parseVisibility(item.VisibleUntil)
+	if err != nil {
+		return data.Item{}, err
+	}
+	return data.Item{
+		ItemId:       item.ItemId,
+		IsHidden:     item.IsHidden,
+		Categories:   item.Categories,
+		Timestamp:    timestamp,
+		Labels:       item.Labels,
+		Comment:      item.Comment,
+		VisibleFrom:  visibleFrom,
+		VisibleUntil: visibleUntil,
+	}, nil
 }
 
 func (s *RestServer) batchInsertItems(response *restful.Response, temp []Item) {
+	// parse datetime
+	start := time.Now()
+	items := make([]data.Item, len(temp))
+	for i, item := range temp {
+		var err error
+		if items[i], err = item.ToDataItem(); err != nil {
+			BadRequest(response, err)
+			return
+		}
+	}
+	parseTimesatmpTime := time.Since(start)
+	if err := s.insertItemsToStores(log.ResponseLogger(response), items); err != nil {
+		var quota *QuotaExceeded
+		if errors.As(err, &quota) {
+			Forbidden(response, quota)
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
+	log.ResponseLogger(response).Info("parse items", zap.Duration("parse_timestamp_time", parseTimesatmpTime))
+	Ok(response, Success{RowAffected: len(items)})
+}
+
+// insertItemsToStores inserts items into the data store, and updates latest items, popular items, categories and
+// hidden items in the cache store.
+func (s *RestServer) insertItemsToStores(logger *zap.Logger, items []data.Item) error {
 	var (
-		count        int
-		items        = make([]data.Item, 0, len(temp))
-		popularScore = lo.Map(temp, func(item Item, i int) float64 {
+		popularScore = lo.Map(items, func(item data.Item, i int) float64 {
 			return s.PopularItemsCache.GetSortedScore(item.ItemId)
 		})
 		modification = NewCacheModification(s.CacheClient, s.HiddenItemsManager)
 
 		loadExistedItemsTime time.Duration
-		parseTimesatmpTime   time.Duration
 		insertItemsTime      time.Duration
 		insertCacheTime      time.Duration
 	)
+	if s.QuotaManager != nil {
+		if err := s.QuotaManager.AdmitItems(lo.Map(items, func(t data.Item, i int) string {
+			return t.ItemId
+		})); err != nil {
+			return err
+		}
+	}
 	// load existed items
 	start := time.Now()
-	existedItems, err := s.DataClient.BatchGetItems(lo.Map(temp, func(t Item, i int) string {
+	existedItems, _, err := s.DataClient.BatchGetItems(lo.Map(items, func(t data.Item, i int) string {
 		return t.ItemId
 	}))
 	if err != nil {
-		InternalServerError(response, err)
-		return
+		return errors.Trace(err)
 	}
 	existedItemsSet := make(map[string]data.Item)
 	for _, item := range existedItems {
@@ -1281,30 +3217,15 @@ func (s *RestServer) batchInsertItems(response *restful.Response, temp []Item) {
 	}
 	loadExistedItemsTime = time.Since(start)
 
-	start = time.Now()
-	for i, item := range temp {
-		// parse datetime
-		var timestamp time.Time
-		var err error
-		if item.Timestamp != "" {
-			if timestamp, err = dateparse.ParseAny(item.Timestamp); err != nil {
-				BadRequest(response, err)
-				return
-			}
-		}
-		items = append(items, data.Item{
-			ItemId:     item.ItemId,
-			IsHidden:   item.IsHidden,
-			Categories: item.Categories,
-			Timestamp:  timestamp,
-			Labels:     item.Labels,
-			Comment:    item.Comment,
-		})
-		// collect latest items and poplar items
+	now := time.Now()
+	for i, item := range items {
+		// collect latest items and poplar items, while creation time of existing items is kept by the data store
 		if existedItem, exist := existedItemsSet[item.ItemId]; exist {
-			modification.modifyItem(item.ItemId, existedItem.Categories, item.Categories, float64(items[i].Timestamp.Unix()), popularScore[i])
+			item.CreatedAt = existedItem.CreatedAt
+			modification.modifyItem(item.ItemId, existedItem.Categories, item.Categories, s.latestScore(item), popularScore[i])
 		} else {
-			modification.addItem(item.ItemId, item.Categories, float64(timestamp.Unix()), popularScore[i])
+			item.CreatedAt = now
+			modification.addItem(item.ItemId, item.Categories, s.latestScore(item), popularScore[i])
 		}
 		// handle hidden items
 		if item.IsHidden {
@@ -1312,16 +3233,15 @@ func (s *RestServer) batchInsertItems(response *restful.Response, temp []Item) {
 		} else {
 			modification.unHideItem(item.ItemId)
 		}
-		count++
+		modification.setVisibility(item.ItemId, item.VisibleFrom, item.VisibleUntil)
 	}
-	parseTimesatmpTime = time.Since(start)
 
 	// insert items
 	start = time.Now()
 	if err = s.DataClient.BatchInsertItems(items); err != nil {
-		InternalServerError(response, err)
-		return
+		return errors.Trace(err)
 	}
+	s.AddUsage(UsageIngestedItems, len(items))
 	insertItemsTime = time.Since(start)
 
 	// insert modify timestamp
@@ -1333,26 +3253,22 @@ func (s *RestServer) batchInsertItems(response *restful.Response, temp []Item) {
 		categories.Add(item.Categories...)
 	}
 	if err = s.CacheClient.Set(values...); err != nil {
-		InternalServerError(response, err)
-		return
+		return errors.Trace(err)
 	}
 	// insert categories
 	if err = s.CacheClient.AddSet(cache.ItemCategories, categories.List()...); err != nil {
-		InternalServerError(response, err)
-		return
+		return errors.Trace(err)
 	}
 	// insert timestamp score and popular score
 	if err = modification.Exec(); err != nil {
-		InternalServerError(response, err)
-		return
+		return errors.Trace(err)
 	}
 	insertCacheTime = time.Since(start)
-	log.ResponseLogger(response).Info("batch insert items",
+	logger.Info("batch insert items",
 		zap.Duration("load_existed_items_time", loadExistedItemsTime),
-		zap.Duration("parse_timestamp_time", parseTimesatmpTime),
 		zap.Duration("insert_items_time", insertItemsTime),
 		zap.Duration("insert_cache_time", insertCacheTime))
-	Ok(response, Success{RowAffected: count})
+	return nil
 }
 
 func (s *RestServer) insertItems(request *restful.Request, response *restful.Response) {
@@ -1361,6 +3277,9 @@ func (s *RestServer) insertItems(request *restful.Request, response *restful.Res
 		BadRequest(response, err)
 		return
 	}
+	SetAudit(request, fmt.Sprintf("insert %d items", len(items)), AuditEntities(AuditEntityItem, lo.Map(items, func(item Item, _ int) string {
+		return item.ItemId
+	})...)...)
 	// Insert items
 	s.batchInsertItems(response, items)
 }
@@ -1372,6 +3291,7 @@ func (s *RestServer) insertItem(request *restful.Request, response *restful.Resp
 		BadRequest(response, err)
 		return
 	}
+	SetAudit(request, "insert an item", AuditEntity(AuditEntityItem, item.ItemId))
 	s.batchInsertItems(response, []Item{item})
 }
 
@@ -1382,6 +3302,53 @@ func (s *RestServer) modifyItem(request *restful.Request, response *restful.Resp
 		BadRequest(response, err)
 		return
 	}
+	if err := validateArrayPatch(patch.AddLabels, patch.RemoveLabels, patch.AddCategories, patch.RemoveCategories); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	// items hidden or unhidden by users have no hidden reason
+	if patch.IsHidden != nil && patch.HiddenReason == nil {
+		patch.HiddenReason = new(string)
+	}
+	if version := ifMatchVersion(request.HeaderParameter("If-Match")); version != "" {
+		patch.Version = version
+	}
+	if err := s.patchItem(itemId, patch); err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			s.conflictItem(response, itemId)
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
+	SetAudit(request, auditPatch("modify an item", patch))
+	Ok(response, Success{RowAffected: 1})
+}
+
+// conflictItem sends the current item with 409 Conflict to the client.
+func (s *RestServer) conflictItem(response *restful.Response, itemId string) {
+	item, err := s.DataClient.GetItem(itemId)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	response.AddHeader("ETag", versionTag(item.Version()))
+	Conflict(response, item)
+}
+
+// validateArrayPatch validates pairs of elements to add and remove. An element can't be added and removed at the same
+// time.
+func validateArrayPatch(pairs ...[]string) error {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if conflicts := lo.Intersect(pairs[i], pairs[i+1]); len(conflicts) > 0 {
+			return errors.NotValidf("patch adding and removing %v", conflicts)
+		}
+	}
+	return nil
+}
+
+// patchItem modifies an item in the data store and refreshes the item in the cache store.
+func (s *RestServer) patchItem(itemId string, patch data.ItemPatch) error {
 	// insert hidden items to cache
 	modification := NewCacheModification(s.CacheClient, s.HiddenItemsManager)
 	if patch.IsHidden != nil {
@@ -1392,33 +3359,35 @@ func (s *RestServer) modifyItem(request *restful.Request, response *restful.Resp
 		}
 	}
 	// insert new timestamp to the latest scores
-	if patch.Timestamp != nil || patch.Categories != nil {
+	if patch.Timestamp != nil || patch.Categories != nil || len(patch.AddCategories) > 0 || len(patch.RemoveCategories) > 0 {
 		item, err := s.DataClient.GetItem(itemId)
 		if err != nil {
-			InternalServerError(response, err)
-			return
+			return errors.Trace(err)
 		}
 		popularScore := s.PopularItemsCache.GetSortedScore(itemId)
-		modification.modifyItem(itemId, item.Categories,
-			lo.If(patch.Categories != nil, patch.Categories).Else(item.Categories),
-			float64(lo.If(patch.Timestamp != nil, patch.Timestamp).Else(&item.Timestamp).Unix()),
-			popularScore)
+		patched := patch.Apply(item)
+		modification.modifyItem(itemId, item.Categories, patched.Categories, s.latestScore(patched), popularScore)
+	}
+	// insert new visibility window
+	if patch.VisibleFrom != nil || patch.VisibleUntil != nil {
+		item, err := s.DataClient.GetItem(itemId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		modification.setVisibility(itemId,
+			lo.If(patch.VisibleFrom != nil, patch.VisibleFrom).Else(item.VisibleFrom),
+			lo.If(patch.VisibleUntil != nil, patch.VisibleUntil).Else(item.VisibleUntil))
 	}
 	// modify item
 	if err := s.DataClient.ModifyItem(itemId, patch); err != nil {
-		InternalServerError(response, err)
-		return
+		return errors.Trace(err)
 	}
 	// insert modify timestamp
 	if err := s.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyItemTime, itemId), time.Now())); err != nil {
-		return
+		return errors.Trace(err)
 	}
 	// refresh cache
-	if err := modification.Exec(); err != nil {
-		InternalServerError(response, err)
-		return
-	}
-	Ok(response, Success{RowAffected: 1})
+	return modification.Exec()
 }
 
 // ItemIterator is the iterator for items.
@@ -1427,6 +3396,26 @@ type ItemIterator struct {
 	Items  []data.Item
 }
 
+// Categories are categories and numbers of items in them. Counts are approximate if Approximate is true.
+type Categories struct {
+	Categories  []data.CategoryCount
+	Approximate bool
+}
+
+func (s *RestServer) getCategories(_ *restful.Request, response *restful.Response) {
+	categories, err := s.DataClient.GetCategories()
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	// replaced rows in ClickHouse might not be merged yet
+	dataStore := s.Config.Database.DataStore
+	approximate := strings.HasPrefix(dataStore, storage.ClickhousePrefix) ||
+		strings.HasPrefix(dataStore, storage.CHHTTPPrefix) ||
+		strings.HasPrefix(dataStore, storage.CHHTTPSPrefix)
+	Ok(response, Categories{Categories: categories, Approximate: approximate})
+}
+
 func (s *RestServer) getItems(request *restful.Request, response *restful.Response) {
 	cursor := request.QueryParameter("cursor")
 	n, err := ParseInt(request, "n", s.Config.Server.DefaultN)
@@ -1434,19 +3423,57 @@ func (s *RestServer) getItems(request *restful.Request, response *restful.Respon
 		BadRequest(response, err)
 		return
 	}
-	cursor, items, err := s.DataClient.GetItems(cursor, n, nil)
+	visibleNow, err := ParseBool(request, "visible-now", false)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	fields, err := ParseFields(request, itemFields)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	readFields := fields
+	if visibleNow && fields != nil {
+		readFields = append([]string{"IsHidden", "VisibleFrom", "VisibleUntil"}, fields...)
+	}
+	cursor, items, err := s.getItemsProjected(cursor, n, nil, readFields)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if visibleNow {
+		// a page might contain less than n items after filtering
+		now := time.Now()
+		items = lo.Filter(items, func(item data.Item, _ int) bool {
+			return !item.IsHidden && item.IsVisibleAt(now)
+		})
+	}
+	if fields == nil {
+		Ok(response, ItemIterator{Cursor: cursor, Items: items})
+		return
+	}
+	projected, err := project(items, "ItemId", fields)
 	if err != nil {
 		InternalServerError(response, err)
 		return
 	}
-	Ok(response, ItemIterator{Cursor: cursor, Items: items})
+	Ok(response, struct {
+		Cursor string
+		Items  interface{}
+	}{Cursor: cursor, Items: projected})
 }
 
 func (s *RestServer) getItem(request *restful.Request, response *restful.Response) {
 	// Get item id
 	itemId := request.PathParameter("item-id")
+	fields, err := ParseFields(request, itemFields)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
 	// Get item
-	item, err := s.DataClient.GetItem(itemId)
+	item, err := s.getItemProjected(itemId, fields)
 	if err != nil {
 		if errors.Is(err, errors.NotFound) {
 			PageNotFound(response, err)
@@ -1455,7 +3482,15 @@ func (s *RestServer) getItem(request *restful.Request, response *restful.Respons
 		}
 		return
 	}
-	Ok(response, item)
+	if fields == nil {
+		response.AddHeader("ETag", versionTag(item.Version()))
+	}
+	projected, err := project(item, "ItemId", fields)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	Ok(response, projected)
 }
 
 func (s *RestServer) deleteItem(request *restful.Request, response *restful.Response) {
@@ -1470,6 +3505,7 @@ func (s *RestServer) deleteItem(request *restful.Request, response *restful.Resp
 		InternalServerError(response, err)
 		return
 	}
+	SetAudit(request, "delete an item")
 	Ok(response, Success{RowAffected: 1})
 }
 
@@ -1494,11 +3530,12 @@ func (s *RestServer) insertItemCategory(request *restful.Request, response *rest
 	// refresh cache
 	popularScore := s.PopularItemsCache.GetSortedScore(itemId)
 	modification := NewCacheModification(s.CacheClient, s.HiddenItemsManager)
-	modification.addItemCategory(itemId, category, float64(item.Timestamp.Unix()), popularScore)
+	modification.addItemCategory(itemId, category, s.latestScore(item), popularScore)
 	if err = modification.Exec(); err != nil {
 		InternalServerError(response, err)
 		return
 	}
+	SetAudit(request, fmt.Sprintf("insert category %v", category))
 	Ok(response, Success{RowAffected: 1})
 }
 
@@ -1529,6 +3566,7 @@ func (s *RestServer) deleteItemCategory(request *restful.Request, response *rest
 		InternalServerError(response, err)
 		return
 	}
+	SetAudit(request, fmt.Sprintf("delete category %v", category))
 	Ok(response, Success{RowAffected: 1})
 }
 
@@ -1537,12 +3575,15 @@ type Feedback struct {
 	data.FeedbackKey
 	Timestamp string
 	Comment   string
+	// Context is the context of the feedback, such as the device and the placement.
+	Context map[string]string
 }
 
 func (f Feedback) ToDataFeedback() (data.Feedback, error) {
 	var feedback data.Feedback
 	feedback.FeedbackKey = f.FeedbackKey
 	feedback.Comment = f.Comment
+	feedback.Context = f.Context
 	if f.Timestamp != "" {
 		var err error
 		feedback.Timestamp, err = dateparse.ParseAny(f.Timestamp)
@@ -1553,6 +3594,111 @@ func (f Feedback) ToDataFeedback() (data.Feedback, error) {
 	return feedback, nil
 }
 
+// insertFeedbackToStores inserts feedback into the data store and the cache store, and updates modification
+// timestamps of users and items. Future timestamps beyond the skew tolerance are clamped to now. New users and items
+// aren't inserted beyond quotas.
+func (s *RestServer) insertFeedbackToStores(feedback []data.Feedback, overwrite bool) error {
+	s.clampFutureFeedback(feedback)
+	autoInsertUser, autoInsertItem, err := s.admitFeedback(feedback)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// items created automatically are enriched in the background
+	var newItems []string
+	if autoInsertItem && s.ItemEnricher.enabled() {
+		newItems = s.ItemEnricher.newItems(feedback)
+	}
+	// insert feedback to data store
+	err = s.DataClient.BatchInsertFeedback(feedback, autoInsertUser, autoInsertItem, overwrite)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.ItemEnricher.Enqueue(newItems)
+	s.AddUsage(UsageIngestedFeedback, len(feedback))
+	// insert feedback to cache store
+	if err = s.InsertFeedbackToCache(feedback); err != nil {
+		return errors.Trace(err)
+	}
+	if s.ActivityTracker != nil {
+		s.ActivityTracker.Add(feedback)
+	}
+	if s.Config.Recommend.ConsumedFilter.EnableConsumedFilter {
+		if err = s.updateConsumedFilters(feedback); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	users := set.NewStringSet()
+	items := set.NewStringSet()
+	for _, v := range feedback {
+		users.Add(v.UserId)
+		items.Add(v.ItemId)
+	}
+	values := make([]cache.Value, 0, users.Size()+items.Size()+1)
+	for _, userId := range users.List() {
+		values = append(values, cache.Time(cache.Key(cache.LastModifyUserTime, userId), time.Now()))
+	}
+	for _, itemId := range items.List() {
+		values = append(values, cache.Time(cache.Key(cache.LastModifyItemTime, itemId), time.Now()))
+	}
+	// the master watches the latest ingestion to detect stalled pipelines
+	values = append(values, cache.Time(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime), time.Now()))
+	if err = s.CacheClient.Set(values...); err != nil {
+		return errors.Trace(err)
+	}
+	// refresh recommendation of these users in priority
+	if err = s.PushPriorityUsers(users.List()); err != nil {
+		log.Logger().Error("failed to push users to priority refresh queue", zap.Error(err))
+	}
+	// track active users to warm up their recommendation
+	if err = s.pushActiveUsers(users.List()); err != nil {
+		log.Logger().Error("failed to push active users", zap.Error(err))
+	}
+	return nil
+}
+
+// PushPriorityUsers pushes users into the priority refresh queue. Users already in the queue are moved to the tail,
+// and the oldest users are dropped once the queue is full.
+func (s *RestServer) PushPriorityUsers(userIds []string) error {
+	queueSize := s.Config.Recommend.Offline.PriorityRefreshQueueSize
+	if queueSize <= 0 || len(userIds) == 0 {
+		return nil
+	}
+	timestamp := float64(time.Now().UnixNano())
+	scores := make([]cache.Scored, len(userIds))
+	for i, userId := range userIds {
+		scores[i] = cache.Scored{Id: userId, Score: timestamp}
+	}
+	if err := s.CacheClient.AddSorted(cache.Sorted(cache.PriorityRefreshUsers, scores)); err != nil {
+		return errors.Trace(err)
+	}
+	overflow, err := s.CacheClient.GetSorted(cache.PriorityRefreshUsers, queueSize, queueSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(overflow) > 0 {
+		return s.CacheClient.RemSortedByScore(cache.PriorityRefreshUsers, math.Inf(-1), overflow[0].Score)
+	}
+	return nil
+}
+
+// estimateCTR returns true if both read feedback types and positive feedback types are configured, so that the
+// click-through rate could be estimated from impressions written back and positive feedback.
+func (s *RestServer) estimateCTR() bool {
+	return len(s.Config.Recommend.DataSource.ReadFeedbackTypes) > 0 &&
+		len(s.Config.Recommend.DataSource.PositiveFeedbackTypes) > 0
+}
+
+// recordClicks counts positive feedback as clicks of recommended items if the click-through rate is estimated.
+func (s *RestServer) recordClicks(feedback []data.Feedback) {
+	if s.estimateCTR() {
+		for _, v := range feedback {
+			if lo.Contains(s.Config.Recommend.DataSource.PositiveFeedbackTypes, v.FeedbackType) {
+				onlineCTR.Click(time.Now(), v.UserId, v.ItemId)
+			}
+		}
+	}
+}
+
 func (s *RestServer) insertFeedback(overwrite bool) func(request *restful.Request, response *restful.Response) {
 	return func(request *restful.Request, response *restful.Response) {
 		// add ratings
@@ -1564,42 +3710,27 @@ func (s *RestServer) insertFeedback(overwrite bool) func(request *restful.Reques
 		// parse datetime
 		var err error
 		feedback := make([]data.Feedback, len(feedbackLiterTime))
-		users := set.NewStringSet()
-		items := set.NewStringSet()
 		for i := range feedback {
-			users.Add(feedbackLiterTime[i].UserId)
-			items.Add(feedbackLiterTime[i].ItemId)
 			feedback[i], err = feedbackLiterTime[i].ToDataFeedback()
 			if err != nil {
 				BadRequest(response, err)
 				return
 			}
 		}
-		// insert feedback to data store
-		err = s.DataClient.BatchInsertFeedback(feedback,
-			s.Config.Server.AutoInsertUser,
-			s.Config.Server.AutoInsertItem, overwrite)
-		if err != nil {
-			InternalServerError(response, err)
-			return
-		}
-		// insert feedback to cache store
-		if err = s.InsertFeedbackToCache(feedback); err != nil {
-			InternalServerError(response, err)
+		// validate feedback
+		if rejections := s.validateFeedbackBatch(response, feedback); len(rejections) > 0 {
+			RejectFeedback(response, rejections)
 			return
 		}
-		values := make([]cache.Value, 0, users.Size()+items.Size())
-		for _, userId := range users.List() {
-			values = append(values, cache.Time(cache.Key(cache.LastModifyUserTime, userId), time.Now()))
-		}
-		for _, itemId := range items.List() {
-			values = append(values, cache.Time(cache.Key(cache.LastModifyItemTime, itemId), time.Now()))
-		}
-		if err = s.CacheClient.Set(values...); err != nil {
+		if err = s.insertFeedbackToStores(feedback, overwrite); err != nil {
 			InternalServerError(response, err)
 			return
 		}
+		s.recordClicks(feedback)
 		log.ResponseLogger(response).Info("Insert feedback successfully", zap.Int("num_feedback", len(feedback)))
+		SetAudit(request, fmt.Sprintf("insert %d feedback", len(feedback)), append(
+			AuditEntities(AuditEntityUser, lo.Map(feedback, func(f data.Feedback, _ int) string { return f.UserId })...),
+			AuditEntities(AuditEntityItem, lo.Map(feedback, func(f data.Feedback, _ int) string { return f.ItemId })...)...)...)
 		Ok(response, Success{RowAffected: len(feedback)})
 	}
 }
@@ -1661,10 +3792,57 @@ func (s *RestServer) deleteUserItemFeedback(request *restful.Request, response *
 	if deleteCount, err := s.DataClient.DeleteUserItemFeedback(userId, itemId); err != nil {
 		InternalServerError(response, err)
 	} else {
+		SetAudit(request, fmt.Sprintf("delete %d feedback", deleteCount))
 		Ok(response, Success{RowAffected: deleteCount})
 	}
 }
 
+// deleteUserFeedbackInRange deletes feedback of a user in a time range, such as erasing activities in a month. Deleting
+// feedback in an unbounded range requires the confirm flag. Recommendation of the user is refreshed in priority.
+func (s *RestServer) deleteUserFeedbackInRange(request *restful.Request, response *restful.Response) {
+	userId := request.PathParameter("user-id")
+	feedbackTypes := request.QueryParameters("type")
+	begin, err := ParseTime(request, "begin")
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	end, err := ParseTime(request, "end")
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	confirm, err := ParseBool(request, "confirm", false)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if begin == nil && end == nil && !confirm {
+		BadRequest(response, errors.New("begin or end is required unless confirm is true"))
+		return
+	}
+	if begin != nil && end != nil && !begin.Before(*end) {
+		BadRequest(response, errors.NotValidf("range [%v, %v)", begin, end))
+		return
+	}
+	deleteCount, err := s.DataClient.DeleteUserFeedbackInRange(userId, begin, end, feedbackTypes...)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if deleteCount > 0 {
+		if err = s.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, userId), time.Now())); err != nil {
+			InternalServerError(response, err)
+			return
+		}
+		if err = s.PushPriorityUsers([]string{userId}); err != nil {
+			log.ResponseLogger(response).Error("failed to push users to priority refresh queue", zap.Error(err))
+		}
+	}
+	SetAudit(request, fmt.Sprintf("delete %d feedback in range [%v, %v) of types %v", deleteCount, begin, end, feedbackTypes))
+	Ok(response, Success{RowAffected: deleteCount})
+}
+
 func (s *RestServer) getTypedUserItemFeedback(request *restful.Request, response *restful.Response) {
 	// Parse parameters
 	feedbackType := request.PathParameter("feedback-type")
@@ -1687,6 +3865,7 @@ func (s *RestServer) deleteTypedUserItemFeedback(request *restful.Request, respo
 	if deleteCount, err := s.DataClient.DeleteUserItemFeedback(userId, itemId, feedbackType); err != nil {
 		InternalServerError(response, err)
 	} else {
+		SetAudit(request, fmt.Sprintf("delete %d feedback of type %v", deleteCount, feedbackType))
 		Ok(response, Success{deleteCount})
 	}
 }
@@ -1795,6 +3974,46 @@ func PageNotFound(response *restful.Response, err error) {
 	}
 }
 
+// Gone returns a gone error.
+func Gone(response *restful.Response, err error) {
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := response.WriteError(http.StatusGone, err); err != nil {
+		log.ResponseLogger(response).Error("failed to write error", zap.Error(err))
+	}
+}
+
+// TooManyRequests returns a too many requests error.
+func TooManyRequests(response *restful.Response, err error) {
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := response.WriteError(http.StatusTooManyRequests, err); err != nil {
+		log.ResponseLogger(response).Error("failed to write error", zap.Error(err))
+	}
+}
+
+// Forbidden returns a forbidden error with the content as JSON.
+func Forbidden(response *restful.Response, content interface{}) {
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := response.WriteHeaderAndJson(http.StatusForbidden, content, restful.MIME_JSON); err != nil {
+		log.ResponseLogger(response).Error("failed to write json", zap.Error(err))
+	}
+}
+
+// ServiceUnavailable sends the content as JSON with 503 Service Unavailable to the client.
+func ServiceUnavailable(response *restful.Response, content interface{}) {
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := response.WriteHeaderAndJson(http.StatusServiceUnavailable, content, restful.MIME_JSON); err != nil {
+		log.ResponseLogger(response).Error("failed to write json", zap.Error(err))
+	}
+}
+
+// Conflict sends the content as JSON with 409 Conflict to the client.
+func Conflict(response *restful.Response, content interface{}) {
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := response.WriteHeaderAndJson(http.StatusConflict, content, restful.MIME_JSON); err != nil {
+		log.ResponseLogger(response).Error("failed to write json", zap.Error(err))
+	}
+}
+
 // Ok sends the content as JSON to the client.
 func Ok(response *restful.Response, content interface{}) {
 	response.Header().Set("Access-Control-Allow-Origin", "*")
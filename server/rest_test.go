@@ -14,18 +14,25 @@
 package server
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
 	"github.com/samber/lo"
 	"github.com/steinfletcher/apitest"
 	"github.com/stretchr/testify/assert"
 	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model/rerank"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
 	"google.golang.org/protobuf/proto"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -58,6 +65,18 @@ func newMockServer(t *testing.T) *mockServer {
 	s.Config.Server.APIKey = apiKey
 	s.PopularItemsCache = newPopularItemsCacheForTest(&s.RestServer)
 	s.HiddenItemsManager = newHiddenItemsManagerForTest(&s.RestServer)
+	s.RulesManager = newRulesManagerForTest(&s.RestServer)
+	s.DuplicatesManager = newDuplicatesManagerForTest(&s.RestServer)
+	s.ActivityTracker = newActivityTrackerForTest(&s.RestServer)
+	s.QuotaManager = newQuotaManagerForTest(&s.RestServer)
+	s.ReadOnlyManager = newReadOnlyManagerForTest(&s.RestServer)
+	s.AuditLogger = newAuditLoggerForTest(&s.RestServer)
+	s.WriteBackBuffer = newWriteBackBufferForTest(&s.RestServer)
+	s.HistoryArchiver = newHistoryArchiverForTest(&s.RestServer)
+	s.UsageCounter = newUsageCounterForTest(&s.RestServer)
+	s.ShadowTraffic = newShadowTrafficForTest(&s.RestServer)
+	s.ItemEnricher = newItemEnricherForTest(&s.RestServer)
+	s.Reranker = rerank.NewReranker()
 	s.WebService = new(restful.WebService)
 	s.CreateWebService()
 	// create handler
@@ -171,6 +190,320 @@ func TestServer_Users(t *testing.T) {
 		End()
 }
 
+func TestServer_ExportEraseUser(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	user := data.User{UserId: "0", Labels: []string{"a"}, Subscribe: []string{}, Comment: "comment"}
+	err := s.DataClient.BatchInsertUsers([]data.User{user, {UserId: "1"}})
+	assert.NoError(t, err)
+	feedback := []data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "1"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: time.Date(1996, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "1", ItemId: "2"}, Timestamp: time.Date(1996, 3, 16, 0, 0, 0, 0, time.UTC)},
+	}
+	err = s.DataClient.BatchInsertFeedback(feedback, true, true, true)
+	assert.NoError(t, err)
+	err = s.CacheClient.AddSet(cache.ItemCategories, "c")
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0", "c"), []cache.Scored{{"3", 1}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.UserNeighbors, "0"), []cache.Scored{{"1", 1}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.UserNeighbors, "1"), []cache.Scored{{"0", 1}, {"2", 0.5}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.UserNeighbors, "2"), []cache.Scored{{"0", 1}, {"1", 0.5}})
+	assert.NoError(t, err)
+	err = s.CacheClient.AddSorted(cache.Sorted(cache.PriorityRefreshUsers, []cache.Scored{{"0", 1}, {"1", 1}}))
+	assert.NoError(t, err)
+	err = s.CacheClient.Set(cache.String(cache.Key(cache.OfflineRecommendDigest, "0"), "digest"))
+	assert.NoError(t, err)
+
+	// export user
+	request, err := http.NewRequest(http.MethodGet, "/api/user/0/export", nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var export UserExport
+	err = json.Unmarshal(recorder.Body.Bytes(), &export)
+	assert.NoError(t, err)
+	assert.Equal(t, user, export.User)
+	assert.ElementsMatch(t, feedback[:2], export.Feedback)
+	assert.Equal(t, map[string][]cache.Scored{
+		cache.Key(cache.OfflineRecommend, "0", "c"): {{"3", 1}},
+		cache.Key(cache.UserNeighbors, "0"):         {{"1", 1}},
+	}, export.Sorted)
+	assert.Equal(t, map[string]string{cache.Key(cache.OfflineRecommendDigest, "0"): "digest"}, export.Values)
+
+	// erase user with the admin api key
+	s.Config.Server.AdminAPIKey = "admin"
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/user/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"erase": "true"}).
+		Expect(t).
+		Status(http.StatusForbidden).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/user/0").
+		Header("X-API-Key", "admin").
+		QueryParams(map[string]string{"erase": "true"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected":1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/0/export").
+		Header("X-API-Key", "admin").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	ret, err := s.DataClient.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Empty(t, ret)
+	scores, err := s.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0", "c"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, scores)
+	scores, err = s.CacheClient.GetSorted(cache.Key(cache.UserNeighbors, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, scores)
+	_, err = s.CacheClient.Get(cache.Key(cache.OfflineRecommendDigest, "0")).String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+	scores, err = s.CacheClient.GetSorted(cache.Key(cache.UserNeighbors, "2"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 0.5}}, scores)
+	scores, err = s.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 1}}, scores)
+	// others are kept
+	ret, err = s.DataClient.GetUserFeedback("1", true)
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+	scores, err = s.CacheClient.GetSorted(cache.Key(cache.UserNeighbors, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"2", 0.5}}, scores)
+}
+
+func TestServer_ImportItems(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// import csv with mapping
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/import/items").
+		Header("X-API-Key", apiKey).
+		Header("Content-Type", "text/csv").
+		QueryParams(map[string]string{"mapping": "item_id:id,is_hidden:hidden,categories:cats,time_stamp:ts"}).
+		Body("id,hidden,cats,ts,labels\n" +
+			"1,false,a|b,2020-01-01,x|y\n" +
+			",false,,,\n" +
+			"2,maybe,,,\n" +
+			"3,true,a,2020-01-02,\n").
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, ImportSummary{
+			RowsAccepted: 2,
+			RowsRejected: 2,
+			Rejections: []ImportRejection{
+				{Line: 3, Reason: "invalid item id `` (id cannot be empty)"},
+				{Line: 4, Reason: "invalid hidden value `maybe`"},
+			},
+		})).
+		End()
+	item, err := s.DataClient.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, item.Categories)
+	assert.Equal(t, []string{"x", "y"}, item.Labels)
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), item.Timestamp)
+	item, err = s.DataClient.GetItem("3")
+	assert.NoError(t, err)
+	assert.True(t, item.IsHidden)
+	categories, err := s.CacheClient.GetSet(cache.ItemCategories)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, categories)
+
+	// import json lines
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/import/items").
+		Header("X-API-Key", apiKey).
+		Header("Content-Type", "application/x-ndjson").
+		QueryParams(map[string]string{"format": "jsonl"}).
+		Body(`{"ItemId":"4","Categories":["c"],"Timestamp":"2020-01-03"}` + "\n\n" +
+			`{"ItemId":"5/6"}` + "\n").
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, ImportSummary{
+			RowsAccepted: 1,
+			RowsRejected: 1,
+			Rejections:   []ImportRejection{{Line: 3, Reason: "invalid item id `5/6` (id cannot contain `/`)"}},
+		})).
+		End()
+	item, err = s.DataClient.GetItem("4")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, item.Categories)
+
+	// missing columns and unknown fields
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/import/items").
+		Header("X-API-Key", apiKey).
+		Header("Content-Type", "text/csv").
+		Body("id\n1\n").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/import/items").
+		Header("X-API-Key", apiKey).
+		Header("Content-Type", "text/csv").
+		QueryParams(map[string]string{"mapping": "name:id"}).
+		Body("id\n1\n").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestServer_ImportFeedback(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.ImportJobs = 2
+	// import csv without header from a multipart form
+	var body strings.Builder
+	writer := multipart.NewWriter(&body)
+	file, err := writer.CreateFormFile("file", "feedback.csv")
+	assert.NoError(t, err)
+	_, err = file.Write([]byte("2020-01-01\tread\t0\t1\n" +
+		"2020-01-02\tread\t0\t2\n" +
+		"yesterday\tread\t0\t3\n"))
+	assert.NoError(t, err)
+	err = writer.Close()
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/import/feedback").
+		Header("X-API-Key", apiKey).
+		Header("Content-Type", writer.FormDataContentType()).
+		QueryParams(map[string]string{
+			"sep":        "\t",
+			"has-header": "false",
+			"mapping":    "time_stamp:0,feedback_type:1,user_id:2,item_id:3",
+		}).
+		Body(body.String()).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, ImportSummary{
+			RowsAccepted: 2,
+			RowsRejected: 1,
+			Rejections:   []ImportRejection{{Line: 3, Reason: "failed to parse datetime `yesterday`"}},
+		})).
+		End()
+	feedback, err := s.DataClient.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}, feedback)
+
+	// import json lines
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/import/feedback").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"format": "jsonl"}).
+		Body(`{"FeedbackType":"star","UserId":"1","ItemId":"1","Timestamp":"2020-01-03"}` + "\n").
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, ImportSummary{RowsAccepted: 1})).
+		End()
+	feedback, err = s.DataClient.GetUserFeedback("1", true)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+}
+
+func TestServer_Export(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0", Labels: []string{"a", "b"}, Comment: "comment"}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "0", Categories: []string{"c"}, Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Comment: "a,b"},
+	})
+	assert.NoError(t, err)
+
+	// export csv
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/export/users").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Header("Content-Type", "text/csv").
+		Body("user_id,labels,subscribe,comment\r\n0,a|b,,comment\r\n").
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/export/items").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body("item_id,is_hidden,categories,time_stamp,labels,comment,visible_from,visible_until\r\n" +
+			"0,false,c,2020-01-01T00:00:00Z,,\"a,b\",,\r\n").
+		End()
+	feedback := []data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "0"}, Timestamp: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), Context: map[string]string{"device": "mobile"}},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "2"}, Timestamp: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	err = s.DataClient.BatchInsertFeedback(feedback, true, true, true)
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/export/feedback").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"since": "2020-01-02", "until": "2020-01-03"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body("feedback_type,user_id,item_id,time_stamp,comment,context\r\nread,0,1,2020-01-02T00:00:00Z,,\"{\"\"device\"\":\"\"mobile\"\"}\"\r\n").
+		End()
+
+	// export json lines with gzip
+	request, err := http.NewRequest(http.MethodGet, "/api/export/feedback?format=jsonl&feedback-type=read", nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+	request.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(recorder.Body)
+	assert.NoError(t, err)
+	var exported []data.Feedback
+	decoder := json.NewDecoder(reader)
+	for decoder.More() {
+		var v data.Feedback
+		err = decoder.Decode(&v)
+		assert.NoError(t, err)
+		exported = append(exported, v)
+	}
+	assert.ElementsMatch(t, feedback[:2], exported)
+
+	// unknown format
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/export/users").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"format": "xml"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
 func TestServer_Items(t *testing.T) {
 	s := newMockServer(t)
 	defer s.Close(t)
@@ -267,6 +600,7 @@ func TestServer_Items(t *testing.T) {
 		}).
 		Expect(t).
 		Status(http.StatusOK).
+		Header(OrderedByHeader, data.ItemTimeTimestamp).
 		Body(marshal(t, []cache.Scored{
 			{Id: items[3].ItemId, Score: float64(items[3].Timestamp.Unix())},
 			{Id: items[1].ItemId, Score: float64(items[1].Timestamp.Unix())},
@@ -606,6 +940,25 @@ func TestServer_Items(t *testing.T) {
 		End()
 }
 
+func TestServer_Categories(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "0", Categories: []string{"a", "b"}},
+		{ItemId: "1", Categories: []string{"a"}},
+		{ItemId: "2", IsHidden: true, Categories: []string{"c"}},
+	})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/categories").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, Categories{Categories: []data.CategoryCount{{"a", 2}, {"b", 1}, {"c", 1}}})).
+		End()
+}
+
 func TestServer_Feedback(t *testing.T) {
 	s := newMockServer(t)
 	defer s.Close(t)
@@ -627,6 +980,9 @@ func TestServer_Feedback(t *testing.T) {
 		Status(http.StatusOK).
 		Body(`{"RowAffected": 5}`).
 		End()
+	insertTime, err := s.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.LastInsertFeedbackTime)).Time()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), insertTime, time.Minute)
 	//Get Feedback
 	apitest.New().
 		Handler(s.handler).
@@ -775,6 +1131,8 @@ func TestServer_Sort(t *testing.T) {
 		{"Latest Items in Category", cache.Key(cache.LatestItems, "0"), "/api/latest/0"},
 		{"Popular Items", cache.PopularItems, "/api/popular/"},
 		{"Popular Items in Category", cache.Key(cache.PopularItems, "0"), "/api/popular/0"},
+		{"Trending Items", cache.TrendingItems, "/api/trending/"},
+		{"Trending Items in Category", cache.Key(cache.TrendingItems, "0"), "/api/trending/0"},
 		{"Offline Recommend", cache.Key(cache.OfflineRecommend, "0"), "/api/intermediate/recommend/0"},
 		{"Offline Recommend in Category", cache.Key(cache.OfflineRecommend, "0", "0"), "/api/intermediate/recommend/0/0"},
 	}
@@ -838,6 +1196,138 @@ func TestServer_Sort(t *testing.T) {
 	}
 }
 
+func TestServer_GetCovisitedItems(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.CacheClient.SetSorted(cache.Key(cache.CovisitedItems, "0"), []cache.Scored{
+		{"1", 30}, {"2", 20}, {"3", 10},
+	})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0/covisit").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"1", 30}, {"2", 20}})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0/covisit").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "offset": "2"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"3", 10}})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/1/covisit").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{})).
+		End()
+}
+
+func TestServer_GetItemNeighborsInCategory(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert items
+	err := s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1", Categories: []string{"a"}},
+		{ItemId: "2", Categories: []string{"b"}},
+		{ItemId: "3", Categories: []string{"a", "b"}},
+		{ItemId: "4"},
+	})
+	assert.NoError(t, err)
+	// insert neighbors
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0"), []cache.Scored{
+		{"1", 100}, {"2", 99}, {"3", 98}, {"4", 97},
+	})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0", "b"), []cache.Scored{
+		{"5", 100}, {"6", 99},
+	})
+	assert.NoError(t, err)
+
+	// get cached neighbors in category
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0/neighbors/b").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"5", 100}, {"6", 99}})).
+		End()
+	// filter neighbors in category without cache
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0/neighbors/a").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"1", 100}, {"3", 98}})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0/neighbors/a").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "1", "offset": "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"3", 98}})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0/neighbors/c").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{})).
+		End()
+}
+
+func TestServer_PriorityRefreshQueue(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.Offline.PriorityRefreshQueueSize = 3
+	// users with new feedback are pushed
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "1", ItemId: "1"}},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "2", ItemId: "1"}},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 2}`).
+		End()
+	users, err := s.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1", "2"}, cache.RemoveScores(users))
+	// users are deduplicated and the oldest users are dropped
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "2", ItemId: "2"}},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "3", ItemId: "2"}},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "4", ItemId: "2"}},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 3}`).
+		End()
+	users, err = s.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"2", "3", "4"}, cache.RemoveScores(users))
+}
+
 func TestServer_DeleteFeedback(t *testing.T) {
 	s := newMockServer(t)
 	defer s.Close(t)
@@ -896,23 +1386,115 @@ func TestServer_DeleteFeedback(t *testing.T) {
 		End()
 }
 
-func TestServer_Measurement(t *testing.T) {
+func TestServer_DeleteUserFeedbackInRange(t *testing.T) {
 	s := newMockServer(t)
 	defer s.Close(t)
-	measurements := []Measurement{
-		{"Test_NDCG", time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 0},
-		{"Test_NDCG", time.Date(2001, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 1},
-		{"Test_NDCG", time.Date(2002, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 2},
-		{"Test_NDCG", time.Date(2003, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 3},
-		{"Test_NDCG", time.Date(2004, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 4},
-		{"Test_Recall", time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 1},
+	feedback := []Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: "2022-02-28T00:00:00Z"},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "1"}, Timestamp: "2022-03-01T00:00:00Z"},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: "2022-03-15T00:00:00Z"},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "3"}, Timestamp: "2022-04-01T00:00:00Z"},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "1", ItemId: "1"}, Timestamp: "2022-03-01T00:00:00Z"},
 	}
-	err := s.InsertMeasurement(measurements...)
-	assert.NoError(t, err)
 	apitest.New().
 		Handler(s.handler).
-		Get("/api/measurements/Test_NDCG").
-		Query("n", "3").
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON(feedback).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 5}`).
+		End()
+	err := s.CacheClient.SetSorted(cache.PriorityRefreshUsers, nil)
+	assert.NoError(t, err)
+
+	// delete feedback of a type in March
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/feedback/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"type": "click", "begin": "2022-03-01", "end": "2022-04-01"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	remained, err := s.DataClient.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"0", "2", "3"}, lo.Map(remained, func(f data.Feedback, _ int) string {
+		return f.ItemId
+	}))
+	users, err := s.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0"}, cache.RemoveScores(users))
+	_, err = s.CacheClient.Get(cache.Key(cache.LastModifyUserTime, "0")).Time()
+	assert.NoError(t, err)
+
+	// delete feedback since a time
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/feedback/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"begin": "2022-03-01"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 2}`).
+		End()
+	// deleting all feedback requires the confirm flag
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/feedback/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/feedback/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"confirm": "true"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	// invalid ranges
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/feedback/1").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"begin": "2022-04-01", "end": "2022-03-01"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/feedback/1").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"begin": "March"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	remained, err = s.DataClient.GetUserFeedback("1", true)
+	assert.NoError(t, err)
+	assert.Len(t, remained, 1)
+}
+
+func TestServer_Measurement(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	measurements := []Measurement{
+		{"Test_NDCG", time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 0},
+		{"Test_NDCG", time.Date(2001, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 1},
+		{"Test_NDCG", time.Date(2002, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 2},
+		{"Test_NDCG", time.Date(2003, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 3},
+		{"Test_NDCG", time.Date(2004, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 4},
+		{"Test_Recall", time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC).Local(), 1},
+	}
+	err := s.InsertMeasurement(measurements...)
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/measurements/Test_NDCG").
+		Query("n", "3").
 		Header("X-API-Key", apiKey).
 		Expect(t).
 		Status(http.StatusOK).
@@ -956,7 +1538,7 @@ func TestServer_GetRecommends(t *testing.T) {
 	feedback := []data.Feedback{
 		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "2"}},
 		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "4"}},
-		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "1"}, Timestamp: time.Now().Add(time.Hour)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "1"}, Timestamp: time.Now().Add(time.Minute)},
 	}
 	apitest.New().
 		Handler(s.handler).
@@ -1004,39 +1586,858 @@ func TestServer_GetRecommends(t *testing.T) {
 		End()
 	apitest.New().
 		Handler(s.handler).
-		Get("/api/recommend/0").
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":               "3",
+			"write-back-type": "read",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "3", "5"})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                "3",
+			"write-back-type":  "read",
+			"write-back-delay": "10m",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"6", "7", "8"})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"6", "7", "8"})).
+		End()
+}
+
+func TestServer_GetRecommends_Suppression(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.DataSource.ReadFeedbackTypes = []string{"read"}
+	// insert recommendation
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+		{Id: "6", Score: 94},
+		{Id: "7", Score: 93},
+		{Id: "8", Score: 92},
+	})
+	assert.NoError(t, err)
+	// feedback of unknown items isn't written back
+	err = s.DataClient.BatchInsertItems(lo.Map([]string{"1", "2", "3", "4", "5", "6", "7", "8"}, func(itemId string, _ int) data.Item {
+		return data.Item{ItemId: itemId}
+	}))
+	assert.NoError(t, err)
+	// insert read feedback a day ago
+	err = s.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: time.Now().Add(-24 * time.Hour)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: time.Now().Add(-24 * time.Hour)},
+	}, true, true, true)
+	assert.NoError(t, err)
+	// items read within 48 hours are suppressed
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                "3",
+			"write-back-type":  "read",
+			"write-back-delay": "10m",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"3", "4", "5"})).
+		End()
+	// override suppression window
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                  "3",
+			"write-back-type":    "read",
+			"write-back-delay":   "10m",
+			"suppression-window": "12h",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "6"})).
+		End()
+	// skip suppression if candidates are not enough
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                "3",
+			"write-back-type":  "read",
+			"write-back-delay": "10m",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+	// skip suppression if write back is disabled
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+	// invalid suppression window
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"write-back-type":    "read",
+			"suppression-window": "abc",
+		}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestServer_GetRecommends_SuppressionPending(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.DataSource.ReadFeedbackTypes = []string{"read"}
+	// write back feedback in the background
+	s.WriteBackBuffer = NewWriteBackBuffer(&s.RestServer)
+	defer s.WriteBackBuffer.Close()
+	// insert recommendation
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+		{Id: "6", Score: 94},
+		{Id: "7", Score: 93},
+		{Id: "8", Score: 92},
+	})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                "3",
+			"write-back-type":  "read",
+			"write-back-delay": "10m",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3"})).
+		End()
+	// delayed read feedback is pending in the cache store
+	feedback, err := s.DataClient.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+	// items with pending read feedback are suppressed
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                "3",
+			"write-back-type":  "read",
+			"write-back-delay": "10m",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"4", "5", "6"})).
+		End()
+}
+
+func TestServer_GetRecommends_NegativeFeedback(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.DataSource.ReadFeedbackTypes = []string{"read"}
+	s.Config.Recommend.DataSource.NegativeFeedbackTypes = []string{"dislike"}
+	s.Config.Recommend.Online.FallbackRecommend = []string{"latest"}
+	// insert recommendation
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+	})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{
+		{Id: "2", Score: 2},
+		{Id: "5", Score: 1},
+	})
+	assert.NoError(t, err)
+	// dislike item 2 a year ago
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{{
+			FeedbackKey: data.FeedbackKey{FeedbackType: "dislike", UserId: "0", ItemId: "2"},
+			Timestamp:   time.Now().AddDate(-1, 0, 0).Format(time.RFC3339),
+		}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	// disliked items are excluded from offline recommendation
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                "3",
+			"write-back-type":  "read",
+			"write-back-delay": "10m",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "3", "4"})).
+		End()
+	// disliked items are excluded even if suppression is skipped for lack of candidates
+	for i := 0; i < 3; i++ {
+		apitest.New().
+			Handler(s.handler).
+			Get("/api/recommend/0").
+			Header("X-API-Key", apiKey).
+			QueryParams(map[string]string{
+				"n":                "10",
+				"write-back-type":  "read",
+				"write-back-delay": "10m",
+			}).
+			Expect(t).
+			Status(http.StatusOK).
+			Body(marshal(t, []string{"1", "3", "4", "5"})).
+			End()
+	}
+}
+
+func TestServer_NegativeFeedback_Neighbors(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"star"}
+	s.Config.Recommend.DataSource.NegativeFeedbackTypes = []string{"dislike"}
+	err := s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "1"), []cache.Scored{{"2", 3}, {"3", 2}, {"4", 1}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "2"), []cache.Scored{{"5", 1}})
+	assert.NoError(t, err)
+	// user 0 dislikes item 3
+	err = s.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "dislike", UserId: "0", ItemId: "3"}, Timestamp: time.Now()},
+	}, true, true, true)
+	assert.NoError(t, err)
+
+	// neighbors exclude items disliked by the user
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/1/neighbors").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"user-id": "0"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"2", 3}, {"4", 1}})).
+		End()
+	// session recommendation excludes items disliked by users of the session
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/recommend").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "1"}, Timestamp: time.Now()},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"2", 3}, {"4", 1}})).
+		End()
+	// items disliked in the session are neither used nor recommended
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/recommend").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "star", ItemId: "1"}, Timestamp: time.Now()},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "star", ItemId: "2"}, Timestamp: time.Now()},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "dislike", ItemId: "2"}, Timestamp: time.Now()},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"3", 2}, {"4", 1}})).
+		End()
+}
+
+func TestServer_GetRecommends_Freshness(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert items
+	staleTime, freshTime := time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour)
+	err := s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1", Timestamp: staleTime},
+		{ItemId: "2", Timestamp: staleTime},
+		{ItemId: "3", Timestamp: staleTime},
+		{ItemId: "4", Timestamp: staleTime},
+		{ItemId: "5", Timestamp: staleTime},
+		{ItemId: "6", Timestamp: staleTime},
+		{ItemId: "7", Timestamp: freshTime},
+		{ItemId: "8", Timestamp: staleTime},
+		{ItemId: "9", Timestamp: freshTime},
+		{ItemId: "10", Timestamp: freshTime},
+	})
+	assert.NoError(t, err)
+	// insert recommendation
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+		{Id: "6", Score: 94},
+		{Id: "7", Score: 93},
+		{Id: "8", Score: 92},
+	})
+	assert.NoError(t, err)
+	// insert latest items
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{
+		{Id: "10", Score: float64(freshTime.Unix())},
+		{Id: "9", Score: float64(freshTime.Unix() - 1)},
+		{Id: "7", Score: float64(freshTime.Unix() - 2)},
+		{Id: "8", Score: float64(staleTime.Unix())},
+	})
+	assert.NoError(t, err)
+	// freshness is disabled by default
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "5",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3", "4", "5"})).
+		End()
+	// promote fresh items from candidates
+	s.Config.Recommend.Online.FreshnessQuota = 0.2
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "5",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "7", "3", "4"})).
+		End()
+	// promote fresh items from latest items
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":               "5",
+			"freshness-quota": "0.4",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "7", "2", "10", "3"})).
+		End()
+	// override freshness window
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":                "5",
+			"freshness-quota":  "0.4",
+			"freshness-window": "30m",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3", "4", "5"})).
+		End()
+	// invalid freshness quota
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":               "5",
+			"freshness-quota": "1.5",
+		}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestServer_GetLatest_ItemTimeField(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	backfilledTime, recentTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Now().Add(-time.Hour)
+	latest := func(orderedBy string) []cache.Scored {
+		request, err := http.NewRequest(http.MethodGet, "/api/latest", nil)
+		assert.NoError(t, err)
+		request.Header.Set("X-API-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		s.handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, orderedBy, recorder.Header().Get(OrderedByHeader))
+		var scores []cache.Scored
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &scores))
+		return scores
+	}
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "backfilled", Score: 99},
+		{Id: "old", Score: 98},
+		{Id: "recent", Score: 97},
+	})
+	assert.NoError(t, err)
+
+	// backfilled items are ordered by historical timestamps in event time
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/items").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Item{{ItemId: "old", Timestamp: backfilledTime.Add(-time.Hour)}, {ItemId: "recent", Timestamp: recentTime}}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/items").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Item{{ItemId: "backfilled", Timestamp: backfilledTime}}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.Equal(t, []cache.Scored{
+		{Id: "recent", Score: float64(recentTime.Unix())},
+		{Id: "backfilled", Score: float64(backfilledTime.Unix())},
+		{Id: "old", Score: float64(backfilledTime.Add(-time.Hour).Unix())},
+	}, latest(data.ItemTimeTimestamp))
+	// backfilled items are stale in event time
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":               "2",
+			"freshness-quota": "0.5",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"backfilled", "recent"})).
+		End()
+
+	// backfilled items are ordered by the time of insertion in ingestion time
+	s.Config.Recommend.DataSource.ItemTimeField = data.ItemTimeCreatedAt
+	start := time.Now()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/items").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Item{{ItemId: "backfilled", Timestamp: backfilledTime}}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	scores := latest(data.ItemTimeCreatedAt)
+	if assert.Len(t, scores, 3) {
+		assert.Equal(t, "backfilled", scores[0].Id)
+		assert.GreaterOrEqual(t, scores[0].Score, float64(start.Add(-time.Minute).Unix()))
+	}
+	// backfilled items are fresh in ingestion time
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":               "2",
+			"freshness-quota": "0.5",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"backfilled", "old"})).
+		End()
+}
+
+func TestServer_GetRecommends_Explore(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert recommendation
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+		{Id: "6", Score: 94},
+	})
+	assert.NoError(t, err)
+	// insert latest items
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{
+		{Id: "1", Score: 13},
+		{Id: "11", Score: 12},
+		{Id: "12", Score: 11},
+	})
+	assert.NoError(t, err)
+	// exploration is disabled by default
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "5",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3", "4", "5"})).
+		End()
+	// replace the last items by explored items
+	s.Config.Server.ExploreRatio = 0.4
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "5",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Header(HeaderExploredItems, "11,12").
+		Body(marshal(t, []string{"1", "2", "3", "11", "12"})).
+		End()
+	// override explore ratio
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{{Id: "11", Score: 12}})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":       "5",
+			"explore": "0.2",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3", "4", "11"})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n":       "5",
+			"explore": "2",
+		}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	// samples are stable for a user
+	var latest []cache.Scored
+	for i := 100; i < 200; i++ {
+		latest = append(latest, cache.Scored{Id: strconv.Itoa(i), Score: float64(i)})
+	}
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), latest)
+	assert.NoError(t, err)
+	var results [][]string
+	for i := 0; i < 2; i++ {
+		request, err := http.NewRequest(http.MethodGet, "/api/recommend/0?n=5", nil)
+		assert.NoError(t, err)
+		request.Header.Set("X-API-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		s.handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var items []string
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &items))
+		assert.Equal(t, []string{"1", "2", "3"}, items[:3])
+		assert.Equal(t, strings.Join(items[3:], ","), recorder.Header().Get(HeaderExploredItems))
+		results = append(results, items)
+	}
+	assert.Equal(t, results[0], results[1])
+}
+
+func TestServer_GetRecommends_Staleness(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert recommendation generated an hour ago
+	recommendTime := time.Now().Add(-time.Hour)
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"1", 99}, {"2", 98}, {"3", 97}})
+	assert.NoError(t, err)
+	err = s.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), recommendTime))
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{{"4", 96}, {"5", 95}, {"6", 94}})
+	assert.NoError(t, err)
+
+	// serve offline recommendation with freshness
+	request, err := http.NewRequest(http.MethodGet, "/api/recommend/0?n=3", nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []string{"1", "2", "3"}), recorder.Body.String())
+	assert.Equal(t, recommendTime.Format(time.RFC3339), recorder.Header().Get(HeaderRecommendFreshness))
+
+	// fallback if offline recommendation is stale
+	s.Config.Recommend.Online.OfflineRecommendTTL = 30 * time.Minute
+	recorder = httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []string{"4", "5", "6"}), recorder.Body.String())
+	assert.Empty(t, recorder.Header().Get(HeaderRecommendFreshness))
+}
+
+func TestServer_GetRecommends_CacheSize(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.CacheSize = 3
+	s.Config.Recommend.CategoryCacheSize = map[string]int{"shorts": 5}
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"1", 99}, {"2", 98}, {"3", 97}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0", "shorts"), []cache.Scored{
+		{"1", 99}, {"2", 98}, {"3", 97}, {"4", 96}, {"5", 95}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{{"4", 96}, {"5", 95}, {"6", 94}})
+	assert.NoError(t, err)
+
+	// backfill by fallback recommenders
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "5"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2", "3", "4", "5"})).
+		End()
+
+	// reject n greater than the length of cached recommendation
+	s.Config.Recommend.Online.ExceedCacheSize = config.ExceedCacheSizeReject
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "5"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "2", "offset": "2"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0/shorts").
 		Header("X-API-Key", apiKey).
-		QueryParams(map[string]string{
-			"n":               "3",
-			"write-back-type": "read",
-		}).
+		QueryParams(map[string]string{"n": "5"}).
 		Expect(t).
 		Status(http.StatusOK).
-		Body(marshal(t, []string{"1", "3", "5"})).
+		Body(marshal(t, []string{"1", "2", "3", "4", "5"})).
 		End()
+}
+
+func TestServer_GetRecommends_RankingGeneration(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"1", 99}, {"2", 98}, {"3", 97}})
+	assert.NoError(t, err)
+	err = s.CacheClient.Set(cache.String(cache.Key(cache.RankingGeneration, "0"), "a"))
+	assert.NoError(t, err)
+	request, err := http.NewRequest(http.MethodGet, "/api/recommend/0?n=3", nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+
+	// untagged without canary
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, recorder.Header().Get(HeaderRankingGeneration))
+
+	// tagged with the generation of the ranking model
+	s.Config.Recommend.Collaborative.CanaryPercent = 5
+	recorder = httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []string{"1", "2", "3"}), recorder.Body.String())
+	assert.Equal(t, "a", recorder.Header().Get(HeaderRankingGeneration))
+}
+
+func TestServer_GetRecommends_Rerank(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"1", 99}, {"2", 98}, {"3", 97}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1", Labels: []string{"a"}},
+		{ItemId: "2", Labels: []string{"b"}},
+		{ItemId: "3", Labels: []string{"c"}},
+	})
+	assert.NoError(t, err)
+
+	// the scorer prefers items with later labels
+	scorer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request rerank.Request
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, "server", request.Context["stage"])
+		response := rerank.Response{SchemaVersion: rerank.FeatureSchemaVersion}
+		for _, candidate := range request.Candidates {
+			response.Scores = append(response.Scores, float64(candidate.Labels[0][0]))
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(response))
+	}))
+	s.Config.Recommend.Rerank.Scorer = rerank.ScorerHTTP
+	s.Config.Recommend.Rerank.Endpoint = scorer.URL
+	request, err := http.NewRequest(http.MethodGet, "/api/recommend/0?n=3", nil)
+	assert.NoError(t, err)
+	request.Header.Set("X-API-Key", apiKey)
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []string{"3", "2", "1"}), recorder.Body.String())
+
+	// keep the original order if the scorer is down
+	scorer.Close()
+	recorder = httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []string{"1", "2", "3"}), recorder.Body.String())
+}
+
+func TestServer_RequireMetadata(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0", Labels: []string{"a"}}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{{ItemId: "1"}, {ItemId: "2"}})
+	assert.NoError(t, err)
+	ctx, err := s.createRecommendContext("0", "", 10)
+	assert.NoError(t, err)
+	user, err := s.requireUser(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, user.Labels)
+	items, err := s.requireItems(ctx, []string{"1", "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", items["1"].ItemId)
+	assert.Nil(t, items["3"])
+
+	// metadata is loaded once per request
+	assert.NoError(t, s.DataClient.DeleteUser("0"))
+	assert.NoError(t, s.DataClient.DeleteItem("1"))
+	user, err = s.requireUser(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, user.Labels)
+	items, err = s.requireItems(ctx, []string{"1", "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", items["1"].ItemId)
+	assert.Equal(t, "2", items["2"].ItemId)
+}
+
+func TestServer_RecommendPreview(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// hide item 1 and remove item 7 from category c
+	err := NewCacheModification(s.CacheClient, s.HiddenItemsManager).HideItem("1").deleteItemCategory("7", "c").Exec()
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0", "c"), []cache.Scored{{"1", 99}, {"7", 98}, {"2", 97}, {"3", 96}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.LatestItems, "c"), []cache.Scored{{"3", 95}, {"4", 94}, {"5", 93}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.PopularItems, "c"), []cache.Scored{{"5", 92}, {"6", 91}})
+	assert.NoError(t, err)
+	// item 4 has been read
+	err = s.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "4"}, Timestamp: time.Now().Add(-time.Hour)},
+	}, true, true, true)
+	assert.NoError(t, err)
+
 	apitest.New().
 		Handler(s.handler).
-		Get("/api/recommend/0").
+		Get("/api/dashboard/recommend-preview/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"category": "c", "n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, RecommendPreview{
+			UserId:   "0",
+			Category: "c",
+			Stages: []PreviewStage{
+				{Name: "offline", Candidates: []RecommendCandidate{
+					{"1", 99, DecisionHidden},
+					{"7", 98, DecisionCategoryMismatch},
+					{"2", 97, DecisionKept},
+					{"3", 96, DecisionKept},
+				}},
+				{Name: "item_based", Candidates: []RecommendCandidate{}},
+				{Name: "latest", Candidates: []RecommendCandidate{
+					{"3", 95, DecisionDuplicate},
+					{"4", 94, DecisionRead},
+					{"5", 93, DecisionKept},
+				}},
+				{Name: "popular", Candidates: []RecommendCandidate{
+					{"5", 92, DecisionDuplicate},
+					{"6", 91, DecisionKept},
+				}},
+			},
+			Results: []string{"2", "3", "5"},
+		})).
+		End()
+
+	// read feedback is not written back
+	feedback, err := s.DataClient.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+
+	// staleness of offline recommendation
+	recommendTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = s.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), recommendTime))
+	assert.NoError(t, err)
+	r := apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-preview/0").
 		Header("X-API-Key", apiKey).
-		QueryParams(map[string]string{
-			"n":                "3",
-			"write-back-type":  "read",
-			"write-back-delay": "10m",
-		}).
+		QueryParams(map[string]string{"category": "c", "n": "3"}).
 		Expect(t).
 		Status(http.StatusOK).
-		Body(marshal(t, []string{"6", "7", "8"})).
 		End()
+	var preview RecommendPreview
+	r.JSON(&preview)
+	assert.True(t, recommendTime.Equal(preview.OfflineRecommendTime))
+	assert.GreaterOrEqual(t, preview.StalenessSeconds, time.Hour.Seconds())
+
+	// admin api key is required
+	s.Config.Server.AdminAPIKey = "admin"
 	apitest.New().
 		Handler(s.handler).
-		Get("/api/recommend/0").
+		Get("/api/dashboard/recommend-preview/0").
 		Header("X-API-Key", apiKey).
-		QueryParams(map[string]string{
-			"n": "3",
-		}).
 		Expect(t).
-		Status(http.StatusOK).
-		Body(marshal(t, []string{"6", "7", "8"})).
+		Status(http.StatusForbidden).
 		End()
 }
 
@@ -1065,7 +2466,7 @@ func TestServer_GetRecommends_Replacement(t *testing.T) {
 	feedback := []data.Feedback{
 		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "2"}},
 		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "4"}},
-		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "1"}, Timestamp: time.Now().Add(time.Hour)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "1"}, Timestamp: time.Now().Add(time.Minute)},
 	}
 	apitest.New().
 		Handler(s.handler).
@@ -1277,6 +2678,198 @@ func TestServer_GetRecommends_Fallback_UserBasedSimilar(t *testing.T) {
 		End()
 }
 
+func TestServer_GetRecommends_Fallback_LabelBased(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert users
+	err := s.DataClient.BatchInsertUsers([]data.User{
+		{UserId: "0", Labels: []string{"a", "b"}},
+		{UserId: "1", Labels: []string{"a", "b"}},
+	})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "1", ItemId: "9"}},
+	}, true, true, true)
+	assert.NoError(t, err)
+	// insert categorized items
+	err = s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1", Categories: []string{"*"}},
+		{ItemId: "2", Categories: []string{"*"}},
+	})
+	assert.NoError(t, err)
+	// insert popular items of labels
+	err = s.CacheClient.SetSorted(cache.Key(cache.LabelPopularItems, "a"), []cache.Scored{{"1", 10}, {"2", 8}, {"3", 2}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.LabelPopularItems, "b"), []cache.Scored{{"3", 6}, {"4", 4.5}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.PopularItems, ""), []cache.Scored{{"5", 1}})
+	assert.NoError(t, err)
+	// test fallback
+	s.Config.Recommend.Online.FallbackRecommend = []string{"label_based", "popular"}
+	s.Config.Recommend.Online.LabelWeights = map[string]float64{"b": 2}
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"3", "1", "4"})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "5",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"3", "1", "4", "2", "5"})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0/*").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "2"})).
+		End()
+	// skip users with feedback
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/1").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"5"})).
+		End()
+}
+
+func TestServer_GetRecommends_Fallback_Subscription(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0", Subscribe: []string{"a", "b"}}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1", Categories: []string{"*"}},
+		{ItemId: "3", Categories: []string{"*"}},
+	})
+	assert.NoError(t, err)
+	// item 2 has been read
+	err = s.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: time.Now().Add(-time.Hour)},
+	}, true, true, true)
+	assert.NoError(t, err)
+	// insert items of subscription topics
+	err = s.CacheClient.SetSorted(cache.Key(cache.SubscriptionItems, "a"), []cache.Scored{{"1", 10}, {"2", 8}, {"3", 2}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.SubscriptionItems, "b"), []cache.Scored{{"3", 9}, {"4", 4}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.SubscriptionItems, "c"), []cache.Scored{{"5", 100}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.PopularItems, ""), []cache.Scored{{"6", 1}})
+	assert.NoError(t, err)
+	// test fallback
+	s.Config.Recommend.Online.FallbackRecommend = []string{"subscription", "popular"}
+	s.Config.Recommend.Subscription.Weight = 2
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "4",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"3", "1", "4", "6"})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0/*").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"3", "1"})).
+		End()
+
+	// subscription candidates are listed in the preview
+	r := apitest.New().
+		Handler(s.handler).
+		Get("/api/dashboard/recommend-preview/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	var preview RecommendPreview
+	r.JSON(&preview)
+	stage, ok := lo.Find(preview.Stages, func(stage PreviewStage) bool {
+		return stage.Name == config.StageSubscription
+	})
+	if assert.True(t, ok) {
+		assert.Equal(t, []RecommendCandidate{
+			{"3", 22, DecisionKept},
+			{"1", 20, DecisionKept},
+			{"2", 16, DecisionRead},
+			{"4", 8, DecisionKept},
+		}, stage.Candidates)
+	}
+}
+
+func TestServer_Subscribe(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0", Subscribe: []string{"a"}}})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/user/0/subscribe/b").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, Success{RowAffected: 1})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/user/0/subscribe/a").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, Success{RowAffected: 1})).
+		End()
+	user, err := s.DataClient.GetUser("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, user.Subscribe)
+	_, err = s.CacheClient.Get(cache.Key(cache.LastModifyUserTime, "0")).Time()
+	assert.NoError(t, err)
+	// users should exist
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/user/1/subscribe/b").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestServer_RecommendStages(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	assert.ElementsMatch(t, config.RecommendStages, lo.Keys(s.recommendStages()))
+}
+
 func TestServer_GetRecommends_Fallback_PreCached(t *testing.T) {
 	s := newMockServer(t)
 	defer s.Close(t)
@@ -1380,6 +2973,19 @@ func TestServer_GetRecommends_Fallback_PreCached(t *testing.T) {
 		Status(http.StatusOK).
 		Body(marshal(t, []string{"101", "102", "103", "104", "113", "114", "115", "116"})).
 		End()
+	// test fallback order
+	s.Config.Recommend.Online.FallbackRecommend = []string{"latest", "offline", "popular"}
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "8",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"5", "6", "7", "8", "1", "2", "3", "4"})).
+		End()
 	// test wrong fallback
 	s.Config.Recommend.Online.FallbackRecommend = []string{""}
 	apitest.New().
@@ -1482,41 +3088,107 @@ func TestServer_SessionRecommend(t *testing.T) {
 		Handler(s.handler).
 		Post("/api/session/recommend").
 		Header("X-API-Key", apiKey).
-		QueryParams(map[string]string{
-			"n": "3",
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		JSON(feedback).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"9", 4}, {"8", 3}, {"7", 2}})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/recommend").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"offset": "100",
+		}).
+		JSON(feedback).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored(nil))).
+		End()
+	s.Config.Recommend.Online.FallbackRecommend = []string{"item_based"}
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/recommend/*").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		JSON(feedback).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"9", 4}, {"7", 2}})).
+		End()
+}
+
+func TestServer_SessionRecommendCache(t *testing.T) {
+	s := newMockServer(t)
+	s.Config.Recommend.Online.SessionRecommendTTL = time.Minute
+	s.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"a"}
+	defer s.Close(t)
+
+	// insert similar items
+	err := s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "1"), []cache.Scored{{"3", 3}, {"4", 2}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "2"), []cache.Scored{{"4", 2}, {"5", 1}})
+	assert.NoError(t, err)
+
+	// merge neighbors of seed items
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/recommend").
+		Header("X-API-Key", apiKey).
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "1"}, Timestamp: time.Date(2010, 1, 1, 1, 1, 1, 1, time.UTC)},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "2"}, Timestamp: time.Date(2009, 1, 1, 1, 1, 1, 1, time.UTC)},
 		}).
-		JSON(feedback).
 		Expect(t).
 		Status(http.StatusOK).
-		Body(marshal(t, []cache.Scored{{"9", 4}, {"8", 3}, {"7", 2}})).
+		Body(marshal(t, []cache.Scored{{"4", 4}, {"3", 3}, {"5", 1}})).
 		End()
+
+	// the cached merge is used regardless of the order and timestamps of feedback, and items in the session are excluded
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "1"), []cache.Scored{{"6", 100}})
+	assert.NoError(t, err)
 	apitest.New().
 		Handler(s.handler).
 		Post("/api/session/recommend").
 		Header("X-API-Key", apiKey).
-		QueryParams(map[string]string{
-			"offset": "100",
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "1", ItemId: "2"}, Timestamp: time.Date(2012, 1, 1, 1, 1, 1, 1, time.UTC)},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "1", ItemId: "1"}, Timestamp: time.Date(2011, 1, 1, 1, 1, 1, 1, time.UTC)},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "b", UserId: "1", ItemId: "3"}, Timestamp: time.Date(2011, 1, 1, 1, 1, 1, 1, time.UTC)},
 		}).
-		JSON(feedback).
 		Expect(t).
 		Status(http.StatusOK).
-		Body(marshal(t, []cache.Scored(nil))).
+		Body(marshal(t, []cache.Scored{{"4", 4}, {"5", 1}})).
 		End()
-	s.Config.Recommend.Online.FallbackRecommend = []string{"item_based"}
+
+	// the cached merge expires after the TTL
+	err = s.CacheClient.Set(cache.Time(cache.Key(cache.SessionRecommendTime, sessionSignature([]string{"1", "2"}, "")), time.Now().Add(-time.Hour)))
+	assert.NoError(t, err)
 	apitest.New().
 		Handler(s.handler).
-		Post("/api/session/recommend/*").
+		Post("/api/session/recommend").
 		Header("X-API-Key", apiKey).
-		QueryParams(map[string]string{
-			"n": "3",
+		JSON([]data.Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "1"}, Timestamp: time.Date(2010, 1, 1, 1, 1, 1, 1, time.UTC)},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", UserId: "0", ItemId: "2"}, Timestamp: time.Date(2009, 1, 1, 1, 1, 1, 1, time.UTC)},
 		}).
-		JSON(feedback).
 		Expect(t).
 		Status(http.StatusOK).
-		Body(marshal(t, []cache.Scored{{"9", 4}, {"7", 2}})).
+		Body(marshal(t, []cache.Scored{{"6", 100}, {"4", 2}, {"5", 1}})).
 		End()
 }
 
+func TestSessionSignature(t *testing.T) {
+	assert.Equal(t, sessionSignature([]string{"1", "2"}, ""), sessionSignature([]string{"2", "1"}, ""))
+	assert.NotEqual(t, sessionSignature([]string{"1", "2"}, ""), sessionSignature([]string{"1", "2"}, "a"))
+	assert.NotEqual(t, sessionSignature([]string{"1", "2"}, ""), sessionSignature([]string{"1", "2", "2"}, ""))
+}
+
 func TestServer_Visibility(t *testing.T) {
 	s := newMockServer(t)
 	defer s.Close(t)
@@ -1831,3 +3503,417 @@ func TestServer_Visibility(t *testing.T) {
 		Body(marshal(t, cache.RemoveScores(scores))).
 		End()
 }
+
+func TestServer_VisibilityWindow(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	now := time.Now().UTC()
+
+	// insert items with visibility windows
+	items := []Item{
+		{ItemId: "0", VisibleUntil: now.Add(-time.Hour).Format(time.RFC3339)},
+		{ItemId: "1", VisibleFrom: now.Add(time.Hour).Format(time.RFC3339)},
+		{ItemId: "2", VisibleFrom: now.Add(-time.Hour).Format(time.RFC3339), VisibleUntil: now.Add(time.Hour).Format(time.RFC3339)},
+		{ItemId: "3"},
+		{ItemId: "4", VisibleFrom: "2022-03-13T01:30:00-05:00", VisibleUntil: "2022-11-06 03:00:00 -0500"},
+	}
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/items").
+		Header("X-API-Key", apiKey).
+		JSON(items).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 5}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/item").
+		Header("X-API-Key", apiKey).
+		JSON(Item{ItemId: "5", VisibleFrom: "yesterday"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	// windows are normalized to UTC
+	item, err := s.DataClient.GetItem("4")
+	assert.NoError(t, err)
+	if assert.NotNil(t, item.VisibleFrom) && assert.NotNil(t, item.VisibleUntil) {
+		assert.Equal(t, time.Date(2022, 3, 13, 6, 30, 0, 0, time.UTC), *item.VisibleFrom)
+		assert.Equal(t, time.Date(2022, 11, 6, 8, 0, 0, 0, time.UTC), *item.VisibleUntil)
+	}
+
+	// items outside visibility windows are hidden
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "0", Score: 100},
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+	})
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"2", "3"})).
+		End()
+	visibleItems := make([]data.Item, 2)
+	visibleItems[0], err = s.DataClient.GetItem("2")
+	assert.NoError(t, err)
+	visibleItems[1], err = s.DataClient.GetItem("3")
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/items").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"visible-now": "true",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, ItemIterator{Items: visibleItems})).
+		End()
+
+	// open the window of item 1 and close the window of item 2
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/1").
+		Header("X-API-Key", apiKey).
+		JSON(data.ItemPatch{VisibleFrom: &time.Time{}}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	visibleUntil := now.Add(-time.Minute)
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/2").
+		Header("X-API-Key", apiKey).
+		JSON(data.ItemPatch{VisibleUntil: &visibleUntil}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "3"})).
+		End()
+}
+
+// blockingFeedbackDatabase blocks reads of feedback of users until the context is done.
+type blockingFeedbackDatabase struct {
+	data.Database
+	ctx context.Context
+}
+
+func (d *blockingFeedbackDatabase) WithContext(ctx context.Context) data.Database {
+	return &blockingFeedbackDatabase{Database: d.Database, ctx: ctx}
+}
+
+func (d *blockingFeedbackDatabase) GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]data.Feedback, error) {
+	if d.ctx == nil {
+		return d.Database.GetUserFeedback(userId, withFuture, feedbackTypes...)
+	}
+	<-d.ctx.Done()
+	return nil, d.ctx.Err()
+}
+
+func TestServer_GetRecommends_LatencyBudget(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.DataClient = &blockingFeedbackDatabase{Database: s.DataClient}
+	s.Config.Recommend.Online.FallbackRecommend = []string{"latest"}
+	err := s.CacheClient.SetSorted(cache.Key(cache.LatestItems, ""), []cache.Scored{{"1", 99}, {"2", 98}, {"3", 97}})
+	assert.NoError(t, err)
+	recommend := func(timeout string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest(http.MethodGet, "/api/recommend/0?n=3", nil)
+		assert.NoError(t, err)
+		request.Header.Set("X-API-Key", apiKey)
+		if timeout != "" {
+			request.Header.Set(HeaderTimeout, timeout)
+		}
+		recorder := httptest.NewRecorder()
+		s.handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// no budget by default
+	recorder := recommend("")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []string{"1", "2", "3"}), recorder.Body.String())
+	assert.Empty(t, recorder.Header().Get(HeaderBudgetTruncated))
+
+	// requests to storage are cancelled at the deadline
+	start := time.Now()
+	recorder = recommend("50ms")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, marshal(t, []string{}), recorder.Body.String())
+	assert.Equal(t, "latest", recorder.Header().Get(HeaderBudgetTruncated))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the timeout is capped by the max latency budget
+	s.Config.Recommend.Online.MaxLatencyBudget = 50 * time.Millisecond
+	start = time.Now()
+	recorder = recommend("1h")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "latest", recorder.Header().Get(HeaderBudgetTruncated))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// stages are skipped once the budget is exhausted
+	s.Config.Recommend.Online.FallbackRecommend = []string{"collaborative", "latest"}
+	recorder = recommend("1ns")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "offline,collaborative,latest", recorder.Header().Get(HeaderBudgetTruncated))
+
+	// invalid timeout
+	assert.Equal(t, http.StatusBadRequest, recommend("soon").Code)
+	assert.Equal(t, http.StatusBadRequest, recommend("-1s").Code)
+}
+
+func TestServer_PatchArrays(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	timestamp := time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)
+	err := s.DataClient.BatchInsertItems([]data.Item{{ItemId: "0", Categories: []string{"a"}, Labels: []string{"x"}, Timestamp: timestamp}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertUsers([]data.User{{UserId: "0", Subscribe: []string{"x"}}})
+	assert.NoError(t, err)
+	err = s.CacheClient.AddSorted(cache.Sorted(cache.Key(cache.LatestItems, "a"), []cache.Scored{{Id: "0", Score: float64(timestamp.Unix())}}))
+	assert.NoError(t, err)
+
+	// add and remove labels and categories of an item
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/0").
+		Header("X-API-Key", apiKey).
+		JSON(data.ItemPatch{AddLabels: []string{"y"}, AddCategories: []string{"b"}, RemoveCategories: []string{"a"}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	item, err := s.DataClient.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, item.Labels)
+	assert.Equal(t, []string{"b"}, item.Categories)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/latest/b").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{Id: "0", Score: float64(timestamp.Unix())}})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/latest/a").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{})).
+		End()
+
+	// add and remove subscriptions of a user
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/user/0").
+		Header("X-API-Key", apiKey).
+		JSON(data.UserPatch{AddSubscribe: []string{"y"}, RemoveSubscribe: []string{"x"}, AddLabels: []string{"z"}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	user, err := s.DataClient.GetUser("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"y"}, user.Subscribe)
+	assert.Equal(t, []string{"z"}, user.Labels)
+
+	// elements can't be added and removed at the same time
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/0").
+		Header("X-API-Key", apiKey).
+		JSON(data.ItemPatch{AddLabels: []string{"y"}, RemoveLabels: []string{"y"}}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/user/0").
+		Header("X-API-Key", apiKey).
+		JSON(data.UserPatch{AddSubscribe: []string{"y"}, RemoveSubscribe: []string{"y"}}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestServer_ModifyConflict(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	timestamp := time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)
+	err := s.DataClient.BatchInsertItems([]data.Item{{ItemId: "0", Labels: []string{"x"}, Timestamp: timestamp}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertUsers([]data.User{{UserId: "0", Labels: []string{"x"}}})
+	assert.NoError(t, err)
+
+	// modify an item at the version in ETag
+	resp := apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	tag := resp.Response.Header.Get("ETag")
+	assert.NotEmpty(t, tag)
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/0").
+		Header("X-API-Key", apiKey).
+		Header("If-Match", tag).
+		JSON(data.ItemPatch{AddLabels: []string{"y"}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	// modify an item at a stale version
+	item, err := s.DataClient.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, item.Labels)
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/0").
+		Header("X-API-Key", apiKey).
+		Header("If-Match", tag).
+		JSON(data.ItemPatch{AddLabels: []string{"z"}}).
+		Expect(t).
+		Status(http.StatusConflict).
+		Header("ETag", versionTag(item.Version())).
+		Body(marshal(t, item)).
+		End()
+	// modify an item regardless of versions
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/item/0").
+		Header("X-API-Key", apiKey).
+		JSON(data.ItemPatch{AddLabels: []string{"z"}}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	// modify a user at the version in the patch
+	user, err := s.DataClient.GetUser("0")
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Header("ETag", versionTag(user.Version())).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/user/0").
+		Header("X-API-Key", apiKey).
+		JSON(data.UserPatch{AddLabels: []string{"y"}, Version: user.Version()}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	// modify a user at a stale version
+	current, err := s.DataClient.GetUser("0")
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Patch("/api/user/0").
+		Header("X-API-Key", apiKey).
+		Header("If-Match", versionTag(user.Version())).
+		JSON(data.UserPatch{AddLabels: []string{"z"}}).
+		Expect(t).
+		Status(http.StatusConflict).
+		Header("ETag", versionTag(current.Version())).
+		Body(marshal(t, current)).
+		End()
+}
+
+func TestServer_Sample(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	var items []data.Item
+	var users []data.User
+	for i := 0; i < 10; i++ {
+		items = append(items, data.Item{ItemId: strconv.Itoa(i), IsHidden: i == 0, Categories: []string{strconv.Itoa(i % 2)}})
+		users = append(users, data.User{UserId: strconv.Itoa(i)})
+	}
+	err := s.DataClient.BatchInsertItems(items)
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertUsers(users)
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertFeedback([]data.Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "1", ItemId: "1"}}}, false, false, true)
+	assert.NoError(t, err)
+
+	// the same items are sampled under the same seed
+	resp := apitest.New().
+		Handler(s.handler).
+		Get("/api/items/sample").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3", "seed": "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Header(SampleSeedHeader, "1").
+		End()
+	var sampled []data.Item
+	assert.NoError(t, json.NewDecoder(resp.Response.Body).Decode(&sampled))
+	assert.Len(t, sampled, 3)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/items/sample").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3", "seed": "1"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, sampled)).
+		End()
+	// sample items in a category
+	resp = apitest.New().
+		Handler(s.handler).
+		Get("/api/items/sample").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "100", "category": "0"}).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.NotEmpty(t, resp.Response.Header.Get(SampleSeedHeader))
+	assert.NoError(t, json.NewDecoder(resp.Response.Body).Decode(&sampled))
+	assert.ElementsMatch(t, []string{"2", "4", "6", "8"}, lo.Map(sampled, func(item data.Item, _ int) string { return item.ItemId }))
+	// sample users with feedback
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/users/sample").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "100", "has-feedback": "true"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []data.User{{UserId: "1"}})).
+		End()
+	// invalid parameters
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/items/sample").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "0"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/users/sample").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"seed": "random"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
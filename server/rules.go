@@ -0,0 +1,427 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RuleActionPin   = "pin"
+	RuleActionBoost = "boost"
+	RuleActionBlock = "block"
+)
+
+// Rule is a business rule applied to recommendations after candidates are retrieved.
+//   - pin: ItemIds are placed at Position (starting from 1).
+//   - boost: scores of matched items are multiplied by Weight.
+//   - block: matched items are excluded.
+//
+// An item matches a rule if its id is in ItemIds, or it has any label in Labels, or it belongs to any category in
+// Categories. Scope restricts the rule to recommendations in given categories ("" for global recommendation), and the
+// rule applies to all recommendations if Scope is empty. The rule is active between StartTime and EndTime, and zero
+// time means unbounded.
+type Rule struct {
+	RuleId     string
+	Action     string
+	Position   int
+	Weight     float64
+	ItemIds    []string
+	Labels     []string
+	Categories []string
+	Scope      []string
+	StartTime  time.Time
+	EndTime    time.Time
+	Comment    string
+}
+
+// Validate checks whether the rule is well-formed.
+func (r *Rule) Validate() error {
+	if r.RuleId == "" {
+		return errors.BadRequestf("empty rule id")
+	}
+	switch r.Action {
+	case RuleActionPin:
+		if r.Position <= 0 {
+			return errors.BadRequestf("position of pin rule should be positive")
+		}
+		if len(r.ItemIds) == 0 {
+			return errors.BadRequestf("no items to pin")
+		}
+	case RuleActionBoost:
+		if r.Weight <= 0 {
+			return errors.BadRequestf("weight of boost rule should be positive")
+		}
+	case RuleActionBlock:
+	default:
+		return errors.BadRequestf("unknown rule action `%s`", r.Action)
+	}
+	if r.Action != RuleActionPin && len(r.ItemIds) == 0 && len(r.Labels) == 0 && len(r.Categories) == 0 {
+		return errors.BadRequestf("no condition in rule")
+	}
+	if !r.StartTime.IsZero() && !r.EndTime.IsZero() && r.EndTime.Before(r.StartTime) {
+		return errors.BadRequestf("end time is before start time")
+	}
+	return nil
+}
+
+// IsActive returns true if the rule is applicable to the recommendation in the category at the given time.
+func (r *Rule) IsActive(category string, now time.Time) bool {
+	if !r.StartTime.IsZero() && now.Before(r.StartTime) {
+		return false
+	}
+	if !r.EndTime.IsZero() && now.After(r.EndTime) {
+		return false
+	}
+	return len(r.Scope) == 0 || lo.Contains(r.Scope, category)
+}
+
+// Match returns true if the item satisfies the conditions of the rule. Item metadata might be nil.
+func (r *Rule) Match(itemId string, item *data.Item) bool {
+	if lo.Contains(r.ItemIds, itemId) {
+		return true
+	}
+	if item != nil {
+		for _, label := range item.Labels {
+			if lo.Contains(r.Labels, label) {
+				return true
+			}
+		}
+		for _, category := range item.Categories {
+			if lo.Contains(r.Categories, category) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) requireMetadata() bool {
+	return len(r.Labels) > 0 || len(r.Categories) > 0
+}
+
+// RulesManager keeps business rules in memory and reloads them from the cache store periodically.
+type RulesManager struct {
+	server *RestServer
+	mu     sync.RWMutex
+	rules  []Rule
+	test   bool
+}
+
+func NewRulesManager(s *RestServer) *RulesManager {
+	rm := &RulesManager{server: s}
+	go func() {
+		for {
+			rm.sync()
+			log.Logger().Debug("refresh server side business rules", zap.String("cache_expire", s.Config.Server.CacheExpire.String()))
+			time.Sleep(s.Config.Server.CacheExpire)
+		}
+	}()
+	return rm
+}
+
+func newRulesManagerForTest(s *RestServer) *RulesManager {
+	return &RulesManager{server: s, test: true}
+}
+
+func (rm *RulesManager) sync() {
+	rules, err := loadRules(rm.server.CacheClient)
+	if err != nil {
+		if !errors.Is(err, errors.NotAssigned) {
+			log.Logger().Error("failed to load business rules", zap.Error(err))
+		}
+		return
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.rules = rules
+}
+
+// ActiveRules returns rules applicable to the recommendation in the category at the given time.
+func (rm *RulesManager) ActiveRules(category string, now time.Time) []Rule {
+	if rm.test {
+		rm.sync()
+	}
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return lo.Filter(rm.rules, func(rule Rule, _ int) bool {
+		return rule.IsActive(category, now)
+	})
+}
+
+func loadRules(client cache.Database) ([]Rule, error) {
+	ruleIds, err := client.GetSet(cache.BusinessRules)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(ruleIds)
+	rules := make([]Rule, 0, len(ruleIds))
+	for _, ruleId := range ruleIds {
+		rule, err := loadRule(client, ruleId)
+		if err != nil {
+			if errors.Is(err, errors.NotFound) {
+				continue
+			}
+			return nil, errors.Trace(err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func loadRule(client cache.Database, ruleId string) (Rule, error) {
+	var rule Rule
+	text, err := client.Get(cache.Key(cache.BusinessRule, ruleId)).String()
+	if err != nil {
+		return rule, errors.Trace(err)
+	}
+	if err = json.Unmarshal([]byte(text), &rule); err != nil {
+		return rule, errors.Trace(err)
+	}
+	return rule, nil
+}
+
+func saveRule(client cache.Database, rule Rule) error {
+	text, err := json.Marshal(rule)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = client.Set(cache.String(cache.Key(cache.BusinessRule, rule.RuleId), string(text))); err != nil {
+		return errors.Trace(err)
+	}
+	return client.AddSet(cache.BusinessRules, rule.RuleId)
+}
+
+// maxBlockRetries is the maximum number of times recommenders are executed again to backfill items blocked by labels
+// or categories.
+const maxBlockRetries = 2
+
+// blockedItemIds returns items blocked by ids. These items are excluded before recommenders run.
+func blockedItemIds(rules []Rule) *strset.Set {
+	blocked := strset.New()
+	for _, rule := range rules {
+		if rule.Action == RuleActionBlock {
+			blocked.Add(rule.ItemIds...)
+		}
+	}
+	return blocked
+}
+
+// loadRuleMetadata loads metadata of candidates if any rule matches items by labels or categories.
+func (s *RestServer) loadRuleMetadata(ctx *recommendContext, actions ...string) (map[string]*data.Item, error) {
+	if lo.ContainsBy(ctx.rules, func(rule Rule) bool {
+		return lo.Contains(actions, rule.Action) && rule.requireMetadata()
+	}) {
+		return s.requireItems(ctx, ctx.results)
+	}
+	return map[string]*data.Item{}, nil
+}
+
+// removeBlockedItems removes candidates blocked by labels or categories and returns them. Recommenders are expected to
+// run again with these items excluded if candidates are not enough.
+func (s *RestServer) removeBlockedItems(ctx *recommendContext) ([]string, error) {
+	if len(ctx.results) == 0 {
+		return nil, nil
+	}
+	items, err := s.loadRuleMetadata(ctx, RuleActionBlock)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	var blocked []string
+	results := make([]string, 0, len(ctx.results))
+	for _, itemId := range ctx.results {
+		rule, isBlocked := lo.Find(ctx.rules, func(rule Rule) bool {
+			return rule.Action == RuleActionBlock && rule.Match(itemId, items[itemId])
+		})
+		if isBlocked {
+			RuleApplicationsTotal.WithLabelValues(rule.RuleId).Inc()
+			blocked = append(blocked, itemId)
+		} else {
+			results = append(results, itemId)
+		}
+	}
+	ctx.results = results
+	ctx.blockedSet.Add(blocked...)
+	return blocked, nil
+}
+
+// applyRules boosts and pins candidates before the final cut. Retrieval scores of boosted items are multiplied by
+// weights, and boosted items move forward among candidates from the same stage since scores from different stages are
+// not comparable. Candidates without retrieval scores, such as explored items, keep their positions.
+func (s *RestServer) applyRules(ctx *recommendContext) error {
+	if len(ctx.rules) == 0 || len(ctx.results) == 0 {
+		return nil
+	}
+	start := time.Now()
+	items, err := s.loadRuleMetadata(ctx, RuleActionBoost)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// boost items
+	candidates := make([]cache.Scored, len(ctx.results))
+	for i, itemId := range ctx.results {
+		candidates[i] = cache.Scored{Id: itemId, Score: ctx.scores[itemId]}
+		for _, rule := range ctx.rules {
+			if rule.Action == RuleActionBoost && rule.Match(itemId, items[itemId]) {
+				RuleApplicationsTotal.WithLabelValues(rule.RuleId).Inc()
+				candidates[i].Score *= rule.Weight
+			}
+		}
+	}
+	for begin := 0; begin < len(candidates); {
+		source, hasSource := ctx.sources[candidates[begin].Id]
+		end := begin + 1
+		for hasSource && end < len(candidates) && ctx.sources[candidates[end].Id] == source {
+			end++
+		}
+		cache.SortScores(candidates[begin:end])
+		begin = end
+	}
+	results := cache.RemoveScores(candidates)
+
+	// pin items
+	pinRules := lo.Filter(ctx.rules, func(rule Rule, _ int) bool {
+		return rule.Action == RuleActionPin
+	})
+	sort.SliceStable(pinRules, func(i, j int) bool {
+		return pinRules[i].Position < pinRules[j].Position
+	})
+	inResults := strset.New(ctx.results...)
+	for _, rule := range pinRules {
+		position := rule.Position - 1
+		for _, itemId := range rule.ItemIds {
+			if ctx.blockedSet.Has(itemId) {
+				continue
+			}
+			if index := lo.IndexOf(results, itemId); index >= 0 {
+				results = append(results[:index], results[index+1:]...)
+			} else if ctx.isExcluded(itemId) && !inResults.Has(itemId) {
+				// skip items consumed by the user
+				continue
+			} else if s.HiddenItemsManager.IsHiddenWithDelta([]string{itemId}, ctx.category, ctx.hiddenDelta)[0] {
+				continue
+			}
+			if position > len(results) {
+				position = len(results)
+			}
+			results = append(results[:position], append([]string{itemId}, results[position:]...)...)
+			ctx.excludeSet.Add(itemId)
+			RuleApplicationsTotal.WithLabelValues(rule.RuleId).Inc()
+			position++
+		}
+	}
+	ctx.results = results
+	ctx.applyRulesTime = time.Since(start)
+	return nil
+}
+
+func (s *RestServer) getRules(_ *restful.Request, response *restful.Response) {
+	rules, err := loadRules(s.CacheClient)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	Ok(response, rules)
+}
+
+func (s *RestServer) getRule(request *restful.Request, response *restful.Response) {
+	ruleId := request.PathParameter("rule-id")
+	rule, err := loadRule(s.CacheClient, ruleId)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			PageNotFound(response, fmt.Errorf("rule %s not found", ruleId))
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
+	Ok(response, rule)
+}
+
+func (s *RestServer) insertRule(request *restful.Request, response *restful.Response) {
+	var rule Rule
+	if err := request.ReadEntity(&rule); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if err := saveRule(s.CacheClient, rule); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	SetAudit(request, "insert a rule", AuditEntity(AuditEntityRule, rule.RuleId))
+	Ok(response, Success{RowAffected: 1})
+}
+
+func (s *RestServer) updateRule(request *restful.Request, response *restful.Response) {
+	ruleId := request.PathParameter("rule-id")
+	var rule Rule
+	if err := request.ReadEntity(&rule); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	rule.RuleId = ruleId
+	if err := rule.Validate(); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if _, err := loadRule(s.CacheClient, ruleId); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			PageNotFound(response, fmt.Errorf("rule %s not found", ruleId))
+		} else {
+			InternalServerError(response, err)
+		}
+		return
+	}
+	if err := saveRule(s.CacheClient, rule); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	SetAudit(request, "update a rule")
+	Ok(response, Success{RowAffected: 1})
+}
+
+func (s *RestServer) deleteRule(request *restful.Request, response *restful.Response) {
+	ruleId := request.PathParameter("rule-id")
+	if err := s.CacheClient.RemSet(cache.BusinessRules, ruleId); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if err := s.CacheClient.Delete(cache.Key(cache.BusinessRule, ruleId)); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	SetAudit(request, "delete a rule")
+	Ok(response, Success{RowAffected: 1})
+}
@@ -0,0 +1,276 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRule_Validate(t *testing.T) {
+	assert.Error(t, (&Rule{Action: RuleActionBlock, Labels: []string{"a"}}).Validate())
+	assert.Error(t, (&Rule{RuleId: "1", Action: "unknown", Labels: []string{"a"}}).Validate())
+	assert.Error(t, (&Rule{RuleId: "1", Action: RuleActionPin, ItemIds: []string{"1"}}).Validate())
+	assert.Error(t, (&Rule{RuleId: "1", Action: RuleActionPin, Position: 1}).Validate())
+	assert.Error(t, (&Rule{RuleId: "1", Action: RuleActionBoost, Labels: []string{"a"}}).Validate())
+	assert.Error(t, (&Rule{RuleId: "1", Action: RuleActionBlock}).Validate())
+	assert.Error(t, (&Rule{RuleId: "1", Action: RuleActionBlock, Labels: []string{"a"},
+		StartTime: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC), EndTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}).Validate())
+	assert.NoError(t, (&Rule{RuleId: "1", Action: RuleActionPin, Position: 1, ItemIds: []string{"1"}}).Validate())
+	assert.NoError(t, (&Rule{RuleId: "1", Action: RuleActionBoost, Weight: 1.2, Categories: []string{"a"}}).Validate())
+	assert.NoError(t, (&Rule{RuleId: "1", Action: RuleActionBlock, ItemIds: []string{"1"}}).Validate())
+}
+
+func TestRule_IsActive(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rule := Rule{}
+	assert.True(t, rule.IsActive("", now))
+	assert.True(t, rule.IsActive("a", now))
+	rule.Scope = []string{""}
+	assert.True(t, rule.IsActive("", now))
+	assert.False(t, rule.IsActive("a", now))
+	rule.StartTime = now.Add(time.Hour)
+	assert.False(t, rule.IsActive("", now))
+	rule.StartTime = now.Add(-time.Hour)
+	rule.EndTime = now.Add(-time.Minute)
+	assert.False(t, rule.IsActive("", now))
+	rule.EndTime = now.Add(time.Minute)
+	assert.True(t, rule.IsActive("", now))
+}
+
+func TestServer_Rules(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	rules := []Rule{
+		{RuleId: "1", Action: RuleActionPin, Position: 2, ItemIds: []string{"9"}},
+		{RuleId: "2", Action: RuleActionBoost, Weight: 1.2, Categories: []string{"a"}},
+	}
+	// insert rules
+	for _, rule := range rules {
+		apitest.New().
+			Handler(s.handler).
+			Post("/api/rules").
+			Header("X-API-Key", apiKey).
+			JSON(rule).
+			Expect(t).
+			Status(http.StatusOK).
+			Body(`{"RowAffected": 1}`).
+			End()
+	}
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/rules").
+		Header("X-API-Key", apiKey).
+		JSON(Rule{RuleId: "3", Action: "unknown"}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+	// get rules
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/rules").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, rules)).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/rules/1").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, rules[0])).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/rules/3").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	// update rule
+	rules[1].Weight = 1.5
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/rules/2").
+		Header("X-API-Key", apiKey).
+		JSON(rules[1]).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Put("/api/rules/3").
+		Header("X-API-Key", apiKey).
+		JSON(rules[1]).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/rules/2").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, rules[1])).
+		End()
+	// delete rule
+	apitest.New().
+		Handler(s.handler).
+		Delete("/api/rules/1").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/rules").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, rules[1:])).
+		End()
+
+	// require admin api key
+	s.Config.Server.AdminAPIKey = "admin_api_key"
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/rules").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusForbidden).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/rules").
+		Header("X-API-Key", "admin_api_key").
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, rules[1:])).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/items").
+		Header("X-API-Key", "admin_api_key").
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestServer_GetRecommends_Rules(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	// insert items
+	err := s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1"},
+		{ItemId: "2", Labels: []string{"vendor:x"}},
+		{ItemId: "3"},
+		{ItemId: "4"},
+		{ItemId: "5", Categories: []string{"promotion"}},
+		{ItemId: "6"},
+		{ItemId: "7"},
+		{ItemId: "8"},
+		{ItemId: "9"},
+	})
+	assert.NoError(t, err)
+	// insert recommendation
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+		{Id: "4", Score: 96},
+		{Id: "5", Score: 95},
+		{Id: "6", Score: 94},
+		{Id: "7", Score: 93},
+		{Id: "8", Score: 92},
+	})
+	assert.NoError(t, err)
+	// insert rules
+	for _, rule := range []Rule{
+		{RuleId: "block", Action: RuleActionBlock, Labels: []string{"vendor:x"}},
+		{RuleId: "boost", Action: RuleActionBoost, Weight: 2, Categories: []string{"promotion"}},
+		{RuleId: "pin", Action: RuleActionPin, Position: 2, ItemIds: []string{"9"}},
+		{RuleId: "scoped", Action: RuleActionBlock, ItemIds: []string{"1"}, Scope: []string{"other"}},
+		{RuleId: "expired", Action: RuleActionBlock, ItemIds: []string{"3"}, EndTime: time.Now().Add(-time.Hour)},
+	} {
+		assert.NoError(t, saveRule(s.CacheClient, rule))
+	}
+	// boosted scores: 1=99, 3=97, 4=96, 5=95*2=190, 6=94
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "4",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"5", "9", "1", "3"})).
+		End()
+}
+
+func TestServer_GetRecommends_BlockRules(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.Online.FallbackRecommend = []string{"popular"}
+	// insert items
+	err := s.DataClient.BatchInsertItems([]data.Item{
+		{ItemId: "1"},
+		{ItemId: "2", Labels: []string{"vendor:x"}},
+		{ItemId: "3"},
+		{ItemId: "4"},
+		{ItemId: "5"},
+	})
+	assert.NoError(t, err)
+	// insert recommendation
+	err = s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{
+		{Id: "1", Score: 99},
+		{Id: "2", Score: 98},
+		{Id: "3", Score: 97},
+	})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.PopularItems, ""), []cache.Scored{
+		{Id: "4", Score: 2},
+		{Id: "5", Score: 1},
+	})
+	assert.NoError(t, err)
+	// insert rules
+	for _, rule := range []Rule{
+		{RuleId: "block_vendor", Action: RuleActionBlock, Labels: []string{"vendor:x"}},
+		{RuleId: "block_item", Action: RuleActionBlock, ItemIds: []string{"4"}},
+	} {
+		assert.NoError(t, saveRule(s.CacheClient, rule))
+	}
+	// blocked items are backfilled by the following stages
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{
+			"n": "3",
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []string{"1", "3", "5"})).
+		End()
+}
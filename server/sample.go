@@ -0,0 +1,88 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math/rand"
+	"strconv"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+)
+
+const (
+	// MaxSampleSize is the maximum number of sampled items or users in a request.
+	MaxSampleSize = 1000
+	// SampleSeedHeader is the header of the seed used to sample items or users, which reproduces the sample if it is
+	// passed back as the seed parameter.
+	SampleSeedHeader = "X-Sample-Seed"
+)
+
+// parseSample parses the number of sampled items or users and the seed. The number is capped by MaxSampleSize, and a
+// random seed is used if the seed isn't given.
+func (s *RestServer) parseSample(request *restful.Request) (int, int64, error) {
+	n, err := ParseInt(request, "n", s.Config.Server.DefaultN)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	if n <= 0 {
+		return 0, 0, errors.NotValidf("n %d", n)
+	}
+	if n > MaxSampleSize {
+		n = MaxSampleSize
+	}
+	seed := rand.Int63()
+	if value := request.QueryParameter("seed"); value != "" {
+		if seed, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+	}
+	return n, seed, nil
+}
+
+func (s *RestServer) sampleItems(request *restful.Request, response *restful.Response) {
+	n, seed, err := s.parseSample(request)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	items, err := s.DataClient.SampleItems(n, request.QueryParameter("category"), seed)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	response.AddHeader(SampleSeedHeader, strconv.FormatInt(seed, 10))
+	Ok(response, items)
+}
+
+func (s *RestServer) sampleUsers(request *restful.Request, response *restful.Response) {
+	n, seed, err := s.parseSample(request)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	hasFeedback, err := ParseBool(request, "has-feedback", false)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	users, err := s.DataClient.SampleUsers(n, hasFeedback, seed)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	response.AddHeader(SampleSeedHeader, strconv.FormatInt(seed, 10))
+	Ok(response, users)
+}
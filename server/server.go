@@ -26,6 +26,7 @@ import (
 	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/cmd/version"
 	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model/rerank"
 	"github.com/zhenghaoz/gorse/protocol"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
@@ -38,6 +39,9 @@ import (
 	"time"
 )
 
+// ShadowQueueSuffix is appended to the path of the local cache file to store writes queued for the shadow data store.
+const ShadowQueueSuffix = ".shadow_queue"
+
 // Server manages states of a server node.
 type Server struct {
 	RestServer
@@ -45,12 +49,19 @@ type Server struct {
 	cachePrefix  string
 	dataPath     string
 	dataPrefix   string
+	hotPath      string
+	shadowPath   string
 	masterClient protocol.MasterClient
 	serverName   string
 	masterHost   string
 	masterPort   int
 	testMode     bool
 	cacheFile    string
+	shadowCache  *cache.Shadow           // offline recommendation is read under the production prefix
+	obfuscator   *cache.Obfuscator       // user ids in cache keys are replaced by digests
+	kafka        *KafkaConsumer          // started once databases are connected
+	dualWrite    *data.DualWriteDatabase // writes to the shadow data store during migration, nil if not configured
+	warmUp       bool                    // warm-up is started once databases are connected
 }
 
 // NewServer creates a server node.
@@ -68,6 +79,21 @@ func NewServer(masterHost string, masterPort int, serverHost string, serverPort
 	}
 	s.RestServer.PopularItemsCache = NewPopularItemsCache(&s.RestServer)
 	s.RestServer.HiddenItemsManager = NewHiddenItemsManager(&s.RestServer)
+	s.RestServer.RulesManager = NewRulesManager(&s.RestServer)
+	s.RestServer.DuplicatesManager = NewDuplicatesManager(&s.RestServer)
+	s.RestServer.ActivityTracker = NewActivityTracker(&s.RestServer)
+	s.RestServer.QuotaManager = NewQuotaManager(&s.RestServer)
+	s.RestServer.ReadOnlyManager = NewReadOnlyManager(&s.RestServer)
+	s.RestServer.AuditLogger = NewAuditLogger(&s.RestServer)
+	s.RestServer.WriteBackBuffer = NewWriteBackBuffer(&s.RestServer)
+	s.RestServer.HistoryArchiver = NewHistoryArchiver(&s.RestServer)
+	s.RestServer.UsageCounter = NewUsageCounter(&s.RestServer)
+	s.RestServer.ShadowTraffic = NewShadowTraffic(&s.RestServer)
+	s.RestServer.ItemEnricher = NewItemEnricher(&s.RestServer)
+	s.RestServer.DegradedCache = NewDegradedCache(&s.RestServer)
+	s.RestServer.Reranker = rerank.NewReranker()
+	// the server isn't ready until warm-up finishes
+	s.RestServer.warmingUp = 1
 	return s
 }
 
@@ -111,10 +137,31 @@ func (s *Server) Serve() {
 	s.StartHttpServer(container)
 }
 
+// Shutdown stops the server gracefully. In-flight requests are drained before connections to databases are closed.
 func (s *Server) Shutdown() {
-	err := s.HttpServer.Shutdown(context.TODO())
-	if err != nil {
-		log.Logger().Fatal("failed to shutdown http server", zap.Error(err))
+	if err := s.ShutdownHttpServer(); err != nil {
+		log.Logger().Error("failed to shutdown http server", zap.Error(err))
+	}
+	if s.WriteBackBuffer != nil {
+		s.WriteBackBuffer.Close()
+	}
+	if s.kafka != nil {
+		if err := s.kafka.Close(); err != nil {
+			log.Logger().Error("failed to close kafka consumer", zap.Error(err))
+		}
+	}
+	if err := s.CloseDatabases(); err != nil {
+		log.Logger().Error("failed to close databases", zap.Error(err))
+	}
+}
+
+// closeDualWrite closes the previous dual-write database, including connections to its primary data store.
+func (s *Server) closeDualWrite() {
+	if s.dualWrite != nil {
+		if err := s.dualWrite.Close(); err != nil {
+			log.Logger().Warn("failed to close shadow data store", zap.Error(err))
+		}
+		s.dualWrite = nil
 	}
 }
 
@@ -144,29 +191,120 @@ func (s *Server) Sync() {
 		}
 
 		// connect to data store
-		if s.dataPath != s.Config.Database.DataStore || s.dataPrefix != s.Config.Database.TablePrefix {
+		if s.dataPath != s.Config.Database.DataStore || s.dataPrefix != s.Config.Database.TablePrefix ||
+			s.hotPath != s.Config.Database.HotFeedbackStore || s.shadowPath != s.Config.Database.ShadowDataStore {
 			log.Logger().Info("connect data store",
 				zap.String("database", log.RedactDBURL(s.Config.Database.DataStore)))
-			if s.DataClient, err = data.Open(s.Config.Database.DataStore, s.Config.Database.TablePrefix); err != nil {
+			dataClient, err := data.Open(s.Config.Database.DataStore, s.Config.Database.TablePrefix)
+			if err != nil {
 				log.Logger().Error("failed to connect data store", zap.Error(err))
 				goto sleep
 			}
+			data.SetBatchGetOptions(dataClient, s.Config.Database.BatchGetChunkSize, s.Config.Database.BatchGetJobs)
+			// writes go to the shadow data store as well during migration
+			if s.Config.Database.ShadowDataStore != "" {
+				shadowClient, err := data.Open(s.Config.Database.ShadowDataStore, s.Config.Database.TablePrefix)
+				if err != nil {
+					log.Logger().Error("failed to connect shadow data store", zap.Error(err))
+					goto sleep
+				}
+				data.SetBatchGetOptions(shadowClient, s.Config.Database.BatchGetChunkSize, s.Config.Database.BatchGetJobs)
+				// the queue file of writes to the shadow data store is owned by one dual-write database
+				s.closeDualWrite()
+				if s.dualWrite, err = data.NewDualWriteDatabase(dataClient, shadowClient, s.cacheFile+ShadowQueueSuffix,
+					s.Config.Database.ShadowRetryInterval); err != nil {
+					log.Logger().Error("failed to load queued writes of shadow data store", zap.Error(err))
+					goto sleep
+				}
+				dataClient = s.dualWrite
+			} else {
+				s.closeDualWrite()
+			}
+			// recent feedback is served by the hot feedback store
+			if s.Config.Database.HotFeedbackStore != "" {
+				if dataClient, err = data.NewTieredDatabase(dataClient, s.Config.Database.HotFeedbackStore,
+					s.Config.Database.HotFeedbackWindow); err != nil {
+					log.Logger().Error("failed to connect hot feedback store", zap.Error(err))
+					goto sleep
+				}
+			}
+			s.DataClient = data.NewCommentCompressor(dataClient, s.Config.Database.CommentThreshold())
 			s.dataPath = s.Config.Database.DataStore
 			s.dataPrefix = s.Config.Database.TablePrefix
+			s.hotPath = s.Config.Database.HotFeedbackStore
+			s.shadowPath = s.Config.Database.ShadowDataStore
 		}
 
 		// connect to cache store
 		if s.cachePath != s.Config.Database.CacheStore || s.cachePrefix != s.Config.Database.TablePrefix {
 			log.Logger().Info("connect cache store",
 				zap.String("database", log.RedactDBURL(s.Config.Database.CacheStore)))
-			if s.CacheClient, err = cache.Open(s.Config.Database.CacheStore, s.Config.Database.TablePrefix); err != nil {
+			cacheClient, err := cache.Open(s.Config.Database.CacheStore, s.Config.Database.TablePrefix)
+			if err != nil {
 				log.Logger().Error("failed to connect cache store", zap.Error(err))
 				goto sleep
 			}
+			if s.Config.Server.Degraded.Enable {
+				s.cacheBreaker = cache.NewCircuitBreaker(cacheClient,
+					s.Config.Server.Degraded.FailureThreshold, s.Config.Server.Degraded.RetryInterval)
+				s.cacheBreaker.OnStateChange = func(open bool) {
+					if open {
+						log.Logger().Warn("cache store is down, serve degraded recommendation")
+						CacheCircuitOpen.Set(1)
+					} else {
+						log.Logger().Info("cache store is recovered")
+						CacheCircuitOpen.Set(0)
+					}
+				}
+				cacheClient = s.cacheBreaker
+			} else {
+				s.cacheBreaker = nil
+			}
+			s.obfuscator = cache.NewObfuscator(cacheClient,
+				s.Config.Database.IdObfuscationSecret, s.Config.Database.IdObfuscationPreviousSecret)
+			log.SetUserIdObfuscator(s.obfuscator.Digest)
+			cacheClient = s.obfuscator
+			if s.Config.Server.LocalCacheSize > 0 {
+				localCache := cache.NewLocalCache(cacheClient, s.Config.Server.LocalCacheSize,
+					s.Config.Server.LocalCacheTTL, s.Config.Server.LocalCacheExcludePrefixes)
+				localCache.OnHit = LocalCacheHitsTotal.Inc
+				localCache.OnMiss = LocalCacheMissesTotal.Inc
+				localCache.OnEvict = LocalCacheEvictionsTotal.Inc
+				cacheClient = localCache
+			}
+			// keys of the local cache are physical, so that promotion never serves stale entries
+			s.shadowCache = cache.NewShadow(cacheClient, "")
+			s.CacheClient = s.shadowCache
 			s.cachePath = s.Config.Database.CacheStore
 			s.cachePrefix = s.Config.Database.TablePrefix
 		}
 
+		// follow rotation of the obfuscation secret
+		if s.obfuscator != nil {
+			s.obfuscator.SetSecrets(s.Config.Database.IdObfuscationSecret, s.Config.Database.IdObfuscationPreviousSecret)
+		}
+
+		// serve offline recommendation under the production prefix
+		if s.shadowCache != nil {
+			if productionPrefix, err := cache.ProductionPrefix(s.shadowCache.Database); err != nil {
+				log.Logger().Error("failed to read prefix of offline recommendation", zap.Error(err))
+			} else {
+				s.shadowCache.SetPrefix(productionPrefix)
+			}
+		}
+
+		// warm up the local cache
+		if !s.warmUp {
+			s.warmUp = true
+			go s.WarmUp()
+		}
+
+		// consume feedback from kafka
+		if s.kafka == nil && len(s.Config.Server.Kafka.Brokers) > 0 && !s.testMode {
+			s.kafka = NewKafkaConsumer(&s.RestServer)
+			go s.kafka.Run()
+		}
+
 	sleep:
 		if s.testMode {
 			return
@@ -238,6 +376,8 @@ type HiddenItemsManager struct {
 	mu                      sync.RWMutex
 	hiddenItems             *strset.Set // global hidden items
 	hiddenItemsInCategories sync.Map    // categorized hidden items
+	visibleFrom             map[string]float64
+	visibleUntil            map[string]float64
 	updateTime              time.Time
 	test                    bool
 }
@@ -296,20 +436,80 @@ func (hc *HiddenItemsManager) sync() {
 		}
 		hc.hiddenItemsInCategories.Store(category, strset.New(cache.RemoveScores(score)...))
 	}
+	// load visibility windows
+	visibleFrom, err := hc.loadVisibilityBounds(cache.ItemVisibleFrom)
+	if err != nil {
+		log.Logger().Error("failed to load visibility windows", zap.Error(err))
+		return
+	}
+	visibleUntil, err := hc.loadVisibilityBounds(cache.ItemVisibleUntil)
+	if err != nil {
+		log.Logger().Error("failed to load visibility windows", zap.Error(err))
+		return
+	}
 	hc.mu.Lock()
 	defer hc.mu.Unlock()
 	hc.hiddenItems = hiddenItems
+	hc.visibleFrom = visibleFrom
+	hc.visibleUntil = visibleUntil
 	hc.updateTime = ts
 }
 
+func (hc *HiddenItemsManager) loadVisibilityBounds(key string) (map[string]float64, error) {
+	scores, err := hc.server.CacheClient.GetSorted(key, 0, -1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	bounds := make(map[string]float64, len(scores))
+	for _, score := range scores {
+		bounds[score.Id] = score.Score
+	}
+	return bounds, nil
+}
+
 func (hc *HiddenItemsManager) IsHidden(members []string, category string) ([]bool, error) {
+	documents, err := hc.server.CacheClient.ReadDocuments(hc.DeltaReads(category)...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return hc.IsHiddenWithDelta(members, category, DeltaHiddenItems(documents)), nil
+}
+
+// DeltaReads returns reads of items hidden globally and in the category after the last sync. They could be batched
+// with other reads and the result should be passed to DeltaHiddenItems.
+func (hc *HiddenItemsManager) DeltaReads(category string) []cache.Read {
 	if hc.test {
 		hc.sync()
 	}
+	hc.mu.RLock()
+	updateTime := hc.updateTime
+	hc.mu.RUnlock()
+	reads := []cache.Read{cache.ReadSortedByScore(cache.HiddenItemsV2, float64(updateTime.Unix()), float64(time.Now().Unix()))}
+	if category != "" {
+		reads = append(reads, cache.ReadSortedByScore(cache.Key(cache.HiddenItemsV2, category), float64(updateTime.Unix()), float64(time.Now().Unix())))
+	}
+	return reads
+}
+
+// DeltaHiddenItems collects items hidden after the last sync from results of DeltaReads.
+func DeltaHiddenItems(documents []cache.Document) *strset.Set {
+	deltaHiddenItems := strset.New()
+	for _, document := range documents {
+		deltaHiddenItems.Add(cache.RemoveScores(document.Scores)...)
+	}
+	return deltaHiddenItems
+}
+
+// IsHiddenWithDelta checks hidden items with delta hidden items loaded before.
+func (hc *HiddenItemsManager) IsHiddenWithDelta(members []string, category string, deltaHiddenItems *strset.Set) []bool {
+	if deltaHiddenItems == nil {
+		deltaHiddenItems = strset.New()
+	}
 	// load hidden items
 	hc.mu.RLock()
 	hiddenItems := hc.hiddenItems
-	updateTime := hc.updateTime
+	visibleFrom := hc.visibleFrom
+	visibleUntil := hc.visibleUntil
 	hc.mu.RUnlock()
 	// load hidden items in category
 	hiddenItemsInCategory := strset.New()
@@ -318,24 +518,20 @@ func (hc *HiddenItemsManager) IsHidden(members []string, category string) ([]boo
 			hiddenItemsInCategory = temp.(*strset.Set)
 		}
 	}
-	// load delta hidden items
-	score, err := hc.server.CacheClient.GetSortedByScore(cache.HiddenItemsV2, float64(updateTime.Unix()), float64(time.Now().Unix()))
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	deltaHiddenItems := strset.New(cache.RemoveScores(score)...)
-	// load delta hidden items in category
-	deltaHiddenItemsInCategory := strset.New()
-	if category != "" {
-		score, err = hc.server.CacheClient.GetSortedByScore(cache.Key(cache.HiddenItemsV2, category), float64(updateTime.Unix()), float64(time.Now().Unix()))
-		if err != nil {
-			return nil, errors.Trace(err)
+	// items outside their visibility windows are hidden
+	now := float64(time.Now().Unix())
+	isInvisible := func(itemId string) bool {
+		if from, exist := visibleFrom[itemId]; exist && now < from {
+			return true
+		}
+		if until, exist := visibleUntil[itemId]; exist && now >= until {
+			return true
 		}
-		deltaHiddenItemsInCategory = strset.New(cache.RemoveScores(score)...)
+		return false
 	}
 	return lo.Map(members, func(t string, i int) bool {
-		return hiddenItems.Has(t) || deltaHiddenItems.Has(t) || hiddenItemsInCategory.Has(t) || deltaHiddenItemsInCategory.Has(t)
-	}), nil
+		return hiddenItems.Has(t) || deltaHiddenItems.Has(t) || hiddenItemsInCategory.Has(t) || isInvisible(t)
+	})
 }
 
 func (hc *HiddenItemsManager) IsHiddenInCache(member string, category string) bool {
@@ -422,6 +618,20 @@ func (cm *CacheModification) modifyItem(itemId string, prevCategories, categorie
 	return cm
 }
 
+func (cm *CacheModification) setVisibility(itemId string, visibleFrom, visibleUntil *time.Time) *CacheModification {
+	if visibleFrom != nil && !visibleFrom.IsZero() {
+		cm.insertion = append(cm.insertion, cache.Sorted(cache.ItemVisibleFrom, []cache.Scored{{itemId, float64(visibleFrom.Unix())}}))
+	} else {
+		cm.deletion = append(cm.deletion, cache.Member(cache.ItemVisibleFrom, itemId))
+	}
+	if visibleUntil != nil && !visibleUntil.IsZero() {
+		cm.insertion = append(cm.insertion, cache.Sorted(cache.ItemVisibleUntil, []cache.Scored{{itemId, float64(visibleUntil.Unix())}}))
+	} else {
+		cm.deletion = append(cm.deletion, cache.Member(cache.ItemVisibleUntil, itemId))
+	}
+	return cm
+}
+
 func (cm *CacheModification) HideItem(itemId string) *CacheModification {
 	cm.insertion = append(cm.insertion, cache.Sorted(cache.HiddenItemsV2, []cache.Scored{{itemId, float64(time.Now().Unix())}}))
 	return cm
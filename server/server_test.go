@@ -20,10 +20,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/zhenghaoz/gorse/config"
 	"github.com/zhenghaoz/gorse/protocol"
+	"github.com/zhenghaoz/gorse/storage/cache"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"net"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
 )
 
 type mockMaster struct {
@@ -98,3 +102,54 @@ func TestServer_Sync(t *testing.T) {
 	assert.Equal(t, "redis://"+master.cacheStore.Addr(), serv.cachePath)
 	master.Stop()
 }
+
+func TestServer_Shutdown(t *testing.T) {
+	s := &Server{RestServer: RestServer{Settings: config.NewSettings()}}
+	s.Config.Server.DrainTimeout = 10 * time.Second
+	cacheStore, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer cacheStore.Close()
+	s.CacheClient, err = cache.Open("redis://"+cacheStore.Addr(), "")
+	assert.NoError(t, err)
+
+	// serve slow requests
+	started := make(chan struct{}, 10)
+	s.HttpServer = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})}
+	listen, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	go func() {
+		assert.Equal(t, http.ErrServerClosed, s.HttpServer.Serve(listen))
+	}()
+
+	// in-flight requests are drained
+	var wg sync.WaitGroup
+	statusCodes := make([]int, 10)
+	for i := range statusCodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get("http://" + listen.Addr().String())
+			if assert.NoError(t, err) {
+				statusCodes[i] = resp.StatusCode
+				resp.Body.Close()
+			}
+		}(i)
+	}
+	for range statusCodes {
+		<-started
+	}
+	s.Shutdown()
+	wg.Wait()
+	for _, statusCode := range statusCodes {
+		assert.Equal(t, http.StatusOK, statusCode)
+	}
+
+	// new requests are rejected and databases are closed
+	_, err = http.Get("http://" + listen.Addr().String())
+	assert.Error(t, err)
+	assert.Error(t, s.CacheClient.Set(cache.String("key", "value")))
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+// ErrSessionExpired means a session doesn't exist or has been idle for longer than the TTL, and clients should create
+// a new session.
+var ErrSessionExpired = errors.New("session expired")
+
+// Session is a session stored by the server. Feedback appended to the session is kept in the cache store until the
+// session expires, so that clients don't resend the whole session for recommendation.
+type Session struct {
+	SessionId string
+}
+
+func (s *RestServer) createSession(_ *restful.Request, response *restful.Response) {
+	session := Session{SessionId: uuid.New().String()}
+	if err := s.CacheClient.Set(cache.Time(cache.Key(cache.SessionActiveTime, session.SessionId), time.Now())); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	Ok(response, session)
+}
+
+func (s *RestServer) insertSessionFeedback(request *restful.Request, response *restful.Response) {
+	sessionId := request.PathParameter("session-id")
+	var feedbacks []Feedback
+	if err := request.ReadEntity(&feedbacks); err != nil {
+		BadRequest(response, err)
+		return
+	}
+	// validate feedback before appending
+	members := make([]cache.Scored, len(feedbacks))
+	now := time.Now()
+	for i, feedback := range feedbacks {
+		if _, err := feedback.ToDataFeedback(); err != nil {
+			BadRequest(response, err)
+			return
+		}
+		if feedback.Timestamp == "" {
+			feedback.Timestamp = now.Format(time.RFC3339Nano)
+		}
+		buf, err := json.Marshal(feedback)
+		if err != nil {
+			InternalServerError(response, err)
+			return
+		}
+		// scores keep feedback in the order of appending
+		members[i] = cache.Scored{Id: string(buf), Score: float64(now.UnixMicro() + int64(i))}
+	}
+	if err := s.touchSession(sessionId); errors.Is(err, ErrSessionExpired) {
+		Gone(response, err)
+		return
+	} else if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	if err := s.CacheClient.AddSorted(cache.Sorted(cache.Key(cache.SessionFeedback, sessionId), members)); err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	Ok(response, Success{RowAffected: len(feedbacks)})
+}
+
+func (s *RestServer) getSessionRecommend(request *restful.Request, response *restful.Response) {
+	sessionId := request.PathParameter("session-id")
+	category := request.PathParameter("category")
+	n, err := ParseInt(request, "n", s.Config.Server.DefaultN)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	offset, err := ParseInt(request, "offset", 0)
+	if err != nil {
+		BadRequest(response, err)
+		return
+	}
+	if err = s.touchSession(sessionId); errors.Is(err, ErrSessionExpired) {
+		Gone(response, err)
+		return
+	} else if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	dataFeedback, err := s.loadSessionFeedback(sessionId)
+	if err != nil {
+		InternalServerError(response, err)
+		return
+	}
+	data.SortFeedbacks(dataFeedback)
+	if result, ok := s.recommendSession(response, dataFeedback, category, n, offset); ok {
+		Ok(response, result)
+	}
+}
+
+// touchSession renews the active time of a session. ErrSessionExpired is returned if the session doesn't exist or has
+// been idle for longer than the TTL, and feedback of the expired session is deleted.
+func (s *RestServer) touchSession(sessionId string) error {
+	activeTime, err := s.CacheClient.Get(cache.Key(cache.SessionActiveTime, sessionId)).Time()
+	if errors.Is(err, errors.NotFound) {
+		return ErrSessionExpired
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if time.Since(activeTime) > s.Config.Server.SessionIdleTTL {
+		if err = s.CacheClient.SetSorted(cache.Key(cache.SessionFeedback, sessionId), nil); err != nil {
+			return errors.Trace(err)
+		}
+		if err = s.CacheClient.Delete(cache.Key(cache.SessionActiveTime, sessionId)); err != nil {
+			return errors.Trace(err)
+		}
+		return ErrSessionExpired
+	}
+	return s.CacheClient.Set(cache.Time(cache.Key(cache.SessionActiveTime, sessionId), time.Now()))
+}
+
+// loadSessionFeedback loads feedback appended to a session.
+func (s *RestServer) loadSessionFeedback(sessionId string) ([]data.Feedback, error) {
+	members, err := s.CacheClient.GetSorted(cache.Key(cache.SessionFeedback, sessionId), 0, -1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	feedbacks := make([]data.Feedback, 0, len(members))
+	for _, member := range members {
+		var feedback Feedback
+		if err = json.Unmarshal([]byte(member.Id), &feedback); err != nil {
+			return nil, errors.Trace(err)
+		}
+		dataFeedback, err := feedback.ToDataFeedback()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		feedbacks = append(feedbacks, dataFeedback)
+	}
+	return feedbacks, nil
+}
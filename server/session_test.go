@@ -0,0 +1,134 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_Session(t *testing.T) {
+	s := newMockServer(t)
+	s.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"a"}
+	defer s.Close(t)
+
+	// insert similar items
+	err := s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "1"), []cache.Scored{{"3", 3}, {"4", 2}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "2"), []cache.Scored{{"4", 2}, {"5", 1}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "2", "*"), []cache.Scored{{"5", 1}})
+	assert.NoError(t, err)
+
+	// create a session
+	response := apitest.New().
+		Handler(s.handler).
+		Post("/api/session").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	var session Session
+	err = json.NewDecoder(response.Response.Body).Decode(&session)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, session.SessionId)
+
+	// recommend for an empty session
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/session/"+session.SessionId+"/recommend").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	// append feedback in two requests
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/"+session.SessionId+"/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "a", ItemId: "1"}}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/"+session.SessionId+"/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "a", ItemId: "2"}},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "b", ItemId: "3"}},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 2}`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/"+session.SessionId+"/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "a", ItemId: "4"}, Timestamp: "invalid"}}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	// recommend from stored feedback
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/session/"+session.SessionId+"/recommend").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"4", 4}, {"5", 1}})).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/session/"+session.SessionId+"/recommend/*").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{"5", 1}})).
+		End()
+
+	// sessions expire after being idle
+	err = s.CacheClient.Set(cache.Time(cache.Key(cache.SessionActiveTime, session.SessionId), time.Now().Add(-time.Hour)))
+	assert.NoError(t, err)
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/session/"+session.SessionId+"/recommend").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusGone).
+		End()
+	sorted, err := s.CacheClient.GetSorted(cache.Key(cache.SessionFeedback, session.SessionId), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, sorted)
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/session/"+session.SessionId+"/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "a", ItemId: "1"}}}).
+		Expect(t).
+		Status(http.StatusGone).
+		End()
+}
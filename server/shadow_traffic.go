@@ -0,0 +1,327 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+const (
+	ShadowTrafficOk      = "ok"
+	ShadowTrafficFailed  = "failed"
+	ShadowTrafficDropped = "dropped"
+
+	shadowTrafficQueueSize = 1000
+	shadowTrafficWorkers   = 4
+
+	// shadowTrafficHeader marks replayed requests, so that the secondary cluster never replays them again.
+	shadowTrafficHeader = "X-Gorse-Shadow"
+)
+
+// ShadowTrafficDiff is the difference between responses of this cluster and the secondary cluster to a request. The
+// Jaccard overlap of returned ids is nil if the request is mutating or the secondary cluster fails.
+type ShadowTrafficDiff struct {
+	Timestamp      time.Time
+	Endpoint       string
+	URI            string
+	StatusCode     int
+	Error          string
+	Jaccard        *float64
+	PrimaryLatency time.Duration
+	ShadowLatency  time.Duration
+}
+
+type shadowRequest struct {
+	timestamp      time.Time
+	method         string
+	endpoint       string
+	uri            string
+	body           []byte
+	primaryBody    []byte
+	primaryLatency time.Duration
+}
+
+// shadowResponseRecorder records the body of a response while writing it.
+type shadowResponseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *shadowResponseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// ShadowTrafficFilter replays a sampled request against the secondary cluster in the background once it has been
+// served. Only requests of recommendation and neighbors are replayed, as well as insertions of feedback if enabled.
+func (s *RestServer) ShadowTrafficFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	cfg := s.Config.Server.ShadowTraffic
+	mutating := req.Request.Method != http.MethodGet
+	if s.ShadowTraffic == nil || cfg.Target == "" || (mutating && !cfg.Feedback) ||
+		req.HeaderParameter(shadowTrafficHeader) != "" || rand.Float64()*100 >= cfg.SamplePercent {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	request := shadowRequest{
+		timestamp: time.Now(),
+		method:    req.Request.Method,
+		endpoint:  req.Request.Method + " " + req.SelectedRoutePath(),
+		uri:       req.Request.URL.RequestURI(),
+	}
+	var recorder *shadowResponseRecorder
+	if mutating {
+		body, err := io.ReadAll(req.Request.Body)
+		req.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			chain.ProcessFilter(req, resp)
+			return
+		}
+		request.body = body
+	} else {
+		recorder = &shadowResponseRecorder{ResponseWriter: resp.ResponseWriter}
+		resp.ResponseWriter = recorder
+	}
+	chain.ProcessFilter(req, resp)
+	if resp.StatusCode() != http.StatusOK {
+		return
+	}
+	request.primaryLatency = time.Since(request.timestamp)
+	if recorder != nil {
+		request.primaryBody = recorder.body.Bytes()
+	}
+	s.ShadowTraffic.push(request)
+}
+
+// ShadowTraffic replays requests against the secondary cluster by background workers. Requests are queued in a bounded
+// queue and dropped if the queue is full, so that API calls are never blocked by the secondary cluster. Differences
+// between responses are saved into the rolling log in the cache store periodically.
+type ShadowTraffic struct {
+	server *RestServer
+	client *http.Client
+	queue  chan shadowRequest
+	mu     sync.Mutex
+	diffs  []ShadowTrafficDiff
+	test   bool
+}
+
+func NewShadowTraffic(s *RestServer) *ShadowTraffic {
+	t := &ShadowTraffic{server: s, client: &http.Client{}, queue: make(chan shadowRequest, shadowTrafficQueueSize)}
+	for i := 0; i < shadowTrafficWorkers; i++ {
+		go func() {
+			for request := range t.queue {
+				t.replay(request)
+			}
+		}()
+	}
+	go func() {
+		for {
+			time.Sleep(s.Config.Server.CacheExpire)
+			t.flush()
+			log.Logger().Debug("flush shadow traffic log", zap.String("cache_expire", s.Config.Server.CacheExpire.String()))
+		}
+	}()
+	return t
+}
+
+func newShadowTrafficForTest(s *RestServer) *ShadowTraffic {
+	return &ShadowTraffic{server: s, client: &http.Client{}, test: true}
+}
+
+// push queues a request to replay.
+func (t *ShadowTraffic) push(request shadowRequest) {
+	if t.test {
+		t.replay(request)
+		t.flush()
+		return
+	}
+	select {
+	case t.queue <- request:
+	default:
+		ShadowTrafficRequestsTotal.WithLabelValues(ShadowTrafficDropped).Inc()
+	}
+}
+
+// replay sends a request to the secondary cluster and compares responses.
+func (t *ShadowTraffic) replay(request shadowRequest) {
+	diff := ShadowTrafficDiff{
+		Timestamp:      request.timestamp,
+		Endpoint:       request.endpoint,
+		URI:            request.uri,
+		PrimaryLatency: request.primaryLatency,
+	}
+	body, err := t.send(request, &diff)
+	if err != nil {
+		ShadowTrafficRequestsTotal.WithLabelValues(ShadowTrafficFailed).Inc()
+		diff.Error = err.Error()
+	} else {
+		ShadowTrafficRequestsTotal.WithLabelValues(ShadowTrafficOk).Inc()
+		ShadowTrafficLatencyDeltaSeconds.Observe((diff.ShadowLatency - diff.PrimaryLatency).Seconds())
+		if request.primaryBody != nil {
+			if jaccard, err := responseJaccard(request.primaryBody, body); err != nil {
+				diff.Error = err.Error()
+			} else {
+				diff.Jaccard = &jaccard
+				ShadowTrafficJaccard.Observe(jaccard)
+			}
+		}
+	}
+	logSize := t.server.Config.Server.ShadowTraffic.LogSize
+	t.mu.Lock()
+	t.diffs = append(t.diffs, diff)
+	if len(t.diffs) > logSize {
+		t.diffs = t.diffs[len(t.diffs)-logSize:]
+	}
+	t.mu.Unlock()
+}
+
+// send sends a request to the secondary cluster, and records the status code and latency in the difference.
+func (t *ShadowTraffic) send(request shadowRequest, diff *ShadowTrafficDiff) ([]byte, error) {
+	cfg := t.server.Config.Server.ShadowTraffic
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, request.method, strings.TrimSuffix(cfg.Target, "/")+request.uri,
+		bytes.NewReader(request.body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req.Header.Set(shadowTrafficHeader, "true")
+	if cfg.APIKey != "" {
+		req.Header.Set("X-API-Key", cfg.APIKey)
+	}
+	if request.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	start := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		diff.ShadowLatency = time.Since(start)
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	diff.ShadowLatency = time.Since(start)
+	diff.StatusCode = resp.StatusCode
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return body, nil
+}
+
+// flush saves differences in memory into the rolling log in the cache store.
+func (t *ShadowTraffic) flush() {
+	t.mu.Lock()
+	diffs := t.diffs
+	t.diffs = nil
+	t.mu.Unlock()
+	if len(diffs) == 0 {
+		return
+	}
+	if err := t.save(diffs); err != nil {
+		log.Logger().Error("failed to save shadow traffic log", zap.Int("n", len(diffs)), zap.Error(err))
+	}
+}
+
+func (t *ShadowTraffic) save(diffs []ShadowTrafficDiff) error {
+	scores := make([]cache.Scored, 0, len(diffs))
+	for _, diff := range diffs {
+		buf, err := json.Marshal(diff)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		scores = append(scores, cache.Scored{Id: string(buf), Score: float64(diff.Timestamp.UnixNano())})
+	}
+	if err := t.server.CacheClient.AddSorted(cache.Sorted(cache.ShadowTrafficLog, scores)); err != nil {
+		return errors.Trace(err)
+	}
+	logSize := t.server.Config.Server.ShadowTraffic.LogSize
+	overflow, err := t.server.CacheClient.GetSorted(cache.ShadowTrafficLog, logSize, logSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(overflow) > 0 {
+		return t.server.CacheClient.RemSortedByScore(cache.ShadowTrafficLog, math.Inf(-1), overflow[0].Score)
+	}
+	return nil
+}
+
+// responseIds returns ids in a response of recommendation or neighbors, which is a list of ids or scored ids.
+func responseIds(body []byte) ([]string, error) {
+	var ids []string
+	if err := json.Unmarshal(body, &ids); err == nil {
+		return ids, nil
+	}
+	var scores []cache.Scored
+	if err := json.Unmarshal(body, &scores); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return lo.Map(scores, func(score cache.Scored, _ int) string {
+		return score.Id
+	}), nil
+}
+
+// responseJaccard returns the Jaccard overlap of ids in two responses. The overlap of two empty responses is 1.
+func responseJaccard(a, b []byte) (float64, error) {
+	idsA, err := responseIds(a)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	idsB, err := responseIds(b)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	idsA, idsB = lo.Uniq(idsA), lo.Uniq(idsB)
+	union := lo.Union(idsA, idsB)
+	if len(union) == 0 {
+		return 1, nil
+	}
+	return float64(len(lo.Intersect(idsA, idsB))) / float64(len(union)), nil
+}
+
+// GetShadowTrafficDiffs returns the latest n differences in the rolling log.
+func GetShadowTrafficDiffs(cacheClient cache.Database, n int) ([]ShadowTrafficDiff, error) {
+	scores, err := cacheClient.GetSorted(cache.ShadowTrafficLog, 0, n-1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	diffs := make([]ShadowTrafficDiff, 0, len(scores))
+	for _, score := range scores {
+		var diff ShadowTrafficDiff
+		if err = json.Unmarshal([]byte(score.Id), &diff); err != nil {
+			return nil, errors.Trace(err)
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestResponseJaccard(t *testing.T) {
+	jaccard, err := responseJaccard([]byte(`["1","2","3"]`), []byte(`["2","3","4"]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, jaccard)
+	jaccard, err = responseJaccard([]byte(`[{"Id":"1","Score":2},{"Id":"1","Score":1}]`), []byte(`[{"Id":"1","Score":1}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, jaccard)
+	jaccard, err = responseJaccard([]byte(`[]`), []byte(`[]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, jaccard)
+	_, err = responseJaccard([]byte(`["1"]`), []byte(`{}`))
+	assert.Error(t, err)
+}
+
+func TestServer_ShadowTraffic(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	var mu sync.Mutex
+	var requests []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("X-API-Key")+" "+string(body))
+		switch r.URL.Path {
+		case "/api/recommend/0":
+			_, _ = w.Write([]byte(`["2","3"]`))
+		case "/api/item/0/neighbors/":
+			_, _ = w.Write([]byte(`[{"Id":"1","Score":1}]`))
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer target.Close()
+	err := s.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{Id: "1", Score: 2}, {Id: "2", Score: 1}})
+	assert.NoError(t, err)
+	err = s.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0"), []cache.Scored{{Id: "1", Score: 1}})
+	assert.NoError(t, err)
+
+	// requests aren't replayed by default
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`["1","2"]`).
+		End()
+	assert.Empty(t, requests)
+
+	s.Config.Server.ShadowTraffic.Target = target.URL + "/"
+	s.Config.Server.ShadowTraffic.APIKey = "shadow"
+	s.Config.Server.ShadowTraffic.SamplePercent = 100
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`["1","2"]`).
+		End()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/item/0/neighbors/").
+		Header("X-API-Key", apiKey).
+		QueryParams(map[string]string{"n": "3"}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(marshal(t, []cache.Scored{{Id: "1", Score: 1}})).
+		End()
+	// replayed requests and feedback aren't replayed by default
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		Header(shadowTrafficHeader, "true").
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	feedback := []data.Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "1", ItemId: "1"}}}
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON(feedback).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.Equal(t, []string{
+		"GET /api/recommend/0 shadow ",
+		"GET /api/item/0/neighbors/?n=3 shadow ",
+	}, requests)
+
+	// feedback is replayed if enabled
+	s.Config.Server.ShadowTraffic.Feedback = true
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON(feedback).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	assert.Len(t, requests, 3)
+	assert.Equal(t, "POST /api/feedback shadow "+marshal(t, feedback), requests[2])
+
+	// differences are saved into the rolling log
+	diffs, err := GetShadowTrafficDiffs(s.CacheClient, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, diffs, 3) {
+		assert.Equal(t, "POST /api/feedback", diffs[0].Endpoint)
+		assert.Nil(t, diffs[0].Jaccard)
+		assert.Equal(t, "GET /api/item/{item-id}/neighbors/", diffs[1].Endpoint)
+		assert.Equal(t, 1.0, *diffs[1].Jaccard)
+		assert.Equal(t, "GET /api/recommend/{user-id}", diffs[2].Endpoint)
+		assert.Equal(t, 1.0/3, *diffs[2].Jaccard)
+		assert.Equal(t, http.StatusOK, diffs[2].StatusCode)
+		assert.Empty(t, diffs[2].Error)
+	}
+
+	// failures of the secondary cluster never affect responses
+	s.Config.Server.ShadowTraffic.Target = "http://127.0.0.1:1"
+	s.Config.Server.ShadowTraffic.Timeout = time.Second
+	s.Config.Server.ShadowTraffic.LogSize = 2
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/recommend/0").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`["1","2"]`).
+		End()
+	diffs, err = GetShadowTrafficDiffs(s.CacheClient, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, diffs, 2) {
+		assert.NotEmpty(t, diffs[0].Error)
+		assert.Nil(t, diffs[0].Jaccard)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/hll"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+// ActivityPrecision is the precision of sketches of active users and items. A sketch takes 16KB, and the relative
+// standard error is 0.81%.
+const ActivityPrecision = 14
+
+// ActivityDay returns the day of daily sketches of a time in UTC.
+func ActivityDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+type activitySketches struct {
+	users *hll.HyperLogLog
+	items *hll.HyperLogLog
+}
+
+// ActivityTracker adds users and items of inserted feedback to sketches of days in memory, and merges them into daily
+// sketches in the cache store periodically. The sketch of today is kept in memory and merged again at each flush, so
+// that updates lost by concurrent merges of servers are recovered.
+type ActivityTracker struct {
+	server *RestServer
+	mu     sync.Mutex
+	days   map[string]*activitySketches
+	test   bool
+}
+
+func NewActivityTracker(s *RestServer) *ActivityTracker {
+	t := &ActivityTracker{server: s, days: make(map[string]*activitySketches)}
+	go func() {
+		for {
+			time.Sleep(s.Config.Server.CacheExpire)
+			t.flush()
+			log.Logger().Debug("flush server side activity sketches", zap.String("cache_expire", s.Config.Server.CacheExpire.String()))
+		}
+	}()
+	return t
+}
+
+func newActivityTrackerForTest(s *RestServer) *ActivityTracker {
+	return &ActivityTracker{server: s, days: make(map[string]*activitySketches), test: true}
+}
+
+// Add adds users and items of feedback to the sketches of today.
+func (t *ActivityTracker) Add(feedback []data.Feedback) {
+	day := ActivityDay(time.Now())
+	t.mu.Lock()
+	sketches, exist := t.days[day]
+	if !exist {
+		sketches = &activitySketches{users: hll.New(ActivityPrecision), items: hll.New(ActivityPrecision)}
+		t.days[day] = sketches
+	}
+	for _, v := range feedback {
+		sketches.users.Add(v.UserId)
+		sketches.items.Add(v.ItemId)
+	}
+	t.mu.Unlock()
+	if t.test {
+		t.flush()
+	}
+}
+
+// flush merges sketches in memory into daily sketches in the cache store. Sketches of past days are dropped once
+// merged.
+func (t *ActivityTracker) flush() {
+	today := ActivityDay(time.Now())
+	t.mu.Lock()
+	encoded := make(map[string][2]string, len(t.days))
+	for day, sketches := range t.days {
+		encoded[day] = [2]string{sketches.users.String(), sketches.items.String()}
+	}
+	t.mu.Unlock()
+	for day, sketches := range encoded {
+		if err := mergeSketch(t.server.CacheClient, cache.Key(cache.ActiveUsersSketch, day), sketches[0]); err != nil {
+			log.Logger().Error("failed to merge sketch of active users", zap.String("day", day), zap.Error(err))
+			continue
+		}
+		if err := mergeSketch(t.server.CacheClient, cache.Key(cache.ActiveItemsSketch, day), sketches[1]); err != nil {
+			log.Logger().Error("failed to merge sketch of active items", zap.String("day", day), zap.Error(err))
+			continue
+		}
+		if day != today {
+			t.mu.Lock()
+			delete(t.days, day)
+			t.mu.Unlock()
+		}
+	}
+}
+
+// mergeSketch merges an encoded sketch into a sketch in the cache store.
+func mergeSketch(cacheClient cache.Database, key, encoded string) error {
+	sketch, err := hll.Parse(encoded)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	prev, err := cacheClient.Get(key).String()
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		return errors.Trace(err)
+	} else if err == nil {
+		prevSketch, err := hll.Parse(prev)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = sketch.Merge(prevSketch); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return cacheClient.Set(cache.String(key, sketch.String()))
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/hll"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_InsertFeedback_Activity(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	var feedback []Feedback
+	for i := 0; i < 100; i++ {
+		feedback = append(feedback, Feedback{FeedbackKey: data.FeedbackKey{
+			FeedbackType: "click", UserId: strconv.Itoa(i % 10), ItemId: strconv.Itoa(i)}})
+	}
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON(feedback).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 100}`).
+		End()
+	// sketches of today are merged into the cache store
+	day := ActivityDay(time.Now())
+	encoded, err := s.CacheClient.Get(cache.Key(cache.ActiveUsersSketch, day)).String()
+	assert.NoError(t, err)
+	users, err := hll.Parse(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), users.Count())
+	encoded, err = s.CacheClient.Get(cache.Key(cache.ActiveItemsSketch, day)).String()
+	assert.NoError(t, err)
+	items, err := hll.Parse(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), items.Count())
+}
+
+func TestMergeSketch(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	a, b := hll.New(ActivityPrecision), hll.New(ActivityPrecision)
+	a.Add("1")
+	a.Add("2")
+	b.Add("2")
+	b.Add("3")
+	assert.NoError(t, mergeSketch(s.CacheClient, "sketch", a.String()))
+	assert.NoError(t, mergeSketch(s.CacheClient, "sketch", b.String()))
+	encoded, err := s.CacheClient.Get("sketch").String()
+	assert.NoError(t, err)
+	merged, err := hll.Parse(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), merged.Count())
+}
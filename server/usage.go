@@ -0,0 +1,136 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+// Metrics of usage. Metrics of requests are followed by endpoints, such as "requests:GET /api/user/{user-id}". Only
+// successful requests are counted by endpoints, while server errors are counted in total.
+const (
+	UsageRequests         = "requests:"
+	UsageServerErrors     = "errors:server"
+	UsageIngestedUsers    = "ingested:users"
+	UsageIngestedItems    = "ingested:items"
+	UsageIngestedFeedback = "ingested:feedback"
+)
+
+// UsageCounter counts requests by endpoints and ingested rows by days in memory, and saves counters of this node into
+// the cache store periodically. Counters are cumulative in a day, so that counters in the cache store are overwritten
+// instead of incremented. Counters of past days are dropped once saved.
+type UsageCounter struct {
+	server *RestServer
+	node   string
+	mu     sync.Mutex
+	days   map[string]map[string]int64
+	test   bool
+}
+
+func NewUsageCounter(s *RestServer) *UsageCounter {
+	c := &UsageCounter{server: s, node: newUsageNode(), days: make(map[string]map[string]int64)}
+	go func() {
+		for {
+			time.Sleep(s.Config.Server.CacheExpire)
+			c.flush()
+			log.Logger().Debug("flush usage counters", zap.String("cache_expire", s.Config.Server.CacheExpire.String()))
+		}
+	}()
+	return c
+}
+
+func newUsageCounterForTest(s *RestServer) *UsageCounter {
+	return &UsageCounter{server: s, node: newUsageNode(), days: make(map[string]map[string]int64), test: true}
+}
+
+// newUsageNode returns a random name of this node, so that counters of restarted nodes never overwrite each other.
+func newUsageNode() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Add adds a number to the counter of a metric today.
+func (c *UsageCounter) Add(metric string, n int) {
+	if n <= 0 {
+		return
+	}
+	day := ActivityDay(time.Now())
+	c.mu.Lock()
+	counters, exist := c.days[day]
+	if !exist {
+		counters = make(map[string]int64)
+		c.days[day] = counters
+	}
+	counters[metric] += int64(n)
+	c.mu.Unlock()
+	if c.test {
+		c.flush()
+	}
+}
+
+// flush saves counters in memory into the cache store.
+func (c *UsageCounter) flush() {
+	today := ActivityDay(time.Now())
+	c.mu.Lock()
+	days := make(map[string][]cache.Scored, len(c.days))
+	for day, counters := range c.days {
+		scores := make([]cache.Scored, 0, len(counters))
+		for metric, count := range counters {
+			scores = append(scores, cache.Scored{Id: metric, Score: float64(count)})
+		}
+		sort.Slice(scores, func(i, j int) bool {
+			return scores[i].Id < scores[j].Id
+		})
+		days[day] = scores
+	}
+	c.mu.Unlock()
+	for day, scores := range days {
+		if err := c.save(day, scores); err != nil {
+			log.Logger().Error("failed to save usage counters", zap.String("day", day), zap.Error(err))
+			continue
+		}
+		if day != today {
+			c.mu.Lock()
+			delete(c.days, day)
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *UsageCounter) save(day string, scores []cache.Scored) error {
+	if err := c.server.CacheClient.AddSet(cache.Key(cache.UsageNodes, day), c.node); err != nil {
+		return errors.Trace(err)
+	}
+	return c.server.CacheClient.SetSorted(cache.Key(cache.UsageCounters, day, c.node), scores)
+}
+
+// AddUsage adds a number to the usage counter of a metric if usage counters are enabled.
+func (s *RestServer) AddUsage(metric string, n int) {
+	if s.UsageCounter != nil {
+		s.UsageCounter.Add(metric, n)
+	}
+}
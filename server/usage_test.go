@@ -0,0 +1,84 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_Usage(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	var feedback []Feedback
+	for i := 0; i < 10; i++ {
+		feedback = append(feedback, Feedback{FeedbackKey: data.FeedbackKey{
+			FeedbackType: "click", UserId: strconv.Itoa(i), ItemId: strconv.Itoa(i)}})
+	}
+	for i := 0; i < 2; i++ {
+		apitest.New().
+			Handler(s.handler).
+			Post("/api/feedback").
+			Header("X-API-Key", apiKey).
+			JSON(feedback).
+			Expect(t).
+			Status(http.StatusOK).
+			End()
+	}
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/user/10").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	// counters of this node are saved into the cache store
+	day := ActivityDay(time.Now())
+	nodes, err := s.CacheClient.GetSet(cache.Key(cache.UsageNodes, day))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s.UsageCounter.node}, nodes)
+	counters, err := s.CacheClient.GetSorted(cache.Key(cache.UsageCounters, day, s.UsageCounter.node), 0, -1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Scored{
+		{Id: UsageIngestedFeedback, Score: 20},
+		{Id: UsageRequests + "POST /api/feedback", Score: 2},
+	}, counters)
+}
+
+func TestUsageCounter_Flush(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	counter := &UsageCounter{server: &s.RestServer, node: "node", days: make(map[string]map[string]int64)}
+	yesterday := ActivityDay(time.Now().AddDate(0, 0, -1))
+	counter.days[yesterday] = map[string]int64{UsageIngestedUsers: 1}
+	counter.Add(UsageIngestedItems, 2)
+	counter.flush()
+	// counters of past days are dropped once saved
+	assert.Len(t, counter.days, 1)
+	counters, err := s.CacheClient.GetSorted(cache.Key(cache.UsageCounters, yesterday, "node"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{Id: UsageIngestedUsers, Score: 1}}, counters)
+	counters, err = s.CacheClient.GetSorted(cache.Key(cache.UsageCounters, ActivityDay(time.Now()), "node"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{Id: UsageIngestedItems, Score: 2}}, counters)
+}
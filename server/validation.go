@@ -0,0 +1,152 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+// Reasons of rejected feedback.
+const (
+	RejectUnknownType     = "unknown_type"
+	RejectFutureTimestamp = "future_timestamp"
+)
+
+// FeedbackRejection is a feedback rejected by validation and the reason.
+type FeedbackRejection struct {
+	Index        int
+	FeedbackType string
+	UserId       string
+	ItemId       string
+	Reason       string
+}
+
+// FeedbackRejections is the response of feedback rejected by validation.
+type FeedbackRejections struct {
+	Rejections []FeedbackRejection
+}
+
+// normalizeFeedbackType lowercases a feedback type if required and replaces it with its normalized type if it is an
+// alias.
+func (s *RestServer) normalizeFeedbackType(feedbackType string) string {
+	conf := s.Config.Server.FeedbackValidation
+	if conf.Lowercase {
+		feedbackType = strings.ToLower(feedbackType)
+	}
+	// keys of maps are lowercased by viper
+	if normalized, exist := conf.Aliases[strings.ToLower(feedbackType)]; exist {
+		return normalized
+	}
+	return feedbackType
+}
+
+// isKnownFeedbackType returns true if a feedback type is allowed or used by the data source.
+func (s *RestServer) isKnownFeedbackType(feedbackType string) bool {
+	dataSource := s.Config.Recommend.DataSource
+	return lo.Contains(s.Config.Server.FeedbackValidation.AllowedTypes, feedbackType) ||
+		lo.Contains(dataSource.PositiveFeedbackTypes, feedbackType) ||
+		lo.Contains(dataSource.ReadFeedbackTypes, feedbackType) ||
+		lo.Contains(dataSource.NegativeFeedbackTypes, feedbackType)
+}
+
+// validateFeedbackSchema normalizes the type of a feedback and returns the reason if the feedback is rejected. Feedback
+// of unknown types is only rejected in strict mode.
+func (s *RestServer) validateFeedbackSchema(feedback *data.Feedback) (reason string) {
+	conf := s.Config.Server.FeedbackValidation
+	feedback.FeedbackType = s.normalizeFeedbackType(feedback.FeedbackType)
+	if !s.isKnownFeedbackType(feedback.FeedbackType) {
+		if conf.Strict {
+			FeedbackRejectedTotal.WithLabelValues(RejectUnknownType).Inc()
+			return RejectUnknownType
+		}
+		FeedbackUnknownTypeTotal.Inc()
+	}
+	if skew, exist := conf.MaxFutureSkew[strings.ToLower(feedback.FeedbackType)]; exist &&
+		feedback.Timestamp.After(time.Now().Add(skew)) {
+		FeedbackRejectedTotal.WithLabelValues(RejectFutureTimestamp).Inc()
+		return RejectFutureTimestamp
+	}
+	return ""
+}
+
+// validateFeedbackBatch validates a batch of feedback. Feedback is normalized in place, and rejected feedback is
+// returned.
+func (s *RestServer) validateFeedbackBatch(response *restful.Response, feedback []data.Feedback) []FeedbackRejection {
+	var (
+		rejections   []FeedbackRejection
+		unknownTypes []string
+	)
+	for i := range feedback {
+		if reason := s.validateFeedbackSchema(&feedback[i]); reason != "" {
+			rejections = append(rejections, FeedbackRejection{
+				Index:        i,
+				FeedbackType: feedback[i].FeedbackType,
+				UserId:       feedback[i].UserId,
+				ItemId:       feedback[i].ItemId,
+				Reason:       reason,
+			})
+		} else if !s.isKnownFeedbackType(feedback[i].FeedbackType) {
+			unknownTypes = append(unknownTypes, feedback[i].FeedbackType)
+		}
+	}
+	if len(unknownTypes) > 0 {
+		log.ResponseLogger(response).Warn("accept feedback of unknown types", zap.Strings("feedback_types", lo.Uniq(unknownTypes)))
+	}
+	return rejections
+}
+
+// RejectFeedback returns a bad request error listing rejected feedback.
+func RejectFeedback(response *restful.Response, rejections []FeedbackRejection) {
+	response.Header().Set("Access-Control-Allow-Origin", "*")
+	log.ResponseLogger(response).Error("bad request", zap.Int("n_rejected", len(rejections)))
+	if err := response.WriteHeaderAndJson(http.StatusBadRequest, FeedbackRejections{Rejections: rejections}, restful.MIME_JSON); err != nil {
+		log.ResponseLogger(response).Error("failed to write json", zap.Error(err))
+	}
+}
+
+// clampFutureFeedback clamps timestamps of feedback later than now plus the skew tolerance to now, otherwise feedback
+// from clients with wrong clocks is hidden until the future. Timestamps are truncated to seconds so that clamped
+// feedback is visible at once in data stores of second precision. Clamped rows are logged with the max skew.
+func (s *RestServer) clampFutureFeedback(feedback []data.Feedback) {
+	now := time.Now()
+	deadline := now.Add(s.Config.Server.FeedbackSkewTolerance)
+	var (
+		clampedKeys []string
+		maxSkew     time.Duration
+	)
+	for i := range feedback {
+		if feedback[i].Timestamp.After(deadline) {
+			clampedKeys = append(clampedKeys, fmt.Sprintf("%s/%s/%s", feedback[i].FeedbackType, feedback[i].UserId, feedback[i].ItemId))
+			if skew := feedback[i].Timestamp.Sub(now); skew > maxSkew {
+				maxSkew = skew
+			}
+			feedback[i].Timestamp = now.Truncate(time.Second)
+		}
+	}
+	if len(clampedKeys) > 0 {
+		FeedbackClampedTotal.Add(float64(len(clampedKeys)))
+		log.Logger().Warn("clamp future timestamps of feedback",
+			zap.Strings("feedback", clampedKeys), zap.Duration("max_skew", maxSkew))
+	}
+}
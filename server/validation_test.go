@@ -0,0 +1,137 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestServer_ValidateFeedbackSchema(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	s.Config.Recommend.DataSource.ReadFeedbackTypes = []string{"read"}
+	s.Config.Server.FeedbackValidation.Lowercase = true
+	s.Config.Server.FeedbackValidation.Aliases = map[string]string{"thumbs_up": "like"}
+	s.Config.Server.FeedbackValidation.AllowedTypes = []string{"share"}
+	s.Config.Server.FeedbackValidation.MaxFutureSkew = map[string]time.Duration{"like": time.Hour}
+
+	// normalize feedback types
+	feedback := data.Feedback{FeedbackKey: data.FeedbackKey{FeedbackType: "LIKE"}}
+	assert.Empty(t, s.validateFeedbackSchema(&feedback))
+	assert.Equal(t, "like", feedback.FeedbackType)
+	feedback = data.Feedback{FeedbackKey: data.FeedbackKey{FeedbackType: "Thumbs_Up"}}
+	assert.Empty(t, s.validateFeedbackSchema(&feedback))
+	assert.Equal(t, "like", feedback.FeedbackType)
+	feedback = data.Feedback{FeedbackKey: data.FeedbackKey{FeedbackType: "share"}}
+	assert.Empty(t, s.validateFeedbackSchema(&feedback))
+	// unknown types are accepted out of strict mode
+	feedback = data.Feedback{FeedbackKey: data.FeedbackKey{FeedbackType: "liek"}}
+	assert.Empty(t, s.validateFeedbackSchema(&feedback))
+	s.Config.Server.FeedbackValidation.Strict = true
+	assert.Equal(t, RejectUnknownType, s.validateFeedbackSchema(&feedback))
+	// future timestamps beyond the skew are rejected
+	feedback = data.Feedback{FeedbackKey: data.FeedbackKey{FeedbackType: "like"}, Timestamp: time.Now().Add(time.Minute)}
+	assert.Empty(t, s.validateFeedbackSchema(&feedback))
+	feedback = data.Feedback{FeedbackKey: data.FeedbackKey{FeedbackType: "like"}, Timestamp: time.Now().Add(2 * time.Hour)}
+	assert.Equal(t, RejectFutureTimestamp, s.validateFeedbackSchema(&feedback))
+	feedback = data.Feedback{FeedbackKey: data.FeedbackKey{FeedbackType: "read"}, Timestamp: time.Now().Add(2 * time.Hour)}
+	assert.Empty(t, s.validateFeedbackSchema(&feedback))
+}
+
+func TestServer_InsertFeedback_Validation(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	s.Config.Server.FeedbackValidation.Lowercase = true
+	s.Config.Server.FeedbackValidation.Strict = true
+	s.Config.Server.FeedbackValidation.MaxFutureSkew = map[string]time.Duration{"like": time.Hour}
+	future := time.Now().Add(2 * time.Hour).Format(time.RFC3339)
+
+	// reject the whole batch with offending rows
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "LIKE", UserId: "0", ItemId: "0"}},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "liek", UserId: "0", ItemId: "1"}},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "0", ItemId: "2"}, Timestamp: future},
+		}).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		Body(marshal(t, FeedbackRejections{Rejections: []FeedbackRejection{
+			{Index: 1, FeedbackType: "liek", UserId: "0", ItemId: "1", Reason: RejectUnknownType},
+			{Index: 2, FeedbackType: "like", UserId: "0", ItemId: "2", Reason: RejectFutureTimestamp},
+		}})).
+		End()
+	feedback, err := s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+
+	// insert normalized feedback
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "LIKE", UserId: "0", ItemId: "0"}}}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 1}`).
+		End()
+	feedback, err = s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	if assert.Len(t, feedback, 1) {
+		assert.Equal(t, "like", feedback[0].FeedbackType)
+	}
+}
+
+func TestServer_InsertFeedback_ClampFuture(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.FeedbackSkewTolerance = 5 * time.Minute
+	now := time.Now()
+	apitest.New().
+		Handler(s.handler).
+		Post("/api/feedback").
+		Header("X-API-Key", apiKey).
+		JSON([]Feedback{
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "0", ItemId: "0"}, Timestamp: now.Add(time.Minute).Format(time.RFC3339)},
+			{FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "0", ItemId: "1"}, Timestamp: now.Add(time.Hour).Format(time.RFC3339)},
+		}).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"RowAffected": 2}`).
+		End()
+	// feedback within the tolerance is kept in the future
+	feedback, err := s.DataClient.GetUserItemFeedback("0", "0")
+	assert.NoError(t, err)
+	if assert.Len(t, feedback, 1) {
+		assert.True(t, feedback[0].Timestamp.After(now))
+	}
+	// feedback beyond the tolerance is clamped to now
+	feedback, err = s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	if assert.Len(t, feedback, 1) {
+		assert.Equal(t, "1", feedback[0].ItemId)
+		assert.WithinDuration(t, now, feedback[0].Timestamp, 2*time.Second)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+// warmUpLogInterval is the number of prefetched keys between logs of progress.
+const warmUpLogInterval = 100
+
+// Readiness is the readiness of a node to serve requests.
+type Readiness struct {
+	Ready bool
+}
+
+// pushActiveUsers pushes users into the sorted set of active users. The least recently active users are dropped
+// beyond the number of users to warm up.
+func (s *RestServer) pushActiveUsers(userIds []string) error {
+	size := s.Config.Server.WarmUp.ActiveUsers
+	if size <= 0 || len(userIds) == 0 {
+		return nil
+	}
+	timestamp := float64(time.Now().UnixNano())
+	scores := make([]cache.Scored, len(userIds))
+	for i, userId := range userIds {
+		scores[i] = cache.Scored{Id: userId, Score: timestamp}
+	}
+	if err := s.CacheClient.AddSorted(cache.Sorted(cache.ActiveUsers, scores)); err != nil {
+		return errors.Trace(err)
+	}
+	overflow, err := s.CacheClient.GetSorted(cache.ActiveUsers, size, size)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(overflow) > 0 {
+		return s.CacheClient.RemSortedByScore(cache.ActiveUsers, math.Inf(-1), overflow[0].Score)
+	}
+	return nil
+}
+
+// Ready returns true if the node has been warmed up.
+func (s *RestServer) Ready() bool {
+	return atomic.LoadInt32(&s.warmingUp) == 0
+}
+
+func (s *RestServer) getReady(_ *restful.Request, response *restful.Response) {
+	if !s.Ready() {
+		ServiceUnavailable(response, Readiness{Ready: false})
+		return
+	}
+	Ok(response, Readiness{Ready: true})
+}
+
+// WarmUp prefetches configured sorted sets and recommendation of the most recently active users into the local
+// cache, and then marks the node as ready. The node is marked as ready once the deadline exceeds even if warm-up
+// hasn't finished, and remaining keys are skipped.
+func (s *RestServer) WarmUp() {
+	defer atomic.StoreInt32(&s.warmingUp, 0)
+	cfg := s.Config.Server.WarmUp
+	if s.Config.Server.LocalCacheSize <= 0 || (len(cfg.Keys) == 0 && cfg.ActiveUsers <= 0) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(done)
+		s.warmUp(ctx)
+	}()
+	select {
+	case <-done:
+		log.Logger().Info("complete warming up", zap.Duration("elapsed", time.Since(start)))
+	case <-ctx.Done():
+		log.Logger().Warn("warm-up deadline exceeded, serve requests anyway", zap.Duration("timeout", cfg.Timeout))
+	}
+}
+
+func (s *RestServer) warmUp(ctx context.Context) {
+	cfg := s.Config.Server.WarmUp
+	keys, err := s.warmUpKeys()
+	if err != nil {
+		log.Logger().Error("failed to list keys to warm up", zap.Error(err))
+	}
+	var userIds []string
+	if cfg.ActiveUsers > 0 {
+		users, err := s.CacheClient.GetSorted(cache.ActiveUsers, 0, cfg.ActiveUsers-1)
+		if err != nil {
+			log.Logger().Error("failed to list active users to warm up", zap.Error(err))
+		}
+		for _, user := range users {
+			userIds = append(userIds, user.Id)
+		}
+	}
+	total := len(keys) + len(userIds)
+	log.Logger().Info("start warming up", zap.Int("n_keys", len(keys)), zap.Int("n_users", len(userIds)))
+	for i := 0; i < total && ctx.Err() == nil; i++ {
+		if i < len(keys) {
+			_, err = s.CacheClient.GetSorted(keys[i], 0, s.Config.Recommend.CacheSize)
+		} else {
+			_, err = s.CacheClient.ReadDocuments(s.recommendContextReads(userIds[i-len(keys)], "")...)
+		}
+		if err != nil {
+			log.Logger().Warn("failed to warm up", zap.Error(err))
+		}
+		if (i+1)%warmUpLogInterval == 0 {
+			log.Logger().Info("warming up", zap.Int("n_complete", i+1), zap.Int("n_total", total))
+		}
+	}
+}
+
+// warmUpKeys returns configured keys to warm up. Keys ending with "/*" are expanded to categories.
+func (s *RestServer) warmUpKeys() ([]string, error) {
+	var (
+		keys       []string
+		categories []string
+		err        error
+	)
+	for _, key := range s.Config.Server.WarmUp.Keys {
+		if name := strings.TrimSuffix(key, "/*"); name != key {
+			if categories == nil {
+				if categories, err = s.CacheClient.GetSet(cache.ItemCategories); err != nil {
+					return keys, errors.Trace(err)
+				}
+			}
+			for _, category := range categories {
+				keys = append(keys, cache.Key(name, category))
+			}
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
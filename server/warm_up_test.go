@@ -0,0 +1,113 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+type slowCache struct {
+	cache.Database
+	delay time.Duration
+}
+
+func (c *slowCache) GetSorted(key string, begin, end int) ([]cache.Scored, error) {
+	time.Sleep(c.delay)
+	return c.Database.GetSorted(key, begin, end)
+}
+
+func TestServer_PushActiveUsers(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.WarmUp.ActiveUsers = 2
+	assert.NoError(t, s.pushActiveUsers([]string{"0"}))
+	assert.NoError(t, s.pushActiveUsers([]string{"1"}))
+	assert.NoError(t, s.pushActiveUsers([]string{"2"}))
+	users, err := s.CacheClient.GetSorted(cache.ActiveUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "1"}, cache.RemoveScores(users))
+}
+
+func TestServer_WarmUp(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.LocalCacheSize = 100
+	s.Config.Server.LocalCacheTTL = time.Hour
+	s.Config.Server.WarmUp.Keys = []string{cache.PopularItems, cache.Key(cache.LatestItems, "*")}
+	s.Config.Server.WarmUp.ActiveUsers = 10
+	assert.NoError(t, s.CacheClient.AddSet(cache.ItemCategories, "a", "b"))
+	assert.NoError(t, s.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{Id: "1", Score: 1}}))
+	assert.NoError(t, s.CacheClient.SetSorted(cache.Key(cache.LatestItems, "a"), []cache.Scored{{Id: "2", Score: 1}}))
+	assert.NoError(t, s.insertFeedbackToStores([]data.Feedback{{FeedbackKey: data.FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "1"}}}, false))
+	localCache := cache.NewLocalCache(s.CacheClient, s.Config.Server.LocalCacheSize, s.Config.Server.LocalCacheTTL, nil)
+	var misses int
+	localCache.OnMiss = func() { misses++ }
+	s.CacheClient = localCache
+
+	// the server isn't ready before warm-up
+	s.warmingUp = 1
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/health/ready").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusServiceUnavailable).
+		Body(`{"Ready":false}`).
+		End()
+	s.WarmUp()
+	apitest.New().
+		Handler(s.handler).
+		Get("/api/health/ready").
+		Header("X-API-Key", apiKey).
+		Expect(t).
+		Status(http.StatusOK).
+		Body(`{"Ready":true}`).
+		End()
+
+	// warmed keys are served by the local cache
+	misses = 0
+	_, err := s.CacheClient.GetSorted(cache.PopularItems, 0, s.Config.Recommend.CacheSize)
+	assert.NoError(t, err)
+	_, err = s.CacheClient.GetSorted(cache.Key(cache.LatestItems, "a"), 0, s.Config.Recommend.CacheSize)
+	assert.NoError(t, err)
+	_, err = s.CacheClient.GetSorted(cache.Key(cache.LatestItems, "b"), 0, s.Config.Recommend.CacheSize)
+	assert.NoError(t, err)
+	_, err = s.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0"), 0, s.Config.Recommend.CacheSize)
+	assert.NoError(t, err)
+	assert.Zero(t, misses)
+}
+
+func TestServer_WarmUpDeadline(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	s.Config.Server.LocalCacheSize = 100
+	s.Config.Server.WarmUp.Keys = []string{cache.PopularItems, cache.LatestItems}
+	s.Config.Server.WarmUp.Timeout = 10 * time.Millisecond
+	s.CacheClient = &slowCache{Database: s.CacheClient, delay: time.Second}
+
+	// the server is ready once the deadline exceeds
+	s.warmingUp = 1
+	start := time.Now()
+	s.WarmUp()
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, s.Ready())
+}
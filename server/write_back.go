@@ -0,0 +1,330 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+const writeBackQueueSize = 10000
+
+// WriteBackBuffer writes back feedback of recommended items in batches in the background, so that recommendation APIs
+// never wait for the data store. Feedback without delay is buffered in a bounded queue in memory and dropped if the
+// queue is full. Delayed feedback is buffered in the cache store and flushed once it is about to take effect, so that
+// it survives restarts. Delayed feedback is removed from the cache store after it is inserted, which is at least once
+// since inserting feedback twice is harmless: existed feedback is never overwritten. Delayed feedback is also indexed
+// by users, so that pending impressions are suppressed before they are inserted.
+type WriteBackBuffer struct {
+	server   *RestServer
+	queue    chan data.Feedback
+	writable chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+	// queued counts feedback in the queue or being written, Flush waits until it drops to zero
+	queued     int
+	queuedLock sync.Mutex
+	drained    *sync.Cond
+	test       bool
+}
+
+func NewWriteBackBuffer(s *RestServer) *WriteBackBuffer {
+	b := newWriteBackBuffer(s, writeBackQueueSize)
+	if s.ReadOnlyManager != nil {
+		s.ReadOnlyManager.OnWritable(func() {
+			select {
+			case b.writable <- struct{}{}:
+			default:
+			}
+		})
+	}
+	b.workers.Add(2)
+	go b.run()
+	go b.runDelayed()
+	return b
+}
+
+func newWriteBackBuffer(s *RestServer, queueSize int) *WriteBackBuffer {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &WriteBackBuffer{
+		server:   s,
+		queue:    make(chan data.Feedback, queueSize),
+		writable: make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	b.drained = sync.NewCond(&b.queuedLock)
+	return b
+}
+
+func newWriteBackBufferForTest(s *RestServer) *WriteBackBuffer {
+	b := newWriteBackBuffer(s, 0)
+	b.test = true
+	return b
+}
+
+// Add buffers feedback written back by a recommendation API. Feedback is written in place in tests. An error is
+// returned if any feedback is dropped.
+func (b *WriteBackBuffer) Add(feedback []data.Feedback, delay time.Duration) error {
+	if len(feedback) == 0 {
+		return nil
+	}
+	WriteBackBufferedTotal.Add(float64(len(feedback)))
+	if b.test {
+		return b.writeOrDrop(feedback)
+	}
+	if delay > 0 {
+		return b.addDelayed(feedback)
+	}
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	for i, f := range feedback {
+		select {
+		case b.queue <- f:
+			b.queued++
+		default:
+			WriteBackDroppedTotal.Add(float64(len(feedback) - i))
+			return errors.Errorf("write back queue is full, %d feedback dropped", len(feedback)-i)
+		}
+	}
+	return nil
+}
+
+// addDelayed buffers delayed feedback in the cache store. Feedback is added to the sorted set of all delayed feedback
+// and the sorted set of the user.
+func (b *WriteBackBuffer) addDelayed(feedback []data.Feedback) error {
+	members := make([]cache.Scored, len(feedback))
+	userMembers := make(map[string][]cache.Scored)
+	for i, f := range feedback {
+		member, err := json.Marshal(f)
+		if err != nil {
+			WriteBackDroppedTotal.Add(float64(len(feedback)))
+			return errors.Trace(err)
+		}
+		members[i] = cache.Scored{Id: string(member), Score: float64(f.Timestamp.Unix())}
+		userMembers[f.UserId] = append(userMembers[f.UserId], members[i])
+	}
+	sortedSets := []cache.SortedSet{cache.Sorted(cache.WriteBackFeedback, members)}
+	for userId, scores := range userMembers {
+		sortedSets = append(sortedSets, cache.Sorted(cache.Key(cache.WriteBackFeedback, userId), scores))
+	}
+	if err := b.server.CacheClient.AddSorted(sortedSets...); err != nil {
+		WriteBackDroppedTotal.Add(float64(len(feedback)))
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// PendingFeedback returns delayed feedback of a user buffered in the cache store, which hasn't been inserted into the
+// data store. Only feedback of given types is returned if types are given.
+func (b *WriteBackBuffer) PendingFeedback(userId string, feedbackTypes ...string) ([]data.Feedback, error) {
+	members, err := b.server.CacheClient.GetSorted(cache.Key(cache.WriteBackFeedback, userId), 0, -1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	feedback := make([]data.Feedback, 0, len(members))
+	for _, member := range members {
+		var f data.Feedback
+		if err = json.Unmarshal([]byte(member.Id), &f); err != nil {
+			log.Logger().Warn("skip invalid write back feedback", zap.String("member", member.Id), zap.Error(err))
+			continue
+		}
+		if len(feedbackTypes) == 0 || lo.Contains(feedbackTypes, f.FeedbackType) {
+			feedback = append(feedback, f)
+		}
+	}
+	return feedback, nil
+}
+
+// Flush waits until feedback queued in memory is written. Delayed feedback is left in the cache store.
+func (b *WriteBackBuffer) Flush() {
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	for b.queued > 0 && b.ctx.Err() == nil {
+		b.drained.Wait()
+	}
+}
+
+// Close writes feedback queued in memory and stops background goroutines, which is called on shutdown. Delayed
+// feedback is left in the cache store.
+func (b *WriteBackBuffer) Close() {
+	b.cancel()
+	// wake up Flush
+	b.queuedLock.Lock()
+	b.drained.Broadcast()
+	b.queuedLock.Unlock()
+	b.workers.Wait()
+}
+
+// done marks queued feedback as written or dropped.
+func (b *WriteBackBuffer) done(n int) {
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	b.queued -= n
+	if b.queued <= 0 {
+		b.drained.Broadcast()
+	}
+}
+
+// run writes queued feedback in batches until the buffer is closed. Feedback left in the queue is written once the
+// buffer is closed, unless writes are disabled.
+func (b *WriteBackBuffer) run() {
+	defer b.workers.Done()
+	for {
+		select {
+		case f := <-b.queue:
+			batch := b.drain([]data.Feedback{f})
+			if b.waitWritable() {
+				_ = b.writeOrDrop(batch)
+			} else {
+				b.drop(batch)
+			}
+			b.done(len(batch))
+		case <-b.ctx.Done():
+			for batch := b.drain(nil); len(batch) > 0; batch = b.drain(nil) {
+				if b.server.ReadOnlyState().ReadOnly {
+					b.drop(batch)
+				} else {
+					_ = b.writeOrDrop(batch)
+				}
+				b.done(len(batch))
+			}
+			return
+		}
+	}
+}
+
+// drop drops queued feedback since the buffer is closed while writes are disabled.
+func (b *WriteBackBuffer) drop(feedback []data.Feedback) {
+	WriteBackDroppedTotal.Add(float64(len(feedback)))
+	log.Logger().Warn("drop write back feedback since writes are disabled on shutdown", zap.Int("n", len(feedback)))
+}
+
+// drain appends queued feedback to a batch until the batch is full or the queue is empty.
+func (b *WriteBackBuffer) drain(batch []data.Feedback) []data.Feedback {
+	for len(batch) < b.server.Config.Server.WriteBack.BatchSize {
+		select {
+		case f := <-b.queue:
+			batch = append(batch, f)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// runDelayed flushes delayed feedback periodically until the buffer is closed. Feedback taking effect before the next
+// flush is flushed.
+func (b *WriteBackBuffer) runDelayed() {
+	defer b.workers.Done()
+	for {
+		interval := b.server.Config.Server.WriteBack.FlushInterval
+		select {
+		case <-time.After(interval):
+		case <-b.ctx.Done():
+			return
+		}
+		if !b.waitWritable() {
+			return
+		}
+		// the cache store might not be connected yet
+		if err := b.flushDelayed(time.Now().Add(interval)); err != nil && !errors.Is(err, errors.NotAssigned) {
+			log.Logger().Error("failed to flush delayed write back feedback", zap.Error(err))
+		}
+	}
+}
+
+// flushDelayed writes delayed feedback before the deadline in batches. Feedback is removed from the cache store once
+// it is written, and feedback failed to be written is retried by the next flush.
+func (b *WriteBackBuffer) flushDelayed(deadline time.Time) error {
+	members, err := b.server.CacheClient.GetSortedByScore(cache.WriteBackFeedback, math.Inf(-1), float64(deadline.Unix()))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, chunk := range lo.Chunk(members, b.server.Config.Server.WriteBack.BatchSize) {
+		feedback := make([]data.Feedback, 0, len(chunk))
+		removed := make([]cache.SetMember, 0, 2*len(chunk))
+		for _, member := range chunk {
+			removed = append(removed, cache.Member(cache.WriteBackFeedback, member.Id))
+			var f data.Feedback
+			if err = json.Unmarshal([]byte(member.Id), &f); err != nil {
+				WriteBackDroppedTotal.Inc()
+				log.Logger().Error("drop invalid write back feedback", zap.String("member", member.Id), zap.Error(err))
+				continue
+			}
+			feedback = append(feedback, f)
+			removed = append(removed, cache.Member(cache.Key(cache.WriteBackFeedback, f.UserId), member.Id))
+		}
+		if len(feedback) > 0 {
+			if err = b.write(feedback); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if err = b.server.CacheClient.RemSorted(removed...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// waitWritable blocks until writes are enabled or the buffer is closed, and returns false if the buffer is closed. The
+// read-only state is checked periodically in case the callback is missed.
+func (b *WriteBackBuffer) waitWritable() bool {
+	for b.server.ReadOnlyState().ReadOnly {
+		select {
+		case <-b.writable:
+		case <-time.After(b.server.Config.Server.WriteBack.PollInterval):
+		case <-b.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// writeOrDrop writes feedback, which is dropped if it fails to be written.
+func (b *WriteBackBuffer) writeOrDrop(feedback []data.Feedback) error {
+	if len(feedback) == 0 {
+		return nil
+	}
+	if err := b.write(feedback); err != nil {
+		WriteBackDroppedTotal.Add(float64(len(feedback)))
+		log.Logger().Error("failed to write back feedback", zap.Int("n", len(feedback)), zap.Error(err))
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// write inserts feedback into the data store and the cache store.
+func (b *WriteBackBuffer) write(feedback []data.Feedback) error {
+	if err := b.server.DataClient.BatchInsertFeedback(feedback, false, false, false); err != nil {
+		return errors.Trace(err)
+	}
+	if err := b.server.InsertFeedbackToCache(feedback); err != nil {
+		return errors.Trace(err)
+	}
+	WriteBackFlushedTotal.Add(float64(len(feedback)))
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+// insertUsersAndItems inserts users and items, since feedback of unknown users or items isn't written back.
+func insertUsersAndItems(t *testing.T, s *mockServer) {
+	err := s.DataClient.BatchInsertUsers([]data.User{{UserId: "0"}, {UserId: "1"}})
+	assert.NoError(t, err)
+	err = s.DataClient.BatchInsertItems([]data.Item{{ItemId: "1"}, {ItemId: "2"}, {ItemId: "3"}})
+	assert.NoError(t, err)
+}
+
+func TestWriteBackBuffer_Flush(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	insertUsersAndItems(t, s)
+	s.Config.Server.WriteBack.BatchSize = 2
+	b := newWriteBackBuffer(&s.RestServer, 2)
+	timestamp := time.Now().Add(-time.Minute).Truncate(time.Second)
+	// feedback out of the queue is dropped
+	err := b.Add([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: timestamp},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: timestamp},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "3"}, Timestamp: timestamp},
+	}, 0)
+	assert.Error(t, err)
+	// feedback is buffered in memory
+	feedback, err := s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+	// flush waits until queued feedback is written
+	b.workers.Add(1)
+	go b.run()
+	b.Flush()
+	feedback, err = s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 2)
+	ignored, err := s.CacheClient.GetSorted(cache.Key(cache.IgnoreItems, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1", "2"}, cache.RemoveScores(ignored))
+	b.Close()
+}
+
+func TestWriteBackBuffer_Close(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	insertUsersAndItems(t, s)
+	s.Config.Server.WriteBack.FlushInterval = time.Hour
+	b := NewWriteBackBuffer(&s.RestServer)
+	err := b.Add([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: time.Now()},
+	}, 0)
+	assert.NoError(t, err)
+	// background goroutines stop after queued feedback is written
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("write back buffer isn't closed")
+	}
+	feedback, err := s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+}
+
+func TestWriteBackBuffer_CloseReadOnly(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	insertUsersAndItems(t, s)
+	s.Config.Server.WriteBack.PollInterval = time.Hour
+	s.Config.Server.ReadOnly = true
+	b := NewWriteBackBuffer(&s.RestServer)
+	err := b.Add([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: time.Now()},
+	}, 0)
+	assert.NoError(t, err)
+	// closing doesn't wait for writes to be enabled
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("write back buffer isn't closed")
+	}
+	feedback, err := s.DataClient.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+}
+
+func TestWriteBackBuffer_Delayed(t *testing.T) {
+	s := newMockServer(t)
+	defer s.Close(t)
+	insertUsersAndItems(t, s)
+	s.Config.Server.WriteBack.BatchSize = 2
+	b := newWriteBackBuffer(&s.RestServer, 2)
+	now := time.Now().Truncate(time.Second)
+	err := b.Add([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: now.Add(time.Minute)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: now.Add(time.Minute)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "3"}, Timestamp: now.Add(time.Minute)},
+	}, time.Minute)
+	assert.NoError(t, err)
+	err = b.Add([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "1", ItemId: "1"}, Timestamp: now.Add(time.Hour)},
+	}, time.Hour)
+	assert.NoError(t, err)
+	// delayed feedback is buffered in the cache store, which survives restarts
+	b.Flush()
+	members, err := s.CacheClient.GetSorted(cache.WriteBackFeedback, 0, -1)
+	assert.NoError(t, err)
+	assert.Len(t, members, 4)
+	// pending feedback is indexed by users
+	pending, err := b.PendingFeedback("0", "read")
+	assert.NoError(t, err)
+	assert.Len(t, pending, 3)
+	pending, err = b.PendingFeedback("0", "like")
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// feedback isn't flushed until it is about to take effect
+	err = b.flushDelayed(now)
+	assert.NoError(t, err)
+	feedback, err := s.DataClient.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+	err = b.flushDelayed(now.Add(time.Minute))
+	assert.NoError(t, err)
+	feedback, err = s.DataClient.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: now.Add(time.Minute).UTC()},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "2"}, Timestamp: now.Add(time.Minute).UTC()},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "3"}, Timestamp: now.Add(time.Minute).UTC()},
+	}, feedback)
+	members, err = s.CacheClient.GetSorted(cache.WriteBackFeedback, 0, -1)
+	assert.NoError(t, err)
+	assert.Len(t, members, 1)
+	pending, err = b.PendingFeedback("0")
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// feedback is kept if it fails to be written
+	s.dataStoreServer.SetError("data store is down")
+	err = b.flushDelayed(now.Add(time.Hour))
+	assert.Error(t, err)
+	s.dataStoreServer.SetError("")
+	members, err = s.CacheClient.GetSorted(cache.WriteBackFeedback, 0, -1)
+	assert.NoError(t, err)
+	assert.Len(t, members, 1)
+	err = b.flushDelayed(now.Add(time.Hour))
+	assert.NoError(t, err)
+	feedback, err = s.DataClient.GetUserFeedback("1", true)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+	members, err = s.CacheClient.GetSorted(cache.WriteBackFeedback, 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+}
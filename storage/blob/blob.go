@@ -0,0 +1,69 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	FilePrefix = "file://"
+	S3Prefix   = "s3://"
+	GCSPrefix  = "gs://"
+)
+
+// Store is a blob storage for large artifacts such as model checkpoints and snapshots. Blobs are named by slash
+// separated paths.
+type Store interface {
+	// Put writes a blob from a reader. The blob is visible once the reader is consumed successfully.
+	Put(name string, r io.Reader) error
+	// Get returns a reader of a blob. errors.NotFound is returned if the blob doesn't exist.
+	Get(name string) (io.ReadCloser, error)
+	// List returns names of blobs with a prefix in lexicographical order.
+	List(prefix string) ([]string, error)
+	// Delete removes a blob. It succeeds if the blob doesn't exist.
+	Delete(name string) error
+}
+
+// Open connects to a blob storage by a DSN:
+//   - Local paths, with or without the file:// prefix.
+//   - S3-compatible endpoints: s3://bucket/prefix?endpoint=http://127.0.0.1:9000&region=us-east-1&access_key_id=...&secret_access_key=...
+//     The endpoint is AWS S3 if it is empty, and credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+//     if they aren't in the DSN.
+//   - GCS with HMAC keys: gs://bucket/prefix?access_key_id=...&secret_access_key=...
+func Open(dsn string) (Store, error) {
+	if strings.HasPrefix(dsn, S3Prefix) || strings.HasPrefix(dsn, GCSPrefix) {
+		return OpenS3(dsn)
+	}
+	if dsn == "" {
+		return nil, errors.NotValidf("empty blob store")
+	}
+	return NewLocal(strings.TrimPrefix(dsn, FilePrefix)), nil
+}
+
+// Write writes a blob by a function writing to a stream.
+func Write(store Store, name string, write func(w io.Writer) error) error {
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(write(w))
+	}()
+	err := store.Put(name, r)
+	// unblock the writer if the blob store stops reading
+	_ = r.CloseWithError(io.ErrClosedPipe)
+	return errors.Trace(err)
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, store Store) {
+	// put and get blobs
+	err := store.Put("models/ranking", strings.NewReader("ranking"))
+	assert.NoError(t, err)
+	err = Write(store, "models/click", func(w io.Writer) error {
+		_, err := io.WriteString(w, "click")
+		return err
+	})
+	assert.NoError(t, err)
+	err = store.Put("snapshots/1/manifest.json", bytes.NewReader(nil))
+	assert.NoError(t, err)
+	r, err := store.Get("models/ranking")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "ranking", string(data))
+	r, err = store.Get("snapshots/1/manifest.json")
+	assert.NoError(t, err)
+	data, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Empty(t, data)
+	_, err = store.Get("models/missing")
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	// failed writes aren't visible
+	err = Write(store, "models/failed", func(w io.Writer) error {
+		_, _ = io.WriteString(w, "failed")
+		return errors.New("failed")
+	})
+	assert.Error(t, err)
+	_, err = store.Get("models/failed")
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	// list blobs
+	names, err := store.List("models/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"models/click", "models/ranking"}, names)
+	names, err = store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"models/click", "models/ranking", "snapshots/1/manifest.json"}, names)
+
+	// delete blobs
+	assert.NoError(t, store.Delete("models/ranking"))
+	assert.NoError(t, store.Delete("models/ranking"))
+	names, err = store.List("models/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"models/click"}, names)
+}
+
+func TestLocal(t *testing.T) {
+	store, err := Open(t.TempDir())
+	assert.NoError(t, err)
+	testStore(t, store)
+	// list an empty store
+	names, err := NewLocal(t.TempDir() + "/missing").List("")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// tempSuffix is the suffix of temporary files of blobs being written.
+const tempSuffix = ".tmp"
+
+// Local stores blobs as files under a root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal creates a blob store under a root directory.
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *Local) Put(name string, r io.Reader) error {
+	path := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return errors.Trace(err)
+	}
+	// write a temporary file and rename it to the blob
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return errors.Trace(err)
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(file.Name(), path))
+}
+
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	file, err := os.Open(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, errors.NotFoundf("blob %s", name)
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return file, nil
+}
+
+func (l *Local) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(l.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == l.root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || (strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), tempSuffix)) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (l *Local) Delete(name string) error {
+	if err := os.Remove(l.path(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// GCSEndpoint is the endpoint of the XML API of GCS, which is compatible with S3.
+	GCSEndpoint = "https://storage.googleapis.com"
+	// emptyPayloadHash is the SHA-256 of empty payloads.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3 stores blobs in a bucket of an S3-compatible object storage, such as AWS S3, MinIO and GCS with HMAC keys.
+// Requests are signed by AWS Signature Version 4.
+type S3 struct {
+	client          *http.Client
+	endpoint        *url.URL
+	virtualHost     bool // address buckets by host names instead of paths
+	bucket          string
+	prefix          string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+}
+
+// OpenS3 connects to an S3-compatible object storage by a DSN, which is s3://bucket/prefix or gs://bucket/prefix.
+func OpenS3(dsn string) (*S3, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if u.Host == "" {
+		return nil, errors.NotValidf("bucket of blob store %s", dsn)
+	}
+	query := u.Query()
+	param := func(key, env, defaultValue string) string {
+		if value := query.Get(key); value != "" {
+			return value
+		} else if value = os.Getenv(env); value != "" {
+			return value
+		}
+		return defaultValue
+	}
+	s := &S3{
+		client:          http.DefaultClient,
+		bucket:          u.Host,
+		prefix:          strings.Trim(u.Path, "/"),
+		region:          param("region", "AWS_REGION", "us-east-1"),
+		accessKeyId:     param("access_key_id", "AWS_ACCESS_KEY_ID", ""),
+		secretAccessKey: param("secret_access_key", "AWS_SECRET_ACCESS_KEY", ""),
+	}
+	endpoint := query.Get("endpoint")
+	if u.Scheme+"://" == GCSPrefix {
+		endpoint, s.region = GCSEndpoint, param("region", "", "auto")
+	} else if endpoint == "" {
+		// buckets of AWS S3 are addressed by host names
+		endpoint, s.virtualHost = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region), true
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s.accessKeyId == "" || s.secretAccessKey == "" {
+		return nil, errors.NotValidf("credentials of blob store %s", u.Scheme+"://"+u.Host+u.Path)
+	}
+	return s, nil
+}
+
+// key returns the object key of a blob.
+func (s *S3) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *S3) Put(name string, r io.Reader) error {
+	// objects are uploaded with lengths and hashes, so that the blob is spooled to a temporary file
+	file, err := os.CreateTemp("", "gorse-blob-*")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, digest), r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return errors.Trace(err)
+	}
+	var body io.ReadCloser
+	if size > 0 {
+		// requests with empty bodies would be chunked
+		body = io.NopCloser(file)
+	}
+	response, err := s.do(http.MethodPut, s.key(name), nil, body, size, hex.EncodeToString(digest.Sum(nil)))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return response.Body.Close()
+}
+
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	response, err := s.do(http.MethodGet, s.key(name), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return response.Body, nil
+}
+
+func (s *S3) Delete(name string) error {
+	response, err := s.do(http.MethodDelete, s.key(name), nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return response.Body.Close()
+}
+
+func (s *S3) List(prefix string) ([]string, error) {
+	var (
+		names []string
+		token string
+	)
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		response, err := s.do(http.MethodGet, "", query, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		_ = response.Body.Close()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, content := range result.Contents {
+			names = append(names, strings.TrimPrefix(content.Key, s.key("")))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// do sends a signed request on an object, or the bucket if the key is empty. Responses with error status codes are
+// returned as errors, and errors.NotFound is returned if the object doesn't exist.
+func (s *S3) do(method, key string, query url.Values, body io.ReadCloser, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	path := "/"
+	if s.virtualHost {
+		u.Host = s.bucket + "." + u.Host
+	} else {
+		path += s.bucket + "/"
+	}
+	path = strings.TrimSuffix(s.endpoint.Path, "/") + path + key
+	u.RawPath = uriEncode(path, false)
+	u.Path = path
+	u.RawQuery = canonicalQuery(query)
+	request, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	request.ContentLength = size
+	s.sign(request, u.RawPath, payloadHash, time.Now())
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if response.StatusCode >= http.StatusMultipleChoices {
+		defer response.Body.Close()
+		var result struct {
+			Code    string
+			Message string
+		}
+		_ = xml.NewDecoder(response.Body).Decode(&result)
+		if response.StatusCode == http.StatusNotFound && result.Code != "NoSuchBucket" {
+			return nil, errors.NotFoundf("blob %s", key)
+		}
+		return nil, errors.Errorf("%s %s: %s %s %s", method, key, response.Status, result.Code, result.Message)
+	}
+	return response, nil
+}
+
+// sign signs a request by AWS Signature Version 4.
+func (s *S3) sign(request *http.Request, canonicalURI, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalURI,
+		request.URL.RawQuery,
+		"host:" + request.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, s.region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexHash(sha256.New(), canonicalRequest)}, "\n")
+	key := []byte("AWS4" + s.secretAccessKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSum(key, part)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyId, scope, signedHeaders, hex.EncodeToString(hmacSum(key, stringToSign))))
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexHash(h hash.Hash, data string) string {
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalQuery encodes a query with sorted keys as required by AWS Signature Version 4.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes all characters except unreserved characters as required by AWS Signature Version 4. Slashes are
+// kept in paths.
+func uriEncode(s string, encodeSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			builder.WriteByte(b)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without accessing the cache store while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker of cache store is open")
+
+// CircuitBreaker stops accessing a failing cache store. The circuit opens after threshold consecutive failures, and
+// requests fail with ErrCircuitOpen immediately. After each retry interval, a single request is let through to probe the
+// cache store, and the circuit closes once a request succeeds. Missing documents aren't failures.
+type CircuitBreaker struct {
+	Database
+	threshold     int
+	retryInterval time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+
+	// OnStateChange is called when the circuit opens or closes if it is not nil.
+	OnStateChange func(open bool)
+
+	// parent is the circuit breaker sharing the state of the circuit, and requests cancelled by ctx aren't failures.
+	parent *CircuitBreaker
+	ctx    context.Context
+}
+
+// NewCircuitBreaker creates a circuit breaker of a database.
+func NewCircuitBreaker(db Database, threshold int, retryInterval time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Database:      db,
+		threshold:     threshold,
+		retryInterval: retryInterval,
+	}
+}
+
+// WithContext returns a circuit breaker sharing the state of the circuit, whose requests are cancelled once the context
+// is done. Cancelled requests aren't counted as failures.
+func (b *CircuitBreaker) WithContext(ctx context.Context) Database {
+	return &CircuitBreaker{Database: WithContext(ctx, b.Database), parent: b.root(), ctx: ctx}
+}
+
+func (b *CircuitBreaker) root() *CircuitBreaker {
+	if b.parent != nil {
+		return b.parent
+	}
+	return b
+}
+
+// Failing returns true if the last request to the cache store failed.
+func (b *CircuitBreaker) Failing() bool {
+	b = b.root()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures > 0
+}
+
+// IsOpen returns true if the circuit is open.
+func (b *CircuitBreaker) IsOpen() bool {
+	b = b.root()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
+
+// allow returns ErrCircuitOpen if the circuit is open and it isn't the time to probe the cache store.
+func (b *CircuitBreaker) allow() error {
+	b = b.root()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	// let a single request probe the cache store
+	b.openUntil = now.Add(b.retryInterval)
+	return nil
+}
+
+// record counts consecutive failures and switches the state of the circuit.
+func (b *CircuitBreaker) record(err error) {
+	if errors.Is(err, ErrCircuitOpen) || b.ctx != nil && b.ctx.Err() != nil {
+		return
+	}
+	b = b.root()
+	b.mu.Lock()
+	var changed, open bool
+	if err == nil || errors.Is(err, errors.NotFound) {
+		changed = b.failures >= b.threshold
+		b.failures = 0
+	} else {
+		b.failures++
+		if b.failures == b.threshold {
+			changed, open = true, true
+			b.openUntil = time.Now().Add(b.retryInterval)
+		}
+	}
+	b.mu.Unlock()
+	if changed && b.OnStateChange != nil {
+		b.OnStateChange(open)
+	}
+}
+
+func (b *CircuitBreaker) Scan(work func(string) error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.Scan(work)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) Set(values ...Value) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.Set(values...)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) Get(name string) *ReturnValue {
+	if err := b.allow(); err != nil {
+		return &ReturnValue{err: err}
+	}
+	value := b.Database.Get(name)
+	b.record(value.err)
+	return value
+}
+
+func (b *CircuitBreaker) Delete(name string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.Delete(name)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) GetSet(key string) ([]string, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	members, err := b.Database.GetSet(key)
+	b.record(err)
+	return members, err
+}
+
+func (b *CircuitBreaker) SetSet(key string, members ...string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.SetSet(key, members...)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) AddSet(key string, members ...string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.AddSet(key, members...)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) RemSet(key string, members ...string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.RemSet(key, members...)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) AddSorted(sortedSets ...SortedSet) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.AddSorted(sortedSets...)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) GetSorted(key string, begin, end int) ([]Scored, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	scores, err := b.Database.GetSorted(key, begin, end)
+	b.record(err)
+	return scores, err
+}
+
+func (b *CircuitBreaker) GetSortedByScore(key string, begin, end float64) ([]Scored, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	scores, err := b.Database.GetSortedByScore(key, begin, end)
+	b.record(err)
+	return scores, err
+}
+
+func (b *CircuitBreaker) RemSortedByScore(key string, begin, end float64) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.RemSortedByScore(key, begin, end)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) SetSorted(key string, scores []Scored) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.SetSorted(key, scores)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) RemSorted(members ...SetMember) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.RemSorted(members...)
+	b.record(err)
+	return err
+}
+
+func (b *CircuitBreaker) ReadDocuments(reads ...Read) ([]Document, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	documents, err := b.Database.ReadDocuments(reads...)
+	b.record(err)
+	return documents, err
+}
+
+func (b *CircuitBreaker) WriteDocuments(writes ...Write) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.Database.WriteDocuments(writes...)
+	b.record(err)
+	return err
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// downDatabase fails all requests while it is down.
+type downDatabase struct {
+	Database
+	down  bool
+	calls int
+}
+
+func (d *downDatabase) Get(name string) *ReturnValue {
+	d.calls++
+	if d.down {
+		return &ReturnValue{err: errors.New("connection refused")}
+	}
+	return d.Database.Get(name)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	err := db.Set(String("key", "value"))
+	assert.NoError(t, err)
+	down := &downDatabase{Database: db.Database}
+	breaker := NewCircuitBreaker(down, 2, 50*time.Millisecond)
+	var states []bool
+	breaker.OnStateChange = func(open bool) {
+		states = append(states, open)
+	}
+
+	// missing documents aren't failures
+	_, err = breaker.Get("missing").String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+	assert.False(t, breaker.Failing())
+
+	// the circuit opens after consecutive failures
+	down.down = true
+	_, err = breaker.Get("key").String()
+	assert.Error(t, err)
+	assert.True(t, breaker.Failing())
+	assert.False(t, breaker.IsOpen())
+	_, err = breaker.Get("key").String()
+	assert.Error(t, err)
+	assert.True(t, breaker.IsOpen())
+	assert.Equal(t, 3, down.calls)
+	// requests fail immediately while the circuit is open
+	_, err = breaker.Get("key").String()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 3, down.calls)
+
+	// a failed probe keeps the circuit open
+	time.Sleep(60 * time.Millisecond)
+	_, err = breaker.Get("key").String()
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 4, down.calls)
+	_, err = breaker.Get("key").String()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+
+	// the circuit closes once the cache store returns
+	down.down = false
+	time.Sleep(60 * time.Millisecond)
+	value, err := breaker.Get("key").String()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.False(t, breaker.IsOpen())
+	assert.False(t, breaker.Failing())
+	assert.Equal(t, []bool{true, false}, states)
+}
+
+func TestCircuitBreaker_WithContext(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	down := &downDatabase{Database: db.Database, down: true}
+	breaker := NewCircuitBreaker(down, 2, time.Minute)
+
+	// failures of cancelled requests aren't counted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := WithContext(ctx, breaker).Get("key").String()
+	assert.Error(t, err)
+	assert.False(t, breaker.Failing())
+
+	// requests bound to a context share the state of the circuit
+	bound := WithContext(context.Background(), breaker)
+	_, err = bound.Get("key").String()
+	assert.Error(t, err)
+	assert.True(t, breaker.Failing())
+	_, err = breaker.Get("key").String()
+	assert.Error(t, err)
+	assert.True(t, breaker.IsOpen())
+	_, err = bound.Get("key").String()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 	"github.com/araddon/dateparse"
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/dzwvip/oracle"
 	"github.com/go-redis/redis/v8"
 	"github.com/juju/errors"
@@ -27,6 +28,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"go.uber.org/atomic"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
@@ -53,11 +55,23 @@ const (
 	//  Category hidden items   - hidden_items_v2/{category}
 	HiddenItemsV2 = "hidden_items_v2"
 
+	// ItemVisibleFrom is sorted set of items with the start time of their visibility windows as scores.
+	//  Items visible from - item_visible_from
+	ItemVisibleFrom = "item_visible_from"
+
+	// ItemVisibleUntil is sorted set of items with the end time of their visibility windows as scores.
+	//  Items visible until - item_visible_until
+	ItemVisibleUntil = "item_visible_until"
+
 	// ItemNeighbors is sorted set of neighbors for each item.
 	//  Global item neighbors      - item_neighbors/{item_id}
 	//  Categorized item neighbors - item_neighbors/{item_id}/{category}
 	ItemNeighbors = "item_neighbors"
 
+	// ItemNeighborCategories is set of categories with cached neighbors for each item.
+	//  Item neighbor categories - item_neighbor_categories/{item_id}
+	ItemNeighborCategories = "item_neighbor_categories"
+
 	// ItemNeighborsDigest is digest of item neighbors configuration
 	//	Item neighbors digest      - item_neighbors_digest/{item_id}
 	ItemNeighborsDigest = "item_neighbors_digest"
@@ -84,6 +98,34 @@ const (
 	//	Recommendation digest      - offline_recommend_digest/{user_id}
 	OfflineRecommendDigest = "offline_recommend_digest"
 
+	// OfflineRecommendModel is versions of models generating offline recommendation.
+	//  Recommendation models - offline_recommend_model/{user_id}
+	OfflineRecommendModel = "offline_recommend_model"
+
+	// OfflineRecommendSkips is the number of consecutive cycles skipping offline recommendation of an unchanged user.
+	//  Skipped cycles - offline_recommend_skips/{user_id}
+	OfflineRecommendSkips = "offline_recommend_skips"
+
+	// RankingGeneration is the version of the ranking model generating offline recommendation, in hexadecimal.
+	//	Recommendation generation  - ranking_generation/{user_id}
+	RankingGeneration = "ranking_generation"
+
+	// SessionRecommend is sorted set of merged neighbors of seed items in session recommendation.
+	//  Session recommendation - session_recommend/{signature}
+	SessionRecommend = "session_recommend"
+
+	// SessionRecommendTime is the timestamp that neighbors of seed items in session recommendation were merged.
+	//  Session recommendation time - session_recommend_time/{signature}
+	SessionRecommendTime = "session_recommend_time"
+
+	// SessionFeedback is sorted set of feedback appended to a session, with the append time in microseconds as scores.
+	//  Session feedback - session_feedback/{session_id}
+	SessionFeedback = "session_feedback"
+
+	// SessionActiveTime is the timestamp that a session was last active.
+	//  Session active time - session_active_time/{session_id}
+	SessionActiveTime = "session_active_time"
+
 	// PopularItems is sorted set of popular items. The format of key:
 	//  Global popular items      - latest_items
 	//  Categorized popular items - latest_items/{category}
@@ -94,10 +136,133 @@ const (
 	//  Categorized the latest items - latest_items/{category}
 	LatestItems = "latest_items"
 
+	// TrendingItems is sorted set of trending items. The format of key:
+	//  Global trending items      - trending_items
+	//  Categorized trending items - trending_items/{category}
+	TrendingItems = "trending_items"
+
+	// CovisitedItems is sorted set of items co-visited with an item, with numbers of users as scores. The format of key:
+	//  Co-visited items - covisited_items/{item_id}
+	CovisitedItems = "covisited_items"
+
+	// LabelRewrite is the progress record of the latest label rewrite in JSON. The format of key:
+	//  Label rewrite - label_rewrite
+	LabelRewrite = "label_rewrite"
+
+	// LabelPopularItems is sorted set of popular items for each item label. The format of key:
+	//  Popular items with label - label_popular_items/{label}
+	LabelPopularItems = "label_popular_items"
+
+	// SubscriptionItems is sorted set of recent and popular items for each subscription topic. The format of key:
+	//  Subscription items - subscription_items/{topic}
+	SubscriptionItems = "subscription_items"
+
+	// SubscriptionTopics is the set of subscription topics with items. The format of key:
+	//  Subscription topics - subscription_topics
+	SubscriptionTopics = "subscription_topics"
+
+	// WriteBackFeedback is sorted set of delayed feedback written back by recommendation APIs, scored by timestamps of
+	// feedback. Delayed feedback is also indexed by users. The format of key:
+	//  Delayed write back feedback - write_back_feedback
+	//  Delayed write back feedback of a user - write_back_feedback/{user_id}
+	WriteBackFeedback = "write_back_feedback"
+
+	// ItemLabels is the set of item labels with popular items. The format of key:
+	//  Item labels - item_labels
+	ItemLabels = "item_labels"
+
 	// ItemCategories is the set of item categories. The format of key:
 	//	Global item categories - item_categories
 	ItemCategories = "item_categories"
 
+	// RankingEvaluations is sorted set of offline evaluation reports of the collaborative filtering model in JSON with
+	// timestamps of training runs as scores. The format of key:
+	//  Evaluation reports - ranking_evaluations
+	RankingEvaluations = "ranking_evaluations"
+
+	// WebhookDeliveries is sorted set of webhook delivery attempts in JSON with timestamps of attempts as scores. The
+	// format of key:
+	//  Webhook deliveries - webhook_deliveries
+	WebhookDeliveries = "webhook_deliveries"
+
+	// Alerts is the state of active and recently resolved alerts in JSON. The format of key:
+	//  Alerts - alerts
+	Alerts = "alerts"
+
+	// ReadOnly is the read-only state of the cluster turned on by the admin API in JSON. The format of key:
+	//  Read-only state - read_only
+	ReadOnly = "read_only"
+
+	// WorkerCheckpoint is the latest timestamp that a worker stopped cleanly with no recommendation partially written.
+	// The format of key:
+	//  Worker checkpoint - worker_checkpoint/{worker_name}
+	WorkerCheckpoint = "worker_checkpoint"
+
+	// PriorityRefreshUsers is the queue of users with new feedback, scored by the time they were pushed. The format of key:
+	//  Priority refresh users - priority_refresh_users
+	PriorityRefreshUsers = "priority_refresh_users"
+
+	// OfflineRecommendCheckpoint is the progress of the in-progress offline recommendation cycle of a worker in JSON.
+	// The format of key:
+	//  Offline recommendation checkpoint - offline_recommend_checkpoint/{worker_name}
+	OfflineRecommendCheckpoint = "offline_recommend_checkpoint"
+
+	// BlendWeights is weights of score blending in JSON, which override weights in the configuration. The format of key:
+	//  Blend weights - blend_weights
+	BlendWeights = "blend_weights"
+
+	// DedupBreaks is the set of items excluded from duplicate detection since their clusters were broken by users. The
+	// format of key:
+	//  Dedup breaks - dedup_breaks
+	DedupBreaks = "dedup_breaks"
+
+	// RecommendSnapshot is recommendation of a user frozen for paging by tokens in JSON. The format of key:
+	//  Recommendation snapshot - recommend_snapshot/{snapshot_id}
+	RecommendSnapshot = "recommend_snapshot"
+
+	// ActiveUsersSketch and ActiveItemsSketch are HyperLogLog sketches of users giving feedback and items receiving
+	// feedback in base64. Daily sketches are merged into sketches of sliding windows. The format of key:
+	//  Daily sketch  - active_users_sketch/{yyyy-mm-dd}
+	//  Window sketch - active_users_sketch/{weekly|monthly}
+	ActiveUsersSketch = "active_users_sketch"
+	ActiveItemsSketch = "active_items_sketch"
+	WeeklySketch      = "weekly"
+	MonthlySketch     = "monthly"
+
+	// UsageCounters is the sorted set of cumulative counters of requests and ingested rows of a node in a day, where
+	// members are metrics and scores are counters. UsageNodes is the set of nodes having counters in a day. Counters
+	// are removed once they are collected into the data store. The format of key:
+	//  Usage counters - usage_counters/{yyyy-mm-dd}/{node}
+	//  Usage nodes    - usage_nodes/{yyyy-mm-dd}
+	UsageCounters = "usage_counters"
+	UsageNodes    = "usage_nodes"
+
+	// ShadowTrafficLog is the sorted set of differences between responses of this cluster and a secondary cluster in
+	// JSON with timestamps of requests as scores. The format of key:
+	//  Shadow traffic log - shadow_traffic_log
+	ShadowTrafficLog = "shadow_traffic_log"
+
+	// ItemEnrichment is the sorted set of items created automatically by feedback in each enrichment status, scored by
+	// the time the status was updated. The format of key:
+	//  Item enrichment - item_enrichment/{pending|enriched|failed}
+	ItemEnrichment = "item_enrichment"
+
+	// ActiveUsers is the sorted set of users with new feedback, scored by the time they were active. The format of key:
+	//  Active users - active_users
+	ActiveUsers = "active_users"
+
+	// ConsumedFilter is the Bloom filter of items consumed by each user in base64. The format of key:
+	//  Consumed filter - consumed_filter/{user_id}
+	ConsumedFilter = "consumed_filter"
+
+	// BusinessRules is the set of business rule ids. The format of key:
+	//  Business rules - business_rules
+	BusinessRules = "business_rules"
+
+	// BusinessRule is the definition of a business rule in JSON. The format of key:
+	//  Business rule - business_rule/{rule_id}
+	BusinessRule = "business_rule"
+
 	LastModifyItemTime          = "last_modify_item_time"           // the latest timestamp that a user related data was modified
 	LastModifyUserTime          = "last_modify_user_time"           // the latest timestamp that an item related data was modified
 	LastUpdateUserRecommendTime = "last_update_user_recommend_time" // the latest timestamp that a user's recommendation was updated
@@ -105,22 +270,31 @@ const (
 	LastUpdateItemNeighborsTime = "last_update_item_neighbors_time" // the latest timestamp that an item's neighbors was updated
 
 	// GlobalMeta is global meta information
-	GlobalMeta                 = "global_meta"
-	DataImported               = "data_imported"
-	NumUsers                   = "num_users"
-	NumItems                   = "num_items"
-	NumUserLabels              = "num_user_labels"
-	NumItemLabels              = "num_item_labels"
-	NumTotalPosFeedbacks       = "num_total_pos_feedbacks"
-	NumValidPosFeedbacks       = "num_valid_pos_feedbacks"
-	NumValidNegFeedbacks       = "num_valid_neg_feedbacks"
-	LastFitMatchingModelTime   = "last_fit_matching_model_time"
-	LastFitRankingModelTime    = "last_fit_ranking_model_time"
-	LastUpdateLatestItemsTime  = "last_update_latest_items_time"  // the latest timestamp that latest items were updated
-	LastUpdatePopularItemsTime = "last_update_popular_items_time" // the latest timestamp that popular items were updated
-	UserNeighborIndexRecall    = "user_neighbor_index_recall"
-	ItemNeighborIndexRecall    = "item_neighbor_index_recall"
-	MatchingIndexRecall        = "matching_index_recall"
+	GlobalMeta                      = "global_meta"
+	DataImported                    = "data_imported"
+	NumUsers                        = "num_users"
+	NumItems                        = "num_items"
+	NumUserLabels                   = "num_user_labels"
+	NumItemLabels                   = "num_item_labels"
+	NumTotalPosFeedbacks            = "num_total_pos_feedbacks"
+	NumValidPosFeedbacks            = "num_valid_pos_feedbacks"
+	NumValidNegFeedbacks            = "num_valid_neg_feedbacks"
+	LastFitMatchingModelTime        = "last_fit_matching_model_time"
+	LastFitRankingModelTime         = "last_fit_ranking_model_time"
+	LastUpdateLatestItemsTime       = "last_update_latest_items_time"       // the latest timestamp that latest items were updated
+	LastUpdatePopularItemsTime      = "last_update_popular_items_time"      // the latest timestamp that popular items were updated
+	LastUpdateTrendingItemsTime     = "last_update_trending_items_time"     // the latest timestamp that trending items were updated
+	LastUpdateCovisitedItemsTime    = "last_update_covisited_items_time"    // the latest timestamp that co-visited items were updated
+	LastLoadDatasetTime             = "last_load_dataset_time"              // the latest timestamp that the training dataset was loaded
+	LastRequestOfflineRecommendTime = "last_request_offline_recommend_time" // the latest timestamp that offline recommendation was requested
+	LastInsertFeedbackTime          = "last_insert_feedback_time"           // the latest timestamp that feedback was ingested
+	OfflineRecommendPrefix          = "offline_recommend_prefix"            // the prefix of offline recommendation served to users
+	UserNeighborIndexRecall         = "user_neighbor_index_recall"
+	ItemNeighborIndexRecall         = "item_neighbor_index_recall"
+	ItemNeighborSimilarity          = "item_neighbor_similarity"
+	MatchingIndexRecall             = "matching_index_recall"
+	RankingCanaryVersion            = "ranking_canary_version" // the version of the ranking model serving canary users
+	SnapshotPauseUntil              = "snapshot_pause_until"   // cache writes of workers are paused until the timestamp while exporting a snapshot
 )
 
 var (
@@ -165,7 +339,8 @@ func GetScores(s []Scored) []float64 {
 	return scores
 }
 
-// SortScores sorts scores from high score to low score.
+// SortScores sorts scores from high score to low score. Ties are broken by ids in ascending order, which is the same
+// order as heap.TopKFilter.
 func SortScores(scores []Scored) {
 	sort.Sort(scoresSorter(scores))
 }
@@ -179,7 +354,10 @@ func (s scoresSorter) Len() int {
 
 // Less reports whether the element with index i
 func (s scoresSorter) Less(i, j int) bool {
-	return s[i].Score > s[j].Score
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	return s[i].Id < s[j].Id
 }
 
 // Swap swaps the elements with indexes i and j.
@@ -268,6 +446,112 @@ func Member(name, member string) SetMember {
 	return SetMember{name: name, member: member}
 }
 
+type readKind int
+
+const (
+	readValue readKind = iota
+	readSorted
+	readSortedByScore
+)
+
+// Read is a read of a value or a sorted set in ReadDocuments.
+type Read struct {
+	kind     readKind
+	name     string
+	begin    int
+	end      int
+	minScore float64
+	maxScore float64
+}
+
+// ReadValue reads a value like Get.
+func ReadValue(name string) Read {
+	return Read{kind: readValue, name: name}
+}
+
+// ReadSorted reads scores in a sorted set like GetSorted.
+func ReadSorted(name string, begin, end int) Read {
+	return Read{kind: readSorted, name: name, begin: begin, end: end}
+}
+
+// ReadSortedByScore reads scores in a sorted set like GetSortedByScore.
+func ReadSortedByScore(name string, begin, end float64) Read {
+	return Read{kind: readSortedByScore, name: name, minScore: begin, maxScore: end}
+}
+
+// Document is the result of a Read. Value is set for ReadValue and Scores is set for others.
+type Document struct {
+	Value  *ReturnValue
+	Scores []Scored
+}
+
+// Write is a write of a value or a sorted set in WriteDocuments.
+type Write struct {
+	value  *Value
+	sorted *SortedSet
+}
+
+// WriteValue writes a value like Set.
+func WriteValue(value Value) Write {
+	return Write{value: &value}
+}
+
+// WriteSorted replaces scores in a sorted set like SetSorted.
+func WriteSorted(name string, scores []Scored) Write {
+	sorted := Sorted(name, scores)
+	return Write{sorted: &sorted}
+}
+
+// Name returns the name of the value or the sorted set to write.
+func (w Write) Name() string {
+	if w.value != nil {
+		return w.value.name
+	}
+	return w.sorted.name
+}
+
+// writeDocuments executes writes one by one. Sorted sets are written before values, so that a value such as the
+// update time of a sorted set is never newer than the sorted set.
+func writeDocuments(db Database, writes []Write) error {
+	var values []Value
+	for _, write := range writes {
+		if write.sorted != nil {
+			if err := db.SetSorted(write.sorted.name, write.sorted.scores); err != nil {
+				return errors.Trace(err)
+			}
+		} else {
+			values = append(values, *write.value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return errors.Trace(db.Set(values...))
+}
+
+// readDocuments executes reads one by one. It is used by databases without round trip costs or batch reads.
+func readDocuments(db Database, reads []Read) ([]Document, error) {
+	documents := make([]Document, len(reads))
+	for i, read := range reads {
+		var err error
+		switch read.kind {
+		case readValue:
+			documents[i].Value = db.Get(read.name)
+			if err = documents[i].Value.err; errors.Is(err, errors.NotFound) {
+				err = nil
+			}
+		case readSorted:
+			documents[i].Scores, err = db.GetSorted(read.name, read.begin, read.end)
+		case readSortedByScore:
+			documents[i].Scores, err = db.GetSortedByScore(read.name, read.minScore, read.maxScore)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return documents, nil
+}
+
 // Database is the common interface for cache store.
 type Database interface {
 	Close() error
@@ -290,6 +574,39 @@ type Database interface {
 	RemSortedByScore(key string, begin, end float64) error
 	SetSorted(key string, scores []Scored) error
 	RemSorted(members ...SetMember) error
+
+	// ReadDocuments executes reads in one round trip if possible. Documents are returned in the order of reads.
+	ReadDocuments(reads ...Read) ([]Document, error)
+	// WriteDocuments executes writes atomically if possible. Otherwise, sorted sets are written before values.
+	WriteDocuments(writes ...Write) error
+}
+
+// ContextDatabase is implemented by databases whose requests could be cancelled.
+type ContextDatabase interface {
+	// WithContext returns a copy of the database sharing connections, whose requests are cancelled once the context
+	// is done.
+	WithContext(ctx context.Context) Database
+}
+
+// WithContext returns a copy of the database whose requests are cancelled once the context is done. The database is
+// returned as it is if requests to it couldn't be cancelled.
+func WithContext(ctx context.Context, database Database) Database {
+	if contextDatabase, ok := database.(ContextDatabase); ok {
+		return contextDatabase.WithContext(ctx)
+	}
+	return database
+}
+
+// requestContext is the context of requests to a database, which is the background context if it is not set.
+type requestContext struct {
+	ctx context.Context
+}
+
+func (c requestContext) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 // Open a connection to a database.
@@ -297,7 +614,7 @@ func Open(path, tablePrefix string) (Database, error) {
 	var err error
 	if strings.HasPrefix(path, storage.RedisPrefix) || strings.HasPrefix(path, storage.RedissPrefix) {
 		if strings.Contains(path, ",") {
-			addrsSlice := strings.Split(path, ",")
+			addrsSlice := strings.Split(strings.TrimPrefix(path, storage.RedisPrefix), ",")
 			var addrs []string
 			for _, addr := range addrsSlice {
 				if addr != "" {
@@ -320,9 +637,30 @@ func Open(path, tablePrefix string) (Database, error) {
 			database.TablePrefix = storage.TablePrefix(tablePrefix)
 			return database, nil
 		}
+	} else if strings.HasPrefix(path, storage.InMemoryPrefix) {
+		store, err := openInMemory(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		database := new(InMemory)
+		database.store = store
+		database.TablePrefix = storage.TablePrefix(tablePrefix)
+		return database, nil
+	} else if strings.HasPrefix(path, storage.MemcachedPrefix) {
+		servers, ttl, maxItemSize, err := parseMemcached(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		database := new(Memcached)
+		database.client = memcache.New(servers...)
+		database.ttl = ttl
+		database.maxItemSize = maxItemSize
+		database.TablePrefix = storage.TablePrefix(tablePrefix)
+		return database, nil
 	} else if strings.HasPrefix(path, storage.MongoPrefix) || strings.HasPrefix(path, storage.MongoSrvPrefix) {
 		// connect to database
 		database := new(MongoDB)
+		database.noTransaction = atomic.NewBool(false)
 		if database.client, err = mongo.Connect(context.Background(), options.Client().ApplyURI(path)); err != nil {
 			return nil, errors.Trace(err)
 		}
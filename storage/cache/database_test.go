@@ -17,6 +17,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/stretchr/testify/assert"
 	"math"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -195,6 +196,39 @@ func testSort(t *testing.T, db Database) {
 	assert.Empty(t, scores)
 }
 
+func testSetSortedIsolation(t *testing.T, db Database) {
+	// lists of different lengths and members
+	lists := make([][]Scored, 2)
+	for i := range lists {
+		for j := 0; j < 10*(i+1); j++ {
+			lists[i] = append(lists[i], Scored{Id: strconv.Itoa(i) + "_" + strconv.Itoa(j), Score: float64(100 - j)})
+		}
+	}
+	err := db.SetSorted("isolation", lists[0])
+	assert.NoError(t, err)
+
+	// read while rewriting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 100; i++ {
+			assert.NoError(t, db.SetSorted("isolation", lists[i%2]))
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		scores, err := db.GetSorted("isolation", 0, -1)
+		assert.NoError(t, err)
+		// either the complete old list or the complete new list is read
+		assert.Contains(t, lists, scores)
+		assert.IsDecreasing(t, GetScores(scores))
+	}
+}
+
 func testScan(t *testing.T, db Database) {
 	err := db.Set(String("1", "1"))
 	assert.NoError(t, err)
@@ -245,6 +279,57 @@ func testPurge(t *testing.T, db Database) {
 	assert.Empty(t, z)
 }
 
+func testReadDocuments(t *testing.T, db Database) {
+	err := db.Set(String("value", "1"))
+	assert.NoError(t, err)
+	err = db.SetSorted("sorted", []Scored{{"1", 1}, {"2", 2}, {"3", 3}, {"4", 4}})
+	assert.NoError(t, err)
+	documents, err := db.ReadDocuments(
+		ReadValue("value"),
+		ReadValue("unknown_value"),
+		ReadSorted("sorted", 1, 2),
+		ReadSorted("sorted", 0, -1),
+		ReadSortedByScore("sorted", 2, 3),
+		ReadSorted("unknown_sorted", 0, -1),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, documents, 6)
+	value, err := documents[0].Value.String()
+	assert.NoError(t, err)
+	assert.Equal(t, "1", value)
+	_, err = documents[1].Value.String()
+	assert.True(t, errors.Is(err, errors.NotFound), err)
+	assert.Equal(t, []Scored{{"3", 3}, {"2", 2}}, documents[2].Scores)
+	assert.Equal(t, []Scored{{"4", 4}, {"3", 3}, {"2", 2}, {"1", 1}}, documents[3].Scores)
+	assert.Equal(t, []Scored{{"2", 2}, {"3", 3}}, documents[4].Scores)
+	assert.Empty(t, documents[5].Scores)
+
+	// test read empty
+	documents, err = db.ReadDocuments()
+	assert.NoError(t, err)
+	assert.Empty(t, documents)
+}
+
+func testWriteDocuments(t *testing.T, db Database) {
+	err := db.SetSorted("write_sorted", []Scored{{"1", 1}, {"2", 2}})
+	assert.NoError(t, err)
+	err = db.WriteDocuments(
+		WriteValue(String("write_value", "1")),
+		WriteSorted("write_sorted", []Scored{{"3", 3}, {"4", 4}}),
+	)
+	assert.NoError(t, err)
+	value, err := db.Get("write_value").String()
+	assert.NoError(t, err)
+	assert.Equal(t, "1", value)
+	scores, err := db.GetSorted("write_sorted", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"4", 4}, {"3", 3}}, scores)
+
+	// test write empty
+	err = db.WriteDocuments()
+	assert.NoError(t, err)
+}
+
 func TestScored(t *testing.T) {
 	itemIds := []string{"2", "4", "6"}
 	scores := []float64{2, 4, 6}
@@ -254,6 +339,10 @@ func TestScored(t *testing.T) {
 	assert.Equal(t, scores, GetScores(scored))
 	SortScores(scored)
 	assert.Equal(t, []Scored{{Id: "6", Score: 6}, {Id: "4", Score: 4}, {Id: "2", Score: 2}}, scored)
+	// ties are broken by ids
+	scored = []Scored{{Id: "3", Score: 1}, {Id: "1", Score: 1}, {Id: "2", Score: 2}}
+	SortScores(scored)
+	assert.Equal(t, []Scored{{Id: "2", Score: 2}, {Id: "1", Score: 1}, {Id: "3", Score: 1}}, scored)
 }
 
 func TestKey(t *testing.T) {
@@ -0,0 +1,519 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/gob"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	inMemoryNumShards       = 64
+	inMemoryJanitorInterval = time.Minute
+)
+
+var (
+	inMemoryStores      = make(map[string]*inMemoryStore)
+	inMemoryStoresMutex sync.Mutex
+)
+
+// InMemory cache storage keeps everything in the memory of the process. Databases opened with the same DSN share
+// the same store, so that the master, the worker and the server in gorse-in-one see the same cache. The DSN is:
+//
+//	inmemory://[path/to/snapshot][?ttl=24h]
+//
+// If the snapshot path is given, the store is loaded from the snapshot on open and saved to the snapshot when the
+// last database is closed. The ttl parameter sets the expiration of all keys (0 means never expire).
+type InMemory struct {
+	storage.TablePrefix
+	store  *inMemoryStore
+	closed bool
+}
+
+type inMemoryEntry struct {
+	Value    string
+	Set      []string
+	Sorted   []Scored
+	ExpireAt time.Time
+}
+
+func (e *inMemoryEntry) expired(now time.Time) bool {
+	return !e.ExpireAt.IsZero() && !now.Before(e.ExpireAt)
+}
+
+type inMemoryShard struct {
+	sync.RWMutex
+	entries map[string]*inMemoryEntry
+}
+
+type inMemoryStore struct {
+	dsn    string
+	path   string
+	ttl    time.Duration
+	shards [inMemoryNumShards]inMemoryShard
+	refs   int
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// openInMemory returns the store of the DSN. A new store is created if it doesn't exist.
+func openInMemory(dsn string) (*inMemoryStore, error) {
+	inMemoryStoresMutex.Lock()
+	defer inMemoryStoresMutex.Unlock()
+	if store, exist := inMemoryStores[dsn]; exist {
+		store.refs++
+		return store, nil
+	}
+	// parse DSN
+	path := strings.TrimPrefix(dsn, storage.InMemoryPrefix)
+	var rawQuery string
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, rawQuery = path[:i], path[i+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	store := &inMemoryStore{dsn: dsn, path: path, refs: 1}
+	if value := query.Get("ttl"); value != "" {
+		if store.ttl, err = time.ParseDuration(value); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	for i := range store.shards {
+		store.shards[i].entries = make(map[string]*inMemoryEntry)
+	}
+	// load snapshot
+	if store.path != "" {
+		if err = store.load(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	// start janitor
+	if store.ttl > 0 {
+		store.stop = make(chan struct{})
+		store.done = make(chan struct{})
+		go store.janitor(inMemoryJanitorInterval)
+	}
+	inMemoryStores[dsn] = store
+	return store, nil
+}
+
+// release the store. The store is saved and removed after the last database is closed.
+func (s *inMemoryStore) release() error {
+	inMemoryStoresMutex.Lock()
+	defer inMemoryStoresMutex.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(inMemoryStores, s.dsn)
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+	if s.path != "" {
+		return s.save()
+	}
+	return nil
+}
+
+func (s *inMemoryStore) shard(key string) *inMemoryShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return &s.shards[hash.Sum32()%inMemoryNumShards]
+}
+
+func (s *inMemoryStore) expireAt() time.Time {
+	if s.ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.ttl)
+}
+
+// view calls the function with the entry of a key. The entry is nil if it doesn't exist or has expired.
+func (s *inMemoryStore) view(key string, fn func(entry *inMemoryEntry)) {
+	shard := s.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	entry, exist := shard.entries[key]
+	if !exist || entry.expired(time.Now()) {
+		entry = nil
+	}
+	fn(entry)
+}
+
+// update calls the function with the entry of a key. The entry passed to the function is nil if it doesn't exist or
+// has expired. The key is removed if the function returns nil.
+func (s *inMemoryStore) update(key string, fn func(entry *inMemoryEntry) *inMemoryEntry) {
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	entry, exist := shard.entries[key]
+	if !exist || entry.expired(time.Now()) {
+		entry = nil
+	}
+	if entry = fn(entry); entry == nil {
+		delete(shard.entries, key)
+	} else {
+		entry.ExpireAt = s.expireAt()
+		shard.entries[key] = entry
+	}
+}
+
+// deleteExpired removes expired entries.
+func (s *inMemoryStore) deleteExpired() {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.Lock()
+		now := time.Now()
+		for key, entry := range shard.entries {
+			if entry.expired(now) {
+				delete(shard.entries, key)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+func (s *inMemoryStore) janitor(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.deleteExpired()
+		}
+	}
+}
+
+func (s *inMemoryStore) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	var entries map[string]*inMemoryEntry
+	if err = gob.NewDecoder(f).Decode(&entries); err != nil {
+		return errors.Trace(err)
+	}
+	now := time.Now()
+	for key, entry := range entries {
+		if !entry.expired(now) {
+			s.shard(key).entries[key] = entry
+		}
+	}
+	log.Logger().Info("load in-memory cache snapshot", zap.String("path", s.path), zap.Int("num_keys", len(entries)))
+	return nil
+}
+
+// save writes the snapshot to a temporary file and renames it, so that the previous snapshot is kept on failure.
+func (s *inMemoryStore) save() error {
+	entries := make(map[string]*inMemoryEntry)
+	now := time.Now()
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for key, entry := range shard.entries {
+			if !entry.expired(now) {
+				entries[key] = entry
+			}
+		}
+		shard.RUnlock()
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = gob.NewEncoder(f).Encode(entries); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return errors.Trace(err)
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Trace(err)
+	}
+	if err = os.Rename(f.Name(), s.path); err != nil {
+		return errors.Trace(err)
+	}
+	log.Logger().Info("save in-memory cache snapshot", zap.String("path", s.path), zap.Int("num_keys", len(entries)))
+	return nil
+}
+
+// Close releases the store.
+func (m *InMemory) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	return m.store.release()
+}
+
+// Init nothing.
+func (m *InMemory) Init() error {
+	return nil
+}
+
+func (m *InMemory) Scan(work func(string) error) error {
+	// collect keys first since the work might modify the store
+	var keys []string
+	now := time.Now()
+	for i := range m.store.shards {
+		shard := &m.store.shards[i]
+		shard.RLock()
+		for key, entry := range shard.entries {
+			if strings.HasPrefix(key, string(m.TablePrefix)) && !entry.expired(now) {
+				keys = append(keys, key[len(m.TablePrefix):])
+			}
+		}
+		shard.RUnlock()
+	}
+	for _, key := range keys {
+		if err := work(key); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (m *InMemory) Purge() error {
+	for i := range m.store.shards {
+		shard := &m.store.shards[i]
+		shard.Lock()
+		for key := range shard.entries {
+			if strings.HasPrefix(key, string(m.TablePrefix)) {
+				delete(shard.entries, key)
+			}
+		}
+		shard.Unlock()
+	}
+	return nil
+}
+
+func (m *InMemory) Set(values ...Value) error {
+	for _, v := range values {
+		value := v.value
+		m.store.update(m.Key(v.name), func(*inMemoryEntry) *inMemoryEntry {
+			return &inMemoryEntry{Value: value}
+		})
+	}
+	return nil
+}
+
+// Get returns a value from the memory.
+func (m *InMemory) Get(name string) *ReturnValue {
+	var ret *ReturnValue
+	m.store.view(m.Key(name), func(entry *inMemoryEntry) {
+		if entry == nil {
+			ret = &ReturnValue{err: errors.Annotate(ErrObjectNotExist, name)}
+		} else {
+			ret = &ReturnValue{value: entry.Value}
+		}
+	})
+	return ret
+}
+
+// Delete object from the memory.
+func (m *InMemory) Delete(name string) error {
+	m.store.update(m.Key(name), func(*inMemoryEntry) *inMemoryEntry {
+		return nil
+	})
+	return nil
+}
+
+// GetSet returns members of a set from the memory.
+func (m *InMemory) GetSet(key string) ([]string, error) {
+	var members []string
+	m.store.view(m.Key(key), func(entry *inMemoryEntry) {
+		if entry != nil {
+			members = append(members, entry.Set...)
+		}
+	})
+	return members, nil
+}
+
+// SetSet overrides a set with members in the memory.
+func (m *InMemory) SetSet(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	m.store.update(m.Key(key), func(*inMemoryEntry) *inMemoryEntry {
+		return &inMemoryEntry{Set: addStrings(nil, members)}
+	})
+	return nil
+}
+
+// AddSet adds members to a set in the memory.
+func (m *InMemory) AddSet(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	m.store.update(m.Key(key), func(entry *inMemoryEntry) *inMemoryEntry {
+		if entry == nil {
+			entry = new(inMemoryEntry)
+		}
+		entry.Set = addStrings(entry.Set, members)
+		return entry
+	})
+	return nil
+}
+
+// RemSet removes members from a set in the memory.
+func (m *InMemory) RemSet(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	m.store.update(m.Key(key), func(entry *inMemoryEntry) *inMemoryEntry {
+		if entry == nil {
+			return nil
+		}
+		if entry.Set = remStrings(entry.Set, members); len(entry.Set) == 0 {
+			return nil
+		}
+		return entry
+	})
+	return nil
+}
+
+// GetSorted get scores from sorted set.
+func (m *InMemory) GetSorted(key string, begin, end int) ([]Scored, error) {
+	results := make([]Scored, 0)
+	m.store.view(m.Key(key), func(entry *inMemoryEntry) {
+		if entry == nil {
+			return
+		}
+		if end < 0 || end >= len(entry.Sorted) {
+			end = len(entry.Sorted) - 1
+		}
+		if begin < len(entry.Sorted) && begin <= end {
+			results = append(results, entry.Sorted[begin:end+1]...)
+		}
+	})
+	return results, nil
+}
+
+func (m *InMemory) GetSortedByScore(key string, begin, end float64) ([]Scored, error) {
+	results := make([]Scored, 0)
+	m.store.view(m.Key(key), func(entry *inMemoryEntry) {
+		if entry == nil {
+			return
+		}
+		// scores are stored from high score to low score
+		for i := len(entry.Sorted) - 1; i >= 0; i-- {
+			if entry.Sorted[i].Score >= begin && entry.Sorted[i].Score <= end {
+				results = append(results, entry.Sorted[i])
+			}
+		}
+	})
+	return results, nil
+}
+
+func (m *InMemory) RemSortedByScore(key string, begin, end float64) error {
+	m.store.update(m.Key(key), func(entry *inMemoryEntry) *inMemoryEntry {
+		if entry == nil {
+			return nil
+		}
+		remained := make([]Scored, 0, len(entry.Sorted))
+		for _, score := range entry.Sorted {
+			if score.Score < begin || score.Score > end {
+				remained = append(remained, score)
+			}
+		}
+		if entry.Sorted = remained; len(entry.Sorted) == 0 {
+			return nil
+		}
+		return entry
+	})
+	return nil
+}
+
+// AddSorted add scores to sorted set.
+func (m *InMemory) AddSorted(sortedSets ...SortedSet) error {
+	for _, sorted := range sortedSets {
+		if len(sorted.scores) == 0 {
+			continue
+		}
+		scores := sorted.scores
+		m.store.update(m.Key(sorted.name), func(entry *inMemoryEntry) *inMemoryEntry {
+			if entry == nil {
+				entry = new(inMemoryEntry)
+			}
+			entry.Sorted = addScores(entry.Sorted, scores)
+			return entry
+		})
+	}
+	return nil
+}
+
+// SetSorted set scores in sorted set and clear previous scores.
+func (m *InMemory) SetSorted(key string, scores []Scored) error {
+	m.store.update(m.Key(key), func(*inMemoryEntry) *inMemoryEntry {
+		if len(scores) == 0 {
+			return nil
+		}
+		return &inMemoryEntry{Sorted: addScores(nil, scores)}
+	})
+	return nil
+}
+
+// RemSorted removes members from sorted sets.
+func (m *InMemory) RemSorted(members ...SetMember) error {
+	for _, member := range members {
+		id := member.member
+		m.store.update(m.Key(member.name), func(entry *inMemoryEntry) *inMemoryEntry {
+			if entry == nil {
+				return nil
+			}
+			remained := make([]Scored, 0, len(entry.Sorted))
+			for _, score := range entry.Sorted {
+				if score.Id != id {
+					remained = append(remained, score)
+				}
+			}
+			if entry.Sorted = remained; len(entry.Sorted) == 0 {
+				return nil
+			}
+			return entry
+		})
+	}
+	return nil
+}
+
+// WriteDocuments executes writes one by one since there is no round trip.
+func (m *InMemory) WriteDocuments(writes ...Write) error {
+	return writeDocuments(m, writes)
+}
+
+// ReadDocuments executes reads one by one since there is no round trip.
+func (m *InMemory) ReadDocuments(reads ...Read) ([]Document, error) {
+	return readDocuments(m, reads)
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testInMemory struct {
+	Database
+}
+
+func newMockInMemory(t *testing.T) *testInMemory {
+	var err error
+	db := new(testInMemory)
+	db.Database, err = Open("inmemory://", "gorse_"+t.Name()+"_")
+	assert.NoError(t, err)
+	return db
+}
+
+func (db *testInMemory) Close(t *testing.T) {
+	err := db.Database.Close()
+	assert.NoError(t, err)
+}
+
+func TestInMemory_Meta(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	testMeta(t, db.Database)
+}
+
+func TestInMemory_Sort(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	testSort(t, db.Database)
+	testSetSortedIsolation(t, db.Database)
+}
+
+func TestInMemory_Set(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	testSet(t, db.Database)
+}
+
+func TestInMemory_Scan(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	testScan(t, db.Database)
+}
+
+func TestInMemory_Purge(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	testPurge(t, db.Database)
+}
+
+func TestInMemory_ReadDocuments(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
+
+func TestInMemory_Share(t *testing.T) {
+	// databases opened with the same DSN share the store
+	db1, err := Open("inmemory://?ttl=1h", "")
+	assert.NoError(t, err)
+	db2, err := Open("inmemory://?ttl=1h", "")
+	assert.NoError(t, err)
+	err = db1.Set(String("key", "value"))
+	assert.NoError(t, err)
+	value, err := db2.Get("key").String()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	// the store is removed after all databases are closed
+	assert.NoError(t, db1.Close())
+	assert.NoError(t, db2.Close())
+	db3, err := Open("inmemory://?ttl=1h", "")
+	assert.NoError(t, err)
+	_, err = db3.Get("key").String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+	assert.NoError(t, db3.Close())
+}
+
+func TestInMemory_Expire(t *testing.T) {
+	db, err := Open("inmemory://?ttl=100ms", "")
+	assert.NoError(t, err)
+	defer db.Close()
+	store := db.(*InMemory).store
+	err = db.Set(String("key", "value"))
+	assert.NoError(t, err)
+	err = db.AddSorted(Sorted("sorted", []Scored{{"1", 1}}))
+	assert.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	// expired keys are invisible
+	_, err = db.Get("key").String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+	scores, err := db.GetSorted("sorted", 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, scores)
+	// expired keys are removed by janitor
+	store.deleteExpired()
+	for i := range store.shards {
+		assert.Empty(t, store.shards[i].entries)
+	}
+}
+
+func TestInMemory_Snapshot(t *testing.T) {
+	dsn := "inmemory://" + filepath.Join(t.TempDir(), "cache.snapshot")
+	db, err := Open(dsn, "")
+	assert.NoError(t, err)
+	err = db.Set(String("key", "value"))
+	assert.NoError(t, err)
+	err = db.SetSet("set", "a", "b")
+	assert.NoError(t, err)
+	err = db.SetSorted("sorted", []Scored{{"a", 1}, {"b", 2}})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	// load snapshot
+	db, err = Open(dsn, "")
+	assert.NoError(t, err)
+	defer db.Close()
+	value, err := db.Get("key").String()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	members, err := db.GetSet("set")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, members)
+	scores, err := db.GetSorted("sorted", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"b", 2}, {"a", 1}}, scores)
+}
+
+// TestInMemory_Concurrency should be run with the race detector.
+func TestInMemory_Concurrency(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	const numGoroutines, numOperations = 16, 1000
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < numOperations; j++ {
+				key := strconv.Itoa(j % 10)
+				member := strconv.Itoa(i)
+				assert.NoError(t, db.Set(String(key, member)))
+				_ = db.Get(key)
+				assert.NoError(t, db.AddSorted(Sorted("sorted/"+key, []Scored{{member, float64(j)}})))
+				_, err := db.GetSorted("sorted/"+key, 0, -1)
+				assert.NoError(t, err)
+				assert.NoError(t, db.AddSet("set/"+key, member))
+				_, err = db.GetSet("set/" + key)
+				assert.NoError(t, err)
+				if j%3 == 0 {
+					assert.NoError(t, db.RemSorted(Member("sorted/"+key, member)))
+					assert.NoError(t, db.RemSet("set/"+key, member))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	// members added in the last round of key 8 are not removed
+	scores, err := db.GetSorted("sorted/8", 0, -1)
+	assert.NoError(t, err)
+	assert.Len(t, scores, numGoroutines)
+	members, err := db.GetSet("set/8")
+	assert.NoError(t, err)
+	assert.Len(t, members, numGoroutines)
+}
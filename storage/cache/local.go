@@ -0,0 +1,356 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"github.com/juju/errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalCache is a read-through LRU cache in front of a cache store. Values, sets and ranges of sorted sets are kept in
+// process for at most ttl and copied on return. Writes through LocalCache invalidate cached entries of written keys,
+// but writes from other processes are not observed, so reads might be stale for up to ttl. Keys starting with excluded
+// prefixes are never cached.
+type LocalCache struct {
+	Database
+	size            int
+	ttl             time.Duration
+	excludePrefixes []string
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	names   map[string]map[string]*list.Element
+
+	// OnHit, OnMiss and OnEvict are called on cache hits, cache misses and evictions if they are not nil.
+	OnHit   func()
+	OnMiss  func()
+	OnEvict func()
+
+	// parent is the local cache sharing entries.
+	parent *LocalCache
+}
+
+type localCacheEntry struct {
+	key      string
+	name     string
+	value    *ReturnValue
+	members  []string
+	scores   []Scored
+	expireAt time.Time
+}
+
+// NewLocalCache creates a LocalCache holding at most size entries.
+func NewLocalCache(db Database, size int, ttl time.Duration, excludePrefixes []string) *LocalCache {
+	return &LocalCache{
+		Database:        db,
+		size:            size,
+		ttl:             ttl,
+		excludePrefixes: excludePrefixes,
+		lru:             list.New(),
+		entries:         make(map[string]*list.Element),
+		names:           make(map[string]map[string]*list.Element),
+	}
+}
+
+func (c *LocalCache) cacheable(name string) bool {
+	for _, prefix := range c.excludePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithContext returns a local cache sharing entries, whose requests to the cache store are cancelled once the context
+// is done.
+func (c *LocalCache) WithContext(ctx context.Context) Database {
+	root := c.root()
+	return &LocalCache{
+		Database:        WithContext(ctx, c.Database),
+		size:            root.size,
+		ttl:             root.ttl,
+		excludePrefixes: root.excludePrefixes,
+		parent:          root,
+	}
+}
+
+func (c *LocalCache) root() *LocalCache {
+	if c.parent != nil {
+		return c.parent
+	}
+	return c
+}
+
+func (c *LocalCache) load(key string) (*localCacheEntry, bool) {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exist := c.entries[key]; exist {
+		entry := element.Value.(*localCacheEntry)
+		if time.Now().Before(entry.expireAt) {
+			c.lru.MoveToFront(element)
+			if c.OnHit != nil {
+				c.OnHit()
+			}
+			return entry, true
+		}
+		c.remove(element)
+	}
+	if c.OnMiss != nil {
+		c.OnMiss()
+	}
+	return nil, false
+}
+
+func (c *LocalCache) store(entry *localCacheEntry) {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.expireAt = time.Now().Add(c.ttl)
+	if element, exist := c.entries[entry.key]; exist {
+		c.remove(element)
+	}
+	element := c.lru.PushFront(entry)
+	c.entries[entry.key] = element
+	if _, exist := c.names[entry.name]; !exist {
+		c.names[entry.name] = make(map[string]*list.Element)
+	}
+	c.names[entry.name][entry.key] = element
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		if c.OnEvict != nil {
+			c.OnEvict()
+		}
+	}
+}
+
+func (c *LocalCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*localCacheEntry)
+	delete(c.entries, entry.key)
+	if keys, exist := c.names[entry.name]; exist {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.names, entry.name)
+		}
+	}
+}
+
+func (c *LocalCache) invalidate(names ...string) {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		for _, element := range c.names[name] {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *LocalCache) invalidateAll() {
+	c = c.root()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.names = make(map[string]map[string]*list.Element)
+}
+
+func valueKey(name string) string {
+	return "value:" + name
+}
+
+func setKey(name string) string {
+	return "set:" + name
+}
+
+func sortedKey(name string, begin, end int) string {
+	return "sorted:" + strconv.Itoa(begin) + ":" + strconv.Itoa(end) + ":" + name
+}
+
+func (c *LocalCache) Purge() error {
+	c.invalidateAll()
+	return c.Database.Purge()
+}
+
+func (c *LocalCache) Set(values ...Value) error {
+	names := make([]string, len(values))
+	for i, value := range values {
+		names[i] = value.name
+	}
+	defer c.invalidate(names...)
+	return c.Database.Set(values...)
+}
+
+// Get returns a value. Missing values are cached as well while other errors are not.
+func (c *LocalCache) Get(name string) *ReturnValue {
+	if !c.cacheable(name) {
+		return c.Database.Get(name)
+	}
+	key := valueKey(name)
+	if entry, ok := c.load(key); ok {
+		return entry.value
+	}
+	value := c.Database.Get(name)
+	if value.err == nil || errors.Is(value.err, errors.NotFound) {
+		c.store(&localCacheEntry{key: key, name: name, value: value})
+	}
+	return value
+}
+
+func (c *LocalCache) Delete(name string) error {
+	defer c.invalidate(name)
+	return c.Database.Delete(name)
+}
+
+func (c *LocalCache) GetSet(key string) ([]string, error) {
+	if !c.cacheable(key) {
+		return c.Database.GetSet(key)
+	}
+	entryKey := setKey(key)
+	if entry, ok := c.load(entryKey); ok {
+		return append([]string(nil), entry.members...), nil
+	}
+	members, err := c.Database.GetSet(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.store(&localCacheEntry{key: entryKey, name: key, members: append([]string(nil), members...)})
+	return members, nil
+}
+
+func (c *LocalCache) SetSet(key string, members ...string) error {
+	defer c.invalidate(key)
+	return c.Database.SetSet(key, members...)
+}
+
+func (c *LocalCache) AddSet(key string, members ...string) error {
+	defer c.invalidate(key)
+	return c.Database.AddSet(key, members...)
+}
+
+func (c *LocalCache) RemSet(key string, members ...string) error {
+	defer c.invalidate(key)
+	return c.Database.RemSet(key, members...)
+}
+
+func (c *LocalCache) AddSorted(sortedSets ...SortedSet) error {
+	names := make([]string, len(sortedSets))
+	for i, sortedSet := range sortedSets {
+		names[i] = sortedSet.name
+	}
+	defer c.invalidate(names...)
+	return c.Database.AddSorted(sortedSets...)
+}
+
+func (c *LocalCache) GetSorted(key string, begin, end int) ([]Scored, error) {
+	if !c.cacheable(key) {
+		return c.Database.GetSorted(key, begin, end)
+	}
+	entryKey := sortedKey(key, begin, end)
+	if entry, ok := c.load(entryKey); ok {
+		return append([]Scored(nil), entry.scores...), nil
+	}
+	scores, err := c.Database.GetSorted(key, begin, end)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.store(&localCacheEntry{key: entryKey, name: key, scores: append([]Scored(nil), scores...)})
+	return scores, nil
+}
+
+func (c *LocalCache) RemSortedByScore(key string, begin, end float64) error {
+	defer c.invalidate(key)
+	return c.Database.RemSortedByScore(key, begin, end)
+}
+
+func (c *LocalCache) SetSorted(key string, scores []Scored) error {
+	defer c.invalidate(key)
+	return c.Database.SetSorted(key, scores)
+}
+
+func (c *LocalCache) RemSorted(members ...SetMember) error {
+	names := make([]string, len(members))
+	for i, member := range members {
+		names[i] = member.name
+	}
+	defer c.invalidate(names...)
+	return c.Database.RemSorted(members...)
+}
+
+func (c *LocalCache) WriteDocuments(writes ...Write) error {
+	names := make([]string, len(writes))
+	for i, write := range writes {
+		names[i] = write.Name()
+	}
+	defer c.invalidate(names...)
+	return c.Database.WriteDocuments(writes...)
+}
+
+// ReadDocuments serves cached values and ranges locally and reads the rest from the cache store in one round trip.
+// Reads by score are never cached.
+func (c *LocalCache) ReadDocuments(reads ...Read) ([]Document, error) {
+	documents := make([]Document, len(reads))
+	var (
+		missReads   []Read
+		missIndices []int
+	)
+	for i, read := range reads {
+		if c.cacheable(read.name) {
+			switch read.kind {
+			case readValue:
+				if entry, ok := c.load(valueKey(read.name)); ok {
+					documents[i].Value = entry.value
+					continue
+				}
+			case readSorted:
+				if entry, ok := c.load(sortedKey(read.name, read.begin, read.end)); ok {
+					documents[i].Scores = append([]Scored(nil), entry.scores...)
+					continue
+				}
+			}
+		}
+		missReads = append(missReads, read)
+		missIndices = append(missIndices, i)
+	}
+	if len(missReads) == 0 {
+		return documents, nil
+	}
+	missDocuments, err := c.Database.ReadDocuments(missReads...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for j, read := range missReads {
+		documents[missIndices[j]] = missDocuments[j]
+		if !c.cacheable(read.name) {
+			continue
+		}
+		switch read.kind {
+		case readValue:
+			value := missDocuments[j].Value
+			if value.err == nil || errors.Is(value.err, errors.NotFound) {
+				c.store(&localCacheEntry{key: valueKey(read.name), name: read.name, value: value})
+			}
+		case readSorted:
+			c.store(&localCacheEntry{key: sortedKey(read.name, read.begin, read.end), name: read.name, scores: append([]Scored(nil), missDocuments[j].Scores...)})
+		}
+	}
+	return documents, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newMockLocalCache(t *testing.T, size int, ttl time.Duration, excludePrefixes ...string) (*LocalCache, *testInMemory) {
+	db := newMockInMemory(t)
+	return NewLocalCache(db.Database, size, ttl, excludePrefixes), db
+}
+
+func TestLocalCache_Meta(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, time.Minute)
+	defer db.Close(t)
+	testMeta(t, local)
+}
+
+func TestLocalCache_Sort(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, time.Minute)
+	defer db.Close(t)
+	testSort(t, local)
+}
+
+func TestLocalCache_Set(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, time.Minute)
+	defer db.Close(t)
+	testSet(t, local)
+}
+
+func TestLocalCache_Purge(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, time.Minute)
+	defer db.Close(t)
+	testPurge(t, local)
+}
+
+func TestLocalCache_ReadDocuments(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, time.Minute)
+	defer db.Close(t)
+	testReadDocuments(t, local)
+	testWriteDocuments(t, local)
+}
+
+func TestLocalCache_ReadThrough(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, time.Minute, "user/")
+	defer db.Close(t)
+	var hits, misses int
+	local.OnHit = func() { hits++ }
+	local.OnMiss = func() { misses++ }
+
+	// writes bypassing the local cache are not observed until expiry
+	err := db.Set(String("popular", "1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", local.Get("popular").value)
+	err = db.Set(String("popular", "2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", local.Get("popular").value)
+	assert.Equal(t, 1, hits)
+	assert.Equal(t, 1, misses)
+
+	// writes through the local cache invalidate the key
+	err = local.Set(String("popular", "3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "3", local.Get("popular").value)
+	err = local.SetSorted("latest", []Scored{{"1", 1}, {"2", 2}})
+	assert.NoError(t, err)
+	scores, err := local.GetSorted("latest", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"2", 2}, {"1", 1}}, scores)
+	err = local.AddSorted(Sorted("latest", []Scored{{"3", 3}}))
+	assert.NoError(t, err)
+	scores, err = local.GetSorted("latest", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"3", 3}, {"2", 2}, {"1", 1}}, scores)
+
+	// returned slices are copies
+	scores[0].Id = "x"
+	scores, err = local.GetSorted("latest", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", scores[0].Id)
+
+	// excluded keys are always read from the cache store
+	err = db.Set(String("user/1", "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", local.Get("user/1").value)
+	err = db.Set(String("user/1", "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", local.Get("user/1").value)
+}
+
+func TestLocalCache_Expire(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, 100*time.Millisecond)
+	defer db.Close(t)
+	err := db.AddSet("categories", "a")
+	assert.NoError(t, err)
+	members, err := local.GetSet("categories")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, members)
+	err = db.AddSet("categories", "b")
+	assert.NoError(t, err)
+	members, err = local.GetSet("categories")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, members)
+	time.Sleep(200 * time.Millisecond)
+	members, err = local.GetSet("categories")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, members)
+}
+
+func TestLocalCache_Evict(t *testing.T) {
+	local, db := newMockLocalCache(t, 2, time.Minute)
+	defer db.Close(t)
+	var evictions int
+	local.OnEvict = func() { evictions++ }
+	err := db.Set(String("a", "1"), String("b", "1"), String("c", "1"))
+	assert.NoError(t, err)
+	local.Get("a")
+	local.Get("b")
+	local.Get("a")
+	local.Get("c")
+	assert.Equal(t, 1, evictions)
+	assert.Equal(t, 2, local.lru.Len())
+	// the least recently used key is evicted
+	err = db.Set(String("a", "2"), String("b", "2"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", local.Get("a").value)
+	assert.Equal(t, "2", local.Get("b").value)
+}
+
+func TestLocalCache_WithContext(t *testing.T) {
+	local, db := newMockLocalCache(t, 100, time.Minute)
+	defer db.Close(t)
+	bound := WithContext(context.Background(), local)
+	assert.NoError(t, bound.Set(String("key", "value")))
+	value, err := bound.Get("key").String()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	// entries are shared with the local cache
+	assert.NoError(t, db.Database.Set(String("key", "stale")))
+	value, err = local.Get("key").String()
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.NoError(t, local.Delete("key"))
+	_, err = bound.Get("key").String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
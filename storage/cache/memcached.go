@@ -0,0 +1,627 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/storage"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMemcachedMaxItemSize is the default item size limit of memcached (1MB). Values larger than the limit
+	// are rejected by memcached, so a sorted set holding more than about 50k scores won't fit in the default limit.
+	DefaultMemcachedMaxItemSize = 1024 * 1024
+
+	memcachedMaxKeyLength  = 250
+	memcachedMaxCASRetries = 100
+	// memcached treats expirations larger than 30 days as unix timestamps.
+	memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+)
+
+// Memcached cache storage. Memcached only supports plain values, so sets and sorted sets are serialized into single
+// values and modified by read-modify-write under CAS tokens. Since memcached is unable to list keys, Scan isn't
+// supported and stale keys are reclaimed by the TTL.
+type Memcached struct {
+	storage.TablePrefix
+	client      *memcache.Client
+	ttl         time.Duration
+	maxItemSize int
+}
+
+// parseMemcached parses the DSN of memcached:
+//
+//	memcached://host1:port1[,...hostN:portN][?ttl=24h&max_item_size=1048576]
+//
+// The ttl parameter sets the expiration of all keys (0 means never expire) and max_item_size should be equal to the
+// item size limit of memcached servers (-I option).
+func parseMemcached(path string) (servers []string, ttl time.Duration, maxItemSize int, err error) {
+	path = strings.TrimPrefix(path, storage.MemcachedPrefix)
+	var rawQuery string
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, rawQuery = path[:i], path[i+1:]
+	}
+	for _, server := range strings.Split(strings.TrimSuffix(path, "/"), ",") {
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, 0, 0, errors.NotValidf("memcached servers")
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, 0, 0, errors.Trace(err)
+	}
+	if value := query.Get("ttl"); value != "" {
+		if ttl, err = time.ParseDuration(value); err != nil {
+			return nil, 0, 0, errors.Trace(err)
+		}
+	}
+	maxItemSize = DefaultMemcachedMaxItemSize
+	if value := query.Get("max_item_size"); value != "" {
+		if maxItemSize, err = strconv.Atoi(value); err != nil {
+			return nil, 0, 0, errors.Trace(err)
+		}
+	}
+	return servers, ttl, maxItemSize, nil
+}
+
+// Close memcached connection.
+func (m *Memcached) Close() error {
+	return nil
+}
+
+// Init nothing.
+func (m *Memcached) Init() error {
+	return nil
+}
+
+// Scan isn't supported since memcached is unable to list keys.
+func (m *Memcached) Scan(_ func(string) error) error {
+	return errors.NotSupportedf("scan of memcached")
+}
+
+// Purge flushes all keys in memcached servers, including keys of other table prefixes.
+func (m *Memcached) Purge() error {
+	return errors.Trace(m.client.FlushAll())
+}
+
+func (m *Memcached) Set(values ...Value) error {
+	for _, v := range values {
+		if err := m.set(v.name, []byte(v.value)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Get returns a value from memcached.
+func (m *Memcached) Get(name string) *ReturnValue {
+	item, err := m.client.Get(m.key(name))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return &ReturnValue{err: errors.Annotate(ErrObjectNotExist, name)}
+		}
+		return &ReturnValue{err: err}
+	}
+	return &ReturnValue{value: string(item.Value)}
+}
+
+// Delete object from memcached.
+func (m *Memcached) Delete(name string) error {
+	if err := m.client.Delete(m.key(name)); err != nil && err != memcache.ErrCacheMiss {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// GetSet returns members of a set from memcached.
+func (m *Memcached) GetSet(key string) ([]string, error) {
+	item, err := m.client.Get(m.key(key))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	return decodeStrings(item.Value)
+}
+
+// SetSet overrides a set with members in memcached.
+func (m *Memcached) SetSet(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	return m.set(key, encodeStrings(addStrings(nil, members)))
+}
+
+// AddSet adds members to a set in memcached.
+func (m *Memcached) AddSet(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	return m.update(m.key(key), func(value []byte) ([]byte, error) {
+		set, err := decodeStrings(value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return encodeStrings(addStrings(set, members)), nil
+	})
+}
+
+// RemSet removes members from a set in memcached.
+func (m *Memcached) RemSet(key string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	return m.update(m.key(key), func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, nil
+		}
+		set, err := decodeStrings(value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return encodeStrings(remStrings(set, members)), nil
+	})
+}
+
+// GetSorted get scores from sorted set.
+func (m *Memcached) GetSorted(key string, begin, end int) ([]Scored, error) {
+	scores, err := m.getSorted(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if end < 0 || end >= len(scores) {
+		end = len(scores) - 1
+	}
+	if begin >= len(scores) || begin > end {
+		return []Scored{}, nil
+	}
+	return scores[begin : end+1], nil
+}
+
+func (m *Memcached) GetSortedByScore(key string, begin, end float64) ([]Scored, error) {
+	scores, err := m.getSorted(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	results := make([]Scored, 0, len(scores))
+	// scores are stored from high score to low score
+	for i := len(scores) - 1; i >= 0; i-- {
+		if scores[i].Score >= begin && scores[i].Score <= end {
+			results = append(results, scores[i])
+		}
+	}
+	return results, nil
+}
+
+func (m *Memcached) RemSortedByScore(key string, begin, end float64) error {
+	return m.update(m.key(key), func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, nil
+		}
+		scores, err := decodeScores(value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		remained := scores[:0]
+		for _, score := range scores {
+			if score.Score < begin || score.Score > end {
+				remained = append(remained, score)
+			}
+		}
+		return encodeScores(remained), nil
+	})
+}
+
+// AddSorted add scores to sorted set. Current values of all sorted sets are fetched by one multi-get.
+func (m *Memcached) AddSorted(sortedSets ...SortedSet) error {
+	// merge sorted sets with the same name
+	var names []string
+	merged := make(map[string][]Scored)
+	for _, sorted := range sortedSets {
+		if len(sorted.scores) > 0 {
+			if _, exist := merged[sorted.name]; !exist {
+				names = append(names, sorted.name)
+			}
+			merged[sorted.name] = append(merged[sorted.name], sorted.scores...)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	// read-modify-write sorted sets
+	items, err := m.getMulti(names)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, name := range names {
+		add := func(value []byte) ([]byte, error) {
+			scores, err := decodeScores(value)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			return encodeScores(addScores(scores, merged[name])), nil
+		}
+		if err = m.modify(m.key(name), items[m.key(name)], add); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// SetSorted set scores in sorted set and clear previous scores.
+func (m *Memcached) SetSorted(key string, scores []Scored) error {
+	if len(scores) == 0 {
+		return m.Delete(key)
+	}
+	return m.set(key, encodeScores(addScores(nil, scores)))
+}
+
+// RemSorted removes members from sorted sets. Current values of all sorted sets are fetched by one multi-get.
+func (m *Memcached) RemSorted(members ...SetMember) error {
+	var names []string
+	removed := make(map[string][]string)
+	for _, member := range members {
+		if _, exist := removed[member.name]; !exist {
+			names = append(names, member.name)
+		}
+		removed[member.name] = append(removed[member.name], member.member)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	items, err := m.getMulti(names)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, name := range names {
+		item, exist := items[m.key(name)]
+		if !exist {
+			continue
+		}
+		remove := func(value []byte) ([]byte, error) {
+			if value == nil {
+				return nil, nil
+			}
+			scores, err := decodeScores(value)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			ids := make(map[string]struct{}, len(removed[name]))
+			for _, id := range removed[name] {
+				ids[id] = struct{}{}
+			}
+			remained := scores[:0]
+			for _, score := range scores {
+				if _, exist := ids[score.Id]; !exist {
+					remained = append(remained, score)
+				}
+			}
+			return encodeScores(remained), nil
+		}
+		if err = m.modify(m.key(name), item, remove); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// key converts a name to a memcached key. Memcached keys are limited to 250 bytes without spaces and control
+// characters, so other names are hashed.
+func (m *Memcached) key(name string) string {
+	key := m.Key(name)
+	if len(key) > memcachedMaxKeyLength || strings.IndexFunc(key, func(r rune) bool {
+		return r <= ' ' || r == 0x7f
+	}) >= 0 {
+		hash := sha1.Sum([]byte(name))
+		return m.Key("#" + hex.EncodeToString(hash[:]))
+	}
+	return key
+}
+
+func (m *Memcached) getMulti(names []string) (map[string]*memcache.Item, error) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = m.key(name)
+	}
+	return m.client.GetMulti(keys)
+}
+
+func (m *Memcached) getSorted(key string) ([]Scored, error) {
+	item, err := m.client.Get(m.key(key))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	return decodeScores(item.Value)
+}
+
+func (m *Memcached) set(name string, value []byte) error {
+	if err := m.checkSize(name, value); err != nil {
+		return errors.Trace(err)
+	}
+	return m.client.Set(&memcache.Item{Key: m.key(name), Value: value, Expiration: m.expiration()})
+}
+
+// update a value by read-modify-write. The function receives nil if the value doesn't exist and returns nil to
+// leave the value unchanged.
+func (m *Memcached) update(key string, fn func([]byte) ([]byte, error)) error {
+	item, err := m.client.Get(key)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return errors.Trace(err)
+	}
+	return m.modify(key, item, fn)
+}
+
+// modify a value by read-modify-write under the CAS token of the item read before. It is retried if the value was
+// modified by others.
+func (m *Memcached) modify(key string, item *memcache.Item, fn func([]byte) ([]byte, error)) error {
+	for i := 0; i < memcachedMaxCASRetries; i++ {
+		var value []byte
+		if item != nil {
+			value = item.Value
+		}
+		newValue, err := fn(value)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if newValue == nil {
+			return nil
+		}
+		if err = m.checkSize(key, newValue); err != nil {
+			return errors.Trace(err)
+		}
+		if item == nil {
+			err = m.client.Add(&memcache.Item{Key: key, Value: newValue, Expiration: m.expiration()})
+		} else {
+			item.Value = newValue
+			item.Expiration = m.expiration()
+			err = m.client.CompareAndSwap(item)
+		}
+		if err != memcache.ErrNotStored && err != memcache.ErrCASConflict && err != memcache.ErrCacheMiss {
+			return errors.Trace(err)
+		}
+		// reload the value modified by others
+		if item, err = m.client.Get(key); err != nil {
+			if err != memcache.ErrCacheMiss {
+				return errors.Trace(err)
+			}
+			item = nil
+		}
+	}
+	return errors.Errorf("failed to update %s after %d retries", key, memcachedMaxCASRetries)
+}
+
+func (m *Memcached) checkSize(name string, value []byte) error {
+	if len(value) > m.maxItemSize {
+		return errors.Errorf("value of %s (%d bytes) exceeds the item size limit of memcached (%d bytes)",
+			name, len(value), m.maxItemSize)
+	}
+	return nil
+}
+
+// expiration converts the TTL to memcached expiration.
+func (m *Memcached) expiration() int32 {
+	if m.ttl <= 0 {
+		return 0
+	} else if m.ttl > memcachedMaxRelativeExpiration {
+		return int32(time.Now().Add(m.ttl).Unix())
+	}
+	return int32(math.Ceil(m.ttl.Seconds()))
+}
+
+// addStrings appends members not in the set.
+func addStrings(set, members []string) []string {
+	exist := make(map[string]struct{}, len(set))
+	for _, member := range set {
+		exist[member] = struct{}{}
+	}
+	for _, member := range members {
+		if _, ok := exist[member]; !ok {
+			set = append(set, member)
+			exist[member] = struct{}{}
+		}
+	}
+	return set
+}
+
+// remStrings removes members from the set.
+func remStrings(set, members []string) []string {
+	removed := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		removed[member] = struct{}{}
+	}
+	remained := make([]string, 0, len(set))
+	for _, member := range set {
+		if _, ok := removed[member]; !ok {
+			remained = append(remained, member)
+		}
+	}
+	return remained
+}
+
+// addScores adds or updates scores and keeps scores sorted from high score to low score. Ties are sorted by ids in
+// descending order, which is consistent with ZREVRANGE of Redis.
+func addScores(scores, added []Scored) []Scored {
+	index := make(map[string]int, len(scores))
+	for i, score := range scores {
+		index[score.Id] = i
+	}
+	for _, score := range added {
+		if i, exist := index[score.Id]; exist {
+			scores[i].Score = score.Score
+		} else {
+			index[score.Id] = len(scores)
+			scores = append(scores, score)
+		}
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].Id > scores[j].Id
+	})
+	return scores
+}
+
+// encodeStrings serializes strings into a compact binary value: the number of strings followed by length-prefixed
+// strings.
+func encodeStrings(values []string) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(len(values)+1))
+	buf = appendUvarint(buf, uint64(len(values)))
+	for _, value := range values {
+		buf = appendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+func decodeStrings(buf []byte) ([]string, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	n, k := binary.Uvarint(buf)
+	if k <= 0 {
+		return nil, errors.NotValidf("encoded strings")
+	}
+	buf = buf[k:]
+	values := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		length, k := binary.Uvarint(buf)
+		if k <= 0 || uint64(len(buf)-k) < length {
+			return nil, errors.NotValidf("encoded strings")
+		}
+		values = append(values, string(buf[k:k+int(length)]))
+		buf = buf[k+int(length):]
+	}
+	return values, nil
+}
+
+// encodeScores serializes scores into a compact binary value: the number of scores followed by length-prefixed ids
+// and 8-byte scores.
+func encodeScores(scores []Scored) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(scores)*(binary.MaxVarintLen64+8))
+	buf = appendUvarint(buf, uint64(len(scores)))
+	for _, score := range scores {
+		buf = appendUvarint(buf, uint64(len(score.Id)))
+		buf = append(buf, score.Id...)
+		buf = appendUint64(buf, math.Float64bits(score.Score))
+	}
+	return buf
+}
+
+func decodeScores(buf []byte) ([]Scored, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	n, k := binary.Uvarint(buf)
+	if k <= 0 {
+		return nil, errors.NotValidf("encoded scores")
+	}
+	buf = buf[k:]
+	scores := make([]Scored, 0, n)
+	for i := uint64(0); i < n; i++ {
+		length, k := binary.Uvarint(buf)
+		if k <= 0 || uint64(len(buf)-k) < length+8 {
+			return nil, errors.NotValidf("encoded scores")
+		}
+		id := string(buf[k : k+int(length)])
+		buf = buf[k+int(length):]
+		scores = append(scores, Scored{Id: id, Score: math.Float64frombits(binary.LittleEndian.Uint64(buf))})
+		buf = buf[8:]
+	}
+	return scores, nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendUint64(buf []byte, x uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], x)
+	return append(buf, tmp[:]...)
+}
+
+// WriteDocuments executes writes one by one.
+func (m *Memcached) WriteDocuments(writes ...Write) error {
+	return writeDocuments(m, writes)
+}
+
+// ReadDocuments fetches all keys by one multi-get.
+func (m *Memcached) ReadDocuments(reads ...Read) ([]Document, error) {
+	if len(reads) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(reads))
+	for i, read := range reads {
+		names[i] = read.name
+	}
+	items, err := m.getMulti(names)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	documents := make([]Document, len(reads))
+	for i, read := range reads {
+		item, exist := items[m.key(read.name)]
+		if read.kind == readValue {
+			if exist {
+				documents[i].Value = &ReturnValue{value: string(item.Value)}
+			} else {
+				documents[i].Value = &ReturnValue{err: errors.Annotate(ErrObjectNotExist, read.name)}
+			}
+			continue
+		}
+		var scores []Scored
+		if exist {
+			if scores, err = decodeScores(item.Value); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		documents[i].Scores = make([]Scored, 0)
+		if read.kind == readSorted {
+			end := read.end
+			if end < 0 || end >= len(scores) {
+				end = len(scores) - 1
+			}
+			if read.begin < len(scores) && read.begin <= end {
+				documents[i].Scores = append(documents[i].Scores, scores[read.begin:end+1]...)
+			}
+		} else {
+			for j := len(scores) - 1; j >= 0; j-- {
+				if scores[j].Score >= read.minScore && scores[j].Score <= read.maxScore {
+					documents[i].Scores = append(documents[i].Scores, scores[j])
+				}
+			}
+		}
+	}
+	return documents, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	memcachedDSN      string
+	memcachedDatabase atomic.Int64
+)
+
+func init() {
+	// get environment variables
+	env := func(key, defaultValue string) string {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+		return defaultValue
+	}
+	memcachedDSN = env("MEMCACHED_URI", "memcached://127.0.0.1:11211")
+}
+
+type testMemcached struct {
+	Database
+}
+
+func newMockMemcached(t *testing.T) *testMemcached {
+	var err error
+	db := new(testMemcached)
+	// memcached has no databases, so tests are isolated by prefixes
+	memcachedDatabase.Inc()
+	prefix := "gorse_" + strconv.FormatInt(time.Now().UnixNano(), 36) + "_" + strconv.Itoa(int(memcachedDatabase.Load())) + "_"
+	db.Database, err = Open(memcachedDSN, prefix)
+	assert.NoError(t, err)
+	return db
+}
+
+func (db *testMemcached) Close(t *testing.T) {
+	err := db.Database.Close()
+	assert.NoError(t, err)
+}
+
+func TestMemcached_Meta(t *testing.T) {
+	db := newMockMemcached(t)
+	defer db.Close(t)
+	testMeta(t, db.Database)
+}
+
+func TestMemcached_Sort(t *testing.T) {
+	db := newMockMemcached(t)
+	defer db.Close(t)
+	testSort(t, db.Database)
+	testSetSortedIsolation(t, db.Database)
+}
+
+func TestMemcached_Set(t *testing.T) {
+	db := newMockMemcached(t)
+	defer db.Close(t)
+	testSet(t, db.Database)
+}
+
+func TestMemcached_Scan(t *testing.T) {
+	db := newMockMemcached(t)
+	defer db.Close(t)
+	err := db.Scan(func(string) error { return nil })
+	assert.True(t, errors.IsNotSupported(err), err)
+}
+
+func TestMemcached_Purge(t *testing.T) {
+	db := newMockMemcached(t)
+	defer db.Close(t)
+	testPurge(t, db.Database)
+}
+
+func TestMemcached_ReadDocuments(t *testing.T) {
+	db := newMockMemcached(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
+
+func TestMemcached_ItemSize(t *testing.T) {
+	db := newMockMemcached(t)
+	defer db.Close(t)
+	// values larger than the item size limit are rejected
+	err := db.Set(String("large", strings.Repeat("a", DefaultMemcachedMaxItemSize+1)))
+	assert.Error(t, err)
+	// names are hashed if they are illegal memcached keys
+	err = db.Set(String("key with spaces", "1"), String(strings.Repeat("a", 300), "2"))
+	assert.NoError(t, err)
+	value, err := db.Get("key with spaces").String()
+	assert.NoError(t, err)
+	assert.Equal(t, "1", value)
+	value, err = db.Get(strings.Repeat("a", 300)).String()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", value)
+}
+
+func TestParseMemcached(t *testing.T) {
+	servers, ttl, maxItemSize, err := parseMemcached("memcached://127.0.0.1:11211,127.0.0.2:11211?ttl=24h&max_item_size=2048")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:11211", "127.0.0.2:11211"}, servers)
+	assert.Equal(t, 24*time.Hour, ttl)
+	assert.Equal(t, 2048, maxItemSize)
+	_, ttl, maxItemSize, err = parseMemcached("memcached://127.0.0.1:11211")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl)
+	assert.Equal(t, DefaultMemcachedMaxItemSize, maxItemSize)
+	_, _, _, err = parseMemcached("memcached://")
+	assert.Error(t, err)
+}
+
+func TestMemcachedEncoding(t *testing.T) {
+	strs := []string{"", "a", "中文"}
+	decodedStrings, err := decodeStrings(encodeStrings(strs))
+	assert.NoError(t, err)
+	assert.Equal(t, strs, decodedStrings)
+	scores := []Scored{{"a", 1.5}, {"", -2}, {"中文", 0}}
+	decodedScores, err := decodeScores(encodeScores(scores))
+	assert.NoError(t, err)
+	assert.Equal(t, scores, decodedScores)
+	_, err = decodeScores([]byte{2, 1})
+	assert.Error(t, err)
+}
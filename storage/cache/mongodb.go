@@ -17,20 +17,28 @@ package cache
 import (
 	"context"
 	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
 	"github.com/zhenghaoz/gorse/storage"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/atomic"
 )
 
+// mongoIllegalOperation is the error code of transactions on standalone servers.
+const mongoIllegalOperation = 20
+
 type MongoDB struct {
 	storage.TablePrefix
+	requestContext
 	client *mongo.Client
 	dbName string
+	// noTransaction is true if transactions aren't supported by the server
+	noTransaction *atomic.Bool
 }
 
 func (m MongoDB) Init() error {
-	ctx := context.Background()
+	ctx := m.context()
 	d := m.client.Database(m.dbName)
 	// list collections
 	var hasValues, hasSets, hasSortedSets bool
@@ -98,11 +106,11 @@ func (m MongoDB) Init() error {
 }
 
 func (m MongoDB) Close() error {
-	return m.client.Disconnect(context.Background())
+	return m.client.Disconnect(m.context())
 }
 
 func (m MongoDB) Scan(work func(string) error) error {
-	ctx := context.Background()
+	ctx := m.context()
 
 	// scan values
 	valuesCollection := m.client.Database(m.dbName).Collection(m.ValuesTable())
@@ -171,7 +179,7 @@ func (m MongoDB) Purge() error {
 	tables := []string{m.ValuesTable(), m.SortedSetsTable(), m.SetsTable()}
 	for _, tableName := range tables {
 		c := m.client.Database(m.dbName).Collection(tableName)
-		_, err := c.DeleteMany(context.Background(), bson.D{})
+		_, err := c.DeleteMany(m.context(), bson.D{})
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -183,7 +191,7 @@ func (m MongoDB) Set(values ...Value) error {
 	if len(values) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.ValuesTable())
 	var models []mongo.WriteModel
 	for _, value := range values {
@@ -197,7 +205,7 @@ func (m MongoDB) Set(values ...Value) error {
 }
 
 func (m MongoDB) Get(name string) *ReturnValue {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.ValuesTable())
 	r := c.FindOne(ctx, bson.M{"_id": bson.M{"$eq": name}})
 	if err := r.Err(); err == mongo.ErrNoDocuments {
@@ -213,14 +221,14 @@ func (m MongoDB) Get(name string) *ReturnValue {
 }
 
 func (m MongoDB) Delete(name string) error {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.ValuesTable())
 	_, err := c.DeleteOne(ctx, bson.M{"_id": bson.M{"$eq": name}})
 	return errors.Trace(err)
 }
 
 func (m MongoDB) GetSet(name string) ([]string, error) {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SetsTable())
 	r, err := c.Find(ctx, bson.M{"name": name})
 	if err != nil {
@@ -238,7 +246,7 @@ func (m MongoDB) GetSet(name string) ([]string, error) {
 }
 
 func (m MongoDB) SetSet(name string, members ...string) error {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SetsTable())
 	var models []mongo.WriteModel
 	models = append(models, mongo.NewDeleteManyModel().SetFilter(bson.M{"name": bson.M{"$eq": name}}))
@@ -256,7 +264,7 @@ func (m MongoDB) AddSet(name string, members ...string) error {
 	if len(members) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SetsTable())
 	var models []mongo.WriteModel
 	for _, member := range members {
@@ -273,7 +281,7 @@ func (m MongoDB) RemSet(name string, members ...string) error {
 	if len(members) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SetsTable())
 	var models []mongo.WriteModel
 	for _, member := range members {
@@ -285,7 +293,7 @@ func (m MongoDB) RemSet(name string, members ...string) error {
 }
 
 func (m MongoDB) GetSorted(name string, begin, end int) ([]Scored, error) {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SortedSetsTable())
 	opt := options.Find()
 	opt.SetSort(bson.M{"score": -1})
@@ -314,7 +322,7 @@ func (m MongoDB) GetSorted(name string, begin, end int) ([]Scored, error) {
 }
 
 func (m MongoDB) GetSortedByScore(name string, begin, end float64) ([]Scored, error) {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SortedSetsTable())
 	opt := options.Find()
 	opt.SetSort(bson.M{"score": 1})
@@ -341,7 +349,7 @@ func (m MongoDB) GetSortedByScore(name string, begin, end float64) ([]Scored, er
 }
 
 func (m MongoDB) RemSortedByScore(name string, begin, end float64) error {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SortedSetsTable())
 	_, err := c.DeleteMany(ctx, bson.D{
 		{"name", name},
@@ -352,7 +360,7 @@ func (m MongoDB) RemSortedByScore(name string, begin, end float64) error {
 }
 
 func (m MongoDB) AddSorted(sortedSets ...SortedSet) error {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SortedSetsTable())
 	var models []mongo.WriteModel
 	for _, sorted := range sortedSets {
@@ -370,8 +378,11 @@ func (m MongoDB) AddSorted(sortedSets ...SortedSet) error {
 	return errors.Trace(err)
 }
 
+// SetSorted replaces scores in a sorted set in a transaction, so that readers never see a partially written sorted
+// set. Transactions are only supported by replica sets and sharded clusters, scores are replaced without isolation on
+// standalone servers.
 func (m MongoDB) SetSorted(name string, scores []Scored) error {
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SortedSetsTable())
 	var models []mongo.WriteModel
 	models = append(models, mongo.NewDeleteManyModel().SetFilter(bson.M{"name": bson.M{"$eq": name}}))
@@ -381,6 +392,20 @@ func (m MongoDB) SetSorted(name string, scores []Scored) error {
 			SetFilter(bson.M{"name": bson.M{"$eq": name}, "member": bson.M{"$eq": score.Id}}).
 			SetUpdate(bson.M{"$set": bson.M{"name": name, "member": score.Id, "score": score.Score}}))
 	}
+	if !m.noTransaction.Load() {
+		err := m.client.UseSession(ctx, func(sc mongo.SessionContext) error {
+			_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+				return c.BulkWrite(sc, models)
+			})
+			return err
+		})
+		var commandError mongo.CommandError
+		if !errors.As(err, &commandError) || commandError.Code != mongoIllegalOperation {
+			return errors.Trace(err)
+		}
+		m.noTransaction.Store(true)
+		log.Logger().Warn("transactions aren't supported by MongoDB, sorted sets are replaced without isolation")
+	}
 	_, err := c.BulkWrite(ctx, models)
 	return errors.Trace(err)
 }
@@ -389,7 +414,7 @@ func (m MongoDB) RemSorted(members ...SetMember) error {
 	if len(members) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := m.context()
 	c := m.client.Database(m.dbName).Collection(m.SortedSetsTable())
 	var models []mongo.WriteModel
 	for _, member := range members {
@@ -398,3 +423,102 @@ func (m MongoDB) RemSorted(members ...SetMember) error {
 	_, err := c.BulkWrite(ctx, models)
 	return errors.Trace(err)
 }
+
+// WriteDocuments executes writes one by one.
+func (m MongoDB) WriteDocuments(writes ...Write) error {
+	return writeDocuments(m, writes)
+}
+
+// ReadDocuments reads values in one query by $in and sorted sets in one query by $or.
+func (m MongoDB) ReadDocuments(reads ...Read) ([]Document, error) {
+	ctx := m.context()
+	var (
+		names   []string
+		filters bson.A
+	)
+	for _, read := range reads {
+		switch read.kind {
+		case readValue:
+			names = append(names, read.name)
+		case readSorted:
+			filters = append(filters, bson.M{"name": read.name})
+		case readSortedByScore:
+			filters = append(filters, bson.D{
+				{"name", read.name},
+				{"score", bson.M{"$gte": read.minScore, "$lte": read.maxScore}},
+			})
+		}
+	}
+	// read values
+	values := make(map[string]string)
+	if len(names) > 0 {
+		c := m.client.Database(m.dbName).Collection(m.ValuesTable())
+		r, err := c.Find(ctx, bson.M{"_id": bson.M{"$in": names}})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for r.Next(ctx) {
+			var doc bson.Raw
+			if err = r.Decode(&doc); err != nil {
+				return nil, errors.Trace(err)
+			}
+			values[doc.Lookup("_id").StringValue()] = doc.Lookup("value").StringValue()
+		}
+	}
+	// read sorted sets from high score to low score
+	scores := make(map[string][]Scored)
+	if len(filters) > 0 {
+		c := m.client.Database(m.dbName).Collection(m.SortedSetsTable())
+		opt := options.Find()
+		opt.SetSort(bson.M{"score": -1})
+		r, err := c.Find(ctx, bson.M{"$or": filters}, opt)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for r.Next(ctx) {
+			var doc bson.Raw
+			if err = r.Decode(&doc); err != nil {
+				return nil, errors.Trace(err)
+			}
+			name := doc.Lookup("name").StringValue()
+			scores[name] = append(scores[name], Scored{
+				Id:    doc.Lookup("member").StringValue(),
+				Score: doc.Lookup("score").Double(),
+			})
+		}
+	}
+	documents := make([]Document, len(reads))
+	for i, read := range reads {
+		switch read.kind {
+		case readValue:
+			if value, exist := values[read.name]; exist {
+				documents[i].Value = &ReturnValue{value: value}
+			} else {
+				documents[i].Value = &ReturnValue{err: errors.Annotate(ErrObjectNotExist, read.name)}
+			}
+		case readSorted:
+			all, end := scores[read.name], read.end
+			if end < 0 || end >= len(all) {
+				end = len(all) - 1
+			}
+			documents[i].Scores = make([]Scored, 0)
+			if read.begin < len(all) && read.begin <= end {
+				documents[i].Scores = append(documents[i].Scores, all[read.begin:end+1]...)
+			}
+		case readSortedByScore:
+			documents[i].Scores = make([]Scored, 0)
+			all := scores[read.name]
+			for j := len(all) - 1; j >= 0; j-- {
+				if all[j].Score >= read.minScore && all[j].Score <= read.maxScore {
+					documents[i].Scores = append(documents[i].Scores, all[j])
+				}
+			}
+		}
+	}
+	return documents, nil
+}
+
+func (m MongoDB) WithContext(ctx context.Context) Database {
+	m.ctx = ctx
+	return &m
+}
@@ -102,6 +102,17 @@ func TestMongo_Sort(t *testing.T) {
 	testSort(t, db.Database)
 }
 
+func TestMongo_SetSortedIsolation(t *testing.T) {
+	db := newTestMongo(t)
+	defer db.Close(t)
+	err := db.SetSorted("isolation", []Scored{{"1", 1}})
+	assert.NoError(t, err)
+	if db.GetMongoDB(t).noTransaction.Load() {
+		t.Skip("transactions aren't supported by standalone servers")
+	}
+	testSetSortedIsolation(t, db.Database)
+}
+
 func TestMongo_Set(t *testing.T) {
 	db := newTestMongo(t)
 	defer db.Close(t)
@@ -119,3 +130,10 @@ func TestMongo_Purge(t *testing.T) {
 	defer db.Close(t)
 	testPurge(t, db.Database)
 }
+
+func TestMongo_ReadDocuments(t *testing.T) {
+	db := newTestMongo(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
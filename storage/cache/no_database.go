@@ -98,3 +98,13 @@ func (NoDatabase) SetSorted(_ string, _ []Scored) error {
 func (NoDatabase) RemSorted(_ ...SetMember) error {
 	return ErrNoDatabase
 }
+
+// ReadDocuments method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) ReadDocuments(_ ...Read) ([]Document, error) {
+	return nil, ErrNoDatabase
+}
+
+// WriteDocuments method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) WriteDocuments(_ ...Write) error {
+	return ErrNoDatabase
+}
@@ -61,4 +61,8 @@ func TestNoDatabase(t *testing.T) {
 	assert.ErrorIs(t, err, ErrNoDatabase)
 	err = database.RemSorted()
 	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.ReadDocuments()
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	err = database.WriteDocuments()
+	assert.ErrorIs(t, err, ErrNoDatabase)
 }
@@ -0,0 +1,342 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+)
+
+// UserNames are names of documents keyed by user ids. User ids in keys of these documents are replaced by digests if
+// user ids are obfuscated. Names with prefixes, such as names of shadow recommendation, are matched by suffixes.
+var UserNames = []string{
+	IgnoreItems,
+	OfflineRecommend,
+	OfflineRecommendDigest,
+	OfflineRecommendModel,
+	OfflineRecommendSkips,
+	RankingGeneration,
+	CollaborativeRecommend,
+	UserNeighbors,
+	UserNeighborsDigest,
+	ConsumedFilter,
+	LastModifyUserTime,
+	LastUpdateUserRecommendTime,
+	LastUpdateUserNeighborsTime,
+}
+
+// DigestPrefix is the prefix of digests of user ids, so that keys listed by Scan aren't obfuscated again.
+const DigestPrefix = "~"
+
+// DigestID returns the digest of an id, which is HMAC-SHA256 of the id keyed by the secret truncated to 128 bits in
+// hexadecimal with DigestPrefix.
+func DigestID(secret, id string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(id))
+	return DigestPrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// IsDigest returns true if a string is a digest returned by DigestID.
+func IsDigest(s string) bool {
+	if len(s) != len(DigestPrefix)+32 || !strings.HasPrefix(s, DigestPrefix) {
+		return false
+	}
+	_, err := hex.DecodeString(s[len(DigestPrefix):])
+	return err == nil
+}
+
+// isUserKey returns true if the key is a document keyed by a user id.
+func isUserKey(key string) bool {
+	name, _, _ := strings.Cut(key, "/")
+	for _, userName := range UserNames {
+		if strings.HasSuffix(name, userName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Obfuscator replaces user ids in keys of documents keyed by user ids with digests, while other documents are
+// accessed as usual. Keys are accessed as they are if the secret is empty. During rotation of the secret, documents are
+// written under digests of both secrets, and documents under digests of the previous secret are read if documents
+// under digests of the current secret are missing.
+type Obfuscator struct {
+	Database
+	secrets atomic.Value
+}
+
+// NewObfuscator creates an obfuscator of a database.
+func NewObfuscator(database Database, secret, previousSecret string) *Obfuscator {
+	o := &Obfuscator{Database: database}
+	o.SetSecrets(secret, previousSecret)
+	return o
+}
+
+// SetSecrets switches secrets. The previous secret should be empty after the grace period of rotation.
+func (o *Obfuscator) SetSecrets(secret, previousSecret string) {
+	if secret == "" || previousSecret == secret {
+		previousSecret = ""
+	}
+	o.secrets.Store([2]string{secret, previousSecret})
+}
+
+// WithContext returns an obfuscator with current secrets, whose requests are cancelled once the context is done.
+func (o *Obfuscator) WithContext(ctx context.Context) Database {
+	obfuscator := &Obfuscator{Database: WithContext(ctx, o.Database)}
+	obfuscator.secrets.Store(o.secrets.Load())
+	return obfuscator
+}
+
+// Digest returns the digest of a user id by the current secret. The user id is returned if the secret is empty.
+func (o *Obfuscator) Digest(userId string) string {
+	secret := o.secrets.Load().([2]string)[0]
+	if secret == "" {
+		return userId
+	}
+	return DigestID(secret, userId)
+}
+
+// Digests returns digests of a user id by the current secret and the previous secret. Digests are empty if secrets
+// are empty.
+func (o *Obfuscator) Digests(userId string) (string, string) {
+	secrets := o.secrets.Load().([2]string)
+	var current, previous string
+	if secrets[0] != "" {
+		current = DigestID(secrets[0], userId)
+	}
+	if secrets[1] != "" {
+		previous = DigestID(secrets[1], userId)
+	}
+	return current, previous
+}
+
+// keys returns the key of a document under the current secret and the previous secret. The previous key is empty if
+// the secret isn't being rotated or the key isn't obfuscated.
+func (o *Obfuscator) keys(key string) (string, string) {
+	secrets := o.secrets.Load().([2]string)
+	if secrets[0] == "" || !isUserKey(key) {
+		return key, ""
+	}
+	splits := strings.SplitN(key, "/", 3)
+	if len(splits) < 2 || IsDigest(splits[1]) {
+		return key, ""
+	}
+	userId := splits[1]
+	splits[1] = DigestID(secrets[0], userId)
+	current := strings.Join(splits, "/")
+	if secrets[1] == "" {
+		return current, ""
+	}
+	splits[1] = DigestID(secrets[1], userId)
+	return current, strings.Join(splits, "/")
+}
+
+func (o *Obfuscator) Set(values ...Value) error {
+	obfuscated := make([]Value, 0, len(values))
+	for _, value := range values {
+		current, previous := o.keys(value.name)
+		obfuscated = append(obfuscated, Value{name: current, value: value.value})
+		if previous != "" {
+			obfuscated = append(obfuscated, Value{name: previous, value: value.value})
+		}
+	}
+	return o.Database.Set(obfuscated...)
+}
+
+func (o *Obfuscator) Get(name string) *ReturnValue {
+	current, previous := o.keys(name)
+	value := o.Database.Get(current)
+	if previous != "" && errors.Is(value.err, errors.NotFound) {
+		return o.Database.Get(previous)
+	}
+	return value
+}
+
+func (o *Obfuscator) Delete(name string) error {
+	current, previous := o.keys(name)
+	if previous != "" {
+		if err := o.Database.Delete(previous); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return o.Database.Delete(current)
+}
+
+func (o *Obfuscator) GetSet(key string) ([]string, error) {
+	current, previous := o.keys(key)
+	members, err := o.Database.GetSet(current)
+	if err == nil && previous != "" && len(members) == 0 {
+		return o.Database.GetSet(previous)
+	}
+	return members, err
+}
+
+func (o *Obfuscator) SetSet(key string, members ...string) error {
+	current, previous := o.keys(key)
+	if previous != "" {
+		if err := o.Database.SetSet(previous, members...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return o.Database.SetSet(current, members...)
+}
+
+func (o *Obfuscator) AddSet(key string, members ...string) error {
+	current, previous := o.keys(key)
+	if previous != "" {
+		if err := o.Database.AddSet(previous, members...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return o.Database.AddSet(current, members...)
+}
+
+func (o *Obfuscator) RemSet(key string, members ...string) error {
+	current, previous := o.keys(key)
+	if previous != "" {
+		if err := o.Database.RemSet(previous, members...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return o.Database.RemSet(current, members...)
+}
+
+func (o *Obfuscator) AddSorted(sortedSets ...SortedSet) error {
+	obfuscated := make([]SortedSet, 0, len(sortedSets))
+	for _, sortedSet := range sortedSets {
+		current, previous := o.keys(sortedSet.name)
+		obfuscated = append(obfuscated, SortedSet{name: current, scores: sortedSet.scores})
+		if previous != "" {
+			obfuscated = append(obfuscated, SortedSet{name: previous, scores: sortedSet.scores})
+		}
+	}
+	return o.Database.AddSorted(obfuscated...)
+}
+
+func (o *Obfuscator) GetSorted(key string, begin, end int) ([]Scored, error) {
+	current, previous := o.keys(key)
+	scores, err := o.Database.GetSorted(current, begin, end)
+	if err == nil && previous != "" && len(scores) == 0 {
+		return o.Database.GetSorted(previous, begin, end)
+	}
+	return scores, err
+}
+
+func (o *Obfuscator) GetSortedByScore(key string, begin, end float64) ([]Scored, error) {
+	current, previous := o.keys(key)
+	scores, err := o.Database.GetSortedByScore(current, begin, end)
+	if err == nil && previous != "" && len(scores) == 0 {
+		return o.Database.GetSortedByScore(previous, begin, end)
+	}
+	return scores, err
+}
+
+func (o *Obfuscator) RemSortedByScore(key string, begin, end float64) error {
+	current, previous := o.keys(key)
+	if previous != "" {
+		if err := o.Database.RemSortedByScore(previous, begin, end); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return o.Database.RemSortedByScore(current, begin, end)
+}
+
+func (o *Obfuscator) SetSorted(key string, scores []Scored) error {
+	current, previous := o.keys(key)
+	if previous != "" {
+		if err := o.Database.SetSorted(previous, scores); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return o.Database.SetSorted(current, scores)
+}
+
+func (o *Obfuscator) RemSorted(members ...SetMember) error {
+	obfuscated := make([]SetMember, 0, len(members))
+	for _, member := range members {
+		current, previous := o.keys(member.name)
+		obfuscated = append(obfuscated, SetMember{name: current, member: member.member})
+		if previous != "" {
+			obfuscated = append(obfuscated, SetMember{name: previous, member: member.member})
+		}
+	}
+	return o.Database.RemSorted(obfuscated...)
+}
+
+func (o *Obfuscator) WriteDocuments(writes ...Write) error {
+	obfuscated := make([]Write, 0, len(writes))
+	for _, write := range writes {
+		if write.value != nil {
+			current, previous := o.keys(write.value.name)
+			obfuscated = append(obfuscated, WriteValue(Value{name: current, value: write.value.value}))
+			if previous != "" {
+				obfuscated = append(obfuscated, WriteValue(Value{name: previous, value: write.value.value}))
+			}
+		} else {
+			current, previous := o.keys(write.sorted.name)
+			obfuscated = append(obfuscated, WriteSorted(current, write.sorted.scores))
+			if previous != "" {
+				obfuscated = append(obfuscated, WriteSorted(previous, write.sorted.scores))
+			}
+		}
+	}
+	return o.Database.WriteDocuments(obfuscated...)
+}
+
+func (o *Obfuscator) ReadDocuments(reads ...Read) ([]Document, error) {
+	currentReads := make([]Read, len(reads))
+	previousKeys := make([]string, len(reads))
+	for i, read := range reads {
+		currentReads[i] = read
+		currentReads[i].name, previousKeys[i] = o.keys(read.name)
+	}
+	documents, err := o.Database.ReadDocuments(currentReads...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// read missing documents under digests of the previous secret
+	var (
+		previousReads []Read
+		indices       []int
+	)
+	for i, read := range reads {
+		if previousKeys[i] == "" {
+			continue
+		}
+		if (read.kind == readValue && errors.Is(documents[i].Value.err, errors.NotFound)) ||
+			(read.kind != readValue && len(documents[i].Scores) == 0) {
+			previousRead := read
+			previousRead.name = previousKeys[i]
+			previousReads = append(previousReads, previousRead)
+			indices = append(indices, i)
+		}
+	}
+	if len(previousReads) > 0 {
+		previousDocuments, err := o.Database.ReadDocuments(previousReads...)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for j, i := range indices {
+			documents[i] = previousDocuments[j]
+		}
+	}
+	return documents, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDigestID(t *testing.T) {
+	digest := DigestID("secret", "1")
+	assert.Len(t, digest, 33)
+	assert.True(t, IsDigest(digest))
+	assert.Equal(t, digest, DigestID("secret", "1"))
+	assert.NotEqual(t, digest, DigestID("secret", "2"))
+	assert.NotEqual(t, digest, DigestID("another", "1"))
+	assert.False(t, IsDigest("1"))
+	assert.False(t, IsDigest("~"+digest[2:]+"x"))
+}
+
+func TestObfuscator(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	obfuscator := NewObfuscator(db.Database, "secret", "")
+	digest := DigestID("secret", "1")
+
+	// user ids in keys of users are replaced by digests
+	err := obfuscator.SetSorted(Key(OfflineRecommend, "1"), []Scored{{"1", 1}})
+	assert.NoError(t, err)
+	err = obfuscator.Set(String(Key(OfflineRecommendDigest, "1"), "digest"))
+	assert.NoError(t, err)
+	scores, err := db.GetSorted(Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, scores)
+	scores, err = db.GetSorted(Key(OfflineRecommend, digest), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, scores)
+	scores, err = obfuscator.GetSorted(Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, scores)
+	value, err := obfuscator.Get(Key(OfflineRecommendDigest, "1")).String()
+	assert.NoError(t, err)
+	assert.Equal(t, "digest", value)
+	documents, err := obfuscator.ReadDocuments(ReadSorted(Key(OfflineRecommend, "1"), 0, -1))
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, documents[0].Scores)
+	// keys of digests aren't obfuscated again
+	scores, err = obfuscator.GetSorted(Key(OfflineRecommend, digest), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, scores)
+	// keys with prefixes of shadow recommendation are obfuscated
+	err = NewShadow(obfuscator, "shadow_").SetSorted(Key(OfflineRecommend, "1"), []Scored{{"2", 2}})
+	assert.NoError(t, err)
+	scores, err = db.GetSorted("shadow_"+Key(OfflineRecommend, digest), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"2", 2}}, scores)
+
+	// other documents are accessed as usual
+	err = obfuscator.SetSorted(Key(ItemNeighbors, "1"), []Scored{{"2", 2}})
+	assert.NoError(t, err)
+	scores, err = db.GetSorted(Key(ItemNeighbors, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"2", 2}}, scores)
+
+	// keys are accessed as they are without secrets
+	obfuscator.SetSecrets("", "")
+	assert.Equal(t, "1", obfuscator.Digest("1"))
+	err = obfuscator.SetSorted(Key(OfflineRecommend, "2"), []Scored{{"3", 3}})
+	assert.NoError(t, err)
+	scores, err = db.GetSorted(Key(OfflineRecommend, "2"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"3", 3}}, scores)
+}
+
+func TestObfuscator_Rotation(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	obfuscator := NewObfuscator(db.Database, "old", "")
+	err := obfuscator.SetSorted(Key(OfflineRecommend, "1"), []Scored{{"1", 1}})
+	assert.NoError(t, err)
+	err = obfuscator.Set(String(Key(OfflineRecommendDigest, "1"), "digest"))
+	assert.NoError(t, err)
+
+	// documents under digests of the previous secret are read during the grace period
+	obfuscator.SetSecrets("new", "old")
+	assert.Equal(t, DigestID("new", "1"), obfuscator.Digest("1"))
+	scores, err := obfuscator.GetSorted(Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, scores)
+	value, err := obfuscator.Get(Key(OfflineRecommendDigest, "1")).String()
+	assert.NoError(t, err)
+	assert.Equal(t, "digest", value)
+	documents, err := obfuscator.ReadDocuments(
+		ReadValue(Key(OfflineRecommendDigest, "1")),
+		ReadSorted(Key(OfflineRecommend, "1"), 0, -1))
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, documents[1].Scores)
+	value, err = documents[0].Value.String()
+	assert.NoError(t, err)
+	assert.Equal(t, "digest", value)
+
+	// documents are written under digests of both secrets during the grace period
+	err = obfuscator.WriteDocuments(
+		WriteSorted(Key(OfflineRecommend, "1"), []Scored{{"2", 2}}),
+		WriteValue(String(Key(OfflineRecommendDigest, "1"), "new_digest")))
+	assert.NoError(t, err)
+	for _, secret := range []string{"new", "old"} {
+		scores, err = db.GetSorted(Key(OfflineRecommend, DigestID(secret, "1")), 0, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, []Scored{{"2", 2}}, scores)
+		value, err = db.Get(Key(OfflineRecommendDigest, DigestID(secret, "1"))).String()
+		assert.NoError(t, err)
+		assert.Equal(t, "new_digest", value)
+	}
+
+	// documents under digests of the previous secret aren't read after the grace period
+	err = obfuscator.Delete(Key(OfflineRecommendDigest, "1"))
+	assert.NoError(t, err)
+	err = db.Set(String(Key(OfflineRecommendDigest, DigestID("old", "1")), "digest"))
+	assert.NoError(t, err)
+	obfuscator.SetSecrets("new", "")
+	_, err = obfuscator.Get(Key(OfflineRecommendDigest, "1")).String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
@@ -17,14 +17,19 @@ package cache
 import (
 	"context"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/juju/errors"
 	"github.com/zhenghaoz/gorse/storage"
 	"strconv"
 )
 
+// tempSorted is the name of temporary sorted sets, which are renamed to sorted sets once they are written.
+const tempSorted = "temp_sorted"
+
 // Redis cache storage.
 type Redis struct {
 	storage.TablePrefix
+	requestContext
 	client *redis.Client
 }
 
@@ -40,7 +45,7 @@ func (r *Redis) Init() error {
 
 func (r *Redis) Scan(work func(string) error) error {
 	var (
-		ctx    = context.Background()
+		ctx    = r.context()
 		result []string
 		cursor uint64
 		err    error
@@ -63,7 +68,7 @@ func (r *Redis) Scan(work func(string) error) error {
 
 func (r *Redis) Purge() error {
 	var (
-		ctx    = context.Background()
+		ctx    = r.context()
 		result []string
 		cursor uint64
 		err    error
@@ -83,7 +88,7 @@ func (r *Redis) Purge() error {
 }
 
 func (r *Redis) Set(values ...Value) error {
-	var ctx = context.Background()
+	var ctx = r.context()
 	p := r.client.Pipeline()
 	for _, v := range values {
 		if err := p.Set(ctx, r.Key(v.name), v.value, 0).Err(); err != nil {
@@ -96,7 +101,7 @@ func (r *Redis) Set(values ...Value) error {
 
 // Get returns a value from Redis.
 func (r *Redis) Get(key string) *ReturnValue {
-	var ctx = context.Background()
+	var ctx = r.context()
 	val, err := r.client.Get(ctx, r.Key(key)).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -109,13 +114,13 @@ func (r *Redis) Get(key string) *ReturnValue {
 
 // Delete object from Redis.
 func (r *Redis) Delete(key string) error {
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.Del(ctx, r.Key(key)).Err()
 }
 
 // GetSet returns members of a set from Redis.
 func (r *Redis) GetSet(key string) ([]string, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.SMembers(ctx, r.Key(key)).Result()
 }
 
@@ -130,7 +135,7 @@ func (r *Redis) SetSet(key string, members ...string) error {
 		values = append(values, member)
 	}
 	// push set
-	ctx := context.Background()
+	ctx := r.context()
 	pipeline := r.client.Pipeline()
 	pipeline.Del(ctx, r.Key(key))
 	pipeline.SAdd(ctx, r.Key(key), values...)
@@ -149,7 +154,7 @@ func (r *Redis) AddSet(key string, members ...string) error {
 		values = append(values, member)
 	}
 	// push set
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.SAdd(ctx, r.Key(key), values...).Err()
 }
 
@@ -158,13 +163,13 @@ func (r *Redis) RemSet(key string, members ...string) error {
 	if len(members) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.SRem(ctx, r.Key(key), members).Err()
 }
 
 // GetSorted get scores from sorted set.
 func (r *Redis) GetSorted(key string, begin, end int) ([]Scored, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	members, err := r.client.ZRevRangeWithScores(ctx, r.Key(key), int64(begin), int64(end)).Result()
 	if err != nil {
 		return nil, err
@@ -177,7 +182,7 @@ func (r *Redis) GetSorted(key string, begin, end int) ([]Scored, error) {
 }
 
 func (r *Redis) GetSortedByScore(key string, begin, end float64) ([]Scored, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	members, err := r.client.ZRangeByScoreWithScores(ctx, r.Key(key), &redis.ZRangeBy{
 		Min:    strconv.FormatFloat(begin, 'g', -1, 64),
 		Max:    strconv.FormatFloat(end, 'g', -1, 64),
@@ -195,7 +200,7 @@ func (r *Redis) GetSortedByScore(key string, begin, end float64) ([]Scored, erro
 }
 
 func (r *Redis) RemSortedByScore(key string, begin, end float64) error {
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.ZRemRangeByScore(ctx, r.Key(key),
 		strconv.FormatFloat(begin, 'g', -1, 64),
 		strconv.FormatFloat(end, 'g', -1, 64)).
@@ -204,7 +209,7 @@ func (r *Redis) RemSortedByScore(key string, begin, end float64) error {
 
 // AddSorted add scores to sorted set.
 func (r *Redis) AddSorted(sortedSets ...SortedSet) error {
-	ctx := context.Background()
+	ctx := r.context()
 	p := r.client.Pipeline()
 	for _, sorted := range sortedSets {
 		if len(sorted.scores) > 0 {
@@ -219,20 +224,27 @@ func (r *Redis) AddSorted(sortedSets ...SortedSet) error {
 	return err
 }
 
-// SetSorted set scores in sorted set and clear previous scores.
+// SetSorted set scores in sorted set and clear previous scores. Scores are written to a temporary sorted set, which
+// replaces the sorted set by RENAME atomically, so that readers never see a partially written sorted set.
 func (r *Redis) SetSorted(key string, scores []Scored) error {
+	ctx := r.context()
+	if len(scores) == 0 {
+		return r.client.Del(ctx, r.Key(key)).Err()
+	}
 	members := make([]*redis.Z, 0, len(scores))
 	for _, score := range scores {
 		members = append(members, &redis.Z{Member: score.Id, Score: float64(score.Score)})
 	}
-	ctx := context.Background()
+	temp := r.Key(Key(tempSorted, uuid.New().String()))
 	pipeline := r.client.Pipeline()
-	pipeline.Del(ctx, r.Key(key))
-	if len(scores) > 0 {
-		pipeline.ZAdd(ctx, r.Key(key), members...)
+	pipeline.ZAdd(ctx, temp, members...)
+	pipeline.Rename(ctx, temp, r.Key(key))
+	if _, err := pipeline.Exec(ctx); err != nil {
+		// remove the temporary sorted set if it hasn't been renamed
+		_ = r.client.Del(ctx, temp).Err()
+		return errors.Trace(err)
 	}
-	_, err := pipeline.Exec(ctx)
-	return err
+	return nil
 }
 
 // RemSorted method of NoDatabase returns ErrNoDatabase.
@@ -240,7 +252,7 @@ func (r *Redis) RemSorted(members ...SetMember) error {
 	if len(members) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := r.context()
 	pipe := r.client.Pipeline()
 	for _, member := range members {
 		pipe.ZRem(ctx, r.Key(member.name), member.member)
@@ -248,3 +260,88 @@ func (r *Redis) RemSorted(members ...SetMember) error {
 	_, err := pipe.Exec(ctx)
 	return errors.Trace(err)
 }
+
+// ReadDocuments executes reads in a transaction, so that documents written by WriteDocuments are consistent.
+func (r *Redis) ReadDocuments(reads ...Read) ([]Document, error) {
+	return readDocumentsInPipeline(r.context(), r.client.TxPipeline(), r.TablePrefix, reads)
+}
+
+// WriteDocuments executes writes in a transaction.
+func (r *Redis) WriteDocuments(writes ...Write) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	ctx := r.context()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, write := range writes {
+			if write.value != nil {
+				pipe.Set(ctx, r.Key(write.value.name), write.value.value, 0)
+				continue
+			}
+			pipe.Del(ctx, r.Key(write.sorted.name))
+			if len(write.sorted.scores) > 0 {
+				members := make([]*redis.Z, len(write.sorted.scores))
+				for i, score := range write.sorted.scores {
+					members[i] = &redis.Z{Member: score.Id, Score: score.Score}
+				}
+				pipe.ZAdd(ctx, r.Key(write.sorted.name), members...)
+			}
+		}
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func readDocumentsInPipeline(ctx context.Context, pipeline redis.Pipeliner, prefix storage.TablePrefix, reads []Read) ([]Document, error) {
+	if len(reads) == 0 {
+		return nil, nil
+	}
+	cmds := make([]redis.Cmder, len(reads))
+	for i, read := range reads {
+		switch read.kind {
+		case readValue:
+			cmds[i] = pipeline.Get(ctx, prefix.Key(read.name))
+		case readSorted:
+			cmds[i] = pipeline.ZRevRangeWithScores(ctx, prefix.Key(read.name), int64(read.begin), int64(read.end))
+		case readSortedByScore:
+			cmds[i] = pipeline.ZRangeByScoreWithScores(ctx, prefix.Key(read.name), &redis.ZRangeBy{
+				Min: strconv.FormatFloat(read.minScore, 'g', -1, 64),
+				Max: strconv.FormatFloat(read.maxScore, 'g', -1, 64),
+			})
+		}
+	}
+	// missing values are reported by commands
+	if _, err := pipeline.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, errors.Trace(err)
+	}
+	documents := make([]Document, len(reads))
+	for i, read := range reads {
+		switch cmd := cmds[i].(type) {
+		case *redis.StringCmd:
+			val, err := cmd.Result()
+			if err == redis.Nil {
+				documents[i].Value = &ReturnValue{err: errors.Annotate(ErrObjectNotExist, read.name)}
+			} else if err != nil {
+				return nil, errors.Trace(err)
+			} else {
+				documents[i].Value = &ReturnValue{value: val}
+			}
+		case *redis.ZSliceCmd:
+			members, err := cmd.Result()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			documents[i].Scores = make([]Scored, 0, len(members))
+			for _, member := range members {
+				documents[i].Scores = append(documents[i].Scores, Scored{Id: member.Member.(string), Score: member.Score})
+			}
+		}
+	}
+	return documents, nil
+}
+
+func (r *Redis) WithContext(ctx context.Context) Database {
+	database := *r
+	database.ctx = ctx
+	return &database
+}
@@ -25,6 +25,7 @@ import (
 // RedisCluster cache storage.
 type RedisCluster struct {
 	storage.TablePrefix
+	requestContext
 	client *redis.ClusterClient
 }
 
@@ -40,7 +41,7 @@ func (r *RedisCluster) Init() error {
 
 func (r *RedisCluster) Scan(work func(string) error) error {
 	var (
-		ctx    = context.Background()
+		ctx    = r.context()
 		result []string
 		cursor uint64
 		err    error
@@ -61,8 +62,33 @@ func (r *RedisCluster) Scan(work func(string) error) error {
 	}
 }
 
+// Purge deletes all keys with the table prefix. Keys are scanned and deleted on every master node, since keys are
+// sharded over master nodes.
+func (r *RedisCluster) Purge() error {
+	return r.client.ForEachMaster(r.context(), func(ctx context.Context, client *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(ctx, cursor, string(r.TablePrefix)+"*", 0).Result()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			// keys in different slots can't be deleted by a command
+			pipe := client.Pipeline()
+			for _, key := range keys {
+				pipe.Del(ctx, key)
+			}
+			if _, err = pipe.Exec(ctx); err != nil {
+				return errors.Trace(err)
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+}
+
 func (r *RedisCluster) Set(values ...Value) error {
-	var ctx = context.Background()
+	var ctx = r.context()
 	p := r.client.Pipeline()
 	for _, v := range values {
 		if err := p.Set(ctx, r.Key(v.name), v.value, 0).Err(); err != nil {
@@ -75,7 +101,7 @@ func (r *RedisCluster) Set(values ...Value) error {
 
 // Get returns a value from Redis.
 func (r *RedisCluster) Get(key string) *ReturnValue {
-	var ctx = context.Background()
+	var ctx = r.context()
 	val, err := r.client.Get(ctx, r.Key(key)).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -88,13 +114,13 @@ func (r *RedisCluster) Get(key string) *ReturnValue {
 
 // Delete object from Redis.
 func (r *RedisCluster) Delete(key string) error {
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.Del(ctx, r.Key(key)).Err()
 }
 
 // GetSet returns members of a set from Redis.
 func (r *RedisCluster) GetSet(key string) ([]string, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.SMembers(ctx, r.Key(key)).Result()
 }
 
@@ -109,7 +135,7 @@ func (r *RedisCluster) SetSet(key string, members ...string) error {
 		values = append(values, member)
 	}
 	// push set
-	ctx := context.Background()
+	ctx := r.context()
 	pipeline := r.client.Pipeline()
 	pipeline.Del(ctx, r.Key(key))
 	pipeline.SAdd(ctx, r.Key(key), values...)
@@ -128,7 +154,7 @@ func (r *RedisCluster) AddSet(key string, members ...string) error {
 		values = append(values, member)
 	}
 	// push set
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.SAdd(ctx, r.Key(key), values...).Err()
 }
 
@@ -137,13 +163,13 @@ func (r *RedisCluster) RemSet(key string, members ...string) error {
 	if len(members) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.SRem(ctx, r.Key(key), members).Err()
 }
 
 // GetSorted get scores from sorted set.
 func (r *RedisCluster) GetSorted(key string, begin, end int) ([]Scored, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	members, err := r.client.ZRevRangeWithScores(ctx, r.Key(key), int64(begin), int64(end)).Result()
 	if err != nil {
 		return nil, err
@@ -156,7 +182,7 @@ func (r *RedisCluster) GetSorted(key string, begin, end int) ([]Scored, error) {
 }
 
 func (r *RedisCluster) GetSortedByScore(key string, begin, end float64) ([]Scored, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	members, err := r.client.ZRangeByScoreWithScores(ctx, r.Key(key), &redis.ZRangeBy{
 		Min:    strconv.FormatFloat(begin, 'g', -1, 64),
 		Max:    strconv.FormatFloat(end, 'g', -1, 64),
@@ -174,7 +200,7 @@ func (r *RedisCluster) GetSortedByScore(key string, begin, end float64) ([]Score
 }
 
 func (r *RedisCluster) RemSortedByScore(key string, begin, end float64) error {
-	ctx := context.Background()
+	ctx := r.context()
 	return r.client.ZRemRangeByScore(ctx, r.Key(key),
 		strconv.FormatFloat(begin, 'g', -1, 64),
 		strconv.FormatFloat(end, 'g', -1, 64)).
@@ -183,7 +209,7 @@ func (r *RedisCluster) RemSortedByScore(key string, begin, end float64) error {
 
 // AddSorted add scores to sorted set.
 func (r *RedisCluster) AddSorted(sortedSets ...SortedSet) error {
-	ctx := context.Background()
+	ctx := r.context()
 	p := r.client.Pipeline()
 	for _, sorted := range sortedSets {
 		if len(sorted.scores) > 0 {
@@ -198,14 +224,16 @@ func (r *RedisCluster) AddSorted(sortedSets ...SortedSet) error {
 	return err
 }
 
-// SetSorted set scores in sorted set and clear previous scores.
+// SetSorted set scores in sorted set and clear previous scores. Scores are replaced in a transaction on the node
+// of the sorted set, so that readers never see a partially written sorted set. A temporary sorted set isn't renamed
+// like Redis since it might be located in another slot.
 func (r *RedisCluster) SetSorted(key string, scores []Scored) error {
 	members := make([]*redis.Z, 0, len(scores))
 	for _, score := range scores {
 		members = append(members, &redis.Z{Member: score.Id, Score: float64(score.Score)})
 	}
-	ctx := context.Background()
-	pipeline := r.client.Pipeline()
+	ctx := r.context()
+	pipeline := r.client.TxPipeline()
 	pipeline.Del(ctx, r.Key(key))
 	if len(scores) > 0 {
 		pipeline.ZAdd(ctx, r.Key(key), members...)
@@ -219,7 +247,7 @@ func (r *RedisCluster) RemSorted(members ...SetMember) error {
 	if len(members) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := r.context()
 	pipe := r.client.Pipeline()
 	for _, member := range members {
 		pipe.ZRem(ctx, r.Key(member.name), member.member)
@@ -227,3 +255,19 @@ func (r *RedisCluster) RemSorted(members ...SetMember) error {
 	_, err := pipe.Exec(ctx)
 	return errors.Trace(err)
 }
+
+// ReadDocuments executes reads in a pipeline.
+func (r *RedisCluster) ReadDocuments(reads ...Read) ([]Document, error) {
+	return readDocumentsInPipeline(r.context(), r.client.Pipeline(), r.TablePrefix, reads)
+}
+
+// WriteDocuments executes writes one by one since keys might be located in different slots.
+func (r *RedisCluster) WriteDocuments(writes ...Write) error {
+	return writeDocuments(r, writes)
+}
+
+func (r *RedisCluster) WithContext(ctx context.Context) Database {
+	database := *r
+	database.ctx = ctx
+	return &database
+}
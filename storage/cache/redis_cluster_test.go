@@ -47,6 +47,7 @@ func TestRedisCluster_Sort(t *testing.T) {
 	db := newMockRedisCluster(t)
 	defer db.Close(t)
 	testSort(t, db.Database)
+	testSetSortedIsolation(t, db.Database)
 }
 
 func TestRedisCluster_Set(t *testing.T) {
@@ -60,3 +61,16 @@ func TestRedisCluster_Scan(t *testing.T) {
 	defer db.Close(t)
 	testScan(t, db.Database)
 }
+
+func TestRedisCluster_ReadDocuments(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
+
+func TestRedisCluster_Purge(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testPurge(t, db.Database)
+}
@@ -67,6 +67,7 @@ func TestRedis_Sort(t *testing.T) {
 	db := newMockRedis(t)
 	defer db.Close(t)
 	testSort(t, db.Database)
+	testSetSortedIsolation(t, db.Database)
 }
 
 func TestRedis_Set(t *testing.T) {
@@ -86,3 +87,10 @@ func TestRedis_Purge(t *testing.T) {
 	defer db.Close(t)
 	testPurge(t, db.Database)
 }
+
+func TestRedis_ReadDocuments(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
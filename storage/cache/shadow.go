@@ -0,0 +1,214 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"strings"
+	"sync/atomic"
+)
+
+// ShadowNames are names of documents generated by offline recommendation. These documents are written under the
+// shadow prefix in dry-run mode.
+var ShadowNames = []string{
+	OfflineRecommend,
+	OfflineRecommendDigest,
+	OfflineRecommendModel,
+	OfflineRecommendSkips,
+	RankingGeneration,
+	LastUpdateUserRecommendTime,
+	CollaborativeRecommend,
+	OfflineRecommendCheckpoint,
+}
+
+// ProductionPrefix returns the prefix of offline recommendation served to users. It is empty until shadow
+// recommendation is promoted.
+func ProductionPrefix(database Database) (string, error) {
+	prefix, err := database.Get(Key(GlobalMeta, OfflineRecommendPrefix)).String()
+	if errors.Is(err, errors.NotFound) {
+		return "", nil
+	}
+	return prefix, errors.Trace(err)
+}
+
+// CandidatePrefix returns the prefix of shadow recommendation. Production recommendation and shadow recommendation
+// take turns to live under the empty prefix and the shadow prefix.
+func CandidatePrefix(productionPrefix, shadowPrefix string) string {
+	if productionPrefix == "" {
+		return shadowPrefix
+	}
+	return ""
+}
+
+// PromoteShadow makes shadow recommendation production by switching the production prefix. Only one key is written,
+// so that the promotion is atomic in every database and costs nothing regardless of the number of users. Production
+// recommendation becomes shadow recommendation, so that it could be restored by promoting again. The new production
+// prefix is returned.
+func PromoteShadow(database Database, shadowPrefix string) (string, error) {
+	shadow, isShadow := database.(*Shadow)
+	if isShadow {
+		database = shadow.Database
+	}
+	productionPrefix, err := ProductionPrefix(database)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	productionPrefix = CandidatePrefix(productionPrefix, shadowPrefix)
+	if err = database.Set(String(Key(GlobalMeta, OfflineRecommendPrefix), productionPrefix)); err != nil {
+		return "", errors.Trace(err)
+	}
+	if isShadow {
+		shadow.SetPrefix(productionPrefix)
+	}
+	return productionPrefix, nil
+}
+
+// ShadowKey returns the key of a shadow document.
+func ShadowKey(prefix, key string) string {
+	if hasName(key, ShadowNames) {
+		return prefix + key
+	}
+	return key
+}
+
+// hasName returns true if the key is one of names or belongs to one of names.
+func hasName(key string, names []string) bool {
+	for _, name := range names {
+		if key == name || strings.HasPrefix(key, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Shadow redirects documents generated by offline recommendation to a prefix, while other documents are accessed as
+// usual. The prefix could be switched while the database is being used.
+type Shadow struct {
+	Database
+	prefix atomic.Value
+}
+
+// NewShadow creates a shadow of a database.
+func NewShadow(database Database, prefix string) *Shadow {
+	s := &Shadow{Database: database}
+	s.prefix.Store(prefix)
+	return s
+}
+
+// WithContext returns a shadow with the current prefix, whose requests are cancelled once the context is done.
+func (s *Shadow) WithContext(ctx context.Context) Database {
+	return NewShadow(WithContext(ctx, s.Database), s.Prefix())
+}
+
+// Prefix returns the current prefix.
+func (s *Shadow) Prefix() string {
+	return s.prefix.Load().(string)
+}
+
+// SetPrefix switches the prefix.
+func (s *Shadow) SetPrefix(prefix string) {
+	s.prefix.Store(prefix)
+}
+
+func (s *Shadow) Set(values ...Value) error {
+	prefix := s.Prefix()
+	shadowValues := make([]Value, len(values))
+	for i, value := range values {
+		shadowValues[i] = Value{name: ShadowKey(prefix, value.name), value: value.value}
+	}
+	return s.Database.Set(shadowValues...)
+}
+
+func (s *Shadow) Get(name string) *ReturnValue {
+	return s.Database.Get(ShadowKey(s.Prefix(), name))
+}
+
+func (s *Shadow) Delete(name string) error {
+	return s.Database.Delete(ShadowKey(s.Prefix(), name))
+}
+
+func (s *Shadow) GetSet(key string) ([]string, error) {
+	return s.Database.GetSet(ShadowKey(s.Prefix(), key))
+}
+
+func (s *Shadow) SetSet(key string, members ...string) error {
+	return s.Database.SetSet(ShadowKey(s.Prefix(), key), members...)
+}
+
+func (s *Shadow) AddSet(key string, members ...string) error {
+	return s.Database.AddSet(ShadowKey(s.Prefix(), key), members...)
+}
+
+func (s *Shadow) RemSet(key string, members ...string) error {
+	return s.Database.RemSet(ShadowKey(s.Prefix(), key), members...)
+}
+
+func (s *Shadow) AddSorted(sortedSets ...SortedSet) error {
+	prefix := s.Prefix()
+	shadowSets := make([]SortedSet, len(sortedSets))
+	for i, sortedSet := range sortedSets {
+		shadowSets[i] = SortedSet{name: ShadowKey(prefix, sortedSet.name), scores: sortedSet.scores}
+	}
+	return s.Database.AddSorted(shadowSets...)
+}
+
+func (s *Shadow) GetSorted(key string, begin, end int) ([]Scored, error) {
+	return s.Database.GetSorted(ShadowKey(s.Prefix(), key), begin, end)
+}
+
+func (s *Shadow) GetSortedByScore(key string, begin, end float64) ([]Scored, error) {
+	return s.Database.GetSortedByScore(ShadowKey(s.Prefix(), key), begin, end)
+}
+
+func (s *Shadow) RemSortedByScore(key string, begin, end float64) error {
+	return s.Database.RemSortedByScore(ShadowKey(s.Prefix(), key), begin, end)
+}
+
+func (s *Shadow) SetSorted(key string, scores []Scored) error {
+	return s.Database.SetSorted(ShadowKey(s.Prefix(), key), scores)
+}
+
+func (s *Shadow) RemSorted(members ...SetMember) error {
+	prefix := s.Prefix()
+	shadowMembers := make([]SetMember, len(members))
+	for i, member := range members {
+		shadowMembers[i] = SetMember{name: ShadowKey(prefix, member.name), member: member.member}
+	}
+	return s.Database.RemSorted(shadowMembers...)
+}
+
+func (s *Shadow) WriteDocuments(writes ...Write) error {
+	prefix := s.Prefix()
+	shadowWrites := make([]Write, len(writes))
+	for i, write := range writes {
+		if write.value != nil {
+			shadowWrites[i] = WriteValue(Value{name: ShadowKey(prefix, write.value.name), value: write.value.value})
+		} else {
+			shadowWrites[i] = WriteSorted(ShadowKey(prefix, write.sorted.name), write.sorted.scores)
+		}
+	}
+	return s.Database.WriteDocuments(shadowWrites...)
+}
+
+func (s *Shadow) ReadDocuments(reads ...Read) ([]Document, error) {
+	prefix := s.Prefix()
+	shadowReads := make([]Read, len(reads))
+	for i, read := range reads {
+		shadowReads[i] = read
+		shadowReads[i].name = ShadowKey(prefix, read.name)
+	}
+	return s.Database.ReadDocuments(shadowReads...)
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShadowKey(t *testing.T) {
+	assert.Equal(t, "shadow_offline_recommend/1", ShadowKey("shadow_", Key(OfflineRecommend, "1")))
+	assert.Equal(t, "shadow_offline_recommend_digest/1", ShadowKey("shadow_", Key(OfflineRecommendDigest, "1")))
+	assert.Equal(t, Key(PopularItems, "*"), ShadowKey("shadow_", Key(PopularItems, "*")))
+	assert.Equal(t, Key(LastModifyUserTime, "1"), ShadowKey("shadow_", Key(LastModifyUserTime, "1")))
+}
+
+func TestShadow(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	shadow := NewShadow(db.Database, "shadow_")
+
+	// documents of offline recommendation are redirected
+	err := shadow.SetSorted(Key(OfflineRecommend, "1"), []Scored{{"1", 1}})
+	assert.NoError(t, err)
+	err = shadow.Set(String(Key(OfflineRecommendDigest, "1"), "digest"))
+	assert.NoError(t, err)
+	scores, err := db.GetSorted(Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, scores)
+	scores, err = db.GetSorted("shadow_"+Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, scores)
+	scores, err = shadow.GetSorted(Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, scores)
+	digest, err := shadow.Get(Key(OfflineRecommendDigest, "1")).String()
+	assert.NoError(t, err)
+	assert.Equal(t, "digest", digest)
+	documents, err := shadow.ReadDocuments(ReadSorted(Key(OfflineRecommend, "1"), 0, -1))
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, documents[0].Scores)
+	err = shadow.RemSorted(Member(Key(OfflineRecommend, "1"), "1"))
+	assert.NoError(t, err)
+	scores, err = db.GetSorted("shadow_"+Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, scores)
+
+	// other documents are accessed as usual
+	err = shadow.SetSorted(PopularItems, []Scored{{"2", 2}})
+	assert.NoError(t, err)
+	scores, err = db.GetSorted(PopularItems, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"2", 2}}, scores)
+}
+
+func TestPromoteShadow(t *testing.T) {
+	db := newMockInMemory(t)
+	defer db.Close(t)
+	production := NewShadow(db.Database, "")
+	err := production.SetSorted(Key(OfflineRecommend, "1"), []Scored{{"1", 1}})
+	assert.NoError(t, err)
+	err = NewShadow(db.Database, "shadow_").SetSorted(Key(OfflineRecommend, "1"), []Scored{{"2", 2}})
+	assert.NoError(t, err)
+	prefix, err := ProductionPrefix(db.Database)
+	assert.NoError(t, err)
+	assert.Empty(t, prefix)
+	assert.Equal(t, "shadow_", CandidatePrefix(prefix, "shadow_"))
+
+	// shadow recommendation is served after promotion
+	prefix, err = PromoteShadow(production, "shadow_")
+	assert.NoError(t, err)
+	assert.Equal(t, "shadow_", prefix)
+	assert.Equal(t, "shadow_", production.Prefix())
+	scores, err := production.GetSorted(Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"2", 2}}, scores)
+	prefix, err = ProductionPrefix(db.Database)
+	assert.NoError(t, err)
+	assert.Equal(t, "shadow_", prefix)
+	assert.Empty(t, CandidatePrefix(prefix, "shadow_"))
+
+	// production recommendation is restored by promoting again
+	prefix, err = PromoteShadow(production, "shadow_")
+	assert.NoError(t, err)
+	assert.Empty(t, prefix)
+	scores, err = production.GetSorted(Key(OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scored{{"1", 1}}, scores)
+}
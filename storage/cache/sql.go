@@ -15,6 +15,7 @@
 package cache
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
@@ -66,6 +67,12 @@ func (db *SQLDatabase) Close() error {
 	return db.client.Close()
 }
 
+func (db *SQLDatabase) WithContext(ctx context.Context) Database {
+	database := *db
+	database.gormDB = db.gormDB.WithContext(ctx)
+	return &database
+}
+
 func (db *SQLDatabase) Init() error {
 	err := db.gormDB.AutoMigrate(&SQLValue{}, &SQLSet{}, &SQLSortedSet{})
 	return errors.Trace(err)
@@ -330,8 +337,16 @@ func (db *SQLDatabase) RemSortedByScore(key string, begin, end float64) error {
 	return errors.Trace(err)
 }
 
+// SetSorted replaces scores in a sorted set in a transaction, so that readers never see a partially written sorted
+// set.
 func (db *SQLDatabase) SetSorted(key string, scores []Scored) error {
-	err := db.gormDB.Delete(&SQLSortedSet{}, "name = ?", key).Error
+	return db.gormDB.Transaction(func(tx *gorm.DB) error {
+		return setSorted(tx, key, scores)
+	})
+}
+
+func setSorted(tx *gorm.DB, key string, scores []Scored) error {
+	err := tx.Delete(&SQLSortedSet{}, "name = ?", key).Error
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -348,7 +363,7 @@ func (db *SQLDatabase) SetSorted(key string, scores []Scored) error {
 				memberSets[lo.Tuple2[string, string]{key, member.Id}] = struct{}{}
 			}
 		}
-		err = db.gormDB.Clauses(clause.OnConflict{
+		err = tx.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "name"}, {Name: "member"}},
 			DoUpdates: clause.AssignmentColumns([]string{"score"}),
 		}).Create(&rows).Error
@@ -372,3 +387,13 @@ func (db *SQLDatabase) RemSorted(members ...SetMember) error {
 	err := db.gormDB.Delete(rows).Error
 	return errors.Trace(err)
 }
+
+// ReadDocuments executes reads one by one.
+func (db *SQLDatabase) ReadDocuments(reads ...Read) ([]Document, error) {
+	return readDocuments(db, reads)
+}
+
+// WriteDocuments executes writes one by one.
+func (db *SQLDatabase) WriteDocuments(writes ...Write) error {
+	return writeDocuments(db, writes)
+}
@@ -97,6 +97,7 @@ func TestPostgres_Sort(t *testing.T) {
 	db := newTestPostgresDatabase(t)
 	defer db.Close(t)
 	testSort(t, db.Database)
+	testSetSortedIsolation(t, db.Database)
 }
 
 func TestPostgres_Set(t *testing.T) {
@@ -117,6 +118,13 @@ func TestPostgres_Purge(t *testing.T) {
 	testPurge(t, db.Database)
 }
 
+func TestPostgres_ReadDocuments(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
+
 func TestPostgres_Init(t *testing.T) {
 	db := newTestPostgresDatabase(t)
 	defer db.Close(t)
@@ -166,6 +174,7 @@ func TestMySQL_Sort(t *testing.T) {
 	db := newTestMySQLDatabase(t)
 	defer db.Close(t)
 	testSort(t, db.Database)
+	testSetSortedIsolation(t, db.Database)
 }
 
 func TestMySQL_Set(t *testing.T) {
@@ -186,6 +195,13 @@ func TestMySQL_Purge(t *testing.T) {
 	testPurge(t, db.Database)
 }
 
+func TestMySQL_ReadDocuments(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
+
 func TestMySQL_Init(t *testing.T) {
 	db := newTestMySQLDatabase(t)
 	defer db.Close(t)
@@ -252,6 +268,7 @@ func TestOracle_Sort(t *testing.T) {
 	db := newTestOracleDatabase(t)
 	defer db.Close(t)
 	testSort(t, db.Database)
+	testSetSortedIsolation(t, db.Database)
 }
 
 func TestOracle_Set(t *testing.T) {
@@ -272,6 +289,13 @@ func TestOracle_Purge(t *testing.T) {
 	testPurge(t, db.Database)
 }
 
+func TestOracle_ReadDocuments(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
+
 func TestOracle_Init(t *testing.T) {
 	db := newTestOracleDatabase(t)
 	defer db.Close(t)
@@ -321,6 +345,13 @@ func TestSQLite_Purge(t *testing.T) {
 	testPurge(t, db.Database)
 }
 
+func TestSQLite_ReadDocuments(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testReadDocuments(t, db.Database)
+	testWriteDocuments(t, db.Database)
+}
+
 func assertQuery(t *testing.T, connection *sql.DB, sql string, expected string) {
 	rows, err := connection.Query(sql)
 	assert.NoError(t, err)
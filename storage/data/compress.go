@@ -0,0 +1,389 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressedCommentPrefix is the magic prefix of comments compressed by zstd. Compressed bytes are encoded in base64
+// after the prefix, so that compressed comments are valid text in all data stores.
+const CompressedCommentPrefix = "\x01zstd:"
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// CompressComment compresses a comment longer than the threshold in bytes. Comments are returned as they are if the
+// threshold is not positive, they are compressed already, or compression doesn't save space.
+func CompressComment(comment string, threshold int) string {
+	if threshold <= 0 || len(comment) <= threshold || strings.HasPrefix(comment, CompressedCommentPrefix) {
+		return comment
+	}
+	compressed := CompressedCommentPrefix + base64.StdEncoding.EncodeToString(zstdEncoder.EncodeAll([]byte(comment), nil))
+	if len(compressed) >= len(comment) {
+		return comment
+	}
+	return compressed
+}
+
+// DecompressComment decompresses a comment compressed by CompressComment. Comments without the magic prefix or
+// failing to be decompressed are returned as they are.
+func DecompressComment(comment string) string {
+	if !strings.HasPrefix(comment, CompressedCommentPrefix) {
+		return comment
+	}
+	compressed, err := base64.StdEncoding.DecodeString(comment[len(CompressedCommentPrefix):])
+	if err != nil {
+		return comment
+	}
+	decompressed, err := zstdDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return comment
+	}
+	return string(decompressed)
+}
+
+// CommentCompressor compresses comments of items, users and feedback longer than the threshold on writes, and
+// decompresses them on reads. Comments are decompressed even if the threshold is zero, so that compressed rows are
+// still read correctly after compression is disabled.
+type CommentCompressor struct {
+	Database
+	threshold int
+}
+
+// NewCommentCompressor creates a CommentCompressor. Comments are never compressed if the threshold is zero.
+func NewCommentCompressor(db Database, threshold int) *CommentCompressor {
+	return &CommentCompressor{Database: db, threshold: threshold}
+}
+
+func (c *CommentCompressor) WithContext(ctx context.Context) Database {
+	return NewCommentCompressor(WithContext(ctx, c.Database), c.threshold)
+}
+
+func (c *CommentCompressor) compressPatch(comment *string) *string {
+	if comment == nil {
+		return nil
+	}
+	compressed := CompressComment(*comment, c.threshold)
+	return &compressed
+}
+
+func decompressItems(items []Item) []Item {
+	for i := range items {
+		items[i].Comment = DecompressComment(items[i].Comment)
+	}
+	return items
+}
+
+func decompressUsers(users []User) []User {
+	for i := range users {
+		users[i].Comment = DecompressComment(users[i].Comment)
+	}
+	return users
+}
+
+func decompressFeedback(feedback []Feedback) []Feedback {
+	for i := range feedback {
+		feedback[i].Comment = DecompressComment(feedback[i].Comment)
+	}
+	return feedback
+}
+
+// decompressStream decompresses batches of a stream.
+func decompressStream[T any](in chan []T, decompress func([]T) []T) chan []T {
+	out := make(chan []T, cap(in))
+	go func() {
+		defer close(out)
+		for batch := range in {
+			out <- decompress(batch)
+		}
+	}()
+	return out
+}
+
+func (c *CommentCompressor) BatchInsertItems(items []Item) error {
+	compressed := make([]Item, len(items))
+	for i, item := range items {
+		item.Comment = CompressComment(item.Comment, c.threshold)
+		compressed[i] = item
+	}
+	return c.Database.BatchInsertItems(compressed)
+}
+
+func (c *CommentCompressor) BatchGetItems(itemIds []string) ([]Item, []string, error) {
+	items, missing, err := c.Database.BatchGetItems(itemIds)
+	return decompressItems(items), missing, err
+}
+
+func (c *CommentCompressor) SetBatchGetOptions(chunkSize, numJobs int) {
+	SetBatchGetOptions(c.Database, chunkSize, numJobs)
+}
+
+func (c *CommentCompressor) GetItem(itemId string) (Item, error) {
+	item, err := c.Database.GetItem(itemId)
+	item.Comment = DecompressComment(item.Comment)
+	return item, err
+}
+
+func (c *CommentCompressor) ModifyItem(itemId string, patch ItemPatch) error {
+	patch.Comment = c.compressPatch(patch.Comment)
+	return c.Database.ModifyItem(itemId, patch)
+}
+
+func (c *CommentCompressor) BatchModifyItems(itemIds []string, patch ItemPatch) error {
+	patch.Comment = c.compressPatch(patch.Comment)
+	return c.Database.BatchModifyItems(itemIds, patch)
+}
+
+func (c *CommentCompressor) GetItems(cursor string, n int, timeLimit *time.Time) (string, []Item, error) {
+	cursor, items, err := c.Database.GetItems(cursor, n, timeLimit)
+	return cursor, decompressItems(items), err
+}
+
+func (c *CommentCompressor) SampleItems(n int, category string, seed int64) ([]Item, error) {
+	items, err := c.Database.SampleItems(n, category, seed)
+	return decompressItems(items), err
+}
+
+func (c *CommentCompressor) GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedback, error) {
+	feedback, err := c.Database.GetItemFeedback(itemId, feedbackTypes...)
+	return decompressFeedback(feedback), err
+}
+
+func (c *CommentCompressor) BatchInsertUsers(users []User) error {
+	compressed := make([]User, len(users))
+	for i, user := range users {
+		user.Comment = CompressComment(user.Comment, c.threshold)
+		compressed[i] = user
+	}
+	return c.Database.BatchInsertUsers(compressed)
+}
+
+func (c *CommentCompressor) GetUser(userId string) (User, error) {
+	user, err := c.Database.GetUser(userId)
+	user.Comment = DecompressComment(user.Comment)
+	return user, err
+}
+
+func (c *CommentCompressor) ModifyUser(userId string, patch UserPatch) error {
+	patch.Comment = c.compressPatch(patch.Comment)
+	return c.Database.ModifyUser(userId, patch)
+}
+
+func (c *CommentCompressor) GetUsers(cursor string, n int) (string, []User, error) {
+	cursor, users, err := c.Database.GetUsers(cursor, n)
+	return cursor, decompressUsers(users), err
+}
+
+func (c *CommentCompressor) SampleUsers(n int, hasFeedback bool, seed int64) ([]User, error) {
+	users, err := c.Database.SampleUsers(n, hasFeedback, seed)
+	return decompressUsers(users), err
+}
+
+func (c *CommentCompressor) GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]Feedback, error) {
+	feedback, err := c.Database.GetUserFeedback(userId, withFuture, feedbackTypes...)
+	return decompressFeedback(feedback), err
+}
+
+func (c *CommentCompressor) GetUserItemFeedback(userId, itemId string, feedbackTypes ...string) ([]Feedback, error) {
+	feedback, err := c.Database.GetUserItemFeedback(userId, itemId, feedbackTypes...)
+	return decompressFeedback(feedback), err
+}
+
+func (c *CommentCompressor) BatchInsertFeedback(feedback []Feedback, insertUser, insertItem, overwrite bool) error {
+	compressed := make([]Feedback, len(feedback))
+	for i, f := range feedback {
+		f.Comment = CompressComment(f.Comment, c.threshold)
+		compressed[i] = f
+	}
+	return c.Database.BatchInsertFeedback(compressed, insertUser, insertItem, overwrite)
+}
+
+func (c *CommentCompressor) GetFeedback(cursor string, n int, timeLimit *time.Time, feedbackTypes ...string) (string, []Feedback, error) {
+	cursor, feedback, err := c.Database.GetFeedback(cursor, n, timeLimit, feedbackTypes...)
+	return cursor, decompressFeedback(feedback), err
+}
+
+func (c *CommentCompressor) GetUserStream(batchSize int) (chan []User, chan error) {
+	users, errChan := c.Database.GetUserStream(batchSize)
+	return decompressStream(users, decompressUsers), errChan
+}
+
+func (c *CommentCompressor) GetItemStream(batchSize int, timeLimit *time.Time) (chan []Item, chan error) {
+	items, errChan := c.Database.GetItemStream(batchSize, timeLimit)
+	return decompressStream(items, decompressItems), errChan
+}
+
+func (c *CommentCompressor) GetFeedbackStream(batchSize int, timeLimit *time.Time, feedbackTypes ...string) (chan []Feedback, chan error) {
+	feedback, errChan := c.Database.GetFeedbackStream(batchSize, timeLimit, feedbackTypes...)
+	return decompressStream(feedback, decompressFeedback), errChan
+}
+
+func (c *CommentCompressor) GetUserFeedbackStream(userId string, batchSize int) (chan []Feedback, chan error) {
+	feedback, errChan := c.Database.GetUserFeedbackStream(userId, batchSize)
+	return decompressStream(feedback, decompressFeedback), errChan
+}
+
+// The following methods project fields if the underlying database supports projection. Otherwise, all fields are read.
+
+func (c *CommentCompressor) GetItemProjected(itemId string, fields []string) (Item, error) {
+	projector, ok := c.Database.(Projector)
+	if !ok {
+		return c.GetItem(itemId)
+	}
+	item, err := projector.GetItemProjected(itemId, fields)
+	item.Comment = DecompressComment(item.Comment)
+	return item, err
+}
+
+func (c *CommentCompressor) GetItemsProjected(cursor string, n int, timeLimit *time.Time, fields []string) (string, []Item, error) {
+	projector, ok := c.Database.(Projector)
+	if !ok {
+		return c.GetItems(cursor, n, timeLimit)
+	}
+	cursor, items, err := projector.GetItemsProjected(cursor, n, timeLimit, fields)
+	return cursor, decompressItems(items), err
+}
+
+func (c *CommentCompressor) GetUserProjected(userId string, fields []string) (User, error) {
+	projector, ok := c.Database.(Projector)
+	if !ok {
+		return c.GetUser(userId)
+	}
+	user, err := projector.GetUserProjected(userId, fields)
+	user.Comment = DecompressComment(user.Comment)
+	return user, err
+}
+
+func (c *CommentCompressor) GetUsersProjected(cursor string, n int, fields []string) (string, []User, error) {
+	projector, ok := c.Database.(Projector)
+	if !ok {
+		return c.GetUsers(cursor, n)
+	}
+	cursor, users, err := projector.GetUsersProjected(cursor, n, fields)
+	return cursor, decompressUsers(users), err
+}
+
+// CompressionStats are numbers of rows and bytes of comments compressed by CompressComments.
+type CompressionStats struct {
+	Rows        int
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+// Add accumulates compression of a comment.
+func (s *CompressionStats) Add(before, after string) {
+	s.Rows++
+	s.BytesBefore += int64(len(before))
+	s.BytesAfter += int64(len(after))
+}
+
+// CompressComments compresses comments of existing items, users and feedback longer than the threshold in batches.
+// Only comments compressed are written back, and comments compressed already are skipped. Progress is called after
+// each batch with the name of the table and stats of the table so far. Feedback timestamped in the future isn't
+// compressed.
+func CompressComments(db Database, threshold, batchSize int, progress func(table string, stats CompressionStats)) error {
+	// compress comments of items
+	var (
+		cursor string
+		stats  CompressionStats
+	)
+	for {
+		var (
+			items []Item
+			err   error
+		)
+		cursor, items, err = db.GetItems(cursor, batchSize, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, item := range items {
+			if compressed := CompressComment(item.Comment, threshold); compressed != item.Comment {
+				if err = db.ModifyItem(item.ItemId, ItemPatch{Comment: &compressed}); err != nil {
+					return errors.Trace(err)
+				}
+				stats.Add(item.Comment, compressed)
+			}
+		}
+		progress("items", stats)
+		if cursor == "" {
+			break
+		}
+	}
+
+	// compress comments of users
+	stats = CompressionStats{}
+	for {
+		var (
+			users []User
+			err   error
+		)
+		cursor, users, err = db.GetUsers(cursor, batchSize)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, user := range users {
+			if compressed := CompressComment(user.Comment, threshold); compressed != user.Comment {
+				if err = db.ModifyUser(user.UserId, UserPatch{Comment: &compressed}); err != nil {
+					return errors.Trace(err)
+				}
+				stats.Add(user.Comment, compressed)
+			}
+		}
+		progress("users", stats)
+		if cursor == "" {
+			break
+		}
+	}
+
+	// compress comments of feedback, which are replaced by feedback with the same timestamps
+	stats = CompressionStats{}
+	for {
+		var (
+			feedback []Feedback
+			err      error
+		)
+		cursor, feedback, err = db.GetFeedback(cursor, batchSize, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		var compressed []Feedback
+		for _, f := range feedback {
+			if comment := CompressComment(f.Comment, threshold); comment != f.Comment {
+				stats.Add(f.Comment, comment)
+				f.Comment = comment
+				compressed = append(compressed, f)
+			}
+		}
+		if len(compressed) > 0 {
+			if err = db.BatchInsertFeedback(compressed, false, false, true); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		progress("feedback", stats)
+		if cursor == "" {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressComment(t *testing.T) {
+	large := strings.Repeat(`{"key":"value"}`, 100)
+	compressed := CompressComment(large, 100)
+	assert.True(t, strings.HasPrefix(compressed, CompressedCommentPrefix))
+	assert.Less(t, len(compressed), len(large))
+	assert.Equal(t, large, DecompressComment(compressed))
+	// comments are compressed once
+	assert.Equal(t, compressed, CompressComment(compressed, 100))
+	// short comments and disabled compression
+	assert.Equal(t, "short", CompressComment("short", 100))
+	assert.Equal(t, large, CompressComment(large, 0))
+	// uncompressed comments and broken compressed comments
+	assert.Equal(t, "plain", DecompressComment("plain"))
+	assert.Equal(t, CompressedCommentPrefix+"!", DecompressComment(CompressedCommentPrefix+"!"))
+}
+
+func TestCommentCompressor(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	large := strings.Repeat("comment ", 100)
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// rows written before compression is enabled
+	assert.NoError(t, db.BatchInsertItems([]Item{{ItemId: "0", Comment: large, Timestamp: timestamp}}))
+	assert.NoError(t, db.BatchInsertUsers([]User{{UserId: "0", Comment: large}}))
+
+	// compressed and uncompressed rows are read correctly
+	compressor := NewCommentCompressor(db.Database, 100)
+	assert.NoError(t, compressor.BatchInsertItems([]Item{{ItemId: "1", Comment: large, Timestamp: timestamp}}))
+	assert.NoError(t, compressor.BatchInsertUsers([]User{{UserId: "1", Comment: large}}))
+	assert.NoError(t, compressor.BatchInsertFeedback([]Feedback{{
+		FeedbackKey: FeedbackKey{FeedbackType: "star", UserId: "1", ItemId: "1"},
+		Comment:     large,
+		Timestamp:   timestamp,
+	}}, false, false, true))
+	item, err := db.GetItem("1")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(item.Comment, CompressedCommentPrefix))
+	_, items, err := compressor.GetItems("", 10, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{large, large}, []string{items[0].Comment, items[1].Comment})
+	user, err := compressor.GetUser("1")
+	assert.NoError(t, err)
+	assert.Equal(t, large, user.Comment)
+	feedback, err := compressor.GetUserFeedback("1", true)
+	assert.NoError(t, err)
+	if assert.Len(t, feedback, 1) {
+		assert.Equal(t, large, feedback[0].Comment)
+	}
+	itemStream, errChan := compressor.GetItemStream(1, nil)
+	for batch := range itemStream {
+		for _, item := range batch {
+			assert.Equal(t, large, item.Comment)
+		}
+	}
+	assert.NoError(t, <-errChan)
+
+	// patches are compressed
+	comment := large + "patched"
+	assert.NoError(t, compressor.ModifyItem("0", ItemPatch{Comment: &comment}))
+	item, err = db.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, comment, DecompressComment(item.Comment))
+	assert.NotEqual(t, comment, item.Comment)
+}
+
+func TestCompressComments(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	large := strings.Repeat("comment ", 100)
+	assert.NoError(t, db.BatchInsertItems([]Item{{ItemId: "0", Comment: large}, {ItemId: "1", Comment: "short"}}))
+	assert.NoError(t, db.BatchInsertUsers([]User{{UserId: "0", Comment: large}}))
+	assert.NoError(t, db.BatchInsertFeedback([]Feedback{{
+		FeedbackKey: FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "0"},
+		Comment:     large,
+	}}, false, false, true))
+
+	stats := make(map[string]CompressionStats)
+	assert.NoError(t, CompressComments(db.Database, 100, 1, func(table string, s CompressionStats) {
+		stats[table] = s
+	}))
+	for _, table := range []string{"items", "users", "feedback"} {
+		assert.Equal(t, 1, stats[table].Rows, table)
+		assert.Equal(t, int64(len(large)), stats[table].BytesBefore, table)
+		assert.Less(t, stats[table].BytesAfter, stats[table].BytesBefore, table)
+	}
+	item, err := db.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, large, DecompressComment(item.Comment))
+	assert.NotEqual(t, large, item.Comment)
+	item, err = db.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "short", item.Comment)
+	feedback, err := db.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	if assert.Len(t, feedback, 1) {
+		assert.Equal(t, large, DecompressComment(feedback[0].Comment))
+		assert.NotEqual(t, large, feedback[0].Comment)
+	}
+
+	// compressed comments are skipped
+	stats = make(map[string]CompressionStats)
+	assert.NoError(t, CompressComments(db.Database, 100, 10, func(table string, s CompressionStats) {
+		stats[table] = s
+	}))
+	assert.Zero(t, stats["items"].Rows)
+}
@@ -17,11 +17,15 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"github.com/dzwvip/oracle"
 	"github.com/go-redis/redis/v8"
 	"github.com/juju/errors"
 	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
 	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/base/parallel"
 	"github.com/zhenghaoz/gorse/storage"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -32,6 +36,8 @@ import (
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"hash/fnv"
+	"math/rand"
 	"moul.io/zapgorm2"
 	"net/url"
 	"sort"
@@ -40,9 +46,12 @@ import (
 )
 
 var (
-	ErrUserNotExist = errors.NotFoundf("user")
-	ErrItemNotExist = errors.NotFoundf("item")
-	ErrNoDatabase   = errors.NotAssignedf("database")
+	ErrUserNotExist      = errors.NotFoundf("user")
+	ErrItemNotExist      = errors.NotFoundf("item")
+	ErrOverridesNotExist = errors.NotFoundf("overrides")
+	ErrNoDatabase        = errors.NotAssignedf("database")
+	// ErrConflict means an item or a user has been modified since the version given by a patch.
+	ErrConflict = errors.New("version conflict")
 )
 
 // Item stores meta data about item.
@@ -53,6 +62,52 @@ type Item struct {
 	Timestamp  time.Time
 	Labels     []string `gorm:"serializer:json"`
 	Comment    string
+	// VisibleFrom and VisibleUntil bound the period during which the item could be recommended.
+	// A nil bound is open.
+	VisibleFrom  *time.Time
+	VisibleUntil *time.Time
+	// HiddenReason is the reason why the item is hidden by gorse, such as HiddenReasonLowQuality. It is empty if the
+	// item is hidden by users.
+	HiddenReason string `json:",omitempty"`
+	// CreatedAt is the time when the item was inserted for the first time, which is set by data stores and hidden from
+	// the API. It is zero if the item was inserted before the time was recorded.
+	CreatedAt time.Time `json:"-" bson:",omitempty"`
+}
+
+// HiddenReasonLowQuality means the item is hidden by the quality gate.
+const HiddenReasonLowQuality = "low_quality"
+
+// Fields of item time used to order latest items.
+const (
+	ItemTimeTimestamp = "timestamp"  // the time given by users, such as the time of publication
+	ItemTimeCreatedAt = "created_at" // the time when the item was inserted into the data store
+)
+
+// Time returns the time of the item by a field of item time. Items without creation time fall back to Timestamp.
+func (item *Item) Time(field string) time.Time {
+	if field == ItemTimeCreatedAt && !item.CreatedAt.IsZero() {
+		return item.CreatedAt
+	}
+	return item.Timestamp
+}
+
+// Version returns the version of the item, which is a hash of its content. The version changes once the item is
+// modified, and it doesn't depend on how the data store encodes the item.
+func (item *Item) Version() string {
+	return contentVersion(item.ItemId, item.IsHidden, versionStrings(item.Categories), versionTime(&item.Timestamp),
+		versionStrings(item.Labels), DecompressComment(item.Comment), versionTime(item.VisibleFrom),
+		versionTime(item.VisibleUntil), item.HiddenReason)
+}
+
+// IsVisibleAt returns true if the visibility window of the item contains the given time.
+func (item *Item) IsVisibleAt(now time.Time) bool {
+	if item.VisibleFrom != nil && now.Before(*item.VisibleFrom) {
+		return false
+	}
+	if item.VisibleUntil != nil && !now.Before(*item.VisibleUntil) {
+		return false
+	}
+	return true
 }
 
 // ItemPatch is the modification on an item.
@@ -62,6 +117,165 @@ type ItemPatch struct {
 	Timestamp  *time.Time
 	Labels     []string
 	Comment    *string
+	// VisibleFrom and VisibleUntil set the visibility window. A zero time removes the bound.
+	VisibleFrom  *time.Time
+	VisibleUntil *time.Time
+	HiddenReason *string
+	// AddLabels, RemoveLabels, AddCategories and RemoveCategories add or remove individual elements atomically without
+	// replacing the whole array. They are applied after Labels and Categories, and removal is applied after addition.
+	AddLabels        []string
+	RemoveLabels     []string
+	AddCategories    []string
+	RemoveCategories []string
+	// Version makes the modification conditional. ErrConflict is returned if the item isn't at the version. The item is
+	// modified regardless of its version if it is empty.
+	Version string `json:",omitempty"`
+}
+
+// IsEmpty returns true if the patch modifies nothing.
+func (patch *ItemPatch) IsEmpty() bool {
+	return patch.IsHidden == nil && patch.Categories == nil && patch.Labels == nil && patch.Comment == nil &&
+		patch.Timestamp == nil && patch.VisibleFrom == nil && patch.VisibleUntil == nil && patch.HiddenReason == nil &&
+		!patch.hasArrayOperations()
+}
+
+// hasArrayOperations returns true if the patch adds or removes elements of arrays.
+func (patch *ItemPatch) hasArrayOperations() bool {
+	return len(patch.AddLabels) > 0 || len(patch.RemoveLabels) > 0 || len(patch.AddCategories) > 0 ||
+		len(patch.RemoveCategories) > 0
+}
+
+// Apply applies the patch to an item.
+func (patch *ItemPatch) Apply(item Item) Item {
+	if patch.IsHidden != nil {
+		item.IsHidden = *patch.IsHidden
+	}
+	if patch.Categories != nil {
+		item.Categories = patch.Categories
+	}
+	if patch.Comment != nil {
+		item.Comment = *patch.Comment
+	}
+	if patch.Labels != nil {
+		item.Labels = patch.Labels
+	}
+	if patch.Timestamp != nil {
+		item.Timestamp = *patch.Timestamp
+	}
+	if patch.VisibleFrom != nil {
+		item.VisibleFrom = patch.VisibleFrom
+	}
+	if patch.VisibleUntil != nil {
+		item.VisibleUntil = patch.VisibleUntil
+	}
+	if patch.HiddenReason != nil {
+		item.HiddenReason = *patch.HiddenReason
+	}
+	item.Labels = PatchArray(item.Labels, patch.AddLabels, patch.RemoveLabels)
+	item.Categories = PatchArray(item.Categories, patch.AddCategories, patch.RemoveCategories)
+	return item
+}
+
+// checkVersion returns ErrConflict if the patch is conditional and the item isn't at the version of the patch.
+func (patch *ItemPatch) checkVersion(item Item) error {
+	if patch.Version != "" && patch.Version != item.Version() {
+		return errors.Annotate(ErrConflict, item.ItemId)
+	}
+	return nil
+}
+
+// PatchArray adds and removes elements of an array. Existing elements keep their order and new elements are appended.
+func PatchArray(values, add, remove []string) []string {
+	if len(add) == 0 && len(remove) == 0 {
+		return values
+	}
+	exist := strset.New(remove...)
+	patched := make([]string, 0, len(values)+len(add))
+	for _, value := range append(append([]string{}, values...), add...) {
+		if !exist.Has(value) {
+			exist.Add(value)
+			patched = append(patched, value)
+		}
+	}
+	return patched
+}
+
+// contentVersion hashes values of an item or a user into a version.
+func contentVersion(values ...any) string {
+	h := fnv.New64a()
+	for _, value := range values {
+		data, _ := json.Marshal(value)
+		_, _ = h.Write(data)
+		_, _ = h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// versionStrings treats nil and empty arrays the same in versions.
+func versionStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// versionTime treats times at the same instant the same in versions regardless of locations.
+func versionTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	return lo.ToPtr(t.UTC().Format(time.RFC3339Nano))
+}
+
+// utcTime normalizes an optional time to UTC. A zero time is treated as absent.
+func utcTime(t *time.Time) *time.Time {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	utc := t.In(time.UTC)
+	return &utc
+}
+
+// CategoryCount is the number of items in a category.
+type CategoryCount struct {
+	Name  string
+	Count int
+}
+
+// SortCategoryCounts sorts categories by name.
+func SortCategoryCounts(categories []CategoryCount) {
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Name < categories[j].Name
+	})
+}
+
+// LabelCount is the number of items and users with a label.
+type LabelCount struct {
+	Name     string
+	NumItems int
+	NumUsers int
+}
+
+// MergeLabelCounts merges numbers of items and users with labels into label counts sorted by name.
+func MergeLabelCounts(itemCounts, userCounts map[string]int) []LabelCount {
+	labels := make(map[string]*LabelCount)
+	for name, count := range itemCounts {
+		labels[name] = &LabelCount{Name: name, NumItems: count}
+	}
+	for name, count := range userCounts {
+		if _, exist := labels[name]; !exist {
+			labels[name] = &LabelCount{Name: name}
+		}
+		labels[name].NumUsers = count
+	}
+	counts := make([]LabelCount, 0, len(labels))
+	for _, label := range labels {
+		counts = append(counts, *label)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Name < counts[j].Name
+	})
+	return counts
 }
 
 // User stores meta data about user.
@@ -72,11 +286,199 @@ type User struct {
 	Comment   string
 }
 
+// Version returns the version of the user, which is a hash of its content. The version changes once the user is
+// modified, and it doesn't depend on how the data store encodes the user.
+func (user *User) Version() string {
+	return contentVersion(user.UserId, versionStrings(user.Labels), versionStrings(user.Subscribe),
+		DecompressComment(user.Comment))
+}
+
 // UserPatch is the modification on a user.
 type UserPatch struct {
 	Labels    []string
 	Subscribe []string
 	Comment   *string
+	// AddLabels, RemoveLabels, AddSubscribe and RemoveSubscribe add or remove individual elements atomically without
+	// replacing the whole array. They are applied after Labels and Subscribe, and removal is applied after addition.
+	AddLabels       []string
+	RemoveLabels    []string
+	AddSubscribe    []string
+	RemoveSubscribe []string
+	// Version makes the modification conditional. ErrConflict is returned if the user isn't at the version. The user is
+	// modified regardless of its version if it is empty.
+	Version string `json:",omitempty"`
+}
+
+// IsEmpty returns true if the patch modifies nothing.
+func (patch *UserPatch) IsEmpty() bool {
+	return patch.Labels == nil && patch.Subscribe == nil && patch.Comment == nil && !patch.hasArrayOperations()
+}
+
+// hasArrayOperations returns true if the patch adds or removes elements of arrays.
+func (patch *UserPatch) hasArrayOperations() bool {
+	return len(patch.AddLabels) > 0 || len(patch.RemoveLabels) > 0 || len(patch.AddSubscribe) > 0 ||
+		len(patch.RemoveSubscribe) > 0
+}
+
+// checkVersion returns ErrConflict if the patch is conditional and the user isn't at the version of the patch.
+func (patch *UserPatch) checkVersion(user User) error {
+	if patch.Version != "" && patch.Version != user.Version() {
+		return errors.Annotate(ErrConflict, user.UserId)
+	}
+	return nil
+}
+
+// Apply applies the patch to a user.
+func (patch *UserPatch) Apply(user User) User {
+	if patch.Comment != nil {
+		user.Comment = *patch.Comment
+	}
+	if patch.Labels != nil {
+		user.Labels = patch.Labels
+	}
+	if patch.Subscribe != nil {
+		user.Subscribe = patch.Subscribe
+	}
+	user.Labels = PatchArray(user.Labels, patch.AddLabels, patch.RemoveLabels)
+	user.Subscribe = PatchArray(user.Subscribe, patch.AddSubscribe, patch.RemoveSubscribe)
+	return user
+}
+
+// PinnedItem is an item pinned at a position (starting from 1) in recommendations of a user.
+type PinnedItem struct {
+	ItemId   string
+	Position int
+	// ExpireTime is the time when the pin expires. Zero means never.
+	ExpireTime time.Time
+}
+
+// BlockedItem is an item never recommended to a user.
+type BlockedItem struct {
+	ItemId string
+	// ExpireTime is the time when the block expires. Zero means never.
+	ExpireTime time.Time
+}
+
+// UserOverrides are manual overrides applied to recommendations of a user.
+type UserOverrides struct {
+	UserId  string
+	Pinned  []PinnedItem
+	Blocked []BlockedItem
+}
+
+// IsEmpty returns true if there are neither pinned items nor blocked items.
+func (overrides *UserOverrides) IsEmpty() bool {
+	return len(overrides.Pinned) == 0 && len(overrides.Blocked) == 0
+}
+
+// RemoveExpired removes pinned items and blocked items expired before now.
+// It returns true if any override is removed.
+func (overrides *UserOverrides) RemoveExpired(now time.Time) bool {
+	n := len(overrides.Pinned) + len(overrides.Blocked)
+	overrides.Pinned = lo.Filter(overrides.Pinned, func(item PinnedItem, _ int) bool {
+		return item.ExpireTime.IsZero() || item.ExpireTime.After(now)
+	})
+	overrides.Blocked = lo.Filter(overrides.Blocked, func(item BlockedItem, _ int) bool {
+		return item.ExpireTime.IsZero() || item.ExpireTime.After(now)
+	})
+	return len(overrides.Pinned)+len(overrides.Blocked) < n
+}
+
+// ItemCanonical maps a near-duplicate item to the canonical item of its cluster.
+type ItemCanonical struct {
+	ItemId      string `gorm:"column:item_id"`
+	CanonicalId string `gorm:"column:canonical_id"`
+}
+
+func sortItemCanonicals(canonicals map[string]string) []ItemCanonical {
+	result := make([]ItemCanonical, 0, len(canonicals))
+	for itemId, canonicalId := range canonicals {
+		result = append(result, ItemCanonical{ItemId: itemId, CanonicalId: canonicalId})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ItemId < result[j].ItemId
+	})
+	return result
+}
+
+// AuditLog is a record of a mutating API call. Ids of audit logs begin with their timestamps, so that audit logs are
+// ordered by ids.
+type AuditLog struct {
+	Id        string
+	Timestamp time.Time
+	Actor     string   // hash of the API key or the user of the dashboard
+	Endpoint  string   // method and path of the route
+	Entities  []string // affected entities such as "user/1" and "item/2"
+	Summary   string
+}
+
+// NewAuditLogId creates the id of an audit log written at a time.
+func NewAuditLogId(timestamp time.Time) string {
+	return auditLogIdPrefix(timestamp) + fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// auditLogIdPrefix returns the prefix of ids of audit logs written at a time. Audit logs written before the time have
+// smaller ids than the prefix.
+func auditLogIdPrefix(timestamp time.Time) string {
+	return fmt.Sprintf("%016x", timestamp.UnixNano())
+}
+
+// match returns true if the audit log affects the entity and is written by the actor. Empty entity or actor matches
+// all audit logs.
+func (auditLog *AuditLog) match(entity, actor string) bool {
+	if actor != "" && auditLog.Actor != actor {
+		return false
+	}
+	return entity == "" || lo.Contains(auditLog.Entities, entity)
+}
+
+// RecommendSnapshot is recommendation served to a user in a time bucket, so that recommendation seen by the user in the
+// past could be reproduced. Snapshots are identified by users and buckets, and only the latest recommendation served
+// to a user in a bucket is kept.
+type RecommendSnapshot struct {
+	UserId    string
+	Category  string            // category of recommendation, empty for all items
+	Timestamp time.Time         // beginning of the time bucket
+	Items     []string          // served items in order
+	Tags      map[string]string // provenance of recommendation, such as headers of the response
+}
+
+// SortRecommendSnapshots sorts snapshots of recommendation from the oldest to the latest.
+func SortRecommendSnapshots(snapshots []RecommendSnapshot) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.Before(snapshots[j].Timestamp)
+	})
+}
+
+// Usage is a figure of usage in a day, such as the number of requests to an endpoint or the size of a table.
+type Usage struct {
+	Day    string `gorm:"column:day"` // day in UTC formatted as 2006-01-02
+	Metric string `gorm:"column:metric"`
+	Value  int64  `gorm:"column:amount"`
+}
+
+// SortUsage sorts figures of usage by days and metrics.
+func SortUsage(usage []Usage) {
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Day != usage[j].Day {
+			return usage[i].Day < usage[j].Day
+		}
+		return usage[i].Metric < usage[j].Metric
+	})
+}
+
+// tableNames returns names of tables with the prefix by names of tables without the prefix.
+func tableNames(tp storage.TablePrefix) map[string]string {
+	return map[string]string{
+		"users":               tp.UsersTable(),
+		"items":               tp.ItemsTable(),
+		"feedback":            tp.FeedbackTable(),
+		"user_overrides":      tp.UserOverridesTable(),
+		"item_canonicals":     tp.ItemCanonicalsTable(),
+		"audit_logs":          tp.AuditLogsTable(),
+		"daily_usage":         tp.DailyUsageTable(),
+		"recommend_snapshots": tp.RecommendSnapshotsTable(),
+	}
 }
 
 // FeedbackKey identifies feedback.
@@ -89,8 +491,9 @@ type FeedbackKey struct {
 // Feedback stores feedback.
 type Feedback struct {
 	FeedbackKey `gorm:"embedded"`
-	Timestamp   time.Time `gorm:"column:time_stamp"`
-	Comment     string    `gorm:"column:comment"`
+	Timestamp   time.Time         `gorm:"column:time_stamp"`
+	Comment     string            `gorm:"column:comment"`
+	Context     map[string]string `gorm:"column:context;serializer:json" json:",omitempty"`
 }
 
 // SortFeedbacks sorts feedback from latest to oldest.
@@ -116,27 +519,189 @@ type Database interface {
 	Init() error
 	Close() error
 	Optimize() error
+	// Purge deletes all data except audit logs and usage.
 	Purge() error
 	BatchInsertItems(items []Item) error
-	BatchGetItems(itemIds []string) ([]Item, error)
+	// BatchGetItems returns items in the order of ids and ids of items which don't exist.
+	BatchGetItems(itemIds []string) ([]Item, []string, error)
 	DeleteItem(itemId string) error
 	GetItem(itemId string) (Item, error)
 	ModifyItem(itemId string, patch ItemPatch) error
+	BatchModifyItems(itemIds []string, patch ItemPatch) error
 	GetItems(cursor string, n int, timeLimit *time.Time) (string, []Item, error)
 	GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedback, error)
+	// GetCategories returns categories and numbers of items in them, including hidden items.
+	GetCategories() ([]CategoryCount, error)
+	// CountItems returns the number of items, including hidden items.
+	CountItems() (int, error)
+	// GetLabels returns labels and numbers of items and users with them.
+	GetLabels() ([]LabelCount, error)
+	// SampleItems returns at most n random items which aren't hidden, in the category if it isn't empty. The same items
+	// are sampled under the same seed as long as items are unchanged, except in MongoDB.
+	SampleItems(n int, category string, seed int64) ([]Item, error)
+	// SampleUsers returns at most n random users, with feedback only if hasFeedback is true. The same users are sampled
+	// under the same seed as long as users and feedback are unchanged, except in MongoDB.
+	SampleUsers(n int, hasFeedback bool, seed int64) ([]User, error)
 	BatchInsertUsers(users []User) error
 	DeleteUser(userId string) error
 	GetUser(userId string) (User, error)
 	ModifyUser(userId string, patch UserPatch) error
 	GetUsers(cursor string, n int) (string, []User, error)
+	// CountUsers returns the number of users.
+	CountUsers() (int, error)
+	// GetUserFeedback returns feedback of a user. Feedback timestamped after now is excluded unless withFuture is true,
+	// while feedback timestamped exactly now is included.
 	GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]Feedback, error)
 	GetUserItemFeedback(userId, itemId string, feedbackTypes ...string) ([]Feedback, error)
 	DeleteUserItemFeedback(userId, itemId string, feedbackTypes ...string) (int, error)
+	// DeleteUserFeedbackInRange deletes feedback of a user timestamped in [begin, end) and returns the number of deleted
+	// feedback. A nil begin or end means the range is open on that side.
+	DeleteUserFeedbackInRange(userId string, begin, end *time.Time, feedbackTypes ...string) (int, error)
+	// BatchInsertFeedback inserts feedback. If overwrite is true, stored feedback is replaced by incoming feedback with
+	// the same or a later timestamp, so that feedback arriving out of order never rolls back newer feedback. Otherwise,
+	// stored feedback is kept.
 	BatchInsertFeedback(feedback []Feedback, insertUser, insertItem, overwrite bool) error
 	GetFeedback(cursor string, n int, timeLimit *time.Time, feedbackTypes ...string) (string, []Feedback, error)
 	GetUserStream(batchSize int) (chan []User, chan error)
 	GetItemStream(batchSize int, timeLimit *time.Time) (chan []Item, chan error)
 	GetFeedbackStream(batchSize int, timeLimit *time.Time, feedbackTypes ...string) (chan []Feedback, chan error)
+	// GetUserFeedbackStream reads feedback of a user (including future feedback) by stream.
+	GetUserFeedbackStream(userId string, batchSize int) (chan []Feedback, chan error)
+	SetUserOverrides(overrides UserOverrides) error
+	GetUserOverrides(userId string) (UserOverrides, error)
+	DeleteUserOverrides(userId string) error
+	GetUserOverridesStream(batchSize int) (chan []UserOverrides, chan error)
+	// BatchInsertItemCanonicals inserts or replaces canonical items of near-duplicate items.
+	BatchInsertItemCanonicals(canonicals []ItemCanonical) error
+	GetItemCanonicals() ([]ItemCanonical, error)
+	DeleteItemCanonicals(itemIds []string) error
+	InsertAuditLogs(auditLogs []AuditLog) error
+	// GetAuditLogs returns audit logs from the latest to the oldest, starting from the cursor. Audit logs are filtered by
+	// the entity and the actor if they aren't empty.
+	GetAuditLogs(cursor string, n int, entity, actor string) (string, []AuditLog, error)
+	// DeleteAuditLogs deletes audit logs written before a time.
+	DeleteAuditLogs(before time.Time) error
+	// BatchInsertUsage inserts or replaces figures of usage.
+	BatchInsertUsage(usage []Usage) error
+	// GetUsage returns figures of usage from one day to another day (both inclusive) ordered by days and metrics.
+	GetUsage(from, to string) ([]Usage, error)
+	// BatchInsertRecommendSnapshots inserts or replaces snapshots of recommendation.
+	BatchInsertRecommendSnapshots(snapshots []RecommendSnapshot) error
+	// GetRecommendSnapshots returns snapshots of recommendation of a user from the oldest to the latest.
+	GetRecommendSnapshots(userId string) ([]RecommendSnapshot, error)
+	// DeleteRecommendSnapshots deletes snapshots of recommendation in time buckets beginning before a time.
+	DeleteRecommendSnapshots(before time.Time) error
+	// GetTableSizes returns bytes of tables on disk by names of tables without the prefix. errors.NotSupported is
+	// returned if sizes of tables are unavailable.
+	GetTableSizes() (map[string]int64, error)
+}
+
+// Projector is implemented by databases reading only some fields of items and users, so that large fields such as
+// comments are never read if they aren't needed. Fields are names of fields of Item or User, and fields not read are
+// zero values. All fields are read if fields are empty.
+type Projector interface {
+	GetItemProjected(itemId string, fields []string) (Item, error)
+	GetItemsProjected(cursor string, n int, timeLimit *time.Time, fields []string) (string, []Item, error)
+	GetUserProjected(userId string, fields []string) (User, error)
+	GetUsersProjected(cursor string, n int, fields []string) (string, []User, error)
+}
+
+// ContextDatabase is implemented by databases whose requests could be cancelled.
+type ContextDatabase interface {
+	// WithContext returns a copy of the database sharing connections, whose requests are cancelled once the context
+	// is done.
+	WithContext(ctx context.Context) Database
+}
+
+// WithContext returns a copy of the database whose requests are cancelled once the context is done. The database is
+// returned as it is if requests to it couldn't be cancelled.
+func WithContext(ctx context.Context, database Database) Database {
+	if contextDatabase, ok := database.(ContextDatabase); ok {
+		return contextDatabase.WithContext(ctx)
+	}
+	return database
+}
+
+// requestContext is the context of requests to a database, which is the background context if it is not set.
+type requestContext struct {
+	ctx context.Context
+}
+
+func (c requestContext) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Default options of fetching items in batches.
+const (
+	DefaultBatchGetChunkSize = 1000
+	DefaultBatchGetJobs      = 4
+)
+
+// BatchDatabase is implemented by databases fetching items in batches by chunks of ids.
+type BatchDatabase interface {
+	// SetBatchGetOptions sets the max number of ids in a chunk and the max number of chunks fetched concurrently.
+	SetBatchGetOptions(chunkSize, numJobs int)
+}
+
+// SetBatchGetOptions sets options of fetching items in batches if the database fetches items by chunks of ids.
+func SetBatchGetOptions(database Database, chunkSize, numJobs int) {
+	if batchDatabase, ok := database.(BatchDatabase); ok {
+		batchDatabase.SetBatchGetOptions(chunkSize, numJobs)
+	}
+}
+
+// batchGetOptions are options of fetching items in batches, default options are used if they are not set.
+type batchGetOptions struct {
+	chunkSize int
+	numJobs   int
+}
+
+func (o *batchGetOptions) SetBatchGetOptions(chunkSize, numJobs int) {
+	o.chunkSize, o.numJobs = chunkSize, numJobs
+}
+
+// batchGetItems splits ids into chunks and fetches chunks in parallel. Found items are returned in the order of ids,
+// followed by ids which are not found. Duplicate ids are fetched once.
+func (o batchGetOptions) batchGetItems(itemIds []string, fetch func(chunk []string) ([]Item, error)) ([]Item, []string, error) {
+	if len(itemIds) == 0 {
+		return nil, nil, nil
+	}
+	chunkSize, numJobs := o.chunkSize, o.numJobs
+	if chunkSize <= 0 {
+		chunkSize = DefaultBatchGetChunkSize
+	}
+	if numJobs <= 0 {
+		numJobs = DefaultBatchGetJobs
+	}
+	itemIds = lo.Uniq(itemIds)
+	chunks := lo.Chunk(itemIds, chunkSize)
+	results := make([][]Item, len(chunks))
+	if err := parallel.Parallel(len(chunks), lo.Min([]int{numJobs, len(chunks)}), func(_, jobId int) error {
+		var err error
+		results[jobId], err = fetch(chunks[jobId])
+		return errors.Trace(err)
+	}); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	found := make(map[string]Item, len(itemIds))
+	for _, result := range results {
+		for _, item := range result {
+			found[item.ItemId] = item
+		}
+	}
+	items := make([]Item, 0, len(found))
+	var missing []string
+	for _, itemId := range itemIds {
+		if item, exist := found[itemId]; exist {
+			items = append(items, item)
+		} else {
+			missing = append(missing, itemId)
+		}
+	}
+	return items, missing, nil
 }
 
 // Open a connection to a database.
@@ -249,7 +814,7 @@ func Open(path, tablePrefix string) (Database, error) {
 		return database, nil
 	} else if strings.HasPrefix(path, storage.RedisPrefix) {
 		if strings.Contains(path, ",") {
-			addrsSlice := strings.Split(path, ",")
+			addrsSlice := strings.Split(strings.TrimPrefix(path, storage.RedisPrefix), ",")
 			var addrs []string
 			for _, addr := range addrsSlice {
 				if addr != "" {
@@ -20,8 +20,11 @@ import (
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/protobuf/proto"
+	"math/rand"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -96,6 +99,15 @@ func getItemStream(t *testing.T, db Database, batchSize int) []Item {
 	return items
 }
 
+// withoutCreatedAt checks that items have creation time and clears it for comparison.
+func withoutCreatedAt(t *testing.T, items ...Item) []Item {
+	for i := range items {
+		assert.False(t, items[i].CreatedAt.IsZero(), items[i].ItemId)
+		items[i].CreatedAt = time.Time{}
+	}
+	return items
+}
+
 func getFeedback(t *testing.T, db Database, batchSize int, feedbackTypes ...string) []Feedback {
 	feedback := make([]Feedback, 0)
 	var err error
@@ -201,11 +213,11 @@ func testFeedback(t *testing.T, db Database) {
 	assert.NoError(t, err)
 	// insert feedbacks
 	feedback := []Feedback{
-		{FeedbackKey{positiveFeedbackType, "0", "8"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "1", "6"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "2", "4"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "3", "2"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "4", "0"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
+		{FeedbackKey{positiveFeedbackType, "0", "8"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", map[string]string{"device": "mobile"}},
+		{FeedbackKey{positiveFeedbackType, "1", "6"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "2", "4"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", map[string]string{"device": "desktop", "placement": "home"}},
+		{FeedbackKey{positiveFeedbackType, "3", "2"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "4", "0"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
 	}
 	err = db.BatchInsertFeedback(feedback, true, true, true)
 	assert.NoError(t, err)
@@ -216,11 +228,11 @@ func testFeedback(t *testing.T, db Database) {
 	assert.NoError(t, err)
 	// future feedback
 	futureFeedback := []Feedback{
-		{FeedbackKey{duplicateFeedbackType, "0", "0"}, time.Now().Add(time.Hour), "comment"},
-		{FeedbackKey{duplicateFeedbackType, "1", "2"}, time.Now().Add(time.Hour), "comment"},
-		{FeedbackKey{duplicateFeedbackType, "2", "4"}, time.Now().Add(time.Hour), "comment"},
-		{FeedbackKey{duplicateFeedbackType, "3", "6"}, time.Now().Add(time.Hour), "comment"},
-		{FeedbackKey{duplicateFeedbackType, "4", "8"}, time.Now().Add(time.Hour), "comment"},
+		{FeedbackKey{duplicateFeedbackType, "0", "0"}, time.Now().Add(time.Hour), "comment", nil},
+		{FeedbackKey{duplicateFeedbackType, "1", "2"}, time.Now().Add(time.Hour), "comment", nil},
+		{FeedbackKey{duplicateFeedbackType, "2", "4"}, time.Now().Add(time.Hour), "comment", nil},
+		{FeedbackKey{duplicateFeedbackType, "3", "6"}, time.Now().Add(time.Hour), "comment", nil},
+		{FeedbackKey{duplicateFeedbackType, "4", "8"}, time.Now().Add(time.Hour), "comment", nil},
 	}
 	err = db.BatchInsertFeedback(futureFeedback, true, true, true)
 	assert.NoError(t, err)
@@ -270,7 +282,7 @@ func testFeedback(t *testing.T, db Database) {
 	// check items that already exists
 	item, err := db.GetItem("0")
 	assert.NoError(t, err)
-	assert.Equal(t, Item{ItemId: "0", Labels: []string{"b"}, Timestamp: time.Date(1996, 4, 8, 10, 0, 0, 0, time.UTC)}, item)
+	assert.Equal(t, []Item{{ItemId: "0", Labels: []string{"b"}, Timestamp: time.Date(1996, 4, 8, 10, 0, 0, 0, time.UTC)}}, withoutCreatedAt(t, item))
 	// Get typed feedback by user
 	ret, err = db.GetUserFeedback("2", false, positiveFeedbackType)
 	assert.NoError(t, err)
@@ -281,6 +293,17 @@ func testFeedback(t *testing.T, db Database) {
 	ret, err = db.GetUserFeedback("2", false)
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(ret))
+	// Get feedback stream by user
+	expected, err := db.GetUserFeedback("2", true)
+	assert.NoError(t, err)
+	var feedbackOfUser []Feedback
+	feedbackChan, errChan := db.GetUserFeedbackStream("2", 1)
+	for batchFeedback := range feedbackChan {
+		assert.Len(t, batchFeedback, 1)
+		feedbackOfUser = append(feedbackOfUser, batchFeedback...)
+	}
+	assert.NoError(t, <-errChan)
+	assert.ElementsMatch(t, expected, feedbackOfUser)
 	// Get typed feedback by item
 	ret, err = db.GetItemFeedback("4", positiveFeedbackType)
 	assert.NoError(t, err)
@@ -294,6 +317,7 @@ func testFeedback(t *testing.T, db Database) {
 	// test override
 	err = db.BatchInsertFeedback([]Feedback{{
 		FeedbackKey: FeedbackKey{positiveFeedbackType, "0", "8"},
+		Timestamp:   time.Date(1996, 3, 16, 0, 0, 0, 0, time.UTC),
 		Comment:     "override",
 	}}, true, true, true)
 	assert.NoError(t, err)
@@ -303,6 +327,7 @@ func testFeedback(t *testing.T, db Database) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(ret))
 	assert.Equal(t, "override", ret[0].Comment)
+	assert.Nil(t, ret[0].Context)
 	// test not overwrite
 	err = db.BatchInsertFeedback([]Feedback{{
 		FeedbackKey: FeedbackKey{positiveFeedbackType, "0", "8"},
@@ -399,20 +424,21 @@ func testItems(t *testing.T, db Database) {
 	assert.NoError(t, err)
 	// Get items
 	totalItems := getItems(t, db, 3)
-	assert.Equal(t, items, totalItems)
+	assert.Equal(t, items, withoutCreatedAt(t, totalItems...))
 	// Get item stream
 	itemsFromStream := getItemStream(t, db, 3)
-	assert.ElementsMatch(t, items, itemsFromStream)
+	assert.ElementsMatch(t, items, withoutCreatedAt(t, itemsFromStream...))
 	// Get item
 	for _, item := range items {
 		ret, err := db.GetItem(item.ItemId)
 		assert.NoError(t, err)
-		assert.Equal(t, item, ret)
+		assert.Equal(t, []Item{item}, withoutCreatedAt(t, ret))
 	}
 	// batch get items
-	batchItem, err := db.BatchGetItems([]string{"2", "6"})
+	batchItem, missing, err := db.BatchGetItems([]string{"6", "2", "7"})
 	assert.NoError(t, err)
-	assert.Equal(t, []Item{items[1], items[3]}, batchItem)
+	assert.Equal(t, []Item{items[3], items[1]}, withoutCreatedAt(t, batchItem...))
+	assert.Equal(t, []string{"7"}, missing)
 	// Delete item
 	err = db.DeleteItem("0")
 	assert.NoError(t, err)
@@ -420,16 +446,21 @@ func testItems(t *testing.T, db Database) {
 	assert.True(t, errors.Is(err, errors.NotFound), err)
 
 	// test override
-	err = db.BatchInsertItems([]Item{{ItemId: "4", IsHidden: false, Categories: []string{"b"}, Labels: []string{"o"}, Comment: "override"}})
+	item, err := db.GetItem("4")
+	assert.NoError(t, err)
+	createdAt := item.CreatedAt
+	err = db.BatchInsertItems([]Item{{ItemId: "4", IsHidden: false, Categories: []string{"b"}, Labels: []string{"o"}, Comment: "override", CreatedAt: time.Now()}})
 	assert.NoError(t, err)
 	err = db.Optimize()
 	assert.NoError(t, err)
-	item, err := db.GetItem("4")
+	item, err = db.GetItem("4")
 	assert.NoError(t, err)
 	assert.False(t, item.IsHidden)
 	assert.Equal(t, []string{"b"}, item.Categories)
 	assert.Equal(t, []string{"o"}, item.Labels)
 	assert.Equal(t, "override", item.Comment)
+	// creation time is kept after override
+	assert.Equal(t, createdAt, item.CreatedAt)
 
 	// test modify
 	timestamp := time.Date(2000, 1, 1, 1, 1, 1, 0, time.UTC)
@@ -453,11 +484,79 @@ func testItems(t *testing.T, db Database) {
 	assert.Equal(t, []string{"a", "b", "c"}, item.Labels)
 	assert.Equal(t, timestamp, item.Timestamp)
 
+	// test batch modify
+	err = db.BatchModifyItems([]string{"2", "4"}, ItemPatch{IsHidden: proto.Bool(false), Comment: proto.String("batch")})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	items, _, err = db.BatchGetItems([]string{"2", "4"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(items))
+	for _, item := range items {
+		assert.False(t, item.IsHidden)
+		assert.Equal(t, "batch", item.Comment)
+	}
+	err = db.BatchModifyItems([]string{"2", "4"}, ItemPatch{IsHidden: proto.Bool(true), HiddenReason: proto.String(HiddenReasonLowQuality)})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	items, _, err = db.BatchGetItems([]string{"2", "4"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(items))
+	for _, item := range items {
+		assert.True(t, item.IsHidden)
+		assert.Equal(t, HiddenReasonLowQuality, item.HiddenReason)
+	}
+	err = db.BatchModifyItems([]string{"2", "4"}, ItemPatch{IsHidden: proto.Bool(false), HiddenReason: proto.String("")})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+
+	// test visibility window across daylight saving time transitions
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	visibleFrom := time.Date(2022, 3, 13, 1, 30, 0, 0, newYork)
+	visibleUntil := time.Date(2022, 11, 6, 3, 0, 0, 0, newYork)
+	err = db.ModifyItem("2", ItemPatch{VisibleFrom: &visibleFrom, VisibleUntil: &visibleUntil})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	item, err = db.GetItem("2")
+	assert.NoError(t, err)
+	if assert.NotNil(t, item.VisibleFrom) && assert.NotNil(t, item.VisibleUntil) {
+		assert.Equal(t, time.Date(2022, 3, 13, 6, 30, 0, 0, time.UTC), *item.VisibleFrom)
+		assert.Equal(t, time.Date(2022, 11, 6, 8, 0, 0, 0, time.UTC), *item.VisibleUntil)
+	}
+	assert.False(t, item.IsVisibleAt(time.Date(2022, 3, 13, 1, 29, 0, 0, newYork)))
+	assert.True(t, item.IsVisibleAt(time.Date(2022, 3, 13, 3, 0, 0, 0, newYork)))
+	assert.True(t, item.IsVisibleAt(time.Date(2022, 11, 6, 7, 59, 0, 0, time.UTC)))
+	assert.False(t, item.IsVisibleAt(time.Date(2022, 11, 6, 8, 0, 0, 0, time.UTC)))
+	// clear visibility window
+	err = db.ModifyItem("2", ItemPatch{VisibleFrom: &time.Time{}})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	item, err = db.GetItem("2")
+	assert.NoError(t, err)
+	assert.Nil(t, item.VisibleFrom)
+	assert.NotNil(t, item.VisibleUntil)
+	// insert visibility window
+	err = db.BatchInsertItems([]Item{{ItemId: "4", VisibleUntil: &visibleUntil}})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	items, _, err = db.BatchGetItems([]string{"4"})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(items)) && assert.NotNil(t, items[0].VisibleUntil) {
+		assert.Nil(t, items[0].VisibleFrom)
+		assert.Equal(t, time.Date(2022, 11, 6, 8, 0, 0, 0, time.UTC), *items[0].VisibleUntil)
+	}
+
 	// test insert empty
 	err = db.BatchInsertItems(nil)
 	assert.NoError(t, err)
 	// test get empty
-	items, err = db.BatchGetItems(nil)
+	items, _, err = db.BatchGetItems(nil)
 	assert.NoError(t, err)
 	assert.Empty(t, items)
 
@@ -469,11 +568,11 @@ func testItems(t *testing.T, db Database) {
 func testDeleteUser(t *testing.T, db Database) {
 	// Insert ret
 	feedback := []Feedback{
-		{FeedbackKey{positiveFeedbackType, "a", "0"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "a", "2"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "a", "4"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "a", "6"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "a", "8"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
+		{FeedbackKey{positiveFeedbackType, "a", "0"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "a", "2"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "a", "4"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "a", "6"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "a", "8"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
 	}
 	err := db.BatchInsertFeedback(feedback, true, true, true)
 	assert.NoError(t, err)
@@ -493,11 +592,11 @@ func testDeleteUser(t *testing.T, db Database) {
 func testDeleteItem(t *testing.T, db Database) {
 	// Insert ret
 	feedbacks := []Feedback{
-		{FeedbackKey{positiveFeedbackType, "0", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "1", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "2", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "3", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{positiveFeedbackType, "4", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
+		{FeedbackKey{positiveFeedbackType, "0", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "1", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "2", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "3", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{positiveFeedbackType, "4", "b"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
 	}
 	err := db.BatchInsertFeedback(feedbacks, true, true, true)
 	assert.NoError(t, err)
@@ -514,13 +613,630 @@ func testDeleteItem(t *testing.T, db Database) {
 	assert.Empty(t, ret)
 }
 
+func testCategories(t *testing.T, db Database) {
+	err := db.BatchInsertItems([]Item{
+		{ItemId: "0", Categories: []string{"a", "b"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "1", Categories: []string{"a"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "2", IsHidden: true, Categories: []string{"c"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "3", Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+	})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	categories, err := db.GetCategories()
+	assert.NoError(t, err)
+	assert.Equal(t, []CategoryCount{{"a", 2}, {"b", 1}, {"c", 1}}, categories)
+	// modify categories
+	err = db.ModifyItem("1", ItemPatch{Categories: []string{"b", "c"}})
+	assert.NoError(t, err)
+	err = db.DeleteItem("2")
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	categories, err = db.GetCategories()
+	assert.NoError(t, err)
+	assert.Equal(t, []CategoryCount{{"a", 1}, {"b", 2}, {"c", 1}}, categories)
+}
+
+func testLabels(t *testing.T, db Database) {
+	err := db.BatchInsertItems([]Item{
+		{ItemId: "0", Labels: []string{"a", "b"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "1", Labels: []string{"a"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "2", Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+	})
+	assert.NoError(t, err)
+	err = db.BatchInsertUsers([]User{
+		{UserId: "0", Labels: []string{"b", "c"}},
+		{UserId: "1"},
+	})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	labels, err := db.GetLabels()
+	assert.NoError(t, err)
+	assert.Equal(t, []LabelCount{
+		{Name: "a", NumItems: 2},
+		{Name: "b", NumItems: 1, NumUsers: 1},
+		{Name: "c", NumUsers: 1},
+	}, labels)
+}
+
+func testPatchArrays(t *testing.T, db Database) {
+	err := db.BatchInsertItems([]Item{
+		{ItemId: "0", Labels: []string{"a", "b"}, Categories: []string{"x"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{ItemId: "1", Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+	})
+	assert.NoError(t, err)
+	err = db.BatchInsertUsers([]User{{UserId: "0", Labels: []string{"a"}, Subscribe: []string{"x", "y"}}})
+	assert.NoError(t, err)
+	// add and remove elements of items
+	err = db.ModifyItem("0", ItemPatch{AddLabels: []string{"b", "c", "c"}, RemoveLabels: []string{"a"}, AddCategories: []string{"y"}})
+	assert.NoError(t, err)
+	err = db.BatchModifyItems([]string{"0", "1"}, ItemPatch{AddLabels: []string{"d"}, RemoveCategories: []string{"x"}, Comment: proto.String("$comment")})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	item, err := db.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, item.Labels)
+	assert.Equal(t, []string{"y"}, item.Categories)
+	assert.Equal(t, "$comment", item.Comment)
+	item, err = db.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d"}, item.Labels)
+	assert.Empty(t, item.Categories)
+	// replace and then add elements
+	err = db.ModifyItem("0", ItemPatch{Labels: []string{"e"}, AddLabels: []string{"f"}})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	item, err = db.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e", "f"}, item.Labels)
+	// add and remove elements of users
+	err = db.ModifyUser("0", UserPatch{AddLabels: []string{"b"}, AddSubscribe: []string{"z"}, RemoveSubscribe: []string{"x"}})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	user, err := db.GetUser("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, user.Labels)
+	assert.Equal(t, []string{"y", "z"}, user.Subscribe)
+}
+
+func testConcurrentPatchArrays(t *testing.T, db Database) {
+	err := db.BatchInsertItems([]Item{{ItemId: "0", Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)}})
+	assert.NoError(t, err)
+	err = db.BatchInsertUsers([]User{{UserId: "0"}})
+	assert.NoError(t, err)
+	// concurrent additions of different elements survive
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, db.ModifyItem("0", ItemPatch{AddLabels: []string{strconv.Itoa(i)}, AddCategories: []string{strconv.Itoa(i)}}))
+			assert.NoError(t, db.ModifyUser("0", UserPatch{AddLabels: []string{strconv.Itoa(i)}}))
+		}(i)
+	}
+	wg.Wait()
+	expected := make([]string, n)
+	for i := range expected {
+		expected[i] = strconv.Itoa(i)
+	}
+	item, err := db.GetItem("0")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expected, item.Labels)
+	assert.ElementsMatch(t, expected, item.Categories)
+	user, err := db.GetUser("0")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expected, user.Labels)
+}
+
+func testModifyConflict(t *testing.T, db Database) {
+	err := db.BatchInsertItems([]Item{{ItemId: "0", Labels: []string{"a"}, Comment: "comment", Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)}})
+	assert.NoError(t, err)
+	err = db.BatchInsertUsers([]User{{UserId: "0", Labels: []string{"a"}, Comment: "comment"}})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	// modify items at the current version
+	item, err := db.GetItem("0")
+	assert.NoError(t, err)
+	version := item.Version()
+	err = db.ModifyItem("0", ItemPatch{Comment: proto.String("modified"), Version: version})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	item, err = db.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, "modified", item.Comment)
+	assert.NotEqual(t, version, item.Version())
+	// modify items at a stale version
+	err = db.ModifyItem("0", ItemPatch{AddLabels: []string{"b"}, Version: version})
+	assert.True(t, errors.Is(err, ErrConflict))
+	err = db.ModifyItem("1", ItemPatch{Comment: proto.String("modified"), Version: version})
+	assert.True(t, errors.Is(err, errors.NotFound))
+	// modify items regardless of versions
+	err = db.ModifyItem("0", ItemPatch{AddLabels: []string{"b"}})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	item, err = db.GetItem("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, item.Labels)
+
+	// modify users at the current version
+	user, err := db.GetUser("0")
+	assert.NoError(t, err)
+	version = user.Version()
+	err = db.ModifyUser("0", UserPatch{AddLabels: []string{"b"}, Version: version})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	user, err = db.GetUser("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, user.Labels)
+	// modify users at a stale version
+	err = db.ModifyUser("0", UserPatch{Comment: proto.String("modified"), Version: version})
+	assert.True(t, errors.Is(err, ErrConflict))
+	err = db.ModifyUser("1", UserPatch{Comment: proto.String("modified"), Version: version})
+	assert.True(t, errors.Is(err, errors.NotFound))
+	user, err = db.GetUser("0")
+	assert.NoError(t, err)
+	assert.Equal(t, "comment", user.Comment)
+}
+
+func testBatchGetItems(t *testing.T, db Database) {
+	var items []Item
+	for i := 0; i < 10; i++ {
+		items = append(items, Item{ItemId: strconv.Itoa(i), Labels: []string{"a"}, Categories: []string{"b"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)})
+	}
+	err := db.BatchInsertItems(items)
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	// items are fetched by chunks in parallel and returned in the order of ids
+	SetBatchGetOptions(db, 3, 2)
+	result, missing, err := db.BatchGetItems([]string{"9", "x", "1", "5", "1", "y", "0", "7", "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Item{items[9], items[1], items[5], items[0], items[7], items[3]}, withoutCreatedAt(t, result...))
+	assert.Equal(t, []string{"x", "y"}, missing)
+	// all items are missing
+	result, missing, err = db.BatchGetItems([]string{"x", "y"})
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+	assert.Equal(t, []string{"x", "y"}, missing)
+}
+
+// benchmarkBatchGetItems fetches batches of 10k items.
+func benchmarkBatchGetItems(b *testing.B, db Database) {
+	const numItems = 10000
+	itemIds := make([]string, numItems)
+	items := make([]Item, numItems)
+	for i := range items {
+		itemIds[i] = strconv.Itoa(i)
+		items[i] = Item{ItemId: itemIds[i], Labels: []string{"a", "b"}, Categories: []string{"c"}, Timestamp: time.Now()}
+	}
+	err := db.BatchInsertItems(items)
+	assert.NoError(b, err)
+	err = db.Optimize()
+	assert.NoError(b, err)
+	for _, chunkSize := range []int{numItems, DefaultBatchGetChunkSize} {
+		b.Run(fmt.Sprintf("ChunkSize=%d", chunkSize), func(b *testing.B) {
+			SetBatchGetOptions(db, chunkSize, DefaultBatchGetJobs)
+			for i := 0; i < b.N; i++ {
+				result, _, err := db.BatchGetItems(itemIds)
+				assert.NoError(b, err)
+				assert.Equal(b, numItems, len(result))
+			}
+		})
+	}
+}
+
+func testSample(t *testing.T, db Database, reproducible bool) {
+	var items []Item
+	var users []User
+	for i := 0; i < 20; i++ {
+		items = append(items, Item{
+			ItemId:     strconv.Itoa(i),
+			IsHidden:   i%4 == 0,
+			Categories: []string{strconv.Itoa(i % 2)},
+			Timestamp:  time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC),
+		})
+		users = append(users, User{UserId: strconv.Itoa(i)})
+	}
+	err := db.BatchInsertItems(items)
+	assert.NoError(t, err)
+	err = db.BatchInsertUsers(users)
+	assert.NoError(t, err)
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{positiveFeedbackType, "1", "1"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{FeedbackKey: FeedbackKey{positiveFeedbackType, "3", "1"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{FeedbackKey: FeedbackKey{negativeFeedbackType, "3", "2"}, Timestamp: time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)},
+	}, false, false, true)
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+
+	// sample items which aren't hidden
+	sampled, err := db.SampleItems(5, "", 1)
+	assert.NoError(t, err)
+	assert.Len(t, sampled, 5)
+	for _, item := range sampled {
+		assert.False(t, item.IsHidden)
+	}
+	assert.Len(t, lo.UniqBy(sampled, func(item Item) string { return item.ItemId }), 5)
+	if reproducible {
+		again, err := db.SampleItems(5, "", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, sampled, again)
+	}
+	// sample items in a category
+	sampled, err = db.SampleItems(100, "1", 2)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1", "3", "5", "7", "9", "11", "13", "15", "17", "19"},
+		lo.Map(sampled, func(item Item, _ int) string { return item.ItemId }))
+	sampled, err = db.SampleItems(100, "0", 2)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"2", "6", "10", "14", "18"},
+		lo.Map(sampled, func(item Item, _ int) string { return item.ItemId }))
+
+	// sample users
+	sampledUsers, err := db.SampleUsers(5, false, 1)
+	assert.NoError(t, err)
+	assert.Len(t, sampledUsers, 5)
+	assert.Len(t, lo.UniqBy(sampledUsers, func(user User) string { return user.UserId }), 5)
+	if reproducible {
+		again, err := db.SampleUsers(5, false, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, sampledUsers, again)
+	}
+	// sample users with feedback
+	sampledUsers, err = db.SampleUsers(100, true, 1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1", "3"}, lo.Map(sampledUsers, func(user User, _ int) string { return user.UserId }))
+}
+
+func testItemCanonicals(t *testing.T, db Database) {
+	// insert canonicals
+	err := db.BatchInsertItemCanonicals([]ItemCanonical{
+		{ItemId: "1", CanonicalId: "0"},
+		{ItemId: "2", CanonicalId: "0"},
+		{ItemId: "4", CanonicalId: "3"},
+	})
+	assert.NoError(t, err)
+	canonicals, err := db.GetItemCanonicals()
+	assert.NoError(t, err)
+	assert.Equal(t, []ItemCanonical{
+		{ItemId: "1", CanonicalId: "0"},
+		{ItemId: "2", CanonicalId: "0"},
+		{ItemId: "4", CanonicalId: "3"},
+	}, canonicals)
+	// replace canonicals
+	err = db.BatchInsertItemCanonicals([]ItemCanonical{{ItemId: "2", CanonicalId: "3"}})
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	canonicals, err = db.GetItemCanonicals()
+	assert.NoError(t, err)
+	assert.Equal(t, []ItemCanonical{
+		{ItemId: "1", CanonicalId: "0"},
+		{ItemId: "2", CanonicalId: "3"},
+		{ItemId: "4", CanonicalId: "3"},
+	}, canonicals)
+	// delete canonicals
+	err = db.DeleteItemCanonicals([]string{"2", "4"})
+	assert.NoError(t, err)
+	canonicals, err = db.GetItemCanonicals()
+	assert.NoError(t, err)
+	assert.Equal(t, []ItemCanonical{{ItemId: "1", CanonicalId: "0"}}, canonicals)
+}
+
+func testAuditLogs(t *testing.T, db Database) {
+	timestamp := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	auditLogs := make([]AuditLog, 5)
+	for i := range auditLogs {
+		auditLogs[i] = AuditLog{
+			Id:        NewAuditLogId(timestamp.Add(time.Duration(i) * time.Second)),
+			Timestamp: timestamp.Add(time.Duration(i) * time.Second),
+			Actor:     []string{"a", "b"}[i%2],
+			Endpoint:  "POST /api/items",
+			Entities:  []string{"item/" + strconv.Itoa(i), "item/" + strconv.Itoa(i+1)},
+			Summary:   "insert items",
+		}
+	}
+	err := db.InsertAuditLogs(auditLogs)
+	assert.NoError(t, err)
+	getAuditLogs := func(cursor string, n int, entity, actor string) (string, []AuditLog) {
+		cursor, result, err := db.GetAuditLogs(cursor, n, entity, actor)
+		assert.NoError(t, err)
+		for i := range result {
+			result[i].Timestamp = result[i].Timestamp.In(time.UTC)
+		}
+		return cursor, result
+	}
+	// get audit logs from the latest to the oldest
+	cursor, result := getAuditLogs("", 2, "", "")
+	assert.Equal(t, []AuditLog{auditLogs[4], auditLogs[3]}, result)
+	cursor, result = getAuditLogs(cursor, 2, "", "")
+	assert.Equal(t, []AuditLog{auditLogs[2], auditLogs[1]}, result)
+	cursor, result = getAuditLogs(cursor, 2, "", "")
+	assert.Equal(t, []AuditLog{auditLogs[0]}, result)
+	assert.Empty(t, cursor)
+	// filter by actor
+	cursor, result = getAuditLogs("", 2, "", "a")
+	assert.Equal(t, []AuditLog{auditLogs[4], auditLogs[2]}, result)
+	cursor, result = getAuditLogs(cursor, 2, "", "a")
+	assert.Equal(t, []AuditLog{auditLogs[0]}, result)
+	assert.Empty(t, cursor)
+	// filter by entity
+	_, result = getAuditLogs("", 10, "item/2", "")
+	assert.Equal(t, []AuditLog{auditLogs[2], auditLogs[1]}, result)
+	_, result = getAuditLogs("", 10, "item/2", "b")
+	assert.Equal(t, []AuditLog{auditLogs[1]}, result)
+
+	// audit logs are kept after purge
+	err = db.Purge()
+	assert.NoError(t, err)
+	_, result = getAuditLogs("", 10, "", "")
+	assert.Len(t, result, 5)
+	// delete expired audit logs
+	err = db.DeleteAuditLogs(timestamp.Add(2 * time.Second))
+	assert.NoError(t, err)
+	_, result = getAuditLogs("", 10, "", "")
+	assert.Equal(t, []AuditLog{auditLogs[4], auditLogs[3], auditLogs[2]}, result)
+}
+
+func testUsage(t *testing.T, db Database) {
+	err := db.BatchInsertUsage([]Usage{
+		{Day: "2022-10-02", Metric: "users", Value: 20},
+		{Day: "2022-10-01", Metric: "users", Value: 10},
+		{Day: "2022-10-01", Metric: "requests:GET /api/user/{user-id}", Value: 100},
+		{Day: "2022-10-03", Metric: "users", Value: 30},
+	})
+	assert.NoError(t, err)
+	// figures of usage are replaced
+	err = db.BatchInsertUsage([]Usage{{Day: "2022-10-02", Metric: "users", Value: 21}})
+	assert.NoError(t, err)
+	usage, err := db.GetUsage("2022-10-01", "2022-10-02")
+	assert.NoError(t, err)
+	assert.Equal(t, []Usage{
+		{Day: "2022-10-01", Metric: "requests:GET /api/user/{user-id}", Value: 100},
+		{Day: "2022-10-01", Metric: "users", Value: 10},
+		{Day: "2022-10-02", Metric: "users", Value: 21},
+	}, usage)
+
+	// usage is kept after purge
+	err = db.Purge()
+	assert.NoError(t, err)
+	usage, err = db.GetUsage("2022-10-03", "2022-10-03")
+	assert.NoError(t, err)
+	assert.Equal(t, []Usage{{Day: "2022-10-03", Metric: "users", Value: 30}}, usage)
+}
+
+func testRecommendSnapshots(t *testing.T, db Database) {
+	timestamp := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	err := db.BatchInsertRecommendSnapshots([]RecommendSnapshot{
+		{UserId: "0", Timestamp: timestamp.Add(time.Hour), Items: []string{"1", "2"}, Tags: map[string]string{"a": "1"}},
+		{UserId: "0", Timestamp: timestamp, Items: []string{"3", "4"}, Tags: map[string]string{"b": "2"}},
+		{UserId: "1", Timestamp: timestamp, Items: []string{"5"}, Tags: map[string]string{}},
+	})
+	assert.NoError(t, err)
+	// snapshots in the same time bucket are replaced
+	err = db.BatchInsertRecommendSnapshots([]RecommendSnapshot{
+		{UserId: "0", Category: "c", Timestamp: timestamp.Add(2 * time.Hour), Items: []string{"6"}, Tags: map[string]string{}},
+		{UserId: "0", Category: "c", Timestamp: timestamp.Add(time.Hour), Items: []string{"7", "8"}, Tags: map[string]string{"c": "3"}},
+	})
+	assert.NoError(t, err)
+	snapshots, err := db.GetRecommendSnapshots("0")
+	assert.NoError(t, err)
+	assert.Equal(t, []RecommendSnapshot{
+		{UserId: "0", Timestamp: timestamp, Items: []string{"3", "4"}, Tags: map[string]string{"b": "2"}},
+		{UserId: "0", Category: "c", Timestamp: timestamp.Add(time.Hour), Items: []string{"7", "8"}, Tags: map[string]string{"c": "3"}},
+		{UserId: "0", Category: "c", Timestamp: timestamp.Add(2 * time.Hour), Items: []string{"6"}, Tags: map[string]string{}},
+	}, snapshots)
+
+	// snapshots in time buckets beginning before a time are deleted
+	err = db.DeleteRecommendSnapshots(timestamp.Add(time.Hour))
+	assert.NoError(t, err)
+	snapshots, err = db.GetRecommendSnapshots("0")
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 2)
+	assert.Equal(t, timestamp.Add(time.Hour), snapshots[0].Timestamp)
+	snapshots, err = db.GetRecommendSnapshots("1")
+	assert.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	// snapshots are removed by purge
+	err = db.Purge()
+	assert.NoError(t, err)
+	snapshots, err = db.GetRecommendSnapshots("0")
+	assert.NoError(t, err)
+	assert.Empty(t, snapshots)
+}
+
+func testFutureFeedback(t *testing.T, db Database) {
+	now := time.Now().Truncate(time.Second)
+	err := db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{positiveFeedbackType, "future", "past"}, Timestamp: now.Add(-time.Hour)},
+		{FeedbackKey: FeedbackKey{positiveFeedbackType, "future", "now"}, Timestamp: now},
+		{FeedbackKey: FeedbackKey{positiveFeedbackType, "future", "soon"}, Timestamp: now.Add(time.Minute)},
+		{FeedbackKey: FeedbackKey{positiveFeedbackType, "future", "later"}, Timestamp: now.Add(time.Hour)},
+	}, true, true, true)
+	assert.NoError(t, err)
+	// feedback timestamped now is visible while feedback timestamped after now is not
+	feedback, err := db.GetUserFeedback("future", false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"past", "now"}, lo.Map(feedback, func(f Feedback, _ int) string { return f.ItemId }))
+	feedback, err = db.GetItemFeedback("now")
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+	feedback, err = db.GetItemFeedback("soon")
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+	// all feedback is visible with future feedback
+	feedback, err = db.GetUserFeedback("future", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"past", "now", "soon", "later"}, lo.Map(feedback, func(f Feedback, _ int) string { return f.ItemId }))
+}
+
+func testFeedbackOutOfOrder(t *testing.T, db Database) {
+	now := time.Now().Truncate(time.Second)
+	key := FeedbackKey{positiveFeedbackType, "0", "0"}
+	// insert the newest feedback
+	err := db.BatchInsertFeedback([]Feedback{{FeedbackKey: key, Timestamp: now, Comment: "newest"}}, true, true, true)
+	assert.NoError(t, err)
+	// outdated feedback is ignored
+	err = db.BatchInsertFeedback([]Feedback{{FeedbackKey: key, Timestamp: now.Add(-time.Hour), Comment: "outdated"}}, true, true, true)
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	feedback, err := db.GetUserItemFeedback("0", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, []Feedback{{FeedbackKey: key, Timestamp: now, Comment: "newest"}}, lo.Map(feedback, func(f Feedback, _ int) Feedback {
+		f.Timestamp = f.Timestamp.In(now.Location())
+		return f
+	}))
+	// feedback out of order in a batch
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: key, Timestamp: now.Add(2 * time.Hour), Comment: "latest"},
+		{FeedbackKey: key, Timestamp: now.Add(time.Hour), Comment: "later"},
+	}, true, true, true)
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	feedback, err = db.GetUserItemFeedback("0", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, []Feedback{{FeedbackKey: key, Timestamp: now.Add(2 * time.Hour), Comment: "latest"}}, lo.Map(feedback, func(f Feedback, _ int) Feedback {
+		f.Timestamp = f.Timestamp.In(now.Location())
+		return f
+	}))
+	// feedback with the same timestamp is overwritten
+	err = db.BatchInsertFeedback([]Feedback{{FeedbackKey: key, Timestamp: now.Add(2 * time.Hour), Comment: "replayed"}}, true, true, true)
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	feedback, err = db.GetUserItemFeedback("0", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"replayed"}, lo.Map(feedback, func(f Feedback, _ int) string { return f.Comment }))
+}
+
+func testConcurrentFeedbackOutOfOrder(t *testing.T, db Database) {
+	now := time.Now().Truncate(time.Second)
+	key := FeedbackKey{positiveFeedbackType, "0", "0"}
+	err := db.BatchInsertFeedback([]Feedback{{FeedbackKey: key, Timestamp: now}}, true, true, true)
+	assert.NoError(t, err)
+	// concurrent inserts in random order never overwrite newer feedback
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for _, i := range rand.Perm(n) {
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, db.BatchInsertFeedback([]Feedback{{
+				FeedbackKey: key,
+				Timestamp:   now.Add(time.Duration(i) * time.Second),
+				Comment:     strconv.Itoa(i),
+			}}, true, true, true))
+		}(i)
+	}
+	wg.Wait()
+	err = db.Optimize()
+	assert.NoError(t, err)
+	feedback, err := db.GetUserItemFeedback("0", "0")
+	assert.NoError(t, err)
+	if assert.Len(t, feedback, 1) {
+		assert.Equal(t, strconv.Itoa(n-1), feedback[0].Comment)
+		assert.Equal(t, now.Add((n-1)*time.Second).Unix(), feedback[0].Timestamp.Unix())
+	}
+}
+
+func testCount(t *testing.T, db Database) {
+	// count empty tables
+	count, err := db.CountUsers()
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+	count, err = db.CountItems()
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+	// insert users and items
+	err = db.BatchInsertUsers([]User{{UserId: "0"}, {UserId: "1"}, {UserId: "2"}})
+	assert.NoError(t, err)
+	err = db.BatchInsertItems([]Item{{ItemId: "0"}, {ItemId: "1"}, {ItemId: "2", IsHidden: true}, {ItemId: "3"}})
+	assert.NoError(t, err)
+	// replaced users and items are counted once
+	err = db.BatchInsertUsers([]User{{UserId: "0", Comment: "replaced"}})
+	assert.NoError(t, err)
+	err = db.BatchInsertItems([]Item{{ItemId: "0", Comment: "replaced"}})
+	assert.NoError(t, err)
+	// feedback doesn't affect counts
+	err = db.BatchInsertFeedback([]Feedback{{FeedbackKey: FeedbackKey{positiveFeedbackType, "0", "0"}}}, false, false, true)
+	assert.NoError(t, err)
+	count, err = db.CountUsers()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = db.CountItems()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+}
+
+func testUserOverrides(t *testing.T, db Database) {
+	// get missing overrides
+	_, err := db.GetUserOverrides("0")
+	assert.True(t, errors.Is(err, errors.NotFound))
+	// set overrides
+	overrides := UserOverrides{
+		UserId: "0",
+		Pinned: []PinnedItem{
+			{ItemId: "1", Position: 1},
+			{ItemId: "2", Position: 3, ExpireTime: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		Blocked: []BlockedItem{
+			{ItemId: "3", ExpireTime: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	err = db.SetUserOverrides(overrides)
+	assert.NoError(t, err)
+	err = db.SetUserOverrides(UserOverrides{UserId: "1", Blocked: []BlockedItem{{ItemId: "4"}}})
+	assert.NoError(t, err)
+	ret, err := db.GetUserOverrides("0")
+	assert.NoError(t, err)
+	assert.Equal(t, overrides, ret)
+	// replace overrides
+	overrides.Pinned = overrides.Pinned[:1]
+	err = db.SetUserOverrides(overrides)
+	assert.NoError(t, err)
+	err = db.Optimize()
+	assert.NoError(t, err)
+	ret, err = db.GetUserOverrides("0")
+	assert.NoError(t, err)
+	assert.Equal(t, overrides, ret)
+	// stream overrides
+	var userIds []string
+	overridesChan, errChan := db.GetUserOverridesStream(1)
+	for batch := range overridesChan {
+		for _, overrides := range batch {
+			userIds = append(userIds, overrides.UserId)
+		}
+	}
+	assert.NoError(t, <-errChan)
+	assert.ElementsMatch(t, []string{"0", "1"}, userIds)
+	// delete overrides
+	err = db.DeleteUserOverrides("0")
+	assert.NoError(t, err)
+	_, err = db.GetUserOverrides("0")
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
+
 func testDeleteFeedback(t *testing.T, db Database) {
 	feedbacks := []Feedback{
-		{FeedbackKey{"type1", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type2", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type3", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type1", "2", "4"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type1", "1", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
+		{FeedbackKey{"type1", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type2", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type3", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type1", "2", "4"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type1", "1", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
 	}
 	err := db.BatchInsertFeedback(feedbacks, true, true, true)
 	assert.NoError(t, err)
@@ -552,6 +1268,38 @@ func testDeleteFeedback(t *testing.T, db Database) {
 	ret, err = db.GetUserItemFeedback("1", "3", feedbackType2)
 	assert.NoError(t, err)
 	assert.Empty(t, ret)
+
+	// delete feedback of a user in a time range
+	feedbacks = []Feedback{
+		{FeedbackKey{"type1", "5", "1"}, time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC), "", nil},
+		{FeedbackKey{"type1", "5", "2"}, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), "", nil},
+		{FeedbackKey{"type2", "5", "3"}, time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC), "", nil},
+		{FeedbackKey{"type1", "5", "4"}, time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC), "", nil},
+		{FeedbackKey{"type1", "6", "2"}, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), "", nil},
+	}
+	err = db.BatchInsertFeedback(feedbacks, true, true, true)
+	assert.NoError(t, err)
+	begin := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	deleteCount, err = db.DeleteUserFeedbackInRange("5", &begin, &end, "type1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleteCount)
+	ret, err = db.GetUserFeedback("5", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []Feedback{feedbacks[0], feedbacks[2], feedbacks[3]}, ret)
+	// open-ended ranges
+	deleteCount, err = db.DeleteUserFeedbackInRange("5", nil, &end)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleteCount)
+	deleteCount, err = db.DeleteUserFeedbackInRange("5", &begin, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleteCount)
+	ret, err = db.GetUserFeedback("5", true)
+	assert.NoError(t, err)
+	assert.Empty(t, ret)
+	ret, err = db.GetUserFeedback("6", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []Feedback{feedbacks[4]}, ret)
 }
 
 func testTimeLimit(t *testing.T, db Database) {
@@ -593,15 +1341,15 @@ func testTimeLimit(t *testing.T, db Database) {
 	timeLimit := time.Date(1998, 1, 1, 0, 0, 0, 0, time.UTC)
 	_, ret, err := db.GetItems("", 100, &timeLimit)
 	assert.NoError(t, err)
-	assert.Equal(t, []Item{items[2], items[3], items[4]}, ret)
+	assert.Equal(t, []Item{items[2], items[3], items[4]}, withoutCreatedAt(t, ret...))
 
 	// insert feedback
 	feedbacks := []Feedback{
-		{FeedbackKey{"type1", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type2", "2", "3"}, time.Date(1997, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type3", "2", "3"}, time.Date(1998, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type1", "2", "4"}, time.Date(1999, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
-		{FeedbackKey{"type1", "1", "3"}, time.Date(2000, 3, 15, 0, 0, 0, 0, time.UTC), "comment"},
+		{FeedbackKey{"type1", "2", "3"}, time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type2", "2", "3"}, time.Date(1997, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type3", "2", "3"}, time.Date(1998, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type1", "2", "4"}, time.Date(1999, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
+		{FeedbackKey{"type1", "1", "3"}, time.Date(2000, 3, 15, 0, 0, 0, 0, time.UTC), "comment", nil},
 	}
 	err = db.BatchInsertFeedback(feedbacks, true, true, true)
 	assert.NoError(t, err)
@@ -748,3 +1496,18 @@ func TestSortFeedbacks(t *testing.T) {
 		{FeedbackKey: FeedbackKey{"star", "1", "1"}, Timestamp: time.Date(2000, 10, 1, 0, 0, 0, 0, time.UTC)},
 	}, feedback)
 }
+
+func TestVersion(t *testing.T) {
+	timestamp := time.Date(1996, 3, 15, 0, 0, 0, 0, time.UTC)
+	comment := strings.Repeat("comment", 100)
+	item := Item{ItemId: "0", Timestamp: timestamp, Comment: comment}
+	// versions don't depend on encodings
+	assert.Equal(t, item.Version(), (&Item{ItemId: "0", Timestamp: timestamp.In(time.FixedZone("UTC+8", 8*60*60)),
+		Labels: []string{}, Categories: []string{}, Comment: CompressComment(comment, 1)}).Version())
+	// versions change once items are modified
+	assert.NotEqual(t, item.Version(), (&Item{ItemId: "0", Timestamp: timestamp, Comment: comment, Labels: []string{"a"}}).Version())
+	assert.NotEqual(t, item.Version(), (&Item{ItemId: "0", Timestamp: timestamp, Comment: comment, IsHidden: true}).Version())
+	user := User{UserId: "0", Labels: []string{"a"}}
+	assert.Equal(t, user.Version(), (&User{UserId: "0", Labels: []string{"a"}, Subscribe: []string{}}).Version())
+	assert.NotEqual(t, user.Version(), (&User{UserId: "0", Labels: []string{"b"}}).Version())
+}
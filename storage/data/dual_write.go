@@ -0,0 +1,712 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"go.uber.org/zap"
+)
+
+// Mutating methods of Database replayed on the shadow data store.
+const (
+	shadowPurge                         = "Purge"
+	shadowBatchInsertItems              = "BatchInsertItems"
+	shadowDeleteItem                    = "DeleteItem"
+	shadowModifyItem                    = "ModifyItem"
+	shadowBatchModifyItems              = "BatchModifyItems"
+	shadowBatchInsertUsers              = "BatchInsertUsers"
+	shadowDeleteUser                    = "DeleteUser"
+	shadowModifyUser                    = "ModifyUser"
+	shadowDeleteUserItemFeedback        = "DeleteUserItemFeedback"
+	shadowDeleteUserFeedbackInRange     = "DeleteUserFeedbackInRange"
+	shadowBatchInsertFeedback           = "BatchInsertFeedback"
+	shadowSetUserOverrides              = "SetUserOverrides"
+	shadowDeleteUserOverrides           = "DeleteUserOverrides"
+	shadowBatchInsertItemCanonicals     = "BatchInsertItemCanonicals"
+	shadowDeleteItemCanonicals          = "DeleteItemCanonicals"
+	shadowInsertAuditLogs               = "InsertAuditLogs"
+	shadowDeleteAuditLogs               = "DeleteAuditLogs"
+	shadowBatchInsertUsage              = "BatchInsertUsage"
+	shadowBatchInsertRecommendSnapshots = "BatchInsertRecommendSnapshots"
+	shadowDeleteRecommendSnapshots      = "DeleteRecommendSnapshots"
+)
+
+// shadowWrite is a call of a mutating method of Database. Only arguments of the method are set.
+type shadowWrite struct {
+	Method        string
+	ItemId        string              `json:",omitempty"`
+	UserId        string              `json:",omitempty"`
+	ItemIds       []string            `json:",omitempty"`
+	Items         []Item              `json:",omitempty"`
+	Users         []User              `json:",omitempty"`
+	Feedback      []Feedback          `json:",omitempty"`
+	FeedbackTypes []string            `json:",omitempty"`
+	ItemPatch     *ItemPatch          `json:",omitempty"`
+	UserPatch     *UserPatch          `json:",omitempty"`
+	Begin         *time.Time          `json:",omitempty"`
+	End           *time.Time          `json:",omitempty"`
+	Before        time.Time           `json:",omitempty"`
+	InsertUser    bool                `json:",omitempty"`
+	InsertItem    bool                `json:",omitempty"`
+	Overwrite     bool                `json:",omitempty"`
+	Overrides     *UserOverrides      `json:",omitempty"`
+	Canonicals    []ItemCanonical     `json:",omitempty"`
+	AuditLogs     []AuditLog          `json:",omitempty"`
+	Usage         []Usage             `json:",omitempty"`
+	Snapshots     []RecommendSnapshot `json:",omitempty"`
+}
+
+// apply calls the method on a database. Versions of patches are ignored since they have been checked by the primary
+// data store.
+func (w *shadowWrite) apply(database Database) error {
+	var err error
+	switch w.Method {
+	case shadowPurge:
+		err = database.Purge()
+	case shadowBatchInsertItems:
+		err = database.BatchInsertItems(w.Items)
+	case shadowDeleteItem:
+		err = database.DeleteItem(w.ItemId)
+	case shadowModifyItem:
+		patch := *w.ItemPatch
+		patch.Version = ""
+		err = database.ModifyItem(w.ItemId, patch)
+	case shadowBatchModifyItems:
+		patch := *w.ItemPatch
+		patch.Version = ""
+		err = database.BatchModifyItems(w.ItemIds, patch)
+	case shadowBatchInsertUsers:
+		err = database.BatchInsertUsers(w.Users)
+	case shadowDeleteUser:
+		err = database.DeleteUser(w.UserId)
+	case shadowModifyUser:
+		patch := *w.UserPatch
+		patch.Version = ""
+		err = database.ModifyUser(w.UserId, patch)
+	case shadowDeleteUserItemFeedback:
+		_, err = database.DeleteUserItemFeedback(w.UserId, w.ItemId, w.FeedbackTypes...)
+	case shadowDeleteUserFeedbackInRange:
+		_, err = database.DeleteUserFeedbackInRange(w.UserId, w.Begin, w.End, w.FeedbackTypes...)
+	case shadowBatchInsertFeedback:
+		err = database.BatchInsertFeedback(w.Feedback, w.InsertUser, w.InsertItem, w.Overwrite)
+	case shadowSetUserOverrides:
+		err = database.SetUserOverrides(*w.Overrides)
+	case shadowDeleteUserOverrides:
+		err = database.DeleteUserOverrides(w.UserId)
+	case shadowBatchInsertItemCanonicals:
+		err = database.BatchInsertItemCanonicals(w.Canonicals)
+	case shadowDeleteItemCanonicals:
+		err = database.DeleteItemCanonicals(w.ItemIds)
+	case shadowInsertAuditLogs:
+		err = database.InsertAuditLogs(w.AuditLogs)
+	case shadowDeleteAuditLogs:
+		err = database.DeleteAuditLogs(w.Before)
+	case shadowBatchInsertUsage:
+		err = database.BatchInsertUsage(w.Usage)
+	case shadowBatchInsertRecommendSnapshots:
+		err = database.BatchInsertRecommendSnapshots(w.Snapshots)
+	case shadowDeleteRecommendSnapshots:
+		err = database.DeleteRecommendSnapshots(w.Before)
+	default:
+		return errors.NotSupportedf("shadow write %s", w.Method)
+	}
+	// writes to entities missing in the shadow data store are skipped instead of blocking the queue forever, and these
+	// entities are reported by the divergence checker
+	if errors.Is(err, errors.NotFound) {
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// shadowQueue is a FIFO queue of writes to the shadow data store. Writes are appended to a file in JSON lines, so that
+// they survive restarts. The file is rewritten with remaining writes after writes are replayed. Writes are kept in
+// memory only if the path is empty.
+type shadowQueue struct {
+	mutex  sync.Mutex
+	path   string
+	file   *os.File
+	writes []shadowWrite
+}
+
+// openShadowQueue loads writes remaining in the file. A broken last line written before a crash is skipped.
+func openShadowQueue(path string) (*shadowQueue, error) {
+	q := &shadowQueue{path: path}
+	if path == "" {
+		return q, nil
+	}
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 64*1024*1024)
+		for scanner.Scan() {
+			var w shadowWrite
+			if err = json.Unmarshal(scanner.Bytes(), &w); err != nil {
+				log.Logger().Warn("skip broken shadow write", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			q.writes = append(q.writes, w)
+		}
+		_ = file.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
+	if err := q.rewrite(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return q, nil
+}
+
+// Len returns the number of writes waiting to be replayed.
+func (q *shadowQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.writes)
+}
+
+// Push appends a write to the end of the queue.
+func (q *shadowQueue) Push(w shadowWrite) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.file != nil {
+		line, err := json.Marshal(w)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err = q.file.Write(append(line, '\n')); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	q.writes = append(q.writes, w)
+	return nil
+}
+
+// Replay applies writes to a database in order until a write fails. Replayed writes are removed from the queue, and
+// the number of replayed writes is returned. Writes pushed during replay are kept behind remaining writes. Since the
+// file is rewritten after replay, writes might be replayed again after a crash, which is harmless since writes are
+// idempotent.
+func (q *shadowQueue) Replay(database Database) (int, error) {
+	q.mutex.Lock()
+	writes := q.writes
+	q.mutex.Unlock()
+	var (
+		n   int
+		err error
+	)
+	for n < len(writes) {
+		if err = writes[n].apply(database); err != nil {
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		q.mutex.Lock()
+		q.writes = q.writes[n:]
+		if rewriteErr := q.rewrite(); rewriteErr != nil && err == nil {
+			err = rewriteErr
+		}
+		q.mutex.Unlock()
+	}
+	return n, errors.Trace(err)
+}
+
+// rewrite replaces the file by remaining writes and reopens the file for appending.
+func (q *shadowQueue) rewrite() error {
+	if q.path == "" {
+		return nil
+	}
+	if q.file != nil {
+		if err := q.file.Close(); err != nil {
+			return errors.Trace(err)
+		}
+		q.file = nil
+	}
+	temp, err := os.Create(q.path + ".tmp")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	writer := bufio.NewWriter(temp)
+	for _, w := range q.writes {
+		line, err := json.Marshal(w)
+		if err != nil {
+			_ = temp.Close()
+			return errors.Trace(err)
+		}
+		if _, err = writer.Write(append(line, '\n')); err != nil {
+			_ = temp.Close()
+			return errors.Trace(err)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		_ = temp.Close()
+		return errors.Trace(err)
+	}
+	if err = temp.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if err = os.Rename(q.path+".tmp", q.path); err != nil {
+		return errors.Trace(err)
+	}
+	q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0644)
+	return errors.Trace(err)
+}
+
+func (q *shadowQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.file != nil {
+		return errors.Trace(q.file.Close())
+	}
+	return nil
+}
+
+// dualWriter writes to the shadow data store. It is shared by copies of DualWriteDatabase with different contexts.
+type dualWriter struct {
+	shadow      Database
+	queue       *shadowQueue
+	initialized int32 // 1 if tables of the shadow data store have been created
+	done        chan struct{}
+}
+
+// DualWriteDatabase writes to both the primary data store and the shadow data store while migrating from the primary
+// data store to the shadow data store, and reads from the primary data store only. Writes go to the primary data store
+// first, and errors of the primary data store are returned. Writes to the shadow data store never fail requests:
+// failed writes are logged and queued for retry. Once the queue isn't empty, following writes are queued as well, so
+// that the shadow data store receives writes in the order of the primary data store. The queue is replayed every retry
+// interval and persisted in a file, so that queued writes survive restarts.
+//
+// Writes are applied to the shadow data store without contexts of requests, so that canceled requests never fail
+// writes to the shadow data store.
+type DualWriteDatabase struct {
+	Database
+	writer *dualWriter
+}
+
+// NewDualWriteDatabase creates a DualWriteDatabase on the primary data store and the shadow data store. Failed writes
+// are queued in the file at the queue path, or in memory if the path is empty.
+func NewDualWriteDatabase(primary, shadow Database, queuePath string, retryInterval time.Duration) (*DualWriteDatabase, error) {
+	queue, err := openShadowQueue(queuePath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if n := queue.Len(); n > 0 {
+		log.Logger().Info("load queued shadow writes", zap.String("path", queuePath), zap.Int("n", n))
+	}
+	d := &DualWriteDatabase{
+		Database: primary,
+		writer:   &dualWriter{shadow: shadow, queue: queue, done: make(chan struct{})},
+	}
+	go d.runReplay(retryInterval)
+	return d, nil
+}
+
+func (d *DualWriteDatabase) WithContext(ctx context.Context) Database {
+	database := *d
+	database.Database = WithContext(ctx, d.Database)
+	return &database
+}
+
+// Init creates tables in both data stores. Tables of the shadow data store are created before replay if the shadow
+// data store isn't available.
+func (d *DualWriteDatabase) Init() error {
+	if err := d.Database.Init(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := d.writer.shadow.Init(); err != nil {
+		log.Logger().Warn("failed to init shadow data store", zap.Error(err))
+	} else {
+		atomic.StoreInt32(&d.writer.initialized, 1)
+	}
+	return nil
+}
+
+// Close stops replay and closes both data stores. Queued writes are kept in the file.
+func (d *DualWriteDatabase) Close() error {
+	close(d.writer.done)
+	if err := d.writer.queue.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := d.writer.shadow.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return d.Database.Close()
+}
+
+// QueueLen returns the number of writes waiting to be replayed on the shadow data store.
+func (d *DualWriteDatabase) QueueLen() int {
+	return d.writer.queue.Len()
+}
+
+// Replay replays queued writes on the shadow data store and returns the number of replayed writes.
+func (d *DualWriteDatabase) Replay() (int, error) {
+	if atomic.LoadInt32(&d.writer.initialized) == 0 {
+		if err := d.writer.shadow.Init(); err != nil {
+			return 0, errors.Trace(err)
+		}
+		atomic.StoreInt32(&d.writer.initialized, 1)
+	}
+	return d.writer.queue.Replay(d.writer.shadow)
+}
+
+func (d *DualWriteDatabase) runReplay(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.writer.done:
+			return
+		case <-ticker.C:
+		}
+		if d.writer.queue.Len() == 0 {
+			continue
+		}
+		n, err := d.Replay()
+		if err != nil {
+			log.Logger().Warn("failed to replay shadow writes",
+				zap.Int("n_replayed", n), zap.Int("n_queued", d.writer.queue.Len()), zap.Error(err))
+		} else {
+			log.Logger().Info("complete replaying shadow writes", zap.Int("n_replayed", n))
+		}
+	}
+}
+
+// writeShadow writes to the shadow data store, or queues the write if the shadow data store fails or writes are
+// queued already.
+func (d *DualWriteDatabase) writeShadow(w shadowWrite) {
+	if atomic.LoadInt32(&d.writer.initialized) == 1 && d.writer.queue.Len() == 0 {
+		err := w.apply(d.writer.shadow)
+		if err == nil {
+			return
+		}
+		log.Logger().Warn("failed to write shadow data store", zap.String("method", w.Method), zap.Error(err))
+	}
+	if err := d.writer.queue.Push(w); err != nil {
+		log.Logger().Error("failed to queue shadow write", zap.String("method", w.Method), zap.Error(err))
+	}
+}
+
+func (d *DualWriteDatabase) Purge() error {
+	if err := d.Database.Purge(); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowPurge})
+	return nil
+}
+
+func (d *DualWriteDatabase) BatchInsertItems(items []Item) error {
+	if err := d.Database.BatchInsertItems(items); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowBatchInsertItems, Items: items})
+	return nil
+}
+
+func (d *DualWriteDatabase) DeleteItem(itemId string) error {
+	if err := d.Database.DeleteItem(itemId); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteItem, ItemId: itemId})
+	return nil
+}
+
+func (d *DualWriteDatabase) ModifyItem(itemId string, patch ItemPatch) error {
+	if err := d.Database.ModifyItem(itemId, patch); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowModifyItem, ItemId: itemId, ItemPatch: &patch})
+	return nil
+}
+
+func (d *DualWriteDatabase) BatchModifyItems(itemIds []string, patch ItemPatch) error {
+	if err := d.Database.BatchModifyItems(itemIds, patch); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowBatchModifyItems, ItemIds: itemIds, ItemPatch: &patch})
+	return nil
+}
+
+func (d *DualWriteDatabase) BatchInsertUsers(users []User) error {
+	if err := d.Database.BatchInsertUsers(users); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowBatchInsertUsers, Users: users})
+	return nil
+}
+
+func (d *DualWriteDatabase) DeleteUser(userId string) error {
+	if err := d.Database.DeleteUser(userId); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteUser, UserId: userId})
+	return nil
+}
+
+func (d *DualWriteDatabase) ModifyUser(userId string, patch UserPatch) error {
+	if err := d.Database.ModifyUser(userId, patch); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowModifyUser, UserId: userId, UserPatch: &patch})
+	return nil
+}
+
+func (d *DualWriteDatabase) DeleteUserItemFeedback(userId, itemId string, feedbackTypes ...string) (int, error) {
+	count, err := d.Database.DeleteUserItemFeedback(userId, itemId, feedbackTypes...)
+	if err != nil {
+		return count, errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteUserItemFeedback, UserId: userId, ItemId: itemId, FeedbackTypes: feedbackTypes})
+	return count, nil
+}
+
+func (d *DualWriteDatabase) DeleteUserFeedbackInRange(userId string, begin, end *time.Time, feedbackTypes ...string) (int, error) {
+	count, err := d.Database.DeleteUserFeedbackInRange(userId, begin, end, feedbackTypes...)
+	if err != nil {
+		return count, errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteUserFeedbackInRange, UserId: userId, Begin: begin, End: end,
+		FeedbackTypes: feedbackTypes})
+	return count, nil
+}
+
+func (d *DualWriteDatabase) BatchInsertFeedback(feedback []Feedback, insertUser, insertItem, overwrite bool) error {
+	if err := d.Database.BatchInsertFeedback(feedback, insertUser, insertItem, overwrite); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowBatchInsertFeedback, Feedback: feedback, InsertUser: insertUser,
+		InsertItem: insertItem, Overwrite: overwrite})
+	return nil
+}
+
+func (d *DualWriteDatabase) SetUserOverrides(overrides UserOverrides) error {
+	if err := d.Database.SetUserOverrides(overrides); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowSetUserOverrides, Overrides: &overrides})
+	return nil
+}
+
+func (d *DualWriteDatabase) DeleteUserOverrides(userId string) error {
+	if err := d.Database.DeleteUserOverrides(userId); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteUserOverrides, UserId: userId})
+	return nil
+}
+
+func (d *DualWriteDatabase) BatchInsertItemCanonicals(canonicals []ItemCanonical) error {
+	if err := d.Database.BatchInsertItemCanonicals(canonicals); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowBatchInsertItemCanonicals, Canonicals: canonicals})
+	return nil
+}
+
+func (d *DualWriteDatabase) DeleteItemCanonicals(itemIds []string) error {
+	if err := d.Database.DeleteItemCanonicals(itemIds); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteItemCanonicals, ItemIds: itemIds})
+	return nil
+}
+
+func (d *DualWriteDatabase) InsertAuditLogs(auditLogs []AuditLog) error {
+	if err := d.Database.InsertAuditLogs(auditLogs); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowInsertAuditLogs, AuditLogs: auditLogs})
+	return nil
+}
+
+func (d *DualWriteDatabase) DeleteAuditLogs(before time.Time) error {
+	if err := d.Database.DeleteAuditLogs(before); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteAuditLogs, Before: before})
+	return nil
+}
+
+func (d *DualWriteDatabase) BatchInsertUsage(usage []Usage) error {
+	if err := d.Database.BatchInsertUsage(usage); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowBatchInsertUsage, Usage: usage})
+	return nil
+}
+
+func (d *DualWriteDatabase) BatchInsertRecommendSnapshots(snapshots []RecommendSnapshot) error {
+	if err := d.Database.BatchInsertRecommendSnapshots(snapshots); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowBatchInsertRecommendSnapshots, Snapshots: snapshots})
+	return nil
+}
+
+func (d *DualWriteDatabase) DeleteRecommendSnapshots(before time.Time) error {
+	if err := d.Database.DeleteRecommendSnapshots(before); err != nil {
+		return errors.Trace(err)
+	}
+	d.writeShadow(shadowWrite{Method: shadowDeleteRecommendSnapshots, Before: before})
+	return nil
+}
+
+// The following methods project fields if the primary data store supports projection. Otherwise, all fields are read.
+
+func (d *DualWriteDatabase) GetItemProjected(itemId string, fields []string) (Item, error) {
+	if projector, ok := d.Database.(Projector); ok {
+		return projector.GetItemProjected(itemId, fields)
+	}
+	return d.GetItem(itemId)
+}
+
+func (d *DualWriteDatabase) GetItemsProjected(cursor string, n int, timeLimit *time.Time, fields []string) (string, []Item, error) {
+	if projector, ok := d.Database.(Projector); ok {
+		return projector.GetItemsProjected(cursor, n, timeLimit, fields)
+	}
+	return d.GetItems(cursor, n, timeLimit)
+}
+
+func (d *DualWriteDatabase) GetUserProjected(userId string, fields []string) (User, error) {
+	if projector, ok := d.Database.(Projector); ok {
+		return projector.GetUserProjected(userId, fields)
+	}
+	return d.GetUser(userId)
+}
+
+func (d *DualWriteDatabase) GetUsersProjected(cursor string, n int, fields []string) (string, []User, error) {
+	if projector, ok := d.Database.(Projector); ok {
+		return projector.GetUsersProjected(cursor, n, fields)
+	}
+	return d.GetUsers(cursor, n)
+}
+
+// Divergence is the result of comparing sampled users, items and feedback of users between the primary data store and
+// the shadow data store. The divergence rate is the ratio of diverged users and items to sampled users and items. A
+// user is diverged if the user or feedback of the user differs.
+type Divergence struct {
+	NumUsers         int
+	NumItems         int
+	NumDivergedUsers int
+	NumDivergedItems int
+	NumQueuedWrites  int
+	DivergenceRate   float64
+	DivergedEntities []string // diverged users and items such as "user/1" and "item/2", at most maxDivergedEntities
+}
+
+// maxDivergedEntities is the max number of diverged entities reported.
+const maxDivergedEntities = 100
+
+func (d *Divergence) addEntity(entity string) {
+	if len(d.DivergedEntities) < maxDivergedEntities {
+		d.DivergedEntities = append(d.DivergedEntities, entity)
+	}
+}
+
+// CheckDivergence samples users and items from the primary data store and compares them with the shadow data store.
+// Users and items are compared by versions, which don't depend on how data stores encode them, and feedback is
+// compared by keys and timestamps in seconds.
+func (d *DualWriteDatabase) CheckDivergence(numUsers, numItems int, seed int64) (*Divergence, error) {
+	var (
+		users []User
+		items []Item
+		err   error
+	)
+	if numUsers > 0 {
+		if users, err = d.Database.SampleUsers(numUsers, false, seed); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if numItems > 0 {
+		if items, err = d.Database.SampleItems(numItems, "", seed); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	divergence := &Divergence{NumUsers: len(users), NumItems: len(items), NumQueuedWrites: d.QueueLen()}
+
+	// compare users and their feedback
+	for _, user := range users {
+		diverged, err := d.userDiverged(user)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if diverged {
+			divergence.NumDivergedUsers++
+			divergence.addEntity("user/" + user.UserId)
+		}
+	}
+
+	// compare items
+	if len(items) > 0 {
+		shadowItems, _, err := d.writer.shadow.BatchGetItems(lo.Map(items, func(item Item, _ int) string {
+			return item.ItemId
+		}))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		versions := strset.New(lo.Map(shadowItems, func(item Item, _ int) string {
+			return item.ItemId + "/" + item.Version()
+		})...)
+		for _, item := range items {
+			if !versions.Has(item.ItemId + "/" + item.Version()) {
+				divergence.NumDivergedItems++
+				divergence.addEntity("item/" + item.ItemId)
+			}
+		}
+	}
+
+	if total := divergence.NumUsers + divergence.NumItems; total > 0 {
+		divergence.DivergenceRate = float64(divergence.NumDivergedUsers+divergence.NumDivergedItems) / float64(total)
+	}
+	return divergence, nil
+}
+
+// userDiverged returns true if the user or feedback of the user differs between data stores.
+func (d *DualWriteDatabase) userDiverged(user User) (bool, error) {
+	shadowUser, err := d.writer.shadow.GetUser(user.UserId)
+	if errors.Is(err, errors.NotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	if shadowUser.Version() != user.Version() {
+		return true, nil
+	}
+	feedback, err := d.Database.GetUserFeedback(user.UserId, true)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	shadowFeedback, err := d.writer.shadow.GetUserFeedback(user.UserId, true)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if len(feedback) != len(shadowFeedback) {
+		return true, nil
+	}
+	feedbackKey := func(f Feedback, _ int) string {
+		return f.FeedbackType + "/" + f.ItemId + "/" + f.Timestamp.UTC().Truncate(time.Second).String()
+	}
+	return !strset.New(lo.Map(feedback, feedbackKey)...).IsEqual(strset.New(lo.Map(shadowFeedback, feedbackKey)...)), nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage"
+)
+
+type mockDualWriteDatabase struct {
+	*DualWriteDatabase
+	primary *mockRedis
+	shadow  *mockRedis
+}
+
+func newMockDualWriteDatabase(t *testing.T, queuePath string) *mockDualWriteDatabase {
+	var err error
+	db := new(mockDualWriteDatabase)
+	db.primary = newMockRedis(t)
+	db.shadow = newMockRedis(t)
+	db.DualWriteDatabase, err = NewDualWriteDatabase(db.primary.Database, db.shadow.Database, queuePath, time.Hour)
+	assert.NoError(t, err)
+	err = db.Init()
+	assert.NoError(t, err)
+	return db
+}
+
+func (db *mockDualWriteDatabase) Close(t *testing.T) {
+	err := db.DualWriteDatabase.Close()
+	assert.NoError(t, err)
+	db.primary.server.Close()
+	db.shadow.server.Close()
+}
+
+func TestDualWriteDatabase_Write(t *testing.T) {
+	db := newMockDualWriteDatabase(t, "")
+	defer db.Close(t)
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	// writes go to both data stores
+	err := db.BatchInsertItems([]Item{{ItemId: "1", Labels: []string{"a"}, Timestamp: timestamp}})
+	assert.NoError(t, err)
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "1"}, Timestamp: timestamp},
+	}, true, false, false)
+	assert.NoError(t, err)
+	item, err := db.shadow.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, item.Labels)
+	feedback, err := db.shadow.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+	assert.Zero(t, db.QueueLen())
+
+	// writes never fail if the shadow data store fails
+	db.shadow.server.SetError("shadow data store is down")
+	err = db.DeleteItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, db.QueueLen())
+	_, err = db.GetItem("1")
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	// errors of the primary data store are returned and writes don't go to the shadow data store
+	db.primary.server.SetError("primary data store is down")
+	err = db.BatchInsertUsers([]User{{UserId: "1"}})
+	assert.Error(t, err)
+	assert.Equal(t, 1, db.QueueLen())
+}
+
+func TestDualWriteDatabase_ReplayOrder(t *testing.T) {
+	db := newMockDualWriteDatabase(t, "")
+	defer db.Close(t)
+	err := db.BatchInsertItems([]Item{{ItemId: "1", Labels: []string{"a"}}})
+	assert.NoError(t, err)
+
+	// writes following a failed write are queued even if the shadow data store recovers
+	db.shadow.server.SetError("shadow data store is down")
+	err = db.ModifyItem("1", ItemPatch{Labels: []string{"b"}})
+	assert.NoError(t, err)
+	db.shadow.server.SetError("")
+	err = db.ModifyItem("1", ItemPatch{Labels: []string{"c"}})
+	assert.NoError(t, err)
+	err = db.BatchInsertUsers([]User{{UserId: "1"}})
+	assert.NoError(t, err)
+	err = db.DeleteUser("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, db.QueueLen())
+	item, err := db.shadow.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, item.Labels)
+
+	// replay stops at the first failure
+	db.shadow.server.SetError("shadow data store is down")
+	n, err := db.Replay()
+	assert.Error(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, 4, db.QueueLen())
+
+	// writes are replayed in order
+	db.shadow.server.SetError("")
+	n, err = db.Replay()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Zero(t, db.QueueLen())
+	item, err = db.shadow.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, item.Labels)
+	_, err = db.shadow.GetUser("1")
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	// writes go to the shadow data store directly once the queue is empty
+	err = db.ModifyItem("1", ItemPatch{Labels: []string{"d"}})
+	assert.NoError(t, err)
+	assert.Zero(t, db.QueueLen())
+	item, err = db.shadow.GetItem("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d"}, item.Labels)
+}
+
+func TestDualWriteDatabase_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shadow_queue")
+	db := newMockDualWriteDatabase(t, path)
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.shadow.server.SetError("shadow data store is down")
+	err := db.BatchInsertItems([]Item{{ItemId: "1", Timestamp: timestamp}})
+	assert.NoError(t, err)
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "1"}, Timestamp: timestamp},
+	}, true, false, false)
+	assert.NoError(t, err)
+	_, err = db.DeleteUserItemFeedback("0", "1", "click")
+	assert.NoError(t, err)
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "1"}, Timestamp: timestamp},
+	}, true, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, db.QueueLen())
+	err = db.DualWriteDatabase.Close()
+	assert.NoError(t, err)
+
+	// queued writes survive restarts, and a broken line written before a crash is skipped
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`{"Method":"DeleteItem","ItemId":`)
+	assert.NoError(t, err)
+	err = file.Close()
+	assert.NoError(t, err)
+	db.primary.Database, err = Open(storage.RedisPrefix+db.primary.server.Addr(), "")
+	assert.NoError(t, err)
+	db.shadow.Database, err = Open(storage.RedisPrefix+db.shadow.server.Addr(), "")
+	assert.NoError(t, err)
+	db.DualWriteDatabase, err = NewDualWriteDatabase(db.primary.Database, db.shadow.Database, path, time.Hour)
+	assert.NoError(t, err)
+	defer db.Close(t)
+	assert.Equal(t, 4, db.QueueLen())
+
+	// writes are replayed in order after restarts
+	db.shadow.server.SetError("")
+	n, err := db.Replay()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	_, err = db.shadow.GetItem("1")
+	assert.NoError(t, err)
+	feedback, err := db.shadow.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	if assert.Len(t, feedback, 1) {
+		assert.Equal(t, "read", feedback[0].FeedbackType)
+	}
+	// the file is truncated once writes are replayed
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestDualWriteDatabase_CheckDivergence(t *testing.T) {
+	db := newMockDualWriteDatabase(t, "")
+	defer db.Close(t)
+	timestamp := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := db.BatchInsertItems([]Item{{ItemId: "1", Timestamp: timestamp}, {ItemId: "2", Timestamp: timestamp}})
+	assert.NoError(t, err)
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "1", ItemId: "1"}, Timestamp: timestamp},
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "2", ItemId: "1"}, Timestamp: timestamp},
+	}, true, false, false)
+	assert.NoError(t, err)
+	divergence, err := db.CheckDivergence(10, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, &Divergence{NumUsers: 2, NumItems: 2}, divergence)
+
+	// users, feedback and items written to the primary data store only are diverged
+	err = db.primary.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "2", ItemId: "2"}, Timestamp: timestamp},
+	}, true, false, false)
+	assert.NoError(t, err)
+	err = db.primary.ModifyItem("1", ItemPatch{Labels: []string{"a"}})
+	assert.NoError(t, err)
+	db.shadow.server.SetError("shadow data store is down")
+	err = db.BatchInsertUsers([]User{{UserId: "3"}})
+	assert.NoError(t, err)
+	db.shadow.server.SetError("")
+	divergence, err = db.CheckDivergence(10, 10, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, divergence.NumUsers)
+	assert.Equal(t, 2, divergence.NumDivergedUsers)
+	assert.Equal(t, 1, divergence.NumDivergedItems)
+	assert.Equal(t, 1, divergence.NumQueuedWrites)
+	assert.InDelta(t, 0.6, divergence.DivergenceRate, 1e-6)
+	assert.ElementsMatch(t, []string{"user/2", "user/3", "item/1"}, divergence.DivergedEntities)
+}
@@ -18,11 +18,13 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/juju/errors"
+	"github.com/samber/lo"
 	"github.com/scylladb/go-set/strset"
 	"github.com/zhenghaoz/gorse/storage"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
 	"time"
 )
 
@@ -40,6 +42,8 @@ func (k *FeedbackKey) toString() (string, error) {
 // MongoDB is the data storage based on MongoDB.
 type MongoDB struct {
 	storage.TablePrefix
+	requestContext
+	batchGetOptions
 	client *mongo.Client
 	dbName string
 }
@@ -51,10 +55,10 @@ func (db *MongoDB) Optimize() error {
 
 // Init collections and indices in MongoDB.
 func (db *MongoDB) Init() error {
-	ctx := context.Background()
+	ctx := db.context()
 	d := db.client.Database(db.dbName)
 	// list collections
-	var hasUsers, hasItems, hasFeedback bool
+	var hasUsers, hasItems, hasFeedback, hasOverrides, hasCanonicals, hasAuditLogs, hasUsage, hasSnapshots bool
 	collections, err := d.ListCollectionNames(ctx, bson.M{})
 	if err != nil {
 		return errors.Trace(err)
@@ -67,6 +71,16 @@ func (db *MongoDB) Init() error {
 			hasItems = true
 		case db.FeedbackTable():
 			hasFeedback = true
+		case db.UserOverridesTable():
+			hasOverrides = true
+		case db.ItemCanonicalsTable():
+			hasCanonicals = true
+		case db.AuditLogsTable():
+			hasAuditLogs = true
+		case db.DailyUsageTable():
+			hasUsage = true
+		case db.RecommendSnapshotsTable():
+			hasSnapshots = true
 		}
 	}
 	// create collections
@@ -85,6 +99,31 @@ func (db *MongoDB) Init() error {
 			return errors.Trace(err)
 		}
 	}
+	if !hasOverrides {
+		if err = d.CreateCollection(ctx, db.UserOverridesTable()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !hasCanonicals {
+		if err = d.CreateCollection(ctx, db.ItemCanonicalsTable()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !hasAuditLogs {
+		if err = d.CreateCollection(ctx, db.AuditLogsTable()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !hasUsage {
+		if err = d.CreateCollection(ctx, db.DailyUsageTable()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !hasSnapshots {
+		if err = d.CreateCollection(ctx, db.RecommendSnapshotsTable()); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	// create index
 	_, err = d.Collection(db.UsersTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
 		Keys: bson.M{
@@ -129,19 +168,85 @@ func (db *MongoDB) Init() error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	_, err = d.Collection(db.UserOverridesTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{
+			"userid": 1,
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = d.Collection(db.ItemCanonicalsTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{
+			"itemid": 1,
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = d.Collection(db.AuditLogsTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{
+			"id": 1,
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = d.Collection(db.AuditLogsTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{
+			"actor": 1,
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = d.Collection(db.AuditLogsTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{
+			"entities": 1,
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = d.Collection(db.DailyUsageTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"day", 1}, {"metric", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = d.Collection(db.RecommendSnapshotsTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"userid", 1}, {"timestamp", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = d.Collection(db.RecommendSnapshotsTable()).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{
+			"timestamp": 1,
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
 	return nil
 }
 
 // Close connection to MongoDB.
 func (db *MongoDB) Close() error {
-	return db.client.Disconnect(context.Background())
+	return db.client.Disconnect(db.context())
 }
 
 func (db *MongoDB) Purge() error {
-	tables := []string{db.ItemsTable(), db.FeedbackTable(), db.UsersTable()}
+	tables := []string{db.ItemsTable(), db.FeedbackTable(), db.UsersTable(), db.UserOverridesTable(), db.ItemCanonicalsTable(),
+		db.RecommendSnapshotsTable()}
 	for _, tableName := range tables {
 		c := db.client.Database(db.dbName).Collection(tableName)
-		_, err := c.DeleteMany(context.Background(), bson.D{})
+		_, err := c.DeleteMany(db.context(), bson.D{})
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -154,44 +259,114 @@ func (db *MongoDB) BatchInsertItems(items []Item) error {
 	if len(items) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
 	var models []mongo.WriteModel
+	now := time.Now().In(time.UTC)
 	for _, item := range items {
+		item.VisibleFrom, item.VisibleUntil = utcTime(item.VisibleFrom), utcTime(item.VisibleUntil)
+		// creation time of existing items isn't updated
+		item.CreatedAt = time.Time{}
 		models = append(models, mongo.NewUpdateOneModel().
 			SetUpsert(true).
 			SetFilter(bson.M{"itemid": bson.M{"$eq": item.ItemId}}).
-			SetUpdate(bson.M{"$set": item}))
+			SetUpdate(bson.M{"$set": item, "$setOnInsert": bson.M{"createdat": now}}))
 	}
 	_, err := c.BulkWrite(ctx, models)
 	return errors.Trace(err)
 }
 
-func (db *MongoDB) BatchGetItems(itemIds []string) ([]Item, error) {
-	if len(itemIds) == 0 {
-		return nil, nil
-	}
-	ctx := context.Background()
+// BatchGetItems gets items from MongoDB by queries of chunks of ids.
+func (db *MongoDB) BatchGetItems(itemIds []string) ([]Item, []string, error) {
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
-	r, err := c.Find(ctx, bson.M{"itemid": bson.M{"$in": itemIds}})
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	items := make([]Item, 0)
-	defer r.Close(ctx)
-	for r.Next(ctx) {
-		var item Item
-		if err = r.Decode(&item); err != nil {
+	return db.batchGetItems(itemIds, func(chunk []string) ([]Item, error) {
+		r, err := c.Find(ctx, bson.M{"itemid": bson.M{"$in": chunk}})
+		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		items = append(items, item)
-	}
-	return items, nil
+		items := make([]Item, 0, len(chunk))
+		defer r.Close(ctx)
+		for r.Next(ctx) {
+			var item Item
+			if err = r.Decode(&item); err != nil {
+				return nil, errors.Trace(err)
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	})
 }
 
 // ModifyItem modify an item in MongoDB.
 func (db *MongoDB) ModifyItem(itemId string, patch ItemPatch) error {
-	// create update
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
+	filter := bson.M{"itemid": bson.M{"$eq": itemId}}
+	if patch.Version != "" {
+		var err error
+		filter, err = mongoVersionFilter(ctx, c, filter, errors.Annotate(ErrItemNotExist, itemId), func(raw bson.Raw) error {
+			var item Item
+			if err := bson.Unmarshal(raw, &item); err != nil {
+				return errors.Trace(err)
+			}
+			return patch.checkVersion(item)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	r, err := c.UpdateOne(ctx, filter, itemPatchUpdate(patch))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if patch.Version != "" && r.MatchedCount == 0 {
+		return errors.Annotate(ErrConflict, itemId)
+	}
+	return nil
+}
+
+// mongoVersionFilter reads a document and checks its version. The returned filter only matches the document as it was
+// read, so that a conditional update fails if the document is modified concurrently.
+func mongoVersionFilter(ctx context.Context, c *mongo.Collection, filter bson.M, notExist error, check func(bson.Raw) error) (bson.M, error) {
+	raw, err := c.FindOne(ctx, filter).DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return nil, notExist
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = check(raw); err != nil {
+		return nil, err
+	}
+	return bson.M{"$and": bson.A{filter, bson.M{"$expr": bson.M{"$eq": bson.A{"$$ROOT", bson.M{"$literal": raw}}}}}}, nil
+}
+
+// BatchModifyItems applies the same modification to items in MongoDB.
+func (db *MongoDB) BatchModifyItems(itemIds []string, patch ItemPatch) error {
+	if len(itemIds) == 0 {
+		return nil
+	}
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
+	_, err := c.UpdateMany(ctx, bson.M{"itemid": bson.M{"$in": itemIds}}, itemPatchUpdate(patch))
+	return errors.Trace(err)
+}
+
+// mongoProjection returns the projection of fields of items or users, which are lowercase in MongoDB. The id field is
+// always read. Nil is returned if fields are empty.
+func mongoProjection(fields []string, idField string) interface{} {
+	if len(fields) == 0 {
+		return nil
+	}
+	projection := bson.M{"_id": 0, idField: 1}
+	for _, field := range fields {
+		projection[strings.ToLower(field)] = 1
+	}
+	return projection
+}
+
+// itemPatchUpdate returns the update document of an item patch.
+func itemPatchUpdate(patch ItemPatch) interface{} {
 	update := bson.M{}
 	if patch.IsHidden != nil {
 		update["ishidden"] = patch.IsHidden
@@ -208,16 +383,64 @@ func (db *MongoDB) ModifyItem(itemId string, patch ItemPatch) error {
 	if patch.Timestamp != nil {
 		update["timestamp"] = patch.Timestamp
 	}
-	// execute
-	ctx := context.Background()
-	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
-	_, err := c.UpdateOne(ctx, bson.M{"itemid": bson.M{"$eq": itemId}}, bson.M{"$set": update})
-	return errors.Trace(err)
+	if patch.VisibleFrom != nil {
+		update["visiblefrom"] = utcTime(patch.VisibleFrom)
+	}
+	if patch.VisibleUntil != nil {
+		update["visibleuntil"] = utcTime(patch.VisibleUntil)
+	}
+	if patch.HiddenReason != nil {
+		update["hiddenreason"] = *patch.HiddenReason
+	}
+	if !patch.hasArrayOperations() {
+		return bson.M{"$set": update}
+	}
+	update = mongoLiterals(update)
+	if len(patch.AddLabels) > 0 || len(patch.RemoveLabels) > 0 {
+		update["labels"] = mongoPatchArray("$labels", patch.Labels, patch.AddLabels, patch.RemoveLabels)
+	}
+	if len(patch.AddCategories) > 0 || len(patch.RemoveCategories) > 0 {
+		update["categories"] = mongoPatchArray("$categories", patch.Categories, patch.AddCategories, patch.RemoveCategories)
+	}
+	return bson.A{bson.M{"$set": update}}
+}
+
+// mongoLiterals wraps values of fields with $literal so that they are not parsed as expressions in an aggregation
+// pipeline.
+func mongoLiterals(update bson.M) bson.M {
+	literals := make(bson.M, len(update))
+	for name, value := range update {
+		literals[name] = bson.M{"$literal": value}
+	}
+	return literals
+}
+
+// mongoPatchArray returns the expression of an array field after adding and removing elements. Elements are added or
+// removed in an update pipeline so that concurrent modifications of different elements don't overwrite each other.
+// Existing elements keep their order and new elements are appended.
+func mongoPatchArray(field string, values, add, remove []string) interface{} {
+	var array interface{} = bson.M{"$ifNull": bson.A{field, bson.A{}}}
+	if values != nil {
+		array = bson.M{"$literal": values}
+	}
+	if add = lo.Uniq(add); len(add) > 0 {
+		array = bson.M{"$concatArrays": bson.A{array, bson.M{"$filter": bson.M{
+			"input": bson.M{"$literal": add},
+			"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", array}}}},
+		}}}}
+	}
+	if len(remove) > 0 {
+		array = bson.M{"$filter": bson.M{
+			"input": array,
+			"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", bson.M{"$literal": remove}}}}},
+		}}
+	}
+	return array
 }
 
 // DeleteItem deletes a item from MongoDB.
 func (db *MongoDB) DeleteItem(itemId string) error {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
 	_, err := c.DeleteOne(ctx, bson.M{"itemid": itemId})
 	if err != nil {
@@ -232,9 +455,14 @@ func (db *MongoDB) DeleteItem(itemId string) error {
 
 // GetItem returns a item from MongoDB.
 func (db *MongoDB) GetItem(itemId string) (item Item, err error) {
-	ctx := context.Background()
+	return db.GetItemProjected(itemId, nil)
+}
+
+// GetItemProjected returns an item from MongoDB with only the fields read.
+func (db *MongoDB) GetItemProjected(itemId string, fields []string) (item Item, err error) {
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
-	r := c.FindOne(ctx, bson.M{"itemid": itemId})
+	r := c.FindOne(ctx, bson.M{"itemid": itemId}, options.FindOne().SetProjection(mongoProjection(fields, "itemid")))
 	if r.Err() == mongo.ErrNoDocuments {
 		err = errors.Annotate(ErrItemNotExist, itemId)
 		return
@@ -245,11 +473,17 @@ func (db *MongoDB) GetItem(itemId string) (item Item, err error) {
 
 // GetItems returns items from MongoDB.
 func (db *MongoDB) GetItems(cursor string, n int, timeLimit *time.Time) (string, []Item, error) {
-	ctx := context.Background()
+	return db.GetItemsProjected(cursor, n, timeLimit, nil)
+}
+
+// GetItemsProjected returns items from MongoDB with only the fields read.
+func (db *MongoDB) GetItemsProjected(cursor string, n int, timeLimit *time.Time, fields []string) (string, []Item, error) {
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
 	opt := options.Find()
 	opt.SetLimit(int64(n))
 	opt.SetSort(bson.D{{"itemid", 1}})
+	opt.SetProjection(mongoProjection(fields, "itemid"))
 	filter := bson.M{"itemid": bson.M{"$gt": cursor}}
 	if timeLimit != nil {
 		filter["timestamp"] = bson.M{"$gt": *timeLimit}
@@ -283,7 +517,7 @@ func (db *MongoDB) GetItemStream(batchSize int, timeLimit *time.Time) (chan []It
 		defer close(itemChan)
 		defer close(errChan)
 		// send query
-		ctx := context.Background()
+		ctx := db.context()
 		c := db.client.Database(db.dbName).Collection(db.ItemsTable())
 		opt := options.Find()
 		filter := bson.M{}
@@ -318,9 +552,134 @@ func (db *MongoDB) GetItemStream(batchSize int, timeLimit *time.Time) (chan []It
 	return itemChan, errChan
 }
 
+// GetCategories returns categories and numbers of items from MongoDB.
+func (db *MongoDB) GetCategories() ([]CategoryCount, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
+	r, err := c.Aggregate(ctx, mongo.Pipeline{
+		{{"$unwind", "$categories"}},
+		{{"$group", bson.D{{"_id", "$categories"}, {"count", bson.D{{"$sum", 1}}}}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	categories := make([]CategoryCount, 0)
+	defer r.Close(ctx)
+	for r.Next(ctx) {
+		var doc struct {
+			Name  string `bson:"_id"`
+			Count int    `bson:"count"`
+		}
+		if err = r.Decode(&doc); err != nil {
+			return nil, errors.Trace(err)
+		}
+		categories = append(categories, CategoryCount{Name: doc.Name, Count: doc.Count})
+	}
+	return categories, nil
+}
+
+// SampleItems samples items by $sample in MongoDB, which is uniform if items are more than 100 times of the sample
+// size. The seed is ignored since $sample can't be seeded, so that samples are not reproducible.
+func (db *MongoDB) SampleItems(n int, category string, _ int64) ([]Item, error) {
+	filter := bson.M{"ishidden": bson.M{"$ne": true}}
+	if category != "" {
+		filter["categories"] = category
+	}
+	return mongoSample[Item](db, db.ItemsTable(), bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$sample": bson.M{"size": n}},
+	})
+}
+
+// SampleUsers samples users by $sample in MongoDB, which is uniform if users are more than 100 times of the sample
+// size. Feedback of each user is looked up before sampling if required, which scans all users. The seed is ignored
+// since $sample can't be seeded, so that samples are not reproducible.
+func (db *MongoDB) SampleUsers(n int, hasFeedback bool, _ int64) ([]User, error) {
+	pipeline := bson.A{}
+	if hasFeedback {
+		pipeline = append(pipeline,
+			bson.M{"$lookup": bson.M{
+				"from":     db.FeedbackTable(),
+				"let":      bson.M{"userid": "$userid"},
+				"pipeline": bson.A{bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$feedbackkey.userid", "$$userid"}}}}, bson.M{"$limit": 1}},
+				"as":       "feedback",
+			}},
+			bson.M{"$match": bson.M{"feedback": bson.M{"$ne": bson.A{}}}},
+			bson.M{"$project": bson.M{"feedback": 0}})
+	}
+	pipeline = append(pipeline, bson.M{"$sample": bson.M{"size": n}})
+	return mongoSample[User](db, db.UsersTable(), pipeline)
+}
+
+func mongoSample[T any](db *MongoDB, collection string, pipeline bson.A) ([]T, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(collection)
+	r, err := c.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close(ctx)
+	values := make([]T, 0)
+	for r.Next(ctx) {
+		var value T
+		if err = r.Decode(&value); err != nil {
+			return nil, errors.Trace(err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// GetLabels returns labels and numbers of items and users from MongoDB.
+func (db *MongoDB) GetLabels() ([]LabelCount, error) {
+	itemCounts, err := db.countElements(db.ItemsTable(), "labels")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	userCounts, err := db.countElements(db.UsersTable(), "labels")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return MergeLabelCounts(itemCounts, userCounts), nil
+}
+
+// countElements counts documents containing each element of an array field.
+func (db *MongoDB) countElements(collection, field string) (map[string]int, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(collection)
+	r, err := c.Aggregate(ctx, mongo.Pipeline{
+		{{"$unwind", "$" + field}},
+		{{"$group", bson.D{{"_id", "$" + field}, {"count", bson.D{{"$sum", 1}}}}}},
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	counts := make(map[string]int)
+	defer r.Close(ctx)
+	for r.Next(ctx) {
+		var doc struct {
+			Name  string `bson:"_id"`
+			Count int    `bson:"count"`
+		}
+		if err = r.Decode(&doc); err != nil {
+			return nil, errors.Trace(err)
+		}
+		counts[doc.Name] = doc.Count
+	}
+	return counts, nil
+}
+
+// CountItems returns the number of items in MongoDB.
+func (db *MongoDB) CountItems() (int, error) {
+	c := db.client.Database(db.dbName).Collection(db.ItemsTable())
+	count, err := c.CountDocuments(db.context(), bson.M{})
+	return int(count), errors.Trace(err)
+}
+
 // GetItemFeedback returns feedback of a item from MongoDB.
 func (db *MongoDB) GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedback, error) {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
 	var r *mongo.Cursor
 	var err error
@@ -352,7 +711,7 @@ func (db *MongoDB) BatchInsertUsers(users []User) error {
 	if len(users) == 0 {
 		return nil
 	}
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.UsersTable())
 	var models []mongo.WriteModel
 	for _, user := range users {
@@ -378,16 +737,47 @@ func (db *MongoDB) ModifyUser(userId string, patch UserPatch) error {
 	if patch.Subscribe != nil {
 		update["subscribe"] = patch.Subscribe
 	}
+	var document interface{} = bson.M{"$set": update}
+	if patch.hasArrayOperations() {
+		update = mongoLiterals(update)
+		if len(patch.AddLabels) > 0 || len(patch.RemoveLabels) > 0 {
+			update["labels"] = mongoPatchArray("$labels", patch.Labels, patch.AddLabels, patch.RemoveLabels)
+		}
+		if len(patch.AddSubscribe) > 0 || len(patch.RemoveSubscribe) > 0 {
+			update["subscribe"] = mongoPatchArray("$subscribe", patch.Subscribe, patch.AddSubscribe, patch.RemoveSubscribe)
+		}
+		document = bson.A{bson.M{"$set": update}}
+	}
 	// execute
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.UsersTable())
-	_, err := c.UpdateOne(ctx, bson.M{"userid": bson.M{"$eq": userId}}, bson.M{"$set": update})
-	return errors.Trace(err)
+	filter := bson.M{"userid": bson.M{"$eq": userId}}
+	if patch.Version != "" {
+		var err error
+		filter, err = mongoVersionFilter(ctx, c, filter, errors.Annotate(ErrUserNotExist, userId), func(raw bson.Raw) error {
+			var user User
+			if err := bson.Unmarshal(raw, &user); err != nil {
+				return errors.Trace(err)
+			}
+			return patch.checkVersion(user)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	r, err := c.UpdateOne(ctx, filter, document)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if patch.Version != "" && r.MatchedCount == 0 {
+		return errors.Annotate(ErrConflict, userId)
+	}
+	return nil
 }
 
 // DeleteUser deletes a user from MongoDB.
 func (db *MongoDB) DeleteUser(userId string) error {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.UsersTable())
 	_, err := c.DeleteOne(ctx, bson.M{"userid": userId})
 	if err != nil {
@@ -402,9 +792,14 @@ func (db *MongoDB) DeleteUser(userId string) error {
 
 // GetUser returns a user from MongoDB.
 func (db *MongoDB) GetUser(userId string) (user User, err error) {
-	ctx := context.Background()
+	return db.GetUserProjected(userId, nil)
+}
+
+// GetUserProjected returns a user from MongoDB with only the fields read.
+func (db *MongoDB) GetUserProjected(userId string, fields []string) (user User, err error) {
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.UsersTable())
-	r := c.FindOne(ctx, bson.M{"userid": userId})
+	r := c.FindOne(ctx, bson.M{"userid": userId}, options.FindOne().SetProjection(mongoProjection(fields, "userid")))
 	if r.Err() == mongo.ErrNoDocuments {
 		err = errors.Annotate(ErrUserNotExist, userId)
 		return
@@ -415,11 +810,17 @@ func (db *MongoDB) GetUser(userId string) (user User, err error) {
 
 // GetUsers returns users from MongoDB.
 func (db *MongoDB) GetUsers(cursor string, n int) (string, []User, error) {
-	ctx := context.Background()
+	return db.GetUsersProjected(cursor, n, nil)
+}
+
+// GetUsersProjected returns users from MongoDB with only the fields read.
+func (db *MongoDB) GetUsersProjected(cursor string, n int, fields []string) (string, []User, error) {
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.UsersTable())
 	opt := options.Find()
 	opt.SetLimit(int64(n))
 	opt.SetSort(bson.D{{"userid", 1}})
+	opt.SetProjection(mongoProjection(fields, "userid"))
 	r, err := c.Find(ctx, bson.M{"userid": bson.M{"$gt": cursor}}, opt)
 	if err != nil {
 		return "", nil, err
@@ -441,6 +842,13 @@ func (db *MongoDB) GetUsers(cursor string, n int) (string, []User, error) {
 	return cursor, users, nil
 }
 
+// CountUsers returns the number of users in MongoDB.
+func (db *MongoDB) CountUsers() (int, error) {
+	c := db.client.Database(db.dbName).Collection(db.UsersTable())
+	count, err := c.CountDocuments(db.context(), bson.M{})
+	return int(count), errors.Trace(err)
+}
+
 // GetUserStream reads users from MongoDB by stream.
 func (db *MongoDB) GetUserStream(batchSize int) (chan []User, chan error) {
 	userChan := make(chan []User, bufSize)
@@ -449,7 +857,7 @@ func (db *MongoDB) GetUserStream(batchSize int) (chan []User, chan error) {
 		defer close(userChan)
 		defer close(errChan)
 		// send query
-		ctx := context.Background()
+		ctx := db.context()
 		c := db.client.Database(db.dbName).Collection(db.UsersTable())
 		opt := options.Find()
 		r, err := c.Find(ctx, bson.M{}, opt)
@@ -481,7 +889,7 @@ func (db *MongoDB) GetUserStream(batchSize int) (chan []User, chan error) {
 
 // GetUserFeedback returns feedback of a user from MongoDB.
 func (db *MongoDB) GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]Feedback, error) {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
 	var r *mongo.Cursor
 	var err error
@@ -512,7 +920,7 @@ func (db *MongoDB) GetUserFeedback(userId string, withFuture bool, feedbackTypes
 
 // BatchInsertFeedback returns multiple feedback into MongoDB.
 func (db *MongoDB) BatchInsertFeedback(feedback []Feedback, insertUser, insertItem, overwrite bool) error {
-	ctx := context.Background()
+	ctx := db.context()
 	// skip empty list
 	if len(feedback) == 0 {
 		return nil
@@ -555,11 +963,12 @@ func (db *MongoDB) BatchInsertFeedback(feedback []Feedback, insertUser, insertIt
 	itemList := items.List()
 	if insertItem {
 		var models []mongo.WriteModel
+		now := time.Now().In(time.UTC)
 		for _, itemId := range itemList {
 			models = append(models, mongo.NewUpdateOneModel().
 				SetUpsert(true).
 				SetFilter(bson.M{"itemid": bson.M{"$eq": itemId}}).
-				SetUpdate(bson.M{"$setOnInsert": Item{ItemId: itemId}}))
+				SetUpdate(bson.M{"$setOnInsert": Item{ItemId: itemId, CreatedAt: now}}))
 		}
 		c := db.client.Database(db.dbName).Collection(db.ItemsTable())
 		_, err := c.BulkWrite(ctx, models)
@@ -589,7 +998,17 @@ func (db *MongoDB) BatchInsertFeedback(feedback []Feedback, insertUser, insertIt
 					"feedbackkey": f.FeedbackKey,
 				})
 			if overwrite {
-				model.SetUpdate(bson.M{"$set": f})
+				// outdated feedback never replaces newer feedback
+				model.SetUpdate(mongo.Pipeline{{{"$set", bson.M{
+					"feedbackkey": bson.M{"$literal": f.FeedbackKey},
+					"timestamp":   bson.M{"$max": bson.A{"$timestamp", f.Timestamp}},
+					"comment": bson.M{"$cond": bson.A{
+						bson.M{"$gt": bson.A{"$timestamp", f.Timestamp}}, "$comment", bson.M{"$literal": f.Comment},
+					}},
+					"context": bson.M{"$cond": bson.A{
+						bson.M{"$gt": bson.A{"$timestamp", f.Timestamp}}, "$context", bson.M{"$literal": f.Context},
+					}},
+				}}}})
 			} else {
 				model.SetUpdate(bson.M{"$setOnInsert": f})
 			}
@@ -605,7 +1024,7 @@ func (db *MongoDB) BatchInsertFeedback(feedback []Feedback, insertUser, insertIt
 
 // GetFeedback returns multiple feedback from MongoDB.
 func (db *MongoDB) GetFeedback(cursor string, n int, timeLimit *time.Time, feedbackTypes ...string) (string, []Feedback, error) {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
 	opt := options.Find()
 	opt.SetLimit(int64(n))
@@ -660,7 +1079,7 @@ func (db *MongoDB) GetFeedbackStream(batchSize int, timeLimit *time.Time, feedba
 		defer close(feedbackChan)
 		defer close(errChan)
 		// send query
-		ctx := context.Background()
+		ctx := db.context()
 		c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
 		opt := options.Find()
 		filter := make(bson.M)
@@ -700,9 +1119,46 @@ func (db *MongoDB) GetFeedbackStream(batchSize int, timeLimit *time.Time, feedba
 	return feedbackChan, errChan
 }
 
+// GetUserFeedbackStream reads feedback of a user from MongoDB by stream.
+func (db *MongoDB) GetUserFeedbackStream(userId string, batchSize int) (chan []Feedback, chan error) {
+	feedbackChan := make(chan []Feedback, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(feedbackChan)
+		defer close(errChan)
+		// send query
+		ctx := db.context()
+		c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
+		r, err := c.Find(ctx, bson.M{"feedbackkey.userid": bson.M{"$eq": userId}})
+		if err != nil {
+			errChan <- errors.Trace(err)
+			return
+		}
+		feedbacks := make([]Feedback, 0, batchSize)
+		defer r.Close(ctx)
+		for r.Next(ctx) {
+			var feedback Feedback
+			if err = r.Decode(&feedback); err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
+			feedbacks = append(feedbacks, feedback)
+			if len(feedbacks) == batchSize {
+				feedbackChan <- feedbacks
+				feedbacks = make([]Feedback, 0, batchSize)
+			}
+		}
+		if len(feedbacks) > 0 {
+			feedbackChan <- feedbacks
+		}
+		errChan <- nil
+	}()
+	return feedbackChan, errChan
+}
+
 // GetUserItemFeedback returns a feedback return the user id and item id from MongoDB.
 func (db *MongoDB) GetUserItemFeedback(userId, itemId string, feedbackTypes ...string) ([]Feedback, error) {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
 	var filter = bson.M{
 		"feedbackkey.userid": bson.M{"$eq": userId},
@@ -729,7 +1185,7 @@ func (db *MongoDB) GetUserItemFeedback(userId, itemId string, feedbackTypes ...s
 
 // DeleteUserItemFeedback deletes a feedback return the user id and item id from MongoDB.
 func (db *MongoDB) DeleteUserItemFeedback(userId, itemId string, feedbackTypes ...string) (int, error) {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
 	var filter = bson.M{
 		"feedbackkey.userid": bson.M{"$eq": userId},
@@ -745,9 +1201,34 @@ func (db *MongoDB) DeleteUserItemFeedback(userId, itemId string, feedbackTypes .
 	return int(r.DeletedCount), nil
 }
 
+// DeleteUserFeedbackInRange deletes feedback of a user timestamped in a range from MongoDB.
+func (db *MongoDB) DeleteUserFeedbackInRange(userId string, begin, end *time.Time, feedbackTypes ...string) (int, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
+	filter := bson.M{"feedbackkey.userid": bson.M{"$eq": userId}}
+	timeFilter := bson.M{}
+	if begin != nil {
+		timeFilter["$gte"] = *begin
+	}
+	if end != nil {
+		timeFilter["$lt"] = *end
+	}
+	if len(timeFilter) > 0 {
+		filter["timestamp"] = timeFilter
+	}
+	if len(feedbackTypes) > 0 {
+		filter["feedbackkey.feedbacktype"] = bson.M{"$in": feedbackTypes}
+	}
+	r, err := c.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(r.DeletedCount), nil
+}
+
 // CountActiveUsers returns the number active users starting from a specified date.
 func (db *MongoDB) CountActiveUsers(date time.Time) (int, error) {
-	ctx := context.Background()
+	ctx := db.context()
 	c := db.client.Database(db.dbName).Collection(db.FeedbackTable())
 	distinct, err := c.Distinct(ctx, "feedbackkey.userid", bson.M{
 		"timestamp": bson.M{
@@ -760,3 +1241,284 @@ func (db *MongoDB) CountActiveUsers(date time.Time) (int, error) {
 	}
 	return len(distinct), nil
 }
+
+// SetUserOverrides inserts or replaces overrides of a user in MongoDB.
+func (db *MongoDB) SetUserOverrides(overrides UserOverrides) error {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.UserOverridesTable())
+	_, err := c.ReplaceOne(ctx, bson.M{"userid": bson.M{"$eq": overrides.UserId}}, overrides, options.Replace().SetUpsert(true))
+	return errors.Trace(err)
+}
+
+// GetUserOverrides returns overrides of a user from MongoDB.
+func (db *MongoDB) GetUserOverrides(userId string) (overrides UserOverrides, err error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.UserOverridesTable())
+	r := c.FindOne(ctx, bson.M{"userid": userId})
+	if r.Err() == mongo.ErrNoDocuments {
+		err = errors.Annotate(ErrOverridesNotExist, userId)
+		return
+	}
+	err = r.Decode(&overrides)
+	return
+}
+
+// DeleteUserOverrides deletes overrides of a user from MongoDB.
+func (db *MongoDB) DeleteUserOverrides(userId string) error {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.UserOverridesTable())
+	_, err := c.DeleteOne(ctx, bson.M{"userid": userId})
+	return errors.Trace(err)
+}
+
+// GetUserOverridesStream reads overrides of all users from MongoDB by stream.
+func (db *MongoDB) GetUserOverridesStream(batchSize int) (chan []UserOverrides, chan error) {
+	overridesChan := make(chan []UserOverrides, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(overridesChan)
+		defer close(errChan)
+		// send query
+		ctx := db.context()
+		c := db.client.Database(db.dbName).Collection(db.UserOverridesTable())
+		r, err := c.Find(ctx, bson.M{})
+		if err != nil {
+			errChan <- errors.Trace(err)
+			return
+		}
+		batch := make([]UserOverrides, 0, batchSize)
+		defer r.Close(ctx)
+		for r.Next(ctx) {
+			var overrides UserOverrides
+			if err = r.Decode(&overrides); err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
+			batch = append(batch, overrides)
+			if len(batch) == batchSize {
+				overridesChan <- batch
+				batch = make([]UserOverrides, 0, batchSize)
+			}
+		}
+		if len(batch) > 0 {
+			overridesChan <- batch
+		}
+		errChan <- nil
+	}()
+	return overridesChan, errChan
+}
+
+// BatchInsertItemCanonicals inserts or replaces canonical items of near-duplicate items in MongoDB.
+func (db *MongoDB) BatchInsertItemCanonicals(canonicals []ItemCanonical) error {
+	if len(canonicals) == 0 {
+		return nil
+	}
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.ItemCanonicalsTable())
+	var models []mongo.WriteModel
+	for _, canonical := range canonicals {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{"itemid": bson.M{"$eq": canonical.ItemId}}).
+			SetReplacement(canonical))
+	}
+	_, err := c.BulkWrite(ctx, models)
+	return errors.Trace(err)
+}
+
+// GetItemCanonicals returns canonical items of all near-duplicate items from MongoDB.
+func (db *MongoDB) GetItemCanonicals() ([]ItemCanonical, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.ItemCanonicalsTable())
+	r, err := c.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"itemid": 1}))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close(ctx)
+	var canonicals []ItemCanonical
+	for r.Next(ctx) {
+		var canonical ItemCanonical
+		if err = r.Decode(&canonical); err != nil {
+			return nil, errors.Trace(err)
+		}
+		canonicals = append(canonicals, canonical)
+	}
+	return canonicals, nil
+}
+
+// DeleteItemCanonicals deletes canonical items of near-duplicate items from MongoDB.
+func (db *MongoDB) DeleteItemCanonicals(itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
+	}
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.ItemCanonicalsTable())
+	_, err := c.DeleteMany(ctx, bson.M{"itemid": bson.M{"$in": itemIds}})
+	return errors.Trace(err)
+}
+
+// InsertAuditLogs inserts audit logs into MongoDB.
+func (db *MongoDB) InsertAuditLogs(auditLogs []AuditLog) error {
+	if len(auditLogs) == 0 {
+		return nil
+	}
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.AuditLogsTable())
+	documents := make([]interface{}, len(auditLogs))
+	for i, auditLog := range auditLogs {
+		documents[i] = auditLog
+	}
+	_, err := c.InsertMany(ctx, documents)
+	return errors.Trace(err)
+}
+
+// GetAuditLogs returns audit logs from MongoDB.
+func (db *MongoDB) GetAuditLogs(cursor string, n int, entity, actor string) (string, []AuditLog, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.AuditLogsTable())
+	filter := bson.M{}
+	if cursor != "" {
+		filter["id"] = bson.M{"$lte": cursor}
+	}
+	if actor != "" {
+		filter["actor"] = actor
+	}
+	if entity != "" {
+		filter["entities"] = entity
+	}
+	r, err := c.Find(ctx, filter, options.Find().SetSort(bson.M{"id": -1}).SetLimit(int64(n+1)))
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	defer r.Close(ctx)
+	auditLogs := make([]AuditLog, 0)
+	for r.Next(ctx) {
+		var auditLog AuditLog
+		if err = r.Decode(&auditLog); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		auditLogs = append(auditLogs, auditLog)
+	}
+	if len(auditLogs) == n+1 {
+		return auditLogs[n].Id, auditLogs[:n], nil
+	}
+	return "", auditLogs, nil
+}
+
+// DeleteAuditLogs deletes audit logs written before a time from MongoDB.
+func (db *MongoDB) DeleteAuditLogs(before time.Time) error {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.AuditLogsTable())
+	_, err := c.DeleteMany(ctx, bson.M{"id": bson.M{"$lt": auditLogIdPrefix(before)}})
+	return errors.Trace(err)
+}
+
+// BatchInsertUsage inserts or replaces figures of usage in MongoDB.
+func (db *MongoDB) BatchInsertUsage(usage []Usage) error {
+	if len(usage) == 0 {
+		return nil
+	}
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.DailyUsageTable())
+	var models []mongo.WriteModel
+	for _, u := range usage {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{"day": u.Day, "metric": u.Metric}).
+			SetReplacement(u))
+	}
+	_, err := c.BulkWrite(ctx, models)
+	return errors.Trace(err)
+}
+
+// GetUsage returns figures of usage from one day to another day from MongoDB.
+func (db *MongoDB) GetUsage(from, to string) ([]Usage, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.DailyUsageTable())
+	r, err := c.Find(ctx, bson.M{"day": bson.M{"$gte": from, "$lte": to}},
+		options.Find().SetSort(bson.D{{"day", 1}, {"metric", 1}}))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close(ctx)
+	usage := make([]Usage, 0)
+	for r.Next(ctx) {
+		var u Usage
+		if err = r.Decode(&u); err != nil {
+			return nil, errors.Trace(err)
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+// BatchInsertRecommendSnapshots inserts or replaces snapshots of recommendation in MongoDB.
+func (db *MongoDB) BatchInsertRecommendSnapshots(snapshots []RecommendSnapshot) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.RecommendSnapshotsTable())
+	var models []mongo.WriteModel
+	for _, snapshot := range snapshots {
+		snapshot.Timestamp = snapshot.Timestamp.In(time.UTC)
+		models = append(models, mongo.NewReplaceOneModel().
+			SetUpsert(true).
+			SetFilter(bson.M{"userid": snapshot.UserId, "timestamp": snapshot.Timestamp}).
+			SetReplacement(snapshot))
+	}
+	_, err := c.BulkWrite(ctx, models)
+	return errors.Trace(err)
+}
+
+// GetRecommendSnapshots returns snapshots of recommendation of a user from MongoDB.
+func (db *MongoDB) GetRecommendSnapshots(userId string) ([]RecommendSnapshot, error) {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.RecommendSnapshotsTable())
+	r, err := c.Find(ctx, bson.M{"userid": userId}, options.Find().SetSort(bson.M{"timestamp": 1}))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close(ctx)
+	snapshots := make([]RecommendSnapshot, 0)
+	for r.Next(ctx) {
+		var snapshot RecommendSnapshot
+		if err = r.Decode(&snapshot); err != nil {
+			return nil, errors.Trace(err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// DeleteRecommendSnapshots deletes snapshots of recommendation in time buckets beginning before a time from MongoDB.
+func (db *MongoDB) DeleteRecommendSnapshots(before time.Time) error {
+	ctx := db.context()
+	c := db.client.Database(db.dbName).Collection(db.RecommendSnapshotsTable())
+	_, err := c.DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": before}})
+	return errors.Trace(err)
+}
+
+// GetTableSizes returns bytes of collections and their indices in MongoDB.
+func (db *MongoDB) GetTableSizes() (map[string]int64, error) {
+	ctx := db.context()
+	d := db.client.Database(db.dbName)
+	sizes := make(map[string]int64)
+	for name, collection := range tableNames(db.TablePrefix) {
+		var stats struct {
+			StorageSize    float64 `bson:"storageSize"`
+			TotalIndexSize float64 `bson:"totalIndexSize"`
+		}
+		if err := d.RunCommand(ctx, bson.D{{"collStats", collection}}).Decode(&stats); err != nil {
+			return nil, errors.Trace(err)
+		}
+		sizes[name] = int64(stats.StorageSize + stats.TotalIndexSize)
+	}
+	return sizes, nil
+}
+
+func (db *MongoDB) WithContext(ctx context.Context) Database {
+	database := *db
+	database.ctx = ctx
+	return &database
+}
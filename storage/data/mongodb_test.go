@@ -15,6 +15,7 @@ package data
 
 import (
 	"context"
+	"github.com/juju/errors"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"runtime"
@@ -41,7 +42,7 @@ type testMongoDatabase struct {
 	Database
 }
 
-func (db *testMongoDatabase) GetMongoDB(t *testing.T) *MongoDB {
+func (db *testMongoDatabase) GetMongoDB(t testing.TB) *MongoDB {
 	var mongoDatabase *MongoDB
 	var ok bool
 	mongoDatabase, ok = db.Database.(*MongoDB)
@@ -49,12 +50,12 @@ func (db *testMongoDatabase) GetMongoDB(t *testing.T) *MongoDB {
 	return mongoDatabase
 }
 
-func (db *testMongoDatabase) Close(t *testing.T) {
+func (db *testMongoDatabase) Close(t testing.TB) {
 	err := db.Database.Close()
 	assert.NoError(t, err)
 }
 
-func newTestMongoDatabase(t *testing.T) *testMongoDatabase {
+func newTestMongoDatabase(t testing.TB) *testMongoDatabase {
 	// retrieve test name
 	var testName string
 	pc, _, _, ok := runtime.Caller(1)
@@ -119,6 +120,103 @@ func TestMongoDatabase_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestMongoDatabase_Categories(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestMongoDatabase_Labels(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestMongoDatabase_PatchArrays(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+	testConcurrentPatchArrays(t, db.Database)
+}
+
+func TestMongoDatabase_ModifyConflict(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestMongoDatabase_BatchGetItems(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func BenchmarkMongoDatabase_BatchGetItems(b *testing.B) {
+	db := newTestMongoDatabase(b)
+	defer db.Close(b)
+	benchmarkBatchGetItems(b, db.Database)
+}
+
+func TestMongoDatabase_Sample(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testSample(t, db.Database, false)
+}
+
+func TestMongoDatabase_UserOverrides(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestMongoDatabase_ItemCanonicals(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestMongoDatabase_AuditLogs(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestMongoDatabase_Usage(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestMongoDatabase_RecommendSnapshots(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestMongoDatabase_FutureFeedback(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestMongoDatabase_FeedbackOutOfOrder(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestMongoDatabase_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestMongoDatabase_Count(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestMongoDatabase_DeleteFeedback(t *testing.T) {
 	db := newTestMongoDatabase(t)
 	defer db.Close(t)
@@ -142,3 +240,43 @@ func TestMongoDatabase_Purge(t *testing.T) {
 	defer db.Close(t)
 	testPurge(t, db.Database)
 }
+
+func TestMongoDatabase_Projection(t *testing.T) {
+	db := newTestMongoDatabase(t)
+	defer db.Close(t)
+	projector := db.Database.(Projector)
+	err := db.BatchInsertItems([]Item{
+		{ItemId: "0", Labels: []string{"a"}, Categories: []string{"b"}, Comment: "large"},
+		{ItemId: "1", Labels: []string{"c"}, Categories: []string{"d"}, Comment: "large"},
+	})
+	assert.NoError(t, err)
+	err = db.BatchInsertUsers([]User{
+		{UserId: "0", Labels: []string{"a"}, Comment: "large"},
+		{UserId: "1", Labels: []string{"b"}, Comment: "large"},
+	})
+	assert.NoError(t, err)
+
+	// only requested fields and ids are read
+	item, err := projector.GetItemProjected("0", []string{"Labels"})
+	assert.NoError(t, err)
+	assert.Equal(t, Item{ItemId: "0", Labels: []string{"a"}}, item)
+	cursor, items, err := projector.GetItemsProjected("", 1, nil, []string{"Categories"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Item{{ItemId: "0", Categories: []string{"b"}}}, items)
+	_, items, err = projector.GetItemsProjected(cursor, 1, nil, []string{"Categories"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Item{{ItemId: "1", Categories: []string{"d"}}}, items)
+	user, err := projector.GetUserProjected("1", []string{"Labels"})
+	assert.NoError(t, err)
+	assert.Equal(t, User{UserId: "1", Labels: []string{"b"}}, user)
+	_, users, err := projector.GetUsersProjected("", 10, []string{"Labels"})
+	assert.NoError(t, err)
+	assert.Equal(t, []User{{UserId: "0", Labels: []string{"a"}}, {UserId: "1", Labels: []string{"b"}}}, users)
+
+	// all fields are read if fields are empty
+	item, err = projector.GetItemProjected("0", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "large", item.Comment)
+	_, err = projector.GetItemProjected("2", []string{"Labels"})
+	assert.True(t, errors.Is(err, errors.NotFound), err)
+}
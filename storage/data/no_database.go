@@ -46,8 +46,8 @@ func (NoDatabase) BatchInsertItems(_ []Item) error {
 }
 
 // BatchGetItems method of NoDatabase returns ErrNoDatabase.
-func (NoDatabase) BatchGetItems(_ []string) ([]Item, error) {
-	return nil, ErrNoDatabase
+func (NoDatabase) BatchGetItems(_ []string) ([]Item, []string, error) {
+	return nil, nil, ErrNoDatabase
 }
 
 // DeleteItem method of NoDatabase returns ErrNoDatabase.
@@ -55,6 +55,31 @@ func (NoDatabase) DeleteItem(_ string) error {
 	return ErrNoDatabase
 }
 
+// GetLabels method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetLabels() ([]LabelCount, error) {
+	return nil, ErrNoDatabase
+}
+
+// SampleItems method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) SampleItems(_ int, _ string, _ int64) ([]Item, error) {
+	return nil, ErrNoDatabase
+}
+
+// SampleUsers method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) SampleUsers(_ int, _ bool, _ int64) ([]User, error) {
+	return nil, ErrNoDatabase
+}
+
+// GetCategories method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetCategories() ([]CategoryCount, error) {
+	return nil, ErrNoDatabase
+}
+
+// CountItems method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) CountItems() (int, error) {
+	return 0, ErrNoDatabase
+}
+
 // GetItem method of NoDatabase returns ErrNoDatabase.
 func (NoDatabase) GetItem(_ string) (Item, error) {
 	return Item{}, ErrNoDatabase
@@ -102,6 +127,11 @@ func (NoDatabase) GetUsers(_ string, _ int) (string, []User, error) {
 	return "", nil, ErrNoDatabase
 }
 
+// CountUsers method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) CountUsers() (int, error) {
+	return 0, ErrNoDatabase
+}
+
 // GetUserStream method of NoDatabase returns ErrNoDatabase.
 func (NoDatabase) GetUserStream(_ int) (chan []User, chan error) {
 	userChan := make(chan []User, bufSize)
@@ -129,6 +159,11 @@ func (NoDatabase) DeleteUserItemFeedback(_, _ string, _ ...string) (int, error)
 	return 0, ErrNoDatabase
 }
 
+// DeleteUserFeedbackInRange method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) DeleteUserFeedbackInRange(_ string, _, _ *time.Time, _ ...string) (int, error) {
+	return 0, ErrNoDatabase
+}
+
 // BatchInsertFeedback method of NoDatabase returns ErrNoDatabase.
 func (NoDatabase) BatchInsertFeedback(_ []Feedback, _, _, _ bool) error {
 	return ErrNoDatabase
@@ -155,6 +190,109 @@ func (d NoDatabase) ModifyItem(_ string, _ ItemPatch) error {
 	return ErrNoDatabase
 }
 
+func (d NoDatabase) BatchModifyItems(_ []string, _ ItemPatch) error {
+	return ErrNoDatabase
+}
+
 func (d NoDatabase) ModifyUser(_ string, _ UserPatch) error {
 	return ErrNoDatabase
 }
+
+// GetUserFeedbackStream method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetUserFeedbackStream(_ string, _ int) (chan []Feedback, chan error) {
+	feedbackChan := make(chan []Feedback, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(feedbackChan)
+		defer close(errChan)
+		errChan <- ErrNoDatabase
+	}()
+	return feedbackChan, errChan
+}
+
+// SetUserOverrides method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) SetUserOverrides(_ UserOverrides) error {
+	return ErrNoDatabase
+}
+
+// GetUserOverrides method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetUserOverrides(_ string) (UserOverrides, error) {
+	return UserOverrides{}, ErrNoDatabase
+}
+
+// DeleteUserOverrides method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) DeleteUserOverrides(_ string) error {
+	return ErrNoDatabase
+}
+
+// GetUserOverridesStream method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetUserOverridesStream(_ int) (chan []UserOverrides, chan error) {
+	overridesChan := make(chan []UserOverrides, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(overridesChan)
+		defer close(errChan)
+		errChan <- ErrNoDatabase
+	}()
+	return overridesChan, errChan
+}
+
+// BatchInsertItemCanonicals method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) BatchInsertItemCanonicals(_ []ItemCanonical) error {
+	return ErrNoDatabase
+}
+
+// GetItemCanonicals method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetItemCanonicals() ([]ItemCanonical, error) {
+	return nil, ErrNoDatabase
+}
+
+// DeleteItemCanonicals method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) DeleteItemCanonicals(_ []string) error {
+	return ErrNoDatabase
+}
+
+// InsertAuditLogs method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) InsertAuditLogs(_ []AuditLog) error {
+	return ErrNoDatabase
+}
+
+// GetAuditLogs method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetAuditLogs(_ string, _ int, _, _ string) (string, []AuditLog, error) {
+	return "", nil, ErrNoDatabase
+}
+
+// DeleteAuditLogs method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) DeleteAuditLogs(_ time.Time) error {
+	return ErrNoDatabase
+}
+
+// BatchInsertUsage method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) BatchInsertUsage(_ []Usage) error {
+	return ErrNoDatabase
+}
+
+// GetUsage method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetUsage(_, _ string) ([]Usage, error) {
+	return nil, ErrNoDatabase
+}
+
+// BatchInsertRecommendSnapshots method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) BatchInsertRecommendSnapshots(_ []RecommendSnapshot) error {
+	return ErrNoDatabase
+}
+
+// GetRecommendSnapshots method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetRecommendSnapshots(_ string) ([]RecommendSnapshot, error) {
+	return nil, ErrNoDatabase
+}
+
+// DeleteRecommendSnapshots method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) DeleteRecommendSnapshots(_ time.Time) error {
+	return ErrNoDatabase
+}
+
+// GetTableSizes method of NoDatabase returns ErrNoDatabase.
+func (NoDatabase) GetTableSizes() (map[string]int64, error) {
+	return nil, ErrNoDatabase
+}
@@ -17,6 +17,7 @@ package data
 import (
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestNoDatabase(t *testing.T) {
@@ -33,16 +34,24 @@ func TestNoDatabase(t *testing.T) {
 
 	err = database.BatchInsertItems(nil)
 	assert.ErrorIs(t, err, ErrNoDatabase)
-	_, err = database.BatchGetItems(nil)
+	_, _, err = database.BatchGetItems(nil)
 	assert.ErrorIs(t, err, ErrNoDatabase)
 	err = database.ModifyItem("", ItemPatch{})
 	assert.ErrorIs(t, err, ErrNoDatabase)
+	err = database.BatchModifyItems(nil, ItemPatch{})
+	assert.ErrorIs(t, err, ErrNoDatabase)
 	_, err = database.GetItem("")
 	assert.ErrorIs(t, err, ErrNoDatabase)
 	_, _, err = database.GetItems("", 0, nil)
 	assert.ErrorIs(t, err, ErrNoDatabase)
 	err = database.DeleteItem("")
 	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.GetCategories()
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.GetLabels()
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.CountItems()
+	assert.ErrorIs(t, err, ErrNoDatabase)
 	_, c := database.GetItemStream(0, nil)
 	assert.ErrorIs(t, <-c, ErrNoDatabase)
 
@@ -54,6 +63,8 @@ func TestNoDatabase(t *testing.T) {
 	assert.ErrorIs(t, err, ErrNoDatabase)
 	_, _, err = database.GetUsers("", 0)
 	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.CountUsers()
+	assert.ErrorIs(t, err, ErrNoDatabase)
 	err = database.DeleteUser("")
 	assert.ErrorIs(t, err, ErrNoDatabase)
 	_, c = database.GetUserStream(0)
@@ -73,6 +84,46 @@ func TestNoDatabase(t *testing.T) {
 	assert.ErrorIs(t, err, ErrNoDatabase)
 	_, err = database.DeleteUserItemFeedback("", "")
 	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.DeleteUserFeedbackInRange("", nil, nil)
+	assert.ErrorIs(t, err, ErrNoDatabase)
 	_, c = database.GetFeedbackStream(0, nil)
 	assert.ErrorIs(t, <-c, ErrNoDatabase)
+	_, c = database.GetUserFeedbackStream("", 0)
+	assert.ErrorIs(t, <-c, ErrNoDatabase)
+
+	err = database.SetUserOverrides(UserOverrides{})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.GetUserOverrides("")
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	err = database.DeleteUserOverrides("")
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, c = database.GetUserOverridesStream(0)
+	assert.ErrorIs(t, <-c, ErrNoDatabase)
+
+	err = database.BatchInsertItemCanonicals([]ItemCanonical{{}})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.GetItemCanonicals()
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	err = database.DeleteItemCanonicals([]string{""})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+
+	err = database.InsertAuditLogs([]AuditLog{{}})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, _, err = database.GetAuditLogs("", 0, "", "")
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	err = database.DeleteAuditLogs(time.Time{})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+
+	err = database.BatchInsertUsage([]Usage{{}})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.GetUsage("", "")
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	err = database.BatchInsertRecommendSnapshots([]RecommendSnapshot{{}})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.GetRecommendSnapshots("")
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	err = database.DeleteRecommendSnapshots(time.Time{})
+	assert.ErrorIs(t, err, ErrNoDatabase)
+	_, err = database.GetTableSizes()
+	assert.ErrorIs(t, err, ErrNoDatabase)
 }
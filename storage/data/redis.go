@@ -17,6 +17,7 @@ package data
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/juju/errors"
 	"github.com/scylladb/go-set/strset"
@@ -27,13 +28,201 @@ import (
 )
 
 const (
-	prefixItem     = "item/"     // prefix for items
-	prefixUser     = "user/"     // prefix for users
-	prefixFeedback = "feedback/" // prefix for feedback
+	prefixItem      = "item/"      // prefix for items
+	prefixUser      = "user/"      // prefix for users
+	prefixFeedback  = "feedback/"  // prefix for feedback
+	prefixOverrides = "overrides/" // prefix for user overrides
+	keyCategories   = "categories" // hash of numbers of items in categories
+	keyCanonicals   = "canonicals" // hash of canonical items of near-duplicate items
+	keyAuditLogs    = "audit_logs" // sorted set of audit logs ordered by ids
+	keyUsage        = "usage"      // hash of figures of usage by days followed by metrics
+
+	prefixRecommendSnapshots = "recommend_snapshots/" // prefix for hashes of snapshots of recommendation of users
+	keyRecommendSnapshots    = "recommend_snapshots"  // sorted set of time buckets followed by users of snapshots
+
+	redisMaxTxRetries  = 100
+	labelScanBatchSize = 1000
+	usageDayLength     = len("2006-01-02")
+	snapshotFieldLen   = 16
 )
 
+// readItemCategories reads categories of an item. Categories of a missing item are empty.
+func readItemCategories(ctx context.Context, client redis.Cmdable, key string) ([]string, error) {
+	item, err := readItem(ctx, client, key)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return item.Categories, nil
+}
+
+// readItem reads an item by its key. Nil is returned if the item doesn't exist.
+func readItem(ctx context.Context, client redis.Cmdable, key string) (*Item, error) {
+	data, err := client.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	item, err := decodeItem(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &item, nil
+}
+
+// modifyUser reads a user and returns the patched user in JSON.
+func modifyUser(ctx context.Context, client redis.Cmdable, userId string, patch UserPatch) ([]byte, error) {
+	val, err := client.Get(ctx, prefixUser+userId).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, errors.Annotate(ErrUserNotExist, userId)
+		}
+		return nil, errors.Trace(err)
+	}
+	var user User
+	if err = json.Unmarshal([]byte(val), &user); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = patch.checkVersion(user); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(patch.Apply(user))
+	return data, errors.Trace(err)
+}
+
+// redisItem is the JSON representation of an item in Redis, which includes the creation time hidden from the API.
+type redisItem struct {
+	Item
+	CreatedAt time.Time
+}
+
+func encodeItem(item Item) ([]byte, error) {
+	return json.Marshal(redisItem{Item: item, CreatedAt: item.CreatedAt})
+}
+
+func decodeItem(data string) (Item, error) {
+	var item redisItem
+	if err := json.Unmarshal([]byte(data), &item); err != nil {
+		return Item{}, err
+	}
+	item.Item.CreatedAt = item.CreatedAt
+	return item.Item, nil
+}
+
+// backfillCategories counts items in categories if the hash of categories doesn't exist, which happens to items
+// inserted before categories were maintained. The hash is written only if it isn't modified during counting.
+func backfillCategories(ctx context.Context, client redis.UniversalClient) error {
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err := client.Watch(ctx, func(tx *redis.Tx) error {
+			exists, err := tx.Exists(ctx, keyCategories).Result()
+			if err != nil || exists > 0 {
+				return err
+			}
+			counts := make(map[string]interface{})
+			var (
+				cursor uint64
+				keys   []string
+			)
+			for {
+				keys, cursor, err = client.Scan(ctx, cursor, prefixItem+"*", 0).Result()
+				if err != nil {
+					return errors.Trace(err)
+				}
+				for _, key := range keys {
+					categories, err := readItemCategories(ctx, client, key)
+					if err != nil {
+						return errors.Trace(err)
+					}
+					for _, category := range strset.New(categories...).List() {
+						count, _ := counts[category].(int64)
+						counts[category] = count + 1
+					}
+				}
+				if cursor == 0 {
+					break
+				}
+			}
+			if len(counts) == 0 {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, keyCategories, counts)
+				return nil
+			})
+			return err
+		}, keyCategories)
+		if err != redis.TxFailedErr {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(redis.TxFailedErr)
+}
+
+// categoryDeltas returns changes of numbers of items in categories when categories of an item are replaced.
+func categoryDeltas(before, after []string) map[string]int64 {
+	deltas := make(map[string]int64)
+	for _, category := range strset.New(before...).List() {
+		deltas[category]--
+	}
+	for _, category := range strset.New(after...).List() {
+		deltas[category]++
+	}
+	for category, delta := range deltas {
+		if delta == 0 {
+			delete(deltas, category)
+		}
+	}
+	return deltas
+}
+
+func parseCategoryCounts(counts map[string]string) ([]CategoryCount, error) {
+	categories := make([]CategoryCount, 0, len(counts))
+	for name, value := range counts {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if count > 0 {
+			categories = append(categories, CategoryCount{Name: name, Count: count})
+		}
+	}
+	SortCategoryCounts(categories)
+	return categories, nil
+}
+
+// scanLabelCounts counts labels of items and users by streams, for databases without aggregations.
+func scanLabelCounts(database Database) ([]LabelCount, error) {
+	itemCounts, userCounts := make(map[string]int), make(map[string]int)
+	itemChan, errChan := database.GetItemStream(labelScanBatchSize, nil)
+	for items := range itemChan {
+		for _, item := range items {
+			for _, label := range item.Labels {
+				itemCounts[label]++
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return nil, errors.Trace(err)
+	}
+	userChan, errChan := database.GetUserStream(labelScanBatchSize)
+	for users := range userChan {
+		for _, user := range users {
+			for _, label := range user.Labels {
+				userCounts[label]++
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return nil, errors.Trace(err)
+	}
+	return MergeLabelCounts(itemCounts, userCounts), nil
+}
+
 // Redis use Redis as data storage, but used for test only.
 type Redis struct {
+	requestContext
+	batchGetOptions
 	client *redis.Client
 }
 
@@ -44,7 +233,7 @@ func (r *Redis) Optimize() error {
 
 // Init does nothing.
 func (r *Redis) Init() error {
-	return nil
+	return backfillCategories(r.context(), r.client)
 }
 
 // Close Redis connection.
@@ -52,66 +241,181 @@ func (r *Redis) Close() error {
 	return r.client.Close()
 }
 
+// Purge deletes all keys except audit logs and usage.
 func (r *Redis) Purge() error {
-	return r.client.FlushDB(context.Background()).Err()
+	ctx := r.context()
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, "*", 0).Result()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		keys = funk.SubtractString(keys, []string{keyAuditLogs, keyUsage})
+		if len(keys) > 0 {
+			if err = r.client.Del(ctx, keys...).Err(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
 }
 
-// insertItem inserts an item into Redis.
-func (r *Redis) insertItem(item Item) error {
-	var ctx = context.Background()
-	// write item
-	data, err := json.Marshal(item)
+// writeFeedback writes feedback unless the feedback exists and overwrite is false, or newer feedback exists. It returns
+// false if the feedback isn't written. The stored feedback is read and replaced in a transaction, which is retried if
+// the feedback is modified.
+func writeFeedback(ctx context.Context, client redis.UniversalClient, feedback Feedback, overwrite bool) (bool, error) {
+	val, err := json.Marshal(feedback)
 	if err != nil {
-		return errors.Trace(err)
+		return false, errors.Trace(err)
 	}
-	if err = r.client.Set(ctx, prefixItem+item.ItemId, data, 0).Err(); err != nil {
-		return errors.Trace(err)
-	}
-	return nil
-}
-
-// BatchInsertItems inserts a batch of items into Redis.
-func (r *Redis) BatchInsertItems(items []Item) error {
-	for _, item := range items {
-		if err := r.insertItem(item); err != nil {
-			return errors.Trace(err)
+	key := createFeedbackKey(feedback.FeedbackKey)
+	var written bool
+	for i := 0; i < redisMaxTxRetries; i++ {
+		written = false
+		err = client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Result()
+			if err == nil {
+				if !overwrite {
+					return nil
+				}
+				var stored Feedback
+				if err = json.Unmarshal([]byte(data), &stored); err != nil {
+					return errors.Trace(err)
+				}
+				if feedback.Timestamp.Before(stored.Timestamp) {
+					return nil
+				}
+			} else if err != redis.Nil {
+				return errors.Trace(err)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, val, 0)
+				return nil
+			})
+			written = err == nil
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return written, errors.Trace(err)
 		}
 	}
-	return nil
+	return false, errors.Trace(err)
 }
 
-func (r *Redis) BatchGetItems(itemIds []string) ([]Item, error) {
-	ctx := context.Background()
+// countKeys counts keys with a prefix by scanning.
+func countKeys(ctx context.Context, client redis.UniversalClient, prefix string) (int, error) {
 	var (
-		items  []Item
+		count  int
 		cursor uint64
-		err    error
 		keys   []string
+		err    error
 	)
 	for {
-		keys, cursor, err = r.client.Scan(ctx, cursor, prefixItem+"*", -1).Result()
+		keys, cursor, err = client.Scan(ctx, cursor, prefix+"*", 0).Result()
 		if err != nil {
-			return nil, err
+			return 0, errors.Trace(err)
 		}
-		for _, key := range keys {
-			data, err := r.client.Get(ctx, key).Result()
+		count += len(keys)
+		if cursor == 0 {
+			return count, nil
+		}
+	}
+}
+
+// insertItem inserts an item into Redis.
+func (r *Redis) insertItem(item Item) error {
+	now := time.Now().In(time.UTC)
+	return r.updateItem(item.ItemId, func(previous *Item) (Item, error) {
+		if previous != nil {
+			item.CreatedAt = previous.CreatedAt
+		} else {
+			item.CreatedAt = now
+		}
+		return item, nil
+	})
+}
+
+// updateItem reads an item and writes back the updated item. The previous item is read and replaced in a
+// transaction, which is retried if the item is modified.
+func (r *Redis) updateItem(itemId string, update func(previous *Item) (Item, error)) error {
+	var ctx = r.context()
+	key := prefixItem + itemId
+	var err error
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			previous, err := readItem(ctx, tx, key)
 			if err != nil {
-				return nil, err
+				return errors.Trace(err)
 			}
-			var item Item
-			err = json.Unmarshal([]byte(data), &item)
+			item, err := update(previous)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			if funk.ContainsString(itemIds, item.ItemId) {
-				items = append(items, item)
+			item.VisibleFrom, item.VisibleUntil = utcTime(item.VisibleFrom), utcTime(item.VisibleUntil)
+			var categories []string
+			if previous != nil {
+				categories = previous.Categories
+			}
+			data, err := encodeItem(item)
+			if err != nil {
+				return errors.Trace(err)
 			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, 0)
+				for category, delta := range categoryDeltas(categories, item.Categories) {
+					pipe.HIncrBy(ctx, keyCategories, category, delta)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return errors.Trace(err)
 		}
-		if cursor == 0 {
-			break
+	}
+	return errors.Trace(err)
+}
+
+// BatchInsertItems inserts a batch of items into Redis.
+func (r *Redis) BatchInsertItems(items []Item) error {
+	for _, item := range items {
+		if err := r.insertItem(item); err != nil {
+			return errors.Trace(err)
 		}
 	}
-	return items, nil
+	return nil
+}
+
+// BatchGetItems gets items from Redis by pipelines of chunks of ids.
+func (r *Redis) BatchGetItems(itemIds []string) ([]Item, []string, error) {
+	ctx := r.context()
+	return r.batchGetItems(itemIds, func(chunk []string) ([]Item, error) {
+		pipeline := r.client.Pipeline()
+		commands := make([]*redis.StringCmd, len(chunk))
+		for i, itemId := range chunk {
+			commands[i] = pipeline.Get(ctx, prefixItem+itemId)
+		}
+		if _, err := pipeline.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, errors.Trace(err)
+		}
+		items := make([]Item, 0, len(chunk))
+		for _, command := range commands {
+			data, err := command.Result()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return nil, errors.Trace(err)
+			}
+			item, err := decodeItem(data)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	})
 }
 
 func (r *Redis) ForFeedback(ctx context.Context, action func(key, thisFeedbackType, thisUserId, thisItemId string) error) error {
@@ -138,9 +442,30 @@ func (r *Redis) ForFeedback(ctx context.Context, action func(key, thisFeedbackTy
 
 // DeleteItem deletes a item from Redis.
 func (r *Redis) DeleteItem(itemId string) error {
-	var ctx = context.Background()
-	// remove user
-	if err := r.client.Del(ctx, prefixItem+itemId).Err(); err != nil {
+	var ctx = r.context()
+	// remove item
+	key := prefixItem + itemId
+	var err error
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			categories, err := readItemCategories(ctx, tx, key)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				for category, delta := range categoryDeltas(categories, nil) {
+					pipe.HIncrBy(ctx, keyCategories, category, delta)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
 		return errors.Trace(err)
 	}
 	// remove feedback
@@ -153,9 +478,49 @@ func (r *Redis) DeleteItem(itemId string) error {
 	})
 }
 
+// GetCategories returns categories and numbers of items maintained in Redis.
+func (r *Redis) GetCategories() ([]CategoryCount, error) {
+	counts, err := r.client.HGetAll(r.context(), keyCategories).Result()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseCategoryCounts(counts)
+}
+
+// GetLabels returns labels and numbers of items and users by scanning items and users in Redis.
+func (r *Redis) GetLabels() ([]LabelCount, error) {
+	return scanLabelCounts(r)
+}
+
+// SampleItems samples items by scanning items in Redis, which is uniform.
+func (r *Redis) SampleItems(n int, category string, seed int64) ([]Item, error) {
+	return scanSampleItems(r, n, category, seed)
+}
+
+// SampleUsers samples users by scanning users in Redis, which is uniform. Users with feedback are collected by
+// scanning keys of feedback if required.
+func (r *Redis) SampleUsers(n int, hasFeedback bool, seed int64) ([]User, error) {
+	var candidates *strset.Set
+	if hasFeedback {
+		candidates = strset.New()
+		if err := r.ForFeedback(r.context(), func(_, _, userId, _ string) error {
+			candidates.Add(userId)
+			return nil
+		}); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return scanSampleUsers(r, n, candidates, seed)
+}
+
+// CountItems returns the number of items in Redis.
+func (r *Redis) CountItems() (int, error) {
+	return countKeys(r.context(), r.client, prefixItem)
+}
+
 // GetItem get a item from Redis.
 func (r *Redis) GetItem(itemId string) (Item, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	data, err := r.client.Get(ctx, prefixItem+itemId).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -163,14 +528,12 @@ func (r *Redis) GetItem(itemId string) (Item, error) {
 		}
 		return Item{}, err
 	}
-	var item Item
-	err = json.Unmarshal([]byte(data), &item)
-	return item, err
+	return decodeItem(data)
 }
 
 // GetItems returns items from Redis.
 func (r *Redis) GetItems(cursor string, n int, timeLimit *time.Time) (string, []Item, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	var err error
 	cursorNum := uint64(0)
 	if len(cursor) > 0 {
@@ -191,8 +554,7 @@ func (r *Redis) GetItems(cursor string, n int, timeLimit *time.Time) (string, []
 		if err != nil {
 			return "", nil, err
 		}
-		var item Item
-		err = json.Unmarshal([]byte(data), &item)
+		item, err := decodeItem(data)
 		if err != nil {
 			return "", nil, err
 		}
@@ -217,7 +579,7 @@ func (r *Redis) GetItemStream(batchSize int, timeLimit *time.Time) (chan []Item,
 	go func() {
 		defer close(itemChan)
 		defer close(errChan)
-		ctx := context.Background()
+		ctx := r.context()
 		var cursor uint64
 		var keys []string
 		var err error
@@ -234,8 +596,7 @@ func (r *Redis) GetItemStream(batchSize int, timeLimit *time.Time) (chan []Item,
 					errChan <- errors.Trace(err)
 					return
 				}
-				var item Item
-				err = json.Unmarshal([]byte(data), &item)
+				item, err := decodeItem(data)
 				if err != nil {
 					errChan <- errors.Trace(err)
 					return
@@ -264,7 +625,7 @@ func (r *Redis) GetItemStream(batchSize int, timeLimit *time.Time) (chan []Item,
 
 // GetItemFeedback returns feedback of an item from Redis.
 func (r *Redis) GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, _, thisItemId string) error {
@@ -273,7 +634,7 @@ func (r *Redis) GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedb
 			if err != nil {
 				return errors.Trace(err)
 			}
-			if val.Timestamp.Before(time.Now()) {
+			if !val.Timestamp.After(time.Now()) {
 				feedback = append(feedback, val)
 			}
 		}
@@ -284,7 +645,7 @@ func (r *Redis) GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedb
 
 // insertUser inserts a user into Redis.
 func (r *Redis) insertUser(user User) error {
-	var ctx = context.Background()
+	var ctx = r.context()
 	data, err := json.Marshal(user)
 	if err != nil {
 		return errors.Trace(err)
@@ -304,7 +665,7 @@ func (r *Redis) BatchInsertUsers(users []User) error {
 
 // DeleteUser deletes a user from Redis.
 func (r *Redis) DeleteUser(userId string) error {
-	var ctx = context.Background()
+	var ctx = r.context()
 	// remove user
 	if err := r.client.Del(ctx, prefixUser+userId).Err(); err != nil {
 		return errors.Trace(err)
@@ -320,7 +681,7 @@ func (r *Redis) DeleteUser(userId string) error {
 
 // GetUser returns a user from Redis.
 func (r *Redis) GetUser(userId string) (User, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	val, err := r.client.Get(ctx, prefixUser+userId).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -338,7 +699,7 @@ func (r *Redis) GetUser(userId string) (User, error) {
 
 // GetUsers returns users from Redis.
 func (r *Redis) GetUsers(cursor string, n int) (string, []User, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	var err error
 	cursorNum := uint64(0)
 	if len(cursor) > 0 {
@@ -373,6 +734,11 @@ func (r *Redis) GetUsers(cursor string, n int) (string, []User, error) {
 	return cursor, users, nil
 }
 
+// CountUsers returns the number of users in Redis.
+func (r *Redis) CountUsers() (int, error) {
+	return countKeys(r.context(), r.client, prefixUser)
+}
+
 // GetUserStream read users from Redis by stream.
 func (r *Redis) GetUserStream(batchSize int) (chan []User, chan error) {
 	userChan := make(chan []User, bufSize)
@@ -380,7 +746,7 @@ func (r *Redis) GetUserStream(batchSize int) (chan []User, chan error) {
 	go func() {
 		defer close(userChan)
 		defer close(errChan)
-		ctx := context.Background()
+		ctx := r.context()
 		var cursor uint64
 		var keys []string
 		var err error
@@ -423,7 +789,7 @@ func (r *Redis) GetUserStream(batchSize int) (chan []User, chan error) {
 
 // GetUserFeedback returns feedback of a user from Redis.
 func (r *Redis) GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	// get itemId list by userId
@@ -433,7 +799,7 @@ func (r *Redis) GetUserFeedback(userId string, withFuture bool, feedbackTypes ..
 			if err != nil {
 				return errors.Trace(err)
 			}
-			if withFuture || val.Timestamp.Before(time.Now()) {
+			if withFuture || !val.Timestamp.After(time.Now()) {
 				feedback = append(feedback, val)
 			}
 		}
@@ -442,8 +808,43 @@ func (r *Redis) GetUserFeedback(userId string, withFuture bool, feedbackTypes ..
 	return feedback, err
 }
 
+// GetUserFeedbackStream reads feedback of a user from Redis by stream.
+func (r *Redis) GetUserFeedbackStream(userId string, batchSize int) (chan []Feedback, chan error) {
+	feedbackChan := make(chan []Feedback, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(feedbackChan)
+		defer close(errChan)
+		feedbacks := make([]Feedback, 0, batchSize)
+		err := r.ForFeedback(r.context(), func(key, _, thisUserId, _ string) error {
+			if thisUserId != userId {
+				return nil
+			}
+			feedback, err := r.getFeedbackInternal(key)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			feedbacks = append(feedbacks, feedback)
+			if len(feedbacks) == batchSize {
+				feedbackChan <- feedbacks
+				feedbacks = make([]Feedback, 0, batchSize)
+			}
+			return nil
+		})
+		if err != nil {
+			errChan <- errors.Trace(err)
+			return
+		}
+		if len(feedbacks) > 0 {
+			feedbackChan <- feedbacks
+		}
+		errChan <- nil
+	}()
+	return feedbackChan, errChan
+}
+
 func (r *Redis) getFeedbackInternal(key string) (Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	// get feedback by feedbackKey
 	val, err := r.client.Get(ctx, key).Result()
 	if err != nil {
@@ -488,22 +889,13 @@ func (r *Redis) insertFeedback(feedback Feedback, insertUser, insertItem, overwr
 	} else if err != nil {
 		return err
 	}
-	var ctx = context.Background()
-	val, err := json.Marshal(feedback)
-	if err != nil {
-		return errors.Trace(err)
-	}
+	var ctx = r.context()
 	// insert feedback
-	feedbackKey := createFeedbackKey(feedback.FeedbackKey)
-	if exists, err := r.client.Exists(ctx, feedbackKey).Result(); err != nil {
+	if written, err := writeFeedback(ctx, r.client, feedback, overwrite); err != nil {
 		return errors.Trace(err)
-	} else if exists > 0 && !overwrite {
+	} else if !written {
 		return nil
 	}
-	err = r.client.Set(ctx, feedbackKey, val, 0).Err()
-	if err != nil {
-		return errors.Trace(err)
-	}
 	// insert user
 	if insertUser {
 		if exist, err := r.client.Exists(ctx, prefixUser+feedback.UserId).Result(); err != nil {
@@ -524,8 +916,8 @@ func (r *Redis) insertFeedback(feedback Feedback, insertUser, insertItem, overwr
 		if exist, err := r.client.Exists(ctx, prefixItem+feedback.ItemId).Result(); err != nil {
 			return errors.Trace(err)
 		} else if exist == 0 {
-			item := Item{ItemId: feedback.ItemId}
-			data, err := json.Marshal(item)
+			item := Item{ItemId: feedback.ItemId, CreatedAt: time.Now().In(time.UTC)}
+			data, err := encodeItem(item)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -551,7 +943,7 @@ func (r *Redis) BatchInsertFeedback(feedback []Feedback, insertUser, insertItem,
 
 // GetFeedback returns feedback from Redis.
 func (r *Redis) GetFeedback(_ string, _ int, timeLimit *time.Time, feedbackTypes ...string) (string, []Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
@@ -563,7 +955,7 @@ func (r *Redis) GetFeedback(_ string, _ int, timeLimit *time.Time, feedbackTypes
 			if timeLimit != nil && val.Timestamp.Unix() < timeLimit.Unix() {
 				return nil
 			}
-			if val.Timestamp.Before(time.Now()) {
+			if !val.Timestamp.After(time.Now()) {
 				feedback = append(feedback, val)
 			}
 		}
@@ -580,7 +972,7 @@ func (r *Redis) GetFeedbackStream(batchSize int, timeLimit *time.Time, feedbackT
 		defer close(feedbackChan)
 		defer close(errChan)
 		feedbackTypeSet := strset.New(feedbackTypes...)
-		ctx := context.Background()
+		ctx := r.context()
 		feedback := make([]Feedback, 0, batchSize)
 		err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
 			if feedbackTypeSet.IsEmpty() || feedbackTypeSet.Has(thisFeedbackType) {
@@ -591,7 +983,7 @@ func (r *Redis) GetFeedbackStream(batchSize int, timeLimit *time.Time, feedbackT
 				if timeLimit != nil && val.Timestamp.Unix() < timeLimit.Unix() {
 					return nil
 				}
-				if val.Timestamp.Before(time.Now()) {
+				if !val.Timestamp.After(time.Now()) {
 					feedback = append(feedback, val)
 					if len(feedback) == batchSize {
 						feedbackChan <- feedback
@@ -611,7 +1003,7 @@ func (r *Redis) GetFeedbackStream(batchSize int, timeLimit *time.Time, feedbackT
 
 // GetUserItemFeedback gets a feedback by user id and item id from Redis.
 func (r *Redis) GetUserItemFeedback(userId, itemId string, feedbackTypes ...string) ([]Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
@@ -629,7 +1021,7 @@ func (r *Redis) GetUserItemFeedback(userId, itemId string, feedbackTypes ...stri
 
 // DeleteUserItemFeedback deletes a feedback by user id and item id from Redis.
 func (r *Redis) DeleteUserItemFeedback(userId, itemId string, feedbackTypes ...string) (int, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	deleteCount := 0
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
@@ -642,50 +1034,411 @@ func (r *Redis) DeleteUserItemFeedback(userId, itemId string, feedbackTypes ...s
 	return deleteCount, err
 }
 
+// DeleteUserFeedbackInRange deletes feedback of a user timestamped in a range from Redis.
+func (r *Redis) DeleteUserFeedbackInRange(userId string, begin, end *time.Time, feedbackTypes ...string) (int, error) {
+	var ctx = r.context()
+	feedbackTypeSet := strset.New(feedbackTypes...)
+	deleteCount := 0
+	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
+		if thisUserId != userId || (!feedbackTypeSet.IsEmpty() && !feedbackTypeSet.Has(thisFeedbackType)) {
+			return nil
+		}
+		feedback, err := r.getFeedbackInternal(key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if (begin != nil && feedback.Timestamp.Before(*begin)) || (end != nil && !feedback.Timestamp.Before(*end)) {
+			return nil
+		}
+		if err = r.client.Del(ctx, key).Err(); err != nil {
+			return errors.Trace(err)
+		}
+		deleteCount++
+		return nil
+	})
+	return deleteCount, err
+}
+
 // ModifyItem modify an item in Redis.
 func (r *Redis) ModifyItem(itemId string, patch ItemPatch) error {
-	// read item
-	item, err := r.GetItem(itemId)
+	return r.updateItem(itemId, func(previous *Item) (Item, error) {
+		if previous == nil {
+			return Item{}, errors.Annotate(ErrItemNotExist, itemId)
+		}
+		if err := patch.checkVersion(*previous); err != nil {
+			return Item{}, err
+		}
+		return patch.Apply(*previous), nil
+	})
+}
+
+// BatchModifyItems applies the same modification to items in Redis.
+func (r *Redis) BatchModifyItems(itemIds []string, patch ItemPatch) error {
+	for _, itemId := range itemIds {
+		if err := r.ModifyItem(itemId, patch); err != nil {
+			if errors.Is(err, errors.NotFound) {
+				continue
+			}
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// ModifyUser modify a user in Redis. The user is read and replaced in a transaction, which is retried if the user is
+// modified.
+func (r *Redis) ModifyUser(userId string, patch UserPatch) error {
+	var ctx = r.context()
+	key := prefixUser + userId
+	var err error
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := modifyUser(ctx, tx, userId, patch)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(err)
+}
+
+// SetUserOverrides inserts or replaces overrides of a user in Redis.
+func (r *Redis) SetUserOverrides(overrides UserOverrides) error {
+	var ctx = r.context()
+	data, err := json.Marshal(overrides)
 	if err != nil {
-		return err
+		return errors.Trace(err)
+	}
+	return r.client.Set(ctx, prefixOverrides+overrides.UserId, data, 0).Err()
+}
+
+// GetUserOverrides returns overrides of a user from Redis.
+func (r *Redis) GetUserOverrides(userId string) (UserOverrides, error) {
+	var ctx = r.context()
+	val, err := r.client.Get(ctx, prefixOverrides+userId).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return UserOverrides{}, errors.Annotate(ErrOverridesNotExist, userId)
+		}
+		return UserOverrides{}, errors.Trace(err)
+	}
+	var overrides UserOverrides
+	if err = json.Unmarshal([]byte(val), &overrides); err != nil {
+		return UserOverrides{}, errors.Trace(err)
+	}
+	return overrides, nil
+}
+
+// DeleteUserOverrides deletes overrides of a user from Redis.
+func (r *Redis) DeleteUserOverrides(userId string) error {
+	var ctx = r.context()
+	return r.client.Del(ctx, prefixOverrides+userId).Err()
+}
+
+// GetUserOverridesStream reads overrides of all users from Redis by stream.
+func (r *Redis) GetUserOverridesStream(batchSize int) (chan []UserOverrides, chan error) {
+	overridesChan := make(chan []UserOverrides, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(overridesChan)
+		defer close(errChan)
+		ctx := r.context()
+		var cursor uint64
+		var keys []string
+		var err error
+		batch := make([]UserOverrides, 0, batchSize)
+		for {
+			keys, cursor, err = r.client.Scan(ctx, cursor, prefixOverrides+"*", int64(batchSize)).Result()
+			if err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
+			for _, key := range keys {
+				var overrides UserOverrides
+				val, err := r.client.Get(ctx, key).Result()
+				if err != nil {
+					errChan <- errors.Trace(err)
+					return
+				}
+				err = json.Unmarshal([]byte(val), &overrides)
+				if err != nil {
+					errChan <- errors.Trace(err)
+					return
+				}
+				batch = append(batch, overrides)
+				if len(batch) == batchSize {
+					overridesChan <- batch
+					batch = make([]UserOverrides, 0, batchSize)
+				}
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+		if len(batch) > 0 {
+			overridesChan <- batch
+		}
+		errChan <- nil
+	}()
+	return overridesChan, errChan
+}
+
+// BatchInsertItemCanonicals inserts or replaces canonical items of near-duplicate items in Redis.
+func (r *Redis) BatchInsertItemCanonicals(canonicals []ItemCanonical) error {
+	if len(canonicals) == 0 {
+		return nil
+	}
+	values := make(map[string]interface{}, len(canonicals))
+	for _, canonical := range canonicals {
+		values[canonical.ItemId] = canonical.CanonicalId
+	}
+	return errors.Trace(r.client.HSet(r.context(), keyCanonicals, values).Err())
+}
+
+// GetItemCanonicals returns canonical items of all near-duplicate items from Redis.
+func (r *Redis) GetItemCanonicals() ([]ItemCanonical, error) {
+	canonicals, err := r.client.HGetAll(r.context(), keyCanonicals).Result()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return sortItemCanonicals(canonicals), nil
+}
+
+// DeleteItemCanonicals deletes canonical items of near-duplicate items from Redis.
+func (r *Redis) DeleteItemCanonicals(itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
 	}
-	// apply patch
-	if patch.IsHidden != nil {
-		item.IsHidden = *patch.IsHidden
+	return errors.Trace(r.client.HDel(r.context(), keyCanonicals, itemIds...).Err())
+}
+
+// InsertAuditLogs inserts audit logs into Redis.
+func (r *Redis) InsertAuditLogs(auditLogs []AuditLog) error {
+	return insertAuditLogs(r.context(), r.client, auditLogs)
+}
+
+// GetAuditLogs returns audit logs from Redis.
+func (r *Redis) GetAuditLogs(cursor string, n int, entity, actor string) (string, []AuditLog, error) {
+	return getAuditLogs(r.context(), r.client, cursor, n, entity, actor)
+}
+
+// DeleteAuditLogs deletes audit logs written before a time from Redis.
+func (r *Redis) DeleteAuditLogs(before time.Time) error {
+	return deleteAuditLogs(r.context(), r.client, before)
+}
+
+// insertAuditLogs adds audit logs to a sorted set, where scores are zero and members are ids of audit logs followed by
+// audit logs in JSON. Since ids are hexadecimal, members are ordered by ids lexicographically.
+func insertAuditLogs(ctx context.Context, client redis.Cmdable, auditLogs []AuditLog) error {
+	if len(auditLogs) == 0 {
+		return nil
 	}
-	if patch.Categories != nil {
-		item.Categories = patch.Categories
+	members := make([]*redis.Z, len(auditLogs))
+	for i, auditLog := range auditLogs {
+		data, err := json.Marshal(auditLog)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		members[i] = &redis.Z{Member: auditLog.Id + string(data)}
 	}
-	if patch.Comment != nil {
-		item.Comment = *patch.Comment
+	return errors.Trace(client.ZAdd(ctx, keyAuditLogs, members...).Err())
+}
+
+// getAuditLogs scans audit logs from the cursor in the sorted set until n + 1 audit logs match the entity and the
+// actor.
+func getAuditLogs(ctx context.Context, client redis.Cmdable, cursor string, n int, entity, actor string) (string, []AuditLog, error) {
+	upper := "+"
+	if cursor != "" {
+		// members of the cursor are followed by JSON objects and less than the byte 0xff
+		upper = "(" + cursor + "\xff"
 	}
-	if patch.Labels != nil {
-		item.Labels = patch.Labels
+	auditLogs := make([]AuditLog, 0)
+	for len(auditLogs) <= n {
+		members, err := client.ZRevRangeByLex(ctx, keyAuditLogs, &redis.ZRangeBy{Min: "-", Max: upper, Count: int64(n + 1)}).Result()
+		if err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		for _, member := range members {
+			var auditLog AuditLog
+			if err = json.Unmarshal([]byte(member[strings.IndexByte(member, '{'):]), &auditLog); err != nil {
+				return "", nil, errors.Trace(err)
+			}
+			if auditLog.match(entity, actor) {
+				auditLogs = append(auditLogs, auditLog)
+				if len(auditLogs) > n {
+					break
+				}
+			}
+		}
+		if len(members) <= n {
+			break
+		}
+		upper = "(" + members[len(members)-1]
 	}
-	if patch.Timestamp != nil {
-		item.Timestamp = *patch.Timestamp
+	if len(auditLogs) > n {
+		return auditLogs[n].Id, auditLogs[:n], nil
 	}
-	// write back
-	return r.insertItem(item)
+	return "", auditLogs, nil
 }
 
-// ModifyUser modify a user in Redis.
-func (r *Redis) ModifyUser(userId string, patch UserPatch) error {
-	// read user
-	user, err := r.GetUser(userId)
+// deleteAuditLogs removes audit logs whose ids are less than the prefix of ids at a time from the sorted set.
+func deleteAuditLogs(ctx context.Context, client redis.Cmdable, before time.Time) error {
+	return errors.Trace(client.ZRemRangeByLex(ctx, keyAuditLogs, "-", "("+auditLogIdPrefix(before)).Err())
+}
+
+// BatchInsertUsage inserts or replaces figures of usage in Redis.
+func (r *Redis) BatchInsertUsage(usage []Usage) error {
+	return insertUsage(r.context(), r.client, usage)
+}
+
+// GetUsage returns figures of usage from one day to another day from Redis.
+func (r *Redis) GetUsage(from, to string) ([]Usage, error) {
+	return getUsage(r.context(), r.client, from, to)
+}
+
+// BatchInsertRecommendSnapshots inserts or replaces snapshots of recommendation in Redis.
+func (r *Redis) BatchInsertRecommendSnapshots(snapshots []RecommendSnapshot) error {
+	return insertRecommendSnapshots(r.context(), r.client, snapshots)
+}
+
+// GetRecommendSnapshots returns snapshots of recommendation of a user from Redis.
+func (r *Redis) GetRecommendSnapshots(userId string) ([]RecommendSnapshot, error) {
+	return getRecommendSnapshots(r.context(), r.client, userId)
+}
+
+// DeleteRecommendSnapshots deletes snapshots of recommendation in time buckets beginning before a time from Redis.
+func (r *Redis) DeleteRecommendSnapshots(before time.Time) error {
+	return deleteRecommendSnapshots(r.context(), r.client, before)
+}
+
+// GetTableSizes is not supported by Redis since tables aren't stored separately.
+func (r *Redis) GetTableSizes() (map[string]int64, error) {
+	return nil, errors.NotSupportedf("sizes of tables in Redis")
+}
+
+// insertUsage sets figures of usage in a hash, where fields are days followed by metrics. Since days are formatted in
+// fixed length, days and metrics are separated by the length of days.
+func insertUsage(ctx context.Context, client redis.Cmdable, usage []Usage) error {
+	if len(usage) == 0 {
+		return nil
+	}
+	values := make(map[string]interface{}, len(usage))
+	for _, u := range usage {
+		values[u.Day+u.Metric] = u.Value
+	}
+	return errors.Trace(client.HSet(ctx, keyUsage, values).Err())
+}
+
+// getUsage reads all figures of usage in the hash and filters them by days.
+func getUsage(ctx context.Context, client redis.Cmdable, from, to string) ([]Usage, error) {
+	values, err := client.HGetAll(ctx, keyUsage).Result()
 	if err != nil {
-		return err
+		return nil, errors.Trace(err)
+	}
+	usage := make([]Usage, 0)
+	for field, value := range values {
+		if len(field) < usageDayLength {
+			continue
+		}
+		day, metric := field[:usageDayLength], field[usageDayLength:]
+		if day < from || day > to {
+			continue
+		}
+		amount, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		usage = append(usage, Usage{Day: day, Metric: metric, Value: amount})
+	}
+	SortUsage(usage)
+	return usage, nil
+}
+
+// snapshotField formats the beginning of a time bucket in fixed length, which is ordered by time lexicographically.
+func snapshotField(timestamp time.Time) string {
+	return fmt.Sprintf("%016x", timestamp.UnixNano())
+}
+
+// insertRecommendSnapshots sets snapshots in hashes of users, where fields are beginnings of time buckets. Time buckets
+// followed by users are indexed in a sorted set scored by seconds, so that expired snapshots are found without scanning.
+func insertRecommendSnapshots(ctx context.Context, client redis.Cmdable, snapshots []RecommendSnapshot) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	members := make([]*redis.Z, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		field := snapshotField(snapshot.Timestamp)
+		if err = client.HSet(ctx, prefixRecommendSnapshots+snapshot.UserId, field, data).Err(); err != nil {
+			return errors.Trace(err)
+		}
+		members = append(members, &redis.Z{Member: field + snapshot.UserId, Score: float64(snapshot.Timestamp.Unix())})
+	}
+	return errors.Trace(client.ZAdd(ctx, keyRecommendSnapshots, members...).Err())
+}
+
+// getRecommendSnapshots reads all snapshots in the hash of a user.
+func getRecommendSnapshots(ctx context.Context, client redis.Cmdable, userId string) ([]RecommendSnapshot, error) {
+	values, err := client.HGetAll(ctx, prefixRecommendSnapshots+userId).Result()
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
-	// apply patch
-	if patch.Comment != nil {
-		user.Comment = *patch.Comment
+	snapshots := make([]RecommendSnapshot, 0, len(values))
+	for _, value := range values {
+		var snapshot RecommendSnapshot
+		if err = json.Unmarshal([]byte(value), &snapshot); err != nil {
+			return nil, errors.Trace(err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	SortRecommendSnapshots(snapshots)
+	return snapshots, nil
+}
+
+// deleteRecommendSnapshots finds expired snapshots in the sorted set and removes them from hashes of users. Since
+// scores are seconds, candidates are filtered by beginnings of time buckets in nanoseconds.
+func deleteRecommendSnapshots(ctx context.Context, client redis.Cmdable, before time.Time) error {
+	members, err := client.ZRangeByScore(ctx, keyRecommendSnapshots, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(before.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return errors.Trace(err)
 	}
-	if patch.Labels != nil {
-		user.Labels = patch.Labels
+	beforeField := snapshotField(before)
+	var removed []interface{}
+	for _, member := range members {
+		if len(member) < snapshotFieldLen {
+			continue
+		}
+		field, userId := member[:snapshotFieldLen], member[snapshotFieldLen:]
+		if field >= beforeField {
+			continue
+		}
+		if err = client.HDel(ctx, prefixRecommendSnapshots+userId, field).Err(); err != nil {
+			return errors.Trace(err)
+		}
+		removed = append(removed, member)
 	}
-	if patch.Subscribe != nil {
-		user.Subscribe = patch.Subscribe
+	if len(removed) > 0 {
+		return errors.Trace(client.ZRem(ctx, keyRecommendSnapshots, removed...).Err())
 	}
-	// write back
-	return r.insertUser(user)
+	return nil
+}
+
+func (r *Redis) WithContext(ctx context.Context) Database {
+	database := *r
+	database.ctx = ctx
+	return &database
 }
@@ -27,6 +27,8 @@ import (
 
 // RedisCluster use RedisCluster as data storage, but used for test only.
 type RedisCluster struct {
+	requestContext
+	batchGetOptions
 	client *redis.ClusterClient
 }
 
@@ -37,7 +39,7 @@ func (r *RedisCluster) Optimize() error {
 
 // Init does nothing.
 func (r *RedisCluster) Init() error {
-	return nil
+	return backfillCategories(r.context(), r.client)
 }
 
 // Close RedisCluster connection.
@@ -47,16 +49,75 @@ func (r *RedisCluster) Close() error {
 
 // insertItem inserts an item into RedisCluster.
 func (r *RedisCluster) insertItem(item Item) error {
-	var ctx = context.Background()
-	// write item
-	data, err := json.Marshal(item)
+	now := time.Now().In(time.UTC)
+	return r.updateItem(item.ItemId, func(previous *Item) (Item, error) {
+		if previous != nil {
+			item.CreatedAt = previous.CreatedAt
+		} else {
+			item.CreatedAt = now
+		}
+		return item, nil
+	})
+}
+
+// updateItem reads an item and writes back the updated item. The item is replaced in a transaction, which is retried
+// if the item is modified. Numbers of items in categories are updated after the transaction since they are located in
+// another slot.
+func (r *RedisCluster) updateItem(itemId string, update func(previous *Item) (Item, error)) error {
+	var ctx = r.context()
+	key := prefixItem + itemId
+	var (
+		categories []string
+		item       Item
+		err        error
+	)
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			previous, err := readItem(ctx, tx, key)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if item, err = update(previous); err != nil {
+				return err
+			}
+			item.VisibleFrom, item.VisibleUntil = utcTime(item.VisibleFrom), utcTime(item.VisibleUntil)
+			categories = nil
+			if previous != nil {
+				categories = previous.Categories
+			}
+			data, err := encodeItem(item)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if err = r.client.Set(ctx, prefixItem+item.ItemId, data, 0).Err(); err != nil {
-		return errors.Trace(err)
+	return r.updateCategories(categoryDeltas(categories, item.Categories))
+}
+
+// updateCategories updates numbers of items in categories.
+func (r *RedisCluster) updateCategories(deltas map[string]int64) error {
+	if len(deltas) == 0 {
+		return nil
 	}
-	return nil
+	ctx := r.context()
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for category, delta := range deltas {
+			pipe.HIncrBy(ctx, keyCategories, category, delta)
+		}
+		return nil
+	})
+	return errors.Trace(err)
 }
 
 // BatchInsertItems inserts a batch of items into RedisCluster.
@@ -69,38 +130,34 @@ func (r *RedisCluster) BatchInsertItems(items []Item) error {
 	return nil
 }
 
-func (r *RedisCluster) BatchGetItems(itemIds []string) ([]Item, error) {
-	ctx := context.Background()
-	var (
-		items  []Item
-		cursor uint64
-		err    error
-		keys   []string
-	)
-	for {
-		keys, cursor, err = r.client.Scan(ctx, cursor, prefixItem+"*", -1).Result()
-		if err != nil {
-			return nil, err
+// BatchGetItems gets items from Redis by pipelines of chunks of ids.
+func (r *RedisCluster) BatchGetItems(itemIds []string) ([]Item, []string, error) {
+	ctx := r.context()
+	return r.batchGetItems(itemIds, func(chunk []string) ([]Item, error) {
+		pipeline := r.client.Pipeline()
+		commands := make([]*redis.StringCmd, len(chunk))
+		for i, itemId := range chunk {
+			commands[i] = pipeline.Get(ctx, prefixItem+itemId)
 		}
-		for _, key := range keys {
-			data, err := r.client.Get(ctx, key).Result()
-			if err != nil {
-				return nil, err
+		if _, err := pipeline.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, errors.Trace(err)
+		}
+		items := make([]Item, 0, len(chunk))
+		for _, command := range commands {
+			data, err := command.Result()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return nil, errors.Trace(err)
 			}
-			var item Item
-			err = json.Unmarshal([]byte(data), &item)
+			item, err := decodeItem(data)
 			if err != nil {
-				return nil, err
-			}
-			if funk.ContainsString(itemIds, item.ItemId) {
-				items = append(items, item)
+				return nil, errors.Trace(err)
 			}
+			items = append(items, item)
 		}
-		if cursor == 0 {
-			break
-		}
-	}
-	return items, nil
+		return items, nil
+	})
 }
 
 func (r *RedisCluster) ForFeedback(ctx context.Context, action func(key, thisFeedbackType, thisUserId, thisItemId string) error) error {
@@ -127,9 +184,32 @@ func (r *RedisCluster) ForFeedback(ctx context.Context, action func(key, thisFee
 
 // DeleteItem deletes a item from RedisCluster.
 func (r *RedisCluster) DeleteItem(itemId string) error {
-	var ctx = context.Background()
-	// remove user
-	if err := r.client.Del(ctx, prefixItem+itemId).Err(); err != nil {
+	var ctx = r.context()
+	// remove item
+	key := prefixItem + itemId
+	var (
+		categories []string
+		err        error
+	)
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			if categories, err = readItemCategories(ctx, tx, key); err != nil {
+				return errors.Trace(err)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, key)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = r.updateCategories(categoryDeltas(categories, nil)); err != nil {
 		return errors.Trace(err)
 	}
 	// remove feedback
@@ -142,9 +222,49 @@ func (r *RedisCluster) DeleteItem(itemId string) error {
 	})
 }
 
+// GetCategories returns categories and numbers of items maintained in RedisCluster.
+func (r *RedisCluster) GetCategories() ([]CategoryCount, error) {
+	counts, err := r.client.HGetAll(r.context(), keyCategories).Result()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseCategoryCounts(counts)
+}
+
+// GetLabels returns labels and numbers of items and users by scanning items and users in RedisCluster.
+func (r *RedisCluster) GetLabels() ([]LabelCount, error) {
+	return scanLabelCounts(r)
+}
+
+// SampleItems samples items by scanning items in RedisCluster, which is uniform.
+func (r *RedisCluster) SampleItems(n int, category string, seed int64) ([]Item, error) {
+	return scanSampleItems(r, n, category, seed)
+}
+
+// SampleUsers samples users by scanning users in RedisCluster, which is uniform. Users with feedback are collected by
+// scanning keys of feedback if required.
+func (r *RedisCluster) SampleUsers(n int, hasFeedback bool, seed int64) ([]User, error) {
+	var candidates *strset.Set
+	if hasFeedback {
+		candidates = strset.New()
+		if err := r.ForFeedback(r.context(), func(_, _, userId, _ string) error {
+			candidates.Add(userId)
+			return nil
+		}); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return scanSampleUsers(r, n, candidates, seed)
+}
+
+// CountItems returns the number of items in RedisCluster.
+func (r *RedisCluster) CountItems() (int, error) {
+	return countKeys(r.context(), r.client, prefixItem)
+}
+
 // GetItem get a item from RedisCluster.
 func (r *RedisCluster) GetItem(itemId string) (Item, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	data, err := r.client.Get(ctx, prefixItem+itemId).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -152,14 +272,13 @@ func (r *RedisCluster) GetItem(itemId string) (Item, error) {
 		}
 		return Item{}, err
 	}
-	var item Item
-	err = json.Unmarshal([]byte(data), &item)
+	item, err := decodeItem(data)
 	return item, err
 }
 
 // GetItems returns items from RedisCluster.
 func (r *RedisCluster) GetItems(cursor string, n int, timeLimit *time.Time) (string, []Item, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	var err error
 	cursorNum := uint64(0)
 	if len(cursor) > 0 {
@@ -180,8 +299,7 @@ func (r *RedisCluster) GetItems(cursor string, n int, timeLimit *time.Time) (str
 		if err != nil {
 			return "", nil, err
 		}
-		var item Item
-		err = json.Unmarshal([]byte(data), &item)
+		item, err := decodeItem(data)
 		if err != nil {
 			return "", nil, err
 		}
@@ -206,7 +324,7 @@ func (r *RedisCluster) GetItemStream(batchSize int, timeLimit *time.Time) (chan
 	go func() {
 		defer close(itemChan)
 		defer close(errChan)
-		ctx := context.Background()
+		ctx := r.context()
 		var cursor uint64
 		var keys []string
 		var err error
@@ -223,8 +341,7 @@ func (r *RedisCluster) GetItemStream(batchSize int, timeLimit *time.Time) (chan
 					errChan <- errors.Trace(err)
 					return
 				}
-				var item Item
-				err = json.Unmarshal([]byte(data), &item)
+				item, err := decodeItem(data)
 				if err != nil {
 					errChan <- errors.Trace(err)
 					return
@@ -253,7 +370,7 @@ func (r *RedisCluster) GetItemStream(batchSize int, timeLimit *time.Time) (chan
 
 // GetItemFeedback returns feedback of an item from RedisCluster.
 func (r *RedisCluster) GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, _, thisItemId string) error {
@@ -262,7 +379,7 @@ func (r *RedisCluster) GetItemFeedback(itemId string, feedbackTypes ...string) (
 			if err != nil {
 				return errors.Trace(err)
 			}
-			if val.Timestamp.Before(time.Now()) {
+			if !val.Timestamp.After(time.Now()) {
 				feedback = append(feedback, val)
 			}
 		}
@@ -273,7 +390,7 @@ func (r *RedisCluster) GetItemFeedback(itemId string, feedbackTypes ...string) (
 
 // insertUser inserts a user into RedisCluster.
 func (r *RedisCluster) insertUser(user User) error {
-	var ctx = context.Background()
+	var ctx = r.context()
 	data, err := json.Marshal(user)
 	if err != nil {
 		return errors.Trace(err)
@@ -293,7 +410,7 @@ func (r *RedisCluster) BatchInsertUsers(users []User) error {
 
 // DeleteUser deletes a user from RedisCluster.
 func (r *RedisCluster) DeleteUser(userId string) error {
-	var ctx = context.Background()
+	var ctx = r.context()
 	// remove user
 	if err := r.client.Del(ctx, prefixUser+userId).Err(); err != nil {
 		return errors.Trace(err)
@@ -309,7 +426,7 @@ func (r *RedisCluster) DeleteUser(userId string) error {
 
 // GetUser returns a user from RedisCluster.
 func (r *RedisCluster) GetUser(userId string) (User, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	val, err := r.client.Get(ctx, prefixUser+userId).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -327,7 +444,7 @@ func (r *RedisCluster) GetUser(userId string) (User, error) {
 
 // GetUsers returns users from RedisCluster.
 func (r *RedisCluster) GetUsers(cursor string, n int) (string, []User, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	var err error
 	cursorNum := uint64(0)
 	if len(cursor) > 0 {
@@ -362,6 +479,11 @@ func (r *RedisCluster) GetUsers(cursor string, n int) (string, []User, error) {
 	return cursor, users, nil
 }
 
+// CountUsers returns the number of users in RedisCluster.
+func (r *RedisCluster) CountUsers() (int, error) {
+	return countKeys(r.context(), r.client, prefixUser)
+}
+
 // GetUserStream read users from RedisCluster by stream.
 func (r *RedisCluster) GetUserStream(batchSize int) (chan []User, chan error) {
 	userChan := make(chan []User, bufSize)
@@ -369,7 +491,7 @@ func (r *RedisCluster) GetUserStream(batchSize int) (chan []User, chan error) {
 	go func() {
 		defer close(userChan)
 		defer close(errChan)
-		ctx := context.Background()
+		ctx := r.context()
 		var cursor uint64
 		var keys []string
 		var err error
@@ -412,7 +534,7 @@ func (r *RedisCluster) GetUserStream(batchSize int) (chan []User, chan error) {
 
 // GetUserFeedback returns feedback of a user from RedisCluster.
 func (r *RedisCluster) GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	// get itemId list by userId
@@ -422,7 +544,7 @@ func (r *RedisCluster) GetUserFeedback(userId string, withFuture bool, feedbackT
 			if err != nil {
 				return errors.Trace(err)
 			}
-			if withFuture || val.Timestamp.Before(time.Now()) {
+			if withFuture || !val.Timestamp.After(time.Now()) {
 				feedback = append(feedback, val)
 			}
 		}
@@ -431,8 +553,43 @@ func (r *RedisCluster) GetUserFeedback(userId string, withFuture bool, feedbackT
 	return feedback, err
 }
 
+// GetUserFeedbackStream reads feedback of a user from RedisCluster by stream.
+func (r *RedisCluster) GetUserFeedbackStream(userId string, batchSize int) (chan []Feedback, chan error) {
+	feedbackChan := make(chan []Feedback, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(feedbackChan)
+		defer close(errChan)
+		feedbacks := make([]Feedback, 0, batchSize)
+		err := r.ForFeedback(r.context(), func(key, _, thisUserId, _ string) error {
+			if thisUserId != userId {
+				return nil
+			}
+			feedback, err := r.getFeedbackInternal(key)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			feedbacks = append(feedbacks, feedback)
+			if len(feedbacks) == batchSize {
+				feedbackChan <- feedbacks
+				feedbacks = make([]Feedback, 0, batchSize)
+			}
+			return nil
+		})
+		if err != nil {
+			errChan <- errors.Trace(err)
+			return
+		}
+		if len(feedbacks) > 0 {
+			feedbackChan <- feedbacks
+		}
+		errChan <- nil
+	}()
+	return feedbackChan, errChan
+}
+
 func (r *RedisCluster) getFeedbackInternal(key string) (Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	// get feedback by feedbackKey
 	val, err := r.client.Get(ctx, key).Result()
 	if err != nil {
@@ -477,22 +634,13 @@ func (r *RedisCluster) insertFeedback(feedback Feedback, insertUser, insertItem,
 	} else if err != nil {
 		return err
 	}
-	var ctx = context.Background()
-	val, err := json.Marshal(feedback)
-	if err != nil {
-		return errors.Trace(err)
-	}
+	var ctx = r.context()
 	// insert feedback
-	feedbackKey := createFeedbackKey(feedback.FeedbackKey)
-	if exists, err := r.client.Exists(ctx, feedbackKey).Result(); err != nil {
+	if written, err := writeFeedback(ctx, r.client, feedback, overwrite); err != nil {
 		return errors.Trace(err)
-	} else if exists > 0 && !overwrite {
+	} else if !written {
 		return nil
 	}
-	err = r.client.Set(ctx, feedbackKey, val, 0).Err()
-	if err != nil {
-		return errors.Trace(err)
-	}
 	// insert user
 	if insertUser {
 		if exist, err := r.client.Exists(ctx, prefixUser+feedback.UserId).Result(); err != nil {
@@ -513,8 +661,8 @@ func (r *RedisCluster) insertFeedback(feedback Feedback, insertUser, insertItem,
 		if exist, err := r.client.Exists(ctx, prefixItem+feedback.ItemId).Result(); err != nil {
 			return errors.Trace(err)
 		} else if exist == 0 {
-			item := Item{ItemId: feedback.ItemId}
-			data, err := json.Marshal(item)
+			item := Item{ItemId: feedback.ItemId, CreatedAt: time.Now().In(time.UTC)}
+			data, err := encodeItem(item)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -540,7 +688,7 @@ func (r *RedisCluster) BatchInsertFeedback(feedback []Feedback, insertUser, inse
 
 // GetFeedback returns feedback from RedisCluster.
 func (r *RedisCluster) GetFeedback(_ string, _ int, timeLimit *time.Time, feedbackTypes ...string) (string, []Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
@@ -552,7 +700,7 @@ func (r *RedisCluster) GetFeedback(_ string, _ int, timeLimit *time.Time, feedba
 			if timeLimit != nil && val.Timestamp.Unix() < timeLimit.Unix() {
 				return nil
 			}
-			if val.Timestamp.Before(time.Now()) {
+			if !val.Timestamp.After(time.Now()) {
 				feedback = append(feedback, val)
 			}
 		}
@@ -569,7 +717,7 @@ func (r *RedisCluster) GetFeedbackStream(batchSize int, timeLimit *time.Time, fe
 		defer close(feedbackChan)
 		defer close(errChan)
 		feedbackTypeSet := strset.New(feedbackTypes...)
-		ctx := context.Background()
+		ctx := r.context()
 		feedback := make([]Feedback, 0, batchSize)
 		err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
 			if feedbackTypeSet.IsEmpty() || feedbackTypeSet.Has(thisFeedbackType) {
@@ -580,7 +728,7 @@ func (r *RedisCluster) GetFeedbackStream(batchSize int, timeLimit *time.Time, fe
 				if timeLimit != nil && val.Timestamp.Unix() < timeLimit.Unix() {
 					return nil
 				}
-				if val.Timestamp.Before(time.Now()) {
+				if !val.Timestamp.After(time.Now()) {
 					feedback = append(feedback, val)
 					if len(feedback) == batchSize {
 						feedbackChan <- feedback
@@ -600,7 +748,7 @@ func (r *RedisCluster) GetFeedbackStream(batchSize int, timeLimit *time.Time, fe
 
 // GetUserItemFeedback gets a feedback by user id and item id from RedisCluster.
 func (r *RedisCluster) GetUserItemFeedback(userId, itemId string, feedbackTypes ...string) ([]Feedback, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedback := make([]Feedback, 0)
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
@@ -618,7 +766,7 @@ func (r *RedisCluster) GetUserItemFeedback(userId, itemId string, feedbackTypes
 
 // DeleteUserItemFeedback deletes a feedback by user id and item id from RedisCluster.
 func (r *RedisCluster) DeleteUserItemFeedback(userId, itemId string, feedbackTypes ...string) (int, error) {
-	var ctx = context.Background()
+	var ctx = r.context()
 	feedbackTypeSet := strset.New(feedbackTypes...)
 	deleteCount := 0
 	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
@@ -631,50 +779,266 @@ func (r *RedisCluster) DeleteUserItemFeedback(userId, itemId string, feedbackTyp
 	return deleteCount, err
 }
 
+// DeleteUserFeedbackInRange deletes feedback of a user timestamped in a range from RedisCluster.
+func (r *RedisCluster) DeleteUserFeedbackInRange(userId string, begin, end *time.Time, feedbackTypes ...string) (int, error) {
+	var ctx = r.context()
+	feedbackTypeSet := strset.New(feedbackTypes...)
+	deleteCount := 0
+	err := r.ForFeedback(ctx, func(key, thisFeedbackType, thisUserId, thisItemId string) error {
+		if thisUserId != userId || (!feedbackTypeSet.IsEmpty() && !feedbackTypeSet.Has(thisFeedbackType)) {
+			return nil
+		}
+		feedback, err := r.getFeedbackInternal(key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if (begin != nil && feedback.Timestamp.Before(*begin)) || (end != nil && !feedback.Timestamp.Before(*end)) {
+			return nil
+		}
+		if err = r.client.Del(ctx, key).Err(); err != nil {
+			return errors.Trace(err)
+		}
+		deleteCount++
+		return nil
+	})
+	return deleteCount, err
+}
+
 // ModifyItem modify an item in RedisCluster.
 func (r *RedisCluster) ModifyItem(itemId string, patch ItemPatch) error {
-	// read item
-	item, err := r.GetItem(itemId)
-	if err != nil {
-		return err
-	}
-	// apply patch
-	if patch.IsHidden != nil {
-		item.IsHidden = *patch.IsHidden
+	return r.updateItem(itemId, func(previous *Item) (Item, error) {
+		if previous == nil {
+			return Item{}, errors.Annotate(ErrItemNotExist, itemId)
+		}
+		if err := patch.checkVersion(*previous); err != nil {
+			return Item{}, err
+		}
+		return patch.Apply(*previous), nil
+	})
+}
+
+// BatchModifyItems applies the same modification to items in RedisCluster.
+func (r *RedisCluster) BatchModifyItems(itemIds []string, patch ItemPatch) error {
+	for _, itemId := range itemIds {
+		if err := r.ModifyItem(itemId, patch); err != nil {
+			if errors.Is(err, errors.NotFound) {
+				continue
+			}
+			return errors.Trace(err)
+		}
 	}
-	if patch.Categories != nil {
-		item.Categories = patch.Categories
+	return nil
+}
+
+// ModifyUser modify a user in RedisCluster. The user is read and replaced in a transaction, which is retried if the
+// user is modified.
+func (r *RedisCluster) ModifyUser(userId string, patch UserPatch) error {
+	var ctx = r.context()
+	key := prefixUser + userId
+	var err error
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := modifyUser(ctx, tx, userId, patch)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return errors.Trace(err)
+		}
 	}
-	if patch.Comment != nil {
-		item.Comment = *patch.Comment
+	return errors.Trace(err)
+}
+
+// SetUserOverrides inserts or replaces overrides of a user in RedisCluster.
+func (r *RedisCluster) SetUserOverrides(overrides UserOverrides) error {
+	var ctx = r.context()
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return errors.Trace(err)
 	}
-	if patch.Labels != nil {
-		item.Labels = patch.Labels
+	return r.client.Set(ctx, prefixOverrides+overrides.UserId, data, 0).Err()
+}
+
+// GetUserOverrides returns overrides of a user from RedisCluster.
+func (r *RedisCluster) GetUserOverrides(userId string) (UserOverrides, error) {
+	var ctx = r.context()
+	val, err := r.client.Get(ctx, prefixOverrides+userId).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return UserOverrides{}, errors.Annotate(ErrOverridesNotExist, userId)
+		}
+		return UserOverrides{}, errors.Trace(err)
 	}
-	if patch.Timestamp != nil {
-		item.Timestamp = *patch.Timestamp
+	var overrides UserOverrides
+	if err = json.Unmarshal([]byte(val), &overrides); err != nil {
+		return UserOverrides{}, errors.Trace(err)
 	}
-	// write back
-	return r.insertItem(item)
+	return overrides, nil
 }
 
-// ModifyUser modify a user in RedisCluster.
-func (r *RedisCluster) ModifyUser(userId string, patch UserPatch) error {
-	// read user
-	user, err := r.GetUser(userId)
-	if err != nil {
-		return err
+// DeleteUserOverrides deletes overrides of a user from RedisCluster.
+func (r *RedisCluster) DeleteUserOverrides(userId string) error {
+	var ctx = r.context()
+	return r.client.Del(ctx, prefixOverrides+userId).Err()
+}
+
+// GetUserOverridesStream reads overrides of all users from RedisCluster by stream.
+func (r *RedisCluster) GetUserOverridesStream(batchSize int) (chan []UserOverrides, chan error) {
+	overridesChan := make(chan []UserOverrides, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(overridesChan)
+		defer close(errChan)
+		ctx := r.context()
+		var cursor uint64
+		var keys []string
+		var err error
+		batch := make([]UserOverrides, 0, batchSize)
+		for {
+			keys, cursor, err = r.client.Scan(ctx, cursor, prefixOverrides+"*", int64(batchSize)).Result()
+			if err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
+			for _, key := range keys {
+				var overrides UserOverrides
+				val, err := r.client.Get(ctx, key).Result()
+				if err != nil {
+					errChan <- errors.Trace(err)
+					return
+				}
+				err = json.Unmarshal([]byte(val), &overrides)
+				if err != nil {
+					errChan <- errors.Trace(err)
+					return
+				}
+				batch = append(batch, overrides)
+				if len(batch) == batchSize {
+					overridesChan <- batch
+					batch = make([]UserOverrides, 0, batchSize)
+				}
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+		if len(batch) > 0 {
+			overridesChan <- batch
+		}
+		errChan <- nil
+	}()
+	return overridesChan, errChan
+}
+
+// Purge deletes all keys except audit logs and usage. Keys are scanned and deleted on every master node, since keys
+// are sharded over master nodes.
+func (r *RedisCluster) Purge() error {
+	return r.client.ForEachMaster(r.context(), func(ctx context.Context, client *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(ctx, cursor, "*", 0).Result()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			keys = funk.SubtractString(keys, []string{keyAuditLogs, keyUsage})
+			// keys in different slots can't be deleted by a command
+			pipe := client.Pipeline()
+			for _, key := range keys {
+				pipe.Del(ctx, key)
+			}
+			if _, err = pipe.Exec(ctx); err != nil {
+				return errors.Trace(err)
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+}
+
+// BatchInsertItemCanonicals inserts or replaces canonical items of near-duplicate items in RedisCluster.
+func (r *RedisCluster) BatchInsertItemCanonicals(canonicals []ItemCanonical) error {
+	if len(canonicals) == 0 {
+		return nil
 	}
-	// apply patch
-	if patch.Comment != nil {
-		user.Comment = *patch.Comment
+	values := make(map[string]interface{}, len(canonicals))
+	for _, canonical := range canonicals {
+		values[canonical.ItemId] = canonical.CanonicalId
 	}
-	if patch.Labels != nil {
-		user.Labels = patch.Labels
+	return errors.Trace(r.client.HSet(r.context(), keyCanonicals, values).Err())
+}
+
+// GetItemCanonicals returns canonical items of all near-duplicate items from RedisCluster.
+func (r *RedisCluster) GetItemCanonicals() ([]ItemCanonical, error) {
+	canonicals, err := r.client.HGetAll(r.context(), keyCanonicals).Result()
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
-	if patch.Subscribe != nil {
-		user.Subscribe = patch.Subscribe
+	return sortItemCanonicals(canonicals), nil
+}
+
+// DeleteItemCanonicals deletes canonical items of near-duplicate items from RedisCluster.
+func (r *RedisCluster) DeleteItemCanonicals(itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
 	}
-	// write back
-	return r.insertUser(user)
+	return errors.Trace(r.client.HDel(r.context(), keyCanonicals, itemIds...).Err())
+}
+
+// InsertAuditLogs inserts audit logs into RedisCluster.
+func (r *RedisCluster) InsertAuditLogs(auditLogs []AuditLog) error {
+	return insertAuditLogs(r.context(), r.client, auditLogs)
+}
+
+// GetAuditLogs returns audit logs from RedisCluster.
+func (r *RedisCluster) GetAuditLogs(cursor string, n int, entity, actor string) (string, []AuditLog, error) {
+	return getAuditLogs(r.context(), r.client, cursor, n, entity, actor)
+}
+
+// DeleteAuditLogs deletes audit logs written before a time from RedisCluster.
+func (r *RedisCluster) DeleteAuditLogs(before time.Time) error {
+	return deleteAuditLogs(r.context(), r.client, before)
+}
+
+// BatchInsertUsage inserts or replaces figures of usage in RedisCluster.
+func (r *RedisCluster) BatchInsertUsage(usage []Usage) error {
+	return insertUsage(r.context(), r.client, usage)
+}
+
+// GetUsage returns figures of usage from one day to another day from RedisCluster.
+func (r *RedisCluster) GetUsage(from, to string) ([]Usage, error) {
+	return getUsage(r.context(), r.client, from, to)
+}
+
+// BatchInsertRecommendSnapshots inserts or replaces snapshots of recommendation in RedisCluster.
+func (r *RedisCluster) BatchInsertRecommendSnapshots(snapshots []RecommendSnapshot) error {
+	return insertRecommendSnapshots(r.context(), r.client, snapshots)
+}
+
+// GetRecommendSnapshots returns snapshots of recommendation of a user from RedisCluster.
+func (r *RedisCluster) GetRecommendSnapshots(userId string) ([]RecommendSnapshot, error) {
+	return getRecommendSnapshots(r.context(), r.client, userId)
+}
+
+// DeleteRecommendSnapshots deletes snapshots of recommendation in time buckets beginning before a time from
+// RedisCluster.
+func (r *RedisCluster) DeleteRecommendSnapshots(before time.Time) error {
+	return deleteRecommendSnapshots(r.context(), r.client, before)
+}
+
+// GetTableSizes is not supported by RedisCluster since tables aren't stored separately.
+func (r *RedisCluster) GetTableSizes() (map[string]int64, error) {
+	return nil, errors.NotSupportedf("sizes of tables in Redis")
+}
+
+func (r *RedisCluster) WithContext(ctx context.Context) Database {
+	database := *r
+	database.ctx = ctx
+	return &database
 }
@@ -58,6 +58,97 @@ func TestRedisCluster_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestRedisCluster_Categories(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestRedisCluster_Labels(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestRedisCluster_PatchArrays(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+	testConcurrentPatchArrays(t, db.Database)
+}
+
+func TestRedisCluster_ModifyConflict(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestRedisCluster_BatchGetItems(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func TestRedisCluster_Sample(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testSample(t, db.Database, true)
+}
+
+func TestRedisCluster_UserOverrides(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestRedisCluster_ItemCanonicals(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestRedisCluster_AuditLogs(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestRedisCluster_Usage(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestRedisCluster_RecommendSnapshots(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestRedisCluster_FutureFeedback(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestRedisCluster_FeedbackOutOfOrder(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestRedisCluster_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestRedisCluster_Count(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestRedisCluster_DeleteFeedback(t *testing.T) {
 	db := newMockRedisCluster(t)
 	defer db.Close(t)
@@ -69,3 +160,9 @@ func TestRedisCluster_TimeLimit(t *testing.T) {
 	defer db.Close(t)
 	testTimeLimit(t, db.Database)
 }
+
+func TestRedisCluster_Purge(t *testing.T) {
+	db := newMockRedisCluster(t)
+	defer db.Close(t)
+	testPurge(t, db.Database)
+}
@@ -17,6 +17,8 @@ import (
 	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/zhenghaoz/gorse/storage"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -71,6 +73,140 @@ func TestRedis_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestRedis_Categories(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestRedis_Labels(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestRedis_PatchArrays(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+	testConcurrentPatchArrays(t, db.Database)
+}
+
+func TestRedis_ModifyConflict(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestRedis_BatchGetItems(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func TestRedis_Sample(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testSample(t, db.Database, true)
+}
+
+func TestRedis_BackfillCategories(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	err := db.BatchInsertItems([]Item{
+		{ItemId: "0", Categories: []string{"a", "b"}},
+		{ItemId: "1", Categories: []string{"a"}},
+	})
+	assert.NoError(t, err)
+	// items inserted before categories were maintained
+	db.server.Del(keyCategories)
+	err = db.Init()
+	assert.NoError(t, err)
+	categories, err := db.GetCategories()
+	assert.NoError(t, err)
+	assert.Equal(t, []CategoryCount{{"a", 2}, {"b", 1}}, categories)
+	// existing categories are kept
+	err = db.Init()
+	assert.NoError(t, err)
+	categories, err = db.GetCategories()
+	assert.NoError(t, err)
+	assert.Equal(t, []CategoryCount{{"a", 2}, {"b", 1}}, categories)
+}
+
+func TestRedis_ConcurrentInsertItem(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := db.BatchInsertItems([]Item{{ItemId: "0", Categories: []string{strconv.Itoa(i % 2)}}})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	item, err := db.GetItem("0")
+	assert.NoError(t, err)
+	categories, err := db.GetCategories()
+	assert.NoError(t, err)
+	assert.Equal(t, []CategoryCount{{item.Categories[0], 1}}, categories)
+}
+
+func TestRedis_UserOverrides(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestRedis_ItemCanonicals(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestRedis_AuditLogs(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestRedis_Usage(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestRedis_RecommendSnapshots(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestRedis_FutureFeedback(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestRedis_FeedbackOutOfOrder(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestRedis_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestRedis_Count(t *testing.T) {
+	db := newMockRedis(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestRedis_DeleteFeedback(t *testing.T) {
 	db := newMockRedis(t)
 	defer db.Close(t)
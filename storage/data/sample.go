@@ -0,0 +1,123 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/scylladb/go-set/strset"
+)
+
+const sampleScanBatchSize = 1000
+
+// hashSampler keeps values of the smallest hashes of keys, which is a uniform sample. Values are sampled by hashes
+// instead of random numbers, so that the same values are sampled under the same seed no matter in which order values
+// are streamed. The buffer is truncated lazily once it grows twice as large as the sample size.
+type hashSampler[T any] struct {
+	n       int
+	seed    int64
+	sampled []hashSampled[T]
+}
+
+type hashSampled[T any] struct {
+	priority uint64
+	value    T
+}
+
+func newHashSampler[T any](n int, seed int64) *hashSampler[T] {
+	return &hashSampler[T]{n: n, seed: seed}
+}
+
+// Add samples a value identified by the key.
+func (s *hashSampler[T]) Add(key string, value T) {
+	s.sampled = append(s.sampled, hashSampled[T]{priority: sampleHash(s.seed, key), value: value})
+	if len(s.sampled) > 2*s.n {
+		s.truncate()
+	}
+}
+
+// Values returns sampled values ordered by hashes.
+func (s *hashSampler[T]) Values() []T {
+	s.truncate()
+	return lo.Map(s.sampled, func(sampled hashSampled[T], _ int) T {
+		return sampled.value
+	})
+}
+
+func (s *hashSampler[T]) truncate() {
+	sort.Slice(s.sampled, func(i, j int) bool {
+		return s.sampled[i].priority < s.sampled[j].priority
+	})
+	if len(s.sampled) > s.n {
+		// copy kept values to release the rest of the buffer
+		s.sampled = append([]hashSampled[T](nil), s.sampled[:s.n]...)
+	}
+}
+
+// sampleHash hashes a key under a seed by FNV-1a followed by the finalizer of SplitMix64.
+func sampleHash(seed int64, key string) uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	for i := 0; i < 8; i++ {
+		h = (h ^ uint64(byte(seed>>(8*i)))) * prime
+	}
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint64(key[i])) * prime
+	}
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// scanSampleItems samples items which aren't hidden by streams, for databases without random access. Items are
+// sampled uniformly and reproducibly, but all items are scanned.
+func scanSampleItems(database Database, n int, category string, seed int64) ([]Item, error) {
+	sampler := newHashSampler[Item](n, seed)
+	itemChan, errChan := database.GetItemStream(sampleScanBatchSize, nil)
+	for items := range itemChan {
+		for _, item := range items {
+			if !item.IsHidden && (category == "" || lo.Contains(item.Categories, category)) {
+				sampler.Add(item.ItemId, item)
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return nil, errors.Trace(err)
+	}
+	return sampler.Values(), nil
+}
+
+// scanSampleUsers samples users by streams, for databases without random access. Only users in the candidate set are
+// sampled if it isn't nil. Users are sampled uniformly and reproducibly, but all users are scanned.
+func scanSampleUsers(database Database, n int, candidates *strset.Set, seed int64) ([]User, error) {
+	sampler := newHashSampler[User](n, seed)
+	userChan, errChan := database.GetUserStream(sampleScanBatchSize)
+	for users := range userChan {
+		for _, user := range users {
+			if candidates == nil || candidates.Has(user.UserId) {
+				sampler.Add(user.UserId, user)
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return nil, errors.Trace(err)
+	}
+	return sampler.Values(), nil
+}
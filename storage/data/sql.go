@@ -15,6 +15,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
@@ -29,11 +30,18 @@ import (
 	"github.com/zhenghaoz/gorse/storage"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"math/rand"
 	_ "modernc.org/sqlite"
+	"strconv"
+	"strings"
 	"time"
 )
 
-const bufSize = 1
+const (
+	bufSize = 1
+	// sqlMaxTxRetries is the maximum number of attempts of a read-modify-write transaction.
+	sqlMaxTxRetries = 100
+)
 
 type SQLDriver int
 
@@ -46,12 +54,16 @@ const (
 )
 
 type SQLItem struct {
-	ItemId     string    `gorm:"column:item_id;primaryKey"`
-	IsHidden   bool      `gorm:"column:is_hidden"`
-	Categories string    `gorm:"column:categories"`
-	Timestamp  time.Time `gorm:"column:time_stamp"`
-	Labels     string    `gorm:"column:labels"`
-	Comment    string    `gorm:"column:comment"`
+	ItemId       string     `gorm:"column:item_id;primaryKey"`
+	IsHidden     bool       `gorm:"column:is_hidden"`
+	Categories   string     `gorm:"column:categories"`
+	Timestamp    time.Time  `gorm:"column:time_stamp"`
+	Labels       string     `gorm:"column:labels"`
+	Comment      string     `gorm:"column:comment"`
+	VisibleFrom  *time.Time `gorm:"column:visible_from"`
+	VisibleUntil *time.Time `gorm:"column:visible_until"`
+	HiddenReason string     `gorm:"column:hidden_reason"`
+	CreatedAt    *time.Time `gorm:"column:created_at"`
 }
 
 func NewSQLItem(item Item) (sqlItem SQLItem) {
@@ -64,6 +76,10 @@ func NewSQLItem(item Item) (sqlItem SQLItem) {
 	buf, _ = json.Marshal(item.Labels)
 	sqlItem.Labels = string(buf)
 	sqlItem.Comment = item.Comment
+	sqlItem.VisibleFrom = utcTime(item.VisibleFrom)
+	sqlItem.VisibleUntil = utcTime(item.VisibleUntil)
+	sqlItem.HiddenReason = item.HiddenReason
+	sqlItem.CreatedAt = utcTime(&item.CreatedAt)
 	return
 }
 
@@ -108,6 +124,87 @@ func NewClickhouseUser(user User) (clickhouseUser ClickhouseUser) {
 	return
 }
 
+type SQLOverrides struct {
+	UserId  string `gorm:"column:user_id;primaryKey"`
+	Pinned  string `gorm:"column:pinned"`
+	Blocked string `gorm:"column:blocked"`
+}
+
+func NewSQLOverrides(overrides UserOverrides) (sqlOverrides SQLOverrides) {
+	var buf []byte
+	sqlOverrides.UserId = overrides.UserId
+	buf, _ = json.Marshal(lo.Map(overrides.Pinned, func(item PinnedItem, _ int) PinnedItem {
+		item.ExpireTime = item.ExpireTime.In(time.UTC)
+		return item
+	}))
+	sqlOverrides.Pinned = string(buf)
+	buf, _ = json.Marshal(lo.Map(overrides.Blocked, func(item BlockedItem, _ int) BlockedItem {
+		item.ExpireTime = item.ExpireTime.In(time.UTC)
+		return item
+	}))
+	sqlOverrides.Blocked = string(buf)
+	return
+}
+
+type ClickHouseOverrides struct {
+	SQLOverrides `gorm:"embedded"`
+	Version      time.Time `gorm:"column:version"`
+}
+
+type ClickHouseItemCanonical struct {
+	ItemCanonical `gorm:"embedded"`
+	Version       time.Time `gorm:"column:version"`
+}
+
+type SQLAuditLog struct {
+	Id        string    `gorm:"column:id;primaryKey"`
+	Timestamp time.Time `gorm:"column:time_stamp"`
+	Actor     string    `gorm:"column:actor"`
+	Endpoint  string    `gorm:"column:endpoint"`
+	Entities  string    `gorm:"column:entities"`
+	Summary   string    `gorm:"column:summary"`
+}
+
+func NewSQLAuditLog(auditLog AuditLog) (sqlAuditLog SQLAuditLog) {
+	sqlAuditLog.Id = auditLog.Id
+	sqlAuditLog.Timestamp = auditLog.Timestamp.In(time.UTC)
+	sqlAuditLog.Actor = auditLog.Actor
+	sqlAuditLog.Endpoint = auditLog.Endpoint
+	buf, _ := json.Marshal(auditLog.Entities)
+	sqlAuditLog.Entities = string(buf)
+	sqlAuditLog.Summary = auditLog.Summary
+	return
+}
+
+type SQLRecommendSnapshot struct {
+	UserId    string    `gorm:"column:user_id;primaryKey"`
+	Category  string    `gorm:"column:category"`
+	Timestamp time.Time `gorm:"column:time_stamp;primaryKey"`
+	Items     string    `gorm:"column:items"`
+	Tags      string    `gorm:"column:tags"`
+}
+
+func NewSQLRecommendSnapshot(snapshot RecommendSnapshot) (sqlSnapshot SQLRecommendSnapshot) {
+	sqlSnapshot.UserId = snapshot.UserId
+	sqlSnapshot.Category = snapshot.Category
+	sqlSnapshot.Timestamp = snapshot.Timestamp.In(time.UTC)
+	buf, _ := json.Marshal(snapshot.Items)
+	sqlSnapshot.Items = string(buf)
+	buf, _ = json.Marshal(snapshot.Tags)
+	sqlSnapshot.Tags = string(buf)
+	return
+}
+
+type ClickHouseRecommendSnapshot struct {
+	SQLRecommendSnapshot `gorm:"embedded"`
+	Version              time.Time `gorm:"column:version"`
+}
+
+type ClickHouseUsage struct {
+	Usage   `gorm:"embedded"`
+	Version time.Time `gorm:"column:version"`
+}
+
 type ClickHouseFeedback struct {
 	Feedback `gorm:"embedded"`
 	Version  time.Time `gorm:"column:version"`
@@ -116,6 +213,7 @@ type ClickHouseFeedback struct {
 // SQLDatabase use MySQL as data storage.
 type SQLDatabase struct {
 	storage.TablePrefix
+	batchGetOptions
 	gormDB *gorm.DB
 	client *sql.DB
 	driver SQLDriver
@@ -124,7 +222,7 @@ type SQLDatabase struct {
 // Optimize is used by ClickHouse only.
 func (d *SQLDatabase) Optimize() error {
 	if d.driver == ClickHouse {
-		for _, tableName := range []string{d.UsersTable(), d.ItemsTable(), d.FeedbackTable()} {
+		for _, tableName := range []string{d.UsersTable(), d.ItemsTable(), d.FeedbackTable(), d.UserOverridesTable(), d.ItemCanonicalsTable()} {
 			_, err := d.client.Exec("OPTIMIZE TABLE " + tableName)
 			if err != nil {
 				return errors.Trace(err)
@@ -140,12 +238,16 @@ func (d *SQLDatabase) Init() error {
 	case MySQL:
 		// create tables
 		type Items struct {
-			ItemId     string    `gorm:"column:item_id;type:varchar(256) not null;primaryKey"`
-			IsHidden   bool      `gorm:"column:is_hidden;type:bool;not null"`
-			Categories []string  `gorm:"column:categories;type:json;not null"`
-			Timestamp  time.Time `gorm:"column:time_stamp;type:datetime;not null"`
-			Labels     []string  `gorm:"column:labels;type:json;not null"`
-			Comment    string    `gorm:"column:comment;type:text;not null"`
+			ItemId       string     `gorm:"column:item_id;type:varchar(256) not null;primaryKey"`
+			IsHidden     bool       `gorm:"column:is_hidden;type:bool;not null"`
+			Categories   []string   `gorm:"column:categories;type:json;not null"`
+			Timestamp    time.Time  `gorm:"column:time_stamp;type:datetime;not null"`
+			Labels       []string   `gorm:"column:labels;type:json;not null"`
+			Comment      string     `gorm:"column:comment;type:text;not null"`
+			VisibleFrom  *time.Time `gorm:"column:visible_from;type:datetime"`
+			VisibleUntil *time.Time `gorm:"column:visible_until;type:datetime"`
+			HiddenReason string     `gorm:"column:hidden_reason;type:varchar(256);not null;default:''"`
+			CreatedAt    *time.Time `gorm:"column:created_at;type:datetime"`
 		}
 		type Users struct {
 			UserId    string   `gorm:"column:user_id;type:varchar(256);not null;primaryKey"`
@@ -159,20 +261,54 @@ func (d *SQLDatabase) Init() error {
 			ItemId       string    `gorm:"column:item_id;type:varchar(256);not null;primaryKey;index:item_id"`
 			Timestamp    time.Time `gorm:"column:time_stamp;type:datetime;not null"`
 			Comment      string    `gorm:"column:comment;type:text;not null"`
-		}
-		err := d.gormDB.Set("gorm:table_options", "ENGINE=InnoDB").AutoMigrate(Users{}, Items{}, Feedback{})
+			Context      string    `gorm:"column:context;type:json"`
+		}
+		type UserOverrides struct {
+			UserId  string   `gorm:"column:user_id;type:varchar(256);not null;primaryKey"`
+			Pinned  []string `gorm:"column:pinned;type:json;not null"`
+			Blocked []string `gorm:"column:blocked;type:json;not null"`
+		}
+		type ItemCanonicals struct {
+			ItemId      string `gorm:"column:item_id;type:varchar(256);not null;primaryKey"`
+			CanonicalId string `gorm:"column:canonical_id;type:varchar(256);not null;index"`
+		}
+		type AuditLogs struct {
+			Id        string    `gorm:"column:id;type:varchar(256);not null;primaryKey"`
+			Timestamp time.Time `gorm:"column:time_stamp;type:datetime;not null"`
+			Actor     string    `gorm:"column:actor;type:varchar(256);not null;index"`
+			Endpoint  string    `gorm:"column:endpoint;type:varchar(256);not null"`
+			Entities  []string  `gorm:"column:entities;type:json;not null"`
+			Summary   string    `gorm:"column:summary;type:text;not null"`
+		}
+		type DailyUsage struct {
+			Day    string `gorm:"column:day;type:varchar(10);not null;primaryKey"`
+			Metric string `gorm:"column:metric;type:varchar(256);not null;primaryKey"`
+			Amount int64  `gorm:"column:amount;type:bigint;not null"`
+		}
+		type RecommendSnapshots struct {
+			UserId    string    `gorm:"column:user_id;type:varchar(256);not null;primaryKey"`
+			Category  string    `gorm:"column:category;type:varchar(256);not null"`
+			Timestamp time.Time `gorm:"column:time_stamp;type:datetime;not null;primaryKey;index"`
+			Items     []string  `gorm:"column:items;type:json;not null"`
+			Tags      string    `gorm:"column:tags;type:json;not null"`
+		}
+		err := d.gormDB.Set("gorm:table_options", "ENGINE=InnoDB").AutoMigrate(Users{}, Items{}, Feedback{}, UserOverrides{}, ItemCanonicals{}, AuditLogs{}, DailyUsage{}, RecommendSnapshots{})
 		if err != nil {
 			return errors.Trace(err)
 		}
 	case Postgres:
 		// create tables
 		type Items struct {
-			ItemId     string    `gorm:"column:item_id;type:varchar(256);not null;primaryKey"`
-			IsHidden   bool      `gorm:"column:is_hidden;type:bool;not null;default:false"`
-			Categories string    `gorm:"column:categories;type:json;not null;default:'[]'"`
-			Timestamp  time.Time `gorm:"column:time_stamp;type:timestamptz;not null"`
-			Labels     string    `gorm:"column:labels;type:json;not null;default:'[]'"`
-			Comment    string    `gorm:"column:comment;type:text;not null;default:''"`
+			ItemId       string     `gorm:"column:item_id;type:varchar(256);not null;primaryKey"`
+			IsHidden     bool       `gorm:"column:is_hidden;type:bool;not null;default:false"`
+			Categories   string     `gorm:"column:categories;type:json;not null;default:'[]'"`
+			Timestamp    time.Time  `gorm:"column:time_stamp;type:timestamptz;not null"`
+			Labels       string     `gorm:"column:labels;type:json;not null;default:'[]'"`
+			Comment      string     `gorm:"column:comment;type:text;not null;default:''"`
+			VisibleFrom  *time.Time `gorm:"column:visible_from;type:timestamptz"`
+			VisibleUntil *time.Time `gorm:"column:visible_until;type:timestamptz"`
+			HiddenReason string     `gorm:"column:hidden_reason;type:varchar(256);not null;default:''"`
+			CreatedAt    *time.Time `gorm:"column:created_at;type:timestamptz"`
 		}
 		type Users struct {
 			UserId    string `gorm:"column:user_id;type:varchar(256) not null;primaryKey"`
@@ -186,20 +322,54 @@ func (d *SQLDatabase) Init() error {
 			ItemId       string    `gorm:"column:item_id;type:varchar(256);not null;primaryKey;index:item_id_index"`
 			Timestamp    time.Time `gorm:"column:time_stamp;type:timestamptz;not null"`
 			Comment      string    `gorm:"column:comment;type:text;not null;default:''"`
-		}
-		err := d.gormDB.AutoMigrate(Users{}, Items{}, Feedback{})
+			Context      string    `gorm:"column:context;type:json"`
+		}
+		type UserOverrides struct {
+			UserId  string `gorm:"column:user_id;type:varchar(256) not null;primaryKey"`
+			Pinned  string `gorm:"column:pinned;type:json;not null;default:'[]'"`
+			Blocked string `gorm:"column:blocked;type:json;not null;default:'[]'"`
+		}
+		type ItemCanonicals struct {
+			ItemId      string `gorm:"column:item_id;type:varchar(256) not null;primaryKey"`
+			CanonicalId string `gorm:"column:canonical_id;type:varchar(256) not null;index"`
+		}
+		type AuditLogs struct {
+			Id        string    `gorm:"column:id;type:varchar(256) not null;primaryKey"`
+			Timestamp time.Time `gorm:"column:time_stamp;type:timestamptz;not null"`
+			Actor     string    `gorm:"column:actor;type:varchar(256);not null;default:'';index"`
+			Endpoint  string    `gorm:"column:endpoint;type:varchar(256);not null;default:''"`
+			Entities  string    `gorm:"column:entities;type:json;not null;default:'[]'"`
+			Summary   string    `gorm:"column:summary;type:text;not null;default:''"`
+		}
+		type DailyUsage struct {
+			Day    string `gorm:"column:day;type:varchar(10) not null;primaryKey"`
+			Metric string `gorm:"column:metric;type:varchar(256) not null;primaryKey"`
+			Amount int64  `gorm:"column:amount;type:bigint;not null;default:0"`
+		}
+		type RecommendSnapshots struct {
+			UserId    string    `gorm:"column:user_id;type:varchar(256) not null;primaryKey"`
+			Category  string    `gorm:"column:category;type:varchar(256);not null;default:''"`
+			Timestamp time.Time `gorm:"column:time_stamp;type:timestamptz;not null;primaryKey;index"`
+			Items     string    `gorm:"column:items;type:json;not null;default:'[]'"`
+			Tags      string    `gorm:"column:tags;type:json;not null;default:'{}'"`
+		}
+		err := d.gormDB.AutoMigrate(Users{}, Items{}, Feedback{}, UserOverrides{}, ItemCanonicals{}, AuditLogs{}, DailyUsage{}, RecommendSnapshots{})
 		if err != nil {
 			return errors.Trace(err)
 		}
 	case SQLite:
 		// create tables
 		type Items struct {
-			ItemId     string `gorm:"column:item_id;type:varchar(256);not null;primaryKey"`
-			IsHidden   bool   `gorm:"column:is_hidden;type:bool;not null;default:false"`
-			Categories string `gorm:"column:categories;type:json;not null;default:'[]'"`
-			Timestamp  string `gorm:"column:time_stamp;type:datetime;not null;default:'0001-01-01'"`
-			Labels     string `gorm:"column:labels;type:json;not null;default:'[]'"`
-			Comment    string `gorm:"column:comment;type:text;not null;default:''"`
+			ItemId       string  `gorm:"column:item_id;type:varchar(256);not null;primaryKey"`
+			IsHidden     bool    `gorm:"column:is_hidden;type:bool;not null;default:false"`
+			Categories   string  `gorm:"column:categories;type:json;not null;default:'[]'"`
+			Timestamp    string  `gorm:"column:time_stamp;type:datetime;not null;default:'0001-01-01'"`
+			Labels       string  `gorm:"column:labels;type:json;not null;default:'[]'"`
+			Comment      string  `gorm:"column:comment;type:text;not null;default:''"`
+			VisibleFrom  *string `gorm:"column:visible_from;type:datetime"`
+			VisibleUntil *string `gorm:"column:visible_until;type:datetime"`
+			HiddenReason string  `gorm:"column:hidden_reason;type:varchar(256);not null;default:''"`
+			CreatedAt    *string `gorm:"column:created_at;type:datetime"`
 		}
 		type Users struct {
 			UserId    string `gorm:"column:user_id;type:varchar(256) not null;primaryKey"`
@@ -213,20 +383,54 @@ func (d *SQLDatabase) Init() error {
 			ItemId       string `gorm:"column:item_id;type:varchar(256);not null;primaryKey;index:item_id_index"`
 			Timestamp    string `gorm:"column:time_stamp;type:datetime;not null;default:'0001-01-01'"`
 			Comment      string `gorm:"column:comment;type:text;not null;default:''"`
+			Context      string `gorm:"column:context;type:json"`
+		}
+		type UserOverrides struct {
+			UserId  string `gorm:"column:user_id;type:varchar(256) not null;primaryKey"`
+			Pinned  string `gorm:"column:pinned;type:json;not null;default:'[]'"`
+			Blocked string `gorm:"column:blocked;type:json;not null;default:'[]'"`
+		}
+		type ItemCanonicals struct {
+			ItemId      string `gorm:"column:item_id;type:varchar(256) not null;primaryKey"`
+			CanonicalId string `gorm:"column:canonical_id;type:varchar(256) not null;index"`
+		}
+		type AuditLogs struct {
+			Id        string `gorm:"column:id;type:varchar(256) not null;primaryKey"`
+			Timestamp string `gorm:"column:time_stamp;type:datetime;not null;default:'0001-01-01'"`
+			Actor     string `gorm:"column:actor;type:varchar(256);not null;default:'';index"`
+			Endpoint  string `gorm:"column:endpoint;type:varchar(256);not null;default:''"`
+			Entities  string `gorm:"column:entities;type:json;not null;default:'[]'"`
+			Summary   string `gorm:"column:summary;type:text;not null;default:''"`
+		}
+		type DailyUsage struct {
+			Day    string `gorm:"column:day;type:varchar(10) not null;primaryKey"`
+			Metric string `gorm:"column:metric;type:varchar(256) not null;primaryKey"`
+			Amount int64  `gorm:"column:amount;type:integer;not null;default:0"`
+		}
+		type RecommendSnapshots struct {
+			UserId    string `gorm:"column:user_id;type:varchar(256) not null;primaryKey"`
+			Category  string `gorm:"column:category;type:varchar(256);not null;default:''"`
+			Timestamp string `gorm:"column:time_stamp;type:datetime;not null;primaryKey;index"`
+			Items     string `gorm:"column:items;type:json;not null;default:'[]'"`
+			Tags      string `gorm:"column:tags;type:json;not null;default:'{}'"`
 		}
-		err := d.gormDB.AutoMigrate(Users{}, Items{}, Feedback{})
+		err := d.gormDB.AutoMigrate(Users{}, Items{}, Feedback{}, UserOverrides{}, ItemCanonicals{}, AuditLogs{}, DailyUsage{}, RecommendSnapshots{})
 		if err != nil {
 			return errors.Trace(err)
 		}
 	case Oracle:
 		// create tables
 		type Items struct {
-			ItemId     string    `gorm:"column:ITEM_ID;type:varchar2(256);not null;primaryKey"`
-			IsHidden   bool      `gorm:"column:IS_HIDDEN;type:bool;not null"`
-			Categories []string  `gorm:"column:CATEGORIES;type:varchar2(4000);not null"`
-			Timestamp  time.Time `gorm:"column:TIME_STAMP;type:TIMESTAMP;not null"`
-			Labels     []string  `gorm:"column:LABELS;type:varchar2(4000);not null"`
-			Comment    string    `gorm:"column:\"COMMENT\";type:varchar2(4000)"`
+			ItemId       string     `gorm:"column:ITEM_ID;type:varchar2(256);not null;primaryKey"`
+			IsHidden     bool       `gorm:"column:IS_HIDDEN;type:bool;not null"`
+			Categories   []string   `gorm:"column:CATEGORIES;type:varchar2(4000);not null"`
+			Timestamp    time.Time  `gorm:"column:TIME_STAMP;type:TIMESTAMP;not null"`
+			Labels       []string   `gorm:"column:LABELS;type:varchar2(4000);not null"`
+			Comment      string     `gorm:"column:\"COMMENT\";type:varchar2(4000)"`
+			VisibleFrom  *time.Time `gorm:"column:VISIBLE_FROM;type:TIMESTAMP"`
+			VisibleUntil *time.Time `gorm:"column:VISIBLE_UNTIL;type:TIMESTAMP"`
+			HiddenReason string     `gorm:"column:HIDDEN_REASON;type:varchar2(256)"`
+			CreatedAt    *time.Time `gorm:"column:CREATED_AT;type:TIMESTAMP"`
 		}
 		type Users struct {
 			UserId    string   `gorm:"column:USER_ID;type:varchar2(256);not null;primaryKey"`
@@ -240,21 +444,55 @@ func (d *SQLDatabase) Init() error {
 			ItemId       string    `gorm:"column:ITEM_ID;type:varchar2(256);not null;primaryKey;index:item_id_index"`
 			Timestamp    time.Time `gorm:"column:TIME_STAMP;type:TIMESTAMP;not null"`
 			Comment      string    `gorm:"column:\"COMMENT\";type:varchar2(4000)"`
-		}
-		err := d.gormDB.AutoMigrate(Users{}, Items{}, Feedback{})
+			Context      string    `gorm:"column:CONTEXT;type:varchar2(4000)"`
+		}
+		type UserOverrides struct {
+			UserId  string `gorm:"column:USER_ID;type:varchar2(256);not null;primaryKey"`
+			Pinned  string `gorm:"column:PINNED;type:varchar2(4000);not null"`
+			Blocked string `gorm:"column:BLOCKED;type:varchar2(4000);not null"`
+		}
+		type ItemCanonicals struct {
+			ItemId      string `gorm:"column:ITEM_ID;type:varchar2(256);not null;primaryKey"`
+			CanonicalId string `gorm:"column:CANONICAL_ID;type:varchar2(256);not null;index"`
+		}
+		type AuditLogs struct {
+			Id        string    `gorm:"column:ID;type:varchar2(256);not null;primaryKey"`
+			Timestamp time.Time `gorm:"column:TIME_STAMP;type:TIMESTAMP;not null"`
+			Actor     string    `gorm:"column:ACTOR;type:varchar2(256);index"`
+			Endpoint  string    `gorm:"column:ENDPOINT;type:varchar2(256)"`
+			Entities  string    `gorm:"column:ENTITIES;type:CLOB;not null"`
+			Summary   string    `gorm:"column:SUMMARY;type:varchar2(4000)"`
+		}
+		type DailyUsage struct {
+			Day    string `gorm:"column:DAY;type:varchar2(10);not null;primaryKey"`
+			Metric string `gorm:"column:METRIC;type:varchar2(256);not null;primaryKey"`
+			Amount int64  `gorm:"column:AMOUNT;type:NUMBER(19);not null"`
+		}
+		type RecommendSnapshots struct {
+			UserId    string    `gorm:"column:USER_ID;type:varchar2(256);not null;primaryKey"`
+			Category  string    `gorm:"column:CATEGORY;type:varchar2(256)"`
+			Timestamp time.Time `gorm:"column:TIME_STAMP;type:TIMESTAMP;not null;primaryKey;index"`
+			Items     string    `gorm:"column:ITEMS;type:CLOB;not null"`
+			Tags      string    `gorm:"column:TAGS;type:CLOB;not null"`
+		}
+		err := d.gormDB.AutoMigrate(Users{}, Items{}, Feedback{}, UserOverrides{}, ItemCanonicals{}, AuditLogs{}, DailyUsage{}, RecommendSnapshots{})
 		if err != nil {
 			return errors.Trace(err)
 		}
 	case ClickHouse:
 		// create tables
 		type Items struct {
-			ItemId     string    `gorm:"column:item_id;type:String"`
-			IsHidden   int       `gorm:"column:is_hidden;type:Boolean;default:0"`
-			Categories string    `gorm:"column:categories;type:String;default:'[]'"`
-			Timestamp  time.Time `gorm:"column:time_stamp;type:Datetime"`
-			Labels     string    `gorm:"column:labels;type:String;default:'[]'"`
-			Comment    string    `gorm:"column:comment;type:String"`
-			Version    struct{}  `gorm:"column:version;type:DateTime"`
+			ItemId       string     `gorm:"column:item_id;type:String"`
+			IsHidden     int        `gorm:"column:is_hidden;type:Boolean;default:0"`
+			Categories   string     `gorm:"column:categories;type:String;default:'[]'"`
+			Timestamp    time.Time  `gorm:"column:time_stamp;type:Datetime"`
+			Labels       string     `gorm:"column:labels;type:String;default:'[]'"`
+			Comment      string     `gorm:"column:comment;type:String"`
+			VisibleFrom  *time.Time `gorm:"column:visible_from;type:Nullable(Datetime)"`
+			VisibleUntil *time.Time `gorm:"column:visible_until;type:Nullable(Datetime)"`
+			HiddenReason string     `gorm:"column:hidden_reason;type:String;default:''"`
+			CreatedAt    *time.Time `gorm:"column:created_at;type:Nullable(Datetime)"`
+			Version      struct{}   `gorm:"column:version;type:DateTime"`
 		}
 		err := d.gormDB.Set("gorm:table_options", "ENGINE = ReplacingMergeTree(version) ORDER BY item_id").AutoMigrate(Items{})
 		if err != nil {
@@ -277,12 +515,66 @@ func (d *SQLDatabase) Init() error {
 			ItemId       string    `gorm:"column:item_id;type:String;index:item_index,type:bloom_filter(0.01),granularity:1"`
 			Timestamp    time.Time `gorm:"column:time_stamp;type:DateTime"`
 			Comment      string    `gorm:"column:comment;type:String"`
+			Context      string    `gorm:"column:context;type:String;default:''"`
 			Version      struct{}  `gorm:"column:version;type:DateTime"`
 		}
 		err = d.gormDB.Set("gorm:table_options", "ENGINE = ReplacingMergeTree(version) ORDER BY (feedback_type, user_id, item_id)").AutoMigrate(Feedback{})
 		if err != nil {
 			return errors.Trace(err)
 		}
+		type UserOverrides struct {
+			UserId  string   `gorm:"column:user_id;type:String"`
+			Pinned  string   `gorm:"column:pinned;type:String;default:'[]'"`
+			Blocked string   `gorm:"column:blocked;type:String;default:'[]'"`
+			Version struct{} `gorm:"column:version;type:DateTime"`
+		}
+		err = d.gormDB.Set("gorm:table_options", "ENGINE = ReplacingMergeTree(version) ORDER BY user_id").AutoMigrate(UserOverrides{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		type ItemCanonicals struct {
+			ItemId      string   `gorm:"column:item_id;type:String"`
+			CanonicalId string   `gorm:"column:canonical_id;type:String"`
+			Version     struct{} `gorm:"column:version;type:DateTime"`
+		}
+		err = d.gormDB.Set("gorm:table_options", "ENGINE = ReplacingMergeTree(version) ORDER BY item_id").AutoMigrate(ItemCanonicals{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		type AuditLogs struct {
+			Id        string    `gorm:"column:id;type:String"`
+			Timestamp time.Time `gorm:"column:time_stamp;type:DateTime"`
+			Actor     string    `gorm:"column:actor;type:String"`
+			Endpoint  string    `gorm:"column:endpoint;type:String"`
+			Entities  string    `gorm:"column:entities;type:String;default:'[]'"`
+			Summary   string    `gorm:"column:summary;type:String"`
+		}
+		err = d.gormDB.Set("gorm:table_options", "ENGINE = MergeTree() ORDER BY id").AutoMigrate(AuditLogs{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		type DailyUsage struct {
+			Day     string   `gorm:"column:day;type:String"`
+			Metric  string   `gorm:"column:metric;type:String"`
+			Amount  int64    `gorm:"column:amount;type:Int64"`
+			Version struct{} `gorm:"column:version;type:DateTime"`
+		}
+		err = d.gormDB.Set("gorm:table_options", "ENGINE = ReplacingMergeTree(version) ORDER BY (day, metric)").AutoMigrate(DailyUsage{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		type RecommendSnapshots struct {
+			UserId    string    `gorm:"column:user_id;type:String"`
+			Category  string    `gorm:"column:category;type:String"`
+			Timestamp time.Time `gorm:"column:time_stamp;type:DateTime"`
+			Items     string    `gorm:"column:items;type:String;default:'[]'"`
+			Tags      string    `gorm:"column:tags;type:String;default:'{}'"`
+			Version   struct{}  `gorm:"column:version;type:DateTime"`
+		}
+		err = d.gormDB.Set("gorm:table_options", "ENGINE = ReplacingMergeTree(version) ORDER BY (user_id, time_stamp)").AutoMigrate(RecommendSnapshots{})
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 	return nil
 }
@@ -292,8 +584,15 @@ func (d *SQLDatabase) Close() error {
 	return d.client.Close()
 }
 
+func (d *SQLDatabase) WithContext(ctx context.Context) Database {
+	database := *d
+	database.gormDB = d.gormDB.WithContext(ctx)
+	return &database
+}
+
 func (d *SQLDatabase) Purge() error {
-	tables := []string{d.ItemsTable(), d.FeedbackTable(), d.UsersTable()}
+	tables := []string{d.ItemsTable(), d.FeedbackTable(), d.UsersTable(), d.UserOverridesTable(), d.ItemCanonicalsTable(),
+		d.RecommendSnapshotsTable()}
 	if d.driver == ClickHouse {
 		for _, tableName := range tables {
 			err := d.gormDB.Exec(fmt.Sprintf("alter table %s delete where 1=1", tableName)).Error
@@ -317,16 +616,28 @@ func (d *SQLDatabase) BatchInsertItems(items []Item) error {
 	if len(items) == 0 {
 		return nil
 	}
+	now := time.Now().In(time.UTC)
 	if d.driver == ClickHouse {
+		// items are replaced in ClickHouse, so that creation time of existing items is read before insertion
+		createdAt, err := d.getItemCreatedAt(lo.Map(items, func(item Item, _ int) string { return item.ItemId }))
+		if err != nil {
+			return errors.Trace(err)
+		}
 		rows := make([]ClickHouseItem, 0, len(items))
 		memo := strset.New()
 		for _, item := range items {
 			if !memo.Has(item.ItemId) {
 				memo.Add(item.ItemId)
-				rows = append(rows, NewClickHouseItem(item))
+				row := NewClickHouseItem(item)
+				if t, exist := createdAt[item.ItemId]; exist {
+					row.CreatedAt = utcTime(&t)
+				} else {
+					row.CreatedAt = &now
+				}
+				rows = append(rows, row)
 			}
 		}
-		err := d.gormDB.Create(rows).Error
+		err = d.gormDB.Create(rows).Error
 		return errors.Trace(err)
 	} else {
 		rows := make([]SQLItem, 0, len(items))
@@ -338,33 +649,68 @@ func (d *SQLDatabase) BatchInsertItems(items []Item) error {
 				if d.driver == SQLite || d.driver == Oracle {
 					row.Timestamp = row.Timestamp.In(time.UTC)
 				}
+				// creation time of existing items isn't updated
+				row.CreatedAt = &now
 				rows = append(rows, row)
 			}
 		}
 		err := d.gormDB.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "item_id"}},
-			DoUpdates: clause.AssignmentColumns([]string{"is_hidden", "categories", "time_stamp", "labels", "comment"}),
+			DoUpdates: clause.AssignmentColumns([]string{"is_hidden", "categories", "time_stamp", "labels", "comment", "visible_from", "visible_until", "hidden_reason"}),
 		}).Create(rows).Error
 		return errors.Trace(err)
 	}
 }
 
-func (d *SQLDatabase) BatchGetItems(itemIds []string) ([]Item, error) {
-	if len(itemIds) == 0 {
-		return nil, nil
-	}
-	result, err := d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment").Where("item_id IN ?", itemIds).Rows()
+// getItemCreatedAt returns creation time of existing items. Items without creation time are absent.
+func (d *SQLDatabase) getItemCreatedAt(itemIds []string) (map[string]time.Time, error) {
+	result, err := d.gormDB.Table(d.ItemsTable()).Select("item_id, created_at").Where("item_id IN ?", itemIds).Rows()
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	defer result.Close()
+	createdAt := make(map[string]time.Time)
+	for result.Next() {
+		var itemId string
+		var t sql.NullTime
+		if err = result.Scan(&itemId, &t); err != nil {
+			return nil, errors.Trace(err)
+		}
+		// replaced rows might not have been merged in ClickHouse
+		if previous, exist := createdAt[itemId]; t.Valid && (!exist || t.Time.Before(previous)) {
+			createdAt[itemId] = t.Time
+		}
+	}
+	return createdAt, nil
+}
+
+// BatchGetItems gets items from SQL database by queries of chunks of ids.
+func (d *SQLDatabase) BatchGetItems(itemIds []string) ([]Item, []string, error) {
+	return d.batchGetItems(itemIds, func(chunk []string) ([]Item, error) {
+		result, err := d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment, visible_from, visible_until, hidden_reason, created_at").Where("item_id IN ?", chunk).Rows()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return scanItems(result)
+	})
+}
+
+// scanItems reads all items from rows and closes rows.
+func scanItems(result *sql.Rows) ([]Item, error) {
 	defer result.Close()
 	var items []Item
+	var err error
 	for result.Next() {
 		var item Item
 		var labels, categories string
-		if err = result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &item.Comment); err != nil {
+		var visibleFrom, visibleUntil, createdAt sql.NullTime
+		var hiddenReason sql.NullString
+		if err = result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &item.Comment, &visibleFrom, &visibleUntil, &hiddenReason, &createdAt); err != nil {
 			return nil, errors.Trace(err)
 		}
+		item.VisibleFrom, item.VisibleUntil = nullTime(visibleFrom), nullTime(visibleUntil)
+		item.HiddenReason = hiddenReason.String
+		item.CreatedAt = lo.FromPtr(nullTime(createdAt))
 		if err = json.Unmarshal([]byte(labels), &item.Labels); err != nil {
 			return nil, err
 		}
@@ -391,7 +737,7 @@ func (d *SQLDatabase) DeleteItem(itemId string) error {
 func (d *SQLDatabase) GetItem(itemId string) (Item, error) {
 	var result *sql.Rows
 	var err error
-	result, err = d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment").Where("item_id = ?", itemId).Rows()
+	result, err = d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment, visible_from, visible_until, hidden_reason, created_at").Where("item_id = ?", itemId).Rows()
 	if err != nil {
 		return Item{}, errors.Trace(err)
 	}
@@ -400,9 +746,14 @@ func (d *SQLDatabase) GetItem(itemId string) (Item, error) {
 		var item Item
 		var labels, categories string
 		var comment sql.NullString
-		if err := result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &comment); err != nil {
+		var visibleFrom, visibleUntil, createdAt sql.NullTime
+		var hiddenReason sql.NullString
+		if err := result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &comment, &visibleFrom, &visibleUntil, &hiddenReason, &createdAt); err != nil {
 			return Item{}, errors.Trace(err)
 		}
+		item.VisibleFrom, item.VisibleUntil = nullTime(visibleFrom), nullTime(visibleUntil)
+		item.HiddenReason = hiddenReason.String
+		item.CreatedAt = lo.FromPtr(nullTime(createdAt))
 		if err := json.Unmarshal([]byte(labels), &item.Labels); err != nil {
 			return Item{}, err
 		}
@@ -418,10 +769,152 @@ func (d *SQLDatabase) GetItem(itemId string) (Item, error) {
 // ModifyItem modify an item in MySQL.
 func (d *SQLDatabase) ModifyItem(itemId string, patch ItemPatch) error {
 	// ignore empty patch
-	if patch.IsHidden == nil && patch.Categories == nil && patch.Labels == nil && patch.Comment == nil && patch.Timestamp == nil {
+	if patch.IsEmpty() {
+		log.Logger().Debug("empty item patch")
+		return nil
+	}
+	if patch.Version != "" {
+		return d.transaction(func(tx *gorm.DB) error {
+			item, err := d.lockItem(tx, itemId)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err = patch.checkVersion(item); err != nil {
+				return errors.Trace(err)
+			}
+			if patch.hasArrayOperations() {
+				return d.modifyItemArrays(tx, itemId, patch)
+			}
+			return errors.Trace(tx.Model(&SQLItem{ItemId: itemId}).Updates(d.itemPatchAttributes(patch)).Error)
+		})
+	}
+	if patch.hasArrayOperations() {
+		return d.transaction(func(tx *gorm.DB) error {
+			return d.modifyItemArrays(tx, itemId, patch)
+		})
+	}
+	err := d.gormDB.Model(&SQLItem{ItemId: itemId}).Updates(d.itemPatchAttributes(patch)).Error
+	return errors.Trace(err)
+}
+
+// lockItem locks an item in a transaction and reads the item.
+func (d *SQLDatabase) lockItem(tx *gorm.DB, itemId string) (Item, error) {
+	var id string
+	if exist, err := d.readRow(d.forUpdate(tx).Table(d.ItemsTable()).Select("item_id").
+		Where("item_id = ?", itemId), &id); err != nil {
+		return Item{}, errors.Trace(err)
+	} else if !exist {
+		return Item{}, errors.Annotate(ErrItemNotExist, itemId)
+	}
+	return d.inTransaction(tx).GetItem(itemId)
+}
+
+// lockUser locks a user in a transaction and reads the user.
+func (d *SQLDatabase) lockUser(tx *gorm.DB, userId string) (User, error) {
+	var id string
+	if exist, err := d.readRow(d.forUpdate(tx).Table(d.UsersTable()).Select("user_id").
+		Where("user_id = ?", userId), &id); err != nil {
+		return User{}, errors.Trace(err)
+	} else if !exist {
+		return User{}, errors.Annotate(ErrUserNotExist, userId)
+	}
+	return d.inTransaction(tx).GetUser(userId)
+}
+
+// inTransaction returns a copy of the database which runs queries in a transaction.
+func (d *SQLDatabase) inTransaction(tx *gorm.DB) *SQLDatabase {
+	database := *d
+	database.gormDB = tx
+	return &database
+}
+
+// modifyItemArrays reads labels and categories of an item and writes back the patched item.
+func (d *SQLDatabase) modifyItemArrays(tx *gorm.DB, itemId string, patch ItemPatch) error {
+	var item Item
+	var labels, categories string
+	if exist, err := d.readRow(d.forUpdate(tx).Table(d.ItemsTable()).Select("labels, categories").
+		Where("item_id = ?", itemId), &labels, &categories); err != nil || !exist {
+		return errors.Trace(err)
+	}
+	if err := json.Unmarshal([]byte(labels), &item.Labels); err != nil {
+		return errors.Trace(err)
+	}
+	if err := json.Unmarshal([]byte(categories), &item.Categories); err != nil {
+		return errors.Trace(err)
+	}
+	item = patch.Apply(item)
+	attributes := d.itemPatchAttributes(patch)
+	if len(patch.AddLabels) > 0 || len(patch.RemoveLabels) > 0 {
+		text, _ := json.Marshal(item.Labels)
+		attributes["labels"] = string(text)
+	}
+	if len(patch.AddCategories) > 0 || len(patch.RemoveCategories) > 0 {
+		text, _ := json.Marshal(item.Categories)
+		attributes["categories"] = string(text)
+	}
+	return errors.Trace(tx.Model(&SQLItem{ItemId: itemId}).Updates(attributes).Error)
+}
+
+// readRow scans the first row of a query. False is returned if there is no row.
+func (d *SQLDatabase) readRow(tx *gorm.DB, dest ...any) (bool, error) {
+	rows, err := tx.Rows()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, errors.Trace(rows.Err())
+	}
+	return true, errors.Trace(rows.Scan(dest...))
+}
+
+// forUpdate locks rows read in a transaction until the transaction ends. SQLite locks the whole database in a
+// transaction instead.
+func (d *SQLDatabase) forUpdate(tx *gorm.DB) *gorm.DB {
+	switch d.driver {
+	case MySQL, Postgres, Oracle:
+		return tx.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	return tx
+}
+
+// transaction runs a read-modify-write transaction, which is retried if it fails due to concurrent modifications.
+// Conflicts and missing rows aren't retried. ClickHouse doesn't support transactions so that modifications aren't
+// atomic.
+func (d *SQLDatabase) transaction(work func(tx *gorm.DB) error) error {
+	if d.driver == ClickHouse {
+		return work(d.gormDB)
+	}
+	var err error
+	for i := 0; i < sqlMaxTxRetries; i++ {
+		if err = d.gormDB.Transaction(work); err == nil || errors.Is(err, ErrConflict) || errors.Is(err, errors.NotFound) {
+			return err
+		}
+		time.Sleep(time.Duration(rand.Intn(i+1)) * time.Millisecond)
+	}
+	return errors.Trace(err)
+}
+
+// BatchModifyItems applies the same modification to items in MySQL.
+func (d *SQLDatabase) BatchModifyItems(itemIds []string, patch ItemPatch) error {
+	// ignore empty patch
+	if len(itemIds) == 0 || patch.IsEmpty() {
 		log.Logger().Debug("empty item patch")
 		return nil
 	}
+	if patch.hasArrayOperations() {
+		for _, itemId := range itemIds {
+			if err := d.ModifyItem(itemId, patch); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	}
+	err := d.gormDB.Model(&SQLItem{}).Where("item_id IN ?", itemIds).Updates(d.itemPatchAttributes(patch)).Error
+	return errors.Trace(err)
+}
+
+func (d *SQLDatabase) itemPatchAttributes(patch ItemPatch) map[string]any {
 	attributes := make(map[string]any)
 	if patch.IsHidden != nil {
 		if *patch.IsHidden {
@@ -449,13 +942,29 @@ func (d *SQLDatabase) ModifyItem(itemId string, patch ItemPatch) error {
 			attributes["time_stamp"] = patch.Timestamp
 		}
 	}
-	err := d.gormDB.Model(&SQLItem{ItemId: itemId}).Updates(attributes).Error
-	return errors.Trace(err)
+	if patch.VisibleFrom != nil {
+		attributes["visible_from"] = utcTime(patch.VisibleFrom)
+	}
+	if patch.VisibleUntil != nil {
+		attributes["visible_until"] = utcTime(patch.VisibleUntil)
+	}
+	if patch.HiddenReason != nil {
+		attributes["hidden_reason"] = *patch.HiddenReason
+	}
+	return attributes
+}
+
+// nullTime converts a nullable column to an optional UTC time.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return utcTime(&t.Time)
 }
 
 // GetItems returns items from MySQL.
 func (d *SQLDatabase) GetItems(cursor string, n int, timeLimit *time.Time) (string, []Item, error) {
-	tx := d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment")
+	tx := d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment, visible_from, visible_until, hidden_reason, created_at")
 	if cursor != "" {
 		tx.Where("item_id >= ?", cursor)
 	}
@@ -472,9 +981,14 @@ func (d *SQLDatabase) GetItems(cursor string, n int, timeLimit *time.Time) (stri
 		var item Item
 		var labels, categories string
 		var comment sql.NullString
-		if err = result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &comment); err != nil {
+		var visibleFrom, visibleUntil, createdAt sql.NullTime
+		var hiddenReason sql.NullString
+		if err = result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &comment, &visibleFrom, &visibleUntil, &hiddenReason, &createdAt); err != nil {
 			return "", nil, errors.Trace(err)
 		}
+		item.VisibleFrom, item.VisibleUntil = nullTime(visibleFrom), nullTime(visibleUntil)
+		item.HiddenReason = hiddenReason.String
+		item.CreatedAt = lo.FromPtr(nullTime(createdAt))
 		if err = json.Unmarshal([]byte(labels), &item.Labels); err != nil {
 			return "", nil, errors.Trace(err)
 		}
@@ -498,7 +1012,7 @@ func (d *SQLDatabase) GetItemStream(batchSize int, timeLimit *time.Time) (chan [
 		defer close(itemChan)
 		defer close(errChan)
 		// send query
-		tx := d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment")
+		tx := d.gormDB.Table(d.ItemsTable()).Select("item_id, is_hidden, categories, time_stamp, labels, comment, visible_from, visible_until, hidden_reason, created_at")
 		if timeLimit != nil {
 			tx.Where("time_stamp >= ?", *timeLimit)
 		}
@@ -513,10 +1027,15 @@ func (d *SQLDatabase) GetItemStream(batchSize int, timeLimit *time.Time) (chan [
 		for result.Next() {
 			var item Item
 			var labels, categories string
-			if err = result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &item.Comment); err != nil {
+			var visibleFrom, visibleUntil, createdAt sql.NullTime
+			var hiddenReason sql.NullString
+			if err = result.Scan(&item.ItemId, &item.IsHidden, &categories, &item.Timestamp, &labels, &item.Comment, &visibleFrom, &visibleUntil, &hiddenReason, &createdAt); err != nil {
 				errChan <- errors.Trace(err)
 				return
 			}
+			item.VisibleFrom, item.VisibleUntil = nullTime(visibleFrom), nullTime(visibleUntil)
+			item.HiddenReason = hiddenReason.String
+			item.CreatedAt = lo.FromPtr(nullTime(createdAt))
 			if err = json.Unmarshal([]byte(labels), &item.Labels); err != nil {
 				errChan <- errors.Trace(err)
 				return
@@ -539,12 +1058,192 @@ func (d *SQLDatabase) GetItemStream(batchSize int, timeLimit *time.Time) (chan [
 	return itemChan, errChan
 }
 
+// GetCategories returns categories and numbers of items from MySQL. Counts from ClickHouse are approximate since
+// replaced rows might not be merged yet.
+func (d *SQLDatabase) GetCategories() ([]CategoryCount, error) {
+	counts, err := d.countElements(d.ItemsTable(), "categories")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	categories := make([]CategoryCount, 0, len(counts))
+	for name, count := range counts {
+		categories = append(categories, CategoryCount{Name: name, Count: count})
+	}
+	SortCategoryCounts(categories)
+	return categories, nil
+}
+
+// GetLabels returns labels and numbers of items and users from MySQL. Counts from ClickHouse are approximate since
+// replaced rows might not be merged yet.
+func (d *SQLDatabase) GetLabels() ([]LabelCount, error) {
+	itemCounts, err := d.countElements(d.ItemsTable(), "labels")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	userCounts, err := d.countElements(d.UsersTable(), "labels")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return MergeLabelCounts(itemCounts, userCounts), nil
+}
+
+// countElements counts rows containing each element of a column of JSON arrays.
+func (d *SQLDatabase) countElements(table, column string) (map[string]int, error) {
+	var query string
+	switch d.driver {
+	case MySQL:
+		query = fmt.Sprintf("SELECT c.element, COUNT(*) FROM %s, JSON_TABLE(%s.%s, '$[*]' COLUMNS (element VARCHAR(256) PATH '$')) AS c GROUP BY c.element",
+			table, table, column)
+	case Postgres:
+		// nil arrays are stored as JSON nulls, which aren't arrays
+		query = fmt.Sprintf("SELECT c.element, COUNT(*) FROM %s, json_array_elements_text(CASE WHEN json_typeof(%s.%s) = 'array' THEN %s.%s ELSE '[]' END) AS c(element) GROUP BY c.element",
+			table, table, column, table, column)
+	case SQLite:
+		query = fmt.Sprintf("SELECT json_each.value, COUNT(*) FROM %s, json_each(%s.%s) WHERE json_each.type != 'null' GROUP BY json_each.value",
+			table, table, column)
+	case Oracle:
+		query = fmt.Sprintf("SELECT c.element, COUNT(*) FROM %s, JSON_TABLE(%s.%s, '$[*]' COLUMNS (element VARCHAR2(256) PATH '$')) c GROUP BY c.element",
+			table, table, column)
+	case ClickHouse:
+		query = fmt.Sprintf("SELECT element, COUNT(*) FROM %s ARRAY JOIN JSONExtract(%s, 'Array(String)') AS element GROUP BY element",
+			table, column)
+	}
+	result, err := d.gormDB.Raw(query).Rows()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer result.Close()
+	counts := make(map[string]int)
+	for result.Next() {
+		var (
+			name  string
+			count int
+		)
+		if err = result.Scan(&name, &count); err != nil {
+			return nil, errors.Trace(err)
+		}
+		counts[name] = count
+	}
+	return counts, nil
+}
+
+// containsElement returns the condition that a column of JSON arrays contains an element.
+func (d *SQLDatabase) containsElement(column string) string {
+	switch d.driver {
+	case MySQL:
+		return fmt.Sprintf("JSON_CONTAINS(%s, JSON_QUOTE(?))", column)
+	case Postgres:
+		return fmt.Sprintf("EXISTS (SELECT 1 FROM json_array_elements_text(%s) AS e(element) WHERE e.element = ?)", column)
+	case SQLite:
+		return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) WHERE json_each.value = ?)", column)
+	case Oracle:
+		return fmt.Sprintf("EXISTS (SELECT 1 FROM JSON_TABLE(%s, '$[*]' COLUMNS (element VARCHAR2(256) PATH '$')) e WHERE e.element = ?)", column)
+	case ClickHouse:
+		return fmt.Sprintf("has(JSONExtract(%s, 'Array(String)'), ?)", column)
+	}
+	return ""
+}
+
+// sampleOrder orders rows by pseudo random numbers under a seed. All rows are scanned and sorted, while samplers
+// differ between drivers:
+//   - MySQL orders rows by RAND(seed), which is uniform.
+//   - Postgres orders rows by MD5 of keys and the seed, which is uniform.
+//   - ClickHouse orders rows by cityHash64 of keys and the seed, which is uniform.
+//   - Oracle orders rows by ORA_HASH of keys under the seed, which is uniform.
+//   - SQLite orders rows by multiplicative hashes of row ids offset by the seed, so that sampled rows are spread evenly
+//     over the insertion order instead of being independent. Row ids might change after VACUUM.
+func (d *SQLDatabase) sampleOrder(key string, seed int64) clause.OrderBy {
+	var expr clause.Expr
+	switch d.driver {
+	case MySQL:
+		expr = clause.Expr{SQL: "RAND(?)", Vars: []any{seed}}
+	case Postgres:
+		expr = clause.Expr{SQL: fmt.Sprintf("MD5(%s || ?)", key), Vars: []any{strconv.FormatInt(seed, 10)}}
+	case ClickHouse:
+		expr = clause.Expr{SQL: fmt.Sprintf("cityHash64(%s, ?)", key), Vars: []any{seed}}
+	case Oracle:
+		expr = clause.Expr{SQL: fmt.Sprintf("ORA_HASH(%s, 4294967295, ?)", key), Vars: []any{int64(uint32(seed))}}
+	case SQLite:
+		// Knuth's multiplicative hash, which never overflows for row ids less than 2^31
+		expr = clause.Expr{SQL: "((rowid + ?) * 2654435761) % 4294967296", Vars: []any{int64(uint16(seed))}}
+	}
+	return clause.OrderBy{Expression: expr}
+}
+
+// SampleItems samples items which aren't hidden from MySQL. See sampleOrder for samplers of drivers. Replaced items in
+// ClickHouse might be sampled twice before merged, so that fewer items might be returned.
+func (d *SQLDatabase) SampleItems(n int, category string, seed int64) ([]Item, error) {
+	tx := d.gormDB.Table(d.ItemsTable()).
+		Select("item_id, is_hidden, categories, time_stamp, labels, comment, visible_from, visible_until, hidden_reason, created_at").
+		Where("is_hidden = 0")
+	if category != "" {
+		tx = tx.Where(d.containsElement("categories"), category)
+	}
+	result, err := tx.Clauses(d.sampleOrder("item_id", seed)).Limit(n).Rows()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	items, err := scanItems(result)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return lo.UniqBy(items, func(item Item) string {
+		return item.ItemId
+	}), nil
+}
+
+// SampleUsers samples users from MySQL. See sampleOrder for samplers of drivers. Replaced users in ClickHouse might be
+// sampled twice before merged, so that fewer users might be returned.
+func (d *SQLDatabase) SampleUsers(n int, hasFeedback bool, seed int64) ([]User, error) {
+	tx := d.gormDB.Table(d.UsersTable()).Select("user_id, labels, subscribe, comment")
+	if hasFeedback {
+		tx = tx.Where(fmt.Sprintf("user_id IN (SELECT user_id FROM %s)", d.FeedbackTable()))
+	}
+	result, err := tx.Clauses(d.sampleOrder("user_id", seed)).Limit(n).Rows()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer result.Close()
+	var users []User
+	for result.Next() {
+		var user User
+		var labels, subscribe string
+		var comment sql.NullString
+		if err = result.Scan(&user.UserId, &labels, &subscribe, &comment); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = json.Unmarshal([]byte(labels), &user.Labels); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = json.Unmarshal([]byte(subscribe), &user.Subscribe); err != nil {
+			return nil, errors.Trace(err)
+		}
+		user.Comment = comment.String
+		users = append(users, user)
+	}
+	return lo.UniqBy(users, func(user User) string {
+		return user.UserId
+	}), nil
+}
+
+// CountItems returns the number of items in MySQL.
+func (d *SQLDatabase) CountItems() (int, error) {
+	var count int64
+	tx := d.gormDB.Table(d.ItemsTable())
+	if d.driver == ClickHouse {
+		// replaced rows might not be merged yet
+		tx = tx.Distinct("item_id")
+	}
+	err := tx.Count(&count).Error
+	return int(count), errors.Trace(err)
+}
+
 // GetItemFeedback returns feedback of a item from MySQL.
 func (d *SQLDatabase) GetItemFeedback(itemId string, feedbackTypes ...string) ([]Feedback, error) {
 	tx := d.gormDB.Table(d.FeedbackTable()).Select("user_id, item_id, feedback_type, time_stamp")
 	switch d.driver {
 	case SQLite:
-		tx.Where("time_stamp <= DATETIME() AND item_id = ?", itemId)
+		tx.Where("time_stamp <= ? AND item_id = ?", time.Now().In(time.UTC), itemId)
 	case Oracle:
 		tx.Where("time_stamp <= SYS_EXTRACT_UTC(SYSTIMESTAMP) AND item_id = ?", itemId)
 	default:
@@ -643,10 +1342,62 @@ func (d *SQLDatabase) GetUser(userId string) (User, error) {
 // ModifyUser modify a user in MySQL.
 func (d *SQLDatabase) ModifyUser(userId string, patch UserPatch) error {
 	// ignore empty patch
-	if patch.Labels == nil && patch.Subscribe == nil && patch.Comment == nil {
+	if patch.IsEmpty() {
 		log.Logger().Debug("empty user patch")
 		return nil
 	}
+	if patch.Version != "" {
+		return d.transaction(func(tx *gorm.DB) error {
+			user, err := d.lockUser(tx, userId)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err = patch.checkVersion(user); err != nil {
+				return errors.Trace(err)
+			}
+			if patch.hasArrayOperations() {
+				return d.modifyUserArrays(tx, userId, patch)
+			}
+			return errors.Trace(tx.Model(&SQLUser{UserId: userId}).Updates(userPatchAttributes(patch)).Error)
+		})
+	}
+	if patch.hasArrayOperations() {
+		return d.transaction(func(tx *gorm.DB) error {
+			return d.modifyUserArrays(tx, userId, patch)
+		})
+	}
+	err := d.gormDB.Model(&SQLUser{UserId: userId}).Updates(userPatchAttributes(patch)).Error
+	return errors.Trace(err)
+}
+
+// modifyUserArrays reads labels and subscribe of a user and writes back the patched user.
+func (d *SQLDatabase) modifyUserArrays(tx *gorm.DB, userId string, patch UserPatch) error {
+	var user User
+	var labels, subscribe string
+	if exist, err := d.readRow(d.forUpdate(tx).Table(d.UsersTable()).Select("labels, subscribe").
+		Where("user_id = ?", userId), &labels, &subscribe); err != nil || !exist {
+		return errors.Trace(err)
+	}
+	if err := json.Unmarshal([]byte(labels), &user.Labels); err != nil {
+		return errors.Trace(err)
+	}
+	if err := json.Unmarshal([]byte(subscribe), &user.Subscribe); err != nil {
+		return errors.Trace(err)
+	}
+	user = patch.Apply(user)
+	attributes := userPatchAttributes(patch)
+	if len(patch.AddLabels) > 0 || len(patch.RemoveLabels) > 0 {
+		text, _ := json.Marshal(user.Labels)
+		attributes["labels"] = string(text)
+	}
+	if len(patch.AddSubscribe) > 0 || len(patch.RemoveSubscribe) > 0 {
+		text, _ := json.Marshal(user.Subscribe)
+		attributes["subscribe"] = string(text)
+	}
+	return errors.Trace(tx.Model(&SQLUser{UserId: userId}).Updates(attributes).Error)
+}
+
+func userPatchAttributes(patch UserPatch) map[string]any {
 	attributes := make(map[string]any)
 	if patch.Comment != nil {
 		attributes["comment"] = *patch.Comment
@@ -659,8 +1410,7 @@ func (d *SQLDatabase) ModifyUser(userId string, patch UserPatch) error {
 		text, _ := json.Marshal(patch.Subscribe)
 		attributes["subscribe"] = string(text)
 	}
-	err := d.gormDB.Model(&SQLUser{UserId: userId}).Updates(attributes).Error
-	return errors.Trace(err)
+	return attributes
 }
 
 // GetUsers returns users from MySQL.
@@ -697,6 +1447,18 @@ func (d *SQLDatabase) GetUsers(cursor string, n int) (string, []User, error) {
 	return "", users, nil
 }
 
+// CountUsers returns the number of users in MySQL.
+func (d *SQLDatabase) CountUsers() (int, error) {
+	var count int64
+	tx := d.gormDB.Table(d.UsersTable())
+	if d.driver == ClickHouse {
+		// replaced rows might not be merged yet
+		tx = tx.Distinct("user_id")
+	}
+	err := tx.Count(&count).Error
+	return int(count), errors.Trace(err)
+}
+
 // GetUserStream read users by stream.
 func (d *SQLDatabase) GetUserStream(batchSize int) (chan []User, chan error) {
 	userChan := make(chan []User, bufSize)
@@ -745,11 +1507,11 @@ func (d *SQLDatabase) GetUserStream(batchSize int) (chan []User, chan error) {
 
 // GetUserFeedback returns feedback of a user from MySQL.
 func (d *SQLDatabase) GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]Feedback, error) {
-	tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment").Where("user_id = ?", userId)
+	tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment, context").Where("user_id = ?", userId)
 	if !withFuture {
 		switch d.driver {
 		case SQLite:
-			tx.Where("time_stamp <= DATETIME()")
+			tx.Where("time_stamp <= ?", time.Now().In(time.UTC))
 		case Oracle:
 			tx.Where("time_stamp <= SYS_EXTRACT_UTC(SYSTIMESTAMP)")
 		default:
@@ -767,11 +1529,14 @@ func (d *SQLDatabase) GetUserFeedback(userId string, withFuture bool, feedbackTy
 	defer result.Close()
 	for result.Next() {
 		var feedback Feedback
-		var comment sql.NullString
-		if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment); err != nil {
+		var comment, feedbackContext sql.NullString
+		if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment, &feedbackContext); err != nil {
 			return nil, errors.Trace(err)
 		}
 		feedback.Comment = comment.String
+		if feedback.Context, err = decodeFeedbackContext(feedbackContext); err != nil {
+			return nil, errors.Trace(err)
+		}
 		feedbacks = append(feedbacks, feedback)
 	}
 	return feedbacks, nil
@@ -839,6 +1604,7 @@ func (d *SQLDatabase) BatchInsertFeedback(feedback []Feedback, insertUser, inser
 	// insert items
 	if insertItem {
 		itemList := items.List()
+		now := time.Now().In(time.UTC)
 		if d.driver == ClickHouse {
 			err := d.gormDB.Create(lo.Map(itemList, func(itemId string, _ int) ClickHouseItem {
 				return ClickHouseItem{
@@ -846,6 +1612,7 @@ func (d *SQLDatabase) BatchInsertFeedback(feedback []Feedback, insertUser, inser
 						ItemId:     itemId,
 						Labels:     "[]",
 						Categories: "[]",
+						CreatedAt:  &now,
 					},
 				}
 			})).Error
@@ -861,6 +1628,7 @@ func (d *SQLDatabase) BatchInsertFeedback(feedback []Feedback, insertUser, inser
 					ItemId:     itemId,
 					Labels:     "[]",
 					Categories: "[]",
+					CreatedAt:  &now,
 				}
 			})).Error
 			if err != nil {
@@ -881,55 +1649,125 @@ func (d *SQLDatabase) BatchInsertFeedback(feedback []Feedback, insertUser, inser
 		}
 	}
 	// insert feedback
-	if d.driver == ClickHouse {
-		rows := make([]ClickHouseFeedback, 0, len(feedback))
-		memo := make(map[lo.Tuple3[string, string, string]]struct{})
-		for _, f := range feedback {
-			if users.Has(f.UserId) && items.Has(f.ItemId) {
-				if _, exist := memo[lo.Tuple3[string, string, string]{f.FeedbackType, f.UserId, f.ItemId}]; !exist {
-					memo[lo.Tuple3[string, string, string]{f.FeedbackType, f.UserId, f.ItemId}] = struct{}{}
-					f.Timestamp = f.Timestamp.In(time.UTC)
-					rows = append(rows, ClickHouseFeedback{
-						Feedback: f,
-						Version:  lo.If(overwrite, time.Now().In(time.UTC)).Else(time.Time{}),
-					})
-				}
-			}
+	rows := uniqueFeedback(feedback, users, items, overwrite)
+	for i := range rows {
+		if d.driver == ClickHouse || d.driver == SQLite || d.driver == Oracle {
+			rows[i].Timestamp = rows[i].Timestamp.In(time.UTC)
 		}
-		if len(rows) == 0 {
-			return nil
+		// nil context isn't serialized by GORM
+		if rows[i].Context == nil {
+			rows[i].Context = map[string]string{}
 		}
-		err := d.gormDB.Create(rows).Error
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if d.driver == ClickHouse {
+		// the newest feedback is kept by versions of ReplacingMergeTree, while existed feedback is kept by zero versions
+		err := d.gormDB.Create(lo.Map(rows, func(f Feedback, _ int) ClickHouseFeedback {
+			return ClickHouseFeedback{
+				Feedback: f,
+				Version:  lo.If(overwrite, f.Timestamp).Else(time.Time{}),
+			}
+		})).Error
 		return errors.Trace(err)
+	} else if d.driver == Oracle && overwrite {
+		return d.mergeFeedback(rows)
 	} else {
-		rows := make([]Feedback, 0, len(feedback))
-		memo := make(map[lo.Tuple3[string, string, string]]struct{})
-		for _, f := range feedback {
-			if users.Has(f.UserId) && items.Has(f.ItemId) {
-				if _, exist := memo[lo.Tuple3[string, string, string]{f.FeedbackType, f.UserId, f.ItemId}]; !exist {
-					memo[lo.Tuple3[string, string, string]{f.FeedbackType, f.UserId, f.ItemId}] = struct{}{}
-					if d.driver == SQLite || d.driver == Oracle {
-						f.Timestamp = f.Timestamp.In(time.UTC)
-					}
-					rows = append(rows, f)
+		onConflict := clause.OnConflict{
+			Columns:   []clause.Column{{Name: "feedback_type"}, {Name: "user_id"}, {Name: "item_id"}},
+			DoNothing: !overwrite,
+		}
+		if overwrite {
+			switch d.driver {
+			case MySQL:
+				// assignments are evaluated in order, so that the comment is updated by the stored timestamp
+				onConflict.DoUpdates = clause.Set{
+					{Column: clause.Column{Name: "comment"}, Value: gorm.Expr("IF(VALUES(time_stamp) >= time_stamp, VALUES(comment), comment)")},
+					{Column: clause.Column{Name: "context"}, Value: gorm.Expr("IF(VALUES(time_stamp) >= time_stamp, VALUES(context), context)")},
+					{Column: clause.Column{Name: "time_stamp"}, Value: gorm.Expr("GREATEST(time_stamp, VALUES(time_stamp))")},
 				}
+			case Postgres, SQLite:
+				onConflict.DoUpdates = clause.AssignmentColumns([]string{"time_stamp", "comment", "context"})
+				onConflict.Where = clause.Where{Exprs: []clause.Expression{
+					gorm.Expr(fmt.Sprintf("%s.time_stamp <= excluded.time_stamp", d.FeedbackTable())),
+				}}
+			default:
+				onConflict.DoUpdates = clause.AssignmentColumns([]string{"time_stamp", "comment", "context"})
 			}
 		}
-		if len(rows) == 0 {
-			return nil
-		}
-		err := d.gormDB.Clauses(clause.OnConflict{
-			Columns:   []clause.Column{{Name: "feedback_type"}, {Name: "user_id"}, {Name: "item_id"}},
-			DoNothing: !overwrite,
-			DoUpdates: lo.If(overwrite, clause.AssignmentColumns([]string{"time_stamp", "comment"})).Else(nil),
-		}).Create(rows).Error
+		err := d.gormDB.Clauses(onConflict).Create(rows).Error
 		return errors.Trace(err)
 	}
 }
 
+// decodeFeedbackContext decodes the context of feedback. Feedback inserted before context was introduced has no context.
+func decodeFeedbackContext(feedbackContext sql.NullString) (map[string]string, error) {
+	if !feedbackContext.Valid || feedbackContext.String == "" {
+		return nil, nil
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(feedbackContext.String), &decoded); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(decoded) == 0 {
+		return nil, nil
+	}
+	return decoded, nil
+}
+
+// uniqueFeedback returns feedback of existing users and items without duplicates. The newest feedback of a key is kept
+// if overwrite is true, otherwise the first one is kept.
+func uniqueFeedback(feedback []Feedback, users, items *strset.Set, overwrite bool) []Feedback {
+	rows := make([]Feedback, 0, len(feedback))
+	memo := make(map[FeedbackKey]int)
+	for _, f := range feedback {
+		if users.Has(f.UserId) && items.Has(f.ItemId) {
+			if i, exist := memo[f.FeedbackKey]; !exist {
+				memo[f.FeedbackKey] = len(rows)
+				rows = append(rows, f)
+			} else if overwrite && !f.Timestamp.Before(rows[i].Timestamp) {
+				rows[i] = f
+			}
+		}
+	}
+	return rows
+}
+
+// mergeFeedback upserts feedback into Oracle by MERGE. Stored feedback is updated only if it isn't newer, which is
+// checked by the statement atomically, so that concurrent inserts never overwrite newer feedback.
+func (d *SQLDatabase) mergeFeedback(rows []Feedback) error {
+	// Oracle limits the number of bind variables in a statement
+	for _, chunk := range lo.Chunk(rows, 1000) {
+		var source strings.Builder
+		values := make([]interface{}, 0, 6*len(chunk))
+		for i, f := range chunk {
+			feedbackContext, err := json.Marshal(f.Context)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if i > 0 {
+				source.WriteString(" UNION ALL ")
+			}
+			source.WriteString(`SELECT ? AS feedback_type, ? AS user_id, ? AS item_id, ? AS time_stamp, ? AS "COMMENT", ? AS context FROM DUAL`)
+			values = append(values, f.FeedbackType, f.UserId, f.ItemId, f.Timestamp, f.Comment, string(feedbackContext))
+		}
+		query := fmt.Sprintf(`MERGE INTO %s t USING (%s) s
+ON (t.feedback_type = s.feedback_type AND t.user_id = s.user_id AND t.item_id = s.item_id)
+WHEN MATCHED THEN UPDATE SET t.time_stamp = s.time_stamp, t."COMMENT" = s."COMMENT", t.context = s.context
+	WHERE t.time_stamp <= s.time_stamp
+WHEN NOT MATCHED THEN INSERT (feedback_type, user_id, item_id, time_stamp, "COMMENT", context)
+	VALUES (s.feedback_type, s.user_id, s.item_id, s.time_stamp, s."COMMENT", s.context)`, d.FeedbackTable(), source.String())
+		if err := d.gormDB.Exec(query, values...).Error; err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
 // GetFeedback returns feedback from MySQL.
 func (d *SQLDatabase) GetFeedback(cursor string, n int, timeLimit *time.Time, feedbackTypes ...string) (string, []Feedback, error) {
-	tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment")
+	tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment, context")
 	if cursor != "" {
 		var cursorKey FeedbackKey
 		if err := json.Unmarshal([]byte(cursor), &cursorKey); err != nil {
@@ -946,7 +1784,7 @@ func (d *SQLDatabase) GetFeedback(cursor string, n int, timeLimit *time.Time, fe
 	}
 	switch d.driver {
 	case SQLite:
-		tx.Where("time_stamp <= DATETIME()")
+		tx.Where("time_stamp <= ?", time.Now().In(time.UTC))
 	case Oracle:
 		tx.Where("time_stamp <= SYS_EXTRACT_UTC(SYSTIMESTAMP)")
 	default:
@@ -967,11 +1805,14 @@ func (d *SQLDatabase) GetFeedback(cursor string, n int, timeLimit *time.Time, fe
 	defer result.Close()
 	for result.Next() {
 		var feedback Feedback
-		var comment sql.NullString
-		if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment); err != nil {
+		var comment, feedbackContext sql.NullString
+		if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment, &feedbackContext); err != nil {
 			return "", nil, errors.Trace(err)
 		}
 		feedback.Comment = comment.String
+		if feedback.Context, err = decodeFeedbackContext(feedbackContext); err != nil {
+			return "", nil, errors.Trace(err)
+		}
 		feedbacks = append(feedbacks, feedback)
 	}
 	if len(feedbacks) == n+1 {
@@ -993,10 +1834,10 @@ func (d *SQLDatabase) GetFeedbackStream(batchSize int, timeLimit *time.Time, fee
 		defer close(feedbackChan)
 		defer close(errChan)
 		// send query
-		tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment")
+		tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment, context")
 		switch d.driver {
 		case SQLite:
-			tx.Where("time_stamp <= DATETIME()")
+			tx.Where("time_stamp <= ?", time.Now().In(time.UTC))
 		case Oracle:
 			tx.Where("time_stamp <= SYS_EXTRACT_UTC(SYSTIMESTAMP)")
 		default:
@@ -1018,12 +1859,61 @@ func (d *SQLDatabase) GetFeedbackStream(batchSize int, timeLimit *time.Time, fee
 		defer result.Close()
 		for result.Next() {
 			var feedback Feedback
-			var comment sql.NullString
-			if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment); err != nil {
+			var comment, feedbackContext sql.NullString
+			if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment, &feedbackContext); err != nil {
 				errChan <- errors.Trace(err)
 				return
 			}
 			feedback.Comment = comment.String
+			if feedback.Context, err = decodeFeedbackContext(feedbackContext); err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
+			feedbacks = append(feedbacks, feedback)
+			if len(feedbacks) == batchSize {
+				feedbackChan <- feedbacks
+				feedbacks = make([]Feedback, 0, batchSize)
+			}
+		}
+		if len(feedbacks) > 0 {
+			feedbackChan <- feedbacks
+		}
+		errChan <- nil
+	}()
+	return feedbackChan, errChan
+}
+
+// GetUserFeedbackStream reads feedback of a user from MySQL by stream.
+func (d *SQLDatabase) GetUserFeedbackStream(userId string, batchSize int) (chan []Feedback, chan error) {
+	feedbackChan := make(chan []Feedback, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(feedbackChan)
+		defer close(errChan)
+		// send query
+		result, err := d.gormDB.Table(d.FeedbackTable()).
+			Select("feedback_type, user_id, item_id, time_stamp, comment, context").
+			Where("user_id = ?", userId).
+			Rows()
+		if err != nil {
+			errChan <- errors.Trace(err)
+			return
+		}
+		// fetch result
+		feedbacks := make([]Feedback, 0, batchSize)
+		defer result.Close()
+		for result.Next() {
+			var feedback Feedback
+			var comment, feedbackContext sql.NullString
+			if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment, &feedbackContext); err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
+			feedback.Comment = comment.String
+			if feedback.Context, err = decodeFeedbackContext(feedbackContext); err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
 			feedbacks = append(feedbacks, feedback)
 			if len(feedbacks) == batchSize {
 				feedbackChan <- feedbacks
@@ -1040,7 +1930,7 @@ func (d *SQLDatabase) GetFeedbackStream(batchSize int, timeLimit *time.Time, fee
 
 // GetUserItemFeedback gets a feedback by user id and item id from MySQL.
 func (d *SQLDatabase) GetUserItemFeedback(userId, itemId string, feedbackTypes ...string) ([]Feedback, error) {
-	tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment").Where("user_id = ? AND item_id = ?", userId, itemId)
+	tx := d.gormDB.Table(d.FeedbackTable()).Select("feedback_type, user_id, item_id, time_stamp, comment, context").Where("user_id = ? AND item_id = ?", userId, itemId)
 	if len(feedbackTypes) > 0 {
 		tx.Where("feedback_type IN ?", feedbackTypes)
 	}
@@ -1052,11 +1942,14 @@ func (d *SQLDatabase) GetUserItemFeedback(userId, itemId string, feedbackTypes .
 	defer result.Close()
 	for result.Next() {
 		var feedback Feedback
-		var comment sql.NullString
-		if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment); err != nil {
+		var comment, feedbackContext sql.NullString
+		if err = result.Scan(&feedback.FeedbackType, &feedback.UserId, &feedback.ItemId, &feedback.Timestamp, &comment, &feedbackContext); err != nil {
 			return nil, errors.Trace(err)
 		}
 		feedback.Comment = comment.String
+		if feedback.Context, err = decodeFeedbackContext(feedbackContext); err != nil {
+			return nil, errors.Trace(err)
+		}
 		feedbacks = append(feedbacks, feedback)
 	}
 	return feedbacks, nil
@@ -1077,3 +1970,407 @@ func (d *SQLDatabase) DeleteUserItemFeedback(userId, itemId string, feedbackType
 	}
 	return int(tx.RowsAffected), nil
 }
+
+// DeleteUserFeedbackInRange deletes feedback of a user timestamped in a range from MySQL. Feedback deleted from
+// ClickHouse is counted before deletion since the number of deleted rows isn't returned.
+func (d *SQLDatabase) DeleteUserFeedbackInRange(userId string, begin, end *time.Time, feedbackTypes ...string) (int, error) {
+	where := func(tx *gorm.DB) *gorm.DB {
+		tx = tx.Where("user_id = ?", userId)
+		if begin != nil {
+			tx = tx.Where("time_stamp >= ?", *begin)
+		}
+		if end != nil {
+			tx = tx.Where("time_stamp < ?", *end)
+		}
+		if len(feedbackTypes) > 0 {
+			tx = tx.Where("feedback_type IN ?", feedbackTypes)
+		}
+		return tx
+	}
+	if d.driver == ClickHouse {
+		var count int64
+		if err := d.gormDB.Table(d.FeedbackTable()).Scopes(where).Count(&count).Error; err != nil {
+			return 0, errors.Trace(err)
+		}
+		if err := d.gormDB.Scopes(where).Delete(&Feedback{}).Error; err != nil {
+			return 0, errors.Trace(err)
+		}
+		return int(count), nil
+	}
+	tx := d.gormDB.Scopes(where).Delete(&Feedback{})
+	if tx.Error != nil {
+		return 0, errors.Trace(tx.Error)
+	}
+	return int(tx.RowsAffected), nil
+}
+
+// SetUserOverrides inserts or replaces overrides of a user in MySQL.
+func (d *SQLDatabase) SetUserOverrides(overrides UserOverrides) error {
+	if d.driver == ClickHouse {
+		row := ClickHouseOverrides{SQLOverrides: NewSQLOverrides(overrides), Version: time.Now().In(time.UTC)}
+		err := d.gormDB.Table(d.UserOverridesTable()).Create(&row).Error
+		return errors.Trace(err)
+	}
+	row := NewSQLOverrides(overrides)
+	err := d.gormDB.Table(d.UserOverridesTable()).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"pinned", "blocked"}),
+	}).Create(&row).Error
+	return errors.Trace(err)
+}
+
+// GetUserOverrides returns overrides of a user from MySQL.
+func (d *SQLDatabase) GetUserOverrides(userId string) (UserOverrides, error) {
+	tx := d.gormDB.Table(d.UserOverridesTable()).Select("user_id, pinned, blocked").Where("user_id = ?", userId)
+	if d.driver == ClickHouse {
+		tx = tx.Order("version DESC").Limit(1)
+	}
+	result, err := tx.Rows()
+	if err != nil {
+		return UserOverrides{}, errors.Trace(err)
+	}
+	defer result.Close()
+	if result.Next() {
+		return scanUserOverrides(result)
+	}
+	return UserOverrides{}, errors.Annotate(ErrOverridesNotExist, userId)
+}
+
+// DeleteUserOverrides deletes overrides of a user from MySQL.
+func (d *SQLDatabase) DeleteUserOverrides(userId string) error {
+	err := d.gormDB.Table(d.UserOverridesTable()).Where("user_id = ?", userId).Delete(&SQLOverrides{}).Error
+	return errors.Trace(err)
+}
+
+// GetUserOverridesStream reads overrides of all users from MySQL by stream.
+func (d *SQLDatabase) GetUserOverridesStream(batchSize int) (chan []UserOverrides, chan error) {
+	overridesChan := make(chan []UserOverrides, bufSize)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(overridesChan)
+		defer close(errChan)
+		// send query
+		result, err := d.gormDB.Table(d.UserOverridesTable()).Select("user_id, pinned, blocked").Rows()
+		if err != nil {
+			errChan <- errors.Trace(err)
+			return
+		}
+		// fetch result
+		batch := make([]UserOverrides, 0, batchSize)
+		defer result.Close()
+		for result.Next() {
+			overrides, err := scanUserOverrides(result)
+			if err != nil {
+				errChan <- errors.Trace(err)
+				return
+			}
+			batch = append(batch, overrides)
+			if len(batch) == batchSize {
+				overridesChan <- batch
+				batch = make([]UserOverrides, 0, batchSize)
+			}
+		}
+		if len(batch) > 0 {
+			overridesChan <- batch
+		}
+		errChan <- nil
+	}()
+	return overridesChan, errChan
+}
+
+func scanUserOverrides(result *sql.Rows) (UserOverrides, error) {
+	var overrides UserOverrides
+	var pinned, blocked string
+	if err := result.Scan(&overrides.UserId, &pinned, &blocked); err != nil {
+		return UserOverrides{}, errors.Trace(err)
+	}
+	if err := json.Unmarshal([]byte(pinned), &overrides.Pinned); err != nil {
+		return UserOverrides{}, errors.Trace(err)
+	}
+	if err := json.Unmarshal([]byte(blocked), &overrides.Blocked); err != nil {
+		return UserOverrides{}, errors.Trace(err)
+	}
+	return overrides, nil
+}
+
+// BatchInsertItemCanonicals inserts or replaces canonical items of near-duplicate items in MySQL.
+func (d *SQLDatabase) BatchInsertItemCanonicals(canonicals []ItemCanonical) error {
+	if len(canonicals) == 0 {
+		return nil
+	}
+	if d.driver == ClickHouse {
+		version := time.Now().In(time.UTC)
+		rows := lo.Map(canonicals, func(canonical ItemCanonical, _ int) ClickHouseItemCanonical {
+			return ClickHouseItemCanonical{ItemCanonical: canonical, Version: version}
+		})
+		err := d.gormDB.Table(d.ItemCanonicalsTable()).Create(rows).Error
+		return errors.Trace(err)
+	}
+	rows := lo.UniqBy(canonicals, func(canonical ItemCanonical) string {
+		return canonical.ItemId
+	})
+	err := d.gormDB.Table(d.ItemCanonicalsTable()).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "item_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"canonical_id"}),
+	}).Create(rows).Error
+	return errors.Trace(err)
+}
+
+// GetItemCanonicals returns canonical items of all near-duplicate items from MySQL.
+func (d *SQLDatabase) GetItemCanonicals() ([]ItemCanonical, error) {
+	tx := d.gormDB.Table(d.ItemCanonicalsTable()).Select("item_id, canonical_id")
+	if d.driver == ClickHouse {
+		tx = tx.Order("version")
+	}
+	result, err := tx.Rows()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer result.Close()
+	// rows of ClickHouse might not be merged, the latest version wins.
+	canonicals := make(map[string]string)
+	for result.Next() {
+		var canonical ItemCanonical
+		if err = result.Scan(&canonical.ItemId, &canonical.CanonicalId); err != nil {
+			return nil, errors.Trace(err)
+		}
+		canonicals[canonical.ItemId] = canonical.CanonicalId
+	}
+	return sortItemCanonicals(canonicals), nil
+}
+
+// DeleteItemCanonicals deletes canonical items of near-duplicate items from MySQL.
+func (d *SQLDatabase) DeleteItemCanonicals(itemIds []string) error {
+	if len(itemIds) == 0 {
+		return nil
+	}
+	err := d.gormDB.Table(d.ItemCanonicalsTable()).Where("item_id IN ?", itemIds).Delete(&ItemCanonical{}).Error
+	return errors.Trace(err)
+}
+
+// InsertAuditLogs inserts audit logs into MySQL.
+func (d *SQLDatabase) InsertAuditLogs(auditLogs []AuditLog) error {
+	if len(auditLogs) == 0 {
+		return nil
+	}
+	rows := lo.Map(auditLogs, func(auditLog AuditLog, _ int) SQLAuditLog {
+		return NewSQLAuditLog(auditLog)
+	})
+	err := d.gormDB.Table(d.AuditLogsTable()).Create(rows).Error
+	return errors.Trace(err)
+}
+
+// GetAuditLogs returns audit logs from MySQL.
+func (d *SQLDatabase) GetAuditLogs(cursor string, n int, entity, actor string) (string, []AuditLog, error) {
+	tx := d.gormDB.Table(d.AuditLogsTable()).Select("id, time_stamp, actor, endpoint, entities, summary")
+	if cursor != "" {
+		tx = tx.Where("id <= ?", cursor)
+	}
+	if actor != "" {
+		tx = tx.Where("actor = ?", actor)
+	}
+	if entity != "" {
+		tx = tx.Where(d.containsElement("entities"), entity)
+	}
+	result, err := tx.Order("id DESC").Limit(n + 1).Rows()
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	defer result.Close()
+	auditLogs := make([]AuditLog, 0)
+	for result.Next() {
+		var auditLog AuditLog
+		var entities string
+		var actor, endpoint, summary sql.NullString
+		if err = result.Scan(&auditLog.Id, &auditLog.Timestamp, &actor, &endpoint, &entities, &summary); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		if err = json.Unmarshal([]byte(entities), &auditLog.Entities); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		auditLog.Actor, auditLog.Endpoint, auditLog.Summary = actor.String, endpoint.String, summary.String
+		auditLogs = append(auditLogs, auditLog)
+	}
+	if len(auditLogs) == n+1 {
+		return auditLogs[n].Id, auditLogs[:n], nil
+	}
+	return "", auditLogs, nil
+}
+
+// DeleteAuditLogs deletes audit logs written before a time from MySQL.
+func (d *SQLDatabase) DeleteAuditLogs(before time.Time) error {
+	err := d.gormDB.Table(d.AuditLogsTable()).Where("id < ?", auditLogIdPrefix(before)).Delete(&SQLAuditLog{}).Error
+	return errors.Trace(err)
+}
+
+// BatchInsertUsage inserts or replaces figures of usage in MySQL.
+func (d *SQLDatabase) BatchInsertUsage(usage []Usage) error {
+	if len(usage) == 0 {
+		return nil
+	}
+	if d.driver == ClickHouse {
+		version := time.Now().In(time.UTC)
+		rows := lo.Map(usage, func(u Usage, _ int) ClickHouseUsage {
+			return ClickHouseUsage{Usage: u, Version: version}
+		})
+		err := d.gormDB.Table(d.DailyUsageTable()).Create(rows).Error
+		return errors.Trace(err)
+	}
+	rows := lo.UniqBy(usage, func(u Usage) string {
+		return u.Day + "/" + u.Metric
+	})
+	err := d.gormDB.Table(d.DailyUsageTable()).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "day"}, {Name: "metric"}},
+		DoUpdates: clause.AssignmentColumns([]string{"amount"}),
+	}).Create(rows).Error
+	return errors.Trace(err)
+}
+
+// GetUsage returns figures of usage from one day to another day from MySQL.
+func (d *SQLDatabase) GetUsage(from, to string) ([]Usage, error) {
+	tx := d.gormDB.Table(d.DailyUsageTable()).Select("day, metric, amount").
+		Where("day >= ? AND day <= ?", from, to)
+	if d.driver == ClickHouse {
+		tx = tx.Order("version")
+	}
+	result, err := tx.Rows()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer result.Close()
+	// rows of ClickHouse might not be merged, the latest version wins.
+	figures := make(map[[2]string]int64)
+	for result.Next() {
+		var u Usage
+		if err = result.Scan(&u.Day, &u.Metric, &u.Value); err != nil {
+			return nil, errors.Trace(err)
+		}
+		figures[[2]string{u.Day, u.Metric}] = u.Value
+	}
+	usage := make([]Usage, 0, len(figures))
+	for key, value := range figures {
+		usage = append(usage, Usage{Day: key[0], Metric: key[1], Value: value})
+	}
+	SortUsage(usage)
+	return usage, nil
+}
+
+// BatchInsertRecommendSnapshots inserts or replaces snapshots of recommendation in MySQL.
+func (d *SQLDatabase) BatchInsertRecommendSnapshots(snapshots []RecommendSnapshot) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	if d.driver == ClickHouse {
+		version := time.Now().In(time.UTC)
+		rows := lo.Map(snapshots, func(snapshot RecommendSnapshot, _ int) ClickHouseRecommendSnapshot {
+			return ClickHouseRecommendSnapshot{SQLRecommendSnapshot: NewSQLRecommendSnapshot(snapshot), Version: version}
+		})
+		err := d.gormDB.Table(d.RecommendSnapshotsTable()).Create(rows).Error
+		return errors.Trace(err)
+	}
+	// the latest snapshot in a bucket wins
+	rows := make([]SQLRecommendSnapshot, 0, len(snapshots))
+	positions := make(map[string]int)
+	for _, snapshot := range snapshots {
+		row := NewSQLRecommendSnapshot(snapshot)
+		key := fmt.Sprintf("%s/%d", row.UserId, row.Timestamp.UnixNano())
+		if i, exist := positions[key]; exist {
+			rows[i] = row
+		} else {
+			positions[key] = len(rows)
+			rows = append(rows, row)
+		}
+	}
+	err := d.gormDB.Table(d.RecommendSnapshotsTable()).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "time_stamp"}},
+		DoUpdates: clause.AssignmentColumns([]string{"category", "items", "tags"}),
+	}).Create(rows).Error
+	return errors.Trace(err)
+}
+
+// GetRecommendSnapshots returns snapshots of recommendation of a user from MySQL.
+func (d *SQLDatabase) GetRecommendSnapshots(userId string) ([]RecommendSnapshot, error) {
+	tx := d.gormDB.Table(d.RecommendSnapshotsTable()).Select("user_id, category, time_stamp, items, tags").
+		Where("user_id = ?", userId)
+	if d.driver == ClickHouse {
+		tx = tx.Order("version")
+	}
+	result, err := tx.Rows()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer result.Close()
+	// rows of ClickHouse might not be merged, the latest version wins.
+	buckets := make(map[int64]RecommendSnapshot)
+	for result.Next() {
+		var snapshot RecommendSnapshot
+		var items, tags string
+		var category sql.NullString
+		if err = result.Scan(&snapshot.UserId, &category, &snapshot.Timestamp, &items, &tags); err != nil {
+			return nil, errors.Trace(err)
+		}
+		snapshot.Category = category.String
+		if err = json.Unmarshal([]byte(items), &snapshot.Items); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = json.Unmarshal([]byte(tags), &snapshot.Tags); err != nil {
+			return nil, errors.Trace(err)
+		}
+		buckets[snapshot.Timestamp.UnixNano()] = snapshot
+	}
+	snapshots := lo.Values(buckets)
+	SortRecommendSnapshots(snapshots)
+	return snapshots, nil
+}
+
+// DeleteRecommendSnapshots deletes snapshots of recommendation in time buckets beginning before a time from MySQL.
+func (d *SQLDatabase) DeleteRecommendSnapshots(before time.Time) error {
+	err := d.gormDB.Table(d.RecommendSnapshotsTable()).Where("time_stamp < ?", before.In(time.UTC)).
+		Delete(&SQLRecommendSnapshot{}).Error
+	return errors.Trace(err)
+}
+
+// GetTableSizes returns bytes of tables from statistics of MySQL, Postgres and ClickHouse.
+func (d *SQLDatabase) GetTableSizes() (map[string]int64, error) {
+	tables := tableNames(d.TablePrefix)
+	names := make(map[string]string, len(tables))
+	for name, table := range tables {
+		names[table] = name
+	}
+	sizes := make(map[string]int64, len(tables))
+	switch d.driver {
+	case MySQL, ClickHouse:
+		query := "SELECT table_name, data_length + index_length FROM information_schema.tables " +
+			"WHERE table_schema = DATABASE() AND table_name IN ?"
+		if d.driver == ClickHouse {
+			query = "SELECT table, toInt64(sum(bytes_on_disk)) FROM system.parts " +
+				"WHERE database = currentDatabase() AND active AND table IN ? GROUP BY table"
+		}
+		result, err := d.gormDB.Raw(query, lo.Values(tables)).Rows()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer result.Close()
+		for result.Next() {
+			var table string
+			var size sql.NullInt64
+			if err = result.Scan(&table, &size); err != nil {
+				return nil, errors.Trace(err)
+			}
+			sizes[names[table]] = size.Int64
+		}
+	case Postgres:
+		for name, table := range tables {
+			var size sql.NullInt64
+			if err := d.gormDB.Raw("SELECT pg_total_relation_size(to_regclass(?))", table).Row().Scan(&size); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if size.Valid {
+				sizes[name] = size.Int64
+			}
+		}
+	default:
+		return nil, errors.NotSupportedf("sizes of tables in SQLite and Oracle")
+	}
+	return sizes, nil
+}
@@ -51,12 +51,12 @@ type testSQLDatabase struct {
 	Database
 }
 
-func (db *testSQLDatabase) Close(t *testing.T) {
+func (db *testSQLDatabase) Close(t testing.TB) {
 	err := db.Database.Close()
 	assert.NoError(t, err)
 }
 
-func newTestMySQLDatabase(t *testing.T) *testSQLDatabase {
+func newTestMySQLDatabase(t testing.TB) *testSQLDatabase {
 	// retrieve test name
 	var testName string
 	pc, _, _, ok := runtime.Caller(1)
@@ -119,6 +119,103 @@ func TestMySQL_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestMySQL_Categories(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestMySQL_Labels(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestMySQL_PatchArrays(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+	testConcurrentPatchArrays(t, db.Database)
+}
+
+func TestMySQL_ModifyConflict(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestMySQL_BatchGetItems(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func BenchmarkMySQL_BatchGetItems(b *testing.B) {
+	db := newTestMySQLDatabase(b)
+	defer db.Close(b)
+	benchmarkBatchGetItems(b, db.Database)
+}
+
+func TestMySQL_Sample(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testSample(t, db.Database, true)
+}
+
+func TestMySQL_UserOverrides(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestMySQL_ItemCanonicals(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestMySQL_AuditLogs(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestMySQL_Usage(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestMySQL_RecommendSnapshots(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestMySQL_FutureFeedback(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestMySQL_FeedbackOutOfOrder(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestMySQL_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestMySQL_Count(t *testing.T) {
+	db := newTestMySQLDatabase(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestMySQL_DeleteFeedback(t *testing.T) {
 	db := newTestMySQLDatabase(t)
 	defer db.Close(t)
@@ -218,6 +315,97 @@ func TestPostgres_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestPostgres_Categories(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestPostgres_Labels(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestPostgres_PatchArrays(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+	testConcurrentPatchArrays(t, db.Database)
+}
+
+func TestPostgres_ModifyConflict(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestPostgres_BatchGetItems(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func TestPostgres_Sample(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testSample(t, db.Database, true)
+}
+
+func TestPostgres_UserOverrides(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestPostgres_ItemCanonicals(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestPostgres_AuditLogs(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestPostgres_Usage(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestPostgres_RecommendSnapshots(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestPostgres_FutureFeedback(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestPostgres_FeedbackOutOfOrder(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestPostgres_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestPostgres_Count(t *testing.T) {
+	db := newTestPostgresDatabase(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestPostgres_DeleteFeedback(t *testing.T) {
 	db := newTestPostgresDatabase(t)
 	defer db.Close(t)
@@ -311,6 +499,96 @@ func TestClickHouse_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestClickHouse_Categories(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestClickHouse_Labels(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestClickHouse_PatchArrays(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+}
+
+func TestClickHouse_ModifyConflict(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestClickHouse_BatchGetItems(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func TestClickHouse_Sample(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testSample(t, db.Database, true)
+}
+
+func TestClickHouse_UserOverrides(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestClickHouse_ItemCanonicals(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestClickHouse_AuditLogs(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestClickHouse_Usage(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestClickHouse_RecommendSnapshots(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestClickHouse_FutureFeedback(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestClickHouse_FeedbackOutOfOrder(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestClickHouse_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestClickHouse_Count(t *testing.T) {
+	db := newTestClickHouseDatabase(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestClickHouse_DeleteFeedback(t *testing.T) {
 	db := newTestClickHouseDatabase(t)
 	defer db.Close(t)
@@ -415,6 +693,97 @@ func TestOracle_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestOracle_Categories(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestOracle_Labels(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestOracle_PatchArrays(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+	testConcurrentPatchArrays(t, db.Database)
+}
+
+func TestOracle_ModifyConflict(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestOracle_BatchGetItems(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func TestOracle_Sample(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testSample(t, db.Database, true)
+}
+
+func TestOracle_UserOverrides(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestOracle_ItemCanonicals(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestOracle_AuditLogs(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestOracle_Usage(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestOracle_RecommendSnapshots(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestOracle_FutureFeedback(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestOracle_FeedbackOutOfOrder(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestOracle_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestOracle_Count(t *testing.T) {
+	db := newTestOracleDatabase(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestOracle_DeleteFeedback(t *testing.T) {
 	db := newTestOracleDatabase(t)
 	defer db.Close(t)
@@ -487,6 +856,97 @@ func TestSQLite_DeleteItem(t *testing.T) {
 	testDeleteItem(t, db.Database)
 }
 
+func TestSQLite_Categories(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testCategories(t, db.Database)
+}
+
+func TestSQLite_Labels(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testLabels(t, db.Database)
+}
+
+func TestSQLite_PatchArrays(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testPatchArrays(t, db.Database)
+	testConcurrentPatchArrays(t, db.Database)
+}
+
+func TestSQLite_ModifyConflict(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testModifyConflict(t, db.Database)
+}
+
+func TestSQLite_BatchGetItems(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testBatchGetItems(t, db.Database)
+}
+
+func TestSQLite_Sample(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testSample(t, db.Database, true)
+}
+
+func TestSQLite_UserOverrides(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testUserOverrides(t, db.Database)
+}
+
+func TestSQLite_ItemCanonicals(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testItemCanonicals(t, db.Database)
+}
+
+func TestSQLite_AuditLogs(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testAuditLogs(t, db.Database)
+}
+
+func TestSQLite_Usage(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testUsage(t, db.Database)
+}
+
+func TestSQLite_RecommendSnapshots(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testRecommendSnapshots(t, db.Database)
+}
+
+func TestSQLite_FutureFeedback(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testFutureFeedback(t, db.Database)
+}
+
+func TestSQLite_FeedbackOutOfOrder(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestSQLite_ConcurrentFeedbackOutOfOrder(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testConcurrentFeedbackOutOfOrder(t, db.Database)
+}
+
+func TestSQLite_Count(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	defer db.Close(t)
+	testCount(t, db.Database)
+}
+
 func TestSQLite_DeleteFeedback(t *testing.T) {
 	db := newTestSQLiteDatabase(t)
 	defer db.Close(t)
@@ -0,0 +1,400 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage"
+	"go.uber.org/zap"
+)
+
+// Keys of the hot tier of feedback.
+const (
+	hotFeedbackGeneration = "hot_feedback_generation" // generation of the hot tier, increased to invalidate all users
+	hotFeedbackWarm       = "hot_feedback_warm/"      // prefix for generations at which users are loaded
+	hotFeedbackVersion    = "hot_feedback_version/"   // prefix for versions of users, increased on every write
+	hotFeedback           = "hot_feedback/"           // prefix for hashes from feedback types and items to feedback
+	hotFeedbackTime       = "hot_feedback_time/"      // prefix for sorted sets of feedback by timestamps
+)
+
+// loadHotFeedbackScript replaces feedback of a user in the hot tier and marks the user loaded, unless the generation or
+// the version of the user changed since feedback was read from the cold tier.
+//
+//	KEYS: generation, warm, version, feedback, time
+//	ARGV: generation, version, ttl, [field, feedback, score]...
+var loadHotFeedbackScript = redis.NewScript(`
+if (redis.call('GET', KEYS[1]) or '0') ~= ARGV[1] or (redis.call('GET', KEYS[3]) or '0') ~= ARGV[2] then
+	return 0
+end
+redis.call('DEL', KEYS[4], KEYS[5])
+for i = 4, #ARGV, 3 do
+	redis.call('HSET', KEYS[4], ARGV[i], ARGV[i + 1])
+	redis.call('ZADD', KEYS[5], ARGV[i + 2], ARGV[i])
+end
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[3])
+redis.call('PEXPIRE', KEYS[4], ARGV[3])
+redis.call('PEXPIRE', KEYS[5], ARGV[3])
+return 1
+`)
+
+// insertHotFeedbackScript increases the version of a user and writes feedback to the hot tier if the user is loaded.
+// Feedback out of the window is removed. Stored feedback is replaced by the same rule as BatchInsertFeedback.
+//
+//	KEYS: generation, warm, version, feedback, time
+//	ARGV: ttl, lower bound of scores, overwrite, [field, feedback, score]...
+var insertHotFeedbackScript = redis.NewScript(`
+redis.call('INCR', KEYS[3])
+redis.call('PEXPIRE', KEYS[3], ARGV[1])
+local warm = redis.call('GET', KEYS[2])
+if not warm or warm ~= (redis.call('GET', KEYS[1]) or '0') then
+	return 0
+end
+local expired = redis.call('ZRANGEBYSCORE', KEYS[5], '-inf', '(' .. ARGV[2])
+for _, field in ipairs(expired) do
+	redis.call('HDEL', KEYS[4], field)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[5], '-inf', '(' .. ARGV[2])
+for i = 4, #ARGV, 3 do
+	local score = tonumber(ARGV[i + 2])
+	local stored = redis.call('ZSCORE', KEYS[5], ARGV[i])
+	if score >= tonumber(ARGV[2]) and (not stored or (ARGV[3] == '1' and score >= tonumber(stored))) then
+		redis.call('HSET', KEYS[4], ARGV[i], ARGV[i + 1])
+		redis.call('ZADD', KEYS[5], score, ARGV[i])
+	end
+end
+redis.call('PEXPIRE', KEYS[4], ARGV[1])
+redis.call('PEXPIRE', KEYS[5], ARGV[1])
+return 1
+`)
+
+// TieredDatabase serves feedback of users in the recent window from a hot tier in Redis in front of the data store,
+// which is the cold tier. Feedback of a user is loaded into the hot tier from the cold tier on the first read, and reads
+// fall through to the cold tier if the user isn't loaded or the hot tier fails. Loaded users expire after the window,
+// so that feedback is reloaded from the cold tier periodically.
+//
+// Only GetUserFeedback and GetUserItemFeedback are served by the hot tier, and they return feedback in the window only,
+// no matter which tier serves them. Scans and streams always read the cold tier. Feedback is written to the cold tier
+// first and then to the hot tier. If feedback isn't written to the hot tier, users are invalidated in the hot tier
+// instead. If neither succeeds, the error is returned so that feedback would be retried.
+type TieredDatabase struct {
+	Database
+	requestContext
+	hot    *redis.Client
+	window time.Duration
+}
+
+// NewTieredDatabase creates a TieredDatabase on the cold tier with the hot tier in Redis.
+func NewTieredDatabase(cold Database, hotStore string, window time.Duration) (*TieredDatabase, error) {
+	if !strings.HasPrefix(hotStore, storage.RedisPrefix) && !strings.HasPrefix(hotStore, storage.RedissPrefix) {
+		return nil, errors.NotSupportedf("hot feedback store %s", log.RedactDBURL(hotStore))
+	}
+	opt, err := redis.ParseURL(hotStore)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &TieredDatabase{Database: cold, hot: redis.NewClient(opt), window: window}, nil
+}
+
+func (t *TieredDatabase) WithContext(ctx context.Context) Database {
+	database := *t
+	database.Database = WithContext(ctx, t.Database)
+	database.ctx = ctx
+	return &database
+}
+
+func (t *TieredDatabase) Close() error {
+	if err := t.hot.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return t.Database.Close()
+}
+
+func (t *TieredDatabase) Purge() error {
+	if err := t.Database.Purge(); err != nil {
+		return errors.Trace(err)
+	}
+	return t.invalidateAll()
+}
+
+func (t *TieredDatabase) DeleteItem(itemId string) error {
+	if err := t.Database.DeleteItem(itemId); err != nil {
+		return errors.Trace(err)
+	}
+	return t.invalidateAll()
+}
+
+func (t *TieredDatabase) DeleteUser(userId string) error {
+	if err := t.Database.DeleteUser(userId); err != nil {
+		return errors.Trace(err)
+	}
+	return t.invalidate(userId)
+}
+
+func (t *TieredDatabase) GetUserFeedback(userId string, withFuture bool, feedbackTypes ...string) ([]Feedback, error) {
+	feedback, err := t.getRecentFeedback(userId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return filterFeedback(feedback, "", withFuture, feedbackTypes), nil
+}
+
+func (t *TieredDatabase) GetUserItemFeedback(userId, itemId string, feedbackTypes ...string) ([]Feedback, error) {
+	feedback, err := t.getRecentFeedback(userId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return filterFeedback(feedback, itemId, true, feedbackTypes), nil
+}
+
+func (t *TieredDatabase) DeleteUserItemFeedback(userId, itemId string, feedbackTypes ...string) (int, error) {
+	count, err := t.Database.DeleteUserItemFeedback(userId, itemId, feedbackTypes...)
+	if err != nil {
+		return count, errors.Trace(err)
+	}
+	return count, t.invalidate(userId)
+}
+
+func (t *TieredDatabase) DeleteUserFeedbackInRange(userId string, begin, end *time.Time, feedbackTypes ...string) (int, error) {
+	count, err := t.Database.DeleteUserFeedbackInRange(userId, begin, end, feedbackTypes...)
+	if err != nil {
+		return count, errors.Trace(err)
+	}
+	return count, t.invalidate(userId)
+}
+
+// BatchInsertFeedback writes feedback to the cold tier and then the hot tier. Feedback of users and items which don't
+// exist might be ignored by the cold tier, so users are invalidated in the hot tier instead if insertUser or insertItem
+// is false.
+func (t *TieredDatabase) BatchInsertFeedback(feedback []Feedback, insertUser, insertItem, overwrite bool) error {
+	if err := t.Database.BatchInsertFeedback(feedback, insertUser, insertItem, overwrite); err != nil {
+		return errors.Trace(err)
+	}
+	userFeedback := make(map[string][]Feedback)
+	for _, f := range feedback {
+		userFeedback[f.UserId] = append(userFeedback[f.UserId], f)
+	}
+	for userId, userFeedback := range userFeedback {
+		if !insertUser || !insertItem {
+			if err := t.invalidate(userId); err != nil {
+				return errors.Trace(err)
+			}
+		} else if err := t.insertHotFeedback(userId, userFeedback, overwrite); err != nil {
+			log.Logger().Warn("failed to write feedback to hot tier", zap.String("user_id", userId), zap.Error(err))
+			if err = t.invalidate(userId); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
+
+// getRecentFeedback returns feedback of a user in the window from the hot tier, or the cold tier if the user isn't
+// loaded or the hot tier fails. Feedback read from the cold tier is loaded into the hot tier.
+func (t *TieredDatabase) getRecentFeedback(userId string) ([]Feedback, error) {
+	lowerBound := time.Now().Add(-t.window)
+	feedback, generation, version, err := t.getHotFeedback(userId, lowerBound)
+	if err != nil {
+		log.Logger().Warn("failed to read feedback from hot tier", zap.String("user_id", userId), zap.Error(err))
+	} else if feedback != nil {
+		return feedback, nil
+	}
+	feedback, err = t.Database.GetUserFeedback(userId, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	recent := make([]Feedback, 0, len(feedback))
+	for _, f := range feedback {
+		if !f.Timestamp.Before(lowerBound) {
+			recent = append(recent, f)
+		}
+	}
+	if generation != "" {
+		if err = t.loadHotFeedback(userId, recent, generation, version); err != nil {
+			log.Logger().Warn("failed to load feedback into hot tier", zap.String("user_id", userId), zap.Error(err))
+		}
+	}
+	return recent, nil
+}
+
+// getHotFeedback returns feedback of a user in the window from the hot tier. Feedback is nil if the user isn't loaded,
+// and the generation and the version of the user are returned to load the user.
+func (t *TieredDatabase) getHotFeedback(userId string, lowerBound time.Time) ([]Feedback, string, string, error) {
+	ctx := t.context()
+	var generation, warm, version *redis.StringCmd
+	var fields *redis.StringSliceCmd
+	if _, err := t.hot.Pipelined(ctx, func(pipeliner redis.Pipeliner) error {
+		generation = pipeliner.Get(ctx, hotFeedbackGeneration)
+		warm = pipeliner.Get(ctx, hotFeedbackWarm+userId)
+		version = pipeliner.Get(ctx, hotFeedbackVersion+userId)
+		fields = pipeliner.ZRangeByScore(ctx, hotFeedbackTime+userId, &redis.ZRangeBy{
+			Min: formatHotFeedbackScore(lowerBound),
+			Max: "+inf",
+		})
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, "", "", errors.Trace(err)
+	}
+	for _, cmd := range []redis.Cmder{generation, warm, version, fields} {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return nil, "", "", errors.Trace(err)
+		}
+	}
+	currentGeneration := valueOrZero(generation)
+	if warm.Err() != nil || warm.Val() != currentGeneration {
+		return nil, currentGeneration, valueOrZero(version), nil
+	}
+	feedback := make([]Feedback, 0, len(fields.Val()))
+	if len(fields.Val()) == 0 {
+		return feedback, "", "", nil
+	}
+	values, err := t.hot.HMGet(ctx, hotFeedback+userId, fields.Val()...).Result()
+	if err != nil {
+		return nil, "", "", errors.Trace(err)
+	}
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			var f Feedback
+			if err = json.Unmarshal([]byte(s), &f); err != nil {
+				return nil, "", "", errors.Trace(err)
+			}
+			feedback = append(feedback, f)
+		}
+	}
+	return feedback, "", "", nil
+}
+
+// loadHotFeedback loads feedback of a user in the window into the hot tier.
+func (t *TieredDatabase) loadHotFeedback(userId string, feedback []Feedback, generation, version string) error {
+	args := []interface{}{generation, version, t.window.Milliseconds()}
+	for _, f := range feedback {
+		value, err := marshalHotFeedback(f)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		args = append(args, hotFeedbackField(f), value, formatHotFeedbackScore(f.Timestamp))
+	}
+	return loadHotFeedbackScript.Run(t.context(), t.hot, hotFeedbackKeys(userId), args...).Err()
+}
+
+// insertHotFeedback writes feedback of a user to the hot tier if the user is loaded.
+func (t *TieredDatabase) insertHotFeedback(userId string, feedback []Feedback, overwrite bool) error {
+	args := []interface{}{t.window.Milliseconds(), formatHotFeedbackScore(time.Now().Add(-t.window)), overwrite}
+	for _, f := range feedback {
+		value, err := marshalHotFeedback(f)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		args = append(args, hotFeedbackField(f), value, formatHotFeedbackScore(f.Timestamp))
+	}
+	return insertHotFeedbackScript.Run(t.context(), t.hot, hotFeedbackKeys(userId), args...).Err()
+}
+
+// invalidate unloads a user from the hot tier, so that feedback of the user is reloaded from the cold tier.
+func (t *TieredDatabase) invalidate(userId string) error {
+	ctx := t.context()
+	_, err := t.hot.TxPipelined(ctx, func(pipeliner redis.Pipeliner) error {
+		pipeliner.Incr(ctx, hotFeedbackVersion+userId)
+		pipeliner.PExpire(ctx, hotFeedbackVersion+userId, t.window)
+		pipeliner.Del(ctx, hotFeedbackWarm+userId)
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+// invalidateAll unloads all users from the hot tier.
+func (t *TieredDatabase) invalidateAll() error {
+	return errors.Trace(t.hot.Incr(t.context(), hotFeedbackGeneration).Err())
+}
+
+// The following methods project fields if the cold tier supports projection. Otherwise, all fields are read.
+
+func (t *TieredDatabase) GetItemProjected(itemId string, fields []string) (Item, error) {
+	if projector, ok := t.Database.(Projector); ok {
+		return projector.GetItemProjected(itemId, fields)
+	}
+	return t.GetItem(itemId)
+}
+
+func (t *TieredDatabase) GetItemsProjected(cursor string, n int, timeLimit *time.Time, fields []string) (string, []Item, error) {
+	if projector, ok := t.Database.(Projector); ok {
+		return projector.GetItemsProjected(cursor, n, timeLimit, fields)
+	}
+	return t.GetItems(cursor, n, timeLimit)
+}
+
+func (t *TieredDatabase) GetUserProjected(userId string, fields []string) (User, error) {
+	if projector, ok := t.Database.(Projector); ok {
+		return projector.GetUserProjected(userId, fields)
+	}
+	return t.GetUser(userId)
+}
+
+func (t *TieredDatabase) GetUsersProjected(cursor string, n int, fields []string) (string, []User, error) {
+	if projector, ok := t.Database.(Projector); ok {
+		return projector.GetUsersProjected(cursor, n, fields)
+	}
+	return t.GetUsers(cursor, n)
+}
+
+func hotFeedbackKeys(userId string) []string {
+	return []string{hotFeedbackGeneration, hotFeedbackWarm + userId, hotFeedbackVersion + userId,
+		hotFeedback + userId, hotFeedbackTime + userId}
+}
+
+// marshalHotFeedback encodes feedback in JSON with the timestamp in UTC.
+func marshalHotFeedback(feedback Feedback) ([]byte, error) {
+	feedback.Timestamp = feedback.Timestamp.UTC()
+	return json.Marshal(feedback)
+}
+
+func hotFeedbackField(feedback Feedback) string {
+	return feedback.FeedbackType + "/" + feedback.ItemId
+}
+
+// formatHotFeedbackScore formats a timestamp in microseconds, which are exact in scores of sorted sets.
+func formatHotFeedbackScore(timestamp time.Time) string {
+	return strconv.FormatInt(timestamp.UnixMicro(), 10)
+}
+
+func valueOrZero(cmd *redis.StringCmd) string {
+	if cmd.Err() != nil {
+		return "0"
+	}
+	return cmd.Val()
+}
+
+// filterFeedback filters feedback by the item if it isn't empty, timestamps and feedback types.
+func filterFeedback(feedback []Feedback, itemId string, withFuture bool, feedbackTypes []string) []Feedback {
+	feedbackTypeSet := strset.New(feedbackTypes...)
+	now := time.Now()
+	filtered := make([]Feedback, 0, len(feedback))
+	for _, f := range feedback {
+		if (itemId == "" || f.ItemId == itemId) &&
+			(withFuture || !f.Timestamp.After(now)) &&
+			(feedbackTypeSet.IsEmpty() || feedbackTypeSet.Has(f.FeedbackType)) {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage"
+)
+
+type mockTieredDatabase struct {
+	*TieredDatabase
+	cold      *mockRedis
+	hotServer *miniredis.Miniredis
+}
+
+func newMockTieredDatabase(t *testing.T, window time.Duration) *mockTieredDatabase {
+	var err error
+	db := new(mockTieredDatabase)
+	db.cold = newMockRedis(t)
+	db.hotServer, err = miniredis.Run()
+	assert.NoError(t, err)
+	db.TieredDatabase, err = NewTieredDatabase(db.cold.Database, storage.RedisPrefix+db.hotServer.Addr(), window)
+	assert.NoError(t, err)
+	return db
+}
+
+func (db *mockTieredDatabase) Close(t *testing.T) {
+	err := db.TieredDatabase.Close()
+	assert.NoError(t, err)
+	db.cold.server.Close()
+	db.hotServer.Close()
+}
+
+func TestTieredDatabase_ReadThrough(t *testing.T) {
+	db := newMockTieredDatabase(t, 24*time.Hour)
+	defer db.Close(t)
+	timestamp := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	// feedback written before the hot tier is read from the cold tier
+	err := db.cold.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: timestamp},
+	}, true, true, true)
+	assert.NoError(t, err)
+	feedback, err := db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Feedback{{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: timestamp}}, feedback)
+	assert.True(t, db.hotServer.Exists(hotFeedbackWarm+"0"))
+
+	// feedback is written to both tiers
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "1"}, Timestamp: timestamp},
+		{FeedbackKey: FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "2"}, Timestamp: time.Now().Add(time.Hour).UTC()},
+	}, true, true, true)
+	assert.NoError(t, err)
+	feedback, err = db.cold.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 2)
+	// feedback is served by the hot tier
+	_, err = db.cold.DeleteUserItemFeedback("0", "0")
+	assert.NoError(t, err)
+	feedback, err = db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: timestamp},
+		{FeedbackKey: FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "1"}, Timestamp: timestamp},
+	}, feedback)
+	feedback, err = db.GetUserFeedback("0", true, "star")
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 2)
+	feedback, err = db.GetUserItemFeedback("0", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Feedback{{FeedbackKey: FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "1"}, Timestamp: timestamp}}, feedback)
+
+	// deleting feedback invalidates the user
+	_, err = db.DeleteUserItemFeedback("0", "1")
+	assert.NoError(t, err)
+	feedback, err = db.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 1)
+	// deleting items invalidates all users
+	err = db.DeleteItem("2")
+	assert.NoError(t, err)
+	feedback, err = db.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+	// feedback which might be ignored by the cold tier invalidates users
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "star", UserId: "0", ItemId: "3"}, Timestamp: timestamp},
+	}, true, false, true)
+	assert.NoError(t, err)
+	assert.False(t, db.hotServer.Exists(hotFeedbackWarm+"0"))
+	feedback, err = db.GetUserFeedback("0", true)
+	assert.NoError(t, err)
+	assert.Empty(t, feedback)
+}
+
+func TestTieredDatabase_Window(t *testing.T) {
+	db := newMockTieredDatabase(t, 24*time.Hour)
+	defer db.Close(t)
+	inside := time.Now().Add(-23 * time.Hour).Truncate(time.Second).UTC()
+	outside := time.Now().Add(-25 * time.Hour).Truncate(time.Second).UTC()
+	err := db.cold.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: inside},
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "1"}, Timestamp: outside},
+	}, true, true, true)
+	assert.NoError(t, err)
+	expected := []Feedback{{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: inside}}
+	// feedback out of the window is excluded from the cold tier
+	feedback, err := db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, feedback)
+	// feedback out of the window isn't loaded into the hot tier
+	feedback, err = db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, feedback)
+	members, err := db.hotServer.ZMembers(hotFeedbackTime + "0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"click/0"}, members)
+	// feedback out of the window isn't written to the hot tier
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "2"}, Timestamp: outside},
+	}, true, true, true)
+	assert.NoError(t, err)
+	feedback, err = db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, feedback)
+	// the user is reloaded from the cold tier after the window
+	db.hotServer.FastForward(24 * time.Hour)
+	assert.False(t, db.hotServer.Exists(hotFeedbackWarm+"0"))
+	feedback, err = db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, feedback)
+	assert.True(t, db.hotServer.Exists(hotFeedbackWarm+"0"))
+}
+
+func TestTieredDatabase_HotFailure(t *testing.T) {
+	db := newMockTieredDatabase(t, 24*time.Hour)
+	defer db.Close(t)
+	timestamp := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	_, err := db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.True(t, db.hotServer.Exists(hotFeedbackWarm+"0"))
+
+	// the user is invalidated if feedback isn't written to the hot tier
+	err = db.hotServer.Set(hotFeedbackTime+"0", "corrupted")
+	assert.NoError(t, err)
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: timestamp},
+	}, true, true, true)
+	assert.NoError(t, err)
+	assert.False(t, db.hotServer.Exists(hotFeedbackWarm+"0"))
+	feedback, err := db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Feedback{{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: timestamp}}, feedback)
+
+	// errors are returned if the user is neither written nor invalidated
+	db.hotServer.SetError("hot tier is down")
+	err = db.BatchInsertFeedback([]Feedback{
+		{FeedbackKey: FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "1"}, Timestamp: timestamp},
+	}, true, true, true)
+	assert.Error(t, err)
+	// reads fall through to the cold tier if the hot tier is down
+	feedback, err = db.GetUserFeedback("0", false)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 2)
+	db.hotServer.SetError("")
+}
@@ -39,6 +39,8 @@ const (
 	SQLitePrefix     = "sqlite://"
 	RedisPrefix      = "redis://"
 	RedissPrefix     = "rediss://"
+	MemcachedPrefix  = "memcached://"
+	InMemoryPrefix   = "inmemory://"
 	OraclePrefix     = "oracle://"
 )
 
@@ -117,6 +119,26 @@ func (tp TablePrefix) FeedbackTable() string {
 	return string(tp) + "feedback"
 }
 
+func (tp TablePrefix) UserOverridesTable() string {
+	return string(tp) + "user_overrides"
+}
+
+func (tp TablePrefix) ItemCanonicalsTable() string {
+	return string(tp) + "item_canonicals"
+}
+
+func (tp TablePrefix) AuditLogsTable() string {
+	return string(tp) + "audit_logs"
+}
+
+func (tp TablePrefix) DailyUsageTable() string {
+	return string(tp) + "daily_usage"
+}
+
+func (tp TablePrefix) RecommendSnapshotsTable() string {
+	return string(tp) + "recommend_snapshots"
+}
+
 func (tp TablePrefix) Key(key string) string {
 	return string(tp) + key
 }
@@ -0,0 +1,462 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/blob"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+const (
+	// ManifestFile is the name of manifests in directories of snapshots.
+	ManifestFile = "manifest.json"
+	// LatestFile stores the id of the latest snapshot, which is the base of the next incremental snapshot.
+	LatestFile = "LATEST"
+)
+
+// Kinds of exported files.
+const (
+	KindUsers          = "users"
+	KindItems          = "items"
+	KindUserOverrides  = "user_overrides"
+	KindItemCanonicals = "item_canonicals"
+	KindFeedback       = "feedback"
+	KindCache          = "cache"
+)
+
+// Kinds are kinds of exported files in the order of export.
+var Kinds = []string{KindUsers, KindItems, KindUserOverrides, KindItemCanonicals, KindFeedback, KindCache}
+
+// Manifest describes a snapshot. Users, items and cache documents are exported fully in every snapshot, while feedback
+// is exported incrementally: a snapshot contains feedback with timestamps in [FeedbackSince, FeedbackUntil] and the
+// base snapshot contains feedback before FeedbackSince.
+type Manifest struct {
+	Id            string
+	Base          string `json:",omitempty"`
+	CreateTime    time.Time
+	FeedbackSince *time.Time `json:",omitempty"`
+	FeedbackUntil time.Time
+	Files         []File
+}
+
+// File is an exported file, which is gzipped JSON lines.
+type File struct {
+	Kind  string
+	Name  string
+	Count int
+}
+
+// File returns the exported file of a kind.
+func (m *Manifest) File(kind string) (File, bool) {
+	for _, file := range m.Files {
+		if file.Kind == kind {
+			return file, true
+		}
+	}
+	return File{}, false
+}
+
+// Document is an exported cache document, which is a value, a set or a sorted set.
+type Document struct {
+	Key    string
+	Value  *string        `json:",omitempty"`
+	Set    []string       `json:",omitempty"`
+	Sorted []cache.Scored `json:",omitempty"`
+}
+
+// ManifestName returns the object name of the manifest of a snapshot.
+func ManifestName(id string) string {
+	return path.Join(id, ManifestFile)
+}
+
+// ParseManifestPath splits the path of a manifest into the DSN of the blob store and the snapshot id. Parameters of
+// the DSN follow the manifest path, such as s3://bucket/id/manifest.json?endpoint=...
+func ParseManifestPath(manifestPath string) (location, id string, err error) {
+	var params string
+	if i := strings.Index(manifestPath, "?"); i >= 0 {
+		manifestPath, params = manifestPath[:i], manifestPath[i:]
+	}
+	dir, file := path.Split(manifestPath)
+	if file != ManifestFile {
+		return "", "", errors.NotValidf("manifest path %s", manifestPath)
+	}
+	location, id = path.Split(strings.TrimSuffix(dir, "/"))
+	if id == "" {
+		return "", "", errors.NotValidf("manifest path %s", manifestPath)
+	}
+	if location == "" {
+		location = "."
+	}
+	return location + params, id, nil
+}
+
+// ReadManifest reads the manifest of a snapshot.
+func ReadManifest(store blob.Store, id string) (*Manifest, error) {
+	r, err := store.Get(ManifestName(id))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+	var manifest Manifest
+	if err = json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &manifest, nil
+}
+
+// ReadLatest reads the manifest of the latest snapshot. errors.NotFound is returned if there is no snapshot.
+func ReadLatest(store blob.Store) (*Manifest, error) {
+	r, err := store.Get(LatestFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+	id, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ReadManifest(store, strings.TrimSpace(string(id)))
+}
+
+// Exporter exports snapshots from a data store and a cache store. Cache writes should be quiesced during exports.
+type Exporter struct {
+	Store       blob.Store
+	DataClient  data.Database
+	CacheClient cache.Database
+	BatchSize   int
+	// Progress is called once a file is exported if it is not nil.
+	Progress func(file File)
+}
+
+// Export exports a snapshot of feedback until the cutoff. The snapshot is incremental if there is a previous snapshot in
+// the blob store. Feedback inserted after the previous snapshot with earlier timestamps isn't exported by
+// incremental snapshots, neither is feedback with timestamps in the future.
+func (e *Exporter) Export(id string, cutoff time.Time) (*Manifest, error) {
+	manifest := &Manifest{
+		Id:            id,
+		CreateTime:    time.Now().UTC(),
+		FeedbackUntil: cutoff.UTC(),
+	}
+	base, err := ReadLatest(e.Store)
+	if err == nil {
+		manifest.Base = base.Id
+		manifest.FeedbackSince = &base.FeedbackUntil
+	} else if !errors.Is(err, errors.NotFound) {
+		return nil, errors.Trace(err)
+	}
+
+	exports := map[string]func(encoder *json.Encoder) (int, error){
+		KindUsers: func(encoder *json.Encoder) (int, error) {
+			users, errChan := e.DataClient.GetUserStream(e.BatchSize)
+			return encodeStream(encoder, users, errChan, nil)
+		},
+		KindItems: func(encoder *json.Encoder) (int, error) {
+			items, errChan := e.DataClient.GetItemStream(e.BatchSize, nil)
+			return encodeStream(encoder, items, errChan, nil)
+		},
+		KindUserOverrides: func(encoder *json.Encoder) (int, error) {
+			overrides, errChan := e.DataClient.GetUserOverridesStream(e.BatchSize)
+			return encodeStream(encoder, overrides, errChan, nil)
+		},
+		KindItemCanonicals: func(encoder *json.Encoder) (int, error) {
+			canonicals, err := e.DataClient.GetItemCanonicals()
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+			for _, canonical := range canonicals {
+				if err = encoder.Encode(canonical); err != nil {
+					return 0, errors.Trace(err)
+				}
+			}
+			return len(canonicals), nil
+		},
+		KindFeedback: func(encoder *json.Encoder) (int, error) {
+			feedback, errChan := e.DataClient.GetFeedbackStream(e.BatchSize, manifest.FeedbackSince)
+			return encodeStream(encoder, feedback, errChan, func(feedback data.Feedback) bool {
+				// feedback after the cutoff belongs to the next snapshot
+				return !feedback.Timestamp.After(manifest.FeedbackUntil)
+			})
+		},
+		KindCache: e.exportCache,
+	}
+	for _, kind := range Kinds {
+		file := File{Kind: kind, Name: path.Join(id, kind+".jsonl.gz")}
+		if file.Count, err = writeFile(e.Store, file.Name, exports[kind]); errors.Is(err, errors.NotSupported) {
+			log.Logger().Warn("skip unsupported export of snapshot", zap.String("kind", kind), zap.Error(err))
+			continue
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "export %s", kind)
+		}
+		manifest.Files = append(manifest.Files, file)
+		if e.Progress != nil {
+			e.Progress(file)
+		}
+	}
+
+	// the snapshot is visible once the manifest is written
+	if err = blob.Write(e.Store, ManifestName(id), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(manifest)
+	}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = blob.Write(e.Store, LatestFile, func(w io.Writer) error {
+		_, err := io.WriteString(w, id)
+		return err
+	}); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return manifest, nil
+}
+
+// exportCache exports all documents in the cache store except the snapshot pause flag. Memcached doesn't support
+// scanning, so that cache documents aren't exported.
+func (e *Exporter) exportCache(encoder *json.Encoder) (int, error) {
+	keys := strset.New()
+	if err := e.CacheClient.Scan(func(key string) error {
+		keys.Add(key)
+		return nil
+	}); err != nil {
+		return 0, errors.Trace(err)
+	}
+	keys.Remove(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil))
+	sortedKeys := keys.List()
+	sort.Strings(sortedKeys)
+	count := 0
+	for _, key := range sortedKeys {
+		document, err := readDocument(e.CacheClient, key)
+		if err != nil {
+			return 0, errors.Trace(err)
+		} else if document == nil {
+			continue
+		}
+		if err = encoder.Encode(document); err != nil {
+			return 0, errors.Trace(err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// readDocument reads a cache document without knowing its type. Sorted sets and sets are tried first since reading
+// them as values might succeed with empty values. nil is returned if the document has been deleted.
+func readDocument(db cache.Database, key string) (*Document, error) {
+	if sorted, err := db.GetSorted(key, 0, -1); err == nil && len(sorted) > 0 {
+		return &Document{Key: key, Sorted: sorted}, nil
+	}
+	if members, err := db.GetSet(key); err == nil && len(members) > 0 {
+		return &Document{Key: key, Set: members}, nil
+	}
+	value, err := db.Get(key).String()
+	if errors.Is(err, errors.NotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Document{Key: key, Value: &value}, nil
+}
+
+// encodeStream encodes rows from a stream of the data store. Rows are skipped if the filter returns false. The stream
+// is drained even if encoding fails.
+func encodeStream[T any](encoder *json.Encoder, batches chan []T, errChan chan error, filter func(T) bool) (int, error) {
+	var (
+		count int
+		err   error
+	)
+	for batch := range batches {
+		for _, row := range batch {
+			if err != nil || (filter != nil && !filter(row)) {
+				continue
+			}
+			if err = encoder.Encode(row); err == nil {
+				count++
+			}
+		}
+	}
+	if streamErr := <-errChan; streamErr != nil {
+		return 0, errors.Trace(streamErr)
+	}
+	return count, errors.Trace(err)
+}
+
+// writeFile writes a gzipped JSON lines file to the blob store.
+func writeFile(store blob.Store, name string, encode func(encoder *json.Encoder) (int, error)) (count int, err error) {
+	err = blob.Write(store, name, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		if count, err = encode(json.NewEncoder(gz)); err != nil {
+			_ = gz.Close()
+			return err
+		}
+		return gz.Close()
+	})
+	return
+}
+
+// Restorer restores snapshots into fresh data and cache stores.
+type Restorer struct {
+	Store       blob.Store
+	DataClient  data.Database
+	CacheClient cache.Database
+	BatchSize   int
+	// Progress is called once a file is restored if it is not nil.
+	Progress func(file File)
+}
+
+// Restore restores a snapshot. Feedback is restored from the chain of base snapshots, while other files are restored
+// from the snapshot itself. Feedback of users or items not in the snapshot is ignored.
+func (r *Restorer) Restore(id string) error {
+	var chain []*Manifest
+	visited := strset.New()
+	for id != "" {
+		if visited.Has(id) {
+			return errors.NotValidf("circular base of snapshot %s", id)
+		}
+		visited.Add(id)
+		manifest, err := ReadManifest(r.Store, id)
+		if err != nil {
+			return errors.Annotatef(err, "read manifest of snapshot %s", id)
+		}
+		chain = append(chain, manifest)
+		id = manifest.Base
+	}
+
+	restores := map[string]func(name string) (int, error){
+		KindUsers: func(name string) (int, error) {
+			return readFile(r.Store, name, r.BatchSize, r.DataClient.BatchInsertUsers)
+		},
+		KindItems: func(name string) (int, error) {
+			return readFile(r.Store, name, r.BatchSize, r.DataClient.BatchInsertItems)
+		},
+		KindUserOverrides: func(name string) (int, error) {
+			return readFile(r.Store, name, r.BatchSize, func(overrides []data.UserOverrides) error {
+				for _, o := range overrides {
+					if err := r.DataClient.SetUserOverrides(o); err != nil {
+						return errors.Trace(err)
+					}
+				}
+				return nil
+			})
+		},
+		KindItemCanonicals: func(name string) (int, error) {
+			return readFile(r.Store, name, r.BatchSize, r.DataClient.BatchInsertItemCanonicals)
+		},
+		KindFeedback: func(name string) (int, error) {
+			return readFile(r.Store, name, r.BatchSize, func(feedback []data.Feedback) error {
+				return r.DataClient.BatchInsertFeedback(feedback, false, false, true)
+			})
+		},
+		KindCache: func(name string) (int, error) {
+			return readFile(r.Store, name, r.BatchSize, func(documents []Document) error {
+				for _, document := range documents {
+					if err := restoreDocument(r.CacheClient, document); err != nil {
+						return errors.Trace(err)
+					}
+				}
+				return nil
+			})
+		},
+	}
+	for _, kind := range Kinds {
+		manifests := chain[:1]
+		if kind == KindFeedback {
+			// restore feedback from the oldest snapshot
+			manifests = make([]*Manifest, 0, len(chain))
+			for i := len(chain) - 1; i >= 0; i-- {
+				manifests = append(manifests, chain[i])
+			}
+		}
+		for _, manifest := range manifests {
+			file, exist := manifest.File(kind)
+			if !exist {
+				continue
+			}
+			if _, err := restores[kind](file.Name); err != nil {
+				return errors.Annotatef(err, "restore %s of snapshot %s", kind, manifest.Id)
+			}
+			if r.Progress != nil {
+				r.Progress(file)
+			}
+		}
+	}
+	return nil
+}
+
+func restoreDocument(db cache.Database, document Document) error {
+	switch {
+	case document.Sorted != nil:
+		return db.SetSorted(document.Key, document.Sorted)
+	case document.Set != nil:
+		return db.SetSet(document.Key, document.Set...)
+	case document.Value != nil:
+		return db.Set(cache.String(document.Key, *document.Value))
+	default:
+		return errors.NotValidf("empty document %s", document.Key)
+	}
+}
+
+// readFile reads a gzipped JSON lines file from the blob store batch by batch.
+func readFile[T any](store blob.Store, name string, batchSize int, insert func([]T) error) (int, error) {
+	r, err := store.Get(name)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer gz.Close()
+	decoder := json.NewDecoder(gz)
+	var (
+		batch []T
+		count int
+	)
+	for {
+		var row T
+		if err = decoder.Decode(&row); err == io.EOF {
+			break
+		} else if err != nil {
+			return count, errors.Trace(err)
+		}
+		if batch = append(batch, row); len(batch) >= batchSize {
+			if err = insert(batch); err != nil {
+				return count, errors.Trace(err)
+			}
+			count += len(batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		if err = insert(batch); err != nil {
+			return count, errors.Trace(err)
+		}
+		count += len(batch)
+	}
+	return count, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/blob"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func openStores(t *testing.T, name string) (data.Database, cache.Database) {
+	dataClient, err := data.Open("sqlite://"+filepath.Join(t.TempDir(), name+".db"), "")
+	assert.NoError(t, err)
+	assert.NoError(t, dataClient.Init())
+	cacheClient, err := cache.Open("inmemory://", t.Name()+"_"+name+"_")
+	assert.NoError(t, err)
+	assert.NoError(t, cacheClient.Init())
+	return dataClient, cacheClient
+}
+
+func TestParseManifestPath(t *testing.T) {
+	location, id, err := ParseManifestPath("/backups/1/manifest.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "/backups/", location)
+	assert.Equal(t, "1", id)
+	location, id, err = ParseManifestPath("1/manifest.json")
+	assert.NoError(t, err)
+	assert.Equal(t, ".", location)
+	assert.Equal(t, "1", id)
+	location, id, err = ParseManifestPath("s3://bucket/backups/1/manifest.json?endpoint=http://127.0.0.1:9000")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://bucket/backups/?endpoint=http://127.0.0.1:9000", location)
+	assert.Equal(t, "1", id)
+	_, _, err = ParseManifestPath("/backups/1")
+	assert.True(t, errors.Is(err, errors.NotValid))
+}
+
+func TestSnapshot(t *testing.T) {
+	store, err := blob.Open(t.TempDir())
+	assert.NoError(t, err)
+	dataClient, cacheClient := openStores(t, "source")
+	defer dataClient.Close()
+	defer cacheClient.Close()
+	now := time.Now().UTC().Truncate(time.Second)
+	err = dataClient.BatchInsertUsers([]data.User{{UserId: "0"}, {UserId: "1"}})
+	assert.NoError(t, err)
+	err = dataClient.BatchInsertItems([]data.Item{{ItemId: "0", Timestamp: now}, {ItemId: "1", Timestamp: now}})
+	assert.NoError(t, err)
+	err = dataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "0", ItemId: "0"}, Timestamp: now.Add(-2 * time.Hour)},
+	}, false, false, true)
+	assert.NoError(t, err)
+	err = cacheClient.Set(cache.String(cache.Key(cache.GlobalMeta, cache.NumUsers), "2"),
+		cache.Time(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil), now))
+	assert.NoError(t, err)
+	err = cacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "1"), []cache.Scored{{Id: "0", Score: 1}})
+	assert.NoError(t, err)
+	err = cacheClient.SetSet(cache.Key(cache.IgnoreItems, "0"), "0")
+	assert.NoError(t, err)
+
+	// the first snapshot is full
+	exporter := &Exporter{Store: store, DataClient: dataClient, CacheClient: cacheClient, BatchSize: 1}
+	manifest, err := exporter.Export("1", now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, manifest.Base)
+	assert.Nil(t, manifest.FeedbackSince)
+	for kind, count := range map[string]int{KindUsers: 2, KindItems: 2, KindFeedback: 1, KindCache: 3} {
+		file, exist := manifest.File(kind)
+		assert.True(t, exist)
+		assert.Equal(t, count, file.Count, kind)
+	}
+
+	// the next snapshot exports feedback since the previous snapshot
+	err = dataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "1", ItemId: "1"}, Timestamp: now.Add(-30 * time.Minute)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "click", UserId: "1", ItemId: "0"}, Timestamp: now.Add(-10 * time.Minute)},
+	}, false, false, true)
+	assert.NoError(t, err)
+	manifest, err = exporter.Export("2", now.Add(-20*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", manifest.Base)
+	assert.Equal(t, now.Add(-time.Hour), *manifest.FeedbackSince)
+	file, _ := manifest.File(KindFeedback)
+	assert.Equal(t, 1, file.Count)
+	latest, err := ReadLatest(store)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", latest.Id)
+
+	// restore the chain of snapshots into fresh stores
+	restoredData, restoredCache := openStores(t, "restored")
+	defer restoredData.Close()
+	defer restoredCache.Close()
+	restorer := &Restorer{Store: store, DataClient: restoredData, CacheClient: restoredCache, BatchSize: 10}
+	err = restorer.Restore("2")
+	assert.NoError(t, err)
+	_, users, err := restoredData.GetUsers("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	_, feedback, err := restoredData.GetFeedback("", 10, nil)
+	assert.NoError(t, err)
+	assert.Len(t, feedback, 2)
+	value, err := restoredCache.Get(cache.Key(cache.GlobalMeta, cache.NumUsers)).String()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", value)
+	scores, err := restoredCache.GetSorted(cache.Key(cache.OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{Id: "0", Score: 1}}, scores)
+	members, err := restoredCache.GetSet(cache.Key(cache.IgnoreItems, "0"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0"}, members)
+	_, err = restoredCache.Get(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil)).String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+}
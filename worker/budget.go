@@ -0,0 +1,141 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"go.uber.org/zap"
+)
+
+const (
+	taskTraining = "training"
+	taskScoring  = "scoring"
+)
+
+// budgetJobs returns the parallelism of a task, which is the number of jobs capped by the budget.
+func (w *Worker) budgetJobs(task string) int {
+	var budget int
+	switch task {
+	case taskTraining:
+		budget = w.Config.Worker.TrainingJobs
+	case taskScoring:
+		budget = w.Config.Worker.ScoringJobs
+	}
+	jobs := w.jobs
+	if jobs <= 0 {
+		jobs = 1
+	}
+	if budget > 0 && budget < jobs {
+		jobs = budget
+	}
+	ParallelismVec.WithLabelValues(task).Set(float64(jobs))
+	return jobs
+}
+
+// softMemoryLimit returns the soft limit of heap memory in bytes. GOMEMLIMIT is used if the limit isn't configured,
+// and zero means unlimited.
+func (w *Worker) softMemoryLimit() int64 {
+	if w.Config.Worker.SoftMemoryLimit > 0 {
+		return w.Config.Worker.SoftMemoryLimit
+	}
+	limit, err := parseMemoryLimit(os.Getenv("GOMEMLIMIT"))
+	if err != nil {
+		log.Logger().Warn("failed to parse GOMEMLIMIT", zap.Error(err))
+		return 0
+	}
+	return limit
+}
+
+// checkMemory records the peak memory of a task and returns true if the soft memory limit is exceeded. Garbage is
+// collected once exceeded, so that the next batch starts with as much free memory as possible.
+func (w *Worker) checkMemory(task string, peak *uint64) bool {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > *peak {
+		*peak = stats.HeapAlloc
+		PeakMemoryBytesVec.WithLabelValues(task).Set(float64(*peak))
+	}
+	limit := w.softMemoryLimit()
+	if limit <= 0 || stats.HeapAlloc <= uint64(limit) {
+		return false
+	}
+	log.Logger().Warn("soft memory limit exceeded",
+		zap.String("task", task),
+		zap.Uint64("heap_alloc", stats.HeapAlloc),
+		zap.Int64("soft_memory_limit", limit))
+	runtime.GC()
+	return true
+}
+
+// nextBatchSize halves the batch size if the soft memory limit is exceeded, otherwise doubles it until the max batch
+// size. A batch is never smaller than the parallelism.
+func nextBatchSize(batch, maxBatch, jobs int, exceeded bool) int {
+	if exceeded {
+		batch /= 2
+	} else {
+		batch *= 2
+	}
+	if batch > maxBatch {
+		batch = maxBatch
+	}
+	if batch < jobs {
+		batch = jobs
+	}
+	return batch
+}
+
+// parseMemoryLimit parses a memory limit in the format of GOMEMLIMIT, which is a number of bytes with an optional
+// unit suffix of B, KiB, MiB, GiB or TiB. Empty and "off" mean unlimited.
+func parseMemoryLimit(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"TiB", 1 << 40},
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+		{"B", 1},
+	}
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, scale = strings.TrimSuffix(s, unit.suffix), unit.scale
+			break
+		}
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if value < 0 {
+		return 0, errors.NotValidf("memory limit %d", value)
+	}
+	if value > math.MaxInt64/scale {
+		return math.MaxInt64, nil
+	}
+	return value * scale, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+)
+
+func TestParseMemoryLimit(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"":        0,
+		"off":     0,
+		"1024":    1024,
+		"100B":    100,
+		"2KiB":    2 << 10,
+		"512MiB":  512 << 20,
+		"4GiB":    4 << 30,
+		"1TiB":    1 << 40,
+		"9999TiB": 9999 << 40,
+	} {
+		limit, err := parseMemoryLimit(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, limit, s)
+	}
+	limit, err := parseMemoryLimit("9223372036854775807KiB")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), limit)
+	_, err = parseMemoryLimit("1GB")
+	assert.Error(t, err)
+	_, err = parseMemoryLimit("-1")
+	assert.Error(t, err)
+}
+
+func TestNextBatchSize(t *testing.T) {
+	assert.Equal(t, 500, nextBatchSize(1000, 1000, 4, true))
+	assert.Equal(t, 4, nextBatchSize(6, 1000, 4, true))
+	assert.Equal(t, 1000, nextBatchSize(500, 1000, 4, false))
+	assert.Equal(t, 1000, nextBatchSize(1000, 1000, 4, false))
+}
+
+func TestWorker_Budget(t *testing.T) {
+	w := &Worker{jobs: 8, Settings: config.NewSettings()}
+	assert.Equal(t, 8, w.budgetJobs(taskTraining))
+	assert.Equal(t, 8, w.budgetJobs(taskScoring))
+	w.Config.Worker.TrainingJobs = 2
+	w.Config.Worker.ScoringJobs = 16
+	assert.Equal(t, 2, w.budgetJobs(taskTraining))
+	assert.Equal(t, 8, w.budgetJobs(taskScoring))
+
+	// memory limit from GOMEMLIMIT
+	t.Setenv("GOMEMLIMIT", "1GiB")
+	assert.Equal(t, int64(1<<30), w.softMemoryLimit())
+	w.Config.Worker.SoftMemoryLimit = 1 << 20
+	assert.Equal(t, int64(1<<20), w.softMemoryLimit())
+
+	// peak memory is recorded
+	var peak uint64
+	w.Config.Worker.SoftMemoryLimit = math.MaxInt64
+	assert.False(t, w.checkMemory(taskScoring, &peak))
+	assert.NotZero(t, peak)
+	w.Config.Worker.SoftMemoryLimit = 1
+	assert.True(t, w.checkMemory(taskScoring, &peak))
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"sync"
+
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+// RecommendSizes accumulates lengths of cached recommendation in a cycle, so that the memory cost of the configured
+// lengths could be estimated. The size of an item is estimated by the length of its id and 8 bytes of its score.
+type RecommendSizes struct {
+	mu    sync.Mutex
+	users int
+	items map[string]int
+	bytes int
+}
+
+func NewRecommendSizes() *RecommendSizes {
+	return &RecommendSizes{items: make(map[string]int)}
+}
+
+// Add adds cached recommendation of a user in all categories.
+func (s *RecommendSizes) Add(results map[string][]cache.Scored) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users++
+	for category, result := range results {
+		s.items[category] += len(result)
+		for _, item := range result {
+			s.bytes += len(item.Id) + 8
+		}
+	}
+}
+
+// BytesPerUser returns the average size of cached recommendation per user.
+func (s *RecommendSizes) BytesPerUser() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == 0 {
+		return 0
+	}
+	return s.bytes / s.users
+}
+
+// ItemsPerUser returns the average length of cached recommendation per user in a category.
+func (s *RecommendSizes) ItemsPerUser(category string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == 0 {
+		return 0
+	}
+	return s.items[category] / s.users
+}
+
+// Log logs the estimated memory cost of cached recommendation per user.
+func (s *RecommendSizes) Log() {
+	s.mu.Lock()
+	users := s.users
+	categories := make([]string, 0, len(s.items))
+	for category := range s.items {
+		categories = append(categories, category)
+	}
+	s.mu.Unlock()
+	if users == 0 {
+		return
+	}
+	fields := []zap.Field{zap.Int("n_users", users), zap.Int("bytes_per_user", s.BytesPerUser())}
+	for _, category := range categories {
+		fields = append(fields, zap.Int("items_per_user:"+category, s.ItemsPerUser(category)))
+	}
+	log.Logger().Info("estimate memory of cached recommendation", fields...)
+}
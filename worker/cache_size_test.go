@@ -0,0 +1,38 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/storage/cache"
+)
+
+func TestRecommendSizes(t *testing.T) {
+	sizes := NewRecommendSizes()
+	assert.Zero(t, sizes.BytesPerUser())
+	sizes.Add(map[string][]cache.Scored{
+		"":       {{Id: "10"}, {Id: "20"}},
+		"shorts": {{Id: "10"}},
+	})
+	sizes.Add(map[string][]cache.Scored{
+		"": {{Id: "30"}, {Id: "40"}, {Id: "50"}, {Id: "60"}},
+	})
+	assert.Equal(t, 35, sizes.BytesPerUser())
+	assert.Equal(t, 3, sizes.ItemsPerUser(""))
+	assert.Equal(t, 0, sizes.ItemsPerUser("shorts"))
+	assert.Equal(t, 0, sizes.ItemsPerUser("news"))
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"math"
+
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/encoding"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/protocol"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// readCanaryVersion reads the version of the canary ranking model published by the master. Zero means no canary
+// ranking model.
+func (w *Worker) readCanaryVersion() (int64, error) {
+	version, err := w.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.RankingCanaryVersion)).Integer()
+	if errors.Is(err, errors.NotFound) {
+		return 0, nil
+	}
+	return int64(version), errors.Trace(err)
+}
+
+// rankingModelFor returns the ranking model serving a user and its version. Canary users are served by the canary
+// ranking model if it exists, while other users are served by the default ranking model.
+func (w *Worker) rankingModelFor(userId string) (ranking.MatrixFactorization, int64) {
+	if w.canaryRankingModel != nil && ranking.IsCanaryUser(userId, w.Config.Recommend.Collaborative.CanaryPercent) {
+		return w.canaryRankingModel, w.canaryRankingModelVersion
+	}
+	return w.RankingModel, w.RankingModelVersion
+}
+
+// swapCanaryRankingModel swaps the canary ranking model with the default ranking model after promotion, so that no
+// model is pulled again.
+func (w *Worker) swapCanaryRankingModel() {
+	w.RankingModel, w.canaryRankingModel = w.canaryRankingModel, w.RankingModel
+	w.RankingModelVersion, w.canaryRankingModelVersion = w.canaryRankingModelVersion, w.RankingModelVersion
+	w.resetIncrementalCheckpoint()
+	log.Logger().Info("promoted canary ranking model",
+		zap.String("version", encoding.Hex(w.RankingModelVersion)))
+	MemoryInuseBytesVec.WithLabelValues("collaborative_filtering_model").Set(float64(w.RankingModel.Bytes()))
+}
+
+// pullCanaryRankingModel pulls the latest canary ranking model from the master, or drops the canary ranking model if
+// it no longer exists. It returns true if the canary ranking model is changed.
+func (w *Worker) pullCanaryRankingModel() bool {
+	if w.latestCanaryRankingModelVersion == 0 {
+		w.canaryRankingModel = nil
+		w.canaryRankingModelVersion = 0
+		log.Logger().Info("dropped canary ranking model")
+		return true
+	}
+	log.Logger().Info("start pull canary ranking model")
+	rankingModelReceiver, err := w.masterClient.GetRankingModel(context.Background(),
+		&protocol.VersionInfo{Version: w.latestCanaryRankingModelVersion},
+		grpc.MaxCallRecvMsgSize(math.MaxInt))
+	if err != nil {
+		log.Logger().Error("failed to pull canary ranking model", zap.Error(err))
+		return false
+	}
+	rankingModel, err := protocol.UnmarshalRankingModel(rankingModelReceiver)
+	if err != nil {
+		log.Logger().Error("failed to unmarshal canary ranking model", zap.Error(err))
+		return false
+	}
+	w.canaryRankingModel = rankingModel
+	w.canaryRankingModelVersion = w.latestCanaryRankingModelVersion
+	log.Logger().Info("synced canary ranking model",
+		zap.String("version", encoding.Hex(w.canaryRankingModelVersion)))
+	return true
+}
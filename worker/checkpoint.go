@@ -0,0 +1,112 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+	"sort"
+	"time"
+)
+
+const checkpointBatchSize = 1000
+
+// Checkpoint is the progress of an in-progress offline recommendation cycle. Users of a shard are recommended in the
+// order of user IDs, and users up to the last user have been recommended. A checkpoint is resumed only if versions of
+// models are unchanged. Users joining or leaving the shard don't invalidate the checkpoint since the position of the
+// last user is searched in the sorted list.
+type Checkpoint struct {
+	CycleId             string
+	LastUserId          string
+	RankingModelVersion int64
+	ClickModelVersion   int64
+	UpdateTime          time.Time
+}
+
+// sortUsers sorts a copy of users by user IDs.
+func sortUsers(users []data.User) []data.User {
+	sorted := make([]data.User, len(users))
+	copy(sorted, users)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].UserId < sorted[j].UserId
+	})
+	return sorted
+}
+
+// cursor returns the position of the first user to recommend in users sorted by user IDs.
+func (c *Checkpoint) cursor(users []data.User) int {
+	if c.LastUserId == "" {
+		return 0
+	}
+	return sort.Search(len(users), func(i int) bool {
+		return users[i].UserId > c.LastUserId
+	})
+}
+
+// loadCheckpoint resumes the checkpoint of the in-progress cycle, or starts a new cycle if the checkpoint is missing
+// or outdated.
+func (w *Worker) loadCheckpoint() *Checkpoint {
+	newCheckpoint := &Checkpoint{
+		CycleId:             uuid.NewString(),
+		RankingModelVersion: w.RankingModelVersion,
+		ClickModelVersion:   w.ClickModelVersion,
+	}
+	buf, err := w.CacheClient.Get(cache.Key(cache.OfflineRecommendCheckpoint, w.workerName)).String()
+	if err != nil {
+		if !errors.Is(err, errors.NotFound) {
+			log.Logger().Error("failed to load checkpoint", zap.Error(err))
+		}
+		return newCheckpoint
+	}
+	var checkpoint Checkpoint
+	if err = json.Unmarshal([]byte(buf), &checkpoint); err != nil {
+		log.Logger().Error("failed to parse checkpoint", zap.Error(err))
+		return newCheckpoint
+	}
+	if checkpoint.RankingModelVersion != newCheckpoint.RankingModelVersion ||
+		checkpoint.ClickModelVersion != newCheckpoint.ClickModelVersion {
+		log.Logger().Info("discard outdated checkpoint", zap.String("cycle_id", checkpoint.CycleId))
+		return newCheckpoint
+	}
+	log.Logger().Info("resume offline recommendation from checkpoint",
+		zap.String("cycle_id", checkpoint.CycleId),
+		zap.String("last_user_id", checkpoint.LastUserId))
+	return &checkpoint
+}
+
+// saveCheckpoint persists the checkpoint once a batch of users is recommended.
+func (w *Worker) saveCheckpoint(checkpoint *Checkpoint) {
+	checkpoint.UpdateTime = time.Now()
+	buf, err := json.Marshal(checkpoint)
+	if err != nil {
+		log.Logger().Error("failed to marshal checkpoint", zap.Error(err))
+		return
+	}
+	if err = w.CacheClient.Set(cache.String(cache.Key(cache.OfflineRecommendCheckpoint, w.workerName), string(buf))); err != nil {
+		log.Logger().Error("failed to save checkpoint", zap.Error(err))
+	}
+}
+
+// clearCheckpoint removes the checkpoint once the cycle completes.
+func (w *Worker) clearCheckpoint() {
+	if err := w.CacheClient.Delete(cache.Key(cache.OfflineRecommendCheckpoint, w.workerName)); err != nil {
+		log.Logger().Error("failed to clear checkpoint", zap.Error(err))
+	}
+}
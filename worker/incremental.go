@@ -0,0 +1,164 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/scylladb/go-set/strset"
+	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+)
+
+// resetIncrementalCheckpoint moves the checkpoint of incremental updates to the time that the training dataset of
+// the current ranking model was loaded. Feedback inserted after that time is unknown to the model.
+func (w *Worker) resetIncrementalCheckpoint() {
+	checkpoint, err := w.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.LastLoadDatasetTime)).Time()
+	if err != nil || checkpoint.IsZero() {
+		if err != nil && !errors.Is(err, cache.ErrObjectNotExist) {
+			log.Logger().Warn("failed to read latest load dataset time", zap.Error(err))
+		}
+		checkpoint = time.Now()
+	}
+	w.incrementalCheckpoint = checkpoint
+}
+
+// incrementalUpdate fits the ranking model with positive feedback inserted since the last checkpoint and refreshes
+// recommendations of affected users. If there are too many new users or items unknown to the model, a full training
+// is requested from the master instead.
+func (w *Worker) incrementalUpdate() error {
+	if w.RankingModel == nil || w.RankingModel.Invalid() {
+		return nil
+	}
+	startTime := time.Now()
+	checkpoint := w.incrementalCheckpoint
+	if checkpoint.IsZero() {
+		w.incrementalCheckpoint = startTime
+		return nil
+	}
+	incrementalConfig := w.Config.Recommend.Incremental
+
+	// pull new positive feedback
+	var feedback []data.Feedback
+	feedbackChan, errChan := w.DataClient.GetFeedbackStream(batchSize, &checkpoint, w.Config.Recommend.DataSource.PositiveFeedbackTypes...)
+	for batch := range feedbackChan {
+		for _, f := range batch {
+			if w.Config.Recommend.DataSource.GetFeedbackWeight(f.FeedbackType) != 0 {
+				feedback = append(feedback, f)
+			}
+		}
+	}
+	if err := <-errChan; err != nil {
+		return errors.Trace(err)
+	}
+	if len(feedback) == 0 {
+		w.incrementalCheckpoint = startTime
+		return nil
+	}
+	// If there is too much feedback, the earliest feedback is used and the checkpoint only advances past the last
+	// used feedback. Feedback sharing the timestamp of the last used feedback is used as well, otherwise it would be
+	// skipped by the next update.
+	nextCheckpoint := startTime
+	if len(feedback) > incrementalConfig.MaxFeedback {
+		sort.SliceStable(feedback, func(i, j int) bool {
+			return feedback[i].Timestamp.Before(feedback[j].Timestamp)
+		})
+		lastTimestamp := feedback[incrementalConfig.MaxFeedback-1].Timestamp
+		n := sort.Search(len(feedback), func(i int) bool {
+			return feedback[i].Timestamp.After(lastTimestamp)
+		})
+		feedback = feedback[:n]
+		nextCheckpoint = lastTimestamp.Add(time.Nanosecond)
+	}
+	userIndex, itemIndex := w.RankingModel.GetUserIndex(), w.RankingModel.GetItemIndex()
+	var userIndices, itemIndices []int32
+	newUsers, newItems := strset.New(), strset.New()
+	for _, f := range feedback {
+		u, i := userIndex.ToNumber(f.UserId), itemIndex.ToNumber(f.ItemId)
+		if u == base.NotId {
+			newUsers.Add(f.UserId)
+		}
+		if i == base.NotId {
+			newItems.Add(f.ItemId)
+		}
+		if u != base.NotId && i != base.NotId {
+			userIndices = append(userIndices, u)
+			itemIndices = append(itemIndices, i)
+		}
+	}
+
+	// request full training if the vocabulary grows too much
+	if float64(newUsers.Size()) > incrementalConfig.MaxVocabularyGrowth*float64(userIndex.Len()) ||
+		float64(newItems.Size()) > incrementalConfig.MaxVocabularyGrowth*float64(itemIndex.Len()) {
+		log.Logger().Info("too many new users or items, request full training",
+			zap.Int("n_new_users", newUsers.Size()),
+			zap.Int("n_new_items", newItems.Size()))
+		if err := w.CacheClient.Set(cache.Integer(cache.Key(cache.GlobalMeta, cache.DataImported), 1)); err != nil {
+			return errors.Trace(err)
+		}
+		w.incrementalCheckpoint = nextCheckpoint
+		return nil
+	}
+
+	// fit model
+	if err := ranking.IncrementalFit(w.RankingModel, userIndices, itemIndices, incrementalConfig.NumEpochs,
+		incrementalConfig.LearningRate, incrementalConfig.Reg, startTime.UnixNano()); err != nil {
+		return errors.Trace(err)
+	}
+	// item factors are updated in place, so the vector index built from them is stale
+	w.rankingIndex.Invalidate()
+
+	// refresh recommendation of affected users belong to this worker
+	c := newConsistentHash(w.peers)
+	affectedUsers := strset.New()
+	var users []data.User
+	for _, u := range userIndices {
+		userId := userIndex.ToName(u)
+		if affectedUsers.Has(userId) {
+			continue
+		}
+		affectedUsers.Add(userId)
+		if p, err := c.Get(userId); err != nil {
+			return errors.Trace(err)
+		} else if p != w.me {
+			continue
+		}
+		user, err := w.DataClient.GetUser(userId)
+		if err != nil {
+			if errors.Is(err, errors.NotFound) {
+				continue
+			}
+			return errors.Trace(err)
+		}
+		users = append(users, user)
+	}
+	if len(users) > 0 {
+		w.Recommend(users)
+	}
+
+	w.incrementalCheckpoint = nextCheckpoint
+	IncrementalUpdateFeedbackTotal.Add(float64(len(userIndices)))
+	log.Logger().Info("complete incremental update",
+		zap.Int("n_feedback", len(userIndices)),
+		zap.Int("n_refreshed_users", len(users)),
+		zap.Duration("used_time", time.Since(startTime)))
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 const (
 	LabelStep = "step"
 	LabelData = "data"
+	LabelTask = "task"
 )
 
 var (
@@ -30,6 +31,11 @@ var (
 		Subsystem: "worker",
 		Name:      "update_user_recommend_total",
 	})
+	SkipUserRecommendTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "worker",
+		Name:      "skip_user_recommend_total",
+	})
 	OfflineRecommendStepSecondsVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "gorse",
 		Subsystem: "worker",
@@ -45,9 +51,39 @@ var (
 		Subsystem: "worker",
 		Name:      "collaborative_filtering_index_recall",
 	})
+	RankingIndexBuildSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "worker",
+		Name:      "ranking_index_build_seconds",
+	})
+	IncrementalUpdateFeedbackTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "worker",
+		Name:      "incremental_update_feedback_total",
+	})
+	PriorityRefreshQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "worker",
+		Name:      "priority_refresh_queue_depth",
+	})
+	PriorityRefreshUsersTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gorse",
+		Subsystem: "worker",
+		Name:      "priority_refresh_users_total",
+	})
 	MemoryInuseBytesVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "gorse",
 		Subsystem: "worker",
 		Name:      "memory_inuse_bytes",
 	}, []string{LabelData})
+	ParallelismVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "worker",
+		Name:      "parallelism",
+	}, []string{LabelTask})
+	PeakMemoryBytesVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorse",
+		Subsystem: "worker",
+		Name:      "peak_memory_bytes",
+	}, []string{LabelTask})
 )
@@ -0,0 +1,123 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+	"go.uber.org/zap"
+	"math"
+	"time"
+)
+
+const priorityRefreshPeriod = 10 * time.Second
+
+// refreshPriorityUsers regenerates recommendation for users in the priority refresh queue between full cycles. Only
+// users of this worker are drained, and at most max_priority_refresh_per_minute users are refreshed every minute.
+func (w *Worker) refreshPriorityUsers() {
+	offlineConfig := &w.Config.Recommend.Offline
+	if offlineConfig.PriorityRefreshQueueSize <= 0 || offlineConfig.MaxPriorityRefreshPerMinute <= 0 {
+		return
+	}
+	// users in the queue are left to production workers in dry-run mode
+	if w.dryRun {
+		return
+	}
+	queue, err := w.CacheClient.GetSortedByScore(cache.PriorityRefreshUsers, math.Inf(-1), math.Inf(1))
+	if err != nil {
+		log.Logger().Error("failed to read priority refresh queue", zap.Error(err))
+		return
+	}
+	PriorityRefreshQueueDepth.Set(float64(len(queue)))
+	// reset the budget every minute
+	if time.Since(w.priorityWindowStart) >= time.Minute {
+		w.priorityWindowStart = time.Now()
+		w.priorityRefreshCount = 0
+	}
+	budget := offlineConfig.MaxPriorityRefreshPerMinute - w.priorityRefreshCount
+	if budget <= 0 || len(queue) == 0 || !lo.Contains(w.peers, w.me) {
+		return
+	}
+
+	// refresh the oldest users of this worker
+	c := newConsistentHash(w.peers)
+	var popped []cache.Scored
+	for _, item := range queue {
+		if len(popped) >= budget {
+			break
+		}
+		if worker, err := c.Get(item.Id); err == nil && worker == w.me {
+			popped = append(popped, item)
+		}
+	}
+	if len(popped) == 0 {
+		return
+	}
+	w.priorityRefreshCount += len(popped)
+	PriorityRefreshUsersTotal.Add(float64(len(popped)))
+	users := make([]data.User, 0, len(popped))
+	refreshed := make([]cache.Scored, 0, len(popped))
+	for _, item := range popped {
+		user, err := w.DataClient.GetUser(item.Id)
+		if err != nil {
+			if errors.Is(err, errors.NotFound) {
+				// deleted users are removed from the queue
+				refreshed = append(refreshed, item)
+			} else {
+				log.Logger().Error("failed to load priority user", log.UserId(item.Id), zap.Error(err))
+			}
+			continue
+		}
+		users = append(users, user)
+		refreshed = append(refreshed, item)
+	}
+	if len(users) > 0 && !w.recommend(users, false) {
+		// users are left in the queue and retried later
+		return
+	}
+
+	// pop users after refreshed, users pushed again during refreshing are kept
+	if err = w.popPriorityUsers(refreshed); err != nil {
+		log.Logger().Error("failed to pop priority refresh queue", zap.Error(err))
+	}
+}
+
+// popPriorityUsers removes users from the priority refresh queue unless they have been pushed again since read.
+func (w *Worker) popPriorityUsers(items []cache.Scored) error {
+	if len(items) == 0 {
+		return nil
+	}
+	queue, err := w.CacheClient.GetSortedByScore(cache.PriorityRefreshUsers, math.Inf(-1), math.Inf(1))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	scores := make(map[string]float64, len(queue))
+	for _, item := range queue {
+		scores[item.Id] = item.Score
+	}
+	var members []cache.SetMember
+	for _, item := range items {
+		if score, exist := scores[item.Id]; exist && score <= item.Score {
+			members = append(members, cache.Member(cache.PriorityRefreshUsers, item.Id))
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	return errors.Trace(w.CacheClient.RemSorted(members...))
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"sync"
+
+	"github.com/zhenghaoz/gorse/base/search"
+	"github.com/zhenghaoz/gorse/model/ranking"
+)
+
+// rankingIndexKey identifies the item factors an index is built from: the version of a ranking model and the number
+// of in-place updates applied to it.
+type rankingIndexKey struct {
+	version int64
+	updates int
+}
+
+// rankingIndexGeneration is a vector index built from item factors of a ranking model. Searches must use the user
+// factors and the item index of the same model.
+type rankingIndexGeneration struct {
+	key   rankingIndexKey
+	model ranking.MatrixFactorization
+	index *search.HNSW
+	bytes int
+	refs  int
+}
+
+// rankingIndexBuffer double-buffers vector indices of ranking models. A new index is built while the current index
+// keeps serving searches, then they are swapped. The previous index is released once in-flight searches complete.
+// The zero value is an empty buffer.
+type rankingIndexBuffer struct {
+	mu       sync.Mutex
+	current  *rankingIndexGeneration
+	previous *rankingIndexGeneration
+	building bool
+	updates  int
+}
+
+// Acquire the current index for searching. It returns nil if there is no index. The returned index must be
+// released after searching.
+func (b *rankingIndexBuffer) Acquire() *rankingIndexGeneration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == nil {
+		return nil
+	}
+	b.current.refs++
+	return b.current
+}
+
+// Release an index acquired before. The previous index is freed if no search uses it.
+func (b *rankingIndexBuffer) Release(g *rankingIndexGeneration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g.refs--
+	if g == b.previous && g.refs == 0 {
+		b.freePrevious()
+	}
+}
+
+// StartBuild marks that an index is being built for the model of the version. It returns false if the current index
+// is built from the same item factors or an index is being built. EndBuild must be called once the build completes.
+func (b *rankingIndexBuffer) StartBuild(version int64) (rankingIndexKey, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := rankingIndexKey{version: version, updates: b.updates}
+	if b.building || (b.current != nil && b.current.key == key) {
+		return key, false
+	}
+	b.building = true
+	return key, true
+}
+
+// EndBuild marks that the index build has completed or failed.
+func (b *rankingIndexBuffer) EndBuild() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.building = false
+}
+
+// Swap the current index with a new index built from the model.
+func (b *rankingIndexBuffer) Swap(key rankingIndexKey, model ranking.MatrixFactorization, index *search.HNSW) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.previous != nil {
+		// searches still using the older index keep it alive until they complete
+		b.freePrevious()
+	}
+	b.previous, b.current = b.current, &rankingIndexGeneration{key: key, model: model, index: index, bytes: index.Bytes()}
+	MemoryInuseBytesVec.WithLabelValues("ranking_index").Set(float64(b.current.bytes))
+	if b.previous != nil {
+		MemoryInuseBytesVec.WithLabelValues("previous_ranking_index").Set(float64(b.previous.bytes))
+		if b.previous.refs == 0 {
+			b.freePrevious()
+		}
+	}
+}
+
+// Reset removes all indices.
+func (b *rankingIndexBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.freePrevious()
+	b.previous, b.current = b.current, nil
+	b.freePrevious()
+	MemoryInuseBytesVec.WithLabelValues("ranking_index").Set(0)
+}
+
+// Invalidate counts an in-place update of the model, so that the index is rebuilt. The stale index keeps serving
+// searches until an index is rebuilt.
+func (b *rankingIndexBuffer) Invalidate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updates++
+}
+
+// IsServing returns true if there is an index for searching.
+func (b *rankingIndexBuffer) IsServing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current != nil
+}
+
+func (b *rankingIndexBuffer) freePrevious() {
+	if b.previous != nil {
+		if b.previous.refs == 0 {
+			b.previous.model = nil
+			b.previous.index = nil
+		}
+		b.previous = nil
+		MemoryInuseBytesVec.WithLabelValues("previous_ranking_index").Set(0)
+	}
+}
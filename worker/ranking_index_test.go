@@ -0,0 +1,87 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/base/search"
+)
+
+func TestRankingIndexBuffer(t *testing.T) {
+	var buffer rankingIndexBuffer
+	assert.Nil(t, buffer.Acquire())
+	assert.False(t, buffer.IsServing())
+
+	// build the first index
+	model1 := newMockMatrixFactorizationForRecommend(1, 12)
+	index1 := search.NewHNSW(nil)
+	key1, ok := buffer.StartBuild(1)
+	assert.True(t, ok)
+	_, ok = buffer.StartBuild(1)
+	assert.False(t, ok)
+	buffer.Swap(key1, model1, index1)
+	buffer.EndBuild()
+	assert.True(t, buffer.IsServing())
+	_, ok = buffer.StartBuild(1)
+	assert.False(t, ok)
+
+	// the first index keeps serving in-flight searches
+	generation1 := buffer.Acquire()
+	assert.Same(t, index1, generation1.index)
+	model2 := newMockMatrixFactorizationForRecommend(1, 12)
+	index2 := search.NewHNSW(nil)
+	key2, ok := buffer.StartBuild(2)
+	assert.True(t, ok)
+	buffer.Swap(key2, model2, index2)
+	buffer.EndBuild()
+	generation2 := buffer.Acquire()
+	assert.Same(t, index2, generation2.index)
+	assert.Same(t, index1, generation1.index)
+	assert.Same(t, generation1, buffer.previous)
+
+	// the first index is freed after searches complete
+	buffer.Release(generation1)
+	assert.Nil(t, buffer.previous)
+	assert.Nil(t, generation1.index)
+	assert.Nil(t, generation1.model)
+	buffer.Release(generation2)
+	assert.Same(t, index2, buffer.Acquire().index)
+
+	// the index is rebuilt after the model is updated in place
+	_, ok = buffer.StartBuild(2)
+	assert.False(t, ok)
+	buffer.Invalidate()
+	key3, ok := buffer.StartBuild(2)
+	assert.True(t, ok)
+	buffer.Swap(key3, model2, search.NewHNSW(nil))
+	buffer.EndBuild()
+	_, ok = buffer.StartBuild(2)
+	assert.False(t, ok)
+
+	// a failed build doesn't block later builds
+	_, ok = buffer.StartBuild(3)
+	assert.True(t, ok)
+	buffer.EndBuild()
+	_, ok = buffer.StartBuild(3)
+	assert.True(t, ok)
+	buffer.EndBuild()
+
+	// remove all indices
+	buffer.Reset()
+	assert.Nil(t, buffer.Acquire())
+	assert.False(t, buffer.IsServing())
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"math"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/samber/lo"
+	"github.com/zhenghaoz/gorse/base/heap"
+	"github.com/zhenghaoz/gorse/base/log"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"go.uber.org/zap"
+)
+
+// subscriptionScore ranks an item in its topics by popularity decayed by age: (1 + popularity) * 2^(-age / half-life).
+func subscriptionScore(popularity float64, timestamp time.Time, halfLife time.Duration, now time.Time) float64 {
+	age := math.Max(now.Sub(timestamp).Seconds(), 0)
+	return (1 + popularity) * math.Exp2(-age/halfLife.Seconds())
+}
+
+// updateSubscriptionItems maintains candidate lists of subscription topics owned by this worker. Topics are labels and
+// categories of available items, which are split between workers by the consistent hash ring. Lists are only
+// maintained if the subscription stage is in the fallback chain, and lists of topics without items are removed.
+func (w *Worker) updateSubscriptionItems(itemCache *ItemCache, peers []string, me string) error {
+	if !lo.Contains(w.Config.Recommend.Online.FallbackRecommend, config.StageSubscription) {
+		return nil
+	}
+	if !lo.Contains(peers, me) {
+		return errors.New("current node isn't in worker nodes")
+	}
+	startTime := time.Now()
+	popularItems, err := w.CacheClient.GetSorted(cache.Key(cache.PopularItems, ""), 0, -1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	popularity := lo.SliceToMap(popularItems, func(item cache.Scored) (string, float64) {
+		return item.Id, item.Score
+	})
+
+	// rank items of topics owned by this worker, nil filters mark topics owned by other workers
+	c := newConsistentHash(peers)
+	filters := make(map[string]*heap.TopKFilter[string, float64])
+	for itemId, item := range itemCache.Data {
+		if item.IsHidden {
+			continue
+		}
+		score := subscriptionScore(popularity[itemId], item.Timestamp, w.Config.Recommend.Subscription.RecencyHalfLife, startTime)
+		for _, topic := range lo.Uniq(append(append([]string{}, item.Labels...), item.Categories...)) {
+			filter, exist := filters[topic]
+			if !exist {
+				owner, err := c.Get(topic)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if owner == me {
+					filter = heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSize)
+				}
+				filters[topic] = filter
+			}
+			if filter != nil {
+				filter.Push(itemId, score)
+			}
+		}
+	}
+	var topics []string
+	for topic, filter := range filters {
+		if filter == nil {
+			continue
+		}
+		ids, scores := filter.PopAll()
+		items := make([]cache.Scored, len(ids))
+		for i := range ids {
+			items[i] = cache.Scored{Id: ids[i], Score: scores[i]}
+		}
+		if err = w.CacheClient.SetSorted(cache.Key(cache.SubscriptionItems, topic), items); err != nil {
+			return errors.Trace(err)
+		}
+		topics = append(topics, topic)
+	}
+
+	// remove lists of topics owned by this worker but without items
+	prevTopics, err := w.CacheClient.GetSet(cache.SubscriptionTopics)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var removedTopics []string
+	for _, topic := range prevTopics {
+		if _, exist := filters[topic]; exist {
+			continue
+		}
+		if owner, err := c.Get(topic); err != nil {
+			return errors.Trace(err)
+		} else if owner == me {
+			if err = w.CacheClient.Delete(cache.Key(cache.SubscriptionItems, topic)); err != nil {
+				return errors.Trace(err)
+			}
+			removedTopics = append(removedTopics, topic)
+		}
+	}
+	if len(removedTopics) > 0 {
+		if err = w.CacheClient.RemSet(cache.SubscriptionTopics, removedTopics...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(topics) > 0 {
+		if err = w.CacheClient.AddSet(cache.SubscriptionTopics, topics...); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	log.Logger().Info("complete updating subscription items",
+		zap.Int("n_topics", len(topics)),
+		zap.Int("n_removed_topics", len(removedTopics)),
+		zap.Duration("used_time", time.Since(startTime)))
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 gorse Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/storage/cache"
+	"github.com/zhenghaoz/gorse/storage/data"
+)
+
+func TestSubscriptionScore(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 3.0, subscriptionScore(2, now, time.Hour, now))
+	assert.Equal(t, 1.5, subscriptionScore(2, now.Add(-time.Hour), time.Hour, now))
+	// items published in the future aren't boosted
+	assert.Equal(t, 3.0, subscriptionScore(2, now.Add(time.Hour), time.Hour, now))
+}
+
+func TestWorker_UpdateSubscriptionItems(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	peers := []string{"worker"}
+	now := time.Now()
+	itemCache := NewItemCache()
+	itemCache.Set("1", data.Item{ItemId: "1", Labels: []string{"a"}, Timestamp: now})
+	itemCache.Set("2", data.Item{ItemId: "2", Labels: []string{"a"}, Categories: []string{"c"}, Timestamp: now.Add(-time.Hour)})
+	itemCache.Set("3", data.Item{ItemId: "3", Labels: []string{"a"}, IsHidden: true, Timestamp: now})
+	err := w.CacheClient.SetSorted(cache.Key(cache.PopularItems, ""), []cache.Scored{{Id: "2", Score: 10}})
+	assert.NoError(t, err)
+
+	// lists aren't maintained without the subscription stage
+	err = w.updateSubscriptionItems(itemCache, peers, "worker")
+	assert.NoError(t, err)
+	topics, err := w.CacheClient.GetSet(cache.SubscriptionTopics)
+	assert.NoError(t, err)
+	assert.Empty(t, topics)
+
+	// items are ranked by popularity decayed by age
+	w.Config.Recommend.Online.FallbackRecommend = []string{config.StageSubscription}
+	err = w.updateSubscriptionItems(itemCache, peers, "worker")
+	assert.NoError(t, err)
+	items, err := w.CacheClient.GetSorted(cache.Key(cache.SubscriptionItems, "a"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "1"}, cache.RemoveScores(items))
+	items, err = w.CacheClient.GetSorted(cache.Key(cache.SubscriptionItems, "c"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2"}, cache.RemoveScores(items))
+	topics, err = w.CacheClient.GetSet(cache.SubscriptionTopics)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "c"}, topics)
+
+	// lists of topics without items are removed
+	itemCache = NewItemCache()
+	itemCache.Set("1", data.Item{ItemId: "1", Labels: []string{"a"}, Timestamp: now})
+	err = w.updateSubscriptionItems(itemCache, peers, "worker")
+	assert.NoError(t, err)
+	items, err = w.CacheClient.GetSorted(cache.Key(cache.SubscriptionItems, "c"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+	topics, err = w.CacheClient.GetSet(cache.SubscriptionTopics)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, topics)
+
+	// the worker should be in the hash ring
+	err = w.updateSubscriptionItems(itemCache, peers, "other")
+	assert.Error(t, err)
+}
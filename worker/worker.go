@@ -26,6 +26,7 @@ import (
 	"github.com/scylladb/go-set/strset"
 	"github.com/thoas/go-funk"
 	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/bloom"
 	"github.com/zhenghaoz/gorse/base/encoding"
 	"github.com/zhenghaoz/gorse/base/heap"
 	"github.com/zhenghaoz/gorse/base/log"
@@ -34,8 +35,10 @@ import (
 	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/cmd/version"
 	"github.com/zhenghaoz/gorse/config"
+	"github.com/zhenghaoz/gorse/model/blend"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/model/rerank"
 	"github.com/zhenghaoz/gorse/protocol"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
@@ -47,6 +50,7 @@ import (
 	"math/rand"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 )
@@ -54,6 +58,7 @@ import (
 const (
 	batchSize                 = 10000
 	recommendComplexityFactor = 100
+	scoreBlockSize            = 256
 )
 
 // Worker manages states of a worker node.
@@ -77,26 +82,55 @@ type Worker struct {
 	dataPath    string
 	dataPrefix  string
 
+	// offline recommendation is written under the production prefix, or the other prefix in dry-run mode
+	shadowCache *cache.Shadow
+	dryRun      bool
+
+	// user ids in cache keys are replaced by digests
+	obfuscator *cache.Obfuscator
+
 	// master connection
 	masterClient protocol.MasterClient
 
 	latestRankingModelVersion int64
 	latestClickModelVersion   int64
-	rankingIndex              *search.HNSW
+	rankingIndex              rankingIndexBuffer
+	reranker                  *rerank.Reranker
+
+	// canary ranking model serving canary users
+	canaryRankingModel              ranking.MatrixFactorization
+	canaryRankingModelVersion       int64
+	latestCanaryRankingModelVersion int64
 
 	// peers
 	peers []string
 	me    string
 
+	// incremental update
+	incrementalCheckpoint time.Time
+
 	// events
-	tickDuration time.Duration
-	ticker       *time.Ticker
-	syncedChan   chan bool // meta synced events
-	pulledChan   chan bool // model pulled events
+	tickDuration            time.Duration
+	ticker                  *time.Ticker
+	incrementalTickDuration time.Duration
+	incrementalTicker       *time.Ticker
+	syncedChan              chan bool // meta synced events
+	pulledChan              chan bool // model pulled events
+	rebalancedChan          chan bool // workers joined or left events
+	checkpointBatch         int       // number of users between checkpoints
+	priorityWindowStart     time.Time // start of the current minute of priority refresh
+	priorityRefreshCount    int       // number of priority users refreshed in the current minute
+
+	// graceful shutdown
+	ctx           context.Context // cancelled once the worker is asked to shut down
+	cancel        context.CancelFunc
+	stopped       chan struct{} // closed once the serving loop exits
+	metricsServer *http.Server  // created before serving, so that shutdown never races with serving
 }
 
 // NewWorker creates a new worker node.
 func NewWorker(masterHost string, masterPort int, httpHost string, httpPort, jobs int, cacheFile string) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Worker{
 		Settings: config.NewSettings(),
 		// config
@@ -107,13 +141,83 @@ func NewWorker(masterHost string, masterPort int, httpHost string, httpPort, job
 		httpPort:   httpPort,
 		jobs:       jobs,
 		// events
-		tickDuration: time.Minute,
-		ticker:       time.NewTicker(time.Minute),
-		syncedChan:   make(chan bool, 1024),
-		pulledChan:   make(chan bool, 1024),
+		tickDuration:            time.Minute,
+		ticker:                  time.NewTicker(time.Minute),
+		incrementalTickDuration: 10 * time.Minute,
+		incrementalTicker:       time.NewTicker(10 * time.Minute),
+		syncedChan:              make(chan bool, 1024),
+		pulledChan:              make(chan bool, 1024),
+		rebalancedChan:          make(chan bool, 1),
+		checkpointBatch:         checkpointBatchSize,
+		reranker:                rerank.NewReranker(),
+		// graceful shutdown
+		ctx:           ctx,
+		cancel:        cancel,
+		stopped:       make(chan struct{}),
+		metricsServer: &http.Server{Addr: fmt.Sprintf("%s:%d", httpHost, httpPort)},
+	}
+}
+
+// shutdownTimeout is the max duration to wait for the serving loop to exit.
+const shutdownTimeout = time.Minute
+
+// shuttingDown returns true once the worker is asked to shut down.
+func (w *Worker) shuttingDown() bool {
+	return w.ctx != nil && w.ctx.Err() != nil
+}
+
+// Shutdown stops the worker gracefully. Users being recommended are finished and the rest are left to the next run,
+// then a clean checkpoint is marked and connections to databases are closed. Databases are shared with the master in
+// one mode, so they are left open. The serving loop might never exit if it is stuck before the loop starts, so it is
+// waited for shutdownTimeout at most.
+func (w *Worker) Shutdown() {
+	w.cancel()
+	select {
+	case <-w.stopped:
+	case <-time.After(shutdownTimeout):
+		log.Logger().Warn("worker doesn't stop in time", zap.Duration("timeout", shutdownTimeout))
+	}
+	if w.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), w.Config.Server.DrainTimeout)
+		defer cancel()
+		if err := w.metricsServer.Shutdown(ctx); err != nil {
+			log.Logger().Error("failed to shutdown http server", zap.Error(err))
+		}
+	}
+	err := w.CacheClient.Set(cache.Time(cache.Key(cache.WorkerCheckpoint, w.workerName), time.Now()))
+	if err != nil && !errors.Is(err, errors.NotAssigned) {
+		log.Logger().Error("failed to mark checkpoint", zap.Error(err))
+	}
+	if !w.oneMode {
+		if err := w.CloseDatabases(); err != nil {
+			log.Logger().Error("failed to close databases", zap.Error(err))
+		}
 	}
 }
 
+// SetDryRun makes the worker write shadow recommendation for all users. A dry-run worker registers as a client, so
+// that it isn't assigned a shard of production users, and it leaves the priority refresh queue to production workers.
+func (w *Worker) SetDryRun() {
+	w.dryRun = true
+}
+
+// syncShadowPrefix redirects offline recommendation to the production prefix, or the shadow prefix in dry-run mode.
+func (w *Worker) syncShadowPrefix() error {
+	prefix, err := cache.ProductionPrefix(w.shadowCache.Database)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if w.dryRun {
+		prefix = cache.CandidatePrefix(prefix, w.Config.Recommend.Offline.ShadowPrefix)
+	}
+	if prefix != w.shadowCache.Prefix() {
+		log.Logger().Info("switch prefix of offline recommendation",
+			zap.Bool("dry_run", w.dryRun), zap.String("prefix", prefix))
+		w.shadowCache.SetPrefix(prefix)
+	}
+	return nil
+}
+
 func (w *Worker) SetOneMode(settings *config.Settings) {
 	w.oneMode = true
 	w.Settings = settings
@@ -126,9 +230,13 @@ func (w *Worker) Sync() {
 	for {
 		var meta *protocol.Meta
 		var err error
+		nodeType := protocol.NodeType_WorkerNode
+		if w.dryRun {
+			nodeType = protocol.NodeType_ClientNode
+		}
 		if meta, err = w.masterClient.GetMeta(context.Background(),
 			&protocol.NodeInfo{
-				NodeType:      protocol.NodeType_WorkerNode,
+				NodeType:      nodeType,
 				NodeName:      w.workerName,
 				HttpPort:      int64(w.httpPort),
 				BinaryVersion: version.Version,
@@ -152,15 +260,22 @@ func (w *Worker) Sync() {
 			w.tickDuration = w.Config.Recommend.Offline.CheckRecommendPeriod
 			w.ticker.Reset(w.Config.Recommend.Offline.CheckRecommendPeriod)
 		}
+		if w.incrementalTickDuration != w.Config.Recommend.Incremental.UpdatePeriod {
+			w.incrementalTickDuration = w.Config.Recommend.Incremental.UpdatePeriod
+			w.incrementalTicker.Reset(w.Config.Recommend.Incremental.UpdatePeriod)
+		}
 
 		// connect to data store
 		if w.dataPath != w.Config.Database.DataStore || w.dataPrefix != w.Config.Database.TablePrefix {
 			log.Logger().Info("connect data store",
 				zap.String("database", log.RedactDBURL(w.Config.Database.DataStore)))
-			if w.DataClient, err = data.Open(w.Config.Database.DataStore, w.Config.Database.TablePrefix); err != nil {
+			dataClient, err := data.Open(w.Config.Database.DataStore, w.Config.Database.TablePrefix)
+			if err != nil {
 				log.Logger().Error("failed to connect data store", zap.Error(err))
 				goto sleep
 			}
+			data.SetBatchGetOptions(dataClient, w.Config.Database.BatchGetChunkSize, w.Config.Database.BatchGetJobs)
+			w.DataClient = data.NewCommentCompressor(dataClient, w.Config.Database.CommentThreshold())
 			w.dataPath = w.Config.Database.DataStore
 			w.dataPrefix = w.Config.Database.TablePrefix
 		}
@@ -169,21 +284,47 @@ func (w *Worker) Sync() {
 		if w.cachePath != w.Config.Database.CacheStore || w.cachePrefix != w.Config.Database.TablePrefix {
 			log.Logger().Info("connect cache store",
 				zap.String("database", log.RedactDBURL(w.Config.Database.CacheStore)))
-			if w.CacheClient, err = cache.Open(w.Config.Database.CacheStore, w.Config.Database.TablePrefix); err != nil {
+			cacheClient, err := cache.Open(w.Config.Database.CacheStore, w.Config.Database.TablePrefix)
+			if err != nil {
 				log.Logger().Error("failed to connect cache store", zap.Error(err))
 				goto sleep
 			}
+			w.obfuscator = cache.NewObfuscator(cacheClient,
+				w.Config.Database.IdObfuscationSecret, w.Config.Database.IdObfuscationPreviousSecret)
+			log.SetUserIdObfuscator(w.obfuscator.Digest)
+			w.shadowCache = cache.NewShadow(w.obfuscator, "")
+			w.CacheClient = w.shadowCache
 			w.cachePath = w.Config.Database.CacheStore
 			w.cachePrefix = w.Config.Database.TablePrefix
 		}
 
+		// follow rotation of the obfuscation secret
+		if w.obfuscator != nil {
+			w.obfuscator.SetSecrets(w.Config.Database.IdObfuscationSecret, w.Config.Database.IdObfuscationPreviousSecret)
+		}
+
+		// follow promotion of shadow recommendation
+		if err = w.syncShadowPrefix(); err != nil {
+			log.Logger().Error("failed to read prefix of offline recommendation", zap.Error(err))
+			goto sleep
+		}
+
 		// check ranking model version
 		w.latestRankingModelVersion = meta.RankingModelVersion
+		if w.latestCanaryRankingModelVersion, err = w.readCanaryVersion(); err != nil {
+			log.Logger().Error("failed to read version of canary ranking model", zap.Error(err))
+			goto sleep
+		}
 		if w.latestRankingModelVersion != w.RankingModelVersion {
 			log.Logger().Info("new ranking model found",
 				zap.String("old_version", encoding.Hex(w.RankingModelVersion)),
 				zap.String("new_version", encoding.Hex(w.latestRankingModelVersion)))
 			w.syncedChan <- true
+		} else if w.latestCanaryRankingModelVersion != w.canaryRankingModelVersion {
+			log.Logger().Info("new canary ranking model found",
+				zap.String("old_version", encoding.Hex(w.canaryRankingModelVersion)),
+				zap.String("new_version", encoding.Hex(w.latestCanaryRankingModelVersion)))
+			w.syncedChan <- true
 		}
 
 		// check click model version
@@ -195,7 +336,22 @@ func (w *Worker) Sync() {
 			w.syncedChan <- true
 		}
 
-		w.peers = meta.Workers
+		// rebalance users once workers join or leave
+		if w.peers != nil && !w.dryRun && !strset.New(w.peers...).IsEqual(strset.New(meta.Workers...)) {
+			log.Logger().Info("workers changed, rebalance users",
+				zap.Strings("old_workers", w.peers),
+				zap.Strings("new_workers", meta.Workers))
+			select {
+			case w.rebalancedChan <- true:
+			default:
+			}
+		}
+		if w.dryRun {
+			// a dry-run worker recommends all users
+			w.peers = []string{meta.Me}
+		} else {
+			w.peers = meta.Workers
+		}
 		w.me = meta.Me
 	sleep:
 		if w.testMode {
@@ -211,6 +367,12 @@ func (w *Worker) Pull() {
 	for range w.syncedChan {
 		pulled := false
 
+		// the canary ranking model becomes the default ranking model after promotion
+		if w.canaryRankingModel != nil && w.latestRankingModelVersion == w.canaryRankingModelVersion {
+			w.swapCanaryRankingModel()
+			pulled = true
+		}
+
 		// pull ranking model
 		if w.latestRankingModelVersion != w.RankingModelVersion {
 			log.Logger().Info("start pull ranking model")
@@ -225,8 +387,8 @@ func (w *Worker) Pull() {
 					log.Logger().Error("failed to unmarshal ranking model", zap.Error(err))
 				} else {
 					w.RankingModel = rankingModel
-					w.rankingIndex = nil
 					w.RankingModelVersion = w.latestRankingModelVersion
+					w.resetIncrementalCheckpoint()
 					log.Logger().Info("synced ranking model",
 						zap.String("version", encoding.Hex(w.RankingModelVersion)))
 					MemoryInuseBytesVec.WithLabelValues("collaborative_filtering_model").Set(float64(w.RankingModel.Bytes()))
@@ -235,6 +397,11 @@ func (w *Worker) Pull() {
 			}
 		}
 
+		// pull canary ranking model
+		if w.latestCanaryRankingModelVersion != w.canaryRankingModelVersion {
+			pulled = w.pullCanaryRankingModel() || pulled
+		}
+
 		// pull click model
 		if w.latestClickModelVersion != w.ClickModelVersion {
 			log.Logger().Info("start pull click model")
@@ -270,14 +437,14 @@ func (w *Worker) Pull() {
 // ServeMetrics serves Prometheus metrics.
 func (w *Worker) ServeMetrics() {
 	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", w.httpHost, w.httpPort), nil)
-	if err != nil {
+	if err := w.metricsServer.ListenAndServe(); err != http.ErrServerClosed {
 		log.Logger().Fatal("failed to start http server", zap.Error(err))
 	}
 }
 
 // Serve as a worker node.
 func (w *Worker) Serve() {
+	defer close(w.stopped)
 	rand.Seed(time.Now().UTC().UnixNano())
 	// open local store
 	if !w.oneMode {
@@ -333,21 +500,37 @@ func (w *Worker) Serve() {
 		w.Recommend(workingUsers)
 	}
 
+	priorityTicker := time.NewTicker(priorityRefreshPeriod)
+	defer priorityTicker.Stop()
 	for {
 		select {
+		case <-w.ctx.Done():
+			log.Logger().Info("stop worker")
+			return
 		case tick := <-w.ticker.C:
 			if time.Since(tick) < w.Config.Recommend.Offline.CheckRecommendPeriod {
 				loop()
 			}
 		case <-w.pulledChan:
 			loop()
+		case <-w.rebalancedChan:
+			loop()
+		case <-priorityTicker.C:
+			w.refreshPriorityUsers()
+		case tick := <-w.incrementalTicker.C:
+			if w.Config.Recommend.Incremental.EnableIncrementalUpdate &&
+				time.Since(tick) < w.Config.Recommend.Incremental.UpdatePeriod {
+				if err := w.incrementalUpdate(); err != nil {
+					log.Logger().Error("failed to update model incrementally", zap.Error(err))
+				}
+			}
 		}
 	}
 }
 
 func (w *Worker) estimateRecommendComplexity(numUsers, numItems int) int {
 	complexity := numUsers * numItems * recommendComplexityFactor
-	if w.Config.Recommend.Collaborative.EnableIndex {
+	if w.useRankingIndex(numItems) && !w.rankingIndex.IsServing() {
 		complexity += search.EstimateHNSWBuilderComplexity(numItems, w.Config.Recommend.Collaborative.IndexFitEpoch)
 	}
 	return complexity
@@ -363,8 +546,15 @@ func (w *Worker) estimateRecommendComplexity(numUsers, numItems int) int {
 // 7. Rank items in results by click-through-rate.
 // 8. Refresh cache.
 func (w *Worker) Recommend(users []data.User) {
+	w.recommend(users, true)
+}
+
+// recommend items to users. Progress of a full cycle is checkpointed, while refreshing priority users isn't. It
+// returns true if all users are recommended.
+func (w *Worker) recommend(users []data.User, fullCycle bool) bool {
 	startRecommendTime := time.Now()
 	log.Logger().Info("ranking recommendation",
+		zap.Bool("full_cycle", fullCycle),
 		zap.Int("n_working_users", len(users)),
 		zap.Int("n_jobs", w.jobs),
 		zap.Int("cache_size", w.Config.Recommend.CacheSize))
@@ -373,23 +563,29 @@ func (w *Worker) Recommend(users []data.User) {
 	itemCache, itemCategories, err := w.pullItems()
 	if err != nil {
 		log.Logger().Error("failed to pull items", zap.Error(err))
-		return
+		return false
 	}
 	MemoryInuseBytesVec.WithLabelValues("item_cache").Set(float64(itemCache.Bytes()))
 	defer MemoryInuseBytesVec.WithLabelValues("item_cache").Set(0)
 
+	// candidate lists of subscription topics are updated in full cycles
+	if fullCycle {
+		if err = w.updateSubscriptionItems(itemCache, w.peers, w.me); err != nil {
+			log.Logger().Error("failed to update subscription items", zap.Error(err))
+		}
+	}
+
 	// progress tracker
 	completed := make(chan struct{}, 1000)
 	recommendTaskName := "Generate offline recommendation"
+	if !fullCycle {
+		recommendTaskName = "Refresh priority users"
+	}
 	if !w.oneMode {
 		recommendTaskName += fmt.Sprintf(" [%s]", w.workerName)
 	}
 	recommendTask := task.NewTask(recommendTaskName, w.estimateRecommendComplexity(len(users), itemCache.Len()))
-	if w.masterClient != nil {
-		if _, err := w.masterClient.PushTaskInfo(context.Background(), protocol.EncodeTask(recommendTask)); err != nil {
-			log.Logger().Error("failed to report start task", zap.Error(err))
-		}
-	}
+	w.reportTask(recommendTask)
 
 	go func() {
 		defer base.CheckPanic()
@@ -414,40 +610,23 @@ func (w *Worker) Recommend(users []data.User) {
 						zap.Int("n_working_users", len(users)),
 						zap.Int("throughput", throughput))
 				}
-				if _, err := w.masterClient.PushTaskInfo(context.Background(), protocol.EncodeTask(recommendTask)); err != nil {
-					log.Logger().Error("failed to report update task", zap.Error(err))
-				}
+				w.reportTask(recommendTask)
 			}
 		}
 	}()
 
 	// build ranking index
-	if w.RankingModel != nil && !w.RankingModel.Invalid() && w.rankingIndex == nil {
-		if w.Config.Recommend.Collaborative.EnableIndex {
-			startTime := time.Now()
-			log.Logger().Info("start building ranking index")
-			itemIndex := w.RankingModel.GetItemIndex()
-			vectors := make([]search.Vector, itemIndex.Len())
-			for i := int32(0); i < itemIndex.Len(); i++ {
-				itemId := itemIndex.ToName(i)
-				if itemCache.IsAvailable(itemId) {
-					vectors[i] = search.NewDenseVector(w.RankingModel.GetItemFactor(i), itemCache.GetCategory(itemId), false)
-				} else {
-					vectors[i] = search.NewDenseVector(w.RankingModel.GetItemFactor(i), nil, true)
-				}
-			}
-			builder := search.NewHNSWBuilder(vectors, w.Config.Recommend.CacheSize, w.jobs)
-			var recall float32
-			w.rankingIndex, recall = builder.Build(w.Config.Recommend.Collaborative.IndexRecall,
-				w.Config.Recommend.Collaborative.IndexFitEpoch, false, recommendTask)
-			CollaborativeFilteringIndexRecall.Set(float64(recall))
-			if err = w.CacheClient.Set(cache.String(cache.Key(cache.GlobalMeta, cache.MatchingIndexRecall), encoding.FormatFloat32(recall))); err != nil {
-				log.Logger().Error("failed to write meta", zap.Error(err))
-			}
-			log.Logger().Info("complete building ranking index",
-				zap.Duration("build_time", time.Since(startTime)))
-		} else {
+	if rankingModel, version := w.RankingModel, w.RankingModelVersion; rankingModel != nil && !rankingModel.Invalid() {
+		if !w.useRankingIndex(int(rankingModel.GetItemIndex().Len())) {
+			w.rankingIndex.Reset()
 			CollaborativeFilteringIndexRecall.Set(1)
+		} else if key, ok := w.rankingIndex.StartBuild(version); ok {
+			if w.rankingIndex.IsServing() {
+				// the current index keeps serving until the new index is built
+				go w.buildRankingIndex(key, rankingModel, itemCache, nil)
+			} else {
+				w.buildRankingIndex(key, rankingModel, itemCache, recommendTask)
+			}
 		}
 	}
 
@@ -455,6 +634,7 @@ func (w *Worker) Recommend(users []data.User) {
 	startTime := time.Now()
 	var (
 		updateUserCount               atomic.Float64
+		skipUserCount                 atomic.Float64
 		collaborativeRecommendSeconds atomic.Float64
 		userBasedRecommendSeconds     atomic.Float64
 		itemBasedRecommendSeconds     atomic.Float64
@@ -462,16 +642,45 @@ func (w *Worker) Recommend(users []data.User) {
 		popularRecommendSeconds       atomic.Float64
 	)
 
+	hiddenItems, err := w.loadHiddenItems(itemCategories)
+	if err != nil {
+		log.Logger().Error("failed to load hidden items", zap.Error(err))
+		return false
+	}
+	blendWeights, err := w.loadBlendWeights()
+	if err != nil {
+		log.Logger().Error("failed to load blend weights", zap.Error(err))
+		return false
+	}
+	requestTime := w.lastRequestOfflineRecommendTime()
+	cachedSizes := NewRecommendSizes()
 	userFeedbackCache := NewFeedbackCache(w.DataClient, w.Config.Recommend.DataSource.PositiveFeedbackTypes...)
 	defer MemoryInuseBytesVec.WithLabelValues("user_feedback_cache").Set(0)
-	err = parallel.Parallel(len(users), w.jobs, func(workerId, jobId int) error {
+	recommendUser := func(jobId int) error {
 		defer func() {
 			completed <- struct{}{}
 		}()
+		// skip remaining users once cancelled or shutting down, users being recommended are finished
+		if recommendTask.Cancelled() || w.shuttingDown() {
+			return nil
+		}
 		user := users[jobId]
 		userId := user.UserId
 		// skip inactive users before max recommend period
-		if !w.checkRecommendCacheTimeout(userId, itemCategories) {
+		if !w.checkRecommendCacheTimeout(userId, itemCategories, requestTime) {
+			skipUserCount.Add(1)
+			// only full cycles are counted
+			if w.Config.Recommend.Offline.SkipUnchangedUsers && fullCycle {
+				if err := w.skipUnchangedUser(userId); err != nil {
+					log.Logger().Error("failed to count skipped cycles of offline recommendation",
+						log.UserId(userId), zap.Error(err))
+				}
+			}
+			// remove items hidden after the cache was generated
+			if err := w.removeHiddenItems(userId, hiddenItems); err != nil {
+				log.Logger().Error("failed to remove hidden items from offline recommendation",
+					log.UserId(userId), zap.Error(err))
+			}
 			return nil
 		}
 		updateUserCount.Add(1)
@@ -481,9 +690,15 @@ func (w *Worker) Recommend(users []data.User) {
 		excludeSet := set.NewStringSet(historyItems...)
 		if err != nil {
 			log.Logger().Error("failed to pull user feedback",
-				zap.String("user_id", userId), zap.Error(err))
+				log.UserId(userId), zap.Error(err))
 			return errors.Trace(err)
 		}
+		if w.Config.Recommend.ConsumedFilter.EnableConsumedFilter {
+			if err = w.rebuildConsumedFilter(userId, excludeSet.List()); err != nil {
+				log.Logger().Error("failed to rebuild consumed filter",
+					log.UserId(userId), zap.Error(err))
+			}
+		}
 
 		// load positive items
 		var positiveItems []string
@@ -491,7 +706,7 @@ func (w *Worker) Recommend(users []data.User) {
 			positiveItems, err = userFeedbackCache.GetUserFeedback(userId)
 			if err != nil {
 				log.Logger().Error("failed to pull user feedback",
-					zap.String("user_id", userId), zap.Error(err))
+					log.UserId(userId), zap.Error(err))
 				return errors.Trace(err)
 			}
 			MemoryInuseBytesVec.WithLabelValues("user_feedback_cache").Set(float64(userFeedbackCache.Bytes()))
@@ -506,18 +721,25 @@ func (w *Worker) Recommend(users []data.User) {
 
 		// Recommender #1: collaborative filtering.
 		collaborativeUsed := false
-		if w.Config.Recommend.Offline.EnableColRecommend && w.RankingModel != nil && !w.RankingModel.Invalid() {
-			if userIndex := w.RankingModel.GetUserIndex().ToNumber(userId); w.RankingModel.IsUserPredictable(userIndex) {
+		rankingModel, rankingModelVersion := w.rankingModelFor(userId)
+		if w.Config.Recommend.Offline.EnableColRecommend && rankingModel != nil && !rankingModel.Invalid() {
+			if userIndex := rankingModel.GetUserIndex().ToNumber(userId); rankingModel.IsUserPredictable(userIndex) {
 				var recommend map[string][]string
 				var usedTime time.Duration
-				if w.Config.Recommend.Collaborative.EnableIndex && w.rankingIndex != nil {
-					recommend, usedTime, err = w.collaborativeRecommendHNSW(w.rankingIndex, userId, itemCategories, excludeSet, itemCache)
+				// the index is built for the default model only
+				if rankingIndex := w.rankingIndex.Acquire(); rankingIndex != nil && rankingModelVersion == w.RankingModelVersion &&
+					rankingIndex.model.IsUserPredictable(rankingIndex.model.GetUserIndex().ToNumber(userId)) {
+					recommend, usedTime, err = w.collaborativeRecommendHNSW(rankingIndex, userId, itemCategories, excludeSet, itemCache)
+					w.rankingIndex.Release(rankingIndex)
 				} else {
+					if rankingIndex != nil {
+						w.rankingIndex.Release(rankingIndex)
+					}
 					recommend, usedTime, err = w.collaborativeRecommendBruteForce(userId, itemCategories, excludeSet, itemCache)
 				}
 				if err != nil {
 					log.Logger().Error("failed to recommend by collaborative filtering",
-						zap.String("user_id", userId), zap.Error(err))
+						log.UserId(userId), zap.Error(err))
 					return errors.Trace(err)
 				}
 				for category, items := range recommend {
@@ -525,10 +747,10 @@ func (w *Worker) Recommend(users []data.User) {
 				}
 				collaborativeUsed = true
 				collaborativeRecommendSeconds.Add(usedTime.Seconds())
-			} else if !w.RankingModel.IsUserPredictable(userIndex) {
-				log.Logger().Debug("user is unpredictable", zap.String("user_id", userId))
+			} else if !rankingModel.IsUserPredictable(userIndex) {
+				log.Logger().Debug("user is unpredictable", log.UserId(userId))
 			}
-		} else if w.RankingModel == nil || w.RankingModel.Invalid() {
+		} else if rankingModel == nil || rankingModel.Invalid() {
 			log.Logger().Debug("no collaborative filtering model")
 		}
 
@@ -541,7 +763,7 @@ func (w *Worker) Recommend(users []data.User) {
 				scores := make(map[string]float64)
 				for _, itemId := range positiveItems {
 					// load similar items
-					similarItems, err := w.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, itemId, category), 0, w.Config.Recommend.CacheSize)
+					similarItems, err := w.loadItemNeighbors(itemId, category, itemCache)
 					if err != nil {
 						log.Logger().Error("failed to load similar items", zap.Error(err))
 						return errors.Trace(err)
@@ -563,7 +785,7 @@ func (w *Worker) Recommend(users []data.User) {
 					itemNeighborDigests.Add(digest)
 				}
 				// collect top k
-				filter := heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSize)
+				filter := heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSizeOf(category))
 				for id, score := range scores {
 					filter.Push(id, score)
 				}
@@ -589,7 +811,7 @@ func (w *Worker) Recommend(users []data.User) {
 				similarUserPositiveItems, err := userFeedbackCache.GetUserFeedback(user.Id)
 				if err != nil {
 					log.Logger().Error("failed to pull user feedback",
-						zap.String("user_id", userId), zap.Error(err))
+						log.UserId(userId), zap.Error(err))
 					return errors.Trace(err)
 				}
 				MemoryInuseBytesVec.WithLabelValues("user_feedback_cache").Set(float64(userFeedbackCache.Bytes()))
@@ -613,7 +835,7 @@ func (w *Worker) Recommend(users []data.User) {
 			filters := make(map[string]*heap.TopKFilter[string, float64])
 			filters[""] = heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSize)
 			for _, category := range itemCategories {
-				filters[category] = heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSize)
+				filters[category] = heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSizeOf(category))
 			}
 			for id, score := range scores {
 				filters[""].Push(id, score)
@@ -632,7 +854,7 @@ func (w *Worker) Recommend(users []data.User) {
 		if w.Config.Recommend.Offline.EnableLatestRecommend {
 			localStartTime := time.Now()
 			for _, category := range append([]string{""}, itemCategories...) {
-				latestItems, err := w.CacheClient.GetSorted(cache.Key(cache.LatestItems, category), 0, w.Config.Recommend.CacheSize)
+				latestItems, err := w.CacheClient.GetSorted(cache.Key(cache.LatestItems, category), 0, w.Config.Recommend.CacheSizeOf(category))
 				if err != nil {
 					log.Logger().Error("failed to load latest items", zap.Error(err))
 					return errors.Trace(err)
@@ -652,7 +874,7 @@ func (w *Worker) Recommend(users []data.User) {
 		if w.Config.Recommend.Offline.EnablePopularRecommend {
 			localStartTime := time.Now()
 			for _, category := range append([]string{""}, itemCategories...) {
-				popularItems, err := w.CacheClient.GetSorted(cache.Key(cache.PopularItems, category), 0, w.Config.Recommend.CacheSize)
+				popularItems, err := w.CacheClient.GetSorted(cache.Key(cache.PopularItems, category), 0, w.Config.Recommend.CacheSizeOf(category))
 				if err != nil {
 					log.Logger().Error("failed to load popular items", zap.Error(err))
 					return errors.Trace(err)
@@ -669,21 +891,25 @@ func (w *Worker) Recommend(users []data.User) {
 		}
 
 		// rank items from different recommenders
-		// 1. If click-through rate prediction model is available, use it to rank items.
-		// 2. If collaborative filtering model is available, use it to rank items.
-		// 3. Otherwise, merge all recommenders' results randomly.
+		// 1. If score blending is enabled, rank items by blended scores.
+		// 2. If click-through rate prediction model is available, use it to rank items.
+		// 3. If collaborative filtering model is available, use it to rank items.
+		// 4. Otherwise, merge all recommenders' results randomly.
 		ctrUsed := false
 		results := make(map[string][]cache.Scored)
 		for category, catCandidates := range candidates {
-			if w.Config.Recommend.Offline.EnableClickThroughPrediction && w.ClickModel != nil && !w.ClickModel.Invalid() {
+			if w.Config.Recommend.Blend.EnableBlend {
+				results[category] = w.rankByBlendedScores(&user, catCandidates, itemCache, blendWeights)
+				ctrUsed = w.clickModelAvailable()
+			} else if w.clickModelAvailable() {
 				results[category], err = w.rankByClickTroughRate(&user, catCandidates, itemCache)
 				if err != nil {
 					log.Logger().Error("failed to rank items", zap.Error(err))
 					return errors.Trace(err)
 				}
 				ctrUsed = true
-			} else if w.RankingModel != nil && !w.RankingModel.Invalid() &&
-				w.RankingModel.IsUserPredictable(w.RankingModel.GetUserIndex().ToNumber(userId)) {
+			} else if rankingModel != nil && !rankingModel.Invalid() &&
+				rankingModel.IsUserPredictable(rankingModel.GetUserIndex().ToNumber(userId)) {
 				results[category], err = w.rankByCollaborativeFiltering(userId, catCandidates)
 				if err != nil {
 					log.Logger().Error("failed to rank items", zap.Error(err))
@@ -694,6 +920,13 @@ func (w *Worker) Recommend(users []data.User) {
 			}
 		}
 
+		// re-rank by the external scorer
+		if w.reranker != nil && rerank.Enabled(w.Config.Recommend.Rerank, rerank.StageWorker) {
+			for category, result := range results {
+				results[category] = w.rerank(&user, category, result, itemCache)
+			}
+		}
+
 		// replacement
 		if w.Config.Recommend.Replacement.EnableReplacement {
 			if results, err = w.replacement(results, &user, feedbacks, itemCache); err != nil {
@@ -703,28 +936,39 @@ func (w *Worker) Recommend(users []data.User) {
 		}
 
 		// explore latest and popular
+		writes := make([]cache.Write, 0, len(results)+2)
 		for category, result := range results {
 			results[category], err = w.exploreRecommend(result, excludeSet, category)
 			if err != nil {
 				log.Logger().Error("failed to explore latest and popular items", zap.Error(err))
 				return errors.Trace(err)
 			}
-
-			if err = w.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, userId, category), results[category]); err != nil {
-				log.Logger().Error("failed to cache recommendation", zap.Error(err))
-				return errors.Trace(err)
+			// keep the configured length of recommendation in the category
+			if size := w.Config.Recommend.CacheSizeOf(category); len(results[category]) > size {
+				results[category] = results[category][:size]
 			}
+			writes = append(writes, cache.WriteSorted(cache.Key(cache.OfflineRecommend, userId, category), results[category]))
 		}
-		if err = w.CacheClient.Set(
-			cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, userId), time.Now()),
-			cache.String(cache.Key(cache.OfflineRecommendDigest, userId), w.Config.OfflineRecommendDigest(
+		// recommendation and its update time are written together, so that staleness is never underestimated
+		writes = append(writes,
+			cache.WriteValue(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, userId), time.Now())),
+			cache.WriteValue(cache.String(cache.Key(cache.OfflineRecommendDigest, userId), w.Config.OfflineRecommendDigest(
 				config.WithCollaborative(collaborativeUsed),
 				config.WithRanking(ctrUsed),
 				config.WithItemNeighborDigest(strings.Join(itemNeighborDigests.List(), "-")),
 				config.WithUserNeighborDigest(strings.Join(userNeighborDigests.List(), "-")),
-			))); err != nil {
-			log.Logger().Error("failed to cache recommendation time", zap.Error(err))
+			))),
+			cache.WriteValue(cache.String(cache.Key(cache.OfflineRecommendModel, userId), w.recommendModelVersion(userId))),
+			cache.WriteValue(cache.Integer(cache.Key(cache.OfflineRecommendSkips, userId), 0)))
+		if w.Config.Recommend.Collaborative.CanaryPercent > 0 {
+			// tag recommendation with the generation of the ranking model
+			writes = append(writes, cache.WriteValue(cache.String(cache.Key(cache.RankingGeneration, userId), encoding.Hex(rankingModelVersion))))
 		}
+		if err = w.CacheClient.WriteDocuments(writes...); err != nil {
+			log.Logger().Error("failed to cache recommendation", zap.Error(err))
+			return errors.Trace(err)
+		}
+		cachedSizes.Add(results)
 
 		// refresh cache
 		err = w.refreshCache(userId)
@@ -733,72 +977,230 @@ func (w *Worker) Recommend(users []data.User) {
 			return errors.Trace(err)
 		}
 		return nil
-	})
+	}
+
+	// recommend users batch by batch from the checkpoint, at most one batch is redone after restart
+	checkpoint := &Checkpoint{}
+	if fullCycle {
+		checkpoint = w.loadCheckpoint()
+		users = sortUsers(users)
+	}
+	batch := w.checkpointBatch
+	if batch <= 0 {
+		batch = checkpointBatchSize
+	}
+	maxBatch := batch
+	var peakMemory uint64
+	cursor := checkpoint.cursor(users)
+	for cursor < len(users) && !recommendTask.Cancelled() && !w.shuttingDown() {
+		// cache writes are paused between batches while the master exports a snapshot
+		w.waitSnapshot(recommendTask)
+		if recommendTask.Cancelled() || w.shuttingDown() {
+			break
+		}
+		begin, end := cursor, cursor+batch
+		if end > len(users) {
+			end = len(users)
+		}
+		jobs := w.budgetJobs(taskScoring)
+		if err = parallel.Parallel(end-begin, jobs, func(_, jobId int) error {
+			return recommendUser(begin + jobId)
+		}); err != nil {
+			break
+		}
+		// users in a batch might be skipped once cancelled or shutting down
+		if !recommendTask.Cancelled() && !w.shuttingDown() {
+			cursor = end
+			checkpoint.LastUserId = users[end-1].UserId
+			if fullCycle {
+				w.saveCheckpoint(checkpoint)
+			}
+		}
+		// shrink batches under memory pressure, and budgets take effect on the next batch
+		batch = nextBatchSize(batch, maxBatch, jobs, w.checkMemory(taskScoring, &peakMemory))
+	}
 	close(completed)
 	if err != nil {
 		log.Logger().Error("failed to continue offline recommendation", zap.Error(err))
-		return
+		return false
 	}
-	if w.masterClient != nil {
-		recommendTask.Finish()
-		if _, err := w.masterClient.PushTaskInfo(context.Background(), protocol.EncodeTask(recommendTask)); err != nil {
-			log.Logger().Error("failed to report finish task", zap.Error(err))
-		}
+	if recommendTask.Cancelled() {
+		w.reportTask(recommendTask)
+		log.Logger().Info("offline recommendation cancelled",
+			zap.String("used_time", time.Since(startTime).String()))
+		return false
+	} else if w.shuttingDown() {
+		log.Logger().Info("offline recommendation stopped by shutdown",
+			zap.String("used_time", time.Since(startTime).String()))
+		return false
+	}
+	recommendTask.Finish()
+	w.reportTask(recommendTask)
+	if !fullCycle {
+		log.Logger().Info("complete refreshing priority users",
+			zap.Int("n_working_users", len(users)),
+			zap.String("used_time", time.Since(startTime).String()))
+		return true
 	}
+	w.clearCheckpoint()
 	log.Logger().Info("complete ranking recommendation",
+		zap.String("cycle_id", checkpoint.CycleId),
+		zap.Float64("n_refreshed_users", updateUserCount.Load()),
+		zap.Float64("n_skipped_users", skipUserCount.Load()),
 		zap.String("used_time", time.Since(startTime).String()))
+	cachedSizes.Log()
 	UpdateUserRecommendTotal.Set(updateUserCount.Load())
+	SkipUserRecommendTotal.Set(skipUserCount.Load())
 	OfflineRecommendTotalSeconds.Set(time.Since(startRecommendTime).Seconds())
 	OfflineRecommendStepSecondsVec.WithLabelValues("collaborative_recommend").Set(collaborativeRecommendSeconds.Load())
 	OfflineRecommendStepSecondsVec.WithLabelValues("item_based_recommend").Set(itemBasedRecommendSeconds.Load())
 	OfflineRecommendStepSecondsVec.WithLabelValues("user_based_recommend").Set(userBasedRecommendSeconds.Load())
 	OfflineRecommendStepSecondsVec.WithLabelValues("latest_recommend").Set(latestRecommendSeconds.Load())
 	OfflineRecommendStepSecondsVec.WithLabelValues("popular_recommend").Set(popularRecommendSeconds.Load())
+	return true
+}
+
+// reportTask pushes the progress of a task to the master, and cancels the task if the master requests.
+func (w *Worker) reportTask(t *task.Task) {
+	if w.masterClient == nil {
+		return
+	}
+	resp, err := w.masterClient.PushTaskInfo(context.Background(), protocol.EncodeTask(t))
+	if err != nil {
+		log.Logger().Error("failed to report task", zap.String("task", t.Name), zap.Error(err))
+		return
+	}
+	if resp.GetCancel() && !t.Cancelled() {
+		log.Logger().Info("task cancelled by master", zap.String("task", t.Name))
+		t.Cancel()
+	}
+}
+
+// snapshotPollInterval is the interval to check whether cache writes are still paused by a snapshot.
+var snapshotPollInterval = time.Second
+
+// waitSnapshot suspends a task while the master pauses cache writes to export a snapshot. The pause is ignored once it
+// expires, in case the master stops without resuming cache writes.
+func (w *Worker) waitSnapshot(t *task.Task) {
+	suspended := false
+	for !t.Cancelled() && !w.shuttingDown() {
+		pauseUntil, err := w.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil)).Time()
+		if err != nil && !errors.Is(err, errors.NotFound) {
+			log.Logger().Error("failed to read pause of cache writes", zap.Error(err))
+		}
+		if err != nil || time.Now().After(pauseUntil) {
+			break
+		}
+		if !suspended {
+			log.Logger().Info("pause offline recommendation for snapshot", zap.Time("until", pauseUntil))
+			t.Suspend(true)
+			w.reportTask(t)
+			suspended = true
+		}
+		time.Sleep(snapshotPollInterval)
+	}
+	if suspended {
+		log.Logger().Info("resume offline recommendation after snapshot")
+		t.Suspend(false)
+		w.reportTask(t)
+	}
 }
 
 func (w *Worker) collaborativeRecommendBruteForce(userId string, itemCategories []string, excludeSet *strset.Set, itemCache *ItemCache) (map[string][]string, time.Duration, error) {
-	userIndex := w.RankingModel.GetUserIndex().ToNumber(userId)
-	itemIds := w.RankingModel.GetItemIndex().GetNames()
+	rankingModel, _ := w.rankingModelFor(userId)
+	userIndex := rankingModel.GetUserIndex().ToNumber(userId)
+	itemIds := rankingModel.GetItemIndex().GetNames()
 	localStartTime := time.Now()
 	recItemsFilters := make(map[string]*heap.TopKFilter[string, float64])
 	recItemsFilters[""] = heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSize)
 	for _, category := range itemCategories {
-		recItemsFilters[category] = heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSize)
+		recItemsFilters[category] = heap.NewTopKFilter[string, float64](w.Config.Recommend.CacheSizeOf(category))
 	}
-	for itemIndex, itemId := range itemIds {
-		if !excludeSet.Has(itemId) && itemCache.IsAvailable(itemId) && w.RankingModel.IsItemPredictable(int32(itemIndex)) {
-			prediction := w.RankingModel.InternalPredict(userIndex, int32(itemIndex))
-			recItemsFilters[""].Push(itemId, float64(prediction))
+	// score candidates in blocks to scan item factors sequentially
+	block := make([]int32, 0, scoreBlockSize)
+	scores := make([]float32, scoreBlockSize)
+	flush := func() {
+		ranking.PredictBatch(rankingModel, userIndex, block, scores)
+		for i, itemIndex := range block {
+			itemId := itemIds[itemIndex]
+			recItemsFilters[""].Push(itemId, float64(scores[i]))
 			for _, category := range itemCache.GetCategory(itemId) {
-				recItemsFilters[category].Push(itemId, float64(prediction))
+				recItemsFilters[category].Push(itemId, float64(scores[i]))
+			}
+		}
+		block = block[:0]
+	}
+	for itemIndex, itemId := range itemIds {
+		if !excludeSet.Has(itemId) && itemCache.IsAvailable(itemId) && rankingModel.IsItemPredictable(int32(itemIndex)) {
+			block = append(block, int32(itemIndex))
+			if len(block) == scoreBlockSize {
+				flush()
 			}
 		}
 	}
+	flush()
 	// save result
 	recommend := make(map[string][]string)
 	for category, recItemsFilter := range recItemsFilters {
 		recommendItems, recommendScores := recItemsFilter.PopAll()
 		recommend[category] = recommendItems
 		if err := w.CacheClient.SetSorted(cache.Key(cache.CollaborativeRecommend, userId, category), cache.CreateScoredItems(recommendItems, recommendScores)); err != nil {
-			log.Logger().Error("failed to cache collaborative filtering recommendation result", zap.String("user_id", userId), zap.Error(err))
+			log.Logger().Error("failed to cache collaborative filtering recommendation result", log.UserId(userId), zap.Error(err))
 			return nil, 0, errors.Trace(err)
 		}
 	}
 	return recommend, time.Since(localStartTime), nil
 }
 
-func (w *Worker) collaborativeRecommendHNSW(rankingIndex *search.HNSW, userId string, itemCategories []string, excludeSet *strset.Set, itemCache *ItemCache) (map[string][]string, time.Duration, error) {
-	userIndex := w.RankingModel.GetUserIndex().ToNumber(userId)
+// useRankingIndex returns true if the vector index is worth building for the number of items.
+func (w *Worker) useRankingIndex(numItems int) bool {
+	return w.Config.Recommend.Collaborative.EnableIndex && numItems >= w.Config.Recommend.Collaborative.IndexMinItems
+}
+
+// buildRankingIndex builds a vector index from item factors of the ranking model and swaps it with the current index.
+func (w *Worker) buildRankingIndex(key rankingIndexKey, rankingModel ranking.MatrixFactorization, itemCache *ItemCache, t *task.Task) {
+	defer base.CheckPanic()
+	defer w.rankingIndex.EndBuild()
+	startTime := time.Now()
+	log.Logger().Info("start building ranking index")
+	itemIndex := rankingModel.GetItemIndex()
+	vectors := make([]search.Vector, itemIndex.Len())
+	for i := int32(0); i < itemIndex.Len(); i++ {
+		itemId := itemIndex.ToName(i)
+		if itemCache.IsAvailable(itemId) {
+			vectors[i] = search.NewDenseVector(rankingModel.GetItemFactor(i), itemCache.GetCategory(itemId), false)
+		} else {
+			vectors[i] = search.NewDenseVector(rankingModel.GetItemFactor(i), nil, true)
+		}
+	}
+	builder := search.NewHNSWBuilder(vectors, w.Config.Recommend.CacheSize, w.budgetJobs(taskTraining))
+	index, recall := builder.Build(w.Config.Recommend.Collaborative.IndexRecall,
+		w.Config.Recommend.Collaborative.IndexFitEpoch, false, t)
+	var peakMemory uint64
+	w.checkMemory(taskTraining, &peakMemory)
+	w.rankingIndex.Swap(key, rankingModel, index)
+	RankingIndexBuildSeconds.Set(time.Since(startTime).Seconds())
+	CollaborativeFilteringIndexRecall.Set(float64(recall))
+	if err := w.CacheClient.Set(cache.String(cache.Key(cache.GlobalMeta, cache.MatchingIndexRecall), encoding.FormatFloat32(recall))); err != nil {
+		log.Logger().Error("failed to write meta", zap.Error(err))
+	}
+	log.Logger().Info("complete building ranking index",
+		zap.Duration("build_time", time.Since(startTime)))
+}
+
+func (w *Worker) collaborativeRecommendHNSW(rankingIndex *rankingIndexGeneration, userId string, itemCategories []string, excludeSet *strset.Set, itemCache *ItemCache) (map[string][]string, time.Duration, error) {
+	userIndex := rankingIndex.model.GetUserIndex().ToNumber(userId)
 	localStartTime := time.Now()
-	values, scores := rankingIndex.MultiSearch(search.NewDenseVector(w.RankingModel.GetUserFactor(userIndex), nil, false),
-		itemCategories, w.Config.Recommend.CacheSize+excludeSet.Size(), false)
+	values, scores := rankingIndex.index.MultiSearch(search.NewDenseVector(rankingIndex.model.GetUserFactor(userIndex), nil, false),
+		itemCategories, w.Config.Recommend.MaxCacheSize()+excludeSet.Size(), false)
 	// save result
 	recommend := make(map[string][]string)
 	for category, catValues := range values {
+		size := w.Config.Recommend.CacheSizeOf(category)
 		recommendItems := make([]string, 0, len(catValues))
 		recommendScores := make([]float64, 0, len(catValues))
-		for i := range catValues {
-			itemId := w.RankingModel.GetItemIndex().ToName(catValues[i])
+		for i := 0; i < len(catValues) && len(recommendItems) < size; i++ {
+			itemId := rankingIndex.model.GetItemIndex().ToName(catValues[i])
 			if !excludeSet.Has(itemId) && itemCache.IsAvailable(itemId) {
 				recommendItems = append(recommendItems, itemId)
 				recommendScores = append(recommendScores, float64(scores[category][i]))
@@ -807,13 +1209,35 @@ func (w *Worker) collaborativeRecommendHNSW(rankingIndex *search.HNSW, userId st
 		recommend[category] = recommendItems
 		if err := w.CacheClient.SetSorted(cache.Key(cache.CollaborativeRecommend, userId, category),
 			cache.CreateScoredItems(recommendItems, recommendScores)); err != nil {
-			log.Logger().Error("failed to cache collaborative filtering recommendation result", zap.String("user_id", userId), zap.Error(err))
+			log.Logger().Error("failed to cache collaborative filtering recommendation result", log.UserId(userId), zap.Error(err))
 			return nil, 0, errors.Trace(err)
 		}
 	}
 	return recommend, time.Since(localStartTime), nil
 }
 
+// loadItemNeighbors loads neighbors of a item in a category. Neighbors are cached for limited categories of each
+// item. For other categories, neighbors are filtered from global neighbors of the item.
+func (w *Worker) loadItemNeighbors(itemId, category string, itemCache *ItemCache) ([]cache.Scored, error) {
+	items, err := w.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, itemId, category), 0, w.Config.Recommend.CacheSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	} else if category == "" || len(items) > 0 {
+		return items, nil
+	}
+	items, err = w.CacheClient.GetSorted(cache.Key(cache.ItemNeighbors, itemId), 0, w.Config.Recommend.CacheSize)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var categorized []cache.Scored
+	for _, item := range items {
+		if funk.ContainsString(itemCache.GetCategory(item.Id), category) {
+			categorized = append(categorized, item)
+		}
+	}
+	return categorized, nil
+}
+
 func (w *Worker) rankByCollaborativeFiltering(userId string, candidates [][]string) ([]cache.Scored, error) {
 	// concat candidates
 	memo := strset.New()
@@ -827,11 +1251,12 @@ func (w *Worker) rankByCollaborativeFiltering(userId string, candidates [][]stri
 		}
 	}
 	// rank by collaborative filtering
+	rankingModel, _ := w.rankingModelFor(userId)
 	topItems := make([]cache.Scored, 0, len(candidates))
 	for _, itemId := range itemIds {
 		topItems = append(topItems, cache.Scored{
 			Id:    itemId,
-			Score: float64(w.RankingModel.Predict(userId, itemId)),
+			Score: float64(rankingModel.Predict(userId, itemId)),
 		})
 	}
 	cache.SortScores(topItems)
@@ -872,6 +1297,99 @@ func (w *Worker) rankByClickTroughRate(user *data.User, candidates [][]string, i
 	return topItems, nil
 }
 
+// clickModelAvailable returns true if click-through rate prediction is enabled and the click model is trained.
+func (w *Worker) clickModelAvailable() bool {
+	return w.Config.Recommend.Offline.EnableClickThroughPrediction && w.ClickModel != nil && !w.ClickModel.Invalid()
+}
+
+// rankByBlendedScores ranks items by blending collaborative filtering scores, click-through rates and freshness.
+// Components of unavailable models are zeros.
+func (w *Worker) rankByBlendedScores(user *data.User, candidates [][]string, itemCache *ItemCache, weights blend.Weights) []cache.Scored {
+	// concat candidates
+	memo := strset.New()
+	var items []*data.Item
+	for _, v := range candidates {
+		for _, itemId := range v {
+			if memo.Has(itemId) {
+				continue
+			}
+			memo.Add(itemId)
+			if item, exist := itemCache.Get(itemId); exist {
+				items = append(items, item)
+			} else {
+				log.Logger().Warn("item doesn't exists in database", zap.String("item_id", itemId))
+			}
+		}
+	}
+	// predict components
+	var cf, ctr []float64
+	if rankingModel, _ := w.rankingModelFor(user.UserId); rankingModel != nil && !rankingModel.Invalid() &&
+		rankingModel.IsUserPredictable(rankingModel.GetUserIndex().ToNumber(user.UserId)) {
+		cf = make([]float64, len(items))
+		for i, item := range items {
+			cf[i] = float64(rankingModel.Predict(user.UserId, item.ItemId))
+		}
+	}
+	if w.clickModelAvailable() {
+		ctr = make([]float64, len(items))
+		for i, item := range items {
+			ctr[i] = float64(w.ClickModel.Predict(user.UserId, item.ItemId, user.Labels, item.Labels))
+		}
+	}
+	now := time.Now()
+	freshness := make([]float64, len(items))
+	for i, item := range items {
+		freshness[i] = blend.Freshness(item.Timestamp, now, weights.FreshnessHalfLife)
+	}
+	// rank by blended scores
+	scores := blend.Blend(weights, len(items), cf, ctr, freshness)
+	topItems := make([]cache.Scored, len(items))
+	for i, item := range items {
+		topItems[i] = cache.Scored{Id: item.ItemId, Score: scores[i].Score}
+	}
+	cache.SortScores(topItems)
+	return topItems
+}
+
+// loadBlendWeights loads weights of score blending saved in the cache store. Weights in the configuration are used if
+// none is saved.
+func (w *Worker) loadBlendWeights() (blend.Weights, error) {
+	s, err := w.CacheClient.Get(cache.BlendWeights).String()
+	if errors.Is(err, errors.NotFound) {
+		return blend.NewWeights(w.Config.Recommend.Blend), nil
+	} else if err != nil {
+		return blend.Weights{}, errors.Trace(err)
+	}
+	return blend.ParseWeights(s)
+}
+
+// rerank re-orders ranked items by the external scorer. Scores are replaced by scores from the scorer, and items keep
+// the original order and scores if the scorer fails.
+func (w *Worker) rerank(user *data.User, category string, items []cache.Scored, itemCache *ItemCache) []cache.Scored {
+	request := &rerank.Request{
+		UserId:     user.UserId,
+		UserLabels: user.Labels,
+		Context:    map[string]string{"category": category, "stage": rerank.StageWorker},
+		Candidates: make([]rerank.Candidate, 0, len(items)),
+	}
+	for _, item := range items {
+		candidate := rerank.Candidate{ItemId: item.Id, Score: item.Score}
+		if cached, exist := itemCache.Get(item.Id); exist {
+			candidate.Labels = cached.Labels
+			candidate.Categories = cached.Categories
+		}
+		request.Candidates = append(request.Candidates, candidate)
+	}
+	if !w.reranker.Rerank(w.Config.Recommend.Rerank, request) {
+		return items
+	}
+	results := make([]cache.Scored, 0, len(request.Candidates))
+	for _, candidate := range request.Candidates {
+		results = append(results, cache.Scored{Id: candidate.ItemId, Score: candidate.Score})
+	}
+	return results
+}
+
 func mergeAndShuffle(candidates [][]string) []cache.Scored {
 	memo := strset.New()
 	pos := make([]int, len(candidates))
@@ -916,12 +1434,12 @@ func (w *Worker) exploreRecommend(exploitRecommend []cache.Scored, excludeSet *s
 		exploreLatestThreshold += threshold
 	}
 	// load popular items
-	popularItems, err := w.CacheClient.GetSorted(cache.Key(cache.PopularItems, category), 0, w.Config.Recommend.CacheSize)
+	popularItems, err := w.CacheClient.GetSorted(cache.Key(cache.PopularItems, category), 0, w.Config.Recommend.CacheSizeOf(category))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	// load the latest items
-	latestItems, err := w.CacheClient.GetSorted(cache.Key(cache.LatestItems, category), 0, w.Config.Recommend.CacheSize)
+	latestItems, err := w.CacheClient.GetSorted(cache.Key(cache.LatestItems, category), 0, w.Config.Recommend.CacheSizeOf(category))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -963,7 +1481,9 @@ func (w *Worker) exploreRecommend(exploitRecommend []cache.Scored, excludeSet *s
 // 1. if cache is empty, stale.
 // 2. if active time > recommend time, stale.
 // 3. if recommend time + timeout < now, stale.
-func (w *Worker) checkRecommendCacheTimeout(userId string, categories []string) bool {
+// 4. if recommend time < requested time, stale.
+// 5. if unchanged users are skipped, stale once models change or after max skipped cycles.
+func (w *Worker) checkRecommendCacheTimeout(userId string, categories []string, requestTime time.Time) bool {
 	var (
 		activeTime    time.Time
 		recommendTime time.Time
@@ -974,7 +1494,7 @@ func (w *Worker) checkRecommendCacheTimeout(userId string, categories []string)
 	for _, category := range append([]string{""}, categories...) {
 		items, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, userId, category), 0, -1)
 		if err != nil {
-			log.Logger().Error("failed to load offline recommendation", zap.String("user_id", userId), zap.Error(err))
+			log.Logger().Error("failed to load offline recommendation", log.UserId(userId), zap.Error(err))
 			return true
 		} else if len(items) == 0 {
 			return true
@@ -984,7 +1504,7 @@ func (w *Worker) checkRecommendCacheTimeout(userId string, categories []string)
 	cacheDigest, err = w.CacheClient.Get(cache.Key(cache.OfflineRecommendDigest, userId)).String()
 	if err != nil {
 		if !errors.Is(err, errors.NotFound) {
-			log.Logger().Error("failed to load offline recommendation digest", zap.String("user_id", userId), zap.Error(err))
+			log.Logger().Error("failed to load offline recommendation digest", log.UserId(userId), zap.Error(err))
 		}
 		return true
 	}
@@ -1007,18 +1527,136 @@ func (w *Worker) checkRecommendCacheTimeout(userId string, categories []string)
 		}
 		return true
 	}
+	// check manual request
+	if recommendTime.Before(requestTime) {
+		return true
+	}
 	// check cache expire
 	if recommendTime.Before(time.Now().Add(-w.Config.Recommend.CacheExpire)) {
 		return true
 	}
 	// check time
 	if activeTime.Before(recommendTime) {
+		if w.Config.Recommend.Offline.SkipUnchangedUsers {
+			return w.checkUnchangedUserTimeout(userId)
+		}
 		timeoutTime := recommendTime.Add(w.Config.Recommend.Offline.RefreshRecommendPeriod)
 		return timeoutTime.Before(time.Now())
 	}
 	return true
 }
 
+// checkUnchangedUserTimeout checks if recommendation of a user without new feedback is stale, which happens once
+// models generating the recommendation change or the recommendation has been skipped for max skipped cycles.
+func (w *Worker) checkUnchangedUserTimeout(userId string) bool {
+	modelVersion, err := w.CacheClient.Get(cache.Key(cache.OfflineRecommendModel, userId)).String()
+	if err != nil {
+		if !errors.Is(err, errors.NotFound) {
+			log.Logger().Error("failed to read offline recommendation model", log.UserId(userId), zap.Error(err))
+		}
+		return true
+	}
+	if modelVersion != w.recommendModelVersion(userId) {
+		return true
+	}
+	skips, err := w.CacheClient.Get(cache.Key(cache.OfflineRecommendSkips, userId)).Integer()
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		log.Logger().Error("failed to read skipped cycles of offline recommendation", log.UserId(userId), zap.Error(err))
+		return true
+	}
+	return skips >= w.Config.Recommend.Offline.MaxSkippedCycles
+}
+
+// recommendModelVersion returns versions of models generating offline recommendation of a user.
+func (w *Worker) recommendModelVersion(userId string) string {
+	_, rankingModelVersion := w.rankingModelFor(userId)
+	return encoding.Hex(rankingModelVersion) + "-" + encoding.Hex(w.ClickModelVersion)
+}
+
+// skipUnchangedUser counts a cycle skipping offline recommendation of an unchanged user.
+func (w *Worker) skipUnchangedUser(userId string) error {
+	skips, err := w.CacheClient.Get(cache.Key(cache.OfflineRecommendSkips, userId)).Integer()
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		return errors.Trace(err)
+	}
+	return w.CacheClient.Set(cache.Integer(cache.Key(cache.OfflineRecommendSkips, userId), skips+1))
+}
+
+// lastRequestOfflineRecommendTime returns the time offline recommendation was requested manually. Zero time is
+// returned if it has never been requested.
+func (w *Worker) lastRequestOfflineRecommendTime() time.Time {
+	requestTime, err := w.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.LastRequestOfflineRecommendTime)).Time()
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		log.Logger().Error("failed to read last request offline recommend time", zap.Error(err))
+	}
+	return requestTime
+}
+
+// loadHiddenItems loads items hidden globally (category "") and in each category.
+func (w *Worker) loadHiddenItems(categories []string) (map[string][]cache.Scored, error) {
+	hiddenItems := make(map[string][]cache.Scored)
+	end := float64(time.Now().Unix())
+	for _, category := range append([]string{""}, categories...) {
+		items, err := w.CacheClient.GetSortedByScore(cache.Key(cache.HiddenItemsV2, category), math.Inf(-1), end)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		hiddenItems[category] = items
+	}
+	return hiddenItems, nil
+}
+
+// removeHiddenItems removes items hidden after the latest offline recommendation of a user from offline and
+// collaborative recommendation caches, since the cache won't be regenerated until it expires. Items hidden globally
+// are removed from all categories.
+func (w *Worker) removeHiddenItems(userId string, hiddenItems map[string][]cache.Scored) error {
+	recommendTime, err := w.CacheClient.Get(cache.Key(cache.LastUpdateUserRecommendTime, userId)).Time()
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+	var members []cache.SetMember
+	for category := range hiddenItems {
+		for _, item := range hiddenItems[category] {
+			if item.Score < float64(recommendTime.Unix()) {
+				continue
+			}
+			categories := []string{category}
+			if category == "" {
+				categories = categories[:0]
+				for c := range hiddenItems {
+					categories = append(categories, c)
+				}
+			}
+			for _, c := range categories {
+				members = append(members,
+					cache.Member(cache.Key(cache.OfflineRecommend, userId, c), item.Id),
+					cache.Member(cache.Key(cache.CollaborativeRecommend, userId, c), item.Id))
+			}
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	return w.CacheClient.RemSorted(members...)
+}
+
+// rebuildConsumedFilter replaces the Bloom filter of items consumed by the user. The filter is sized for twice the
+// number of consumed items to leave room for items added by servers until the next rebuild.
+func (w *Worker) rebuildConsumedFilter(userId string, consumedItems []string) error {
+	numBits := 2 * len(consumedItems) * w.Config.Recommend.ConsumedFilter.BitsPerItem
+	if numBits < 64 {
+		numBits = 64
+	}
+	filter := bloom.New(numBits, uint8(w.Config.Recommend.ConsumedFilter.NumHashes))
+	for _, itemId := range consumedItems {
+		filter.Add(itemId)
+	}
+	return w.CacheClient.Set(cache.String(cache.Key(cache.ConsumedFilter, userId), filter.String()))
+}
+
 func loadUserHistoricalItems(database data.Database, userId string) ([]string, []data.Feedback, error) {
 	items := make([]string, 0)
 	feedbacks, err := database.GetUserFeedback(userId, false)
@@ -1086,16 +1724,14 @@ func (w *Worker) pullItems() (*ItemCache, []string, error) {
 	return itemCache, itemCategories.List(), nil
 }
 
+// pullUsers pulls users of this worker sorted by user ids.
 func (w *Worker) pullUsers(peers []string, me string) ([]data.User, error) {
 	// locate me
 	if !funk.ContainsString(peers, me) {
 		return nil, errors.New("current node isn't in worker nodes")
 	}
 	// create consistent hash ring
-	c := consistent.New()
-	for _, peer := range peers {
-		c.Add(peer)
-	}
+	c := newConsistentHash(peers)
 	// pull users from database
 	var users []data.User
 	userChan, errChan := w.DataClient.GetUserStream(batchSize)
@@ -1113,9 +1749,21 @@ func (w *Worker) pullUsers(peers []string, me string) ([]data.User, error) {
 	if err := <-errChan; err != nil {
 		return nil, errors.Trace(err)
 	}
+	// sort users so that cursors of checkpoints are stable
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserId < users[j].UserId
+	})
 	return users, nil
 }
 
+func newConsistentHash(peers []string) *consistent.Consistent {
+	c := consistent.New()
+	for _, peer := range peers {
+		c.Add(peer)
+	}
+	return c
+}
+
 // replacement inserts historical items back to recommendation.
 func (w *Worker) replacement(recommend map[string][]cache.Scored, user *data.User, feedbacks []data.Feedback, itemCache *ItemCache) (map[string][]cache.Scored, error) {
 	upperBounds := make(map[string]float64)
@@ -1147,6 +1795,7 @@ func (w *Worker) replacement(recommend map[string][]cache.Scored, user *data.Use
 		}
 	}
 
+	rankingModel, _ := w.rankingModelFor(user.UserId)
 	for _, itemId := range distinctItems.List() {
 		if item, exist := itemCache.Get(itemId); exist {
 			// scoring item
@@ -1156,8 +1805,8 @@ func (w *Worker) replacement(recommend map[string][]cache.Scored, user *data.Use
 			var score float64
 			if w.Config.Recommend.Offline.EnableClickThroughPrediction && w.ClickModel != nil {
 				score = float64(w.ClickModel.Predict(user.UserId, itemId, user.Labels, item.Labels))
-			} else if w.RankingModel != nil && !w.RankingModel.Invalid() && w.RankingModel.IsUserPredictable(w.RankingModel.GetUserIndex().ToNumber(user.UserId)) {
-				score = float64(w.RankingModel.Predict(user.UserId, itemId))
+			} else if rankingModel != nil && !rankingModel.Invalid() && rankingModel.IsUserPredictable(rankingModel.GetUserIndex().ToNumber(user.UserId)) {
+				score = float64(rankingModel.Predict(user.UserId, itemId))
 			} else {
 				upper := upperBounds[""]
 				lower := lowerBounds[""]
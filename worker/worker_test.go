@@ -18,16 +18,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/bits-and-blooms/bitset"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/scylladb/go-set/strset"
 	"github.com/stretchr/testify/assert"
 	"github.com/thoas/go-funk"
 	"github.com/zhenghaoz/gorse/base"
+	"github.com/zhenghaoz/gorse/base/bloom"
+	"github.com/zhenghaoz/gorse/base/task"
 	"github.com/zhenghaoz/gorse/config"
 	"github.com/zhenghaoz/gorse/model"
+	"github.com/zhenghaoz/gorse/model/blend"
 	"github.com/zhenghaoz/gorse/model/click"
 	"github.com/zhenghaoz/gorse/model/ranking"
+	"github.com/zhenghaoz/gorse/model/rerank"
 	"github.com/zhenghaoz/gorse/protocol"
 	"github.com/zhenghaoz/gorse/storage/cache"
 	"github.com/zhenghaoz/gorse/storage/data"
@@ -35,7 +42,13 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -73,27 +86,73 @@ func TestCheckRecommendCacheTimeout(t *testing.T) {
 	defer w.Close(t)
 
 	// empty cache
-	assert.True(t, w.checkRecommendCacheTimeout("0", nil))
+	assert.True(t, w.checkRecommendCacheTimeout("0", nil, time.Time{}))
 	err := w.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"0", 0}})
 	assert.NoError(t, err)
 
 	// digest mismatch
-	assert.True(t, w.checkRecommendCacheTimeout("0", nil))
+	assert.True(t, w.checkRecommendCacheTimeout("0", nil, time.Time{}))
 	err = w.CacheClient.Set(cache.String(cache.Key(cache.OfflineRecommendDigest, "0"), w.Config.OfflineRecommendDigest()))
 	assert.NoError(t, err)
 
 	err = w.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, "0"), time.Now().Add(-time.Hour)))
 	assert.NoError(t, err)
-	assert.True(t, w.checkRecommendCacheTimeout("0", nil))
+	assert.True(t, w.checkRecommendCacheTimeout("0", nil, time.Time{}))
 	err = w.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), time.Now().Add(-time.Hour*100)))
 	assert.NoError(t, err)
-	assert.True(t, w.checkRecommendCacheTimeout("0", nil))
+	assert.True(t, w.checkRecommendCacheTimeout("0", nil, time.Time{}))
 	err = w.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), time.Now().Add(time.Hour*100)))
 	assert.NoError(t, err)
-	assert.False(t, w.checkRecommendCacheTimeout("0", nil))
+	assert.False(t, w.checkRecommendCacheTimeout("0", nil, time.Time{}))
+	err = w.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.LastRequestOfflineRecommendTime), time.Now().Add(time.Hour*200)))
+	assert.NoError(t, err)
+	assert.True(t, w.checkRecommendCacheTimeout("0", nil, w.lastRequestOfflineRecommendTime()))
 	err = w.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), nil)
 	assert.NoError(t, err)
-	assert.True(t, w.checkRecommendCacheTimeout("0", nil))
+	assert.True(t, w.checkRecommendCacheTimeout("0", nil, time.Time{}))
+}
+
+func TestRemoveHiddenItems(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+
+	recommendTime := time.Now().Add(-time.Hour)
+	err := w.CacheClient.Set(cache.Time(cache.Key(cache.LastUpdateUserRecommendTime, "0"), recommendTime))
+	assert.NoError(t, err)
+	err = w.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0"), []cache.Scored{{"1", 4}, {"2", 3}, {"3", 2}, {"4", 1}})
+	assert.NoError(t, err)
+	err = w.CacheClient.SetSorted(cache.Key(cache.OfflineRecommend, "0", "a"), []cache.Scored{{"1", 4}, {"2", 3}, {"3", 2}})
+	assert.NoError(t, err)
+	err = w.CacheClient.SetSorted(cache.Key(cache.CollaborativeRecommend, "0"), []cache.Scored{{"1", 4}, {"2", 3}, {"4", 1}})
+	assert.NoError(t, err)
+	// item 1 was hidden before recommendation, item 2 was deleted and item 3 was removed from category a
+	err = w.CacheClient.AddSorted(
+		cache.Sorted(cache.HiddenItemsV2, []cache.Scored{
+			{"1", float64(recommendTime.Add(-time.Hour).Unix())},
+			{"2", float64(time.Now().Unix())},
+		}),
+		cache.Sorted(cache.Key(cache.HiddenItemsV2, "a"), []cache.Scored{{"3", float64(time.Now().Unix())}}),
+	)
+	assert.NoError(t, err)
+
+	hiddenItems, err := w.loadHiddenItems([]string{"a"})
+	assert.NoError(t, err)
+	err = w.removeHiddenItems("0", hiddenItems)
+	assert.NoError(t, err)
+	items, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 4}, {"3", 2}, {"4", 1}}, items)
+	items, err = w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0", "a"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 4}}, items)
+	items, err = w.CacheClient.GetSorted(cache.Key(cache.CollaborativeRecommend, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 4}, {"4", 1}}, items)
+
+	// skip users without recommendation
+	err = w.removeHiddenItems("1", hiddenItems)
+	assert.NoError(t, err)
 }
 
 type mockMatrixFactorizationForRecommend struct {
@@ -255,6 +314,7 @@ func TestRecommendMatrixFactorizationHNSW(t *testing.T) {
 	defer w.Close(t)
 	w.Config.Recommend.Offline.EnableColRecommend = true
 	w.Config.Recommend.Collaborative.EnableIndex = true
+	w.Config.Recommend.Collaborative.IndexMinItems = 0
 	// insert feedbacks
 	now := time.Now()
 	err := w.DataClient.BatchInsertFeedback([]data.Feedback{
@@ -308,6 +368,32 @@ func TestRecommendMatrixFactorizationHNSW(t *testing.T) {
 	}
 }
 
+func TestWorker_LoadItemNeighbors(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	itemCache := NewItemCache()
+	itemCache.Set("1", data.Item{ItemId: "1", Categories: []string{"a"}})
+	itemCache.Set("2", data.Item{ItemId: "2", Categories: []string{"b"}})
+	itemCache.Set("3", data.Item{ItemId: "3", Categories: []string{"a", "b"}})
+	err := w.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0"), []cache.Scored{{"1", 3}, {"2", 2}, {"3", 1}})
+	assert.NoError(t, err)
+	err = w.CacheClient.SetSorted(cache.Key(cache.ItemNeighbors, "0", "b"), []cache.Scored{{"4", 1}})
+	assert.NoError(t, err)
+
+	// global neighbors
+	neighbors, err := w.loadItemNeighbors("0", "", itemCache)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 3}, {"2", 2}, {"3", 1}}, neighbors)
+	// cached neighbors in category
+	neighbors, err = w.loadItemNeighbors("0", "b", itemCache)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"4", 1}}, neighbors)
+	// filtered neighbors in category
+	neighbors, err = w.loadItemNeighbors("0", "a", itemCache)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"1", 3}, {"3", 1}}, neighbors)
+}
+
 func TestRecommend_ItemBased(t *testing.T) {
 	// create mock worker
 	w := newMockWorker(t)
@@ -478,6 +564,169 @@ func TestRecommend_Popular(t *testing.T) {
 	assert.Equal(t, []cache.Scored{{"20", 20}, {"19", 19}, {"18", 18}}, recommends)
 }
 
+func TestRecommend_ConsumedFilter(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.Config.Recommend.Offline.EnableColRecommend = false
+	w.Config.Recommend.Offline.EnablePopularRecommend = true
+	w.Config.Recommend.ConsumedFilter.EnableConsumedFilter = true
+	// insert popular items
+	err := w.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	// insert feedback
+	err = w.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "read", UserId: "0", ItemId: "10"}, Timestamp: time.Now().Add(-time.Hour)},
+	}, true, true, true)
+	assert.NoError(t, err)
+	w.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+	w.Recommend([]data.User{{UserId: "0"}})
+	recommends, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"9", 9}, {"8", 8}}, recommends)
+	// the filter is rebuilt from feedback
+	value, err := w.CacheClient.Get(cache.Key(cache.ConsumedFilter, "0")).String()
+	assert.NoError(t, err)
+	filter, err := bloom.Parse(value)
+	assert.NoError(t, err)
+	assert.True(t, filter.Has("10"))
+	assert.Equal(t, 1, filter.Count())
+}
+
+func TestRecommend_HideItem(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.Config.Recommend.Offline.EnableColRecommend = false
+	w.Config.Recommend.Offline.EnablePopularRecommend = true
+	err := w.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	err = w.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, "0"), time.Now().Add(-time.Hour)))
+	assert.NoError(t, err)
+	w.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+	w.Recommend([]data.User{{UserId: "0"}})
+	recommends, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}}, recommends)
+
+	// hide an item after recommendation
+	err = w.CacheClient.AddSorted(cache.Sorted(cache.HiddenItemsV2, []cache.Scored{{"9", float64(time.Now().Unix())}}))
+	assert.NoError(t, err)
+	assert.False(t, w.checkRecommendCacheTimeout("0", nil, time.Time{}))
+	w.Recommend([]data.User{{UserId: "0"}})
+	recommends, err = w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"10", 10}, {"8", 8}}, recommends)
+}
+
+func TestRecommend_SkipUnchangedUsers(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.Config.Recommend.Offline.EnableColRecommend = false
+	w.Config.Recommend.Offline.EnablePopularRecommend = true
+	w.Config.Recommend.Offline.MaxSkippedCycles = 2
+	err := w.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	users := []data.User{{UserId: "0"}, {UserId: "1"}}
+	for _, user := range users {
+		err = w.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, user.UserId), time.Now().Add(-time.Hour)))
+		assert.NoError(t, err)
+	}
+	w.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+	recommendations := func() map[string][]cache.Scored {
+		result := make(map[string][]cache.Scored)
+		for _, user := range users {
+			recommends, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, user.UserId), 0, -1)
+			assert.NoError(t, err)
+			result[user.UserId] = recommends
+		}
+		return result
+	}
+
+	// recommendation without skipping unchanged users
+	w.Config.Recommend.Offline.RefreshRecommendPeriod = time.Nanosecond
+	w.Recommend(users)
+	expected := recommendations()
+	assert.Equal(t, 2.0, testutil.ToFloat64(UpdateUserRecommendTotal))
+	w.Recommend(users)
+	assert.Equal(t, expected, recommendations())
+	assert.Equal(t, 2.0, testutil.ToFloat64(UpdateUserRecommendTotal))
+	assert.Zero(t, testutil.ToFloat64(SkipUserRecommendTotal))
+
+	// unchanged users are skipped and recommendation is identical
+	w.Config.Recommend.Offline.SkipUnchangedUsers = true
+	w.Recommend(users)
+	assert.Equal(t, expected, recommendations())
+	assert.Zero(t, testutil.ToFloat64(UpdateUserRecommendTotal))
+	assert.Equal(t, 2.0, testutil.ToFloat64(SkipUserRecommendTotal))
+
+	// users with new feedback are refreshed
+	err = w.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, "0"), time.Now()))
+	assert.NoError(t, err)
+	w.Recommend(users)
+	assert.Equal(t, expected, recommendations())
+	assert.Equal(t, 1.0, testutil.ToFloat64(UpdateUserRecommendTotal))
+	assert.Equal(t, 1.0, testutil.ToFloat64(SkipUserRecommendTotal))
+
+	// users are refreshed after max skipped cycles
+	w.Recommend(users)
+	assert.Equal(t, expected, recommendations())
+	assert.Equal(t, 1.0, testutil.ToFloat64(UpdateUserRecommendTotal))
+	assert.Equal(t, 1.0, testutil.ToFloat64(SkipUserRecommendTotal))
+	skips, err := w.CacheClient.Get(cache.Key(cache.OfflineRecommendSkips, "1")).Integer()
+	assert.NoError(t, err)
+	assert.Zero(t, skips)
+
+	// users are refreshed once models change
+	w.ClickModelVersion++
+	w.Recommend(users)
+	assert.Equal(t, expected, recommendations())
+	assert.Equal(t, 2.0, testutil.ToFloat64(UpdateUserRecommendTotal))
+	assert.Zero(t, testutil.ToFloat64(SkipUserRecommendTotal))
+}
+
+func TestRecommend_Rerank(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.Config.Recommend.Offline.EnableColRecommend = false
+	w.Config.Recommend.Offline.EnablePopularRecommend = true
+	err := w.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	// the scorer prefers items with smaller ids
+	scorer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var request rerank.Request
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, "worker", request.Context["stage"])
+		response := rerank.Response{SchemaVersion: rerank.FeatureSchemaVersion}
+		for _, candidate := range request.Candidates {
+			score, err := strconv.ParseFloat(candidate.ItemId, 64)
+			assert.NoError(t, err)
+			response.Scores = append(response.Scores, -score)
+		}
+		assert.NoError(t, json.NewEncoder(rw).Encode(response))
+	}))
+	defer scorer.Close()
+	w.Config.Recommend.Rerank.Scorer = rerank.ScorerHTTP
+	w.Config.Recommend.Rerank.Stage = rerank.StageWorker
+	w.Config.Recommend.Rerank.Endpoint = scorer.URL
+	w.reranker = rerank.NewReranker()
+	w.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+	w.Recommend([]data.User{{UserId: "0"}})
+	recommends, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []cache.Scored{{"8", -8}, {"9", -9}, {"10", -10}}, recommends)
+}
+
 func TestRecommend_Latest(t *testing.T) {
 	// create mock worker
 	w := newMockWorker(t)
@@ -703,11 +952,12 @@ func TestWorker_Sync(t *testing.T) {
 	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	assert.NoError(t, err)
 	serv := &Worker{
-		Settings:     config.NewSettings(),
-		testMode:     true,
-		masterClient: protocol.NewMasterClient(conn),
-		syncedChan:   make(chan bool, 1024),
-		ticker:       time.NewTicker(time.Minute),
+		Settings:          config.NewSettings(),
+		testMode:          true,
+		masterClient:      protocol.NewMasterClient(conn),
+		syncedChan:        make(chan bool, 1024),
+		ticker:            time.NewTicker(time.Minute),
+		incrementalTicker: time.NewTicker(time.Minute),
 	}
 
 	// This clause is used to test race condition.
@@ -738,6 +988,61 @@ func TestWorker_Sync(t *testing.T) {
 	done <- struct{}{}
 }
 
+func TestWorker_SyncCanary(t *testing.T) {
+	master := newMockMaster(t)
+	go master.Start(t)
+	address := <-master.addr
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	serv := &Worker{
+		Settings:          config.NewSettings(),
+		testMode:          true,
+		masterClient:      protocol.NewMasterClient(conn),
+		syncedChan:        make(chan bool, 1024),
+		ticker:            time.NewTicker(time.Minute),
+		incrementalTicker: time.NewTicker(time.Minute),
+	}
+	serv.Sync()
+	serv.Pull()
+	assert.Equal(t, int64(2), serv.RankingModelVersion)
+	assert.Nil(t, serv.canaryRankingModel)
+
+	// pull the canary ranking model
+	err = serv.CacheClient.Set(cache.Integer(cache.Key(cache.GlobalMeta, cache.RankingCanaryVersion), 3))
+	assert.NoError(t, err)
+	serv.Sync()
+	assert.Equal(t, int64(3), serv.latestCanaryRankingModelVersion)
+	serv.Pull()
+	assert.Equal(t, int64(2), serv.RankingModelVersion)
+	assert.Equal(t, int64(3), serv.canaryRankingModelVersion)
+	assert.NotNil(t, serv.canaryRankingModel)
+
+	// canary users are served by the canary ranking model
+	_, version := serv.rankingModelFor("1")
+	assert.Equal(t, int64(2), version)
+	serv.Config.Recommend.Collaborative.CanaryPercent = 100
+	_, version = serv.rankingModelFor("1")
+	assert.Equal(t, int64(3), version)
+
+	// the canary ranking model is swapped without pulling after promotion
+	defaultModel, canaryModel := serv.RankingModel, serv.canaryRankingModel
+	serv.latestRankingModelVersion, serv.latestCanaryRankingModelVersion = 3, 2
+	serv.syncedChan <- true
+	serv.Pull()
+	assert.Equal(t, int64(3), serv.RankingModelVersion)
+	assert.Equal(t, int64(2), serv.canaryRankingModelVersion)
+	assert.Same(t, canaryModel, serv.RankingModel)
+	assert.Same(t, defaultModel, serv.canaryRankingModel)
+
+	// drop the canary ranking model
+	serv.latestCanaryRankingModelVersion = 0
+	serv.syncedChan <- true
+	serv.Pull()
+	assert.Nil(t, serv.canaryRankingModel)
+	assert.Zero(t, serv.canaryRankingModelVersion)
+	master.Stop()
+}
+
 type mockFactorizationMachine struct {
 	click.BaseFactorizationMachine
 }
@@ -822,6 +1127,53 @@ func TestRankByClickTroughRate(t *testing.T) {
 	assert.IsDecreasing(t, cache.GetScores(result))
 }
 
+func TestRankByBlendedScores(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	// insert items, items with smaller ids are fresher
+	now := time.Now()
+	itemCache := NewItemCache()
+	for i := 1; i <= 5; i++ {
+		itemCache.Set(strconv.Itoa(i), data.Item{ItemId: strconv.Itoa(i), Timestamp: now.Add(-time.Duration(i) * time.Hour)})
+	}
+	w.RankingModel = newMockMatrixFactorizationForRecommend(10, 10)
+	w.ClickModel = new(mockFactorizationMachine)
+	candidates := [][]string{{"1", "2", "3"}, {"3", "4", "5"}}
+	// rank items by collaborative filtering scores
+	result := w.rankByBlendedScores(&data.User{UserId: "1"}, candidates, itemCache, blend.Weights{CFWeight: 1, FreshnessHalfLife: time.Hour})
+	assert.Equal(t, []cache.Scored{{"5", 1}, {"4", 0.75}, {"3", 0.5}, {"2", 0.25}, {"1", 0}}, result)
+	// rank items by freshness
+	result = w.rankByBlendedScores(&data.User{UserId: "1"}, candidates, itemCache, blend.Weights{CFWeight: 0.1, FreshnessWeight: 1, FreshnessHalfLife: time.Hour})
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, cache.RemoveScores(result))
+	// click-through rates are blended only if click-through rate prediction is enabled
+	w.Config.Recommend.Offline.EnableClickThroughPrediction = false
+	result = w.rankByBlendedScores(&data.User{UserId: "1"}, candidates, itemCache, blend.Weights{CTRWeight: 1, FreshnessHalfLife: time.Hour})
+	assert.Equal(t, []float64{0, 0, 0, 0, 0}, cache.GetScores(result))
+	w.Config.Recommend.Offline.EnableClickThroughPrediction = true
+	result = w.rankByBlendedScores(&data.User{UserId: "1"}, candidates, itemCache, blend.Weights{CTRWeight: 1, FreshnessHalfLife: time.Hour})
+	assert.Equal(t, []string{"5", "4", "3", "2", "1"}, cache.RemoveScores(result))
+}
+
+func TestLoadBlendWeights(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	// weights in the configuration are used by default
+	weights, err := w.loadBlendWeights()
+	assert.NoError(t, err)
+	assert.Equal(t, blend.NewWeights(w.Config.Recommend.Blend), weights)
+	// weights saved in the cache store override the configuration
+	expected := blend.Weights{CFWeight: 0.5, CTRWeight: 2, FreshnessWeight: 1, FreshnessHalfLife: time.Hour}
+	buf, err := json.Marshal(expected)
+	assert.NoError(t, err)
+	err = w.CacheClient.Set(cache.String(cache.BlendWeights, string(buf)))
+	assert.NoError(t, err)
+	weights, err = w.loadBlendWeights()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, weights)
+}
+
 func TestReplacement_ClickThroughRate(t *testing.T) {
 	// create mock worker
 	w := newMockWorker(t)
@@ -918,3 +1270,518 @@ func TestReplacement_CollaborativeFiltering(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []cache.Scored{{"10", 9}, {"9", 7.4}, {"7", 7}}, recommends)
 }
+
+func newIncrementalTestModel() *ranking.BPR {
+	// user i likes items i, i+1, ..., i+4
+	dataset := ranking.NewMapIndexDataset()
+	for i := 0; i < 5; i++ {
+		for j := i; j < i+5; j++ {
+			dataset.AddFeedback(strconv.Itoa(i), strconv.Itoa(j), true)
+		}
+	}
+	trainSet, testSet := dataset.Split(0, 0)
+	m := ranking.NewBPR(model.Params{model.NFactors: 4, model.NEpochs: 5})
+	m.Fit(trainSet, testSet, ranking.NewFitConfig())
+	return m
+}
+
+func TestWorker_IncrementalUpdate(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	w.Config.Recommend.Offline.EnableColRecommend = true
+	w.Config.Recommend.Collaborative.EnableIndex = false
+	w.peers = []string{"worker"}
+	w.me = "worker"
+	m := newIncrementalTestModel()
+	w.RankingModel = m
+	userFactor := append([]float32{}, m.UserFactor[m.UserIndex.ToNumber("1")]...)
+	itemFactor := append([]float32{}, m.ItemFactor[m.ItemIndex.ToNumber("8")]...)
+	w.incrementalCheckpoint = time.Now().Add(-time.Hour)
+
+	// insert items and new feedback
+	var items []data.Item
+	for i := 0; i < 9; i++ {
+		items = append(items, data.Item{ItemId: strconv.Itoa(i)})
+	}
+	err := w.DataClient.BatchInsertItems(items)
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "0", ItemId: "8"}, Timestamp: time.Now().Add(-time.Minute)},
+	}, true, true, true)
+	assert.NoError(t, err)
+
+	err = w.incrementalUpdate()
+	assert.NoError(t, err)
+	assert.Greater(t, time.Since(w.incrementalCheckpoint), time.Duration(0))
+	assert.Less(t, time.Since(w.incrementalCheckpoint), time.Minute)
+	// factors of affected user and item are updated
+	assert.Equal(t, userFactor, m.UserFactor[m.UserIndex.ToNumber("1")])
+	assert.NotEqual(t, itemFactor, m.ItemFactor[m.ItemIndex.ToNumber("8")])
+	// recommendation of affected user is refreshed
+	recommends, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "0"), 0, -1)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, recommends)
+	recommends, err = w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, "1"), 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, recommends)
+}
+
+func TestWorker_IncrementalUpdate_MaxFeedback(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	w.Config.Recommend.Collaborative.EnableIndex = false
+	w.Config.Recommend.Incremental.MaxFeedback = 2
+	w.peers = []string{"worker"}
+	w.me = "worker"
+	m := newIncrementalTestModel()
+	w.RankingModel = m
+	itemFactor := append([]float32{}, m.ItemFactor[m.ItemIndex.ToNumber("8")]...)
+	w.incrementalCheckpoint = time.Now().Add(-time.Hour)
+
+	// only the earliest two feedback are used
+	timestamp := time.Now().Add(-time.Minute).Truncate(time.Second)
+	err := w.DataClient.BatchInsertFeedback([]data.Feedback{
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "0", ItemId: "5"}, Timestamp: timestamp.Add(-2 * time.Second)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "1", ItemId: "6"}, Timestamp: timestamp.Add(-time.Second)},
+		{FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "2", ItemId: "8"}, Timestamp: timestamp},
+	}, true, true, true)
+	assert.NoError(t, err)
+	err = w.incrementalUpdate()
+	assert.NoError(t, err)
+	assert.Equal(t, timestamp.Add(-time.Second+time.Nanosecond).Unix(), w.incrementalCheckpoint.Unix())
+	assert.Equal(t, itemFactor, m.ItemFactor[m.ItemIndex.ToNumber("8")])
+
+	// skipped feedback is used by the next update
+	err = w.incrementalUpdate()
+	assert.NoError(t, err)
+	assert.NotEqual(t, itemFactor, m.ItemFactor[m.ItemIndex.ToNumber("8")])
+}
+
+func TestWorker_IncrementalUpdate_VocabularyGrowth(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.Config.Recommend.DataSource.PositiveFeedbackTypes = []string{"like"}
+	w.peers = []string{"worker"}
+	w.me = "worker"
+	m := newIncrementalTestModel()
+	w.RankingModel = m
+	userFactor := append([]float32{}, m.UserFactor[m.UserIndex.ToNumber("0")]...)
+	w.incrementalCheckpoint = time.Now().Add(-time.Hour)
+
+	// feedback from new users
+	var feedback []data.Feedback
+	for i := 0; i < 10; i++ {
+		feedback = append(feedback, data.Feedback{
+			FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "new" + strconv.Itoa(i), ItemId: "0"},
+			Timestamp:   time.Now().Add(-time.Minute),
+		})
+	}
+	feedback = append(feedback, data.Feedback{
+		FeedbackKey: data.FeedbackKey{FeedbackType: "like", UserId: "0", ItemId: "8"},
+		Timestamp:   time.Now().Add(-time.Minute),
+	})
+	err := w.DataClient.BatchInsertFeedback(feedback, true, true, true)
+	assert.NoError(t, err)
+
+	err = w.incrementalUpdate()
+	assert.NoError(t, err)
+	// full training is requested and the model is unchanged
+	dataImported, err := w.CacheClient.Get(cache.Key(cache.GlobalMeta, cache.DataImported)).Integer()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dataImported)
+	assert.Equal(t, userFactor, m.UserFactor[m.UserIndex.ToNumber("0")])
+}
+
+func TestWorker_Shutdown(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.workerName = "worker"
+	w.Config.Recommend.Offline.EnableColRecommend = false
+	w.Config.Recommend.Offline.EnablePopularRecommend = true
+	err := w.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	w.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+
+	// users are skipped once shutting down
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.stopped = make(chan struct{})
+	close(w.stopped)
+	w.oneMode = true
+	w.Shutdown()
+	w.Recommend([]data.User{{UserId: "0"}, {UserId: "1"}})
+	for _, userId := range []string{"0", "1"} {
+		recommends, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, userId), 0, -1)
+		assert.NoError(t, err)
+		assert.Empty(t, recommends)
+		_, err = w.CacheClient.Get(cache.Key(cache.LastUpdateUserRecommendTime, userId)).Time()
+		assert.True(t, errors.Is(err, errors.NotFound))
+	}
+
+	// clean checkpoint is marked
+	checkpoint, err := w.CacheClient.Get(cache.Key(cache.WorkerCheckpoint, "worker")).Time()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), checkpoint, time.Minute)
+}
+
+func TestWorker_ShutdownBySignal(t *testing.T) {
+	// create mock worker
+	w := newMockWorker(t)
+	defer w.Close(t)
+	counter := &countingCache{Database: w.CacheClient, writes: make(map[string]int)}
+	w.CacheClient = counter
+	w.workerName = "worker"
+	w.oneMode = true
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.stopped = make(chan struct{})
+	w.Config.Recommend.Offline.EnableColRecommend = true
+	w.RankingModel = newMockMatrixFactorizationForRecommend(100, 10)
+	var items []data.Item
+	for i := 0; i < 10; i++ {
+		items = append(items, data.Item{ItemId: strconv.Itoa(i), Categories: []string{"*"}})
+	}
+	err := w.DataClient.BatchInsertItems(items)
+	assert.NoError(t, err)
+	var users []data.User
+	for i := 0; i < 100; i++ {
+		users = append(users, data.User{UserId: strconv.Itoa(i)})
+	}
+
+	// SIGTERM is sent in the middle of recommendation
+	signals := base.NotifyShutdown()
+	numUsers := 0
+	counter.onWrite = func(key string) {
+		if strings.HasPrefix(key, cache.LastUpdateUserRecommendTime+"/") {
+			if numUsers++; numUsers == 10 {
+				assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+			}
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		<-signals
+		w.Shutdown()
+		close(done)
+	}()
+	w.Recommend(users)
+	close(w.stopped)
+	<-done
+
+	// users are either recommended completely or left untouched
+	numRecommended := 0
+	for _, user := range users {
+		documents, err := w.CacheClient.ReadDocuments(
+			cache.ReadSorted(cache.Key(cache.OfflineRecommend, user.UserId), 0, -1),
+			cache.ReadSorted(cache.Key(cache.OfflineRecommend, user.UserId, "*"), 0, -1),
+			cache.ReadValue(cache.Key(cache.LastUpdateUserRecommendTime, user.UserId)),
+			cache.ReadValue(cache.Key(cache.OfflineRecommendDigest, user.UserId)))
+		assert.NoError(t, err)
+		_, err = documents[2].Value.Time()
+		recommended := err == nil
+		assert.Equal(t, recommended, len(documents[0].Scores) > 0, user.UserId)
+		assert.Equal(t, recommended, len(documents[1].Scores) > 0, user.UserId)
+		_, err = documents[3].Value.String()
+		assert.Equal(t, recommended, err == nil, user.UserId)
+		if recommended {
+			numRecommended++
+		}
+	}
+	assert.GreaterOrEqual(t, numRecommended, 10)
+	assert.Less(t, numRecommended, len(users))
+
+	// clean checkpoint is marked
+	checkpoint, err := w.CacheClient.Get(cache.Key(cache.WorkerCheckpoint, "worker")).Time()
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), checkpoint, time.Minute)
+}
+
+func TestWorker_SyncShadowPrefix(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.shadowCache = cache.NewShadow(w.CacheClient, "")
+	dryRunWorker := &Worker{Settings: w.Settings, dryRun: true, shadowCache: cache.NewShadow(w.CacheClient, "")}
+
+	// shadow recommendation is written under the shadow prefix
+	assert.NoError(t, w.syncShadowPrefix())
+	assert.NoError(t, dryRunWorker.syncShadowPrefix())
+	assert.Empty(t, w.shadowCache.Prefix())
+	assert.Equal(t, "shadow_", dryRunWorker.shadowCache.Prefix())
+
+	// production and shadow take turns once promoted
+	_, err := cache.PromoteShadow(w.CacheClient, w.Config.Recommend.Offline.ShadowPrefix)
+	assert.NoError(t, err)
+	assert.NoError(t, w.syncShadowPrefix())
+	assert.NoError(t, dryRunWorker.syncShadowPrefix())
+	assert.Equal(t, "shadow_", w.shadowCache.Prefix())
+	assert.Empty(t, dryRunWorker.shadowCache.Prefix())
+}
+
+// countingCache counts writes to sorted sets.
+type countingCache struct {
+	cache.Database
+	mutex   sync.Mutex
+	writes  map[string]int
+	onWrite func(key string)
+}
+
+func (c *countingCache) SetSorted(key string, scores []cache.Scored) error {
+	c.mutex.Lock()
+	c.writes[key]++
+	c.mutex.Unlock()
+	if c.onWrite != nil {
+		c.onWrite(key)
+	}
+	return c.Database.SetSorted(key, scores)
+}
+
+func (c *countingCache) WriteDocuments(writes ...cache.Write) error {
+	for _, write := range writes {
+		c.mutex.Lock()
+		c.writes[write.Name()]++
+		c.mutex.Unlock()
+		if c.onWrite != nil {
+			c.onWrite(write.Name())
+		}
+	}
+	return c.Database.WriteDocuments(writes...)
+}
+
+func TestWorker_Sharding(t *testing.T) {
+	// create two workers sharing databases
+	w1 := newMockWorker(t)
+	defer w1.Close(t)
+	counter := &countingCache{Database: w1.CacheClient, writes: make(map[string]int)}
+	w1.CacheClient = counter
+	w1.workerName = "worker_1"
+	w1.Config.Recommend.Offline.EnableColRecommend = false
+	w1.Config.Recommend.Offline.EnablePopularRecommend = true
+	w1.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+	w2 := &Worker{Settings: w1.Settings, jobs: 1, workerName: "worker_2"}
+	err := w1.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w1.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	var users []data.User
+	for i := 0; i < 100; i++ {
+		userId := strconv.Itoa(i)
+		users = append(users, data.User{UserId: userId})
+		err = w1.CacheClient.Set(cache.Time(cache.Key(cache.LastModifyUserTime, userId), time.Now().Add(-time.Hour)))
+		assert.NoError(t, err)
+	}
+	err = w1.DataClient.BatchInsertUsers(users)
+	assert.NoError(t, err)
+	assertWrittenOnce := func() {
+		for _, user := range users {
+			assert.Equal(t, 1, counter.writes[cache.Key(cache.OfflineRecommend, user.UserId)], user.UserId)
+		}
+		counter.writes = make(map[string]int)
+	}
+
+	// users are partitioned by consistent hashing
+	peers := []string{"worker_1", "worker_2"}
+	users1, err := w1.pullUsers(peers, "worker_1")
+	assert.NoError(t, err)
+	users2, err := w2.pullUsers(peers, "worker_2")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, users1)
+	assert.NotEmpty(t, users2)
+	assert.Equal(t, len(users), len(users1)+len(users2))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w1.Recommend(users1)
+	}()
+	go func() {
+		defer wg.Done()
+		w2.Recommend(users2)
+	}()
+	wg.Wait()
+	assertWrittenOnce()
+
+	// the shard of a crashed worker is retried by another
+	for _, user := range users {
+		err = w1.CacheClient.Delete(cache.Key(cache.OfflineRecommendDigest, user.UserId))
+		assert.NoError(t, err)
+	}
+	w1.Recommend(users1)
+	users1, err = w1.pullUsers([]string{"worker_1"}, "worker_1")
+	assert.NoError(t, err)
+	assert.Len(t, users1, len(users))
+	w1.Recommend(users1)
+	assertWrittenOnce()
+}
+
+func TestWorker_Checkpoint(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	counter := &countingCache{Database: w.CacheClient, writes: make(map[string]int)}
+	w.CacheClient = counter
+	w.workerName = "worker"
+	w.checkpointBatch = 10
+	w.Config.Recommend.Offline.EnableColRecommend = false
+	w.Config.Recommend.Offline.EnablePopularRecommend = true
+	w.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+	err := w.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	var users []data.User
+	for i := 0; i < 100; i++ {
+		users = append(users, data.User{UserId: fmt.Sprintf("%03d", i)})
+	}
+	countWrites := func() (total int) {
+		for _, user := range users {
+			total += counter.writes[cache.Key(cache.OfflineRecommend, user.UserId)]
+		}
+		return
+	}
+	killAfter := func(n int) {
+		numWrites := 0
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+		counter.onWrite = func(key string) {
+			if strings.HasPrefix(key, cache.OfflineRecommend+"/") {
+				if numWrites++; numWrites == n {
+					w.cancel()
+				}
+			}
+		}
+	}
+	restart := func() {
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+		counter.onWrite = nil
+	}
+
+	// kill the worker in the middle of the third batch
+	killAfter(25)
+	w.Recommend(users)
+	assert.Equal(t, 25, countWrites())
+	buf, err := w.CacheClient.Get(cache.Key(cache.OfflineRecommendCheckpoint, "worker")).String()
+	assert.NoError(t, err)
+	var checkpoint Checkpoint
+	assert.NoError(t, json.Unmarshal([]byte(buf), &checkpoint))
+	assert.Equal(t, "019", checkpoint.LastUserId)
+
+	// resume from the checkpoint, no user is skipped and at most one batch is redone
+	restart()
+	w.Recommend(users)
+	for _, user := range users {
+		assert.GreaterOrEqual(t, counter.writes[cache.Key(cache.OfflineRecommend, user.UserId)], 1, user.UserId)
+	}
+	assert.LessOrEqual(t, countWrites(), len(users)+w.checkpointBatch)
+	_, err = w.CacheClient.Get(cache.Key(cache.OfflineRecommendCheckpoint, "worker")).String()
+	assert.True(t, errors.Is(err, errors.NotFound))
+
+	// resume from the position of the last user if users of the shard changed
+	counter.writes = make(map[string]int)
+	killAfter(25)
+	w.Recommend(users)
+	restart()
+	w.Recommend(append([]data.User{{UserId: "050"}, {UserId: "100"}}, users[:50]...))
+	for _, user := range users[20:50] {
+		assert.GreaterOrEqual(t, counter.writes[cache.Key(cache.OfflineRecommend, user.UserId)], 1, user.UserId)
+	}
+	assert.Equal(t, 1, counter.writes[cache.Key(cache.OfflineRecommend, "100")])
+	assert.Equal(t, 25+31, countWrites())
+
+	// restart from the beginning if the model changed
+	counter.writes = make(map[string]int)
+	killAfter(15)
+	w.Recommend(users)
+	restart()
+	w.RankingModelVersion++
+	w.Recommend(users)
+	assert.Equal(t, 15+len(users), countWrites())
+}
+
+func TestWorker_RefreshPriorityUsers(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	w.peers = []string{"worker"}
+	w.me = "worker"
+	w.Config.Recommend.Offline.MaxPriorityRefreshPerMinute = 2
+	w.Config.Recommend.Offline.EnableColRecommend = false
+	w.Config.Recommend.Offline.EnablePopularRecommend = true
+	w.RankingModel = newMockMatrixFactorizationForRecommend(1, 10)
+	err := w.CacheClient.SetSorted(cache.PopularItems, []cache.Scored{{"10", 10}, {"9", 9}, {"8", 8}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertItems([]data.Item{{ItemId: "10"}, {ItemId: "9"}, {ItemId: "8"}})
+	assert.NoError(t, err)
+	err = w.DataClient.BatchInsertUsers([]data.User{{UserId: "1"}, {UserId: "2"}, {UserId: "3"}})
+	assert.NoError(t, err)
+	err = w.CacheClient.AddSorted(cache.Sorted(cache.PriorityRefreshUsers, []cache.Scored{{"1", 1}, {"2", 2}, {"3", 3}}))
+	assert.NoError(t, err)
+	assertRefreshed := func(userId string, refreshed bool) {
+		recommends, err := w.CacheClient.GetSorted(cache.Key(cache.OfflineRecommend, userId), 0, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, refreshed, len(recommends) > 0, userId)
+	}
+
+	// users are kept in the queue if refreshing fails
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.cancel()
+	w.refreshPriorityUsers()
+	assertRefreshed("1", false)
+	queue, err := w.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, cache.RemoveScores(queue))
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.priorityWindowStart = time.Time{}
+
+	// the oldest users are refreshed
+	w.refreshPriorityUsers()
+	assertRefreshed("1", true)
+	assertRefreshed("2", true)
+	assertRefreshed("3", false)
+	queue, err = w.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3"}, cache.RemoveScores(queue))
+
+	// refresh is limited per minute
+	w.refreshPriorityUsers()
+	assertRefreshed("3", false)
+	w.priorityWindowStart = time.Now().Add(-time.Minute)
+	w.refreshPriorityUsers()
+	assertRefreshed("3", true)
+	queue, err = w.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, queue)
+
+	// users pushed again during refreshing are kept
+	err = w.CacheClient.AddSorted(cache.Sorted(cache.PriorityRefreshUsers, []cache.Scored{{"1", 5}, {"2", 5}}))
+	assert.NoError(t, err)
+	err = w.popPriorityUsers([]cache.Scored{{"1", 4}, {"2", 5}})
+	assert.NoError(t, err)
+	queue, err = w.CacheClient.GetSorted(cache.PriorityRefreshUsers, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1"}, cache.RemoveScores(queue))
+}
+
+func TestWorker_WaitSnapshot(t *testing.T) {
+	w := newMockWorker(t)
+	defer w.Close(t)
+	snapshotPollInterval = 10 * time.Millisecond
+	defer func() {
+		snapshotPollInterval = time.Second
+	}()
+	recommendTask := task.NewTask("offline recommend", 1)
+
+	// wait until the pause ends
+	err := w.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil), time.Now().Add(100*time.Millisecond)))
+	assert.NoError(t, err)
+	startTime := time.Now()
+	w.waitSnapshot(recommendTask)
+	assert.GreaterOrEqual(t, time.Since(startTime), 50*time.Millisecond)
+	assert.Equal(t, task.StatusRunning, recommendTask.Status)
+
+	// expired pauses are ignored
+	err = w.CacheClient.Set(cache.Time(cache.Key(cache.GlobalMeta, cache.SnapshotPauseUntil), time.Now().Add(-time.Minute)))
+	assert.NoError(t, err)
+	startTime = time.Now()
+	w.waitSnapshot(recommendTask)
+	assert.Less(t, time.Since(startTime), 50*time.Millisecond)
+}